@@ -54,6 +54,8 @@ type AppManifest struct {
 		Permissions      *permissions.Set `json:"permissions"`
 		AvailableVersion string           `json:"available_version,omitempty"`
 
+		PermissionsUpdate *json.RawMessage `json:"permissions_update,omitempty"`
+
 		Parameters json.RawMessage `json:"parameters,omitempty"`
 
 		Intents []struct {
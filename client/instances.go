@@ -31,6 +31,10 @@ type Instance struct {
 		AuthMode             int       `json:"auth_mode,omitempty"`
 		NoAutoUpdate         bool      `json:"no_auto_update,omitempty"`
 		Blocked              bool      `json:"blocked,omitempty"`
+		BlockingReason       string    `json:"blocking_reason,omitempty"`
+		Maintenance          bool      `json:"maintenance,omitempty"`
+		MaintenanceApps      []string  `json:"maintenance_apps,omitempty"`
+		DeleteAt             time.Time `json:"delete_at,omitempty"`
 		Dev                  bool      `json:"dev"`
 		OnboardingFinished   bool      `json:"onboarding_finished"`
 		BytesDiskQuota       int64     `json:"disk_quota,string,omitempty"`
@@ -60,7 +64,10 @@ type InstanceOptions struct {
 	Apps               []string
 	Passphrase         string
 	Debug              *bool
+	DebugTTL           time.Duration
 	Blocked            *bool
+	BlockingReason     string
+	Maintenance        *bool
 	OnboardingFinished *bool
 	Dev                bool
 }
@@ -95,6 +102,7 @@ type UpdatesOptions struct {
 	Slugs              []string
 	ForceRegistry      bool
 	OnlyRegistry       bool
+	PermissionsAcked   bool
 	Logs               chan *JobLog
 }
 
@@ -201,9 +209,18 @@ func (c *Client) ModifyInstance(opts *InstanceOptions) (*Instance, error) {
 	if opts.Debug != nil {
 		q.Add("Debug", strconv.FormatBool(*opts.Debug))
 	}
+	if opts.DebugTTL > 0 {
+		q.Add("DebugTTL", opts.DebugTTL.String())
+	}
 	if opts.Blocked != nil {
 		q.Add("Blocked", strconv.FormatBool(*opts.Blocked))
 	}
+	if opts.BlockingReason != "" {
+		q.Add("BlockingReason", opts.BlockingReason)
+	}
+	if opts.Maintenance != nil {
+		q.Add("Maintenance", strconv.FormatBool(*opts.Maintenance))
+	}
 	if opts.OnboardingFinished != nil {
 		q.Add("OnboardingFinished", strconv.FormatBool(*opts.OnboardingFinished))
 	}
@@ -218,6 +235,65 @@ func (c *Client) ModifyInstance(opts *InstanceOptions) (*Instance, error) {
 	return readInstance(res)
 }
 
+// SetAppMaintenance is used to put an application of an instance in
+// maintenance, or to take it out of maintenance.
+func (c *Client) SetAppMaintenance(domain, slug string, maintenance bool) (*Instance, error) {
+	if !validDomain(domain) {
+		return nil, fmt.Errorf("Invalid domain: %s", domain)
+	}
+	method := "PUT"
+	if !maintenance {
+		method = "DELETE"
+	}
+	res, err := c.Req(&request.Options{
+		Method: method,
+		Path:   "/instances/" + domain + "/maintenance/" + url.PathEscape(slug),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readInstance(res)
+}
+
+// CloneInstance is used to copy an instance to a new domain.
+func (c *Client) CloneInstance(domain, newDomain string) (*Instance, error) {
+	if !validDomain(domain) {
+		return nil, fmt.Errorf("Invalid domain: %s", domain)
+	}
+	if !validDomain(newDomain) {
+		return nil, fmt.Errorf("Invalid domain: %s", newDomain)
+	}
+	res, err := c.Req(&request.Options{
+		Method:  "POST",
+		Path:    "/instances/" + domain + "/clone",
+		Queries: url.Values{"Domain": {newDomain}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readInstance(res)
+}
+
+// ScheduleInstanceDeletion is used to schedule the deletion of an instance at
+// the end of the grace period, or to cancel its scheduled deletion.
+func (c *Client) ScheduleInstanceDeletion(domain string, schedule bool) (*Instance, error) {
+	if !validDomain(domain) {
+		return nil, fmt.Errorf("Invalid domain: %s", domain)
+	}
+	method := "POST"
+	if !schedule {
+		method = "DELETE"
+	}
+	res, err := c.Req(&request.Options{
+		Method: method,
+		Path:   "/instances/" + domain + "/deletion",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readInstance(res)
+}
+
 // DestroyInstance is used to delete an instance and all its data.
 func (c *Client) DestroyInstance(domain string) error {
 	if !validDomain(domain) {
@@ -297,6 +373,7 @@ func (c *Client) Updates(opts *UpdatesOptions) error {
 		"Slugs":              {strings.Join(opts.Slugs, ",")},
 		"ForceRegistry":      {strconv.FormatBool(opts.ForceRegistry)},
 		"OnlyRegistry":       {strconv.FormatBool(opts.OnlyRegistry)},
+		"PermissionsAcked":   {strconv.FormatBool(opts.PermissionsAcked)},
 	}
 	channel, err := c.RealtimeClient(RealtimeOptions{
 		DocTypes: []string{"io.cozy.jobs", "io.cozy.jobs.logs"},
@@ -2,6 +2,7 @@ package tlsclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
@@ -22,6 +23,7 @@ import (
 type HTTPEndpoint struct {
 	Host      string
 	Port      int
+	Socket    string
 	Timeout   time.Duration
 	EnvPrefix string
 
@@ -30,6 +32,7 @@ type HTTPEndpoint struct {
 	PinnedKey              string
 	InsecureSkipValidation bool
 	MaxIdleConnsPerHost    int
+	IdleConnTimeout        time.Duration
 	DisableCompression     bool
 }
 
@@ -60,7 +63,11 @@ func generateURL(host string, port int) (*url.URL, error) {
 }
 
 func NewHTTPClient(opt HTTPEndpoint) (client *http.Client, u *url.URL, err error) {
-	if opt.Host != "" || opt.Port > 0 {
+	if opt.Socket != "" {
+		// The host is not used to connect to a unix socket, but it is still
+		// needed for the URL of the requests.
+		u = &url.URL{Scheme: "http", Host: "localhost"}
+	} else if opt.Host != "" || opt.Port > 0 {
 		u, err = generateURL(opt.Host, opt.Port)
 		if err != nil {
 			return
@@ -104,9 +111,19 @@ func NewHTTPClient(opt HTTPEndpoint) (client *http.Client, u *url.URL, err error
 	if opt.MaxIdleConnsPerHost > 0 {
 		tr.MaxIdleConnsPerHost = opt.MaxIdleConnsPerHost
 	}
+	if opt.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = opt.IdleConnTimeout
+	}
 	if opt.DisableCompression {
 		tr.DisableCompression = true
 	}
+	if opt.Socket != "" {
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		socket := opt.Socket
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
 	client = &http.Client{
 		Timeout:   opt.Timeout,
 		Transport: &tr,
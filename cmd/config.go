@@ -392,6 +392,29 @@ var listAssetCmd = &cobra.Command{
 	},
 }
 
+var reloadConfigCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the configuration file",
+	Long: `
+cozy-stack config reload asks the stack to read again its configuration file,
+and to apply the changes of the contexts, registries, mail settings and log
+level, without a restart. The other changes need a restart.
+
+When several stacks are running, only the one that receives the request is
+reloaded. The SIGHUP signal can also be used to reload the configuration.
+`,
+	Example: "$ cozy-stack config reload",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		_, err := c.Req(&request.Options{
+			Method:     "POST",
+			Path:       "config/reload",
+			NoResponse: true,
+		})
+		return err
+	},
+}
+
 func init() {
 	configCmdGroup.AddCommand(configPrintCmd)
 	configCmdGroup.AddCommand(adminPasswdCmd)
@@ -402,6 +425,7 @@ func init() {
 	configCmdGroup.AddCommand(decryptCredentialsCmd)
 	configCmdGroup.AddCommand(insertAssetCmd)
 	configCmdGroup.AddCommand(listAssetCmd)
+	configCmdGroup.AddCommand(reloadConfigCmd)
 	RootCmd.AddCommand(configCmdGroup)
 	insertAssetCmd.Flags().StringVar(&flagURL, "url", "", "The URL of the asset")
 	insertAssetCmd.Flags().StringVar(&flagName, "name", "", "The name of the asset")
@@ -20,6 +20,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/logger"
 	humanize "github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 )
@@ -35,6 +36,11 @@ var flagSettings string
 var flagDiskQuota string
 var flagApps []string
 var flagBlocked bool
+var flagBlockingReason string
+var flagMaintenance bool
+var flagOff bool
+var flagShowMigration bool
+var flagTTL time.Duration
 var flagDev bool
 var flagPassphrase string
 var flagForce bool
@@ -43,6 +49,7 @@ var flagDirectory string
 var flagIncreaseQuota bool
 var flagForceRegistry bool
 var flagOnlyRegistry bool
+var flagPermissionsAcked bool
 var flagSwiftCluster int
 var flagUUID string
 var flagTOSSigned string
@@ -53,6 +60,7 @@ var flagOnboardingFinished bool
 var flagExpire time.Duration
 var flagAllowLoginScope bool
 var flagFsckIndexIntegrity bool
+var flagFsckRepair bool
 var flagAvailableFields bool
 var flagOnboardingSecret string
 var flagOnboardingApp string
@@ -254,6 +262,10 @@ settings for a specified domain.
 		if flag := cmd.Flag("blocked"); flag.Changed {
 			opts.Blocked = &flagBlocked
 		}
+		opts.BlockingReason = flagBlockingReason
+		if flag := cmd.Flag("maintenance"); flag.Changed {
+			opts.Maintenance = &flagMaintenance
+		}
 		if flagOnboardingFinished {
 			opts.OnboardingFinished = &flagOnboardingFinished
 		}
@@ -307,9 +319,10 @@ var debugInstanceCmd = &cobra.Command{
 	Short: "Activate or deactivate debugging of the instance",
 	Long: `
 cozy-stack instances debug allows to activate or deactivate the debugging of a
-specific domain.
+specific domain. The debug mode is automatically deactivated after the duration
+given by the --ttl flag.
 `,
-	Example: "$ cozy-stack instances debug cozy.tools:8080 true",
+	Example: "$ cozy-stack instances debug cozy.tools:8080 true --ttl 1h",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) != 2 {
 			return cmd.Usage()
@@ -321,8 +334,9 @@ specific domain.
 		}
 		c := newAdminClient()
 		_, err = c.ModifyInstance(&client.InstanceOptions{
-			Domain: domain,
-			Debug:  &debug,
+			Domain:   domain,
+			Debug:    &debug,
+			DebugTTL: flagTTL,
 		})
 		return err
 	},
@@ -542,6 +556,12 @@ var fsckInstanceCmd = &cobra.Command{
 The cozy-stack fsck command checks that the files in the VFS are not
 desynchronized, ie a file present in CouchDB but not swift/localfs, or present
 in swift/localfs but not couchdb.
+
+By default, the inconsistencies are only reported. With the --repair flag, the
+index is fixed to match the content of the storage: the files without content
+are removed from the index, the size and checksum of the files are updated, and
+the orphan files and not indexed contents are moved to the /.cozy_orphans
+directory, and the directories get the path of their position in the tree.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
@@ -556,6 +576,7 @@ in swift/localfs but not couchdb.
 			Path:   "/instances/" + url.PathEscape(domain) + "/fsck",
 			Queries: url.Values{
 				"IndexIntegrity": {strconv.FormatBool(flagFsckIndexIntegrity)},
+				"Repair":         {strconv.FormatBool(flagFsckRepair)},
 			},
 		})
 		if err != nil {
@@ -773,10 +794,11 @@ updated.`,
 				}
 			}()
 			return c.Updates(&client.UpdatesOptions{
-				Slugs:         args,
-				ForceRegistry: flagForceRegistry,
-				OnlyRegistry:  flagOnlyRegistry,
-				Logs:          logs,
+				Slugs:            args,
+				ForceRegistry:    flagForceRegistry,
+				OnlyRegistry:     flagOnlyRegistry,
+				PermissionsAcked: flagPermissionsAcked,
+				Logs:             logs,
 			})
 		}
 		if flagDomain == "" {
@@ -788,6 +810,7 @@ updated.`,
 			Slugs:              args,
 			ForceRegistry:      flagForceRegistry,
 			OnlyRegistry:       flagOnlyRegistry,
+			PermissionsAcked:   flagPermissionsAcked,
 		})
 	},
 }
@@ -853,6 +876,354 @@ var showSwiftPrefixInstanceCmd = &cobra.Command{
 	},
 }
 
+var showIndexesInstanceCmd = &cobra.Command{
+	Use:     "show-indexes <domain>",
+	Short:   "Show the status of the CouchDB views and indexes of the specified domain",
+	Example: "$ cozy-stack instances show-indexes cozy.tools:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var v map[string]interface{}
+
+		c := newAdminClient()
+		if len(args) < 1 {
+			return errors.New("The domain is missing")
+		}
+
+		req := &request.Options{
+			Method: "GET",
+			Path:   "instances/" + args[0] + "/indexes",
+		}
+		res, err := c.Req(req)
+		if err != nil {
+			return err
+		}
+		errd := json.NewDecoder(res.Body).Decode(&v)
+		if errd != nil {
+			return errd
+		}
+		json, errj := json.MarshalIndent(v, "", "  ")
+		if errj != nil {
+			return errj
+		}
+		fmt.Println(string(json))
+
+		return nil
+	},
+}
+
+var migrateDoctypeCmd = &cobra.Command{
+	Use:   "migrate-doctype [domain] [doctype]",
+	Short: "Apply the migrations of the schema of a doctype to all its documents",
+	Long: `
+cozy-stack instances migrate-doctype pushes a job that applies the pending
+migrations of the schema of a doctype to all its documents. Without this
+command, the documents are migrated when they are read one by one. Use the
+--all-domains flag to do it for all the instances, and the --show flag to see
+the version of the schema and the progress of the migration.
+`,
+	Example: "$ cozy-stack instances migrate-doctype cozy.tools:8080 io.cozy.contacts",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		var domains []string
+		if flagAllDomains {
+			if len(args) < 1 {
+				return errors.New("The doctype is missing")
+			}
+			list, err := c.ListInstances()
+			if err != nil {
+				return err
+			}
+			for _, i := range list {
+				domains = append(domains, i.Attrs.Domain)
+			}
+		} else {
+			if len(args) < 2 {
+				return errors.New("The domain or the doctype is missing")
+			}
+			domains = args[:1]
+			args = args[1:]
+		}
+		doctype := args[0]
+
+		for _, domain := range domains {
+			if flagShowMigration {
+				res, err := c.Req(&request.Options{
+					Method: "GET",
+					Path:   "instances/" + domain + "/doctypes/" + doctype,
+				})
+				if err != nil {
+					return fmt.Errorf("%s: %s", domain, err)
+				}
+				var v map[string]interface{}
+				err = json.NewDecoder(res.Body).Decode(&v)
+				res.Body.Close()
+				if err != nil {
+					return err
+				}
+				out, err := json.MarshalIndent(v, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s: %s\n", domain, out)
+				continue
+			}
+			res, err := c.Req(&request.Options{
+				Method: "POST",
+				Path:   "instances/" + domain + "/doctypes/" + doctype + "/migrate",
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %s", domain, err)
+			}
+			res.Body.Close()
+			fmt.Printf("%s: the documents of %s will be migrated\n", domain, doctype)
+		}
+		return nil
+	},
+}
+
+var reencryptAccountsCmd = &cobra.Command{
+	Use:   "reencrypt-accounts [domain]",
+	Short: "Encrypt again the credentials of the accounts after a rotation of the master secret",
+	Long: `
+cozy-stack instances reencrypt-accounts decrypts the credentials of the accounts
+of an instance (with the current or the previous master secret of the keyring)
+and encrypts them again with the current master secret. The secrets of the
+instance are also encrypted again, if an instance secrets master key is in the
+keyring. Use the --all-domains flag to do it for all the instances.
+
+When it has been done for all the instances, the previous master secret can be
+removed from the keyring.
+`,
+	Example: "$ cozy-stack instances reencrypt-accounts cozy.tools:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		var domains []string
+		if flagAllDomains {
+			list, err := c.ListInstances()
+			if err != nil {
+				return err
+			}
+			for _, i := range list {
+				domains = append(domains, i.Attrs.Domain)
+			}
+		} else {
+			if len(args) < 1 {
+				return errors.New("The domain is missing")
+			}
+			domains = args[:1]
+		}
+
+		for _, domain := range domains {
+			var v struct {
+				Accounts int `json:"accounts"`
+			}
+			res, err := c.Req(&request.Options{
+				Method: "POST",
+				Path:   "instances/" + domain + "/reencrypt_accounts",
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %s", domain, err)
+			}
+			err = json.NewDecoder(res.Body).Decode(&v)
+			res.Body.Close()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: %d accounts re-encrypted\n", domain, v.Accounts)
+		}
+		return nil
+	},
+}
+
+var rekeyFilesCmd = &cobra.Command{
+	Use:   "rekey-files [domain]",
+	Short: "Encrypt again the files of an instance with a new data key",
+	Long: `
+cozy-stack instances rekey-files pushes a job that generates a new data key for
+an instance, and encrypts again its files with this key. Use the --all-domains
+flag to do it for all the instances.
+
+It is used for the rotation of the data keys, and after a rotation of the files
+master key: when it has been done for all the instances, the previous master
+key can be removed from the keyring. It can also be used to encrypt the files
+of the instances created before the encryption has been enabled.
+`,
+	Example: "$ cozy-stack instances rekey-files cozy.tools:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		var domains []string
+		if flagAllDomains {
+			list, err := c.ListInstances()
+			if err != nil {
+				return err
+			}
+			for _, i := range list {
+				domains = append(domains, i.Attrs.Domain)
+			}
+		} else {
+			if len(args) < 1 {
+				return errors.New("The domain is missing")
+			}
+			domains = args[:1]
+		}
+
+		for _, domain := range domains {
+			res, err := c.Req(&request.Options{
+				Method: "POST",
+				Path:   "instances/" + domain + "/rekey_files",
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %s", domain, err)
+			}
+			res.Body.Close()
+			fmt.Printf("%s: the files will be encrypted with a new key\n", domain)
+		}
+		return nil
+	},
+}
+
+var rotateJWTKeysCmd = &cobra.Command{
+	Use:   "rotate-jwt-keys [domain]",
+	Short: "Generate new keys for signing the tokens of an instance",
+	Long: `
+cozy-stack instances rotate-jwt-keys generates new keys for signing the tokens
+of an instance. The keys are also rotated automatically, every 30 days by
+default. Use the --all-domains flag to do it for all the instances.
+
+The tokens signed with the previous keys are still accepted until they expire.
+After a leak, the --force flag can be used to invalidate them immediately: it
+also invalidates the refresh tokens of the OAuth clients and the links of the
+sharings by link.
+`,
+	Example: "$ cozy-stack instances rotate-jwt-keys --force cozy.tools:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		var domains []string
+		if flagAllDomains {
+			list, err := c.ListInstances()
+			if err != nil {
+				return err
+			}
+			for _, i := range list {
+				domains = append(domains, i.Attrs.Domain)
+			}
+		} else {
+			if len(args) < 1 {
+				return errors.New("The domain is missing")
+			}
+			domains = args[:1]
+		}
+
+		for _, domain := range domains {
+			res, err := c.Req(&request.Options{
+				Method:  "POST",
+				Path:    "instances/" + domain + "/rotate_jwt_keys",
+				Queries: url.Values{"Force": {strconv.FormatBool(flagForce)}},
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %s", domain, err)
+			}
+			res.Body.Close()
+			fmt.Printf("%s: the tokens will be signed with new keys\n", domain)
+		}
+		return nil
+	},
+}
+
+var appMaintenanceCmd = &cobra.Command{
+	Use:   "app-maintenance [domain] [slug]",
+	Short: "Put an application of an instance in maintenance",
+	Long: `
+cozy-stack instances app-maintenance puts an application or a konnector of an
+instance in maintenance: the user can't open it, its routes respond with a 503
+status code, and its triggers are paused until the maintenance ends. Use the
+--off flag to take it out of maintenance.
+
+The whole instance can be put in maintenance with
+cozy-stack instances modify --maintenance.
+`,
+	Example: "$ cozy-stack instances app-maintenance cozy.tools:8080 banks",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Usage()
+		}
+		c := newAdminClient()
+		in, err := c.SetAppMaintenance(args[0], args[1], !flagOff)
+		if err != nil {
+			return err
+		}
+		if flagOff {
+			fmt.Printf("%s: %s is no longer in maintenance\n", in.Attrs.Domain, args[1])
+		} else {
+			fmt.Printf("%s: %s is in maintenance\n", in.Attrs.Domain, args[1])
+		}
+		return nil
+	},
+}
+
+var cloneInstanceCmd = &cobra.Command{
+	Use:   "clone [domain] [new-domain]",
+	Short: "Copy an instance to a new domain",
+	Long: `
+cozy-stack instances clone copies an instance to a new domain, to reproduce an
+issue or to test an upgrade of the applications on a staging instance.
+
+The CouchDB databases and the files are copied, but the new instance has its
+own secrets. The sessions, the OAuth clients, the sharings, the jobs and the
+triggers are not copied. The accounts of the konnectors are copied: be careful
+when running a konnector on the clone.
+
+It is only supported for the file:// and mem:// storages.
+`,
+	Example: "$ cozy-stack instances clone alice.cozy.tools alice-staging.cozy.tools",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if reason := os.Getenv("COZY_DISABLE_INSTANCES_ADD_RM"); reason != "" {
+			return fmt.Errorf("Sorry, instances add is disabled: %s", reason)
+		}
+		if len(args) != 2 {
+			return cmd.Usage()
+		}
+		c := newAdminClient()
+		in, err := c.CloneInstance(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Instance %s cloned to %s\n", args[0], in.Attrs.Domain)
+		return nil
+	},
+}
+
+var scheduleDeletionCmd = &cobra.Command{
+	Use:   "schedule-deletion <domain>",
+	Short: "Schedule the deletion of an instance",
+	Long: `
+cozy-stack instances schedule-deletion schedules the deletion of an instance at
+the end of the grace period of the configuration (deletion.grace_period). Until
+then, the instance is blocked for the user and its triggers are paused, but its
+data are kept. A mail is sent to the user when the deletion is scheduled, and a
+reminder is sent some days before the final purge (deletion.reminder).
+
+Use the --off flag to cancel the scheduled deletion. The instances destroy
+command can be used to remove an instance immediately.
+`,
+	Example: "$ cozy-stack instances schedule-deletion alice.cozy.tools",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		c := newAdminClient()
+		in, err := c.ScheduleInstanceDeletion(args[0], !flagOff)
+		if err != nil {
+			return err
+		}
+		if flagOff {
+			fmt.Printf("%s: the deletion has been canceled\n", in.Attrs.Domain)
+		} else {
+			fmt.Printf("%s: the instance will be deleted on %s\n", in.Attrs.Domain, in.Attrs.DeleteAt.Format("2006-01-02 15:04"))
+		}
+		return nil
+	},
+}
+
 var instanceAppVersionCmd = &cobra.Command{
 	Use:     "show-app-version [app-slug] [version]",
 	Short:   `Show instances that have a particular app version`,
@@ -915,7 +1286,15 @@ func init() {
 	instanceCmdGroup.AddCommand(exportCmd)
 	instanceCmdGroup.AddCommand(importCmd)
 	instanceCmdGroup.AddCommand(showSwiftPrefixInstanceCmd)
+	instanceCmdGroup.AddCommand(showIndexesInstanceCmd)
 	instanceCmdGroup.AddCommand(instanceAppVersionCmd)
+	instanceCmdGroup.AddCommand(migrateDoctypeCmd)
+	instanceCmdGroup.AddCommand(reencryptAccountsCmd)
+	instanceCmdGroup.AddCommand(rekeyFilesCmd)
+	instanceCmdGroup.AddCommand(rotateJWTKeysCmd)
+	instanceCmdGroup.AddCommand(appMaintenanceCmd)
+	instanceCmdGroup.AddCommand(cloneInstanceCmd)
+	instanceCmdGroup.AddCommand(scheduleDeletionCmd)
 	addInstanceCmd.Flags().StringSliceVar(&flagDomainAliases, "domain-aliases", nil, "Specify one or more aliases domain for the instance (separated by ',')")
 	addInstanceCmd.Flags().StringVar(&flagLocale, "locale", instance.DefaultLocale, "Locale of the new cozy instance")
 	addInstanceCmd.Flags().StringVar(&flagUUID, "uuid", "", "The UUID of the instance")
@@ -943,10 +1322,13 @@ func init() {
 	modifyInstanceCmd.Flags().IntVar(&flagSwiftCluster, "swift-cluster", 0, "New swift cluster")
 	modifyInstanceCmd.Flags().StringVar(&flagDiskQuota, "disk-quota", "", "Specify a new disk quota")
 	modifyInstanceCmd.Flags().BoolVar(&flagBlocked, "blocked", false, "Block the instance")
+	modifyInstanceCmd.Flags().StringVar(&flagBlockingReason, "blocking-reason", "", "The reason for blocking the instance (payment_overdue, abuse or user_request)")
+	modifyInstanceCmd.Flags().BoolVar(&flagMaintenance, "maintenance", false, "Put the instance in maintenance")
 	modifyInstanceCmd.Flags().BoolVar(&flagOnboardingFinished, "onboarding-finished", false, "Force the finishing of the onboarding")
 	destroyInstanceCmd.Flags().BoolVar(&flagForce, "force", false, "Force the deletion without asking for confirmation")
 	fsckInstanceCmd.Flags().BoolVar(&flagFsckIndexIntegrity, "index-indegrity", false, "Check the index integrity only")
 	fsckInstanceCmd.Flags().BoolVar(&flagJSON, "json", false, "Output more informations in JSON format")
+	fsckInstanceCmd.Flags().BoolVar(&flagFsckRepair, "repair", false, "Repair the index to match the content of the storage")
 	oauthClientInstanceCmd.Flags().BoolVar(&flagJSON, "json", false, "Output more informations in JSON format")
 	oauthClientInstanceCmd.Flags().BoolVar(&flagAllowLoginScope, "allow-login-scope", false, "Allow login scope")
 	oauthClientInstanceCmd.Flags().StringVar(&flagOnboardingSecret, "onboarding-secret", "", "Specify an OnboardingSecret")
@@ -959,10 +1341,20 @@ func init() {
 	lsInstanceCmd.Flags().StringSliceVar(&flagListFields, "fields", nil, "Arguments shown for each line in the list")
 	lsInstanceCmd.Flags().BoolVar(&flagAvailableFields, "available-fields", false, "List available fields for --fields option")
 	updateCmd.Flags().BoolVar(&flagAllDomains, "all-domains", false, "Work on all domains iterativelly")
+	reencryptAccountsCmd.Flags().BoolVar(&flagAllDomains, "all-domains", false, "Work on all domains iterativelly")
+	rekeyFilesCmd.Flags().BoolVar(&flagAllDomains, "all-domains", false, "Work on all domains iterativelly")
+	rotateJWTKeysCmd.Flags().BoolVar(&flagAllDomains, "all-domains", false, "Work on all domains iterativelly")
+	rotateJWTKeysCmd.Flags().BoolVar(&flagForce, "force", false, "Invalidate the tokens signed with the previous keys")
+	migrateDoctypeCmd.Flags().BoolVar(&flagAllDomains, "all-domains", false, "Work on all domains iterativelly")
+	migrateDoctypeCmd.Flags().BoolVar(&flagShowMigration, "show", false, "Show the version of the schema and the progress of the migration")
+	debugInstanceCmd.Flags().DurationVar(&flagTTL, "ttl", logger.DefaultDebugTTL, "Deactivate the debug mode after this duration")
+	appMaintenanceCmd.Flags().BoolVar(&flagOff, "off", false, "Take the application out of maintenance")
+	scheduleDeletionCmd.Flags().BoolVar(&flagOff, "off", false, "Cancel the scheduled deletion")
 	updateCmd.Flags().StringVar(&flagDomain, "domain", "", "Specify the domain name of the instance")
 	updateCmd.Flags().StringVar(&flagContextName, "context-name", "", "Work only on the instances with the given context name")
 	updateCmd.Flags().BoolVar(&flagForceRegistry, "force-registry", false, "Force to update all applications sources from git to the registry")
 	updateCmd.Flags().BoolVar(&flagOnlyRegistry, "only-registry", false, "Only update applications installed from the registry")
+	updateCmd.Flags().BoolVar(&flagPermissionsAcked, "permissions-acked", false, "Apply the updates that request new permissions without the approval of the user")
 	exportCmd.Flags().StringVar(&flagDomain, "domain", "", "Specify the domain name of the instance")
 	importCmd.Flags().StringVar(&flagDomain, "domain", "", "Specify the domain name of the instance")
 	importCmd.Flags().StringVar(&flagDirectory, "directory", "", "Put the imported files inside this directory")
@@ -107,6 +107,7 @@ func newAdminClient() *client.Client {
 	httpClient, adminURL, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
 		Host:      config.GetConfig().AdminHost,
 		Port:      config.GetConfig().AdminPort,
+		Socket:    config.GetConfig().AdminSocket,
 		Timeout:   10 * time.Minute,
 		EnvPrefix: "COZY_ADMIN",
 	})
@@ -143,6 +144,9 @@ func init() {
 
 	flags.Int("admin-port", 6060, "administration server port")
 	checkNoErr(viper.BindPFlag("admin.port", flags.Lookup("admin-port")))
+
+	flags.String("admin-socket", "", "administration server unix socket (used instead of the host and port)")
+	checkNoErr(viper.BindPFlag("admin.socket", flags.Lookup("admin-socket")))
 }
 
 func checkNoErr(err error) {
@@ -10,7 +10,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
-	"time"
+	"syscall"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/stack"
@@ -32,9 +32,19 @@ var serveCmd = &cobra.Command{
 It will accept HTTP requests on localhost:8080 by default.
 Use the --port and --host flags to change the listening option.
 
-The SIGINT signal will trigger a graceful stop of cozy-stack: it will wait that
-current HTTP requests and jobs are finished (in a limit of 2 minutes) before
-exiting.
+The SIGINT and SIGTERM signals will trigger a graceful stop of cozy-stack: it
+stops accepting new connections and jobs, waits that current HTTP requests
+(like the uploads) and jobs are finished (in a limit of 2 minutes by default,
+configurable with shutdown_timeout), and closes the websockets with a hint for
+the clients to reconnect, before exiting.
+
+The SIGHUP signal reloads the configuration file: the changes of the contexts,
+registries, mail settings and log level are applied without a restart.
+
+For zero-downtime restarts, the stack can use a socket passed by systemd
+(socket activation), or open its socket with SO_REUSEPORT (reuse_port in the
+configuration file), so that a new stack can be started on the same port
+before the old one is stopped.
 
 If you are the developer of a client-side app, you can use --appdir
 to mount a directory as the application with the 'app' slug.
@@ -102,20 +112,29 @@ example), you can use the --appdir flag like this:
 		group := utils.NewGroupShutdown(servers, processes)
 
 		sigs := make(chan os.Signal, 1)
-		signal.Notify(sigs, os.Interrupt)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
 
-		select {
-		case err := <-servers.Wait():
-			return err
-		case <-sigs:
-			fmt.Println("\nReceived interrupt signal:")
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-			defer cancel() // make gometalinter happy
-			if err := group.Shutdown(ctx); err != nil {
+		for {
+			select {
+			case err := <-servers.Wait():
 				return err
+			case <-reload:
+				if err := config.Reload(); err != nil {
+					errPrintfln("Could not reload the configuration: %s", err)
+				}
+			case sig := <-sigs:
+				fmt.Printf("\nReceived %s signal:\n", sig)
+				timeout := config.GetConfig().ShutdownTimeout
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel() // make gometalinter happy
+				if err := group.Shutdown(ctx); err != nil {
+					return err
+				}
+				fmt.Println("All settled, bye bye !")
+				return nil
 			}
-			fmt.Println("All settled, bye bye !")
-			return nil
 		}
 	},
 }
@@ -173,6 +192,9 @@ func init() {
 	flags.Bool("log-syslog", false, "use the local syslog for logging")
 	checkNoErr(viper.BindPFlag("log.syslog", flags.Lookup("log-syslog")))
 
+	flags.String("log-format", "text", "define the format of the logs (text or json)")
+	checkNoErr(viper.BindPFlag("log.format", flags.Lookup("log-format")))
+
 	flags.String("hooks", ".", "define the directory used for hook scripts")
 	checkNoErr(viper.BindPFlag("hooks", flags.Lookup("hooks")))
 
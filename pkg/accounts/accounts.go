@@ -6,6 +6,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -18,6 +19,7 @@ type Account struct {
 	Name        string                 `json:"name"`
 	AccountType string                 `json:"account_type"`
 	FolderPath  string                 `json:"folderPath,omitempty"`
+	FolderID    string                 `json:"folder_id,omitempty"`
 	Basic       *BasicInfo             `json:"auth,omitempty"`
 	Oauth       *OauthInfo             `json:"oauth,omitempty"`
 	Extras      map[string]interface{} `json:"oauth_callback_results,omitempty"`
@@ -74,12 +76,36 @@ func (ac *Account) Clone() couchdb.Doc {
 	return &cloned
 }
 
+// SetFolder saves on the account the folder where its konnector writes its
+// files. Only these fields are changed, to preserve the other fields of the
+// document that are not in the Account struct.
+func SetFolder(db prefixer.Prefixer, ac *Account, folderID, folderPath string) error {
+	if ac.FolderID == folderID && ac.FolderPath == folderPath {
+		return nil
+	}
+	doc := &couchdb.JSONDoc{}
+	if err := couchdb.GetDoc(db, consts.Accounts, ac.ID(), doc); err != nil {
+		return err
+	}
+	doc.Type = consts.Accounts
+	doc.M["folder_id"] = folderID
+	doc.M["folderPath"] = folderPath
+	if err := couchdb.UpdateDoc(db, doc); err != nil {
+		return err
+	}
+	ac.DocRev = doc.Rev()
+	ac.FolderID = folderID
+	ac.FolderPath = folderPath
+	return nil
+}
+
 // Match implements permissions.Matcher
 func (ac *Account) Match(field, expected string) bool {
 	return field == "account_type" && expected == ac.AccountType
 }
 
 func init() {
+	instance.AddCloneHook(consts.Accounts, reencryptClonedAccount)
 	couchdb.AddHook(consts.Accounts, couchdb.EventDelete,
 		func(db prefixer.Prefixer, doc couchdb.Doc, old couchdb.Doc) error {
 			jobsSystem := jobs.System()
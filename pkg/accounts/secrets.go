@@ -0,0 +1,360 @@
+package accounts
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// instanceCipherHeader is the header of the values encrypted with a key
+// derived for the instance from the master secret. The values starting with
+// cipherHeader are encrypted with the vault keys, and are still supported for
+// retro-compatibility.
+const instanceCipherHeader = "inst"
+
+const instanceKeyInfo = "io.cozy.accounts credentials"
+
+// encryptedFields is the list of the fields of the auth part of an account
+// that are encrypted before being saved in CouchDB. The password is a special
+// case, as it is encrypted with the login in credentials_encrypted.
+var encryptedFields = []string{
+	"secret", "dob", "code", "answer", "access_token", "refresh_token", "appSecret",
+}
+
+// instanceKey returns the key used to encrypt the credentials of the accounts
+// of the given instance. It is derived from the master secret, and nil is
+// returned if this secret has not been configured.
+func instanceKey(db prefixer.Prefixer) (*[32]byte, error) {
+	return deriveKey(config.GetVault().CredentialsMasterSecret(), db)
+}
+
+func deriveKey(secret []byte, db prefixer.Prefixer) (*[32]byte, error) {
+	if len(secret) == 0 {
+		return nil, nil
+	}
+	h := hkdf.New(sha256.New, secret, []byte(db.DBPrefix()), []byte(instanceKeyInfo))
+	var key [32]byte
+	if _, err := io.ReadFull(h, key[:]); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func sealForInstance(key *[32]byte, plain []byte) string {
+	var nonce [nonceLen]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		panic(err)
+	}
+	out := make([]byte, len(instanceCipherHeader)+len(nonce))
+	copy(out[0:], instanceCipherHeader)
+	copy(out[len(instanceCipherHeader):], nonce[:])
+	out = secretbox.Seal(out, plain, &nonce, key)
+	return base64.StdEncoding.EncodeToString(out)
+}
+
+// openForInstance decrypts a value encrypted with the key of the instance. The
+// key derived from the previous master secret is also tried, for the values
+// that have not been re-encrypted since the last rotation.
+func openForInstance(db prefixer.Prefixer, encrypted []byte) ([]byte, error) {
+	encrypted = encrypted[len(instanceCipherHeader):]
+	if len(encrypted) < nonceLen {
+		return nil, errBadCredentials
+	}
+	var nonce [nonceLen]byte
+	copy(nonce[:], encrypted[:nonceLen])
+
+	vault := config.GetVault()
+	secrets := [][]byte{vault.CredentialsMasterSecret(), vault.CredentialsPreviousMasterSecret()}
+	found := false
+	for _, secret := range secrets {
+		key, err := deriveKey(secret, db)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			continue
+		}
+		found = true
+		if plain, ok := secretbox.Open(nil, encrypted[nonceLen:], &nonce, key); ok {
+			return plain, nil
+		}
+	}
+	if !found {
+		return nil, errCannotDecrypt
+	}
+	return nil, errBadCredentials
+}
+
+// EncryptInstanceCredentials encrypts the given login / password pair with the
+// key of the instance. If no master secret has been configured, it falls back
+// on the vault keys.
+func EncryptInstanceCredentials(db prefixer.Prefixer, login, password string) (string, error) {
+	key, err := instanceKey(db)
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		return EncryptCredentials(login, password)
+	}
+	creds := make([]byte, plainPrefixLen+len(login)+len(password))
+	binary.BigEndian.PutUint32(creds[0:], uint32(len(login)))
+	copy(creds[plainPrefixLen:], login)
+	copy(creds[plainPrefixLen+len(login):], password)
+	return sealForInstance(key, creds), nil
+}
+
+// EncryptInstanceCredentialsData encrypts any json encodable data with the key
+// of the instance. If no master secret has been configured, it falls back on
+// the vault keys.
+func EncryptInstanceCredentialsData(db prefixer.Prefixer, data interface{}) (string, error) {
+	key, err := instanceKey(db)
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		return EncryptCredentialsData(data)
+	}
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return sealForInstance(key, buf), nil
+}
+
+// DecryptInstanceCredentials decrypts a login / password pair encrypted with
+// EncryptInstanceCredentials (or EncryptCredentials).
+func DecryptInstanceCredentials(db prefixer.Prefixer, encryptedData string) (login, password string, err error) {
+	encrypted, err := base64.StdEncoding.DecodeString(encryptedData)
+	if err != nil {
+		return "", "", errCannotDecrypt
+	}
+	if !bytes.HasPrefix(encrypted, []byte(instanceCipherHeader)) {
+		return DecryptCredentials(encryptedData)
+	}
+	creds, err := openForInstance(db, encrypted)
+	if err != nil {
+		return "", "", err
+	}
+	if len(creds) < plainPrefixLen {
+		return "", "", errBadCredentials
+	}
+	loginLen := int(binary.BigEndian.Uint32(creds[0:]))
+	creds = creds[plainPrefixLen:]
+	if len(creds) < loginLen {
+		return "", "", errBadCredentials
+	}
+	return string(creds[:loginLen]), string(creds[loginLen:]), nil
+}
+
+// DecryptInstanceCredentialsData decrypts and decodes a value encrypted with
+// EncryptInstanceCredentialsData (or EncryptCredentialsData).
+func DecryptInstanceCredentialsData(db prefixer.Prefixer, encryptedData string) (interface{}, error) {
+	encrypted, err := base64.StdEncoding.DecodeString(encryptedData)
+	if err != nil {
+		return nil, errCannotDecrypt
+	}
+	if !bytes.HasPrefix(encrypted, []byte(instanceCipherHeader)) {
+		return DecryptCredentialsData(encryptedData)
+	}
+	plain, err := openForInstance(db, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	var data interface{}
+	if err = json.Unmarshal(plain, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// CanEncryptAccounts returns true if the stack has been configured with a key
+// or a secret to encrypt the credentials of the accounts.
+func CanEncryptAccounts() bool {
+	vault := config.GetVault()
+	return len(vault.CredentialsMasterSecret()) > 0 || vault.CredentialsEncryptorKey() != nil
+}
+
+// EncryptAccount encrypts the secret fields of the auth part of an account
+// (and of its data part, for aggregator accounts). It returns true if some
+// fields have been encrypted, and an error if a field can't be encrypted: the
+// account must not be saved in this case.
+func EncryptAccount(db prefixer.Prefixer, doc couchdb.JSONDoc) (bool, error) {
+	if !CanEncryptAccounts() {
+		return false, nil
+	}
+	return encryptMap(db, doc.M)
+}
+
+// DecryptAccount decrypts the secret fields of an account. It must only be
+// used to inject the credentials in a konnector run: the decrypted values
+// should never be sent in the responses of the API.
+func DecryptAccount(db prefixer.Prefixer, doc couchdb.JSONDoc) bool {
+	return decryptMap(db, doc.M)
+}
+
+func isEncryptedField(k string) bool {
+	for _, field := range encryptedFields {
+		if field == k {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptMap encrypts the secret fields of the auth part of the map (and of
+// its data part). If a field can't be encrypted, an error is returned and the
+// map is left untouched, so that it is not saved without the credentials.
+func encryptMap(db prefixer.Prefixer, m map[string]interface{}) (encrypted bool, err error) {
+	auth, ok := m["auth"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	login, _ := auth["login"].(string)
+	cloned := make(map[string]interface{}, len(auth))
+	var encKeys []string
+	for k, v := range auth {
+		switch {
+		case k == "password":
+			password, _ := v.(string)
+			if cloned["credentials_encrypted"], err = EncryptInstanceCredentials(db, login, password); err != nil {
+				return false, err
+			}
+			encrypted = true
+		case isEncryptedField(k):
+			if cloned[k+"_encrypted"], err = EncryptInstanceCredentialsData(db, v); err != nil {
+				return false, err
+			}
+			encrypted = true
+		case strings.HasSuffix(k, "_encrypted"):
+			encKeys = append(encKeys, k)
+		default:
+			cloned[k] = v
+		}
+	}
+	for _, key := range encKeys {
+		if _, ok := cloned[key]; !ok {
+			cloned[key] = auth[key]
+		}
+	}
+	if data, ok := m["data"].(map[string]interface{}); ok {
+		dataEncrypted, err := encryptMap(db, data)
+		if err != nil {
+			return false, err
+		}
+		encrypted = encrypted || dataEncrypted
+	}
+	m["auth"] = cloned
+	return encrypted, nil
+}
+
+func decryptMap(db prefixer.Prefixer, m map[string]interface{}) (decrypted bool) {
+	auth, ok := m["auth"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	cloned := make(map[string]interface{}, len(auth))
+	for k, v := range auth {
+		if !strings.HasSuffix(k, "_encrypted") {
+			cloned[k] = v
+			continue
+		}
+		k = strings.TrimSuffix(k, "_encrypted")
+		var str string
+		str, ok = v.(string)
+		if !ok {
+			cloned[k] = v
+			continue
+		}
+		// If the value can't be decrypted, it is kept encrypted, in order to
+		// not lose it when the account is saved again.
+		if k == "credentials" {
+			login, password, err := DecryptInstanceCredentials(db, str)
+			if err != nil {
+				cloned[k+"_encrypted"] = v
+				continue
+			}
+			cloned["login"], cloned["password"] = login, password
+		} else {
+			data, err := DecryptInstanceCredentialsData(db, str)
+			if err != nil {
+				cloned[k+"_encrypted"] = v
+				continue
+			}
+			cloned[k] = data
+		}
+		decrypted = true
+	}
+	m["auth"] = cloned
+	if data, ok := m["data"].(map[string]interface{}); ok {
+		if decryptMap(db, data) && !decrypted {
+			decrypted = true
+		}
+	}
+	return
+}
+
+// reencryptClonedAccount decrypts the secret fields of an account copied from
+// the src database, and encrypts them again with the key of the dst database,
+// as this key is derived from the database prefix.
+func reencryptClonedAccount(src, dst prefixer.Prefixer, doc map[string]interface{}) error {
+	decryptMap(src, doc)
+	if !CanEncryptAccounts() {
+		return nil
+	}
+	_, err := encryptMap(dst, doc)
+	return err
+}
+
+// ReencryptAccounts decrypts and encrypts again the credentials of all the
+// accounts of an instance. It is used after a rotation of the master secret,
+// to encrypt the credentials with the new key. It returns the number of
+// accounts that have been updated.
+func ReencryptAccounts(db prefixer.Prefixer) (int, error) {
+	if !CanEncryptAccounts() {
+		return 0, errCannotEncrypt
+	}
+	var docs []couchdb.JSONDoc
+	err := couchdb.ForeachDocs(db, consts.Accounts, func(_ string, raw json.RawMessage) error {
+		var doc couchdb.JSONDoc
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		doc.Type = consts.Accounts
+		docs = append(docs, doc)
+		return nil
+	})
+	if couchdb.IsNoDatabaseError(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, doc := range docs {
+		decryptMap(db, doc.M)
+		encrypted, err := encryptMap(db, doc.M)
+		if err != nil {
+			return count, err
+		}
+		if !encrypted {
+			continue
+		}
+		if err := couchdb.UpdateDoc(db, doc); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
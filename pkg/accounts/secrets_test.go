@@ -0,0 +1,153 @@
+package accounts
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountsEncryptDecrypt(t *testing.T) {
+	db := prefixer.NewPrefixer("accounts.cozy.tools", "accounts-cozy-tools")
+
+	v := []byte(`
+{
+    "_id": "d01aa821781612dce542a13d6989e6d0",
+    "_rev": "5-c8fc2169ff3226165688865e7cb609ef",
+    "_type": "io.cozy.accounts",
+    "account_type": "labanquepostale44",
+    "auth": {
+        "accountName": "Perso",
+        "identifier": "WHATYOUWANT",
+        "secret": "YOUWANTTOREADMYSECRET"
+    },
+    "data": {
+        "account_type": "linxo",
+        "auth": {
+            "login": "linxo.SOMEID@cozy.rocks",
+            "password": "SOMEPASSWORD"
+        },
+        "status": "connected",
+        "token": "4D757B74AD",
+        "uuid": "f6bb19cf-1c03-4d80-92e9-af66c18c4aa4"
+    },
+    "type": "io.cozy.accounts"
+}
+`)
+
+	var encrypted, decrypted bool
+	var m1 map[string]interface{} // original
+	var m2 map[string]interface{} // encrypted
+	var m3 map[string]interface{} // decrypted
+	json.Unmarshal(v, &m1)
+	json.Unmarshal(v, &m2)
+	json.Unmarshal(v, &m3)
+
+	encrypted, err := encryptMap(db, m2)
+	assert.NoError(t, err)
+	assert.True(t, encrypted)
+
+	{
+		auth1 := m2["auth"].(map[string]interface{})
+		auth2 := m2["data"].(map[string]interface{})["auth"].(map[string]interface{})
+		{
+			_, ok1 := auth1["secret"]
+			_, ok2 := auth1["secret_encrypted"]
+			assert.False(t, ok1)
+			assert.True(t, ok2)
+		}
+		{
+			_, ok1 := auth2["password"]
+			_, ok2 := auth2["credentials_encrypted"]
+			assert.False(t, ok1)
+			assert.True(t, ok2)
+		}
+	}
+
+	encrypted, err = encryptMap(db, m3)
+	assert.NoError(t, err)
+	decrypted = decryptMap(db, m3)
+	assert.True(t, encrypted)
+	assert.True(t, decrypted)
+	assert.EqualValues(t, m1, m3)
+
+	{
+		auth1 := m3["auth"].(map[string]interface{})
+		auth2 := m3["data"].(map[string]interface{})["auth"].(map[string]interface{})
+		{
+			_, ok1 := auth1["secret"]
+			_, ok2 := auth1["secret_encrypted"]
+			assert.True(t, ok1)
+			assert.False(t, ok2)
+		}
+		{
+			_, ok1 := auth2["password"]
+			_, ok2 := auth2["credentials_encrypted"]
+			assert.True(t, ok1)
+			assert.False(t, ok2)
+		}
+	}
+}
+
+func TestEncryptMapError(t *testing.T) {
+	db := prefixer.NewPrefixer("accounts.cozy.tools", "accounts-cozy-tools")
+	// A value that can't be serialized in JSON can't be encrypted
+	secret := make(chan int)
+	m := map[string]interface{}{
+		"auth": map[string]interface{}{
+			"login":    "alice",
+			"password": "my-secret-password",
+			"secret":   secret,
+		},
+	}
+	encrypted, err := encryptMap(db, m)
+	assert.Error(t, err)
+	assert.False(t, encrypted)
+	auth := m["auth"].(map[string]interface{})
+	assert.Equal(t, "my-secret-password", auth["password"])
+	assert.Contains(t, auth, "secret")
+	assert.NotContains(t, auth, "credentials_encrypted")
+}
+
+func TestInstanceCredentials(t *testing.T) {
+	db1 := prefixer.NewPrefixer("alice.cozy.tools", "alice-cozy-tools")
+	db2 := prefixer.NewPrefixer("bob.cozy.tools", "bob-cozy-tools")
+
+	encrypted, err := EncryptInstanceCredentials(db1, "me@mycozy.cloud", "fzEE6HFWsSp8jP")
+	if !assert.NoError(t, err) {
+		return
+	}
+	login, password, err := DecryptInstanceCredentials(db1, encrypted)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "me@mycozy.cloud", login)
+		assert.Equal(t, "fzEE6HFWsSp8jP", password)
+	}
+
+	// The key of an instance can't be used to decrypt the credentials of
+	// another instance
+	_, _, err = DecryptInstanceCredentials(db2, encrypted)
+	assert.Error(t, err)
+
+	// The credentials encrypted with the vault keys can still be decrypted
+	legacy, err := EncryptCredentials("me@mycozy.cloud", "fzEE6HFWsSp8jP")
+	if !assert.NoError(t, err) {
+		return
+	}
+	login, password, err = DecryptInstanceCredentials(db2, legacy)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "me@mycozy.cloud", login)
+		assert.Equal(t, "fzEE6HFWsSp8jP", password)
+	}
+
+	data, err := EncryptInstanceCredentialsData(db1, map[string]interface{}{"foo": "bar"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	decrypted, err := DecryptInstanceCredentialsData(db1, data)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, map[string]interface{}{"foo": "bar"}, decrypted)
+	}
+	_, err = DecryptInstanceCredentialsData(db2, data)
+	assert.Error(t, err)
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
@@ -321,7 +322,8 @@ func (at *AccountType) RefreshAccount(a Account) error {
 	return nil
 }
 
-// TypeInfo returns the AccountType document for a given id
+// TypeInfo returns the AccountType document for a given id. The client secret
+// of the document is replaced by the one of the keyring, if any.
 func TypeInfo(id string) (*AccountType, error) {
 	if id == "" {
 		return nil, errors.New("no account type id provided")
@@ -331,5 +333,8 @@ func TypeInfo(id string) (*AccountType, error) {
 	if err != nil {
 		return nil, err
 	}
+	if secret := config.GetVault().OAuthClientSecret(id); secret != "" {
+		a.ClientSecret = secret
+	}
 	return &a, nil
 }
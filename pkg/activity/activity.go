@@ -0,0 +1,242 @@
+// Package activity is for the feed of the recent activity on an instance: the
+// files added or modified, the sharings accepted, the konnectors run and the
+// logins. The events that happen in a short period of time for the same
+// group (for example, the files added in the same directory) are aggregated
+// in a single activity, to avoid flooding the feed with the bursts.
+package activity
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+const (
+	// KindFileAdded is the kind of the activities for the new files.
+	KindFileAdded = "file_added"
+	// KindFileModified is the kind of the activities for the files whose
+	// content has changed.
+	KindFileModified = "file_modified"
+	// KindSharingAccepted is the kind of the activities for the sharings
+	// accepted by the user, or by a member of a sharing of the user.
+	KindSharingAccepted = "sharing_accepted"
+	// KindKonnectorRun is the kind of the activities for the successful
+	// executions of a konnector.
+	KindKonnectorRun = "konnector_run"
+	// KindKonnectorFailed is the kind of the activities for the executions of
+	// a konnector that have failed.
+	KindKonnectorFailed = "konnector_failed"
+	// KindLogin is the kind of the activities for the logins of the user.
+	KindLogin = "login"
+)
+
+const (
+	// GroupingWindow is the duration since the last event of an activity
+	// during which a new event of the same group is added to it.
+	GroupingWindow = 30 * time.Minute
+	// MaxObjects is the maximal number of objects kept in an activity: the
+	// older ones are only counted.
+	MaxObjects = 10
+	// Retention is the duration during which the activities are kept.
+	Retention = 90 * 24 * time.Hour
+)
+
+// purgeBatchSize is the number of activities deleted in one bulk request.
+const purgeBatchSize = 1000
+
+// Object is a document concerned by an event of an activity.
+type Object struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// Activity is an entry of the feed, that aggregates the events of the same
+// group.
+type Activity struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+	Kind   string `json:"kind"`
+	Group  string `json:"group"`
+	// Count is the number of events in this activity
+	Count int `json:"count"`
+	// Objects are the documents of the most recent events, the most recent
+	// first
+	Objects   []Object  `json:"objects"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ID implements couchdb.Doc
+func (a *Activity) ID() string { return a.DocID }
+
+// Rev implements couchdb.Doc
+func (a *Activity) Rev() string { return a.DocRev }
+
+// DocType implements couchdb.Doc
+func (a *Activity) DocType() string { return consts.Activities }
+
+// SetID implements couchdb.Doc
+func (a *Activity) SetID(v string) { a.DocID = v }
+
+// SetRev implements couchdb.Doc
+func (a *Activity) SetRev(v string) { a.DocRev = v }
+
+// Clone implements couchdb.Doc
+func (a *Activity) Clone() couchdb.Doc {
+	clone := *a
+	clone.Objects = make([]Object, len(a.Objects))
+	copy(clone.Objects, a.Objects)
+	return &clone
+}
+
+// Record adds an event to the feed. If the last activity of the group has
+// been updated recently, the event is added to it. Else, a new activity is
+// created.
+func Record(db prefixer.Prefixer, kind, group string, obj Object) error {
+	now := time.Now().UTC()
+	last, err := lastOfGroup(db, group)
+	if err != nil {
+		return err
+	}
+	if last != nil && last.Kind == kind && now.Sub(last.UpdatedAt) < GroupingWindow {
+		old := last.Clone()
+		last.Count++
+		last.Objects = append([]Object{obj}, last.Objects...)
+		if len(last.Objects) > MaxObjects {
+			last.Objects = last.Objects[:MaxObjects]
+		}
+		last.UpdatedAt = now
+		return couchdb.UpdateDocWithOld(db, last, old)
+	}
+	a := &Activity{
+		Kind:      kind,
+		Group:     group,
+		Count:     1,
+		Objects:   []Object{obj},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	return couchdb.CreateDoc(db, a)
+}
+
+// lastOfGroup returns the most recent activity of the group, or nil if the
+// group has no activity.
+func lastOfGroup(db prefixer.Prefixer, group string) (*Activity, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.ActivitiesByGroup, &couchdb.ViewRequest{
+		StartKey:    []interface{}{group, map[string]interface{}{}},
+		EndKey:      []interface{}{group},
+		Descending:  true,
+		Limit:       1,
+		IncludeDocs: true,
+	}, &res)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(res.Rows) == 0 {
+		return nil, nil
+	}
+	var a Activity
+	if err := json.Unmarshal(res.Rows[0].Doc, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// List returns a page of the activities of the feed, from the most recent to
+// the oldest.
+func List(db prefixer.Prefixer, cursor couchdb.Cursor) ([]*Activity, error) {
+	req := &couchdb.ViewRequest{
+		Descending:  true,
+		IncludeDocs: true,
+	}
+	cursor.ApplyTo(req)
+	var res couchdb.ViewResponse
+	if err := couchdb.ExecView(db, consts.ActivitiesByDate, req, &res); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cursor.UpdateFrom(&res)
+	activities := make([]*Activity, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var a Activity
+		if err := json.Unmarshal(row.Doc, &a); err != nil {
+			return nil, err
+		}
+		activities = append(activities, &a)
+	}
+	return activities, nil
+}
+
+// ListSince returns the activities updated since the given date, the most
+// recent first.
+func ListSince(db prefixer.Prefixer, since time.Time, limit int) ([]*Activity, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.ActivitiesByDate, &couchdb.ViewRequest{
+		EndKey:      since,
+		Descending:  true,
+		Limit:       limit,
+		IncludeDocs: true,
+	}, &res)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	activities := make([]*Activity, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var a Activity
+		if err := json.Unmarshal(row.Doc, &a); err != nil {
+			return nil, err
+		}
+		activities = append(activities, &a)
+	}
+	return activities, nil
+}
+
+// Purge removes the activities that have not been updated during the
+// retention period.
+func Purge(i *instance.Instance) error {
+	limit := time.Now().UTC().Add(-Retention)
+	for {
+		var res couchdb.ViewResponse
+		err := couchdb.ExecView(i, consts.ActivitiesByDate, &couchdb.ViewRequest{
+			EndKey:      limit,
+			Limit:       purgeBatchSize,
+			IncludeDocs: true,
+		}, &res)
+		if err != nil {
+			if couchdb.IsNoDatabaseError(err) {
+				return nil
+			}
+			return err
+		}
+		docs := make([]couchdb.Doc, 0, len(res.Rows))
+		for _, row := range res.Rows {
+			var a Activity
+			if err := json.Unmarshal(row.Doc, &a); err != nil {
+				return err
+			}
+			docs = append(docs, &a)
+		}
+		if err = couchdb.BulkDeleteDocs(i, consts.Activities, docs); err != nil {
+			return err
+		}
+		if len(res.Rows) < purgeBatchSize {
+			return nil
+		}
+	}
+}
+
+var _ couchdb.Doc = &Activity{}
@@ -0,0 +1,210 @@
+package activity
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/sharing"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// queueSize is the number of events waiting to be recorded over which the
+// new events are dropped, to not slow down the realtime hub.
+const queueSize = 1000
+
+// purgeInterval is the duration between two purges of the old activities.
+const purgeInterval = 24 * time.Hour
+
+const purgerKey = "activities-purge"
+
+// event is an event of the realtime hub that must be recorded in the feed.
+type event struct {
+	src   *realtime.Event
+	kind  string
+	group string
+	obj   Object
+}
+
+// StartFeeder starts the process that records in the feeds the events that
+// happen in this cozy-stack process, and removes the old activities once a
+// day. When the stack has several processes, only the leader does the purge.
+func StartFeeder() utils.Shutdowner {
+	closed := make(chan struct{})
+	queue := make(chan *event, queueSize)
+	go func() {
+		c := realtime.GetHub().SubscribeLocalAll()
+		defer func() {
+			c.Close()
+			close(queue)
+		}()
+		for {
+			select {
+			case <-closed:
+				return
+			case e := <-c.Channel:
+				ev := fromRealtime(e)
+				if ev == nil {
+					continue
+				}
+				select {
+				case queue <- ev:
+				default:
+					logger.WithDomain(e.Domain).WithField("nspace", "activity").
+						Infof("Activity dropped for %s", ev.group)
+				}
+			}
+		}
+	}()
+	go func() {
+		for ev := range queue {
+			if err := Record(ev.src, ev.kind, ev.group, ev.obj); err != nil {
+				logger.WithDomain(ev.src.Domain).WithField("nspace", "activity").
+					Errorf("Could not record the %s activity: %s", ev.kind, err)
+			}
+		}
+	}()
+
+	leader := lock.Elect(purgerKey)
+	go func() {
+		waitDuration := purgeInterval
+		for {
+			select {
+			case <-time.After(waitDuration):
+				if !leader.IsLeader() {
+					waitDuration = lock.LeaderTimeout
+					continue
+				}
+				waitDuration = purgeInterval
+				err := instance.ForeachInstances(func(i *instance.Instance) error {
+					if err := Purge(i); err != nil {
+						i.Logger().WithField("nspace", "activity").
+							Errorf("Could not purge the activities: %s", err)
+					}
+					return nil
+				})
+				if err != nil {
+					logger.WithNamespace("activity").
+						Errorf("Could not purge the activities: %s", err)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &feeder{closed, leader}
+}
+
+type feeder struct {
+	closed chan struct{}
+	leader lock.Leader
+}
+
+func (f *feeder) Shutdown(ctx context.Context) error {
+	// One message for the events loop, and one for the purge loop
+	for i := 0; i < 2; i++ {
+		select {
+		case f.closed <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return f.leader.Shutdown(ctx)
+}
+
+// fromRealtime returns the event to record in the feed for a realtime event,
+// or nil if it is not interesting for the feed.
+func fromRealtime(e *realtime.Event) *event {
+	switch doc := e.Doc.(type) {
+	case *vfs.FileDoc:
+		return fromFile(e, doc)
+	case *sharing.Sharing:
+		return fromSharing(e, doc)
+	case *jobs.Job:
+		return fromJob(e, doc)
+	case *audit.Entry:
+		if e.Verb == realtime.EventCreate && doc.Action == audit.ActionLogin {
+			return &event{e, KindLogin, KindLogin, Object{
+				Type: consts.AuditLogs,
+				ID:   doc.ID(),
+				Name: doc.UA,
+			}}
+		}
+	}
+	return nil
+}
+
+func fromFile(e *realtime.Event, doc *vfs.FileDoc) *event {
+	if doc.Type != consts.FileType || doc.Trashed || doc.DirID == consts.TrashDirID {
+		return nil
+	}
+	obj := Object{Type: consts.Files, ID: doc.ID(), Name: doc.DocName}
+	switch e.Verb {
+	case realtime.EventCreate:
+		return &event{e, KindFileAdded, KindFileAdded + "/" + doc.DirID, obj}
+	case realtime.EventUpdate:
+		old, ok := e.OldDoc.(*vfs.FileDoc)
+		if ok && !old.Trashed && !bytes.Equal(old.MD5Sum, doc.MD5Sum) {
+			return &event{e, KindFileModified, KindFileModified + "/" + doc.DirID, obj}
+		}
+	}
+	return nil
+}
+
+func fromSharing(e *realtime.Event, doc *sharing.Sharing) *event {
+	old, ok := e.OldDoc.(*sharing.Sharing)
+	if e.Verb != realtime.EventUpdate || !ok {
+		return nil
+	}
+	obj := Object{Type: consts.Sharings, ID: doc.ID(), Name: doc.Description}
+	group := KindSharingAccepted + "/" + doc.ID()
+	if !doc.Owner {
+		if doc.Active && !old.Active {
+			return &event{e, KindSharingAccepted, group, obj}
+		}
+		return nil
+	}
+	// On the owner, a member has accepted the sharing when its status is
+	// changed to ready
+	for i, m := range doc.Members {
+		if i == 0 || i >= len(old.Members) {
+			continue
+		}
+		if m.Status == sharing.MemberStatusReady && old.Members[i].Status != sharing.MemberStatusReady {
+			obj.Name = m.PrimaryName()
+			return &event{e, KindSharingAccepted, group, obj}
+		}
+	}
+	return nil
+}
+
+func fromJob(e *realtime.Event, doc *jobs.Job) *event {
+	if e.Verb != realtime.EventUpdate || doc.WorkerType != "konnector" {
+		return nil
+	}
+	var kind string
+	switch doc.State {
+	case jobs.Done:
+		kind = KindKonnectorRun
+	case jobs.Errored:
+		kind = KindKonnectorFailed
+	default:
+		return nil
+	}
+	var msg struct {
+		Konnector string `json:"konnector"`
+	}
+	if err := doc.Message.Unmarshal(&msg); err != nil || msg.Konnector == "" {
+		return nil
+	}
+	obj := Object{Type: consts.Jobs, ID: doc.ID(), Name: msg.Konnector}
+	return &event{e, kind, kind + "/" + msg.Konnector, obj}
+}
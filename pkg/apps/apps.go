@@ -74,6 +74,8 @@ type Manifest interface {
 	Source() string
 	Version() string
 	SetAvailableVersion(version string)
+	PermissionsUpdate() *PermissionsUpdate
+	SetPermissionsUpdate(pu *PermissionsUpdate)
 	Slug() string
 	State() State
 	LastUpdate() time.Time
@@ -2,7 +2,9 @@ package apps
 
 import (
 	"testing"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -126,3 +128,34 @@ func TestFindIntent(t *testing.T) {
 	found = man.FindIntent("PICK", "io.cozy.files")
 	assert.Nil(t, found)
 }
+
+func TestDiffPermissions(t *testing.T) {
+	oldPerms := permissions.Set{
+		permissions.Rule{Title: "files", Type: "io.cozy.files", Verbs: permissions.ALL},
+		permissions.Rule{Title: "contacts", Type: "io.cozy.contacts", Verbs: permissions.Verbs(permissions.GET)},
+		permissions.Rule{Title: "settings", Type: "io.cozy.settings", Verbs: permissions.ALL},
+	}
+	newPerms := permissions.Set{
+		permissions.Rule{Title: "files", Type: "io.cozy.files", Verbs: permissions.ALL},
+		permissions.Rule{Title: "contacts", Type: "io.cozy.contacts", Verbs: permissions.ALL},
+		permissions.Rule{Title: "bills", Type: "io.cozy.bills", Verbs: permissions.ALL},
+	}
+	pu := diffPermissions("2.0.0", oldPerms, newPerms)
+	assert.Equal(t, "2.0.0", pu.Version)
+	if assert.Len(t, pu.Added, 1) {
+		assert.Equal(t, "io.cozy.bills", pu.Added[0].Type)
+	}
+	if assert.Len(t, pu.Removed, 1) {
+		assert.Equal(t, "io.cozy.settings", pu.Removed[0].Type)
+	}
+	if assert.Len(t, pu.Changed, 1) {
+		assert.Equal(t, "io.cozy.contacts", pu.Changed[0].Type)
+		assert.True(t, pu.Changed[0].Verbs.ContainsAll(permissions.ALL))
+	}
+
+	assert.False(t, pu.Approved("2.0.0"))
+	now := time.Now()
+	pu.ApprovedAt = &now
+	assert.True(t, pu.Approved("2.0.0"))
+	assert.False(t, pu.Approved("3.0.0"))
+}
@@ -31,4 +31,7 @@ var (
 	// ErrBadChecksum is used when the application checksum does not match the
 	// specified one.
 	ErrBadChecksum = errors.New("Application checksum does not match")
+	// ErrNoPermissionsUpdate is used when approving the permissions of an
+	// application that has no update waiting for new permissions.
+	ErrNoPermissionsUpdate = errors.New("Application has no update waiting for new permissions")
 )
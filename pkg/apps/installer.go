@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/Masterminds/semver"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/hooks"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -314,6 +315,7 @@ func (i *Installer) update() error {
 	// to actually fetch the data to extract the exact version of the manifest.
 	makeUpdate := true
 	availableVersion := ""
+	var permissionsUpdate *PermissionsUpdate
 	switch i.src.Scheme {
 	case "registry", "http", "https":
 		makeUpdate = (newManifest.Version() != oldManifest.Version())
@@ -322,15 +324,21 @@ func (i *Installer) update() error {
 	// Check the possible permissions changes before updating. If the
 	// verifyPermissions flag is activated (for non manual updates for example),
 	// we cancel out the update and mark the UpdateAvailable field of the
-	// application instead of actually updating.
+	// application instead of actually updating. The diff of the permissions is
+	// kept on the manifest, until the user approves it for this version.
 	if makeUpdate && !isPlatformApp(oldManifest) {
 		oldPermissions := oldManifest.Permissions()
 		newPermissions := newManifest.Permissions()
 		samePermissions := newPermissions != nil && oldPermissions != nil &&
 			newPermissions.HasSameRules(oldPermissions)
 		if !samePermissions && !i.permissionsAcked {
-			makeUpdate = false
-			availableVersion = newManifest.Version()
+			if pu := oldManifest.PermissionsUpdate(); pu.Approved(newManifest.Version()) {
+				newManifest.SetPermissionsUpdate(pu)
+			} else {
+				makeUpdate = false
+				availableVersion = newManifest.Version()
+				permissionsUpdate = diffPermissions(availableVersion, oldPermissions, newPermissions)
+			}
 		}
 	}
 
@@ -346,6 +354,7 @@ func (i *Installer) update() error {
 		i.man.SetSource(i.src)
 		if availableVersion != "" {
 			i.man.SetAvailableVersion(availableVersion)
+			i.man.SetPermissionsUpdate(permissionsUpdate)
 		}
 		i.sendRealtimeEvent()
 		i.notifyChannel()
@@ -427,20 +436,8 @@ func (i *Installer) Poll() (Manifest, bool, error) {
 
 // DoLazyUpdate tries to update an application before using it
 func DoLazyUpdate(db prefixer.Prefixer, man Manifest, availableVersion string, copier Copier, registries []*url.URL) Manifest {
-	src, err := url.Parse(man.Source())
-	if err != nil || src.Scheme != "registry" {
-		return man
-	}
-	var v *registry.Version
-	channel, _ := getRegistryChannel(src)
-	v, errv := registry.GetLatestVersion(man.Slug(), channel, registries)
-	if errv != nil || v.Version == man.Version() {
-		return man
-	}
-	if availableVersion != "" && v.Version == availableVersion {
-		return man
-	}
-	if channel == "stable" && !isMoreRecent(man.Version(), v.Version) {
+	version, src := registryUpdate(man, registries)
+	if version == "" || version == availableVersion {
 		return man
 	}
 	inst, err := NewInstaller(db, copier, &InstallerOptions{
@@ -459,6 +456,44 @@ func DoLazyUpdate(db prefixer.Prefixer, man Manifest, availableVersion string, c
 	return newman
 }
 
+// CheckForUpdate looks in the registries for a new version of an application
+// installed from a registry. If there is one that was not already known, it is
+// recorded as the available version of the application, and the change is
+// sent to the realtime hub. The new version is returned, or an empty string if
+// the application is up-to-date.
+func CheckForUpdate(db prefixer.Prefixer, man Manifest, availableVersion string, registries []*url.URL) (string, error) {
+	version, _ := registryUpdate(man, registries)
+	if version == "" || version == availableVersion {
+		return "", nil
+	}
+	man.SetAvailableVersion(version)
+	// The services and the permissions are not changed, so the Update method
+	// of the manifest is not used.
+	if err := couchdb.UpdateDoc(db, man); err != nil {
+		return "", err
+	}
+	realtime.GetHub().Publish(db, realtime.EventUpdate, man.Clone(), nil)
+	return version, nil
+}
+
+// registryUpdate returns the latest version of an application installed from
+// a registry, and its source, if it is more recent than the installed one.
+func registryUpdate(man Manifest, registries []*url.URL) (string, *url.URL) {
+	src, err := url.Parse(man.Source())
+	if err != nil || src.Scheme != "registry" {
+		return "", nil
+	}
+	channel, _ := getRegistryChannel(src)
+	v, err := registry.GetLatestVersion(man.Slug(), channel, registries)
+	if err != nil || v.Version == man.Version() {
+		return "", nil
+	}
+	if channel == "stable" && !isMoreRecent(man.Version(), v.Version) {
+		return "", nil
+	}
+	return v.Version, src
+}
+
 // isMoreRecent returns true if b is greater than a
 func isMoreRecent(a, b string) bool {
 	vA, err := semver.NewVersion(a)
@@ -57,6 +57,8 @@ type KonnManifest struct {
 	DocPermissions   permissions.Set `json:"permissions"`
 	AvailableVersion string          `json:"available_version,omitempty"`
 
+	PendingPermissions *PermissionsUpdate `json:"permissions_update,omitempty"`
+
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
@@ -79,6 +81,7 @@ func (m *KonnManifest) Clone() couchdb.Doc {
 
 	cloned.DocPermissions = make(permissions.Set, len(m.DocPermissions))
 	copy(cloned.DocPermissions, m.DocPermissions)
+	cloned.PendingPermissions = m.PendingPermissions.clone()
 
 	cloned.Locales = cloneRawMessage(m.Locales)
 	cloned.Langs = cloneRawMessage(m.Langs)
@@ -108,6 +111,27 @@ func (m *KonnManifest) Clone() couchdb.Doc {
 // SetID is part of the Manifest interface
 func (m *KonnManifest) SetID(id string) {}
 
+// DefaultFolderTemplate returns the template for the path of the folder where
+// the konnector saves its files, from the defaultDir of its folders, or an
+// empty string if the konnector has not declared one.
+func (m *KonnManifest) DefaultFolderTemplate() string {
+	if m.Folders == nil {
+		return ""
+	}
+	var folders []struct {
+		DefaultDir string `json:"defaultDir"`
+	}
+	if err := json.Unmarshal(*m.Folders, &folders); err != nil {
+		return ""
+	}
+	for _, f := range folders {
+		if f.DefaultDir != "" {
+			return f.DefaultDir
+		}
+	}
+	return ""
+}
+
 // SetRev is part of the Manifest interface
 func (m *KonnManifest) SetRev(rev string) { m.DocRev = rev }
 
@@ -138,6 +162,12 @@ func (m *KonnManifest) SetVersion(version string) { m.DocVersion = version }
 // SetAvailableVersion is part of the Manifest interface
 func (m *KonnManifest) SetAvailableVersion(version string) { m.AvailableVersion = version }
 
+// PermissionsUpdate is part of the Manifest interface
+func (m *KonnManifest) PermissionsUpdate() *PermissionsUpdate { return m.PendingPermissions }
+
+// SetPermissionsUpdate is part of the Manifest interface
+func (m *KonnManifest) SetPermissionsUpdate(pu *PermissionsUpdate) { m.PendingPermissions = pu }
+
 // AppType is part of the Manifest interface
 func (m *KonnManifest) AppType() AppType { return Konnector }
 
@@ -180,6 +210,9 @@ func (m *KonnManifest) ReadManifest(r io.Reader, slug, sourceURL string) (Manife
 	newManifest.CreatedAt = m.CreatedAt
 	newManifest.DocSlug = slug
 	newManifest.DocSource = sourceURL
+	// The approval of the permissions is only given by the user, never by the
+	// manifest of the source.
+	newManifest.PendingPermissions = nil
 	if newManifest.Parameters == nil {
 		newManifest.Parameters = m.Parameters
 	}
@@ -0,0 +1,94 @@
+package apps
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// PermissionsUpdate describes the changes of permissions requested by a new
+// version of an application or a konnector. The automatic updates of this
+// version are blocked until the user has approved the new permissions.
+type PermissionsUpdate struct {
+	Version    string          `json:"version"`
+	Added      permissions.Set `json:"added,omitempty"`
+	Removed    permissions.Set `json:"removed,omitempty"`
+	Changed    permissions.Set `json:"changed,omitempty"`
+	ApprovedAt *time.Time      `json:"approved_at,omitempty"`
+}
+
+// Approved returns true if the user has approved the permissions of the given
+// version.
+func (pu *PermissionsUpdate) Approved(version string) bool {
+	return pu != nil && pu.ApprovedAt != nil && pu.Version == version
+}
+
+func (pu *PermissionsUpdate) clone() *PermissionsUpdate {
+	if pu == nil {
+		return nil
+	}
+	cloned := *pu
+	cloned.Added = cloneSet(pu.Added)
+	cloned.Removed = cloneSet(pu.Removed)
+	cloned.Changed = cloneSet(pu.Changed)
+	if pu.ApprovedAt != nil {
+		approvedAt := *pu.ApprovedAt
+		cloned.ApprovedAt = &approvedAt
+	}
+	return &cloned
+}
+
+func cloneSet(set permissions.Set) permissions.Set {
+	if set == nil {
+		return nil
+	}
+	cloned := make(permissions.Set, len(set))
+	copy(cloned, set)
+	return cloned
+}
+
+// diffPermissions compares the permissions of the installed version with the
+// ones of a new version. The rules are identified by their title: the added
+// and changed rules are taken from the new version, and the removed ones from
+// the installed version.
+func diffPermissions(version string, oldPerms, newPerms permissions.Set) *PermissionsUpdate {
+	pu := &PermissionsUpdate{Version: version}
+	olds := make(map[string]permissions.Rule, len(oldPerms))
+	for _, rule := range oldPerms {
+		olds[rule.Title] = rule
+	}
+	news := make(map[string]bool, len(newPerms))
+	for _, rule := range newPerms {
+		news[rule.Title] = true
+		old, ok := olds[rule.Title]
+		if !ok {
+			pu.Added = append(pu.Added, rule)
+		} else if !(permissions.Set{rule}).HasSameRules(permissions.Set{old}) {
+			pu.Changed = append(pu.Changed, rule)
+		}
+	}
+	for _, rule := range oldPerms {
+		if !news[rule.Title] {
+			pu.Removed = append(pu.Removed, rule)
+		}
+	}
+	return pu
+}
+
+// ApprovePermissions records on the manifest that the user has approved the
+// new permissions requested by the available version. The next update to
+// this version will be applied.
+func ApprovePermissions(db prefixer.Prefixer, man Manifest) error {
+	pu := man.PermissionsUpdate()
+	if pu == nil {
+		return ErrNoPermissionsUpdate
+	}
+	now := time.Now().UTC()
+	pu.ApprovedAt = &now
+	// The services and the permissions of the installed version are not
+	// changed, so the document is saved without the Update method of the
+	// manifest, which would recreate the triggers of the services.
+	return couchdb.UpdateDoc(db, man)
+}
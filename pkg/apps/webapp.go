@@ -54,6 +54,15 @@ type Intent struct {
 	Href   string   `json:"href"`
 }
 
+// CSP is the list of the external sources that an application can use, for
+// each type of resource. They are added to the Content-Security-Policy header
+// when its index is served.
+type CSP struct {
+	ConnectSrc []string `json:"connect_src,omitempty"`
+	ImgSrc     []string `json:"img_src,omitempty"`
+	FrameSrc   []string `json:"frame_src,omitempty"`
+}
+
 // WebappManifest contains all the informations associated with an installed web
 // application.
 type WebappManifest struct {
@@ -84,10 +93,13 @@ type WebappManifest struct {
 	DocPermissions   permissions.Set `json:"permissions"`
 	AvailableVersion string          `json:"available_version,omitempty"`
 
+	PendingPermissions *PermissionsUpdate `json:"permissions_update,omitempty"`
+
 	Intents       []Intent      `json:"intents"`
 	Routes        Routes        `json:"routes"`
 	Services      Services      `json:"services"`
 	Notifications Notifications `json:"notifications"`
+	CSP           *CSP          `json:"csp,omitempty"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -144,8 +156,21 @@ func (m *WebappManifest) Clone() couchdb.Doc {
 	cloned.Intents = make([]Intent, len(m.Intents))
 	copy(cloned.Intents, m.Intents)
 
+	if m.CSP != nil {
+		csp := CSP{
+			ConnectSrc: make([]string, len(m.CSP.ConnectSrc)),
+			ImgSrc:     make([]string, len(m.CSP.ImgSrc)),
+			FrameSrc:   make([]string, len(m.CSP.FrameSrc)),
+		}
+		copy(csp.ConnectSrc, m.CSP.ConnectSrc)
+		copy(csp.ImgSrc, m.CSP.ImgSrc)
+		copy(csp.FrameSrc, m.CSP.FrameSrc)
+		cloned.CSP = &csp
+	}
+
 	cloned.DocPermissions = make(permissions.Set, len(m.DocPermissions))
 	copy(cloned.DocPermissions, m.DocPermissions)
+	cloned.PendingPermissions = m.PendingPermissions.clone()
 
 	return &cloned
 }
@@ -183,6 +208,12 @@ func (m *WebappManifest) SetVersion(version string) { m.DocVersion = version }
 // SetAvailableVersion is part of the Manifest interface
 func (m *WebappManifest) SetAvailableVersion(version string) { m.AvailableVersion = version }
 
+// PermissionsUpdate is part of the Manifest interface
+func (m *WebappManifest) PermissionsUpdate() *PermissionsUpdate { return m.PendingPermissions }
+
+// SetPermissionsUpdate is part of the Manifest interface
+func (m *WebappManifest) SetPermissionsUpdate(pu *PermissionsUpdate) { m.PendingPermissions = pu }
+
 // AppType is part of the Manifest interface
 func (m *WebappManifest) AppType() AppType { return Webapp }
 
@@ -240,6 +271,9 @@ func (m *WebappManifest) ReadManifest(r io.Reader, slug, sourceURL string) (Mani
 	newManifest.Instance = m.Instance
 	newManifest.DocSlug = slug
 	newManifest.DocSource = sourceURL
+	// The approval of the permissions is only given by the user, never by the
+	// manifest of the source.
+	newManifest.PendingPermissions = nil
 	newManifest.oldServices = m.Services
 	if newManifest.Routes == nil {
 		newManifest.Routes = make(Routes)
@@ -0,0 +1,258 @@
+// Package audit stores a log of the security-sensitive actions made on an
+// instance: the logins, the changes of the passphrase, the OAuth clients, the
+// sharings and the permissions given to the share links. The log is
+// append-only: its entries are never modified, and they are only removed at
+// the end of the retention period.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const (
+	// ActionLogin is the action of a successful login of the user.
+	ActionLogin = "login"
+	// ActionLoginFailed is the action of a login attempt with a wrong
+	// passphrase or two-factor passcode.
+	ActionLoginFailed = "login_failed"
+	// ActionPassphraseChanged is the action of a change of the passphrase, by
+	// the user or after a reset.
+	ActionPassphraseChanged = "passphrase_changed"
+	// ActionOAuthClientCreated is the action of the registration of an OAuth
+	// client.
+	ActionOAuthClientCreated = "oauth_client_created"
+	// ActionOAuthClientRevoked is the action of the deletion of an OAuth
+	// client.
+	ActionOAuthClientRevoked = "oauth_client_revoked"
+	// ActionSharingCreated is the action of the creation of a sharing.
+	ActionSharingCreated = "sharing_created"
+	// ActionPermissionGranted is the action of the creation of a permission
+	// for a share by link.
+	ActionPermissionGranted = "permission_granted"
+	// ActionFileACLGranted is the action of the grant of an access on a file
+	// or a directory to an OAuth client.
+	ActionFileACLGranted = "file_acl_granted"
+	// ActionFileACLRevoked is the action of the revocation of an access on a
+	// file or a directory.
+	ActionFileACLRevoked = "file_acl_revoked"
+	// ActionGuestTokenCreated is the action of the creation of a guest token
+	// for a list of documents.
+	ActionGuestTokenCreated = "guest_token_created"
+	// ActionGuestTokenRevoked is the action of the revocation of a guest
+	// token.
+	ActionGuestTokenRevoked = "guest_token_revoked"
+)
+
+// DefaultRetention is the duration during which the entries are kept, if the
+// context of the instance has no audit_retention.
+const DefaultRetention = 365 * 24 * time.Hour
+
+// purgeInterval is the duration between two purges of the old entries.
+const purgeInterval = 24 * time.Hour
+
+// purgeBatchSize is the number of entries deleted in one bulk request.
+const purgeBatchSize = 1000
+
+const purgerKey = "audit-logs-purge"
+
+// Entry is an entry of the audit log.
+type Entry struct {
+	DocID     string                 `json:"_id,omitempty"`
+	DocRev    string                 `json:"_rev,omitempty"`
+	Action    string                 `json:"action"`
+	IP        string                 `json:"ip,omitempty"`
+	UA        string                 `json:"user_agent,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// ID implements couchdb.Doc
+func (e *Entry) ID() string { return e.DocID }
+
+// Rev implements couchdb.Doc
+func (e *Entry) Rev() string { return e.DocRev }
+
+// DocType implements couchdb.Doc
+func (e *Entry) DocType() string { return consts.AuditLogs }
+
+// SetID implements couchdb.Doc
+func (e *Entry) SetID(v string) { e.DocID = v }
+
+// SetRev implements couchdb.Doc
+func (e *Entry) SetRev(v string) { e.DocRev = v }
+
+// Clone implements couchdb.Doc
+func (e *Entry) Clone() couchdb.Doc {
+	clone := *e
+	if e.Details != nil {
+		clone.Details = make(map[string]interface{}, len(e.Details))
+		for k, v := range e.Details {
+			clone.Details[k] = v
+		}
+	}
+	return &clone
+}
+
+// Record adds an entry to the audit log of the instance. The IP address and
+// the user-agent are taken from the request, if there is one. An error is
+// only logged, as it must not prevent the action from being made.
+func Record(i *instance.Instance, action string, req *http.Request, details map[string]interface{}) {
+	e := &Entry{
+		Action:    action,
+		Details:   details,
+		CreatedAt: time.Now().UTC(),
+	}
+	if req != nil {
+		e.IP = clientIP(req)
+		e.UA = req.UserAgent()
+	}
+	if err := couchdb.CreateDoc(i, e); err != nil {
+		i.Logger().WithField("nspace", "audit").
+			Errorf("Could not record the %s action: %s", action, err)
+	}
+}
+
+func clientIP(req *http.Request) string {
+	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		if ip := strings.TrimSpace(strings.SplitN(forwardedFor, ",", 2)[0]); ip != "" {
+			return ip
+		}
+	}
+	return req.RemoteAddr
+}
+
+// List returns a page of the entries of the audit log, from the most recent
+// to the oldest.
+func List(i *instance.Instance, cursor couchdb.Cursor) ([]*Entry, error) {
+	req := &couchdb.ViewRequest{
+		Descending:  true,
+		IncludeDocs: true,
+	}
+	cursor.ApplyTo(req)
+	var res couchdb.ViewResponse
+	if err := couchdb.ExecView(i, consts.AuditLogsByDate, req, &res); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cursor.UpdateFrom(&res)
+	entries := make([]*Entry, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var e Entry
+		if err := json.Unmarshal(row.Doc, &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+// Retention returns the duration during which the entries of the audit log
+// are kept for the instance: the audit_retention of its context (like
+// 2160h), or else DefaultRetention.
+func Retention(i *instance.Instance) time.Duration {
+	if context, err := i.SettingsContext(); err == nil {
+		if r, ok := context["audit_retention"].(string); ok {
+			if d, err := time.ParseDuration(r); err == nil && d > 0 {
+				return d
+			}
+		}
+	}
+	return DefaultRetention
+}
+
+// Purge removes the entries of the audit log that are older than the
+// retention period of the instance.
+func Purge(i *instance.Instance) error {
+	limit := time.Now().UTC().Add(-Retention(i))
+	for {
+		var res couchdb.ViewResponse
+		err := couchdb.ExecView(i, consts.AuditLogsByDate, &couchdb.ViewRequest{
+			EndKey:      limit,
+			Limit:       purgeBatchSize,
+			IncludeDocs: true,
+		}, &res)
+		if err != nil {
+			if couchdb.IsNoDatabaseError(err) {
+				return nil
+			}
+			return err
+		}
+		docs := make([]couchdb.Doc, 0, len(res.Rows))
+		for _, row := range res.Rows {
+			var e Entry
+			if err := json.Unmarshal(row.Doc, &e); err != nil {
+				return err
+			}
+			docs = append(docs, &e)
+		}
+		if err = couchdb.BulkDeleteDocs(i, consts.AuditLogs, docs); err != nil {
+			return err
+		}
+		if len(res.Rows) < purgeBatchSize {
+			return nil
+		}
+	}
+}
+
+// StartPurger starts the process that removes the old entries of the audit
+// logs of all the instances, once a day. When the stack has several
+// processes, only the leader does it.
+func StartPurger() utils.Shutdowner {
+	closed := make(chan struct{})
+	leader := lock.Elect(purgerKey)
+	go func() {
+		waitDuration := purgeInterval
+		for {
+			select {
+			case <-time.After(waitDuration):
+				if !leader.IsLeader() {
+					waitDuration = lock.LeaderTimeout
+					continue
+				}
+				waitDuration = purgeInterval
+				err := instance.ForeachInstances(func(i *instance.Instance) error {
+					if err := Purge(i); err != nil {
+						i.Logger().WithField("nspace", "audit").
+							Errorf("Could not purge the audit log: %s", err)
+					}
+					return nil
+				})
+				if err != nil {
+					logger.WithNamespace("audit").
+						Errorf("Could not purge the audit logs: %s", err)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &purger{closed, leader}
+}
+
+type purger struct {
+	closed chan struct{}
+	leader lock.Leader
+}
+
+func (p *purger) Shutdown(ctx context.Context) error {
+	select {
+	case p.closed <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return p.leader.Shutdown(ctx)
+}
+
+var _ couchdb.Doc = &Entry{}
@@ -0,0 +1,157 @@
+package bank
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/notification"
+	"github.com/cozy/cozy-stack/pkg/notification/center"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// AlertBalanceLower is the type of the alerts for a balance below the
+	// threshold.
+	AlertBalanceLower = "balance_lower"
+	// AlertLargeTransaction is the type of the alerts for a transaction with
+	// an amount (credit or debit) greater than the threshold.
+	AlertLargeTransaction = "large_transaction"
+)
+
+// Alert is configured by the user to be notified of a low balance or of a
+// large transaction. It is for all the accounts, or only for one if the
+// account field is set.
+type Alert struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	Type      string  `json:"type"`
+	Account   string  `json:"account,omitempty"`
+	Threshold float64 `json:"threshold"`
+}
+
+// ID returns the alert qualified identifier
+func (a *Alert) ID() string { return a.DocID }
+
+// Rev returns the alert revision
+func (a *Alert) Rev() string { return a.DocRev }
+
+// DocType returns the alert document type
+func (a *Alert) DocType() string { return consts.BankAlerts }
+
+// Clone implements couchdb.Doc
+func (a *Alert) Clone() couchdb.Doc {
+	cloned := *a
+	return &cloned
+}
+
+// SetID changes the alert qualified identifier
+func (a *Alert) SetID(id string) { a.DocID = id }
+
+// SetRev changes the alert revision
+func (a *Alert) SetRev(rev string) { a.DocRev = rev }
+
+func (a *Alert) appliesTo(account *Account) bool {
+	return a.Account == "" || a.Account == account.DocID
+}
+
+// GetAllAlerts returns all the alerts configured by the user.
+func GetAllAlerts(db couchdb.Database) ([]*Alert, error) {
+	var list []*Alert
+	err := couchdb.ForeachDocs(db, consts.BankAlerts, func(_ string, raw json.RawMessage) error {
+		var a Alert
+		if err := json.Unmarshal(raw, &a); err != nil {
+			return err
+		}
+		list = append(list, &a)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// CheckAlerts sends the notifications for the alerts of an account after an
+// import: for the balance of the account, and for the created transactions.
+// The notification of a low balance is stateful: it is sent when the balance
+// goes below the threshold, and not again until it goes back above it.
+func CheckAlerts(inst *instance.Instance, account *Account, created []*Transaction) error {
+	alerts, err := GetAllAlerts(inst)
+	if err != nil {
+		return err
+	}
+	var errm error
+	for _, alert := range alerts {
+		if !alert.appliesTo(account) {
+			continue
+		}
+		switch alert.Type {
+		case AlertBalanceLower:
+			below := account.Balance < alert.Threshold
+			n := newAlertNotification(inst, account, alert)
+			n.CategoryID = alert.DocID + "/" + account.DocID
+			n.State = below
+			n.Message = inst.Translate("Notifications Bank Balance Lower Message",
+				account.Label, formatAmount(account.Balance, account.Currency))
+			n.Data["Balance"] = formatAmount(account.Balance, account.Currency)
+			if err := center.PushStack(inst.Domain, center.NotificationBankBalanceLower, n); err != nil {
+				errm = multierror.Append(errm, err)
+			}
+		case AlertLargeTransaction:
+			for _, tx := range created {
+				if math.Abs(tx.Amount) < alert.Threshold {
+					continue
+				}
+				currency := tx.Currency
+				if currency == "" {
+					currency = account.Currency
+				}
+				n := newAlertNotification(inst, account, alert)
+				n.CategoryID = tx.DocID
+				n.Message = inst.Translate("Notifications Bank Large Transaction Message",
+					formatAmount(tx.Amount, currency), tx.Label, account.Label)
+				n.Data["Amount"] = formatAmount(tx.Amount, currency)
+				n.Data["TransactionLabel"] = tx.Label
+				if err := center.PushStack(inst.Domain, center.NotificationBankLargeTransaction, n); err != nil {
+					errm = multierror.Append(errm, err)
+				}
+			}
+		}
+	}
+	return errm
+}
+
+func newAlertNotification(inst *instance.Instance, account *Account, alert *Alert) *notification.Notification {
+	var title string
+	switch alert.Type {
+	case AlertBalanceLower:
+		title = inst.Translate("Notifications Bank Balance Lower Subject")
+	case AlertLargeTransaction:
+		title = inst.Translate("Notifications Bank Large Transaction Subject")
+	}
+	link := inst.SubDomain(consts.BanksSlug)
+	link.Fragment = "/balances/" + account.DocID
+	return &notification.Notification{
+		Title: title,
+		Slug:  consts.BanksSlug,
+		Data: map[string]interface{}{
+			"AccountLabel": account.Label,
+			"Threshold":    formatAmount(alert.Threshold, account.Currency),
+			"BanksLink":    link.String(),
+		},
+		PreferredChannels: []string{"mobile", "mail"},
+	}
+}
+
+func formatAmount(amount float64, currency string) string {
+	s := strconv.FormatFloat(amount, 'f', 2, 64)
+	if currency != "" {
+		s += " " + currency
+	}
+	return s
+}
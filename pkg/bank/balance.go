@@ -0,0 +1,138 @@
+package bank
+
+import (
+	"math"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// periodLevels gives the group level of the BankOperationsByAccountAndDate
+// view for each period.
+var periodLevels = map[string]int{
+	"year":  2,
+	"month": 3,
+	"day":   4,
+}
+
+// IsValidPeriod returns true if the balances can be aggregated by the given
+// period.
+func IsValidPeriod(period string) bool {
+	_, ok := periodLevels[period]
+	return ok
+}
+
+// Balance is the aggregation of the transactions of an account for a period,
+// with the balance of the account at the end of this period.
+type Balance struct {
+	Account string  `json:"account"`
+	Period  string  `json:"period"`
+	Credits float64 `json:"credits"`
+	Debits  float64 `json:"debits"`
+	Count   int     `json:"count"`
+	Balance float64 `json:"balance"`
+}
+
+// Balances returns the aggregated transactions of an account for each period
+// (year, month or day) with at least one transaction. The balances at the end
+// of the periods are computed backwards from the current balance of the
+// account. The start and end parameters, like 2018-01 or 2018-06-15, can be
+// used to keep only the periods between them (an empty string is no limit).
+func Balances(db couchdb.Database, account *Account, period, start, end string) ([]*Balance, error) {
+	level, ok := periodLevels[period]
+	if !ok {
+		return nil, ErrInvalidPeriod
+	}
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.BankOperationsByAccountAndDate, &couchdb.ViewRequest{
+		StartKey:   []string{account.DocID},
+		EndKey:     []string{account.DocID, couchdb.MaxString},
+		Reduce:     true,
+		GroupLevel: level,
+	}, &res)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return []*Balance{}, nil
+		}
+		return nil, err
+	}
+
+	balances := make([]*Balance, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		if b := balanceFromRow(account.DocID, row); b != nil {
+			balances = append(balances, b)
+		}
+	}
+	computeBalances(account.Balance, balances)
+	return filterPeriods(balances, start, end), nil
+}
+
+func balanceFromRow(accountID string, row *couchdb.ViewResponseRow) *Balance {
+	key, ok := row.Key.([]interface{})
+	if !ok || len(key) < 2 {
+		return nil
+	}
+	parts := make([]string, 0, len(key)-1)
+	for _, k := range key[1:] {
+		if s, ok := k.(string); ok {
+			parts = append(parts, s)
+		}
+	}
+	values, ok := row.Value.([]interface{})
+	if !ok || len(values) != 3 {
+		return nil
+	}
+	b := &Balance{Account: accountID, Period: strings.Join(parts, "-")}
+	if credits, ok := values[0].(float64); ok {
+		b.Credits = roundAmount(credits)
+	}
+	if debits, ok := values[1].(float64); ok {
+		b.Debits = roundAmount(debits)
+	}
+	if count, ok := values[2].(float64); ok {
+		b.Count = int(count)
+	}
+	return b
+}
+
+// computeBalances fills the balance at the end of each period, from the
+// current balance and the transactions of the periods after it. The list
+// must be sorted by period.
+func computeBalances(current float64, balances []*Balance) {
+	for i := len(balances) - 1; i >= 0; i-- {
+		b := balances[i]
+		b.Balance = roundAmount(current)
+		current -= b.Credits + b.Debits
+	}
+}
+
+// filterPeriods keeps the periods between start and end (included). They
+// are compared on the length of the period, so that 2018-06-15 as the start
+// keeps the month 2018-06.
+func filterPeriods(balances []*Balance, start, end string) []*Balance {
+	filtered := balances[:0]
+	for _, b := range balances {
+		if start != "" && b.Period < truncate(start, len(b.Period)) {
+			continue
+		}
+		if end != "" && b.Period > truncate(end, len(b.Period)) {
+			continue
+		}
+		filtered = append(filtered, b)
+	}
+	return filtered
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// roundAmount rounds an amount to the cents, to avoid the errors of the
+// floating point sums.
+func roundAmount(amount float64) float64 {
+	return math.Floor(amount*100+0.5) / 100
+}
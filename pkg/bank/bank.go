@@ -0,0 +1,144 @@
+// Package bank is for the io.cozy.bank.accounts and io.cozy.bank.operations
+// doctypes: the bank accounts and their transactions, as imported by the
+// banking konnectors. It gives the balances of the accounts per period, and
+// the alerts that notify the user of a low balance or of a large transaction.
+package bank
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// dateFormat is the format of the dates of the transactions, which can be
+// followed by a time.
+const dateFormat = "2006-01-02"
+
+// Account is a bank account. The documents can have more fields, written by
+// the konnectors and the banking application, and they are kept as is.
+type Account struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	Label            string  `json:"label"`
+	InstitutionLabel string  `json:"institutionLabel,omitempty"`
+	Number           string  `json:"number,omitempty"`
+	Type             string  `json:"type,omitempty"`
+	Balance          float64 `json:"balance"`
+	Currency         string  `json:"currency,omitempty"`
+	VendorID         string  `json:"vendorId,omitempty"`
+}
+
+// ID returns the account qualified identifier
+func (a *Account) ID() string { return a.DocID }
+
+// Rev returns the account revision
+func (a *Account) Rev() string { return a.DocRev }
+
+// DocType returns the account document type
+func (a *Account) DocType() string { return consts.BankAccounts }
+
+// Clone implements couchdb.Doc
+func (a *Account) Clone() couchdb.Doc {
+	cloned := *a
+	return &cloned
+}
+
+// SetID changes the account qualified identifier
+func (a *Account) SetID(id string) { a.DocID = id }
+
+// SetRev changes the account revision
+func (a *Account) SetRev(rev string) { a.DocRev = rev }
+
+// Transaction is a transaction of a bank account, also called an operation.
+// The amount is negative for a debit. Like for the accounts, the documents
+// can have more fields.
+type Transaction struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	Account  string  `json:"account"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency,omitempty"`
+	Date     string  `json:"date"`
+	Label    string  `json:"label"`
+	VendorID string  `json:"vendorId,omitempty"`
+}
+
+// ID returns the transaction qualified identifier
+func (t *Transaction) ID() string { return t.DocID }
+
+// Rev returns the transaction revision
+func (t *Transaction) Rev() string { return t.DocRev }
+
+// DocType returns the transaction document type
+func (t *Transaction) DocType() string { return consts.BankOperations }
+
+// Clone implements couchdb.Doc
+func (t *Transaction) Clone() couchdb.Doc {
+	cloned := *t
+	return &cloned
+}
+
+// SetID changes the transaction qualified identifier
+func (t *Transaction) SetID(id string) { t.DocID = id }
+
+// SetRev changes the transaction revision
+func (t *Transaction) SetRev(rev string) { t.DocRev = rev }
+
+// Day returns the day of the transaction, in the 2006-01-02 format.
+func (t *Transaction) Day() string { return dayOf(t.Date) }
+
+// fingerprint returns a key that is the same for the transactions that are
+// considered as duplicates: same vendor identifier if there is one, or else
+// same day, amount and label (ignoring the case and the spaces).
+func (t *Transaction) fingerprint() string {
+	if t.VendorID != "" {
+		return "vendor:" + t.VendorID
+	}
+	label := strings.Join(strings.Fields(strings.ToLower(t.Label)), " ")
+	amount := strconv.FormatFloat(t.Amount, 'f', 2, 64)
+	return t.Day() + "|" + amount + "|" + label
+}
+
+// GetAccount returns the bank account with the given identifier.
+func GetAccount(db couchdb.Database, id string) (*Account, error) {
+	account := &Account{}
+	if err := couchdb.GetDoc(db, consts.BankAccounts, id, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// GetAllAccounts returns all the bank accounts.
+func GetAllAccounts(db couchdb.Database) ([]*Account, error) {
+	var list []*Account
+	err := couchdb.ForeachDocs(db, consts.BankAccounts, func(_ string, raw json.RawMessage) error {
+		var a Account
+		if err := json.Unmarshal(raw, &a); err != nil {
+			return err
+		}
+		list = append(list, &a)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// dayOf returns the day of a date, by removing the time if there is one.
+func dayOf(date string) string {
+	if len(date) < len(dateFormat) {
+		return date
+	}
+	return date[:len(dateFormat)]
+}
+
+var (
+	_ couchdb.Doc = &Account{}
+	_ couchdb.Doc = &Transaction{}
+)
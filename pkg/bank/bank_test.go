@@ -0,0 +1,94 @@
+package bank
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	a := &Transaction{Date: "2018-06-15T00:00:00Z", Amount: -12.5, Label: "CB  Bakery"}
+	b := &Transaction{Date: "2018-06-15", Amount: -12.50, Label: "cb bakery"}
+	assert.Equal(t, a.fingerprint(), b.fingerprint())
+
+	c := &Transaction{Date: "2018-06-16", Amount: -12.5, Label: "CB Bakery"}
+	assert.NotEqual(t, a.fingerprint(), c.fingerprint())
+	d := &Transaction{Date: "2018-06-15", Amount: -12.4, Label: "CB Bakery"}
+	assert.NotEqual(t, a.fingerprint(), d.fingerprint())
+
+	e := &Transaction{Date: "2018-06-15", Amount: -12.5, Label: "CB Bakery", VendorID: "42"}
+	f := &Transaction{Date: "2018-06-17", Amount: -13, Label: "Bakery", VendorID: "42"}
+	assert.Equal(t, e.fingerprint(), f.fingerprint())
+	assert.NotEqual(t, a.fingerprint(), e.fingerprint())
+}
+
+func TestComputeBalances(t *testing.T) {
+	balances := []*Balance{
+		{Period: "2018-04", Credits: 1000, Debits: -200},
+		{Period: "2018-05", Credits: 0, Debits: -300.1},
+		{Period: "2018-06", Credits: 1000, Debits: -450.2},
+	}
+	computeBalances(1549.7, balances)
+	assert.Equal(t, 1549.7, balances[2].Balance)
+	assert.Equal(t, 999.9, balances[1].Balance)
+	assert.Equal(t, 1300.0, balances[0].Balance)
+}
+
+func TestFilterPeriods(t *testing.T) {
+	balances := []*Balance{
+		{Period: "2018-04"},
+		{Period: "2018-05"},
+		{Period: "2018-06"},
+		{Period: "2018-07"},
+	}
+	filtered := filterPeriods(balances, "2018-05-15", "2018-06")
+	if assert.Len(t, filtered, 2) {
+		assert.Equal(t, "2018-05", filtered[0].Period)
+		assert.Equal(t, "2018-06", filtered[1].Period)
+	}
+	assert.Len(t, filterPeriods(filtered, "", ""), 2)
+}
+
+func TestRoundAmount(t *testing.T) {
+	assert.Equal(t, 0.3, roundAmount(0.1+0.2))
+	assert.Equal(t, -12.35, roundAmount(-12.345001))
+	assert.Equal(t, 100.0, roundAmount(99.999))
+}
+
+func TestMatchingScore(t *testing.T) {
+	bill := &Bill{Amount: 49.5, Date: "2018-06-14T00:00:00Z", Vendor: "Bakery"}
+	tx := &Transaction{Amount: -49.5, Date: "2018-06-15T00:00:00Z", Label: "CB BAKERY 14/06"}
+	score, ok := matchingScore(bill, tx)
+	assert.True(t, ok)
+	assert.Equal(t, 0.98, score)
+
+	other := &Transaction{Amount: -49.5, Date: "2018-06-29", Label: "Something else"}
+	score, ok = matchingScore(bill, other)
+	assert.True(t, ok)
+	assert.Equal(t, 0.5, score)
+
+	_, ok = matchingScore(bill, &Transaction{Amount: -49.6, Date: "2018-06-15", Label: "Bakery"})
+	assert.False(t, ok)
+	_, ok = matchingScore(bill, &Transaction{Amount: 49.5, Date: "2018-06-15", Label: "Bakery"})
+	assert.False(t, ok)
+	_, ok = matchingScore(bill, &Transaction{Amount: -49.5, Date: "2018-07-01", Label: "Bakery"})
+	assert.False(t, ok)
+
+	refund := &Bill{Amount: 20, Date: "2018-06-14", IsRefund: true}
+	_, ok = matchingScore(refund, &Transaction{Amount: 20, Date: "2018-06-20", Label: "Refund"})
+	assert.True(t, ok)
+}
+
+func TestAddBillRelationship(t *testing.T) {
+	doc := &couchdb.JSONDoc{M: map[string]interface{}{"label": "CB Bakery"}}
+	addBillRelationship(doc, "bill1")
+	addBillRelationship(doc, "bill1")
+	addBillRelationship(doc, "bill2")
+	rels := doc.M["relationships"].(map[string]interface{})
+	data := rels["bills"].(map[string]interface{})["data"].([]interface{})
+	if assert.Len(t, data, 2) {
+		assert.Equal(t, "bill1", data[0].(map[string]interface{})["id"])
+		assert.Equal(t, "bill2", data[1].(map[string]interface{})["id"])
+	}
+}
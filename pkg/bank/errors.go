@@ -0,0 +1,14 @@
+package bank
+
+import "errors"
+
+var (
+	// ErrInvalidPeriod is returned when a period is not year, month or day
+	ErrInvalidPeriod = errors.New("The period must be year, month or day")
+	// ErrInvalidTransaction is returned when a transaction has no date or no
+	// amount
+	ErrInvalidTransaction = errors.New("The transaction must have a date and an amount")
+	// ErrMatchingNotSuggested is returned when a matching that has already
+	// been confirmed or rejected is confirmed or rejected again
+	ErrMatchingNotSuggested = errors.New("The matching has already been confirmed or rejected")
+)
@@ -0,0 +1,159 @@
+package bank
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// ImportResult is the result of the import of the transactions of an account:
+// the transactions that have been created, and the ones that have been
+// skipped as they were already known.
+type ImportResult struct {
+	Created    []*Transaction
+	Duplicates []*Transaction
+}
+
+// Import creates the transactions of an account, as sent by a konnector. The
+// konnectors often fetch the same transactions on several executions, so a
+// transaction is skipped if it is a duplicate of a known transaction of the
+// account (see fingerprint). If a balance is given, the account is updated
+// with it.
+func Import(db couchdb.Database, account *Account, docs []couchdb.JSONDoc, balance *float64) (*ImportResult, error) {
+	list := make([]*Transaction, len(docs))
+	for i := range docs {
+		doc := &docs[i]
+		doc.Type = consts.BankOperations
+		delete(doc.M, "_id")
+		delete(doc.M, "_rev")
+		doc.M["account"] = account.DocID
+		tx, err := parseTransaction(doc)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = tx
+	}
+
+	known, err := knownTransactions(db, account, list)
+	if err != nil {
+		return nil, err
+	}
+	res := &ImportResult{}
+	for i, tx := range list {
+		fp := tx.fingerprint()
+		if dups := known[fp]; len(dups) > 0 {
+			res.Duplicates = append(res.Duplicates, dups[0])
+			known[fp] = dups[1:]
+			continue
+		}
+		if err := couchdb.CreateDoc(db, &docs[i]); err != nil {
+			return nil, err
+		}
+		tx.DocID = docs[i].ID()
+		tx.DocRev = docs[i].Rev()
+		res.Created = append(res.Created, tx)
+	}
+
+	if balance != nil {
+		if err := updateBalance(db, account, *balance); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func parseTransaction(doc *couchdb.JSONDoc) (*Transaction, error) {
+	if _, ok := doc.M["amount"].(float64); !ok {
+		return nil, ErrInvalidTransaction
+	}
+	raw, err := json.Marshal(doc.M)
+	if err != nil {
+		return nil, err
+	}
+	tx := &Transaction{}
+	if err := json.Unmarshal(raw, tx); err != nil {
+		return nil, ErrInvalidTransaction
+	}
+	if _, err := time.Parse(dateFormat, tx.Day()); err != nil {
+		return nil, ErrInvalidTransaction
+	}
+	return tx, nil
+}
+
+// knownTransactions returns the transactions of the account on the days of
+// the given transactions, indexed by their fingerprint.
+func knownTransactions(db couchdb.Database, account *Account, list []*Transaction) (map[string][]*Transaction, error) {
+	known := make(map[string][]*Transaction)
+	if len(list) == 0 {
+		return known, nil
+	}
+	first, last := list[0].Day(), list[0].Day()
+	for _, tx := range list[1:] {
+		if day := tx.Day(); day < first {
+			first = day
+		} else if day > last {
+			last = day
+		}
+	}
+
+	txs, err := transactionsBetween(db, account.DocID, first, last)
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range txs {
+		fp := tx.fingerprint()
+		known[fp] = append(known[fp], tx)
+	}
+	return known, nil
+}
+
+// transactionsBetween returns the transactions of an account between the two
+// days (included).
+func transactionsBetween(db couchdb.Database, accountID, first, last string) ([]*Transaction, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.BankOperationsByAccountAndDate, &couchdb.ViewRequest{
+		StartKey:    dayKey(accountID, first),
+		EndKey:      dayKey(accountID, last),
+		IncludeDocs: true,
+		Reduce:      false,
+	}, &res)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	list := make([]*Transaction, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var tx Transaction
+		if err := json.Unmarshal(row.Doc, &tx); err != nil {
+			return nil, err
+		}
+		list = append(list, &tx)
+	}
+	return list, nil
+}
+
+// dayKey returns the key of the BankOperationsByAccountAndDate view for a day
+func dayKey(accountID, day string) []string {
+	return []string{accountID, day[0:4], day[5:7], day[8:10]}
+}
+
+// updateBalance saves the new balance of the account, without losing the
+// fields of the document that are not in the Account struct.
+func updateBalance(db couchdb.Database, account *Account, balance float64) error {
+	var doc couchdb.JSONDoc
+	if err := couchdb.GetDoc(db, consts.BankAccounts, account.DocID, &doc); err != nil {
+		return err
+	}
+	doc.Type = consts.BankAccounts
+	doc.M["balance"] = balance
+	if err := couchdb.UpdateDoc(db, &doc); err != nil {
+		return err
+	}
+	account.Balance = balance
+	account.DocRev = doc.Rev()
+	return nil
+}
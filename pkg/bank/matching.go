@@ -0,0 +1,397 @@
+package bank
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+const (
+	// MatchingSuggested is the state of a matching found by the stack, that
+	// has not been confirmed or rejected by the user.
+	MatchingSuggested = "suggested"
+	// MatchingConfirmed is the state of a matching confirmed by the user: the
+	// transaction has a relationship to the bill.
+	MatchingConfirmed = "confirmed"
+	// MatchingRejected is the state of a matching rejected by the user, or of
+	// the other suggestions for a bill when a matching is confirmed. They are
+	// kept to not suggest them again.
+	MatchingRejected = "rejected"
+)
+
+// matchingDateWindow is the maximal number of days between the date of a bill
+// and the date of a transaction for them to be matched.
+const matchingDateWindow = 15
+
+// maxSuggestionsPerBill is the maximal number of transactions suggested for a
+// bill.
+const maxSuggestionsPerBill = 3
+
+// Bill is a bill fetched by a konnector, with its file in the invoice field
+// (like io.cozy.files:<id>). The amount is positive, and IsRefund is true for
+// a refund.
+type Bill struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	Amount   float64 `json:"amount"`
+	Date     string  `json:"date"`
+	Vendor   string  `json:"vendor,omitempty"`
+	IsRefund bool    `json:"isRefund,omitempty"`
+	Invoice  string  `json:"invoice,omitempty"`
+}
+
+// ID returns the bill qualified identifier
+func (b *Bill) ID() string { return b.DocID }
+
+// Rev returns the bill revision
+func (b *Bill) Rev() string { return b.DocRev }
+
+// DocType returns the bill document type
+func (b *Bill) DocType() string { return consts.Bills }
+
+// Clone implements couchdb.Doc
+func (b *Bill) Clone() couchdb.Doc {
+	cloned := *b
+	return &cloned
+}
+
+// SetID changes the bill qualified identifier
+func (b *Bill) SetID(id string) { b.DocID = id }
+
+// SetRev changes the bill revision
+func (b *Bill) SetRev(rev string) { b.DocRev = rev }
+
+// Matching is a link between a bill and a bank transaction, suggested by the
+// stack and then confirmed or rejected by the user.
+type Matching struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	Bill        string    `json:"bill"`
+	Transaction string    `json:"transaction"`
+	Score       float64   `json:"score"`
+	State       string    `json:"state"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ID returns the matching qualified identifier
+func (m *Matching) ID() string { return m.DocID }
+
+// Rev returns the matching revision
+func (m *Matching) Rev() string { return m.DocRev }
+
+// DocType returns the matching document type
+func (m *Matching) DocType() string { return consts.BankMatchings }
+
+// Clone implements couchdb.Doc
+func (m *Matching) Clone() couchdb.Doc {
+	cloned := *m
+	return &cloned
+}
+
+// SetID changes the matching qualified identifier
+func (m *Matching) SetID(id string) { m.DocID = id }
+
+// SetRev changes the matching revision
+func (m *Matching) SetRev(rev string) { m.DocRev = rev }
+
+// GetAllBills returns all the bills.
+func GetAllBills(db couchdb.Database) ([]*Bill, error) {
+	var list []*Bill
+	err := couchdb.ForeachDocs(db, consts.Bills, func(_ string, raw json.RawMessage) error {
+		var b Bill
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return err
+		}
+		list = append(list, &b)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// billsBetween returns the bills between the two days (included).
+func billsBetween(db couchdb.Database, first, last string) ([]*Bill, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.BillsByDate, &couchdb.ViewRequest{
+		StartKey:    first,
+		EndKey:      last,
+		IncludeDocs: true,
+	}, &res)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	list := make([]*Bill, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var b Bill
+		if err := json.Unmarshal(row.Doc, &b); err != nil {
+			return nil, err
+		}
+		list = append(list, &b)
+	}
+	return list, nil
+}
+
+// GetMatching returns the matching with the given identifier.
+func GetMatching(db couchdb.Database, id string) (*Matching, error) {
+	m := &Matching{}
+	if err := couchdb.GetDoc(db, consts.BankMatchings, id, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetMatchings returns the matchings in the given state, or all the matchings
+// if the state is empty.
+func GetMatchings(db couchdb.Database, state string) ([]*Matching, error) {
+	var list []*Matching
+	err := couchdb.ForeachDocs(db, consts.BankMatchings, func(_ string, raw json.RawMessage) error {
+		var m Matching
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		if state == "" || m.State == state {
+			list = append(list, &m)
+		}
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// MatchTransactions looks for the bills that can be matched with the given
+// transactions, typically the ones that have just been imported, and suggests
+// the matchings for them.
+func MatchTransactions(db couchdb.Database, created []*Transaction) ([]*Matching, error) {
+	if len(created) == 0 {
+		return nil, nil
+	}
+	var first, last time.Time
+	for _, tx := range created {
+		day, err := time.Parse(dateFormat, tx.Day())
+		if err != nil {
+			continue
+		}
+		if first.IsZero() || day.Before(first) {
+			first = day
+		}
+		if last.IsZero() || day.After(last) {
+			last = day
+		}
+	}
+	if first.IsZero() {
+		return nil, nil
+	}
+	bills, err := billsBetween(db,
+		first.AddDate(0, 0, -matchingDateWindow).Format(dateFormat),
+		last.AddDate(0, 0, matchingDateWindow).Format(dateFormat))
+	if err != nil {
+		return nil, err
+	}
+	return MatchBills(db, bills)
+}
+
+// MatchBills suggests the matchings between the given bills and the bank
+// transactions. The candidates for a bill are the transactions with the same
+// amount (a debit, or a credit for a refund) and a date close to the date of
+// the bill. They are scored by the distance between the dates and by the
+// vendor of the bill being in the label of the transaction, and the best ones
+// are suggested. The bills with a confirmed matching are skipped, and a
+// matching is never suggested twice, even if it has been rejected.
+func MatchBills(db couchdb.Database, bills []*Bill) ([]*Matching, error) {
+	existing, err := GetMatchings(db, "")
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	confirmed := make(map[string]bool)
+	for _, m := range existing {
+		known[m.Bill+"/"+m.Transaction] = true
+		if m.State == MatchingConfirmed {
+			confirmed[m.Bill] = true
+		}
+	}
+	accounts, err := GetAllAccounts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var created []*Matching
+	for _, bill := range bills {
+		if confirmed[bill.DocID] {
+			continue
+		}
+		day, err := time.Parse(dateFormat, dayOf(bill.Date))
+		if err != nil {
+			continue
+		}
+		first := day.AddDate(0, 0, -matchingDateWindow).Format(dateFormat)
+		last := day.AddDate(0, 0, matchingDateWindow).Format(dateFormat)
+
+		var candidates []*Matching
+		for _, account := range accounts {
+			txs, err := transactionsBetween(db, account.DocID, first, last)
+			if err != nil {
+				return nil, err
+			}
+			for _, tx := range txs {
+				if known[bill.DocID+"/"+tx.DocID] {
+					continue
+				}
+				if score, ok := matchingScore(bill, tx); ok {
+					candidates = append(candidates, &Matching{
+						Bill:        bill.DocID,
+						Transaction: tx.DocID,
+						Score:       score,
+						State:       MatchingSuggested,
+					})
+				}
+			}
+		}
+
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].Score > candidates[j].Score
+		})
+		if len(candidates) > maxSuggestionsPerBill {
+			candidates = candidates[:maxSuggestionsPerBill]
+		}
+		for _, m := range candidates {
+			m.CreatedAt = time.Now()
+			if err := couchdb.CreateDoc(db, m); err != nil {
+				return nil, err
+			}
+			known[m.Bill+"/"+m.Transaction] = true
+			created = append(created, m)
+		}
+	}
+	return created, nil
+}
+
+// matchingScore returns a score between 0 and 1 for the matching of a bill
+// with a transaction, and false if they can't be matched.
+func matchingScore(bill *Bill, tx *Transaction) (float64, bool) {
+	expected := -bill.Amount
+	if bill.IsRefund {
+		expected = bill.Amount
+	}
+	if math.Abs(tx.Amount-expected) >= 0.005 {
+		return 0, false
+	}
+	billDay, err := time.Parse(dateFormat, dayOf(bill.Date))
+	if err != nil {
+		return 0, false
+	}
+	txDay, err := time.Parse(dateFormat, tx.Day())
+	if err != nil {
+		return 0, false
+	}
+	days := math.Abs(txDay.Sub(billDay).Hours() / 24)
+	if days > matchingDateWindow {
+		return 0, false
+	}
+	score := 0.5 + 0.3*(1-days/matchingDateWindow)
+	if vendor := normalizeLabel(bill.Vendor); vendor != "" {
+		if strings.Contains(normalizeLabel(tx.Label), vendor) {
+			score += 0.2
+		}
+	}
+	return roundAmount(score), true
+}
+
+// normalizeLabel returns the label in lower case, with only the letters and
+// the digits, separated by a space.
+func normalizeLabel(label string) string {
+	words := strings.FieldsFunc(strings.ToLower(label), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// ConfirmMatching confirms a suggested matching: a relationship to the bill is
+// added to the transaction, and the other suggestions for the bill are
+// rejected.
+func ConfirmMatching(db couchdb.Database, m *Matching) error {
+	if m.State != MatchingSuggested {
+		return ErrMatchingNotSuggested
+	}
+	var doc couchdb.JSONDoc
+	if err := couchdb.GetDoc(db, consts.BankOperations, m.Transaction, &doc); err != nil {
+		return err
+	}
+	doc.Type = consts.BankOperations
+	addBillRelationship(&doc, m.Bill)
+	if err := couchdb.UpdateDoc(db, &doc); err != nil {
+		return err
+	}
+
+	m.State = MatchingConfirmed
+	if err := couchdb.UpdateDoc(db, m); err != nil {
+		return err
+	}
+	others, err := GetMatchings(db, MatchingSuggested)
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other.Bill == m.Bill {
+			other.State = MatchingRejected
+			if err := couchdb.UpdateDoc(db, other); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RejectMatching rejects a suggested matching.
+func RejectMatching(db couchdb.Database, m *Matching) error {
+	if m.State != MatchingSuggested {
+		return ErrMatchingNotSuggested
+	}
+	m.State = MatchingRejected
+	return couchdb.UpdateDoc(db, m)
+}
+
+// addBillRelationship adds a reference to the bill in the bills relationship
+// of a transaction, if it is not already there.
+func addBillRelationship(doc *couchdb.JSONDoc, billID string) {
+	rels, ok := doc.M["relationships"].(map[string]interface{})
+	if !ok {
+		rels = make(map[string]interface{})
+	}
+	bills, ok := rels["bills"].(map[string]interface{})
+	if !ok {
+		bills = make(map[string]interface{})
+	}
+	data, _ := bills["data"].([]interface{})
+	for _, ref := range data {
+		if r, ok := ref.(map[string]interface{}); ok && r["id"] == billID {
+			return
+		}
+	}
+	bills["data"] = append(data, map[string]interface{}{
+		"id":   billID,
+		"type": consts.Bills,
+	})
+	rels["bills"] = bills
+	doc.M["relationships"] = rels
+}
+
+var (
+	_ couchdb.Doc = &Bill{}
+	_ couchdb.Doc = &Matching{}
+)
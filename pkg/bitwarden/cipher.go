@@ -0,0 +1,160 @@
+package bitwarden
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// CipherType is the type of an item of the vault
+type CipherType int
+
+const (
+	// LoginType is for the logins, with a username and a password
+	LoginType CipherType = 1
+	// SecureNoteType is for the secure notes
+	SecureNoteType CipherType = 2
+	// CardType is for the payment cards
+	CardType CipherType = 3
+	// IdentityType is for the identities
+	IdentityType CipherType = 4
+)
+
+// Cipher is an item of the vault. The name, the notes and the fields of the
+// data are encrypted by the clients as cipher strings, and the stack doesn't
+// look inside them: the data is the login, the secure note, the card or the
+// identity, depending of the type, as sent by the client.
+type Cipher struct {
+	DocID           string          `json:"_id,omitempty"`
+	DocRev          string          `json:"_rev,omitempty"`
+	Type            CipherType      `json:"type"`
+	FolderID        string          `json:"folder_id,omitempty"`
+	Favorite        bool            `json:"favorite,omitempty"`
+	Name            string          `json:"name"`
+	Notes           string          `json:"notes,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	Fields          json.RawMessage `json:"fields,omitempty"`
+	PasswordHistory json.RawMessage `json:"password_history,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+}
+
+// ID returns the cipher qualified identifier
+func (c *Cipher) ID() string { return c.DocID }
+
+// Rev returns the cipher revision
+func (c *Cipher) Rev() string { return c.DocRev }
+
+// DocType returns the cipher document type
+func (c *Cipher) DocType() string { return consts.BitwardenCiphers }
+
+// Clone implements couchdb.Doc
+func (c *Cipher) Clone() couchdb.Doc {
+	cloned := *c
+	cloned.Data = cloneRaw(c.Data)
+	cloned.Fields = cloneRaw(c.Fields)
+	cloned.PasswordHistory = cloneRaw(c.PasswordHistory)
+	return &cloned
+}
+
+// SetID changes the cipher qualified identifier
+func (c *Cipher) SetID(id string) { c.DocID = id }
+
+// SetRev changes the cipher revision
+func (c *Cipher) SetRev(rev string) { c.DocRev = rev }
+
+func cloneRaw(raw json.RawMessage) json.RawMessage {
+	if raw == nil {
+		return nil
+	}
+	cloned := make(json.RawMessage, len(raw))
+	copy(cloned, raw)
+	return cloned
+}
+
+func (c *Cipher) validate(db prefixer.Prefixer) error {
+	if c.Name == "" {
+		return ErrMissingName
+	}
+	if c.Type < LoginType || c.Type > IdentityType {
+		return ErrInvalidType
+	}
+	if c.FolderID != "" {
+		if _, err := FindFolder(db, c.FolderID); err != nil {
+			if couchdb.IsNotFoundError(err) {
+				return ErrUnknownFolder
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateCipher saves a new item in the vault
+func CreateCipher(inst *instance.Instance, c *Cipher) error {
+	if err := c.validate(inst); err != nil {
+		return err
+	}
+	c.DocID = ""
+	c.DocRev = ""
+	c.CreatedAt = time.Now().UTC()
+	c.UpdatedAt = c.CreatedAt
+	if err := couchdb.CreateDoc(inst, c); err != nil {
+		return err
+	}
+	touch(inst, c.UpdatedAt)
+	return nil
+}
+
+// UpdateCipher replaces an item of the vault by its new version
+func UpdateCipher(inst *instance.Instance, c, old *Cipher) error {
+	if err := c.validate(inst); err != nil {
+		return err
+	}
+	c.DocID = old.DocID
+	c.DocRev = old.DocRev
+	c.CreatedAt = old.CreatedAt
+	c.UpdatedAt = time.Now().UTC()
+	if err := couchdb.UpdateDoc(inst, c); err != nil {
+		return err
+	}
+	touch(inst, c.UpdatedAt)
+	return nil
+}
+
+// DeleteCipher removes an item from the vault
+func DeleteCipher(inst *instance.Instance, c *Cipher) error {
+	if err := couchdb.DeleteDoc(inst, c); err != nil {
+		return err
+	}
+	touch(inst, time.Now().UTC())
+	return nil
+}
+
+// FindCipher returns the item of the vault with the given identifier
+func FindCipher(db prefixer.Prefixer, id string) (*Cipher, error) {
+	c := &Cipher{}
+	err := couchdb.GetDoc(db, consts.BitwardenCiphers, id, c)
+	return c, err
+}
+
+// GetAllCiphers returns all the items of the vault
+func GetAllCiphers(db couchdb.Database) ([]*Cipher, error) {
+	var list []*Cipher
+	err := couchdb.ForeachDocs(db, consts.BitwardenCiphers, func(_ string, raw json.RawMessage) error {
+		var c Cipher
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return err
+		}
+		list = append(list, &c)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
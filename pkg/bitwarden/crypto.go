@@ -0,0 +1,141 @@
+package bitwarden
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The Bitwarden clients derive the keys from the master password with
+// PBKDF2-SHA256, and the cipher strings of type 2 are encrypted with
+// AES-256-CBC and authenticated with HMAC-SHA256.
+const (
+	keyLen            = 32
+	symmetricKeyLen   = 2 * keyLen
+	cipherStringType2 = "2"
+)
+
+// MasterKey derives the master key from the master password, the same way
+// the Bitwarden clients do: the salt is the email and the iterations are
+// given by the KDF parameters of the profile.
+func MasterKey(password []byte, email string, iterations int) []byte {
+	salt := []byte(strings.ToLower(strings.TrimSpace(email)))
+	return pbkdf2.Key(password, salt, iterations, keyLen, sha256.New)
+}
+
+// HashPassword returns the hash of the master password that the clients
+// send to the server to log in. The master password never leaves the client.
+func HashPassword(masterKey, password []byte) string {
+	hash := pbkdf2.Key(masterKey, password, 1, keyLen, sha256.New)
+	return base64.StdEncoding.EncodeToString(hash)
+}
+
+// stretchKey expands a 256 bits key to the encryption and MAC keys.
+func stretchKey(key []byte) (encKey, macKey []byte, err error) {
+	encKey = make([]byte, keyLen)
+	if _, err = io.ReadFull(hkdf.Expand(sha256.New, key, []byte("enc")), encKey); err != nil {
+		return nil, nil, err
+	}
+	macKey = make([]byte, keyLen)
+	if _, err = io.ReadFull(hkdf.Expand(sha256.New, key, []byte("mac")), macKey); err != nil {
+		return nil, nil, err
+	}
+	return encKey, macKey, nil
+}
+
+// EncryptWithMasterKey encrypts the payload with the keys stretched from the
+// master key, and returns it as a cipher string of type 2.
+func EncryptWithMasterKey(masterKey, payload []byte) (string, error) {
+	encKey, macKey, err := stretchKey(masterKey)
+	if err != nil {
+		return "", err
+	}
+	return encrypt(encKey, macKey, payload)
+}
+
+// DecryptWithMasterKey decrypts a cipher string of type 2 that has been
+// encrypted with the keys stretched from the master key.
+func DecryptWithMasterKey(masterKey []byte, cipherString string) ([]byte, error) {
+	encKey, macKey, err := stretchKey(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(encKey, macKey, cipherString)
+}
+
+// generateSymmetricKey returns a new random key for the vault, with the
+// encryption key and the MAC key concatenated.
+func generateSymmetricKey() []byte {
+	return crypto.GenerateRandomBytes(symmetricKeyLen)
+}
+
+func encrypt(encKey, macKey, payload []byte) (string, error) {
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return "", err
+	}
+	iv := crypto.GenerateRandomBytes(aes.BlockSize)
+	padding := aes.BlockSize - len(payload)%aes.BlockSize
+	padded := make([]byte, len(payload), len(payload)+padding)
+	copy(padded, payload)
+	padded = append(padded, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	encrypted := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, padded)
+	mac := computeMAC(macKey, iv, encrypted)
+	return cipherStringType2 + "." +
+		base64.StdEncoding.EncodeToString(iv) + "|" +
+		base64.StdEncoding.EncodeToString(encrypted) + "|" +
+		base64.StdEncoding.EncodeToString(mac), nil
+}
+
+func decrypt(encKey, macKey []byte, cipherString string) ([]byte, error) {
+	parts := strings.SplitN(cipherString, ".", 2)
+	if len(parts) != 2 || parts[0] != cipherStringType2 {
+		return nil, ErrInvalidCipherString
+	}
+	pieces := strings.Split(parts[1], "|")
+	if len(pieces) != 3 {
+		return nil, ErrInvalidCipherString
+	}
+	var decoded [3][]byte
+	for i, piece := range pieces {
+		var err error
+		if decoded[i], err = base64.StdEncoding.DecodeString(piece); err != nil {
+			return nil, ErrInvalidCipherString
+		}
+	}
+	iv, encrypted, mac := decoded[0], decoded[1], decoded[2]
+	if !hmac.Equal(mac, computeMAC(macKey, iv, encrypted)) {
+		return nil, ErrInvalidCipherString
+	}
+	if len(iv) != aes.BlockSize || len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 {
+		return nil, ErrInvalidCipherString
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, ErrInvalidCipherString
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+func computeMAC(macKey, iv, encrypted []byte) []byte {
+	h := hmac.New(sha256.New, macKey)
+	h.Write(iv)
+	h.Write(encrypted)
+	return h.Sum(nil)
+}
@@ -0,0 +1,37 @@
+package bitwarden
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashPassword(t *testing.T) {
+	masterKey := MasterKey([]byte("cozy"), " Me@Alice.cozy.example", 5000)
+	assert.Equal(t, "b560ba37166db6c2d2da195aea98207439b1dd4c71aa77f09cf0c0a1792b01e0", hex.EncodeToString(masterKey))
+	assert.Equal(t, "DbqrX8QmZDbMYTU0SKNUT8/1KDPLK26aDUTG+0OUbI0=", HashPassword(masterKey, []byte("cozy")))
+}
+
+func TestEncryptWithMasterKey(t *testing.T) {
+	masterKey := MasterKey([]byte("cozy"), "me@alice.cozy.example", 5000)
+	symKey := generateSymmetricKey()
+	encrypted, err := EncryptWithMasterKey(masterKey, symKey)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encrypted, "2."))
+	assert.Len(t, strings.Split(encrypted, "|"), 3)
+
+	decrypted, err := DecryptWithMasterKey(masterKey, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, symKey, decrypted)
+
+	otherKey := MasterKey([]byte("other"), "me@alice.cozy.example", 5000)
+	_, err = DecryptWithMasterKey(otherKey, encrypted)
+	assert.Equal(t, ErrInvalidCipherString, err)
+
+	_, err = DecryptWithMasterKey(masterKey, "0."+encrypted[2:])
+	assert.Equal(t, ErrInvalidCipherString, err)
+	_, err = DecryptWithMasterKey(masterKey, "2.foo|bar")
+	assert.Equal(t, ErrInvalidCipherString, err)
+}
@@ -0,0 +1,21 @@
+package bitwarden
+
+import "errors"
+
+var (
+	// ErrInvalidCipherString is used when a cipher string can't be decrypted
+	ErrInvalidCipherString = errors.New("Invalid cipher string")
+	// ErrInvalidPassword is used when the hashed master password is not the
+	// expected one
+	ErrInvalidPassword = errors.New("Invalid master password")
+	// ErrNoProfile is used when the vault has not been initialized, ie the
+	// user has not logged in on the cozy since the vault exists
+	ErrNoProfile = errors.New("The vault has not been initialized")
+	// ErrMissingName is used when a cipher or a folder has no name
+	ErrMissingName = errors.New("The name is mandatory")
+	// ErrInvalidType is used when the type of a cipher is not known
+	ErrInvalidType = errors.New("Invalid cipher type")
+	// ErrUnknownFolder is used when a cipher is put in a folder that doesn't
+	// exist
+	ErrUnknownFolder = errors.New("The folder doesn't exist")
+)
@@ -0,0 +1,119 @@
+package bitwarden
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// Folder is a folder of the vault, to organize the items. Its name is
+// encrypted by the clients.
+type Folder struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ID returns the folder qualified identifier
+func (f *Folder) ID() string { return f.DocID }
+
+// Rev returns the folder revision
+func (f *Folder) Rev() string { return f.DocRev }
+
+// DocType returns the folder document type
+func (f *Folder) DocType() string { return consts.BitwardenFolders }
+
+// Clone implements couchdb.Doc
+func (f *Folder) Clone() couchdb.Doc {
+	cloned := *f
+	return &cloned
+}
+
+// SetID changes the folder qualified identifier
+func (f *Folder) SetID(id string) { f.DocID = id }
+
+// SetRev changes the folder revision
+func (f *Folder) SetRev(rev string) { f.DocRev = rev }
+
+// CreateFolder creates a folder with the given encrypted name
+func CreateFolder(inst *instance.Instance, name string) (*Folder, error) {
+	if name == "" {
+		return nil, ErrMissingName
+	}
+	now := time.Now().UTC()
+	f := &Folder{Name: name, CreatedAt: now, UpdatedAt: now}
+	if err := couchdb.CreateDoc(inst, f); err != nil {
+		return nil, err
+	}
+	touch(inst, now)
+	return f, nil
+}
+
+// Rename changes the encrypted name of the folder
+func (f *Folder) Rename(inst *instance.Instance, name string) error {
+	if name == "" {
+		return ErrMissingName
+	}
+	f.Name = name
+	f.UpdatedAt = time.Now().UTC()
+	if err := couchdb.UpdateDoc(inst, f); err != nil {
+		return err
+	}
+	touch(inst, f.UpdatedAt)
+	return nil
+}
+
+// DeleteFolder removes a folder. The items inside it are kept, but moved out
+// of the folder.
+func DeleteFolder(inst *instance.Instance, f *Folder) error {
+	ciphers, err := GetAllCiphers(inst)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, c := range ciphers {
+		if c.FolderID != f.DocID {
+			continue
+		}
+		c.FolderID = ""
+		c.UpdatedAt = now
+		if err = couchdb.UpdateDoc(inst, c); err != nil {
+			return err
+		}
+	}
+	if err = couchdb.DeleteDoc(inst, f); err != nil {
+		return err
+	}
+	touch(inst, now)
+	return nil
+}
+
+// FindFolder returns the folder with the given identifier
+func FindFolder(db prefixer.Prefixer, id string) (*Folder, error) {
+	f := &Folder{}
+	err := couchdb.GetDoc(db, consts.BitwardenFolders, id, f)
+	return f, err
+}
+
+// GetAllFolders returns all the folders of the vault
+func GetAllFolders(db couchdb.Database) ([]*Folder, error) {
+	var list []*Folder
+	err := couchdb.ForeachDocs(db, consts.BitwardenFolders, func(_ string, raw json.RawMessage) error {
+		var f Folder
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return err
+		}
+		list = append(list, &f)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,259 @@
+// Package bitwarden is for the password vault, compatible with the official
+// Bitwarden clients. The vault items are encrypted on the clients, with a key
+// derived from the master password, which is the passphrase of the cozy. The
+// stack only stores the encrypted items and checks the hashed master password
+// when a client logs in.
+package bitwarden
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// KdfPBKDF2 is the identifier of PBKDF2-SHA256 for the key derivation
+// function, the only one supported by the stack.
+const KdfPBKDF2 = 0
+
+// DefaultKdfIterations is the number of iterations of PBKDF2 used by the
+// clients to derive the master key from the master password.
+const DefaultKdfIterations = 100000
+
+// KdfIterations returns the number of iterations of PBKDF2 for a new master
+// key of the instance: the kdf_iterations of its context, or else the default
+// number of iterations.
+func KdfIterations(inst *instance.Instance) int {
+	context, err := inst.SettingsContext()
+	if err != nil {
+		return DefaultKdfIterations
+	}
+	switch n := context["kdf_iterations"].(type) {
+	case int:
+		if n > 0 {
+			return n
+		}
+	case float64:
+		if n > 0 {
+			return int(n)
+		}
+	}
+	return DefaultKdfIterations
+}
+
+// SoftwareIDPrefix is the prefix of the software_id of the OAuth clients
+// registered for the Bitwarden clients.
+const SoftwareIDPrefix = "github.com/bitwarden/"
+
+// profileID is the identifier of the single profile document
+const profileID = "profile"
+
+// Profile is the document with the keys of the vault. The symmetric key,
+// used to encrypt the items, is itself encrypted with the master key. The
+// private key is encrypted with the symmetric key by the clients.
+type Profile struct {
+	DocID          string    `json:"_id,omitempty"`
+	DocRev         string    `json:"_rev,omitempty"`
+	PassphraseHash []byte    `json:"passphrase_hash"`
+	KdfIterations  int       `json:"kdf_iterations"`
+	Key            string    `json:"key"`
+	PublicKey      string    `json:"public_key,omitempty"`
+	PrivateKey     string    `json:"private_key,omitempty"`
+	SecurityStamp  string    `json:"security_stamp"`
+	RevisionDate   time.Time `json:"revision_date"`
+}
+
+// ID returns the profile qualified identifier
+func (p *Profile) ID() string { return p.DocID }
+
+// Rev returns the profile revision
+func (p *Profile) Rev() string { return p.DocRev }
+
+// DocType returns the profile document type
+func (p *Profile) DocType() string { return consts.BitwardenProfiles }
+
+// Clone implements couchdb.Doc
+func (p *Profile) Clone() couchdb.Doc {
+	cloned := *p
+	cloned.PassphraseHash = make([]byte, len(p.PassphraseHash))
+	copy(cloned.PassphraseHash, p.PassphraseHash)
+	return &cloned
+}
+
+// SetID changes the profile qualified identifier
+func (p *Profile) SetID(id string) { p.DocID = id }
+
+// SetRev changes the profile revision
+func (p *Profile) SetRev(rev string) { p.DocRev = rev }
+
+// Email returns the email used by the Bitwarden clients to log in on the
+// instance. It is also the salt of the master key.
+func Email(inst *instance.Instance) string {
+	domain := strings.Split(inst.Domain, ":")[0]
+	return "me@" + domain
+}
+
+// GetProfile returns the profile of the vault, or ErrNoProfile if the vault
+// has not been initialized.
+func GetProfile(db prefixer.Prefixer) (*Profile, error) {
+	p := &Profile{}
+	if err := couchdb.GetDoc(db, consts.BitwardenProfiles, profileID, p); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil, ErrNoProfile
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// CheckPassword checks the hashed master password sent by a client.
+func (p *Profile) CheckPassword(hashed string) error {
+	if len(p.PassphraseHash) == 0 || hashed == "" {
+		return ErrInvalidPassword
+	}
+	if _, err := crypto.CompareHashAndPassphrase(p.PassphraseHash, []byte(hashed)); err != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// InitProfile creates the profile of the vault from the passphrase of the
+// cozy, if it does not exist yet. It is called when the user logs in, as it
+// is the only moment where the stack knows the passphrase.
+func InitProfile(inst *instance.Instance, pass []byte) error {
+	_, err := GetProfile(inst)
+	if err != ErrNoProfile {
+		return err
+	}
+	return ResetProfile(inst, pass)
+}
+
+// ResetProfile generates new keys for the vault. As the items encrypted with
+// the previous key can't be decrypted anymore, they are deleted, and the
+// Bitwarden clients are revoked.
+func ResetProfile(inst *instance.Instance, pass []byte) error {
+	p, err := GetProfile(inst)
+	if err == ErrNoProfile {
+		p = &Profile{DocID: profileID}
+	} else if err != nil {
+		return err
+	}
+	for _, doctype := range []string{consts.BitwardenCiphers, consts.BitwardenFolders} {
+		if err = couchdb.DeleteDB(inst, doctype); err != nil && !couchdb.IsNotFoundError(err) {
+			return err
+		}
+	}
+	p.KdfIterations = KdfIterations(inst)
+	p.PublicKey = ""
+	p.PrivateKey = ""
+	if err = p.setKey(Email(inst), pass, generateSymmetricKey()); err != nil {
+		return err
+	}
+	if p.DocRev == "" {
+		err = couchdb.CreateNamedDocWithDB(inst, p)
+	} else {
+		err = couchdb.UpdateDoc(inst, p)
+	}
+	if err != nil {
+		return err
+	}
+	return revokeClients(inst)
+}
+
+// ChangeMasterPassword is called when the passphrase of the cozy is changed.
+// The symmetric key is kept and encrypted with the new master key, and the
+// Bitwarden clients are revoked as they must log in again. If the symmetric
+// key can't be decrypted with the current passphrase, the vault is reset.
+func ChangeMasterPassword(inst *instance.Instance, pass, current []byte) error {
+	p, err := GetProfile(inst)
+	if err == ErrNoProfile {
+		return ResetProfile(inst, pass)
+	} else if err != nil {
+		return err
+	}
+	email := Email(inst)
+	oldKey := MasterKey(current, email, p.KdfIterations)
+	symKey, err := DecryptWithMasterKey(oldKey, p.Key)
+	if err != nil || len(symKey) != symmetricKeyLen {
+		inst.Logger().WithField("nspace", "bitwarden").
+			Infof("Cannot decrypt the vault key, the vault is reset")
+		return ResetProfile(inst, pass)
+	}
+	// The new master key is derived with the number of iterations of the
+	// context, as the clients must log in again
+	p.KdfIterations = KdfIterations(inst)
+	if err = p.setKey(email, pass, symKey); err != nil {
+		return err
+	}
+	if err = couchdb.UpdateDoc(inst, p); err != nil {
+		return err
+	}
+	return revokeClients(inst)
+}
+
+// setKey encrypts the symmetric key with the master key derived from the
+// given passphrase, and updates the password hash and the security stamp.
+func (p *Profile) setKey(email string, pass, symKey []byte) error {
+	masterKey := MasterKey(pass, email, p.KdfIterations)
+	key, err := EncryptWithMasterKey(masterKey, symKey)
+	if err != nil {
+		return err
+	}
+	hash, err := crypto.GenerateFromPassphrase([]byte(HashPassword(masterKey, pass)))
+	if err != nil {
+		return err
+	}
+	p.Key = key
+	p.PassphraseHash = hash
+	p.SecurityStamp = crypto.GenerateRandomString(16)
+	p.RevisionDate = time.Now().UTC()
+	return nil
+}
+
+// SetKeyPair saves the RSA keys generated by a client. The private key is
+// encrypted with the symmetric key.
+func (p *Profile) SetKeyPair(inst *instance.Instance, publicKey, privateKey string) error {
+	p.PublicKey = publicKey
+	p.PrivateKey = privateKey
+	p.RevisionDate = time.Now().UTC()
+	return couchdb.UpdateDoc(inst, p)
+}
+
+// touch updates the revision date of the vault, that the clients use to know
+// if they need to synchronize.
+func touch(inst *instance.Instance, date time.Time) {
+	for i := 0; i < 3; i++ {
+		p, err := GetProfile(inst)
+		if err != nil || !p.RevisionDate.Before(date) {
+			return
+		}
+		p.RevisionDate = date
+		if err = couchdb.UpdateDoc(inst, p); err == nil || !couchdb.IsConflictError(err) {
+			return
+		}
+	}
+}
+
+// revokeClients deletes the OAuth clients of the Bitwarden clients, to force
+// them to log in again.
+func revokeClients(inst *instance.Instance) error {
+	clients, err := oauth.GetAll(inst)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+	for _, client := range clients {
+		if !strings.HasPrefix(client.SoftwareID, SoftwareIDPrefix) {
+			continue
+		}
+		if cerr := client.Delete(inst); cerr != nil {
+			inst.Logger().WithField("nspace", "bitwarden").
+				Errorf("Cannot revoke the client %s: %s", client.ID(), cerr.Error)
+		}
+	}
+	return nil
+}
@@ -41,6 +41,13 @@ func (c Cache) Set(key string, data []byte, expiration time.Duration) bool {
 	return false
 }
 
+// Clear removes the asset at the given key from the cache.
+func (c Cache) Clear(key string) {
+	if c.client != nil {
+		c.client.Del(key)
+	}
+}
+
 // GetCompressed works like Get but expect a compressed asset that is
 // uncompressed.
 func (c Cache) GetCompressed(key string) (io.Reader, bool) {
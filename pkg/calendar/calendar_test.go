@@ -0,0 +1,112 @@
+package calendar
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const ics = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Example//Example//EN\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:meeting@example.com\r\n" +
+	"DTSTAMP:20181201T100000Z\r\n" +
+	"DTSTART;TZID=Europe/Paris:20181204T100000\r\n" +
+	"DTEND;TZID=Europe/Paris:20181204T113000\r\n" +
+	"SUMMARY:Meeting\\, with Bob\r\n" +
+	"DESCRIPTION:A long description that is folded because it is longer than s\r\n" +
+	" eventy-five characters\\nwith a new line\r\n" +
+	"LOCATION:Room 1\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"ACTION:DISPLAY\r\n" +
+	"TRIGGER:-PT15M\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:holidays@example.com\r\n" +
+	"DTSTART;VALUE=DATE:20181224\r\n" +
+	"DURATION:P2D\r\n" +
+	"SUMMARY:Holidays\r\n" +
+	"RRULE:FREQ=YEARLY\r\n" +
+	"EXDATE;VALUE=DATE:20191224,20201224\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:holidays@example.com\r\n" +
+	"RECURRENCE-ID;VALUE=DATE:20211224\r\n" +
+	"DTSTART;VALUE=DATE:20211223\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseICalendar(t *testing.T) {
+	list, err := ParseICalendar(strings.NewReader(ics))
+	assert.NoError(t, err)
+	if !assert.Len(t, list, 2) {
+		return
+	}
+
+	meeting := list[0]
+	assert.Equal(t, "meeting@example.com", meeting.UID)
+	assert.Equal(t, "Meeting, with Bob", meeting.Summary)
+	assert.Equal(t, "A long description that is folded because it is longer than seventy-five characters\nwith a new line", meeting.Description)
+	assert.Equal(t, "Room 1", meeting.Location)
+	assert.Equal(t, "2018-12-04T09:00:00Z", meeting.Start)
+	assert.Equal(t, "2018-12-04T10:30:00Z", meeting.End)
+	assert.False(t, meeting.AllDay)
+
+	holidays := list[1]
+	assert.Equal(t, "2018-12-24", holidays.Start)
+	assert.Equal(t, "2018-12-26", holidays.End)
+	assert.True(t, holidays.AllDay)
+	assert.Equal(t, "FREQ=YEARLY", holidays.RRule)
+	assert.Equal(t, []string{"2019-12-24", "2020-12-24"}, holidays.ExDates)
+}
+
+func TestParseInvalidICalendar(t *testing.T) {
+	_, err := ParseICalendar(strings.NewReader("not an iCalendar"))
+	assert.Equal(t, ErrInvalidICalendar, err)
+	_, err = ParseICalendar(strings.NewReader("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VCALENDAR\r\n"))
+	assert.Equal(t, ErrInvalidICalendar, err)
+	_, err = ParseICalendar(strings.NewReader("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:42\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"))
+	assert.Equal(t, ErrMissingStart, err)
+}
+
+func TestWriteICalendar(t *testing.T) {
+	list, err := ParseICalendar(strings.NewReader(ics))
+	assert.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, WriteICalendar(buf, list))
+	out := buf.String()
+	assert.Contains(t, out, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n")
+	assert.Contains(t, out, "DTSTART:20181204T090000Z\r\n")
+	assert.Contains(t, out, "DTSTART;VALUE=DATE:20181224\r\n")
+	assert.Contains(t, out, "SUMMARY:Meeting\\, with Bob\r\n")
+	for _, line := range strings.Split(out, "\r\n") {
+		assert.True(t, len(line) <= 75, line)
+	}
+
+	// The export can be imported again without losing the fields
+	again, err := ParseICalendar(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, list, again)
+}
+
+func TestOverlaps(t *testing.T) {
+	e := &Event{Start: "2018-12-04T09:00:00Z", End: "2018-12-04T10:30:00Z"}
+	day := func(d int) time.Time { return time.Date(2018, 12, d, 0, 0, 0, 0, time.UTC) }
+	assert.True(t, e.Overlaps(day(4), day(5)))
+	assert.True(t, e.Overlaps(time.Time{}, day(5)))
+	assert.False(t, e.Overlaps(day(5), day(6)))
+	assert.False(t, e.Overlaps(day(3), day(4)))
+
+	allDay := &Event{Start: "2018-12-04", AllDay: true}
+	assert.True(t, allDay.Overlaps(day(4).Add(12*time.Hour), time.Time{}))
+	assert.False(t, allDay.Overlaps(day(5), time.Time{}))
+
+	recurring := &Event{Start: "2018-12-04", AllDay: true, RRule: "FREQ=DAILY"}
+	assert.True(t, recurring.Overlaps(day(10), day(11)))
+}
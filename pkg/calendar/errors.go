@@ -0,0 +1,13 @@
+package calendar
+
+import "errors"
+
+var (
+	// ErrInvalidICalendar is returned when a file can't be parsed as
+	// iCalendar
+	ErrInvalidICalendar = errors.New("The file is not a valid iCalendar")
+	// ErrMissingStart is returned when an event has no start date
+	ErrMissingStart = errors.New("The event has no start date")
+	// ErrNotFound is returned when no event has been found for a query
+	ErrNotFound = errors.New("No event has been found")
+)
@@ -0,0 +1,307 @@
+// Package calendar is for the io.cozy.calendar.events doctype, and its
+// conversion from and to the iCalendar format (RFC 5545).
+package calendar
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+const (
+	dateFormat     = "2006-01-02"
+	icalDateFormat = "20060102"
+	icalTimeFormat = "20060102T150405"
+	icalUTCFormat  = "20060102T150405Z"
+)
+
+// prodID is the identifier of the stack in the generated iCalendar files
+const prodID = "-//Cozy Cloud//Cozy Stack//EN"
+
+// Event is a struct containing all the informations about an event of the
+// calendar. The start and end dates are in the RFC 3339 format, in UTC, or
+// just a date (2006-01-02) for the all-day events.
+type Event struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	UID         string   `json:"uid"`
+	Summary     string   `json:"summary,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Location    string   `json:"location,omitempty"`
+	Start       string   `json:"start"`
+	End         string   `json:"end,omitempty"`
+	AllDay      bool     `json:"allDay,omitempty"`
+	RRule       string   `json:"rrule,omitempty"`
+	ExDates     []string `json:"exdates,omitempty"`
+	Status      string   `json:"status,omitempty"`
+	Sequence    int      `json:"sequence,omitempty"`
+}
+
+// ID returns the event qualified identifier
+func (e *Event) ID() string { return e.DocID }
+
+// Rev returns the event revision
+func (e *Event) Rev() string { return e.DocRev }
+
+// DocType returns the event document type
+func (e *Event) DocType() string { return consts.Events }
+
+// Clone implements couchdb.Doc
+func (e *Event) Clone() couchdb.Doc {
+	cloned := *e
+	cloned.ExDates = make([]string, len(e.ExDates))
+	copy(cloned.ExDates, e.ExDates)
+	return &cloned
+}
+
+// SetID changes the event qualified identifier
+func (e *Event) SetID(id string) { e.DocID = id }
+
+// SetRev changes the event revision
+func (e *Event) SetRev(rev string) { e.DocRev = rev }
+
+// StartTime returns the beginning of the event
+func (e *Event) StartTime() time.Time {
+	t, _ := parseEventDate(e.Start)
+	return t
+}
+
+// EndTime returns the end of the event. If the event has no end, it ends at
+// the start for an event with a time, and the day after for an all-day event.
+func (e *Event) EndTime() time.Time {
+	if e.End != "" {
+		if t, err := parseEventDate(e.End); err == nil {
+			return t
+		}
+	}
+	start := e.StartTime()
+	if e.AllDay {
+		return start.AddDate(0, 0, 1)
+	}
+	return start
+}
+
+// Overlaps returns true if the event overlaps the given time range. A zero
+// time means no limit. The recurring events are always considered to
+// overlap, as their occurrences are not expanded.
+func (e *Event) Overlaps(start, end time.Time) bool {
+	if e.RRule != "" {
+		return true
+	}
+	evStart, evEnd := e.StartTime(), e.EndTime()
+	if !end.IsZero() && !end.After(evStart) {
+		return false
+	}
+	if start.IsZero() {
+		return true
+	}
+	if evEnd.Equal(evStart) {
+		return !start.After(evStart)
+	}
+	return start.Before(evEnd)
+}
+
+func parseEventDate(value string) (time.Time, error) {
+	if len(value) == len(dateFormat) {
+		return time.Parse(dateFormat, value)
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// FromComponent builds an event from a VEVENT component
+func FromComponent(comp *Component) (*Event, error) {
+	e := &Event{
+		UID:         comp.Value("UID"),
+		Summary:     UnescapeText(comp.Value("SUMMARY")),
+		Description: UnescapeText(comp.Value("DESCRIPTION")),
+		Location:    UnescapeText(comp.Value("LOCATION")),
+		RRule:       comp.Value("RRULE"),
+		Status:      comp.Value("STATUS"),
+	}
+	if e.UID == "" {
+		e.UID = crypto.GenerateRandomString(32)
+	}
+	if seq := comp.Value("SEQUENCE"); seq != "" {
+		e.Sequence, _ = strconv.Atoi(seq)
+	}
+
+	dtstart := comp.Prop("DTSTART")
+	if dtstart == nil {
+		return nil, ErrMissingStart
+	}
+	start, allDay, err := parseICalDate(dtstart, dtstart.Value)
+	if err != nil {
+		return nil, err
+	}
+	e.Start = start
+	e.AllDay = allDay
+
+	if dtend := comp.Prop("DTEND"); dtend != nil {
+		if e.End, _, err = parseICalDate(dtend, dtend.Value); err != nil {
+			return nil, err
+		}
+	} else if duration := comp.Value("DURATION"); duration != "" {
+		d, err := parseDuration(duration)
+		if err != nil {
+			return nil, err
+		}
+		end := e.StartTime().Add(d)
+		if allDay {
+			e.End = end.Format(dateFormat)
+		} else {
+			e.End = end.UTC().Format(time.RFC3339)
+		}
+	}
+
+	for _, p := range comp.Props {
+		if p.Name != "EXDATE" {
+			continue
+		}
+		for _, value := range strings.Split(p.Value, ",") {
+			exdate, _, err := parseICalDate(p, value)
+			if err != nil {
+				return nil, err
+			}
+			e.ExDates = append(e.ExDates, exdate)
+		}
+	}
+	return e, nil
+}
+
+// parseICalDate parses a DATE or DATE-TIME value. The floating times (without
+// timezone) are considered to be in UTC.
+func parseICalDate(prop *Property, value string) (string, bool, error) {
+	if prop.Param("VALUE") == "DATE" || len(value) == len(icalDateFormat) {
+		t, err := time.Parse(icalDateFormat, value)
+		if err != nil {
+			return "", false, ErrInvalidICalendar
+		}
+		return t.Format(dateFormat), true, nil
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(icalUTCFormat, value)
+		if err != nil {
+			return "", false, ErrInvalidICalendar
+		}
+		return t.Format(time.RFC3339), false, nil
+	}
+	loc := time.UTC
+	if tzid := prop.Param("TZID"); tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation(icalTimeFormat, value, loc)
+	if err != nil {
+		return "", false, ErrInvalidICalendar
+	}
+	return t.UTC().Format(time.RFC3339), false, nil
+}
+
+var durationRegexp = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseDuration parses a DURATION value, like PT1H30M or P1D
+func parseDuration(value string) (time.Duration, error) {
+	m := durationRegexp.FindStringSubmatch(value)
+	if m == nil {
+		return 0, ErrInvalidICalendar
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, unit := range units {
+		if m[i+2] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(m[i+2])
+		if err != nil {
+			return 0, ErrInvalidICalendar
+		}
+		d += time.Duration(n) * unit
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+func icalDate(value string, allDay bool) (string, map[string]string) {
+	t, err := parseEventDate(value)
+	if err != nil {
+		return "", nil
+	}
+	if allDay {
+		return t.Format(icalDateFormat), map[string]string{"VALUE": "DATE"}
+	}
+	return t.UTC().Format(icalUTCFormat), nil
+}
+
+// ToComponent returns the event as a VEVENT component
+func (e *Event) ToComponent() *Component {
+	comp := &Component{Name: "VEVENT"}
+	comp.Add("UID", e.UID, nil)
+	comp.Add("DTSTAMP", time.Now().UTC().Format(icalUTCFormat), nil)
+	start, params := icalDate(e.Start, e.AllDay)
+	comp.Add("DTSTART", start, params)
+	if e.End != "" {
+		end, params := icalDate(e.End, e.AllDay)
+		comp.Add("DTEND", end, params)
+	}
+	comp.Add("SUMMARY", EscapeText(e.Summary), nil)
+	comp.Add("DESCRIPTION", EscapeText(e.Description), nil)
+	comp.Add("LOCATION", EscapeText(e.Location), nil)
+	comp.Add("RRULE", e.RRule, nil)
+	for _, exdate := range e.ExDates {
+		value, params := icalDate(exdate, e.AllDay)
+		comp.Add("EXDATE", value, params)
+	}
+	comp.Add("STATUS", e.Status, nil)
+	if e.Sequence > 0 {
+		comp.Add("SEQUENCE", strconv.Itoa(e.Sequence), nil)
+	}
+	return comp
+}
+
+// newCalendar returns a VCALENDAR component with the given events
+func newCalendar(events []*Event) *Component {
+	cal := &Component{Name: "VCALENDAR"}
+	cal.Add("VERSION", "2.0", nil)
+	cal.Add("PRODID", prodID, nil)
+	for _, e := range events {
+		cal.Components = append(cal.Components, e.ToComponent())
+	}
+	return cal
+}
+
+// Find returns the event stored in database from a given ID
+func Find(db prefixer.Prefixer, eventID string) (*Event, error) {
+	doc := &Event{}
+	err := couchdb.GetDoc(db, consts.Events, eventID, doc)
+	return doc, err
+}
+
+// GetAll returns all the events stored in database
+func GetAll(db couchdb.Database) ([]*Event, error) {
+	var list []*Event
+	err := couchdb.ForeachDocs(db, consts.Events, func(_ string, raw json.RawMessage) error {
+		var e Event
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return err
+		}
+		list = append(list, &e)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+var _ couchdb.Doc = &Event{}
@@ -0,0 +1,270 @@
+package calendar
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+)
+
+// maxLineLen is the maximal length of a line in an iCalendar file, before
+// folding (RFC 5545 section 3.1).
+const maxLineLen = 75
+
+// Property is a property of an iCalendar component, like DTSTART or SUMMARY.
+type Property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Param returns the value of a parameter of the property
+func (p *Property) Param(name string) string {
+	if p == nil || p.Params == nil {
+		return ""
+	}
+	return p.Params[name]
+}
+
+// Component is an iCalendar component, like VCALENDAR or VEVENT, with its
+// properties and its sub-components.
+type Component struct {
+	Name       string
+	Props      []*Property
+	Components []*Component
+}
+
+// Prop returns the first property with the given name, or nil
+func (c *Component) Prop(name string) *Property {
+	for _, p := range c.Props {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Value returns the value of the first property with the given name
+func (c *Component) Value(name string) string {
+	if p := c.Prop(name); p != nil {
+		return p.Value
+	}
+	return ""
+}
+
+// AllValues returns the values of all the properties with the given name
+func (c *Component) AllValues(name string) []string {
+	var values []string
+	for _, p := range c.Props {
+		if p.Name == name {
+			values = append(values, p.Value)
+		}
+	}
+	return values
+}
+
+// Add adds a property to the component. Nothing is added if the value is
+// empty.
+func (c *Component) Add(name, value string, params map[string]string) {
+	if value == "" {
+		return
+	}
+	c.Props = append(c.Props, &Property{Name: name, Params: params, Value: value})
+}
+
+// Decode reads the iCalendar components (usually one VCALENDAR) of a file.
+func Decode(r io.Reader) ([]*Component, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []*Component
+	var stack []*Component
+	for _, line := range lines {
+		prop, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		switch prop.Name {
+		case "BEGIN":
+			comp := &Component{Name: strings.ToUpper(prop.Value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, comp)
+			} else {
+				roots = append(roots, comp)
+			}
+			stack = append(stack, comp)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(prop.Value) {
+				return nil, ErrInvalidICalendar
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, ErrInvalidICalendar
+			}
+			comp := stack[len(stack)-1]
+			comp.Props = append(comp.Props, prop)
+		}
+	}
+	if len(stack) > 0 {
+		return nil, ErrInvalidICalendar
+	}
+	return roots, nil
+}
+
+// unfold reads the lines of the file, and joins the lines that have been
+// folded: a line starting with a space or a tab is the continuation of the
+// previous line.
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// parseLine parses a content line: NAME;PARAM=value:VALUE
+func parseLine(line string) (*Property, error) {
+	prop := &Property{}
+	i := strings.IndexAny(line, ";:")
+	if i <= 0 {
+		return nil, ErrInvalidICalendar
+	}
+	prop.Name = strings.ToUpper(line[:i])
+	for line[i] == ';' {
+		line = line[i+1:]
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			return nil, ErrInvalidICalendar
+		}
+		name := strings.ToUpper(line[:eq])
+		line = line[eq+1:]
+		var value string
+		if strings.HasPrefix(line, `"`) {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				return nil, ErrInvalidICalendar
+			}
+			value = line[1 : end+1]
+			line = line[end+2:]
+		} else {
+			end := strings.IndexAny(line, ";:")
+			if end < 0 {
+				return nil, ErrInvalidICalendar
+			}
+			value = line[:end]
+			line = line[end:]
+		}
+		if prop.Params == nil {
+			prop.Params = make(map[string]string)
+		}
+		prop.Params[name] = value
+		if line == "" {
+			return nil, ErrInvalidICalendar
+		}
+		i = 0
+	}
+	if line[i] != ':' {
+		return nil, ErrInvalidICalendar
+	}
+	prop.Value = line[i+1:]
+	return prop, nil
+}
+
+// Encode writes the components in the iCalendar format
+func Encode(w io.Writer, comps ...*Component) error {
+	for _, comp := range comps {
+		if err := encodeComponent(w, comp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeComponent(w io.Writer, comp *Component) error {
+	if err := writeLine(w, "BEGIN:"+comp.Name); err != nil {
+		return err
+	}
+	for _, prop := range comp.Props {
+		line := prop.Name
+		for _, name := range sortedKeys(prop.Params) {
+			value := prop.Params[name]
+			if strings.ContainsAny(value, ";:,") {
+				value = `"` + value + `"`
+			}
+			line += ";" + name + "=" + value
+		}
+		if err := writeLine(w, line+":"+prop.Value); err != nil {
+			return err
+		}
+	}
+	for _, sub := range comp.Components {
+		if err := encodeComponent(w, sub); err != nil {
+			return err
+		}
+	}
+	return writeLine(w, "END:"+comp.Name)
+}
+
+// writeLine writes a content line, folded if it is too long. The line is not
+// cut in the middle of a multi-bytes character.
+func writeLine(w io.Writer, line string) error {
+	limit := maxLineLen
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isRuneStart(line[cut]) {
+			cut--
+		}
+		if _, err := io.WriteString(w, line[:cut]+"\r\n "); err != nil {
+			return err
+		}
+		line = line[cut:]
+		// The space at the beginning of the next line counts
+		limit = maxLineLen - 1
+	}
+	_, err := io.WriteString(w, line+"\r\n")
+	return err
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var textEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+var textUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+// EscapeText escapes a value of type TEXT
+func EscapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+// UnescapeText unescapes a value of type TEXT
+func UnescapeText(s string) string {
+	return textUnescaper.Replace(s)
+}
@@ -0,0 +1,82 @@
+package calendar
+
+import (
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// ImportResult is the result of the import of an iCalendar file: the events
+// that have been created, and the ones that have been skipped as they are
+// already in the calendar.
+type ImportResult struct {
+	Created    []*Event
+	Duplicates []*Event
+}
+
+// ParseICalendar reads all the events of an iCalendar file. The overridden
+// occurrences of the recurring events (with a RECURRENCE-ID) are ignored.
+func ParseICalendar(r io.Reader) ([]*Event, error) {
+	comps, err := Decode(r)
+	if err != nil {
+		return nil, ErrInvalidICalendar
+	}
+	var list []*Event
+	for _, cal := range comps {
+		if cal.Name != "VCALENDAR" {
+			return nil, ErrInvalidICalendar
+		}
+		for _, comp := range cal.Components {
+			if comp.Name != "VEVENT" || comp.Prop("RECURRENCE-ID") != nil {
+				continue
+			}
+			e, err := FromComponent(comp)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, e)
+		}
+	}
+	if len(list) == 0 {
+		return nil, ErrInvalidICalendar
+	}
+	return list, nil
+}
+
+// WriteICalendar writes the given events as an iCalendar file
+func WriteICalendar(w io.Writer, events []*Event) error {
+	return Encode(w, newCalendar(events))
+}
+
+// Import parses the events of an iCalendar file and creates them in the
+// calendar. An event is skipped if there is already an event with the same
+// UID.
+func Import(db couchdb.Database, r io.Reader) (*ImportResult, error) {
+	list, err := ParseICalendar(r)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := GetAll(db)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]*Event, len(existing))
+	for _, e := range existing {
+		known[e.UID] = e
+	}
+
+	res := &ImportResult{}
+	for _, e := range list {
+		if dup, ok := known[e.UID]; ok {
+			res.Duplicates = append(res.Duplicates, dup)
+			continue
+		}
+		if err := couchdb.CreateDoc(db, e); err != nil {
+			return nil, err
+		}
+		known[e.UID] = e
+		res.Created = append(res.Created, e)
+	}
+	return res, nil
+}
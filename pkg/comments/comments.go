@@ -0,0 +1,234 @@
+// Package comments is for the comments on the documents (io.cozy.comments),
+// like the files, the photos and the notes. A comment can be the start of a
+// thread, or a reply in a thread, and it can mention some contacts.
+package comments
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// maxTextLength is the maximal length of the text of a comment, in bytes
+const maxTextLength = 10000
+
+// maxMentions is the maximal number of contacts mentioned in a comment
+const maxMentions = 20
+
+// Author is the person who has written a comment.
+type Author struct {
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+}
+
+// Comment is a comment on a document. The replies of a thread have the
+// identifier of the first comment of the thread in their parent_id.
+type Comment struct {
+	DocID     string               `json:"_id,omitempty"`
+	DocRev    string               `json:"_rev,omitempty"`
+	Target    couchdb.DocReference `json:"target"`
+	ParentID  string               `json:"parent_id,omitempty"`
+	Author    Author               `json:"author"`
+	Text      string               `json:"text"`
+	Mentions  []string             `json:"mentions,omitempty"`
+	CreatedAt time.Time            `json:"created_at"`
+	UpdatedAt time.Time            `json:"updated_at"`
+}
+
+// ID returns the comment qualified identifier
+func (c *Comment) ID() string { return c.DocID }
+
+// Rev returns the comment revision
+func (c *Comment) Rev() string { return c.DocRev }
+
+// DocType returns the comment document type
+func (c *Comment) DocType() string { return consts.Comments }
+
+// Clone implements couchdb.Doc
+func (c *Comment) Clone() couchdb.Doc {
+	cloned := *c
+	cloned.Mentions = make([]string, len(c.Mentions))
+	copy(cloned.Mentions, c.Mentions)
+	return &cloned
+}
+
+// SetID changes the comment qualified identifier
+func (c *Comment) SetID(id string) { c.DocID = id }
+
+// SetRev changes the comment revision
+func (c *Comment) SetRev(rev string) { c.DocRev = rev }
+
+// Match implements permissions.Matcher
+func (c *Comment) Match(field, value string) bool {
+	switch field {
+	case "target.type":
+		return c.Target.Type == value
+	case "target.id":
+		return c.Target.ID == value
+	case "parent_id":
+		return c.ParentID == value
+	}
+	return false
+}
+
+func checkText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", ErrEmptyText
+	}
+	if len(text) > maxTextLength {
+		return "", ErrTextTooLong
+	}
+	return text, nil
+}
+
+func checkMentions(inst *instance.Instance, mentions []string) error {
+	if len(mentions) > maxMentions {
+		return ErrTooManyMentions
+	}
+	for _, id := range mentions {
+		var doc couchdb.JSONDoc
+		if err := couchdb.GetDoc(inst, consts.Contacts, id, &doc); err != nil {
+			if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+				return ErrUnknownContact
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Create saves a new comment on the target document, and notifies the
+// mentioned contacts and the other members of the sharings of the document.
+// The name of the document is used in the notifications.
+func Create(inst *instance.Instance, c *Comment, targetName string) error {
+	text, err := checkText(c.Text)
+	if err != nil {
+		return err
+	}
+	c.Text = text
+	if c.ParentID != "" {
+		parent, err := Find(inst, c.ParentID)
+		if err != nil {
+			if couchdb.IsNotFoundError(err) {
+				return ErrParentNotFound
+			}
+			return err
+		}
+		if parent.Target != c.Target {
+			return ErrParentNotFound
+		}
+		// The replies to a reply are in the same thread
+		if parent.ParentID != "" {
+			c.ParentID = parent.ParentID
+		}
+	}
+	if err = checkMentions(inst, c.Mentions); err != nil {
+		return err
+	}
+	if c.Author.Name == "" {
+		c.Author.Name, _ = inst.PublicName()
+	}
+	c.CreatedAt = time.Now().UTC()
+	c.UpdatedAt = c.CreatedAt
+	if err = couchdb.CreateDoc(inst, c); err != nil {
+		return err
+	}
+	notify(inst, c, c.Mentions, targetName)
+	return nil
+}
+
+// Find returns the comment stored in database from a given ID
+func Find(db prefixer.Prefixer, commentID string) (*Comment, error) {
+	doc := &Comment{}
+	err := couchdb.GetDoc(db, consts.Comments, commentID, doc)
+	return doc, err
+}
+
+// List returns the comments on the target document, from the oldest to the
+// most recent.
+func List(db prefixer.Prefixer, target couchdb.DocReference) ([]*Comment, error) {
+	req := &couchdb.ViewRequest{
+		StartKey:    []interface{}{target.Type, target.ID},
+		EndKey:      []interface{}{target.Type, target.ID, couchdb.MaxString},
+		IncludeDocs: true,
+	}
+	var res couchdb.ViewResponse
+	if err := couchdb.ExecView(db, consts.CommentsByTarget, req, &res); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	list := make([]*Comment, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var c Comment
+		if err := json.Unmarshal(row.Doc, &c); err != nil {
+			return nil, err
+		}
+		list = append(list, &c)
+	}
+	return list, nil
+}
+
+// Update changes the text and the mentions of a comment. Only the newly
+// mentioned contacts are notified.
+func (c *Comment) Update(inst *instance.Instance, text string, mentions []string, targetName string) error {
+	text, err := checkText(text)
+	if err != nil {
+		return err
+	}
+	if err = checkMentions(inst, mentions); err != nil {
+		return err
+	}
+	var added []string
+	for _, id := range mentions {
+		if !contains(c.Mentions, id) {
+			added = append(added, id)
+		}
+	}
+	c.Text = text
+	c.Mentions = mentions
+	c.UpdatedAt = time.Now().UTC()
+	if err = couchdb.UpdateDoc(inst, c); err != nil {
+		return err
+	}
+	if len(added) > 0 {
+		notifyMentions(inst, c, added, targetName)
+	}
+	return nil
+}
+
+// Delete removes a comment. For the first comment of a thread, the replies
+// are also removed.
+func (c *Comment) Delete(inst *instance.Instance) error {
+	docs := []couchdb.Doc{c}
+	if c.ParentID == "" {
+		list, err := List(inst, c.Target)
+		if err != nil {
+			return err
+		}
+		for _, reply := range list {
+			if reply.ParentID == c.DocID {
+				docs = append(docs, reply)
+			}
+		}
+	}
+	return couchdb.BulkDeleteDocs(inst, consts.Comments, docs)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+var _ couchdb.Doc = &Comment{}
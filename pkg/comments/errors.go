@@ -0,0 +1,18 @@
+package comments
+
+import "errors"
+
+var (
+	// ErrEmptyText is used when a comment has no text
+	ErrEmptyText = errors.New("The text of the comment is empty")
+	// ErrTextTooLong is used when the text of a comment is too long
+	ErrTextTooLong = errors.New("The text of the comment is too long")
+	// ErrTooManyMentions is used when a comment mentions too many contacts
+	ErrTooManyMentions = errors.New("The comment mentions too many contacts")
+	// ErrUnknownContact is used when a comment mentions a contact that does
+	// not exist
+	ErrUnknownContact = errors.New("The mentioned contact does not exist")
+	// ErrParentNotFound is used when the comment to reply to is not found on
+	// the same document
+	ErrParentNotFound = errors.New("The comment to reply to has not been found")
+)
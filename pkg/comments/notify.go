@@ -0,0 +1,129 @@
+package comments
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/contacts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/sharing"
+	"github.com/cozy/cozy-stack/pkg/workers/mails"
+)
+
+// MailTemplateValues is a struct with the values used in the mails for the
+// comments.
+type MailTemplateValues struct {
+	RecipientName string
+	AuthorName    string
+	DocumentName  string
+	Text          string
+}
+
+// notify sends a mail to the mentioned contacts, and to the other members of
+// the sharings of the commented document. A recipient receives only one mail,
+// the mention being more relevant. The errors are only logged: the comment
+// has already been saved.
+func notify(inst *instance.Instance, c *Comment, mentions []string, targetName string) {
+	sent := notifyMentions(inst, c, mentions, targetName)
+	for _, addr := range sharingRecipients(inst, c.Target) {
+		if sent[addr.Email] {
+			continue
+		}
+		sent[addr.Email] = true
+		sendMail(inst, "comment_new", addr, c, targetName)
+	}
+}
+
+// notifyMentions sends a mail to the mentioned contacts, and returns the
+// addresses where a mail has been sent.
+func notifyMentions(inst *instance.Instance, c *Comment, mentions []string, targetName string) map[string]bool {
+	sent := make(map[string]bool)
+	for _, id := range mentions {
+		contact, err := contacts.Find(inst, id)
+		if err != nil {
+			continue
+		}
+		addr, err := contact.ToMailAddress()
+		if err != nil || sent[addr.Email] {
+			continue
+		}
+		sent[addr.Email] = true
+		sendMail(inst, "comment_mention", addr, c, targetName)
+	}
+	return sent
+}
+
+// sharingRecipients returns the addresses of the other members of the
+// sharings where the document is shared.
+func sharingRecipients(inst *instance.Instance, target couchdb.DocReference) []*mails.Address {
+	var ref sharing.SharedRef
+	if err := couchdb.GetDoc(inst, consts.Shared, target.Type+"/"+target.ID, &ref); err != nil {
+		return nil
+	}
+	ids := make([]string, 0, len(ref.Infos))
+	for id, info := range ref.Infos {
+		if !info.Removed {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sharings, err := sharing.FindSharings(inst, ids)
+	if err != nil {
+		return nil
+	}
+	var addrs []*mails.Address
+	for _, s := range sharings {
+		for i, m := range s.Members {
+			if m.Email == "" || m.Status == sharing.MemberStatusRevoked {
+				continue
+			}
+			if (s.Owner && i == 0) || isSelf(inst, &m) {
+				continue
+			}
+			addrs = append(addrs, &mails.Address{Name: m.PrimaryName(), Email: m.Email})
+		}
+	}
+	return addrs
+}
+
+// isSelf returns true if the member is the owner of the instance.
+func isSelf(inst *instance.Instance, m *sharing.Member) bool {
+	if m.Instance == "" {
+		return false
+	}
+	u, err := url.Parse(m.Instance)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, inst.Domain)
+}
+
+func sendMail(inst *instance.Instance, template string, addr *mails.Address, c *Comment, targetName string) {
+	msg, err := jobs.NewMessage(mails.Options{
+		Mode:         "from",
+		To:           []*mails.Address{addr},
+		TemplateName: template,
+		TemplateValues: &MailTemplateValues{
+			RecipientName: addr.Name,
+			AuthorName:    c.Author.Name,
+			DocumentName:  targetName,
+			Text:          c.Text,
+		},
+		RecipientName: addr.Name,
+	})
+	if err == nil {
+		_, err = jobs.System().PushJob(inst, &jobs.JobRequest{
+			WorkerType: "sendmail",
+			Message:    msg,
+		})
+	}
+	if err != nil {
+		inst.Logger().WithField("nspace", "comments").
+			Errorf("Cannot send a mail for the comment %s: %s", c.ID(), err)
+	}
+}
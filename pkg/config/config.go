@@ -13,13 +13,17 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	"github.com/cozy/cozy-stack/client/tlsclient"
 	"github.com/cozy/cozy-stack/pkg/cache"
+	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/keymgmt"
+	"github.com/cozy/cozy-stack/pkg/keyring"
 	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/gomail"
 	"github.com/go-redis/redis"
@@ -90,16 +94,25 @@ const defaultAdminSecretFileName = "cozy-admin-passphrase" // #nosec
 
 var config *Config
 var vault *Vault
+var vaultMu sync.RWMutex
+
+// vaultReloadInterval is the interval after which the secrets of the vault
+// are read again from the keyring, so that a rotation of the secrets is seen
+// by all the stack processes.
+const vaultReloadInterval = 5 * time.Minute
 
 var log = logger.WithNamespace("config")
 
 // Config contains the configuration values of the application
 type Config struct {
-	Host string
-	Port int
+	Host            string
+	Port            int
+	ReusePort       bool
+	ShutdownTimeout time.Duration
 
 	AdminHost           string
 	AdminPort           int
+	AdminSocket         string
 	AdminSecretFileName string
 
 	Assets                string
@@ -113,6 +126,20 @@ type Config struct {
 
 	CredentialsEncryptorKey string
 	CredentialsDecryptorKey string
+	CredentialsMasterSecret string
+	// CredentialsPreviousMasterSecret is the file of the master secret used
+	// before a rotation.
+	CredentialsPreviousMasterSecret string
+	// FilesMasterKey is the file of the master key used to wrap the data keys
+	// for the encryption of the files at rest.
+	FilesMasterKey         string
+	FilesPreviousMasterKey string
+	// InstanceSecretsMasterKey is the file of the master key used to encrypt
+	// the secrets of the instances in their documents.
+	InstanceSecretsMasterKey         string
+	InstanceSecretsPreviousMasterKey string
+
+	Keyring keyring.Options
 
 	RemoteAssets map[string]string
 
@@ -122,13 +149,25 @@ type Config struct {
 	Konnectors    Konnectors
 	Mail          *gomail.DialerOptions
 	Notifications Notifications
+	Flagship      Flagship
 	Logger        logger.Options
+	Tracing       tracing.Options
+	ACME          ACME
+	Cookies       Cookies
+	Deletion      Deletion
+	Updates       Updates
+	Scrub         Scrub
+	Uploads       Uploads
+	SFTP          SFTP
+	Hosting       Hosting
+	RateLimits    map[string]RateLimit
 
 	Lock                        RedisConfig
 	SessionStorage              RedisConfig
 	DownloadStorage             RedisConfig
 	KonnectorsOauthStateStorage RedisConfig
 	Realtime                    RedisConfig
+	RateLimitingStorage         RedisConfig
 
 	CacheStorage cache.Cache
 
@@ -146,8 +185,18 @@ type Config struct {
 // Vault contains security keys used for various encryption or signing of
 // critical assets.
 type Vault struct {
-	credsEncryptor *keymgmt.NACLKey
-	credsDecryptor *keymgmt.NACLKey
+	credsEncryptor            *keymgmt.NACLKey
+	credsDecryptor            *keymgmt.NACLKey
+	credsMasterSecret         []byte
+	credsPreviousMasterSecret []byte
+	filesMasterKey            []byte
+	filesPreviousMasterKey    []byte
+
+	instanceSecretsMasterKey         []byte
+	instanceSecretsPreviousMasterKey []byte
+
+	kr       keyring.Keyring
+	loadedAt time.Time
 }
 
 // CredentialsEncryptorKey returns the key used to encrypt credentials values,
@@ -162,11 +211,71 @@ func (v *Vault) CredentialsDecryptorKey() *keymgmt.NACLKey {
 	return v.credsDecryptor
 }
 
+// CredentialsMasterSecret returns the secret from which the instance-level
+// keys used to encrypt the credentials of the accounts are derived.
+func (v *Vault) CredentialsMasterSecret() []byte {
+	return v.credsMasterSecret
+}
+
+// CredentialsPreviousMasterSecret returns the master secret used before the
+// last rotation, if any.
+func (v *Vault) CredentialsPreviousMasterSecret() []byte {
+	return v.credsPreviousMasterSecret
+}
+
+// FilesMasterKey returns the key used to wrap the data keys of the instances,
+// with which the content of the files is encrypted. The files are not
+// encrypted if it is nil.
+func (v *Vault) FilesMasterKey() []byte {
+	return v.filesMasterKey
+}
+
+// FilesPreviousMasterKey returns the files master key used before the last
+// rotation, if any.
+func (v *Vault) FilesPreviousMasterKey() []byte {
+	return v.filesPreviousMasterKey
+}
+
+// InstanceSecretsMasterKey returns the key used to encrypt the secrets of the
+// instances in their documents. They are kept in clear if it is nil.
+func (v *Vault) InstanceSecretsMasterKey() []byte {
+	return v.instanceSecretsMasterKey
+}
+
+// InstanceSecretsPreviousMasterKey returns the instance secrets master key
+// used before the last rotation, if any.
+func (v *Vault) InstanceSecretsPreviousMasterKey() []byte {
+	return v.instanceSecretsPreviousMasterKey
+}
+
+// OAuthClientSecret returns the client secret of the given OAuth account type
+// if it is in the keyring, or an empty string.
+func (v *Vault) OAuthClientSecret(accountType string) string {
+	if v.kr == nil {
+		return ""
+	}
+	secret, err := v.kr.Get(keyring.OAuthClientSecretPrefix + accountType)
+	if err != nil {
+		if err != keyring.ErrNotFound {
+			log.Errorf("Could not read the client secret of %s: %s", accountType, err)
+		}
+		return ""
+	}
+	return string(secret)
+}
+
 // Fs contains the configuration values of the file-system
 type Fs struct {
 	Auth      *url.Userinfo
 	URL       *url.URL
 	Transport http.RoundTripper
+
+	// StoragePolicy is the Swift storage policy of the containers created
+	// for the instances
+	StoragePolicy string
+	// TrashExpiry is the duration after which the content of the files in the
+	// trash is deleted by Swift (0 to keep it)
+	TrashExpiry time.Duration
 }
 
 // CouchDB contains the configuration values of the database
@@ -174,6 +283,29 @@ type CouchDB struct {
 	Auth   *url.Userinfo
 	URL    *url.URL
 	Client *http.Client
+
+	// Nodes is the list of the CouchDB nodes of the cluster that can be used
+	// by the stack. The first one is always the node of the URL field, the
+	// others are only used when a failover is needed.
+	Nodes               []*url.URL
+	HealthCheckInterval time.Duration
+
+	// Prefix is added to the name of all the databases, to allow several
+	// stacks to use the same CouchDB cluster.
+	Prefix string
+	// GlobalDoctypes are the doctypes whose documents are shared by all the
+	// instances, and stored in the global database.
+	GlobalDoctypes []string
+	// PartitionedDoctypes are the doctypes whose databases are created as
+	// partitioned databases (CouchDB 3.x).
+	PartitionedDoctypes []string
+
+	// CachedDoctypes are the doctypes of the hot documents, that are cached
+	// for the duration of a request.
+	CachedDoctypes []string
+	// DocCacheTTL is the duration during which the hot documents are also
+	// kept in redis, or 0 to not cache them in redis.
+	DocCacheTTL time.Duration
 }
 
 // Jobs contains the configuration values for the jobs and triggers
@@ -184,6 +316,10 @@ type Jobs struct {
 	WhiteList             bool
 	Workers               []Worker
 	ImageMagickConvertCmd string
+	PdftoppmCmd           string
+	FFmpegCmd             string
+	TesseractCmd          string
+	ClassifierURL         string
 	// XXX for retro-compatibility
 	NbWorkers int
 }
@@ -193,6 +329,92 @@ type Konnectors struct {
 	Cmd string
 }
 
+// ACME contains the configuration for obtaining and renewing automatically the
+// TLS certificates of the instances with an ACME server, like Let's Encrypt
+type ACME struct {
+	Enabled      bool
+	Email        string
+	DirectoryURL string
+	HTTPAddr     string
+	CacheDir     string
+}
+
+// Deletion contains the configuration for the deletion of the instances: the
+// data of an instance scheduled for deletion is kept during the grace period,
+// and a reminder is sent to the user some time before the final purge.
+type Deletion struct {
+	GracePeriod time.Duration
+	Reminder    time.Duration
+}
+
+// Updates contains the configuration for the periodic check of the new
+// versions of the applications and konnectors installed from the registries.
+type Updates struct {
+	CheckInterval time.Duration
+	AutoUpdate    bool
+}
+
+// Scrub contains the configuration for the periodic verification of the
+// content of the files: the interval between two verifications of all the
+// files of an instance, and the maximal number of bytes read per second.
+type Scrub struct {
+	Interval  time.Duration
+	Bandwidth int64
+}
+
+// Uploads contains the configuration for the uploads in two phases: the
+// duration during which the content stays in the staging area before being
+// committed, and the command used to scan this content for viruses.
+type Uploads struct {
+	TTL          time.Duration
+	AntivirusCmd string
+}
+
+// The values for the per field of a rate limit
+const (
+	RateLimitPerToken    = "token"
+	RateLimitPerInstance = "instance"
+)
+
+// RateLimit contains the configuration of a rate limit: the maximal number of
+// actions during the period, for each token or for the whole instance. The
+// zero values are for the defaults of the rate limit.
+type RateLimit struct {
+	Limit  int64
+	Period time.Duration
+	Per    string
+}
+
+// Hosting contains the configuration of the webhook of the hosting, where the
+// events of the lifecycle of the instances are posted, and the secret used to
+// sign them.
+type Hosting struct {
+	WebhookURL    string
+	WebhookSecret string
+}
+
+// SFTP contains the configuration of the SFTP server, that gives access to
+// the files of the instances with their app passwords.
+type SFTP struct {
+	Enabled bool
+	Addr    string
+	HostKey string
+}
+
+// Cookies contains the attributes of the cookies set by the stack, for the
+// instances served on https, and on http (for the development).
+type Cookies struct {
+	HTTPS CookieAttributes
+	HTTP  CookieAttributes
+}
+
+// CookieAttributes are the SameSite (lax, strict, or empty for no attribute)
+// and Secure attributes of the cookies.
+type CookieAttributes struct {
+	SameSite string
+	Secure   bool
+}
+
 // Notifications contains the configuration for the mobile push-notification
 // center, for Android and iOS
 type Notifications struct {
@@ -206,6 +428,15 @@ type Notifications struct {
 	IOSTeamID              string
 }
 
+// Flagship contains the configuration for the certification of the flagship
+// apps, when they are paired: the Android package names, and the SHA-256
+// digests of the certificates used to sign the APK, that are accepted in the
+// SafetyNet attestations.
+type Flagship struct {
+	APKPackageNames       []string
+	APKCertificateDigests []string
+}
+
 // Worker contains the configuration fields for a specific worker type.
 type Worker struct {
 	WorkerType   string
@@ -312,11 +543,35 @@ func GetConfig() *Config {
 	return config
 }
 
-// GetVault returns the configured instance of Vault
+// GetVault returns the configured instance of Vault. When the secrets come
+// from a keyring, they are read again after vaultReloadInterval.
 func GetVault() *Vault {
+	vaultMu.RLock()
+	v := vault
+	expired := v != nil && v.kr != nil && time.Since(v.loadedAt) > vaultReloadInterval
+	vaultMu.RUnlock()
+	if !expired {
+		return v
+	}
+	if err := ReloadVault(); err != nil {
+		// The previous secrets are kept until the next interval
+		log.Errorf("Could not reload the vault: %s", err)
+		vaultMu.Lock()
+		v.loadedAt = time.Now()
+		vaultMu.Unlock()
+		return v
+	}
+	vaultMu.RLock()
+	defer vaultMu.RUnlock()
 	return vault
 }
 
+// ReloadVault reads again the secrets of the vault, for example after their
+// rotation in the keyring.
+func ReloadVault() error {
+	return MakeVault(config)
+}
+
 var defaultPasswordResetInterval = 15 * time.Minute
 
 // PasswordResetInterval returns the minimal delay between two password reset
@@ -324,6 +579,9 @@ func PasswordResetInterval() time.Duration {
 	return config.PasswordResetInterval
 }
 
+// configFile is the path of the configuration file used by the stack, if any
+var configFile string
+
 // Setup Viper to read the environment and the optional config file
 func Setup(cfgFile string) (err error) {
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
@@ -347,10 +605,20 @@ func Setup(cfgFile string) (err error) {
 	}
 
 	log.Debugf("Using config file: %s", cfgFile)
+	if err = readConfigFile(viper.GetViper(), cfgFile); err != nil {
+		return err
+	}
+	configFile = cfgFile
+
+	return UseViper(viper.GetViper())
+}
 
+// readConfigFile evaluates the template of the configuration file, and reads
+// its content in viper.
+func readConfigFile(v *viper.Viper, cfgFile string) error {
 	tmpl := template.New(filepath.Base(cfgFile))
 	tmpl = tmpl.Option("missingkey=zero")
-	tmpl, err = tmpl.Funcs(numericFuncsMap).ParseFiles(cfgFile)
+	tmpl, err := tmpl.Funcs(numericFuncsMap).ParseFiles(cfgFile)
 	if err != nil {
 		return fmt.Errorf("Unable to open and parse configuration file "+
 			"template %s: %s", cfgFile, err)
@@ -370,24 +638,44 @@ func Setup(cfgFile string) (err error) {
 	}
 
 	if ext := filepath.Ext(cfgFile); len(ext) > 0 {
-		viper.SetConfigType(ext[1:])
+		v.SetConfigType(ext[1:])
 	}
-	if err := viper.ReadConfig(dest); err != nil {
+	if err := v.ReadConfig(dest); err != nil {
 		if _, isParseErr := err.(viper.ConfigParseError); isParseErr {
 			log.Errorf("Failed to read cozy-stack configurations from %s", cfgFile)
 			log.Errorf(dest.String())
 			return err
 		}
 	}
-
-	return UseViper(viper.GetViper())
+	return nil
 }
 
 func applyDefaults(v *viper.Viper) {
 	v.SetDefault("password_reset_interval", defaultPasswordResetInterval)
+	v.SetDefault("shutdown_timeout", 2*time.Minute)
+	v.SetDefault("acme.http_addr", ":80")
+	v.SetDefault("cookies.https.same_site", "lax")
+	v.SetDefault("cookies.https.secure", true)
+	v.SetDefault("cookies.http.same_site", "lax")
+	v.SetDefault("cookies.http.secure", false)
+	v.SetDefault("deletion.grace_period", 30*24*time.Hour)
+	v.SetDefault("deletion.reminder", 7*24*time.Hour)
+	v.SetDefault("updates.check_interval", 24*time.Hour)
+	v.SetDefault("updates.auto_update", true)
+	v.SetDefault("scrub.interval", 30*24*time.Hour)
+	v.SetDefault("scrub.bandwidth", 10*1024*1024)
+	v.SetDefault("uploads.ttl", 24*time.Hour)
+	v.SetDefault("sftp.addr", ":2222")
 	v.SetDefault("jobs.imagemagick_convert_cmd", "convert")
+	v.SetDefault("jobs.pdftoppm_cmd", "pdftoppm")
 	v.SetDefault("assets_polling_disabled", false)
 	v.SetDefault("assets_polling_interval", 2*time.Minute)
+	v.SetDefault("couchdb.max_idle_conns_per_host", 64)
+	v.SetDefault("couchdb.idle_conn_timeout", 90*time.Second)
+	v.SetDefault("couchdb.health_check_interval", 10*time.Second)
+	v.SetDefault("couchdb.cached_doctypes", []string{
+		"io.cozy.settings", "io.cozy.permissions", "io.cozy.apps", "io.cozy.konnectors",
+	})
 }
 
 func envMap() map[string]string {
@@ -425,9 +713,22 @@ func UseViper(v *viper.Viper) error {
 	if couchURL.Path == "" {
 		couchURL.Path = "/"
 	}
+	couchNodes := []*url.URL{couchURL}
+	for _, n := range v.GetStringSlice("couchdb.nodes") {
+		nodeURL, _, err := parseURL(n)
+		if err != nil {
+			return err
+		}
+		if nodeURL.Path == "" {
+			nodeURL.Path = "/"
+		}
+		couchNodes = append(couchNodes, nodeURL)
+	}
 	couchClient, _, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
-		Timeout:    10 * time.Second,
-		RootCAFile: v.GetString("couchdb.root_ca"),
+		Timeout:             10 * time.Second,
+		MaxIdleConnsPerHost: v.GetInt("couchdb.max_idle_conns_per_host"),
+		IdleConnTimeout:     v.GetDuration("couchdb.idle_conn_timeout"),
+		RootCAFile:          v.GetString("couchdb.root_ca"),
 		ClientCertificateFiles: tlsclient.ClientCertificateFilePair{
 			CertificateFile: v.GetString("couchdb.client_cert"),
 			KeyFile:         v.GetString("couchdb.client_key"),
@@ -531,6 +832,10 @@ func UseViper(v *viper.Viper) error {
 	// cache entry is optional
 	cacheRedis, _ := GetRedisConfig(v, redisOptions, "cache", "url")
 
+	// rate_limiting entry is optional too, to keep working the configurations
+	// made before it was introduced
+	rateLimitingRedis, _ := GetRedisConfig(v, redisOptions, "rate_limiting", "url")
+
 	adminSecretFile := v.GetString("admin.secret_filename")
 	if adminSecretFile == "" {
 		adminSecretFile = defaultAdminSecretFileName
@@ -539,6 +844,10 @@ func UseViper(v *viper.Viper) error {
 	jobs := Jobs{
 		RedisConfig:           jobsRedis,
 		ImageMagickConvertCmd: v.GetString("jobs.imagemagick_convert_cmd"),
+		PdftoppmCmd:           v.GetString("jobs.pdftoppm_cmd"),
+		FFmpegCmd:             v.GetString("jobs.ffmpeg_cmd"),
+		TesseractCmd:          v.GetString("jobs.tesseract_cmd"),
+		ClassifierURL:         v.GetString("jobs.classifier_url"),
 	}
 	{
 		isWhiteList := v.GetBool("jobs.whitelist")
@@ -596,12 +905,67 @@ func UseViper(v *viper.Viper) error {
 		}
 	}
 
+	rateLimits := make(map[string]RateLimit)
+	for name, mapInterface := range v.GetStringMap("rate_limits") {
+		m, ok := mapInterface.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("config: expecting a map in the key %q", "rate_limits."+name)
+		}
+		var rl RateLimit
+		for k, val := range m {
+			switch k {
+			case "limit":
+				if limit, ok := val.(int); ok {
+					rl.Limit = int64(limit)
+				}
+			case "period":
+				if period, ok := val.(string); ok {
+					rl.Period, err = time.ParseDuration(period)
+					if err != nil {
+						return fmt.Errorf("config: could not parse period duration for rate limit %q: %s",
+							name, err)
+					}
+				}
+			case "per":
+				rl.Per, _ = val.(string)
+				if rl.Per != RateLimitPerToken && rl.Per != RateLimitPerInstance {
+					return fmt.Errorf(`config: the key %q should be "token" or "instance"`,
+						"rate_limits."+name+".per")
+				}
+			default:
+				return fmt.Errorf("config: unknown key %q", "rate_limits."+name+"."+k)
+			}
+		}
+		rateLimits[name] = rl
+	}
+
+	cookies := Cookies{
+		HTTPS: CookieAttributes{
+			SameSite: v.GetString("cookies.https.same_site"),
+			Secure:   v.GetBool("cookies.https.secure"),
+		},
+		HTTP: CookieAttributes{
+			SameSite: v.GetString("cookies.http.same_site"),
+			Secure:   v.GetBool("cookies.http.secure"),
+		},
+	}
+	for _, attrs := range []CookieAttributes{cookies.HTTPS, cookies.HTTP} {
+		switch attrs.SameSite {
+		case "", "lax", "strict":
+		default:
+			return fmt.Errorf(`SameSite attribute of the cookies should be "lax", "strict" or empty, was: %q`, attrs.SameSite)
+		}
+	}
+
 	config = &Config{
-		Host: v.GetString("host"),
-		Port: v.GetInt("port"),
+		Host:            v.GetString("host"),
+		Port:            v.GetInt("port"),
+		ReusePort:       v.GetBool("reuse_port"),
+		ShutdownTimeout: v.GetDuration("shutdown_timeout"),
 
 		AdminHost:           v.GetString("admin.host"),
 		AdminPort:           v.GetInt("admin.port"),
+		AdminSocket:         v.GetString("admin.socket"),
 		AdminSecretFileName: adminSecretFile,
 
 		Subdomains:            subdomains,
@@ -617,15 +981,48 @@ func UseViper(v *viper.Viper) error {
 
 		CredentialsEncryptorKey: v.GetString("vault.credentials_encryptor_key"),
 		CredentialsDecryptorKey: v.GetString("vault.credentials_decryptor_key"),
+		CredentialsMasterSecret: v.GetString("vault.credentials_master_secret"),
+
+		CredentialsPreviousMasterSecret: v.GetString("vault.credentials_previous_master_secret"),
+		FilesMasterKey:                  v.GetString("vault.files_master_key"),
+		FilesPreviousMasterKey:          v.GetString("vault.files_previous_master_key"),
+
+		InstanceSecretsMasterKey:         v.GetString("vault.instance_secrets_master_key"),
+		InstanceSecretsPreviousMasterKey: v.GetString("vault.instance_secrets_previous_master_key"),
+
+		Keyring: keyring.Options{
+			Backend: v.GetString("keyring.backend"),
+			Path:    v.GetString("keyring.path"),
+			Prefix:  v.GetString("keyring.prefix"),
+			Vault: keyring.VaultOptions{
+				Address: v.GetString("keyring.vault.address"),
+				Token:   v.GetString("keyring.vault.token"),
+				Mount:   v.GetString("keyring.vault.mount"),
+
+				CacheTTL: v.GetDuration("keyring.vault.cache_ttl"),
+			},
+		},
 
 		Fs: Fs{
-			URL:       fsURL,
-			Transport: fsClient.Transport,
+			URL:           fsURL,
+			Transport:     fsClient.Transport,
+			StoragePolicy: v.GetString("fs.storage_policy"),
+			TrashExpiry:   v.GetDuration("fs.trash_expiry"),
 		},
 		CouchDB: CouchDB{
 			Auth:   couchAuth,
 			URL:    couchURL,
 			Client: couchClient,
+
+			Nodes:               couchNodes,
+			HealthCheckInterval: v.GetDuration("couchdb.health_check_interval"),
+
+			Prefix:              v.GetString("couchdb.prefix"),
+			GlobalDoctypes:      v.GetStringSlice("couchdb.global_doctypes"),
+			PartitionedDoctypes: v.GetStringSlice("couchdb.partitioned_doctypes"),
+
+			CachedDoctypes: v.GetStringSlice("couchdb.cached_doctypes"),
+			DocCacheTTL:    v.GetDuration("couchdb.doc_cache_ttl"),
 		},
 		Jobs: jobs,
 		Konnectors: Konnectors{
@@ -641,25 +1038,64 @@ func UseViper(v *viper.Viper) error {
 			IOSKeyID:               v.GetString("notifications.ios_key_id"),
 			IOSTeamID:              v.GetString("notifications.ios_team_id"),
 		},
+		Flagship: Flagship{
+			APKPackageNames:       v.GetStringSlice("flagship.apk_package_names"),
+			APKCertificateDigests: v.GetStringSlice("flagship.apk_certificate_digests"),
+		},
 		Lock:                        lockRedis,
 		SessionStorage:              sessionsRedis,
 		DownloadStorage:             downloadRedis,
 		KonnectorsOauthStateStorage: konnectorsOauthStateRedis,
 		Realtime:                    realtimeRedis,
+		RateLimitingStorage:         rateLimitingRedis,
 		CacheStorage:                cache.New(cacheRedis.Client()),
 		Logger: logger.Options{
 			Level:  v.GetString("log.level"),
 			Syslog: v.GetBool("log.syslog"),
+			Format: v.GetString("log.format"),
+			Ship:   v.GetString("log.ship"),
 			Redis:  loggerRedis.Client(),
 		},
-		Mail: &gomail.DialerOptions{
-			Host:                      v.GetString("mail.host"),
-			Port:                      v.GetInt("mail.port"),
-			Username:                  v.GetString("mail.username"),
-			Password:                  v.GetString("mail.password"),
-			DisableTLS:                v.GetBool("mail.disable_tls"),
-			SkipCertificateValidation: v.GetBool("mail.skip_certificate_validation"),
+		Tracing: tracing.Options{
+			Endpoint:    v.GetString("tracing.endpoint"),
+			Insecure:    v.GetBool("tracing.insecure"),
+			SampleRatio: v.GetFloat64("tracing.sample_ratio"),
+		},
+		ACME: ACME{
+			Enabled:      v.GetBool("acme.enabled"),
+			Email:        v.GetString("acme.email"),
+			DirectoryURL: v.GetString("acme.directory_url"),
+			HTTPAddr:     v.GetString("acme.http_addr"),
+			CacheDir:     v.GetString("acme.cache_dir"),
+		},
+		Deletion: Deletion{
+			GracePeriod: v.GetDuration("deletion.grace_period"),
+			Reminder:    v.GetDuration("deletion.reminder"),
+		},
+		Updates: Updates{
+			CheckInterval: v.GetDuration("updates.check_interval"),
+			AutoUpdate:    v.GetBool("updates.auto_update"),
+		},
+		Scrub: Scrub{
+			Interval:  v.GetDuration("scrub.interval"),
+			Bandwidth: v.GetInt64("scrub.bandwidth"),
+		},
+		Uploads: Uploads{
+			TTL:          v.GetDuration("uploads.ttl"),
+			AntivirusCmd: v.GetString("uploads.antivirus_cmd"),
+		},
+		SFTP: SFTP{
+			Enabled: v.GetBool("sftp.enabled"),
+			Addr:    v.GetString("sftp.addr"),
+			HostKey: v.GetString("sftp.host_key"),
 		},
+		Hosting: Hosting{
+			WebhookURL:    v.GetString("hosting.webhook_url"),
+			WebhookSecret: v.GetString("hosting.webhook_secret"),
+		},
+		RateLimits: rateLimits,
+		Cookies:    cookies,
+		Mail:       makeMail(v),
 		Contexts:   v.GetStringMap("contexts"),
 		Registries: regs,
 		Clouderies: v.GetStringMap("clouderies"),
@@ -677,40 +1113,121 @@ func UseViper(v *viper.Viper) error {
 	return logger.Init(config.Logger)
 }
 
-// MakeVault initializes the global vault.
+// MakeVault initializes the global vault. The secrets are read from the
+// keyring if a backend has been configured, or else from the files given in
+// the vault section of the configuration.
 func MakeVault(c *Config) error {
-	var credsEncryptor *keymgmt.NACLKey
-	var credsDecryptor *keymgmt.NACLKey
-
-	if credsEncryptorKey := config.CredentialsEncryptorKey; credsEncryptorKey != "" {
-		keyBytes, err := ioutil.ReadFile(credsEncryptorKey)
-		if err != nil {
-			return err
+	kr, err := keyring.New(config.Keyring)
+	if err != nil {
+		return err
+	}
+	readSecret := func(name, filename string) ([]byte, error) {
+		if kr != nil {
+			secret, err := kr.Get(name)
+			if err == keyring.ErrNotFound {
+				return nil, nil
+			}
+			return secret, err
 		}
-		credsEncryptor, err = keymgmt.UnmarshalNACLKey(keyBytes)
-		if err != nil {
-			return err
+		if filename == "" {
+			return nil, nil
 		}
-	}
-
-	if credsDecryptorKey := config.CredentialsDecryptorKey; credsDecryptorKey != "" {
-		keyBytes, err := ioutil.ReadFile(credsDecryptorKey)
+		secret, err := ioutil.ReadFile(filename)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		credsDecryptor, err = keymgmt.UnmarshalNACLKey(keyBytes)
-		if err != nil {
-			return err
+		return bytes.TrimSpace(secret), nil
+	}
+	readKey := func(name, filename string) (*keymgmt.NACLKey, error) {
+		keyBytes, err := readSecret(name, filename)
+		if err != nil || keyBytes == nil {
+			return nil, err
 		}
+		return keymgmt.UnmarshalNACLKey(keyBytes)
 	}
 
-	vault = &Vault{
-		credsEncryptor: credsEncryptor,
-		credsDecryptor: credsDecryptor,
+	credsEncryptor, err := readKey(keyring.CredentialsEncryptorKey, config.CredentialsEncryptorKey)
+	if err != nil {
+		return err
+	}
+	credsDecryptor, err := readKey(keyring.CredentialsDecryptorKey, config.CredentialsDecryptorKey)
+	if err != nil {
+		return err
+	}
+	credsMasterSecret, err := readSecret(keyring.CredentialsMasterSecret, config.CredentialsMasterSecret)
+	if err != nil {
+		return err
+	}
+	if credsMasterSecret != nil && len(credsMasterSecret) < 32 {
+		return fmt.Errorf("The credentials master secret must be at least 32 bytes long")
+	}
+	credsPreviousMasterSecret, err := readSecret(keyring.CredentialsPreviousMasterSecret, config.CredentialsPreviousMasterSecret)
+	if err != nil {
+		return err
+	}
+	if credsPreviousMasterSecret != nil && len(credsPreviousMasterSecret) < 32 {
+		return fmt.Errorf("The previous credentials master secret must be at least 32 bytes long")
+	}
+	filesMasterKey, err := readSecret(keyring.FilesMasterKey, config.FilesMasterKey)
+	if err != nil {
+		return err
+	}
+	if filesMasterKey != nil && len(filesMasterKey) < 32 {
+		return fmt.Errorf("The files master key must be at least 32 bytes long")
+	}
+	filesPreviousMasterKey, err := readSecret(keyring.FilesPreviousMasterKey, config.FilesPreviousMasterKey)
+	if err != nil {
+		return err
+	}
+	if filesPreviousMasterKey != nil && len(filesPreviousMasterKey) < 32 {
+		return fmt.Errorf("The previous files master key must be at least 32 bytes long")
+	}
+	instanceSecretsMasterKey, err := readSecret(keyring.InstanceSecretsMasterKey, config.InstanceSecretsMasterKey)
+	if err != nil {
+		return err
+	}
+	if instanceSecretsMasterKey != nil && len(instanceSecretsMasterKey) < 32 {
+		return fmt.Errorf("The instance secrets master key must be at least 32 bytes long")
+	}
+	instanceSecretsPreviousMasterKey, err := readSecret(keyring.InstanceSecretsPreviousMasterKey, config.InstanceSecretsPreviousMasterKey)
+	if err != nil {
+		return err
 	}
+	if instanceSecretsPreviousMasterKey != nil && len(instanceSecretsPreviousMasterKey) < 32 {
+		return fmt.Errorf("The previous instance secrets master key must be at least 32 bytes long")
+	}
+
+	v := &Vault{
+		credsEncryptor:            credsEncryptor,
+		credsDecryptor:            credsDecryptor,
+		credsMasterSecret:         credsMasterSecret,
+		credsPreviousMasterSecret: credsPreviousMasterSecret,
+		filesMasterKey:            filesMasterKey,
+		filesPreviousMasterKey:    filesPreviousMasterKey,
+
+		instanceSecretsMasterKey:         instanceSecretsMasterKey,
+		instanceSecretsPreviousMasterKey: instanceSecretsPreviousMasterKey,
+
+		kr:       kr,
+		loadedAt: time.Now(),
+	}
+	vaultMu.Lock()
+	vault = v
+	vaultMu.Unlock()
 	return nil
 }
 
+func makeMail(v *viper.Viper) *gomail.DialerOptions {
+	return &gomail.DialerOptions{
+		Host:                      v.GetString("mail.host"),
+		Port:                      v.GetInt("mail.port"),
+		Username:                  v.GetString("mail.username"),
+		Password:                  v.GetString("mail.password"),
+		DisableTLS:                v.GetBool("mail.disable_tls"),
+		SkipCertificateValidation: v.GetBool("mail.skip_certificate_validation"),
+	}
+}
+
 func makeRegistries(v *viper.Viper) (map[string][]*url.URL, error) {
 	regs := make(map[string][]*url.URL)
 
@@ -803,8 +1320,11 @@ func UseTestFile() {
 	}
 
 	vault = &Vault{
-		credsEncryptor: credsEncryptor,
-		credsDecryptor: credsDecryptor,
+		credsEncryptor:    credsEncryptor,
+		credsDecryptor:    credsDecryptor,
+		credsMasterSecret: crypto.GenerateRandomBytes(32),
+
+		instanceSecretsMasterKey: crypto.GenerateRandomBytes(32),
 	}
 }
 
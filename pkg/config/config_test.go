@@ -1,6 +1,7 @@
 package config
 
 import (
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -97,6 +98,64 @@ registries:
 	assert.EqualValues(t, []string{"https://default"}, regsToStrings(GetConfig().Registries["default"]))
 }
 
+func TestReload(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "cozy-reload")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(tmpfile.Name())
+	name := tmpfile.Name() + ".yaml"
+	tmpfile.Close()
+	defer os.Remove(name)
+
+	err = ioutil.WriteFile(name, []byte(`
+port: 1236
+mail:
+  host: smtp.example.org
+log:
+  level: warning
+contexts:
+  foo:
+    default_apps:
+      - drive
+`), 0600)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, Setup(name)) {
+		return
+	}
+	assert.Equal(t, 1236, GetConfig().Port)
+	assert.Equal(t, "smtp.example.org", GetConfig().Mail.Host)
+
+	err = ioutil.WriteFile(name, []byte(`
+port: 1237
+mail:
+  host: smtp2.example.org
+log:
+  level: debug
+contexts:
+  bar:
+    default_apps:
+      - photos
+registries:
+  - https://registry.example.org/
+`), 0600)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, Reload()) {
+		return
+	}
+	// The port can't be changed without a restart
+	assert.Equal(t, 1236, GetConfig().Port)
+	assert.Equal(t, "smtp2.example.org", GetConfig().Mail.Host)
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+	assert.Contains(t, GetConfig().Contexts, "bar")
+	assert.NotContains(t, GetConfig().Contexts, "foo")
+	assert.EqualValues(t, []string{"https://registry.example.org/"}, regsToStrings(GetConfig().Registries["default"]))
+}
+
 func regsToStrings(regs []*url.URL) []string {
 	ss := make([]string, len(regs))
 	for i, r := range regs {
@@ -0,0 +1,18 @@
+package config
+
+import "net/http"
+
+// CookieAttributesFor returns the attributes of the cookies for an instance
+// served with the given scheme.
+func CookieAttributesFor(scheme string) CookieAttributes {
+	if scheme == "http" {
+		return GetConfig().Cookies.HTTP
+	}
+	return GetConfig().Cookies.HTTPS
+}
+
+// Apply sets the SameSite and Secure attributes on the cookie.
+func (a CookieAttributes) Apply(cookie *http.Cookie) {
+	cookie.Secure = a.Secure
+	setSameSite(cookie, a.SameSite)
+}
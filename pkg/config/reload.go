@@ -0,0 +1,44 @@
+package config
+
+import (
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/spf13/viper"
+)
+
+// Reload reads again the configuration file and the environment variables,
+// and applies the changes that can be made without restarting the stack: the
+// contexts, the registries, the mail settings and the log level. The other
+// parameters, like the addresses of CouchDB, redis or the storage, need a
+// restart to be taken into account.
+func Reload() error {
+	v := viper.GetViper()
+	if configFile != "" {
+		if err := readConfigFile(v, configFile); err != nil {
+			return err
+		}
+	}
+
+	regs, err := makeRegistries(v)
+	if err != nil {
+		return err
+	}
+	if err = logger.SetLevel(v.GetString("log.level")); err != nil {
+		return err
+	}
+
+	// The configuration is copied and then replaced, so that the goroutines
+	// that use it don't see a partially reloaded configuration.
+	reloaded := *config
+	reloaded.Contexts = v.GetStringMap("contexts")
+	reloaded.Registries = regs
+	reloaded.Mail = makeMail(v)
+	reloaded.NoReplyAddr = v.GetString("mail.noreply_address")
+	reloaded.NoReplyName = v.GetString("mail.noreply_name")
+	reloaded.PasswordResetInterval = v.GetDuration("password_reset_interval")
+	reloaded.ShutdownTimeout = v.GetDuration("shutdown_timeout")
+	reloaded.Logger.Level = v.GetString("log.level")
+	config = &reloaded
+
+	log.Infof("Configuration reloaded")
+	return nil
+}
@@ -0,0 +1,14 @@
+// +build go1.11
+
+package config
+
+import "net/http"
+
+func setSameSite(cookie *http.Cookie, sameSite string) {
+	switch sameSite {
+	case "lax":
+		cookie.SameSite = http.SameSiteLaxMode
+	case "strict":
+		cookie.SameSite = http.SameSiteStrictMode
+	}
+}
@@ -0,0 +1,9 @@
+// +build !go1.11
+
+package config
+
+import "net/http"
+
+// setSameSite does nothing: the SameSite attribute can't be set on the cookies
+// before go 1.11.
+func setSameSite(cookie *http.Cookie, sameSite string) {}
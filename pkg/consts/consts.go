@@ -15,34 +15,107 @@ const (
 	Versions = "io.cozy.registry.versions"
 	// KonnectorLogs doc type for konnector last execution logs.
 	KonnectorLogs = "io.cozy.konnectors.logs"
+	// AppPasswords doc type for the passwords generated for the DAV clients
+	AppPasswords = "io.cozy.auth.app_passwords"
 	// Archives doc type for zip archives with files and directories
 	Archives = "io.cozy.files.archives"
+	// AuditLogs doc type for the log of the security-sensitive actions
+	AuditLogs = "io.cozy.audit.logs"
+	// Activities doc type for the feed of the recent activity on an instance
+	Activities = "io.cozy.activities"
+	// Backups doc type for the configuration and the state of the backups of
+	// an instance in an external S3 bucket
+	Backups = "io.cozy.backups"
 	// Exports doc type for global exports archives
 	Exports = "io.cozy.exports"
 	// Doctypes doc type for doctype list
 	Doctypes = "io.cozy.doctypes"
 	// Files doc type for type for files and directories
 	Files = "io.cozy.files"
+	// FilesAccesses doc type for the last accesses to the content of the
+	// files, for the list of the recent files
+	FilesAccesses = "io.cozy.files.accesses"
+	// FilesImports doc type for the imports of files from the cloud storage
+	// services, like Google Drive or Dropbox
+	FilesImports = "io.cozy.files.imports"
+	// FilesUploads doc type for the uploads in two phases, whose content is
+	// in the staging area until they are committed
+	FilesUploads = "io.cozy.files.uploads"
+	// FilesSizes doc type for the aggregates of the directories: the total
+	// size and the number of the files inside them
+	FilesSizes = "io.cozy.files.sizes"
+	// FilesACLs doc type for the accesses on a file or a directory granted
+	// to an OAuth client, in addition to the permissions of its token
+	FilesACLs = "io.cozy.files.acls"
+	// FilesKeyEnvelopes doc type for the wrapped keys of the directories
+	// encrypted end-to-end by the clients
+	FilesKeyEnvelopes = "io.cozy.files.envelopes"
 	// PhotosAlbums doc type for photos albums
 	PhotosAlbums = "io.cozy.photos.albums"
+	// PhotosMoments doc type for the moments suggested as albums of photos
+	PhotosMoments = "io.cozy.photos.moments"
 	// Intents doc type for intents persisted in couchdb
 	Intents = "io.cozy.intents"
 	// Jobs doc type for queued jobs
 	Jobs = "io.cozy.jobs"
 	// JobEvents doc type for realt time events sent by jobs
 	JobEvents = "io.cozy.jobs.events"
+	// Moves doc type for the tokens and the transfers of the moves of the data
+	// from an instance to another
+	Moves = "io.cozy.moves"
 	// Notifications doc type for notifications
 	Notifications = "io.cozy.notifications"
+	// NotificationDevices doc type for the devices registered for the push
+	// notifications
+	NotificationDevices = "io.cozy.notifications.devices"
 	// OAuthAccessCodes doc type for OAuth2 access codes
 	OAuthAccessCodes = "io.cozy.oauth.access_codes"
 	// OAuthClients doc type for OAuth2 clients
 	OAuthClients = "io.cozy.oauth.clients"
+	// OAuthPairingCodes doc type for the codes used to pair a mobile app
+	OAuthPairingCodes = "io.cozy.oauth.pairing_codes"
 	// Permissions doc type for permissions identifying a connection
 	Permissions = "io.cozy.permissions"
 	// Contacts doc type for sharing
 	Contacts = "io.cozy.contacts"
+	// Events doc type for the events of the calendar
+	Events = "io.cozy.calendar.events"
+	// BankAccounts doc type for the bank accounts
+	BankAccounts = "io.cozy.bank.accounts"
+	// BankOperations doc type for the transactions of the bank accounts
+	BankOperations = "io.cozy.bank.operations"
+	// BankAlerts doc type for the alerts configured on the bank accounts
+	BankAlerts = "io.cozy.bank.alerts"
+	// BankMatchings doc type for the matchings between the bills and the
+	// bank transactions
+	BankMatchings = "io.cozy.bank.matchings"
+	// Bills doc type for the bills fetched by the konnectors
+	Bills = "io.cozy.bills"
+	// Notes doc type for the notes edited collaboratively
+	Notes = "io.cozy.notes"
+	// NotesSteps doc type for the editing steps applied to the notes
+	NotesSteps = "io.cozy.notes.steps"
+	// NotesEvents doc type for the realtime events sent to the editors of
+	// a note
+	NotesEvents = "io.cozy.notes.events"
+	// Comments doc type for the comments on the documents, like the files
+	// and the notes
+	Comments = "io.cozy.comments"
+	// BitwardenProfiles doc type for the keys and master password hash of
+	// the password vault
+	BitwardenProfiles = "io.cozy.bitwarden.profiles"
+	// BitwardenCiphers doc type for the encrypted items of the password vault
+	BitwardenCiphers = "io.cozy.bitwarden.ciphers"
+	// BitwardenFolders doc type for the folders of the password vault
+	BitwardenFolders = "io.cozy.bitwarden.folders"
+	// OfficeURL doc type for the parameters of the editor of the office
+	// documents (not persisted)
+	OfficeURL = "io.cozy.office.url"
 	// RemoteRequests doc type for logging requests to remote websites
 	RemoteRequests = "io.cozy.remote.requests"
+	// RemoteSecrets doc type for the secrets injected in the requests to
+	// remote websites, like the API keys
+	RemoteSecrets = "io.cozy.remote.secrets"
 	// Sessions doc type for sessions identifying a connection
 	Sessions = "io.cozy.sessions"
 	// SessionsLogins doc type for sessions identifying a connection
@@ -55,6 +128,8 @@ const (
 	Sharings = "io.cozy.sharings"
 	// SharingsAnswer doc type for credentials exchange for sharings
 	SharingsAnswer = "io.cozy.sharings.answer"
+	// SharingsStatus doc type for the summary of the health of a sharing
+	SharingsStatus = "io.cozy.sharings.status"
 	// SharingsInitialSync doc type for real-time events for initial sync of a
 	// sharing
 	SharingsInitialSync = "io.cozy.sharings.initial-sync"
@@ -62,6 +137,18 @@ const (
 	Triggers = "io.cozy.triggers"
 	// TriggersState doc type for triggers current state, jobs launchers
 	TriggersState = "io.cozy.triggers.state"
+	// WebhookDeliveries doc type for the log of the deliveries of the
+	// outgoing webhooks
+	WebhookDeliveries = "io.cozy.webhooks.deliveries"
+	// WebhookSecrets doc type for the secrets used to sign the payloads of
+	// the outgoing webhooks
+	WebhookSecrets = "io.cozy.webhooks.secrets"
+	// DoctypeVersions doc type for the migrations of the schema of the
+	// doctypes applied on an instance
+	DoctypeVersions = "io.cozy.doctypes.versions"
+	// KonnectorsInteractions doc type for the values asked to the user by a
+	// running konnector, like a two-factor authentication code
+	KonnectorsInteractions = "io.cozy.konnectors.interactions"
 	// Accounts doc type for accounts
 	Accounts = "io.cozy.accounts"
 	// AccountTypes doc type for account types
@@ -83,6 +170,8 @@ const (
 	// DriveSlug is the slug of the default app, files, where the user is
 	// redirected after login.
 	DriveSlug = "drive"
+	// BanksSlug is the slug of the application for the bank accounts.
+	BanksSlug = "banks"
 )
 
 const (
@@ -103,6 +192,9 @@ const (
 	// NoLongerSharedDirID is the identifier of the directory where the files &
 	// folders removed from a sharing but still used via a reference are put
 	NoLongerSharedDirID = "io.cozy.files.no-longer-shared-dir"
+	// DrivesDirID is the identifier of the directory where the folders of
+	// the shared drives are put
+	DrivesDirID = "io.cozy.files.drives-dir"
 )
 
 const (
@@ -110,8 +202,23 @@ const (
 	ContextSettingsID = "io.cozy.settings.context"
 	// DiskUsageID is the id of the settings JSON-API response for disk-usage
 	DiskUsageID = "io.cozy.settings.disk-usage"
+	// QuotasID is the id of the settings JSON-API response for the quotas of
+	// the rate limits
+	QuotasID = "io.cozy.settings.quotas"
 	// InstanceSettingsID is the id of settings document for the instance
 	InstanceSettingsID = "io.cozy.settings.instance"
+	// ThemeSettingsID is the id of the settings JSON-API response for the theme
+	ThemeSettingsID = "io.cozy.settings.theme"
+	// CapabilitiesSettingsID is the id of the settings JSON-API response for
+	// the capabilities
+	CapabilitiesSettingsID = "io.cozy.settings.capabilities"
+	// FlagsSettingsID is the id of the settings JSON-API response for the
+	// feature flags, and of the document for the default flags in the global
+	// database
+	FlagsSettingsID = "io.cozy.settings.flags"
+	// ContextsSettingsID is the id of the document in the global database
+	// with the overrides of the contexts
+	ContextsSettingsID = "io.cozy.settings.contexts"
 )
 
 // ShortCodeLen is the number of chars for the shortcode
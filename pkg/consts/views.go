@@ -7,12 +7,14 @@ import (
 
 // IndexViewsVersion is the version of current definition of views & indexes.
 // This number should be incremented when this file changes.
-const IndexViewsVersion int = 19
+const IndexViewsVersion int = 25
 
 // globalIndexes is the index list required on the global databases to run
 // properly.
 var globalIndexes = []*mango.Index{
 	mango.IndexOnFields(Exports, "by-domain", []string{"domain", "created_at"}),
+	// Used to lookup the deliveries of the lifecycle webhooks of an instance
+	mango.IndexOnFields(WebhookDeliveries, "by-domain", []string{"domain", "created_at"}),
 }
 
 // DomainAndAliasesView defines a view to fetch instances by domain and domain
@@ -61,6 +63,9 @@ var Indexes = []*mango.Index{
 	mango.IndexOnFields(Jobs, "by-worker-and-state", []string{"worker", "state"}),
 	mango.IndexOnFields(Jobs, "by-trigger-id", []string{"trigger_id", "queued_at"}),
 
+	// Used to lookup the deliveries of an outgoing webhook
+	mango.IndexOnFields(WebhookDeliveries, "by-trigger-id", []string{"trigger_id", "created_at"}),
+
 	// Used to lookup oauth clients by name
 	mango.IndexOnFields(OAuthClients, "by-client-name", []string{"client_name"}),
 	mango.IndexOnFields(OAuthClients, "by-notification-platform", []string{"notification_platform"}),
@@ -71,6 +76,8 @@ var Indexes = []*mango.Index{
 	// Used to lookup notifications by their source, ordered by their creation
 	// date
 	mango.IndexOnFields(Notifications, "by-source-id", []string{"source_id", "created_at"}),
+	// Used to lookup the recent notifications for the digest mails
+	mango.IndexOnFields(Notifications, "by-created-at", []string{"created_at"}),
 }
 
 // DiskUsageView is the view used for computing the disk usage
@@ -244,12 +251,180 @@ function(doc) {
 `,
 }
 
+// BankOperationsByAccountAndDate is the view used for the balances of the
+// bank accounts per period, and for finding the transactions of an account
+// on some dates. The key is [account, year, month, day], and the value is
+// [credit, debit, count], to be summed by period with the group level.
+var BankOperationsByAccountAndDate = &couchdb.View{
+	Name:    "by-account-and-date",
+	Doctype: BankOperations,
+	Map: `
+function(doc) {
+  if (typeof doc.account === 'string' && typeof doc.date === 'string' && typeof doc.amount === 'number') {
+    var d = doc.date;
+    var credit = doc.amount > 0 ? doc.amount : 0;
+    var debit = doc.amount < 0 ? doc.amount : 0;
+    emit([doc.account, d.substr(0, 4), d.substr(5, 2), d.substr(8, 2)], [credit, debit, 1]);
+  }
+}`,
+	Reduce: "_sum",
+}
+
+// BillsByDate is the view used for finding the bills on some dates, to match
+// them with the bank transactions.
+var BillsByDate = &couchdb.View{
+	Name:    "by-date",
+	Doctype: Bills,
+	Map: `
+function(doc) {
+  if (typeof doc.date === 'string' && typeof doc.amount === 'number') {
+    emit(doc.date.substr(0, 10));
+  }
+}`,
+}
+
+// FilesFavoritesView is the view used for listing the files and directories
+// marked as favorites, by name.
+var FilesFavoritesView = &couchdb.View{
+	Name:    "favorites",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  if (doc.favorite === true && !doc.trashed &&
+      !(doc.path && doc.path.indexOf('/.cozy_trash') === 0)) {
+    emit(doc.name);
+  }
+}`,
+}
+
+// FilesByTagView is the view used for counting the files and directories
+// by tag, and for fetching the documents with a given tag.
+var FilesByTagView = &couchdb.View{
+	Name:    "by-tag",
+	Doctype: Files,
+	Reduce:  "_count",
+	Map: `
+function(doc) {
+  if (Array.isArray(doc.tags)) {
+    for (var i = 0; i < doc.tags.length; i++) {
+      emit(doc.tags[i]);
+    }
+  }
+}`,
+}
+
+// FilesAccessesByDate is the view used for listing the recently accessed
+// files.
+var FilesAccessesByDate = &couchdb.View{
+	Name:    "by-date",
+	Doctype: FilesAccesses,
+	Map: `
+function(doc) {
+  if (typeof doc.accessed_at === 'string') {
+    emit(doc.accessed_at);
+  }
+}`,
+}
+
+// AuditLogsByDate is the view used for listing the entries of the audit log
+// by date, and for removing the old ones.
+var AuditLogsByDate = &couchdb.View{
+	Name:    "by-date",
+	Doctype: AuditLogs,
+	Map: `
+function(doc) {
+  if (typeof doc.created_at === 'string') {
+    emit(doc.created_at);
+  }
+}`,
+}
+
+// ActivitiesByDate is the view used for listing the activities of the feed
+// by date, and for removing the old ones.
+var ActivitiesByDate = &couchdb.View{
+	Name:    "by-date",
+	Doctype: Activities,
+	Map: `
+function(doc) {
+  if (typeof doc.updated_at === 'string') {
+    emit(doc.updated_at);
+  }
+}`,
+}
+
+// ActivitiesByGroup is the view used for finding the last activity of a
+// group, to add a new event to it.
+var ActivitiesByGroup = &couchdb.View{
+	Name:    "by-group",
+	Doctype: Activities,
+	Map: `
+function(doc) {
+  if (doc.group && typeof doc.updated_at === 'string') {
+    emit([doc.group, doc.updated_at]);
+  }
+}`,
+}
+
+// KonnectorLogsByJob is the view used for listing the log entries of an
+// execution of a konnector, in order.
+var KonnectorLogsByJob = &couchdb.View{
+	Name:    "by-job",
+	Doctype: KonnectorLogs,
+	Map: `
+function(doc) {
+  if (doc.job_id) {
+    emit([doc.job_id, doc.seq]);
+  }
+}`,
+}
+
+// KonnectorLogsByDate is the view used for removing the old log entries of
+// the konnectors.
+var KonnectorLogsByDate = &couchdb.View{
+	Name:    "by-date",
+	Doctype: KonnectorLogs,
+	Map: `
+function(doc) {
+  if (typeof doc.timestamp === 'string') {
+    emit(doc.timestamp);
+  }
+}`,
+}
+
+// CommentsByTarget is the view used for listing the comments on a document,
+// from the oldest to the most recent.
+var CommentsByTarget = &couchdb.View{
+	Name:    "by-target",
+	Doctype: Comments,
+	Map: `
+function(doc) {
+  if (doc.target && doc.target.type && doc.target.id) {
+    emit([doc.target.type, doc.target.id, doc.created_at]);
+  }
+}`,
+}
+
+// FilesACLsView is the view used for finding the ACLs of an OAuth client, and
+// the ACLs on a file or a directory.
+var FilesACLsView = &couchdb.View{
+	Name:    "by-client-and-file",
+	Doctype: FilesACLs,
+	Map: `
+function(doc) {
+  emit(["client", doc.client_id]);
+  emit(["file", doc.file_id]);
+}`,
+}
+
 // Views is the list of all views that are created by the stack.
 var Views = []*couchdb.View{
 	DiskUsageView,
 	FilesReferencedByView,
 	ReferencedBySortedByDatetimeView,
 	FilesByParentView,
+	FilesFavoritesView,
+	FilesByTagView,
+	FilesAccessesByDate,
 	PermissionsShareByCView,
 	PermissionsShareByDocView,
 	PermissionsByDoctype,
@@ -257,6 +432,15 @@ var Views = []*couchdb.View{
 	SharedDocsBySharingID,
 	SharingsByDocTypeView,
 	ContactByEmail,
+	BankOperationsByAccountAndDate,
+	BillsByDate,
+	AuditLogsByDate,
+	ActivitiesByDate,
+	ActivitiesByGroup,
+	KonnectorLogsByJob,
+	KonnectorLogsByDate,
+	CommentsByTarget,
+	FilesACLsView,
 }
 
 // ViewsByDoctype returns the list of views for a specified doc type.
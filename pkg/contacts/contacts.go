@@ -64,6 +64,8 @@ type Contact struct {
 	Name     Name      `json:"name,omitempty"`
 	Birthday string    `json:"birthday,omitempty"`
 	Note     string    `json:"note,omitempty"`
+	Company  string    `json:"company,omitempty"`
+	JobTitle string    `json:"jobTitle,omitempty"`
 	Email    []Email   `json:"email,omitempty"`
 	Address  []Address `json:"address,omitempty"`
 	Phone    []Phone   `json:"phone,omitempty"`
@@ -157,6 +159,23 @@ func Find(db prefixer.Prefixer, contactID string) (*Contact, error) {
 	return doc, err
 }
 
+// GetAll returns all the contacts stored in database
+func GetAll(db couchdb.Database) ([]*Contact, error) {
+	var list []*Contact
+	err := couchdb.ForeachDocs(db, consts.Contacts, func(_ string, raw json.RawMessage) error {
+		var c Contact
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return err
+		}
+		list = append(list, &c)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
 // FindByEmail returns the contact with the given email address, when possible
 func FindByEmail(db couchdb.Database, email string) (*Contact, error) {
 	var res couchdb.ViewResponse
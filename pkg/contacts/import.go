@@ -0,0 +1,98 @@
+package contacts
+
+import (
+	"io"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// ImportResult is the result of the import of a vCard file: the contacts that
+// have been created, and the ones that have been skipped as they are
+// duplicates of existing contacts.
+type ImportResult struct {
+	Created    []*Contact
+	Duplicates []*Contact
+}
+
+// Import parses the vCards of a file and creates a contact for each of them.
+// A vCard is skipped if it looks like a contact already in the database (or
+// earlier in the same file): same email address, or same name and phone
+// number.
+func Import(db couchdb.Database, r io.Reader) (*ImportResult, error) {
+	list, err := ParseVCards(r)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := GetAll(db)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]*Contact)
+	for _, c := range existing {
+		for _, key := range c.duplicateKeys() {
+			known[key] = c
+		}
+	}
+
+	res := &ImportResult{}
+	for _, c := range list {
+		if dup := findDuplicate(known, c); dup != nil {
+			res.Duplicates = append(res.Duplicates, dup)
+			continue
+		}
+		if err := couchdb.CreateDoc(db, c); err != nil {
+			return nil, err
+		}
+		for _, key := range c.duplicateKeys() {
+			known[key] = c
+		}
+		res.Created = append(res.Created, c)
+	}
+	return res, nil
+}
+
+func findDuplicate(known map[string]*Contact, c *Contact) *Contact {
+	for _, key := range c.duplicateKeys() {
+		if dup, ok := known[key]; ok {
+			return dup
+		}
+	}
+	return nil
+}
+
+// duplicateKeys returns the keys used to detect that two contacts are the
+// same person.
+func (c *Contact) duplicateKeys() []string {
+	var keys []string
+	for _, email := range c.Email {
+		if addr := strings.ToLower(strings.TrimSpace(email.Address)); addr != "" {
+			keys = append(keys, "email:"+addr)
+		}
+	}
+	name := strings.ToLower(strings.TrimSpace(c.PrimaryName()))
+	if name == "" {
+		return keys
+	}
+	for _, phone := range c.Phone {
+		if number := normalizePhone(phone.Number); number != "" {
+			keys = append(keys, "phone:"+name+":"+number)
+		}
+	}
+	if len(c.Email) == 0 && len(c.Phone) == 0 {
+		keys = append(keys, "name:"+name)
+	}
+	return keys
+}
+
+// normalizePhone keeps only the digits of a phone number (and the leading +)
+func normalizePhone(number string) string {
+	var b []rune
+	for i, r := range strings.TrimSpace(number) {
+		if (r >= '0' && r <= '9') || (r == '+' && i == 0) {
+			b = append(b, r)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,209 @@
+package contacts
+
+import (
+	"io"
+	"strings"
+
+	vcard "github.com/emersion/go-vcard"
+)
+
+// FromVCard builds a contact from a vCard. The vCard can be in version 3.0 or
+// 4.0.
+func FromVCard(card vcard.Card) *Contact {
+	c := &Contact{}
+
+	if name := card.Name(); name != nil {
+		c.Name = Name{
+			FamilyName:     name.FamilyName,
+			GivenName:      name.GivenName,
+			AdditionalName: name.AdditionalName,
+			NamePrefix:     name.HonorificPrefix,
+			NameSuffix:     name.HonorificSuffix,
+		}
+	}
+	c.FullName = card.PreferredValue(vcard.FieldFormattedName)
+	c.Birthday = card.Value(vcard.FieldBirthday)
+	c.Note = card.Value(vcard.FieldNote)
+	c.JobTitle = card.Value(vcard.FieldTitle)
+	if org := card.Value(vcard.FieldOrganization); org != "" {
+		// The organization can have several components, separated by ;
+		c.Company = strings.Split(org, ";")[0]
+	}
+
+	for _, f := range card[vcard.FieldEmail] {
+		if f.Value == "" {
+			continue
+		}
+		c.Email = append(c.Email, Email{
+			Address: f.Value,
+			Type:    fieldType(f),
+			Primary: isPreferred(f),
+		})
+	}
+
+	for _, f := range card[vcard.FieldTelephone] {
+		number := strings.TrimPrefix(f.Value, "tel:")
+		if number == "" {
+			continue
+		}
+		c.Phone = append(c.Phone, Phone{
+			Number:  number,
+			Type:    fieldType(f),
+			Primary: isPreferred(f),
+		})
+	}
+
+	for _, addr := range card.Addresses() {
+		street := addr.StreetAddress
+		if addr.ExtendedAddress != "" {
+			street = strings.TrimSpace(street + " " + addr.ExtendedAddress)
+		}
+		c.Address = append(c.Address, Address{
+			Street:           street,
+			Pobox:            addr.PostOfficeBox,
+			City:             addr.Locality,
+			Region:           addr.Region,
+			Postcode:         addr.PostalCode,
+			Country:          addr.Country,
+			Type:             fieldType(addr.Field),
+			Primary:          isPreferred(addr.Field),
+			FormattedAddress: addr.Params.Get("LABEL"),
+		})
+	}
+
+	return c
+}
+
+// ToVCard returns the contact as a vCard, in version 4.0.
+func (c *Contact) ToVCard() vcard.Card {
+	card := make(vcard.Card)
+	card.SetValue(vcard.FieldVersion, "4.0")
+	if c.DocID != "" {
+		card.SetValue(vcard.FieldUID, c.DocID)
+	}
+
+	// FN is mandatory in a vCard
+	fullname := c.PrimaryName()
+	if fullname == "" && len(c.Email) > 0 {
+		fullname = c.Email[0].Address
+	}
+	card.SetValue(vcard.FieldFormattedName, fullname)
+	if c.Name != (Name{}) {
+		card.SetName(&vcard.Name{
+			FamilyName:      c.Name.FamilyName,
+			GivenName:       c.Name.GivenName,
+			AdditionalName:  c.Name.AdditionalName,
+			HonorificPrefix: c.Name.NamePrefix,
+			HonorificSuffix: c.Name.NameSuffix,
+		})
+	}
+	if c.Birthday != "" {
+		card.SetValue(vcard.FieldBirthday, c.Birthday)
+	}
+	if c.Note != "" {
+		card.SetValue(vcard.FieldNote, c.Note)
+	}
+	if c.Company != "" {
+		card.SetValue(vcard.FieldOrganization, c.Company)
+	}
+	if c.JobTitle != "" {
+		card.SetValue(vcard.FieldTitle, c.JobTitle)
+	}
+
+	for _, email := range c.Email {
+		card.Add(vcard.FieldEmail, &vcard.Field{
+			Value:  email.Address,
+			Params: fieldParams(email.Type, email.Primary),
+		})
+	}
+	for _, phone := range c.Phone {
+		card.Add(vcard.FieldTelephone, &vcard.Field{
+			Value:  phone.Number,
+			Params: fieldParams(phone.Type, phone.Primary),
+		})
+	}
+	for _, addr := range c.Address {
+		params := fieldParams(addr.Type, addr.Primary)
+		if addr.FormattedAddress != "" {
+			params.Set("LABEL", addr.FormattedAddress)
+		}
+		card.AddAddress(&vcard.Address{
+			Field:         &vcard.Field{Params: params},
+			PostOfficeBox: addr.Pobox,
+			StreetAddress: addr.Street,
+			Locality:      addr.City,
+			Region:        addr.Region,
+			PostalCode:    addr.Postcode,
+			Country:       addr.Country,
+		})
+	}
+
+	return card
+}
+
+// ParseVCards reads all the vCards of a file, and returns them as contacts.
+func ParseVCards(r io.Reader) ([]*Contact, error) {
+	var list []*Contact
+	dec := vcard.NewDecoder(r)
+	for {
+		card, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrInvalidVCard
+		}
+		list = append(list, FromVCard(card))
+	}
+	if len(list) == 0 {
+		return nil, ErrInvalidVCard
+	}
+	return list, nil
+}
+
+// WriteVCards writes the given contacts as vCards.
+func WriteVCards(w io.Writer, list []*Contact) error {
+	enc := vcard.NewEncoder(w)
+	for _, c := range list {
+		if err := enc.Encode(c.ToVCard()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldType returns the first meaningful type of a vCard field, like home or
+// work.
+func fieldType(f *vcard.Field) string {
+	if f == nil {
+		return ""
+	}
+	for _, t := range f.Params.Types() {
+		switch t {
+		case "pref", "internet", "voice", "x400":
+			continue
+		}
+		return t
+	}
+	return ""
+}
+
+// isPreferred returns true if the field has the PREF=1 parameter (vCard 4.0)
+// or the pref type (vCard 3.0).
+func isPreferred(f *vcard.Field) bool {
+	if f == nil {
+		return false
+	}
+	return f.Params.Get(vcard.ParamPreferred) == "1" || f.Params.HasType("pref")
+}
+
+func fieldParams(typ string, primary bool) vcard.Params {
+	params := make(vcard.Params)
+	if typ != "" {
+		params.Set(vcard.ParamType, typ)
+	}
+	if primary {
+		params.Set(vcard.ParamPreferred, "1")
+	}
+	return params
+}
@@ -0,0 +1,130 @@
+package contacts
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const vcard3 = `BEGIN:VCARD
+VERSION:3.0
+N:Doe;John;;Dr.;
+FN:John Doe
+ORG:Example Corp;R&D
+TITLE:Engineer
+EMAIL;TYPE=INTERNET,HOME:john@example.net
+EMAIL;TYPE=INTERNET,WORK,pref:john.doe@example.com
+TEL;TYPE=CELL:+33 6 12 34 56 78
+ADR;TYPE=HOME:;;1 rue de la Paix;Paris;;75001;France
+BDAY:1980-01-02
+NOTE:A note
+END:VCARD
+`
+
+const vcard4 = `BEGIN:VCARD
+VERSION:4.0
+FN:Jane Roe
+EMAIL;PREF=1:jane@example.org
+TEL;VALUE=uri;TYPE=work:tel:+1-555-555-5555
+END:VCARD
+`
+
+func TestParseVCards(t *testing.T) {
+	list, err := ParseVCards(strings.NewReader(vcard3 + vcard4))
+	assert.NoError(t, err)
+	if !assert.Len(t, list, 2) {
+		return
+	}
+
+	john := list[0]
+	assert.Equal(t, "John Doe", john.FullName)
+	assert.Equal(t, "Doe", john.Name.FamilyName)
+	assert.Equal(t, "John", john.Name.GivenName)
+	assert.Equal(t, "Dr.", john.Name.NamePrefix)
+	assert.Equal(t, "Example Corp", john.Company)
+	assert.Equal(t, "Engineer", john.JobTitle)
+	assert.Equal(t, "1980-01-02", john.Birthday)
+	assert.Equal(t, "A note", john.Note)
+	if assert.Len(t, john.Email, 2) {
+		assert.Equal(t, "john@example.net", john.Email[0].Address)
+		assert.Equal(t, "home", john.Email[0].Type)
+		assert.False(t, john.Email[0].Primary)
+		assert.Equal(t, "work", john.Email[1].Type)
+		assert.True(t, john.Email[1].Primary)
+	}
+	if assert.Len(t, john.Phone, 1) {
+		assert.Equal(t, "+33 6 12 34 56 78", john.Phone[0].Number)
+		assert.Equal(t, "cell", john.Phone[0].Type)
+	}
+	if assert.Len(t, john.Address, 1) {
+		assert.Equal(t, "1 rue de la Paix", john.Address[0].Street)
+		assert.Equal(t, "Paris", john.Address[0].City)
+		assert.Equal(t, "75001", john.Address[0].Postcode)
+		assert.Equal(t, "France", john.Address[0].Country)
+	}
+
+	jane := list[1]
+	assert.Equal(t, "Jane Roe", jane.FullName)
+	if assert.Len(t, jane.Email, 1) {
+		assert.True(t, jane.Email[0].Primary)
+	}
+	if assert.Len(t, jane.Phone, 1) {
+		assert.Equal(t, "+1-555-555-5555", jane.Phone[0].Number)
+		assert.Equal(t, "work", jane.Phone[0].Type)
+	}
+}
+
+func TestParseInvalidVCards(t *testing.T) {
+	_, err := ParseVCards(strings.NewReader("not a vcard"))
+	assert.Equal(t, ErrInvalidVCard, err)
+	_, err = ParseVCards(strings.NewReader(""))
+	assert.Equal(t, ErrInvalidVCard, err)
+}
+
+func TestWriteVCards(t *testing.T) {
+	list, err := ParseVCards(strings.NewReader(vcard3))
+	assert.NoError(t, err)
+	list[0].DocID = "42"
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, WriteVCards(buf, list))
+	out := buf.String()
+	assert.Contains(t, out, "VERSION:4.0")
+	assert.Contains(t, out, "UID:42")
+	assert.Contains(t, out, "FN:John Doe")
+
+	// The export can be imported again without losing the fields
+	again, err := ParseVCards(buf)
+	assert.NoError(t, err)
+	if assert.Len(t, again, 1) {
+		again[0].DocID = "42"
+		assert.Equal(t, list[0], again[0])
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	a := &Contact{
+		FullName: "John Doe",
+		Email:    []Email{{Address: "John@Example.net"}},
+		Phone:    []Phone{{Number: "+33 6 12 34 56 78"}},
+	}
+	b := &Contact{
+		FullName: "john doe",
+		Phone:    []Phone{{Number: "+33612345678"}},
+	}
+	c := &Contact{
+		FullName: "Jane Roe",
+		Email:    []Email{{Address: "john@example.net"}},
+	}
+	d := &Contact{FullName: "Jane Roe"}
+
+	known := make(map[string]*Contact)
+	for _, key := range a.duplicateKeys() {
+		known[key] = a
+	}
+	assert.Equal(t, a, findDuplicate(known, b))
+	assert.Equal(t, a, findDuplicate(known, c))
+	assert.Nil(t, findDuplicate(known, d))
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
@@ -178,37 +179,250 @@ func BulkGetDocs(db Database, doctype string, payload []IDRev) ([]map[string]int
 	return results, nil
 }
 
-// BulkUpdateDocs is used to update several docs in one call, as a bulk.
-// olddocs parameter is used for realtime / event triggers.
-func BulkUpdateDocs(db Database, doctype string, docs, olddocs []interface{}) error {
-	if len(docs) == 0 {
+// BulkBatchSize is the maximal number of documents sent to CouchDB in a
+// single _bulk_docs request.
+const BulkBatchSize = 1000
+
+// BulkResult is the result of the write of a document in a _bulk_docs
+// request.
+type BulkResult struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev,omitempty"`
+	Name   string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Err returns the error for the write of the document, or nil if it has
+// been written.
+func (r *BulkResult) Err() error {
+	if r.Name == "" {
 		return nil
 	}
+	status := http.StatusBadRequest
+	switch r.Name {
+	case "conflict":
+		status = http.StatusConflict
+	case "forbidden":
+		status = http.StatusForbidden
+	case "unauthorized":
+		status = http.StatusUnauthorized
+	}
+	return &Error{StatusCode: status, Name: r.Name, Reason: r.Reason}
+}
+
+// BulkError is the error returned by the bulk functions when some documents
+// have not been written. The other documents have been written.
+type BulkError struct {
+	Failures []BulkResult
+}
+
+func (e *BulkError) Error() string {
+	first := e.Failures[0]
+	return fmt.Sprintf("%d documents have not been written (%s: %s)",
+		len(e.Failures), first.ID, first.Err())
+}
+
+// IsBulkError returns whether or not the given error is of type
+// couchdb.BulkError.
+func IsBulkError(err error) (*BulkError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	bulkErr, isBulkErr := err.(*BulkError)
+	return bulkErr, isBulkErr
+}
+
+// bulkDocs sends a batch of documents to the _bulk_docs endpoint, and
+// returns the result for each document, in the same order.
+func bulkDocs(db Database, doctype string, docs []interface{}) ([]BulkResult, error) {
 	body := struct {
 		Docs []interface{} `json:"docs"`
 	}{
 		Docs: docs,
 	}
-	var res []UpdateResponse
+	var res []BulkResult
 	if err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
-		return err
+		return nil, err
 	}
 	if len(res) != len(docs) {
-		return errors.New("BulkUpdateDoc receive an unexpected number of responses")
+		return nil, errors.New("BulkUpdateDoc receive an unexpected number of responses")
 	}
-	for i, doc := range docs {
-		if d, ok := doc.(Doc); ok {
-			d.SetRev(res[i].Rev)
-			if old, ok := olddocs[i].(Doc); ok {
-				RTEvent(db, realtime.EventUpdate, d, old)
-			} else {
-				RTEvent(db, realtime.EventUpdate, d, nil)
+	return res, nil
+}
+
+// BulkCreateDocs is used to create several docs in one call, as a bulk. The
+// documents are sent by batches of BulkBatchSize, and the database is
+// created if it does not exist yet. The documents with an identifier are
+// created with it, and the others will have one generated by CouchDB.
+//
+// When some documents can't be created, the others are still created, and a
+// *BulkError is returned with the failures.
+func BulkCreateDocs(db Database, doctype string, docs []Doc) error {
+	var failures []BulkResult
+	for start := 0; start < len(docs); start += BulkBatchSize {
+		end := start + BulkBatchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		batch := make([]interface{}, end-start)
+		for i, doc := range docs[start:end] {
+			batch[i] = doc
+		}
+		res, err := bulkDocs(db, doctype, batch)
+		if IsNoDatabaseError(err) {
+			err = CreateDB(db, doctype)
+			if err == nil || IsFileExists(err) {
+				res, err = bulkDocs(db, doctype, batch)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		for i, doc := range docs[start:end] {
+			if res[i].Name != "" {
+				failures = append(failures, res[i])
+				continue
 			}
+			doc.SetID(res[i].ID)
+			doc.SetRev(res[i].Rev)
+			RTEvent(db, realtime.EventCreate, doc, nil)
 		}
 	}
+	if len(failures) > 0 {
+		return &BulkError{Failures: failures}
+	}
 	return nil
 }
 
+// BulkUpdateDocs is used to update several docs in one call, as a bulk. The
+// documents are sent by batches of BulkBatchSize.
+// olddocs parameter is used for realtime / event triggers.
+//
+// When some documents can't be updated, the others are still updated, and a
+// *BulkError is returned with the failures.
+func BulkUpdateDocs(db Database, doctype string, docs, olddocs []interface{}) error {
+	var failures []BulkResult
+	for start := 0; start < len(docs); start += BulkBatchSize {
+		end := start + BulkBatchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		res, err := bulkDocs(db, doctype, docs[start:end])
+		if err != nil {
+			return err
+		}
+		for i, doc := range docs[start:end] {
+			if res[i].Name != "" {
+				failures = append(failures, res[i])
+				continue
+			}
+			if d, ok := doc.(Doc); ok {
+				d.SetRev(res[i].Rev)
+				if old, ok := olddocs[start+i].(Doc); ok {
+					RTEvent(db, realtime.EventUpdate, d, old)
+				} else {
+					RTEvent(db, realtime.EventUpdate, d, nil)
+				}
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return &BulkError{Failures: failures}
+	}
+	return nil
+}
+
+// BulkWriter is used to create a lot of documents, like for an import,
+// without keeping them all in memory: the documents are sent to CouchDB by
+// batches, as they are written.
+type BulkWriter struct {
+	db       Database
+	doctype  string
+	size     int
+	batch    []Doc
+	failures []BulkResult
+}
+
+// NewBulkWriter returns a BulkWriter for creating documents of the given
+// doctype.
+func NewBulkWriter(db Database, doctype string) *BulkWriter {
+	return &BulkWriter{db: db, doctype: doctype, size: BulkBatchSize}
+}
+
+// Write adds a document to the current batch, and sends the batch to CouchDB
+// when it is full. The identifier and the revision of the document are set
+// only when its batch has been sent.
+func (w *BulkWriter) Write(doc Doc) error {
+	w.batch = append(w.batch, doc)
+	if len(w.batch) < w.size {
+		return nil
+	}
+	return w.Flush()
+}
+
+// Flush sends the current batch to CouchDB. The documents that can't be
+// created are kept in the failures.
+func (w *BulkWriter) Flush() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	err := BulkCreateDocs(w.db, w.doctype, w.batch)
+	w.batch = w.batch[:0]
+	if bulkErr, ok := IsBulkError(err); ok {
+		w.failures = append(w.failures, bulkErr.Failures...)
+		return nil
+	}
+	return err
+}
+
+// Failures returns the documents that have not been created so far.
+func (w *BulkWriter) Failures() []BulkResult {
+	return w.failures
+}
+
+// Close sends the last batch to CouchDB, and returns a *BulkError if some
+// documents have not been created.
+func (w *BulkWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(w.failures) > 0 {
+		return &BulkError{Failures: w.failures}
+	}
+	return nil
+}
+
+// BulkCreateFromReader creates the documents read from a stream of JSON
+// objects, like a file with one document per line. The documents are decoded
+// and sent to CouchDB by batches, so the stream can be very large. The
+// revisions in the stream are ignored. It returns the number of documents
+// that have been created.
+func BulkCreateFromReader(db Database, doctype string, r io.Reader) (int, error) {
+	w := NewBulkWriter(db, doctype)
+	decoder := json.NewDecoder(r)
+	count := 0
+	for {
+		doc := &JSONDoc{Type: doctype}
+		err := decoder.Decode(&doc.M)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		doc.SetRev("")
+		if err = w.Write(doc); err != nil {
+			return count, err
+		}
+		count++
+	}
+	err := w.Close()
+	if bulkErr, ok := IsBulkError(err); ok {
+		count -= len(bulkErr.Failures)
+	}
+	return count, err
+}
+
 // BulkDeleteDocs is used to delete serveral documents in one call.
 func BulkDeleteDocs(db Database, doctype string, docs []Doc) error {
 	if len(docs) == 0 {
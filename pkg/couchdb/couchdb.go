@@ -15,7 +15,9 @@ import (
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // MaxString is the unicode character "\uFFFF", useful in query as
@@ -54,6 +56,7 @@ func newDatabase(prefix string) prefixer.Prefixer {
 
 // RTEvent published a realtime event for a couchDB change
 func RTEvent(db Database, verb string, doc, oldDoc Doc) {
+	clearDocCache(db, doc)
 	if err := runHooks(db, verb, doc, oldDoc); err != nil {
 		logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb").
 			Errorf("error in hooks on %s %s %v\n", verb, doc.DocType(), err)
@@ -243,22 +246,21 @@ func EscapeCouchdbName(name string) string {
 	return strings.ToLower(name)
 }
 
-func makeDBName(db Database, doctype string) string {
-	dbname := EscapeCouchdbName(db.DBPrefix() + "/" + doctype)
-	return url.PathEscape(dbname)
-}
-
-func dbNameHasPrefix(dbname, dbprefix string) (bool, string) {
-	dbprefix = EscapeCouchdbName(dbprefix + "/")
-	if !strings.HasPrefix(dbname, dbprefix) {
-		return false, ""
-	}
-	return true, strings.Replace(dbname, dbprefix, "", 1)
-}
-
-func makeRequest(db Database, doctype, method, path string, reqbody interface{}, resbody interface{}) error {
+func makeRequest(db Database, doctype, method, path string, reqbody interface{}, resbody interface{}) (err error) {
 	var reqjson []byte
-	var err error
+
+	_, span := tracing.Start(tracing.ContextOf(db), "couchdb "+method,
+		attribute.String("db.system", "couchdb"),
+		attribute.String("db.operation", method),
+		attribute.String("db.doctype", doctype),
+	)
+	defer func() {
+		if IsNotFoundError(err) {
+			tracing.End(span, nil)
+		} else {
+			tracing.End(span, err)
+		}
+	}()
 
 	if reqbody != nil {
 		reqjson, err = json.Marshal(reqbody)
@@ -281,36 +283,39 @@ func makeRequest(db Database, doctype, method, path string, reqbody interface{},
 		log.Debugf("request: %s %s %s", method, path, string(bytes.TrimSpace(reqjson)))
 	}
 
-	req, err := http.NewRequest(
-		method,
-		config.CouchURL().String()+path,
-		bytes.NewReader(reqjson),
-	)
-	// Possible err = wrong method, unparsable url
-	if err != nil {
-		return newRequestError(err)
-	}
-	req.Header.Add("Accept", "application/json")
-	if reqbody != nil {
-		req.Header.Add("Content-Type", "application/json")
-	}
-
-	auth := config.GetConfig().CouchDB.Auth
-	if auth != nil {
-		if p, ok := auth.Password(); ok {
-			req.SetBasicAuth(auth.Username(), p)
-		}
-	}
+	var resp *http.Response
+	var node *Node
 	start := time.Now()
-	resp, err := config.GetConfig().CouchDB.Client.Do(req)
-	elapsed := time.Since(start)
-	// Possible err = mostly connection failure
-	if err != nil {
+	for _, node = range getPool().candidates() {
+		var req *http.Request
+		req, err = newRequest(node, method, path, reqbody != nil, reqjson)
+		// Possible err = wrong method, unparsable url
+		if err != nil {
+			return newRequestError(err)
+		}
+		resp, err = config.GetConfig().CouchDB.Client.Do(req)
+		if err == nil {
+			break
+		}
+		// Possible err = mostly connection failure
 		err = newConnectionError(err)
 		log.Error(err.Error())
+		requestsErrors.WithLabelValues(node.URL.Host, "connection").Inc()
+		node.markFailure(err)
+		if !isRetryable(method, path) {
+			return err
+		}
+	}
+	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	elapsed := time.Since(start)
+	node.markUp()
+	requestsDurations.WithLabelValues(node.URL.Host, method).Observe(elapsed.Seconds())
+	if resp.StatusCode >= 500 {
+		requestsErrors.WithLabelValues(node.URL.Host, "5xx").Inc()
+	}
 
 	if elapsed.Seconds() >= 10 {
 		log.Printf("slow request on %s %s (%s)", method, path, elapsed)
@@ -347,6 +352,29 @@ func makeRequest(db Database, doctype, method, path string, reqbody interface{},
 	return err
 }
 
+func newRequest(node *Node, method, path string, hasBody bool, reqjson []byte) (*http.Request, error) {
+	req, err := http.NewRequest(
+		method,
+		node.URL.String()+path,
+		bytes.NewReader(reqjson),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	if hasBody {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	auth := config.GetConfig().CouchDB.Auth
+	if auth != nil {
+		if p, ok := auth.Password(); ok {
+			req.SetBasicAuth(auth.Username(), p)
+		}
+	}
+	return req, nil
+}
+
 // DBStatus responds with informations on the database: size, number of
 // documents, sequence numbers, etc.
 func DBStatus(db Database, doctype string) (*DBStatusResponse, error) {
@@ -361,12 +389,9 @@ func AllDoctypes(db Database) ([]string, error) {
 	if err := makeRequest(db, "", http.MethodGet, "_all_dbs", nil, &dbs); err != nil {
 		return nil, err
 	}
-	prefix := EscapeCouchdbName(db.DBPrefix())
 	var doctypes []string
 	for _, dbname := range dbs {
-		parts := strings.Split(dbname, "/")
-		if len(parts) == 2 && parts[0] == prefix {
-			doctype := unescapeCouchdbName(parts[1])
+		if doctype, ok := getNaming().ParseDBName(db, dbname); ok {
 			doctypes = append(doctypes, doctype)
 		}
 	}
@@ -384,6 +409,9 @@ func GetDoc(db Database, doctype, id string, out Doc) error {
 	if id == "" {
 		return fmt.Errorf("Missing ID for GetDoc")
 	}
+	if isCachedDoctype(doctype) {
+		return getCachedDoc(db, doctype, id, out)
+	}
 	return makeRequest(db, doctype, http.MethodGet, url.PathEscape(id), nil, out)
 }
 
@@ -415,7 +443,11 @@ func EnsureDBExist(db Database, doctype string) error {
 
 // CreateDB creates the necessary database for a doctype
 func CreateDB(db Database, doctype string) error {
-	return makeRequest(db, doctype, http.MethodPut, "", nil, nil)
+	path := ""
+	if getNaming().Partition(db, doctype) != "" {
+		path = "?partitioned=true"
+	}
+	return makeRequest(db, doctype, http.MethodPut, path, nil, nil)
 }
 
 // DeleteDB destroy the database for a doctype
@@ -438,8 +470,8 @@ func DeleteAllDBs(db Database) error {
 	}
 
 	for _, doctypedb := range dbsList {
-		hasPrefix, doctype := dbNameHasPrefix(doctypedb, dbprefix)
-		if !hasPrefix {
+		doctype, ok := getNaming().ParseDBName(db, doctypedb)
+		if !ok {
 			continue
 		}
 		if err = DeleteDB(db, doctype); err != nil {
@@ -630,7 +662,9 @@ func createDocOrDb(db Database, doc Doc, response interface{}) error {
 // CreateDoc is used to persist the given document in the couchdb
 // database. The document's SetRev and SetID function will be called
 // with the document's new ID and Rev.
-// This function creates a database if this is the first document of its type
+// This function creates a database if this is the first document of its type.
+// For a partitioned database, the identifier is generated by the stack, with
+// the partition of the Database.
 func CreateDoc(db Database, doc Doc) error {
 	var res *UpdateResponse
 
@@ -638,11 +672,22 @@ func CreateDoc(db Database, doc Doc) error {
 		return newDefinedIDError()
 	}
 
-	err := createDocOrDb(db, doc, &res)
+	id, err := newPartitionedID(db, doc.DocType())
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		doc.SetID(id)
+	}
+	err = createDocOrDb(db, doc, &res)
+	if err == nil && !res.Ok {
+		err = fmt.Errorf("CouchDB replied with 200 ok=false")
+	}
 	if err != nil {
+		if id != "" {
+			doc.SetID("")
+		}
 		return err
-	} else if !res.Ok {
-		return fmt.Errorf("CouchDB replied with 200 ok=false")
 	}
 
 	doc.SetID(res.ID)
@@ -760,6 +805,26 @@ func DefineIndexes(db Database, indexes []*mango.Index) error {
 	return nil
 }
 
+// UpdateIndexes defines a list of indexes on databases that can already have
+// older versions of them. When an index is created in a design doc that had
+// an index with other fields, this old index is removed, as CouchDB would
+// else keep it in the same design doc.
+func UpdateIndexes(db Database, indexes []*mango.Index) error {
+	for _, index := range indexes {
+		res, err := DefineIndexRaw(db, index.Doctype, index.Request)
+		if err != nil {
+			return err
+		}
+		if res.Result != "created" || index.Request.DDoc == "" {
+			continue
+		}
+		if err = removeObsoleteIndexes(db, index, res.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // FindDocs returns all documents matching the passed FindRequest
 // documents will be unmarshalled in the provided results slice.
 func FindDocs(db Database, doctype string, req *FindRequest, results interface{}) error {
@@ -1,10 +1,13 @@
 package couchdb
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -166,6 +169,107 @@ func TestBulkUpdateDocs(t *testing.T) {
 	}
 }
 
+func TestBulkCreateDocs(t *testing.T) {
+	doc1 := &testDoc{TestID: "bulk-create-1", Test: "bulk_1"}
+	doc2 := &testDoc{Test: "bulk_2"}
+	err := BulkCreateDocs(TestPrefix, TestDoctype, []Doc{doc1, doc2})
+	assert.NoError(t, err)
+	assert.Equal(t, "bulk-create-1", doc1.ID())
+	assert.NotEmpty(t, doc1.Rev())
+	assert.NotEmpty(t, doc2.ID())
+	assert.NotEmpty(t, doc2.Rev())
+	assertGotEvent(t, realtime.EventCreate, doc2.ID())
+
+	// The documents that can't be created are reported, the others are created
+	doc3 := &testDoc{TestID: "bulk-create-1", Test: "bulk_3"}
+	doc4 := &testDoc{Test: "bulk_4"}
+	err = BulkCreateDocs(TestPrefix, TestDoctype, []Doc{doc3, doc4})
+	bulkErr, ok := IsBulkError(err)
+	if assert.True(t, ok) {
+		assert.Len(t, bulkErr.Failures, 1)
+		assert.Equal(t, "bulk-create-1", bulkErr.Failures[0].ID)
+		assert.True(t, IsConflictError(bulkErr.Failures[0].Err()))
+	}
+	assert.Empty(t, doc3.Rev())
+	assert.NotEmpty(t, doc4.ID())
+
+	fetched := &testDoc{}
+	err = GetDoc(TestPrefix, TestDoctype, "bulk-create-1", fetched)
+	assert.NoError(t, err)
+	assert.Equal(t, "bulk_1", fetched.Test)
+}
+
+func TestBulkCreateFromReader(t *testing.T) {
+	stream := `{"_id": "bulk-reader-1", "test": "line_1"}
+{"_id": "bulk-reader-2", "_rev": "1-abc", "test": "line_2"}
+{"test": "line_3"}
+{"_id": "bulk-reader-1", "test": "line_4"}
+`
+	count, err := BulkCreateFromReader(TestPrefix, TestDoctype, strings.NewReader(stream))
+	assert.Equal(t, 3, count)
+	bulkErr, ok := IsBulkError(err)
+	if assert.True(t, ok) {
+		assert.Len(t, bulkErr.Failures, 1)
+	}
+
+	fetched := &testDoc{}
+	err = GetDoc(TestPrefix, TestDoctype, "bulk-reader-2", fetched)
+	assert.NoError(t, err)
+	assert.Equal(t, "line_2", fetched.Test)
+
+	w := NewBulkWriter(TestPrefix, TestDoctype)
+	w.size = 2
+	docs := []*testDoc{{Test: "w_1"}, {Test: "w_2"}, {Test: "w_3"}}
+	for _, doc := range docs {
+		assert.NoError(t, w.Write(doc))
+	}
+	assert.NotEmpty(t, docs[0].ID())
+	assert.NotEmpty(t, docs[1].ID())
+	assert.Empty(t, docs[2].ID())
+	assert.NoError(t, w.Close())
+	assert.NotEmpty(t, docs[2].ID())
+	assert.Empty(t, w.Failures())
+}
+
+type ctxDatabase struct {
+	Database
+	ctx context.Context
+}
+
+func (db *ctxDatabase) Context() context.Context { return db.ctx }
+
+func TestDocCache(t *testing.T) {
+	conf := &config.GetConfig().CouchDB
+	conf.CachedDoctypes = []string{TestDoctype}
+	defer func() { conf.CachedDoctypes = nil }()
+
+	doc := &testDoc{Test: "cached_1"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	db := &ctxDatabase{TestPrefix, WithDocCache(context.Background())}
+	fetched := &testDoc{}
+	assert.NoError(t, GetDoc(db, TestDoctype, doc.ID(), fetched))
+	assert.Equal(t, "cached_1", fetched.Test)
+
+	// A change made outside of the stack is not seen during the operation
+	outside := &testDoc{TestID: doc.ID(), TestRev: doc.Rev(), Test: "cached_2"}
+	var res UpdateResponse
+	err := makeRequest(TestPrefix, TestDoctype, http.MethodPut, doc.ID(), outside, &res)
+	assert.NoError(t, err)
+	fetched = &testDoc{}
+	assert.NoError(t, GetDoc(db, TestDoctype, doc.ID(), fetched))
+	assert.Equal(t, "cached_1", fetched.Test)
+	fetched = &testDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, doc.ID(), fetched))
+	assert.Equal(t, "cached_2", fetched.Test)
+
+	// A change made by the stack invalidates the caches of all the operations
+	fetched.Test = "cached_3"
+	assert.NoError(t, UpdateDoc(TestPrefix, fetched))
+	other := &testDoc{}
+	assert.NoError(t, GetDoc(db, TestDoctype, doc.ID(), other))
+	assert.Equal(t, "cached_3", other.Test)
+}
+
 func TestDefineIndex(t *testing.T) {
 	err := DefineIndex(TestPrefix, mango.IndexOnFields(TestDoctype, "my-index", []string{"fieldA", "fieldB"}))
 	assert.NoError(t, err)
@@ -175,6 +279,64 @@ func TestDefineIndex(t *testing.T) {
 	assert.NoError(t, err2)
 }
 
+func TestUpdateIndexes(t *testing.T) {
+	doctype := "io.cozy.tests.indexes"
+	defer DeleteDB(TestPrefix, doctype)
+
+	oldIndex := mango.IndexOnFields(doctype, "by-fields", []string{"fieldA"})
+	newIndex := mango.IndexOnFields(doctype, "by-fields", []string{"fieldA", "fieldB"})
+	view := &View{
+		Name:    "by-test",
+		Doctype: doctype,
+		Map:     "function(doc) { emit(doc.test); }",
+	}
+
+	states, err := CheckDesignDocs(TestPrefix, []*View{view}, []*mango.Index{oldIndex})
+	if assert.NoError(t, err) && assert.Len(t, states, 2) {
+		assert.Equal(t, DesignDocMissing, states[0].Status)
+		assert.Equal(t, DesignDocMissing, states[1].Status)
+	}
+
+	assert.NoError(t, DefineIndexes(TestPrefix, []*mango.Index{oldIndex}))
+	assert.NoError(t, DefineViews(TestPrefix, []*View{view}))
+	states, err = CheckDesignDocs(TestPrefix, []*View{view}, []*mango.Index{oldIndex, newIndex})
+	if assert.NoError(t, err) && assert.Len(t, states, 3) {
+		assert.Contains(t, []string{DesignDocReady, DesignDocBuilding}, states[0].Status)
+		assert.Contains(t, []string{DesignDocReady, DesignDocBuilding}, states[1].Status)
+		assert.Equal(t, DesignDocStale, states[2].Status)
+	}
+
+	// The old index is removed from the design doc when the fields change
+	assert.NoError(t, UpdateIndexes(TestPrefix, []*mango.Index{newIndex}))
+	indexes, err := listIndexes(TestPrefix, doctype)
+	assert.NoError(t, err)
+	var inDDoc []*indexDef
+	for _, idx := range indexes {
+		if idx.DDoc == "_design/by-fields" {
+			inDDoc = append(inDDoc, idx)
+		}
+	}
+	if assert.Len(t, inDDoc, 1) {
+		assert.True(t, inDDoc[0].sameFields([]string{"fieldA", "fieldB"}))
+	}
+	states, err = CheckDesignDocs(TestPrefix, nil, []*mango.Index{newIndex})
+	if assert.NoError(t, err) && assert.Len(t, states, 1) {
+		assert.Contains(t, []string{DesignDocReady, DesignDocBuilding}, states[0].Status)
+	}
+
+	// Updating again an up-to-date index does nothing
+	assert.NoError(t, UpdateIndexes(TestPrefix, []*mango.Index{newIndex}))
+	indexes, err = listIndexes(TestPrefix, doctype)
+	assert.NoError(t, err)
+	count := 0
+	for _, idx := range indexes {
+		if idx.DDoc == "_design/by-fields" {
+			count++
+		}
+	}
+	assert.Equal(t, 1, count)
+}
+
 func TestQuery(t *testing.T) {
 
 	// create a few docs for testing
@@ -0,0 +1,229 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+const (
+	// DesignDocMissing is the status of a view or index that does not exist
+	// in CouchDB.
+	DesignDocMissing = "missing"
+	// DesignDocStale is the status of a view or index that exists in CouchDB,
+	// but with a definition different of the one expected by the stack.
+	DesignDocStale = "stale"
+	// DesignDocBuilding is the status of a view or index that is currently
+	// built by CouchDB.
+	DesignDocBuilding = "building"
+	// DesignDocReady is the status of a view or index that is up-to-date and
+	// ready to be used.
+	DesignDocReady = "ready"
+)
+
+// DesignDocState describes the state of a view or an index declared by the
+// stack for a doctype.
+type DesignDocState struct {
+	Doctype  string `json:"doctype"`
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Status   string `json:"status"`
+	Progress int    `json:"progress,omitempty"`
+}
+
+type indexDef struct {
+	DDoc string `json:"ddoc"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Def  struct {
+		Fields []map[string]string `json:"fields"`
+	} `json:"def"`
+}
+
+type indexesResponse struct {
+	Indexes []*indexDef `json:"indexes"`
+}
+
+type activeTask struct {
+	Type           string `json:"type"`
+	Database       string `json:"database"`
+	DesignDocument string `json:"design_document"`
+	Progress       int    `json:"progress"`
+}
+
+type designInfo struct {
+	ViewIndex struct {
+		UpdaterRunning bool `json:"updater_running"`
+	} `json:"view_index"`
+}
+
+func (idx *indexDef) sameFields(fields []string) bool {
+	if len(idx.Def.Fields) != len(fields) {
+		return false
+	}
+	for i, f := range fields {
+		if _, ok := idx.Def.Fields[i][f]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func listIndexes(db Database, doctype string) ([]*indexDef, error) {
+	var res indexesResponse
+	if err := makeRequest(db, doctype, http.MethodGet, "_index", nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Indexes, nil
+}
+
+func deleteIndex(db Database, doctype string, idx *indexDef) error {
+	ddoc := strings.TrimPrefix(idx.DDoc, "_design/")
+	path := "_index/" + url.PathEscape(ddoc) + "/json/" + url.PathEscape(idx.Name)
+	return makeRequest(db, doctype, http.MethodDelete, path, nil, nil)
+}
+
+// removeObsoleteIndexes deletes the indexes inside the design doc of the given
+// index that are not the current one: an index of the design doc is a view
+// named after the index.
+func removeObsoleteIndexes(db Database, index *mango.Index, current string) error {
+	ddoc := "_design/" + index.Request.DDoc
+	var doc struct {
+		Views map[string]json.RawMessage `json:"views"`
+	}
+	if err := makeRequest(db, index.Doctype, http.MethodGet, url.PathEscape(ddoc), nil, &doc); err != nil {
+		return err
+	}
+	for name := range doc.Views {
+		if name == current {
+			continue
+		}
+		idx := &indexDef{DDoc: ddoc, Name: name}
+		if err := deleteIndex(db, index.Doctype, idx); err != nil && !IsNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// activeIndexers returns the progress of the indexers currently running on
+// CouchDB, indexed by database name and design doc.
+func activeIndexers() map[string]int {
+	var tasks []*activeTask
+	progress := make(map[string]int)
+	if err := makeRequest(GlobalDB, "", http.MethodGet, "_active_tasks", nil, &tasks); err != nil {
+		return progress
+	}
+	for _, t := range tasks {
+		if t.Type != "indexer" {
+			continue
+		}
+		// In a cluster, the database is the name of a shard, like
+		// shards/00000000-1fffffff/prefix/doctype.1540982162
+		dbname := t.Database
+		if strings.HasPrefix(dbname, "shards/") {
+			parts := strings.SplitN(dbname, "/", 3)
+			if len(parts) == 3 {
+				dbname = parts[2]
+			}
+			if i := strings.LastIndex(dbname, "."); i > 0 {
+				dbname = dbname[:i]
+			}
+		}
+		key := dbname + "#" + t.DesignDocument
+		if p, ok := progress[key]; !ok || t.Progress < p {
+			progress[key] = t.Progress
+		}
+	}
+	return progress
+}
+
+// CheckDesignDocs returns the state of the given views and indexes for a
+// database: missing, stale, building or ready.
+func CheckDesignDocs(db Database, views []*View, indexes []*mango.Index) ([]*DesignDocState, error) {
+	running := activeIndexers()
+	building := func(doctype, ddoc string) (int, bool) {
+		dbname, _ := url.PathUnescape(makeDBName(db, doctype))
+		p, ok := running[dbname+"#_design/"+ddoc]
+		return p, ok
+	}
+
+	var states []*DesignDocState
+	for _, v := range views {
+		state := &DesignDocState{Doctype: v.Doctype, Name: v.Name, Kind: "view"}
+		states = append(states, state)
+
+		id := "_design/" + v.Name
+		var doc ViewDesignDoc
+		err := makeRequest(db, v.Doctype, http.MethodGet, url.PathEscape(id), nil, &doc)
+		if IsNotFoundError(err) {
+			state.Status = DesignDocMissing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		expected := &ViewDesignDoc{
+			Lang:  "javascript",
+			Views: map[string]*View{v.Name: v},
+		}
+		if !equalViews(&doc, expected) {
+			state.Status = DesignDocStale
+			continue
+		}
+		if p, ok := building(v.Doctype, v.Name); ok {
+			state.Status = DesignDocBuilding
+			state.Progress = p
+			continue
+		}
+		var info designInfo
+		err = makeRequest(db, v.Doctype, http.MethodGet, url.PathEscape(id)+"/_info", nil, &info)
+		if err != nil {
+			return nil, err
+		}
+		if info.ViewIndex.UpdaterRunning {
+			state.Status = DesignDocBuilding
+		} else {
+			state.Status = DesignDocReady
+		}
+	}
+
+	byDoctype := make(map[string][]*indexDef)
+	for _, index := range indexes {
+		state := &DesignDocState{Doctype: index.Doctype, Name: index.Request.DDoc, Kind: "index"}
+		states = append(states, state)
+
+		defs, ok := byDoctype[index.Doctype]
+		if !ok {
+			var err error
+			defs, err = listIndexes(db, index.Doctype)
+			if err != nil && !IsNoDatabaseError(err) {
+				return nil, err
+			}
+			byDoctype[index.Doctype] = defs
+		}
+
+		state.Status = DesignDocMissing
+		for _, def := range defs {
+			if def.DDoc != "_design/"+index.Request.DDoc {
+				continue
+			}
+			if def.sameFields(index.Request.Index) {
+				state.Status = DesignDocReady
+				break
+			}
+			state.Status = DesignDocStale
+		}
+		if state.Status == DesignDocReady {
+			if p, ok := building(index.Doctype, index.Request.DDoc); ok {
+				state.Status = DesignDocBuilding
+				state.Progress = p
+			}
+		}
+	}
+
+	return states, nil
+}
@@ -0,0 +1,186 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/tracing"
+)
+
+// The hot documents, like the settings of the instance, the permissions and
+// the manifests of the applications, are fetched several times for a single
+// request. They can be cached at two levels:
+//
+//   - for the duration of an operation (HTTP request, job), in memory, when
+//     its context has been created with WithDocCache
+//   - in redis, for a short duration, if couchdb.doc_cache_ttl has been
+//     configured.
+//
+// The cached documents are removed from the caches when their realtime event
+// is published, ie when they are written by the stack. The TTLs are a
+// protection for the changes made outside of the stack.
+
+// requestCacheTTL is the maximal duration during which a document is kept in
+// the cache of an operation
+const requestCacheTTL = time.Minute
+
+// maxInvalidations is the number of invalidations kept in memory over which
+// the old ones are removed
+const maxInvalidations = 10000
+
+const docCachePrefix = "couchdb:"
+
+type docCacheCtxKey struct{}
+
+type docCacheEntry struct {
+	doc     []byte
+	fetched time.Time
+}
+
+// docCache is the cache of the documents fetched during an operation.
+type docCache struct {
+	mu      sync.Mutex
+	entries map[string]docCacheEntry
+}
+
+var (
+	// invalidations are the dates of the last writes of the cached
+	// documents, to ignore the older entries in the caches of the operations
+	// that don't have made the writes
+	invalidations   = make(map[string]time.Time)
+	invalidationsMu sync.Mutex
+)
+
+// WithDocCache returns a context with a cache for the hot documents, that can
+// be used for the duration of an operation.
+func WithDocCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, docCacheCtxKey{}, &docCache{
+		entries: make(map[string]docCacheEntry),
+	})
+}
+
+// operationCache returns the cache of the operation made with db, or nil if
+// it has none.
+func operationCache(db Database) *docCache {
+	c, _ := tracing.ContextOf(db).Value(docCacheCtxKey{}).(*docCache)
+	return c
+}
+
+// isCachedDoctype returns true if the documents of the given doctype can be
+// cached.
+func isCachedDoctype(doctype string) bool {
+	for _, dt := range config.GetConfig().CouchDB.CachedDoctypes {
+		if dt == doctype {
+			return true
+		}
+	}
+	return false
+}
+
+func docCacheKey(db Database, doctype, id string) string {
+	return docCachePrefix + makeDBName(db, doctype) + "/" + id
+}
+
+// getCachedDoc works like GetDoc, but looks for the document in the caches
+// first, and keeps it in the caches when it is fetched from CouchDB.
+func getCachedDoc(db Database, doctype, id string, out Doc) error {
+	key := docCacheKey(db, doctype, id)
+	if doc, ok := lookupDocCache(db, key); ok {
+		return json.Unmarshal(doc, out)
+	}
+
+	fetched := time.Now()
+	var doc json.RawMessage
+	if err := makeRequest(db, doctype, http.MethodGet, url.PathEscape(id), nil, &doc); err != nil {
+		return err
+	}
+	storeInDocCache(db, key, doc, fetched)
+	return json.Unmarshal(doc, out)
+}
+
+func lookupDocCache(db Database, key string) ([]byte, bool) {
+	c := operationCache(db)
+	if c != nil {
+		c.mu.Lock()
+		entry, ok := c.entries[key]
+		c.mu.Unlock()
+		if ok && time.Since(entry.fetched) < requestCacheTTL && !isInvalidated(key, entry.fetched) {
+			return entry.doc, true
+		}
+	}
+
+	if config.GetConfig().CouchDB.DocCacheTTL <= 0 {
+		return nil, false
+	}
+	r, ok := config.GetConfig().CacheStorage.Get(key)
+	if !ok {
+		return nil, false
+	}
+	doc, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false
+	}
+	if c != nil {
+		c.mu.Lock()
+		c.entries[key] = docCacheEntry{doc: doc, fetched: time.Now()}
+		c.mu.Unlock()
+	}
+	return doc, true
+}
+
+func storeInDocCache(db Database, key string, doc []byte, fetched time.Time) {
+	if c := operationCache(db); c != nil {
+		c.mu.Lock()
+		c.entries[key] = docCacheEntry{doc: doc, fetched: fetched}
+		c.mu.Unlock()
+	}
+	if ttl := config.GetConfig().CouchDB.DocCacheTTL; ttl > 0 && !isInvalidated(key, fetched) {
+		config.GetConfig().CacheStorage.Set(key, doc, ttl)
+	}
+}
+
+// isInvalidated returns true if the document has been written since the
+// given date.
+func isInvalidated(key string, fetched time.Time) bool {
+	invalidationsMu.Lock()
+	defer invalidationsMu.Unlock()
+	written, ok := invalidations[key]
+	return ok && !written.Before(fetched)
+}
+
+// clearDocCache removes a document from the caches, after it has been
+// written.
+func clearDocCache(db Database, doc Doc) {
+	doctype := doc.DocType()
+	if !isCachedDoctype(doctype) {
+		return
+	}
+	key := docCacheKey(db, doctype, doc.ID())
+	if c := operationCache(db); c != nil {
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+	}
+	if config.GetConfig().CouchDB.DocCacheTTL > 0 {
+		config.GetConfig().CacheStorage.Clear(key)
+	}
+
+	invalidationsMu.Lock()
+	defer invalidationsMu.Unlock()
+	now := time.Now()
+	if len(invalidations) >= maxInvalidations {
+		for k, written := range invalidations {
+			// The older entries in the caches of the operations have expired
+			if now.Sub(written) > requestCacheTTL {
+				delete(invalidations, k)
+			}
+		}
+	}
+	invalidations[key] = now
+}
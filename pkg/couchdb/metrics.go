@@ -0,0 +1,76 @@
+package couchdb
+
+import (
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// requestsDurations is a histogram of the durations of the requests sent to
+// CouchDB, labelled by node and HTTP method.
+var requestsDurations = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "couchdb",
+		Subsystem: "requests",
+		Name:      "durations",
+
+		Help: "Durations in seconds of the requests to CouchDB, labelled by node and method.",
+
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	},
+	[]string{"node", "method"},
+)
+
+// requestsErrors is a counter of the requests to CouchDB that have failed,
+// labelled by node and kind of error (connection or status code class).
+var requestsErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "couchdb",
+		Subsystem: "requests",
+		Name:      "errors",
+
+		Help: "Number of failed requests to CouchDB, labelled by node and kind of error.",
+	},
+	[]string{"node", "kind"},
+)
+
+type nodesHealthCollector struct {
+	prometheus.Desc
+}
+
+func newNodesHealthCollector() prometheus.Collector {
+	desc := prometheus.NewDesc(
+		prometheus.BuildFQName("couchdb", "nodes", "healthy"),
+		`Health of the CouchDB nodes (1 for up, 0 for down)`,
+		[]string{"node"},
+		prometheus.Labels{},
+	)
+	return &nodesHealthCollector{*desc}
+}
+
+func (c *nodesHealthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- &c.Desc
+}
+
+func (c *nodesHealthCollector) Collect(ch chan<- prometheus.Metric) {
+	if config.GetConfig() == nil {
+		return
+	}
+	for _, n := range getPool().nodes {
+		var v float64
+		if n.Healthy() {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			&c.Desc, prometheus.GaugeValue, v,
+			n.URL.Host,
+		)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(
+		requestsDurations,
+		requestsErrors,
+		newNodesHealthCollector(),
+	)
+}
@@ -0,0 +1,156 @@
+package couchdb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// Naming is the strategy used to build the names of the CouchDB databases
+// from a Database and a doctype. The code outside of this package should not
+// build the names from the prefix of the Database, but ask the Naming.
+type Naming interface {
+	// DBNamePrefix returns the prefix of the names of the CouchDB databases
+	// of db, for the doctypes that are not global.
+	DBNamePrefix(db Database) string
+	// DBName returns the name of the CouchDB database where the documents of
+	// the given doctype are persisted. It is not URL-escaped.
+	DBName(db Database, doctype string) string
+	// ParseDBName returns the doctype of the documents persisted in the given
+	// CouchDB database, if this database belongs to db.
+	ParseDBName(db Database, dbname string) (string, bool)
+	// Partition returns the partition of the documents of db for the given
+	// doctype, or an empty string if the database of this doctype is not
+	// partitioned (CouchDB 3.x). The identifiers of the documents in a
+	// partitioned database are prefixed by their partition and a colon.
+	Partition(db Database, doctype string) string
+}
+
+// DefaultNaming is the naming strategy used by default: there is one database
+// per doctype and per instance, named like <prefix>/<doctype>. It can be
+// customized with:
+//   - a global prefix, to host several stacks on the same CouchDB cluster
+//   - global doctypes, whose documents are shared by all the instances and
+//     stored in the database of the GlobalDB
+//   - partitioned doctypes, whose databases are created with partitions.
+type DefaultNaming struct {
+	Prefix              string
+	GlobalDoctypes      []string
+	PartitionedDoctypes []string
+}
+
+func (n *DefaultNaming) isGlobal(doctype string) bool {
+	for _, dt := range n.GlobalDoctypes {
+		if dt == doctype {
+			return true
+		}
+	}
+	return false
+}
+
+// DBNamePrefix implements the Naming interface
+func (n *DefaultNaming) DBNamePrefix(db Database) string {
+	return EscapeCouchdbName(n.Prefix + db.DBPrefix())
+}
+
+// DBName implements the Naming interface
+func (n *DefaultNaming) DBName(db Database, doctype string) string {
+	if n.isGlobal(doctype) {
+		db = GlobalDB
+	}
+	return n.DBNamePrefix(db) + "/" + EscapeCouchdbName(doctype)
+}
+
+// ParseDBName implements the Naming interface
+func (n *DefaultNaming) ParseDBName(db Database, dbname string) (string, bool) {
+	prefix := n.DBNamePrefix(db) + "/"
+	if !strings.HasPrefix(dbname, prefix) {
+		return "", false
+	}
+	doctype := unescapeCouchdbName(strings.TrimPrefix(dbname, prefix))
+	if doctype == "" || strings.Contains(doctype, "/") {
+		return "", false
+	}
+	return doctype, true
+}
+
+// Partition implements the Naming interface. The partition is the prefix of
+// the instance, so that the documents of an instance are grouped together,
+// even in the database of a global doctype.
+func (n *DefaultNaming) Partition(db Database, doctype string) string {
+	for _, dt := range n.PartitionedDoctypes {
+		if dt == doctype {
+			return EscapeCouchdbName(db.DBPrefix())
+		}
+	}
+	return ""
+}
+
+var (
+	namingMu   sync.Mutex
+	naming     Naming
+	namingConf *config.CouchDB
+)
+
+// SetNaming can be used to replace the naming strategy built from the
+// configuration.
+func SetNaming(n Naming) {
+	namingMu.Lock()
+	defer namingMu.Unlock()
+	naming = n
+	namingConf = nil
+}
+
+func getNaming() Naming {
+	namingMu.Lock()
+	defer namingMu.Unlock()
+	if naming != nil && namingConf == nil {
+		return naming
+	}
+	conf := &config.GetConfig().CouchDB
+	if naming == nil || namingConf != conf {
+		naming = &DefaultNaming{
+			Prefix:              conf.Prefix,
+			GlobalDoctypes:      conf.GlobalDoctypes,
+			PartitionedDoctypes: conf.PartitionedDoctypes,
+		}
+		namingConf = conf
+	}
+	return naming
+}
+
+// DBName returns the name of the CouchDB database used for the documents of
+// the given doctype.
+func DBName(db Database, doctype string) string {
+	return getNaming().DBName(db, doctype)
+}
+
+// DBNamePrefix returns the prefix of the names of the CouchDB databases used
+// for the documents of db.
+func DBNamePrefix(db Database) string {
+	return getNaming().DBNamePrefix(db)
+}
+
+// newPartitionedID returns a new identifier for a document in a partitioned
+// database, or an empty string if the database is not partitioned (CouchDB
+// generates the identifier in this case).
+func newPartitionedID(db Database, doctype string) (string, error) {
+	partition := getNaming().Partition(db, doctype)
+	if partition == "" {
+		return "", nil
+	}
+	var id [16]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return "", err
+	}
+	return partition + ":" + hex.EncodeToString(id[:]), nil
+}
+
+func makeDBName(db Database, doctype string) string {
+	return url.PathEscape(DBName(db, doctype))
+}
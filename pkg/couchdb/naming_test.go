@@ -0,0 +1,69 @@
+package couchdb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultNaming(t *testing.T) {
+	db := newDatabase("cozy1234")
+	n := &DefaultNaming{}
+	assert.Equal(t, "cozy1234/io-cozy-files", n.DBName(db, "io.cozy.files"))
+	doctype, ok := n.ParseDBName(db, "cozy1234/io-cozy-files")
+	assert.True(t, ok)
+	assert.Equal(t, "io.cozy.files", doctype)
+	_, ok = n.ParseDBName(db, "cozy5678/io-cozy-files")
+	assert.False(t, ok)
+
+	n = &DefaultNaming{
+		Prefix:              "stack1_",
+		GlobalDoctypes:      []string{"io.cozy.registry.versions"},
+		PartitionedDoctypes: []string{"io.cozy.timeseries"},
+	}
+	assert.Equal(t, "stack1_cozy1234/io-cozy-files", n.DBName(db, "io.cozy.files"))
+	assert.Equal(t, "stack1_global/io-cozy-registry-versions", n.DBName(db, "io.cozy.registry.versions"))
+	_, ok = n.ParseDBName(db, "cozy1234/io-cozy-files")
+	assert.False(t, ok)
+	_, ok = n.ParseDBName(db, "stack1_global/io-cozy-registry-versions")
+	assert.False(t, ok)
+	doctype, ok = n.ParseDBName(db, "stack1_cozy1234/io-cozy-files")
+	assert.True(t, ok)
+	assert.Equal(t, "io.cozy.files", doctype)
+	assert.Equal(t, "cozy1234", n.Partition(db, "io.cozy.timeseries"))
+	assert.Equal(t, "", n.Partition(db, "io.cozy.files"))
+	assert.Equal(t, "stack1_cozy1234", n.DBNamePrefix(db))
+}
+
+func TestNewPartitionedID(t *testing.T) {
+	SetNaming(&DefaultNaming{PartitionedDoctypes: []string{"io.cozy.tests.partitioned"}})
+	defer SetNaming(nil)
+
+	db := newDatabase("couchdb-tests-partitioned")
+	id, err := newPartitionedID(db, "io.cozy.tests")
+	assert.NoError(t, err)
+	assert.Equal(t, "", id)
+	id, err = newPartitionedID(db, "io.cozy.tests.partitioned")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^couchdb-tests-partitioned:[0-9a-f]{32}$`, id)
+}
+
+func TestCreateDocInPartitionedDB(t *testing.T) {
+	SetNaming(&DefaultNaming{PartitionedDoctypes: []string{"io.cozy.tests.partitioned"}})
+	defer SetNaming(nil)
+
+	db := newDatabase("couchdb-tests-partitioned")
+	defer func() { _ = DeleteDB(db, "io.cozy.tests.partitioned") }()
+	doc := &JSONDoc{Type: "io.cozy.tests.partitioned", M: map[string]interface{}{"test": "partitioned"}}
+	err := CreateDoc(db, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, strings.HasPrefix(doc.ID(), "couchdb-tests-partitioned:"))
+
+	fetched := &JSONDoc{}
+	err = GetDoc(db, "io.cozy.tests.partitioned", doc.ID(), fetched)
+	assert.NoError(t, err)
+	assert.Equal(t, "partitioned", fetched.M["test"])
+}
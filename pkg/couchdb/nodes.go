@@ -0,0 +1,222 @@
+package couchdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// maxNodeFailures is the number of consecutive connection errors after which
+// a node is considered as down, and the requests are sent to another node.
+const maxNodeFailures = 3
+
+// Node is a CouchDB node of the cluster, with its health status.
+type Node struct {
+	URL *url.URL
+
+	mu       sync.Mutex
+	healthy  bool
+	failures int
+	lastErr  error
+}
+
+// NodeStatus is the status of a CouchDB node, as reported by NodesStatus.
+type NodeStatus struct {
+	URL       string `json:"url"`
+	Healthy   bool   `json:"healthy"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Healthy returns true if the node can be used for requests.
+func (n *Node) Healthy() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.healthy
+}
+
+func (n *Node) markUp() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.healthy {
+		logger.WithNamespace("couchdb").Infof("Node %s is up", n.URL.Host)
+	}
+	n.healthy = true
+	n.failures = 0
+	n.lastErr = nil
+}
+
+func (n *Node) markFailure(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.failures++
+	n.lastErr = err
+	if n.healthy && n.failures >= maxNodeFailures {
+		logger.WithNamespace("couchdb").Warnf("Node %s is down: %s", n.URL.Host, err)
+		n.healthy = false
+	}
+}
+
+func (n *Node) status() NodeStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s := NodeStatus{
+		URL:      n.URL.String(),
+		Healthy:  n.healthy,
+		Failures: n.failures,
+	}
+	if n.lastErr != nil {
+		s.LastError = n.lastErr.Error()
+	}
+	return s
+}
+
+type nodesPool struct {
+	conf  *config.CouchDB
+	nodes []*Node
+}
+
+var (
+	poolMu sync.Mutex
+	pool   *nodesPool
+)
+
+// getPool returns the pool of nodes for the current configuration. It is
+// rebuilt if the configuration has changed (useful for tests).
+func getPool() *nodesPool {
+	conf := &config.GetConfig().CouchDB
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	if pool != nil && pool.conf == conf {
+		return pool
+	}
+	urls := conf.Nodes
+	if len(urls) == 0 {
+		urls = []*url.URL{conf.URL}
+	}
+	nodes := make([]*Node, len(urls))
+	for i, u := range urls {
+		nodes[i] = &Node{URL: u, healthy: true}
+	}
+	pool = &nodesPool{conf: conf, nodes: nodes}
+	return pool
+}
+
+// candidates returns the list of nodes to try for a request, in order: the
+// healthy nodes first, and then the other ones as a last resort.
+func (p *nodesPool) candidates() []*Node {
+	list := make([]*Node, 0, len(p.nodes))
+	var down []*Node
+	for _, n := range p.nodes {
+		if n.Healthy() {
+			list = append(list, n)
+		} else {
+			down = append(down, n)
+		}
+	}
+	return append(list, down...)
+}
+
+// pickNode returns the node that should be used for the next request.
+func pickNode() *Node {
+	return getPool().candidates()[0]
+}
+
+// NodesStatus returns the health status of the CouchDB nodes.
+func NodesStatus() []NodeStatus {
+	p := getPool()
+	list := make([]NodeStatus, len(p.nodes))
+	for i, n := range p.nodes {
+		list[i] = n.status()
+	}
+	return list
+}
+
+// isRetryable returns true if a request can be sent again to another node
+// after a connection error, ie when it is idempotent.
+func isRetryable(method, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		parts := strings.SplitN(path, "/", 3)
+		last := parts[len(parts)-1]
+		return strings.HasPrefix(last, "_find") ||
+			strings.HasPrefix(last, "_all_docs") ||
+			strings.HasPrefix(last, "_bulk_get") ||
+			strings.HasPrefix(last, "_index") ||
+			strings.Contains(path, "/_view/")
+	}
+	return false
+}
+
+func checkNode(n *Node) {
+	conf := &config.GetConfig().CouchDB
+	req, err := http.NewRequest(http.MethodGet, n.URL.String()+"_up", nil)
+	if err != nil {
+		n.markFailure(err)
+		return
+	}
+	if conf.Auth != nil {
+		if p, ok := conf.Auth.Password(); ok {
+			req.SetBasicAuth(conf.Auth.Username(), p)
+		}
+	}
+	res, err := conf.Client.Do(req)
+	if err != nil {
+		n.markFailure(newConnectionError(err))
+		return
+	}
+	res.Body.Close()
+	// CouchDB 2.0 does not have the _up endpoint, a 404 still means that the
+	// node is responding.
+	if res.StatusCode >= 500 {
+		n.markFailure(fmt.Errorf("unexpected status code %d", res.StatusCode))
+		return
+	}
+	n.markUp()
+}
+
+// StartNodesHealthCheck starts a goroutine that checks periodically the health
+// of the CouchDB nodes, in order to put back in the pool the nodes that were
+// considered as down.
+func StartNodesHealthCheck() utils.Shutdowner {
+	interval := config.GetConfig().CouchDB.HealthCheckInterval
+	if interval <= 0 || len(getPool().nodes) < 2 {
+		return utils.NopShutdown
+	}
+	closed := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-time.After(interval):
+				for _, n := range getPool().nodes {
+					checkNode(n)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &healthChecker{closed}
+}
+
+type healthChecker struct {
+	closed chan struct{}
+}
+
+func (h *healthChecker) Shutdown(ctx context.Context) error {
+	select {
+	case h.closed <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return nil
+}
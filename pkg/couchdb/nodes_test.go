@@ -0,0 +1,40 @@
+package couchdb
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodesCandidates(t *testing.T) {
+	u1, _ := url.Parse("http://couch1:5984/")
+	u2, _ := url.Parse("http://couch2:5984/")
+	n1 := &Node{URL: u1, healthy: true}
+	n2 := &Node{URL: u2, healthy: true}
+	p := &nodesPool{nodes: []*Node{n1, n2}}
+	assert.Equal(t, []*Node{n1, n2}, p.candidates())
+
+	for i := 0; i < maxNodeFailures-1; i++ {
+		n1.markFailure(errors.New("connection refused"))
+	}
+	assert.True(t, n1.Healthy())
+	n1.markFailure(errors.New("connection refused"))
+	assert.False(t, n1.Healthy())
+	assert.Equal(t, []*Node{n2, n1}, p.candidates())
+
+	n1.markUp()
+	assert.True(t, n1.Healthy())
+	assert.Equal(t, []*Node{n1, n2}, p.candidates())
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(http.MethodGet, "db/doc"))
+	assert.True(t, isRetryable(http.MethodPut, "db/doc"))
+	assert.True(t, isRetryable(http.MethodPost, "db/_find"))
+	assert.True(t, isRetryable(http.MethodPost, "db/_design/foo/_view/foo?limit=1"))
+	assert.False(t, isRetryable(http.MethodPost, "db/"))
+	assert.False(t, isRetryable(http.MethodPost, "db/_bulk_docs"))
+}
@@ -0,0 +1,149 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Params are the cost parameters of argon2id for hashing the
+// passphrases.
+type Argon2Params struct {
+	// Time is the number of passes over the memory
+	Time uint32
+	// Memory is the size of the memory, in KiB
+	Memory uint32
+	// Threads is the number of threads used for hashing
+	Threads uint8
+}
+
+// DefaultArgon2Params are the parameters used when no other parameters have
+// been configured. They are the second recommended option of the RFC 9106.
+var DefaultArgon2Params = Argon2Params{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+type argon2Hash struct {
+	params Argon2Params
+	salt   []byte
+	dk     []byte
+}
+
+func (h *argon2Hash) UnmarshalText(hashbytes []byte) error {
+	// "argon2id", time, memory, threads, salt, argon2id derived key
+	vals := bytes.Split(hashbytes, sep)
+	if len(vals) != 6 {
+		return ErrInvalidHash
+	}
+	if string(vals[0]) != "argon2id" {
+		return ErrInvalidHash
+	}
+
+	t, err := strconv.ParseUint(string(vals[1]), 10, 32)
+	if err != nil {
+		return ErrInvalidHash
+	}
+	m, err := strconv.ParseUint(string(vals[2]), 10, 32)
+	if err != nil {
+		return ErrInvalidHash
+	}
+	p, err := strconv.ParseUint(string(vals[3]), 10, 8)
+	if err != nil || p == 0 {
+		return ErrInvalidHash
+	}
+	h.params = Argon2Params{Time: uint32(t), Memory: uint32(m), Threads: uint8(p)}
+
+	h.salt = make([]byte, hex.DecodedLen(len(vals[4])))
+	if _, err = hex.Decode(h.salt, vals[4]); err != nil {
+		return ErrInvalidHash
+	}
+	h.dk = make([]byte, hex.DecodedLen(len(vals[5])))
+	if _, err = hex.Decode(h.dk, vals[5]); err != nil || len(h.dk) == 0 {
+		return ErrInvalidHash
+	}
+	return nil
+}
+
+func (h *argon2Hash) MarshalText() ([]byte, error) {
+	s := fmt.Sprintf("argon2id$%d$%d$%d$%x$%x",
+		h.params.Time, h.params.Memory, h.params.Threads, h.salt, h.dk)
+	return []byte(s), nil
+}
+
+func (h *argon2Hash) Compare(passphrase []byte) error {
+	other := argon2.IDKey(passphrase, h.salt, h.params.Time, h.params.Memory,
+		h.params.Threads, uint32(len(h.dk)))
+	if subtle.ConstantTimeCompare(h.dk, other) == 1 {
+		return nil
+	}
+	return ErrMismatchedHashAndPassphrase
+}
+
+func (h *argon2Hash) NeedUpdate(params Argon2Params) bool {
+	return h.params != params ||
+		len(h.salt) != defaultSaltLen || len(h.dk) != defaultDkLen
+}
+
+// GenerateFromPassphrase returns the derived key of the passphrase, with
+// argon2id and the default parameters. The parameters are prepended to the
+// derived key and separated by the "$" character (0x24).
+func GenerateFromPassphrase(passphrase []byte) ([]byte, error) {
+	return GenerateFromPassphraseWithParams(passphrase, DefaultArgon2Params)
+}
+
+// GenerateFromPassphraseWithParams works like GenerateFromPassphrase, but
+// with the given cost parameters.
+func GenerateFromPassphraseWithParams(passphrase []byte, params Argon2Params) ([]byte, error) {
+	if params.Time == 0 || params.Memory == 0 || params.Threads == 0 {
+		params = DefaultArgon2Params
+	}
+	h := &argon2Hash{params: params}
+	h.salt = GenerateRandomBytes(defaultSaltLen)
+	h.dk = argon2.IDKey(passphrase, h.salt, params.Time, params.Memory,
+		params.Threads, defaultDkLen)
+	return h.MarshalText()
+}
+
+// CompareHashAndPassphrase compares a derived key with the possible cleartext
+// equivalent. The parameters used in the provided derived key are used. The
+// comparison performed by this function is constant-time.
+//
+// It returns an error if the derived keys do not match. It also returns a
+// needUpdate boolean indicating whether or not the passphrase hash has
+// outdated parameters (or is a legacy scrypt hash) and should be recomputed.
+func CompareHashAndPassphrase(hash []byte, passphrase []byte) (needUpdate bool, err error) {
+	return CompareHashAndPassphraseWithParams(hash, passphrase, DefaultArgon2Params)
+}
+
+// CompareHashAndPassphraseWithParams works like CompareHashAndPassphrase,
+// but the hash needs an update if it has not been made with the given
+// parameters.
+func CompareHashAndPassphraseWithParams(hash []byte, passphrase []byte, params Argon2Params) (needUpdate bool, err error) {
+	if params.Time == 0 || params.Memory == 0 || params.Threads == 0 {
+		params = DefaultArgon2Params
+	}
+	if bytes.HasPrefix(hash, []byte("scrypt$")) {
+		var h scryptHash
+		if err = h.UnmarshalText(hash); err != nil {
+			return false, err
+		}
+		if err = h.Compare(passphrase); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	var h argon2Hash
+	if err = h.UnmarshalText(hash); err != nil {
+		return false, err
+	}
+	if err = h.Compare(passphrase); err != nil {
+		return false, err
+	}
+	return h.NeedUpdate(params), nil
+}
@@ -14,7 +14,17 @@ var SigningMethod = jwt.SigningMethodHS512
 // NewJWT creates a JWT token with the given claims,
 // and signs it with the secret
 func NewJWT(secret []byte, claims jwt.Claims) (string, error) {
+	return NewJWTWithKeyID(secret, "", claims)
+}
+
+// NewJWTWithKeyID creates a JWT token with the given claims, signs it with
+// the secret, and puts the identifier of this secret in the kid header (when
+// it is not empty)
+func NewJWTWithKeyID(secret []byte, kid string, claims jwt.Claims) (string, error) {
 	token := jwt.NewWithClaims(SigningMethod, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
 	return token.SignedString(secret)
 }
 
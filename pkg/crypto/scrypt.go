@@ -14,16 +14,6 @@ import (
 
 // The code below is heavily inspired by https://github.com/elithrar/simple-scrypt
 
-// Scrypt params, this set of parameters is recommended in
-// - https://www.tarsnap.com/scrypt/scrypt-slides.pdf
-// - https://godoc.org/golang.org/x/crypto/scrypt#Key
-// - https://godoc.org/github.com/elithrar/simple-scrypt#DefaultParams
-// - https://blog.filippo.io/the-scrypt-parameters/
-// - https://github.com/golang/go/issues/22082
-const defaultN = 32768
-const defaultR = 8
-const defaultP = 1
-
 // hash length
 const defaultDkLen = 32
 
@@ -39,6 +29,8 @@ var (
 
 var sep = []byte("$")
 
+// scryptHash is the legacy format of the hashes of the passphrases. They are
+// still accepted, but they are replaced by argon2id hashes when possible.
 type scryptHash struct {
 	n    int
 	r    int
@@ -109,46 +101,3 @@ func (h *scryptHash) Compare(passphrase []byte) error {
 
 	return ErrMismatchedHashAndPassphrase
 }
-
-func (h *scryptHash) NeedUpdate() bool {
-	return h.n != defaultN || h.p != defaultP || h.r != defaultR ||
-		len(h.salt) != defaultSaltLen || len(h.dk) != defaultDkLen
-}
-
-// GenerateFromPassphrase returns the derived key of the passphrase using the
-// parameters provided. The parameters are prepended to the derived key and
-// separated by the "$" character (0x24).
-// If the parameters provided are less than the minimum acceptable values,
-// an error will be returned.
-func GenerateFromPassphrase(passphrase []byte) ([]byte, error) {
-	var h = &scryptHash{n: defaultN, r: defaultR, p: defaultP}
-	var err error
-
-	h.salt = GenerateRandomBytes(defaultSaltLen)
-
-	// scrypt.Key returns the raw scrypt derived key.
-	h.dk, err = scrypt.Key(passphrase, h.salt, h.n, h.r, h.p, defaultDkLen)
-	if err != nil {
-		return nil, err
-	}
-
-	return h.MarshalText()
-}
-
-// CompareHashAndPassphrase compares a derived key with the possible cleartext
-// equivalent. The parameters used in the provided derived key are used. The
-// comparison performed by this function is constant-time.
-//
-// It returns an error if the derived keys do not match. It also returns a
-// needUpdate boolean indicating whether or not the passphrase hash has
-// outdated parameters and should be recomputed.
-func CompareHashAndPassphrase(hash []byte, passphrase []byte) (needUpdate bool, err error) {
-	var h = &scryptHash{}
-	if err = h.UnmarshalText(hash); err != nil {
-		return false, err
-	}
-	if err = h.Compare(passphrase); err != nil {
-		return false, err
-	}
-	return h.NeedUpdate(), nil
-}
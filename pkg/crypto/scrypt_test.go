@@ -18,7 +18,23 @@ func TestGenerateFromPassphrase(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 5, bytes.Count(val, sep), "hash should have 6 parts")
 	algo := string(bytes.Split(val, sep)[0])
-	assert.Equal(t, "scrypt", algo, "hash should contain algo")
+	assert.Equal(t, "argon2id", algo, "hash should contain algo")
+}
+
+func TestGenerateFromPassphraseWithParams(t *testing.T) {
+	params := Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1}
+	val, err := GenerateFromPassphraseWithParams(pass, params)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(val, []byte("argon2id$1$8192$1$")))
+
+	needUpdate, err := CompareHashAndPassphraseWithParams(val, pass, params)
+	assert.NoError(t, err)
+	assert.False(t, needUpdate)
+	needUpdate, err = CompareHashAndPassphrase(val, pass)
+	assert.NoError(t, err)
+	assert.True(t, needUpdate)
+	_, err = CompareHashAndPassphraseWithParams(val, []byte("not the passphrase"), params)
+	assert.Equal(t, ErrMismatchedHashAndPassphrase, err)
 }
 
 func TestCompareGoodHashAndPassphrase(t *testing.T) {
@@ -32,11 +48,20 @@ func TestCompareBadHashAndPassphrase(t *testing.T) {
 }
 
 func TestUpdateHashNoUpdate(t *testing.T) {
-	needUpdate, err := CompareHashAndPassphrase(goodhash, pass)
+	hash, err := GenerateFromPassphrase(pass)
+	assert.NoError(t, err)
+	needUpdate, err := CompareHashAndPassphrase(hash, pass)
 	assert.NoError(t, err)
 	assert.False(t, needUpdate)
 }
 
+func TestUpdateLegacyHash(t *testing.T) {
+	// The scrypt hashes are upgraded to argon2id
+	needUpdate, err := CompareHashAndPassphrase(goodhash, pass)
+	assert.NoError(t, err)
+	assert.True(t, needUpdate)
+}
+
 func TestUpdateHashNeedUpdate(t *testing.T) {
 	needUpdate, err := CompareHashAndPassphrase(oldhash, pass)
 	assert.NoError(t, err)
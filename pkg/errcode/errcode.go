@@ -0,0 +1,101 @@
+// Package errcode is for the errors with a stable and machine-readable code.
+// The code is sent in the JSON-API error objects, so that the clients can
+// know what has failed without parsing the messages, and translate them.
+package errcode
+
+import "net/http"
+
+// The codes of the errors. They are part of the API, and must not be changed.
+const (
+	BadRequest         = "bad_request"
+	Unauthorized       = "unauthorized"
+	Forbidden          = "forbidden"
+	NotFound           = "not_found"
+	MethodNotAllowed   = "method_not_allowed"
+	Conflict           = "conflict"
+	Gone               = "gone"
+	PreconditionFailed = "precondition_failed"
+	TooLarge           = "too_large"
+	InvalidParameter   = "invalid_parameter"
+	TooManyRequests    = "too_many_requests"
+	Internal           = "internal_error"
+	BadGateway         = "bad_gateway"
+	Unavailable        = "unavailable"
+
+	QuotaExceeded  = "quota_exceeded"
+	InvalidHash    = "invalid_hash"
+	LengthMismatch = "length_mismatch"
+
+	PasswordTooShort = "password_too_short"
+	PasswordTooWeak  = "password_too_weak"
+	PasswordBanned   = "password_banned"
+	PasswordReused   = "password_reused"
+)
+
+// Error is an error with a stable code, and the HTTP status for it.
+type Error struct {
+	Code    string
+	Status  int
+	Message string
+}
+
+// New returns an error with the given code, status and message. The message
+// is in english, and can be used as a key for the translations.
+func New(code string, status int, message string) *Error {
+	return &Error{Code: code, Status: status, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is returns true if the error has the given code.
+func Is(err error, code string) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == code
+}
+
+// Of returns the code of the given error. If the error has no code, the
+// generic code for the status is returned.
+func Of(err error, status int) string {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return FromStatus(status)
+}
+
+// FromStatus returns the generic code for an HTTP status.
+func FromStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return BadRequest
+	case http.StatusUnauthorized:
+		return Unauthorized
+	case http.StatusForbidden:
+		return Forbidden
+	case http.StatusNotFound:
+		return NotFound
+	case http.StatusMethodNotAllowed:
+		return MethodNotAllowed
+	case http.StatusConflict:
+		return Conflict
+	case http.StatusGone:
+		return Gone
+	case http.StatusPreconditionFailed:
+		return PreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return TooLarge
+	case http.StatusUnprocessableEntity:
+		return InvalidParameter
+	case http.StatusTooManyRequests:
+		return TooManyRequests
+	case http.StatusBadGateway:
+		return BadGateway
+	case http.StatusServiceUnavailable:
+		return Unavailable
+	}
+	if status >= 500 {
+		return Internal
+	}
+	return ""
+}
@@ -0,0 +1,248 @@
+// Package feature is for the feature flags of the instances. A flag can be
+// set for an instance, for its context in the configuration file, or in the
+// default flags saved in the global database, in this order of priority. The
+// value of a flag can be a list of rules with a ratio, for a progressive
+// rollout: each instance picks a value, always the same for a given flag.
+package feature
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"math"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+// The sources of the flags, from the highest priority to the lowest
+const (
+	SourceInstance = "instance"
+	SourceContext  = "context"
+	SourceDefaults = "defaults"
+)
+
+const (
+	defaultsCacheKey = "feature-flags-defaults"
+	defaultsCacheTTL = 5 * time.Minute
+)
+
+// Flags are the feature flags of an instance, with the source of each flag.
+type Flags struct {
+	M       map[string]interface{}
+	Sources map[string]string
+}
+
+// ID implements the realtime.Doc interface
+func (f *Flags) ID() string { return consts.FlagsSettingsID }
+
+// DocType implements the realtime.Doc interface
+func (f *Flags) DocType() string { return consts.Settings }
+
+// MarshalJSON implements the json.Marshaler interface
+func (f *Flags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.M)
+}
+
+// Get returns the value of a flag, or nil if the flag is not set.
+func (f *Flags) Get(name string) interface{} {
+	return f.M[name]
+}
+
+// Bool returns the value of a boolean flag. A flag that is not set, or that
+// is not a boolean, is false.
+func (f *Flags) Bool(name string) bool {
+	b, _ := f.M[name].(bool)
+	return b
+}
+
+// String returns the value of a string flag, or an empty string.
+func (f *Flags) String(name string) string {
+	s, _ := f.M[name].(string)
+	return s
+}
+
+// Int returns the value of a numeric flag, or 0.
+func (f *Flags) Int(name string) int {
+	n, _ := f.M[name].(float64)
+	return int(n)
+}
+
+// GetFlags returns the feature flags of the instance.
+func GetFlags(inst *instance.Instance) (*Flags, error) {
+	defaults, err := GetDefaults()
+	if err != nil {
+		return nil, err
+	}
+	var ctxFlags map[string]interface{}
+	if ctx, err := inst.SettingsContext(); err == nil {
+		ctxFlags = contextFlags(ctx["features"])
+	}
+	return buildFlags(inst.DocID, inst.FeatureFlags, ctxFlags, defaults), nil
+}
+
+// IsEnabled returns true if the boolean flag is enabled for the instance. It
+// is false if the flags can't be loaded.
+func IsEnabled(inst *instance.Instance, name string) bool {
+	flags, err := GetFlags(inst)
+	if err != nil {
+		inst.Logger().WithField("nspace", "feature").
+			Warnf("Cannot load the flags: %s", err)
+		return false
+	}
+	return flags.Bool(name)
+}
+
+// SetInstanceFlags changes the flags of an instance (a nil value removes a
+// flag), and sends a realtime event to the apps with the new flags.
+func SetInstanceFlags(inst *instance.Instance, flags map[string]interface{}) (*Flags, error) {
+	if err := inst.SetFeatureFlags(flags); err != nil {
+		return nil, err
+	}
+	updated, err := GetFlags(inst)
+	if err != nil {
+		return nil, err
+	}
+	realtime.GetHub().Publish(inst, realtime.EventUpdate, updated, nil)
+	return updated, nil
+}
+
+// GetDefaults returns the default flags, from the global database. They are
+// cached, as they are read for every instance.
+func GetDefaults() (map[string]interface{}, error) {
+	cache := config.GetConfig().CacheStorage
+	if r, ok := cache.Get(defaultsCacheKey); ok {
+		var defaults map[string]interface{}
+		if err := json.NewDecoder(r).Decode(&defaults); err == nil {
+			return defaults, nil
+		}
+	}
+	doc, err := getDefaultsDoc()
+	if err != nil {
+		return nil, err
+	}
+	defaults := doc.M
+	delete(defaults, "_id")
+	delete(defaults, "_rev")
+	if buf, err := json.Marshal(defaults); err == nil {
+		cache.Set(defaultsCacheKey, buf, defaultsCacheTTL)
+	}
+	return defaults, nil
+}
+
+// SetDefaults replaces the default flags. The instances see the new flags on
+// their next request, but no realtime event is sent.
+func SetDefaults(defaults map[string]interface{}) error {
+	doc, err := getDefaultsDoc()
+	if err != nil {
+		return err
+	}
+	rev := doc.Rev()
+	doc.M = make(map[string]interface{}, len(defaults))
+	for k, v := range defaults {
+		if v != nil {
+			doc.M[k] = v
+		}
+	}
+	doc.SetID(consts.FlagsSettingsID)
+	if rev == "" {
+		err = couchdb.CreateNamedDocWithDB(couchdb.GlobalDB, doc)
+	} else {
+		doc.SetRev(rev)
+		err = couchdb.UpdateDoc(couchdb.GlobalDB, doc)
+	}
+	config.GetConfig().CacheStorage.Clear(defaultsCacheKey)
+	return err
+}
+
+func getDefaultsDoc() (*couchdb.JSONDoc, error) {
+	doc := &couchdb.JSONDoc{Type: consts.Settings}
+	err := couchdb.GetDoc(couchdb.GlobalDB, consts.Settings, consts.FlagsSettingsID, doc)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		doc.M = make(map[string]interface{})
+		return doc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// contextFlags returns the flags of a context: the features key of the
+// context can be a map of flags, or a list of the names of the enabled flags.
+func contextFlags(features interface{}) map[string]interface{} {
+	switch features := features.(type) {
+	case map[string]interface{}:
+		return features
+	case []interface{}:
+		flags := make(map[string]interface{}, len(features))
+		for _, name := range features {
+			if name, ok := name.(string); ok {
+				flags[name] = true
+			}
+		}
+		return flags
+	}
+	return nil
+}
+
+// buildFlags merges the flags of the sources, from the lowest priority to
+// the highest one, and resolves the ratios.
+func buildFlags(instanceID string, instFlags, ctxFlags, defaults map[string]interface{}) *Flags {
+	flags := &Flags{
+		M:       make(map[string]interface{}),
+		Sources: make(map[string]string),
+	}
+	sources := []struct {
+		name  string
+		flags map[string]interface{}
+	}{
+		{SourceDefaults, defaults},
+		{SourceContext, ctxFlags},
+		{SourceInstance, instFlags},
+	}
+	for _, source := range sources {
+		for name, value := range source.flags {
+			value, ok := resolve(instanceID, name, value)
+			if !ok {
+				continue
+			}
+			flags.M[name] = value
+			flags.Sources[name] = source.name
+		}
+	}
+	return flags
+}
+
+// resolve returns the value of a flag for an instance. When the value is a
+// list of rules like {"ratio": 0.1, "value": true}, the instance is placed
+// in [0, 1) by a hash of its identifier and of the flag name, and the rule
+// is picked by adding the ratios. If no rule matches, the flag is not set by
+// this source.
+func resolve(instanceID, name string, value interface{}) (interface{}, bool) {
+	rules, ok := value.([]interface{})
+	if !ok || len(rules) == 0 {
+		return value, true
+	}
+	if first, ok := rules[0].(map[string]interface{}); !ok || first["ratio"] == nil {
+		return value, true
+	}
+	sum := crc32.ChecksumIEEE([]byte(name + ":" + instanceID))
+	position := float64(sum) / (math.MaxUint32 + 1.0)
+	threshold := 0.0
+	for _, rule := range rules {
+		rule, ok := rule.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ratio, _ := rule["ratio"].(float64)
+		threshold += ratio
+		if position < threshold {
+			return rule["value"], true
+		}
+	}
+	return nil, false
+}
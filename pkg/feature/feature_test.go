@@ -0,0 +1,65 @@
+package feature
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextFlags(t *testing.T) {
+	assert.Nil(t, contextFlags(nil))
+	assert.Equal(t, map[string]interface{}{"drive.new_ui": true, "max_apps": 10.0},
+		contextFlags(map[string]interface{}{"drive.new_ui": true, "max_apps": 10.0}))
+	assert.Equal(t, map[string]interface{}{"drive.new_ui": true, "photos.maps": true},
+		contextFlags([]interface{}{"drive.new_ui", "photos.maps"}))
+}
+
+func TestBuildFlags(t *testing.T) {
+	defaults := map[string]interface{}{"a": "default", "b": "default", "c": "default"}
+	ctx := map[string]interface{}{"b": "context", "c": "context"}
+	inst := map[string]interface{}{"c": "instance", "d": 42.0}
+	flags := buildFlags("instance-id", inst, ctx, defaults)
+	assert.Equal(t, "default", flags.String("a"))
+	assert.Equal(t, "context", flags.String("b"))
+	assert.Equal(t, "instance", flags.String("c"))
+	assert.Equal(t, 42, flags.Int("d"))
+	assert.False(t, flags.Bool("e"))
+	assert.Equal(t, map[string]string{
+		"a": SourceDefaults,
+		"b": SourceContext,
+		"c": SourceInstance,
+		"d": SourceInstance,
+	}, flags.Sources)
+}
+
+func TestRatio(t *testing.T) {
+	rules := []interface{}{
+		map[string]interface{}{"ratio": 0.25, "value": true},
+		map[string]interface{}{"ratio": 0.75, "value": false},
+	}
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("instance-%d", i)
+		value, ok := resolve(id, "drive.new_ui", rules)
+		assert.True(t, ok)
+		if value == true {
+			enabled++
+		}
+		// The value is always the same for an instance
+		again, _ := resolve(id, "drive.new_ui", rules)
+		assert.Equal(t, value, again)
+	}
+	assert.InDelta(t, 250, enabled, 60)
+
+	// The instances that are not in a rule don't have the flag
+	partial := []interface{}{map[string]interface{}{"ratio": 0.0, "value": true}}
+	_, ok := resolve("instance-1", "drive.new_ui", partial)
+	assert.False(t, ok)
+
+	// A list without ratios is a normal value
+	list := []interface{}{"a", "b"}
+	value, ok := resolve("instance-1", "list", list)
+	assert.True(t, ok)
+	assert.Equal(t, list, value)
+}
@@ -0,0 +1,179 @@
+// Package geo is for the geospatial queries on the documents: the documents
+// with a position can be found inside a bounding box or near a point, and
+// they are returned as GeoJSON.
+package geo
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// earthRadius is the mean radius of the Earth, in meters
+const earthRadius = 6371000.0
+
+var (
+	// ErrInvalidBBox is used when the bounding box of a query is not valid
+	ErrInvalidBBox = errors.New("The bounding box must be minLong,minLat,maxLong,maxLat")
+	// ErrInvalidCircle is used when the point or the radius of a query is not
+	// valid
+	ErrInvalidCircle = errors.New("The point must be a latitude and a longitude, and the radius a positive distance in meters")
+)
+
+// Point is a position, in degrees.
+type Point struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"long"`
+}
+
+// valid returns true if the latitude and the longitude are in their ranges.
+func (p Point) valid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Long >= -180 && p.Long <= 180
+}
+
+// Distance returns the distance in meters between two points, with the
+// haversine formula.
+func Distance(a, b Point) float64 {
+	rad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * rad
+	dLong := (b.Long - a.Long) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(h, 1)))
+}
+
+// Area is a zone of the Earth where the documents are looked for.
+type Area interface {
+	// Latitudes returns the range of the latitudes of the points in the area,
+	// used to select the documents in the index.
+	Latitudes() (min, max float64)
+	// Contains returns true if the point is inside the area.
+	Contains(p Point) bool
+}
+
+// BBox is a bounding box, with the same order as for GeoJSON: the south-west
+// corner, then the north-east corner. The box crosses the antimeridian when
+// the west longitude is greater than the east longitude.
+type BBox struct {
+	West  float64
+	South float64
+	East  float64
+	North float64
+}
+
+// ParseBBox parses a bounding box given as minLong,minLat,maxLong,maxLat.
+func ParseBBox(s string) (*BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, ErrInvalidBBox
+	}
+	var values [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(v) {
+			return nil, ErrInvalidBBox
+		}
+		values[i] = v
+	}
+	b := &BBox{West: values[0], South: values[1], East: values[2], North: values[3]}
+	sw := Point{Lat: b.South, Long: b.West}
+	ne := Point{Lat: b.North, Long: b.East}
+	if !sw.valid() || !ne.valid() || b.South > b.North {
+		return nil, ErrInvalidBBox
+	}
+	return b, nil
+}
+
+// Latitudes is used to implement the Area interface
+func (b *BBox) Latitudes() (float64, float64) {
+	return b.South, b.North
+}
+
+// Contains is used to implement the Area interface
+func (b *BBox) Contains(p Point) bool {
+	if p.Lat < b.South || p.Lat > b.North {
+		return false
+	}
+	if b.West <= b.East {
+		return p.Long >= b.West && p.Long <= b.East
+	}
+	return p.Long >= b.West || p.Long <= b.East
+}
+
+// Circle is the zone around a point, with a radius in meters.
+type Circle struct {
+	Center Point
+	Radius float64
+}
+
+// ParseCircle parses the latitude, the longitude and the radius of a circle.
+func ParseCircle(lat, long, radius string) (*Circle, error) {
+	var values [3]float64
+	for i, s := range []string{lat, long, radius} {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, ErrInvalidCircle
+		}
+		values[i] = v
+	}
+	c := &Circle{
+		Center: Point{Lat: values[0], Long: values[1]},
+		Radius: values[2],
+	}
+	if !c.Center.valid() || c.Radius <= 0 {
+		return nil, ErrInvalidCircle
+	}
+	return c, nil
+}
+
+// Latitudes is used to implement the Area interface
+func (c *Circle) Latitudes() (float64, float64) {
+	delta := c.Radius / earthRadius * 180 / math.Pi
+	return math.Max(c.Center.Lat-delta, -90), math.Min(c.Center.Lat+delta, 90)
+}
+
+// Contains is used to implement the Area interface
+func (c *Circle) Contains(p Point) bool {
+	return Distance(c.Center, p) <= c.Radius
+}
+
+// Geometry is a GeoJSON geometry. Only the points are used for the
+// documents.
+type Geometry struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// Feature is a GeoJSON feature, for a document: its geometry is the position
+// of the document, and its properties are the document itself.
+type Feature struct {
+	Type       string          `json:"type"`
+	ID         string          `json:"id"`
+	Geometry   Geometry        `json:"geometry"`
+	Properties json.RawMessage `json:"properties"`
+}
+
+// NewFeature returns a GeoJSON feature for the document at the given point.
+// The coordinates of GeoJSON are the longitude, then the latitude.
+func NewFeature(id string, p Point, doc json.RawMessage) *Feature {
+	return &Feature{
+		Type: "Feature",
+		ID:   id,
+		Geometry: Geometry{
+			Type:        "Point",
+			Coordinates: [2]float64{p.Long, p.Lat},
+		},
+		Properties: doc,
+	}
+}
+
+// FeatureCollection is a GeoJSON collection of features. Next is a foreign
+// member, true when the limit has been reached and some features are not
+// included.
+type FeatureCollection struct {
+	Type     string     `json:"type"`
+	Features []*Feature `json:"features"`
+	Next     bool       `json:"next"`
+}
@@ -0,0 +1,55 @@
+package geo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBBox(t *testing.T) {
+	b, err := ParseBBox("2.2,48.8,2.5,48.9")
+	assert.NoError(t, err)
+	assert.Equal(t, &BBox{West: 2.2, South: 48.8, East: 2.5, North: 48.9}, b)
+	assert.True(t, b.Contains(Point{Lat: 48.85, Long: 2.35}))
+	assert.False(t, b.Contains(Point{Lat: 45.76, Long: 4.83}))
+
+	// Across the antimeridian
+	b, err = ParseBBox("170,-20,-170,-10")
+	assert.NoError(t, err)
+	assert.True(t, b.Contains(Point{Lat: -17.7, Long: 178.0}))
+	assert.True(t, b.Contains(Point{Lat: -17.7, Long: -175.0}))
+	assert.False(t, b.Contains(Point{Lat: -17.7, Long: 0}))
+
+	for _, s := range []string{"", "1,2,3", "a,b,c,d", "0,10,1,5", "0,-95,1,5", "-200,0,1,1"} {
+		_, err = ParseBBox(s)
+		assert.Equal(t, ErrInvalidBBox, err)
+	}
+}
+
+func TestParseCircle(t *testing.T) {
+	c, err := ParseCircle("48.8566", "2.3522", "10000")
+	assert.NoError(t, err)
+	// Versailles is at about 17km from Paris, and Boulogne at about 8km
+	assert.True(t, c.Contains(Point{Lat: 48.8352, Long: 2.2410}))
+	assert.False(t, c.Contains(Point{Lat: 48.8049, Long: 2.1204}))
+	min, max := c.Latitudes()
+	assert.InDelta(t, 48.7667, min, 0.001)
+	assert.InDelta(t, 48.9465, max, 0.001)
+
+	for _, args := range [][3]string{
+		{"48.8566", "2.3522", "0"},
+		{"48.8566", "2.3522", "-1"},
+		{"98", "2.3522", "10"},
+		{"48.8566", "", "10"},
+	} {
+		_, err = ParseCircle(args[0], args[1], args[2])
+		assert.Equal(t, ErrInvalidCircle, err)
+	}
+}
+
+func TestDistance(t *testing.T) {
+	paris := Point{Lat: 48.8566, Long: 2.3522}
+	lyon := Point{Lat: 45.7640, Long: 4.8357}
+	assert.InDelta(t, 391500, Distance(paris, lyon), 1000)
+	assert.Equal(t, 0.0, Distance(paris, paris))
+}
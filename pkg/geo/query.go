@@ -0,0 +1,99 @@
+package geo
+
+import "github.com/cozy/cozy-stack/pkg/couchdb"
+
+// viewName is the name of the view used as a geospatial index
+const viewName = "geo-index"
+
+// queryBatchSize is the number of rows of the index read in one request:
+// the index only narrows the latitudes, and the rows are then filtered.
+const queryBatchSize = 500
+
+// geoMap is the map function of the index. The position of a document is its
+// geo field, with a GeoJSON point, or the GPS coordinates of the metadata for
+// the photos. The key is the latitude, and the value the longitude.
+const geoMap = `
+function(doc) {
+  if (doc.trashed) return;
+  var lat, lng;
+  if (doc.geo && doc.geo.type === "Point" && doc.geo.coordinates) {
+    lng = doc.geo.coordinates[0];
+    lat = doc.geo.coordinates[1];
+  } else if (doc.metadata && doc.metadata.gps) {
+    lat = doc.metadata.gps.lat;
+    lng = doc.metadata.gps.long;
+  }
+  if (typeof lat === "number" && typeof lng === "number") {
+    emit(lat, lng);
+  }
+}`
+
+func geoView(doctype string) *couchdb.View {
+	return &couchdb.View{
+		Name:    viewName,
+		Doctype: doctype,
+		Map:     geoMap,
+	}
+}
+
+// Query returns the documents of the doctype that have a position inside the
+// area, as GeoJSON features. At most limit features are returned, and the
+// boolean is true if there are more documents in the area.
+func Query(db couchdb.Database, doctype string, area Area, limit int) ([]*Feature, bool, error) {
+	view := geoView(doctype)
+	min, max := area.Latitudes()
+	req := &couchdb.ViewRequest{
+		StartKey:    min,
+		EndKey:      max,
+		Limit:       queryBatchSize + 1,
+		IncludeDocs: true,
+	}
+
+	var features []*Feature
+	defined := false
+	for {
+		var res couchdb.ViewResponse
+		err := couchdb.ExecView(db, view, req, &res)
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, false, nil
+		}
+		if couchdb.IsNotFoundError(err) && !defined {
+			// The index is created the first time that it is used
+			if err = couchdb.DefineViews(db, []*couchdb.View{view}); err != nil {
+				return nil, false, err
+			}
+			defined = true
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		rows := res.Rows
+		if len(rows) > queryBatchSize {
+			rows = rows[:queryBatchSize]
+		}
+		for _, row := range rows {
+			lat, okLat := row.Key.(float64)
+			long, okLong := row.Value.(float64)
+			if !okLat || !okLong {
+				continue
+			}
+			p := Point{Lat: lat, Long: long}
+			if !area.Contains(p) {
+				continue
+			}
+			if len(features) == limit {
+				return features, true, nil
+			}
+			features = append(features, NewFeature(row.ID, p, row.Doc))
+		}
+
+		if len(res.Rows) <= queryBatchSize {
+			return features, false, nil
+		}
+		next := res.Rows[queryBatchSize]
+		req.StartKey = next.Key
+		req.StartKeyDocID = next.ID
+	}
+}
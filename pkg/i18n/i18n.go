@@ -2,9 +2,14 @@ package i18n
 
 import (
 	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/statik/fs"
 	gotext "gopkg.in/leonelquinteros/gotext.v1"
 )
 
@@ -16,6 +21,15 @@ var SupportedLocales = []string{"en", "fr"}
 
 var translations = make(map[string]*gotext.Po)
 
+// contextTranslations is a cache of the translations parsed from the po files
+// inserted as assets for a context: {context:locale -> *contextPo}
+var contextTranslations sync.Map
+
+type contextPo struct {
+	etag string
+	po   *gotext.Po
+}
+
 // LoadLocale creates the translation object for a locale from the content of a .po file
 func LoadLocale(identifier string, rawPO []byte) {
 	po := &gotext.Po{Language: identifier}
@@ -50,3 +64,101 @@ func Translate(key, locale string, vars ...interface{}) string {
 	}
 	return fmt.Sprintf(key, vars...)
 }
+
+// TranslateContext translates the given key on the specified locale, with the
+// translations of the context first. They can be customized for a context by
+// inserting a /locales/<locale>.po asset for it, and only the overridden keys
+// need to be in this file.
+func TranslateContext(key, locale, context string, vars ...interface{}) string {
+	if po := contextCatalog(locale, context); po != nil {
+		translated := po.Get(key, vars...)
+		if translated != key && translated != "" {
+			return translated
+		}
+	}
+	return Translate(key, locale, vars...)
+}
+
+// ContextVersion returns an identifier for the version of the translations
+// of a context for the given locale, or an empty string if they are not
+// customized. It can be used as a cache key for the translated texts.
+func ContextVersion(locale, context string) string {
+	if context == "" {
+		return ""
+	}
+	asset, ok := fs.Get("/locales/"+locale+".po", context)
+	if !ok {
+		return ""
+	}
+	return asset.Etag
+}
+
+func contextCatalog(locale, context string) *gotext.Po {
+	if context == "" {
+		return nil
+	}
+	asset, ok := fs.Get("/locales/"+locale+".po", context)
+	if !ok {
+		return nil
+	}
+	key := context + ":" + locale
+	if cached, ok := contextTranslations.Load(key); ok {
+		if c := cached.(*contextPo); c.etag == asset.Etag {
+			return c.po
+		}
+	}
+	rawPO, err := ioutil.ReadAll(asset.Reader())
+	if err != nil {
+		return nil
+	}
+	po := &gotext.Po{Language: locale}
+	po.Parse(rawPO)
+	contextTranslations.Store(key, &contextPo{etag: asset.Etag, po: po})
+	return po
+}
+
+// NegotiateLocale returns the supported locale preferred by the user, given
+// an Accept-Language header, or the default locale if none is acceptable.
+func NegotiateLocale(acceptLanguage string) string {
+	type tag struct {
+		locale  string
+		quality float64
+	}
+	var tags []tag
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		quality := 1.0
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			params := strings.TrimSpace(part[i+1:])
+			part = strings.TrimSpace(part[:i])
+			if strings.HasPrefix(params, "q=") {
+				q, err := strconv.ParseFloat(params[2:], 64)
+				if err != nil {
+					continue
+				}
+				quality = q
+			}
+		}
+		// The country variants, like en-US, are not taken into account
+		if i := strings.IndexByte(part, '-'); i >= 0 {
+			part = part[:i]
+		}
+		if quality > 0 {
+			tags = append(tags, tag{strings.ToLower(part), quality})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].quality > tags[j].quality
+	})
+	for _, t := range tags {
+		for _, locale := range SupportedLocales {
+			if t.locale == locale {
+				return locale
+			}
+		}
+	}
+	return DefaultLocale
+}
@@ -1,8 +1,13 @@
 package i18n
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/cozy/cozy-stack/pkg/cache"
+	"github.com/cozy/cozy-stack/pkg/statik/fs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,3 +30,51 @@ msgstr "bonjour %s"
 	s = Translate("hello %s", "en", "toto")
 	assert.Equal(t, "hello toto", s)
 }
+
+func TestTranslateContext(t *testing.T) {
+	LoadLocale("fr", []byte(`
+msgid "english"
+msgstr "french"
+
+msgid "hello %s"
+msgstr "bonjour %s"
+`))
+
+	dir, err := ioutil.TempDir("", "i18n")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pofile := filepath.Join(dir, "fr.po")
+	err = ioutil.WriteFile(pofile, []byte(`
+msgid "hello %s"
+msgstr "salut %s"
+`), 0600)
+	assert.NoError(t, err)
+	err = fs.RegisterCustomExternals(cache.New(nil), []fs.AssetOption{{
+		Name:    "/locales/fr.po",
+		Context: "white-label",
+		URL:     "file://" + pofile,
+	}}, 0)
+	assert.NoError(t, err)
+
+	s := TranslateContext("hello %s", "fr", "white-label", "toto")
+	assert.Equal(t, "salut toto", s)
+	s = TranslateContext("english", "fr", "white-label")
+	assert.Equal(t, "french", s)
+	s = TranslateContext("hello %s", "fr", "another-context", "toto")
+	assert.Equal(t, "bonjour toto", s)
+	s = TranslateContext("hello %s", "en", "white-label", "toto")
+	assert.Equal(t, "hello toto", s)
+
+	assert.NotEmpty(t, ContextVersion("fr", "white-label"))
+	assert.Empty(t, ContextVersion("en", "white-label"))
+	assert.Empty(t, ContextVersion("fr", ""))
+}
+
+func TestNegotiateLocale(t *testing.T) {
+	assert.Equal(t, "en", NegotiateLocale(""))
+	assert.Equal(t, "fr", NegotiateLocale("fr-FR"))
+	assert.Equal(t, "fr", NegotiateLocale("de-DE, fr;q=0.8, en;q=0.5"))
+	assert.Equal(t, "en", NegotiateLocale("fr;q=0.3, en-US;q=0.9"))
+	assert.Equal(t, "en", NegotiateLocale("fr;q=0, de"))
+	assert.Equal(t, "fr", NegotiateLocale("FR, en;q=0.1"))
+}
@@ -0,0 +1,217 @@
+// Package imaging is for the editing of the images on the server: rotation,
+// cropping and resizing. It is made with ImageMagick, like the thumbnails.
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+// MaxSize is the maximal size of the images that can be edited
+const MaxSize = 100 * 1024 * 1024
+
+// editTimeout is the maximal duration of an edition of an image
+const editTimeout = time.Minute
+
+// maxDimension is the maximal width or height of a resized image
+const maxDimension = 10000
+
+var (
+	// ErrUnsupportedFormat is used when the format of the image can't be
+	// edited
+	ErrUnsupportedFormat = errors.New("The format of this image cannot be edited")
+	// ErrInvalidRotation is used when the angle of a rotation is not a
+	// multiple of 90 degrees
+	ErrInvalidRotation = errors.New("The rotation must be 90, 180 or 270 degrees")
+	// ErrInvalidCrop is used when the zone for cropping an image is invalid
+	ErrInvalidCrop = errors.New("The crop must be x,y,width,height in pixels")
+	// ErrInvalidResize is used when the dimensions for resizing an image are
+	// invalid
+	ErrInvalidResize = errors.New("The resize must be widthxheight in pixels")
+	// ErrNoOperation is used when an edition has no operation
+	ErrNoOperation = errors.New("No operation to apply on the image")
+	// ErrEditFailed is used when ImageMagick has failed to edit the image
+	ErrEditFailed = errors.New("The image cannot be edited")
+)
+
+// formats are the mime types of the images that can be edited, with the
+// format for ImageMagick. The edited image keeps the format of the original.
+var formats = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+	"image/bmp":  "bmp",
+	"image/tiff": "tiff",
+}
+
+// CanEdit returns true if the images with this mime type can be edited.
+func CanEdit(mime string) bool {
+	_, ok := formats[mime]
+	return ok
+}
+
+// Crop is a zone of the image to keep, in pixels, relatively to the top-left
+// corner of the image, as it is displayed (after its EXIF orientation).
+type Crop struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+// Resize is the box where the resized image must fit. The aspect ratio of the
+// image is kept. One of the dimensions can be 0 to only constrain the other.
+type Resize struct {
+	Width  int
+	Height int
+}
+
+// Edition is a list of operations to apply on an image, in this order: the
+// rotation clockwise, the cropping, and the resizing.
+type Edition struct {
+	Rotate int
+	Crop   *Crop
+	Resize *Resize
+}
+
+// ParseRotate parses the angle of a rotation, in degrees clockwise. The
+// negative angles are for the counterclockwise rotations.
+func ParseRotate(s string) (int, error) {
+	angle, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, ErrInvalidRotation
+	}
+	angle = ((angle % 360) + 360) % 360
+	if angle%90 != 0 {
+		return 0, ErrInvalidRotation
+	}
+	return angle, nil
+}
+
+// ParseCrop parses a zone for cropping an image, given as x,y,width,height.
+func ParseCrop(s string) (*Crop, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, ErrInvalidCrop
+	}
+	var values [4]int
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || v < 0 {
+			return nil, ErrInvalidCrop
+		}
+		values[i] = v
+	}
+	if values[2] == 0 || values[3] == 0 {
+		return nil, ErrInvalidCrop
+	}
+	return &Crop{X: values[0], Y: values[1], Width: values[2], Height: values[3]}, nil
+}
+
+// ParseResize parses the dimensions for resizing an image, given as
+// widthxheight, like 1280x720 or 1280x.
+func ParseResize(s string) (*Resize, error) {
+	parts := strings.Split(strings.ToLower(s), "x")
+	if len(parts) != 2 {
+		return nil, ErrInvalidResize
+	}
+	var values [2]int
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || v <= 0 || v > maxDimension {
+			return nil, ErrInvalidResize
+		}
+		values[i] = v
+	}
+	if values[0] == 0 && values[1] == 0 {
+		return nil, ErrInvalidResize
+	}
+	return &Resize{Width: values[0], Height: values[1]}, nil
+}
+
+// args returns the arguments of the ImageMagick command for the edition. The
+// image is first rotated according to its EXIF orientation, which is then
+// reset, so that the edited image is displayed as expected by the user. The
+// other metadata are kept.
+func (e *Edition) args(format string) []string {
+	args := []string{
+		"-limit", "Memory", "2GB",
+		"-limit", "Map", "3GB",
+		"-[0]",         // Takes the input from stdin
+		"-auto-orient", // Rotate image according to the EXIF metadata
+	}
+	if e.Rotate != 0 {
+		args = append(args, "-rotate", strconv.Itoa(e.Rotate))
+	}
+	if c := e.Crop; c != nil {
+		args = append(args,
+			"-crop", fmt.Sprintf("%dx%d+%d+%d", c.Width, c.Height, c.X, c.Y),
+			"+repage", // Removes the offset of the cropped zone
+		)
+	}
+	if r := e.Resize; r != nil {
+		var geometry string
+		if r.Width > 0 {
+			geometry = strconv.Itoa(r.Width)
+		}
+		if r.Height > 0 {
+			geometry += "x" + strconv.Itoa(r.Height)
+		}
+		args = append(args, "-resize", geometry)
+	}
+	return append(args, format+":-") // Send the output on stdout
+}
+
+// Apply edits the image from in, with the given mime type, and writes the
+// result in out, in the same format.
+func (e *Edition) Apply(ctx context.Context, mime string, in io.Reader, out io.Writer) error {
+	format, ok := formats[mime]
+	if !ok {
+		return ErrUnsupportedFormat
+	}
+	if e.Rotate == 0 && e.Crop == nil && e.Resize == nil {
+		return ErrNoOperation
+	}
+
+	convertCmd := config.GetConfig().Jobs.ImageMagickConvertCmd
+	if convertCmd == "" {
+		convertCmd = "convert"
+	}
+	var env []string
+	if tempDir, err := ioutil.TempDir("", "magick"); err == nil {
+		defer os.RemoveAll(tempDir) // #nosec
+		env = []string{fmt.Sprintf("MAGICK_TEMPORARY_PATH=%s", tempDir)}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, editTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, convertCmd, e.args(format)...) // #nosec
+	cmd.Env = env
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		logger.WithNamespace("imaging").
+			WithField("stderr", stderr.String()).
+			Errorf("imagemagick failed: %s", err)
+		return ErrEditFailed
+	}
+	return nil
+}
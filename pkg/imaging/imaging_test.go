@@ -0,0 +1,61 @@
+package imaging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRotate(t *testing.T) {
+	for s, expected := range map[string]int{"90": 90, "180": 180, "-90": 270, "360": 0, "450": 90} {
+		angle, err := ParseRotate(s)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, angle)
+	}
+	for _, s := range []string{"", "45", "foo"} {
+		_, err := ParseRotate(s)
+		assert.Equal(t, ErrInvalidRotation, err)
+	}
+}
+
+func TestParseCrop(t *testing.T) {
+	crop, err := ParseCrop("10,20,300,400")
+	assert.NoError(t, err)
+	assert.Equal(t, &Crop{X: 10, Y: 20, Width: 300, Height: 400}, crop)
+	for _, s := range []string{"", "1,2,3", "1,2,0,4", "-1,2,3,4", "a,b,c,d"} {
+		_, err = ParseCrop(s)
+		assert.Equal(t, ErrInvalidCrop, err)
+	}
+}
+
+func TestParseResize(t *testing.T) {
+	resize, err := ParseResize("1280x720")
+	assert.NoError(t, err)
+	assert.Equal(t, &Resize{Width: 1280, Height: 720}, resize)
+	resize, err = ParseResize("x720")
+	assert.NoError(t, err)
+	assert.Equal(t, &Resize{Height: 720}, resize)
+	for _, s := range []string{"", "x", "1280", "0x0", "-1x2", "100000x10"} {
+		_, err = ParseResize(s)
+		assert.Equal(t, ErrInvalidResize, err)
+	}
+}
+
+func TestEditionArgs(t *testing.T) {
+	e := &Edition{
+		Rotate: 90,
+		Crop:   &Crop{X: 10, Y: 20, Width: 300, Height: 400},
+		Resize: &Resize{Width: 150},
+	}
+	assert.Equal(t, []string{
+		"-limit", "Memory", "2GB",
+		"-limit", "Map", "3GB",
+		"-[0]",
+		"-auto-orient",
+		"-rotate", "90",
+		"-crop", "300x400+10+20",
+		"+repage",
+		"-resize", "150",
+		"png:-",
+	}, e.args("png"))
+}
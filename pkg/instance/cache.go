@@ -0,0 +1,111 @@
+package instance
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// cacheTTL is the duration during which the document of an instance is kept
+// in the cache. The cache is cleared when the instance is updated, and the TTL
+// is only a protection for the changes made outside of the stack.
+const cacheTTL = 5 * time.Minute
+
+// cacheMaxSize is the maximal number of instances kept in the memory cache
+const cacheMaxSize = 1000
+
+const cachePrefix = "instance:"
+
+type cacheEntry struct {
+	doc     []byte
+	expired time.Time
+}
+
+var (
+	memCache   = make(map[string]cacheEntry)
+	memCacheMu sync.Mutex
+)
+
+// useMemCache returns true if the instances can be cached in memory: it is
+// the case when there is a single stack process, without redis. With redis,
+// the cache is shared by the stack processes, so that it can be cleared on
+// all of them when an instance is updated.
+func useMemCache() bool {
+	return config.GetConfig().Lock.Client() == nil
+}
+
+// getFromCache returns the instance for the given domain if its document is
+// in the cache.
+func getFromCache(domain string) (*Instance, bool) {
+	var doc []byte
+	if useMemCache() {
+		memCacheMu.Lock()
+		entry, ok := memCache[domain]
+		memCacheMu.Unlock()
+		if !ok || time.Now().After(entry.expired) {
+			return nil, false
+		}
+		doc = entry.doc
+	} else {
+		r, ok := config.GetConfig().CacheStorage.Get(cachePrefix + domain)
+		if !ok {
+			return nil, false
+		}
+		var err error
+		if doc, err = ioutil.ReadAll(r); err != nil {
+			return nil, false
+		}
+	}
+
+	inst := &Instance{}
+	if err := json.Unmarshal(doc, inst); err != nil {
+		return nil, false
+	}
+	if err := inst.makeVFS(); err != nil {
+		return nil, false
+	}
+	return inst, true
+}
+
+// storeInCache keeps in the cache the document of the instance fetched with
+// the given domain.
+func storeInCache(domain string, doc []byte) {
+	if !useMemCache() {
+		config.GetConfig().CacheStorage.Set(cachePrefix+domain, doc, cacheTTL)
+		return
+	}
+	memCacheMu.Lock()
+	defer memCacheMu.Unlock()
+	now := time.Now()
+	if len(memCache) >= cacheMaxSize {
+		for key, entry := range memCache {
+			if now.After(entry.expired) {
+				delete(memCache, key)
+			}
+		}
+		if len(memCache) >= cacheMaxSize {
+			memCache = make(map[string]cacheEntry)
+		}
+	}
+	memCache[domain] = cacheEntry{doc: doc, expired: now.Add(cacheTTL)}
+}
+
+// clearCache removes the instance from the cache, for its domain and its
+// aliases.
+func (i *Instance) clearCache() {
+	domains := append([]string{i.Domain}, i.DomainAliases...)
+	if !useMemCache() {
+		for _, domain := range domains {
+			config.GetConfig().CacheStorage.Clear(cachePrefix + domain)
+		}
+		return
+	}
+	memCacheMu.Lock()
+	defer memCacheMu.Unlock()
+	for _, domain := range domains {
+		delete(memCache, domain)
+	}
+}
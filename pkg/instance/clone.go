@@ -0,0 +1,263 @@
+package instance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/hooks"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+)
+
+// ErrCloneNotSupported is returned when trying to clone an instance on a
+// storage that does not support it.
+var ErrCloneNotSupported = errors.New("The cloning of an instance is not supported by this storage")
+
+// cloneBatchSize is the number of documents copied in one bulk request when
+// an instance is cloned.
+const cloneBatchSize = 100
+
+// notClonedDoctypes are the doctypes of the databases that are not copied
+// when an instance is cloned: the jobs and triggers (the konnectors and the
+// webhooks of the clone must not run for the original instance), the
+// sessions and the OAuth clients (they are signed with the secrets of the
+// original instance), and the sharings (the other members of a sharing only
+// know the original instance).
+var notClonedDoctypes = map[string]bool{
+	consts.Jobs:                   true,
+	consts.JobEvents:              true,
+	consts.Triggers:               true,
+	consts.TriggersState:          true,
+	consts.Sessions:               true,
+	consts.OAuthClients:           true,
+	consts.OAuthAccessCodes:       true,
+	consts.OAuthPairingCodes:      true,
+	consts.Sharings:               true,
+	consts.SharingsAnswer:         true,
+	consts.SharingsInitialSync:    true,
+	consts.Shared:                 true,
+	consts.KonnectorsInteractions: true,
+}
+
+// CloneHook is a function called on the documents of a doctype when they are
+// copied from the src database to the dst one, before being saved. It can be
+// used to encrypt again the fields encrypted with a key derived from the
+// database prefix.
+type CloneHook func(src, dst prefixer.Prefixer, doc map[string]interface{}) error
+
+var cloneHooks = make(map[string]CloneHook)
+
+// AddCloneHook adds a hook for the documents of the given doctype that are
+// copied when an instance is cloned.
+func AddCloneHook(doctype string, hook CloneHook) {
+	cloneHooks[doctype] = hook
+}
+
+// CanCloneInstances returns true if the instances can be cloned: it is only
+// supported for the file:// and mem:// storages.
+func CanCloneInstances() bool {
+	switch config.FsURL().Scheme {
+	case config.SchemeFile, config.SchemeMem:
+		return true
+	}
+	return false
+}
+
+// Clone copies an instance to a new domain, for the support to reproduce an
+// issue, or to test an upgrade of the applications on a staging instance.
+// The CouchDB databases and the content of the VFS are copied, but the
+// instance has new secrets: the sessions, the OAuth clients and the sharings
+// of the original instance are not copied, like the jobs and the triggers
+// (only the triggers of the stack are created for the clone).
+func Clone(src *Instance, domain string) (*Instance, error) {
+	domain, err := validateDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	if !CanCloneInstances() {
+		return nil, ErrCloneNotSupported
+	}
+	var i *Instance
+	err = hooks.Execute("add-instance", []string{domain}, func() error {
+		var err2 error
+		i, err2 = cloneWithoutHooks(src, domain)
+		return err2
+	})
+	return i, err
+}
+
+func cloneWithoutHooks(src *Instance, domain string) (*Instance, error) {
+	if _, err := getFromCouch(domain); err != ErrNotFound {
+		if err == nil {
+			err = ErrExists
+		}
+		return nil, err
+	}
+
+	i := src.Clone().(*Instance)
+	prefix := sha256.Sum256([]byte(domain))
+	i.DocID = ""
+	i.DocRev = ""
+	i.Domain = domain
+	i.DomainAliases = nil
+	i.Prefix = "cozy" + hex.EncodeToString(prefix[:16])
+	i.UUID = ""
+	i.PassphraseResetToken = nil
+	i.PassphraseResetTime = nil
+	i.DeleteAt = nil
+	i.DeletionReminded = false
+	i.RegisterToken = crypto.GenerateRandomBytes(RegisterTokenLen)
+	i.SessionSecret = crypto.GenerateRandomBytes(SessionSecretLen)
+	i.OAuthSecret = crypto.GenerateRandomBytes(OauthSecretLen)
+	i.CLISecret = crypto.GenerateRandomBytes(OauthSecretLen)
+	i.JWTKeys = nil
+	i.vfs = nil
+	i.filesKeys = nil
+	i.contextualDomain = ""
+	i.ctx = nil
+
+	// The data keys are wrapped with a key derived from the database prefix,
+	// so they must be wrapped again for the clone.
+	keys, err := src.unwrapFilesKeys()
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		if i.FilesKeys, err = keys.Wrap(config.GetVault().FilesMasterKey(), i); err != nil {
+			return nil, err
+		}
+	}
+
+	err = couchdb.CreateDoc(couchdb.GlobalDB, i)
+	i.clearCache()
+	if err != nil {
+		return nil, err
+	}
+	if err = i.copyFrom(src); err != nil {
+		i.Logger().Errorf("Could not clone the instance %s: %s", src.Domain, err)
+		i.destroyClone()
+		return nil, err
+	}
+	return i, nil
+}
+
+// copyFrom copies the databases and the files of the original instance, and
+// creates the views, the indexes and the triggers of the clone.
+func (i *Instance) copyFrom(src *Instance) error {
+	doctypes, err := couchdb.AllDoctypes(src)
+	if err != nil {
+		return err
+	}
+	for _, doctype := range doctypes {
+		if notClonedDoctypes[doctype] {
+			continue
+		}
+		if err = copyDB(src, i, doctype); err != nil {
+			return err
+		}
+	}
+	for _, doctype := range []string{consts.OAuthClients, consts.Sharings} {
+		if err = couchdb.CreateDB(i, doctype); err != nil {
+			return err
+		}
+	}
+
+	if err = vfsafero.CopyAll(src, i, config.FsURL(), src.DirName(), i.DirName()); err != nil {
+		return err
+	}
+	if err = i.makeVFS(); err != nil {
+		return err
+	}
+	if err = i.defineViewsAndIndex(); err != nil {
+		return err
+	}
+	err = couchdb.UpdateDoc(couchdb.GlobalDB, i)
+	i.clearCache()
+	if err != nil {
+		return err
+	}
+
+	sched := jobs.System()
+	for _, trigger := range Triggers(i) {
+		t, err := jobs.NewTrigger(i, trigger, nil)
+		if err != nil {
+			return err
+		}
+		if err = sched.AddTrigger(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDB copies the documents of a database, with their revisions. Only the
+// permissions of the applications and of the CLI are copied: the OAuth clients
+// and the sharings are not copied, and the codes of the share links are
+// signed with the secrets of the original instance. The clone hook of the
+// doctype, if any, is called on each document.
+func copyDB(src, dst *Instance, doctype string) error {
+	if err := couchdb.CreateDB(dst, doctype); err != nil {
+		return err
+	}
+	hook := cloneHooks[doctype]
+	docs := make([]map[string]interface{}, 0, cloneBatchSize)
+	err := couchdb.ForeachDocs(src, doctype, func(_ string, raw json.RawMessage) error {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		if doctype == consts.Permissions && !isClonedPermission(doc) {
+			return nil
+		}
+		if hook != nil {
+			if err := hook(src, dst, doc); err != nil {
+				return err
+			}
+		}
+		docs = append(docs, doc)
+		if len(docs) < cloneBatchSize {
+			return nil
+		}
+		err := couchdb.BulkForceUpdateDocs(dst, doctype, docs)
+		docs = docs[:0]
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return couchdb.BulkForceUpdateDocs(dst, doctype, docs)
+}
+
+func isClonedPermission(doc map[string]interface{}) bool {
+	switch doc["type"] {
+	case permissions.TypeWebapp, permissions.TypeKonnector, permissions.TypeCLI:
+		return true
+	}
+	return false
+}
+
+// destroyClone removes what has been created for a clone that has failed. The
+// accounts are removed without their deletion hooks, as they are still used
+// by the original instance.
+func (i *Instance) destroyClone() {
+	if err := couchdb.DeleteAllDBs(i); err != nil {
+		i.Logger().Errorf("Could not delete all CouchDB databases: %s", err)
+	}
+	if err := i.makeVFS(); err == nil {
+		if err = i.VFS().Delete(); err != nil {
+			i.Logger().Errorf("Could not delete VFS: %s", err)
+		}
+	}
+	if err := couchdb.DeleteDoc(couchdb.GlobalDB, i); err != nil {
+		i.Logger().Errorf("Could not delete the instance: %s", err)
+	}
+	i.clearCache()
+}
@@ -0,0 +1,138 @@
+package instance
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+var (
+	// ErrDeletionScheduled is returned when trying to schedule the deletion of
+	// an instance that is already scheduled for deletion.
+	ErrDeletionScheduled = errors.New("The deletion of the instance is already scheduled")
+	// ErrDeletionNotScheduled is returned when trying to cancel the deletion
+	// of an instance that is not scheduled for deletion.
+	ErrDeletionNotScheduled = errors.New("The deletion of the instance is not scheduled")
+)
+
+const deletionJanitorKey = "instances-deletion"
+
+// deletionJanitorInterval is the duration between two checks of the
+// instances scheduled for deletion.
+const deletionJanitorInterval = 1 * time.Hour
+
+const deletionDateFormat = "2006-01-02"
+
+// ScheduleDeletion schedules the deletion of the instance, at the end of the
+// grace period of the configuration. Until then, the instance is blocked for
+// the user and its triggers are paused, but its data are kept, and the
+// deletion can be canceled. A mail is sent to the user to warn them.
+func (i *Instance) ScheduleDeletion() error {
+	if i.DeleteAt != nil {
+		return ErrDeletionScheduled
+	}
+	deleteAt := time.Now().UTC().Add(config.GetConfig().Deletion.GracePeriod)
+	i.DeleteAt = &deleteAt
+	i.DeletionReminded = false
+	if err := i.update(); err != nil {
+		return err
+	}
+	return i.sendDeletionMail("instance_deletion_scheduled")
+}
+
+// CancelDeletion cancels the scheduled deletion of the instance: it is no
+// longer blocked, and its triggers are resumed.
+func (i *Instance) CancelDeletion() error {
+	if i.DeleteAt == nil {
+		return ErrDeletionNotScheduled
+	}
+	i.DeleteAt = nil
+	i.DeletionReminded = false
+	return i.update()
+}
+
+func (i *Instance) sendDeletionMail(templateName string) error {
+	return i.SendMail(&Mail{
+		TemplateName: templateName,
+		TemplateValues: map[string]interface{}{
+			"Domain":       i.ContextualDomain(),
+			"DeletionDate": i.DeleteAt.Format(deletionDateFormat),
+		},
+	})
+}
+
+// StartDeletionJanitor starts the process that purges the instances at the
+// end of their grace period, and that sends the reminder mails some days
+// before. When the stack has several processes, only the leader does it.
+func StartDeletionJanitor() utils.Shutdowner {
+	closed := make(chan struct{})
+	leader := lock.Elect(deletionJanitorKey)
+	go func() {
+		waitDuration := deletionJanitorInterval
+		for {
+			select {
+			case <-time.After(waitDuration):
+				if !leader.IsLeader() {
+					waitDuration = lock.LeaderTimeout
+					continue
+				}
+				waitDuration = deletionJanitorInterval
+				if err := purgeScheduledDeletions(); err != nil {
+					logger.WithNamespace("instances").
+						Errorf("Could not purge the instances scheduled for deletion: %s", err)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &janitor{closed, leader}
+}
+
+type janitor struct {
+	closed chan struct{}
+	leader lock.Leader
+}
+
+func (j *janitor) Shutdown(ctx context.Context) error {
+	select {
+	case j.closed <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return j.leader.Shutdown(ctx)
+}
+
+// purgeScheduledDeletions destroys the instances whose grace period is over,
+// and sends the reminder mail for the ones that will be destroyed soon.
+func purgeScheduledDeletions() error {
+	now := time.Now().UTC()
+	reminder := config.GetConfig().Deletion.Reminder
+	return ForeachInstances(func(i *Instance) error {
+		if i.DeleteAt == nil {
+			return nil
+		}
+		if now.After(*i.DeleteAt) {
+			if err := Destroy(i.Domain); err != nil {
+				i.Logger().Errorf("Could not destroy the instance scheduled for deletion: %s", err)
+			}
+			return nil
+		}
+		if reminder > 0 && !i.DeletionReminded && now.After(i.DeleteAt.Add(-reminder)) {
+			// The flag is saved before sending the mail, so that the reminder
+			// is not sent twice if the instance can't be updated.
+			i.DeletionReminded = true
+			if err := i.update(); err != nil {
+				return nil
+			}
+			if err := i.sendDeletionMail("instance_deletion_reminder"); err != nil {
+				i.Logger().Errorf("Could not send the deletion reminder: %s", err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,20 @@
+package instance
+
+// SetFeatureFlags updates the feature flags of the instance: a nil value
+// removes the flag.
+func (i *Instance) SetFeatureFlags(flags map[string]interface{}) error {
+	if i.FeatureFlags == nil {
+		i.FeatureFlags = make(map[string]interface{}, len(flags))
+	}
+	for name, value := range flags {
+		if value == nil {
+			delete(i.FeatureFlags, name)
+		} else {
+			i.FeatureFlags[name] = value
+		}
+	}
+	if len(i.FeatureFlags) == 0 {
+		i.FeatureFlags = nil
+	}
+	return i.update()
+}
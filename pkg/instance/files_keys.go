@@ -0,0 +1,131 @@
+package instance
+
+import (
+	"errors"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+)
+
+// rekeyPasses is the maximal number of times the files are walked to be
+// encrypted again with the new data key, as some files can be written with
+// the old key during a walk.
+const rekeyPasses = 3
+
+var (
+	// ErrNoFilesMasterKey is returned when trying to encrypt the files of an
+	// instance, but no files master key has been configured.
+	ErrNoFilesMasterKey = errors.New("The files master key is missing")
+	// ErrEncryptionNotSupported is returned when trying to encrypt the files
+	// on a storage that does not support it.
+	ErrEncryptionNotSupported = errors.New("The encryption of the files is not supported by this storage")
+)
+
+// CanEncryptFiles returns true if the content of the files can be encrypted
+// at rest: it is only supported for the file:// and mem:// storages.
+func CanEncryptFiles() bool {
+	switch config.FsURL().Scheme {
+	case config.SchemeFile, config.SchemeMem:
+		return true
+	}
+	return false
+}
+
+// initFilesKeys generates the first data key of a new instance, if the
+// encryption of the files is enabled.
+func (i *Instance) initFilesKeys() error {
+	master := config.GetVault().FilesMasterKey()
+	if len(master) == 0 || !CanEncryptFiles() {
+		return nil
+	}
+	key, err := vfscrypt.GenerateKey(master, i, 1)
+	if err != nil {
+		return err
+	}
+	i.FilesKeys = []vfscrypt.WrappedKey{key}
+	return nil
+}
+
+func (i *Instance) unwrapFilesKeys() (*vfscrypt.Keys, error) {
+	vault := config.GetVault()
+	return vfscrypt.Unwrap(i.FilesKeys, i, vault.FilesMasterKey(), vault.FilesPreviousMasterKey())
+}
+
+// encryptFs adds the encryption layer to the given afero.Fs, if the files of
+// the instance are encrypted.
+func (i *Instance) encryptFs(fs afero.Fs) afero.Fs {
+	if i.filesKeys == nil {
+		return fs
+	}
+	return vfscrypt.NewFs(fs, i.filesKeys)
+}
+
+// RekeyFiles generates a new data key for the instance, and encrypts again the
+// files with it. It is used for the rotation of the data keys, and after a
+// rotation of the files master key (the previous master key can be removed
+// from the keyring when all the instances have been rekeyed). It can also be
+// used to encrypt the files of an instance that has been created before the
+// encryption has been enabled. It returns the number of files that have been
+// rewritten.
+func (i *Instance) RekeyFiles() (int, error) {
+	master := config.GetVault().FilesMasterKey()
+	if len(master) == 0 {
+		return 0, ErrNoFilesMasterKey
+	}
+	if !CanEncryptFiles() {
+		return 0, ErrEncryptionNotSupported
+	}
+
+	keys, err := i.unwrapFilesKeys()
+	if err != nil {
+		return 0, err
+	}
+	var wrapped []vfscrypt.WrappedKey
+	id := uint32(1)
+	if keys != nil {
+		// The old keys are kept (wrapped with the current master key) while the
+		// files are encrypted again, so that they can still be read.
+		if wrapped, err = keys.Wrap(master, i); err != nil {
+			return 0, err
+		}
+		id = keys.MaxID() + 1
+	}
+	newKey, err := vfscrypt.GenerateKey(master, i, id)
+	if err != nil {
+		return 0, err
+	}
+	if err = i.saveFilesKeys(append(wrapped, newKey)); err != nil {
+		return 0, err
+	}
+
+	mutex := lock.ReadWrite(i, "vfs")
+	total := 0
+	for pass := 0; pass < rekeyPasses; pass++ {
+		count, err := vfsafero.Reencrypt(i, mutex, config.FsURL(), i.DirName(), i.filesKeys)
+		total += count
+		if err != nil {
+			return total, err
+		}
+		if count == 0 {
+			// No file uses the old keys anymore, they can be removed
+			return total, i.saveFilesKeys([]vfscrypt.WrappedKey{newKey})
+		}
+	}
+	i.Logger().WithField("nspace", "rekey").
+		Warnf("Some files are still encrypted with the old keys after %d passes", rekeyPasses)
+	return total, nil
+}
+
+// saveFilesKeys updates the data keys of the instance, and makes the VFS
+// again to use them.
+func (i *Instance) saveFilesKeys(keys []vfscrypt.WrappedKey) error {
+	i.FilesKeys = keys
+	if err := i.update(); err != nil {
+		return err
+	}
+	i.vfs = nil
+	return i.makeVFS()
+}
@@ -0,0 +1,56 @@
+package instance
+
+import (
+	"encoding/base64"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"golang.org/x/crypto/ed25519"
+)
+
+// signingKey returns the ed25519 key of the instance. It is generated for the
+// instances created before the keys were added.
+func (i *Instance) signingKey() (ed25519.PrivateKey, error) {
+	if len(i.SigningSeed) != SigningSeedLen {
+		i.SigningSeed = crypto.GenerateRandomBytes(SigningSeedLen)
+		if err := i.update(); err != nil {
+			return nil, err
+		}
+	}
+	return ed25519.NewKeyFromSeed(i.SigningSeed), nil
+}
+
+// PublicKey returns the public key of the instance, encoded in base64. It
+// can be used by the other Cozy instances to check the signatures of the
+// requests sent by this instance.
+func (i *Instance) PublicKey() (string, error) {
+	key, err := i.signingKey()
+	if err != nil {
+		return "", err
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// Sign returns the signature of the data with the key of the instance,
+// encoded in base64.
+func (i *Instance) Sign(data []byte) (string, error) {
+	key, err := i.signingKey()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)), nil
+}
+
+// VerifySignature checks that the signature (in base64) of the data has been
+// made with the private key of the given public key (in base64).
+func VerifySignature(publicKey string, data []byte, signature string) bool {
+	pub, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), data, sig)
+}
@@ -0,0 +1,52 @@
+package instance
+
+import (
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+// IndexesMigrationType is the type of the migrations job used to define the
+// views and indexes of an instance.
+const IndexesMigrationType = "indexes"
+
+// ViewsAndIndexesStatus returns the state of the views and indexes of the
+// instance, to know if some of them are missing, stale or still building.
+func (i *Instance) ViewsAndIndexesStatus() ([]*couchdb.DesignDocState, error) {
+	return couchdb.CheckDesignDocs(i, consts.Views, consts.Indexes)
+}
+
+// PushIndexesMigrations pushes a migrations job for each instance whose views
+// and indexes are outdated. It is called on the startup of the stack, so that
+// the instances are migrated in the background after an upgrade instead of
+// on their first request.
+func PushIndexesMigrations() error {
+	log := logger.WithNamespace("instances")
+	msg, err := jobs.NewMessage(map[string]interface{}{
+		"type": IndexesMigrationType,
+	})
+	if err != nil {
+		return err
+	}
+	count := 0
+	err = ForeachInstances(func(i *Instance) error {
+		if i.IndexViewsVersion == consts.IndexViewsVersion {
+			return nil
+		}
+		_, err := jobs.System().PushJob(i, &jobs.JobRequest{
+			WorkerType: "migrations",
+			Message:    msg,
+		})
+		if err != nil {
+			log.Errorf("Could not push indexes migration for %s: %s", i.Domain, err)
+			return nil
+		}
+		count++
+		return nil
+	})
+	if count > 0 {
+		log.Infof("Indexes migrations pushed for %d instances", count)
+	}
+	return err
+}
@@ -1,6 +1,7 @@
 package instance
 
 import (
+	"context"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
@@ -27,10 +28,13 @@ import (
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
+	humanize "github.com/dustin/go-humanize"
 	"github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/dgrijalva/jwt-go.v3"
@@ -42,11 +46,16 @@ const (
 	PasswordResetTokenLen = 16
 	SessionSecretLen      = 64
 	OauthSecretLen        = 128
+	SigningSeedLen        = 32 // ed25519.SeedSize
 )
 
 // DefaultLocale is the default locale when creating an instance
 const DefaultLocale = "en"
 
+// DefaultSupportEmail is the email address used for contacting the support
+// when none is configured for the context of the instance
+const DefaultSupportEmail = "contact@cozycloud.cc"
+
 const illegalChars = " /,;&?#@|='\"\t\r\n\x00"
 const illegalFirstChars = "0123456789."
 
@@ -77,26 +86,63 @@ var (
 	ErrUnknownAuthMode = errors.New("Unknown authentication mode")
 	// ErrBadTOSVersion is returned when a malformed TOS version is provided.
 	ErrBadTOSVersion = errors.New("Bad format for TOS version")
+	// ErrBadBlockingReason is returned when an unknown reason is given for
+	// blocking an instance.
+	ErrBadBlockingReason = errors.New("Unknown reason for blocking the instance")
+)
+
+// The reasons for which an instance can be blocked. They are sent to the
+// clients as the code of the warning.
+const (
+	// BlockingPaymentOverdue is used when the payment of the offer is overdue
+	BlockingPaymentOverdue = "payment_overdue"
+	// BlockingAbuse is used when the instance has been used for an abuse
+	BlockingAbuse = "abuse"
+	// BlockingUserRequest is used when the user has asked to suspend the
+	// instance
+	BlockingUserRequest = "user_request"
 )
 
 // An Instance has the informations relatives to the logical cozy instance,
 // like the domain, the locale or the access to the databases and files storage
 // It is a couchdb.Doc to be persisted in couchdb.
 type Instance struct {
-	DocID         string   `json:"_id,omitempty"`  // couchdb _id
-	DocRev        string   `json:"_rev,omitempty"` // couchdb _rev
-	Domain        string   `json:"domain"`         // The main DNS domain, like example.cozycloud.cc
-	DomainAliases []string `json:"domain_aliases,omitempty"`
-	Prefix        string   `json:"prefix,omitempty"`     // Possible database prefix
-	Locale        string   `json:"locale"`               // The locale used on the server
-	UUID          string   `json:"uuid,omitempty"`       // UUID associated with the instance
-	ContextName   string   `json:"context,omitempty"`    // The context attached to the instance
-	TOSSigned     string   `json:"tos,omitempty"`        // Terms of Service signed version
-	TOSLatest     string   `json:"tos_latest,omitempty"` // Terms of Service latest version
-	AuthMode      AuthMode `json:"auth_mode,omitempty"`
-	Blocked       bool     `json:"blocked,omitempty"`        // Whether or not the instance is blocked
-	NoAutoUpdate  bool     `json:"no_auto_update,omitempty"` // Whether or not the instance has auto updates for its applications
-	Dev           bool     `json:"dev,omitempty"`            // Whether or not the instance is for development
+	DocID          string   `json:"_id,omitempty"`  // couchdb _id
+	DocRev         string   `json:"_rev,omitempty"` // couchdb _rev
+	Domain         string   `json:"domain"`         // The main DNS domain, like example.cozycloud.cc
+	DomainAliases  []string `json:"domain_aliases,omitempty"`
+	Prefix         string   `json:"prefix,omitempty"`     // Possible database prefix
+	Locale         string   `json:"locale"`               // The locale used on the server
+	UUID           string   `json:"uuid,omitempty"`       // UUID associated with the instance
+	ContextName    string   `json:"context,omitempty"`    // The context attached to the instance
+	TOSSigned      string   `json:"tos,omitempty"`        // Terms of Service signed version
+	TOSLatest      string   `json:"tos_latest,omitempty"` // Terms of Service latest version
+	AuthMode       AuthMode `json:"auth_mode,omitempty"`
+	Blocked        bool     `json:"blocked,omitempty"`         // Whether or not the instance is blocked
+	BlockingReason string   `json:"blocking_reason,omitempty"` // The reason why the instance is blocked
+	Maintenance    bool     `json:"maintenance,omitempty"`     // Whether or not the instance is in maintenance
+	NoAutoUpdate   bool     `json:"no_auto_update,omitempty"`  // Whether or not the instance has auto updates for its applications
+	Dev            bool     `json:"dev,omitempty"`             // Whether or not the instance is for development
+
+	// The slugs of the applications (webapps and konnectors) in maintenance
+	MaintenanceApps []string `json:"maintenance_apps,omitempty"`
+
+	// The feature flags set by the administrators for this instance. They
+	// have priority over the flags of the context and the default ones.
+	FeatureFlags map[string]interface{} `json:"feature_flags,omitempty"`
+
+	// The URL of the instance where the data has been moved, when the user
+	// has migrated to another instance. The requests are redirected to it.
+	MovedTo string `json:"moved_to,omitempty"`
+
+	// The date of the final purge of the instance, when its deletion has been
+	// scheduled, and whether the reminder mail has been sent
+	DeleteAt         *time.Time `json:"delete_at,omitempty"`
+	DeletionReminded bool       `json:"deletion_reminded,omitempty"`
+
+	// The state of the installation of the default apps and konnectors of
+	// the context, by step (like "webapp/drive"), for the onboarding
+	OnboardingSteps map[string]string `json:"onboarding_steps,omitempty"`
 
 	OnboardingFinished bool  `json:"onboarding_finished,omitempty"` // Whether or not the onboarding is complete.
 	BytesDiskQuota     int64 `json:"disk_quota,string,omitempty"`   // The total size in bytes allowed to the user
@@ -106,10 +152,13 @@ type Instance struct {
 	SwiftCluster int `json:"swift_cluster,omitempty"`
 
 	// PassphraseHash is a hash of the user's passphrase. For more informations,
-	// see crypto.GenerateFromPassphrase.
+	// see crypto.GenerateFromPassphraseWithParams.
 	PassphraseHash       []byte     `json:"passphrase_hash,omitempty"`
 	PassphraseResetToken []byte     `json:"passphrase_reset_token,omitempty"`
 	PassphraseResetTime  *time.Time `json:"passphrase_reset_time,omitempty"`
+	// PassphraseHistory are the hashes of the previous passphrases, kept for
+	// the history of the password policy.
+	PassphraseHistory [][]byte `json:"passphrase_history,omitempty"`
 
 	// Secure assets
 
@@ -123,34 +172,50 @@ type Instance struct {
 	OAuthSecret []byte `json:"oauth_secret,omitempty"`
 	// CLISecret is used to authenticate request from the CLI
 	CLISecret []byte `json:"cli_secret,omitempty"`
+	// SigningSeed is the seed of the ed25519 key used to sign the requests
+	// sent to the other Cozy instances, like for the sharings
+	SigningSeed []byte `json:"signing_seed,omitempty"`
+	// FilesKeys are the data keys used to encrypt the content of the files at
+	// rest, wrapped with the files master key of the vault. The last one is the
+	// current key.
+	FilesKeys []vfscrypt.WrappedKey `json:"files_keys,omitempty"`
+	// JWTKeys are the keys used to sign the JSON Web Tokens. When there is no
+	// key for a family of tokens, the legacy secrets above are used.
+	JWTKeys []JWTKey `json:"jwt_keys,omitempty"`
 
 	vfs              vfs.VFS
+	filesKeys        *vfscrypt.Keys
 	contextualDomain string
+	ctx              context.Context
 }
 
 // Options holds the parameters to create a new instance.
 type Options struct {
-	Domain        string
-	DomainAliases []string
-	Locale        string
-	UUID          string
-	TOSSigned     string
-	TOSLatest     string
-	Timezone      string
-	ContextName   string
-	Email         string
-	PublicName    string
-	Settings      string
-	SettingsObj   *couchdb.JSONDoc
-	AuthMode      string
-	Passphrase    string
-	SwiftCluster  int
-	DiskQuota     int64
-	Apps          []string
-	AutoUpdate    *bool
-	Debug         *bool
-	Blocked       *bool
-	Dev           bool
+	Domain         string
+	DomainAliases  []string
+	Locale         string
+	UUID           string
+	TOSSigned      string
+	TOSLatest      string
+	Timezone       string
+	ContextName    string
+	Email          string
+	PublicName     string
+	Settings       string
+	SettingsObj    *couchdb.JSONDoc
+	AuthMode       string
+	Passphrase     string
+	SwiftCluster   int
+	DiskQuota      int64
+	Apps           []string
+	AutoUpdate     *bool
+	Debug          *bool
+	DebugTTL       time.Duration
+	Blocked        *bool
+	BlockingReason string
+	Maintenance    *bool
+	MovedTo        *string
+	Dev            bool
 
 	OnboardingFinished *bool
 }
@@ -177,17 +242,52 @@ func (i *Instance) Clone() couchdb.Doc {
 	cloned.DomainAliases = make([]string, len(i.DomainAliases))
 	copy(cloned.DomainAliases, i.DomainAliases)
 
+	if i.MaintenanceApps != nil {
+		cloned.MaintenanceApps = make([]string, len(i.MaintenanceApps))
+		copy(cloned.MaintenanceApps, i.MaintenanceApps)
+	}
+
+	if i.FeatureFlags != nil {
+		cloned.FeatureFlags = make(map[string]interface{}, len(i.FeatureFlags))
+		for k, v := range i.FeatureFlags {
+			cloned.FeatureFlags[k] = v
+		}
+	}
+
+	if i.OnboardingSteps != nil {
+		cloned.OnboardingSteps = make(map[string]string, len(i.OnboardingSteps))
+		for k, v := range i.OnboardingSteps {
+			cloned.OnboardingSteps[k] = v
+		}
+	}
+
 	cloned.PassphraseHash = make([]byte, len(i.PassphraseHash))
 	copy(cloned.PassphraseHash, i.PassphraseHash)
 
+	cloned.SigningSeed = make([]byte, len(i.SigningSeed))
+	copy(cloned.SigningSeed, i.SigningSeed)
+
 	cloned.PassphraseResetToken = make([]byte, len(i.PassphraseResetToken))
 	copy(cloned.PassphraseResetToken, i.PassphraseResetToken)
 
+	if i.PassphraseHistory != nil {
+		cloned.PassphraseHistory = make([][]byte, len(i.PassphraseHistory))
+		for k, hash := range i.PassphraseHistory {
+			cloned.PassphraseHistory[k] = make([]byte, len(hash))
+			copy(cloned.PassphraseHistory[k], hash)
+		}
+	}
+
 	if i.PassphraseResetTime != nil {
 		tmp := *i.PassphraseResetTime
 		cloned.PassphraseResetTime = &tmp
 	}
 
+	if i.DeleteAt != nil {
+		tmp := *i.DeleteAt
+		cloned.DeleteAt = &tmp
+	}
+
 	cloned.RegisterToken = make([]byte, len(i.RegisterToken))
 	copy(cloned.RegisterToken, i.RegisterToken)
 
@@ -199,6 +299,16 @@ func (i *Instance) Clone() couchdb.Doc {
 
 	cloned.CLISecret = make([]byte, len(i.CLISecret))
 	copy(cloned.CLISecret, i.CLISecret)
+
+	if i.FilesKeys != nil {
+		cloned.FilesKeys = make([]vfscrypt.WrappedKey, len(i.FilesKeys))
+		copy(cloned.FilesKeys, i.FilesKeys)
+	}
+
+	if i.JWTKeys != nil {
+		cloned.JWTKeys = make([]JWTKey, len(i.JWTKeys))
+		copy(cloned.JWTKeys, i.JWTKeys)
+	}
 	return &cloned
 }
 
@@ -241,7 +351,10 @@ func (i *Instance) makeVFS() error {
 	var err error
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
-		i.vfs, err = vfsafero.New(i, index, disk, mutex, fsURL, i.DirName())
+		if i.filesKeys, err = i.unwrapFilesKeys(); err != nil {
+			return err
+		}
+		i.vfs, err = vfsafero.NewEncrypted(i, index, disk, mutex, fsURL, i.DirName(), i.filesKeys)
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		if i.SwiftCluster > 0 {
 			i.vfs, err = vfsswift.NewV2(i, index, disk, mutex)
@@ -251,6 +364,9 @@ func (i *Instance) makeVFS() error {
 	default:
 		err = fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
 	}
+	if err == nil && tracing.Enabled() {
+		i.vfs = vfs.Traced(i.vfs, i)
+	}
 	return err
 }
 
@@ -317,7 +433,7 @@ func (i *Instance) ThumbsFS() vfs.Thumbser {
 	case config.SchemeFile, config.SchemeMem:
 		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
 			path.Join(fsURL.Path, i.DirName(), vfs.ThumbsDirName))
-		return vfsafero.NewThumbsFs(baseFS)
+		return vfsafero.NewThumbsFs(i.encryptFs(baseFS))
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		if i.SwiftCluster > 0 {
 			return vfsswift.NewThumbsFsV2(config.GetSwiftConnection(), i)
@@ -328,6 +444,45 @@ func (i *Instance) ThumbsFS() vfs.Thumbser {
 	}
 }
 
+// StreamsFS returns the hidden filesystem for storing the videos transcoded
+// for streaming
+func (i *Instance) StreamsFS() vfs.Streamer {
+	fsURL := config.FsURL()
+	switch fsURL.Scheme {
+	case config.SchemeFile, config.SchemeMem:
+		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
+			path.Join(fsURL.Path, i.DirName(), vfs.StreamsDirName))
+		return vfsafero.NewStreamsFs(i.encryptFs(baseFS))
+	case config.SchemeSwift, config.SchemeSwiftSecure:
+		if i.SwiftCluster > 0 {
+			return vfsswift.NewStreamsFsV2(config.GetSwiftConnection(), i)
+		}
+		return vfsswift.NewStreamsFs(config.GetSwiftConnection(), i.Domain)
+	default:
+		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
+	}
+}
+
+// StagingFS returns the hidden filesystem for the content of the uploads that
+// have not yet been committed
+func (i *Instance) StagingFS() vfs.Stager {
+	fsURL := config.FsURL()
+	switch fsURL.Scheme {
+	case config.SchemeFile, config.SchemeMem:
+		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
+			path.Join(fsURL.Path, i.DirName(), vfs.StagingDirName))
+		return vfsafero.NewStagingFs(i.encryptFs(baseFS))
+	case config.SchemeSwift, config.SchemeSwiftSecure:
+		ttl := config.GetConfig().Uploads.TTL
+		if i.SwiftCluster > 0 {
+			return vfsswift.NewStagingFsV2(config.GetSwiftConnection(), i, ttl)
+		}
+		return vfsswift.NewStagingFs(config.GetSwiftConnection(), i.Domain, ttl)
+	default:
+		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
+	}
+}
+
 // SettingsDocument returns the document with the settings of this instance
 func (i *Instance) SettingsDocument() (*couchdb.JSONDoc, error) {
 	doc := &couchdb.JSONDoc{}
@@ -382,19 +537,33 @@ func (i *Instance) getFromContexts(contexts map[string]interface{}) (interface{}
 }
 
 // SettingsContext returns the map from the config that matches the context of
-// this instance
+// this instance, with the overrides of this context made via the admin API.
 func (i *Instance) SettingsContext() (map[string]interface{}, error) {
 	contexts := config.GetConfig().Contexts
+	overrides := i.contextOverrides()
 	context, ok := i.getFromContexts(contexts)
 	if !ok {
-		return nil, ErrContextNotFound
+		if len(overrides) == 0 {
+			return nil, ErrContextNotFound
+		}
+		context = map[string]interface{}{}
+	}
+	settings, _ := context.(map[string]interface{})
+	if len(overrides) > 0 {
+		settings = withOverrides(settings, overrides)
 	}
-	settings := context.(map[string]interface{})
 	return settings, nil
 }
 
-// Registries returns the list of registries associated with the instance.
+// Registries returns the list of registries associated with the instance: the
+// registries of its context if they have been overridden, or else the ones of
+// the configuration.
 func (i *Instance) Registries() []*url.URL {
+	if regs, ok := i.contextOverrides()[OverrideRegistries]; ok {
+		if list, err := parseRegistries(regs); err == nil {
+			return list
+		}
+	}
 	contexts := config.GetConfig().Registries
 	var context []*url.URL
 	var ok bool
@@ -410,9 +579,98 @@ func (i *Instance) Registries() []*url.URL {
 	return context
 }
 
-// DiskQuota returns the number of bytes allowed on the disk to the user.
+// DiskQuota returns the number of bytes allowed on the disk to the user. If
+// the instance has no quota of its own, the disk_quota of its context is used.
 func (i *Instance) DiskQuota() int64 {
-	return i.BytesDiskQuota
+	if i.BytesDiskQuota > 0 {
+		return i.BytesDiskQuota
+	}
+	context, err := i.SettingsContext()
+	if err != nil {
+		return 0
+	}
+	switch quota := context["disk_quota"].(type) {
+	case int:
+		return int64(quota)
+	case int64:
+		return quota
+	case float64:
+		return int64(quota)
+	case string:
+		if q, err := humanize.ParseBytes(quota); err == nil {
+			return int64(q)
+		}
+	}
+	return 0
+}
+
+// Argon2Params returns the cost parameters of argon2id for hashing the
+// passphrase of the instance, from the argon2 section of its context. The
+// parameters that are not in this section have their default value.
+func (i *Instance) Argon2Params() crypto.Argon2Params {
+	params := crypto.DefaultArgon2Params
+	context, err := i.SettingsContext()
+	if err != nil {
+		return params
+	}
+	argon, ok := context["argon2"].(map[string]interface{})
+	if !ok {
+		return params
+	}
+	if t := toFloat(argon["time"]); t >= 1 {
+		params.Time = uint32(t)
+	}
+	if m := toFloat(argon["memory"]); m >= 8 {
+		params.Memory = uint32(m)
+	}
+	if p := toFloat(argon["threads"]); p >= 1 && p <= 255 {
+		params.Threads = uint8(p)
+	}
+	return params
+}
+
+// DefaultApps returns the slugs of the webapps to install on the creation of
+// the instance, from the default_apps of its context.
+func (i *Instance) DefaultApps() []string {
+	defaults := i.DefaultInstalls()
+	apps := make([]string, 0, len(defaults))
+	for _, app := range defaults {
+		if app.Doctype == consts.Apps {
+			apps = append(apps, app.Slug)
+		}
+	}
+	return apps
+}
+
+// NoReplyAddress returns the address and the name used for sending the mails
+// of the instance: the noreply_address and noreply_name in the mail section
+// of its context, or else the ones of the mail section of the configuration.
+func (i *Instance) NoReplyAddress() (string, string) {
+	addr := config.GetConfig().NoReplyAddr
+	name := config.GetConfig().NoReplyName
+	if context, err := i.SettingsContext(); err == nil {
+		if mail, ok := context["mail"].(map[string]interface{}); ok {
+			if a, ok := mail["noreply_address"].(string); ok && a != "" {
+				addr = a
+			}
+			if n, ok := mail["noreply_name"].(string); ok && n != "" {
+				name = n
+			}
+		}
+	}
+	return addr, name
+}
+
+// SupportEmailAddress returns the email address that can be used to contact
+// the support: the support_address of the context of the instance, or else
+// the default one.
+func (i *Instance) SupportEmailAddress() string {
+	if context, err := i.SettingsContext(); err == nil {
+		if email, ok := context["support_address"].(string); ok && email != "" {
+			return email
+		}
+	}
+	return DefaultSupportEmail
 }
 
 // WithContextualDomain the current instance context with the given hostname.
@@ -423,6 +681,22 @@ func (i *Instance) WithContextualDomain(domain string) *Instance {
 	return i
 }
 
+// WithContext sets the context of the operation (HTTP request, job) made
+// with the instance, for the tracing.
+func (i *Instance) WithContext(ctx context.Context) *Instance {
+	i.ctx = ctx
+	return i
+}
+
+// Context returns the context of the operation made with the instance (the
+// background context if none has been set).
+func (i *Instance) Context() context.Context {
+	if i.ctx == nil {
+		return context.Background()
+	}
+	return i.ctx
+}
+
 // Scheme returns the scheme used for URLs. It is https by default and http
 // for development instances.
 func (i *Instance) Scheme() string {
@@ -567,7 +841,18 @@ func (i *Instance) installApp(slug string) error {
 }
 
 func (i *Instance) update() error {
-	if err := couchdb.UpdateDoc(couchdb.GlobalDB, i); err != nil {
+	// The aliases may be changed by the update, and the previous ones must
+	// also be removed from the cache.
+	previous := &Instance{}
+	if err := couchdb.GetDoc(couchdb.GlobalDB, consts.Instances, i.ID(), previous); err != nil {
+		previous = nil
+	}
+	err := couchdb.UpdateDoc(couchdb.GlobalDB, i)
+	i.clearCache()
+	if previous != nil {
+		previous.clearCache()
+	}
+	if err != nil {
 		i.Logger().Errorf("Could not update: %s", err.Error())
 		return err
 	}
@@ -575,7 +860,12 @@ func (i *Instance) update() error {
 }
 
 func (i *Instance) defineViewsAndIndex() error {
-	if err := couchdb.DefineIndexes(i, consts.Indexes); err != nil {
+	// The databases of a new instance can't have old versions of the indexes
+	define := couchdb.DefineIndexes
+	if i.IndexViewsVersion != 0 {
+		define = couchdb.UpdateIndexes
+	}
+	if err := define(i, consts.Indexes); err != nil {
 		return err
 	}
 	if err := couchdb.DefineViews(i, consts.Views); err != nil {
@@ -671,6 +961,7 @@ func CreateWithoutHooks(opts *Options) (*Instance, error) {
 	i.SessionSecret = crypto.GenerateRandomBytes(SessionSecretLen)
 	i.OAuthSecret = crypto.GenerateRandomBytes(OauthSecretLen)
 	i.CLISecret = crypto.GenerateRandomBytes(OauthSecretLen)
+	i.SigningSeed = crypto.GenerateRandomBytes(SigningSeedLen)
 
 	// If not cluster number is given, we rely on cluster one.
 	if opts.SwiftCluster == 0 {
@@ -703,6 +994,14 @@ func CreateWithoutHooks(opts *Options) (*Instance, error) {
 		i.NoAutoUpdate = !(*opts.AutoUpdate)
 	}
 
+	if err := i.initFilesKeys(); err != nil {
+		return nil, err
+	}
+
+	if len(opts.Apps) == 0 {
+		i.initOnboardingSteps()
+	}
+
 	if err := couchdb.CreateDoc(couchdb.GlobalDB, i); err != nil {
 		return nil, err
 	}
@@ -752,11 +1051,16 @@ func CreateWithoutHooks(opts *Options) (*Instance, error) {
 			return nil, err
 		}
 	}
-	for _, app := range opts.Apps {
-		if err := i.installApp(app); err != nil {
-			i.Logger().Errorf("Failed to install %s: %s", app, err)
+	if len(opts.Apps) > 0 {
+		for _, app := range opts.Apps {
+			if err := i.installApp(app); err != nil {
+				i.Logger().Errorf("Failed to install %s: %s", app, err)
+			}
 		}
+	} else {
+		i.pushDefaultInstalls()
 	}
+	i.SendLifecycleWebhook(EventCreated, nil)
 	return i, nil
 }
 
@@ -906,6 +1210,7 @@ func Patch(i *Instance, opts *Options) error {
 	settings, settingsUpdate := buildSettings(opts)
 
 	clouderyChanges := make(map[string]interface{})
+	var events []string
 
 	for {
 		var err error
@@ -925,6 +1230,29 @@ func Patch(i *Instance, opts *Options) error {
 
 		if opts.Blocked != nil && *opts.Blocked != i.Blocked {
 			i.Blocked = *opts.Blocked
+			if i.Blocked {
+				events = append(events, EventBlocked)
+			} else {
+				i.BlockingReason = ""
+			}
+			needUpdate = true
+		}
+
+		if opts.BlockingReason != "" && i.Blocked && opts.BlockingReason != i.BlockingReason {
+			if !validBlockingReason(opts.BlockingReason) {
+				return ErrBadBlockingReason
+			}
+			i.BlockingReason = opts.BlockingReason
+			needUpdate = true
+		}
+
+		if opts.Maintenance != nil && *opts.Maintenance != i.Maintenance {
+			i.Maintenance = *opts.Maintenance
+			needUpdate = true
+		}
+
+		if opts.MovedTo != nil && *opts.MovedTo != i.MovedTo {
+			i.MovedTo = *opts.MovedTo
 			needUpdate = true
 		}
 
@@ -978,6 +1306,9 @@ func Patch(i *Instance, opts *Options) error {
 
 		if opts.OnboardingFinished != nil && *opts.OnboardingFinished != i.OnboardingFinished {
 			i.OnboardingFinished = *opts.OnboardingFinished
+			if i.OnboardingFinished {
+				events = append(events, EventOnboarded)
+			}
 			needUpdate = true
 		}
 
@@ -1013,6 +1344,7 @@ func Patch(i *Instance, opts *Options) error {
 		err = i.update()
 		if couchdb.IsConflictError(err) {
 			i = nil
+			events = nil
 			continue
 		}
 		if err != nil {
@@ -1020,6 +1352,13 @@ func Patch(i *Instance, opts *Options) error {
 		}
 		break
 	}
+	for _, event := range events {
+		var details map[string]interface{}
+		if event == EventBlocked && i.BlockingReason != "" {
+			details = map[string]interface{}{"reason": i.BlockingReason}
+		}
+		i.SendLifecycleWebhook(event, details)
+	}
 
 	if settingsUpdate {
 		oldSettings, err := i.SettingsDocument()
@@ -1044,7 +1383,7 @@ func Patch(i *Instance, opts *Options) error {
 	if debug := opts.Debug; debug != nil {
 		var err error
 		if *debug {
-			err = logger.AddDebugDomain(i.Domain)
+			err = logger.AddDebugDomain(i.Domain, opts.DebugTTL)
 		} else {
 			err = logger.RemoveDebugDomain(i.Domain)
 		}
@@ -1085,6 +1424,9 @@ func checkAliases(i *Instance, aliases []string) ([]string, error) {
 }
 
 func getFromCouch(domain string) (*Instance, error) {
+	if inst, ok := getFromCache(domain); ok {
+		return inst, nil
+	}
 	var res couchdb.ViewResponse
 	err := couchdb.ExecView(couchdb.GlobalDB, consts.DomainAndAliasesView, &couchdb.ViewRequest{
 		Key:         domain,
@@ -1108,12 +1450,14 @@ func getFromCouch(domain string) (*Instance, error) {
 	if err = inst.makeVFS(); err != nil {
 		return nil, err
 	}
+	storeInCache(domain, res.Rows[0].Doc)
 	return inst, nil
 }
 
-// Translate is used to translate a string to the locale used on this instance
+// Translate is used to translate a string to the locale used on this
+// instance, with the translations customized for its context if any.
 func (i *Instance) Translate(key string, vars ...interface{}) string {
-	return i18n.Translate(key, i.Locale, vars...)
+	return i18n.TranslateContext(key, i.Locale, i.ContextName, vars...)
 }
 
 // List returns the list of declared instances.
@@ -1171,6 +1515,7 @@ func DestroyWithoutHooks(domain string) error {
 
 	// Reload the instance, it can have been updated in CouchDB if the instance
 	// had at least one account and was not up-to-date for its indexes/views.
+	i.clearCache()
 	i, err = getFromCouch(domain)
 	if err != nil {
 		return err
@@ -1195,7 +1540,12 @@ func DestroyWithoutHooks(domain string) error {
 		i.Logger().Errorf("Could not delete VFS: %s", err.Error())
 	}
 
-	return couchdb.DeleteDoc(couchdb.GlobalDB, i)
+	err = couchdb.DeleteDoc(couchdb.GlobalDB, i)
+	i.clearCache()
+	if err == nil {
+		i.SendLifecycleWebhook(EventDeleted, nil)
+	}
+	return err
 }
 
 func deleteAccounts(i *Instance) {
@@ -1254,7 +1604,7 @@ func (i *Instance) registerPassphrase(pass, tok []byte) error {
 	if subtle.ConstantTimeCompare(i.RegisterToken, tok) != 1 {
 		return ErrInvalidToken
 	}
-	hash, err := crypto.GenerateFromPassphrase(pass)
+	hash, err := crypto.GenerateFromPassphraseWithParams(pass, i.Argon2Params())
 	if err != nil {
 		return err
 	}
@@ -1263,8 +1613,14 @@ func (i *Instance) registerPassphrase(pass, tok []byte) error {
 	return nil
 }
 
-// RegisterPassphrase replace the instance registerToken by a passphrase
+// RegisterPassphrase replace the instance registerToken by a passphrase. The
+// passphrase must comply with the password policy.
 func (i *Instance) RegisterPassphrase(pass, tok []byte) error {
+	if len(pass) > 0 {
+		if err := i.CheckPassphrasePolicy(pass); err != nil {
+			return err
+		}
+	}
 	if err := i.registerPassphrase(pass, tok); err != nil {
 		return err
 	}
@@ -1353,7 +1709,10 @@ func (i *Instance) PassphraseRenew(pass, tok []byte) error {
 	if err != nil {
 		return err
 	}
-	hash, err := crypto.GenerateFromPassphrase(pass)
+	if err = i.CheckPassphrasePolicy(pass); err != nil {
+		return err
+	}
+	hash, err := crypto.GenerateFromPassphraseWithParams(pass, i.Argon2Params())
 	if err != nil {
 		return err
 	}
@@ -1383,7 +1742,10 @@ func (i *Instance) UpdatePassphrase(pass, current []byte, twoFactorPasscode stri
 			return ErrInvalidPassphrase
 		}
 	}
-	hash, err := crypto.GenerateFromPassphrase(pass)
+	if err := i.CheckPassphrasePolicy(pass); err != nil {
+		return err
+	}
+	hash, err := crypto.GenerateFromPassphraseWithParams(pass, i.Argon2Params())
 	if err != nil {
 		return err
 	}
@@ -1392,8 +1754,13 @@ func (i *Instance) UpdatePassphrase(pass, current []byte, twoFactorPasscode stri
 }
 
 func (i *Instance) setPassphraseAndSecret(hash []byte) {
+	i.keepInHistory()
 	i.PassphraseHash = hash
 	i.SessionSecret = crypto.GenerateRandomBytes(SessionSecretLen)
+	// The tokens of the apps are invalidated, like the sessions
+	if len(i.jwtKeysOf(jwtFamilyApp)) > 0 {
+		i.rotateJWTFamily(jwtFamilyApp, time.Now().UTC(), true)
+	}
 }
 
 // CheckPassphrase confirm an instance passport
@@ -1402,7 +1769,7 @@ func (i *Instance) CheckPassphrase(pass []byte) error {
 		return ErrMissingPassphrase
 	}
 
-	needUpdate, err := crypto.CompareHashAndPassphrase(i.PassphraseHash, pass)
+	needUpdate, err := crypto.CompareHashAndPassphraseWithParams(i.PassphraseHash, pass, i.Argon2Params())
 	if err != nil {
 		return err
 	}
@@ -1411,7 +1778,7 @@ func (i *Instance) CheckPassphrase(pass []byte) error {
 		return nil
 	}
 
-	newHash, err := crypto.GenerateFromPassphrase(pass)
+	newHash, err := crypto.GenerateFromPassphraseWithParams(pass, i.Argon2Params())
 	if err != nil {
 		return err
 	}
@@ -1427,27 +1794,17 @@ func (i *Instance) CheckPassphrase(pass []byte) error {
 
 // PickKey choose which of the Instance keys to use depending on token audience
 func (i *Instance) PickKey(audience string) ([]byte, error) {
-	switch audience {
-	case permissions.AppAudience,
-		permissions.KonnectorAudience:
-		return i.SessionSecret, nil
-	case permissions.RefreshTokenAudience,
-		permissions.AccessTokenAudience,
-		permissions.ShareAudience:
-		return i.OAuthSecret, nil
-	case permissions.CLIAudience:
-		return i.CLISecret, nil
-	}
-	return nil, permissions.ErrInvalidAudience
+	_, secret, err := i.SigningKey(audience)
+	return secret, err
 }
 
 // MakeJWT is a shortcut to create a JWT
 func (i *Instance) MakeJWT(audience, subject, scope, sessionID string, issuedAt time.Time) (string, error) {
-	secret, err := i.PickKey(audience)
+	kid, secret, err := i.SigningKey(audience)
 	if err != nil {
 		return "", err
 	}
-	return crypto.NewJWT(secret, permissions.Claims{
+	return crypto.NewJWTWithKeyID(secret, kid, permissions.Claims{
 		StandardClaims: jwt.StandardClaims{
 			Audience: audience,
 			Issuer:   i.Domain,
@@ -3,11 +3,15 @@ package instance_test
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/cozy/checkup"
+	"github.com/cozy/cozy-stack/pkg/accounts"
 	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -15,6 +19,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/stack"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/stretchr/testify/assert"
@@ -40,6 +45,126 @@ func TestSubdomain(t *testing.T) {
 	assert.Equal(t, "https://foo-calendar.example.com/", u.String())
 }
 
+func TestContextSettings(t *testing.T) {
+	cfg := config.GetConfig()
+	was := cfg.Contexts
+	defer func() { cfg.Contexts = was }()
+	cfg.Contexts = map[string]interface{}{
+		"foo": map[string]interface{}{
+			"disk_quota":   "1MB",
+			"default_apps": []interface{}{"drive", "photos"},
+			"default_konnectors": []interface{}{
+				map[string]interface{}{"slug": "ameli", "source": "registry://ameli/beta"},
+			},
+			"mail": map[string]interface{}{
+				"noreply_address": "noreply@foo.example.com",
+			},
+			"support_address": "support@foo.example.com",
+		},
+	}
+
+	inst := &instance.Instance{
+		Domain:      "foo.example.com",
+		ContextName: "foo",
+	}
+	assert.EqualValues(t, 1000000, inst.DiskQuota())
+	assert.Equal(t, []string{"drive", "photos"}, inst.DefaultApps())
+	defaults := inst.DefaultInstalls()
+	if assert.Len(t, defaults, 3) {
+		assert.Equal(t, "registry://drive/stable", defaults[0].Source)
+		assert.Equal(t, "webapp/drive", defaults[0].Step())
+		assert.Equal(t, consts.Konnectors, defaults[2].Doctype)
+		assert.Equal(t, "registry://ameli/beta", defaults[2].Source)
+		assert.Equal(t, "konnector/ameli", defaults[2].Step())
+	}
+	addr, _ := inst.NoReplyAddress()
+	assert.Equal(t, "noreply@foo.example.com", addr)
+	assert.Equal(t, "support@foo.example.com", inst.SupportEmailAddress())
+
+	inst.BytesDiskQuota = 42
+	assert.EqualValues(t, 42, inst.DiskQuota())
+
+	other := &instance.Instance{
+		Domain:      "bar.example.com",
+		ContextName: "bar",
+	}
+	assert.EqualValues(t, 0, other.DiskQuota())
+	assert.Len(t, other.DefaultApps(), 0)
+	assert.Equal(t, instance.DefaultSupportEmail, other.SupportEmailAddress())
+}
+
+func TestContextOverrides(t *testing.T) {
+	cfg := config.GetConfig()
+	was := cfg.Contexts
+	defer func() { cfg.Contexts = was }()
+	cfg.Contexts = map[string]interface{}{
+		"foo": map[string]interface{}{
+			"disk_quota": "1MB",
+			"mail": map[string]interface{}{
+				"noreply_address": "noreply@foo.example.com",
+			},
+		},
+	}
+	defer instance.SetContextOverrides("foo", nil)
+
+	err := instance.SetContextOverrides("foo", map[string]interface{}{"unknown": true})
+	assert.Equal(t, instance.ErrBadContextOverride, err)
+	err = instance.SetContextOverrides("foo", map[string]interface{}{"disk_quota": "foo"})
+	assert.Equal(t, instance.ErrBadContextOverride, err)
+
+	inst := &instance.Instance{
+		Domain:      "foo.example.com",
+		ContextName: "foo",
+	}
+	assert.Nil(t, inst.MailDialer())
+
+	err = instance.SetContextOverrides("foo", map[string]interface{}{
+		"disk_quota": "2MB",
+		"mail": map[string]interface{}{
+			"host": "smtp.foo.example.com",
+			"port": float64(587),
+		},
+		"registries": []interface{}{"https://registry.foo.example.com/"},
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2000000, inst.DiskQuota())
+	addr, _ := inst.NoReplyAddress()
+	assert.Equal(t, "noreply@foo.example.com", addr)
+	if dialer := inst.MailDialer(); assert.NotNil(t, dialer) {
+		assert.Equal(t, "smtp.foo.example.com", dialer.Host)
+		assert.Equal(t, 587, dialer.Port)
+	}
+	if regs := inst.Registries(); assert.Len(t, regs, 1) {
+		assert.Equal(t, "https://registry.foo.example.com/", regs[0].String())
+	}
+
+	assert.NoError(t, instance.SetContextOverrides("foo", map[string]interface{}{"disk_quota": nil}))
+	assert.EqualValues(t, 1000000, inst.DiskQuota())
+}
+
+func TestSignature(t *testing.T) {
+	inst := &instance.Instance{
+		Domain:      "foo.example.com",
+		SigningSeed: crypto.GenerateRandomBytes(instance.SigningSeedLen),
+	}
+	key, err := inst.PublicKey()
+	assert.NoError(t, err)
+	sig, err := inst.Sign([]byte("payload"))
+	assert.NoError(t, err)
+	assert.True(t, instance.VerifySignature(key, []byte("payload"), sig))
+	assert.False(t, instance.VerifySignature(key, []byte("other payload"), sig))
+	assert.False(t, instance.VerifySignature(key, []byte("payload"), "invalid"))
+
+	other := &instance.Instance{
+		Domain:      "bar.example.com",
+		SigningSeed: crypto.GenerateRandomBytes(instance.SigningSeedLen),
+	}
+	otherKey, err := other.PublicKey()
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, otherKey)
+	assert.False(t, instance.VerifySignature(otherKey, []byte("payload"), sig))
+}
+
 func TestGetInstanceNoDB(t *testing.T) {
 	instance, err := instance.Get("no.instance.cozycloud.cc")
 	if assert.Error(t, err, "An error is expected") {
@@ -185,6 +310,22 @@ func TestInstanceHasIndexes(t *testing.T) {
 	assert.Len(t, results, 1)
 }
 
+func TestViewsAndIndexesStatus(t *testing.T) {
+	inst, err := instance.Get("test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	states, err := inst.ViewsAndIndexesStatus()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, states, len(consts.Views)+len(consts.Indexes))
+	for _, state := range states {
+		assert.NotEqual(t, couchdb.DesignDocMissing, state.Status, state.Name)
+		assert.NotEqual(t, couchdb.DesignDocStale, state.Status, state.Name)
+	}
+}
+
 func TestBuildAppToken(t *testing.T) {
 	manifest := &apps.WebappManifest{
 		DocSlug: "my-app",
@@ -278,6 +419,59 @@ func TestUpdatePassphrase(t *testing.T) {
 	assert.NotEqual(t, oldSecret, i.SessionSecret)
 }
 
+func TestPassphraseEntropy(t *testing.T) {
+	assert.EqualValues(t, 0, instance.PassphraseEntropy(""))
+	assert.InDelta(t, 4*math.Log2(10), instance.PassphraseEntropy("1234"), 0.001)
+	assert.InDelta(t, 2*math.Log2(26), instance.PassphraseEntropy("aaab"), 0.001)
+	assert.InDelta(t, 4*math.Log2(26+26+10+33), instance.PassphraseEntropy("aB3!"), 0.001)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	cfg := config.GetConfig()
+	was := cfg.Contexts
+	defer func() { cfg.Contexts = was }()
+	cfg.Contexts = map[string]interface{}{
+		"policy": map[string]interface{}{
+			"password_policy": map[string]interface{}{
+				"min_length":  8,
+				"min_entropy": 40,
+				"ban_common":  true,
+				"history":     2,
+			},
+		},
+	}
+
+	instance.Destroy("policy.cozycloud.cc")
+	inst, err := instance.Create(&instance.Options{
+		Domain:      "policy.cozycloud.cc",
+		Locale:      "en",
+		ContextName: "policy",
+		Passphrase:  "Cozy-Cloud-4-ever",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer instance.Destroy("policy.cozycloud.cc")
+
+	current := []byte("Cozy-Cloud-4-ever")
+	err = inst.UpdatePassphrase([]byte("Short1!"), current, "", nil)
+	assert.Equal(t, instance.ErrPassphraseTooShort, err)
+	err = inst.UpdatePassphrase([]byte("Password123"), current, "", nil)
+	assert.Equal(t, instance.ErrPassphraseBanned, err)
+	err = inst.UpdatePassphrase([]byte("abcdefgh"), current, "", nil)
+	assert.Equal(t, instance.ErrPassphraseTooWeak, err)
+	err = inst.UpdatePassphrase(current, current, "", nil)
+	assert.Equal(t, instance.ErrPassphraseReused, err)
+
+	next := []byte("Another-Passphrase-42")
+	assert.NoError(t, inst.UpdatePassphrase(next, current, "", nil))
+	assert.Len(t, inst.PassphraseHistory, 1)
+	err = inst.UpdatePassphrase(current, next, "", nil)
+	assert.Equal(t, instance.ErrPassphraseReused, err)
+	assert.NoError(t, inst.UpdatePassphrase([]byte("Yet-Another-One-1337"), next, "", nil))
+	assert.Len(t, inst.PassphraseHistory, 1)
+}
+
 func TestCheckPassphrase(t *testing.T) {
 	instance, err := instance.Get("test.cozycloud.cc")
 	if !assert.NoError(t, err, "cant fetch instance") {
@@ -294,6 +488,28 @@ func TestCheckPassphrase(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestUpgradeLegacyPassphraseHash(t *testing.T) {
+	instance.Destroy("legacy-hash.cozycloud.cc")
+	inst, err := instance.Create(&instance.Options{
+		Domain: "legacy-hash.cozycloud.cc",
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer instance.Destroy("legacy-hash.cozycloud.cc")
+
+	// A legacy scrypt hash of "This is secret"
+	inst.PassphraseHash = []byte("scrypt$32768$8$1$bc39ced1a16922f626b7036edc2711a9$84a3e30dbde37dcb1b169365a8f7b88c5d0dde057d8b85e3a361fedf8a80d1ef")
+	assert.NoError(t, inst.CheckPassphrase([]byte("This is secret")))
+	assert.True(t, bytes.HasPrefix(inst.PassphraseHash, []byte("argon2id$")))
+
+	inst, err = instance.Get("legacy-hash.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(inst.PassphraseHash, []byte("argon2id$")))
+	assert.NoError(t, inst.CheckPassphrase([]byte("This is secret")))
+}
+
 func TestRequestPassphraseReset(t *testing.T) {
 	instance.Destroy("test.cozycloud.cc.pass_reset")
 	in, err := instance.Create(&instance.Options{
@@ -409,6 +625,49 @@ func TestInstanceDestroy(t *testing.T) {
 	}
 }
 
+func TestInstanceCache(t *testing.T) {
+	instance.Destroy("cache.cozycloud.cc")
+
+	_, err := instance.Create(&instance.Options{
+		Domain: "cache.cozycloud.cc",
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	inst, err := instance.Get("cache.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.Equal(t, "en", inst.Locale)
+
+	err = instance.Patch(inst, &instance.Options{Locale: "fr"})
+	assert.NoError(t, err)
+	inst, err = instance.Get("cache.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.Equal(t, "fr", inst.Locale)
+
+	// The previous aliases are removed from the cache
+	err = instance.Patch(inst, &instance.Options{DomainAliases: []string{"cache-alias.cozycloud.cc"}})
+	assert.NoError(t, err)
+	inst, err = instance.Get("cache-alias.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.Equal(t, "cache.cozycloud.cc", inst.Domain)
+	err = instance.Patch(inst, &instance.Options{DomainAliases: []string{"cache-other.cozycloud.cc"}})
+	assert.NoError(t, err)
+	_, err = instance.Get("cache-alias.cozycloud.cc")
+	assert.Equal(t, instance.ErrNotFound, err)
+	inst, err = instance.Get("cache-other.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.Equal(t, "cache.cozycloud.cc", inst.Domain)
+
+	err = instance.Destroy("cache.cozycloud.cc")
+	assert.NoError(t, err)
+	_, err = instance.Get("cache.cozycloud.cc")
+	assert.Equal(t, instance.ErrNotFound, err)
+	_, err = instance.Get("cache-other.cozycloud.cc")
+	assert.Equal(t, instance.ErrNotFound, err)
+}
+
 func TestCheckTOSNotSigned(t *testing.T) {
 	instance.Destroy("tos.test.cozycloud.cc")
 
@@ -522,3 +781,294 @@ func getDB(t *testing.T, domain string) couchdb.Database {
 	}
 	return instance
 }
+
+func TestCloneInstance(t *testing.T) {
+	instance.Destroy("clone-src.cozycloud.cc")
+	instance.Destroy("clone-dst.cozycloud.cc")
+
+	src, err := instance.Create(&instance.Options{
+		Domain:     "clone-src.cozycloud.cc",
+		Locale:     "en",
+		PublicName: "Alice",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fs := src.VFS()
+	doc, err := vfs.NewFileDoc("hello.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	f, err := fs.CreateFile(doc, nil)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("Hello world"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	clone, err := instance.Clone(src, "clone-dst.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "clone-dst.cozycloud.cc", clone.Domain)
+	assert.NotEqual(t, src.Prefix, clone.Prefix)
+	assert.NotEqual(t, src.SessionSecret, clone.SessionSecret)
+	assert.NotEqual(t, src.OAuthSecret, clone.OAuthSecret)
+
+	clone, err = instance.Get("clone-dst.cozycloud.cc")
+	assert.NoError(t, err)
+	name, err := clone.PublicName()
+	assert.NoError(t, err)
+	assert.Equal(t, "Alice", name)
+	copied, err := clone.VFS().FileByPath("/hello.txt")
+	if assert.NoError(t, err) {
+		file, err := clone.VFS().OpenFile(copied)
+		assert.NoError(t, err)
+		buf := new(bytes.Buffer)
+		_, err = buf.ReadFrom(file)
+		assert.NoError(t, err)
+		assert.NoError(t, file.Close())
+		assert.Equal(t, "Hello world", buf.String())
+	}
+
+	_, err = instance.Clone(src, "clone-dst.cozycloud.cc")
+	assert.Equal(t, instance.ErrExists, err)
+
+	assert.NoError(t, instance.Destroy("clone-dst.cozycloud.cc"))
+	assert.NoError(t, instance.Destroy("clone-src.cozycloud.cc"))
+}
+
+func TestCloneInstanceWithAccount(t *testing.T) {
+	instance.Destroy("clone-src.cozycloud.cc")
+	instance.Destroy("clone-dst.cozycloud.cc")
+
+	src, err := instance.Create(&instance.Options{
+		Domain: "clone-src.cozycloud.cc",
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	account := couchdb.JSONDoc{
+		Type: consts.Accounts,
+		M: map[string]interface{}{
+			"account_type": "foo",
+			"auth": map[string]interface{}{
+				"login":    "alice",
+				"password": "my-secret-password",
+			},
+		},
+	}
+	encrypted, err := accounts.EncryptAccount(src, account)
+	assert.NoError(t, err)
+	assert.True(t, encrypted)
+	assert.NoError(t, couchdb.CreateDoc(src, &account))
+
+	clone, err := instance.Clone(src, "clone-dst.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	copied := couchdb.JSONDoc{}
+	assert.NoError(t, couchdb.GetDoc(clone, consts.Accounts, account.ID(), &copied))
+	copied.Type = consts.Accounts
+	auth, _ := copied.M["auth"].(map[string]interface{})
+	assert.NotContains(t, auth, "password")
+	assert.Contains(t, auth, "credentials_encrypted")
+	assert.True(t, accounts.DecryptAccount(clone, copied))
+	auth, _ = copied.M["auth"].(map[string]interface{})
+	assert.Equal(t, "alice", auth["login"])
+	assert.Equal(t, "my-secret-password", auth["password"])
+
+	assert.NoError(t, instance.Destroy("clone-dst.cozycloud.cc"))
+	assert.NoError(t, instance.Destroy("clone-src.cozycloud.cc"))
+}
+
+func TestScheduleDeletion(t *testing.T) {
+	instance.Destroy("deletion.cozycloud.cc")
+	inst, err := instance.Create(&instance.Options{
+		Domain: "deletion.cozycloud.cc",
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	inst.RegisterToken = nil
+	assert.False(t, inst.CheckInstanceBlocked())
+
+	assert.NoError(t, inst.ScheduleDeletion())
+	assert.Equal(t, instance.ErrDeletionScheduled, inst.ScheduleDeletion())
+	inst, err = instance.Get("deletion.cozycloud.cc")
+	assert.NoError(t, err)
+	if assert.NotNil(t, inst.DeleteAt) {
+		assert.True(t, inst.DeleteAt.After(time.Now().Add(29*24*time.Hour)))
+	}
+	assert.True(t, inst.CheckInstanceBlocked())
+	assert.NotEmpty(t, inst.Warnings())
+
+	assert.NoError(t, inst.CancelDeletion())
+	assert.Equal(t, instance.ErrDeletionNotScheduled, inst.CancelDeletion())
+	inst, err = instance.Get("deletion.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.Nil(t, inst.DeleteAt)
+
+	assert.NoError(t, instance.Destroy("deletion.cozycloud.cc"))
+}
+
+func TestBlockingReason(t *testing.T) {
+	instance.Destroy("blocking.cozycloud.cc")
+	inst, err := instance.Create(&instance.Options{
+		Domain: "blocking.cozycloud.cc",
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer instance.Destroy("blocking.cozycloud.cc")
+
+	blocked := true
+	err = instance.Patch(inst, &instance.Options{Blocked: &blocked, BlockingReason: "unknown"})
+	assert.Equal(t, instance.ErrBadBlockingReason, err)
+
+	inst, err = instance.Get("blocking.cozycloud.cc")
+	assert.NoError(t, err)
+	err = instance.Patch(inst, &instance.Options{
+		Blocked:        &blocked,
+		BlockingReason: instance.BlockingPaymentOverdue,
+	})
+	assert.NoError(t, err)
+	inst, err = instance.Get("blocking.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.True(t, inst.CheckInstanceBlocked())
+	assert.Equal(t, instance.BlockingPaymentOverdue, inst.BlockingReason)
+	warnings := inst.Warnings()
+	if assert.Len(t, warnings, 1) {
+		assert.Equal(t, instance.BlockingPaymentOverdue, warnings[0].Code)
+	}
+
+	blocked = false
+	assert.NoError(t, instance.Patch(inst, &instance.Options{Blocked: &blocked}))
+	inst, err = instance.Get("blocking.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.False(t, inst.Blocked)
+	assert.Empty(t, inst.BlockingReason)
+}
+
+func TestRotateJWTKeys(t *testing.T) {
+	instance.Destroy("jwt-keys.cozycloud.cc")
+	inst, err := instance.Create(&instance.Options{
+		Domain: "jwt-keys.cozycloud.cc",
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer instance.Destroy("jwt-keys.cozycloud.cc")
+
+	parse := func(tokenString string) error {
+		var claims permissions.Claims
+		return crypto.ParseJWT(tokenString, inst.JWTKeyFunc(permissions.AppAudience), &claims)
+	}
+
+	legacy, err := inst.MakeJWT(permissions.AppAudience, "my-app", "", "", time.Now())
+	assert.NoError(t, err)
+	assert.NoError(t, parse(legacy))
+	refresh, err := inst.MakeJWT(permissions.RefreshTokenAudience, "client", "", "", time.Now())
+	assert.NoError(t, err)
+
+	// The previous tokens are still valid after a rotation
+	assert.NoError(t, inst.RotateJWTKeys(false))
+	inst, err = instance.Get("jwt-keys.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.NoError(t, parse(legacy))
+	rotated, err := inst.MakeJWT(permissions.AppAudience, "my-app", "", "", time.Now())
+	assert.NoError(t, err)
+	assert.NotEqual(t, legacy, rotated)
+	assert.NoError(t, parse(rotated))
+	var claims permissions.Claims
+	assert.NoError(t, crypto.ParseJWT(refresh, inst.JWTKeyFunc(permissions.RefreshTokenAudience), &claims))
+
+	// But not after a forced rotation
+	assert.NoError(t, inst.RotateJWTKeys(true))
+	inst, err = instance.Get("jwt-keys.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.Error(t, parse(legacy))
+	assert.Error(t, parse(rotated))
+	assert.Error(t, crypto.ParseJWT(refresh, inst.JWTKeyFunc(permissions.RefreshTokenAudience), &claims))
+	token, err := inst.MakeJWT(permissions.AppAudience, "my-app", "", "", time.Now())
+	assert.NoError(t, err)
+	assert.NoError(t, parse(token))
+}
+
+func TestInstanceSecretsEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instance-secrets")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	current := filepath.Join(dir, "current.key")
+	next := filepath.Join(dir, "next.key")
+	assert.NoError(t, ioutil.WriteFile(current, crypto.GenerateRandomBytes(32), 0600))
+	assert.NoError(t, ioutil.WriteFile(next, crypto.GenerateRandomBytes(32), 0600))
+	short := filepath.Join(dir, "short.key")
+	assert.NoError(t, ioutil.WriteFile(short, crypto.GenerateRandomBytes(16), 0600))
+
+	cfg := config.GetConfig()
+	useKeys := func(key, previous string) error {
+		cfg.InstanceSecretsMasterKey = key
+		cfg.InstanceSecretsPreviousMasterKey = previous
+		return config.MakeVault(cfg)
+	}
+	defer func() {
+		_ = useKeys("", "")
+	}()
+	assert.Error(t, useKeys(current, short))
+	if !assert.NoError(t, useKeys(current, "")) {
+		return
+	}
+
+	domain := "secrets.cozycloud.cc"
+	instance.Destroy(domain)
+	inst, err := instance.Create(&instance.Options{
+		Domain: domain,
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		_ = useKeys(next, current)
+		_ = instance.Destroy(domain)
+	}()
+	sessionSecret := inst.SessionSecret
+
+	var doc couchdb.JSONDoc
+	err = couchdb.GetDoc(couchdb.GlobalDB, consts.Instances, inst.ID(), &doc)
+	assert.NoError(t, err)
+	assert.NotContains(t, doc.M, "session_secret")
+	assert.NotContains(t, doc.M, "oauth_secret")
+	assert.Contains(t, doc.M, "secrets_encrypted")
+
+	inst, err = instance.Get(domain)
+	assert.NoError(t, err)
+	assert.Equal(t, sessionSecret, inst.SessionSecret)
+	assert.Len(t, inst.OAuthSecret, instance.OauthSecretLen)
+
+	// Rotation of the master key
+	assert.NoError(t, useKeys(next, current))
+	inst, err = instance.Get(domain)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, sessionSecret, inst.SessionSecret)
+	assert.NoError(t, inst.ReencryptSecrets())
+	assert.NoError(t, useKeys(next, ""))
+	inst, err = instance.Get(domain)
+	if assert.NoError(t, err) {
+		assert.Equal(t, sessionSecret, inst.SessionSecret)
+	}
+
+	// The secrets can't be read without the master key
+	assert.NoError(t, useKeys(current, ""))
+	_, err = instance.Get(domain)
+	assert.Error(t, err)
+	assert.NoError(t, useKeys("", ""))
+	_, err = instance.Get(domain)
+	assert.Error(t, err)
+}
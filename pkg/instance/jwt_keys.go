@@ -0,0 +1,301 @@
+package instance
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// The families of the keys used to sign the JSON Web Tokens. The tokens of a
+// family are signed with the same key, and the keys of a family are rotated
+// together.
+const (
+	// jwtFamilyApp is for the tokens of the apps and of the konnectors
+	jwtFamilyApp = "app"
+	// jwtFamilyAccess is for the OAuth access tokens
+	jwtFamilyAccess = "access"
+	// jwtFamilyCLI is for the tokens of the command line
+	jwtFamilyCLI = "cli"
+	// jwtFamilyOAuth is for the tokens that don't expire: the refresh tokens,
+	// the registration tokens and the codes of the sharings by link. Their key
+	// is only changed by a forced rotation, as it invalidates them.
+	jwtFamilyOAuth = "oauth"
+)
+
+// DefaultJWTKeysRotation is the duration after which the keys used to sign
+// the tokens are rotated, if the context of the instance has no
+// jwt_keys_rotation.
+const DefaultJWTKeysRotation = 30 * 24 * time.Hour
+
+// jwtKeyIDLen is the number of random bytes for the identifier of a key.
+const jwtKeyIDLen = 8
+
+const (
+	jwtRotatorInterval = 24 * time.Hour
+	jwtRotatorKey      = "jwt-keys-rotation"
+)
+
+// JWTKey is a key used to sign the JSON Web Tokens of an instance. Its
+// identifier is put in the kid header of the tokens. A retired key is no
+// longer used to sign the new tokens, and it is kept while the tokens signed
+// with it can still be valid.
+type JWTKey struct {
+	KID       string     `json:"kid"`
+	Family    string     `json:"family"`
+	Secret    []byte     `json:"secret"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+// jwtFamily returns the family of the keys used for the tokens of the given
+// audience.
+func jwtFamily(audience string) (string, error) {
+	switch audience {
+	case permissions.AppAudience, permissions.KonnectorAudience:
+		return jwtFamilyApp, nil
+	case permissions.AccessTokenAudience:
+		return jwtFamilyAccess, nil
+	case permissions.CLIAudience:
+		return jwtFamilyCLI, nil
+	case permissions.RefreshTokenAudience,
+		permissions.RegistrationTokenAudience,
+		permissions.ShareAudience:
+		return jwtFamilyOAuth, nil
+	}
+	return "", permissions.ErrInvalidAudience
+}
+
+// jwtGracePeriod is the duration during which a retired key can still be used
+// to verify the tokens: it is the validity duration of these tokens.
+func jwtGracePeriod(family string) time.Duration {
+	switch family {
+	case jwtFamilyApp:
+		return permissions.AppTokenValidityDuration
+	case jwtFamilyAccess:
+		return permissions.AccessTokenValidityDuration
+	case jwtFamilyCLI:
+		return permissions.CLITokenValidityDuration
+	}
+	return 0
+}
+
+// legacySecret returns the secret that was used for the tokens of the given
+// family before the keysets. The tokens signed with it have no kid header.
+func (i *Instance) legacySecret(family string) []byte {
+	switch family {
+	case jwtFamilyApp:
+		return i.SessionSecret
+	case jwtFamilyCLI:
+		return i.CLISecret
+	}
+	return i.OAuthSecret
+}
+
+func (i *Instance) jwtKeysOf(family string) []*JWTKey {
+	var keys []*JWTKey
+	for idx := range i.JWTKeys {
+		if i.JWTKeys[idx].Family == family {
+			keys = append(keys, &i.JWTKeys[idx])
+		}
+	}
+	return keys
+}
+
+// SigningKey returns the identifier and the secret of the key to use for
+// signing a new token for the given audience. The identifier is empty for
+// the legacy secrets of the instance.
+func (i *Instance) SigningKey(audience string) (string, []byte, error) {
+	family, err := jwtFamily(audience)
+	if err != nil {
+		return "", nil, err
+	}
+	var current *JWTKey
+	for _, key := range i.jwtKeysOf(family) {
+		if key.RetiredAt == nil && (current == nil || key.CreatedAt.After(current.CreatedAt)) {
+			current = key
+		}
+	}
+	if current == nil {
+		return "", i.legacySecret(family), nil
+	}
+	return current.KID, current.Secret, nil
+}
+
+// VerificationKey returns the secret to use for checking the signature of a
+// token for the given audience, with the given kid header. The retired keys
+// can be used during their grace period.
+func (i *Instance) VerificationKey(audience, kid string) ([]byte, error) {
+	family, err := jwtFamily(audience)
+	if err != nil {
+		return nil, err
+	}
+	keys := i.jwtKeysOf(family)
+	if kid == "" && len(keys) == 0 {
+		return i.legacySecret(family), nil
+	}
+	now := time.Now()
+	for _, key := range keys {
+		if key.KID != kid {
+			continue
+		}
+		if key.RetiredAt != nil && key.RetiredAt.Add(jwtGracePeriod(family)).Before(now) {
+			break
+		}
+		return key.Secret, nil
+	}
+	return nil, permissions.ErrInvalidToken
+}
+
+// JWTKeyFunc returns the function used to pick the key for verifying the
+// signature of a token, with its audience and its kid header.
+func (i *Instance) JWTKeyFunc(audience string) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return i.VerificationKey(audience, kid)
+	}
+}
+
+// JWTKeysRotation returns the duration after which the keys of the instance
+// are rotated: the jwt_keys_rotation of its context (like 720h), or else
+// DefaultJWTKeysRotation.
+func (i *Instance) JWTKeysRotation() time.Duration {
+	if context, err := i.SettingsContext(); err == nil {
+		if r, ok := context["jwt_keys_rotation"].(string); ok {
+			if d, err := time.ParseDuration(r); err == nil && d > 0 {
+				return d
+			}
+		}
+	}
+	return DefaultJWTKeysRotation
+}
+
+// RotateJWTKeys generates new keys for signing the tokens of the instance.
+// The previous keys are retired, and they can still be used for verifying
+// the tokens until these tokens expire. The tokens that don't expire keep
+// their key.
+//
+// With force, typically after a leak, the previous keys and the legacy
+// secrets are no longer accepted, and all the tokens are rotated: the
+// existing tokens, including the refresh tokens and the codes of the sharings
+// by link, are invalidated.
+func (i *Instance) RotateJWTKeys(force bool) error {
+	families := []string{jwtFamilyApp, jwtFamilyAccess, jwtFamilyCLI}
+	if force {
+		families = append(families, jwtFamilyOAuth)
+	}
+	now := time.Now().UTC()
+	for _, family := range families {
+		i.rotateJWTFamily(family, now, force)
+	}
+	return i.update()
+}
+
+func (i *Instance) rotateJWTFamily(family string, now time.Time, force bool) {
+	var keys []JWTKey
+	existing := i.jwtKeysOf(family)
+	if !force {
+		if len(existing) == 0 {
+			// The tokens signed with the legacy secret have no kid, and they
+			// are accepted during the grace period
+			keys = append(keys, JWTKey{
+				Family:    family,
+				Secret:    i.legacySecret(family),
+				CreatedAt: now,
+				RetiredAt: &now,
+			})
+		}
+		for _, key := range existing {
+			if key.RetiredAt == nil {
+				key.RetiredAt = &now
+			}
+			if key.RetiredAt.Add(jwtGracePeriod(family)).After(now) {
+				keys = append(keys, *key)
+			}
+		}
+	}
+	keys = append(keys, JWTKey{
+		KID:       hex.EncodeToString(crypto.GenerateRandomBytes(jwtKeyIDLen)),
+		Family:    family,
+		Secret:    crypto.GenerateRandomBytes(OauthSecretLen),
+		CreatedAt: now,
+	})
+
+	var others []JWTKey
+	for _, key := range i.JWTKeys {
+		if key.Family != family {
+			others = append(others, key)
+		}
+	}
+	i.JWTKeys = append(others, keys...)
+}
+
+// needJWTRotation returns true if the current keys of the instance are older
+// than the rotation duration.
+func (i *Instance) needJWTRotation(now time.Time) bool {
+	limit := now.Add(-i.JWTKeysRotation())
+	for _, key := range i.jwtKeysOf(jwtFamilyApp) {
+		if key.RetiredAt == nil && key.CreatedAt.After(limit) {
+			return false
+		}
+	}
+	return true
+}
+
+// StartJWTKeysRotator starts the process that rotates the keys of the
+// instances when they are too old, once a day. When the stack has several
+// processes, only the leader does it.
+func StartJWTKeysRotator() utils.Shutdowner {
+	closed := make(chan struct{})
+	leader := lock.Elect(jwtRotatorKey)
+	go func() {
+		waitDuration := jwtRotatorInterval
+		for {
+			select {
+			case <-time.After(waitDuration):
+				if !leader.IsLeader() {
+					waitDuration = lock.LeaderTimeout
+					continue
+				}
+				waitDuration = jwtRotatorInterval
+				now := time.Now()
+				err := ForeachInstances(func(i *Instance) error {
+					if !i.needJWTRotation(now) {
+						return nil
+					}
+					if err := i.RotateJWTKeys(false); err != nil {
+						i.Logger().WithField("nspace", "jwt").
+							Errorf("Could not rotate the keys: %s", err)
+					}
+					return nil
+				})
+				if err != nil {
+					logger.WithNamespace("jwt").
+						Errorf("Could not rotate the keys: %s", err)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &jwtRotator{closed, leader}
+}
+
+type jwtRotator struct {
+	closed chan struct{}
+	leader lock.Leader
+}
+
+func (r *jwtRotator) Shutdown(ctx context.Context) error {
+	select {
+	case r.closed <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return r.leader.Shutdown(ctx)
+}
@@ -0,0 +1,85 @@
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/cozy/cozy-stack/pkg/jobs"
+)
+
+// ErrInMaintenance is used when the instance, or one of its applications, is
+// in maintenance.
+var ErrInMaintenance = errors.New("The Cozy is in maintenance")
+
+func init() {
+	jobs.RegisterTriggersPausedCallback(func(t jobs.Trigger) bool {
+		i, err := Get(t.DomainName())
+		if err != nil {
+			return false
+		}
+		if i.Maintenance || i.DeleteAt != nil {
+			return true
+		}
+		if len(i.MaintenanceApps) == 0 {
+			return false
+		}
+		slug := triggerSlug(t.Infos())
+		return slug != "" && i.AppInMaintenance(slug)
+	})
+}
+
+// triggerSlug returns the slug of the konnector or of the webapp service
+// launched by a trigger, or an empty string for the other workers.
+func triggerSlug(infos *jobs.TriggerInfos) string {
+	var msg struct {
+		Konnector string `json:"konnector"`
+		Slug      string `json:"slug"`
+	}
+	if err := json.Unmarshal(infos.Message, &msg); err != nil {
+		return ""
+	}
+	switch infos.WorkerType {
+	case "konnector":
+		return msg.Konnector
+	case "service":
+		return msg.Slug
+	}
+	return ""
+}
+
+// AppInMaintenance returns true if the application with the given slug is in
+// maintenance, or if the whole instance is in maintenance.
+func (i *Instance) AppInMaintenance(slug string) bool {
+	if i.Maintenance {
+		return true
+	}
+	for _, s := range i.MaintenanceApps {
+		if s == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAppMaintenance puts an application in maintenance, or takes it out of
+// maintenance. The user can't use the application while it is in
+// maintenance, and its scheduled jobs are paused.
+func (i *Instance) SetAppMaintenance(slug string, maintenance bool) error {
+	var apps []string
+	found := false
+	for _, s := range i.MaintenanceApps {
+		if s == slug {
+			found = true
+		} else {
+			apps = append(apps, s)
+		}
+	}
+	if found == maintenance {
+		return nil
+	}
+	if maintenance {
+		apps = append(apps, slug)
+	}
+	i.MaintenanceApps = apps
+	return i.update()
+}
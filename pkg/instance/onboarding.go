@@ -0,0 +1,132 @@
+package instance
+
+import (
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+)
+
+// The states of the onboarding steps
+const (
+	StepPending = "pending"
+	StepDone    = "done"
+	StepErrored = "errored"
+)
+
+// maxStepConflicts is the number of times the update of an onboarding step is
+// retried on a conflict, as the installation jobs can finish at the same time.
+const maxStepConflicts = 5
+
+// DefaultApp is a webapp or a konnector to install on the creation of the
+// instances of a context. It is also the message of the apps-install jobs.
+type DefaultApp struct {
+	Slug    string `json:"slug"`
+	Doctype string `json:"doctype"` // consts.Apps or consts.Konnectors
+	Source  string `json:"source"`
+}
+
+// Step returns the name of the onboarding step for the installation of this
+// application, like "webapp/drive".
+func (a *DefaultApp) Step() string {
+	if a.Doctype == consts.Konnectors {
+		return "konnector/" + a.Slug
+	}
+	return "webapp/" + a.Slug
+}
+
+// DefaultInstalls returns the webapps and konnectors to install on the
+// creation of the instance, from the default_apps and default_konnectors of
+// its context. An item can be a slug, or a map with a slug and a source.
+func (i *Instance) DefaultInstalls() []DefaultApp {
+	context, err := i.SettingsContext()
+	if err != nil {
+		return nil
+	}
+	var defaults []DefaultApp
+	defaults = append(defaults, parseDefaultApps(context["default_apps"], consts.Apps)...)
+	defaults = append(defaults, parseDefaultApps(context["default_konnectors"], consts.Konnectors)...)
+	return defaults
+}
+
+func parseDefaultApps(value interface{}, doctype string) []DefaultApp {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+	defaults := make([]DefaultApp, 0, len(list))
+	for _, item := range list {
+		app := DefaultApp{Doctype: doctype}
+		switch item := item.(type) {
+		case string:
+			app.Slug = item
+		case map[string]interface{}:
+			app.Slug, _ = item["slug"].(string)
+			app.Source, _ = item["source"].(string)
+		case map[interface{}]interface{}:
+			app.Slug, _ = item["slug"].(string)
+			app.Source, _ = item["source"].(string)
+		}
+		if app.Slug == "" {
+			continue
+		}
+		if app.Source == "" {
+			app.Source = "registry://" + app.Slug + "/stable"
+		}
+		defaults = append(defaults, app)
+	}
+	return defaults
+}
+
+// SetOnboardingStep saves the state of an onboarding step.
+func (i *Instance) SetOnboardingStep(step, state string) error {
+	var err error
+	for n := 0; n < maxStepConflicts; n++ {
+		if i.OnboardingSteps == nil {
+			i.OnboardingSteps = make(map[string]string)
+		}
+		i.OnboardingSteps[step] = state
+		if err = i.update(); !couchdb.IsConflictError(err) {
+			return err
+		}
+		fresh, errg := getFromCouch(i.Domain)
+		if errg != nil {
+			return errg
+		}
+		i.DocRev = fresh.DocRev
+		i.OnboardingSteps = fresh.OnboardingSteps
+	}
+	return err
+}
+
+// initOnboardingSteps marks the installations of the default apps as pending.
+// It is called before the instance is saved for the first time.
+func (i *Instance) initOnboardingSteps() {
+	defaults := i.DefaultInstalls()
+	if len(defaults) == 0 {
+		return
+	}
+	i.OnboardingSteps = make(map[string]string, len(defaults))
+	for _, app := range defaults {
+		i.OnboardingSteps[app.Step()] = StepPending
+	}
+}
+
+// pushDefaultInstalls pushes a job for the installation of each default app
+// of the context.
+func (i *Instance) pushDefaultInstalls() {
+	for _, app := range i.DefaultInstalls() {
+		msg, err := jobs.NewMessage(app)
+		if err == nil {
+			_, err = jobs.System().PushJob(i, &jobs.JobRequest{
+				WorkerType: "apps-install",
+				Message:    msg,
+			})
+		}
+		if err != nil {
+			i.Logger().Errorf("Failed to push the installation of %s: %s", app.Slug, err)
+			if err = i.SetOnboardingStep(app.Step(), StepErrored); err != nil {
+				i.Logger().Errorf("Failed to save the onboarding step: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/gomail"
+	humanize "github.com/dustin/go-humanize"
+)
+
+const (
+	overridesCacheKey = "contexts-overrides"
+	overridesCacheTTL = 5 * time.Minute
+)
+
+// ErrBadContextOverride is returned when an override of a context has an
+// unknown key or a bad value.
+var ErrBadContextOverride = errors.New("Bad override for the context")
+
+// The keys of a context that can be overridden at runtime, without
+// restarting the stack.
+const (
+	OverrideMail           = "mail"
+	OverrideDiskQuota      = "disk_quota"
+	OverrideRegistries     = "registries"
+	OverridePasswordPolicy = "password_policy"
+)
+
+// GetContextsOverrides returns the overrides of the contexts, indexed by the
+// name of the context. They are saved in the global database, and cached, as
+// they are read for every instance.
+func GetContextsOverrides() (map[string]map[string]interface{}, error) {
+	cache := config.GetConfig().CacheStorage
+	if r, ok := cache.Get(overridesCacheKey); ok {
+		var overrides map[string]map[string]interface{}
+		if err := json.NewDecoder(r).Decode(&overrides); err == nil {
+			return overrides, nil
+		}
+	}
+	doc, err := getOverridesDoc()
+	if err != nil {
+		return nil, err
+	}
+	overrides := make(map[string]map[string]interface{})
+	for name, value := range doc.M {
+		if ctx, ok := value.(map[string]interface{}); ok {
+			overrides[name] = ctx
+		}
+	}
+	if buf, err := json.Marshal(overrides); err == nil {
+		cache.Set(overridesCacheKey, buf, overridesCacheTTL)
+	}
+	return overrides, nil
+}
+
+// SetContextOverrides replaces the overrides of a context. A key with a null
+// value is removed, and the overrides are removed when there is no key left.
+// The instances of the context see the changes on their next request.
+func SetContextOverrides(name string, overrides map[string]interface{}) error {
+	ctx := make(map[string]interface{}, len(overrides))
+	for k, v := range overrides {
+		if v == nil {
+			continue
+		}
+		if err := checkOverride(k, v); err != nil {
+			return err
+		}
+		ctx[k] = v
+	}
+
+	doc, err := getOverridesDoc()
+	if err != nil {
+		return err
+	}
+	rev := doc.Rev()
+	delete(doc.M, "_id")
+	delete(doc.M, "_rev")
+	if len(ctx) > 0 {
+		doc.M[name] = ctx
+	} else {
+		delete(doc.M, name)
+	}
+	doc.SetID(consts.ContextsSettingsID)
+	if rev == "" {
+		err = couchdb.CreateNamedDocWithDB(couchdb.GlobalDB, doc)
+	} else {
+		doc.SetRev(rev)
+		err = couchdb.UpdateDoc(couchdb.GlobalDB, doc)
+	}
+	config.GetConfig().CacheStorage.Clear(overridesCacheKey)
+	return err
+}
+
+func getOverridesDoc() (*couchdb.JSONDoc, error) {
+	doc := &couchdb.JSONDoc{Type: consts.Settings}
+	err := couchdb.GetDoc(couchdb.GlobalDB, consts.Settings, consts.ContextsSettingsID, doc)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		doc.M = make(map[string]interface{})
+		return doc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// checkOverride returns an error if the value can't be used for the given key
+// of a context.
+func checkOverride(key string, value interface{}) error {
+	switch key {
+	case OverrideMail, OverridePasswordPolicy:
+		if _, ok := value.(map[string]interface{}); !ok {
+			return ErrBadContextOverride
+		}
+	case OverrideDiskQuota:
+		switch quota := value.(type) {
+		case float64:
+		case string:
+			if _, err := humanize.ParseBytes(quota); err != nil {
+				return ErrBadContextOverride
+			}
+		default:
+			return ErrBadContextOverride
+		}
+	case OverrideRegistries:
+		if _, err := parseRegistries(value); err != nil {
+			return ErrBadContextOverride
+		}
+	default:
+		return ErrBadContextOverride
+	}
+	return nil
+}
+
+// contextOverrides returns the overrides for the context of the instance.
+func (i *Instance) contextOverrides() map[string]interface{} {
+	overrides, err := GetContextsOverrides()
+	if err != nil {
+		i.Logger().WithField("nspace", "instance").
+			Warnf("Cannot get the overrides of the contexts: %s", err)
+		return nil
+	}
+	name := i.ContextName
+	if name == "" {
+		name = "default"
+	}
+	return overrides[name]
+}
+
+// withOverrides returns the settings of a context from the configuration,
+// with the overrides of this context on top of them. The map from the
+// configuration is not modified, as it is shared by all the instances.
+func withOverrides(settings, overrides map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(settings)+len(overrides))
+	for k, v := range settings {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		if k == OverrideMail {
+			mail := make(map[string]interface{})
+			if base, ok := settings[k].(map[string]interface{}); ok {
+				for mk, mv := range base {
+					mail[mk] = mv
+				}
+			}
+			if m, ok := v.(map[string]interface{}); ok {
+				for mk, mv := range m {
+					mail[mk] = mv
+				}
+			}
+			v = mail
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// parseRegistries returns the URLs of a list of registries from a context.
+func parseRegistries(value interface{}) ([]*url.URL, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, ErrBadContextOverride
+	}
+	regs := make([]*url.URL, len(list))
+	for i, r := range list {
+		s, ok := r.(string)
+		if !ok {
+			return nil, ErrBadContextOverride
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		regs[i] = u
+	}
+	return regs, nil
+}
+
+// MailDialer returns the options for the SMTP relay of the context of the
+// instance, or nil if the context has no relay of its own, and the relay of
+// the configuration must be used.
+func (i *Instance) MailDialer() *gomail.DialerOptions {
+	context, err := i.SettingsContext()
+	if err != nil {
+		return nil
+	}
+	mail, ok := context[OverrideMail].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	host, _ := mail["host"].(string)
+	if host == "" {
+		return nil
+	}
+	opts := &gomail.DialerOptions{Host: host}
+	switch port := mail["port"].(type) {
+	case int:
+		opts.Port = port
+	case float64:
+		opts.Port = int(port)
+	}
+	opts.Username, _ = mail["username"].(string)
+	opts.Password, _ = mail["password"].(string)
+	opts.DisableTLS, _ = mail["disable_tls"].(bool)
+	opts.SkipCertificateValidation, _ = mail["skip_certificate_validation"].(bool)
+	return opts
+}
@@ -0,0 +1,201 @@
+package instance
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/errcode"
+)
+
+var (
+	// ErrPassphraseTooShort is returned when the new passphrase is shorter
+	// than the minimal length of the password policy.
+	ErrPassphraseTooShort = errcode.New(errcode.PasswordTooShort, http.StatusUnprocessableEntity,
+		"The passphrase is too short")
+	// ErrPassphraseTooWeak is returned when the new passphrase has not enough
+	// entropy for the password policy.
+	ErrPassphraseTooWeak = errcode.New(errcode.PasswordTooWeak, http.StatusUnprocessableEntity,
+		"The passphrase is too weak")
+	// ErrPassphraseBanned is returned when the new passphrase is a common
+	// password.
+	ErrPassphraseBanned = errcode.New(errcode.PasswordBanned, http.StatusUnprocessableEntity,
+		"The passphrase is too common")
+	// ErrPassphraseReused is returned when the new passphrase is one of the
+	// previous passphrases of the instance.
+	ErrPassphraseReused = errcode.New(errcode.PasswordReused, http.StatusUnprocessableEntity,
+		"The passphrase has already been used")
+)
+
+// PasswordPolicy is the policy for the passphrases of the instances of a
+// context, from the password_policy of this context. The zero value accepts
+// all the passphrases.
+type PasswordPolicy struct {
+	// MinLength is the minimal number of characters of a passphrase
+	MinLength int `json:"min_length,omitempty"`
+	// MinEntropy is the minimal entropy, in bits, estimated for a passphrase
+	MinEntropy float64 `json:"min_entropy,omitempty"`
+	// BanCommon is true if the most common passwords are refused
+	BanCommon bool `json:"ban_common,omitempty"`
+	// History is the number of the last passphrases that can't be used again,
+	// including the current one
+	History int `json:"history,omitempty"`
+}
+
+// PasswordPolicy returns the policy for the passphrases of the instance.
+func (i *Instance) PasswordPolicy() *PasswordPolicy {
+	policy := &PasswordPolicy{}
+	context, err := i.SettingsContext()
+	if err != nil {
+		return policy
+	}
+	m, ok := context[OverridePasswordPolicy].(map[string]interface{})
+	if !ok {
+		return policy
+	}
+	policy.MinLength = int(toFloat(m["min_length"]))
+	policy.MinEntropy = toFloat(m["min_entropy"])
+	policy.BanCommon, _ = m["ban_common"].(bool)
+	policy.History = int(toFloat(m["history"]))
+	return policy
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// CheckPassphrasePolicy returns an error if the new passphrase doesn't comply
+// with the password policy of the instance.
+func (i *Instance) CheckPassphrasePolicy(pass []byte) error {
+	policy := i.PasswordPolicy()
+	if utf8.RuneCount(pass) < policy.MinLength {
+		return ErrPassphraseTooShort
+	}
+	if policy.BanCommon && isCommonPassword(string(pass)) {
+		return ErrPassphraseBanned
+	}
+	if PassphraseEntropy(string(pass)) < policy.MinEntropy {
+		return ErrPassphraseTooWeak
+	}
+	if policy.History > 0 {
+		hashes := append([][]byte{i.PassphraseHash}, i.PassphraseHistory...)
+		if len(hashes) > policy.History {
+			hashes = hashes[:policy.History]
+		}
+		for _, hash := range hashes {
+			if len(hash) == 0 {
+				continue
+			}
+			if _, err := crypto.CompareHashAndPassphrase(hash, pass); err == nil {
+				return ErrPassphraseReused
+			}
+		}
+	}
+	return nil
+}
+
+// keepInHistory adds the current hash of the passphrase to the history,
+// before it is replaced, and removes the hashes that are no longer needed by
+// the password policy.
+func (i *Instance) keepInHistory() {
+	keep := i.PasswordPolicy().History - 1
+	if keep <= 0 || len(i.PassphraseHash) == 0 {
+		i.PassphraseHistory = nil
+		return
+	}
+	history := append([][]byte{i.PassphraseHash}, i.PassphraseHistory...)
+	if len(history) > keep {
+		history = history[:keep]
+	}
+	i.PassphraseHistory = history
+}
+
+// PassphraseEntropy returns an estimation of the entropy, in bits, of a
+// passphrase: the number of characters multiplied by the logarithm of the
+// size of the alphabet made of the classes of characters in it. The
+// characters repeated consecutively are only counted once.
+func PassphraseEntropy(pass string) float64 {
+	var lower, upper, digit, symbol, other bool
+	count := 0
+	var previous rune
+	for idx, r := range pass {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+		if idx == 0 || r != previous {
+			count++
+		}
+		previous = r
+	}
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+	if size == 0 {
+		return 0
+	}
+	return float64(count) * math.Log2(float64(size))
+}
+
+func isCommonPassword(pass string) bool {
+	pass = strings.ToLower(pass)
+	for _, common := range commonPasswords {
+		if pass == common {
+			return true
+		}
+	}
+	return false
+}
+
+// commonPasswords is a list of the most used passwords, found in the leaks.
+var commonPasswords = []string{
+	"123456", "password", "12345678", "qwerty", "123456789", "12345",
+	"1234", "111111", "1234567", "dragon", "123123", "baseball", "abc123",
+	"football", "monkey", "letmein", "696969", "shadow", "master", "666666",
+	"qwertyuiop", "123321", "mustang", "1234567890", "michael", "654321",
+	"superman", "1qaz2wsx", "7777777", "121212", "000000", "qazwsx",
+	"123qwe", "killer", "trustno1", "jordan", "jennifer", "zxcvbnm",
+	"asdfgh", "hunter", "buster", "soccer", "harley", "batman", "andrew",
+	"tigger", "sunshine", "iloveyou", "2000", "charlie", "robert", "thomas",
+	"hockey", "ranger", "daniel", "starwars", "klaster", "112233", "george",
+	"computer", "michelle", "jessica", "pepper", "1111", "zxcvbn", "555555",
+	"11111111", "131313", "freedom", "777777", "pass", "maggie", "159753",
+	"aaaaaa", "ginger", "princess", "joshua", "cheese", "amanda", "summer",
+	"love", "ashley", "nicole", "chelsea", "biteme", "matthew", "access",
+	"yankees", "987654321", "dallas", "austin", "thunder", "taylor",
+	"matrix", "azerty", "password1", "password123", "welcome", "admin",
+	"motdepasse", "soleil", "doudou", "loulou", "chouchou", "cozycloud",
+	"cozy",
+}
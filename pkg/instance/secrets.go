@@ -0,0 +1,177 @@
+package instance
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const secretsKeyInfo = "io.cozy.instances secrets"
+
+const secretsNonceLen = 24
+
+var (
+	// ErrNoSecretsMasterKey is returned when the secrets of an instance are
+	// encrypted, but no instance secrets master key has been configured.
+	ErrNoSecretsMasterKey = errors.New("The instance secrets master key is missing")
+	// ErrCannotOpenSecrets is returned when the secrets of an instance can't be
+	// decrypted with the current and previous instance secrets master keys.
+	ErrCannotOpenSecrets = errors.New("The secrets of the instance can't be decrypted")
+)
+
+// instanceSecrets are the fields of an instance that are encrypted with the
+// instance secrets master key, when it is configured.
+type instanceSecrets struct {
+	SessionSecret []byte   `json:"session_secret,omitempty"`
+	OAuthSecret   []byte   `json:"oauth_secret,omitempty"`
+	CLISecret     []byte   `json:"cli_secret,omitempty"`
+	SigningSeed   []byte   `json:"signing_seed,omitempty"`
+	JWTKeys       []JWTKey `json:"jwt_keys,omitempty"`
+}
+
+// instanceAlias has the fields of an instance, but not its methods, to avoid
+// a recursion in MarshalJSON and UnmarshalJSON.
+type instanceAlias Instance
+
+// MarshalJSON is used to encrypt the secrets of the instance in its document,
+// with the instance secrets master key of the vault. They are kept in clear
+// if there is no such key.
+func (i *Instance) MarshalJSON() ([]byte, error) {
+	master, _ := secretsMasterKeys()
+	if len(master) == 0 {
+		return json.Marshal((*instanceAlias)(i))
+	}
+	sealed, err := sealSecrets(master, &instanceSecrets{
+		SessionSecret: i.SessionSecret,
+		OAuthSecret:   i.OAuthSecret,
+		CLISecret:     i.CLISecret,
+		SigningSeed:   i.SigningSeed,
+		JWTKeys:       i.JWTKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The fields of the outer struct hide the fields with the same name of the
+	// embedded instance.
+	return json.Marshal(struct {
+		*instanceAlias
+		SessionSecret    []byte   `json:"session_secret,omitempty"`
+		OAuthSecret      []byte   `json:"oauth_secret,omitempty"`
+		CLISecret        []byte   `json:"cli_secret,omitempty"`
+		SigningSeed      []byte   `json:"signing_seed,omitempty"`
+		JWTKeys          []JWTKey `json:"jwt_keys,omitempty"`
+		SecretsEncrypted []byte   `json:"secrets_encrypted"`
+	}{
+		instanceAlias:    (*instanceAlias)(i),
+		SecretsEncrypted: sealed,
+	})
+}
+
+// UnmarshalJSON is used to decrypt the secrets of the instance, with the
+// current or the previous instance secrets master key.
+func (i *Instance) UnmarshalJSON(data []byte) error {
+	doc := struct {
+		*instanceAlias
+		SecretsEncrypted []byte `json:"secrets_encrypted,omitempty"`
+	}{
+		instanceAlias: (*instanceAlias)(i),
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.SecretsEncrypted) == 0 {
+		return nil
+	}
+	secrets, err := openSecrets(doc.SecretsEncrypted)
+	if err != nil {
+		return err
+	}
+	i.SessionSecret = secrets.SessionSecret
+	i.OAuthSecret = secrets.OAuthSecret
+	i.CLISecret = secrets.CLISecret
+	i.SigningSeed = secrets.SigningSeed
+	i.JWTKeys = secrets.JWTKeys
+	return nil
+}
+
+// ReencryptSecrets saves the instance, so that its secrets are encrypted with
+// the current instance secrets master key. It is used after a rotation of the
+// master key (the previous master key can be removed from the keyring when
+// it has been done for all the instances), or to encrypt the secrets of an
+// instance created before the encryption has been enabled.
+func (i *Instance) ReencryptSecrets() error {
+	if master, _ := secretsMasterKeys(); len(master) == 0 {
+		return ErrNoSecretsMasterKey
+	}
+	return i.update()
+}
+
+func secretsMasterKeys() (current, previous []byte) {
+	vault := config.GetVault()
+	if vault == nil {
+		return nil, nil
+	}
+	return vault.InstanceSecretsMasterKey(), vault.InstanceSecretsPreviousMasterKey()
+}
+
+func secretsKey(master []byte) (*[32]byte, error) {
+	h := hkdf.New(sha256.New, master, nil, []byte(secretsKeyInfo))
+	var key [32]byte
+	if _, err := io.ReadFull(h, key[:]); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func sealSecrets(master []byte, secrets *instanceSecrets) ([]byte, error) {
+	key, err := secretsKey(master)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [secretsNonceLen]byte
+	if _, err = io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], plain, &nonce, key), nil
+}
+
+func openSecrets(sealed []byte) (*instanceSecrets, error) {
+	current, previous := secretsMasterKeys()
+	if len(current) == 0 && len(previous) == 0 {
+		return nil, ErrNoSecretsMasterKey
+	}
+	if len(sealed) < secretsNonceLen {
+		return nil, ErrCannotOpenSecrets
+	}
+	var nonce [secretsNonceLen]byte
+	copy(nonce[:], sealed[:secretsNonceLen])
+	for _, master := range [][]byte{current, previous} {
+		if len(master) == 0 {
+			continue
+		}
+		key, err := secretsKey(master)
+		if err != nil {
+			return nil, err
+		}
+		plain, ok := secretbox.Open(nil, sealed[secretsNonceLen:], &nonce, key)
+		if !ok {
+			continue
+		}
+		var secrets instanceSecrets
+		if err = json.Unmarshal(plain, &secrets); err != nil {
+			return nil, err
+		}
+		return &secrets, nil
+	}
+	return nil, ErrCannotOpenSecrets
+}
@@ -7,8 +7,8 @@ import (
 
 // Triggers returns the list of the triggers to add when an instance is created
 func Triggers(db prefixer.Prefixer) []jobs.TriggerInfos {
-	// Create/update/remove thumbnails when an image is created/updated/removed
 	return []jobs.TriggerInfos{
+		// Create/update/remove thumbnails when an image is created/updated/removed
 		{
 			Domain:     db.DomainName(),
 			Prefix:     db.DBPrefix(),
@@ -16,5 +16,56 @@ func Triggers(db prefixer.Prefixer) []jobs.TriggerInfos {
 			WorkerType: "thumbnail",
 			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image:class",
 		},
+		// Transcode the videos for streaming (only if ffmpeg is configured)
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@event",
+			WorkerType: "video",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:video:class",
+		},
+		// Group the new photos in moments, that are suggested as albums
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@event",
+			WorkerType: "clustering",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image:class",
+			Debounce:   "5m",
+		},
+		// Extract the text of the images and PDFs (only if tesseract is
+		// configured and the ocr feature flag is enabled)
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@event",
+			WorkerType: "ocr",
+			Arguments:  "io.cozy.files:CREATED,UPDATED:image,pdf:class",
+		},
+		// Qualify the administrative documents, like invoices and payslips
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@event",
+			WorkerType: "classification",
+			Arguments:  "io.cozy.files:CREATED,UPDATED:image,pdf:class",
+		},
+		// Recompute the aggregates of the directories, to fix their drift
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@weekly",
+			WorkerType: "dir-sizes",
+			Arguments:  "0-5",
+		},
+		// Send the digest mails of the notifications and of the activity, if
+		// the user has asked for them
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@daily",
+			WorkerType: "digest",
+			Arguments:  "6-8",
+		},
 	}
 }
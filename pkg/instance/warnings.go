@@ -1,6 +1,7 @@
 package instance
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
@@ -9,8 +10,23 @@ import (
 	"github.com/cozy/cozy-stack/web/jsonapi"
 )
 
+// ErrBlocked is used when the instance is blocked, for the pages rendered in
+// HTML.
+var ErrBlocked = errors.New("The Cozy is blocked")
+
 // Warnings returns a list of possible warnings associated with the instance.
 func (i *Instance) Warnings() (warnings []*jsonapi.Error) {
+	if i.Blocked {
+		warnings = append(warnings, i.BlockedWarning())
+	}
+	if i.DeleteAt != nil {
+		warnings = append(warnings, &jsonapi.Error{
+			Status: http.StatusPaymentRequired,
+			Title:  "Deletion Scheduled",
+			Code:   "deletion-scheduled",
+			Detail: i.Translate("The deletion of your Cozy is scheduled on %s", i.DeleteAt.Format("2006-01-02")),
+		})
+	}
 	notSigned, deadline := i.CheckTOSNotSignedAndDeadline()
 	if notSigned && deadline >= TOSWarning {
 		tosLink, _ := i.ManagerURL(ManagerTOSURL)
@@ -25,6 +41,29 @@ func (i *Instance) Warnings() (warnings []*jsonapi.Error) {
 	return
 }
 
+// BlockedWarning returns the warning for a blocked instance, with the reason
+// as its code.
+func (i *Instance) BlockedWarning() *jsonapi.Error {
+	code := i.BlockingReason
+	if code == "" {
+		code = "blocked"
+	}
+	return &jsonapi.Error{
+		Status: http.StatusPaymentRequired,
+		Title:  "Instance Blocked",
+		Code:   code,
+		Detail: i.Translate("Instance Blocked " + code),
+	}
+}
+
+func validBlockingReason(reason string) bool {
+	switch reason {
+	case BlockingPaymentOverdue, BlockingAbuse, BlockingUserRequest:
+		return true
+	}
+	return false
+}
+
 // TOSDeadline represent the state for reaching the TOS deadline.
 type TOSDeadline int
 
@@ -41,7 +80,7 @@ const (
 // CheckInstanceBlocked returns whether or not the instance is currently in a
 // blocked state: meaning it should be accessible.
 func (i *Instance) CheckInstanceBlocked() bool {
-	if i.Blocked {
+	if i.Blocked || i.DeleteAt != nil {
 		return true
 	}
 	if len(i.RegisterToken) > 0 {
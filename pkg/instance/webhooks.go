@@ -0,0 +1,73 @@
+package instance
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// The events of the lifecycle of the instances, sent to the webhook of the
+// hosting, so that the billing or CRM systems can react. The quota_exceeded
+// event is sent when the disk usage goes over the alert threshold, ie 90% of
+// the quota.
+const (
+	EventCreated       = "instance.created"
+	EventOnboarded     = "instance.onboarded"
+	EventQuotaExceeded = "instance.quota_exceeded"
+	EventDeleted       = "instance.deleted"
+	EventBlocked       = "instance.blocked"
+)
+
+func init() {
+	vfs.RegisterDiskQuotaAlertCallback(func(domain string, exceeded bool) {
+		if !exceeded {
+			return
+		}
+		if i, err := Get(domain); err == nil {
+			i.SendLifecycleWebhook(EventQuotaExceeded, nil)
+		}
+	})
+}
+
+// SendLifecycleWebhook pushes a job to post an event of the lifecycle of the
+// instance to the webhook of the hosting, if one has been configured. The job
+// is pushed on the global database, as the databases of the instance can have
+// been deleted when it is executed, and the deliveries are logged there. The
+// secret is not put in the message, the worker reads it from the
+// configuration. An error is only logged, as it must not prevent the action
+// from being made.
+func (i *Instance) SendLifecycleWebhook(event string, details map[string]interface{}) {
+	hosting := config.GetConfig().Hosting
+	if hosting.WebhookURL == "" {
+		return
+	}
+	payload := map[string]interface{}{
+		"event":      event,
+		"domain":     i.Domain,
+		"uuid":       i.UUID,
+		"context":    i.ContextName,
+		"created_at": time.Now().UTC(),
+	}
+	if details != nil {
+		payload["details"] = details
+	}
+	msg, err := jobs.NewMessage(map[string]interface{}{
+		"url":     hosting.WebhookURL,
+		"payload": payload,
+		"domain":  i.Domain,
+		"event":   event,
+	})
+	if err == nil {
+		_, err = jobs.System().PushJob(prefixer.GlobalPrefixer, &jobs.JobRequest{
+			WorkerType: "webhook",
+			Message:    msg,
+		})
+	}
+	if err != nil {
+		i.Logger().WithField("nspace", "lifecycle").
+			Errorf("Could not send the %s webhook: %s", event, err)
+	}
+}
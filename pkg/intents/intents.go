@@ -1,12 +1,29 @@
 package intents
 
 import (
+	"errors"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+)
+
+// PermissionsTTL is the validity duration of the permissions granted by a
+// service to the client of an intent.
+const PermissionsTTL = 24 * time.Hour
+
+var (
+	// ErrNotAService is used when an app that is not a service of the intent
+	// tries to act on it
+	ErrNotAService = errors.New("This app is not a service of the intent")
+	// ErrNoPermissions is used when a service tries to grant permissions for
+	// an intent that has not requested them
+	ErrNoPermissions = errors.New("No permissions have been requested by the intent")
 )
 
 // Service is a struct for an app that can serve an intent
@@ -83,6 +100,9 @@ func (in *Intent) FillServices(instance *instance.Instance) error {
 		return err
 	}
 	for _, man := range res {
+		if !in.canBeServedBy(&man) {
+			continue
+		}
 		if intent := man.FindIntent(in.Action, in.Type); intent != nil {
 			href := in.GenerateHref(instance, man.Slug(), intent.Href)
 			service := Service{Slug: man.Slug(), Href: href}
@@ -92,4 +112,77 @@ func (in *Intent) FillServices(instance *instance.Instance) error {
 	return nil
 }
 
+// requestedVerbs returns the verbs of the permissions requested by the client
+func (in *Intent) requestedVerbs() permissions.VerbSet {
+	return permissions.VerbSplit(strings.Join(in.Permissions, ","))
+}
+
+// isDoctype returns true if the type of the intent is a doctype, and not a
+// mime-type
+func (in *Intent) isDoctype() bool {
+	return !strings.Contains(in.Type, "/")
+}
+
+// canBeServedBy returns false if the intent requests permissions on a doctype
+// that the app itself does not have, as the app could not grant them to the
+// client.
+func (in *Intent) canBeServedBy(man *apps.WebappManifest) bool {
+	if len(in.Permissions) == 0 || !in.isDoctype() {
+		return true
+	}
+	verbs := in.requestedVerbs()
+	return man.Permissions().Some(func(r permissions.Rule) bool {
+		return r.Type == in.Type && len(r.Values) == 0 && r.Verbs.ContainsAll(verbs)
+	})
+}
+
+// IsService returns true if the app with the given slug is one of the services
+// of the intent.
+func (in *Intent) IsService(slug string) bool {
+	for _, service := range in.Services {
+		if service.Slug == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// GrantPermissions creates a temporary permission for the client of the
+// intent, on the given documents, with the verbs requested by the intent. The
+// parent is the permission of the service, and the granted permission must be
+// a subset of it. The client can use the code of the returned permission as a
+// token to access the documents.
+func (in *Intent) GrantPermissions(inst *instance.Instance, parent *permissions.Permission, ids []string) (*permissions.Permission, error) {
+	if len(in.Permissions) == 0 || !in.isDoctype() {
+		return nil, ErrNoPermissions
+	}
+	parts := strings.SplitN(parent.SourceID, "/", 2)
+	if len(parts) != 2 || !in.IsService(parts[1]) {
+		return nil, ErrNotAService
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("No documents are given")
+	}
+
+	clientParts := strings.SplitN(in.Client, "/", 2)
+	name := clientParts[len(clientParts)-1]
+	code, err := inst.CreateShareCode(name)
+	if err != nil {
+		return nil, err
+	}
+	codes := map[string]string{name: code}
+	shortcodes := map[string]string{name: crypto.GenerateRandomString(consts.ShortCodeLen)}
+
+	set := permissions.Set{
+		permissions.Rule{
+			Type:        in.Type,
+			Description: "documents given by the intent " + in.ID(),
+			Verbs:       in.requestedVerbs(),
+			Values:      ids,
+		},
+	}
+	expiresAt := time.Now().Add(PermissionsTTL)
+	return permissions.CreateShareSet(inst, parent, codes, shortcodes, set, &expiresAt)
+}
+
 var _ couchdb.Doc = (*Intent)(nil)
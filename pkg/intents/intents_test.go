@@ -10,6 +10,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -106,6 +107,72 @@ func TestFillServices(t *testing.T) {
 
 }
 
+func TestFillServicesWithPermissions(t *testing.T) {
+	contacts := &apps.WebappManifest{
+		DocSlug: "contacts",
+		DocPermissions: permissions.Set{
+			permissions.Rule{
+				Type:  consts.Contacts,
+				Verbs: permissions.Verbs(permissions.GET),
+			},
+		},
+		Intents: []apps.Intent{
+			{
+				Action: "PICK",
+				Types:  []string{consts.Contacts},
+				Href:   "/pick",
+			},
+		},
+	}
+	err := couchdb.CreateNamedDoc(ins, contacts)
+	assert.NoError(t, err)
+	agenda := &apps.WebappManifest{
+		DocSlug:        "agenda",
+		DocPermissions: permissions.Set{},
+		Intents: []apps.Intent{
+			{
+				Action: "PICK",
+				Types:  []string{consts.Contacts},
+				Href:   "/contacts",
+			},
+		},
+	}
+	err = couchdb.CreateNamedDoc(ins, agenda)
+	assert.NoError(t, err)
+
+	intent := &Intent{
+		IID:         "1f3d7a4e-8e7d-11e9-8a2b-6b4f8b0c6f0f",
+		Action:      "PICK",
+		Type:        consts.Contacts,
+		Permissions: []string{"GET"},
+	}
+	err = intent.FillServices(ins)
+	assert.NoError(t, err)
+	assert.Len(t, intent.Services, 1)
+	assert.Equal(t, "contacts", intent.Services[0].Slug)
+	assert.True(t, intent.IsService("contacts"))
+	assert.False(t, intent.IsService("agenda"))
+
+	intent = &Intent{
+		IID:         "1f3d7a4e-8e7d-11e9-8a2b-6b4f8b0c6f0f",
+		Action:      "PICK",
+		Type:        consts.Contacts,
+		Permissions: []string{"GET", "PUT"},
+	}
+	err = intent.FillServices(ins)
+	assert.NoError(t, err)
+	assert.Len(t, intent.Services, 0)
+
+	intent = &Intent{
+		IID:    "1f3d7a4e-8e7d-11e9-8a2b-6b4f8b0c6f0f",
+		Action: "PICK",
+		Type:   consts.Contacts,
+	}
+	err = intent.FillServices(ins)
+	assert.NoError(t, err)
+	assert.Len(t, intent.Services, 2)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -12,6 +12,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	"github.com/sirupsen/logrus"
 )
 
@@ -59,6 +60,10 @@ type (
 	// Event is a json encoded value of a realtime.Event
 	Event json.RawMessage
 
+	// Payload is the raw body of the request that has fired a @webhook
+	// trigger
+	Payload json.RawMessage
+
 	// Job contains all the metadata informations of a Job. It can be
 	// marshalled in JSON.
 	Job struct {
@@ -70,6 +75,7 @@ type (
 		TriggerID   string      `json:"trigger_id,omitempty"`
 		Message     Message     `json:"message"`
 		Event       Event       `json:"event"`
+		Payload     Payload     `json:"payload,omitempty"`
 		Manual      bool        `json:"manual_execution,omitempty"`
 		Debounced   bool        `json:"debounced,omitempty"`
 		Options     *JobOptions `json:"options,omitempty"`
@@ -79,6 +85,9 @@ type (
 		FinishedAt  time.Time   `json:"finished_at"`
 		Error       string      `json:"error,omitempty"`
 		ForwardLogs bool        `json:"forward_logs,omitempty"`
+		// Trace is the trace context of the request that has pushed the job,
+		// if any
+		Trace map[string]string `json:"trace,omitempty"`
 	}
 
 	// JobRequest struct is used to represent a new job request.
@@ -88,6 +97,7 @@ type (
 		Trigger     Trigger
 		Message     Message
 		Event       Event
+		Payload     Payload
 		Manual      bool
 		Debounced   bool
 		ForwardLogs bool
@@ -141,6 +151,11 @@ func (j *Job) Clone() couchdb.Doc {
 		j.Event = make([]byte, len(tmp))
 		copy(j.Event[:], tmp)
 	}
+	if j.Payload != nil {
+		tmp := j.Payload
+		cloned.Payload = make([]byte, len(tmp))
+		copy(cloned.Payload[:], tmp)
+	}
 	return &cloned
 }
 
@@ -261,10 +276,12 @@ func NewJob(db prefixer.Prefixer, req *JobRequest) *Job {
 		Message:     req.Message,
 		Debounced:   req.Debounced,
 		Event:       req.Event,
+		Payload:     req.Payload,
 		Options:     req.Options,
 		ForwardLogs: req.ForwardLogs,
 		State:       Queued,
 		QueuedAt:    time.Now(),
+		Trace:       tracing.Carrier(tracing.ContextOf(db)),
 	}
 }
 
@@ -344,6 +361,18 @@ func (e Event) Unmarshal(evt interface{}) error {
 	return nil
 }
 
+// Unmarshal can be used to unmarshal the encoded payload value in the
+// specified interface's type.
+func (p Payload) Unmarshal(v interface{}) error {
+	if p == nil {
+		return ErrMessageNil
+	}
+	if err := json.Unmarshal(p, &v); err != nil {
+		return ErrMessageUnmarshal
+	}
+	return nil
+}
+
 var (
 	_ permissions.Matcher = (*JobRequest)(nil)
 	_ permissions.Matcher = (*Job)(nil)
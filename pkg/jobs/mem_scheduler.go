@@ -148,6 +148,9 @@ func (s *memScheduler) DeleteTrigger(db prefixer.Prefixer, id string) error {
 	}
 	delete(s.ts, db.DBPrefix()+"/"+id)
 	t.Unschedule()
+	if err := deleteWebhookSecret(t); err != nil {
+		return err
+	}
 	return couchdb.DeleteDoc(db, t.Infos())
 }
 
@@ -202,6 +205,10 @@ func (s *memScheduler) schedule(t Trigger) {
 
 func (s *memScheduler) pushJob(t Trigger, req *JobRequest) {
 	log := s.log.WithField("domain", t.DomainName())
+	if isPaused(t) {
+		log.Infof("trigger %s(%s): Paused", t.Type(), t.Infos().TID)
+		return
+	}
 	log.Infof("trigger %s(%s): Pushing new job %s",
 		t.Type(), t.Infos().TID, req.WorkerType)
 	if _, err := s.broker.PushJob(t, req); err != nil {
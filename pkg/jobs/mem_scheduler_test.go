@@ -34,6 +34,54 @@ func TestTriggersBadArguments(t *testing.T) {
 	}
 }
 
+func TestPeriodicTrigger(t *testing.T) {
+	infos := &TriggerInfos{
+		Type:       "@daily",
+		Domain:     "cozy.example.net",
+		WorkerType: "konnector",
+		Arguments:  "2-5",
+		Message:    Message(`{"konnector":"foo"}`),
+	}
+	trigger, err := NewPeriodicTrigger(infos)
+	assert.NoError(t, err)
+	from := time.Date(2018, 6, 1, 0, 0, 0, 0, time.Local)
+	next := trigger.NextExecution(from)
+	assert.True(t, next.Hour() >= 2 && next.Hour() < 5)
+	assert.Equal(t, next.Add(24*time.Hour), trigger.NextExecution(next))
+
+	// The time is stable for a trigger, but not for another one
+	other, err := NewPeriodicTrigger(infos)
+	assert.NoError(t, err)
+	assert.Equal(t, next, other.NextExecution(from))
+	infos.Message = Message(`{"konnector":"bar"}`)
+	other, err = NewPeriodicTrigger(infos)
+	assert.NoError(t, err)
+	assert.NotEqual(t, next, other.NextExecution(from))
+
+	infos.Type = "@weekly"
+	trigger, err = NewPeriodicTrigger(infos)
+	assert.NoError(t, err)
+	next = trigger.NextExecution(from)
+	assert.Equal(t, next.Add(7*24*time.Hour), trigger.NextExecution(next))
+
+	infos.Type = "@hourly"
+	_, err = NewPeriodicTrigger(infos)
+	assert.Error(t, err)
+	infos.Arguments = ""
+	trigger, err = NewPeriodicTrigger(infos)
+	assert.NoError(t, err)
+	next = trigger.NextExecution(from)
+	assert.Equal(t, next.Add(time.Hour), trigger.NextExecution(next))
+
+	infos.Type = "@daily"
+	infos.Arguments = "5-2"
+	_, err = NewPeriodicTrigger(infos)
+	assert.Error(t, err)
+	infos.Arguments = "0-25"
+	_, err = NewPeriodicTrigger(infos)
+	assert.Error(t, err)
+}
+
 func TestMemSchedulerWithDebounce(t *testing.T) {
 	called := 0
 	bro := NewMemBroker()
@@ -113,3 +161,67 @@ func TestMemSchedulerWithDebounce(t *testing.T) {
 	err = sch.ShutdownScheduler(context.Background())
 	assert.NoError(t, err)
 }
+
+func TestMemSchedulerPaused(t *testing.T) {
+	called := 0
+	bro := NewMemBroker()
+	bro.StartWorkers(WorkersList{
+		{
+			WorkerType:   "worker",
+			Concurrency:  1,
+			MaxExecCount: 1,
+			Timeout:      1 * time.Millisecond,
+			WorkerFunc: func(ctx *WorkerContext) error {
+				called++
+				return nil
+			},
+		},
+	})
+
+	paused := true
+	RegisterTriggersPausedCallback(func(t Trigger) bool {
+		return paused && t.DomainName() == "cozy.local.paused"
+	})
+	defer RegisterTriggersPausedCallback(nil)
+
+	msg, _ := NewMessage("@event")
+	sch := newMemScheduler()
+	sch.StartScheduler(bro)
+
+	db := prefixer.NewPrefixer("cozy.local.paused", "cozy.local.paused")
+	trigger, err := NewTrigger(db, TriggerInfos{
+		Type:       "@event",
+		Arguments:  "io.cozy.testpaused",
+		WorkerType: "worker",
+		Message:    msg,
+	}, msg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = sch.AddTrigger(trigger)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	doc := couchdb.JSONDoc{
+		Type: "io.cozy.testpaused",
+		M: map[string]interface{}{
+			"_id":  "test-id",
+			"_rev": "1-xxabxx",
+		},
+	}
+
+	realtime.GetHub().Publish(db, realtime.EventCreate, &doc, nil)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 0, called)
+
+	paused = false
+	realtime.GetHub().Publish(db, realtime.EventCreate, &doc, nil)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 1, called)
+
+	err = sch.DeleteTrigger(db, trigger.ID())
+	assert.NoError(t, err)
+	err = sch.ShutdownScheduler(context.Background())
+	assert.NoError(t, err)
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -56,6 +57,7 @@ return t`
 type redisScheduler struct {
 	broker  Broker
 	client  redis.UniversalClient
+	leader  lock.Leader
 	closed  chan struct{}
 	stopped chan struct{}
 	log     *logrus.Entry
@@ -84,6 +86,7 @@ func eventsKey(db prefixer.Prefixer) string {
 func (s *redisScheduler) StartScheduler(b Broker) error {
 	s.broker = b
 	s.closed = make(chan struct{})
+	s.leader = lock.Elect("scheduler")
 	s.startEventDispatcher()
 	go s.pollLoop()
 	return nil
@@ -98,6 +101,11 @@ func (s *redisScheduler) pollLoop() {
 			s.stopped <- struct{}{}
 			return
 		case <-ticker.C:
+			// The lua script is atomic, but polling redis from only one
+			// process avoids hammering it when the stack has many replicas.
+			if !s.leader.IsLeader() {
+				continue
+			}
 			now := time.Now().UTC().Unix()
 			if err := s.PollScheduler(now); err != nil {
 				s.log.Warnf("Failed to poll redis: %s", err)
@@ -182,6 +190,9 @@ func (s *redisScheduler) eventLoop(eventsCh <-chan *realtime.Event) {
 					event.Domain, triggerID, err.Error())
 				continue
 			}
+			if isPaused(t) {
+				continue
+			}
 			_, err = s.broker.PushJob(t, jobRequest)
 			if err != nil {
 				s.log.Warnf("Could not push job trigger by event %s %s: %s",
@@ -204,6 +215,10 @@ func (s *redisScheduler) ShutdownScheduler(ctx context.Context) error {
 		fmt.Println("failed: ", ctx.Err())
 		return ctx.Err()
 	case <-s.stopped:
+		if err := s.leader.Shutdown(ctx); err != nil {
+			fmt.Println("failed: ", err)
+			return err
+		}
 		fmt.Println("ok.")
 	}
 	return nil
@@ -245,21 +260,27 @@ func (s *redisScheduler) PollScheduler(now int64) error {
 			if err = s.client.ZRem(SchedKey, results[0]).Err(); err != nil {
 				return err
 			}
-			if _, err = s.broker.PushJob(t, job); err != nil {
-				return err
+			if !isPaused(t) {
+				if _, err = s.broker.PushJob(t, job); err != nil {
+					return err
+				}
 			}
 		case *AtTrigger:
 			job := t.Infos().JobRequest()
-			if _, err = s.broker.PushJob(t, job); err != nil {
-				return err
+			if !isPaused(t) {
+				if _, err = s.broker.PushJob(t, job); err != nil {
+					return err
+				}
 			}
 			if err = s.deleteTrigger(t); err != nil {
 				return err
 			}
 		case *CronTrigger:
 			job := t.Infos().JobRequest()
-			if _, err = s.broker.PushJob(t, job); err != nil {
-				return err
+			if !isPaused(t) {
+				if _, err = s.broker.PushJob(t, job); err != nil {
+					return err
+				}
 			}
 			score, err := strconv.ParseInt(results[1].(string), 10, 64)
 			var prev time.Time
@@ -293,6 +314,9 @@ func (s *redisScheduler) addToRedis(t Trigger, prev time.Time) error {
 	case *EventTrigger:
 		hKey := eventsKey(t)
 		return s.client.HSet(hKey, t.ID(), t.Infos().Arguments).Err()
+	case *WebhookTrigger:
+		// The jobs are pushed when the webhook is called
+		return nil
 	case *AtTrigger:
 		timestamp = t.at
 	case *CronTrigger:
@@ -337,6 +361,9 @@ func (s *redisScheduler) DeleteTrigger(db prefixer.Prefixer, id string) error {
 }
 
 func (s *redisScheduler) deleteTrigger(t Trigger) error {
+	if err := deleteWebhookSecret(t); err != nil {
+		return err
+	}
 	if err := couchdb.DeleteDoc(t, t.Infos()); err != nil {
 		return err
 	}
@@ -53,6 +53,7 @@ type (
 		Debounce     string        `json:"debounce"`
 		Options      *JobOptions   `json:"options"`
 		Message      Message       `json:"message"`
+		Secret       string        `json:"secret,omitempty"`
 		CurrentState *TriggerState `json:"current_state,omitempty"`
 	}
 
@@ -69,6 +70,9 @@ type (
 		LastError           string     `json:"last_error,omitempty"`
 		LastManualExecution *time.Time `json:"last_manual_execution,omitempty"`
 		LastManualJobID     string     `json:"last_manual_job_id,omitempty"`
+		ConsecutiveFailures int        `json:"consecutive_failures,omitempty"`
+		PausedUntil         *time.Time `json:"paused_until,omitempty"`
+		NextExecution       *time.Time `json:"next_execution,omitempty"`
 	}
 )
 
@@ -112,8 +116,12 @@ func fromTriggerInfos(infos *TriggerInfos) (Trigger, error) {
 		return NewCronTrigger(infos)
 	case "@every":
 		return NewEveryTrigger(infos)
+	case "@hourly", "@daily", "@weekly":
+		return NewPeriodicTrigger(infos)
 	case "@event":
 		return NewEventTrigger(infos)
+	case "@webhook":
+		return NewWebhookTrigger(infos)
 	default:
 		return nil, ErrUnknownTrigger
 	}
@@ -230,9 +238,11 @@ func GetTriggerState(db prefixer.Prefixer, triggerID string) (*TriggerState, err
 			state.LastFailure = startedAt
 			state.LastFailedJobID = j.ID()
 			state.LastError = j.Error
+			state.ConsecutiveFailures++
 		case Done:
 			state.LastSuccess = startedAt
 			state.LastSuccessfulJobID = j.ID()
+			state.ConsecutiveFailures = 0
 		default:
 			// skip any job that is not done or errored
 			continue
@@ -249,4 +259,53 @@ func GetTriggerState(db prefixer.Prefixer, triggerID string) (*TriggerState, err
 	return &state, nil
 }
 
+// PlanNextExecution fills the state of a trigger with its next planned
+// execution: the time until which its jobs are skipped after consecutive
+// failures (see RegisterTriggerBackoffCallback), and the time of the next job
+// for the @at, @in, @cron, @every, @hourly, @daily and @weekly triggers.
+func PlanNextExecution(t Trigger, state *TriggerState) {
+	from := time.Now()
+	if cbTriggerBackoff != nil {
+		if until := cbTriggerBackoff(t, state); until.After(from) {
+			state.PausedUntil = &until
+			from = until
+		}
+	}
+	switch t := t.(type) {
+	case *CronTrigger:
+		next := t.NextExecution(from)
+		state.NextExecution = &next
+	case *AtTrigger:
+		if t.at.After(from) {
+			next := t.at
+			state.NextExecution = &next
+		}
+	}
+}
+
+var cbTriggerBackoff func(t Trigger, state *TriggerState) time.Time
+
+// RegisterTriggerBackoffCallback allows to register a callback function that
+// returns the time until which the jobs of a trigger are skipped, given its
+// state, like after consecutive failures of a konnector. It is only used to
+// compute the next planned execution: skipping the jobs is done by the
+// BeforeHook of the worker.
+func RegisterTriggerBackoffCallback(cb func(t Trigger, state *TriggerState) time.Time) {
+	cbTriggerBackoff = cb
+}
+
+var cbTriggersPaused func(t Trigger) bool
+
+// RegisterTriggersPausedCallback allows to register a callback function called
+// when a trigger is fired: the job is not pushed if the callback returns true,
+// when the instance is in maintenance for example.
+func RegisterTriggersPausedCallback(cb func(t Trigger) bool) {
+	cbTriggersPaused = cb
+}
+
+// isPaused returns true if the trigger must not push a job for now.
+func isPaused(t Trigger) bool {
+	return cbTriggersPaused != nil && cbTriggersPaused(t)
+}
+
 var _ couchdb.Doc = &TriggerInfos{}
@@ -1,6 +1,11 @@
 package jobs
 
 import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -42,6 +47,77 @@ func NewEveryTrigger(infos *TriggerInfos) (*CronTrigger, error) {
 	}, nil
 }
 
+// NewPeriodicTrigger returns a new instance of CronTrigger given the specified
+// options as @hourly, @daily or @weekly. The exact time of the executions is
+// chosen by the stack, to spread the jobs of the instances (and of the
+// triggers of an instance) over the period, instead of running them all at
+// the same time. For @daily and @weekly, the arguments can restrict the hours
+// of the executions with a range, like 2-5 for between 2am and 5am.
+func NewPeriodicTrigger(infos *TriggerInfos) (*CronTrigger, error) {
+	spec, err := periodicSpec(infos)
+	if err != nil {
+		return nil, ErrMalformedTrigger
+	}
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return nil, ErrMalformedTrigger
+	}
+	return &CronTrigger{
+		TriggerInfos: infos,
+		sched:        schedule,
+		done:         make(chan struct{}),
+	}, nil
+}
+
+// periodicSpec returns the cron spec for a periodic trigger. The time is
+// chosen with a seed computed from the domain and the message of the trigger,
+// so that it is stable for a trigger.
+func periodicSpec(infos *TriggerInfos) (string, error) {
+	seed := crc32.ChecksumIEEE([]byte(infos.Domain + "/" + infos.WorkerType + "/" + string(infos.Message)))
+	rng := rand.New(rand.NewSource(int64(seed)))
+	sec, min := rng.Intn(60), rng.Intn(60)
+	if infos.Type == "@hourly" {
+		if infos.Arguments != "" {
+			return "", fmt.Errorf("Unexpected arguments for @hourly: %q", infos.Arguments)
+		}
+		return fmt.Sprintf("%d %d * * * *", sec, min), nil
+	}
+
+	from, to, err := parseHoursRange(infos.Arguments)
+	if err != nil {
+		return "", err
+	}
+	hour := from + rng.Intn(to-from)
+	if infos.Type == "@weekly" {
+		return fmt.Sprintf("%d %d %d * * %d", sec, min, hour, rng.Intn(7)), nil
+	}
+	return fmt.Sprintf("%d %d %d * * *", sec, min, hour), nil
+}
+
+// parseHoursRange parses a range of hours like 2-5, where the end is
+// excluded. An empty string is the whole day.
+func parseHoursRange(arg string) (int, int, error) {
+	if arg == "" {
+		return 0, 24, nil
+	}
+	parts := strings.SplitN(arg, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid range of hours: %q", arg)
+	}
+	from, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+	if from < 0 || to > 24 || from >= to {
+		return 0, 0, fmt.Errorf("Invalid range of hours: %q", arg)
+	}
+	return from, to, nil
+}
+
 // Type implements the Type method of the Trigger interface.
 func (c *CronTrigger) Type() string {
 	return c.TriggerInfos.Type
@@ -9,6 +9,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -135,3 +136,31 @@ func TestTriggerEvent(t *testing.T) {
 	err := sch.ShutdownScheduler(context.Background())
 	assert.NoError(t, err)
 }
+
+type fixedPather string
+
+func (p fixedPather) FilePath(doc *vfs.FileDoc) (string, error) {
+	return string(p), nil
+}
+
+func TestTestPathInheritedByChildren(t *testing.T) {
+	shared := &vfs.DirDoc{Fullpath: "/Shared"}
+
+	subdir := &vfs.DirDoc{Fullpath: "/Shared/Photos/2019"}
+	assert.True(t, testPath(shared, subdir))
+	sibling := &vfs.DirDoc{Fullpath: "/Shared with me"}
+	assert.False(t, testPath(shared, sibling))
+
+	file := &vfs.FileDoc{DocRev: "1-123"}
+	_, _ = file.Path(fixedPather("/Shared/Photos/2019/beach.jpg"))
+	assert.True(t, testPath(shared, file))
+	other := &vfs.FileDoc{DocRev: "1-123"}
+	_, _ = other.Path(fixedPather("/Documents/beach.jpg"))
+	assert.False(t, testPath(shared, other))
+
+	uploading := &vfs.FileDoc{DocRev: "1-123", Trashed: true}
+	_, _ = uploading.Path(fixedPather("/Shared/new.txt"))
+	assert.False(t, testPath(shared, uploading))
+	trashed := &vfs.FileDoc{DocRev: "2-456", Trashed: true, RestorePath: "/Shared/Photos"}
+	assert.True(t, testPath(shared, trashed))
+}
@@ -0,0 +1,173 @@
+package jobs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const (
+	// SignatureHeader is the name of the HTTP header used for the signature of
+	// the payloads of the webhooks.
+	SignatureHeader = "X-Cozy-Signature"
+	// DeliveryHeader is the name of the HTTP header used for the identifier of
+	// a delivery of a webhook.
+	DeliveryHeader = "X-Cozy-Delivery"
+
+	signaturePrefix     = "sha256="
+	webhookSecretLength = 32
+)
+
+// WebhookTrigger implements the @webhook trigger type. It pushes a job each
+// time a request is sent to the webhook URL of the trigger, with the body of
+// the request as the payload of the job.
+type WebhookTrigger struct {
+	*TriggerInfos
+	unscheduled chan struct{}
+}
+
+// NewWebhookTrigger returns a new instance of WebhookTrigger given the
+// specified options.
+func NewWebhookTrigger(infos *TriggerInfos) (*WebhookTrigger, error) {
+	if infos.Secret == "" {
+		infos.Secret = utils.RandomString(webhookSecretLength)
+	}
+	return &WebhookTrigger{
+		TriggerInfos: infos,
+		unscheduled:  make(chan struct{}),
+	}, nil
+}
+
+// Type implements the Type method of the Trigger interface.
+func (t *WebhookTrigger) Type() string {
+	return t.TriggerInfos.Type
+}
+
+// DocType implements the permissions.Matcher interface
+func (t *WebhookTrigger) DocType() string {
+	return consts.Triggers
+}
+
+// ID implements the permissions.Matcher interface
+func (t *WebhookTrigger) ID() string {
+	return t.TriggerInfos.TID
+}
+
+// Match implements the permissions.Matcher interface
+func (t *WebhookTrigger) Match(key, value string) bool {
+	switch key {
+	case WorkerType:
+		return t.TriggerInfos.WorkerType == value
+	}
+	return false
+}
+
+// Schedule implements the Schedule method of the Trigger interface. The jobs
+// of a webhook are not scheduled, they are pushed when the webhook is called.
+func (t *WebhookTrigger) Schedule() <-chan *JobRequest {
+	ch := make(chan *JobRequest)
+	go func() {
+		<-t.unscheduled
+		close(ch)
+	}()
+	return ch
+}
+
+// Unschedule implements the Unschedule method of the Trigger interface.
+func (t *WebhookTrigger) Unschedule() {
+	close(t.unscheduled)
+}
+
+// Infos implements the Infos method of the Trigger interface.
+func (t *WebhookTrigger) Infos() *TriggerInfos {
+	return t.TriggerInfos
+}
+
+// CheckSignature returns true if the signature is the one of the payload with
+// the secret of the trigger.
+func (t *WebhookTrigger) CheckSignature(payload []byte, signature string) bool {
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+	expected := SignPayload(t.Secret, payload)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// Fire returns the job request for a call of the webhook with the given
+// payload, or nil if the triggers of the instance are paused.
+func (t *WebhookTrigger) Fire(payload []byte) *JobRequest {
+	if isPaused(t) {
+		return nil
+	}
+	req := t.Infos().JobRequest()
+	if len(payload) > 0 {
+		req.Payload = Payload(payload)
+	}
+	return req
+}
+
+// SignPayload returns the signature of a payload with a secret, as sent in the
+// X-Cozy-Signature header: sha256= followed by the hex encoded HMAC-SHA256.
+func SignPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSecret is the secret used to sign the payloads posted by the webhook
+// worker for a trigger. It is kept in its own document, with the identifier
+// of the trigger, as the triggers and the jobs can be read by the apps.
+type webhookSecret struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+	Secret string `json:"secret"`
+}
+
+func (s *webhookSecret) ID() string         { return s.DocID }
+func (s *webhookSecret) Rev() string        { return s.DocRev }
+func (s *webhookSecret) DocType() string    { return consts.WebhookSecrets }
+func (s *webhookSecret) SetID(id string)    { s.DocID = id }
+func (s *webhookSecret) SetRev(rev string)  { s.DocRev = rev }
+func (s *webhookSecret) Clone() couchdb.Doc { cloned := *s; return &cloned }
+
+// SetWebhookSecret saves the secret used to sign the payloads of the webhooks
+// of the given trigger.
+func SetWebhookSecret(db prefixer.Prefixer, triggerID, secret string) error {
+	doc := &webhookSecret{DocID: triggerID, Secret: secret}
+	return couchdb.CreateNamedDocWithDB(db, doc)
+}
+
+// GetWebhookSecret returns the secret used to sign the payloads of the
+// webhooks of the given trigger.
+func GetWebhookSecret(db prefixer.Prefixer, triggerID string) (string, error) {
+	doc := &webhookSecret{}
+	if err := couchdb.GetDoc(db, consts.WebhookSecrets, triggerID, doc); err != nil {
+		return "", err
+	}
+	return doc.Secret, nil
+}
+
+// deleteWebhookSecret removes the secret of a trigger, if it has one, when
+// the trigger is deleted.
+func deleteWebhookSecret(t Trigger) error {
+	if t.Infos().WorkerType != "webhook" {
+		return nil
+	}
+	doc := &webhookSecret{}
+	err := couchdb.GetDoc(t, consts.WebhookSecrets, t.Infos().TID, doc)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(t, doc)
+}
+
+var _ couchdb.Doc = &webhookSecret{}
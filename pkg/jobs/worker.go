@@ -15,8 +15,10 @@ import (
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/metrics"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -104,7 +106,7 @@ func (w *WorkerConfig) Clone() *WorkerConfig {
 
 // NewWorkerContext returns a context.Context usable by a worker.
 func NewWorkerContext(workerID string, job *Job) *WorkerContext {
-	ctx := context.Background()
+	ctx := tracing.FromCarrier(context.Background(), job.Trace)
 	id := fmt.Sprintf("%s/%s", workerID, job.ID())
 	log := logger.WithDomain(job.Domain).
 		WithField("job_id", job.ID()).
@@ -168,6 +170,11 @@ func (c *WorkerContext) ID() string {
 	return c.id
 }
 
+// JobID returns the identifier of the job executed by the worker.
+func (c *WorkerContext) JobID() string {
+	return c.job.ID()
+}
+
 // Logger return the logger associated with the worker context.
 func (c *WorkerContext) Logger() *logrus.Entry {
 	return c.log
@@ -186,6 +193,14 @@ func (c *WorkerContext) UnmarshalEvent(v interface{}) error {
 	return c.job.Event.Unmarshal(v)
 }
 
+// UnmarshalPayload unmarshals the payload contained in the worker context.
+func (c *WorkerContext) UnmarshalPayload(v interface{}) error {
+	if c.job == nil || c.job.Payload == nil {
+		return errors.New("jobs: does not have a payload associated")
+	}
+	return c.job.Payload.Unmarshal(v)
+}
+
 // Domain returns the domain associated with the worker context.
 func (c *WorkerContext) Domain() string {
 	return c.job.Domain
@@ -392,6 +407,17 @@ func (t *task) run() (err error) {
 	t.startTime = time.Now()
 	t.execCount = 0
 
+	spanCtx, span := tracing.Start(t.ctx.Context, "job "+t.w.Type,
+		attribute.String("domain", t.job.Domain),
+		attribute.String("job.id", t.job.ID()),
+		attribute.String("job.worker", t.w.Type),
+	)
+	t.ctx.Context = spanCtx
+	defer func() {
+		span.SetAttributes(attribute.Int("job.exec_count", t.execCount))
+		tracing.End(span, err)
+	}()
+
 	if t.conf.WorkerStart != nil {
 		t.ctx, err = t.conf.WorkerStart(t.ctx)
 		if err != nil {
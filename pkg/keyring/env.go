@@ -0,0 +1,28 @@
+package keyring
+
+import (
+	"os"
+	"strings"
+)
+
+type envKeyring struct {
+	prefix string
+}
+
+// NewEnvKeyring returns a keyring where the secrets are read from environment
+// variables. The name of the variable is the prefix followed by the name of
+// the secret in upper case: COZY_SECRET_CREDENTIALS_MASTER_SECRET for example.
+func NewEnvKeyring(prefix string) Keyring {
+	if prefix == "" {
+		prefix = "COZY_SECRET_"
+	}
+	return &envKeyring{prefix}
+}
+
+func (k *envKeyring) Get(name string) ([]byte, error) {
+	value, ok := os.LookupEnv(k.prefix + strings.ToUpper(name))
+	if !ok || value == "" {
+		return nil, ErrNotFound
+	}
+	return []byte(value), nil
+}
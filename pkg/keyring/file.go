@@ -0,0 +1,55 @@
+package keyring
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type fileKeyring struct {
+	dir string
+}
+
+// NewFileKeyring returns a keyring where each secret is stored in a file of
+// the given directory, with the name of the secret as filename.
+func NewFileKeyring(dir string) (Keyring, error) {
+	if dir == "" {
+		return nil, errors.New("keyring: the path of the directory is missing")
+	}
+	return &fileKeyring{dir}, nil
+}
+
+func (k *fileKeyring) Get(name string) ([]byte, error) {
+	if name != filepath.Base(name) {
+		return nil, ErrNotFound
+	}
+	value, err := ioutil.ReadFile(filepath.Join(k.dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(value), nil
+}
+
+func (k *fileKeyring) Put(name string, value []byte) error {
+	if name != filepath.Base(name) {
+		return fmt.Errorf("keyring: invalid name %q", name)
+	}
+	return ioutil.WriteFile(filepath.Join(k.dir, name), value, 0600)
+}
+
+func (k *fileKeyring) Delete(name string) error {
+	if name != filepath.Base(name) {
+		return fmt.Errorf("keyring: invalid name %q", name)
+	}
+	err := os.Remove(filepath.Join(k.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
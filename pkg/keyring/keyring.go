@@ -0,0 +1,93 @@
+// Package keyring gives access to the secrets of the stack (the keys used to
+// encrypt the credentials of the accounts for example), with pluggable
+// backends: local files, environment variables, or HashiCorp Vault.
+package keyring
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// CredentialsEncryptorKey is the name of the NACL key used to encrypt the
+	// credentials of the accounts (legacy format).
+	CredentialsEncryptorKey = "credentials_encryptor_key"
+	// CredentialsDecryptorKey is the name of the NACL key used to decrypt the
+	// credentials of the accounts (legacy format).
+	CredentialsDecryptorKey = "credentials_decryptor_key"
+	// CredentialsMasterSecret is the name of the secret from which the
+	// instance-level keys for the accounts credentials are derived.
+	CredentialsMasterSecret = "credentials_master_secret"
+	// CredentialsPreviousMasterSecret is the name of the master secret used
+	// before a rotation. It is only used to decrypt the credentials that have
+	// not been re-encrypted yet with the new master secret.
+	CredentialsPreviousMasterSecret = "credentials_master_secret_previous"
+	// FilesMasterKey is the name of the secret used to wrap the data keys
+	// with which the content of the files is encrypted at rest.
+	FilesMasterKey = "files_master_key"
+	// FilesPreviousMasterKey is the name of the files master key used before
+	// a rotation. It is only used to unwrap the data keys of the instances
+	// that have not been rekeyed yet.
+	FilesPreviousMasterKey = "files_master_key_previous"
+	// InstanceSecretsMasterKey is the name of the secret used to encrypt the
+	// secrets of the instances (session, OAuth and CLI secrets, signing seed
+	// and JWT keys) in their documents.
+	InstanceSecretsMasterKey = "instance_secrets_master_key"
+	// InstanceSecretsPreviousMasterKey is the name of the instance secrets
+	// master key used before a rotation.
+	InstanceSecretsPreviousMasterKey = "instance_secrets_master_key_previous"
+	// OAuthClientSecretPrefix is the prefix of the names of the client secrets
+	// of the OAuth account types, followed by the id of the account type (like
+	// oauth_client_secret_google). When present, they take the precedence over
+	// the client secrets of the account types documents.
+	OAuthClientSecretPrefix = "oauth_client_secret_"
+)
+
+// ErrNotFound is returned when a secret is not present in the keyring.
+var ErrNotFound = errors.New("keyring: secret not found")
+
+// Keyring is the interface of the backends that store the secrets.
+type Keyring interface {
+	// Get returns the value of the secret with the given name, or ErrNotFound.
+	Get(name string) ([]byte, error)
+}
+
+// Store is implemented by the keyrings where the stack can also write secrets,
+// like the TLS certificates obtained with ACME. The file and vault backends
+// are stores, but not the env one.
+type Store interface {
+	Keyring
+	// Put writes the value of the secret with the given name.
+	Put(name string, value []byte) error
+	// Delete removes the secret with the given name.
+	Delete(name string) error
+}
+
+// Options is used to configure the backend of the keyring.
+type Options struct {
+	// Backend can be "file", "env" or "vault"
+	Backend string
+	// Path is the directory of the secrets for the file backend, and the path
+	// of the secrets in the KV engine for the vault backend.
+	Path string
+	// Prefix is the prefix of the environment variables for the env backend.
+	Prefix string
+	// Vault contains the options for the vault backend
+	Vault VaultOptions
+}
+
+// New returns a keyring with the backend described by the options. A nil
+// keyring is returned if no backend has been configured.
+func New(opts Options) (Keyring, error) {
+	switch opts.Backend {
+	case "":
+		return nil, nil
+	case "file":
+		return NewFileKeyring(opts.Path)
+	case "env":
+		return NewEnvKeyring(opts.Prefix), nil
+	case "vault":
+		return NewVaultKeyring(opts.Path, opts.Vault)
+	}
+	return nil, fmt.Errorf("keyring: unknown backend %q", opts.Backend)
+}
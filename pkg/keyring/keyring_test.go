@@ -0,0 +1,129 @@
+package keyring
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, CredentialsMasterSecret), []byte("foobar\n"), 0600)
+	assert.NoError(t, err)
+
+	kr, err := New(Options{Backend: "file", Path: dir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	secret, err := kr.Get(CredentialsMasterSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, "foobar", string(secret))
+	_, err = kr.Get(CredentialsPreviousMasterSecret)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = kr.Get("../" + filepath.Base(dir) + "/" + CredentialsMasterSecret)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	kr, err := New(Options{Backend: "file", Path: dir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	store, ok := kr.(Store)
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.NoError(t, store.Put("acme_example.org", []byte("cert")))
+	value, err := store.Get("acme_example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, "cert", string(value))
+	assert.NoError(t, store.Delete("acme_example.org"))
+	_, err = store.Get("acme_example.org")
+	assert.Equal(t, ErrNotFound, err)
+	assert.NoError(t, store.Delete("acme_example.org"))
+	assert.Error(t, store.Put("../foo", []byte("bar")))
+}
+
+func TestEnvKeyring(t *testing.T) {
+	os.Setenv("COZY_SECRET_CREDENTIALS_MASTER_SECRET", "foobar")
+	defer os.Unsetenv("COZY_SECRET_CREDENTIALS_MASTER_SECRET")
+
+	kr, err := New(Options{Backend: "env"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	secret, err := kr.Get(CredentialsMasterSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, "foobar", string(secret))
+	_, err = kr.Get(CredentialsPreviousMasterSecret)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestVaultKeyring(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/v1/secret/data/cozy-stack" || r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"credentials_master_secret":"foobar"}}}`))
+	}))
+	defer ts.Close()
+
+	kr, err := New(Options{Backend: "vault", Vault: VaultOptions{
+		Address: ts.URL,
+		Token:   "s.token",
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	secret, err := kr.Get(CredentialsMasterSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, "foobar", string(secret))
+	_, err = kr.Get(CredentialsPreviousMasterSecret)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, 1, calls)
+
+	// The secrets are fetched again when the cache has expired
+	kr.(*vaultKeyring).fetchedAt = time.Now().Add(-2 * defaultVaultCacheTTL)
+	secret, err = kr.Get(CredentialsMasterSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, "foobar", string(secret))
+	assert.Equal(t, 2, calls)
+
+	kr, err = New(Options{Backend: "vault", Vault: VaultOptions{
+		Address: ts.URL,
+		Token:   "bad",
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = kr.Get(CredentialsMasterSecret)
+	assert.Error(t, err)
+}
+
+func TestUnknownBackend(t *testing.T) {
+	kr, err := New(Options{})
+	assert.NoError(t, err)
+	assert.Nil(t, kr)
+	_, err = New(Options{Backend: "foo"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,174 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultOptions contains the options for the HashiCorp Vault backend.
+type VaultOptions struct {
+	// Address is the URL of the Vault server, like https://vault:8200
+	Address string
+	// Token is the token used to authenticate the requests to Vault
+	Token string `json:"-"`
+	// Mount is the mount point of the KV (version 2) secrets engine
+	Mount string
+	// Client is the HTTP client used for the requests (optional)
+	Client *http.Client `json:"-"`
+	// CacheTTL is the duration during which the secrets fetched from Vault are
+	// kept in memory (5 minutes by default), so that a rotation is seen by
+	// the stack without a restart.
+	CacheTTL time.Duration
+}
+
+// defaultVaultCacheTTL is the default duration of the cache of the secrets
+// fetched from Vault.
+const defaultVaultCacheTTL = 5 * time.Minute
+
+type vaultKeyring struct {
+	opts VaultOptions
+	path string
+
+	mu        sync.Mutex
+	secrets   map[string]string
+	fetchedAt time.Time
+}
+
+// NewVaultKeyring returns a keyring where the secrets are the keys of a secret
+// in the KV (version 2) secrets engine of a HashiCorp Vault server.
+func NewVaultKeyring(path string, opts VaultOptions) (Keyring, error) {
+	if opts.Address == "" {
+		return nil, errors.New("keyring: the address of vault is missing")
+	}
+	if opts.Mount == "" {
+		opts.Mount = "secret"
+	}
+	if path == "" {
+		path = "cozy-stack"
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = defaultVaultCacheTTL
+	}
+	return &vaultKeyring{opts: opts, path: path}, nil
+}
+
+type vaultResponse struct {
+	Data struct {
+		Data map[string]string `json:"data"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+func (k *vaultKeyring) fetch() (map[string]string, error) {
+	u := strings.TrimSuffix(k.opts.Address, "/") + "/v1/" +
+		strings.Trim(k.opts.Mount, "/") + "/data/" + strings.Trim(k.path, "/")
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", k.opts.Token)
+	res, err := k.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return map[string]string{}, nil
+	}
+	var body vaultResponse
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("keyring: vault responded with %d: %s",
+			res.StatusCode, strings.Join(body.Errors, ", "))
+	}
+	if body.Data.Data == nil {
+		return map[string]string{}, nil
+	}
+	return body.Data.Data, nil
+}
+
+func (k *vaultKeyring) write(secrets map[string]string) error {
+	u := strings.TrimSuffix(k.opts.Address, "/") + "/v1/" +
+		strings.Trim(k.opts.Mount, "/") + "/data/" + strings.Trim(k.path, "/")
+	payload, err := json.Marshal(map[string]interface{}{"data": secrets})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", k.opts.Token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := k.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		var body vaultResponse
+		_ = json.NewDecoder(res.Body).Decode(&body)
+		return fmt.Errorf("keyring: vault responded with %d: %s",
+			res.StatusCode, strings.Join(body.Errors, ", "))
+	}
+	return nil
+}
+
+// update fetches the secrets, applies the change, and writes them back, as
+// a write in the KV engine replaces all the keys of the secret.
+func (k *vaultKeyring) update(change func(secrets map[string]string)) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	secrets, err := k.fetch()
+	if err != nil {
+		return err
+	}
+	change(secrets)
+	if err = k.write(secrets); err != nil {
+		return err
+	}
+	k.secrets = secrets
+	k.fetchedAt = time.Now()
+	return nil
+}
+
+func (k *vaultKeyring) Put(name string, value []byte) error {
+	return k.update(func(secrets map[string]string) {
+		secrets[name] = string(value)
+	})
+}
+
+func (k *vaultKeyring) Delete(name string) error {
+	return k.update(func(secrets map[string]string) {
+		delete(secrets, name)
+	})
+}
+
+func (k *vaultKeyring) Get(name string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.secrets == nil || time.Since(k.fetchedAt) > k.opts.CacheTTL {
+		secrets, err := k.fetch()
+		if err != nil {
+			return nil, err
+		}
+		k.secrets = secrets
+		k.fetchedAt = time.Now()
+	}
+	value, ok := k.secrets[name]
+	if !ok || value == "" {
+		return nil, ErrNotFound
+	}
+	return []byte(value), nil
+}
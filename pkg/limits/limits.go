@@ -0,0 +1,339 @@
+// Package limits is used for the rate limiting of some actions, like the
+// login attempts or the expensive requests. The counters are kept in redis
+// when it is configured, so that the limits are shared by all the stack
+// processes.
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/go-redis/redis"
+)
+
+// CounterType is the type of an action that is rate limited
+type CounterType int
+
+const (
+	// AuthType is used for the login attempts with a passphrase
+	AuthType CounterType = iota
+	// TwoFactorType is used for the checks of a two-factor passcode
+	TwoFactorType
+	// OAuthClientType is used for the registration of OAuth clients
+	OAuthClientType
+	// RemoteType is used for the requests to the remote doctypes
+	RemoteType
+	// SearchType is used for the mango queries, on the files and the documents
+	SearchType
+	// ExportType is used for the creation of the exports of an instance
+	ExportType
+	// ThumbnailType is used for the previews generated on demand, like the
+	// images of the pages of a PDF
+	ThumbnailType
+	// KonnectorTriggerType is used for the manual executions of the
+	// konnectors
+	KonnectorTriggerType
+)
+
+type counterConfig struct {
+	// Name is used in the configuration and in the quotas API
+	Name   string
+	Prefix string
+	Limit  int64
+	Period time.Duration
+	// PerToken is true when the counter is for each token, and not shared by
+	// all the tokens of the instance
+	PerToken bool
+}
+
+var configs = []counterConfig{
+	// AuthType
+	{Name: "auth", Prefix: "auth", Limit: 50, Period: time.Hour},
+	// TwoFactorType
+	{Name: "two_factor", Prefix: "two-factor", Limit: 10, Period: 5 * time.Minute},
+	// OAuthClientType
+	{Name: "oauth_client", Prefix: "oauth-client", Limit: 100, Period: time.Hour},
+	// RemoteType
+	{Name: "remote", Prefix: "remote", Limit: 1000, Period: time.Hour},
+	// SearchType
+	{Name: "search", Prefix: "search", Limit: 600, Period: time.Minute, PerToken: true},
+	// ExportType
+	{Name: "export", Prefix: "export", Limit: 5, Period: 24 * time.Hour},
+	// ThumbnailType
+	{Name: "thumbnail", Prefix: "thumbnail", Limit: 1000, Period: time.Hour, PerToken: true},
+	// KonnectorTriggerType
+	{Name: "konnector_trigger", Prefix: "konnector-trigger", Limit: 100, Period: time.Hour, PerToken: true},
+}
+
+// QuotaTypes are the counters that can be queried by the applications for
+// their remaining quota.
+var QuotaTypes = []CounterType{SearchType, ExportType, ThumbnailType, KonnectorTriggerType}
+
+// getConfig returns the configuration of a counter, with the overrides from
+// the rate_limits of the configuration file.
+func getConfig(ct CounterType) counterConfig {
+	cfg := configs[ct]
+	if override, ok := config.GetConfig().RateLimits[cfg.Name]; ok {
+		if override.Limit > 0 {
+			cfg.Limit = override.Limit
+		}
+		if override.Period > 0 {
+			cfg.Period = override.Period
+		}
+		if override.Per != "" {
+			cfg.PerToken = override.Per == config.RateLimitPerToken
+		}
+	}
+	return cfg
+}
+
+// Quota is the state of a counter for an instance, or a token of an instance.
+type Quota struct {
+	Name      string
+	Limit     int64
+	Remaining int64
+	// Reset is the duration before the counter is reset
+	Reset time.Duration
+}
+
+// ErrRateLimitReached is the error returned when there were too many actions
+// of a type for an instance during the period.
+var ErrRateLimitReached = errors.New("Rate limit reached")
+
+// Counter is an interface for counting the actions, with an expiration of
+// the counter at the end of the period.
+type Counter interface {
+	// Increment increments the counter for the given key, and returns its new
+	// value. The counter is reset after the given duration since its first
+	// increment.
+	Increment(key string, timeLimit time.Duration) (int64, error)
+	// Get returns the value of the counter for the given key, and the
+	// duration before it is reset. It is 0 for a counter that has not been
+	// incremented.
+	Get(key string) (int64, time.Duration, error)
+	// Reset resets the counter for the given key.
+	Reset(key string) error
+}
+
+var counter Counter
+var counterMu sync.Mutex
+
+// GetCounter returns the counter used for the rate limiting: in redis if the
+// rate_limiting storage is configured, or else in memory.
+func GetCounter() Counter {
+	counterMu.Lock()
+	defer counterMu.Unlock()
+	if counter == nil {
+		if cli := config.GetConfig().RateLimitingStorage.Client(); cli != nil {
+			counter = NewRedisCounter(cli)
+		} else {
+			counter = NewMemCounter()
+		}
+	}
+	return counter
+}
+
+func counterKey(p prefixer.Prefixer, ct CounterType) string {
+	return configs[ct].Prefix + ":" + p.DomainName()
+}
+
+// CheckRateLimit increments the counter of the action for the instance, and
+// returns ErrRateLimitReached if the limit has been exceeded.
+func CheckRateLimit(p prefixer.Prefixer, ct CounterType) error {
+	cfg := getConfig(ct)
+	val, err := GetCounter().Increment(counterKey(p, ct), cfg.Period)
+	if err != nil {
+		return err
+	}
+	if val > cfg.Limit {
+		return ErrRateLimitReached
+	}
+	return nil
+}
+
+// ResetCounter resets the counter of the action for the instance, after a
+// successful login for example.
+func ResetCounter(p prefixer.Prefixer, ct CounterType) error {
+	return GetCounter().Reset(counterKey(p, ct))
+}
+
+func quotaKey(p prefixer.Prefixer, cfg counterConfig, token string) string {
+	key := cfg.Prefix + ":" + p.DomainName()
+	if cfg.PerToken && token != "" {
+		key += ":" + token
+	}
+	return key
+}
+
+func newQuota(cfg counterConfig, val int64, reset time.Duration) *Quota {
+	remaining := cfg.Limit - val
+	if remaining < 0 {
+		remaining = 0
+	}
+	if reset <= 0 {
+		reset = cfg.Period
+	}
+	return &Quota{
+		Name:      cfg.Name,
+		Limit:     cfg.Limit,
+		Remaining: remaining,
+		Reset:     reset,
+	}
+}
+
+// CheckQuota increments the counter of the action for the token, or for the
+// instance if the counter is not per token. It returns the quota after the
+// increment, and ErrRateLimitReached if the limit has been exceeded.
+func CheckQuota(p prefixer.Prefixer, ct CounterType, token string) (*Quota, error) {
+	cfg := getConfig(ct)
+	key := quotaKey(p, cfg, token)
+	val, err := GetCounter().Increment(key, cfg.Period)
+	if err != nil {
+		return nil, err
+	}
+	_, reset, err := GetCounter().Get(key)
+	if err != nil {
+		return nil, err
+	}
+	quota := newQuota(cfg, val, reset)
+	if val > cfg.Limit {
+		return quota, ErrRateLimitReached
+	}
+	return quota, nil
+}
+
+// GetQuota returns the quota of the action for the token, or for the
+// instance if the counter is not per token, without incrementing it.
+func GetQuota(p prefixer.Prefixer, ct CounterType, token string) (*Quota, error) {
+	cfg := getConfig(ct)
+	val, reset, err := GetCounter().Get(quotaKey(p, cfg, token))
+	if err != nil {
+		return nil, err
+	}
+	return newQuota(cfg, val, reset), nil
+}
+
+type memRef struct {
+	val int64
+	exp time.Time
+}
+
+type memCounter struct {
+	mu   sync.Mutex
+	vals map[string]*memRef
+}
+
+// NewMemCounter returns a counter in memory, for a single stack process.
+func NewMemCounter() Counter {
+	return &memCounter{vals: make(map[string]*memRef)}
+}
+
+func (c *memCounter) Increment(key string, timeLimit time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	ref, ok := c.vals[key]
+	if !ok || now.After(ref.exp) {
+		c.sweep(now)
+		ref = &memRef{exp: now.Add(timeLimit)}
+		c.vals[key] = ref
+	}
+	ref.val++
+	return ref.val, nil
+}
+
+// sweep removes the expired counters, to avoid keeping them forever
+func (c *memCounter) sweep(now time.Time) {
+	for key, ref := range c.vals {
+		if now.After(ref.exp) {
+			delete(c.vals, key)
+		}
+	}
+}
+
+func (c *memCounter) Get(key string) (int64, time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ref, ok := c.vals[key]
+	if !ok {
+		return 0, 0, nil
+	}
+	ttl := time.Until(ref.exp)
+	if ttl <= 0 {
+		return 0, 0, nil
+	}
+	return ref.val, ttl, nil
+}
+
+func (c *memCounter) Reset(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.vals, key)
+	return nil
+}
+
+// luaIncr increments the counter, and sets its expiration on the first
+// increment, in an atomic way.
+const luaIncr = `
+local v = redis.call("INCR", KEYS[1])
+if v == 1 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return v`
+
+// luaGet returns the value of the counter and its TTL in milliseconds.
+const luaGet = `
+local v = redis.call("GET", KEYS[1])
+if not v then
+  return {0, 0}
+end
+return {tonumber(v), redis.call("PTTL", KEYS[1])}`
+
+const redisPrefix = "ratelimit:"
+
+type redisCounter struct {
+	client redis.UniversalClient
+}
+
+// NewRedisCounter returns a counter in redis, shared by the stack processes.
+func NewRedisCounter(client redis.UniversalClient) Counter {
+	return &redisCounter{client}
+}
+
+func (c *redisCounter) Increment(key string, timeLimit time.Duration) (int64, error) {
+	ttl := int64(timeLimit / time.Millisecond)
+	res, err := c.client.Eval(luaIncr, []string{redisPrefix + key}, ttl).Result()
+	if err != nil {
+		return 0, err
+	}
+	val, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected value from redis: %v", res)
+	}
+	return val, nil
+}
+
+func (c *redisCounter) Get(key string) (int64, time.Duration, error) {
+	res, err := c.client.Eval(luaGet, []string{redisPrefix + key}).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return 0, 0, fmt.Errorf("Unexpected value from redis: %v", res)
+	}
+	val, _ := vals[0].(int64)
+	ttl, _ := vals[1].(int64)
+	if ttl < 0 {
+		ttl = 0
+	}
+	return val, time.Duration(ttl) * time.Millisecond, nil
+}
+
+func (c *redisCounter) Reset(key string) error {
+	return c.client.Del(redisPrefix + key).Err()
+}
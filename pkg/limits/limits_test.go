@@ -0,0 +1,95 @@
+package limits
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func testCounter(t *testing.T, c Counter) {
+	val, err := c.Increment("test-key", 100*time.Millisecond)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, val)
+	val, err = c.Increment("test-key", 100*time.Millisecond)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, val)
+	val, ttl, err := c.Get("test-key")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, val)
+	assert.True(t, ttl > 0 && ttl <= 100*time.Millisecond)
+
+	time.Sleep(150 * time.Millisecond)
+	val, err = c.Increment("test-key", 100*time.Millisecond)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, val)
+
+	assert.NoError(t, c.Reset("test-key"))
+	val, _, err = c.Get("test-key")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, val)
+	val, err = c.Increment("test-key", 100*time.Millisecond)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, val)
+	assert.NoError(t, c.Reset("test-key"))
+}
+
+func TestMemCounter(t *testing.T) {
+	testCounter(t, NewMemCounter())
+}
+
+func TestRedisCounter(t *testing.T) {
+	opts, err := redis.ParseURL("redis://localhost:6379/0")
+	assert.NoError(t, err)
+	testCounter(t, NewRedisCounter(redis.NewClient(opts)))
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	db := prefixer.NewPrefixer("limits.cozy.local", "limits-cozy-local")
+	defer ResetCounter(db, TwoFactorType)
+	for i := int64(0); i < configs[TwoFactorType].Limit; i++ {
+		assert.NoError(t, CheckRateLimit(db, TwoFactorType))
+	}
+	assert.Equal(t, ErrRateLimitReached, CheckRateLimit(db, TwoFactorType))
+	assert.NoError(t, CheckRateLimit(db, AuthType))
+	assert.NoError(t, ResetCounter(db, AuthType))
+
+	assert.NoError(t, ResetCounter(db, TwoFactorType))
+	assert.NoError(t, CheckRateLimit(db, TwoFactorType))
+}
+
+func TestCheckQuota(t *testing.T) {
+	db := prefixer.NewPrefixer("quotas.cozy.local", "quotas-cozy-local")
+	limit := configs[KonnectorTriggerType].Limit
+	for i := int64(1); i <= limit; i++ {
+		quota, err := CheckQuota(db, KonnectorTriggerType, "io.cozy.apps/home")
+		assert.NoError(t, err)
+		assert.Equal(t, limit-i, quota.Remaining)
+	}
+	quota, err := CheckQuota(db, KonnectorTriggerType, "io.cozy.apps/home")
+	assert.Equal(t, ErrRateLimitReached, err)
+	assert.EqualValues(t, 0, quota.Remaining)
+	assert.True(t, quota.Reset > 0)
+
+	// The counter is per token
+	quota, err = GetQuota(db, KonnectorTriggerType, "io.cozy.apps/drive")
+	assert.NoError(t, err)
+	assert.Equal(t, "konnector_trigger", quota.Name)
+	assert.Equal(t, limit, quota.Remaining)
+	quota, err = CheckQuota(db, KonnectorTriggerType, "io.cozy.apps/drive")
+	assert.NoError(t, err)
+	assert.Equal(t, limit-1, quota.Remaining)
+
+	key := configs[KonnectorTriggerType].Prefix + ":" + db.DomainName()
+	assert.NoError(t, GetCounter().Reset(key+":io.cozy.apps/home"))
+	assert.NoError(t, GetCounter().Reset(key+":io.cozy.apps/drive"))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	os.Exit(m.Run())
+}
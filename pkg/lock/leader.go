@@ -0,0 +1,137 @@
+package lock
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	leaderNS = "leader:"
+
+	// LeaderTimeout is the duration of the lease of a leader: if the leader
+	// stops refreshing it (crash, network partition), another stack process
+	// can take the leadership after this delay.
+	LeaderTimeout = 15 * time.Second
+
+	// leaderRefresh is the time interval between two refreshes of the lease
+	leaderRefresh = LeaderTimeout / 3
+)
+
+// Leader is used to elect, for a given name, a single stack process between
+// all the processes that share the same redis. It is useful for the tasks
+// that must be done by only one process at a time, like polling the triggers
+// or sweeping a queue, when the stack is run with several replicas.
+type Leader interface {
+	// IsLeader returns true if the current process is the leader.
+	IsLeader() bool
+	// Shutdown stops the election, and gives up the leadership if the
+	// current process has it.
+	Shutdown(ctx context.Context) error
+}
+
+// Elect starts the election of a leader for the given name. Without redis,
+// there is only one process, and it is always the leader.
+func Elect(name string) Leader {
+	cli := config.GetConfig().Lock.Client()
+	if cli == nil {
+		return memLeader{}
+	}
+	l := &redisLeader{
+		client: cli,
+		key:    leaderNS + name,
+		closed: make(chan struct{}),
+		log:    logger.WithNamespace("redis-leader").WithField("leader", name),
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	l.token = utils.RandomStringFast(rng, lockTokenSize)
+	l.campaign()
+	go l.loop()
+	return l
+}
+
+type memLeader struct{}
+
+func (memLeader) IsLeader() bool                     { return true }
+func (memLeader) Shutdown(ctx context.Context) error { return nil }
+
+type redisLeader struct {
+	client subRedisInterface
+	key    string
+	token  string
+	closed chan struct{}
+	log    *logrus.Entry
+
+	mu     sync.Mutex
+	leader bool
+}
+
+func (l *redisLeader) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader
+}
+
+func (l *redisLeader) loop() {
+	ticker := time.NewTicker(leaderRefresh)
+	for {
+		select {
+		case <-l.closed:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			l.campaign()
+		}
+	}
+}
+
+// campaign refreshes the lease if the process is the leader, or else tries to
+// take it.
+func (l *redisLeader) campaign() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	wasLeader := l.leader
+	l.leader = false
+	if wasLeader {
+		ttl := strconv.FormatInt(int64(LeaderTimeout/time.Millisecond), 10)
+		ok, err := l.client.Eval(luaRefresh, []string{l.key}, l.token, ttl).Result()
+		if err != nil {
+			l.log.Warnf("Failed to refresh the lease: %s", err)
+			return
+		}
+		if ok == int64(1) {
+			l.leader = true
+			return
+		}
+		l.log.Infof("Leadership lost")
+	}
+
+	ok, err := l.client.SetNX(l.key, l.token, LeaderTimeout).Result()
+	if err != nil {
+		l.log.Warnf("Failed to take the lease: %s", err)
+		return
+	}
+	if ok {
+		l.leader = true
+		l.log.Infof("Leadership taken")
+	}
+}
+
+func (l *redisLeader) Shutdown(ctx context.Context) error {
+	close(l.closed)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.leader {
+		l.leader = false
+		return l.client.Eval(luaRelease, []string{l.key}, l.token).Err()
+	}
+	return nil
+}
@@ -7,6 +7,7 @@
 package lock
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"runtime"
@@ -130,6 +131,51 @@ func TestRedisLock(t *testing.T) {
 	}
 }
 
+func TestMemLeader(t *testing.T) {
+	backconf := config.GetConfig().Lock
+	var err error
+	config.GetConfig().Lock, err = config.NewRedisConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { config.GetConfig().Lock = backconf }()
+	l := Elect("test-mem")
+	if !l.IsLeader() {
+		t.Fatal("the process should be the leader without redis")
+	}
+	if err = l.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisLeader(t *testing.T) {
+	backconf := config.GetConfig().Lock
+	var err error
+	config.GetConfig().Lock, err = config.NewRedisConfig("redis://localhost:6379/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { config.GetConfig().Lock = backconf }()
+	l1 := Elect("test-redis")
+	l2 := Elect("test-redis")
+	if !l1.IsLeader() {
+		t.Fatal("the first process should be the leader")
+	}
+	if l2.IsLeader() {
+		t.Fatal("the second process should not be the leader")
+	}
+	if err = l1.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	l2.(*redisLeader).campaign()
+	if !l2.IsLeader() {
+		t.Fatal("the second process should be the leader after a resignation")
+	}
+	if err = l2.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	if testing.Short() {
@@ -1,8 +1,11 @@
 package logger
 
 import (
+	"fmt"
 	"io/ioutil"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/sirupsen/logrus"
@@ -13,16 +16,35 @@ const (
 	debugRedisRmvChannel = "rmv:log-debug"
 )
 
+// DefaultDebugTTL is the duration of the debug mode of a domain, when no
+// duration is given.
+const DefaultDebugTTL = 24 * time.Hour
+
 var opts Options
 
-var loggers = make(map[string]*logrus.Logger)
+// shipper is the hook used to send the logs to an aggregator, if any
+var shipper logrus.Hook
+
+var loggers = make(map[string]debugLogger)
 var loggersMu sync.RWMutex
 
+// debugLogger is a logger with the debug level for a domain, that is used
+// until its expiration.
+type debugLogger struct {
+	logger    *logrus.Logger
+	expiredAt time.Time
+}
+
 // Options contains the configuration values of the logger system
 type Options struct {
 	Syslog bool
 	Level  string
-	Redis  redis.UniversalClient
+	// Format is the format of the logs: "text" (the default) or "json"
+	Format string
+	// Ship is the URL of a server where the logs are sent, in JSON, with a
+	// udp:// or redis:// scheme
+	Ship  string
+	Redis redis.UniversalClient
 }
 
 // Init initializes the logger module with the specified options.
@@ -36,6 +58,11 @@ func Init(opt Options) error {
 		return err
 	}
 	logrus.SetLevel(logLevel)
+	formatter, err := newFormatter(opt.Format)
+	if err != nil {
+		return err
+	}
+	logrus.SetFormatter(formatter)
 	if opt.Syslog {
 		hook, err := syslogHook()
 		if err != nil {
@@ -44,6 +71,14 @@ func Init(opt Options) error {
 		logrus.AddHook(hook)
 		logrus.SetOutput(ioutil.Discard)
 	}
+	if opt.Ship != "" {
+		hook, err := newShipHook(opt.Ship)
+		if err != nil {
+			return err
+		}
+		logrus.AddHook(hook)
+		shipper = hook
+	}
 	if cli := opt.Redis; cli != nil {
 		go subscribeLoggersDebug(cli)
 	}
@@ -51,6 +86,20 @@ func Init(opt Options) error {
 	return nil
 }
 
+// SetLevel changes the level of the logs, when the configuration is reloaded
+// for example.
+func SetLevel(level string) error {
+	if level == "" {
+		level = "info"
+	}
+	logLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(logLevel)
+	return nil
+}
+
 // Clone clones a logrus.Logger struct.
 func Clone(in *logrus.Logger) *logrus.Logger {
 	out := &logrus.Logger{
@@ -65,12 +114,26 @@ func Clone(in *logrus.Logger) *logrus.Logger {
 	return out
 }
 
-// AddDebugDomain adds the specified domain to the debug list.
-func AddDebugDomain(domain string) error {
+func newFormatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case "", "text":
+		return &logrus.TextFormatter{}, nil
+	case "json":
+		return &logrus.JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("Unknown log format: %s", format)
+}
+
+// AddDebugDomain adds the specified domain to the debug list, for the given
+// duration (DefaultDebugTTL if it is zero).
+func AddDebugDomain(domain string, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = DefaultDebugTTL
+	}
 	if cli := opts.Redis; cli != nil {
-		return publishLoggersDebug(cli, debugRedisAddChannel, domain)
+		return publishLoggersDebug(cli, debugRedisAddChannel, domain+"/"+ttl.String())
 	}
-	addDebugDomain(domain)
+	addDebugDomain(domain, ttl)
 	return nil
 }
 
@@ -92,21 +155,30 @@ func WithNamespace(nspace string) *logrus.Entry {
 func WithDomain(domain string) *logrus.Entry {
 	loggersMu.RLock()
 	defer loggersMu.RUnlock()
-	if logger, ok := loggers[domain]; ok {
-		return logger.WithField("domain", domain)
+	if debug, ok := loggers[domain]; ok && time.Now().Before(debug.expiredAt) {
+		return debug.logger.WithField("domain", domain)
 	}
 	return logrus.WithField("domain", domain)
 }
 
-func addDebugDomain(domain string) {
+func addDebugDomain(domain string, ttl time.Duration) {
 	loggersMu.Lock()
 	defer loggersMu.Unlock()
-	_, ok := loggers[domain]
-	if ok {
+	now := time.Now()
+	for d, debug := range loggers {
+		if now.After(debug.expiredAt) {
+			delete(loggers, d)
+		}
+	}
+	expiredAt := now.Add(ttl)
+	if debug, ok := loggers[domain]; ok {
+		debug.expiredAt = expiredAt
+		loggers[domain] = debug
 		return
 	}
 	logger := logrus.New()
 	logger.Level = logrus.DebugLevel
+	logger.Formatter = logrus.StandardLogger().Formatter
 	if opts.Syslog {
 		hook, err := syslogHook()
 		if err == nil {
@@ -114,7 +186,10 @@ func addDebugDomain(domain string) {
 			logger.Out = ioutil.Discard
 		}
 	}
-	loggers[domain] = logger
+	if shipper != nil {
+		logger.Hooks.Add(shipper)
+	}
+	loggers[domain] = debugLogger{logger: logger, expiredAt: expiredAt}
 }
 
 func removeDebugDomain(domain string) {
@@ -129,7 +204,14 @@ func subscribeLoggersDebug(cli redis.UniversalClient) {
 		domain := msg.Payload
 		switch msg.Channel {
 		case debugRedisAddChannel:
-			addDebugDomain(domain)
+			ttl := DefaultDebugTTL
+			if parts := strings.SplitN(domain, "/", 2); len(parts) == 2 {
+				domain = parts[0]
+				if d, err := time.ParseDuration(parts[1]); err == nil {
+					ttl = d
+				}
+			}
+			addDebugDomain(domain, ttl)
 		case debugRedisRmvChannel:
 			removeDebugDomain(domain)
 		}
@@ -1,6 +1,8 @@
 package logger
 
 import (
+	"encoding/json"
+	"net"
 	"testing"
 	"time"
 
@@ -13,9 +15,9 @@ func TestDebugDomain(t *testing.T) {
 	err := Init(Options{Level: "info"})
 	assert.NoError(t, err)
 
-	err = AddDebugDomain("foo.bar")
+	err = AddDebugDomain("foo.bar", 0)
 	assert.NoError(t, err)
-	err = AddDebugDomain("foo.bar")
+	err = AddDebugDomain("foo.bar", 0)
 	assert.NoError(t, err)
 
 	log := WithDomain("foo.bar")
@@ -38,9 +40,9 @@ func TestDebugDomainWithRedis(t *testing.T) {
 
 	time.Sleep(1 * time.Second)
 
-	err = AddDebugDomain("foo.bar.redis")
+	err = AddDebugDomain("foo.bar.redis", 0)
 	assert.NoError(t, err)
-	err = AddDebugDomain("foo.bar.redis")
+	err = AddDebugDomain("foo.bar.redis", 0)
 	assert.NoError(t, err)
 
 	time.Sleep(1 * time.Second)
@@ -56,3 +58,51 @@ func TestDebugDomainWithRedis(t *testing.T) {
 	log = WithDomain("foo.bar.redis")
 	assert.Equal(t, logrus.InfoLevel, log.Logger.Level)
 }
+
+func TestDebugDomainExpiration(t *testing.T) {
+	err := Init(Options{Level: "info"})
+	assert.NoError(t, err)
+
+	err = AddDebugDomain("foo.expired", 100*time.Millisecond)
+	assert.NoError(t, err)
+	log := WithDomain("foo.expired")
+	assert.Equal(t, logrus.DebugLevel, log.Logger.Level)
+
+	time.Sleep(200 * time.Millisecond)
+	log = WithDomain("foo.expired")
+	assert.Equal(t, logrus.InfoLevel, log.Logger.Level)
+}
+
+func TestShipUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	err = Init(Options{
+		Level:  "info",
+		Format: "json",
+		Ship:   "udp://" + conn.LocalAddr().String(),
+	})
+	assert.NoError(t, err)
+	defer func() {
+		logrus.StandardLogger().Hooks = make(logrus.LevelHooks)
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}()
+
+	WithDomain("foo.shipped").WithField("doctype", "io.cozy.files").Info("hello")
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var line map[string]interface{}
+	err = json.Unmarshal(buf[:n], &line)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo.shipped", line["domain"])
+	assert.Equal(t, "io.cozy.files", line["doctype"])
+	assert.Equal(t, "hello", line["msg"])
+}
@@ -0,0 +1,73 @@
+package logger
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+)
+
+// shipRedisChannelPrefix is the prefix of the redis channels where the logs
+// are published: the logs of an instance are sent on log:<domain>, and the
+// logs without a domain on log:stack. It allows the hosting operators to
+// aggregate the logs of a customer with a PSUBSCRIBE on log:*.
+const shipRedisChannelPrefix = "log:"
+
+// shipHook is a logrus hook that sends the entries, formatted in JSON, to a log
+// aggregator.
+type shipHook struct {
+	formatter logrus.Formatter
+	send      func(domain string, line []byte) error
+}
+
+// newShipHook returns a hook for sending the logs to the server at the given
+// URL. The udp:// scheme sends a datagram for each line, and the redis://
+// scheme publishes the lines on a redis channel per domain.
+func newShipHook(rawURL string) (*shipHook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	hook := &shipHook{formatter: &logrus.JSONFormatter{}}
+	switch u.Scheme {
+	case "udp":
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		hook.send = func(domain string, line []byte) error {
+			_, err := conn.Write(line)
+			return err
+		}
+	case "redis":
+		opt, err := redis.ParseURL(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		cli := redis.NewClient(opt)
+		hook.send = func(domain string, line []byte) error {
+			return cli.Publish(shipRedisChannelPrefix+domain, line).Err()
+		}
+	default:
+		return nil, fmt.Errorf("Unknown scheme for shipping the logs: %q", u.Scheme)
+	}
+	return hook, nil
+}
+
+func (h *shipHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *shipHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	domain, _ := entry.Data["domain"].(string)
+	if domain == "" {
+		domain = "stack"
+	}
+	return h.send(domain, line)
+}
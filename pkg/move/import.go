@@ -18,13 +18,14 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/logger"
-	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	vcardParser "github.com/emersion/go-vcard"
 )
 
-func createContact(fs vfs.VFS, hdr *tar.Header, tr *tar.Reader, db prefixer.Prefixer) error {
+// createContact parses a vcard, and writes the contact in the bulk writer: the
+// contacts are created by batches.
+func createContact(fs vfs.VFS, hdr *tar.Header, tr *tar.Reader, w *couchdb.BulkWriter) error {
 	decoder := vcardParser.NewDecoder(tr)
 	vcard, err := decoder.Decode()
 	if err != nil {
@@ -102,11 +103,13 @@ func createContact(fs vfs.VFS, hdr *tar.Header, tr *tar.Reader, db prefixer.Pref
 		Phone:    contactphone,
 	}
 
-	return couchdb.CreateDoc(db, contact)
+	return w.Write(contact)
 }
 
 func createAlbums(i *instance.Instance, tr *tar.Reader, albums *AlbumReferences) error {
 	bs := bufio.NewScanner(tr)
+	w := couchdb.NewBulkWriter(i, consts.PhotosAlbums)
+	oldIDs := make(map[*couchdb.JSONDoc]string)
 
 	for bs.Scan() {
 		jsondoc := &couchdb.JSONDoc{}
@@ -119,16 +122,23 @@ func createAlbums(i *instance.Instance, tr *tar.Reader, albums *AlbumReferences)
 		jsondoc.SetRev("")
 		jsondoc.Type = consts.PhotosAlbums
 
-		if err := couchdb.CreateDoc(i, jsondoc); err != nil {
+		if err := w.Write(jsondoc); err != nil {
 			return err
 		}
-		(*albums)[id] = couchdb.DocReference{
-			ID:   jsondoc.ID(),
-			Type: consts.PhotosAlbums,
-		}
+		oldIDs[jsondoc] = id
 	}
 
-	return nil
+	err := w.Close()
+	for jsondoc, id := range oldIDs {
+		// The albums that have not been created have no identifier
+		if jsondoc.ID() != "" {
+			(*albums)[id] = couchdb.DocReference{
+				ID:   jsondoc.ID(),
+				Type: consts.PhotosAlbums,
+			}
+		}
+	}
+	return err
 }
 
 // AlbumReferences is used to associate photos to their albums, though we don't
@@ -218,6 +228,12 @@ func untar(r io.Reader, dst *vfs.DirDoc, instance *instance.Instance) error {
 
 	albumsRef := make(AlbumReferences)
 	dirs := make(map[string]*vfs.DirDoc)
+	contactsWriter := couchdb.NewBulkWriter(instance, consts.Contacts)
+	defer func() {
+		if errc := contactsWriter.Close(); errc != nil {
+			logger.WithDomain(instance.Domain).Errorf("Can't import contacts: %s", errc)
+		}
+	}()
 
 	for {
 		hdr, errb := tgz.Next()
@@ -272,7 +288,7 @@ func untar(r io.Reader, dst *vfs.DirDoc, instance *instance.Instance) error {
 					logger.WithDomain(instance.Domain).Errorf("Can't import album %s: %s", hdr.Name, err)
 				}
 			} else if doctype == "contacts" {
-				if err = createContact(fs, hdr, tgz, instance); err != nil {
+				if err = createContact(fs, hdr, tgz, contactsWriter); err != nil {
 					logger.WithDomain(instance.Domain).Errorf("Can't import contact %s: %s", hdr.Name, err)
 				}
 			} else if doctype == "files" {
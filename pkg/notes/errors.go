@@ -0,0 +1,22 @@
+package notes
+
+import "errors"
+
+var (
+	// ErrMissingTitle is returned when a note is created without a title
+	ErrMissingTitle = errors.New("The note must have a title")
+	// ErrVersionConflict is returned when the steps are sent for a version
+	// of the note that is not the current one
+	ErrVersionConflict = errors.New("The version of the note has changed")
+	// ErrTooOld is returned when the steps since a version are requested,
+	// but some of them have already been purged
+	ErrTooOld = errors.New("The version is too old")
+	// ErrInvalidStep is returned for a step with an unknown type
+	ErrInvalidStep = errors.New("Invalid step")
+	// ErrInvalidPosition is returned when a step has a position outside of
+	// the document
+	ErrInvalidPosition = errors.New("Invalid position in the document")
+	// ErrCannotApply is returned when a step can't be applied to the
+	// document
+	ErrCannotApply = errors.New("The step cannot be applied to the document")
+)
@@ -0,0 +1,172 @@
+package notes
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// markdownEscaper escapes the characters of the text that have a meaning in
+// markdown
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`*`, `\*`,
+	`_`, `\_`,
+	"`", "\\`",
+	`[`, `\[`,
+	`]`, `\]`,
+	`~`, `\~`,
+)
+
+// Markdown renders the document in the markdown format
+func Markdown(doc *Node) string {
+	buf := &bytes.Buffer{}
+	writeBlocks(buf, doc.Content, "\n\n")
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+func writeBlocks(buf *bytes.Buffer, blocks []*Node, separator string) {
+	for i, block := range blocks {
+		if i > 0 {
+			buf.WriteString(separator)
+		}
+		writeBlock(buf, block)
+	}
+}
+
+func writeBlock(buf *bytes.Buffer, node *Node) {
+	switch node.Type {
+	case "heading":
+		level := 1
+		if l, ok := node.Attrs["level"].(float64); ok && l >= 1 && l <= 6 {
+			level = int(l)
+		}
+		buf.WriteString(strings.Repeat("#", level) + " ")
+		writeInline(buf, node.Content)
+	case "code_block":
+		lang, _ := node.Attrs["language"].(string)
+		buf.WriteString("```" + lang + "\n")
+		for _, child := range node.Content {
+			buf.WriteString(child.Text)
+		}
+		buf.WriteString("\n```")
+	case "blockquote":
+		inner := &bytes.Buffer{}
+		writeBlocks(inner, node.Content, "\n\n")
+		buf.WriteString(indentLines(inner.String(), "> ", "> "))
+	case "bullet_list", "ordered_list":
+		order := 1
+		if o, ok := node.Attrs["order"].(float64); ok {
+			order = int(o)
+		}
+		for i, item := range node.Content {
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+			bullet := "- "
+			if node.Type == "ordered_list" {
+				bullet = fmt.Sprintf("%d. ", order+i)
+			}
+			inner := &bytes.Buffer{}
+			writeBlocks(inner, item.Content, "\n\n")
+			buf.WriteString(indentLines(inner.String(), bullet, strings.Repeat(" ", len(bullet))))
+		}
+	case "horizontal_rule":
+		buf.WriteString("---")
+	default:
+		if len(node.Content) > 0 && !node.Content[0].IsInline() {
+			writeBlocks(buf, node.Content, "\n\n")
+		} else {
+			writeInline(buf, node.Content)
+		}
+	}
+}
+
+// indentLines adds a prefix to the first line, and an indentation to the
+// other non-empty lines
+func indentLines(text, first, others string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		switch {
+		case i == 0:
+			lines[i] = first + line
+		case line != "":
+			lines[i] = others + line
+		case strings.TrimSpace(others) != "":
+			lines[i] = strings.TrimRight(others, " ")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// writeInline writes the inline content of a textblock. The marks are kept
+// opened between text nodes that share them.
+func writeInline(buf *bytes.Buffer, content []*Node) {
+	var active []Mark
+	closeMarks := func(keep int) {
+		for i := len(active) - 1; i >= keep; i-- {
+			buf.WriteString(closingMark(active[i]))
+		}
+		active = active[:keep]
+	}
+	for _, node := range content {
+		keep := 0
+		for keep < len(active) && keep < len(node.Marks) && active[keep].Eq(node.Marks[keep]) {
+			keep++
+		}
+		closeMarks(keep)
+		for _, mark := range node.Marks[keep:] {
+			buf.WriteString(openingMark(mark))
+			active = append(active, mark)
+		}
+		switch node.Type {
+		case "text":
+			if hasMark(node.Marks, "code") {
+				buf.WriteString(node.Text)
+			} else {
+				buf.WriteString(markdownEscaper.Replace(node.Text))
+			}
+		case "hard_break":
+			buf.WriteString("\\\n")
+		case "image":
+			src, _ := node.Attrs["src"].(string)
+			alt, _ := node.Attrs["alt"].(string)
+			buf.WriteString("![" + markdownEscaper.Replace(alt) + "](" + src + ")")
+		}
+	}
+	closeMarks(0)
+}
+
+func hasMark(marks []Mark, markType string) bool {
+	for _, m := range marks {
+		if m.Type == markType {
+			return true
+		}
+	}
+	return false
+}
+
+func openingMark(m Mark) string {
+	switch m.Type {
+	case "em":
+		return "_"
+	case "strong":
+		return "**"
+	case "code":
+		return "`"
+	case "strike":
+		return "~~"
+	case "link":
+		return "["
+	}
+	return ""
+}
+
+func closingMark(m Mark) string {
+	if m.Type == "link" {
+		href, _ := m.Attrs["href"].(string)
+		return "](" + href + ")"
+	}
+	return openingMark(m)
+}
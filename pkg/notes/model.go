@@ -0,0 +1,348 @@
+package notes
+
+import (
+	"reflect"
+	"unicode/utf16"
+)
+
+// leafTypes are the types of nodes that have no content (the text nodes
+// excepted)
+var leafTypes = map[string]bool{
+	"horizontal_rule": true,
+	"hard_break":      true,
+	"image":           true,
+}
+
+// inlineTypes are the types of nodes that are inside a textblock
+var inlineTypes = map[string]bool{
+	"text":       true,
+	"hard_break": true,
+	"image":      true,
+}
+
+// contentGroups are used to know if two types of nodes have a compatible
+// content, and can be joined
+var contentGroups = map[string]string{
+	"paragraph":    "inline",
+	"heading":      "inline",
+	"code_block":   "inline",
+	"bullet_list":  "list",
+	"ordered_list": "list",
+}
+
+// noMarkTypes are the types of nodes where the inline content can't have
+// marks
+var noMarkTypes = map[string]bool{
+	"code_block": true,
+}
+
+// Mark is a piece of information attached to inline content, like the
+// emphasis or a link.
+type Mark struct {
+	Type  string                 `json:"type"`
+	Attrs map[string]interface{} `json:"attrs,omitempty"`
+}
+
+// markRanks gives the order of the marks in a set of marks
+var markRanks = map[string]int{
+	"link":   0,
+	"em":     1,
+	"strong": 2,
+	"code":   3,
+	"strike": 4,
+}
+
+func markRank(m Mark) int {
+	if rank, ok := markRanks[m.Type]; ok {
+		return rank
+	}
+	return len(markRanks)
+}
+
+// Eq returns true if the two marks have the same type and attributes
+func (m Mark) Eq(other Mark) bool {
+	if m.Type != other.Type {
+		return false
+	}
+	if len(m.Attrs) == 0 && len(other.Attrs) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(m.Attrs, other.Attrs)
+}
+
+// addToSet returns a set of marks with this mark added. A mark of the same
+// type is replaced.
+func (m Mark) addToSet(set []Mark) []Mark {
+	var result []Mark
+	placed := false
+	for _, other := range set {
+		if other.Type == m.Type {
+			continue
+		}
+		if !placed && markRank(other) > markRank(m) {
+			result = append(result, m)
+			placed = true
+		}
+		result = append(result, other)
+	}
+	if !placed {
+		result = append(result, m)
+	}
+	return result
+}
+
+// removeFromSet returns a set of marks without this mark
+func (m Mark) removeFromSet(set []Mark) []Mark {
+	var result []Mark
+	for _, other := range set {
+		if !m.Eq(other) {
+			result = append(result, other)
+		}
+	}
+	return result
+}
+
+func sameMarks(a, b []Mark) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Eq(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Node is a node of a document, in the JSON format used by ProseMirror. The
+// document itself is a node of type doc.
+type Node struct {
+	Type    string                 `json:"type"`
+	Attrs   map[string]interface{} `json:"attrs,omitempty"`
+	Content []*Node                `json:"content,omitempty"`
+	Text    string                 `json:"text,omitempty"`
+	Marks   []Mark                 `json:"marks,omitempty"`
+}
+
+// NewDocument returns an empty document, with just an empty paragraph
+func NewDocument() *Node {
+	return &Node{Type: "doc", Content: []*Node{{Type: "paragraph"}}}
+}
+
+// IsText returns true for the text nodes
+func (n *Node) IsText() bool { return n.Type == "text" }
+
+// IsLeaf returns true for the nodes that can't have content
+func (n *Node) IsLeaf() bool { return n.IsText() || leafTypes[n.Type] }
+
+// IsInline returns true for the nodes that are inside a textblock
+func (n *Node) IsInline() bool { return inlineTypes[n.Type] }
+
+// textLen is the length of the text, in UTF-16 code units, as the positions
+// are computed by the editor in javascript.
+func (n *Node) textLen() int { return len(utf16.Encode([]rune(n.Text))) }
+
+// NodeSize returns the size of the node: the length of the text for a text
+// node, 1 for the other leaves, and the size of the content plus 2 (for the
+// opening and closing tokens) for the other nodes.
+func (n *Node) NodeSize() int {
+	if n.IsText() {
+		return n.textLen()
+	}
+	if n.IsLeaf() {
+		return 1
+	}
+	return fragmentSize(n.Content) + 2
+}
+
+// ContentSize returns the size of the content of the node
+func (n *Node) ContentSize() int { return fragmentSize(n.Content) }
+
+// copyWith returns a node with the same markup, but with another content
+func (n *Node) copyWith(content []*Node) *Node {
+	return &Node{Type: n.Type, Attrs: n.Attrs, Content: content, Marks: n.Marks}
+}
+
+func (n *Node) withText(text string) *Node {
+	return &Node{Type: n.Type, Attrs: n.Attrs, Text: text, Marks: n.Marks}
+}
+
+func (n *Node) withMarks(marks []Mark) *Node {
+	return &Node{Type: n.Type, Attrs: n.Attrs, Content: n.Content, Text: n.Text, Marks: marks}
+}
+
+func (n *Node) sameMarkup(other *Node) bool {
+	return n.Type == other.Type &&
+		reflect.DeepEqual(n.Attrs, other.Attrs) &&
+		sameMarks(n.Marks, other.Marks)
+}
+
+// compatibleContent returns true if the content of the two nodes can be
+// joined
+func (n *Node) compatibleContent(other *Node) bool {
+	if n.Type == other.Type {
+		return true
+	}
+	group, ok := contentGroups[n.Type]
+	return ok && group == contentGroups[other.Type]
+}
+
+// cut returns the part of the node between the given positions, relative to
+// the start of its content (or of its text).
+func (n *Node) cut(from, to int) *Node {
+	if n.IsText() {
+		units := utf16.Encode([]rune(n.Text))
+		if from == 0 && to == len(units) {
+			return n
+		}
+		return n.withText(string(utf16.Decode(units[from:to])))
+	}
+	if from == 0 && to == n.ContentSize() {
+		return n
+	}
+	return n.copyWith(fragmentCut(n.Content, from, to))
+}
+
+func fragmentSize(content []*Node) int {
+	size := 0
+	for _, child := range content {
+		size += child.NodeSize()
+	}
+	return size
+}
+
+// addNode adds a node at the end of a fragment, and joins it with the
+// previous node if they are both text nodes with the same marks.
+func addNode(content []*Node, child *Node) []*Node {
+	last := len(content) - 1
+	if last >= 0 && child.IsText() && child.sameMarkup(content[last]) {
+		content[last] = child.withText(content[last].Text + child.Text)
+		return content
+	}
+	return append(content, child)
+}
+
+// fragmentAppend returns a new fragment with the two fragments joined
+func fragmentAppend(a, b []*Node) []*Node {
+	content := make([]*Node, 0, len(a)+len(b))
+	for _, child := range a {
+		content = append(content, child)
+	}
+	for _, child := range b {
+		content = addNode(content, child)
+	}
+	return content
+}
+
+// fragmentCut returns the part of the fragment between the two positions
+func fragmentCut(content []*Node, from, to int) []*Node {
+	var result []*Node
+	if to <= from {
+		return result
+	}
+	pos := 0
+	for _, child := range content {
+		if pos >= to {
+			break
+		}
+		end := pos + child.NodeSize()
+		if end > from {
+			if pos < from || end > to {
+				if child.IsText() {
+					child = child.cut(maxInt(0, from-pos), minInt(child.textLen(), to-pos))
+				} else {
+					child = child.cut(maxInt(0, from-pos-1), minInt(child.ContentSize(), to-pos-1))
+				}
+			}
+			result = append(result, child)
+		}
+		pos = end
+	}
+	return result
+}
+
+// fragmentReplaceChild returns a fragment where the child at the given index
+// has been replaced
+func fragmentReplaceChild(content []*Node, index int, node *Node) []*Node {
+	result := make([]*Node, len(content))
+	copy(result, content)
+	result[index] = node
+	return result
+}
+
+// findIndex finds the index of the child at the given position, and the
+// position of the start of this child. If the position is at the end of a
+// child, the index of the next child is returned.
+func findIndex(content []*Node, pos int) (int, int, error) {
+	if pos == 0 {
+		return 0, 0, nil
+	}
+	size := fragmentSize(content)
+	if pos == size {
+		return len(content), size, nil
+	}
+	if pos < 0 || pos > size {
+		return 0, 0, ErrInvalidPosition
+	}
+	cur := 0
+	for i, child := range content {
+		end := cur + child.NodeSize()
+		if end >= pos {
+			if end == pos {
+				return i + 1, end, nil
+			}
+			return i, cur, nil
+		}
+		cur = end
+	}
+	return 0, 0, ErrInvalidPosition
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Slice is a piece of document, that can be open on its sides: the nodes on
+// the edges can be partial.
+type Slice struct {
+	Content   []*Node `json:"content,omitempty"`
+	OpenStart int     `json:"openStart,omitempty"`
+	OpenEnd   int     `json:"openEnd,omitempty"`
+}
+
+func (s *Slice) size() int {
+	if s == nil {
+		return 0
+	}
+	return fragmentSize(s.Content) - s.OpenStart - s.OpenEnd
+}
+
+// slice returns the slice of the document between the two positions
+func (n *Node) slice(from, to int) (*Slice, error) {
+	if from == to {
+		return &Slice{}, nil
+	}
+	rfrom, err := resolve(n, from)
+	if err != nil {
+		return nil, err
+	}
+	rto, err := resolve(n, to)
+	if err != nil {
+		return nil, err
+	}
+	depth := rfrom.sharedDepth(to)
+	start := rfrom.start(depth)
+	node := rfrom.node(depth)
+	content := fragmentCut(node.Content, rfrom.pos-start, rto.pos-start)
+	return &Slice{Content: content, OpenStart: rfrom.depth - depth, OpenEnd: rto.depth - depth}, nil
+}
@@ -0,0 +1,475 @@
+// Package notes is for the notes (io.cozy.notes) that can be edited by
+// several persons at the same time. The documents of the notes follow the
+// format of ProseMirror, and the editors send steps to the stack that applies
+// them to the document. The notes are also rendered as markdown files in the
+// VFS.
+package notes
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// DefaultDirPath is the directory where the markdown files of the notes are
+// put when no directory is given
+const DefaultDirPath = "/Notes"
+
+// saveDebounce is the delay between the modification of a note and the
+// update of its markdown file
+const saveDebounce = "3m"
+
+// stepsToKeep is the number of steps that are kept after the markdown file
+// of a note has been saved, for the editors that are a bit late
+const stepsToKeep = 100
+
+// maxStepsVersion is used as the end key for fetching the steps of a note
+const maxStepsVersion = "\uffff"
+
+// Note is the document of a note. Its content is a tree of nodes, in the
+// format used by ProseMirror. The nodes are never modified in place: applying
+// a step creates new nodes for the modified branches.
+type Note struct {
+	DocID        string    `json:"_id,omitempty"`
+	DocRev       string    `json:"_rev,omitempty"`
+	Title        string    `json:"title"`
+	Content      *Node     `json:"content"`
+	Version      int64     `json:"version"`
+	FileID       string    `json:"file_id,omitempty"`
+	SavedVersion int64     `json:"saved_version"`
+	TriggerID    string    `json:"trigger_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ID returns the note qualified identifier
+func (n *Note) ID() string { return n.DocID }
+
+// Rev returns the note revision
+func (n *Note) Rev() string { return n.DocRev }
+
+// DocType returns the note document type
+func (n *Note) DocType() string { return consts.Notes }
+
+// Clone implements couchdb.Doc
+func (n *Note) Clone() couchdb.Doc {
+	cloned := *n
+	return &cloned
+}
+
+// SetID changes the note qualified identifier
+func (n *Note) SetID(id string) { n.DocID = id }
+
+// SetRev changes the note revision
+func (n *Note) SetRev(rev string) { n.DocRev = rev }
+
+// Event is sent via the realtime to the editors of a note when some steps
+// have been applied, or when its title has changed. Its identifier is the
+// one of the note, so that the editors can watch it.
+type Event struct {
+	NoteID    string  `json:"_id"`
+	SessionID string  `json:"sessionID,omitempty"`
+	Version   int64   `json:"version,omitempty"`
+	Steps     []*Step `json:"steps,omitempty"`
+	Title     string  `json:"title,omitempty"`
+}
+
+// ID implements realtime.Doc
+func (e *Event) ID() string { return e.NoteID }
+
+// DocType implements realtime.Doc
+func (e *Event) DocType() string { return consts.NotesEvents }
+
+// SaveMessage is the message of the notes-save jobs
+type SaveMessage struct {
+	NoteID string `json:"note_id"`
+}
+
+// Create creates a new note, with an empty document, and its markdown file
+// in the given directory (or in the default directory for notes).
+func Create(inst *instance.Instance, title, dirID string) (*Note, error) {
+	if title == "" {
+		return nil, ErrMissingTitle
+	}
+	fs := inst.VFS()
+	if dirID == "" {
+		dir, err := vfs.MkdirAll(fs, DefaultDirPath)
+		if err != nil {
+			return nil, err
+		}
+		dirID = dir.ID()
+	} else if _, err := fs.DirByID(dirID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	n := &Note{
+		Title:     title,
+		Content:   NewDocument(),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := couchdb.CreateDoc(inst, n); err != nil {
+		return nil, err
+	}
+	if err := n.writeMarkdown(inst, dirID); err != nil {
+		return nil, err
+	}
+	if err := n.addSaveTrigger(inst); err != nil {
+		return nil, err
+	}
+	if err := couchdb.UpdateDoc(inst, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// addSaveTrigger creates the trigger that will update the markdown file when
+// the note is modified
+func (n *Note) addSaveTrigger(inst *instance.Instance) error {
+	t, err := jobs.NewTrigger(inst, jobs.TriggerInfos{
+		Type:       "@event",
+		WorkerType: "notes-save",
+		Arguments:  consts.Notes + ":UPDATED:" + n.DocID,
+		Debounce:   saveDebounce,
+	}, &SaveMessage{NoteID: n.DocID})
+	if err != nil {
+		return err
+	}
+	if err = jobs.System().AddTrigger(t); err != nil {
+		return err
+	}
+	n.TriggerID = t.ID()
+	return nil
+}
+
+// fileName returns the name of the markdown file for the note
+func (n *Note) fileName() string {
+	name := strings.Replace(n.Title, "/", "_", -1)
+	return name + ".md"
+}
+
+// writeMarkdown writes the document of the note to its markdown file. The
+// file is created in the given directory if it doesn't exist yet, or if it
+// has been deleted.
+func (n *Note) writeMarkdown(inst *instance.Instance, dirID string) error {
+	fs := inst.VFS()
+	content := []byte(Markdown(n.Content))
+	var olddoc *vfs.FileDoc
+	if n.FileID != "" {
+		doc, err := fs.FileByID(n.FileID)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && !doc.Trashed {
+			olddoc = doc
+		}
+	}
+
+	var file vfs.File
+	var newdoc *vfs.FileDoc
+	if olddoc != nil {
+		var err error
+		newdoc, err = vfs.NewFileDoc(olddoc.DocName, olddoc.DirID, int64(len(content)), nil,
+			olddoc.Mime, olddoc.Class, time.Now(), olddoc.Executable, false, olddoc.Tags)
+		if err != nil {
+			return err
+		}
+		newdoc.ReferencedBy = olddoc.ReferencedBy
+		newdoc.Favorite = olddoc.Favorite
+		if file, err = fs.CreateFile(newdoc, olddoc); err != nil {
+			return err
+		}
+	} else {
+		if dirID == "" {
+			dir, err := vfs.MkdirAll(fs, DefaultDirPath)
+			if err != nil {
+				return err
+			}
+			dirID = dir.ID()
+		}
+		base := strings.TrimSuffix(n.fileName(), ".md")
+		for i := 1; ; i++ {
+			name := n.fileName()
+			if i > 1 {
+				name = fmt.Sprintf("%s (%d).md", base, i)
+			}
+			var err error
+			newdoc, err = vfs.NewFileDoc(name, dirID, int64(len(content)), nil,
+				"text/markdown", "text", time.Now(), false, false, nil)
+			if err != nil {
+				return err
+			}
+			file, err = fs.CreateFile(newdoc, nil)
+			if os.IsExist(err) && i < 100 {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	if _, err := file.Write(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if olddoc == nil {
+		n.FileID = newdoc.ID()
+	}
+	return nil
+}
+
+// Find returns the note stored in database from a given ID
+func Find(db prefixer.Prefixer, noteID string) (*Note, error) {
+	doc := &Note{}
+	err := couchdb.GetDoc(db, consts.Notes, noteID, doc)
+	return doc, err
+}
+
+// GetAll returns all the notes stored in database
+func GetAll(db couchdb.Database) ([]*Note, error) {
+	var list []*Note
+	err := couchdb.ForeachDocs(db, consts.Notes, func(_ string, raw json.RawMessage) error {
+		var n Note
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return err
+		}
+		list = append(list, &n)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ApplySteps applies the steps sent by an editor to the given version of the
+// note. The steps are saved with their versions, and sent to the other
+// editors via the realtime. ErrVersionConflict is returned if the note has
+// been modified since this version: the editor must fetch the missing steps
+// and rebase its own steps on them before sending them again.
+func ApplySteps(inst *instance.Instance, noteID, sessionID string, version int64, steps []*Step) (*Note, error) {
+	mu := lock.ReadWrite(inst, "notes/"+noteID)
+	if err := mu.Lock(); err != nil {
+		return nil, err
+	}
+	defer mu.Unlock()
+
+	n, err := Find(inst, noteID)
+	if err != nil {
+		return nil, err
+	}
+	if n.Version != version {
+		return nil, ErrVersionConflict
+	}
+	if len(steps) == 0 {
+		return n, nil
+	}
+
+	doc := n.Content
+	for _, s := range steps {
+		if doc, err = s.Apply(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	for _, s := range steps {
+		n.Version++
+		s.DocID = stepID(n.DocID, n.Version)
+		s.DocRev = ""
+		s.NoteID = n.DocID
+		s.Version = n.Version
+		s.SessionID = sessionID
+		s.CreatedAt = now
+		if err = couchdb.CreateNamedDocWithDB(inst, s); err != nil {
+			if couchdb.IsConflictError(err) {
+				return nil, ErrVersionConflict
+			}
+			return nil, err
+		}
+	}
+	n.Content = doc
+	n.UpdatedAt = now
+	if err = couchdb.UpdateDoc(inst, n); err != nil {
+		return nil, err
+	}
+
+	realtime.GetHub().Publish(inst, realtime.EventUpdate, &Event{
+		NoteID:    n.DocID,
+		SessionID: sessionID,
+		Version:   n.Version,
+		Steps:     steps,
+	}, nil)
+	return n, nil
+}
+
+// GetSteps returns the steps of the note that have been applied after the
+// given version. ErrTooOld is returned if some of these steps have been
+// purged: the editor must reload the whole document.
+func GetSteps(db couchdb.Database, n *Note, since int64) ([]*Step, error) {
+	if since > n.Version {
+		return nil, ErrInvalidPosition
+	}
+	var steps []*Step
+	if since == n.Version {
+		return steps, nil
+	}
+	req := &couchdb.AllDocsRequest{
+		StartKey: stepID(n.DocID, since+1),
+		EndKey:   n.DocID + "/" + maxStepsVersion,
+	}
+	if err := couchdb.GetAllDocs(db, consts.NotesSteps, req, &steps); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, ErrTooOld
+		}
+		return nil, err
+	}
+	if len(steps) == 0 || steps[0].Version != since+1 {
+		return nil, ErrTooOld
+	}
+	return steps, nil
+}
+
+// SetTitle changes the title of the note. The markdown file is renamed when
+// it is saved.
+func SetTitle(inst *instance.Instance, n *Note, sessionID, title string) error {
+	if title == "" {
+		return ErrMissingTitle
+	}
+	n.Title = title
+	n.UpdatedAt = time.Now()
+	if err := couchdb.UpdateDoc(inst, n); err != nil {
+		return err
+	}
+	realtime.GetHub().Publish(inst, realtime.EventUpdate, &Event{
+		NoteID:    n.DocID,
+		SessionID: sessionID,
+		Title:     title,
+	}, nil)
+	return nil
+}
+
+// Save writes the note to its markdown file, if it has been modified since
+// the last save, and purges the old steps.
+func Save(inst *instance.Instance, noteID string) error {
+	mu := lock.ReadWrite(inst, "notes/"+noteID)
+	if err := mu.Lock(); err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
+	n, err := Find(inst, noteID)
+	if err != nil {
+		return err
+	}
+	if err = n.rename(inst); err != nil {
+		return err
+	}
+	if n.Version == n.SavedVersion {
+		return nil
+	}
+	if err = n.writeMarkdown(inst, ""); err != nil {
+		return err
+	}
+	n.SavedVersion = n.Version
+	if err = couchdb.UpdateDoc(inst, n); err != nil {
+		return err
+	}
+	return n.purgeSteps(inst, n.SavedVersion-stepsToKeep)
+}
+
+// rename renames the markdown file if the title of the note has changed.
+// The file keeps its name if there is already a file with the new name.
+func (n *Note) rename(inst *instance.Instance) error {
+	if n.FileID == "" {
+		return nil
+	}
+	fs := inst.VFS()
+	doc, err := fs.FileByID(n.FileID)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	name := n.fileName()
+	if doc.Trashed || doc.DocName == name {
+		return nil
+	}
+	_, err = vfs.ModifyFileMetadata(fs, doc, &vfs.DocPatch{Name: &name})
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+// purgeSteps deletes the steps of the note up to the given version
+func (n *Note) purgeSteps(db couchdb.Database, upTo int64) error {
+	if upTo < 1 {
+		return nil
+	}
+	var steps []*Step
+	req := &couchdb.AllDocsRequest{
+		StartKey: stepID(n.DocID, 0),
+		EndKey:   stepID(n.DocID, upTo),
+	}
+	if err := couchdb.GetAllDocs(db, consts.NotesSteps, req, &steps); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
+		return err
+	}
+	if len(steps) == 0 {
+		return nil
+	}
+	docs := make([]couchdb.Doc, len(steps))
+	for i, s := range steps {
+		docs[i] = s
+	}
+	return couchdb.BulkDeleteDocs(db, consts.NotesSteps, docs)
+}
+
+// Delete removes the note, with its steps and its trigger. Its markdown file
+// is moved to the trash.
+func Delete(inst *instance.Instance, n *Note) error {
+	if n.TriggerID != "" {
+		err := jobs.System().DeleteTrigger(inst, n.TriggerID)
+		if err != nil && err != jobs.ErrNotFoundTrigger {
+			return err
+		}
+	}
+	if err := n.purgeSteps(inst, n.Version); err != nil {
+		return err
+	}
+	if n.FileID != "" {
+		fs := inst.VFS()
+		doc, err := fs.FileByID(n.FileID)
+		if err == nil && !doc.Trashed {
+			if _, err = vfs.TrashFile(fs, doc); err != nil {
+				return err
+			}
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return couchdb.DeleteDoc(inst, n)
+}
+
+var _ couchdb.Doc = &Note{}
+var _ couchdb.Doc = &Step{}
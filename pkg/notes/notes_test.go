@@ -0,0 +1,116 @@
+package notes
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseSteps(t *testing.T, raw string) []*Step {
+	var steps []*Step
+	if !assert.NoError(t, json.Unmarshal([]byte(raw), &steps)) {
+		t.FailNow()
+	}
+	return steps
+}
+
+func applySteps(t *testing.T, doc *Node, raw string) *Node {
+	for _, s := range parseSteps(t, raw) {
+		var err error
+		doc, err = s.Apply(doc)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	return doc
+}
+
+func TestInsertAndSplit(t *testing.T) {
+	doc := applySteps(t, NewDocument(), `[
+		{"stepType": "replace", "from": 1, "to": 1, "slice": {"content": [{"type": "text", "text": "Hello"}]}},
+		{"stepType": "replace", "from": 6, "to": 6, "slice": {"content": [{"type": "text", "text": " world"}]}}
+	]`)
+	assert.Equal(t, 13, doc.ContentSize())
+	if assert.Len(t, doc.Content, 1) && assert.Len(t, doc.Content[0].Content, 1) {
+		assert.Equal(t, "Hello world", doc.Content[0].Content[0].Text)
+	}
+
+	// Press enter after "He"
+	doc = applySteps(t, doc, `[{"stepType": "replace", "from": 3, "to": 3, "slice": {
+		"content": [{"type": "paragraph"}, {"type": "paragraph"}],
+		"openStart": 1, "openEnd": 1
+	}}]`)
+	if assert.Len(t, doc.Content, 2) {
+		assert.Equal(t, "He", doc.Content[0].Content[0].Text)
+		assert.Equal(t, "llo world", doc.Content[1].Content[0].Text)
+	}
+
+	// And backspace to join the paragraphs again
+	doc = applySteps(t, doc, `[{"stepType": "replace", "from": 3, "to": 5}]`)
+	if assert.Len(t, doc.Content, 1) && assert.Len(t, doc.Content[0].Content, 1) {
+		assert.Equal(t, "Hello world", doc.Content[0].Content[0].Text)
+	}
+}
+
+func TestMarks(t *testing.T) {
+	doc := applySteps(t, NewDocument(), `[
+		{"stepType": "replace", "from": 1, "to": 1, "slice": {"content": [{"type": "text", "text": "Hello world"}]}},
+		{"stepType": "addMark", "from": 1, "to": 6, "mark": {"type": "strong"}},
+		{"stepType": "addMark", "from": 3, "to": 9, "mark": {"type": "em"}}
+	]`)
+	assert.Equal(t, "**He**_**llo** wo_rld\n", Markdown(doc))
+
+	doc = applySteps(t, doc, `[{"stepType": "removeMark", "from": 1, "to": 12, "mark": {"type": "em"}}]`)
+	assert.Equal(t, "**Hello** world\n", Markdown(doc))
+	assert.Len(t, doc.Content[0].Content, 2)
+}
+
+func TestReplaceAround(t *testing.T) {
+	doc := applySteps(t, NewDocument(), `[
+		{"stepType": "replace", "from": 1, "to": 1, "slice": {"content": [{"type": "text", "text": "Quote"}]}},
+		{"stepType": "replaceAround", "from": 0, "to": 7, "gapFrom": 0, "gapTo": 7, "insert": 1,
+		 "slice": {"content": [{"type": "blockquote"}]}, "structure": true}
+	]`)
+	if assert.Len(t, doc.Content, 1) {
+		assert.Equal(t, "blockquote", doc.Content[0].Type)
+	}
+	assert.Equal(t, "> Quote\n", Markdown(doc))
+}
+
+func TestInvalidSteps(t *testing.T) {
+	doc := NewDocument()
+	_, err := parseSteps(t, `[{"stepType": "replace", "from": 10, "to": 10}]`)[0].Apply(doc)
+	assert.Equal(t, ErrInvalidPosition, err)
+	_, err = parseSteps(t, `[{"stepType": "unknown", "from": 1, "to": 1}]`)[0].Apply(doc)
+	assert.Equal(t, ErrInvalidStep, err)
+	_, err = parseSteps(t, `[{"stepType": "replace", "from": 1, "to": 1, "slice": {
+		"content": [{"type": "paragraph"}], "openStart": 3
+	}}]`)[0].Apply(doc)
+	assert.Equal(t, ErrCannotApply, err)
+}
+
+func TestMarkdown(t *testing.T) {
+	var doc Node
+	err := json.Unmarshal([]byte(`{"type": "doc", "content": [
+		{"type": "heading", "attrs": {"level": 2}, "content": [{"type": "text", "text": "Title"}]},
+		{"type": "paragraph", "content": [
+			{"type": "text", "text": "A "},
+			{"type": "text", "text": "link", "marks": [{"type": "link", "attrs": {"href": "https://cozy.io/"}}]},
+			{"type": "text", "text": " and some *stars*"}
+		]},
+		{"type": "bullet_list", "content": [
+			{"type": "list_item", "content": [{"type": "paragraph", "content": [{"type": "text", "text": "one"}]}]},
+			{"type": "list_item", "content": [{"type": "paragraph", "content": [{"type": "text", "text": "two"}]}]}
+		]},
+		{"type": "code_block", "attrs": {"language": "go"}, "content": [{"type": "text", "text": "x := 1"}]},
+		{"type": "horizontal_rule"}
+	]}`), &doc)
+	assert.NoError(t, err)
+	expected := "## Title\n\n" +
+		"A [link](https://cozy.io/) and some \\*stars\\*\n\n" +
+		"- one\n- two\n\n" +
+		"```go\nx := 1\n```\n\n" +
+		"---\n"
+	assert.Equal(t, expected, Markdown(&doc))
+}
@@ -0,0 +1,291 @@
+package notes
+
+// pathEntry is an ancestor of a resolved position: the node, the index of
+// the child where the position is, and the position of the start of this
+// child.
+type pathEntry struct {
+	node   *Node
+	index  int
+	offset int
+}
+
+// resolvedPos is a position in a document, with the information about its
+// ancestors. It is the equivalent of ResolvedPos in ProseMirror.
+type resolvedPos struct {
+	pos          int
+	path         []pathEntry
+	depth        int
+	parentOffset int
+}
+
+// resolve computes the ancestors of a position in a node
+func resolve(doc *Node, pos int) (*resolvedPos, error) {
+	if pos < 0 || pos > doc.ContentSize() {
+		return nil, ErrInvalidPosition
+	}
+	var path []pathEntry
+	start := 0
+	parentOffset := pos
+	node := doc
+	for {
+		index, offset, err := findIndex(node.Content, parentOffset)
+		if err != nil {
+			return nil, err
+		}
+		rem := parentOffset - offset
+		path = append(path, pathEntry{node: node, index: index, offset: start + offset})
+		if rem == 0 {
+			break
+		}
+		node = node.Content[index]
+		if node.IsText() {
+			break
+		}
+		parentOffset = rem - 1
+		start += offset + 1
+	}
+	return &resolvedPos{
+		pos:          pos,
+		path:         path,
+		depth:        len(path) - 1,
+		parentOffset: parentOffset,
+	}, nil
+}
+
+func (r *resolvedPos) node(depth int) *Node { return r.path[depth].node }
+func (r *resolvedPos) index(depth int) int  { return r.path[depth].index }
+func (r *resolvedPos) parent() *Node        { return r.node(r.depth) }
+
+// indexAfter returns the index pointing after this position in the ancestor
+// at the given depth
+func (r *resolvedPos) indexAfter(depth int) int {
+	if depth == r.depth && r.textOffset() == 0 {
+		return r.index(depth)
+	}
+	return r.index(depth) + 1
+}
+
+// start returns the position of the start of the ancestor at the given depth
+func (r *resolvedPos) start(depth int) int {
+	if depth == 0 {
+		return 0
+	}
+	return r.path[depth-1].offset + 1
+}
+
+// end returns the position of the end of the ancestor at the given depth
+func (r *resolvedPos) end(depth int) int {
+	return r.start(depth) + r.node(depth).ContentSize()
+}
+
+// textOffset is the offset of the position inside a text node, or 0
+func (r *resolvedPos) textOffset() int {
+	return r.pos - r.path[len(r.path)-1].offset
+}
+
+// nodeAfter returns the node just after the position, or nil
+func (r *resolvedPos) nodeAfter() *Node {
+	parent := r.parent()
+	index := r.index(r.depth)
+	if index == len(parent.Content) {
+		return nil
+	}
+	child := parent.Content[index]
+	if off := r.textOffset(); off > 0 {
+		return child.cut(off, child.textLen())
+	}
+	return child
+}
+
+// nodeBefore returns the node just before the position, or nil
+func (r *resolvedPos) nodeBefore() *Node {
+	parent := r.parent()
+	index := r.index(r.depth)
+	if off := r.textOffset(); off > 0 {
+		return parent.Content[index].cut(0, off)
+	}
+	if index == 0 {
+		return nil
+	}
+	return parent.Content[index-1]
+}
+
+// sharedDepth returns the depth of the deepest ancestor that contains both
+// this position and the given one
+func (r *resolvedPos) sharedDepth(pos int) int {
+	for depth := r.depth; depth > 0; depth-- {
+		if r.start(depth) <= pos && r.end(depth) >= pos {
+			return depth
+		}
+	}
+	return 0
+}
+
+// replace replaces the content of the document between two positions by a
+// slice. It follows the algorithm of ProseMirror, where the open nodes of
+// the slice are joined with the nodes around the positions.
+func replace(rfrom, rto *resolvedPos, slice *Slice) (*Node, error) {
+	if slice.OpenStart > rfrom.depth {
+		return nil, ErrCannotApply
+	}
+	if rfrom.depth-slice.OpenStart != rto.depth-slice.OpenEnd {
+		return nil, ErrCannotApply
+	}
+	return replaceOuter(rfrom, rto, slice, 0)
+}
+
+func replaceOuter(rfrom, rto *resolvedPos, slice *Slice, depth int) (*Node, error) {
+	index := rfrom.index(depth)
+	node := rfrom.node(depth)
+	if index == rto.index(depth) && depth < rfrom.depth-slice.OpenStart {
+		inner, err := replaceOuter(rfrom, rto, slice, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return node.copyWith(fragmentReplaceChild(node.Content, index, inner)), nil
+	}
+	if len(slice.Content) == 0 {
+		content, err := replaceTwoWay(rfrom, rto, depth)
+		if err != nil {
+			return nil, err
+		}
+		return node.copyWith(content), nil
+	}
+	if slice.OpenStart == 0 && slice.OpenEnd == 0 && rfrom.depth == depth && rto.depth == depth {
+		parent := rfrom.parent()
+		before := fragmentCut(parent.Content, 0, rfrom.parentOffset)
+		after := fragmentCut(parent.Content, rto.parentOffset, parent.ContentSize())
+		return parent.copyWith(fragmentAppend(fragmentAppend(before, slice.Content), after)), nil
+	}
+	start, end, err := prepareSliceForReplace(slice, rfrom)
+	if err != nil {
+		return nil, err
+	}
+	content, err := replaceThreeWay(rfrom, start, end, rto, depth)
+	if err != nil {
+		return nil, err
+	}
+	return node.copyWith(content), nil
+}
+
+func joinable(before, after *resolvedPos, depth int) (*Node, error) {
+	node := before.node(depth)
+	if !after.node(depth).compatibleContent(node) {
+		return nil, ErrCannotApply
+	}
+	return node, nil
+}
+
+// addRange adds to the target the children of the ancestor at the given
+// depth that are between the two positions (nil means the edge).
+func addRange(start, end *resolvedPos, depth int, target []*Node) []*Node {
+	var node *Node
+	if end != nil {
+		node = end.node(depth)
+	} else {
+		node = start.node(depth)
+	}
+	startIndex := 0
+	endIndex := len(node.Content)
+	if end != nil {
+		endIndex = end.index(depth)
+	}
+	if start != nil {
+		startIndex = start.index(depth)
+		if start.depth > depth {
+			startIndex++
+		} else if start.textOffset() > 0 {
+			target = addNode(target, start.nodeAfter())
+			startIndex++
+		}
+	}
+	for i := startIndex; i < endIndex; i++ {
+		target = addNode(target, node.Content[i])
+	}
+	if end != nil && end.depth == depth && end.textOffset() > 0 {
+		target = addNode(target, end.nodeBefore())
+	}
+	return target
+}
+
+func replaceThreeWay(rfrom, start, end, rto *resolvedPos, depth int) ([]*Node, error) {
+	var openStart, openEnd *Node
+	var err error
+	if rfrom.depth > depth {
+		if openStart, err = joinable(rfrom, start, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	if rto.depth > depth {
+		if openEnd, err = joinable(end, rto, depth+1); err != nil {
+			return nil, err
+		}
+	}
+
+	content := addRange(nil, rfrom, depth, nil)
+	if openStart != nil && openEnd != nil && start.index(depth) == end.index(depth) {
+		if !openStart.compatibleContent(openEnd) {
+			return nil, ErrCannotApply
+		}
+		inner, err := replaceThreeWay(rfrom, start, end, rto, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		content = addNode(content, openStart.copyWith(inner))
+	} else {
+		if openStart != nil {
+			inner, err := replaceTwoWay(rfrom, start, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			content = addNode(content, openStart.copyWith(inner))
+		}
+		content = addRange(start, end, depth, content)
+		if openEnd != nil {
+			inner, err := replaceTwoWay(end, rto, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			content = addNode(content, openEnd.copyWith(inner))
+		}
+	}
+	content = addRange(rto, nil, depth, content)
+	return content, nil
+}
+
+func replaceTwoWay(rfrom, rto *resolvedPos, depth int) ([]*Node, error) {
+	content := addRange(nil, rfrom, depth, nil)
+	if rfrom.depth > depth {
+		node, err := joinable(rfrom, rto, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		inner, err := replaceTwoWay(rfrom, rto, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		content = addNode(content, node.copyWith(inner))
+	}
+	content = addRange(rto, nil, depth, content)
+	return content, nil
+}
+
+// prepareSliceForReplace wraps the content of the slice in the ancestors of
+// the position, and returns the positions of the start and of the end of the
+// slice in this new node.
+func prepareSliceForReplace(slice *Slice, along *resolvedPos) (*resolvedPos, *resolvedPos, error) {
+	extra := along.depth - slice.OpenStart
+	node := along.node(extra).copyWith(slice.Content)
+	for i := extra - 1; i >= 0; i-- {
+		node = along.node(i).copyWith([]*Node{node})
+	}
+	start, err := resolve(node, slice.OpenStart+extra)
+	if err != nil {
+		return nil, nil, err
+	}
+	end, err := resolve(node, node.ContentSize()-slice.OpenEnd-extra)
+	if err != nil {
+		return nil, nil, err
+	}
+	return start, end, nil
+}
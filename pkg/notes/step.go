@@ -0,0 +1,213 @@
+package notes
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// The types of steps that can be applied to a note
+const (
+	StepReplace       = "replace"
+	StepReplaceAround = "replaceAround"
+	StepAddMark       = "addMark"
+	StepRemoveMark    = "removeMark"
+)
+
+// Step is a modification of the document of a note, in the JSON format of
+// the steps of ProseMirror. The steps are saved in CouchDB, with the version
+// of the note they have created, so that the editors that are late can catch
+// up.
+type Step struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	NoteID    string    `json:"note_id,omitempty"`
+	Version   int64     `json:"version,omitempty"`
+	SessionID string    `json:"sessionID,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+
+	StepType  string `json:"stepType"`
+	From      int    `json:"from"`
+	To        int    `json:"to"`
+	GapFrom   int    `json:"gapFrom,omitempty"`
+	GapTo     int    `json:"gapTo,omitempty"`
+	Insert    int    `json:"insert,omitempty"`
+	Slice     *Slice `json:"slice,omitempty"`
+	Mark      *Mark  `json:"mark,omitempty"`
+	Structure bool   `json:"structure,omitempty"`
+}
+
+// ID returns the step qualified identifier
+func (s *Step) ID() string { return s.DocID }
+
+// Rev returns the step revision
+func (s *Step) Rev() string { return s.DocRev }
+
+// DocType returns the step document type
+func (s *Step) DocType() string { return consts.NotesSteps }
+
+// Clone implements couchdb.Doc
+func (s *Step) Clone() couchdb.Doc {
+	cloned := *s
+	return &cloned
+}
+
+// SetID changes the step qualified identifier
+func (s *Step) SetID(id string) { s.DocID = id }
+
+// SetRev changes the step revision
+func (s *Step) SetRev(rev string) { s.DocRev = rev }
+
+// stepID returns the identifier of the step for the given version of a
+// note. The version is padded, so that the steps are sorted by version in
+// _all_docs.
+func stepID(noteID string, version int64) string {
+	return fmt.Sprintf("%s/%08d", noteID, version)
+}
+
+// Apply returns the document with the step applied
+func (s *Step) Apply(doc *Node) (*Node, error) {
+	switch s.StepType {
+	case StepReplace:
+		slice := s.Slice
+		if slice == nil {
+			slice = &Slice{}
+		}
+		if s.Structure && contentBetween(doc, s.From, s.To) {
+			return nil, ErrCannotApply
+		}
+		return replaceRange(doc, s.From, s.To, slice)
+	case StepReplaceAround:
+		if s.Structure && (contentBetween(doc, s.From, s.GapFrom) || contentBetween(doc, s.GapTo, s.To)) {
+			return nil, ErrCannotApply
+		}
+		gap, err := doc.slice(s.GapFrom, s.GapTo)
+		if err != nil {
+			return nil, err
+		}
+		if gap.OpenStart > 0 || gap.OpenEnd > 0 {
+			return nil, ErrCannotApply
+		}
+		slice := s.Slice
+		if slice == nil {
+			slice = &Slice{}
+		}
+		content, err := insertInto(slice.Content, s.Insert+slice.OpenStart, gap.Content)
+		if err != nil {
+			return nil, err
+		}
+		inserted := &Slice{Content: content, OpenStart: slice.OpenStart, OpenEnd: slice.OpenEnd}
+		return replaceRange(doc, s.From, s.To, inserted)
+	case StepAddMark, StepRemoveMark:
+		if s.Mark == nil {
+			return nil, ErrInvalidStep
+		}
+		old, err := doc.slice(s.From, s.To)
+		if err != nil {
+			return nil, err
+		}
+		rfrom, err := resolve(doc, s.From)
+		if err != nil {
+			return nil, err
+		}
+		parent := rfrom.node(rfrom.sharedDepth(s.To))
+		mark := *s.Mark
+		content := mapInline(old.Content, parent, func(node, parent *Node) *Node {
+			if !node.IsLeaf() || noMarkTypes[parent.Type] {
+				return node
+			}
+			if s.StepType == StepAddMark {
+				return node.withMarks(mark.addToSet(node.Marks))
+			}
+			return node.withMarks(mark.removeFromSet(node.Marks))
+		})
+		slice := &Slice{Content: content, OpenStart: old.OpenStart, OpenEnd: old.OpenEnd}
+		return replaceRange(doc, s.From, s.To, slice)
+	}
+	return nil, ErrInvalidStep
+}
+
+func replaceRange(doc *Node, from, to int, slice *Slice) (*Node, error) {
+	if from > to {
+		return nil, ErrInvalidPosition
+	}
+	rfrom, err := resolve(doc, from)
+	if err != nil {
+		return nil, err
+	}
+	rto, err := resolve(doc, to)
+	if err != nil {
+		return nil, err
+	}
+	return replace(rfrom, rto, slice)
+}
+
+// contentBetween returns true if there is some content between the two
+// positions, and not only the opening and closing tokens of nodes.
+func contentBetween(doc *Node, from, to int) bool {
+	rfrom, err := resolve(doc, from)
+	if err != nil {
+		return true
+	}
+	dist := to - from
+	depth := rfrom.depth
+	for dist > 0 && depth > 0 && rfrom.indexAfter(depth) == len(rfrom.node(depth).Content) {
+		depth--
+		dist--
+	}
+	if dist > 0 {
+		var next *Node
+		if i := rfrom.indexAfter(depth); i < len(rfrom.node(depth).Content) {
+			next = rfrom.node(depth).Content[i]
+		}
+		for dist > 0 {
+			if next == nil || next.IsLeaf() {
+				return true
+			}
+			if len(next.Content) > 0 {
+				next = next.Content[0]
+			} else {
+				next = nil
+			}
+			dist--
+		}
+	}
+	return false
+}
+
+// insertInto inserts a fragment at the given position of the content
+func insertInto(content []*Node, dist int, insert []*Node) ([]*Node, error) {
+	index, offset, err := findIndex(content, dist)
+	if err != nil {
+		return nil, err
+	}
+	if offset == dist || content[index].IsText() {
+		before := fragmentCut(content, 0, dist)
+		after := fragmentCut(content, dist, fragmentSize(content))
+		return fragmentAppend(fragmentAppend(before, insert), after), nil
+	}
+	child := content[index]
+	inner, err := insertInto(child.Content, dist-offset-1, insert)
+	if err != nil {
+		return nil, err
+	}
+	return fragmentReplaceChild(content, index, child.copyWith(inner)), nil
+}
+
+// mapInline calls fn on each inline node of the fragment, and returns the
+// fragment with the nodes replaced by the results
+func mapInline(content []*Node, parent *Node, fn func(node, parent *Node) *Node) []*Node {
+	var mapped []*Node
+	for _, child := range content {
+		if len(child.Content) > 0 {
+			child = child.copyWith(mapInline(child.Content, child, fn))
+		}
+		if child.IsInline() {
+			child = fn(child, parent)
+		}
+		mapped = addNode(mapped, child)
+	}
+	return mapped
+}
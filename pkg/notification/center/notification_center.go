@@ -23,6 +23,18 @@ const (
 	// NotificationDiskQuota category for sending alert when reaching 90% of disk
 	// usage quota.
 	NotificationDiskQuota = "disk-quota"
+	// NotificationKonnectorInteraction category for asking the user a value
+	// needed by a running konnector, like a two-factor authentication code.
+	NotificationKonnectorInteraction = "konnector-interaction"
+	// NotificationBankBalanceLower category for the alerts on the balance of
+	// a bank account below a threshold.
+	NotificationBankBalanceLower = "bank-balance-lower"
+	// NotificationBankLargeTransaction category for the alerts on the bank
+	// transactions with a large amount.
+	NotificationBankLargeTransaction = "bank-large-transaction"
+	// NotificationCorruptedFiles category for the alerts on the files whose
+	// content does not match their checksum.
+	NotificationCorruptedFiles = "corrupted-files"
 )
 
 var (
@@ -34,6 +46,24 @@ var (
 			MailTemplate: "notifications_diskquota",
 			MinInterval:  7 * 24 * time.Hour,
 		},
+		NotificationKonnectorInteraction: {
+			Description:  "Ask a value needed by a running konnector",
+			MailTemplate: "notifications_konnector_interaction",
+		},
+		NotificationBankBalanceLower: {
+			Description:  "Alert about the balance of a bank account below a threshold",
+			Collapsible:  true,
+			Stateful:     true,
+			MailTemplate: "notifications_bank_balance_lower",
+		},
+		NotificationBankLargeTransaction: {
+			Description:  "Alert about a bank transaction with a large amount",
+			MailTemplate: "notifications_bank_large_transaction",
+		},
+		NotificationCorruptedFiles: {
+			Description:  "Alert about files whose content is corrupted",
+			MailTemplate: "notifications_corrupted_files",
+		},
 	}
 )
 
@@ -49,17 +79,21 @@ func init() {
 		}
 		cozyDriveLink := i.SubDomain(consts.DriveSlug)
 		n := &notification.Notification{
-			State: exceeded,
+			Title:   i.Translate("Notifications Disk Quota Subject"),
+			Message: i.Translate("Notifications Disk Quota Intro"),
+			State:   exceeded,
 			Data: map[string]interface{}{
 				"OffersLink":    offersLink,
 				"CozyDriveLink": cozyDriveLink.String(),
 			},
 		}
-		pushStack(domain, NotificationDiskQuota, n)
+		PushStack(domain, NotificationDiskQuota, n)
 	})
 }
 
-func pushStack(domain string, category string, n *notification.Notification) error {
+// PushStack creates and sends a new notification from the stack itself, for
+// one of the categories of the stack notifications.
+func PushStack(domain string, category string, n *notification.Notification) error {
 	inst, err := instance.Get(domain)
 	if err != nil {
 		return err
@@ -221,6 +255,28 @@ func findLastNotification(inst *instance.Instance, source string) (*notification
 	return notifs[0], nil
 }
 
+// FindSince returns the notifications created since the given date, the most
+// recent first.
+func FindSince(inst *instance.Instance, since time.Time, limit int) ([]*notification.Notification, error) {
+	var notifs []*notification.Notification
+	req := &couchdb.FindRequest{
+		UseIndex: "by-created-at",
+		Selector: mango.Gt("created_at", since),
+		Sort: mango.SortBy{
+			{Field: "created_at", Direction: mango.Desc},
+		},
+		Limit: limit,
+	}
+	err := couchdb.FindDocs(inst, consts.Notifications, req, &notifs)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return notifs, nil
+}
+
 func sendPush(inst *instance.Instance, p *notification.Properties, n *notification.Notification) error {
 	push := push.Message{
 		NotificationID: n.ID(),
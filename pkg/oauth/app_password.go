@@ -0,0 +1,196 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// appPasswordLen is the number of characters of an app password
+const appPasswordLen = 24
+
+var (
+	// ErrInvalidAppPassword is used when the app password is unknown
+	ErrInvalidAppPassword = errors.New("Invalid app password")
+	// ErrMissingAppPasswordLabel is used when an app password is created
+	// without a label.
+	ErrMissingAppPasswordLabel = errors.New("Missing label for the app password")
+	// ErrUnknownAppPasswordService is used when an app password is created
+	// for a service that doesn't exist.
+	ErrUnknownAppPasswordService = errors.New("Unknown service for the app password")
+)
+
+// The services for which an app password can be used.
+const (
+	ServiceWebDAV  = "webdav"
+	ServiceCardDAV = "carddav"
+	ServiceCalDAV  = "caldav"
+	ServiceSFTP    = "sftp"
+)
+
+var appPasswordServices = []string{ServiceWebDAV, ServiceCardDAV, ServiceCalDAV, ServiceSFTP}
+
+// AppPassword is a password generated by the user for a client that can't do
+// the OAuth dance, like the CardDAV client of a phone. It gives access to the
+// routes of the DAV servers and to the SFTP server, with the permissions of its
+// scope. It can be restricted to some services: an app password without
+// services can be used for all of them.
+//
+// Only a hash of the password is kept: the identifier of the document is the
+// SHA-256 of the password, which is random enough to not need a salt.
+type AppPassword struct {
+	DocID      string     `json:"_id,omitempty"`
+	DocRev     string     `json:"_rev,omitempty"`
+	Label      string     `json:"label"`
+	Scope      string     `json:"scope"`
+	Services   []string   `json:"services,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// ID returns the app password qualified identifier
+func (ap *AppPassword) ID() string { return ap.DocID }
+
+// Rev returns the app password revision
+func (ap *AppPassword) Rev() string { return ap.DocRev }
+
+// DocType returns the app password document type
+func (ap *AppPassword) DocType() string { return consts.AppPasswords }
+
+// Clone implements couchdb.Doc
+func (ap *AppPassword) Clone() couchdb.Doc {
+	cloned := *ap
+	if ap.Services != nil {
+		cloned.Services = make([]string, len(ap.Services))
+		copy(cloned.Services, ap.Services)
+	}
+	if ap.LastUsedAt != nil {
+		tmp := *ap.LastUsedAt
+		cloned.LastUsedAt = &tmp
+	}
+	return &cloned
+}
+
+// SetID changes the app password qualified identifier
+func (ap *AppPassword) SetID(id string) { ap.DocID = id }
+
+// SetRev changes the app password revision
+func (ap *AppPassword) SetRev(rev string) { ap.DocRev = rev }
+
+// Permissions returns the set of permissions given by the app password
+func (ap *AppPassword) Permissions() (permissions.Set, error) {
+	return permissions.UnmarshalScopeString(ap.Scope)
+}
+
+// AllowService returns true if the app password can be used for the given
+// service.
+func (ap *AppPassword) AllowService(service string) bool {
+	return len(ap.Services) == 0 || utils.IsInArray(service, ap.Services)
+}
+
+// Delete revokes the app password
+func (ap *AppPassword) Delete(i *instance.Instance) error {
+	return couchdb.DeleteDoc(i, ap)
+}
+
+func hashAppPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetAppPasswords loads all the app passwords of the instance
+func GetAppPasswords(i *instance.Instance) ([]*AppPassword, error) {
+	var list []*AppPassword
+	req := &couchdb.AllDocsRequest{Limit: 1000}
+	err := couchdb.GetAllDocs(i, consts.AppPasswords, req, &list)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// FindAppPassword loads an app password from the database
+func FindAppPassword(i *instance.Instance, id string) (*AppPassword, error) {
+	var ap AppPassword
+	if err := couchdb.GetDoc(i, consts.AppPasswords, id, &ap); err != nil {
+		return nil, err
+	}
+	return &ap, nil
+}
+
+// CreateAppPassword generates a new app password for the given scope and
+// services. The password is returned in clear, and can't be retrieved later.
+func CreateAppPassword(i *instance.Instance, label, scope string, services []string) (*AppPassword, string, error) {
+	if label == "" {
+		return nil, "", ErrMissingAppPasswordLabel
+	}
+	if _, err := permissions.UnmarshalScopeString(scope); err != nil {
+		return nil, "", err
+	}
+	for _, service := range services {
+		if !utils.IsInArray(service, appPasswordServices) {
+			return nil, "", ErrUnknownAppPasswordService
+		}
+	}
+	password := crypto.GenerateRandomString(appPasswordLen)
+	ap := &AppPassword{
+		DocID:     hashAppPassword(password),
+		Label:     label,
+		Scope:     scope,
+		Services:  services,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := couchdb.CreateNamedDocWithDB(i, ap); err != nil {
+		return nil, "", err
+	}
+	return ap, password, nil
+}
+
+// CheckAppPassword returns the app password document for the given password,
+// or ErrInvalidAppPassword if the password is unknown or can't be used for
+// one of the given services. At least one service must be given.
+func CheckAppPassword(i *instance.Instance, password string, services ...string) (*AppPassword, error) {
+	if password == "" || len(services) == 0 {
+		return nil, ErrInvalidAppPassword
+	}
+	ap, err := FindAppPassword(i, hashAppPassword(password))
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrInvalidAppPassword
+		}
+		return nil, err
+	}
+	allowed := false
+	for _, service := range services {
+		if ap.AllowService(service) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, ErrInvalidAppPassword
+	}
+
+	// The last usage is only informative, so we don't update it on each
+	// request.
+	now := time.Now().UTC()
+	if ap.LastUsedAt == nil || now.Sub(*ap.LastUsedAt) > time.Hour {
+		ap.LastUsedAt = &now
+		if err := couchdb.UpdateDoc(i, ap); err != nil {
+			i.Logger().WithField("nspace", "oauth").
+				Warnf("Cannot update app password %s: %s", ap.ID(), err)
+		}
+	}
+	return ap, nil
+}
+
+var (
+	_ couchdb.Doc = &AppPassword{}
+)
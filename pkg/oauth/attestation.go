@@ -0,0 +1,132 @@
+package oauth
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// AttestationPlatformAndroid is the platform of the SafetyNet attestations
+const AttestationPlatformAndroid = "android"
+
+// safetyNetHostname is the hostname of the certificate that signs the
+// SafetyNet attestations.
+const safetyNetHostname = "attest.android.com"
+
+// attestationMaxAge is the maximal age of an attestation when it is checked
+const attestationMaxAge = 10 * time.Minute
+
+var (
+	// ErrInvalidAttestation is used when the attestation of a flagship app
+	// can't be verified.
+	ErrInvalidAttestation = errors.New("Invalid attestation")
+	// ErrUnsupportedAttestation is used when the flagship app can't be
+	// certified on its platform, or when the certification has not been
+	// configured.
+	ErrUnsupportedAttestation = errors.New("The attestation is not supported")
+)
+
+// safetyNetRoots are the certificate authorities for the SafetyNet
+// attestations. The system roots are used when it is nil.
+var safetyNetRoots *x509.CertPool
+
+// safetyNetClaims are the claims of a SafetyNet attestation.
+// See https://developer.android.com/training/safetynet/attestation
+type safetyNetClaims struct {
+	Nonce                      string   `json:"nonce"`
+	TimestampMs                int64    `json:"timestampMs"`
+	APKPackageName             string   `json:"apkPackageName"`
+	APKCertificateDigestSha256 []string `json:"apkCertificateDigestSha256"`
+	BasicIntegrity             bool     `json:"basicIntegrity"`
+	CTSProfileMatch            bool     `json:"ctsProfileMatch"`
+}
+
+// Valid is part of the jwt.Claims interface. The claims are checked after
+// the signature, in checkSafetyNetAttestation.
+func (c *safetyNetClaims) Valid() error { return nil }
+
+// CheckAttestation verifies the attestation given by a flagship app, to
+// certify that it is the genuine app from the store, running on a device that
+// has not been tampered with. The nonce is the value that the app has put in
+// the attestation, like the pairing code.
+func CheckAttestation(platform, attestation string, nonce []byte) error {
+	switch platform {
+	case AttestationPlatformAndroid:
+		return checkSafetyNetAttestation(attestation, nonce)
+	}
+	return ErrUnsupportedAttestation
+}
+
+func checkSafetyNetAttestation(attestation string, nonce []byte) error {
+	conf := config.GetConfig().Flagship
+	if len(conf.APKPackageNames) == 0 || len(conf.APKCertificateDigests) == 0 {
+		return ErrUnsupportedAttestation
+	}
+
+	var claims safetyNetClaims
+	token, err := jwt.ParseWithClaims(attestation, &claims, safetyNetKey)
+	if err != nil || !token.Valid {
+		return ErrInvalidAttestation
+	}
+	if claims.Nonce != base64.StdEncoding.EncodeToString(nonce) {
+		return ErrInvalidAttestation
+	}
+	issuedAt := time.Unix(0, claims.TimestampMs*int64(time.Millisecond))
+	if time.Since(issuedAt) > attestationMaxAge || time.Until(issuedAt) > time.Minute {
+		return ErrInvalidAttestation
+	}
+	if !claims.BasicIntegrity {
+		return ErrInvalidAttestation
+	}
+	if !utils.IsInArray(claims.APKPackageName, conf.APKPackageNames) {
+		return ErrInvalidAttestation
+	}
+	for _, digest := range claims.APKCertificateDigestSha256 {
+		if utils.IsInArray(digest, conf.APKCertificateDigests) {
+			return nil
+		}
+	}
+	return ErrInvalidAttestation
+}
+
+// safetyNetKey returns the public key of the certificate that has signed a
+// SafetyNet attestation, after having checked its certificate chain.
+func safetyNetKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	x5c, ok := token.Header["x5c"].([]interface{})
+	if !ok || len(x5c) == 0 {
+		return nil, errors.New("Missing certificates")
+	}
+	certs := make([]*x509.Certificate, len(x5c))
+	for i, c := range x5c {
+		str, _ := c.(string)
+		der, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, err
+		}
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, err
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       safetyNetHostname,
+		Intermediates: intermediates,
+		Roots:         safetyNetRoots,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certs[0].PublicKey, nil
+}
@@ -0,0 +1,155 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+const (
+	testAPKPackageName = "io.cozy.flagship.mobile"
+	testAPKDigest      = "bHZ7fB3CgNdnWswV5tQSiS/gKjFQVtqoLUSHAedZuRc="
+)
+
+type attestationSigner struct {
+	key  *rsa.PrivateKey
+	x5c  []string
+	root *x509.Certificate
+}
+
+func newCertificate(t *testing.T, tmpl, parent *x509.Certificate, pub *rsa.PublicKey, priv *rsa.PrivateKey) *x509.Certificate {
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, priv)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+// newAttestationSigner creates a root certificate authority, and a leaf
+// certificate for the given hostname that can sign the attestations.
+func newAttestationSigner(t *testing.T, hostname string) *attestationSigner {
+	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	root := newCertificate(t, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf := newCertificate(t, leafTmpl, root, &key.PublicKey, rootKey)
+
+	return &attestationSigner{
+		key:  key,
+		x5c:  []string{base64.StdEncoding.EncodeToString(leaf.Raw)},
+		root: root,
+	}
+}
+
+func (s *attestationSigner) sign(t *testing.T, claims *safetyNetClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["x5c"] = s.x5c
+	signed, err := token.SignedString(s.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func validClaims(nonce string) *safetyNetClaims {
+	return &safetyNetClaims{
+		Nonce:                      base64.StdEncoding.EncodeToString([]byte(nonce)),
+		TimestampMs:                time.Now().UnixNano() / int64(time.Millisecond),
+		APKPackageName:             testAPKPackageName,
+		APKCertificateDigestSha256: []string{testAPKDigest},
+		BasicIntegrity:             true,
+		CTSProfileMatch:            true,
+	}
+}
+
+func TestCheckAttestation(t *testing.T) {
+	signer := newAttestationSigner(t, safetyNetHostname)
+	roots := x509.NewCertPool()
+	roots.AddCert(signer.root)
+	previousRoots, previousConf := safetyNetRoots, config.GetConfig().Flagship
+	safetyNetRoots = roots
+	defer func() {
+		safetyNetRoots = previousRoots
+		config.GetConfig().Flagship = previousConf
+	}()
+
+	nonce := "bmRrt6ezeBKXXbUjkfAKQSoLHqT6cRiS"
+	attestation := signer.sign(t, validClaims(nonce))
+
+	// The certification must be configured
+	config.GetConfig().Flagship = config.Flagship{}
+	err := CheckAttestation(AttestationPlatformAndroid, attestation, []byte(nonce))
+	assert.Equal(t, ErrUnsupportedAttestation, err)
+
+	config.GetConfig().Flagship = config.Flagship{
+		APKPackageNames:       []string{testAPKPackageName},
+		APKCertificateDigests: []string{testAPKDigest},
+	}
+	assert.NoError(t, CheckAttestation(AttestationPlatformAndroid, attestation, []byte(nonce)))
+
+	err = CheckAttestation("ios", attestation, []byte(nonce))
+	assert.Equal(t, ErrUnsupportedAttestation, err)
+	err = CheckAttestation(AttestationPlatformAndroid, "not-an-attestation", []byte(nonce))
+	assert.Equal(t, ErrInvalidAttestation, err)
+	err = CheckAttestation(AttestationPlatformAndroid, attestation, []byte("another-nonce"))
+	assert.Equal(t, ErrInvalidAttestation, err)
+
+	claims := validClaims(nonce)
+	claims.TimestampMs -= int64(2 * attestationMaxAge / time.Millisecond)
+	err = CheckAttestation(AttestationPlatformAndroid, signer.sign(t, claims), []byte(nonce))
+	assert.Equal(t, ErrInvalidAttestation, err)
+
+	claims = validClaims(nonce)
+	claims.BasicIntegrity = false
+	err = CheckAttestation(AttestationPlatformAndroid, signer.sign(t, claims), []byte(nonce))
+	assert.Equal(t, ErrInvalidAttestation, err)
+
+	claims = validClaims(nonce)
+	claims.APKPackageName = "com.example.fake"
+	err = CheckAttestation(AttestationPlatformAndroid, signer.sign(t, claims), []byte(nonce))
+	assert.Equal(t, ErrInvalidAttestation, err)
+
+	claims = validClaims(nonce)
+	claims.APKCertificateDigestSha256 = []string{"another-digest"}
+	err = CheckAttestation(AttestationPlatformAndroid, signer.sign(t, claims), []byte(nonce))
+	assert.Equal(t, ErrInvalidAttestation, err)
+
+	// The attestation must be signed by a certificate for attest.android.com
+	// from the trusted authorities
+	other := newAttestationSigner(t, safetyNetHostname)
+	err = CheckAttestation(AttestationPlatformAndroid, other.sign(t, validClaims(nonce)), []byte(nonce))
+	assert.Equal(t, ErrInvalidAttestation, err)
+	roots.AddCert(other.root)
+	wrongHost := newAttestationSigner(t, "attest.example.com")
+	roots.AddCert(wrongHost.root)
+	err = CheckAttestation(AttestationPlatformAndroid, wrongHost.sign(t, validClaims(nonce)), []byte(nonce))
+	assert.Equal(t, ErrInvalidAttestation, err)
+}
@@ -71,6 +71,13 @@ type Client struct {
 	// XXX omitempty does not work for time.Time, thus the interface{} type
 	SynchronizedAt interface{} `json:"synchronized_at,omitempty"` // Date of the last synchronization, updated by /settings/synchronized
 
+	// Flagship is true for the clients of the mobile apps that have been
+	// paired with a QR code from the settings (forced by the server)
+	Flagship bool `json:"flagship,omitempty"`
+	// CertifiedFromStore is true when the flagship app has been certified as
+	// the genuine app from the store, by an attestation during the pairing
+	CertifiedFromStore bool `json:"certified_from_store,omitempty"`
+
 	OnboardingSecret      string `json:"onboarding_secret,omitempty"`
 	OnboardingApp         string `json:"onboarding_app,omitempty"`
 	OnboardingPermissions string `json:"onboarding_permissions,omitempty"`
@@ -341,7 +348,14 @@ func (c *Client) Create(i *instance.Instance) *ClientRegistrationError {
 		}
 	}
 
-	c.RegistrationToken, err = crypto.NewJWT(i.OAuthSecret, jwt.StandardClaims{
+	kid, secret, err := i.SigningKey(permissions.RegistrationTokenAudience)
+	if err != nil {
+		return &ClientRegistrationError{
+			Code:  http.StatusInternalServerError,
+			Error: "internal_server_error",
+		}
+	}
+	c.RegistrationToken, err = crypto.NewJWTWithKeyID(secret, kid, jwt.StandardClaims{
 		Audience: permissions.RegistrationTokenAudience,
 		Issuer:   i.Domain,
 		IssuedAt: time.Now().Unix(),
@@ -391,6 +405,8 @@ func (c *Client) Update(i *instance.Instance, old *Client) *ClientRegistrationEr
 	c.CouchID = old.CouchID
 	c.CouchRev = old.CouchRev
 	c.ClientName = old.ClientName
+	c.Flagship = old.Flagship
+	c.CertifiedFromStore = old.CertifiedFromStore
 	c.ClientID = ""
 	c.SecretExpiresAt = 0
 	c.RegistrationToken = ""
@@ -422,6 +438,10 @@ func (c *Client) Delete(i *instance.Instance) *ClientRegistrationError {
 			Error: "internal_server_error",
 		}
 	}
+	if err := DeleteDevicesOfClient(i, c.ID()); err != nil {
+		i.Logger().WithField("nspace", "oauth").
+			Errorf("Failed to delete the devices of the client %s: %s", c.ID(), err)
+	}
 	return nil
 }
 
@@ -438,7 +458,11 @@ func (c *Client) AcceptRedirectURI(u string) bool {
 
 // CreateJWT returns a new JSON Web Token for the given instance and audience
 func (c *Client) CreateJWT(i *instance.Instance, audience, scope string) (string, error) {
-	token, err := crypto.NewJWT(i.OAuthSecret, permissions.Claims{
+	kid, secret, err := i.SigningKey(audience)
+	if err != nil {
+		return "", err
+	}
+	token, err := crypto.NewJWTWithKeyID(secret, kid, permissions.Claims{
 		StandardClaims: jwt.StandardClaims{
 			Audience: audience,
 			Issuer:   i.Domain,
@@ -462,9 +486,7 @@ func (c *Client) ValidToken(i *instance.Instance, audience, token string) (permi
 	if token == "" {
 		return claims, false
 	}
-	keyFunc := func(token *jwt.Token) (interface{}, error) {
-		return i.OAuthSecret, nil
-	}
+	keyFunc := i.JWTKeyFunc(audience)
 	if err := crypto.ParseJWT(token, keyFunc, &claims); err != nil {
 		i.Logger().WithField("nspace", "oauth").
 			Errorf("Failed to verify the %s token: %s", audience, err)
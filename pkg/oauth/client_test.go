@@ -130,6 +130,51 @@ func TestCreateClientWithNotifications(t *testing.T) {
 	}
 }
 
+func TestRegisterDevices(t *testing.T) {
+	client := &oauth.Client{
+		ClientName:   "client-devices",
+		RedirectURIs: []string{"https://foobar"},
+		SoftwareID:   "bar",
+	}
+	if !assert.Nil(t, client.Create(testInstance)) {
+		return
+	}
+	client, err := oauth.FindClient(testInstance, client.ClientID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = oauth.RegisterDevice(testInstance, client.ID(), "unknown", "token-1")
+	assert.Equal(t, oauth.ErrInvalidPlatform, err)
+	_, err = oauth.RegisterDevice(testInstance, client.ID(), "apns", "")
+	assert.Equal(t, oauth.ErrMissingDeviceToken, err)
+
+	d1, err := oauth.RegisterDevice(testInstance, client.ID(), "firebase", "token-1")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, d1.ID())
+	d2, err := oauth.RegisterDevice(testInstance, client.ID(), "APNS", "token-2")
+	assert.NoError(t, err)
+	assert.Equal(t, "apns", d2.Platform)
+
+	// Registering the same token again updates the device
+	d3, err := oauth.RegisterDevice(testInstance, "other-client", "firebase", "token-1")
+	assert.NoError(t, err)
+	assert.Equal(t, d1.ID(), d3.ID())
+	assert.Equal(t, "other-client", d3.ClientID)
+
+	devices, err := oauth.GetDevices(testInstance)
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+
+	// Revoking the client unregisters its devices
+	assert.Nil(t, client.Delete(testInstance))
+	devices, err = oauth.GetDevices(testInstance)
+	assert.NoError(t, err)
+	if assert.Len(t, devices, 1) {
+		assert.Equal(t, "token-1", devices[0].Token)
+	}
+}
+
 func TestParseJWTInvalidIssuer(t *testing.T) {
 	other := &instance.Instance{
 		OAuthSecret: testInstance.OAuthSecret,
@@ -0,0 +1,151 @@
+package oauth
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+)
+
+var (
+	// ErrInvalidPlatform is used when a device is registered with an unknown
+	// notification platform.
+	ErrInvalidPlatform = errors.New("Invalid notification platform")
+	// ErrMissingDeviceToken is used when a device is registered without a
+	// push token.
+	ErrMissingDeviceToken = errors.New("Missing device token")
+)
+
+// Device is a mobile device registered by an OAuth client to receive the push
+// notifications. A client can register several devices, and a device is
+// identified by its push token.
+type Device struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	ClientID  string    `json:"client_id"`
+	Platform  string    `json:"platform"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ID returns the device qualified identifier
+func (d *Device) ID() string { return d.DocID }
+
+// Rev returns the device revision
+func (d *Device) Rev() string { return d.DocRev }
+
+// DocType returns the device document type
+func (d *Device) DocType() string { return consts.NotificationDevices }
+
+// Clone implements couchdb.Doc
+func (d *Device) Clone() couchdb.Doc { cloned := *d; return &cloned }
+
+// SetID changes the device qualified identifier
+func (d *Device) SetID(id string) { d.DocID = id }
+
+// SetRev changes the device revision
+func (d *Device) SetRev(rev string) { d.DocRev = rev }
+
+// GetDevices loads all the devices registered for the push notifications.
+// The documents are fetched page by page, as an instance can have more
+// devices than the limit of a single request.
+func GetDevices(i *instance.Instance) ([]*Device, error) {
+	var devices []*Device
+	err := couchdb.ForeachDocs(i, consts.NotificationDevices, func(_ string, data json.RawMessage) error {
+		var d Device
+		if err := json.Unmarshal(data, &d); err != nil {
+			return err
+		}
+		devices = append(devices, &d)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// FindDevice loads a device from the database
+func FindDevice(i *instance.Instance, id string) (*Device, error) {
+	var d Device
+	if err := couchdb.GetDoc(i, consts.NotificationDevices, id, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// RegisterDevice saves the push token of a device for the given client. If
+// the token is already known, the existing device is updated, as the token
+// may have been given to another client on the same mobile.
+func RegisterDevice(i *instance.Instance, clientID, platform, token string) (*Device, error) {
+	platform = strings.ToLower(platform)
+	if platform != PlatformFirebase && platform != PlatformAPNS {
+		return nil, ErrInvalidPlatform
+	}
+	if token == "" {
+		return nil, ErrMissingDeviceToken
+	}
+
+	devices, err := GetDevices(i)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	for _, d := range devices {
+		if d.Token != token {
+			continue
+		}
+		d.ClientID = clientID
+		d.Platform = platform
+		d.UpdatedAt = now
+		if err := couchdb.UpdateDoc(i, d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	d := &Device{
+		ClientID:  clientID,
+		Platform:  platform,
+		Token:     token,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := couchdb.CreateDoc(i, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Delete unregisters the device: it will no longer receive push
+// notifications.
+func (d *Device) Delete(i *instance.Instance) error {
+	return couchdb.DeleteDoc(i, d)
+}
+
+// DeleteDevicesOfClient unregisters all the devices of the given client. It
+// is used when the client is revoked.
+func DeleteDevicesOfClient(i *instance.Instance, clientID string) error {
+	devices, err := GetDevices(i)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if d.ClientID != clientID {
+			continue
+		}
+		if err := d.Delete(i); err != nil && !couchdb.IsNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	_ couchdb.Doc = &Device{}
+)
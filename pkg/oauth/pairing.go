@@ -0,0 +1,136 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+)
+
+// PairingCodeTTL is the duration of validity of a pairing code: the QR code
+// shown in the settings must be scanned quickly by the mobile app.
+const PairingCodeTTL = 5 * time.Minute
+
+// pairingCodeLen is the number of characters of a pairing code
+const pairingCodeLen = 32
+
+var (
+	// ErrInvalidPairingCode is used when the pairing code is unknown, or has
+	// already been used.
+	ErrInvalidPairingCode = errors.New("Invalid pairing code")
+	// ErrExpiredPairingCode is used when the pairing code is too old
+	ErrExpiredPairingCode = errors.New("Expired pairing code")
+)
+
+// PairingCode is a code generated by the user from the settings of its cozy,
+// and shown as a QR code. It can be exchanged only once by a mobile app for
+// an OAuth client, and the associated tokens, without going through the
+// authorize page. Only a hash of the code is persisted.
+type PairingCode struct {
+	CodeHash string `json:"_id,omitempty"`
+	CouchRev string `json:"_rev,omitempty"`
+	IssuedAt int64  `json:"issued_at"`
+	Scope    string `json:"scope"`
+
+	// Code is the pairing code in clear. It is known only when the pairing
+	// code is created.
+	Code string `json:"-"`
+}
+
+// ID returns the pairing code qualified identifier
+func (pc *PairingCode) ID() string { return pc.CodeHash }
+
+// Rev returns the pairing code revision
+func (pc *PairingCode) Rev() string { return pc.CouchRev }
+
+// DocType returns the pairing code document type
+func (pc *PairingCode) DocType() string { return consts.OAuthPairingCodes }
+
+// Clone implements couchdb.Doc
+func (pc *PairingCode) Clone() couchdb.Doc { cloned := *pc; return &cloned }
+
+// SetID changes the pairing code qualified identifier
+func (pc *PairingCode) SetID(id string) { pc.CodeHash = id }
+
+// SetRev changes the pairing code revision
+func (pc *PairingCode) SetRev(rev string) { pc.CouchRev = rev }
+
+// ExpiresAt returns the date after which the pairing code can no longer be
+// used.
+func (pc *PairingCode) ExpiresAt() time.Time {
+	return time.Unix(pc.IssuedAt, 0).Add(PairingCodeTTL).UTC()
+}
+
+// URL returns the URL encoded in the QR code. The mobile app opens it to
+// start the pairing with the cozy.
+func (pc *PairingCode) URL(i *instance.Instance) string {
+	return i.PageURL("/auth/pair", url.Values{"code": {pc.Code}})
+}
+
+// CreatePairingCode creates a pairing code for the given scope, persisted in
+// CouchDB.
+func CreatePairingCode(i *instance.Instance, scope string) (*PairingCode, error) {
+	if _, err := permissions.UnmarshalScopeString(scope); err != nil {
+		return nil, err
+	}
+	code := crypto.GenerateRandomString(pairingCodeLen)
+	pc := &PairingCode{
+		CodeHash: hashPairingCode(code),
+		IssuedAt: crypto.Timestamp(),
+		Scope:    scope,
+		Code:     code,
+	}
+	if err := couchdb.CreateNamedDocWithDB(i, pc); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// ConsumePairingCode checks that the given pairing code is valid, and deletes
+// it, as it can be used only once.
+func ConsumePairingCode(i *instance.Instance, code string) (*PairingCode, error) {
+	if code == "" {
+		return nil, ErrInvalidPairingCode
+	}
+	hash := hashPairingCode(code)
+	pc := &PairingCode{}
+	if err := couchdb.GetDoc(i, consts.OAuthPairingCodes, hash, pc); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrInvalidPairingCode
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(pc.CodeHash), []byte(hash)) != 1 {
+		return nil, ErrInvalidPairingCode
+	}
+	// If the deletion fails because of a conflict, the code has been used by
+	// a concurrent request.
+	if err := couchdb.DeleteDoc(i, pc); err != nil {
+		if couchdb.IsConflictError(err) || couchdb.IsNotFoundError(err) {
+			return nil, ErrInvalidPairingCode
+		}
+		return nil, err
+	}
+	if time.Now().After(pc.ExpiresAt()) {
+		return nil, ErrExpiredPairingCode
+	}
+	pc.Code = code
+	return pc, nil
+}
+
+func hashPairingCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	_ couchdb.Doc = &PairingCode{}
+)
@@ -0,0 +1,44 @@
+package oauth_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPairingCodeIsHashed(t *testing.T) {
+	pc, err := oauth.CreatePairingCode(testInstance, "io.cozy.files")
+	require.NoError(t, err)
+	assert.NotEmpty(t, pc.Code)
+	assert.NotEqual(t, pc.Code, pc.ID())
+	sum := sha256.Sum256([]byte(pc.Code))
+	assert.Equal(t, hex.EncodeToString(sum[:]), pc.ID())
+
+	// The code in clear is not persisted
+	stored := &oauth.PairingCode{}
+	err = couchdb.GetDoc(testInstance, consts.OAuthPairingCodes, pc.ID(), stored)
+	require.NoError(t, err)
+	assert.Empty(t, stored.Code)
+	assert.Equal(t, "io.cozy.files", stored.Scope)
+
+	// The hash can't be used in place of the code
+	_, err = oauth.ConsumePairingCode(testInstance, pc.ID())
+	assert.Equal(t, oauth.ErrInvalidPairingCode, err)
+	_, err = oauth.ConsumePairingCode(testInstance, "")
+	assert.Equal(t, oauth.ErrInvalidPairingCode, err)
+
+	consumed, err := oauth.ConsumePairingCode(testInstance, pc.Code)
+	require.NoError(t, err)
+	assert.Equal(t, pc.Code, consumed.Code)
+	assert.Equal(t, "io.cozy.files", consumed.Scope)
+
+	// And only once
+	_, err = oauth.ConsumePairingCode(testInstance, pc.Code)
+	assert.Equal(t, oauth.ErrInvalidPairingCode, err)
+}
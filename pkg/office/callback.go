@@ -0,0 +1,182 @@
+package office
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/safehttp"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// The statuses of the document, sent by the document server in the callbacks
+const (
+	StatusEditing        = 1
+	StatusMustSave       = 2
+	StatusSaveError      = 3
+	StatusClosed         = 4
+	StatusForceSave      = 6
+	StatusForceSaveError = 7
+)
+
+// savedTTL is the duration for which the stack remembers the last version of
+// a document saved by the document server
+const savedTTL = 24 * time.Hour
+
+// downloadClient only dials the public IP addresses, as the URL is given in
+// the callback and must not be used to reach the private network of the stack.
+var downloadClient = &http.Client{
+	Timeout:   60 * time.Second,
+	Transport: safehttp.NewTransport(30 * time.Second),
+}
+
+// CallbackParameters are the parameters sent by the document server when the
+// status of a document changes.
+type CallbackParameters struct {
+	Key    string `json:"key"`
+	Status int    `json:"status"`
+	URL    string `json:"url,omitempty"`
+	Token  string `json:"token,omitempty"`
+}
+
+// callbackClaims are the claims of the token of a callback. The parameters
+// are at the root of the claims when the token is in the body, and in the
+// payload when the token is sent in the Authorization header.
+type callbackClaims struct {
+	CallbackParameters
+	Payload *CallbackParameters `json:"payload,omitempty"`
+}
+
+// Valid is a method of the jwt.Claims interface
+func (c *callbackClaims) Valid() error { return nil }
+
+// checkToken verifies the token of the callback, and returns the parameters
+// from the claims, as the rest of the body is not signed.
+func checkToken(cfg *Config, params *CallbackParameters, header string) (*CallbackParameters, error) {
+	token := params.Token
+	if token == "" {
+		token = header
+	}
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+	claims := &callbackClaims{}
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		return []byte(cfg.Secret), nil
+	}
+	if err := crypto.ParseJWT(token, keyFunc, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Payload != nil {
+		return claims.Payload, nil
+	}
+	return &claims.CallbackParameters, nil
+}
+
+// Callback manages a callback from the document server. When the document
+// has been edited, it is downloaded from the document server and saved as a
+// new version of the file. The header is the token sent in the Authorization
+// header, if any.
+func Callback(inst *instance.Instance, params *CallbackParameters, header string) error {
+	cfg, err := GetConfig(inst)
+	if err != nil {
+		return err
+	}
+	params, err = checkToken(cfg, params, header)
+	if err != nil {
+		return err
+	}
+	if params.Status != StatusMustSave && params.Status != StatusForceSave {
+		return nil
+	}
+
+	fileID, md5, err := parseKey(params.Key)
+	if err != nil {
+		return err
+	}
+	doc, err := inst.VFS().FileByID(fileID)
+	if err != nil {
+		return err
+	}
+
+	res, err := downloadClient.Get(params.URL)
+	if err != nil {
+		return ErrDownloadFailed
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ErrDownloadFailed
+	}
+	return save(inst, doc, params.Key, md5, res.Body, res.ContentLength)
+}
+
+// save writes the content of the edited document to the file. If the file has
+// been modified outside of the editor, the content is written to a new file
+// in the same directory, to avoid losing any modification.
+func save(inst *instance.Instance, olddoc *vfs.FileDoc, key, md5 string, content io.Reader, size int64) error {
+	cache := config.GetConfig().CacheStorage
+	cacheKey := "office-saved:" + inst.DBPrefix() + ":" + key
+	current := hex.EncodeToString(olddoc.MD5Sum)
+	conflict := current != md5
+	if conflict {
+		// The document server may have already saved a version of this
+		// document (with a force save for example)
+		if r, ok := cache.Get(cacheKey); ok {
+			if saved, err := ioutil.ReadAll(r); err == nil && string(saved) == current {
+				conflict = false
+			}
+		}
+	}
+
+	fs := inst.VFS()
+	var newdoc *vfs.FileDoc
+	var file vfs.File
+	var err error
+	if conflict {
+		ext := path.Ext(olddoc.DocName)
+		base := strings.TrimSuffix(olddoc.DocName, ext)
+		name := fmt.Sprintf("%s - conflict - %d%s", base, time.Now().Unix(), ext)
+		newdoc, err = vfs.NewFileDoc(name, olddoc.DirID, size, nil,
+			olddoc.Mime, olddoc.Class, time.Now(), olddoc.Executable, false, olddoc.Tags)
+		if err != nil {
+			return err
+		}
+		inst.Logger().WithField("nspace", "office").
+			Infof("Conflict for file %s, the document is saved as %s", olddoc.ID(), name)
+		file, err = fs.CreateFile(newdoc, nil)
+	} else {
+		newdoc, err = vfs.NewFileDoc(olddoc.DocName, olddoc.DirID, size, nil,
+			olddoc.Mime, olddoc.Class, time.Now(), olddoc.Executable, false, olddoc.Tags)
+		if err != nil {
+			return err
+		}
+		newdoc.ReferencedBy = olddoc.ReferencedBy
+		newdoc.Favorite = olddoc.Favorite
+		file, err = fs.CreateFile(newdoc, olddoc)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, content); err != nil {
+		_ = file.Close()
+		return ErrDownloadFailed
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if !conflict {
+		saved := []byte(hex.EncodeToString(newdoc.MD5Sum))
+		cache.Set(cacheKey, saved, utils.DurationFuzzing(savedTTL, 0.10))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Package office is used to edit the office documents (texts, spreadsheets
+// and presentations) with an external document server, like OnlyOffice. The
+// stack gives to the client the configuration for the editor, signed with a
+// secret shared with the document server, and the document server calls the
+// stack back when the document has been edited, to save it in the VFS.
+package office
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+var (
+	// ErrNoServer is used when no document server is configured for the
+	// context of the instance
+	ErrNoServer = errors.New("No document server is configured")
+	// ErrUnsupportedFile is used when the file can't be opened by the
+	// document server
+	ErrUnsupportedFile = errors.New("This type of file is not supported")
+	// ErrInvalidToken is used when the token sent by the document server is
+	// missing or has not been signed with the shared secret
+	ErrInvalidToken = errors.New("Invalid token")
+	// ErrInvalidKey is used when the key sent by the document server doesn't
+	// match a file
+	ErrInvalidKey = errors.New("Invalid key")
+	// ErrDownloadFailed is used when the edited document can't be downloaded
+	// from the document server
+	ErrDownloadFailed = errors.New("The document can't be downloaded from the document server")
+)
+
+// documentTypes is the map of the supported extensions to the type of
+// document for the editor
+var documentTypes = map[string]string{
+	"doc":  "word",
+	"docm": "word",
+	"docx": "word",
+	"dot":  "word",
+	"dotx": "word",
+	"epub": "word",
+	"odt":  "word",
+	"ott":  "word",
+	"rtf":  "word",
+	"txt":  "word",
+	"csv":  "cell",
+	"ods":  "cell",
+	"ots":  "cell",
+	"xls":  "cell",
+	"xlsm": "cell",
+	"xlsx": "cell",
+	"xlt":  "cell",
+	"xltx": "cell",
+	"odp":  "slide",
+	"otp":  "slide",
+	"pps":  "slide",
+	"ppsx": "slide",
+	"ppt":  "slide",
+	"pptm": "slide",
+	"pptx": "slide",
+}
+
+// Config is the configuration of the document server for a context. It is
+// read from the office key of the context in the configuration file.
+type Config struct {
+	// URL is the address of the document server, where the client loads the
+	// editor
+	URL string
+	// Secret is shared with the document server, to sign the tokens
+	Secret string
+}
+
+// GetConfig returns the configuration of the document server for the
+// context of the instance, or ErrNoServer.
+func GetConfig(inst *instance.Instance) (*Config, error) {
+	ctx, err := inst.SettingsContext()
+	if err != nil {
+		return nil, ErrNoServer
+	}
+	office, ok := ctx["office"].(map[string]interface{})
+	if !ok {
+		return nil, ErrNoServer
+	}
+	cfg := &Config{}
+	cfg.URL, _ = office["url"].(string)
+	cfg.Secret, _ = office["secret"].(string)
+	// The secret is required, as it is the only way to check that the
+	// callbacks come from the document server
+	if cfg.URL == "" || cfg.Secret == "" {
+		return nil, ErrNoServer
+	}
+	return cfg, nil
+}
+
+// fileType returns the extension of the file, in lower case
+func fileType(doc *vfs.FileDoc) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(doc.DocName), "."))
+}
+
+// DocumentType returns the type of document (word, cell or slide) for the
+// editor, or ErrUnsupportedFile. The document server can't read the files
+// encrypted end-to-end.
+func DocumentType(doc *vfs.FileDoc) (string, error) {
+	typ, ok := documentTypes[fileType(doc)]
+	if !ok || doc.Encrypted {
+		return "", ErrUnsupportedFile
+	}
+	return typ, nil
+}
@@ -0,0 +1,68 @@
+package office
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+func TestDocumentType(t *testing.T) {
+	typ, err := DocumentType(&vfs.FileDoc{DocName: "letter.docx"})
+	assert.NoError(t, err)
+	assert.Equal(t, "word", typ)
+	typ, err = DocumentType(&vfs.FileDoc{DocName: "Budget.XLSX"})
+	assert.NoError(t, err)
+	assert.Equal(t, "cell", typ)
+	typ, err = DocumentType(&vfs.FileDoc{DocName: "slides.odp"})
+	assert.NoError(t, err)
+	assert.Equal(t, "slide", typ)
+	_, err = DocumentType(&vfs.FileDoc{DocName: "photo.jpg"})
+	assert.Equal(t, ErrUnsupportedFile, err)
+}
+
+func TestParseKey(t *testing.T) {
+	doc := &vfs.FileDoc{DocID: "4f3b2a1c", MD5Sum: []byte{0xde, 0xad, 0xbe, 0xef}}
+	id, md5, err := parseKey(documentKey(doc))
+	assert.NoError(t, err)
+	assert.Equal(t, "4f3b2a1c", id)
+	assert.Equal(t, "deadbeef", md5)
+
+	_, _, err = parseKey("nodash")
+	assert.Equal(t, ErrInvalidKey, err)
+	_, _, err = parseKey("trailing-")
+	assert.Equal(t, ErrInvalidKey, err)
+}
+
+func TestCheckToken(t *testing.T) {
+	cfg := &Config{URL: "https://documentserver.example/", Secret: "s3cr3t"}
+	sign := func(claims jwt.MapClaims, secret string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		assert.NoError(t, err)
+		return token
+	}
+
+	_, err := checkToken(cfg, &CallbackParameters{Key: "foo-bar", Status: 2}, "")
+	assert.Equal(t, ErrInvalidToken, err)
+
+	token := sign(jwt.MapClaims{"key": "foo-bar", "status": 2, "url": "https://ds/file"}, "other")
+	_, err = checkToken(cfg, &CallbackParameters{Token: token}, "")
+	assert.Equal(t, ErrInvalidToken, err)
+
+	// The unsigned parameters are ignored
+	token = sign(jwt.MapClaims{"key": "foo-bar", "status": 2, "url": "https://ds/file"}, "s3cr3t")
+	params, err := checkToken(cfg, &CallbackParameters{Key: "evil-key", Token: token}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo-bar", params.Key)
+	assert.Equal(t, StatusMustSave, params.Status)
+	assert.Equal(t, "https://ds/file", params.URL)
+
+	// The token can be sent in the Authorization header
+	payload := map[string]interface{}{"key": "foo-baz", "status": 6}
+	token = sign(jwt.MapClaims{"payload": payload}, "s3cr3t")
+	params, err = checkToken(cfg, &CallbackParameters{}, token)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo-baz", params.Key)
+	assert.Equal(t, StatusForceSave, params.Status)
+}
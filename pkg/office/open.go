@@ -0,0 +1,125 @@
+package office
+
+import (
+	"encoding/hex"
+	"net/url"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// Document is the description of the document for the editor
+type Document struct {
+	FileType string `json:"fileType"`
+	Key      string `json:"key"`
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+}
+
+// User is the user that opens the document in the editor
+type User struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// EditorConfig is the configuration of the editor
+type EditorConfig struct {
+	CallbackURL string `json:"callbackUrl"`
+	Lang        string `json:"lang"`
+	Mode        string `json:"mode"`
+	User        User   `json:"user"`
+}
+
+// Params are the parameters of the editor that are signed in the token
+type Params struct {
+	DocumentType string       `json:"documentType"`
+	Document     Document     `json:"document"`
+	EditorConfig EditorConfig `json:"editorConfig"`
+}
+
+// Valid is a method of the jwt.Claims interface
+func (p *Params) Valid() error { return nil }
+
+// OnlyOffice is the configuration that the client gives to the editor of the
+// document server. The token contains the parameters, signed with the secret
+// shared by the stack and the document server.
+type OnlyOffice struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+	Params
+}
+
+// documentKey returns the key that identifies the document for the document
+// server. It must change when the content of the file has been modified
+// outside of the editor, hence the md5sum.
+func documentKey(doc *vfs.FileDoc) string {
+	return doc.ID() + "-" + hex.EncodeToString(doc.MD5Sum)
+}
+
+// parseKey returns the file ID and the md5sum (in hexadecimal) of a key
+func parseKey(key string) (string, string, error) {
+	i := strings.LastIndex(key, "-")
+	if i <= 0 || i == len(key)-1 {
+		return "", "", ErrInvalidKey
+	}
+	return key[:i], key[i+1:], nil
+}
+
+// Open returns the configuration for opening the file in the editor of the
+// document server. The file is opened in read-only mode if readOnly is true.
+func Open(inst *instance.Instance, doc *vfs.FileDoc, readOnly bool) (*OnlyOffice, error) {
+	cfg, err := GetConfig(inst)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := DocumentType(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// The document server downloads the file with a link that doesn't need
+	// any permission, like the links for the thumbnails.
+	fs := inst.VFS()
+	filepath, err := doc.Path(fs)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := vfs.GetStore().AddFile(inst, filepath)
+	if err != nil {
+		return nil, err
+	}
+	downloadURL := inst.PageURL("/files/downloads/"+secret+"/"+url.PathEscape(doc.DocName), nil)
+
+	mode := "edit"
+	if readOnly {
+		mode = "view"
+	}
+	name, err := inst.PublicName()
+	if err != nil {
+		return nil, err
+	}
+
+	params := Params{
+		DocumentType: typ,
+		Document: Document{
+			FileType: fileType(doc),
+			Key:      documentKey(doc),
+			Title:    doc.DocName,
+			URL:      downloadURL,
+		},
+		EditorConfig: EditorConfig{
+			CallbackURL: inst.PageURL("/office/callback", nil),
+			Lang:        inst.Locale,
+			Mode:        mode,
+			User:        User{ID: inst.Domain, Name: name},
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &params)
+	o := &OnlyOffice{URL: cfg.URL, Params: params}
+	if o.Token, err = token.SignedString([]byte(cfg.Secret)); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
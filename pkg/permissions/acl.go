@@ -0,0 +1,133 @@
+package permissions
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+const (
+	// ACLRead is the access of an ACL that allows to read a file, or the
+	// files of a directory
+	ACLRead = "read"
+	// ACLWrite is the access of an ACL that allows to read and modify a file,
+	// or the files of a directory
+	ACLWrite = "write"
+)
+
+// FileACL is an access on a file or a directory (and its sub-tree) granted to
+// an OAuth client, in addition to the permissions of its token. The client
+// can be the one used by a member of a sharing for its requests: in this
+// case, the sharing and the index of the member are kept for information.
+type FileACL struct {
+	DocID       string    `json:"_id,omitempty"`
+	DocRev      string    `json:"_rev,omitempty"`
+	FileID      string    `json:"file_id"`
+	ClientID    string    `json:"client_id"`
+	SharingID   string    `json:"sharing_id,omitempty"`
+	MemberIndex int       `json:"member_index,omitempty"`
+	Access      string    `json:"access"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ID returns the ACL identifier
+func (a *FileACL) ID() string { return a.DocID }
+
+// Rev returns the ACL revision
+func (a *FileACL) Rev() string { return a.DocRev }
+
+// DocType returns the ACL document type
+func (a *FileACL) DocType() string { return consts.FilesACLs }
+
+// Clone implements couchdb.Doc
+func (a *FileACL) Clone() couchdb.Doc {
+	cloned := *a
+	return &cloned
+}
+
+// SetID changes the ACL identifier
+func (a *FileACL) SetID(id string) { a.DocID = id }
+
+// SetRev changes the ACL revision
+func (a *FileACL) SetRev(rev string) { a.DocRev = rev }
+
+// Rule returns the permission rule for the access of the ACL.
+func (a *FileACL) Rule() Rule {
+	verbs := Verbs(GET)
+	if a.Access == ACLWrite {
+		verbs = ALL
+	}
+	return Rule{
+		Type:   consts.Files,
+		Verbs:  verbs,
+		Values: []string{a.FileID},
+	}
+}
+
+// CreateFileACL saves a new ACL.
+func CreateFileACL(db prefixer.Prefixer, acl *FileACL) error {
+	if acl.Access != ACLRead && acl.Access != ACLWrite {
+		return ErrInvalidAccess
+	}
+	if acl.FileID == "" || acl.ClientID == "" {
+		return ErrMissingGrantee
+	}
+	acl.CreatedAt = time.Now().UTC()
+	return couchdb.CreateDoc(db, acl)
+}
+
+// GetFileACL returns the ACL with the given identifier.
+func GetFileACL(db prefixer.Prefixer, id string) (*FileACL, error) {
+	acl := &FileACL{}
+	if err := couchdb.GetDoc(db, consts.FilesACLs, id, acl); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// GetFileACLsForClient returns the ACLs granted to the given OAuth client.
+func GetFileACLsForClient(db prefixer.Prefixer, clientID string) ([]*FileACL, error) {
+	return findFileACLs(db, "client", clientID)
+}
+
+// GetFileACLsOnFile returns the ACLs on the given file or directory.
+func GetFileACLsOnFile(db prefixer.Prefixer, fileID string) ([]*FileACL, error) {
+	return findFileACLs(db, "file", fileID)
+}
+
+func findFileACLs(db prefixer.Prefixer, kind, id string) ([]*FileACL, error) {
+	req := &couchdb.ViewRequest{
+		Key:         []string{kind, id},
+		IncludeDocs: true,
+	}
+	var res couchdb.ViewResponse
+	if err := couchdb.ExecView(db, consts.FilesACLsView, req, &res); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	acls := make([]*FileACL, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var acl FileACL
+		if err := json.Unmarshal(row.Doc, &acl); err != nil {
+			return nil, err
+		}
+		acls = append(acls, &acl)
+	}
+	return acls, nil
+}
+
+// FileACLsSet returns the permissions set for the accesses of the ACLs.
+func FileACLsSet(acls []*FileACL) Set {
+	set := make(Set, len(acls))
+	for i, acl := range acls {
+		set[i] = acl.Rule()
+	}
+	return set
+}
+
+var _ couchdb.Doc = &FileACL{}
@@ -12,15 +12,22 @@ var readable = true
 var none = false
 
 var blackList = map[string]bool{
-	consts.Instances:        none,
-	consts.Sessions:         none,
-	consts.Permissions:      none,
-	consts.Intents:          none,
-	consts.OAuthClients:     none,
-	consts.OAuthAccessCodes: none,
-	consts.Archives:         none,
-	consts.Sharings:         none,
-	consts.Shared:           none,
+	consts.Instances:           none,
+	consts.Sessions:            none,
+	consts.Permissions:         none,
+	consts.Intents:             none,
+	consts.OAuthClients:        none,
+	consts.OAuthAccessCodes:    none,
+	consts.OAuthPairingCodes:   none,
+	consts.NotificationDevices: none,
+	consts.AppPasswords:        none,
+	consts.Archives:            none,
+	consts.Sharings:            none,
+	consts.Shared:              none,
+	consts.BitwardenProfiles:   none,
+	consts.Backups:             none,
+	consts.Moves:               none,
+	consts.WebhookSecrets:      none,
 
 	// TODO: uncomment to restric jobs permissions (make these none instead of
 	// readable).
@@ -28,12 +35,27 @@ var blackList = map[string]bool{
 	consts.Triggers:      readable,
 	consts.TriggersState: readable,
 
-	consts.Apps:           readable,
-	consts.Konnectors:     readable,
-	consts.Files:          readable,
-	consts.Notifications:  readable,
-	consts.RemoteRequests: readable,
-	consts.SessionsLogins: readable,
+	consts.WebhookDeliveries:      readable,
+	consts.DoctypeVersions:        readable,
+	consts.KonnectorsInteractions: readable,
+	consts.AuditLogs:              readable,
+	consts.Activities:             readable,
+	consts.FilesAccesses:          readable,
+	consts.FilesImports:           readable,
+	consts.FilesUploads:           none,
+	consts.FilesSizes:             readable,
+	consts.FilesACLs:              none,
+
+	consts.Apps:             readable,
+	consts.Konnectors:       readable,
+	consts.Files:            readable,
+	consts.Notifications:    readable,
+	consts.RemoteRequests:   readable,
+	consts.SessionsLogins:   readable,
+	consts.Notes:            readable,
+	consts.NotesSteps:       readable,
+	consts.BitwardenCiphers: readable,
+	consts.BitwardenFolders: readable,
 }
 
 // CheckReadable will abort the context and returns false if the doctype
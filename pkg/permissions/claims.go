@@ -41,8 +41,9 @@ func (claims *Claims) IssuedAtUTC() time.Time {
 	return time.Unix(claims.IssuedAt, 0).UTC()
 }
 
-// Expired returns true if a Claim is expired
-func (claims *Claims) Expired() bool {
+// ValidUntil returns the date after which the token of the claims is expired,
+// or false if this token never expires.
+func (claims *Claims) ValidUntil() (time.Time, bool) {
 	var validityDuration time.Duration
 	switch claims.Audience {
 	case AppAudience:
@@ -66,11 +67,16 @@ func (claims *Claims) Expired() bool {
 
 	// Share, RefreshToken and RegistrationToken never expire
 	case ShareAudience, RegistrationTokenAudience, RefreshTokenAudience:
-		return false
+		return time.Time{}, false
 
 	default:
 		validityDuration = DefaultValidityDuration
 	}
-	validUntil := claims.IssuedAtUTC().Add(validityDuration)
-	return validUntil.Before(time.Now().UTC())
+	return claims.IssuedAtUTC().Add(validityDuration), true
+}
+
+// Expired returns true if a Claim is expired
+func (claims *Claims) Expired() bool {
+	validUntil, ok := claims.ValidUntil()
+	return ok && validUntil.Before(time.Now().UTC())
 }
@@ -38,4 +38,22 @@ var (
 	// ErrNotParent is used when the permissions should have a specific parent.
 	ErrNotParent = echo.NewHTTPError(http.StatusForbidden,
 		"Permissions can be updated only by its parent")
+
+	// ErrGuestNotExplicit is used when a guest token is not restricted to a
+	// list of documents with some explicit verbs
+	ErrGuestNotExplicit = echo.NewHTTPError(http.StatusBadRequest,
+		"A guest token must be restricted to a list of documents and verbs")
+
+	// ErrGuestTTL is used when a guest token has no valid expiration date
+	ErrGuestTTL = echo.NewHTTPError(http.StatusBadRequest,
+		"A guest token must expire in less than 30 days")
+
+	// ErrInvalidAccess is used when an ACL is created with an unknown access
+	ErrInvalidAccess = echo.NewHTTPError(http.StatusBadRequest,
+		"The access should be read or write")
+
+	// ErrMissingGrantee is used when an ACL is created without a file or an
+	// OAuth client
+	ErrMissingGrantee = echo.NewHTTPError(http.StatusBadRequest,
+		"The ACL should have a file and an OAuth client")
 )
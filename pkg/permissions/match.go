@@ -1,5 +1,7 @@
 package permissions
 
+import "github.com/cozy/cozy-stack/pkg/schema"
+
 // Matcher is an interface for a object than can be matched by a Set
 type Matcher interface {
 	ID() string
@@ -38,7 +40,11 @@ func matchOnFields(r Rule, o Matcher, fields ...string) bool {
 }
 
 func matchVerbAndType(r Rule, v Verb, doctype string) bool {
-	return r.Verbs.Contains(v) && r.Type == doctype
+	if !r.Verbs.Contains(v) {
+		return false
+	}
+	// A permission on the alias of a doctype is also valid for this doctype
+	return r.Type == doctype || schema.Resolve(r.Type) == doctype
 }
 
 func matchWholeType(r Rule) bool {
@@ -1,6 +1,9 @@
 package permissions
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -51,8 +54,15 @@ const (
 	// TypeSharePreview is the value of Permission.Type to preview a
 	// cozy-to-cozy sharing
 	TypeSharePreview = "share-preview"
+
+	// TypeShareGuest is the value of Permission.Type for a guest token, that
+	// gives a time-limited access to a list of documents
+	TypeShareGuest = "share-guest"
 )
 
+// MaxGuestTTL is the maximal duration of validity of a guest token
+const MaxGuestTTL = 30 * 24 * time.Hour
+
 // ID implements jsonapi.Doc
 func (p *Permission) ID() string { return p.PID }
 
@@ -134,6 +144,24 @@ func (p *Permission) PatchCodes(codes map[string]string) {
 	}
 }
 
+// CodeHash returns a hash of a sharecode, that can be kept with the secrets
+// derived from this sharecode without disclosing it.
+func CodeHash(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// HasCodeHash returns true if one of the codes of the permission doc has the
+// given hash.
+func (p *Permission) HasCodeHash(hash string) bool {
+	for _, code := range p.Codes {
+		if subtle.ConstantTimeCompare([]byte(CodeHash(code)), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
 // Revoke destroy a Permission
 func (p *Permission) Revoke(db prefixer.Prefixer) error {
 	return couchdb.DeleteDoc(db, p)
@@ -142,10 +170,16 @@ func (p *Permission) Revoke(db prefixer.Prefixer) error {
 // ParentOf check if child has been created by p
 func (p *Permission) ParentOf(child *Permission) bool {
 	canBeParent := p.Type == TypeWebapp || p.Type == TypeOauth
-	return child.Type == TypeShareByLink && canBeParent &&
+	return child.SharedByCode() && canBeParent &&
 		child.SourceID == p.SourceID
 }
 
+// SharedByCode returns true for the permissions used with a sharecode given
+// by an application: the shares by link and the guest tokens.
+func (p *Permission) SharedByCode() bool {
+	return p.Type == TypeShareByLink || p.Type == TypeShareGuest
+}
+
 // GetByID fetch a permission by its ID
 func GetByID(db prefixer.Prefixer, id string) (*Permission, error) {
 	perm := &Permission{}
@@ -392,6 +426,28 @@ func updateAppSet(db prefixer.Prefixer, doc *Permission, typ, docType, slug stri
 
 // CreateShareSet creates a Permission doc for sharing by link
 func CreateShareSet(db prefixer.Prefixer, parent *Permission, codes, shortcodes map[string]string, set Set, expiresAt *time.Time) (*Permission, error) {
+	return createCodesSet(db, TypeShareByLink, parent, codes, shortcodes, set, expiresAt)
+}
+
+// CreateGuestSet creates a Permission doc for a guest token. The set must
+// be restricted to a list of documents with some explicit verbs, and the
+// token must expire in less than MaxGuestTTL.
+func CreateGuestSet(db prefixer.Prefixer, parent *Permission, codes map[string]string, set Set, expiresAt time.Time) (*Permission, error) {
+	if len(set) == 0 {
+		return nil, ErrGuestNotExplicit
+	}
+	for _, rule := range set {
+		if rule.Selector != "" || len(rule.Values) == 0 || len(rule.Verbs) == 0 {
+			return nil, ErrGuestNotExplicit
+		}
+	}
+	if time.Until(expiresAt) <= 0 || time.Until(expiresAt) > MaxGuestTTL {
+		return nil, ErrGuestTTL
+	}
+	return createCodesSet(db, TypeShareGuest, parent, codes, nil, set, &expiresAt)
+}
+
+func createCodesSet(db prefixer.Prefixer, typ string, parent *Permission, codes, shortcodes map[string]string, set Set, expiresAt *time.Time) (*Permission, error) {
 	if parent.Type != TypeWebapp && parent.Type != TypeKonnector && parent.Type != TypeOauth {
 		return nil, ErrOnlyAppCanCreateSubSet
 	}
@@ -412,7 +468,7 @@ func CreateShareSet(db prefixer.Prefixer, parent *Permission, codes, shortcodes
 
 	// SourceID stays the same, allow quick destruction of all children permissions
 	doc := &Permission{
-		Type:        TypeShareByLink,
+		Type:        typ,
 		SourceID:    parent.SourceID,
 		Permissions: set,
 		Codes:       codes,
@@ -0,0 +1,215 @@
+// Package photos is for the albums of photos (io.cozy.photos.albums). The
+// photos of an album are the files that reference it, as explained in
+// docs/references-docs-in-vfs.md.
+package photos
+
+import (
+	"os"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// photosPerPage is the number of photos fetched by request to CouchDB when
+// all the photos of an album are needed
+const photosPerPage = 100
+
+// Album is a struct for an album of photos. The cover is the most recent
+// photo of the album, and is updated when photos are added or removed.
+type Album struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	CoverID   string    `json:"cover_id,omitempty"`
+}
+
+// ID returns the album qualified identifier
+func (a *Album) ID() string { return a.DocID }
+
+// Rev returns the album revision
+func (a *Album) Rev() string { return a.DocRev }
+
+// DocType returns the album document type
+func (a *Album) DocType() string { return consts.PhotosAlbums }
+
+// Clone implements couchdb.Doc
+func (a *Album) Clone() couchdb.Doc {
+	cloned := *a
+	return &cloned
+}
+
+// SetID changes the album qualified identifier
+func (a *Album) SetID(id string) { a.DocID = id }
+
+// SetRev changes the album revision
+func (a *Album) SetRev(rev string) { a.DocRev = rev }
+
+// Ref returns the reference to the album, as used in the referenced_by
+// field of its photos
+func (a *Album) Ref() couchdb.DocReference {
+	return couchdb.DocReference{ID: a.DocID, Type: consts.PhotosAlbums}
+}
+
+// Create creates a new empty album with the given name
+func Create(inst *instance.Instance, name string) (*Album, error) {
+	if name == "" {
+		return nil, ErrMissingName
+	}
+	a := &Album{Name: name, CreatedAt: time.Now()}
+	if err := couchdb.CreateDoc(inst, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Find returns the album stored in database from a given ID
+func Find(db prefixer.Prefixer, albumID string) (*Album, error) {
+	doc := &Album{}
+	err := couchdb.GetDoc(db, consts.PhotosAlbums, albumID, doc)
+	return doc, err
+}
+
+// AddPhotos adds the photos with the given identifiers to the album
+func (a *Album) AddPhotos(inst *instance.Instance, fileIDs []string) error {
+	fs := inst.VFS()
+	ref := a.Ref()
+	for _, id := range fileIDs {
+		file, err := fs.FileByID(id)
+		if err != nil {
+			return err
+		}
+		if file.Class != "image" {
+			return ErrNotAPhoto
+		}
+		if hasReference(file, ref) {
+			continue
+		}
+		file.AddReferencedBy(ref)
+		if err = couchdb.UpdateDoc(inst, file); err != nil {
+			return err
+		}
+	}
+	return a.UpdateCover(inst)
+}
+
+// RemovePhotos removes the photos with the given identifiers from the album
+func (a *Album) RemovePhotos(inst *instance.Instance, fileIDs []string) error {
+	fs := inst.VFS()
+	ref := a.Ref()
+	for _, id := range fileIDs {
+		file, err := fs.FileByID(id)
+		if err != nil {
+			return err
+		}
+		if !hasReference(file, ref) {
+			continue
+		}
+		file.RemoveReferencedBy(ref)
+		if err = couchdb.UpdateDoc(inst, file); err != nil {
+			return err
+		}
+	}
+	return a.UpdateCover(inst)
+}
+
+func hasReference(file *vfs.FileDoc, ref couchdb.DocReference) bool {
+	for _, r := range file.ReferencedBy {
+		if r.ID == ref.ID && r.Type == ref.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// PhotoIDs returns the identifiers of all the photos of the album
+func (a *Album) PhotoIDs(db prefixer.Prefixer) ([]string, error) {
+	key := []string{consts.PhotosAlbums, a.DocID}
+	var ids []string
+	skip := 0
+	for {
+		req := &couchdb.ViewRequest{
+			Key:    key,
+			Reduce: false,
+			Limit:  photosPerPage,
+			Skip:   skip,
+		}
+		var res couchdb.ViewResponse
+		if err := couchdb.ExecView(db, consts.FilesReferencedByView, req, &res); err != nil {
+			return nil, err
+		}
+		for _, row := range res.Rows {
+			ids = append(ids, row.ID)
+		}
+		if len(res.Rows) < photosPerPage {
+			return ids, nil
+		}
+		skip += len(res.Rows)
+	}
+}
+
+// UpdateCover chooses the most recent photo of the album as its cover, and
+// saves the album if the cover has changed.
+func (a *Album) UpdateCover(inst *instance.Instance) error {
+	key := []string{consts.PhotosAlbums, a.DocID}
+	req := &couchdb.ViewRequest{
+		StartKey:   []string{key[0], key[1], couchdb.MaxString},
+		EndKey:     key,
+		Reduce:     false,
+		Descending: true,
+		Limit:      1,
+	}
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(inst, consts.ReferencedBySortedByDatetimeView, req, &res)
+	if err != nil {
+		return err
+	}
+	coverID := ""
+	if len(res.Rows) > 0 {
+		coverID = res.Rows[0].ID
+	}
+	if coverID == a.CoverID {
+		return nil
+	}
+	a.CoverID = coverID
+	return couchdb.UpdateDoc(inst, a)
+}
+
+// Cover returns the file used as the cover of the album
+func (a *Album) Cover(inst *instance.Instance) (*vfs.FileDoc, error) {
+	if a.CoverID == "" {
+		return nil, ErrNoCover
+	}
+	return inst.VFS().FileByID(a.CoverID)
+}
+
+// Delete removes the album from the referenced_by of its photos, and then
+// deletes it. The photos are kept in the VFS.
+func (a *Album) Delete(inst *instance.Instance) error {
+	ids, err := a.PhotoIDs(inst)
+	if err != nil {
+		return err
+	}
+	fs := inst.VFS()
+	ref := a.Ref()
+	for _, id := range ids {
+		file, err := fs.FileByID(id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		file.RemoveReferencedBy(ref)
+		if err = couchdb.UpdateDoc(inst, file); err != nil {
+			return err
+		}
+	}
+	return couchdb.DeleteDoc(inst, a)
+}
+
+var _ couchdb.Doc = &Album{}
@@ -0,0 +1,118 @@
+package photos
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+const (
+	// maxTimeGap is the maximal duration between two consecutive photos of
+	// the same moment
+	maxTimeGap = 6 * time.Hour
+	// maxDistance is the maximal distance, in kilometers, between two
+	// consecutive photos of the same moment
+	maxDistance = 50.0
+	// minPhotosInMoment is the minimal number of photos for suggesting a
+	// moment
+	minPhotosInMoment = 5
+)
+
+// earthRadius is the mean radius of the Earth, in kilometers
+const earthRadius = 6371.0
+
+// GPS is a position, in degrees, as extracted from the EXIF of a photo
+type GPS struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"long"`
+}
+
+// Point is a photo, with what is used to cluster it: its date and time,
+// and its position if known.
+type Point struct {
+	ID       string    `json:"id"`
+	Datetime time.Time `json:"datetime"`
+	GPS      *GPS      `json:"gps,omitempty"`
+}
+
+// distance returns the distance in kilometers between two positions, with
+// the haversine formula.
+func distance(a, b *GPS) float64 {
+	rad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * rad
+	dLong := (b.Long - a.Long) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// Cluster groups the photos by moments: the photos are sorted by date, and
+// a new moment starts when there is a too large gap of time or of distance
+// between two consecutive photos. The photos without position are only
+// grouped by their date.
+func Cluster(points []Point) [][]Point {
+	sorted := make([]Point, len(points))
+	copy(sorted, points)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Datetime.Before(sorted[j].Datetime)
+	})
+
+	var groups [][]Point
+	var current []Point
+	var last *GPS
+	for _, p := range sorted {
+		if len(current) > 0 {
+			prev := current[len(current)-1]
+			tooLate := p.Datetime.Sub(prev.Datetime) > maxTimeGap
+			tooFar := last != nil && p.GPS != nil && distance(last, p.GPS) > maxDistance
+			if tooLate || tooFar {
+				groups = append(groups, current)
+				current = nil
+				last = nil
+			}
+		}
+		current = append(current, p)
+		if p.GPS != nil {
+			last = p.GPS
+		}
+	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+	return groups
+}
+
+// pointFromFile returns the point for a photo, or false if the file can't be
+// clustered (not an image, in the trash, or without a date).
+func pointFromFile(doc *vfs.FileDoc) (Point, bool) {
+	if doc.Class != "image" || doc.Trashed || doc.Metadata == nil {
+		return Point{}, false
+	}
+	var dt time.Time
+	switch v := doc.Metadata["datetime"].(type) {
+	case time.Time:
+		dt = v
+	case string:
+		var err error
+		if dt, err = time.Parse(time.RFC3339, v); err != nil {
+			return Point{}, false
+		}
+	}
+	if dt.IsZero() {
+		return Point{}, false
+	}
+	p := Point{ID: doc.ID(), Datetime: dt}
+	switch gps := doc.Metadata["gps"].(type) {
+	case map[string]float64:
+		p.GPS = &GPS{Lat: gps["lat"], Long: gps["long"]}
+	case map[string]interface{}:
+		lat, okLat := gps["lat"].(float64)
+		long, okLong := gps["long"].(float64)
+		if okLat && okLong {
+			p.GPS = &GPS{Lat: lat, Long: long}
+		}
+	}
+	return p, true
+}
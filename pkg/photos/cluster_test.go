@@ -0,0 +1,89 @@
+package photos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	paris = &GPS{Lat: 48.8566, Long: 2.3522}
+	lyon  = &GPS{Lat: 45.7640, Long: 4.8357}
+)
+
+func TestDistance(t *testing.T) {
+	assert.InDelta(t, 0, distance(paris, paris), 0.001)
+	assert.InDelta(t, 392, distance(paris, lyon), 5)
+	assert.InDelta(t, distance(paris, lyon), distance(lyon, paris), 0.001)
+}
+
+func TestCluster(t *testing.T) {
+	start := time.Date(2018, 7, 14, 10, 0, 0, 0, time.UTC)
+	at := func(h float64) time.Time { return start.Add(time.Duration(h * float64(time.Hour))) }
+	points := []Point{
+		{ID: "c", Datetime: at(2), GPS: paris},
+		{ID: "a", Datetime: at(0), GPS: paris},
+		{ID: "b", Datetime: at(1)},
+		// Too late after c
+		{ID: "d", Datetime: at(10), GPS: paris},
+		// Too far from d
+		{ID: "e", Datetime: at(11), GPS: lyon},
+		{ID: "f", Datetime: at(12)},
+	}
+	groups := Cluster(points)
+	if !assert.Len(t, groups, 3) {
+		return
+	}
+	ids := func(group []Point) []string {
+		var list []string
+		for _, p := range group {
+			list = append(list, p.ID)
+		}
+		return list
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, ids(groups[0]))
+	assert.Equal(t, []string{"d"}, ids(groups[1]))
+	assert.Equal(t, []string{"e", "f"}, ids(groups[2]))
+
+	assert.Len(t, Cluster(nil), 0)
+}
+
+func TestPointFromFile(t *testing.T) {
+	doc := &vfs.FileDoc{DocID: "photo", Class: "image"}
+	_, ok := pointFromFile(doc)
+	assert.False(t, ok)
+
+	doc.Metadata = vfs.Metadata{
+		"datetime": "2018-07-14T10:00:00Z",
+		"gps":      map[string]interface{}{"lat": 48.8566, "long": 2.3522},
+	}
+	p, ok := pointFromFile(doc)
+	assert.True(t, ok)
+	assert.Equal(t, "photo", p.ID)
+	assert.Equal(t, 2018, p.Datetime.Year())
+	if assert.NotNil(t, p.GPS) {
+		assert.Equal(t, 48.8566, p.GPS.Lat)
+	}
+
+	doc.Trashed = true
+	_, ok = pointFromFile(doc)
+	assert.False(t, ok)
+}
+
+func TestMomentAccepts(t *testing.T) {
+	start := time.Date(2018, 7, 14, 10, 0, 0, 0, time.UTC)
+	m := newMoment([]Point{
+		{ID: "a", Datetime: start, GPS: paris},
+		{ID: "b", Datetime: start.Add(time.Hour)},
+	})
+	assert.Equal(t, start, m.StartDate)
+	assert.Equal(t, start.Add(time.Hour), m.EndDate)
+	assert.Equal(t, paris, m.GPS)
+	assert.Equal(t, []string{"a", "b"}, m.PhotoIDs())
+
+	assert.True(t, m.accepts(Point{Datetime: start.Add(3 * time.Hour)}))
+	assert.False(t, m.accepts(Point{Datetime: start.Add(8 * time.Hour)}))
+	assert.False(t, m.accepts(Point{Datetime: start, GPS: lyon}))
+}
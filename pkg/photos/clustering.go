@@ -0,0 +1,233 @@
+package photos
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+const (
+	// clusteringStateID is the identifier of the local document where the
+	// state of the clustering is saved between two runs
+	clusteringStateID = "clustering"
+	// clusteringBatchSize is the number of changes of the files fetched by
+	// request to CouchDB
+	clusteringBatchSize = 1000
+	// maxPendingPhotos is the maximal number of photos that are kept for
+	// the next run, when they are not enough for a moment
+	maxPendingPhotos = 1000
+)
+
+// clusteringState is what is kept between two runs of the clustering: the
+// sequence number in the changes feed of the files, and the photos that have
+// been seen, but are not in a moment (yet).
+type clusteringState struct {
+	LastSeq string  `json:"last_seq"`
+	Pending []Point `json:"pending,omitempty"`
+}
+
+func loadClusteringState(inst *instance.Instance) (*clusteringState, error) {
+	state := &clusteringState{}
+	doc, err := couchdb.GetLocal(inst, consts.PhotosMoments, clusteringStateID)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(raw, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func saveClusteringState(inst *instance.Instance, state *clusteringState) error {
+	doc, err := couchdb.GetLocal(inst, consts.PhotosMoments, clusteringStateID)
+	if couchdb.IsNoDatabaseError(err) {
+		if err = couchdb.CreateDB(inst, consts.PhotosMoments); err != nil && !couchdb.IsFileExists(err) {
+			return err
+		}
+	} else if err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
+	updated := map[string]interface{}{
+		"last_seq": state.LastSeq,
+		"pending":  state.Pending,
+	}
+	if rev, ok := doc["_rev"]; ok {
+		updated["_rev"] = rev
+	}
+	return couchdb.PutLocal(inst, consts.PhotosMoments, clusteringStateID, updated)
+}
+
+// fetchChangedPhotos reads the changes feed of the files since the given
+// sequence number. It returns the photos that can be clustered, the
+// identifiers of the photos that have been deleted or trashed, and the new
+// sequence number.
+func fetchChangedPhotos(inst *instance.Instance, since string) (map[string]Point, map[string]bool, string, error) {
+	changed := make(map[string]Point)
+	removed := make(map[string]bool)
+	for {
+		res, err := couchdb.GetChanges(inst, &couchdb.ChangesRequest{
+			DocType:     consts.Files,
+			IncludeDocs: true,
+			Since:       since,
+			Limit:       clusteringBatchSize,
+		})
+		if err != nil {
+			return nil, nil, "", err
+		}
+		for _, change := range res.Results {
+			if deleted, _ := change.Doc.M["_deleted"].(bool); deleted {
+				delete(changed, change.DocID)
+				removed[change.DocID] = true
+				continue
+			}
+			if change.Doc.M["type"] != consts.FileType || change.Doc.M["class"] != "image" {
+				continue
+			}
+			raw, err := json.Marshal(change.Doc)
+			if err != nil {
+				return nil, nil, "", err
+			}
+			var doc vfs.FileDoc
+			if err = json.Unmarshal(raw, &doc); err != nil {
+				return nil, nil, "", err
+			}
+			if p, ok := pointFromFile(&doc); ok {
+				changed[p.ID] = p
+				delete(removed, p.ID)
+			} else {
+				delete(changed, doc.ID())
+				removed[doc.ID()] = true
+			}
+		}
+		since = res.LastSeq
+		if res.Pending == 0 || len(res.Results) == 0 {
+			return changed, removed, since, nil
+		}
+	}
+}
+
+// RunClustering looks at the photos added since its last run, and groups
+// them in moments. A new photo can be added to a moment that is still
+// suggested, or be the start of a new moment. The photos that are already
+// in a moment are not clustered again, even if the moment has been
+// dismissed.
+func RunClustering(inst *instance.Instance) error {
+	mu := lock.ReadWrite(inst, "photos/clustering")
+	if err := mu.Lock(); err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
+	state, err := loadClusteringState(inst)
+	if err != nil {
+		return err
+	}
+	changed, removed, seq, err := fetchChangedPhotos(inst, state.LastSeq)
+	if err != nil {
+		return err
+	}
+	moments, err := GetAllMoments(inst)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	dirty := make(map[*Moment]bool)
+	for _, m := range moments {
+		if m.Status == MomentSuggested && len(removed) > 0 {
+			kept := m.Photos[:0]
+			for _, p := range m.Photos {
+				if !removed[p.ID] {
+					kept = append(kept, p)
+				}
+			}
+			if len(kept) != len(m.Photos) {
+				m.setPhotos(kept)
+				dirty[m] = true
+			}
+		}
+		for _, p := range m.Photos {
+			known[p.ID] = true
+		}
+	}
+
+	// The new photos, and the ones from the previous runs, that are not in a
+	// moment
+	var candidates []Point
+	for _, p := range state.Pending {
+		if !removed[p.ID] && !known[p.ID] {
+			if _, ok := changed[p.ID]; !ok {
+				candidates = append(candidates, p)
+			}
+		}
+	}
+	for _, p := range changed {
+		if !known[p.ID] {
+			candidates = append(candidates, p)
+		}
+	}
+
+	var remaining []Point
+	for _, p := range candidates {
+		added := false
+		for _, m := range moments {
+			if m.Status == MomentSuggested && len(m.Photos) > 0 && m.accepts(p) {
+				m.setPhotos(append(m.Photos, p))
+				dirty[m] = true
+				added = true
+				break
+			}
+		}
+		if !added {
+			remaining = append(remaining, p)
+		}
+	}
+
+	var pending []Point
+	for _, group := range Cluster(remaining) {
+		if len(group) < minPhotosInMoment {
+			pending = append(pending, group...)
+			continue
+		}
+		if err = couchdb.CreateDoc(inst, newMoment(group)); err != nil {
+			return err
+		}
+	}
+
+	for m := range dirty {
+		if len(m.Photos) < minPhotosInMoment {
+			// The photos of a moment that is too small are given another
+			// chance on the next run
+			pending = append(pending, m.Photos...)
+			err = couchdb.DeleteDoc(inst, m)
+		} else {
+			err = couchdb.UpdateDoc(inst, m)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep only the most recent pending photos
+	if len(pending) > maxPendingPhotos {
+		sort.Slice(pending, func(i, j int) bool {
+			return pending[i].Datetime.After(pending[j].Datetime)
+		})
+		pending = pending[:maxPendingPhotos]
+	}
+	state.LastSeq = seq
+	state.Pending = pending
+	return saveClusteringState(inst, state)
+}
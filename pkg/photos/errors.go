@@ -0,0 +1,16 @@
+package photos
+
+import "errors"
+
+var (
+	// ErrMissingName is returned when an album is created without a name
+	ErrMissingName = errors.New("The album must have a name")
+	// ErrNotAPhoto is returned when trying to add a file that is not an
+	// image, or a directory, to an album
+	ErrNotAPhoto = errors.New("Only the images can be added to an album")
+	// ErrNoCover is returned when the cover of an empty album is requested
+	ErrNoCover = errors.New("The album has no photo for its cover")
+	// ErrMomentNotSuggested is returned when trying to accept or dismiss a
+	// moment that has already been accepted or dismissed
+	ErrMomentNotSuggested = errors.New("The moment is no longer suggested")
+)
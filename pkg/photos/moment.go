@@ -0,0 +1,202 @@
+package photos
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+const (
+	// MomentSuggested is the status of a moment that can be accepted or
+	// dismissed by the user
+	MomentSuggested = "suggested"
+	// MomentAccepted is the status of a moment that has been transformed in
+	// an album
+	MomentAccepted = "accepted"
+	// MomentDismissed is the status of a moment that the user doesn't want
+	MomentDismissed = "dismissed"
+)
+
+// Moment is a group of photos taken at the same time and place, that is
+// suggested to the user as an album. The moments are kept after they have
+// been accepted or dismissed, so that their photos are not suggested again.
+type Moment struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	Status    string    `json:"status"`
+	StartDate time.Time `json:"start_date"`
+	EndDate   time.Time `json:"end_date"`
+	GPS       *GPS      `json:"gps,omitempty"`
+	Photos    []Point   `json:"photos"`
+	AlbumID   string    `json:"album_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ID returns the moment qualified identifier
+func (m *Moment) ID() string { return m.DocID }
+
+// Rev returns the moment revision
+func (m *Moment) Rev() string { return m.DocRev }
+
+// DocType returns the moment document type
+func (m *Moment) DocType() string { return consts.PhotosMoments }
+
+// Clone implements couchdb.Doc
+func (m *Moment) Clone() couchdb.Doc {
+	cloned := *m
+	if m.GPS != nil {
+		gps := *m.GPS
+		cloned.GPS = &gps
+	}
+	cloned.Photos = make([]Point, len(m.Photos))
+	copy(cloned.Photos, m.Photos)
+	return &cloned
+}
+
+// SetID changes the moment qualified identifier
+func (m *Moment) SetID(id string) { m.DocID = id }
+
+// SetRev changes the moment revision
+func (m *Moment) SetRev(rev string) { m.DocRev = rev }
+
+// newMoment returns a suggested moment for the given photos
+func newMoment(points []Point) *Moment {
+	m := &Moment{Status: MomentSuggested, CreatedAt: time.Now()}
+	m.setPhotos(points)
+	return m
+}
+
+// setPhotos changes the photos of the moment, and computes its dates and
+// its position (the mean of the positions of its photos).
+func (m *Moment) setPhotos(points []Point) {
+	m.Photos = points
+	m.GPS = nil
+	var lat, long float64
+	nb := 0
+	for i, p := range points {
+		if i == 0 || p.Datetime.Before(m.StartDate) {
+			m.StartDate = p.Datetime
+		}
+		if i == 0 || p.Datetime.After(m.EndDate) {
+			m.EndDate = p.Datetime
+		}
+		if p.GPS != nil {
+			lat += p.GPS.Lat
+			long += p.GPS.Long
+			nb++
+		}
+	}
+	if nb > 0 {
+		m.GPS = &GPS{Lat: lat / float64(nb), Long: long / float64(nb)}
+	}
+}
+
+// accepts returns true if the photo can be added to this moment
+func (m *Moment) accepts(p Point) bool {
+	if p.Datetime.Before(m.StartDate.Add(-maxTimeGap)) || p.Datetime.After(m.EndDate.Add(maxTimeGap)) {
+		return false
+	}
+	return m.GPS == nil || p.GPS == nil || distance(m.GPS, p.GPS) <= maxDistance
+}
+
+// PhotoIDs returns the identifiers of the photos of the moment
+func (m *Moment) PhotoIDs() []string {
+	ids := make([]string, len(m.Photos))
+	for i, p := range m.Photos {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+// Accept creates an album with the photos of the moment. If no name is
+// given, the album is named after the date of the moment.
+func (m *Moment) Accept(inst *instance.Instance, name string) (*Album, error) {
+	if m.Status != MomentSuggested {
+		return nil, ErrMomentNotSuggested
+	}
+	if name == "" {
+		name = m.StartDate.Format("2 January 2006")
+	}
+	album, err := Create(inst, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Some photos may have been deleted since the moment was suggested
+	fs := inst.VFS()
+	var ids []string
+	for _, id := range m.PhotoIDs() {
+		if file, err := fs.FileByID(id); err == nil && !file.Trashed {
+			ids = append(ids, id)
+		}
+	}
+	if err = album.AddPhotos(inst, ids); err != nil {
+		return nil, err
+	}
+
+	m.Status = MomentAccepted
+	m.AlbumID = album.ID()
+	if err = couchdb.UpdateDoc(inst, m); err != nil {
+		return nil, err
+	}
+	return album, nil
+}
+
+// Dismiss marks the moment as dismissed by the user
+func (m *Moment) Dismiss(db couchdb.Database) error {
+	if m.Status != MomentSuggested {
+		return ErrMomentNotSuggested
+	}
+	m.Status = MomentDismissed
+	return couchdb.UpdateDoc(db, m)
+}
+
+// FindMoment returns the moment stored in database from a given ID
+func FindMoment(db prefixer.Prefixer, momentID string) (*Moment, error) {
+	doc := &Moment{}
+	err := couchdb.GetDoc(db, consts.PhotosMoments, momentID, doc)
+	return doc, err
+}
+
+// GetAllMoments returns all the moments, whatever their status
+func GetAllMoments(db couchdb.Database) ([]*Moment, error) {
+	var list []*Moment
+	err := couchdb.ForeachDocs(db, consts.PhotosMoments, func(_ string, raw json.RawMessage) error {
+		var m Moment
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		list = append(list, &m)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetSuggestedMoments returns the moments that can be accepted or dismissed,
+// sorted by date
+func GetSuggestedMoments(db couchdb.Database) ([]*Moment, error) {
+	all, err := GetAllMoments(db)
+	if err != nil {
+		return nil, err
+	}
+	var list []*Moment
+	for _, m := range all {
+		if m.Status == MomentSuggested {
+			list = append(list, m)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartDate.Before(list[j].StartDate)
+	})
+	return list, nil
+}
+
+var _ couchdb.Doc = &Moment{}
@@ -0,0 +1,74 @@
+package photos
+
+import (
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/sharing"
+)
+
+// photosRuleValue is the value of the referenced_by selector for the photos
+// of the album, in the sharing rules and in the permissions
+func (a *Album) photosRuleValue() string {
+	return consts.PhotosAlbums + "/" + a.DocID
+}
+
+// SharingRules returns the rules for sharing the album with other cozy
+// instances: the album document itself, and the photos that reference it.
+// The recipients can add and remove photos, unless they are read-only, and
+// the sharing is revoked if the album is deleted.
+func (a *Album) SharingRules() []sharing.Rule {
+	return []sharing.Rule{
+		{
+			Title:   a.Name,
+			DocType: consts.PhotosAlbums,
+			Values:  []string{a.DocID},
+			Update:  sharing.ActionRuleSync,
+			Remove:  sharing.ActionRuleRevoke,
+		},
+		{
+			Title:    "photos",
+			DocType:  consts.Files,
+			Selector: couchdb.SelectorReferencedBy,
+			Values:   []string{a.photosRuleValue()},
+			Add:      sharing.ActionRuleSync,
+			Update:   sharing.ActionRuleNone,
+			Remove:   sharing.ActionRuleSync,
+		},
+	}
+}
+
+// NewSharing prepares a sharing of the album on the cozy of its owner. The
+// recipients must be added before the sharing is created.
+func (a *Album) NewSharing(inst *instance.Instance, slug string) (*sharing.Sharing, error) {
+	s := &sharing.Sharing{
+		Description: a.Name,
+		Rules:       a.SharingRules(),
+	}
+	if err := s.BeOwner(inst, slug); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LinkPermissions returns the permissions for sharing the album by a link:
+// the album and its photos can be read, but not modified.
+func (a *Album) LinkPermissions() permissions.Set {
+	verbs := permissions.Verbs(permissions.GET)
+	return permissions.Set{
+		permissions.Rule{
+			Title:  a.Name,
+			Type:   consts.PhotosAlbums,
+			Verbs:  verbs,
+			Values: []string{a.DocID},
+		},
+		permissions.Rule{
+			Title:    "photos",
+			Type:     consts.Files,
+			Verbs:    verbs,
+			Selector: couchdb.SelectorReferencedBy,
+			Values:   []string{a.photosRuleValue()},
+		},
+	}
+}
@@ -0,0 +1,167 @@
+// Package previews renders the pages of the PDF files as images, so that the
+// documents can be previewed in the browser without downloading the whole
+// file.
+package previews
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+const (
+	// DefaultWidth is the width in pixels of a rendered page, when no width
+	// is requested
+	DefaultWidth = 800
+	// MinWidth is the minimal width that can be requested
+	MinWidth = 16
+	// MaxWidth is the maximal width that can be requested
+	MaxWidth = 2400
+
+	// cacheTTL is the duration for which a rendered page is kept in cache
+	cacheTTL = 24 * time.Hour
+	// renderTimeout is the maximal duration for rendering a page
+	renderTimeout = 30 * time.Second
+)
+
+var (
+	// ErrNotPDF is used when the file is not a PDF
+	ErrNotPDF = errors.New("The file is not a PDF")
+	// ErrInvalidPage is used when the page number is not a positive integer
+	ErrInvalidPage = errors.New("The page must be a positive integer")
+	// ErrInvalidWidth is used when the requested width is out of bounds
+	ErrInvalidWidth = errors.New("The width is out of bounds")
+	// ErrInvalidFormat is used when the format is neither png nor jpeg
+	ErrInvalidFormat = errors.New("The format must be png or jpeg")
+	// ErrPageNotFound is used when the PDF has less pages than the requested
+	// page number
+	ErrPageNotFound = errors.New("The page does not exist")
+)
+
+// Formats is the map of the formats in which a page can be rendered to their
+// content-types
+var Formats = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+}
+
+// Page describes a rendering of a page of a PDF file
+type Page struct {
+	Number int
+	Width  int
+	Format string
+}
+
+// Validate checks the page number, the width and the format, and uses the
+// default values for the width and the format when they are not set.
+func (p *Page) Validate() error {
+	if p.Number < 1 {
+		return ErrInvalidPage
+	}
+	if p.Width == 0 {
+		p.Width = DefaultWidth
+	}
+	if p.Width < MinWidth || p.Width > MaxWidth {
+		return ErrInvalidWidth
+	}
+	if p.Format == "" {
+		p.Format = "png"
+	}
+	if _, ok := Formats[p.Format]; !ok {
+		return ErrInvalidFormat
+	}
+	return nil
+}
+
+// ETag returns an etag for the rendering of this page of the given file. It
+// changes when the content of the file is modified.
+func (p *Page) ETag(doc *vfs.FileDoc) string {
+	return `"` + hex.EncodeToString(doc.MD5Sum) + "-" + p.suffix() + `"`
+}
+
+func (p *Page) suffix() string {
+	return strconv.Itoa(p.Number) + "-" + strconv.Itoa(p.Width) + "." + p.Format
+}
+
+// args returns the arguments for pdftoppm to render the page from stdin to
+// stdout
+func (p *Page) args() []string {
+	n := strconv.Itoa(p.Number)
+	return []string{
+		"-f", n, "-l", n, // Only this page
+		"-singlefile",                        // Don't add the page number to the output name
+		"-scale-to-x", strconv.Itoa(p.Width), // Scale to the requested width
+		"-scale-to-y", "-1", // and keep the aspect ratio
+		"-" + p.Format, // Output format
+		"-",            // Read the PDF from stdin (and write the image to stdout)
+	}
+}
+
+// Render returns the page of the PDF file, rendered as an image. The rendered
+// pages are kept in cache for some time.
+func Render(inst *instance.Instance, doc *vfs.FileDoc, p *Page) ([]byte, error) {
+	if doc.Mime != "application/pdf" {
+		return nil, ErrNotPDF
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	cache := config.GetConfig().CacheStorage
+	key := "pdf-pages:" + inst.DBPrefix() + ":" + doc.ID() + ":" +
+		hex.EncodeToString(doc.MD5Sum) + ":" + p.suffix()
+	if r, ok := cache.Get(key); ok {
+		if data, err := ioutil.ReadAll(r); err == nil {
+			return data, nil
+		}
+	}
+
+	data, err := render(inst, doc, p)
+	if err != nil {
+		return nil, err
+	}
+	cache.Set(key, data, utils.DurationFuzzing(cacheTTL, 0.10))
+	return data, nil
+}
+
+func render(inst *instance.Instance, doc *vfs.FileDoc, p *Page) ([]byte, error) {
+	f, err := inst.VFS().OpenFile(doc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pdftoppmCmd := config.GetConfig().Jobs.PdftoppmCmd
+	if pdftoppmCmd == "" {
+		pdftoppmCmd = "pdftoppm"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), renderTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, pdftoppmCmd, p.args()...) // #nosec
+	cmd.Stdin = f
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "Wrong page range") {
+			return nil, ErrPageNotFound
+		}
+		inst.Logger().WithField("nspace", "previews").
+			WithField("stderr", stderr.String()).
+			WithField("file_id", doc.ID()).
+			Errorf("pdftoppm failed: %s", err)
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
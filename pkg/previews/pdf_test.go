@@ -0,0 +1,33 @@
+package previews
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePage(t *testing.T) {
+	p := &Page{Number: 2}
+	assert.NoError(t, p.Validate())
+	assert.Equal(t, DefaultWidth, p.Width)
+	assert.Equal(t, "png", p.Format)
+
+	assert.Equal(t, ErrInvalidPage, (&Page{Number: 0}).Validate())
+	assert.Equal(t, ErrInvalidWidth, (&Page{Number: 1, Width: 8}).Validate())
+	assert.Equal(t, ErrInvalidWidth, (&Page{Number: 1, Width: 10000}).Validate())
+	assert.Equal(t, ErrInvalidFormat, (&Page{Number: 1, Format: "gif"}).Validate())
+}
+
+func TestArgs(t *testing.T) {
+	p := &Page{Number: 3, Width: 640, Format: "jpeg"}
+	expected := []string{
+		"-f", "3", "-l", "3",
+		"-singlefile",
+		"-scale-to-x", "640",
+		"-scale-to-y", "-1",
+		"-jpeg",
+		"-",
+	}
+	assert.Equal(t, expected, p.args())
+	assert.Equal(t, "3-640.jpeg", p.suffix())
+}
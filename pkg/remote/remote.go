@@ -45,8 +45,23 @@ var (
 	// ErrRemoteAssetNotFound is used when the wanted remote asset is not part of
 	// our defined list.
 	ErrRemoteAssetNotFound = errors.New("wanted remote asset is not part of our asset list")
+	// ErrReservedVariable is used when a request from an app gives a value for a
+	// variable reserved for the secrets
+	ErrReservedVariable = errors.New("the variables prefixed by secret_ are reserved")
 )
 
+// secretPrefix is the prefix of the variables whose values are taken from the
+// secrets of the remote doctype, and not from the request of the app.
+const secretPrefix = "secret_"
+
+// doNotForwardHeaders are the headers that can't be sent to the external
+// website, even if they are in the request defined by the developer: the
+// cookies never cross the proxy.
+var doNotForwardHeaders = []string{
+	"Cookie",
+	"Cookie2",
+}
+
 const rawURL = "https://raw.githubusercontent.com/cozy/cozy-doctypes/master/%s/request"
 
 var remoteClient = &http.Client{
@@ -122,6 +137,54 @@ func (r *Request) Clone() couchdb.Doc {
 	return &cloned
 }
 
+// Secrets are the values injected by the stack in the request for a remote
+// doctype, like the API keys of the external website. They are kept in the
+// global secrets database, so that the apps never see them.
+type Secrets struct {
+	DocID  string            `json:"_id,omitempty"`
+	DocRev string            `json:"_rev,omitempty"`
+	Values map[string]string `json:"values"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (s *Secrets) ID() string { return s.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (s *Secrets) Rev() string { return s.DocRev }
+
+// SetID is used to implement the couchdb.Doc interface
+func (s *Secrets) SetID(id string) { s.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (s *Secrets) SetRev(rev string) { s.DocRev = rev }
+
+// DocType implements couchdb.Doc
+func (s *Secrets) DocType() string { return consts.RemoteSecrets }
+
+// Clone implements couchdb.Doc
+func (s *Secrets) Clone() couchdb.Doc {
+	cloned := *s
+	cloned.Values = make(map[string]string)
+	for k, v := range s.Values {
+		cloned.Values[k] = v
+	}
+	return &cloned
+}
+
+// findSecrets returns the secrets for the given remote doctype, or nil if it
+// has no secrets.
+func findSecrets(doctype string) (map[string]string, error) {
+	var secrets Secrets
+	err := couchdb.GetDoc(couchdb.GlobalSecretsDB, consts.RemoteSecrets, doctype, &secrets)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return secrets.Values, nil
+}
+
 // Remote is the struct used to call a remote website for a doctype
 type Remote struct {
 	Verb    string
@@ -340,7 +403,26 @@ func (remote *Remote) ProxyTo(doctype string, ins *instance.Instance, rw http.Re
 		log.Infof("Error on extracting variables: %s", err)
 		return ErrInvalidVariables
 	}
-	if err = injectVariables(remote, vars); err != nil {
+	for k := range vars {
+		if strings.HasPrefix(k, secretPrefix) {
+			return ErrReservedVariable
+		}
+	}
+	secrets, err := findSecrets(doctype)
+	if err != nil {
+		log.Errorf("Cannot load the secrets for %s: %s", doctype, err)
+		return err
+	}
+	// The secrets are not put in vars, as this map is logged in the request
+	// document
+	all := make(map[string]string, len(vars)+len(secrets))
+	for k, v := range vars {
+		all[k] = v
+	}
+	for k, v := range secrets {
+		all[secretPrefix+k] = v
+	}
+	if err = injectVariables(remote, all); err != nil {
 		return err
 	}
 
@@ -365,6 +447,9 @@ func (remote *Remote) ProxyTo(doctype string, ins *instance.Instance, rw http.Re
 	for k, v := range remote.Headers {
 		req.Header.Set(k, v)
 	}
+	for _, h := range doNotForwardHeaders {
+		req.Header.Del(h)
+	}
 
 	res, err := remoteClient.Do(req)
 	if err != nil {
@@ -394,7 +479,7 @@ func (remote *Remote) ProxyTo(doctype string, ins *instance.Instance, rw http.Re
 	logged := &Request{
 		RemoteDoctype: doctype,
 		Verb:          remote.Verb,
-		URL:           remote.URL.String(),
+		URL:           loggedURL(remote.URL, secrets),
 		ResponseCode:  res.StatusCode,
 		ContentType:   ctype,
 		Variables:     vars,
@@ -415,6 +500,21 @@ func (remote *Remote) ProxyTo(doctype string, ins *instance.Instance, rw http.Re
 	return nil
 }
 
+// loggedURL returns the URL of the request, where the secrets have been
+// masked, for the logs.
+func loggedURL(u *url.URL, secrets map[string]string) string {
+	logged := u.String()
+	for _, v := range secrets {
+		if v == "" {
+			continue
+		}
+		for _, escaped := range []string{v, url.QueryEscape(v), url.PathEscape(v)} {
+			logged = strings.Replace(logged, escaped, "***", -1)
+		}
+	}
+	return logged
+}
+
 // ProxyRemoteAsset proxy the given http request to fetch an asset from our
 // list of available asset list.
 func ProxyRemoteAsset(name string, w http.ResponseWriter) error {
@@ -476,4 +576,5 @@ func copyHeader(dst, src http.Header) {
 var (
 	_ couchdb.Doc = (*Doctype)(nil)
 	_ couchdb.Doc = (*Request)(nil)
+	_ couchdb.Doc = (*Secrets)(nil)
 )
@@ -132,3 +132,20 @@ Accept-Language: {{lang}},en
 	err = injectVariables(r, vars)
 	assert.Equal(t, ErrMissingVar, err)
 }
+
+func TestLoggedURL(t *testing.T) {
+	r, err := ParseRawRequest(doctype, `GET https://example.org/{{path}}?key={{secret_key}}&q={{q}}`)
+	assert.NoError(t, err)
+	secrets := map[string]string{"key": "s3cr3t/&"}
+	vars := map[string]string{
+		"path":       "foo",
+		"q":          "bar",
+		"secret_key": secrets["key"],
+	}
+	err = injectVariables(r, vars)
+	assert.NoError(t, err)
+	assert.Contains(t, r.URL.String(), "s3cr3t")
+	logged := loggedURL(r.URL, secrets)
+	assert.NotContains(t, logged, "s3cr3t")
+	assert.Equal(t, "https://example.org/foo?key=***&q=bar", logged)
+}
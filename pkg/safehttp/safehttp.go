@@ -0,0 +1,91 @@
+// Package safehttp provides an HTTP transport for the requests made by the
+// stack to URLs given by the users, that can't be used to reach the services
+// of the private network of the stack.
+package safehttp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// ErrForbiddenAddress is returned when the host of a URL does not resolve to
+// a public IP address.
+var ErrForbiddenAddress = errors.New("The URL is not allowed")
+
+// privateNetworks are the IP ranges that can't be reached by the stack when
+// it makes a request for a client, as they are not on internet.
+var privateNetworks = parseNetworks(
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// IsPublicIP returns true if the IP address is on internet.
+func IsPublicIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// DialContext resolves the address, and dials it only if it is a public IP
+// address. It is also called for the redirections, as they open new
+// connections. The private addresses are allowed for the development
+// releases.
+func DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	for _, ip := range ips {
+		if !config.IsDevRelease() && !IsPublicIP(ip.IP) {
+			continue
+		}
+		return dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+	}
+	return nil, ErrForbiddenAddress
+}
+
+// NewTransport returns an HTTP transport that only dials the public IP
+// addresses. It does not use the proxy from the environment, as the check
+// would be made on the address of the proxy.
+func NewTransport(responseHeaderTimeout time.Duration) *http.Transport {
+	return &http.Transport{
+		DialContext:           DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}
+}
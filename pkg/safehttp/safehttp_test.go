@@ -0,0 +1,20 @@
+package safehttp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	assert.True(t, IsPublicIP(net.ParseIP("8.8.8.8")))
+	assert.True(t, IsPublicIP(net.ParseIP("2001:4860:4860::8888")))
+	assert.False(t, IsPublicIP(net.ParseIP("127.0.0.1")))
+	assert.False(t, IsPublicIP(net.ParseIP("10.1.2.3")))
+	assert.False(t, IsPublicIP(net.ParseIP("169.254.169.254")))
+	assert.False(t, IsPublicIP(net.ParseIP("192.168.0.1")))
+	assert.False(t, IsPublicIP(net.ParseIP("::1")))
+	assert.False(t, IsPublicIP(net.ParseIP("fd00::1")))
+	assert.False(t, IsPublicIP(net.ParseIP("0.0.0.0")))
+}
@@ -0,0 +1,207 @@
+// Package schema is used for the versions of the schema of the doctypes: a
+// doctype can declare migrations to transform its documents from a version to
+// the next one, and a doctype that has been renamed can keep its old name as
+// an alias.
+package schema
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// VersionField is the field of the cozyMetadata of a document with the
+// version of the schema of its doctype. A document without this field is at
+// the version 0.
+const VersionField = "doctypeVersion"
+
+// MigrateFunc transforms a document to the next version of the schema of its
+// doctype. When a doctype is split, it can also return some documents for
+// other doctypes, that will be created.
+type MigrateFunc func(doc *couchdb.JSONDoc) ([]*couchdb.JSONDoc, error)
+
+// Migration is a step from a version of the schema of a doctype to the next
+// one.
+type Migration struct {
+	Doctype string
+	// Version is the version of the schema after the migration.
+	Version int
+	Name    string
+	Migrate MigrateFunc
+}
+
+var (
+	mu         sync.RWMutex
+	migrations = make(map[string][]*Migration)
+	aliases    = make(map[string]string)
+)
+
+// Register declares a migration for a doctype. It is intended to be called
+// in an init function, and the migrations of a doctype must be registered in
+// order: the first one has the version 1, the next one the version 2, etc.
+func Register(m *Migration) {
+	if m.Doctype == "" || m.Migrate == nil {
+		panic("Missing doctype or migrate function for a migration")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if expected := len(migrations[m.Doctype]) + 1; m.Version != expected {
+		panic(fmt.Errorf("The migration %q of %s should have the version %d",
+			m.Name, m.Doctype, expected))
+	}
+	migrations[m.Doctype] = append(migrations[m.Doctype], m)
+}
+
+// RegisterAlias declares that a doctype has been renamed: the requests on the
+// alias will be made on the doctype, and the permissions on the alias are
+// also valid for the doctype.
+func RegisterAlias(alias, doctype string) {
+	mu.Lock()
+	defer mu.Unlock()
+	aliases[alias] = doctype
+}
+
+// Resolve returns the doctype for the given alias, or the given doctype if it
+// is not an alias.
+func Resolve(doctype string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if target, ok := aliases[doctype]; ok {
+		return target
+	}
+	return doctype
+}
+
+// Version returns the current version of the schema of a doctype.
+func Version(doctype string) int {
+	mu.RLock()
+	defer mu.RUnlock()
+	return len(migrations[doctype])
+}
+
+// Pending returns the migrations that must be applied to go from the given
+// version of the schema of a doctype to the current one.
+func Pending(doctype string, version int) []*Migration {
+	mu.RLock()
+	defer mu.RUnlock()
+	ms := migrations[doctype]
+	if version < 0 {
+		version = 0
+	}
+	if version >= len(ms) {
+		return nil
+	}
+	return ms[version:]
+}
+
+// DocVersion returns the version of the schema of a document.
+func DocVersion(doc *couchdb.JSONDoc) int {
+	meta, ok := doc.M["cozyMetadata"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	switch v := meta[VersionField].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	case string:
+		// Some applications write the version as a string
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+func setDocVersion(doc *couchdb.JSONDoc, version int) {
+	meta, ok := doc.M["cozyMetadata"].(map[string]interface{})
+	if !ok {
+		meta = make(map[string]interface{})
+		doc.M["cozyMetadata"] = meta
+	}
+	meta[VersionField] = version
+}
+
+// Upgrade applies the pending migrations to a document, without saving it. It
+// returns true if the document has been migrated, and the documents to create
+// for other doctypes.
+func Upgrade(doc *couchdb.JSONDoc) (bool, []*couchdb.JSONDoc, error) {
+	pending := Pending(doc.DocType(), DocVersion(doc))
+	if len(pending) == 0 {
+		return false, nil, nil
+	}
+	var others []*couchdb.JSONDoc
+	for _, m := range pending {
+		docs, err := m.Migrate(doc)
+		if err != nil {
+			return false, nil, fmt.Errorf("Migration %q of %s: %s", m.Name, m.Doctype, err)
+		}
+		others = append(others, docs...)
+		setDocVersion(doc, m.Version)
+	}
+	return true, others, nil
+}
+
+// UpgradeAndSave applies the pending migrations to a document, and saves it
+// with the documents created for other doctypes. It returns true if the
+// document has been migrated.
+func UpgradeAndSave(db prefixer.Prefixer, doc *couchdb.JSONDoc) (bool, error) {
+	migrated, others, err := Upgrade(doc)
+	if err != nil || !migrated {
+		return false, err
+	}
+	for _, other := range others {
+		if other.ID() == "" {
+			err = couchdb.CreateDoc(db, other)
+		} else {
+			err = couchdb.CreateNamedDocWithDB(db, other)
+		}
+		// A conflict means that the document has already been created by a
+		// previous attempt of this migration
+		if err != nil && !couchdb.IsConflictError(err) {
+			return false, err
+		}
+	}
+	if err := couchdb.UpdateDoc(db, doc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RenameField returns a migration function that renames a field of the
+// documents.
+func RenameField(from, to string) MigrateFunc {
+	return func(doc *couchdb.JSONDoc) ([]*couchdb.JSONDoc, error) {
+		if value, ok := doc.M[from]; ok {
+			doc.M[to] = value
+			delete(doc.M, from)
+		}
+		return nil, nil
+	}
+}
+
+// SplitDoctype returns a migration function that moves some fields of the
+// documents to new documents of another doctype, with the same identifiers.
+func SplitDoctype(doctype string, fields ...string) MigrateFunc {
+	return func(doc *couchdb.JSONDoc) ([]*couchdb.JSONDoc, error) {
+		other := &couchdb.JSONDoc{
+			Type: doctype,
+			M:    map[string]interface{}{"_id": doc.ID()},
+		}
+		moved := false
+		for _, field := range fields {
+			if value, ok := doc.M[field]; ok {
+				other.M[field] = value
+				delete(doc.M, field)
+				moved = true
+			}
+		}
+		if !moved {
+			return nil, nil
+		}
+		return []*couchdb.JSONDoc{other}, nil
+	}
+}
@@ -0,0 +1,66 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpgrade(t *testing.T) {
+	doctype := "io.cozy.tests.schema"
+	Register(&Migration{
+		Doctype: doctype,
+		Version: 1,
+		Name:    "rename-title",
+		Migrate: RenameField("title", "name"),
+	})
+	Register(&Migration{
+		Doctype: doctype,
+		Version: 2,
+		Name:    "split-address",
+		Migrate: SplitDoctype("io.cozy.tests.addresses", "address"),
+	})
+	assert.Panics(t, func() {
+		Register(&Migration{
+			Doctype: doctype,
+			Version: 4,
+			Name:    "gap",
+			Migrate: RenameField("foo", "bar"),
+		})
+	})
+	assert.Equal(t, 2, Version(doctype))
+	assert.Len(t, Pending(doctype, 1), 1)
+
+	doc := &couchdb.JSONDoc{Type: doctype, M: map[string]interface{}{
+		"_id":     "123",
+		"title":   "foo",
+		"address": "1 rue de la Paix",
+	}}
+	migrated, others, err := Upgrade(doc)
+	assert.NoError(t, err)
+	assert.True(t, migrated)
+	assert.Equal(t, "foo", doc.M["name"])
+	assert.NotContains(t, doc.M, "title")
+	assert.NotContains(t, doc.M, "address")
+	assert.Equal(t, 2, DocVersion(doc))
+	if assert.Len(t, others, 1) {
+		assert.Equal(t, "io.cozy.tests.addresses", others[0].DocType())
+		assert.Equal(t, "123", others[0].ID())
+		assert.Equal(t, "1 rue de la Paix", others[0].M["address"])
+	}
+
+	migrated, _, err = Upgrade(doc)
+	assert.NoError(t, err)
+	assert.False(t, migrated)
+
+	// The version can be a string
+	doc.M["cozyMetadata"] = map[string]interface{}{VersionField: "1"}
+	assert.Equal(t, 1, DocVersion(doc))
+}
+
+func TestResolve(t *testing.T) {
+	RegisterAlias("io.cozy.tests.old", "io.cozy.tests.new")
+	assert.Equal(t, "io.cozy.tests.new", Resolve("io.cozy.tests.old"))
+	assert.Equal(t, "io.cozy.tests.new", Resolve("io.cozy.tests.new"))
+}
@@ -0,0 +1,160 @@
+package schema
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// progressInterval is the number of documents migrated between two saves of
+// the progress of a migration.
+const progressInterval = 100
+
+// State is the document used to track the migrations of a doctype that have
+// been applied to all the documents of an instance. Its identifier is the
+// doctype.
+type State struct {
+	DocID    string             `json:"_id,omitempty"`
+	DocRev   string             `json:"_rev,omitempty"`
+	Version  int                `json:"version"`
+	Applied  []AppliedMigration `json:"applied,omitempty"`
+	Progress *Progress          `json:"progress,omitempty"`
+}
+
+// AppliedMigration is a migration that has been applied to an instance.
+type AppliedMigration struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// Progress is the progress of the last migration of the documents of a
+// doctype.
+type Progress struct {
+	Total      int        `json:"total"`
+	Done       int        `json:"done"`
+	Migrated   int        `json:"migrated"`
+	Errors     int        `json:"errors"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// ID implements the couchdb.Doc interface
+func (s *State) ID() string { return s.DocID }
+
+// Rev implements the couchdb.Doc interface
+func (s *State) Rev() string { return s.DocRev }
+
+// DocType implements the couchdb.Doc interface
+func (s *State) DocType() string { return consts.DoctypeVersions }
+
+// SetID implements the couchdb.Doc interface
+func (s *State) SetID(id string) { s.DocID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (s *State) SetRev(rev string) { s.DocRev = rev }
+
+// Clone implements the couchdb.Doc interface
+func (s *State) Clone() couchdb.Doc {
+	cloned := *s
+	cloned.Applied = make([]AppliedMigration, len(s.Applied))
+	copy(cloned.Applied, s.Applied)
+	if s.Progress != nil {
+		tmp := *s.Progress
+		cloned.Progress = &tmp
+	}
+	return &cloned
+}
+
+// GetState returns the state of the migrations of a doctype on an instance.
+func GetState(db prefixer.Prefixer, doctype string) (*State, error) {
+	var state State
+	err := couchdb.GetDoc(db, consts.DoctypeVersions, doctype, &state)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return &State{DocID: doctype}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (s *State) save(db prefixer.Prefixer) error {
+	if s.DocRev == "" {
+		return couchdb.CreateNamedDocWithDB(db, s)
+	}
+	return couchdb.UpdateDoc(db, s)
+}
+
+// MigrateAll applies the pending migrations to all the documents of a
+// doctype, and tracks them in the state of the doctype. The documents that
+// can't be migrated are logged and skipped, they will be migrated again on
+// the next run.
+func MigrateAll(db prefixer.Prefixer, doctype string) (*State, error) {
+	log := logger.WithDomain(db.DomainName()).WithField("nspace", "schema")
+	state, err := GetState(db, doctype)
+	if err != nil {
+		return nil, err
+	}
+	target := Version(doctype)
+	if state.Version >= target {
+		return state, nil
+	}
+
+	total, err := couchdb.CountAllDocs(db, doctype)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	progress := &Progress{Total: total, StartedAt: time.Now()}
+	state.Progress = progress
+	if err = state.save(db); err != nil {
+		return nil, err
+	}
+
+	err = couchdb.ForeachDocs(db, doctype, func(id string, raw json.RawMessage) error {
+		doc := &couchdb.JSONDoc{Type: doctype}
+		if err := json.Unmarshal(raw, &doc.M); err != nil {
+			return err
+		}
+		migrated, err := UpgradeAndSave(db, doc)
+		if err != nil {
+			log.Warnf("Cannot migrate %s %s: %s", doctype, id, err)
+			progress.Errors++
+		} else if migrated {
+			progress.Migrated++
+		}
+		progress.Done++
+		if progress.Done%progressInterval == 0 {
+			if err := state.save(db); err != nil {
+				log.Warnf("Cannot save the progress of %s: %s", doctype, err)
+			}
+		}
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+
+	now := time.Now()
+	progress.FinishedAt = &now
+	if progress.Errors == 0 {
+		for _, m := range Pending(doctype, state.Version) {
+			state.Applied = append(state.Applied, AppliedMigration{
+				Version:   m.Version,
+				Name:      m.Name,
+				AppliedAt: now,
+			})
+		}
+		state.Version = target
+	}
+	if err = state.save(db); err != nil {
+		return nil, err
+	}
+	log.Infof("Migration of %s to version %d: %d/%d documents migrated, %d errors",
+		doctype, target, progress.Migrated, progress.Done, progress.Errors)
+	return state, nil
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/utils"
@@ -50,13 +51,21 @@ var (
 //   - if we do not receive the activation of the device by the user in 5
 //     minutes, we send a notification for a "normal" login
 //   - otherwise we send a notification for the activation of a new device.
+//
+// When the stack has several processes, only the leader sweeps the queue, so
+// that a notification is not sent twice.
 func SweepLoginRegistrations() utils.Shutdowner {
 	closed := make(chan struct{})
+	leader := lock.Elect(redisRegistationKey)
 	go func() {
 		waitDuration := registrationExpirationDuration / 2
 		for {
 			select {
 			case <-time.After(waitDuration):
+				if !leader.IsLeader() {
+					waitDuration = lock.LeaderTimeout
+					continue
+				}
 				var err error
 				waitDuration, err = sweepRegistrations()
 				if err != nil {
@@ -70,11 +79,12 @@ func SweepLoginRegistrations() utils.Shutdowner {
 			}
 		}
 	}()
-	return &sweeper{closed}
+	return &sweeper{closed, leader}
 }
 
 type sweeper struct {
 	closed chan struct{}
+	leader lock.Leader
 }
 
 func (s *sweeper) Shutdown(ctx context.Context) error {
@@ -82,7 +92,7 @@ func (s *sweeper) Shutdown(ctx context.Context) error {
 	case s.closed <- struct{}{}:
 	case <-ctx.Done():
 	}
-	return nil
+	return s.leader.Shutdown(ctx)
 }
 
 // PushLoginRegistration pushes a new login into the registration queue.
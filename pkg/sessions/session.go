@@ -198,15 +198,16 @@ func (s *Session) ToCookie() (*http.Cookie, error) {
 		maxAge = 10 * 365 * 24 * 3600 // 10 years
 	}
 
-	return &http.Cookie{
+	cookie := &http.Cookie{
 		Name:     SessionCookieName,
 		Value:    string(encoded),
 		MaxAge:   maxAge,
 		Path:     "/",
 		Domain:   utils.StripPort("." + s.Instance.ContextualDomain()),
-		Secure:   !s.Instance.Dev,
 		HttpOnly: true,
-	}, nil
+	}
+	config.CookieAttributesFor(s.Instance.Scheme()).Apply(cookie)
+	return cookie, nil
 }
 
 // ToAppCookie returns an http.Cookie for this Session on an app subdomain
@@ -216,15 +217,16 @@ func (s *Session) ToAppCookie(domain, slug string) (*http.Cookie, error) {
 		return nil, err
 	}
 
-	return &http.Cookie{
+	cookie := &http.Cookie{
 		Name:     SessionCookieName,
 		Value:    string(encoded),
 		MaxAge:   0, // "session cookie", expiring when the browser is closed
 		Path:     "/",
 		Domain:   utils.StripPort(domain),
-		Secure:   !s.Instance.Dev,
 		HttpOnly: true,
-	}, nil
+	}
+	config.CookieAttributesFor(s.Instance.Scheme()).Apply(cookie)
+	return cookie, nil
 }
 
 // DeleteOthers will remove all sessions except the one given in parameter.
@@ -0,0 +1,323 @@
+package sftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/pkg/sftp"
+)
+
+// maxPendingWrites is the maximal number of bytes received in advance, when
+// a client sends the chunks of a file out of order.
+const maxPendingWrites = 32 << 20 // 32 MiB
+
+var errNonSequentialWrite = errors.New("sftp: the chunks of the file are not sent in order")
+
+// handler maps the SFTP requests of a session to the VFS of the instance,
+// with the permissions of the app password used for the authentication.
+type handler struct {
+	inst  *instance.Instance
+	fs    vfs.VFS
+	perms permissions.Set
+}
+
+func (h *handler) handlers() sftp.Handlers {
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+// allow checks that the permissions of the session allow the verb on the
+// file or directory.
+func (h *handler) allow(v permissions.Verb, doc vfs.Matcher) error {
+	if err := vfs.Allows(h.fs, h.perms, v, doc); err != nil {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// Fileread opens a file for reading.
+func (h *handler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	doc, err := h.fs.FileByPath(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.allow(permissions.GET, doc); err != nil {
+		return nil, err
+	}
+	return h.fs.OpenFile(doc)
+}
+
+// Filewrite creates a file, or overwrites its content if it already exists.
+// The VFS only accepts the content of a file in order, so the chunks sent in
+// advance by the client are kept in memory until the missing ones arrive.
+func (h *handler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	dir, err := h.fs.DirByPath(path.Dir(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(r.Filepath)
+	olddoc, err := h.fs.FileByPath(r.Filepath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var tags []string
+	if olddoc != nil {
+		tags = olddoc.Tags
+	}
+	mime, class := vfs.ExtractMimeAndClassFromFilename(name)
+	newdoc, err := vfs.NewFileDoc(name, dir.ID(), -1, nil, mime, class,
+		time.Now(), false, false, tags)
+	if err != nil {
+		return nil, err
+	}
+	if olddoc != nil {
+		newdoc.CreatedAt = olddoc.CreatedAt
+		newdoc.Favorite = olddoc.Favorite
+		err = h.allow(permissions.PUT, olddoc)
+	} else {
+		err = h.allow(permissions.POST, newdoc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = vfs.InheritEncryption(h.fs, newdoc); err != nil {
+		return nil, err
+	}
+	file, err := h.fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	return &sequentialWriter{file: file, pending: make(map[int64][]byte)}, nil
+}
+
+// Filecmd executes the commands that modify the tree of files: the files and
+// directories removed by a client are moved to the trash.
+func (h *handler) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		// The permissions and the dates can't be changed.
+		return nil
+	case "Rename":
+		return h.rename(r.Filepath, r.Target)
+	case "Mkdir":
+		parent, err := h.fs.DirByPath(path.Dir(r.Filepath))
+		if err != nil {
+			return err
+		}
+		dir, err := vfs.NewDirDoc(h.fs, path.Base(r.Filepath), parent.ID(), nil)
+		if err != nil {
+			return err
+		}
+		if err = h.allow(permissions.POST, dir); err != nil {
+			return err
+		}
+		return h.fs.CreateDir(dir)
+	case "Rmdir":
+		dir, err := h.fs.DirByPath(r.Filepath)
+		if err != nil {
+			return err
+		}
+		if err = h.allow(permissions.DELETE, dir); err != nil {
+			return err
+		}
+		empty, err := dir.IsEmpty(h.fs)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return sftp.ErrSSHFxFailure
+		}
+		_, err = vfs.TrashDir(h.fs, dir)
+		return err
+	case "Remove":
+		file, err := h.fs.FileByPath(r.Filepath)
+		if err != nil {
+			return err
+		}
+		if err = h.allow(permissions.DELETE, file); err != nil {
+			return err
+		}
+		_, err = vfs.TrashFile(h.fs, file)
+		return err
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *handler) rename(from, to string) error {
+	dir, file, err := h.fs.DirOrFileByPath(from)
+	if err != nil {
+		return err
+	}
+	parent, err := h.fs.DirByPath(path.Dir(to))
+	if err != nil {
+		return err
+	}
+	if err = h.allow(permissions.POST, parent); err != nil {
+		return err
+	}
+	name := path.Base(to)
+	dirID := parent.ID()
+	patch := &vfs.DocPatch{Name: &name, DirID: &dirID}
+	if dir != nil {
+		if err = h.allow(permissions.PATCH, dir); err != nil {
+			return err
+		}
+		_, err = vfs.ModifyDirMetadata(h.fs, dir, patch)
+		return err
+	}
+	if err = h.allow(permissions.PATCH, file); err != nil {
+		return err
+	}
+	_, err = vfs.ModifyFileMetadata(h.fs, file, patch)
+	return err
+}
+
+// Filelist lists the content of a directory, or returns the information of
+// a file or directory.
+func (h *handler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		dir, err := h.fs.DirByPath(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		if err = h.allow(permissions.GET, dir); err != nil {
+			return nil, err
+		}
+		var infos listerAt
+		iter := h.fs.DirIterator(dir, nil)
+		for {
+			d, f, err := iter.Next()
+			if err == vfs.ErrIteratorDone {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if d != nil {
+				infos = append(infos, dirInfo{d})
+			} else {
+				infos = append(infos, f)
+			}
+		}
+		return infos, nil
+	case "Stat":
+		dir, file, err := h.fs.DirOrFileByPath(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		if dir != nil {
+			if err = h.allow(permissions.GET, dir); err != nil {
+				return nil, err
+			}
+			return listerAt{dirInfo{dir}}, nil
+		}
+		if err = h.allow(permissions.GET, file); err != nil {
+			return nil, err
+		}
+		return listerAt{file}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// dirInfo adds the directory bit to the mode of a directory, as it is
+// expected by the SFTP clients.
+type dirInfo struct{ *vfs.DirDoc }
+
+func (d dirInfo) Mode() os.FileMode { return os.ModeDir | d.DirDoc.Mode() }
+
+type listerAt []os.FileInfo
+
+// ListAt implements the sftp.ListerAt interface
+func (l listerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sequentialWriter writes the chunks of a file in order in the VFS, as the
+// SFTP clients can send several chunks in parallel.
+type sequentialWriter struct {
+	mu      sync.Mutex
+	file    vfs.File
+	offset  int64
+	pending map[int64][]byte
+	size    int
+	err     error
+}
+
+// WriteAt implements the io.WriterAt interface
+func (w *sequentialWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if off < w.offset {
+		w.err = errNonSequentialWrite
+		return 0, w.err
+	}
+	if off > w.offset {
+		if w.size+len(p) > maxPendingWrites {
+			w.err = errNonSequentialWrite
+			return 0, w.err
+		}
+		buf := make([]byte, len(p))
+		copy(buf, p)
+		w.pending[off] = buf
+		w.size += len(buf)
+		return len(p), nil
+	}
+	if err := w.write(p); err != nil {
+		return 0, err
+	}
+	for {
+		buf, ok := w.pending[w.offset]
+		if !ok {
+			break
+		}
+		delete(w.pending, w.offset)
+		w.size -= len(buf)
+		if err := w.write(buf); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *sequentialWriter) write(p []byte) error {
+	n, err := w.file.Write(p)
+	w.offset += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
+// Close is called by the SFTP server when the client closes the file, or
+// when the session ends. Like with the other SFTP servers, an interrupted
+// upload leaves the content that has been received.
+func (w *sequentialWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil && len(w.pending) > 0 {
+		w.err = errNonSequentialWrite
+	}
+	err := w.file.Close()
+	if w.err != nil {
+		return w.err
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package sftpd
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type bufferFile struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (f *bufferFile) ReadAt(p []byte, off int64) (int, error)      { return 0, io.EOF }
+func (f *bufferFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (f *bufferFile) Close() error                                 { f.closed = true; return nil }
+
+func TestSequentialWriter(t *testing.T) {
+	file := &bufferFile{}
+	w := &sequentialWriter{file: file, pending: make(map[int64][]byte)}
+
+	n, err := w.WriteAt([]byte("baz"), 6)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	n, err = w.WriteAt([]byte("foo"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, "foo", file.String())
+	_, err = w.WriteAt([]byte("bar"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, "foobarbaz", file.String())
+	assert.Empty(t, w.pending)
+	assert.NoError(t, w.Close())
+	assert.True(t, file.closed)
+
+	file = &bufferFile{}
+	w = &sequentialWriter{file: file, pending: make(map[int64][]byte)}
+	_, err = w.WriteAt([]byte("foo"), 0)
+	assert.NoError(t, err)
+	_, err = w.WriteAt([]byte("foo"), 0)
+	assert.Equal(t, errNonSequentialWrite, err)
+	assert.Equal(t, errNonSequentialWrite, w.Close())
+
+	file = &bufferFile{}
+	w = &sequentialWriter{file: file, pending: make(map[int64][]byte)}
+	_, err = w.WriteAt([]byte("bar"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, errNonSequentialWrite, w.Close())
+}
+
+func TestListerAt(t *testing.T) {
+	l := listerAt{dirInfo{}, dirInfo{}, dirInfo{}}
+	infos := make([]os.FileInfo, 2)
+	n, err := l.ListAt(infos, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = l.ListAt(infos, 2)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 1, n)
+	n, err = l.ListAt(infos, 3)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n)
+}
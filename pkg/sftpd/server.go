@@ -0,0 +1,251 @@
+// Package sftpd is the SFTP server of the stack. It gives access to the files
+// of the instances to the SFTP clients, like the ones of a NAS or a backup
+// tool. The username is the domain of the instance, and the password is an
+// app password generated by the user from the settings.
+package sftpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	extensionDomain      = "domain"
+	extensionAppPassword = "app_password"
+)
+
+var (
+	// ErrMissingHostKey is used when the SFTP server is enabled without a
+	// host key.
+	ErrMissingHostKey = errors.New("sftp: the host key is missing")
+
+	errInvalidCredentials = errors.New("sftp: invalid credentials")
+	errNoFilesPermission  = errors.New("sftp: the app password has no permission on the files")
+)
+
+var log = logger.WithNamespace("sftp")
+
+// Server is the SFTP server. It implements the Shutdowner interface.
+type Server struct {
+	addr     string
+	config   *ssh.ServerConfig
+	listener net.Listener
+	conns    sync.WaitGroup
+}
+
+// NewServer returns a SFTP server, configured with the host key and the
+// address of the configuration file.
+func NewServer(opts config.SFTP) (*Server, error) {
+	if opts.HostKey == "" {
+		return nil, ErrMissingHostKey
+	}
+	keyFile, err := config.FindConfigFile(opts.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: checkPassword,
+		ServerVersion:    "SSH-2.0-cozy-stack",
+	}
+	cfg.AddHostKey(signer)
+	return &Server{addr: opts.Addr, config: cfg}, nil
+}
+
+// Listen opens the listener on the address of the server.
+func (s *Server) Listen() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	return nil
+}
+
+// Addr returns the address of the server.
+func (s *Server) Addr() string {
+	if s.listener != nil {
+		return s.listener.Addr().String()
+	}
+	return s.addr
+}
+
+// Serve accepts the connections on the listener, until it is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting new connections, and waits for the current ones
+// to be closed by the clients.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.listener == nil {
+		return nil
+	}
+	if err := s.listener.Close(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkPassword authenticates a client: the user is the domain of the
+// instance, and the password is an app password with a permission on the
+// files.
+func checkPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	inst, err := instance.Get(meta.User())
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+	if inst.Blocked {
+		return nil, errInvalidCredentials
+	}
+	// The attempts are counted with the logins on the web, to avoid a brute
+	// force attack on the passwords by the SFTP server.
+	if err = limits.CheckRateLimit(inst, limits.AuthType); err != nil {
+		if err == limits.ErrRateLimitReached {
+			inst.Logger().WithField("nspace", "sftp").Warnf("Too many login attempts")
+			return nil, err
+		}
+		inst.Logger().WithField("nspace", "sftp").
+			Errorf("Could not check the rate limit: %s", err)
+	}
+	ap, err := oauth.CheckAppPassword(inst, string(password), oauth.ServiceSFTP)
+	if err != nil {
+		inst.Logger().WithField("nspace", "sftp").
+			Infof("Authentication failed from %s: %s", meta.RemoteAddr(), err)
+		return nil, errInvalidCredentials
+	}
+	_ = limits.ResetCounter(inst, limits.AuthType)
+	set, err := ap.Permissions()
+	if err != nil {
+		return nil, err
+	}
+	allowed := false
+	for _, rule := range set {
+		if rule.Type == consts.Files {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, errNoFilesPermission
+	}
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			extensionDomain:      inst.Domain,
+			extensionAppPassword: ap.ID(),
+		},
+	}, nil
+}
+
+func (s *Server) handleConn(nConn net.Conn) {
+	defer nConn.Close()
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.config)
+	if err != nil {
+		log.Debugf("Handshake failed from %s: %s", nConn.RemoteAddr(), err)
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Infof("Could not accept the channel: %s", err)
+			return
+		}
+		go handleSession(conn.Permissions, channel, requests)
+	}
+}
+
+// handleSession starts the sftp subsystem for a session. The other requests,
+// like a shell, are refused.
+func handleSession(perms *ssh.Permissions, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		// The payload of a subsystem request is the name of the subsystem,
+		// prefixed by its length on 4 bytes.
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		_ = req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		h, err := newHandler(perms)
+		if err != nil {
+			log.Errorf("Could not start the session: %s", err)
+			return
+		}
+		server := sftp.NewRequestServer(channel, h.handlers())
+		if err = server.Serve(); err != nil && err != io.EOF {
+			h.inst.Logger().WithField("nspace", "sftp").
+				Infof("Session closed with error: %s", err)
+		}
+		server.Close()
+		return
+	}
+}
+
+func newHandler(perms *ssh.Permissions) (*handler, error) {
+	if perms == nil {
+		return nil, errInvalidCredentials
+	}
+	inst, err := instance.Get(perms.Extensions[extensionDomain])
+	if err != nil {
+		return nil, err
+	}
+	ap, err := oauth.FindAppPassword(inst, perms.Extensions[extensionAppPassword])
+	if err != nil {
+		return nil, fmt.Errorf("sftp: app password: %s", err)
+	}
+	set, err := ap.Permissions()
+	if err != nil {
+		return nil, err
+	}
+	return &handler{inst: inst, fs: inst.VFS(), perms: set}, nil
+}
@@ -0,0 +1,318 @@
+package sharing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/client/request"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/tracing"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// The roles of the members of a shared drive
+const (
+	// RoleReader is for a member that can only read the files of the drive
+	RoleReader = "reader"
+	// RoleWriter is for a member that can also add, modify and remove files
+	RoleWriter = "writer"
+	// RoleManager is for a member that can also manage the members
+	RoleManager = "manager"
+)
+
+// IsValidRole returns true if the role is one of the roles for the members of
+// a shared drive.
+func IsValidRole(role string) bool {
+	return role == RoleReader || role == RoleWriter || role == RoleManager
+}
+
+// DriveRole returns the role of the member in a shared drive. The owner is
+// always a manager, and a member added without a role is a reader or a
+// writer, depending on its read-only flag.
+func (m *Member) DriveRole() string {
+	if m.Status == MemberStatusOwner {
+		return RoleManager
+	}
+	if m.Role != "" {
+		return m.Role
+	}
+	if m.ReadOnly {
+		return RoleReader
+	}
+	return RoleWriter
+}
+
+// OwnDriveRole returns the role in the shared drive of the member for this
+// Cozy instance.
+func (s *Sharing) OwnDriveRole() string {
+	if s.Owner {
+		return RoleManager
+	}
+	for i, m := range s.Members {
+		if i > 0 && m.Instance != "" {
+			return m.DriveRole()
+		}
+	}
+	return RoleReader
+}
+
+// EnsureDrivesDir returns the Drives directory, where the folders of the
+// shared drives are put, and create it if it doesn't exist.
+func EnsureDrivesDir(inst *instance.Instance) (*vfs.DirDoc, error) {
+	fs := inst.VFS()
+	dir, _, err := fs.DirOrFileByID(consts.DrivesDirID)
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+
+	if dir == nil {
+		name := inst.Translate("Tree Drives")
+		dir, err = vfs.NewDirDocWithPath(name, consts.RootDirID, "/", nil)
+		if err != nil {
+			return nil, err
+		}
+		dir.DocID = consts.DrivesDirID
+		if err = fs.CreateDir(dir); err != nil {
+			return nil, err
+		}
+		return dir, nil
+	}
+
+	if dir.RestorePath != "" {
+		return vfs.RestoreDir(fs, dir)
+	}
+	return dir, nil
+}
+
+// CreateDrive creates a shared drive: a folder in the Drives directory, and
+// a sharing of this folder. Its owner is the only member at first.
+func CreateDrive(inst *instance.Instance, slug, name string, quota int64) (*Sharing, error) {
+	parent, err := EnsureDrivesDir(inst)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := vfs.NewDirDocWithParent(name, parent, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = inst.VFS().CreateDir(dir); err != nil {
+		return nil, err
+	}
+
+	s := &Sharing{
+		Drive:       true,
+		DriveQuota:  quota,
+		Description: name,
+		// The managers can invite new members from their Cozy
+		Open: true,
+		Rules: []Rule{
+			{
+				Title:   name,
+				DocType: consts.Files,
+				Values:  []string{dir.ID()},
+				Add:     ActionRuleSync,
+				Update:  ActionRuleSync,
+				Remove:  ActionRuleRevoke,
+			},
+		},
+	}
+	if err = s.ValidateRules(); err != nil {
+		return nil, err
+	}
+	if err = s.BeOwner(inst, slug); err != nil {
+		return nil, err
+	}
+	s.Members[0].Role = RoleManager
+	if err = couchdb.CreateDoc(inst, s); err != nil {
+		return nil, err
+	}
+	if err = s.AddReferenceForSharingDir(inst, &s.Rules[0]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetDrives returns the shared drives of the instance, the ones it owns and
+// the ones where it is a member.
+func GetDrives(inst *instance.Instance) ([]*Sharing, error) {
+	var drives []*Sharing
+	err := couchdb.ForeachDocs(inst, consts.Sharings, func(_ string, data json.RawMessage) error {
+		s := &Sharing{}
+		if err := json.Unmarshal(data, s); err != nil {
+			return err
+		}
+		if s.Drive {
+			drives = append(drives, s)
+		}
+		return nil
+	})
+	if couchdb.IsNoDatabaseError(err) {
+		err = nil
+	}
+	return drives, err
+}
+
+// AddDriveMembers adds the contacts with the given identifiers as members of
+// the shared drive, with their role, and sends them an invitation.
+func (s *Sharing) AddDriveMembers(inst *instance.Instance, roles map[string]string) error {
+	if !s.Owner || !s.Drive {
+		return ErrInvalidSharing
+	}
+	for id, role := range roles {
+		if !IsValidRole(role) {
+			return ErrInvalidRole
+		}
+		idx, err := s.addContact(inst, id, role == RoleReader)
+		if err != nil {
+			return err
+		}
+		s.Members[idx].Role = role
+	}
+	if err := s.SendMails(inst, nil); err != nil {
+		return err
+	}
+	cloned := s.Clone().(*Sharing)
+	go cloned.NotifyRecipients(inst, nil)
+	return nil
+}
+
+// SetDriveRole changes the role of a member of the shared drive. When the
+// member goes from or to the reader role, and has already accepted the
+// sharing, new credentials are sent to their Cozy.
+func (s *Sharing) SetDriveRole(inst *instance.Instance, index int, role string) error {
+	if !s.Owner || !s.Drive {
+		return ErrInvalidSharing
+	}
+	if !IsValidRole(role) {
+		return ErrInvalidRole
+	}
+	if index < 1 || index >= len(s.Members) {
+		return ErrMemberNotFound
+	}
+	m := &s.Members[index]
+	readOnly := role == RoleReader
+	m.Role = role
+	var err error
+	switch {
+	case m.Status == MemberStatusReady && readOnly && !m.ReadOnly:
+		err = s.AddReadOnlyFlag(inst, index)
+	case m.Status == MemberStatusReady && !readOnly && m.ReadOnly:
+		err = s.RemoveReadOnlyFlag(inst, index)
+	default:
+		m.ReadOnly = readOnly
+		err = couchdb.UpdateDoc(inst, s)
+	}
+	if err != nil {
+		return err
+	}
+	cloned := s.Clone().(*Sharing)
+	go cloned.NotifyRecipients(inst, nil)
+	return nil
+}
+
+// DelegateDriveMember is used by a manager of a shared drive to ask the
+// owner to change the role of a member, or to remove this member if the
+// role is empty.
+func (s *Sharing) DelegateDriveMember(inst *instance.Instance, index int, role string) error {
+	u, err := url.Parse(s.Members[0].Instance)
+	if err != nil {
+		return err
+	}
+	c := &s.Credentials[0]
+	opts := &request.Options{
+		Method: http.MethodDelete,
+		Scheme: u.Scheme,
+		Domain: u.Host,
+		Path:   fmt.Sprintf("/sharings/drives/%s/members/%d", s.SID, index),
+		Headers: request.Headers{
+			"Authorization": "Bearer " + c.AccessToken.AccessToken,
+		},
+	}
+	var body []byte
+	if role != "" {
+		body, err = json.Marshal(map[string]string{"role": role})
+		if err != nil {
+			return err
+		}
+		opts.Method = http.MethodPut
+		opts.Headers["Content-Type"] = "application/json"
+		opts.Body = bytes.NewReader(body)
+	}
+	res, err := tracing.Req(inst.Context(), opts)
+	if res != nil && res.StatusCode/100 == 4 {
+		res, err = RefreshToken(inst, s, &s.Members[0], c, opts, body)
+	}
+	if err != nil {
+		if res != nil && res.StatusCode == http.StatusForbidden {
+			return ErrInvalidSharing
+		}
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// CheckDriveQuota returns ErrDriveQuotaExceeded if writing size more bytes
+// in the given directory would exceed the quota of a shared drive. The
+// directories outside of the shared drives have no such quota.
+func CheckDriveQuota(inst *instance.Instance, dirID string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	fs := inst.VFS()
+	drives, err := fs.DirByID(consts.DrivesDirID)
+	if err != nil {
+		return nil
+	}
+	parent, err := fs.DirByID(dirID)
+	if err != nil || !strings.HasPrefix(parent.Fullpath, drives.Fullpath+"/") {
+		return nil
+	}
+	rel := strings.TrimPrefix(parent.Fullpath, drives.Fullpath+"/")
+	root := parent
+	if rootPath := path.Join(drives.Fullpath, strings.SplitN(rel, "/", 2)[0]); rootPath != parent.Fullpath {
+		if root, err = fs.DirByPath(rootPath); err != nil {
+			return nil
+		}
+	}
+	for _, ref := range root.ReferencedBy {
+		if ref.Type != consts.Sharings {
+			continue
+		}
+		s, err := FindSharing(inst, ref.ID)
+		if err != nil || !s.Drive || s.DriveQuota <= 0 {
+			continue
+		}
+		used, err := dirSize(fs, root)
+		if err != nil {
+			return err
+		}
+		if used+size > s.DriveQuota {
+			return ErrDriveQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// dirSize returns the sum of the sizes of the files inside the directory.
+func dirSize(fs vfs.Indexer, dir *vfs.DirDoc) (int64, error) {
+	var size int64
+	err := vfs.Walk(fs, dir.Fullpath, func(_ string, _ *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			size += file.ByteSize
+		}
+		return nil
+	})
+	return size, err
+}
@@ -1,6 +1,11 @@
 package sharing
 
-import "errors"
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/errcode"
+)
 
 var (
 	// ErrNoRules is used when a sharing is created without a rule
@@ -20,6 +25,9 @@ var (
 	ErrMemberNotFound = errors.New("The member was not found")
 	// ErrMailNotSent is used when the invitation mail failed to be sent
 	ErrMailNotSent = errors.New("The mail cannot be sent")
+	// ErrInvalidSignature is used when the signature of a request sent by
+	// another Cozy can't be verified with its public key
+	ErrInvalidSignature = errors.New("The signature of the request is invalid")
 	// ErrRequestFailed is used when a cozy tries to create a sharing request
 	// on another cozy, but it failed
 	ErrRequestFailed = errors.New("The sharing request failed")
@@ -46,4 +54,11 @@ var (
 	// ErrAlreadyAccepted is used when someone tries to accept twice a sharing
 	// on the same cozy instance
 	ErrAlreadyAccepted = errors.New("Sharing already accepted by this recipient")
+	// ErrInvalidRole is used when a member of a shared drive is given an
+	// unknown role
+	ErrInvalidRole = errors.New("The role is invalid")
+	// ErrDriveQuotaExceeded is used when a file can't be written in a shared
+	// drive, as it would exceed the quota of the drive
+	ErrDriveQuotaExceeded = errcode.New(errcode.QuotaExceeded, http.StatusRequestEntityTooLarge,
+		"The file exceeds the quota of the shared drive")
 )
@@ -15,6 +15,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	multierror "github.com/hashicorp/go-multierror"
 )
@@ -205,9 +206,16 @@ func EnsureSharedWithMeDir(inst *instance.Instance) (*vfs.DirDoc, error) {
 }
 
 // CreateDirForSharing creates the directory where files for this sharing will
-// be put. This directory will be initially inside the Shared with me folder.
+// be put. This directory will be initially inside the Shared with me folder,
+// or inside the Drives folder for a shared drive.
 func (s *Sharing) CreateDirForSharing(inst *instance.Instance, rule *Rule) (*vfs.DirDoc, error) {
-	parent, err := EnsureSharedWithMeDir(inst)
+	var parent *vfs.DirDoc
+	var err error
+	if s.Drive {
+		parent, err = EnsureDrivesDir(inst)
+	} else {
+		parent, err = EnsureSharedWithMeDir(inst)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -533,6 +541,7 @@ func (s *Sharing) resolveConflictSamePath(inst *instance.Instance, visitorID, pt
 		return "", err
 	}
 	name := conflictName(path.Base(pth), "")
+	s.addConflict(inst)
 	xorKey := s.Credentials[0].XorKey
 	if d != nil {
 		homeID := d.DocID
@@ -581,7 +590,7 @@ func (s *Sharing) getDirDocFromInstance(inst *instance.Instance, m *Member, cred
 			"Authorization": "Bearer " + creds.AccessToken.AccessToken,
 		},
 	}
-	res, err := request.Req(opts)
+	res, err := tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode/100 == 4 {
 		res, err = RefreshToken(inst, s, m, creds, opts, nil)
 	}
@@ -0,0 +1,202 @@
+package sharing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/client/request"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/tracing"
+)
+
+// SignatureHeader is the HTTP header with the signature of the requests sent
+// by a Cozy to another Cozy for a sharing.
+const SignatureHeader = "X-Cozy-Signature"
+
+// identityCheckPeriod is the minimal duration between two checks of the
+// public keys of the members of a sharing by the replicator.
+const identityCheckPeriod = 24 * time.Hour
+
+// Identity is the public information that a Cozy gives to the other Cozy
+// instances to check its signatures.
+type Identity struct {
+	Domain    string `json:"domain"`
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"`
+}
+
+// GetIdentity returns the identity of the instance.
+func GetIdentity(inst *instance.Instance) (*Identity, error) {
+	key, err := inst.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Domain:    inst.Domain,
+		Algorithm: "ed25519",
+		PublicKey: key,
+	}, nil
+}
+
+// signedPayload returns the data that is signed for a request: the method and
+// the path are included to avoid replaying a signature on another route.
+func signedPayload(method, path string, body []byte) []byte {
+	payload := []byte(method + " " + path + "\n")
+	return append(payload, body...)
+}
+
+// signRequest adds the signature of the request to its headers.
+func signRequest(inst *instance.Instance, opts *request.Options, body []byte) {
+	sig, err := inst.Sign(signedPayload(opts.Method, opts.Path, body))
+	if err != nil {
+		inst.Logger().WithField("nspace", "sharing").
+			Warnf("Cannot sign the request: %s", err)
+		return
+	}
+	opts.Headers[SignatureHeader] = sig
+}
+
+// FetchPublicKey returns the public key of the Cozy at the given URL.
+func FetchPublicKey(inst *instance.Instance, cozyURL string) (string, error) {
+	u, err := url.Parse(cozyURL)
+	if err != nil || u.Host == "" {
+		return "", ErrInvalidURL
+	}
+	res, err := tracing.Req(inst.Context(), &request.Options{
+		Method: http.MethodGet,
+		Scheme: u.Scheme,
+		Domain: u.Host,
+		Path:   "/sharings/identity",
+		Headers: request.Headers{
+			"Accept": "application/json",
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var identity Identity
+	if err = json.NewDecoder(res.Body).Decode(&identity); err != nil {
+		return "", err
+	}
+	if identity.PublicKey == "" {
+		return "", ErrInvalidSignature
+	}
+	return identity.PublicKey, nil
+}
+
+// VerifyRequest checks the signature of a request sent by the Cozy at the
+// given URL, and returns the public key of this Cozy. The key is empty if the
+// request is not signed, or if the key can't be fetched, as it is the case
+// for the Cozy instances with an older version of the stack.
+func VerifyRequest(inst *instance.Instance, cozyURL string, r *http.Request, body []byte) (string, error) {
+	sig := r.Header.Get(SignatureHeader)
+	if sig == "" {
+		return "", nil
+	}
+	key, err := FetchPublicKey(inst, cozyURL)
+	if err != nil {
+		inst.Logger().WithField("nspace", "sharing").
+			Infof("Cannot fetch the public key of %s: %s", cozyURL, err)
+		return "", nil
+	}
+	if !instance.VerifySignature(key, signedPayload(r.Method, r.URL.Path, body), sig) {
+		return "", ErrInvalidSignature
+	}
+	return key, nil
+}
+
+// PinPublicKey saves the public key of the Cozy of the member the first time,
+// and then flags the member if the key has changed. It returns true if the
+// key has changed, which can be the sign of a takeover of the domain.
+func (m *Member) PinPublicKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	if m.PublicKey == "" {
+		m.PublicKey = key
+		return false
+	}
+	if m.PublicKey != key {
+		m.KeyChanged = true
+		return true
+	}
+	return false
+}
+
+// VerifyAnswer checks the signature of the answer of a recipient, and pins
+// the public key of its Cozy. The sharing is saved by ProcessAnswer.
+func (s *Sharing) VerifyAnswer(inst *instance.Instance, state string, r *http.Request, body []byte) error {
+	if !s.Owner || len(s.Members) != len(s.Credentials)+1 {
+		return ErrInvalidSharing
+	}
+	for i, c := range s.Credentials {
+		if c.State != state {
+			continue
+		}
+		m := &s.Members[i+1]
+		key, err := VerifyRequest(inst, m.Instance, r, body)
+		if err != nil {
+			return err
+		}
+		if m.PinPublicKey(key) {
+			inst.Logger().WithField("nspace", "sharing").
+				Warnf("The public key of %s has changed for %s", m.Instance, s.SID)
+		}
+		return nil
+	}
+	return ErrMemberNotFound
+}
+
+// CheckIdentities is used by the sharer to check that the public keys of the
+// Cozy instances of the recipients have not changed. It is called by the
+// replicator, but the keys are fetched at most once a day.
+func (s *Sharing) CheckIdentities(inst *instance.Instance) {
+	if !s.Owner {
+		return
+	}
+	cache := config.GetConfig().CacheStorage
+	cacheKey := "sharing-identities:" + inst.Domain + ":" + s.SID
+	if _, ok := cache.Get(cacheKey); ok {
+		return
+	}
+	cache.Set(cacheKey, []byte{'1'}, identityCheckPeriod)
+
+	changed := make(map[int]string)
+	for i, m := range s.Members {
+		if i == 0 || m.Status != MemberStatusReady || m.PublicKey == "" || m.KeyChanged {
+			continue
+		}
+		key, err := FetchPublicKey(inst, m.Instance)
+		if err != nil {
+			continue
+		}
+		if key != m.PublicKey {
+			inst.Logger().WithField("nspace", "sharing").
+				Warnf("The public key of %s has changed for %s", m.Instance, s.SID)
+			changed[i] = m.Instance
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	// The sharing can be updated at the same time by another process
+	fresh, err := FindSharing(inst, s.SID)
+	if err != nil {
+		return
+	}
+	for i, cozyURL := range changed {
+		if i < len(fresh.Members) && fresh.Members[i].Instance == cozyURL {
+			fresh.Members[i].KeyChanged = true
+		}
+	}
+	if err = couchdb.UpdateDoc(inst, fresh); err != nil {
+		inst.Logger().WithField("nspace", "sharing").
+			Warnf("Cannot flag the members with a new key: %s", err)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 )
 
@@ -44,6 +45,12 @@ type Member struct {
 	Email      string `json:"email"`
 	Instance   string `json:"instance,omitempty"`
 	ReadOnly   bool   `json:"read_only,omitempty"`
+	Role       string `json:"role,omitempty"` // Only for a shared drive
+
+	// The public key of the Cozy of the member, pinned on the first exchange,
+	// and a flag set when this Cozy has later presented another key
+	PublicKey  string `json:"public_key,omitempty"`
+	KeyChanged bool   `json:"key_changed,omitempty"`
 }
 
 // PrimaryName returns the main name of this member
@@ -99,13 +106,20 @@ func (s *Sharing) AddContacts(inst *instance.Instance, contactIDs map[string]boo
 
 // AddContact adds the contact with the given identifier
 func (s *Sharing) AddContact(inst *instance.Instance, contactID string, readOnly bool) error {
+	_, err := s.addContact(inst, contactID, readOnly)
+	return err
+}
+
+// addContact adds the contact with the given identifier, and returns the
+// index of its member
+func (s *Sharing) addContact(inst *instance.Instance, contactID string, readOnly bool) (int, error) {
 	c, err := contacts.Find(inst, contactID)
 	if err != nil {
-		return err
+		return -1, err
 	}
 	addr, err := c.ToMailAddress()
 	if err != nil {
-		return err
+		return -1, err
 	}
 	m := Member{
 		Status:   MemberStatusMailNotSent,
@@ -137,10 +151,11 @@ func (s *Sharing) AddContact(inst *instance.Instance, contactID string, readOnly
 	}
 	if idx < 1 {
 		s.Credentials = append(s.Credentials, creds)
+		idx = len(s.Members) - 1
 	} else {
 		s.Credentials[idx-1] = creds
 	}
-	return nil
+	return idx, nil
 }
 
 // APIDelegateAddContacts is used to serialize a request to add contacts to
@@ -236,7 +251,7 @@ func (s *Sharing) DelegateAddContacts(inst *instance.Instance, contactIDs map[st
 		},
 		Body: bytes.NewReader(body),
 	}
-	res, err := request.Req(opts)
+	res, err := tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode/100 == 4 {
 		res, err = RefreshToken(inst, s, &s.Members[0], c, opts, body)
 	}
@@ -318,7 +333,7 @@ func (s *Sharing) DelegateDiscovery(inst *instance.Instance, state, cozyURL stri
 		},
 		Body: bytes.NewReader(body),
 	}
-	res, err := request.Req(opts)
+	res, err := tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode/100 == 4 {
 		res, err = RefreshToken(inst, s, &s.Members[0], c, opts, body)
 	}
@@ -352,6 +367,7 @@ func (s *Sharing) UpdateRecipients(inst *instance.Instance, members []Member) er
 		s.Members[i].PublicName = m.PublicName
 		s.Members[i].Status = m.Status
 		s.Members[i].ReadOnly = m.ReadOnly
+		s.Members[i].Role = m.Role
 	}
 	return couchdb.UpdateDoc(inst, s)
 }
@@ -474,7 +490,7 @@ func (c *Credentials) Refresh(inst *instance.Instance, s *Sharing, m *Member) er
 // an access token with a short validity to let it synchronize its last
 // changes.
 func (s *Sharing) AddReadOnlyFlag(inst *instance.Instance, index int) error {
-	if index <= 1 {
+	if index < 1 {
 		return ErrMemberNotFound
 	}
 	if s.ReadOnly() {
@@ -484,6 +500,9 @@ func (s *Sharing) AddReadOnlyFlag(inst *instance.Instance, index int) error {
 		return nil
 	}
 	s.Members[index].ReadOnly = true
+	if s.Drive {
+		s.Members[index].Role = RoleReader
+	}
 
 	ac := APICredentials{
 		CID:         s.SID,
@@ -536,7 +555,7 @@ func (s *Sharing) AddReadOnlyFlag(inst *instance.Instance, index int) error {
 		},
 		Body: bytes.NewReader(body),
 	}
-	res, err := request.Req(opts)
+	res, err := tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode/100 == 4 {
 		res, err = RefreshToken(inst, s, &s.Members[index], &s.Credentials[index-1], opts, body)
 	}
@@ -568,7 +587,7 @@ func (s *Sharing) DelegateAddReadOnlyFlag(inst *instance.Instance, index int) er
 			"Authorization": "Bearer " + c.AccessToken.AccessToken,
 		},
 	}
-	res, err := request.Req(opts)
+	res, err := tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode/100 == 4 {
 		res, err = RefreshToken(inst, s, &s.Members[0], c, opts, nil)
 	}
@@ -622,7 +641,7 @@ func (s *Sharing) DowngradeToReadOnly(inst *instance.Instance, creds *APICredent
 // RemoveReadOnlyFlag removes the read-only flag of a recipient, and send
 // credentials to their cozy so that it can push its changes.
 func (s *Sharing) RemoveReadOnlyFlag(inst *instance.Instance, index int) error {
-	if index <= 1 {
+	if index < 1 {
 		return ErrMemberNotFound
 	}
 	if s.ReadOnly() {
@@ -632,6 +651,9 @@ func (s *Sharing) RemoveReadOnlyFlag(inst *instance.Instance, index int) error {
 		return nil
 	}
 	s.Members[index].ReadOnly = false
+	if s.Drive && s.Members[index].Role == RoleReader {
+		s.Members[index].Role = RoleWriter
+	}
 
 	ac := APICredentials{
 		CID: s.SID,
@@ -676,7 +698,7 @@ func (s *Sharing) RemoveReadOnlyFlag(inst *instance.Instance, index int) error {
 		},
 		Body: bytes.NewReader(body),
 	}
-	res, err := request.Req(opts)
+	res, err := tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode/100 == 4 {
 		res, err = RefreshToken(inst, s, &s.Members[index], &s.Credentials[index-1], opts, body)
 	}
@@ -728,7 +750,7 @@ func (s *Sharing) DelegateRemoveReadOnlyFlag(inst *instance.Instance, index int)
 			"Authorization": "Bearer " + c.AccessToken.AccessToken,
 		},
 	}
-	res, err := request.Req(opts)
+	res, err := tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode/100 == 4 {
 		res, err = RefreshToken(inst, s, &s.Members[0], c, opts, nil)
 	}
@@ -802,7 +824,7 @@ func (s *Sharing) NotifyMemberRevocation(inst *instance.Instance, m *Member, c *
 			"Authorization": "Bearer " + c.AccessToken.AccessToken,
 		},
 	}
-	res, err := request.Req(opts)
+	res, err := tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode/100 == 4 {
 		res, err = RefreshToken(inst, s, m, c, opts, nil)
 	}
@@ -900,7 +922,7 @@ func (s *Sharing) NotifyRecipients(inst *instance.Instance, except *Member) {
 			},
 			Body: bytes.NewReader(body),
 		}
-		res, err := request.Req(opts)
+		res, err := tracing.Req(inst.Context(), opts)
 		if res != nil && res.StatusCode/100 == 4 {
 			res, err = RefreshToken(inst, s, &s.Members[i], c, opts, body)
 		}
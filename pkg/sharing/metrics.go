@@ -0,0 +1,258 @@
+package sharing
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+)
+
+// maxConflictsRetries is the number of tries for incrementing the counter of
+// conflicts, as it can be updated by several requests at the same time.
+const maxConflictsRetries = 3
+
+// SyncStats are the statistics of the replicator or of the upload of files
+// for a member of a sharing. They are saved with the last sequence number.
+type SyncStats struct {
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	// Errors is the number of failed jobs since the last success
+	Errors int `json:"errors,omitempty"`
+}
+
+// MemberStatus is the state of a member of a sharing, for the dashboard.
+type MemberStatus struct {
+	Name       string     `json:"name,omitempty"`
+	Email      string     `json:"email,omitempty"`
+	Status     string     `json:"status"`
+	ReadOnly   bool       `json:"read_only,omitempty"`
+	KeyChanged bool       `json:"key_changed,omitempty"`
+	Replicator *SyncStats `json:"replicator,omitempty"`
+	Upload     *SyncStats `json:"upload,omitempty"`
+}
+
+// SharingStatus is a summary of a sharing, for a dashboard of the health of
+// the sharings of an instance.
+type SharingStatus struct {
+	SID         string         `json:"_id"`
+	Direction   string         `json:"direction"` // "sent" or "received"
+	Active      bool           `json:"active"`
+	Description string         `json:"description,omitempty"`
+	AppSlug     string         `json:"app_slug"`
+	Doctypes    []string       `json:"doctypes"`
+	Members     []MemberStatus `json:"members"`
+	AnswerState string         `json:"answer_state,omitempty"`
+	// Conflicts is the number of conflicts on files that have been resolved
+	// by creating a copy, which the user may want to check
+	Conflicts int `json:"conflicts"`
+	// Errors is the number of failed jobs since their last success, for all
+	// the members
+	Errors    int       `json:"errors"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ID returns the sharing qualified identifier
+func (s *SharingStatus) ID() string { return s.SID }
+
+// Rev returns the sharing revision
+func (s *SharingStatus) Rev() string { return "" }
+
+// DocType returns the sharing document type
+func (s *SharingStatus) DocType() string { return consts.SharingsStatus }
+
+// SetID changes the sharing qualified identifier
+func (s *SharingStatus) SetID(id string) { s.SID = id }
+
+// SetRev changes the sharing revision
+func (s *SharingStatus) SetRev(rev string) {}
+
+// Clone is part of jsonapi.Object interface
+func (s *SharingStatus) Clone() couchdb.Doc {
+	panic("SharingStatus must not be cloned")
+}
+
+// Included is part of jsonapi.Object interface
+func (s *SharingStatus) Included() []jsonapi.Object { return nil }
+
+// Relationships is part of jsonapi.Object interface
+func (s *SharingStatus) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Links is part of jsonapi.Object interface
+func (s *SharingStatus) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/sharings/" + s.SID}
+}
+
+var _ jsonapi.Object = (*SharingStatus)(nil)
+
+// GetStatuses returns a summary of all the sharings of the instance.
+func GetStatuses(inst *instance.Instance) ([]*SharingStatus, error) {
+	var statuses []*SharingStatus
+	err := couchdb.ForeachDocs(inst, consts.Sharings, func(_ string, data json.RawMessage) error {
+		var s Sharing
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		statuses = append(statuses, s.Status(inst))
+		return nil
+	})
+	if couchdb.IsNoDatabaseError(err) {
+		err = nil
+	}
+	return statuses, err
+}
+
+// Status returns a summary of the sharing, with the statistics of the
+// replications to its members.
+func (s *Sharing) Status(inst *instance.Instance) *SharingStatus {
+	status := &SharingStatus{
+		SID:         s.SID,
+		Direction:   "received",
+		Active:      s.Active,
+		Description: s.Description,
+		AppSlug:     s.AppSlug,
+		AnswerState: s.AnswerState,
+		UpdatedAt:   s.UpdatedAt,
+		Conflicts:   s.countConflicts(inst),
+	}
+	if s.Owner {
+		status.Direction = "sent"
+	}
+
+	doctypes := make(map[string]struct{})
+	for _, rule := range s.Rules {
+		if !rule.Local {
+			doctypes[rule.DocType] = struct{}{}
+		}
+	}
+	status.Doctypes = make([]string, 0, len(doctypes))
+	for doctype := range doctypes {
+		status.Doctypes = append(status.Doctypes, doctype)
+	}
+	sort.Strings(status.Doctypes)
+
+	status.Members = make([]MemberStatus, len(s.Members))
+	for i := range s.Members {
+		m := &s.Members[i]
+		ms := MemberStatus{
+			Name:       m.PrimaryName(),
+			Email:      m.Email,
+			Status:     m.Status,
+			ReadOnly:   m.ReadOnly,
+			KeyChanged: m.KeyChanged,
+		}
+		// The sharer replicates to the recipients, and a recipient to the
+		// sharer
+		if (s.Owner && i > 0) || (!s.Owner && i == 0) {
+			ms.Replicator = s.getSyncStats(inst, m, "replicator")
+			ms.Upload = s.getSyncStats(inst, m, "upload")
+			if ms.Replicator != nil {
+				status.Errors += ms.Replicator.Errors
+			}
+			if ms.Upload != nil {
+				status.Errors += ms.Upload.Errors
+			}
+		}
+		status.Members[i] = ms
+	}
+	return status
+}
+
+func (s *Sharing) getSyncStats(inst *instance.Instance, m *Member, worker string) *SyncStats {
+	id, err := s.replicationID(m)
+	if err != nil {
+		return nil
+	}
+	result, err := couchdb.GetLocal(inst, consts.Shared, id+"/"+worker)
+	if err != nil {
+		return nil
+	}
+	return parseSyncStats(result)
+}
+
+func parseSyncStats(result map[string]interface{}) *SyncStats {
+	raw, ok := result["stats"]
+	if !ok {
+		return nil
+	}
+	buf, err := json.Marshal(raw)
+	if err != nil {
+		return nil
+	}
+	var stats SyncStats
+	if err := json.Unmarshal(buf, &stats); err != nil {
+		return nil
+	}
+	return &stats
+}
+
+// recordSync saves the result of a replicator or upload job for a member in
+// the statistics of the sharing.
+func (s *Sharing) recordSync(inst *instance.Instance, m *Member, worker string, syncErr error) {
+	id, err := s.replicationID(m)
+	if err != nil {
+		return
+	}
+	result, err := couchdb.GetLocal(inst, consts.Shared, id+"/"+worker)
+	if err != nil {
+		if !couchdb.IsNotFoundError(err) {
+			return
+		}
+		result = make(map[string]interface{})
+	}
+	stats := parseSyncStats(result)
+	if stats == nil {
+		stats = &SyncStats{}
+	}
+	now := time.Now()
+	if syncErr == nil {
+		stats.LastSuccessAt = &now
+		stats.Errors = 0
+	} else {
+		stats.LastErrorAt = &now
+		stats.LastError = syncErr.Error()
+		stats.Errors++
+	}
+	result["stats"] = stats
+	if err = couchdb.PutLocal(inst, consts.Shared, id+"/"+worker, result); err != nil {
+		inst.Logger().WithField("nspace", "sharing").
+			Infof("Cannot save the stats for %s: %s", s.SID, err)
+	}
+}
+
+func (s *Sharing) conflictsID() string {
+	return "sharing-" + s.SID + "/conflicts"
+}
+
+func (s *Sharing) countConflicts(inst *instance.Instance) int {
+	result, err := couchdb.GetLocal(inst, consts.Shared, s.conflictsID())
+	if err != nil {
+		return 0
+	}
+	count, _ := result["count"].(float64)
+	return int(count)
+}
+
+// addConflict increments the number of conflicts that have been resolved for
+// this sharing.
+func (s *Sharing) addConflict(inst *instance.Instance) {
+	for i := 0; i < maxConflictsRetries; i++ {
+		result, err := couchdb.GetLocal(inst, consts.Shared, s.conflictsID())
+		if err != nil {
+			if !couchdb.IsNotFoundError(err) {
+				return
+			}
+			result = make(map[string]interface{})
+		}
+		count, _ := result["count"].(float64)
+		result["count"] = count + 1
+		err = couchdb.PutLocal(inst, consts.Shared, s.conflictsID(), result)
+		if !couchdb.IsConflictError(err) {
+			return
+		}
+	}
+}
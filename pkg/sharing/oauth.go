@@ -13,8 +13,10 @@ import (
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 )
@@ -75,7 +77,14 @@ func (m *Member) CreateSharingRequest(inst *instance.Instance, s *Sharing, c *Cr
 	if err != nil {
 		return err
 	}
-	res, err := request.Req(&request.Options{
+	// Pin the public key of the Cozy of the recipient
+	if key, errk := FetchPublicKey(inst, u.String()); errk == nil {
+		if m.PinPublicKey(key) {
+			inst.Logger().WithField("nspace", "sharing").
+				Warnf("The public key of %s has changed for %s", u.Host, s.SID)
+		}
+	}
+	opts := &request.Options{
 		Method: http.MethodPut,
 		Scheme: u.Scheme,
 		Domain: u.Host,
@@ -85,7 +94,9 @@ func (m *Member) CreateSharingRequest(inst *instance.Instance, s *Sharing, c *Cr
 			"Content-Type": "application/vnd.api+json",
 		},
 		Body: bytes.NewReader(body),
-	})
+	}
+	signRequest(inst, opts, body)
+	res, err := tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode == http.StatusConflict {
 		return ErrAlreadyAccepted
 	}
@@ -289,6 +300,95 @@ func CreateAccessToken(inst *instance.Instance, cli *oauth.Client, sharingID str
 	}, nil
 }
 
+// The states of the answer of a recipient, while it is sent to the sharer
+const (
+	// AnswerStatePending is used when the answer is in the jobs queue, or
+	// waits for a retry
+	AnswerStatePending = "pending"
+	// AnswerStateErrored is used when the answer has failed, and won't be
+	// retried
+	AnswerStateErrored = "errored"
+)
+
+// Accept is called when the recipient has accepted the sharing. The answer is
+// sent to the sharer's Cozy by a job, so that a slow or unreachable Cozy
+// doesn't fail the request of the user.
+func (s *Sharing) Accept(inst *instance.Instance, state string) error {
+	if s.Owner || len(s.Members) < 2 || len(s.Credentials) != 1 {
+		return ErrInvalidSharing
+	}
+	if s.AnswerState == AnswerStatePending {
+		return nil
+	}
+	s.Credentials[0].State = state
+	s.AnswerState = AnswerStatePending
+	s.AnswerError = ""
+	if err := couchdb.UpdateDoc(inst, s); err != nil {
+		return err
+	}
+	msg, err := jobs.NewMessage(&ReplicateMsg{SharingID: s.SID})
+	if err != nil {
+		return err
+	}
+	_, err = jobs.System().PushJob(inst, &jobs.JobRequest{
+		WorkerType: "share-answer",
+		Message:    msg,
+	})
+	return err
+}
+
+// RetrySendAnswer is called by the share-answer worker. It sends the answer
+// to the sharer, and on failure, tries again later with a backoff, or marks
+// the answer as errored when the error is permanent.
+func (s *Sharing) RetrySendAnswer(inst *instance.Instance, errors int) error {
+	if s.Active || s.AnswerState != AnswerStatePending {
+		return nil
+	}
+	err := s.SendAnswer(inst, s.Credentials[0].State)
+	if err == nil {
+		return nil
+	}
+	inst.Logger().WithField("nspace", "sharing").
+		Warnf("Error on sending the answer for %s: %s", s.SID, err)
+
+	// SendAnswer may have changed the sharing before failing
+	fresh, errf := FindSharing(inst, s.SID)
+	if errf != nil {
+		return errf
+	}
+	fresh.AnswerError = err.Error()
+	if isPermanentAnswerError(err) || errors+1 >= MaxRetries {
+		fresh.AnswerState = AnswerStateErrored
+	} else {
+		fresh.retryWorker(inst, "share-answer", errors)
+	}
+	if erru := couchdb.UpdateDoc(inst, fresh); erru != nil {
+		return erru
+	}
+	return err
+}
+
+// isPermanentAnswerError returns true for the errors where retrying to send
+// the answer is useless, like a 4xx response of the sharer's Cozy.
+func isPermanentAnswerError(err error) bool {
+	if err == ErrInvalidSharing {
+		return true
+	}
+	reqErr, ok := err.(*request.Error)
+	if !ok {
+		return false
+	}
+	for code := 400; code < 500; code++ {
+		if code == http.StatusRequestTimeout || code == http.StatusTooManyRequests {
+			continue
+		}
+		if reqErr.Status == http.StatusText(code) {
+			return true
+		}
+	}
+	return false
+}
+
 // SendAnswer says to the sharer's Cozy that the sharing has been accepted, and
 // materialize that by an exchange of credentials.
 func (s *Sharing) SendAnswer(inst *instance.Instance, state string) error {
@@ -329,7 +429,7 @@ func (s *Sharing) SendAnswer(inst *instance.Instance, state string) error {
 	if err != nil {
 		return err
 	}
-	res, err := request.Req(&request.Options{
+	opts := &request.Options{
 		Method: http.MethodPost,
 		Scheme: u.Scheme,
 		Domain: u.Host,
@@ -339,8 +439,12 @@ func (s *Sharing) SendAnswer(inst *instance.Instance, state string) error {
 			"Content-Type": "application/vnd.api+json",
 		},
 		Body: bytes.NewReader(body),
-	})
+	}
+	signRequest(inst, opts, body)
+	res, err := tracing.Req(inst.Context(), opts)
 	if err != nil {
+		// A new client is created on the next try
+		_ = cli.Delete(inst)
 		return err
 	}
 	defer res.Body.Close()
@@ -366,7 +470,10 @@ func (s *Sharing) SendAnswer(inst *instance.Instance, state string) error {
 	s.Credentials[0].InboundClientID = cli.ClientID
 	s.Credentials[0].AccessToken = creds.AccessToken
 	s.Credentials[0].Client = creds.Client
+	s.Credentials[0].State = ""
 	s.Active = true
+	s.AnswerState = ""
+	s.AnswerError = ""
 	return couchdb.UpdateDoc(inst, s)
 }
 
@@ -429,7 +536,7 @@ func RefreshToken(inst *instance.Instance, s *Sharing, m *Member, creds *Credent
 	if body != nil {
 		opts.Body = bytes.NewReader(body)
 	}
-	res, err := request.Req(opts)
+	res, err := tracing.Req(inst.Context(), opts)
 	if err != nil {
 		if res != nil && res.StatusCode/100 == 5 {
 			return nil, ErrInternalServerError
@@ -15,6 +15,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	multierror "github.com/hashicorp/go-multierror"
 )
 
@@ -40,10 +41,13 @@ func (s *Sharing) Replicate(inst *instance.Instance, errors int) error {
 	mu.Lock()
 	defer mu.Unlock()
 
+	s.CheckIdentities(inst)
+
 	pending := false
 	var errm error
 	if !s.Owner {
 		pending, errm = s.ReplicateTo(inst, &s.Members[0], false)
+		s.recordSync(inst, &s.Members[0], "replicator", errm)
 	} else {
 		for i, m := range s.Members {
 			if i == 0 {
@@ -51,6 +55,7 @@ func (s *Sharing) Replicate(inst *instance.Instance, errors int) error {
 			}
 			if m.Status == MemberStatusReady {
 				p, err := s.ReplicateTo(inst, &s.Members[i], false)
+				s.recordSync(inst, &s.Members[i], "replicator", err)
 				if err != nil {
 					errm = multierror.Append(errm, err)
 				} else if p {
@@ -413,7 +418,7 @@ func (s *Sharing) callRevsDiff(inst *instance.Instance, m *Member, creds *Creden
 		Body: bytes.NewReader(body),
 	}
 	var res *http.Response
-	res, err = request.Req(opts)
+	res, err = tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode/100 == 4 {
 		res, err = RefreshToken(inst, s, m, creds, opts, body)
 	}
@@ -560,7 +565,7 @@ func (s *Sharing) sendBulkDocs(inst *instance.Instance, m *Member, creds *Creden
 		},
 		Body: bytes.NewReader(body),
 	}
-	res, err := request.Req(opts)
+	res, err := tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode/100 == 4 {
 		res, err = RefreshToken(inst, s, m, creds, opts, body)
 	}
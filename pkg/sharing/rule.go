@@ -59,7 +59,8 @@ func (s *Sharing) ValidateRules() error {
 			for _, val := range rule.Values {
 				if val == consts.RootDirID ||
 					val == consts.TrashDirID ||
-					val == consts.SharedWithMeDirID {
+					val == consts.SharedWithMeDirID ||
+					val == consts.DrivesDirID {
 					return ErrInvalidRule
 				}
 			}
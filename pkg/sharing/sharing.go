@@ -46,6 +46,16 @@ type Sharing struct {
 	UpdatedAt   time.Time `json:"updated_at"`
 	NbFiles     int       `json:"initial_number_of_files_to_sync,omitempty"`
 
+	// A shared drive is a sharing of a folder in the Drives directory, with
+	// roles for its members and an optional quota (in bytes)
+	Drive      bool  `json:"drive,omitempty"`
+	DriveQuota int64 `json:"drive_quota,omitempty"`
+
+	// On a recipient, the state of the answer sent to the sharer by the
+	// share-answer worker, after the sharing has been accepted
+	AnswerState string `json:"answer_state,omitempty"`
+	AnswerError string `json:"answer_error,omitempty"`
+
 	Rules []Rule `json:"rules"`
 
 	// Members[0] is the owner, Members[1...] are the recipients
@@ -256,6 +266,16 @@ func (s *Sharing) CreateRequest(inst *instance.Instance) error {
 		if old.Active {
 			return ErrAlreadyAccepted
 		}
+		// Keep the public key of the sharer pinned on the first request
+		if len(old.Members) > 0 && old.Members[0].PublicKey != "" {
+			key := s.Members[0].PublicKey
+			s.Members[0].PublicKey = old.Members[0].PublicKey
+			s.Members[0].KeyChanged = old.Members[0].KeyChanged
+			if s.Members[0].PinPublicKey(key) {
+				inst.Logger().WithField("nspace", "sharing").
+					Warnf("The public key of the sharer has changed for %s", s.SID)
+			}
+		}
 		s.SRev = old.SRev
 		err = couchdb.UpdateDoc(inst, s)
 	}
@@ -445,6 +465,10 @@ func (s *Sharing) NoMoreRecipient(inst *instance.Instance) error {
 			return couchdb.UpdateDoc(inst, s)
 		}
 	}
+	// A shared drive can live without members, and new ones can be added
+	if s.Drive {
+		return couchdb.UpdateDoc(inst, s)
+	}
 	if err := s.RemoveTriggers(inst); err != nil {
 		return err
 	}
@@ -16,6 +16,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	multierror "github.com/hashicorp/go-multierror"
 )
@@ -47,6 +48,7 @@ func (s *Sharing) Upload(inst *instance.Instance, errors int) error {
 		}
 	}
 
+	results := make(map[*Member]error, len(members))
 	for i := 0; i < BatchSize; i++ {
 		if len(members) == 0 {
 			break
@@ -57,10 +59,16 @@ func (s *Sharing) Upload(inst *instance.Instance, errors int) error {
 		if err != nil {
 			errm = multierror.Append(errm, err)
 		}
+		if results[m] == nil {
+			results[m] = err
+		}
 		if more {
 			members = append(members, m)
 		}
 	}
+	for m, err := range results {
+		s.recordSync(inst, m, "upload", err)
+	}
 
 	if errm != nil {
 		s.retryWorker(inst, "share-upload", errors)
@@ -111,7 +119,7 @@ func (s *Sharing) sendInitialEndNotif(inst *instance.Instance, m *Member) error
 			"Authorization": "Bearer " + c.AccessToken.AccessToken,
 		},
 	}
-	res, err := request.Req(opts)
+	res, err := tracing.Req(inst.Context(), opts)
 	if err != nil {
 		return err
 	}
@@ -249,7 +257,7 @@ func (s *Sharing) uploadFile(inst *instance.Instance, m *Member, file map[string
 		Body: bytes.NewReader(body),
 	}
 	var res *http.Response
-	res, err = request.Req(opts)
+	res, err = tracing.Req(inst.Context(), opts)
 	if res != nil && res.StatusCode/100 == 4 {
 		res, err = RefreshToken(inst, s, m, creds, opts, body)
 	}
@@ -280,7 +288,7 @@ func (s *Sharing) uploadFile(inst *instance.Instance, m *Member, file map[string
 	}
 	defer content.Close()
 
-	res2, err := request.Req(&request.Options{
+	res2, err := tracing.Req(inst.Context(), &request.Options{
 		Method: http.MethodPut,
 		Scheme: u.Scheme,
 		Domain: u.Host,
@@ -714,6 +722,7 @@ func (s *Sharing) uploadLostConflict(inst *instance.Instance, target *FileDocWit
 	if err != nil {
 		return err
 	}
+	s.addConflict(inst)
 	inst.Logger().WithField("nspace", "upload").Debugf("1. loser = %#v", newdoc)
 	return copyFileContent(inst, file, body)
 }
@@ -744,6 +753,7 @@ func (s *Sharing) uploadWonConflict(inst *instance.Instance, src *vfs.FileDoc) e
 	if err != nil {
 		return err
 	}
+	s.addConflict(inst)
 	inst.Logger().WithField("nspace", "upload").Debugf("2. loser = %#v", dst)
 	return copyFileContent(inst, file, content)
 }
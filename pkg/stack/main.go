@@ -7,14 +7,22 @@ import (
 	"time"
 
 	"github.com/cozy/checkup"
+	"github.com/cozy/cozy-stack/pkg/activity"
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config_dyn"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/pkg/statik/fs"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/workers/exec"
+	"github.com/cozy/cozy-stack/pkg/workers/scrub"
+	"github.com/cozy/cozy-stack/pkg/workers/updates"
 
 	"github.com/google/gops/agent"
 	"github.com/sirupsen/logrus"
@@ -31,6 +39,21 @@ func (g gopAgent) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+type tracingAgent struct{}
+
+func (t tracingAgent) Shutdown(ctx context.Context) error {
+	if !tracing.Enabled() {
+		return nil
+	}
+	fmt.Print("  shutting down tracing...")
+	if err := tracing.Shutdown(ctx); err != nil {
+		fmt.Println("failed: ", err.Error())
+		return err
+	}
+	fmt.Println("ok.")
+	return nil
+}
+
 // Start is used to initialize all the
 func Start() (processes utils.Shutdowner, err error) {
 	if config.IsDevRelease() {
@@ -50,6 +73,10 @@ security features. Please do not use this binary as your production server.
 		return
 	}
 
+	if err = tracing.Init(config.GetConfig().Tracing); err != nil {
+		return
+	}
+
 	// Check that we can properly reach CouchDB.
 	u := config.CouchURL()
 	u.User = config.GetConfig().CouchDB.Auth
@@ -111,6 +138,14 @@ security features. Please do not use this binary as your production server.
 		return
 	}
 
+	// Migrate the views and indexes of the instances after an upgrade of the
+	// stack, in the background.
+	go func() {
+		if errm := instance.PushIndexesMigrations(); errm != nil {
+			log.Errorf("Could not push the indexes migrations: %s", errm)
+		}
+	}()
+
 	assetsList, err := config_dyn.GetAssetsList()
 	if err != nil {
 		return
@@ -126,12 +161,29 @@ security features. Please do not use this binary as your production server.
 	}
 
 	sessionSweeper := sessions.SweepLoginRegistrations()
+	deletionJanitor := instance.StartDeletionJanitor()
+	jwtKeysRotator := instance.StartJWTKeysRotator()
+	auditPurger := audit.StartPurger()
+	activityFeeder := activity.StartFeeder()
+	konnectorLogsPurger := exec.StartLogsPurger()
+	updatesChecker := updates.StartChecker()
+	scrubber := scrub.StartScrubber()
+	couchdbHealthChecker := couchdb.StartNodesHealthCheck()
 
 	// Global shutdowner that composes all the running processes of the stack
 	processes = utils.NewGroupShutdown(
 		jobs.System(),
 		sessionSweeper,
+		deletionJanitor,
+		jwtKeysRotator,
+		auditPurger,
+		activityFeeder,
+		konnectorLogsPurger,
+		updatesChecker,
+		scrubber,
+		couchdbHealthChecker,
 		gopAgent{},
+		tracingAgent{},
 	)
 	return
 }
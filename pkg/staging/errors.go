@@ -0,0 +1,17 @@
+package staging
+
+import "errors"
+
+var (
+	// ErrNotReady is used when an upload is committed before its content has
+	// been validated
+	ErrNotReady = errors.New("The content of this upload has not been validated")
+	// ErrExpired is used when an upload is committed after its ttl
+	ErrExpired = errors.New("This upload has expired")
+	// ErrInfected is used when the antivirus has found a virus in the content
+	// of an upload
+	ErrInfected = errors.New("A virus has been found in the content of this upload")
+	// ErrAntivirusFailed is used when the antivirus has failed to scan the
+	// content of an upload
+	ErrAntivirusFailed = errors.New("The content of this upload cannot be scanned")
+)
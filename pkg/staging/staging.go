@@ -0,0 +1,280 @@
+// Package staging is for the uploads in two phases (io.cozy.files.uploads):
+// the content of a file is first uploaded in a staging area, where it is
+// validated (checksum, size, antivirus), and the file is then created in the
+// VFS when the upload is committed with its final metadata.
+package staging
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+const (
+	// StatePending is the state of an upload whose content is being received
+	StatePending = "pending"
+	// StateReady is the state of an upload whose content has been validated,
+	// and that can be committed
+	StateReady = "ready"
+)
+
+const (
+	// antivirusTimeout is the maximal duration of the scan of the content of
+	// an upload
+	antivirusTimeout = 5 * time.Minute
+	// maxPurged is the maximal number of expired uploads purged when a new
+	// upload is staged
+	maxPurged = 20
+)
+
+// Upload is the document for an upload in two phases. Its content is in the
+// staging area of the instance until it is committed, aborted or expired.
+type Upload struct {
+	DocID        string    `json:"_id,omitempty"`
+	DocRev       string    `json:"_rev,omitempty"`
+	DirID        string    `json:"dir_id,omitempty"`
+	State        string    `json:"state"`
+	Size         int64     `json:"size,string"`
+	MD5Sum       []byte    `json:"md5sum"`
+	Mime         string    `json:"mime"`
+	Class        string    `json:"class"`
+	PermissionID string    `json:"permission_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// ID returns the upload identifier
+func (up *Upload) ID() string { return up.DocID }
+
+// Rev returns the upload revision
+func (up *Upload) Rev() string { return up.DocRev }
+
+// DocType returns the upload document type
+func (up *Upload) DocType() string { return consts.FilesUploads }
+
+// Clone implements couchdb.Doc
+func (up *Upload) Clone() couchdb.Doc {
+	cloned := *up
+	cloned.MD5Sum = make([]byte, len(up.MD5Sum))
+	copy(cloned.MD5Sum, up.MD5Sum)
+	return &cloned
+}
+
+// SetID changes the upload identifier
+func (up *Upload) SetID(id string) { up.DocID = id }
+
+// SetRev changes the upload revision
+func (up *Upload) SetRev(rev string) { up.DocRev = rev }
+
+// Expired returns true if the upload can no longer be committed.
+func (up *Upload) Expired() bool {
+	return time.Now().After(up.ExpiresAt)
+}
+
+// Options are the parameters of a new upload.
+type Options struct {
+	// DirID is the directory where the file is expected to be created. It
+	// can be changed when the upload is committed.
+	DirID string
+	// Size is the expected size of the content, or -1 if it is unknown
+	Size int64
+	// MD5Sum is the expected checksum of the content, if known
+	MD5Sum []byte
+	Mime   string
+	Class  string
+	// MaxSize is the maximal number of bytes accepted for the content, or 0
+	// for no limit
+	MaxSize int64
+	// PermissionID is the identifier of the permission used to stage the
+	// upload: only this permission can commit or abort it
+	PermissionID string
+}
+
+// Stage saves the content in the staging area, and validates it: the size
+// and the checksum must match the expected ones, and the antivirus must not
+// find a virus in it. If the content is not valid, the upload is removed.
+func Stage(inst *instance.Instance, content io.Reader, opts *Options) (*Upload, error) {
+	purgeExpired(inst)
+
+	now := time.Now().UTC()
+	up := &Upload{
+		DirID:        opts.DirID,
+		State:        StatePending,
+		Size:         opts.Size,
+		MD5Sum:       opts.MD5Sum,
+		Mime:         opts.Mime,
+		Class:        opts.Class,
+		PermissionID: opts.PermissionID,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(config.GetConfig().Uploads.TTL),
+	}
+	if err := couchdb.CreateDoc(inst, up); err != nil {
+		return nil, err
+	}
+
+	err := receive(inst, up, content, opts.MaxSize)
+	if err == nil {
+		err = scan(inst, up)
+	}
+	if err == nil {
+		up.State = StateReady
+		err = couchdb.UpdateDoc(inst, up)
+	}
+	if err != nil {
+		_ = Abort(inst, up)
+		return nil, err
+	}
+	return up, nil
+}
+
+// receive writes the content in the staging area, and checks its size and
+// its checksum.
+func receive(inst *instance.Instance, up *Upload, content io.Reader, maxSize int64) error {
+	f, err := inst.StagingFS().CreateStagedFile(up.ID())
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 {
+		content = io.LimitReader(content, maxSize+1)
+	}
+	hash := md5.New() // #nosec
+	written, err := io.Copy(io.MultiWriter(f, hash), content)
+	if err == nil && maxSize > 0 && written > maxSize {
+		err = vfs.ErrFileTooBig
+	}
+	if err == nil && up.Size >= 0 && written != up.Size {
+		err = vfs.ErrContentLengthMismatch
+	}
+	sum := hash.Sum(nil)
+	if err == nil && len(up.MD5Sum) > 0 && !bytes.Equal(sum, up.MD5Sum) {
+		err = vfs.ErrInvalidHash
+	}
+	if err != nil {
+		_ = f.Abort()
+		return err
+	}
+	up.Size = written
+	up.MD5Sum = sum
+	return f.Commit()
+}
+
+// scan runs the antivirus on the content of the upload, if one has been
+// configured. The command reads the content on its standard input, and exits
+// with the code 1 if a virus has been found.
+func scan(inst *instance.Instance, up *Upload) error {
+	args := strings.Fields(config.GetConfig().Uploads.AntivirusCmd)
+	if len(args) == 0 {
+		return nil
+	}
+	content, err := inst.StagingFS().OpenStagedFile(up.ID())
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), antivirusTimeout)
+	defer cancel()
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...) // #nosec
+	cmd.Stdin = content
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stdout
+	err = cmd.Run()
+	if err == nil {
+		return nil
+	}
+	log := inst.Logger().WithField("nspace", "staging").
+		WithField("output", stdout.String())
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		log.Warnf("Virus found in upload %s", up.ID())
+		return ErrInfected
+	}
+	log.Errorf("antivirus failed: %s", err)
+	return ErrAntivirusFailed
+}
+
+// Get returns the upload with the given identifier.
+func Get(inst *instance.Instance, id string) (*Upload, error) {
+	var up Upload
+	if err := couchdb.GetDoc(inst, consts.FilesUploads, id, &up); err != nil {
+		return nil, err
+	}
+	return &up, nil
+}
+
+// Commit creates the file in the VFS with the content of the upload, and
+// removes the upload. The size, checksum and type of the file are the ones
+// of the staged content.
+func Commit(inst *instance.Instance, up *Upload, newdoc *vfs.FileDoc) error {
+	if up.Expired() {
+		_ = Abort(inst, up)
+		return ErrExpired
+	}
+	if up.State != StateReady {
+		return ErrNotReady
+	}
+	newdoc.ByteSize = up.Size
+	newdoc.MD5Sum = up.MD5Sum
+
+	content, err := inst.StagingFS().OpenStagedFile(up.ID())
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	file, err := inst.VFS().CreateFile(newdoc, nil)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return Abort(inst, up)
+}
+
+// Abort removes the upload and its content from the staging area.
+func Abort(inst *instance.Instance, up *Upload) error {
+	if err := inst.StagingFS().RemoveStagedFile(up.ID()); err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(inst, up)
+}
+
+// purgeExpired removes some uploads that have expired, as they can't be
+// committed anymore.
+func purgeExpired(inst *instance.Instance) {
+	var list []*Upload
+	req := &couchdb.AllDocsRequest{Limit: 100}
+	if err := couchdb.GetAllDocs(inst, consts.FilesUploads, req, &list); err != nil {
+		return
+	}
+	purged := 0
+	for _, up := range list {
+		if purged == maxPurged {
+			break
+		}
+		if up.Expired() {
+			if err := Abort(inst, up); err != nil {
+				inst.Logger().WithField("nspace", "staging").
+					Infof("Cannot purge upload %s: %s", up.ID(), err)
+			}
+			purged++
+		}
+	}
+}
+
+var _ couchdb.Doc = &Upload{}
@@ -0,0 +1,181 @@
+// Package tracing is used for the distributed tracing of the stack with
+// OpenTelemetry: the spans of the HTTP requests, CouchDB requests, storage
+// operations and jobs are exported to a collector with OTLP.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/cozy/cozy-stack/client/request"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/cozy/cozy-stack"
+
+// Options contains the configuration values of the tracing
+type Options struct {
+	// Endpoint is the host:port of the OTLP/HTTP collector. The tracing is
+	// disabled if it is empty.
+	Endpoint string
+	// Insecure can be used to send the spans without TLS
+	Insecure bool
+	// SampleRatio is the ratio of the traces that are sampled, between 0 and 1
+	SampleRatio float64
+}
+
+var provider *sdktrace.TracerProvider
+
+// Contexter is an interface for the objects that carry the context of the
+// operation in progress, like an instance used for an HTTP request or a job:
+// the spans for the CouchDB requests and the storage operations made with
+// them are the children of this context.
+type Contexter interface {
+	Context() context.Context
+}
+
+// Init initializes the tracing with the given options. It does nothing if no
+// endpoint has been configured.
+func Init(opts Options) error {
+	if opts.Endpoint == "" {
+		return nil
+	}
+	ratio := opts.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	clientOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), clientOpts...)
+	if err != nil {
+		return err
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", "cozy-stack"))
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	return nil
+}
+
+// Enabled returns true if the spans are exported.
+func Enabled() bool {
+	return provider != nil
+}
+
+// Shutdown flushes the spans that have not been exported yet.
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+// Start creates a span, child of the span in the given context.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartServer creates a span for an HTTP request received by the stack.
+func StartServer(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+}
+
+// End ends the span, with the error status if err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// ContextOf returns the context carried by the given object if it has one, or
+// else the background context.
+func ContextOf(v interface{}) context.Context {
+	if c, ok := v.(Contexter); ok {
+		if ctx := c.Context(); ctx != nil {
+			return ctx
+		}
+	}
+	return context.Background()
+}
+
+// Extract returns a context with the trace context found in the headers of an
+// HTTP request, if any.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Carrier returns the trace context of ctx as a map, that can be serialized
+// (in a job for example), or nil if there is no span in the context.
+func Carrier(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// FromCarrier returns a context with the trace context of a map made by
+// Carrier.
+func FromCarrier(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// Environ returns the trace context of ctx as environment variables (like
+// TRACEPARENT), for propagating it to a process like a konnector.
+func Environ(ctx context.Context) []string {
+	var env []string
+	for k, v := range Carrier(ctx) {
+		env = append(env, strings.ToUpper(k)+"="+v)
+	}
+	return env
+}
+
+// Req performs an HTTP request to another cozy, like request.Req, with a
+// span for the request, and the trace context propagated in its headers.
+func Req(ctx context.Context, opts *request.Options) (*http.Response, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "HTTP "+opts.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", opts.Method),
+			attribute.String("http.host", opts.Domain),
+			attribute.String("http.target", opts.Path),
+		))
+	headers := make(request.Headers, len(opts.Headers)+2)
+	for k, v := range opts.Headers {
+		headers[k] = v
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+	cloned := *opts
+	cloned.Headers = headers
+	res, err := request.Req(&cloned)
+	if res != nil {
+		span.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
+	}
+	End(span, err)
+	return res, err
+}
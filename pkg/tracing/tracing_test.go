@@ -0,0 +1,46 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestCarrier(t *testing.T) {
+	assert.Nil(t, Carrier(context.Background()))
+	assert.Empty(t, Environ(context.Background()))
+
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "test")
+	defer span.End()
+
+	carrier := Carrier(ctx)
+	assert.Contains(t, carrier, "traceparent")
+	env := Environ(ctx)
+	if assert.Len(t, env, 1) {
+		assert.True(t, strings.HasPrefix(env[0], "TRACEPARENT="))
+	}
+
+	restored := trace.SpanContextFromContext(FromCarrier(context.Background(), carrier))
+	assert.Equal(t, span.SpanContext().TraceID(), restored.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(), restored.SpanID())
+}
+
+type contexter struct{ ctx context.Context }
+
+func (c contexter) Context() context.Context { return c.ctx }
+
+func TestContextOf(t *testing.T) {
+	key := struct{}{}
+	ctx := context.WithValue(context.Background(), key, "foo")
+	assert.Equal(t, "foo", ContextOf(contexter{ctx}).Value(key))
+	assert.Equal(t, context.Background(), ContextOf("not a contexter"))
+	assert.Equal(t, context.Background(), ContextOf(contexter{}))
+}
@@ -0,0 +1,125 @@
+package vfs
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// accessDebounce is the duration during which the new accesses to a file are
+// not recorded, to avoid writing a document for each request of a video
+// streamed with range requests for example.
+const accessDebounce = time.Minute
+
+// FileAccess is the last access to the content of a file, used to list the
+// recent files. Its identifier is the identifier of the file.
+type FileAccess struct {
+	DocID      string    `json:"_id,omitempty"`
+	DocRev     string    `json:"_rev,omitempty"`
+	AccessedAt time.Time `json:"accessed_at"`
+	Count      int       `json:"count"`
+}
+
+// ID returns the access identifier
+func (a *FileAccess) ID() string { return a.DocID }
+
+// Rev returns the access revision
+func (a *FileAccess) Rev() string { return a.DocRev }
+
+// DocType returns the access document type
+func (a *FileAccess) DocType() string { return consts.FilesAccesses }
+
+// Clone implements couchdb.Doc
+func (a *FileAccess) Clone() couchdb.Doc { cloned := *a; return &cloned }
+
+// SetID changes the access identifier
+func (a *FileAccess) SetID(id string) { a.DocID = id }
+
+// SetRev changes the access revision
+func (a *FileAccess) SetRev(rev string) { a.DocRev = rev }
+
+// RecordAccess records that the content of the file has been opened or
+// downloaded by the user.
+func RecordAccess(db prefixer.Prefixer, doc *FileDoc) error {
+	now := time.Now().UTC()
+	access := &FileAccess{}
+	err := couchdb.GetDoc(db, consts.FilesAccesses, doc.ID(), access)
+	if couchdb.IsNotFoundError(err) {
+		access = &FileAccess{DocID: doc.ID(), AccessedAt: now, Count: 1}
+		err = couchdb.CreateNamedDocWithDB(db, access)
+	} else if err == nil {
+		if now.Sub(access.AccessedAt) < accessDebounce {
+			return nil
+		}
+		access.AccessedAt = now
+		access.Count++
+		err = couchdb.UpdateDoc(db, access)
+	}
+	// A conflict means that the file has been accessed at the same time by
+	// another request, that has recorded it.
+	if couchdb.IsConflictError(err) {
+		return nil
+	}
+	return err
+}
+
+// RecentFiles returns a page of the files accessed by the user, from the most
+// recent access to the oldest. The files that have been trashed are skipped,
+// and the accesses to the files that have been deleted are removed.
+func RecentFiles(fs VFS, cursor couchdb.Cursor) ([]*FileDoc, error) {
+	req := &couchdb.ViewRequest{Descending: true}
+	cursor.ApplyTo(req)
+	var res couchdb.ViewResponse
+	if err := couchdb.ExecView(fs, consts.FilesAccessesByDate, req, &res); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cursor.UpdateFrom(&res)
+	files := make([]*FileDoc, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		file, err := fs.FileByID(row.ID)
+		if os.IsNotExist(err) {
+			access := &FileAccess{DocID: row.ID}
+			if err = couchdb.GetDoc(fs, consts.FilesAccesses, row.ID, access); err == nil {
+				_ = couchdb.DeleteDoc(fs, access)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !file.Trashed {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// Favorites returns a page of the files and directories marked as favorites
+// by the user, sorted by name.
+func Favorites(db prefixer.Prefixer, cursor couchdb.Cursor) ([]*DirOrFileDoc, error) {
+	req := &couchdb.ViewRequest{IncludeDocs: true}
+	cursor.ApplyTo(req)
+	var res couchdb.ViewResponse
+	if err := couchdb.ExecView(db, consts.FilesFavoritesView, req, &res); err != nil {
+		return nil, err
+	}
+	cursor.UpdateFrom(&res)
+	docs := make([]*DirOrFileDoc, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var doc DirOrFileDoc
+		if err := json.Unmarshal(row.Doc, &doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, &doc)
+	}
+	return docs, nil
+}
+
+var _ couchdb.Doc = &FileAccess{}
@@ -54,6 +54,8 @@ func (c *couchdbIndexer) InitIndex() error {
 	if err != nil && !couchdb.IsConflictError(err) {
 		return err
 	}
+	c.initDirSize(consts.RootDirID)
+	c.initDirSize(consts.TrashDirID)
 	return nil
 }
 
@@ -81,7 +83,11 @@ func (c *couchdbIndexer) CreateFileDoc(doc *FileDoc) error {
 	if _, err := doc.Path(c); err != nil {
 		return err
 	}
-	return couchdb.CreateDoc(c.db, doc)
+	if err := couchdb.CreateDoc(c.db, doc); err != nil {
+		return err
+	}
+	c.addToDirSizes(doc.DirID, sizeInDir(doc), 1)
+	return nil
 }
 
 func (c *couchdbIndexer) CreateNamedFileDoc(doc *FileDoc) error {
@@ -89,7 +95,11 @@ func (c *couchdbIndexer) CreateNamedFileDoc(doc *FileDoc) error {
 	if _, err := doc.Path(c); err != nil {
 		return err
 	}
-	return couchdb.CreateNamedDoc(c.db, doc)
+	if err := couchdb.CreateNamedDoc(c.db, doc); err != nil {
+		return err
+	}
+	c.addToDirSizes(doc.DirID, sizeInDir(doc), 1)
+	return nil
 }
 
 func (c *couchdbIndexer) UpdateFileDoc(olddoc, newdoc *FileDoc) error {
@@ -102,7 +112,16 @@ func (c *couchdbIndexer) UpdateFileDoc(olddoc, newdoc *FileDoc) error {
 	}
 	newdoc.SetID(olddoc.ID())
 	newdoc.SetRev(olddoc.Rev())
-	return couchdb.UpdateDocWithOld(c.db, newdoc, olddoc)
+	if err := couchdb.UpdateDocWithOld(c.db, newdoc, olddoc); err != nil {
+		return err
+	}
+	if newdoc.DirID == olddoc.DirID {
+		c.addToDirSizes(newdoc.DirID, sizeInDir(newdoc)-sizeInDir(olddoc), 0)
+	} else {
+		c.addToDirSizes(olddoc.DirID, -sizeInDir(olddoc), -1)
+		c.addToDirSizes(newdoc.DirID, sizeInDir(newdoc), 1)
+	}
+	return nil
 }
 
 func (c *couchdbIndexer) DeleteFileDoc(doc *FileDoc) error {
@@ -110,15 +129,27 @@ func (c *couchdbIndexer) DeleteFileDoc(doc *FileDoc) error {
 	if _, err := doc.Path(c); err != nil {
 		return err
 	}
-	return couchdb.DeleteDoc(c.db, doc)
+	if err := couchdb.DeleteDoc(c.db, doc); err != nil {
+		return err
+	}
+	c.addToDirSizes(doc.DirID, -sizeInDir(doc), -1)
+	return nil
 }
 
 func (c *couchdbIndexer) CreateDirDoc(doc *DirDoc) error {
-	return couchdb.CreateDoc(c.db, doc)
+	if err := couchdb.CreateDoc(c.db, doc); err != nil {
+		return err
+	}
+	c.initDirSize(doc.ID())
+	return nil
 }
 
 func (c *couchdbIndexer) CreateNamedDirDoc(doc *DirDoc) error {
-	return couchdb.CreateNamedDoc(c.db, doc)
+	if err := couchdb.CreateNamedDoc(c.db, doc); err != nil {
+		return err
+	}
+	c.initDirSize(doc.ID())
+	return nil
 }
 
 func (c *couchdbIndexer) UpdateDirDoc(olddoc, newdoc *DirDoc) error {
@@ -147,6 +178,10 @@ func (c *couchdbIndexer) UpdateDirDoc(olddoc, newdoc *DirDoc) error {
 		return err
 	}
 
+	if newdoc.DirID != olddoc.DirID {
+		c.moveDirSize(newdoc.ID(), olddoc.DirID, newdoc.DirID)
+	}
+
 	if isRestored {
 		if err := c.setTrashedForFilesInsideDir(newdoc, false); err != nil {
 			return err
@@ -157,13 +192,20 @@ func (c *couchdbIndexer) UpdateDirDoc(olddoc, newdoc *DirDoc) error {
 }
 
 func (c *couchdbIndexer) DeleteDirDoc(doc *DirDoc) error {
-	return couchdb.DeleteDoc(c.db, doc)
+	if err := couchdb.DeleteDoc(c.db, doc); err != nil {
+		return err
+	}
+	c.deleteDirSizes([]string{doc.ID()})
+	return nil
 }
 
 func (c *couchdbIndexer) DeleteDirDocAndContent(doc *DirDoc, onlyContent bool) (n int64, ids []string, err error) {
 	var files []couchdb.Doc
+	var dirIDs []string
+	var size int64
 	if !onlyContent {
 		files = append(files, doc)
+		dirIDs = append(dirIDs, doc.ID())
 	}
 	err = walk(c, doc.Name(), doc, nil, func(name string, dir *DirDoc, file *FileDoc, err error) error {
 		if err != nil {
@@ -174,16 +216,26 @@ func (c *couchdbIndexer) DeleteDirDocAndContent(doc *DirDoc, onlyContent bool) (
 				return nil
 			}
 			files = append(files, dir)
+			dirIDs = append(dirIDs, dir.ID())
 		} else {
 			files = append(files, file)
 			ids = append(ids, file.ID())
 			n += file.ByteSize
+			size += sizeInDir(file)
 		}
 		return err
 	}, 0)
 	if err == nil {
 		err = c.BatchDelete(files)
 	}
+	if err == nil {
+		if onlyContent {
+			c.addToDirSizes(doc.ID(), -size, -int64(len(ids)))
+		} else {
+			c.addToDirSizes(doc.DirID, -size, -int64(len(ids)))
+		}
+		c.deleteDirSizes(dirIDs)
+	}
 	return
 }
 
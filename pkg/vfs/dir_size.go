@@ -0,0 +1,287 @@
+package vfs
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+const (
+	// maxDirSizeRetries is the maximal number of tries to update the
+	// aggregates of a directory when there are concurrent updates
+	maxDirSizeRetries = 3
+	// maxDirDepth is the maximal number of ancestors of a directory whose
+	// aggregates are updated
+	maxDirDepth = 256
+	// dirSizesBatch is the number of aggregates saved in a bulk request when
+	// they are recomputed
+	dirSizesBatch = 500
+)
+
+// DirSize is the document with the aggregates of a directory, with the same
+// identifier as the directory: the total size and the number of the files
+// inside it, including those of its sub-directories.
+//
+// The aggregates are updated incrementally by the indexer when a file is
+// created, modified, moved or deleted. It is optimistic: the concurrent
+// updates are retried on the new revision, and a failure is only logged. The
+// aggregates can then drift (the files written by the sharings are not
+// counted for example), and they are recomputed regularly by the dir-sizes
+// worker. The aggregates of a directory are unknown until it has been
+// created with this mechanism, or recomputed.
+type DirSize struct {
+	DocID      string    `json:"_id,omitempty"`
+	DocRev     string    `json:"_rev,omitempty"`
+	Size       int64     `json:"size,string"`
+	FilesCount int64     `json:"files_count"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ID returns the directory identifier
+func (s *DirSize) ID() string { return s.DocID }
+
+// Rev returns the aggregates revision
+func (s *DirSize) Rev() string { return s.DocRev }
+
+// DocType returns the aggregates document type
+func (s *DirSize) DocType() string { return consts.FilesSizes }
+
+// Clone implements couchdb.Doc
+func (s *DirSize) Clone() couchdb.Doc {
+	cloned := *s
+	return &cloned
+}
+
+// SetID changes the directory identifier
+func (s *DirSize) SetID(id string) { s.DocID = id }
+
+// SetRev changes the aggregates revision
+func (s *DirSize) SetRev(rev string) { s.DocRev = rev }
+
+// GetDirSizes returns the aggregates of the given directories, indexed by
+// their identifiers. The directories with unknown aggregates are not in the
+// map.
+func GetDirSizes(db prefixer.Prefixer, ids []string) (map[string]*DirSize, error) {
+	sizes := make(map[string]*DirSize, len(ids))
+	if len(ids) == 0 {
+		return sizes, nil
+	}
+	var list []*DirSize
+	req := &couchdb.AllDocsRequest{Keys: ids}
+	if err := couchdb.GetAllDocs(db, consts.FilesSizes, req, &list); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return sizes, nil
+		}
+		return nil, err
+	}
+	for _, s := range list {
+		// The missing documents are null in the response
+		if s != nil {
+			sizes[s.DocID] = s
+		}
+	}
+	return sizes, nil
+}
+
+// RecomputeDirSizes computes the aggregates of all the directories from
+// their content, and saves those that have drifted. It returns the number of
+// directories whose aggregates have been fixed.
+func RecomputeDirSizes(fs Indexer, db prefixer.Prefixer) (int, error) {
+	tree, err := fs.BuildTree()
+	if err != nil {
+		return 0, err
+	}
+	computed := make(map[string]*DirSize, len(tree.DirsMap))
+	aggregateDirSizes(tree.Root, computed)
+
+	existing := make(map[string]*DirSize)
+	err = couchdb.ForeachDocs(db, consts.FilesSizes, func(_ string, data json.RawMessage) error {
+		var s DirSize
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		existing[s.DocID] = &s
+		return nil
+	})
+	if couchdb.IsNoDatabaseError(err) {
+		err = couchdb.CreateDB(db, consts.FilesSizes)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var docs, olddocs []interface{}
+	now := time.Now().UTC()
+	for id, s := range computed {
+		old, ok := existing[id]
+		if ok && old.Size == s.Size && old.FilesCount == s.FilesCount {
+			continue
+		}
+		s.UpdatedAt = now
+		if ok {
+			s.SetRev(old.Rev())
+			olddocs = append(olddocs, old)
+		} else {
+			olddocs = append(olddocs, nil)
+		}
+		docs = append(docs, s)
+	}
+	for start := 0; start < len(docs); start += dirSizesBatch {
+		end := start + dirSizesBatch
+		if end > len(docs) {
+			end = len(docs)
+		}
+		if err = couchdb.BulkUpdateDocs(db, consts.FilesSizes, docs[start:end], olddocs[start:end]); err != nil {
+			return 0, err
+		}
+	}
+
+	// The aggregates of the directories that no longer exist are removed
+	var orphans []couchdb.Doc
+	for id, s := range existing {
+		if _, ok := computed[id]; !ok {
+			orphans = append(orphans, s)
+		}
+	}
+	if err = couchdb.BulkDeleteDocs(db, consts.FilesSizes, orphans); err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+// aggregateDirSizes computes the aggregates of a directory and of its
+// sub-directories.
+func aggregateDirSizes(dir *TreeFile, computed map[string]*DirSize) *DirSize {
+	s := &DirSize{DocID: dir.DocID}
+	for _, child := range dir.FilesChildren {
+		s.Size += sizeInDir(child.AsFile())
+		s.FilesCount++
+	}
+	for _, child := range dir.DirsChildren {
+		sub := aggregateDirSizes(child, computed)
+		s.Size += sub.Size
+		s.FilesCount += sub.FilesCount
+	}
+	computed[dir.DocID] = s
+	return s
+}
+
+// sizeInDir returns the size of a file for the aggregates of its directories.
+// A file can be created with an unknown size, which is set at the end of the
+// upload.
+func sizeInDir(doc *FileDoc) int64 {
+	if doc.ByteSize < 0 {
+		return 0
+	}
+	return doc.ByteSize
+}
+
+// initDirSize creates the aggregates of a new directory.
+func (c *couchdbIndexer) initDirSize(dirID string) {
+	s := &DirSize{DocID: dirID, UpdatedAt: time.Now().UTC()}
+	if err := couchdb.CreateNamedDocWithDB(c.db, s); err != nil && !couchdb.IsConflictError(err) {
+		c.dirSizeError(dirID, err)
+	}
+}
+
+// addToDirSizes adds a size and a number of files to the aggregates of a
+// directory and of its ancestors.
+func (c *couchdbIndexer) addToDirSizes(dirID string, size, count int64) {
+	if size == 0 && count == 0 {
+		return
+	}
+	ids, err := c.dirAndAncestors(dirID)
+	if err != nil {
+		c.dirSizeError(dirID, err)
+		return
+	}
+	sizes, err := GetDirSizes(c.db, ids)
+	if err != nil {
+		c.dirSizeError(dirID, err)
+		return
+	}
+	for _, id := range ids {
+		// The unknown aggregates are left as is, until they are recomputed
+		if s, ok := sizes[id]; ok {
+			if err := c.updateDirSize(s, size, count); err != nil {
+				c.dirSizeError(id, err)
+			}
+		}
+	}
+}
+
+// updateDirSize adds a size and a number of files to the aggregates of a
+// directory. When the document has been updated concurrently, the new
+// revision is fetched and the update is retried.
+func (c *couchdbIndexer) updateDirSize(s *DirSize, size, count int64) error {
+	for i := 1; ; i++ {
+		s.Size += size
+		s.FilesCount += count
+		s.UpdatedAt = time.Now().UTC()
+		err := couchdb.UpdateDoc(c.db, s)
+		if err == nil || !couchdb.IsConflictError(err) || i == maxDirSizeRetries {
+			return err
+		}
+		id := s.DocID
+		s = &DirSize{}
+		if err = couchdb.GetDoc(c.db, consts.FilesSizes, id, s); err != nil {
+			return err
+		}
+	}
+}
+
+// moveDirSize moves the aggregates of a directory from its old parent to its
+// new one.
+func (c *couchdbIndexer) moveDirSize(dirID, oldParentID, newParentID string) {
+	sizes, err := GetDirSizes(c.db, []string{dirID})
+	if err != nil {
+		c.dirSizeError(dirID, err)
+		return
+	}
+	if s, ok := sizes[dirID]; ok {
+		c.addToDirSizes(oldParentID, -s.Size, -s.FilesCount)
+		c.addToDirSizes(newParentID, s.Size, s.FilesCount)
+	}
+}
+
+// deleteDirSizes removes the aggregates of some deleted directories.
+func (c *couchdbIndexer) deleteDirSizes(ids []string) {
+	sizes, err := GetDirSizes(c.db, ids)
+	if err == nil {
+		docs := make([]couchdb.Doc, 0, len(sizes))
+		for _, s := range sizes {
+			docs = append(docs, s)
+		}
+		err = couchdb.BulkDeleteDocs(c.db, consts.FilesSizes, docs)
+	}
+	if err != nil {
+		c.dirSizeError(ids[0], err)
+	}
+}
+
+// dirAndAncestors returns the identifiers of a directory and of its
+// ancestors, up to the root.
+func (c *couchdbIndexer) dirAndAncestors(dirID string) ([]string, error) {
+	var ids []string
+	for dirID != "" && len(ids) < maxDirDepth {
+		ids = append(ids, dirID)
+		if dirID == consts.RootDirID {
+			break
+		}
+		dir, err := c.DirByID(dirID)
+		if err != nil {
+			return nil, err
+		}
+		dirID = dir.DirID
+	}
+	return ids, nil
+}
+
+func (c *couchdbIndexer) dirSizeError(dirID string, err error) {
+	logger.WithDomain(c.db.DomainName()).WithField("nspace", "vfs").
+		Infof("Cannot update the aggregates of the directory %s: %s", dirID, err)
+}
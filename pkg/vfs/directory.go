@@ -36,6 +36,13 @@ type DirDoc struct {
 	// DirDoc is the base of the DirOrFile struct.
 	Fullpath string `json:"path,omitempty"`
 
+	// Encrypted is true for the directories that are encrypted end-to-end by
+	// the clients, and for their content.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// Favorite is true for the directories marked as favorites by the user.
+	Favorite bool `json:"favorite,omitempty"`
+
 	ReferencedBy []couchdb.DocReference `json:"referenced_by,omitempty"`
 }
 
@@ -134,6 +141,7 @@ func NewDirDoc(index Indexer, name, dirID string, tags []string) (*DirDoc, error
 	}
 
 	var dirPath string
+	var encrypted bool
 	if dirID == consts.RootDirID {
 		dirPath = "/"
 	} else {
@@ -142,9 +150,15 @@ func NewDirDoc(index Indexer, name, dirID string, tags []string) (*DirDoc, error
 			return nil, err
 		}
 		dirPath = parent.Fullpath
+		encrypted = parent.Encrypted
 	}
 
-	return NewDirDocWithPath(name, dirID, dirPath, tags)
+	doc, err := NewDirDocWithPath(name, dirID, dirPath, tags)
+	if err != nil {
+		return nil, err
+	}
+	doc.Encrypted = encrypted
+	return doc, nil
 }
 
 // NewDirDocWithParent returns an instance of DirDoc from a parent document.
@@ -164,6 +178,7 @@ func NewDirDocWithParent(name string, parent *DirDoc, tags []string) (*DirDoc, e
 		UpdatedAt: createDate,
 		Tags:      uniqueTags(tags),
 		Fullpath:  path.Join(parent.Fullpath, name),
+		Encrypted: parent.Encrypted,
 	}, nil
 }
 
@@ -211,6 +226,9 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 
 	var newdoc *DirDoc
 	if *patch.DirID != olddoc.DirID {
+		if err = checkEncryptedMove(fs, olddoc.Encrypted, olddoc.DirID, *patch.DirID); err != nil {
+			return nil, err
+		}
 		newdoc, err = NewDirDoc(fs, *patch.Name, *patch.DirID, *patch.Tags)
 	} else {
 		newdoc, err = NewDirDocWithPath(*patch.Name, olddoc.DirID, path.Dir(olddoc.Fullpath), *patch.Tags)
@@ -222,7 +240,12 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 	newdoc.RestorePath = *patch.RestorePath
 	newdoc.CreatedAt = cdate
 	newdoc.UpdatedAt = *patch.UpdatedAt
+	newdoc.Encrypted = olddoc.Encrypted
 	newdoc.ReferencedBy = olddoc.ReferencedBy
+	newdoc.Favorite = olddoc.Favorite
+	if patch.Favorite != nil {
+		newdoc.Favorite = *patch.Favorite
+	}
 
 	if err = fs.UpdateDirDoc(olddoc, newdoc); err != nil {
 		return nil, err
@@ -18,11 +18,28 @@ type DownloadStore interface {
 	AddArchive(db prefixer.Prefixer, archive *Archive) (string, error)
 	GetFile(db prefixer.Prefixer, key string) (string, error)
 	GetArchive(db prefixer.Prefixer, key string) (*Archive, error)
+	AddSharedFile(db prefixer.Prefixer, file *SharedFile) (string, error)
+	GetSharedFile(db prefixer.Prefixer, key string) (*SharedFile, error)
+}
+
+// SharedFile is a file that can be downloaded by a visitor of a share by
+// link. The secret is bound to the permission of the link and to a hash of
+// the sharecode used by the visitor, so that it can be revoked when this
+// sharecode is changed.
+type SharedFile struct {
+	Path         string `json:"path"`
+	PermissionID string `json:"permission_id"`
+	CodeHash     string `json:"code_hash"`
 }
 
 // downloadStoreTTL is the time an Archive stay alive
 var downloadStoreTTL = 1 * time.Hour
 
+// sharedDownloadTTL is the time a secret for a share by link stay alive. It
+// is shorter than for the other downloads, as these secrets are given to
+// anonymous visitors.
+var sharedDownloadTTL = 10 * time.Minute
+
 // downloadStoreCleanInterval is the time interval between each download
 // cleanup.
 var downloadStoreCleanInterval = 1 * time.Hour
@@ -133,6 +150,36 @@ func (s *memStore) GetArchive(db prefixer.Prefixer, key string) (*Archive, error
 	return a, nil
 }
 
+func (s *memStore) AddSharedFile(db prefixer.Prefixer, file *SharedFile) (string, error) {
+	key := makeSecret()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vals[db.DBPrefix()+":"+key] = &memRef{
+		val: file,
+		exp: time.Now().Add(sharedDownloadTTL),
+	}
+	return key, nil
+}
+
+func (s *memStore) GetSharedFile(db prefixer.Prefixer, key string) (*SharedFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key = db.DBPrefix() + ":" + key
+	ref, ok := s.vals[key]
+	if !ok {
+		return nil, nil
+	}
+	if time.Now().After(ref.exp) {
+		delete(s.vals, key)
+		return nil, nil
+	}
+	f, ok := ref.val.(*SharedFile)
+	if !ok {
+		return nil, nil
+	}
+	return f, nil
+}
+
 type redisStore struct {
 	c redis.UniversalClient
 }
@@ -183,6 +230,33 @@ func (s *redisStore) GetArchive(db prefixer.Prefixer, key string) (*Archive, err
 	return arch, nil
 }
 
+func (s *redisStore) AddSharedFile(db prefixer.Prefixer, file *SharedFile) (string, error) {
+	v, err := json.Marshal(file)
+	if err != nil {
+		return "", err
+	}
+	key := makeSecret()
+	if err = s.c.Set(db.DBPrefix()+":shared:"+key, v, sharedDownloadTTL).Err(); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (s *redisStore) GetSharedFile(db prefixer.Prefixer, key string) (*SharedFile, error) {
+	b, err := s.c.Get(db.DBPrefix() + ":shared:" + key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file := &SharedFile{}
+	if err = json.Unmarshal(b, file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
 func makeSecret() string {
 	return hex.EncodeToString(crypto.GenerateRandomBytes(8))
 }
@@ -54,6 +54,40 @@ func TestDownloadStoreInMemory(t *testing.T) {
 	assert.Nil(t, a3, "no expiration")
 }
 
+func TestSharedFileInMemory(t *testing.T) {
+	sharedDownloadTTL = 100 * time.Millisecond
+
+	dbA := prefixer.NewPrefixer("alice.cozycloud.local", "alice.cozycloud.local")
+	dbB := prefixer.NewPrefixer("bob.cozycloud.local", "bob.cozycloud.local")
+	store := newMemStore()
+
+	shared := &SharedFile{
+		Path:         "/test/shared/photo.jpg",
+		PermissionID: "2f9a4c5e6d",
+		CodeHash:     "6b86b273ff34fce19d6b804eff5a3f57",
+	}
+	key, err := store.AddSharedFile(dbA, shared)
+	assert.NoError(t, err)
+
+	path, err := store.GetFile(dbA, key)
+	assert.NoError(t, err)
+	assert.Zero(t, path, "A shared file is not a normal download")
+
+	f, err := store.GetSharedFile(dbB, key)
+	assert.NoError(t, err)
+	assert.Nil(t, f, "Inter-instances store leaking")
+
+	f, err = store.GetSharedFile(dbA, key)
+	assert.NoError(t, err)
+	assert.Equal(t, shared, f)
+
+	time.Sleep(2 * sharedDownloadTTL)
+
+	f, err = store.GetSharedFile(dbA, key)
+	assert.NoError(t, err)
+	assert.Nil(t, f, "no expiration")
+}
+
 func TestDownloadStoreInRedis(t *testing.T) {
 	downloadStoreTTL = 100 * time.Millisecond
 
@@ -0,0 +1,170 @@
+package vfs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// EncryptedMime is the mime type of the files of the encrypted directories:
+// the stack can't know the real type of their content.
+const EncryptedMime = "application/octet-stream"
+
+// MarkAsEncrypted flags the file as encrypted end-to-end by the clients. Its
+// content is an opaque blob for the stack: the mime type given by the client
+// is not kept, so that no preview is made for the file, and no metadata is
+// extracted from its content.
+func (f *FileDoc) MarkAsEncrypted() {
+	f.Encrypted = true
+	f.Mime, f.Class = ExtractMimeAndClass(EncryptedMime)
+	f.Metadata = nil
+}
+
+// InheritEncryption marks the file as encrypted if its parent directory is
+// encrypted.
+func InheritEncryption(fs Indexer, doc *FileDoc) error {
+	if doc.DirID == consts.RootDirID {
+		return nil
+	}
+	parent, err := fs.DirByID(doc.DirID)
+	if err != nil {
+		return err
+	}
+	if parent.Encrypted {
+		doc.MarkAsEncrypted()
+	}
+	return nil
+}
+
+// checkEncryptedMove returns an error if a file or a directory is moved in
+// or out of an encrypted directory: the stack must not have in an encrypted
+// directory some content that has been sent in clear, and the clients would
+// not be able to decrypt the content moved out of the encrypted directory.
+// An encrypted directory can still be moved between two directories that are
+// not encrypted.
+func checkEncryptedMove(fs Indexer, encrypted bool, oldDirID, newDirID string) error {
+	parent, err := fs.DirByID(newDirID)
+	if err != nil {
+		return err
+	}
+	if parent.Encrypted && !encrypted {
+		return ErrForbiddenDocMove
+	}
+	if !parent.Encrypted && encrypted && oldDirID != consts.TrashDirID {
+		old, err := fs.DirByID(oldDirID)
+		if err != nil {
+			return err
+		}
+		if old.Encrypted {
+			return ErrForbiddenDocMove
+		}
+	}
+	return nil
+}
+
+// KeyEnvelope is the key of an encrypted directory, wrapped by a client for
+// one of the devices that can access the directory (with the public key of
+// this device for example). The stack never sees the key in clear: it only
+// keeps the envelopes, so that the clients can share the key between them.
+type KeyEnvelope struct {
+	DocID      string    `json:"_id,omitempty"`
+	DocRev     string    `json:"_rev,omitempty"`
+	DirID      string    `json:"dir_id"`
+	Recipient  string    `json:"recipient"`
+	PublicKey  string    `json:"public_key,omitempty"`
+	WrappedKey string    `json:"wrapped_key"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ID returns the envelope qualified identifier
+func (e *KeyEnvelope) ID() string { return e.DocID }
+
+// Rev returns the envelope revision
+func (e *KeyEnvelope) Rev() string { return e.DocRev }
+
+// DocType returns the envelope document type
+func (e *KeyEnvelope) DocType() string { return consts.FilesKeyEnvelopes }
+
+// Clone implements couchdb.Doc
+func (e *KeyEnvelope) Clone() couchdb.Doc {
+	cloned := *e
+	return &cloned
+}
+
+// SetID changes the envelope qualified identifier
+func (e *KeyEnvelope) SetID(id string) { e.DocID = id }
+
+// SetRev changes the envelope revision
+func (e *KeyEnvelope) SetRev(rev string) { e.DocRev = rev }
+
+// envelopeID returns the identifier of the envelope of a directory for a
+// recipient. The envelopes of a directory can be listed with a range on the
+// identifiers.
+func envelopeID(dirID, recipient string) string {
+	return dirID + "/" + recipient
+}
+
+// ListKeyEnvelopes returns the envelopes of the key of an encrypted directory.
+func ListKeyEnvelopes(db prefixer.Prefixer, dir *DirDoc) ([]*KeyEnvelope, error) {
+	if !dir.Encrypted {
+		return nil, ErrNotEncrypted
+	}
+	var envelopes []*KeyEnvelope
+	req := &couchdb.AllDocsRequest{
+		StartKey: envelopeID(dir.ID(), ""),
+		EndKey:   envelopeID(dir.ID(), couchdb.MaxString),
+	}
+	err := couchdb.GetAllDocs(db, consts.FilesKeyEnvelopes, req, &envelopes)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	if envelopes == nil {
+		envelopes = []*KeyEnvelope{}
+	}
+	return envelopes, nil
+}
+
+// PutKeyEnvelope creates or updates the envelope of the key of an encrypted
+// directory for a recipient.
+func PutKeyEnvelope(db prefixer.Prefixer, dir *DirDoc, envelope *KeyEnvelope) error {
+	if !dir.Encrypted {
+		return ErrNotEncrypted
+	}
+	recipient := strings.TrimSpace(envelope.Recipient)
+	if recipient == "" || strings.Contains(recipient, "/") || envelope.WrappedKey == "" {
+		return ErrInvalidKeyEnvelope
+	}
+	envelope.DocID = envelopeID(dir.ID(), recipient)
+	envelope.DirID = dir.ID()
+	envelope.Recipient = recipient
+	envelope.UpdatedAt = time.Now().UTC()
+
+	old := &KeyEnvelope{}
+	err := couchdb.GetDoc(db, consts.FilesKeyEnvelopes, envelope.DocID, old)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		envelope.DocRev = ""
+		return couchdb.CreateNamedDocWithDB(db, envelope)
+	}
+	if err != nil {
+		return err
+	}
+	envelope.DocRev = old.DocRev
+	return couchdb.UpdateDoc(db, envelope)
+}
+
+// DeleteKeyEnvelope removes the envelope of the key of an encrypted directory
+// for a recipient, when a device must no longer have access to it.
+func DeleteKeyEnvelope(db prefixer.Prefixer, dir *DirDoc, recipient string) error {
+	if !dir.Encrypted {
+		return ErrNotEncrypted
+	}
+	envelope := &KeyEnvelope{}
+	err := couchdb.GetDoc(db, consts.FilesKeyEnvelopes, envelopeID(dir.ID(), recipient), envelope)
+	if err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(db, envelope)
+}
@@ -1,11 +1,17 @@
 package vfs
 
-import "errors"
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/errcode"
+)
 
 var (
 	// ErrParentDoesNotExist is used when the parent directory does not
 	// exist
-	ErrParentDoesNotExist = errors.New("Parent directory with given DirID does not exist")
+	ErrParentDoesNotExist = errcode.New(errcode.NotFound, http.StatusNotFound,
+		"Parent directory with given DirID does not exist")
 	// ErrForbiddenDocMove is used when trying to move a document in an
 	// illicit destination
 	ErrForbiddenDocMove = errors.New("Forbidden document move")
@@ -16,13 +22,16 @@ var (
 	ErrIllegalTime = errors.New("Invalid time given")
 	// ErrInvalidHash is used when the given hash does not match the
 	// calculated one
-	ErrInvalidHash = errors.New("Invalid hash")
+	ErrInvalidHash = errcode.New(errcode.InvalidHash, http.StatusPreconditionFailed,
+		"Invalid hash")
 	// ErrContentLengthMismatch is used when the content-length does not
 	// match the calculated one
-	ErrContentLengthMismatch = errors.New("Content length does not match")
+	ErrContentLengthMismatch = errcode.New(errcode.LengthMismatch, http.StatusPreconditionFailed,
+		"Content length does not match")
 	// ErrConflict is used when the access to a file or directory is in
 	// conflict with another
-	ErrConflict = errors.New("Conflict access to same file or directory")
+	ErrConflict = errcode.New(errcode.Conflict, http.StatusConflict,
+		"Conflict access to same file or directory")
 	// ErrFileInTrash is used when the file is already in the trash
 	ErrFileInTrash = errors.New("File or directory is already in the trash")
 	// ErrFileNotInTrash is used when the file is not in the trash
@@ -39,5 +48,15 @@ var (
 	// ErrWrongCouchdbState is given when couchdb gives us an unexpected value
 	ErrWrongCouchdbState = errors.New("Wrong couchdb reduce value")
 	// ErrFileTooBig is used when there is no more space left on the filesystem
-	ErrFileTooBig = errors.New("The file is too big and exceeds the disk quota")
+	ErrFileTooBig = errcode.New(errcode.QuotaExceeded, http.StatusRequestEntityTooLarge,
+		"The file is too big and exceeds the disk quota")
+	// ErrNotEncrypted is used when an operation is only possible on an
+	// encrypted directory
+	ErrNotEncrypted = errors.New("The directory is not encrypted")
+	// ErrInvalidKeyEnvelope is used when the envelope of the key of an
+	// encrypted directory has no recipient or no wrapped key
+	ErrInvalidKeyEnvelope = errors.New("The key envelope is invalid")
+	// ErrFsckNotRepairable is used when an inconsistency reported by the fsck
+	// can't be repaired automatically
+	ErrFsckNotRepairable = errors.New("The inconsistency can't be repaired automatically")
 )
@@ -43,6 +43,13 @@ type FileDoc struct {
 
 	Metadata Metadata `json:"metadata,omitempty"`
 
+	// Encrypted is true for the files of the directories encrypted end-to-end
+	// by the clients: their content is an opaque blob for the stack.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// Favorite is true for the files marked as favorites by the user.
+	Favorite bool `json:"favorite,omitempty"`
+
 	ReferencedBy []couchdb.DocReference `json:"referenced_by,omitempty"`
 
 	// Cache of the fullpath of the file. Should not have to be invalidated
@@ -256,12 +263,20 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	newname := *patch.Name
 	oldname := olddoc.DocName
 	var mime, class string
-	if patch.Class != nil || (rename && path.Ext(newname) != path.Ext(oldname)) {
+	if olddoc.Encrypted {
+		mime, class = olddoc.Mime, olddoc.Class
+	} else if patch.Class != nil || (rename && path.Ext(newname) != path.Ext(oldname)) {
 		mime, class = ExtractMimeAndClassFromFilename(newname)
 	} else {
 		mime, class = olddoc.Mime, olddoc.Class
 	}
 
+	if *patch.DirID != olddoc.DirID {
+		if err = checkEncryptedMove(fs, olddoc.Encrypted, olddoc.DirID, *patch.DirID); err != nil {
+			return nil, err
+		}
+	}
+
 	newdoc, err := NewFileDoc(
 		newname,
 		*patch.DirID,
@@ -281,7 +296,12 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	newdoc.RestorePath = *patch.RestorePath
 	newdoc.UpdatedAt = *patch.UpdatedAt
 	newdoc.Metadata = olddoc.Metadata
+	newdoc.Encrypted = olddoc.Encrypted
 	newdoc.ReferencedBy = olddoc.ReferencedBy
+	newdoc.Favorite = olddoc.Favorite
+	if patch.Favorite != nil {
+		newdoc.Favorite = *patch.Favorite
+	}
 
 	if patch.MD5Sum != nil {
 		newdoc.MD5Sum = *patch.MD5Sum
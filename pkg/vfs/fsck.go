@@ -36,6 +36,8 @@ type FsckLog struct {
 	IsFile           bool                 `json:"is_file"`
 	ContentMismatch  *FsckContentMismatch `json:"content_mismatch,omitempty"`
 	ExpectedFullpath string               `json:"expected_fullpath,omitempty"`
+	Repaired         bool                 `json:"repaired,omitempty"`
+	RepairError      string               `json:"repair_error,omitempty"`
 }
 
 // String returns a string describing the FsckLog
@@ -0,0 +1,146 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// Repair tries to fix an inconsistency reported by Fsck or
+// CheckIndexIntegrity. The content of the storage is considered as the
+// reference, and only the index is changed:
+//
+//   - a file whose content is missing is removed from the index
+//   - a file whose content does not match has its size and checksum updated
+//   - a content that is not indexed is added to the index, in its directory
+//     or in the orphans directory
+//   - an orphan file or directory is moved to the orphans directory
+//   - a directory with a bad path gets the path of its position in the tree.
+//
+// ErrFsckNotRepairable is returned for the other inconsistencies.
+func Repair(fs VFS, index Indexer, log *FsckLog) error {
+	switch log.Type {
+	case FileMissing:
+		if !log.IsFile {
+			return ErrFsckNotRepairable
+		}
+		return index.DeleteFileDoc(treeFileToFileDoc(log.FileDoc))
+
+	case ContentMismatch:
+		olddoc := treeFileToFileDoc(log.FileDoc)
+		newdoc := olddoc.Clone().(*FileDoc)
+		newdoc.ByteSize = log.ContentMismatch.SizeFile
+		newdoc.MD5Sum = log.ContentMismatch.MD5SumFile
+		return index.UpdateFileDoc(olddoc, newdoc)
+
+	case IndexMissing:
+		return repairIndexMissing(fs, index, log.FileDoc)
+
+	case IndexOrphanTree:
+		orphans, err := orphansDir(fs, index)
+		if err != nil {
+			return err
+		}
+		if log.IsFile {
+			olddoc := treeFileToFileDoc(log.FileDoc)
+			newdoc := olddoc.Clone().(*FileDoc)
+			newdoc.DirID = orphans.DocID
+			newdoc.DocName, err = orphanName(index, orphans, olddoc.DocName, olddoc.DocID)
+			if err != nil {
+				return err
+			}
+			// The path of an orphan file can't be computed from its parent.
+			newdoc.fullpath = path.Join(orphans.Fullpath, newdoc.DocName)
+			olddoc.fullpath = newdoc.fullpath
+			return index.UpdateFileDoc(olddoc, newdoc)
+		}
+		olddoc := log.DirDoc.AsDir()
+		newdoc := olddoc.Clone().(*DirDoc)
+		newdoc.DirID = orphans.DocID
+		newdoc.DocName, err = orphanName(index, orphans, olddoc.DocName, olddoc.DocID)
+		if err != nil {
+			return err
+		}
+		newdoc.Fullpath = path.Join(orphans.Fullpath, newdoc.DocName)
+		return index.UpdateDirDoc(olddoc, newdoc)
+
+	case IndexBadFullpath:
+		olddoc := log.DirDoc.AsDir()
+		newdoc := olddoc.Clone().(*DirDoc)
+		newdoc.Fullpath = log.ExpectedFullpath
+		return index.UpdateDirDoc(olddoc, newdoc)
+	}
+	return ErrFsckNotRepairable
+}
+
+func repairIndexMissing(fs VFS, index Indexer, doc *TreeFile) error {
+	parentPath := path.Dir(doc.Fullpath)
+	var parent *DirDoc
+	var err error
+	if parentPath == OrphansDirName {
+		parent, err = orphansDir(fs, index)
+	} else {
+		parent, err = index.DirByPath(parentPath)
+	}
+	if os.IsNotExist(err) {
+		return ErrFsckNotRepairable
+	}
+	if err != nil {
+		return err
+	}
+	name, err := orphanName(index, parent, doc.DocName, doc.DocID)
+	if err != nil {
+		return err
+	}
+
+	if doc.Type == consts.DirType {
+		dir, err := NewDirDocWithParent(name, parent, nil)
+		if err != nil {
+			return err
+		}
+		dir.CreatedAt = doc.CreatedAt
+		dir.UpdatedAt = doc.UpdatedAt
+		return index.CreateDirDoc(dir)
+	}
+
+	file := treeFileToFileDoc(doc)
+	file.DocRev = ""
+	file.DocName = name
+	file.DirID = parent.DocID
+	file.fullpath = path.Join(parent.Fullpath, name)
+	file.Trashed = strings.HasPrefix(file.fullpath, TrashDirName)
+	// The content of the storage can be identified by the identifier of the
+	// document, so it must be kept when it is known.
+	if file.DocID != "" {
+		return index.CreateNamedFileDoc(file)
+	}
+	return index.CreateFileDoc(file)
+}
+
+// orphansDir returns the directory where the orphan files and directories are
+// moved, and creates it if it does not exist yet.
+func orphansDir(fs VFS, index Indexer) (*DirDoc, error) {
+	dir, err := index.DirByPath(OrphansDirName)
+	if os.IsNotExist(err) {
+		return Mkdir(fs, OrphansDirName, nil)
+	}
+	return dir, err
+}
+
+// orphanName returns the name for a document added to a directory by a
+// repair: its name if it is free, or else its name with its identifier.
+func orphanName(index Indexer, parent *DirDoc, name, id string) (string, error) {
+	exists, err := index.DirChildExists(parent.DocID, name)
+	if err != nil || !exists {
+		return name, err
+	}
+	return name + " " + id, nil
+}
+
+func treeFileToFileDoc(t *TreeFile) *FileDoc {
+	doc := t.AsFile()
+	doc.fullpath = t.Fullpath
+	return doc
+}
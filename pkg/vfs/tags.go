@@ -0,0 +1,122 @@
+package vfs
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// tagsBatchSize is the number of documents updated at once when the tags are
+// replaced.
+const tagsBatchSize = 100
+
+// TagCount is a tag used on the files and directories, with the number of
+// documents that have it.
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// ListTags returns the tags used on the files and directories, sorted by
+// name, with their usage counts.
+func ListTags(db prefixer.Prefixer) ([]TagCount, error) {
+	req := &couchdb.ViewRequest{Reduce: true, Group: true}
+	var res couchdb.ViewResponse
+	if err := couchdb.ExecView(db, consts.FilesByTagView, req, &res); err != nil {
+		return nil, err
+	}
+	tags := make([]TagCount, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		name, ok := row.Key.(string)
+		if !ok {
+			continue
+		}
+		count, _ := row.Value.(float64)
+		tags = append(tags, TagCount{Name: name, Count: int(count)})
+	}
+	return tags, nil
+}
+
+// ReplaceTags removes the given tags from all the files and directories, and
+// adds the into tag to the documents that had one of them. It can be used to
+// rename a tag, to merge several tags in one, or to delete a tag when into is
+// empty. It returns the number of updated documents.
+func ReplaceTags(fs VFS, tags []string, into string) (int, error) {
+	removed := make(map[string]struct{})
+	for _, tag := range uniqueTags(tags) {
+		if tag != into {
+			removed[tag] = struct{}{}
+		}
+	}
+
+	updated := 0
+	for tag := range removed {
+		// The updated documents are no longer emitted for the tag by the view,
+		// so the first page is fetched again until only the documents that
+		// could not be updated remain.
+		skip := 0
+		for {
+			req := &couchdb.ViewRequest{
+				Key:         tag,
+				IncludeDocs: true,
+				Limit:       tagsBatchSize,
+				Skip:        skip,
+			}
+			var res couchdb.ViewResponse
+			if err := couchdb.ExecView(fs, consts.FilesByTagView, req, &res); err != nil {
+				return updated, err
+			}
+			for _, row := range res.Rows {
+				var doc DirOrFileDoc
+				if err := json.Unmarshal(row.Doc, &doc); err != nil {
+					return updated, err
+				}
+				if err := replaceDocTags(fs, &doc, removed, into); err != nil {
+					if !couchdb.IsConflictError(err) {
+						return updated, err
+					}
+					skip++
+					continue
+				}
+				updated++
+			}
+			if len(res.Rows) < tagsBatchSize {
+				break
+			}
+		}
+	}
+	return updated, nil
+}
+
+func replaceDocTags(fs VFS, doc *DirOrFileDoc, removed map[string]struct{}, into string) error {
+	dir, file := doc.Refine()
+	if dir != nil {
+		newdir := dir.Clone().(*DirDoc)
+		newdir.Tags = replaceTags(dir.Tags, removed, into)
+		newdir.UpdatedAt = time.Now()
+		return fs.UpdateDirDoc(dir, newdir)
+	}
+	newfile := file.Clone().(*FileDoc)
+	newfile.Tags = replaceTags(file.Tags, removed, into)
+	newfile.UpdatedAt = time.Now()
+	return fs.UpdateFileDoc(file, newfile)
+}
+
+func replaceTags(tags []string, removed map[string]struct{}, into string) []string {
+	replaced := make([]string, 0, len(tags)+1)
+	found := false
+	for _, tag := range tags {
+		if _, ok := removed[tag]; ok {
+			found = true
+			continue
+		}
+		replaced = append(replaced, tag)
+	}
+	if found && into != "" {
+		replaced = append(replaced, into)
+	}
+	return uniqueTags(replaced)
+}
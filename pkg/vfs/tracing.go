@@ -0,0 +1,94 @@
+package vfs
+
+import (
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedVFS is a VFS that creates spans for the operations on the storage
+// backend, children of the span of the context carried by the prefixer (the
+// instance).
+type tracedVFS struct {
+	VFS
+	db prefixer.Prefixer
+}
+
+// Traced returns a VFS with spans for the operations on the storage backend.
+func Traced(fs VFS, db prefixer.Prefixer) VFS {
+	return &tracedVFS{VFS: fs, db: db}
+}
+
+func (t *tracedVFS) start(name string) trace.Span {
+	_, span := tracing.Start(tracing.ContextOf(t.db), "vfs "+name,
+		attribute.String("domain", t.db.DomainName()))
+	return span
+}
+
+func (t *tracedVFS) UseSharingIndexer(index Indexer) VFS {
+	return Traced(t.VFS.UseSharingIndexer(index), t.db)
+}
+
+func (t *tracedVFS) CreateDir(doc *DirDoc) error {
+	span := t.start("CreateDir")
+	err := t.VFS.CreateDir(doc)
+	tracing.End(span, err)
+	return err
+}
+
+func (t *tracedVFS) CreateFile(newdoc, olddoc *FileDoc) (File, error) {
+	span := t.start("CreateFile")
+	span.SetAttributes(attribute.Int64("file.size", newdoc.ByteSize))
+	file, err := t.VFS.CreateFile(newdoc, olddoc)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	return &tracedFile{File: file, span: span}, nil
+}
+
+func (t *tracedVFS) OpenFile(doc *FileDoc) (File, error) {
+	span := t.start("OpenFile")
+	span.SetAttributes(attribute.Int64("file.size", doc.ByteSize))
+	file, err := t.VFS.OpenFile(doc)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	return &tracedFile{File: file, span: span}, nil
+}
+
+func (t *tracedVFS) DestroyFile(doc *FileDoc) error {
+	span := t.start("DestroyFile")
+	err := t.VFS.DestroyFile(doc)
+	tracing.End(span, err)
+	return err
+}
+
+func (t *tracedVFS) DestroyDirContent(doc *DirDoc) error {
+	span := t.start("DestroyDirContent")
+	err := t.VFS.DestroyDirContent(doc)
+	tracing.End(span, err)
+	return err
+}
+
+func (t *tracedVFS) DestroyDirAndContent(doc *DirDoc) error {
+	span := t.start("DestroyDirAndContent")
+	err := t.VFS.DestroyDirAndContent(doc)
+	tracing.End(span, err)
+	return err
+}
+
+// tracedFile is a file opened or created on a traced VFS: its span ends when
+// the file is closed, as the content is read or written between.
+type tracedFile struct {
+	File
+	span trace.Span
+}
+
+func (f *tracedFile) Close() error {
+	err := f.File.Close()
+	tracing.End(f.span, err)
+	return err
+}
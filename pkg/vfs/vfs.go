@@ -31,6 +31,12 @@ const (
 	TrashDirName = "/.cozy_trash"
 	// ThumbsDirName is the path of the directory for thumbnails
 	ThumbsDirName = "/.thumbs"
+	// StreamsDirName is the path of the directory for the videos transcoded
+	// for streaming
+	StreamsDirName = "/.streams"
+	// StagingDirName is the path of the directory for the content of the
+	// uploads that have not yet been committed
+	StagingDirName = "/.staging"
 	// WebappsDirName is the path of the directory in which apps are stored
 	WebappsDirName = "/.cozy_apps"
 	// KonnectorsDirName is the path of the directory in which konnectors source
@@ -207,6 +213,28 @@ type ThumbFiler interface {
 	Commit() error
 }
 
+// Streamer defines an interface for the filesystem where the videos are
+// stored after their transcoding for streaming: the HLS playlists and their
+// segments. The files are tied to the md5sum of the video, so that the files
+// of a previous version of a video are never served.
+type Streamer interface {
+	StreamFileExists(video *FileDoc, name string) (ok bool, err error)
+	CreateStreamFile(video *FileDoc, name string) (ThumbFiler, error)
+	RemoveStreams(video *FileDoc) error
+	ServeStreamContent(w http.ResponseWriter, req *http.Request,
+		video *FileDoc, name string) error
+}
+
+// Stager defines an interface for the staging area of the uploads in two
+// phases: the content is first uploaded in this area, where it is validated,
+// and it is then copied in the VFS when the upload is committed. The staged
+// files are identified by the ID of their upload.
+type Stager interface {
+	CreateStagedFile(uploadID string) (ThumbFiler, error)
+	OpenStagedFile(uploadID string) (io.ReadCloser, error)
+	RemoveStagedFile(uploadID string) error
+}
+
 // VFS is composed of the Indexer and Fs interface. It is the common interface
 // used throughout the stack to access the VFS.
 type VFS interface {
@@ -247,6 +275,7 @@ type DocPatch struct {
 	Executable  *bool      `json:"executable,omitempty"`
 	MD5Sum      *[]byte    `json:"md5sum,omitempty"`
 	Class       *string    `json:"class,omitempty"`
+	Favorite    *bool      `json:"favorite,omitempty"`
 }
 
 // DirOrFileDoc is a union struct of FileDoc and DirDoc. It is useful to
@@ -293,6 +322,8 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			Trashed:      fd.Trashed,
 			Tags:         fd.Tags,
 			Metadata:     fd.Metadata,
+			Encrypted:    fd.Encrypted,
+			Favorite:     fd.Favorite,
 			ReferencedBy: fd.ReferencedBy,
 		}
 	}
@@ -658,19 +689,20 @@ func ExtractMimeAndClassFromFilename(name string) (mime, class string) {
 	return ExtractMimeAndClass(mimetype.TypeByExtension(ext))
 }
 
-var cbDiskQuotaAlert func(domain string, exceeded bool)
+var cbDiskQuotaAlert []func(domain string, exceeded bool)
 
 // RegisterDiskQuotaAlertCallback allows to register a callback function called
-// when the instance reaches, a fall behind, 90% of its quota capacity.
+// when the instance reaches, a fall behind, 90% of its quota capacity. Several
+// callbacks can be registered.
 func RegisterDiskQuotaAlertCallback(cb func(domain string, exceeded bool)) {
-	cbDiskQuotaAlert = cb
+	cbDiskQuotaAlert = append(cbDiskQuotaAlert, cb)
 }
 
 // PushDiskQuotaAlert can be used to notify when the VFS reaches, or fall
 // behind, its quota alert of 90% of its total capacity.
 func PushDiskQuotaAlert(fs VFS, exceeded bool) {
-	if cbDiskQuotaAlert != nil {
-		cbDiskQuotaAlert(fs.DomainName(), exceeded)
+	for _, cb := range cbDiskQuotaAlert {
+		cb(fs.DomainName(), exceeded)
 	}
 }
 
@@ -764,6 +764,118 @@ func TestCreateFileTooBig(t *testing.T) {
 	assert.NoError(t, fs.DestroyDirContent(root))
 }
 
+func TestFsckRepair(t *testing.T) {
+	index := vfs.NewCouchdbIndexer(fs)
+	dir, err := vfs.Mkdir(fs, "/fsck-repair", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Break the path of the directory in the index
+	broken := dir.Clone().(*vfs.DirDoc)
+	broken.Fullpath = "/fsck-broken"
+	if !assert.NoError(t, couchdb.UpdateDoc(fs, broken)) {
+		return
+	}
+
+	var found *vfs.FsckLog
+	err = fs.CheckIndexIntegrity(func(log *vfs.FsckLog) {
+		if log.Type == vfs.IndexBadFullpath && log.DirDoc.DocID == dir.DocID {
+			found = log
+		}
+	})
+	assert.NoError(t, err)
+	if !assert.NotNil(t, found) {
+		return
+	}
+	assert.Equal(t, "/fsck-repair", found.ExpectedFullpath)
+	assert.NoError(t, vfs.Repair(fs, index, found))
+
+	fixed, err := fs.DirByID(dir.DocID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/fsck-repair", fixed.Fullpath)
+
+	err = vfs.Repair(fs, index, &vfs.FsckLog{Type: vfs.TypeMismatch})
+	assert.Equal(t, vfs.ErrFsckNotRepairable, err)
+
+	assert.NoError(t, fs.DestroyDirAndContent(fixed))
+}
+
+func TestDirSizes(t *testing.T) {
+	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
+	checkSize := func(dirID string, size, count int64) {
+		sizes, err := vfs.GetDirSizes(db, []string{dirID})
+		if assert.NoError(t, err) && assert.Contains(t, sizes, dirID) {
+			assert.Equal(t, size, sizes[dirID].Size)
+			assert.Equal(t, count, sizes[dirID].FilesCount)
+		}
+	}
+	createFile := func(name, dirID, content string) *vfs.FileDoc {
+		doc, err := vfs.NewFileDoc(name, dirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+		assert.NoError(t, err)
+		file, err := fs.CreateFile(doc, nil)
+		assert.NoError(t, err)
+		_, err = file.Write([]byte(content))
+		assert.NoError(t, err)
+		assert.NoError(t, file.Close())
+		return doc
+	}
+
+	dir, err := vfs.Mkdir(fs, "/dirsizes", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	sub, err := vfs.Mkdir(fs, "/dirsizes/sub", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	checkSize(dir.ID(), 0, 0)
+
+	fileA := createFile("a", sub.ID(), "hello")
+	checkSize(sub.ID(), 5, 1)
+	checkSize(dir.ID(), 5, 1)
+	fileB := createFile("b", dir.ID(), "foo")
+	checkSize(sub.ID(), 5, 1)
+	checkSize(dir.ID(), 8, 2)
+
+	fileA, err = fs.FileByID(fileA.ID())
+	assert.NoError(t, err)
+	moved := fileA.Clone().(*vfs.FileDoc)
+	moved.DirID = dir.ID()
+	assert.NoError(t, fs.UpdateFileDoc(fileA, moved))
+	checkSize(sub.ID(), 0, 0)
+	checkSize(dir.ID(), 8, 2)
+
+	other, err := vfs.Mkdir(fs, "/dirsizes-other", nil)
+	assert.NoError(t, err)
+	createFile("c", sub.ID(), "bar")
+	sub, err = fs.DirByID(sub.ID())
+	assert.NoError(t, err)
+	_, err = vfs.ModifyDirMetadata(fs, sub, &vfs.DocPatch{DirID: &other.DocID})
+	assert.NoError(t, err)
+	checkSize(dir.ID(), 8, 2)
+	checkSize(other.ID(), 3, 1)
+
+	fileB, err = fs.FileByID(fileB.ID())
+	assert.NoError(t, err)
+	assert.NoError(t, fs.DestroyFile(fileB))
+	checkSize(dir.ID(), 5, 1)
+
+	// The drift of the aggregates is fixed when they are recomputed
+	sizes, err := vfs.GetDirSizes(db, []string{dir.ID()})
+	assert.NoError(t, err)
+	drifted := sizes[dir.ID()]
+	drifted.Size = 42
+	assert.NoError(t, couchdb.UpdateDoc(db, drifted))
+	fixed, err := vfs.RecomputeDirSizes(fs, db)
+	assert.NoError(t, err)
+	assert.True(t, fixed >= 1)
+	checkSize(dir.ID(), 5, 1)
+	checkSize(other.ID(), 3, 1)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -21,6 +21,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/magic"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
 
 	"github.com/cozy/afero"
 )
@@ -51,12 +52,42 @@ type aferoVFS struct {
 // The supported scheme of the storage url are file://, for an OS-FS store, and
 // mem:// for an in-memory store. The backend used is the afero package.
 func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsURL *url.URL, pathSegment string) (vfs.VFS, error) {
+	return NewEncrypted(db, index, disk, mu, fsURL, pathSegment, nil)
+}
+
+// NewEncrypted returns a vfs.VFS like New, but where the content of the files
+// is encrypted at rest with the given data keys. If keys is nil, the files
+// are not encrypted.
+func NewEncrypted(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsURL *url.URL, pathSegment string, keys *vfscrypt.Keys) (vfs.VFS, error) {
+	pth, fs, err := baseFs(db, fsURL, pathSegment)
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		fs = vfscrypt.NewFs(fs, keys)
+	}
+	return &aferoVFS{
+		Indexer:         index,
+		DiskThresholder: disk,
+
+		domain: db.DomainName(),
+		prefix: db.DBPrefix(),
+		fs:     fs,
+		mu:     mu,
+		pth:    pth,
+		// for now, only the file:// scheme needs a specific initialisation of its
+		// root directory.
+		osFS: fsURL.Scheme == "file",
+	}, nil
+}
+
+func baseFs(db prefixer.Prefixer, fsURL *url.URL, pathSegment string) (string, afero.Fs, error) {
 	if fsURL.Scheme != "mem" && fsURL.Path == "" {
-		return nil, fmt.Errorf("vfsafero: please check the supplied fs url: %s",
+		return "", nil, fmt.Errorf("vfsafero: please check the supplied fs url: %s",
 			fsURL.String())
 	}
 	if pathSegment == "" {
-		return nil, fmt.Errorf("vfsafero: specified path segment is empty")
+		return "", nil, fmt.Errorf("vfsafero: specified path segment is empty")
 	}
 	pth := path.Join(fsURL.Path, pathSegment)
 	var fs afero.Fs
@@ -70,21 +101,71 @@ func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu l
 		}
 		fs = val.(afero.Fs)
 	default:
-		return nil, fmt.Errorf("vfsafero: non supported scheme %s", fsURL.Scheme)
+		return "", nil, fmt.Errorf("vfsafero: non supported scheme %s", fsURL.Scheme)
 	}
-	return &aferoVFS{
-		Indexer:         index,
-		DiskThresholder: disk,
+	return pth, fs, nil
+}
 
-		domain: db.DomainName(),
-		prefix: db.DBPrefix(),
-		fs:     fs,
-		mu:     mu,
-		pth:    pth,
-		// for now, only the file:// scheme needs a specific initialisation of its
-		// root directory.
-		osFS: fsURL.Scheme == "file",
-	}, nil
+// Reencrypt encrypts again with the current data key the files of an
+// instance that are not encrypted with it. The applications are not
+// encrypted, as they are served directly from the storage. It returns the
+// number of files that have been rewritten.
+func Reencrypt(db prefixer.Prefixer, mu lock.ErrorRWLocker, fsURL *url.URL, pathSegment string, keys *vfscrypt.Keys) (int, error) {
+	_, fs, err := baseFs(db, fsURL, pathSegment)
+	if err != nil {
+		return 0, err
+	}
+	skip := func(dir string) bool {
+		return dir == vfs.WebappsDirName || dir == vfs.KonnectorsDirName
+	}
+	return vfscrypt.Reencrypt(fs, keys, mu, skip)
+}
+
+// CopyAll copies the whole storage of an instance (the files, the thumbnails
+// and the applications) to the storage of another instance. The content is
+// copied as is: the encrypted files are still encrypted with the same data
+// keys.
+func CopyAll(src, dst prefixer.Prefixer, fsURL *url.URL, srcSegment, dstSegment string) error {
+	_, srcFs, err := baseFs(src, fsURL, srcSegment)
+	if err != nil {
+		return err
+	}
+	_, dstFs, err := baseFs(dst, fsURL, dstSegment)
+	if err != nil {
+		return err
+	}
+	return afero.Walk(srcFs, "/", func(fullpath string, infos os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if infos.IsDir() {
+			return dstFs.MkdirAll(fullpath, infos.Mode().Perm())
+		}
+		if !infos.Mode().IsRegular() {
+			return nil
+		}
+		if err = copyFile(srcFs, dstFs, fullpath, infos); err != nil {
+			return err
+		}
+		return dstFs.Chtimes(fullpath, infos.ModTime(), infos.ModTime())
+	})
+}
+
+func copyFile(srcFs, dstFs afero.Fs, name string, infos os.FileInfo) error {
+	f, err := srcFs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	g, err := dstFs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, infos.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(g, f); err != nil {
+		g.Close()
+		return err
+	}
+	return g.Close()
 }
 
 func (afs *aferoVFS) DomainName() string {
@@ -362,12 +443,19 @@ func (afs *aferoVFS) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
 
 		if fullpath == vfs.WebappsDirName ||
 			fullpath == vfs.KonnectorsDirName ||
-			fullpath == vfs.ThumbsDirName {
+			fullpath == vfs.ThumbsDirName ||
+			fullpath == vfs.StreamsDirName {
 			return filepath.SkipDir
 		}
 
 		f, ok := entries[fullpath]
-		if !ok {
+		if !ok && info.IsDir() {
+			accumulate(&vfs.FsckLog{
+				Type:    vfs.IndexMissing,
+				IsFile:  false,
+				FileDoc: fileInfosToDirDoc(fullpath, info),
+			})
+		} else if !ok {
 			accumulate(&vfs.FsckLog{
 				Type:    vfs.IndexMissing,
 				IsFile:  true,
@@ -456,6 +544,7 @@ func fileInfosToDirDoc(fullpath string, fileinfo os.FileInfo) *vfs.TreeFile {
 				Fullpath:  fullpath,
 			},
 		},
+		IsDir: true,
 	}
 }
 
@@ -0,0 +1,60 @@
+package vfsafero
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// NewStagingFs creates a new filesystem for the staging area of the uploads,
+// based on a afero.Fs.
+func NewStagingFs(fs afero.Fs) vfs.Stager {
+	return &staging{fs}
+}
+
+type staging struct {
+	fs afero.Fs
+}
+
+func (s *staging) CreateStagedFile(uploadID string) (vfs.ThumbFiler, error) {
+	newname := s.makeName(uploadID)
+	dir := path.Dir(newname)
+	if err := s.fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := afero.TempFile(s.fs, dir, "cozy-staging")
+	if err != nil {
+		return nil, err
+	}
+	// Like a thumbnail, the file is written to a temporary file that is
+	// renamed on commit
+	th := &thumb{
+		File:    f,
+		fs:      s.fs,
+		tmpname: f.Name(),
+		newname: newname,
+	}
+	return th, nil
+}
+
+func (s *staging) OpenStagedFile(uploadID string) (io.ReadCloser, error) {
+	return s.fs.Open(s.makeName(uploadID))
+}
+
+func (s *staging) RemoveStagedFile(uploadID string) error {
+	err := s.fs.Remove(s.makeName(uploadID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *staging) makeName(uploadID string) string {
+	if len(uploadID) < 4 {
+		return path.Join("/", uploadID)
+	}
+	return path.Join("/", uploadID[:4], uploadID)
+}
@@ -0,0 +1,86 @@
+package vfsafero
+
+import (
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// NewStreamsFs creates a new filesystem for the streams of the videos, based
+// on a afero.Fs.
+func NewStreamsFs(fs afero.Fs) vfs.Streamer {
+	return &streams{fs}
+}
+
+type streams struct {
+	fs afero.Fs
+}
+
+func (s *streams) CreateStreamFile(video *vfs.FileDoc, name string) (vfs.ThumbFiler, error) {
+	newname := s.makeName(video, name)
+	dir := path.Dir(newname)
+	if err := s.fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := afero.TempFile(s.fs, dir, "cozy-stream")
+	if err != nil {
+		return nil, err
+	}
+	// Like a thumbnail, the file is written to a temporary file that is
+	// renamed on commit
+	th := &thumb{
+		File:    f,
+		fs:      s.fs,
+		tmpname: f.Name(),
+		newname: newname,
+	}
+	return th, nil
+}
+
+func (s *streams) StreamFileExists(video *vfs.FileDoc, name string) (bool, error) {
+	infos, err := s.fs.Stat(s.makeName(video, name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return infos.Size() > 0, nil
+}
+
+func (s *streams) RemoveStreams(video *vfs.FileDoc) error {
+	err := s.fs.RemoveAll(s.videoDir(video))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *streams) ServeStreamContent(w http.ResponseWriter, req *http.Request,
+	video *vfs.FileDoc, name string) error {
+	filename := s.makeName(video, name)
+	infos, err := s.fs.Stat(filename)
+	if err != nil {
+		return err
+	}
+	f, err := s.fs.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	http.ServeContent(w, req, filename, infos.ModTime(), f)
+	return nil
+}
+
+func (s *streams) videoDir(video *vfs.FileDoc) string {
+	return path.Join("/", video.ID()[:4], video.ID())
+}
+
+func (s *streams) makeName(video *vfs.FileDoc, name string) string {
+	md5 := hex.EncodeToString(video.MD5Sum)
+	return path.Join(s.videoDir(video), md5, path.Base(name))
+}
@@ -28,10 +28,17 @@ type thumb struct {
 }
 
 func (t *thumb) Abort() error {
+	t.File.Close() // #nosec
 	return t.fs.Remove(t.tmpname)
 }
 
+// Commit closes the temporary file before renaming it, as the last chunk of
+// an encrypted file is only written on close.
 func (t *thumb) Commit() error {
+	if err := t.File.Close(); err != nil {
+		t.fs.Remove(t.tmpname) // #nosec
+		return err
+	}
 	return t.fs.Rename(t.tmpname, t.newname)
 }
 
@@ -0,0 +1,202 @@
+package vfscrypt
+
+import (
+	"io"
+	"os"
+
+	"github.com/cozy/afero"
+)
+
+// NewFs returns an afero.Fs where the content of the files written is
+// encrypted with the current data key, and decrypted on reading. The files
+// that have been written before the encryption was enabled are still
+// readable as is.
+//
+// The content of an encrypted file can't be modified in place: the files
+// opened for writing are always truncated, and can't be read.
+func NewFs(fs afero.Fs, keys *Keys) afero.Fs {
+	return &encryptedFs{Fs: fs, keys: keys}
+}
+
+type encryptedFs struct {
+	afero.Fs
+	keys *Keys
+}
+
+func (e *encryptedFs) Name() string {
+	return "EncryptedFs"
+}
+
+func (e *encryptedFs) Create(name string) (afero.File, error) {
+	return e.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (e *encryptedFs) Open(name string) (afero.File, error) {
+	return e.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (e *encryptedFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return e.openForReading(name, flag, perm)
+	}
+	if flag&os.O_APPEND != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+	}
+	f, err := e.Fs.OpenFile(name, flag|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	current := e.keys.Current()
+	key, _ := e.keys.get(current)
+	w, err := NewWriter(f, current, key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &writeFile{File: f, w: w}, nil
+}
+
+func (e *encryptedFs) openForReading(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := e.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if infos.IsDir() {
+		return f, nil
+	}
+	h, err := readHeader(f, infos.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if h == nil {
+		return f, nil
+	}
+	r, err := NewReader(f, infos.Size(), e.keys)
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &readFile{File: f, r: r}, nil
+}
+
+// Stat returns the informations about a file, with the size of the
+// plaintext for an encrypted file.
+func (e *encryptedFs) Stat(name string) (os.FileInfo, error) {
+	infos, err := e.Fs.Stat(name)
+	if err != nil || infos.IsDir() || infos.Size() < int64(headerLen) {
+		return infos, err
+	}
+	f, err := e.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, err := readHeader(f, infos.Size())
+	if err != nil || h == nil {
+		return infos, err
+	}
+	size, err := PlainSize(infos.Size())
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &plainInfo{FileInfo: infos, size: size}, nil
+}
+
+type plainInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *plainInfo) Size() int64 {
+	return i.size
+}
+
+// readFile is an encrypted file opened for reading.
+type readFile struct {
+	afero.File
+	r *Reader
+}
+
+func (f *readFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *readFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.r.ReadAt(p, off)
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	return f.r.Seek(offset, whence)
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	infos, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &plainInfo{FileInfo: infos, size: f.r.Size()}, nil
+}
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *readFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *readFile) WriteString(s string) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *readFile) Truncate(size int64) error {
+	return os.ErrInvalid
+}
+
+// writeFile is a file opened for writing, where the content is encrypted.
+type writeFile struct {
+	afero.File
+	w io.WriteCloser
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+func (f *writeFile) WriteString(s string) (int, error) {
+	return f.w.Write([]byte(s))
+}
+
+func (f *writeFile) Close() error {
+	err := f.w.Close()
+	if errc := f.File.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+func (f *writeFile) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *writeFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *writeFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *writeFile) Truncate(size int64) error {
+	return os.ErrInvalid
+}
@@ -0,0 +1,178 @@
+package vfscrypt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const wrapKeyInfo = "io.cozy.files data keys"
+
+const nonceLen = 24
+
+var (
+	// ErrNoMasterKey is returned when the data keys of an instance can't be
+	// unwrapped, as the files master key is missing.
+	ErrNoMasterKey = errors.New("vfscrypt: the files master key is missing")
+	// ErrCannotUnwrap is returned when a data key can't be unwrapped with the
+	// current and previous files master keys.
+	ErrCannotUnwrap = errors.New("vfscrypt: the data key can't be unwrapped")
+)
+
+// WrappedKey is a data key of an instance, encrypted with a key derived from
+// the files master key. It is the form in which the data keys are persisted,
+// in the instance document.
+type WrappedKey struct {
+	ID  uint32 `json:"id"`
+	Key []byte `json:"key"`
+}
+
+// Keys is the set of the unwrapped data keys of an instance. The new files
+// are encrypted with the current key, the other keys are only used to read
+// the files that have not been rekeyed yet.
+type Keys struct {
+	current uint32
+	keys    map[uint32]*[32]byte
+}
+
+// Current returns the id of the data key used to encrypt the new files.
+func (k *Keys) Current() uint32 {
+	return k.current
+}
+
+// SingleKey returns a set with only one key, that is not a data key of an
+// instance. It is used to encrypt the content sent to an external service,
+// like the backups.
+func SingleKey(id uint32, key *[32]byte) *Keys {
+	return &Keys{current: id, keys: map[uint32]*[32]byte{id: key}}
+}
+
+func (k *Keys) get(id uint32) (*[32]byte, bool) {
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// wrappingKey derives the key used to wrap the data keys of an instance from
+// the files master key.
+func wrappingKey(master []byte, db prefixer.Prefixer) (*[32]byte, error) {
+	if len(master) == 0 {
+		return nil, ErrNoMasterKey
+	}
+	h := hkdf.New(sha256.New, master, []byte(db.DBPrefix()), []byte(wrapKeyInfo))
+	var key [32]byte
+	if _, err := io.ReadFull(h, key[:]); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func wrap(wrapping, key *[32]byte, id uint32) (WrappedKey, error) {
+	var nonce [nonceLen]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return WrappedKey{}, err
+	}
+	sealed := secretbox.Seal(nonce[:], key[:], &nonce, wrapping)
+	return WrappedKey{ID: id, Key: sealed}, nil
+}
+
+// GenerateKey creates a new random data key with the given id, and returns it
+// wrapped with the master key.
+func GenerateKey(master []byte, db prefixer.Prefixer, id uint32) (WrappedKey, error) {
+	wrapping, err := wrappingKey(master, db)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	var key [32]byte
+	if _, err = io.ReadFull(rand.Reader, key[:]); err != nil {
+		return WrappedKey{}, err
+	}
+	return wrap(wrapping, &key, id)
+}
+
+// Unwrap decrypts the data keys of an instance. The master keys are tried in
+// order, so the current master key should be given first, and then the
+// previous one. The last key of the list is the current data key. Nil is
+// returned if the instance has no data key.
+func Unwrap(wrapped []WrappedKey, db prefixer.Prefixer, masters ...[]byte) (*Keys, error) {
+	if len(wrapped) == 0 {
+		return nil, nil
+	}
+	var wrappings []*[32]byte
+	for _, master := range masters {
+		if len(master) == 0 {
+			continue
+		}
+		wrapping, err := wrappingKey(master, db)
+		if err != nil {
+			return nil, err
+		}
+		wrappings = append(wrappings, wrapping)
+	}
+	if len(wrappings) == 0 {
+		return nil, ErrNoMasterKey
+	}
+
+	keys := &Keys{keys: make(map[uint32]*[32]byte, len(wrapped))}
+	for _, w := range wrapped {
+		if len(w.Key) < nonceLen {
+			return nil, ErrCannotUnwrap
+		}
+		var nonce [nonceLen]byte
+		copy(nonce[:], w.Key[:nonceLen])
+		var key *[32]byte
+		for _, wrapping := range wrappings {
+			if plain, ok := secretbox.Open(nil, w.Key[nonceLen:], &nonce, wrapping); ok && len(plain) == 32 {
+				key = new([32]byte)
+				copy(key[:], plain)
+				break
+			}
+		}
+		if key == nil {
+			return nil, ErrCannotUnwrap
+		}
+		keys.keys[w.ID] = key
+		keys.current = w.ID
+	}
+	return keys, nil
+}
+
+// Wrap returns the data keys wrapped with the given master key, the current
+// key being the last one. It is used after a rotation of the master key.
+func (k *Keys) Wrap(master []byte, db prefixer.Prefixer) ([]WrappedKey, error) {
+	wrapping, err := wrappingKey(master, db)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(k.keys))
+	for id := range k.keys {
+		if id != k.current {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+	ids = append(ids, int(k.current))
+	wrapped := make([]WrappedKey, len(ids))
+	for i, id := range ids {
+		if wrapped[i], err = wrap(wrapping, k.keys[uint32(id)], uint32(id)); err != nil {
+			return nil, err
+		}
+	}
+	return wrapped, nil
+}
+
+// MaxID returns the greatest id of the data keys.
+func (k *Keys) MaxID() uint32 {
+	max := k.current
+	for id := range k.keys {
+		if id > max {
+			max = id
+		}
+	}
+	return max
+}
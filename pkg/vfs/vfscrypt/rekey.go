@@ -0,0 +1,125 @@
+package vfscrypt
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/lock"
+)
+
+// Reencrypt walks the files of base (the storage, without the encryption
+// layer), and encrypts again with the current data key the files that are
+// not encrypted with it: the files written before the encryption has been
+// enabled, and the files encrypted with an older data key. The directories
+// for which skip returns true are left as is. It returns the number of files
+// that have been rewritten.
+//
+// The lock of the VFS is taken while a file is rewritten, and the file is
+// left as is if it has been modified in the meantime. The files that can't be
+// decrypted are also skipped.
+func Reencrypt(base afero.Fs, keys *Keys, mu lock.ErrorRWLocker, skip func(dir string) bool) (int, error) {
+	count := 0
+	err := afero.Walk(base, "/", func(fullpath string, infos os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if infos.IsDir() {
+			if skip != nil && skip(fullpath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !infos.Mode().IsRegular() {
+			return nil
+		}
+		rewritten, err := reencryptFile(base, keys, mu, fullpath)
+		if perr, ok := err.(*os.PathError); ok {
+			err = perr.Err
+		}
+		// A file can't be decrypted while it is still being written (a
+		// temporary file of an upload for example)
+		if err == ErrCorrupted {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rewritten {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+func reencryptFile(base afero.Fs, keys *Keys, mu lock.ErrorRWLocker, name string) (bool, error) {
+	if err := mu.Lock(); err != nil {
+		return false, err
+	}
+	defer mu.Unlock()
+
+	before, err := base.Stat(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	upToDate, err := isEncryptedWith(base, name, before.Size(), keys.Current())
+	if err != nil || upToDate {
+		return false, err
+	}
+
+	fs := NewFs(base, keys)
+	src, err := fs.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	dst, err := afero.TempFile(fs, path.Dir(name), ".cozy-rekey")
+	if err != nil {
+		return false, err
+	}
+	tmpname := dst.Name()
+	_, err = io.Copy(dst, src)
+	if errc := dst.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = base.Chmod(tmpname, before.Mode())
+	}
+	if err == nil {
+		err = base.Chtimes(tmpname, before.ModTime(), before.ModTime())
+	}
+	if err != nil {
+		base.Remove(tmpname) // #nosec
+		return false, err
+	}
+
+	after, err := base.Stat(name)
+	if err != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		base.Remove(tmpname) // #nosec
+		return false, err
+	}
+	if err = base.Rename(tmpname, name); err != nil {
+		base.Remove(tmpname) // #nosec
+		return false, err
+	}
+	return true, nil
+}
+
+func isEncryptedWith(base afero.Fs, name string, size int64, keyID uint32) (bool, error) {
+	f, err := base.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h, err := readHeader(f, size)
+	if err != nil || h == nil {
+		return false, err
+	}
+	return h.keyID == keyID, nil
+}
@@ -0,0 +1,306 @@
+// Package vfscrypt is used to encrypt the content of the files at rest, on
+// the storage of the VFS. Each instance has its own data keys, wrapped with
+// the files master key from the keyring. The content is encrypted by chunks
+// with NaCl secretbox, so that a file can still be read from any offset (for
+// the HTTP range requests for example).
+package vfscrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// magic is written at the beginning of the encrypted files, in order to
+	// distinguish them from the files written before the encryption has been
+	// enabled.
+	magic = "COZYENC1"
+	// ChunkSize is the size of the plaintext of a chunk. Each chunk is
+	// encrypted separately, and only the last chunk can be smaller.
+	ChunkSize = 64 * 1024
+
+	prefixLen       = 16
+	headerLen       = len(magic) + 4 + prefixLen
+	cipherChunkSize = ChunkSize + secretbox.Overhead
+)
+
+var (
+	// ErrUnknownKey is returned when a file has been encrypted with a data key
+	// that is not known.
+	ErrUnknownKey = errors.New("vfscrypt: unknown data key")
+	// ErrCorrupted is returned when the content of an encrypted file can't be
+	// authenticated.
+	ErrCorrupted = errors.New("vfscrypt: the content is corrupted")
+)
+
+// header is written at the beginning of an encrypted file: the magic, the id
+// of the data key, and a random prefix for the nonces of the chunks.
+type header struct {
+	keyID  uint32
+	prefix [prefixLen]byte
+}
+
+func (h *header) marshal() []byte {
+	buf := make([]byte, headerLen)
+	copy(buf, magic)
+	binary.BigEndian.PutUint32(buf[len(magic):], h.keyID)
+	copy(buf[len(magic)+4:], h.prefix[:])
+	return buf
+}
+
+// readHeader returns the header of an encrypted file, or nil if the file is
+// not encrypted.
+func readHeader(r io.ReaderAt, size int64) (*header, error) {
+	if size < int64(headerLen) {
+		return nil, nil
+	}
+	buf := make([]byte, headerLen)
+	if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:len(magic)], []byte(magic)) {
+		return nil, nil
+	}
+	h := &header{keyID: binary.BigEndian.Uint32(buf[len(magic):])}
+	copy(h.prefix[:], buf[len(magic)+4:])
+	return h, nil
+}
+
+// nonce returns the nonce of a chunk. The last chunk is flagged, so that a
+// truncated file can't be taken for a complete one.
+func (h *header) nonce(index int64, final bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], h.prefix[:])
+	binary.BigEndian.PutUint64(nonce[prefixLen:], uint64(index))
+	if final {
+		nonce[prefixLen] |= 0x80
+	}
+	return &nonce
+}
+
+// PlainSize returns the size of the plaintext for an encrypted file of the
+// given size.
+func PlainSize(cipherSize int64) (int64, error) {
+	_, plain, err := countChunks(cipherSize)
+	return plain, err
+}
+
+func countChunks(cipherSize int64) (chunks, plain int64, err error) {
+	body := cipherSize - int64(headerLen)
+	if body < secretbox.Overhead {
+		return 0, 0, ErrCorrupted
+	}
+	chunks = (body + cipherChunkSize - 1) / cipherChunkSize
+	last := body - (chunks-1)*cipherChunkSize
+	if last < secretbox.Overhead || (chunks > 1 && last == secretbox.Overhead) {
+		return 0, 0, ErrCorrupted
+	}
+	return chunks, body - chunks*secretbox.Overhead, nil
+}
+
+type writer struct {
+	w     io.Writer
+	key   *[32]byte
+	h     *header
+	index int64
+	buf   []byte
+	out   []byte
+	err   error
+}
+
+// NewWriter returns a writer that encrypts with the given data key what is
+// written to it. It must be closed to write the last chunk, but closing it
+// does not close w.
+func NewWriter(w io.Writer, keyID uint32, key *[32]byte) (io.WriteCloser, error) {
+	h := &header{keyID: keyID}
+	if _, err := io.ReadFull(rand.Reader, h.prefix[:]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(h.marshal()); err != nil {
+		return nil, err
+	}
+	return &writer{
+		w:   w,
+		key: key,
+		h:   h,
+		buf: make([]byte, 0, ChunkSize),
+		out: make([]byte, 0, cipherChunkSize),
+	}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		// A full chunk is kept in the buffer until more data comes, as we
+		// don't know before that if it is the last one.
+		if len(w.buf) == ChunkSize {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(w.buf[len(w.buf):ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+func (w *writer) flush(final bool) error {
+	w.out = secretbox.Seal(w.out[:0], w.buf, w.h.nonce(w.index, final), w.key)
+	if _, err := w.w.Write(w.out); err != nil {
+		w.err = err
+		return err
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	err := w.flush(true)
+	if err == nil {
+		w.err = errors.New("vfscrypt: write on a closed writer")
+	}
+	return err
+}
+
+// Reader decrypts an encrypted file. It can be read sequentially, or from
+// any offset with ReadAt.
+type Reader struct {
+	r      io.ReaderAt
+	key    *[32]byte
+	h      *header
+	size   int64
+	cipher int64
+	chunks int64
+	offset int64
+
+	// the last decrypted chunk is kept, as the reads are often smaller than
+	// a chunk
+	index int64
+	plain []byte
+	buf   []byte
+}
+
+// NewReader returns a reader for the plaintext of an encrypted file of the
+// given size. The data key is looked up in keys with the id from the header
+// of the file.
+func NewReader(r io.ReaderAt, cipherSize int64, keys *Keys) (*Reader, error) {
+	h, err := readHeader(r, cipherSize)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return nil, ErrCorrupted
+	}
+	key, ok := keys.get(h.keyID)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	chunks, size, err := countChunks(cipherSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		r:      r,
+		key:    key,
+		h:      h,
+		size:   size,
+		cipher: cipherSize,
+		chunks: chunks,
+		index:  -1,
+	}, nil
+}
+
+// Size returns the size of the plaintext.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Read implements io.Reader
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vfscrypt: negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		index := off / ChunkSize
+		if err := r.loadChunk(index); err != nil {
+			return n, err
+		}
+		k := copy(p[n:], r.plain[off-index*ChunkSize:])
+		n += k
+		off += int64(k)
+	}
+	return n, nil
+}
+
+func (r *Reader) loadChunk(index int64) error {
+	if r.index == index {
+		return nil
+	}
+	start := int64(headerLen) + index*cipherChunkSize
+	end := start + cipherChunkSize
+	if end > r.cipher {
+		end = r.cipher
+	}
+	if r.buf == nil {
+		r.buf = make([]byte, cipherChunkSize)
+	}
+	buf := r.buf[:end-start]
+	if n, err := r.r.ReadAt(buf, start); n < len(buf) {
+		if err == nil || err == io.EOF {
+			err = ErrCorrupted
+		}
+		return err
+	}
+	final := index == r.chunks-1
+	plain, ok := secretbox.Open(r.plain[:0], buf, r.h.nonce(index, final), r.key)
+	if !ok {
+		r.index = -1
+		return ErrCorrupted
+	}
+	r.plain = plain
+	r.index = index
+	return nil
+}
+
+// Seek implements io.Seeker
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("vfscrypt: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("vfscrypt: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
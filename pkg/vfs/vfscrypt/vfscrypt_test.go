@@ -0,0 +1,216 @@
+package vfscrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var db = prefixer.NewPrefixer("alice.cozy.tools", "cozyalice")
+
+var master = []byte("0123456789abcdef0123456789abcdef")
+
+type noLock struct{}
+
+func (noLock) Lock() error  { return nil }
+func (noLock) Unlock()      {}
+func (noLock) RLock() error { return nil }
+func (noLock) RUnlock()     {}
+
+func makeKeys(t *testing.T, ids ...uint32) (*Keys, []WrappedKey) {
+	var wrapped []WrappedKey
+	for _, id := range ids {
+		w, err := GenerateKey(master, db, id)
+		require.NoError(t, err)
+		wrapped = append(wrapped, w)
+	}
+	keys, err := Unwrap(wrapped, db, master)
+	require.NoError(t, err)
+	return keys, wrapped
+}
+
+func randomContent(t *testing.T, size int) []byte {
+	content := make([]byte, size)
+	_, err := io.ReadFull(rand.Reader, content)
+	require.NoError(t, err)
+	return content
+}
+
+func encrypt(t *testing.T, keys *Keys, content []byte) []byte {
+	var buf bytes.Buffer
+	key, _ := keys.get(keys.Current())
+	w, err := NewWriter(&buf, keys.Current(), key)
+	require.NoError(t, err)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestStream(t *testing.T) {
+	keys, _ := makeKeys(t, 1)
+	sizes := []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 42}
+	for _, size := range sizes {
+		content := randomContent(t, size)
+		encrypted := encrypt(t, keys, content)
+		if size > 16 {
+			assert.False(t, bytes.Contains(encrypted, content[:16]))
+		}
+		plainSize, err := PlainSize(int64(len(encrypted)))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), plainSize)
+
+		r, err := NewReader(bytes.NewReader(encrypted), int64(len(encrypted)), keys)
+		require.NoError(t, err)
+		decrypted, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, content, decrypted)
+
+		if size > 100 {
+			buf := make([]byte, 50)
+			n, err := r.ReadAt(buf, int64(size-70))
+			assert.NoError(t, err)
+			assert.Equal(t, 50, n)
+			assert.Equal(t, content[size-70:size-20], buf)
+			n, err = r.ReadAt(buf, int64(size-20))
+			assert.Equal(t, io.EOF, err)
+			assert.Equal(t, 20, n)
+		}
+	}
+}
+
+func TestTamperedStream(t *testing.T) {
+	keys, _ := makeKeys(t, 1)
+	content := randomContent(t, 2*ChunkSize+10)
+	encrypted := encrypt(t, keys, content)
+
+	tampered := make([]byte, len(encrypted))
+	copy(tampered, encrypted)
+	tampered[headerLen+ChunkSize+100] ^= 1
+	r, err := NewReader(bytes.NewReader(tampered), int64(len(tampered)), keys)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrCorrupted, err)
+
+	// A file truncated at the end of a chunk is detected
+	truncated := encrypted[:headerLen+2*cipherChunkSize]
+	r, err = NewReader(bytes.NewReader(truncated), int64(len(truncated)), keys)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrCorrupted, err)
+
+	other, _ := makeKeys(t, 2)
+	_, err = NewReader(bytes.NewReader(encrypted), int64(len(encrypted)), other)
+	assert.Equal(t, ErrUnknownKey, err)
+}
+
+func TestWrapKeys(t *testing.T) {
+	keys, wrapped := makeKeys(t, 1, 2)
+	assert.Equal(t, uint32(2), keys.Current())
+	assert.Equal(t, uint32(2), keys.MaxID())
+
+	_, err := Unwrap(wrapped, db, []byte("another master key of 32 bytes.."))
+	assert.Equal(t, ErrCannotUnwrap, err)
+	_, err = Unwrap(wrapped, db)
+	assert.Equal(t, ErrNoMasterKey, err)
+	other := prefixer.NewPrefixer("bob.cozy.tools", "cozybob")
+	_, err = Unwrap(wrapped, other, master)
+	assert.Equal(t, ErrCannotUnwrap, err)
+
+	// Rotation of the master key
+	newMaster := []byte("a new master key with 32 bytes..")
+	rewrapped, err := keys.Wrap(newMaster, db)
+	require.NoError(t, err)
+	assert.Len(t, rewrapped, 2)
+	assert.Equal(t, uint32(2), rewrapped[1].ID)
+	unwrapped, err := Unwrap(rewrapped, db, newMaster, master)
+	require.NoError(t, err)
+	encrypted := encrypt(t, keys, []byte("foo"))
+	r, err := NewReader(bytes.NewReader(encrypted), int64(len(encrypted)), unwrapped)
+	require.NoError(t, err)
+	decrypted, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(decrypted))
+}
+
+func TestFs(t *testing.T) {
+	keys, _ := makeKeys(t, 1)
+	base := afero.NewMemMapFs()
+	fs := NewFs(base, keys)
+	content := randomContent(t, ChunkSize+1000)
+
+	require.NoError(t, afero.WriteFile(fs, "/foo", content, 0644))
+	raw, err := afero.ReadFile(base, "/foo")
+	require.NoError(t, err)
+	assert.NotEqual(t, content, raw)
+	infos, err := fs.Stat("/foo")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), infos.Size())
+
+	f, err := fs.Open("/foo")
+	require.NoError(t, err)
+	end, err := f.Seek(-10, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)-10), end)
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, content[len(content)-10:], buf)
+	_, err = f.Write([]byte("bar"))
+	assert.Error(t, err)
+	assert.NoError(t, f.Close())
+
+	// The files written before the encryption are still readable
+	require.NoError(t, afero.WriteFile(base, "/plain", []byte("plain"), 0644))
+	plain, err := afero.ReadFile(fs, "/plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", string(plain))
+
+	_, err = fs.OpenFile("/foo", os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Error(t, err)
+}
+
+func TestReencrypt(t *testing.T) {
+	oldKeys, wrapped := makeKeys(t, 1)
+	base := afero.NewMemMapFs()
+	content := randomContent(t, 3*ChunkSize)
+	require.NoError(t, afero.WriteFile(NewFs(base, oldKeys), "/dir/foo", content, 0644))
+	require.NoError(t, afero.WriteFile(base, "/dir/plain", []byte("plain"), 0644))
+	require.NoError(t, afero.WriteFile(base, "/apps/index.html", []byte("app"), 0644))
+
+	newKey, err := GenerateKey(master, db, 2)
+	require.NoError(t, err)
+	keys, err := Unwrap(append(wrapped, newKey), db, master)
+	require.NoError(t, err)
+	skip := func(dir string) bool { return dir == "/apps" }
+
+	count, err := Reencrypt(base, keys, noLock{}, skip)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = Reencrypt(base, keys, noLock{}, skip)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	onlyNew, err := Unwrap([]WrappedKey{newKey}, db, master)
+	require.NoError(t, err)
+	fs := NewFs(base, onlyNew)
+	foo, err := afero.ReadFile(fs, "/dir/foo")
+	assert.NoError(t, err)
+	assert.Equal(t, content, foo)
+	plain, err := afero.ReadFile(fs, "/dir/plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", string(plain))
+	raw, err := afero.ReadFile(base, "/dir/plain")
+	assert.NoError(t, err)
+	assert.NotEqual(t, "plain", string(raw))
+	app, err := afero.ReadFile(base, "/apps/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "app", string(app))
+}
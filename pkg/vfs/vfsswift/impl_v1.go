@@ -97,6 +97,11 @@ func (sfs *swiftVFS) InitFs() error {
 	if err := sfs.Indexer.InitIndex(); err != nil {
 		return err
 	}
+	if err := createContainers(sfs.c, sfs.domain, sfs.container, sfs.version); err != nil {
+		sfs.log.Errorf("Could not create container %s: %s",
+			sfs.container, err.Error())
+		return err
+	}
 	if err := sfs.c.VersionContainerCreate(sfs.container, sfs.version); err != nil {
 		if err != swift.Forbidden {
 			sfs.log.Errorf("Could not create container %s: %s",
@@ -146,24 +151,7 @@ func (sfs *swiftVFS) Delete() error {
 }
 
 func (sfs *swiftVFS) deleteContainer(container string) error {
-	_, _, err := sfs.c.Container(container)
-	if err == swift.ContainerNotFound {
-		return nil
-	}
-	if err != nil {
-		return err
-	}
-	objectNames, err := sfs.c.ObjectNamesAll(container, nil)
-	if err != nil {
-		return err
-	}
-	if len(objectNames) > 0 {
-		_, err = sfs.c.BulkDelete(container, objectNames)
-		if err != nil {
-			return err
-		}
-	}
-	return sfs.c.ContainerDelete(container)
+	return deleteContainer(sfs.c, sfs.domain, container)
 }
 
 func (sfs *swiftVFS) CreateDir(doc *vfs.DirDoc) error {
@@ -119,6 +119,11 @@ func (sfs *swiftVFSV2) InitFs() error {
 	if err := sfs.Indexer.InitIndex(); err != nil {
 		return err
 	}
+	if err := createContainers(sfs.c, sfs.domain, sfs.container, sfs.version); err != nil {
+		sfs.log.Errorf("Could not create container %s: %s",
+			sfs.container, err.Error())
+		return err
+	}
 	if err := sfs.c.VersionContainerCreate(sfs.container, sfs.version); err != nil {
 		if err != swift.Forbidden {
 			sfs.log.Errorf("Could not create container %s: %s",
@@ -131,7 +136,7 @@ func (sfs *swiftVFSV2) InitFs() error {
 			return err
 		}
 	}
-	if err := sfs.c.ContainerCreate(sfs.dataContainer, nil); err != nil {
+	if err := createContainers(sfs.c, sfs.domain, sfs.dataContainer); err != nil {
 		sfs.log.Errorf("Could not create container %s: %s",
 			sfs.dataContainer, err.Error())
 		return err
@@ -173,24 +178,7 @@ func (sfs *swiftVFSV2) Delete() error {
 }
 
 func (sfs *swiftVFSV2) deleteContainer(container string) error {
-	_, _, err := sfs.c.Container(container)
-	if err == swift.ContainerNotFound {
-		return nil
-	}
-	if err != nil {
-		return err
-	}
-	objectNames, err := sfs.c.ObjectNamesAll(container, nil)
-	if err != nil {
-		return err
-	}
-	if len(objectNames) > 0 {
-		_, err = sfs.c.BulkDelete(container, objectNames)
-		if err != nil {
-			return err
-		}
-	}
-	return sfs.c.ContainerDelete(container)
+	return deleteContainer(sfs.c, sfs.domain, container)
 }
 
 func (sfs *swiftVFSV2) CreateDir(doc *vfs.DirDoc) error {
@@ -496,7 +484,13 @@ func (sfs *swiftVFSV2) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
 			return os.ErrExist
 		}
 	}
-	return sfs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	if err := sfs.Indexer.UpdateFileDoc(olddoc, newdoc); err != nil {
+		return err
+	}
+	if newdoc.Trashed != olddoc.Trashed {
+		sfs.setTrashExpiry([]*vfs.FileDoc{newdoc}, newdoc.Trashed)
+	}
+	return nil
 }
 
 // UdpdateDirDoc calls the indexer UdpdateDirDoc function and adds a few checks
@@ -519,7 +513,15 @@ func (sfs *swiftVFSV2) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
 			return os.ErrExist
 		}
 	}
-	return sfs.Indexer.UpdateDirDoc(olddoc, newdoc)
+	if err := sfs.Indexer.UpdateDirDoc(olddoc, newdoc); err != nil {
+		return err
+	}
+	wasTrashed := strings.HasPrefix(olddoc.Fullpath, vfs.TrashDirName+"/")
+	isTrashed := strings.HasPrefix(newdoc.Fullpath, vfs.TrashDirName+"/")
+	if wasTrashed != isTrashed {
+		sfs.setTrashExpiry(sfs.trashedFiles(newdoc), isTrashed)
+	}
+	return nil
 }
 
 func (sfs *swiftVFSV2) DirByID(fileID string) (*vfs.DirDoc, error) {
@@ -0,0 +1,145 @@
+package vfsswift
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+// domainMetaKey is the key of the metadata of the containers with the domain
+// of the instance that owns them.
+const domainMetaKey = "cozy-domain"
+
+// ErrContainerNotOwned is used when a container is not deleted because it
+// belongs to another instance.
+var ErrContainerNotOwned = errors.New("vfsswift: the container belongs to another instance")
+
+// ErrInvalidContainerName is used when a container is not deleted because its
+// name is not the name of a container of an instance.
+var ErrInvalidContainerName = errors.New("vfsswift: invalid container name")
+
+// containerHeaders returns the headers for creating a container for the
+// given instance: the storage policy from the configuration, and the domain
+// of the instance, that is checked before purging the container.
+func containerHeaders(domain string) swift.Headers {
+	headers := swift.Metadata{
+		domainMetaKey: domain,
+		"created-at":  time.Now().UTC().Format(time.RFC3339),
+	}.ContainerHeaders()
+	if policy := config.GetConfig().Fs.StoragePolicy; policy != "" {
+		headers["X-Storage-Policy"] = policy
+	}
+	return headers
+}
+
+// createContainers creates the containers of an instance with the headers
+// given by containerHeaders. It is a no-op for the containers that already
+// exist.
+func createContainers(c *swift.Connection, domain string, containers ...string) error {
+	headers := containerHeaders(domain)
+	for _, container := range containers {
+		if err := c.ContainerCreate(container, headers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteContainer purges a container of an instance: its objects are deleted,
+// and then the container itself. As a safety check, the container is not
+// purged if its name has no prefix of the containers of the instances, or if
+// it has been created for another domain.
+func deleteContainer(c *swift.Connection, domain, container string) error {
+	if !isInstanceContainer(container) {
+		return ErrInvalidContainerName
+	}
+	_, headers, err := c.Container(container)
+	if err == swift.ContainerNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if owner := headers.ContainerMetadata()[domainMetaKey]; owner != "" && owner != domain {
+		return ErrContainerNotOwned
+	}
+	objectNames, err := c.ObjectNamesAll(container, nil)
+	if err != nil {
+		return err
+	}
+	if len(objectNames) > 0 {
+		_, err = c.BulkDelete(container, objectNames)
+		if err != nil {
+			return err
+		}
+	}
+	return c.ContainerDelete(container)
+}
+
+// isInstanceContainer returns true if the name of the container is the name
+// of a container of an instance. The prefixes of the layout v2 are checked
+// first, as they start with the prefixes of the layout v1.
+func isInstanceContainer(container string) bool {
+	for _, prefix := range []string{
+		swiftV2ContainerPrefixCozy,
+		swiftV2ContainerPrefixData,
+		swiftV1ContainerPrefix,
+		swiftV1DataContainerPrefix,
+	} {
+		if strings.HasPrefix(container, prefix) {
+			name := strings.TrimSuffix(strings.TrimPrefix(container, prefix), versionSuffix)
+			return name != ""
+		}
+	}
+	return false
+}
+
+// setTrashExpiry sets an expiration date on the objects of the files moved
+// to the trash, so that their content is deleted by Swift after the trash
+// expiry of the configuration. The expiration is removed when the files are
+// restored. The metadata of the objects are sent again, as a POST on an object
+// replaces them.
+func (sfs *swiftVFSV2) setTrashExpiry(docs []*vfs.FileDoc, trashed bool) {
+	expiry := config.GetConfig().Fs.TrashExpiry
+	if expiry <= 0 {
+		return
+	}
+	for _, doc := range docs {
+		objName := MakeObjectName(doc.DocID)
+		_, headers, err := sfs.c.Object(sfs.container, objName)
+		if err != nil {
+			sfs.log.Warnf("Could not get the object %s: %s", objName, err)
+			continue
+		}
+		update := headers.ObjectMetadata().ObjectHeaders()
+		if trashed {
+			update["X-Delete-After"] = strconv.FormatInt(int64(expiry/time.Second), 10)
+		} else {
+			update["X-Remove-Delete-At"] = "1"
+		}
+		if err = sfs.c.ObjectUpdate(sfs.container, objName, update); err != nil {
+			sfs.log.Warnf("Could not update the expiry of the object %s: %s", objName, err)
+		}
+	}
+}
+
+// trashedFiles returns the files inside a directory, for setting their trash
+// expiry when the directory is moved to the trash or restored.
+func (sfs *swiftVFSV2) trashedFiles(dir *vfs.DirDoc) []*vfs.FileDoc {
+	var files []*vfs.FileDoc
+	_ = vfs.WalkByID(sfs.Indexer, dir.ID(), func(_ string, _ *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			files = append(files, file)
+		}
+		return nil
+	})
+	return files
+}
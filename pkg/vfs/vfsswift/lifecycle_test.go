@@ -0,0 +1,19 @@
+package vfsswift
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsInstanceContainer(t *testing.T) {
+	assert.True(t, isInstanceContainer("cozy-v2-alice-cozy-tools"))
+	assert.True(t, isInstanceContainer("cozy-v2-alice-cozy-tools-version"))
+	assert.True(t, isInstanceContainer("data-v2-alice-cozy-tools"))
+	assert.True(t, isInstanceContainer("cozy-alice.cozy.tools"))
+	assert.False(t, isInstanceContainer("cozy-v2-"))
+	assert.False(t, isInstanceContainer("cozy-v2--version"))
+	assert.False(t, isInstanceContainer("data-"))
+	assert.False(t, isInstanceContainer("backups"))
+	assert.False(t, isInstanceContainer(""))
+}
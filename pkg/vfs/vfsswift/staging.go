@@ -0,0 +1,89 @@
+package vfsswift
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+// NewStagingFs creates a new filesystem for the staging area of the uploads,
+// based on swift. The files are stored in the data container of the instance,
+// and they expire after the given duration, for the uploads that are never
+// committed nor aborted.
+func NewStagingFs(c *swift.Connection, domain string, ttl time.Duration) vfs.Stager {
+	return &staging{
+		c:         c,
+		domain:    domain,
+		container: swiftV1DataContainerPrefix + domain,
+		ttl:       ttl,
+	}
+}
+
+// NewStagingFsV2 creates a new filesystem for the staging area of the
+// uploads, based on swift, for the instances with the V2 layout.
+func NewStagingFsV2(c *swift.Connection, db prefixer.Prefixer, ttl time.Duration) vfs.Stager {
+	return &staging{
+		c:         c,
+		domain:    db.DomainName(),
+		container: swiftV2ContainerPrefixData + db.DBPrefix(),
+		ttl:       ttl,
+	}
+}
+
+type staging struct {
+	c         *swift.Connection
+	domain    string
+	container string
+	ttl       time.Duration
+}
+
+func (s *staging) CreateStagedFile(uploadID string) (vfs.ThumbFiler, error) {
+	objName := s.makeName(uploadID)
+	headers := swift.Headers{}
+	if s.ttl > 0 {
+		headers["X-Delete-After"] = strconv.FormatInt(int64(s.ttl/time.Second), 10)
+	}
+	obj, err := s.c.ObjectCreate(s.container, objName, true, "", "", headers)
+	if err != nil {
+		if _, _, errc := s.c.Container(s.container); errc == swift.ContainerNotFound {
+			if errc = createContainers(s.c, s.domain, s.container); errc != nil {
+				return nil, err
+			}
+			obj, err = s.c.ObjectCreate(s.container, objName, true, "", "", headers)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	th := &thumb{
+		WriteCloser: obj,
+		c:           s.c,
+		container:   s.container,
+		name:        objName,
+	}
+	return th, nil
+}
+
+func (s *staging) OpenStagedFile(uploadID string) (io.ReadCloser, error) {
+	f, _, err := s.c.ObjectOpen(s.container, s.makeName(uploadID), false, nil)
+	if err != nil {
+		return nil, wrapSwiftErr(err)
+	}
+	return f, nil
+}
+
+func (s *staging) RemoveStagedFile(uploadID string) error {
+	err := s.c.ObjectDelete(s.container, s.makeName(uploadID))
+	if err == swift.ObjectNotFound || err == swift.ContainerNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *staging) makeName(uploadID string) string {
+	return "staging/" + uploadID
+}
@@ -0,0 +1,111 @@
+package vfsswift
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+// NewStreamsFs creates a new filesystem for the streams of the videos, based
+// on swift. The files are stored in the data container of the instance.
+func NewStreamsFs(c *swift.Connection, domain string) vfs.Streamer {
+	return &streams{
+		c:         c,
+		container: swiftV1DataContainerPrefix + domain,
+		objName:   func(id string) string { return id },
+	}
+}
+
+// NewStreamsFsV2 creates a new filesystem for the streams of the videos,
+// based on swift, for the instances with the V2 layout.
+func NewStreamsFsV2(c *swift.Connection, db prefixer.Prefixer) vfs.Streamer {
+	return &streams{
+		c:         c,
+		container: swiftV2ContainerPrefixData + db.DBPrefix(),
+		objName:   MakeObjectName,
+	}
+}
+
+type streams struct {
+	c         *swift.Connection
+	container string
+	objName   func(id string) string
+}
+
+func (s *streams) CreateStreamFile(video *vfs.FileDoc, name string) (vfs.ThumbFiler, error) {
+	objName := s.makeName(video, name)
+	obj, err := s.c.ObjectCreate(s.container, objName, true, "", "", nil)
+	if err != nil {
+		if _, _, errc := s.c.Container(s.container); errc == swift.ContainerNotFound {
+			if errc = s.c.ContainerCreate(s.container, nil); errc != nil {
+				return nil, err
+			}
+			obj, err = s.c.ObjectCreate(s.container, objName, true, "", "", nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	th := &thumb{
+		WriteCloser: obj,
+		c:           s.c,
+		container:   s.container,
+		name:        objName,
+	}
+	return th, nil
+}
+
+func (s *streams) StreamFileExists(video *vfs.FileDoc, name string) (bool, error) {
+	infos, _, err := s.c.Object(s.container, s.makeName(video, name))
+	if err == swift.ObjectNotFound || err == swift.ContainerNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return infos.Bytes > 0, nil
+}
+
+func (s *streams) RemoveStreams(video *vfs.FileDoc) error {
+	objNames, err := s.c.ObjectNamesAll(s.container, &swift.ObjectsOpts{
+		Prefix: s.videoPrefix(video),
+	})
+	if err == swift.ContainerNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(objNames) == 0 {
+		return nil
+	}
+	_, err = s.c.BulkDelete(s.container, objNames)
+	return err
+}
+
+func (s *streams) ServeStreamContent(w http.ResponseWriter, req *http.Request, video *vfs.FileDoc, name string) error {
+	objName := s.makeName(video, name)
+	f, o, err := s.c.ObjectOpen(s.container, objName, false, nil)
+	if err != nil {
+		return wrapSwiftErr(err)
+	}
+	defer f.Close()
+
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, o["Etag"]))
+	http.ServeContent(w, req, objName, unixEpochZero, f)
+	return nil
+}
+
+func (s *streams) videoPrefix(video *vfs.FileDoc) string {
+	return "streams/" + s.objName(video.ID()) + "/"
+}
+
+func (s *streams) makeName(video *vfs.FileDoc, name string) string {
+	md5 := hex.EncodeToString(video.MD5Sum)
+	return s.videoPrefix(video) + md5 + "/" + path.Base(name)
+}
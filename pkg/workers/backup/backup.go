@@ -0,0 +1,475 @@
+// Package backup is for the backups of an instance in an external S3 bucket,
+// configured by the user. The documents and the content of the files are
+// encrypted by the stack before being uploaded, with a key derived from a
+// passphrase chosen for the backups: the bucket never sees them in clear.
+//
+// A backup is incremental: the content of a file is only uploaded if no
+// object with the same checksum is already in the bucket. The manifest of
+// the last backup lists the objects, and it is uploaded at the end, so that
+// an interrupted backup does not break the previous one.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/accounts"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The states of the last backup or restore
+const (
+	StateRunning = "running"
+	StateDone    = "done"
+	StateErrored = "errored"
+)
+
+// The frequencies of the scheduled backups
+const (
+	FrequencyDaily  = "daily"
+	FrequencyWeekly = "weekly"
+)
+
+const (
+	configID      = "config"
+	defaultRegion = "us-east-1"
+	workerTimeout = 12 * time.Hour
+
+	// The parameters of scrypt for deriving the key from the passphrase
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+
+	saltLen    = 16
+	nonceLen   = 24
+	checkValue = "cozy-backup"
+)
+
+var (
+	// ErrNotConfigured is used when the backups have not been configured for
+	// the instance.
+	ErrNotConfigured = errors.New("The backups are not configured")
+	// ErrMissingParams is used when a parameter required for the
+	// configuration is missing.
+	ErrMissingParams = errors.New("The endpoint, the bucket, the access key, the secret key and the passphrase are required")
+	// ErrInvalidPrefix is used when the prefix of the objects has characters
+	// that are not allowed.
+	ErrInvalidPrefix = errors.New("The prefix can only have letters, digits, dots, dashes, underscores and slashes")
+	// ErrInvalidFrequency is used when the frequency is not daily or weekly.
+	ErrInvalidFrequency = errors.New("The frequency must be daily or weekly")
+	// ErrWrongPassphrase is used when the bucket already has a backup, made
+	// with another passphrase.
+	ErrWrongPassphrase = errors.New("The passphrase does not match the backup in the bucket")
+	// ErrAlreadyRunning is used when a backup or a restore is asked while
+	// another one is running.
+	ErrAlreadyRunning = errors.New("A backup or a restore is already running")
+)
+
+var prefixRegexp = regexp.MustCompile(`^[a-zA-Z0-9._/-]+$`)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "backup",
+		Concurrency:  2,
+		MaxExecCount: 2,
+		Timeout:      workerTimeout,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Config is the document with the configuration of the backups of an
+// instance, and the state of the last backup or restore. The secret key of
+// the bucket and the encryption key are encrypted with the key of the
+// instance.
+type Config struct {
+	DocID            string     `json:"_id,omitempty"`
+	DocRev           string     `json:"_rev,omitempty"`
+	Endpoint         string     `json:"endpoint"`
+	Region           string     `json:"region"`
+	Bucket           string     `json:"bucket"`
+	Prefix           string     `json:"prefix"`
+	AccessKeyID      string     `json:"access_key_id"`
+	Secrets          string     `json:"secrets_encrypted"`
+	Frequency        string     `json:"frequency,omitempty"`
+	TriggerID        string     `json:"trigger_id,omitempty"`
+	State            string     `json:"state,omitempty"`
+	Error            string     `json:"error,omitempty"`
+	FilesCount       int        `json:"files_count"`
+	TransferredCount int        `json:"transferred_count"`
+	TransferredBytes int64      `json:"transferred_bytes"`
+	LastBackupAt     *time.Time `json:"last_backup_at,omitempty"`
+	LastRestoreAt    *time.Time `json:"last_restore_at,omitempty"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// ID returns the config identifier
+func (c *Config) ID() string { return c.DocID }
+
+// Rev returns the config revision
+func (c *Config) Rev() string { return c.DocRev }
+
+// DocType returns the config document type
+func (c *Config) DocType() string { return consts.Backups }
+
+// Clone implements couchdb.Doc
+func (c *Config) Clone() couchdb.Doc {
+	cloned := *c
+	if c.LastBackupAt != nil {
+		t := *c.LastBackupAt
+		cloned.LastBackupAt = &t
+	}
+	if c.LastRestoreAt != nil {
+		t := *c.LastRestoreAt
+		cloned.LastRestoreAt = &t
+	}
+	return &cloned
+}
+
+// SetID changes the config identifier
+func (c *Config) SetID(id string) { c.DocID = id }
+
+// SetRev changes the config revision
+func (c *Config) SetRev(rev string) { c.DocRev = rev }
+
+// IsRunning returns true if a backup or a restore is running.
+func (c *Config) IsRunning() bool {
+	return c.State == StateRunning && time.Since(c.UpdatedAt) < workerTimeout
+}
+
+// secrets are the values of the configuration that are encrypted.
+type secrets struct {
+	SecretAccessKey string `json:"secret_access_key"`
+	Key             []byte `json:"key"`
+}
+
+// Params are the parameters given by the user to configure the backups.
+type Params struct {
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Passphrase      string `json:"passphrase"`
+	Frequency       string `json:"frequency"`
+}
+
+// Options is the option handler for the backup worker.
+type Options struct {
+	Restore bool `json:"restore,omitempty"`
+}
+
+// remoteKey is the object, in clear, with the salt used to derive the key
+// from the passphrase. The check value is encrypted with the key, to verify
+// the passphrase when an existing backup is configured on an instance.
+type remoteKey struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Check   []byte `json:"check"`
+}
+
+// GetConfig returns the configuration of the backups of the instance.
+func GetConfig(inst *instance.Instance) (*Config, error) {
+	var conf Config
+	err := couchdb.GetDoc(inst, consts.Backups, configID, &conf)
+	if couchdb.IsNotFoundError(err) {
+		return nil, ErrNotConfigured
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// Configure checks the access to the bucket, and saves the configuration of
+// the backups. If the bucket already has a backup, the passphrase must be
+// the same, so that it can be restored.
+func Configure(inst *instance.Instance, params *Params) (*Config, error) {
+	if params.Endpoint == "" || params.Bucket == "" || params.AccessKeyID == "" ||
+		params.SecretAccessKey == "" || params.Passphrase == "" {
+		return nil, ErrMissingParams
+	}
+	params.Prefix = strings.Trim(params.Prefix, "/")
+	if params.Prefix == "" {
+		params.Prefix = inst.Domain
+	}
+	if !prefixRegexp.MatchString(params.Prefix) {
+		return nil, ErrInvalidPrefix
+	}
+	if params.Region == "" {
+		params.Region = defaultRegion
+	}
+	switch params.Frequency {
+	case "", FrequencyDaily, FrequencyWeekly:
+	default:
+		return nil, ErrInvalidFrequency
+	}
+
+	client := &s3Client{
+		endpoint:  params.Endpoint,
+		region:    params.Region,
+		bucket:    params.Bucket,
+		accessKey: params.AccessKeyID,
+		secretKey: params.SecretAccessKey,
+	}
+	key, err := loadOrCreateKey(context.Background(), client, params.Prefix, params.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := accounts.EncryptInstanceCredentialsData(inst, &secrets{
+		SecretAccessKey: params.SecretAccessKey,
+		Key:             key[:],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := GetConfig(inst)
+	if err == ErrNotConfigured {
+		conf = &Config{DocID: configID}
+	} else if err != nil {
+		return nil, err
+	}
+	if conf.IsRunning() {
+		return nil, ErrAlreadyRunning
+	}
+	conf.Endpoint = params.Endpoint
+	conf.Region = params.Region
+	conf.Bucket = params.Bucket
+	conf.Prefix = params.Prefix
+	conf.AccessKeyID = params.AccessKeyID
+	conf.Secrets = encrypted
+	conf.Frequency = params.Frequency
+	if err = conf.schedule(inst); err != nil {
+		return nil, err
+	}
+	conf.UpdatedAt = time.Now().UTC()
+	if conf.DocRev == "" {
+		err = couchdb.CreateNamedDocWithDB(inst, conf)
+	} else {
+		err = couchdb.UpdateDoc(inst, conf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// Remove deletes the configuration of the backups, and the trigger of the
+// scheduled backups. The objects in the bucket are kept.
+func Remove(inst *instance.Instance) error {
+	conf, err := GetConfig(inst)
+	if err != nil {
+		return err
+	}
+	if conf.IsRunning() {
+		return ErrAlreadyRunning
+	}
+	conf.Frequency = ""
+	if err = conf.schedule(inst); err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(inst, conf)
+}
+
+// schedule replaces the trigger of the scheduled backups by a trigger with
+// the current frequency. The time of the backups is chosen by the stack.
+func (c *Config) schedule(inst *instance.Instance) error {
+	sched := jobs.System()
+	if c.TriggerID != "" {
+		if err := sched.DeleteTrigger(inst, c.TriggerID); err != nil && err != jobs.ErrNotFoundTrigger {
+			return err
+		}
+		c.TriggerID = ""
+	}
+	if c.Frequency == "" {
+		return nil
+	}
+	t, err := jobs.NewTrigger(inst, jobs.TriggerInfos{
+		Type:       "@" + c.Frequency,
+		WorkerType: "backup",
+	}, &Options{})
+	if err != nil {
+		return err
+	}
+	if err = sched.AddTrigger(t); err != nil {
+		return err
+	}
+	c.TriggerID = t.ID()
+	return nil
+}
+
+// Run pushes a job for a backup, or for a restore of the last backup.
+func Run(inst *instance.Instance, restore bool) (*jobs.Job, error) {
+	conf, err := GetConfig(inst)
+	if err != nil {
+		return nil, err
+	}
+	if conf.IsRunning() {
+		return nil, ErrAlreadyRunning
+	}
+	msg, err := jobs.NewMessage(&Options{Restore: restore})
+	if err != nil {
+		return nil, err
+	}
+	return jobs.System().PushJob(inst, &jobs.JobRequest{
+		WorkerType: "backup",
+		Message:    msg,
+	})
+}
+
+// Worker is the worker method for the backups and the restores.
+func Worker(ctx *jobs.WorkerContext) error {
+	var opts Options
+	if err := ctx.UnmarshalMessage(&opts); err != nil {
+		return err
+	}
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	conf, err := GetConfig(inst)
+	if err == ErrNotConfigured {
+		ctx.Logger().WithField("nspace", "backup").Infof("Skipped: %s", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if conf.IsRunning() {
+		ctx.Logger().WithField("nspace", "backup").Infof("Skipped: %s", ErrAlreadyRunning)
+		return nil
+	}
+	// The revision of the document acts as a lock: if another job has
+	// started in the same time, there is a conflict.
+	conf.State = StateRunning
+	conf.Error = ""
+	conf.UpdatedAt = time.Now().UTC()
+	if err = couchdb.UpdateDoc(inst, conf); err != nil {
+		return err
+	}
+
+	run := &runner{ctx: ctx, inst: inst, conf: conf}
+	if err = run.init(); err == nil {
+		if opts.Restore {
+			err = run.restore()
+		} else {
+			err = run.backup()
+		}
+	}
+	now := time.Now().UTC()
+	if err != nil {
+		conf.State = StateErrored
+		conf.Error = err.Error()
+	} else {
+		conf.State = StateDone
+		if opts.Restore {
+			conf.LastRestoreAt = &now
+		} else {
+			conf.LastBackupAt = &now
+		}
+	}
+	conf.UpdatedAt = now
+	if errs := couchdb.UpdateDoc(inst, conf); errs != nil {
+		ctx.Logger().WithField("nspace", "backup").
+			Errorf("Cannot save the state of the backup: %s", errs)
+	}
+	return err
+}
+
+// loadOrCreateKey derives the encryption key from the passphrase, with the
+// salt of the backup in the bucket. If the bucket has no backup for this
+// prefix, a new salt is generated and uploaded.
+func loadOrCreateKey(ctx context.Context, client *s3Client, prefix, passphrase string) (*[32]byte, error) {
+	var rk remoteKey
+	body, err := client.get(ctx, prefix+"/key.json")
+	if err == nil {
+		err = json.NewDecoder(io.LimitReader(body, 4096)).Decode(&rk)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		key, err := deriveKey(passphrase, rk.Salt)
+		if err != nil {
+			return nil, err
+		}
+		if len(rk.Check) < nonceLen {
+			return nil, ErrWrongPassphrase
+		}
+		var nonce [nonceLen]byte
+		copy(nonce[:], rk.Check[:nonceLen])
+		plain, ok := secretbox.Open(nil, rk.Check[nonceLen:], &nonce, key)
+		if !ok || string(plain) != checkValue {
+			return nil, ErrWrongPassphrase
+		}
+		return key, nil
+	}
+	if err != errObjectNotFound {
+		return nil, err
+	}
+
+	rk.Version = 1
+	rk.Salt = make([]byte, saltLen)
+	if _, err = io.ReadFull(rand.Reader, rk.Salt); err != nil {
+		return nil, err
+	}
+	key, err := deriveKey(passphrase, rk.Salt)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [nonceLen]byte
+	if _, err = io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	rk.Check = secretbox.Seal(nonce[:], []byte(checkValue), &nonce, key)
+	buf, err := json.Marshal(rk)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.put(ctx, prefix+"/key.json", bytes.NewReader(buf), int64(len(buf))); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func deriveKey(passphrase string, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// decryptSecrets returns the secret key of the bucket and the encryption
+// key of the backups.
+func (c *Config) decryptSecrets(inst *instance.Instance) (*secrets, error) {
+	data, err := accounts.DecryptInstanceCredentialsData(inst, c.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	// The encrypted data is decoded as a map, so it is encoded again to
+	// get the struct.
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var s secrets
+	if err = json.Unmarshal(buf, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
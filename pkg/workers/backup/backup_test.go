@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an in-memory bucket, that checks that the requests are signed.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Path] = body
+	case http.MethodGet:
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(body)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	client := &s3Client{
+		endpoint:  ts.URL,
+		region:    defaultRegion,
+		bucket:    "backups",
+		accessKey: "AKID",
+		secretKey: "secret",
+	}
+	ctx := context.Background()
+
+	key, err := loadOrCreateKey(ctx, client, "alice.cozy.example", "my backup passphrase")
+	require.NoError(t, err)
+	assert.Contains(t, fake.objects, "/backups/alice.cozy.example/key.json")
+
+	same, err := loadOrCreateKey(ctx, client, "alice.cozy.example", "my backup passphrase")
+	require.NoError(t, err)
+	assert.Equal(t, key, same)
+
+	_, err = loadOrCreateKey(ctx, client, "alice.cozy.example", "another passphrase")
+	assert.Equal(t, ErrWrongPassphrase, err)
+
+	other, err := loadOrCreateKey(ctx, client, "bob.cozy.example", "my backup passphrase")
+	require.NoError(t, err)
+	assert.NotEqual(t, key, other)
+
+	client.accessKey = "invalid"
+	_, err = loadOrCreateKey(ctx, client, "alice.cozy.example", "my backup passphrase")
+	assert.Error(t, err)
+}
+
+func TestIsBackedUpDoctype(t *testing.T) {
+	assert.True(t, isBackedUpDoctype("io.cozy.contacts"))
+	assert.True(t, isBackedUpDoctype("io.cozy.settings"))
+	assert.False(t, isBackedUpDoctype("io.cozy.files"))
+	assert.False(t, isBackedUpDoctype("io.cozy.sessions"))
+	assert.False(t, isBackedUpDoctype("io.cozy.backups"))
+}
+
+func TestS3ErrorWithoutBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("internal secret"))
+	}))
+	defer ts.Close()
+	client := &s3Client{
+		endpoint:  ts.URL,
+		region:    defaultRegion,
+		bucket:    "backups",
+		accessKey: "AKID",
+		secretKey: "secret",
+	}
+	_, err := client.get(context.Background(), "alice.cozy.example/key.json")
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "internal secret")
+}
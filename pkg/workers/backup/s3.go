@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/safehttp"
+)
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// errObjectNotFound is returned when an object is not in the bucket.
+var errObjectNotFound = errors.New("backup: object not found")
+
+// httpClient only dials the public IP addresses, as the endpoint is chosen by
+// the user.
+var httpClient = &http.Client{
+	Transport: safehttp.NewTransport(60 * time.Second),
+}
+
+// s3Client is a minimal client for the S3 API: it can only put, get and
+// delete the objects of a bucket, with the path-style URLs. The requests are
+// signed with the AWS signature version 4, and the payload is not signed as
+// it is already authenticated by the encryption.
+type s3Client struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+}
+
+func (c *s3Client) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + c.bucket + "/" + key
+	return u, nil
+}
+
+// put uploads an object. The size must be known, as S3 does not accept the
+// chunked uploads without a signed payload.
+func (c *s3Client) put(ctx context.Context, key string, body io.Reader, size int64) error {
+	res, err := c.do(ctx, http.MethodPut, key, body, size)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// get returns the content of an object. It must be closed by the caller.
+func (c *s3Client) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := c.do(ctx, http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// remove deletes an object. Deleting an object that does not exist is not an
+// error for S3.
+func (c *s3Client) remove(ctx context.Context, key string) error {
+	res, err := c.do(ctx, http.MethodDelete, key, nil, 0)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (c *s3Client) do(ctx context.Context, method, key string, body io.Reader, size int64) (*http.Response, error) {
+	u, err := c.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	c.sign(req, time.Now())
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errObjectNotFound
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		// The body is not put in the error, as it is saved in the config
+		// document and shown to the user.
+		res.Body.Close()
+		return nil, fmt.Errorf("backup: S3 responded with %d", res.StatusCode)
+	}
+	return res, nil
+}
+
+// sign adds the headers of the AWS signature version 4 to the request. See
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + unsignedPayload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,471 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/accounts"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+)
+
+const (
+	// keyID is the id of the encryption key in the header of the objects.
+	keyID = 1
+	// restoreBatchSize is the number of documents restored in one bulk
+	// request.
+	restoreBatchSize = 100
+	manifestVersion  = 1
+)
+
+// manifest is the list of the objects of a backup. The documents of each
+// doctype are in an object named with the checksum of their content, and the
+// content of the files in an object named with their MD5 checksum, so that
+// the objects can be reused by the next backups.
+type manifest struct {
+	Version   int               `json:"version"`
+	Domain    string            `json:"domain"`
+	CreatedAt time.Time         `json:"created_at"`
+	Doctypes  map[string]string `json:"doctypes"`
+	Files     []manifestFile    `json:"files"`
+}
+
+// manifestFile is the metadata of a file, with the checksum of its content.
+type manifestFile struct {
+	Path       string    `json:"path"`
+	MD5Sum     []byte    `json:"md5sum"`
+	Size       int64     `json:"size"`
+	Mime       string    `json:"mime,omitempty"`
+	Class      string    `json:"class,omitempty"`
+	Executable bool      `json:"executable,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// isBackedUpDoctype returns false for the doctypes that are not in the
+// backups: the files are saved with the manifest, and the other ones are
+// linked to the current instance (the sessions, the OAuth clients, etc.).
+func isBackedUpDoctype(doctype string) bool {
+	switch doctype {
+	case consts.Files, consts.Backups, consts.KonnectorLogs, consts.Archives,
+		consts.Sessions, consts.SessionsLogins, consts.OAuthClients,
+		consts.OAuthAccessCodes, consts.OAuthPairingCodes,
+		consts.NotificationDevices, consts.AppPasswords, consts.Jobs,
+		consts.Triggers, consts.TriggersState, consts.Sharings,
+		consts.SharingsAnswer, consts.Shared:
+		return false
+	}
+	return true
+}
+
+// runner makes a backup, or restores the last one, for an instance.
+type runner struct {
+	ctx    *jobs.WorkerContext
+	inst   *instance.Instance
+	conf   *Config
+	client *s3Client
+	keys   *vfscrypt.Keys
+	key    *[32]byte
+}
+
+func (r *runner) init() error {
+	s, err := r.conf.decryptSecrets(r.inst)
+	if err != nil {
+		return err
+	}
+	r.client = &s3Client{
+		endpoint:  r.conf.Endpoint,
+		region:    r.conf.Region,
+		bucket:    r.conf.Bucket,
+		accessKey: r.conf.AccessKeyID,
+		secretKey: s.SecretAccessKey,
+	}
+	r.key = new([32]byte)
+	copy(r.key[:], s.Key)
+	r.keys = vfscrypt.SingleKey(keyID, r.key)
+	return nil
+}
+
+func (r *runner) objectKey(name string) string {
+	return r.conf.Prefix + "/" + name
+}
+
+// backup uploads the documents and the new files, then the manifest, and
+// finally removes the objects that are no longer used.
+func (r *runner) backup() error {
+	previous, err := r.loadManifest()
+	if err != nil && err != errObjectNotFound {
+		return err
+	}
+	if previous == nil {
+		previous = &manifest{}
+	}
+	known := make(map[string]bool)
+	for _, f := range previous.Files {
+		known[hex.EncodeToString(f.MD5Sum)] = true
+	}
+	for _, sum := range previous.Doctypes {
+		known[sum] = true
+	}
+
+	m := &manifest{
+		Version:   manifestVersion,
+		Domain:    r.inst.Domain,
+		CreatedAt: time.Now().UTC(),
+		Doctypes:  make(map[string]string),
+	}
+	r.conf.FilesCount = 0
+	r.conf.TransferredCount = 0
+	r.conf.TransferredBytes = 0
+	if err = r.backupDocs(m, known); err != nil {
+		return err
+	}
+	if err = r.backupFiles(m, known); err != nil {
+		return err
+	}
+	r.conf.FilesCount = len(m.Files)
+
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = r.upload("manifest", bytes.NewReader(buf)); err != nil {
+		return err
+	}
+
+	// The objects of the previous backup that are not used by the new one
+	// can be removed, now that the new manifest has been uploaded.
+	used := make(map[string]bool)
+	for _, f := range m.Files {
+		used[hex.EncodeToString(f.MD5Sum)] = true
+	}
+	for _, sum := range m.Doctypes {
+		used[sum] = true
+	}
+	for sum := range known {
+		if used[sum] {
+			continue
+		}
+		if err = r.client.remove(r.ctx, r.objectKey("objects/"+sum)); err != nil {
+			r.ctx.Logger().WithField("nspace", "backup").
+				Infof("Cannot remove the object %s: %s", sum, err)
+		}
+	}
+	return nil
+}
+
+// backupDocs uploads the documents of each doctype as NDJSON, if they have
+// changed since the last backup.
+func (r *runner) backupDocs(m *manifest, known map[string]bool) error {
+	doctypes, err := couchdb.AllDoctypes(r.inst)
+	if err != nil {
+		return err
+	}
+	for _, doctype := range doctypes {
+		if !isBackedUpDoctype(doctype) {
+			continue
+		}
+		tmp, err := ioutil.TempFile("", "cozy-backup")
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		w := bufio.NewWriter(io.MultiWriter(tmp, h))
+		err = couchdb.ForeachDocs(r.inst, doctype, func(_ string, doc json.RawMessage) error {
+			if doctype == consts.Accounts {
+				var errd error
+				if doc, errd = r.decryptAccount(doc); errd != nil {
+					return errd
+				}
+			}
+			if _, errw := w.Write(doc); errw != nil {
+				return errw
+			}
+			return w.WriteByte('\n')
+		})
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == nil {
+			sum := hex.EncodeToString(h.Sum(nil))
+			m.Doctypes[doctype] = sum
+			if !known[sum] {
+				_, err = tmp.Seek(0, io.SeekStart)
+				if err == nil {
+					err = r.upload("objects/"+sum, tmp)
+				}
+			}
+		}
+		tmp.Close()
+		os.Remove(tmp.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptAccount returns the account with its credentials in clear: they are
+// encrypted with a key derived for the instance, which could not be used by a
+// restore on another instance, or after a rotation of the master secret. The
+// objects in the bucket are encrypted with the key of the backups.
+func (r *runner) decryptAccount(raw json.RawMessage) (json.RawMessage, error) {
+	var doc couchdb.JSONDoc
+	if err := json.Unmarshal(raw, &doc.M); err != nil {
+		return nil, err
+	}
+	doc.Type = consts.Accounts
+	accounts.DecryptAccount(r.inst, doc)
+	return json.Marshal(doc.M)
+}
+
+// backupFiles adds the files to the manifest, and uploads the content of the
+// files that are not already in the bucket. The trash is not saved.
+func (r *runner) backupFiles(m *manifest, known map[string]bool) error {
+	fs := r.inst.VFS()
+	return vfs.Walk(fs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = r.ctx.Err(); err != nil {
+			return err
+		}
+		if dir != nil {
+			if dir.DocID == consts.TrashDirID {
+				return vfs.ErrSkipDir
+			}
+			return nil
+		}
+		m.Files = append(m.Files, manifestFile{
+			Path:       name,
+			MD5Sum:     file.MD5Sum,
+			Size:       file.ByteSize,
+			Mime:       file.Mime,
+			Class:      file.Class,
+			Executable: file.Executable,
+			Tags:       file.Tags,
+			CreatedAt:  file.CreatedAt,
+			UpdatedAt:  file.UpdatedAt,
+		})
+		sum := hex.EncodeToString(file.MD5Sum)
+		if known[sum] {
+			return nil
+		}
+		content, err := fs.OpenFile(file)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		if err = r.upload("objects/"+sum, content); err != nil {
+			return err
+		}
+		known[sum] = true
+		r.conf.TransferredCount++
+		r.conf.TransferredBytes += file.ByteSize
+		return nil
+	})
+}
+
+// upload encrypts the content in a temporary file, as the size of the
+// object must be known before sending it, and uploads it.
+func (r *runner) upload(name string, content io.Reader) error {
+	tmp, err := ioutil.TempFile("", "cozy-backup")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	w, err := vfscrypt.NewWriter(tmp, keyID, r.key)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, content); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return r.client.put(r.ctx, r.objectKey(name), tmp, size)
+}
+
+// download fetches an object in a temporary file, and returns a reader for
+// its decrypted content. The file is removed when the reader is closed.
+func (r *runner) download(name string) (*decryptedFile, error) {
+	body, err := r.client.get(r.ctx, r.objectKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	tmp, err := ioutil.TempFile("", "cozy-backup")
+	if err != nil {
+		return nil, err
+	}
+	f := &decryptedFile{tmp: tmp}
+	size, err := io.Copy(tmp, body)
+	if err == nil {
+		f.Reader, err = vfscrypt.NewReader(tmp, size, r.keys)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+type decryptedFile struct {
+	*vfscrypt.Reader
+	tmp *os.File
+}
+
+func (f *decryptedFile) Close() error {
+	err := f.tmp.Close()
+	os.Remove(f.tmp.Name())
+	return err
+}
+
+func (r *runner) loadManifest() (*manifest, error) {
+	f, err := r.download("manifest")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m manifest
+	if err = json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// restore puts back the documents and the files of the last backup. The
+// documents are restored with their revisions, so a document modified since
+// the backup keeps its newer version. The files are recreated at their path,
+// and a file with the same content is left untouched.
+func (r *runner) restore() error {
+	m, err := r.loadManifest()
+	if err != nil {
+		return err
+	}
+	for doctype, sum := range m.Doctypes {
+		if err = r.restoreDocs(doctype, sum); err != nil {
+			return err
+		}
+	}
+	r.conf.FilesCount = len(m.Files)
+	r.conf.TransferredCount = 0
+	r.conf.TransferredBytes = 0
+	for _, file := range m.Files {
+		if err = r.ctx.Err(); err != nil {
+			return err
+		}
+		if err = r.restoreFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *runner) restoreDocs(doctype, sum string) error {
+	f, err := r.download("objects/" + sum)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = couchdb.CreateDB(r.inst, doctype); err != nil && !couchdb.IsFileExists(err) {
+		return err
+	}
+	docs := make([]map[string]interface{}, 0, restoreBatchSize)
+	dec := json.NewDecoder(f)
+	for {
+		var doc map[string]interface{}
+		err = dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if doctype == consts.Accounts {
+			// The credentials are in clear in the backup, and must be
+			// encrypted with the key of the instance.
+			if _, err = accounts.EncryptAccount(r.inst, couchdb.JSONDoc{M: doc, Type: doctype}); err != nil {
+				return err
+			}
+		}
+		docs = append(docs, doc)
+		if len(docs) < restoreBatchSize {
+			continue
+		}
+		if err = couchdb.BulkForceUpdateDocs(r.inst, doctype, docs); err != nil {
+			return err
+		}
+		docs = docs[:0]
+	}
+	return couchdb.BulkForceUpdateDocs(r.inst, doctype, docs)
+}
+
+func (r *runner) restoreFile(file manifestFile) error {
+	fs := r.inst.VFS()
+	olddoc, err := fs.FileByPath(file.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if olddoc != nil && bytes.Equal(olddoc.MD5Sum, file.MD5Sum) {
+		return nil
+	}
+	dir, err := vfs.MkdirAll(fs, path.Dir(file.Path))
+	if err != nil {
+		return err
+	}
+	newdoc, err := vfs.NewFileDoc(path.Base(file.Path), dir.ID(), file.Size,
+		file.MD5Sum, file.Mime, file.Class, file.UpdatedAt, file.Executable,
+		false, file.Tags)
+	if err != nil {
+		return err
+	}
+	newdoc.CreatedAt = file.CreatedAt
+	if err = vfs.InheritEncryption(fs, newdoc); err != nil {
+		return err
+	}
+
+	content, err := r.download("objects/" + hex.EncodeToString(file.MD5Sum))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	f, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	r.conf.TransferredCount++
+	r.conf.TransferredBytes += file.Size
+	return nil
+}
@@ -0,0 +1,346 @@
+// Package classification is for the worker that qualifies the administrative
+// documents uploaded by the user: invoices, payslips, tax notices and
+// identity documents. The class is guessed with some heuristics on the name
+// and the text of the file, or by an external classifier if one has been
+// configured.
+package classification
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/contacts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/workers/ocr"
+)
+
+// The labels of the classes of documents
+const (
+	LabelInvoice  = "invoice"
+	LabelPayslip  = "payslip"
+	LabelTax      = "tax_notice"
+	LabelIdentity = "identity_document"
+)
+
+const (
+	// SourceHeuristics is the source of the qualifications guessed by the
+	// heuristics of the stack
+	SourceHeuristics = "heuristics"
+	// SourceClassifier is the source of the qualifications given by the
+	// external classifier
+	SourceClassifier = "classifier"
+)
+
+// MetadataKey is the key of the metadata of the files where the class of the
+// document is saved.
+const MetadataKey = "qualification"
+
+const (
+	// classifierTimeout is the maximal duration of a request to the external
+	// classifier
+	classifierTimeout = 30 * time.Second
+	// maxClassifierText is the maximal number of bytes of the text sent to
+	// the external classifier
+	maxClassifierText = 10 * 1024
+	// minConfidence is the confidence under which the class given by the
+	// external classifier is ignored
+	minConfidence = 0.5
+	// maxContacts is the maximal number of contacts referenced by a document
+	maxContacts = 5
+	// minNameLength is the minimal length of the name of a contact to look
+	// for it in the text, to avoid false positives with short names
+	minNameLength = 6
+)
+
+// rule is a list of keywords for a class of documents. The keywords are in
+// lower case, and the keywords found in the name of the file count more than
+// those found in its text.
+type rule struct {
+	Label    string
+	Keywords []string
+}
+
+var rules = []rule{
+	{Label: LabelInvoice, Keywords: []string{
+		"facture", "invoice", "rechnung", "factura", "montant ttc", "total ttc", "amount due",
+	}},
+	{Label: LabelPayslip, Keywords: []string{
+		"bulletin de paie", "bulletin de salaire", "fiche de paie", "payslip", "pay slip",
+		"salaire net", "net à payer", "net a payer", "gehaltsabrechnung",
+	}},
+	{Label: LabelTax, Keywords: []string{
+		"avis d'impôt", "avis d'impot", "avis d'imposition", "impots.gouv.fr",
+		"revenu fiscal de référence", "tax notice", "tax assessment", "steuerbescheid",
+	}},
+	{Label: LabelIdentity, Keywords: []string{
+		"carte nationale d'identité", "carte d'identité", "carte d'identite", "passeport",
+		"passport", "identity card", "titre de séjour", "personalausweis",
+	}},
+}
+
+// nameWeight is the weight of a keyword found in the name of a file
+const nameWeight = 3
+
+// Qualification is the class of a document, saved in its metadata.
+type Qualification struct {
+	Label      string  `json:"label"`
+	Source     string  `json:"source"`
+	Confidence float64 `json:"confidence,omitempty"`
+}
+
+type fileEvent struct {
+	Verb   string       `json:"verb"`
+	Doc    vfs.FileDoc  `json:"doc"`
+	OldDoc *vfs.FileDoc `json:"old,omitempty"`
+}
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "classification",
+		Concurrency:  1,
+		MaxExecCount: 2,
+		Timeout:      time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that qualifies a document, and references the contacts
+// mentioned in it. It runs when a file is uploaded, and when its text has
+// been extracted by the OCR.
+func Worker(ctx *jobs.WorkerContext) error {
+	var event fileEvent
+	if err := ctx.UnmarshalEvent(&event); err != nil {
+		return err
+	}
+	if event.Doc.Trashed || event.Doc.Encrypted {
+		return nil
+	}
+	if event.OldDoc != nil && !needClassification(&event.Doc, event.OldDoc) {
+		return nil
+	}
+	if isQualifiedByUser(&event.Doc) {
+		return nil
+	}
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+
+	// The file may have changed since the event
+	fs := i.VFS()
+	doc, err := fs.FileByID(event.Doc.ID())
+	if err != nil {
+		return err
+	}
+	if doc.Rev() != event.Doc.Rev() {
+		return nil
+	}
+
+	text := extractedText(doc)
+	q, err := qualifyWithClassifier(doc, text)
+	if err != nil {
+		ctx.Logger().WithField("nspace", "classification").
+			Warnf("Cannot use the classifier for %s: %s", doc.ID(), err)
+	}
+	if q == nil {
+		q = qualifyWithHeuristics(doc.DocName, text)
+	}
+
+	var refs []couchdb.DocReference
+	if q != nil && text != "" {
+		list, err := contacts.GetAll(i)
+		if err != nil {
+			return err
+		}
+		for _, id := range mentionedContacts(text, list) {
+			ref := couchdb.DocReference{Type: consts.Contacts, ID: id}
+			if !containsRef(doc.ReferencedBy, ref) {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	if q == nil && len(refs) == 0 {
+		return nil
+	}
+
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	if q != nil {
+		if newdoc.Metadata == nil {
+			newdoc.Metadata = vfs.NewMetadata()
+		}
+		newdoc.Metadata[MetadataKey] = q
+	}
+	newdoc.AddReferencedBy(refs...)
+	return fs.UpdateFileDoc(doc, newdoc)
+}
+
+// needClassification returns true if the content of the file has changed, or
+// if its text has just been extracted.
+func needClassification(doc, old *vfs.FileDoc) bool {
+	if doc.Trashed != old.Trashed {
+		return true
+	}
+	if doc.ByteSize != old.ByteSize || !bytes.Equal(doc.MD5Sum, old.MD5Sum) {
+		return true
+	}
+	return extractedText(doc) != extractedText(old)
+}
+
+// isQualifiedByUser returns true if the document has a qualification that
+// has not been set by this worker: it must be kept.
+func isQualifiedByUser(doc *vfs.FileDoc) bool {
+	q, ok := doc.Metadata[MetadataKey].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	source, _ := q["source"].(string)
+	return source != SourceHeuristics && source != SourceClassifier
+}
+
+// extractedText returns the text of the document, extracted by the OCR.
+func extractedText(doc *vfs.FileDoc) string {
+	switch o := doc.Metadata[ocr.MetadataKey].(type) {
+	case map[string]interface{}:
+		text, _ := o["text"].(string)
+		return text
+	case map[string]string:
+		return o["text"]
+	}
+	return ""
+}
+
+// qualifyWithHeuristics returns the class of the document with the most
+// keywords found in its name and its text, or nil if no keyword is found.
+func qualifyWithHeuristics(name, text string) *Qualification {
+	name = strings.ToLower(strings.NewReplacer("_", " ", "-", " ").Replace(name))
+	text = strings.ToLower(text)
+	best, bestScore := "", 0
+	for _, r := range rules {
+		score := 0
+		for _, keyword := range r.Keywords {
+			if strings.Contains(name, keyword) {
+				score += nameWeight
+			}
+			if strings.Contains(text, keyword) {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = r.Label, score
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return &Qualification{Label: best, Source: SourceHeuristics}
+}
+
+type classifierRequest struct {
+	Name string `json:"name"`
+	Mime string `json:"mime"`
+	Text string `json:"text"`
+}
+
+type classifierResponse struct {
+	Label      string  `json:"label"`
+	Confidence float64 `json:"confidence"`
+}
+
+// qualifyWithClassifier asks the external classifier for the class of the
+// document. It returns nil if no classifier has been configured, or if it has
+// no confident answer.
+func qualifyWithClassifier(doc *vfs.FileDoc, text string) (*Qualification, error) {
+	classifierURL := config.GetConfig().Jobs.ClassifierURL
+	if classifierURL == "" {
+		return nil, nil
+	}
+	if len(text) > maxClassifierText {
+		text = text[:maxClassifierText]
+	}
+	body, err := json.Marshal(&classifierRequest{
+		Name: doc.DocName,
+		Mime: doc.Mime,
+		Text: text,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: classifierTimeout}
+	res, err := client.Post(classifierURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status code %d", res.StatusCode)
+	}
+	var answer classifierResponse
+	if err = json.NewDecoder(res.Body).Decode(&answer); err != nil {
+		return nil, err
+	}
+	if answer.Label == "" || answer.Confidence < minConfidence {
+		return nil, nil
+	}
+	if !isKnownLabel(answer.Label) {
+		return nil, errors.New("Unknown label " + answer.Label)
+	}
+	return &Qualification{
+		Label:      answer.Label,
+		Source:     SourceClassifier,
+		Confidence: answer.Confidence,
+	}, nil
+}
+
+func isKnownLabel(label string) bool {
+	for _, r := range rules {
+		if r.Label == label {
+			return true
+		}
+	}
+	return false
+}
+
+// mentionedContacts returns the identifiers of the contacts whose email
+// address or full name is in the text.
+func mentionedContacts(text string, list []*contacts.Contact) []string {
+	text = strings.ToLower(text)
+	var ids []string
+	for _, c := range list {
+		if len(ids) == maxContacts {
+			break
+		}
+		found := false
+		for _, email := range c.Email {
+			if email.Address != "" && strings.Contains(text, strings.ToLower(email.Address)) {
+				found = true
+			}
+		}
+		name := strings.ToLower(strings.TrimSpace(c.PrimaryName()))
+		if len(name) >= minNameLength && strings.Contains(name, " ") && strings.Contains(text, name) {
+			found = true
+		}
+		if found {
+			ids = append(ids, c.ID())
+		}
+	}
+	return ids
+}
+
+func containsRef(refs []couchdb.DocReference, ref couchdb.DocReference) bool {
+	for _, r := range refs {
+		if r.ID == ref.ID && r.Type == ref.Type {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package classification
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/contacts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQualifyWithHeuristics(t *testing.T) {
+	q := qualifyWithHeuristics("Facture_EDF_2019-03.pdf", "")
+	if assert.NotNil(t, q) {
+		assert.Equal(t, LabelInvoice, q.Label)
+		assert.Equal(t, SourceHeuristics, q.Source)
+	}
+
+	q = qualifyWithHeuristics("scan.pdf", "BULLETIN DE PAIE\nSalaire net: 2000€\nNet à payer: 1980€")
+	if assert.NotNil(t, q) {
+		assert.Equal(t, LabelPayslip, q.Label)
+	}
+
+	// The name counts more than the text
+	q = qualifyWithHeuristics("avis d'imposition 2018.pdf", "Montant TTC")
+	if assert.NotNil(t, q) {
+		assert.Equal(t, LabelTax, q.Label)
+	}
+
+	assert.Nil(t, qualifyWithHeuristics("holidays.jpg", "A beautiful beach"))
+}
+
+func TestIsQualifiedByUser(t *testing.T) {
+	doc := &vfs.FileDoc{}
+	assert.False(t, isQualifiedByUser(doc))
+	doc.Metadata = vfs.Metadata{MetadataKey: map[string]interface{}{
+		"label":  LabelInvoice,
+		"source": SourceHeuristics,
+	}}
+	assert.False(t, isQualifiedByUser(doc))
+	doc.Metadata = vfs.Metadata{MetadataKey: map[string]interface{}{
+		"label": LabelPayslip,
+	}}
+	assert.True(t, isQualifiedByUser(doc))
+}
+
+func TestMentionedContacts(t *testing.T) {
+	list := []*contacts.Contact{
+		{DocID: "alice", FullName: "Alice Martin"},
+		{DocID: "bob", Email: []contacts.Email{{Address: "bob@example.net"}}},
+		{DocID: "eve", FullName: "Eve"},
+	}
+	text := "Employee: ALICE MARTIN\nContact: bob@example.net\nEvent: 2019"
+	assert.Equal(t, []string{"alice", "bob"}, mentionedContacts(text, list))
+	assert.Empty(t, mentionedContacts("nothing here", list))
+}
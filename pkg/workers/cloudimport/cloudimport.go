@@ -0,0 +1,379 @@
+// Package cloudimport is for the import of the files of a cloud storage
+// service, like Google Drive or Dropbox, in the VFS of an instance. The
+// remote tree is walked with the OAuth token of an account, and the files are
+// copied with their folders and their dates.
+package cloudimport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// The states of an import
+const (
+	StateRunning = "running"
+	StateDone    = "done"
+	StateErrored = "errored"
+)
+
+// saveEvery is the number of files imported between two saves of the
+// progress of an import.
+const saveEvery = 50
+
+var (
+	// ErrUnknownProvider is used when an import is asked for a service that
+	// is not supported.
+	ErrUnknownProvider = errors.New("Unknown provider")
+	// ErrAccountWithoutToken is used when the account of an import has no
+	// OAuth token.
+	ErrAccountWithoutToken = errors.New("The account has no OAuth token")
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "cloud-import",
+		Concurrency:  4,
+		MaxExecCount: 3,
+		Timeout:      24 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Folder is a remote folder that has still to be imported, with the
+// directory where its content is copied.
+type Folder struct {
+	RemoteID string `json:"remote_id"`
+	DirID    string `json:"dir_id"`
+}
+
+// Import is the document for the import of the files of an account. The
+// remote folders that have not been imported are kept in the queue, so that
+// the import can be resumed where it has stopped.
+type Import struct {
+	DocID        string    `json:"_id,omitempty"`
+	DocRev       string    `json:"_rev,omitempty"`
+	Provider     string    `json:"provider"`
+	AccountID    string    `json:"account"`
+	DirID        string    `json:"dir_id"`
+	State        string    `json:"state"`
+	Error        string    `json:"error,omitempty"`
+	FilesCount   int       `json:"files_count"`
+	BytesCount   int64     `json:"bytes_count"`
+	SkippedCount int       `json:"skipped_count"`
+	FailedCount  int       `json:"failed_count"`
+	Queue        []Folder  `json:"queue,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ID returns the import identifier
+func (imp *Import) ID() string { return imp.DocID }
+
+// Rev returns the import revision
+func (imp *Import) Rev() string { return imp.DocRev }
+
+// DocType returns the import document type
+func (imp *Import) DocType() string { return consts.FilesImports }
+
+// Clone implements couchdb.Doc
+func (imp *Import) Clone() couchdb.Doc {
+	cloned := *imp
+	cloned.Queue = make([]Folder, len(imp.Queue))
+	copy(cloned.Queue, imp.Queue)
+	return &cloned
+}
+
+// SetID changes the import identifier
+func (imp *Import) SetID(id string) { imp.DocID = id }
+
+// SetRev changes the import revision
+func (imp *Import) SetRev(rev string) { imp.DocRev = rev }
+
+// Options is the option handler for the import worker.
+type Options struct {
+	ImportID string `json:"import_id"`
+}
+
+// Start creates the document of an import, and pushes the job that copies
+// the files of the account in the directory.
+func Start(inst *instance.Instance, provider, accountID, dirID string) (*Import, error) {
+	p, ok := providers[provider]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	now := time.Now().UTC()
+	imp := &Import{
+		Provider:  provider,
+		AccountID: accountID,
+		DirID:     dirID,
+		State:     StateRunning,
+		Queue:     []Folder{{RemoteID: p.root, DirID: dirID}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := couchdb.CreateDoc(inst, imp); err != nil {
+		return nil, err
+	}
+	msg, err := jobs.NewMessage(&Options{ImportID: imp.ID()})
+	if err != nil {
+		return nil, err
+	}
+	_, err = jobs.System().PushJob(inst, &jobs.JobRequest{
+		WorkerType: "cloud-import",
+		Message:    msg,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return imp, nil
+}
+
+// Get returns the import with the given identifier.
+func Get(inst *instance.Instance, id string) (*Import, error) {
+	var imp Import
+	if err := couchdb.GetDoc(inst, consts.FilesImports, id, &imp); err != nil {
+		return nil, err
+	}
+	return &imp, nil
+}
+
+// Worker is the worker method to import the files of an account. If the job
+// fails, it is retried from the folders that have not been imported.
+func Worker(ctx *jobs.WorkerContext) error {
+	var opts Options
+	if err := ctx.UnmarshalMessage(&opts); err != nil {
+		return err
+	}
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	imp, err := Get(inst, opts.ImportID)
+	if err != nil {
+		return err
+	}
+	if imp.State == StateDone {
+		return nil
+	}
+	imp.State = StateRunning
+	imp.Error = ""
+
+	err = runImport(ctx, inst, imp)
+	if err == vfs.ErrFileTooBig {
+		ctx.SetNoRetry()
+	}
+	if err != nil {
+		imp.State = StateErrored
+		imp.Error = err.Error()
+	} else {
+		imp.State = StateDone
+	}
+	if errs := saveImport(inst, imp); errs != nil {
+		ctx.Logger().WithField("nspace", "cloud-import").
+			Errorf("Cannot save the import %s: %s", imp.ID(), errs)
+	}
+	return err
+}
+
+// importer copies the files of an account in the VFS of an instance.
+type importer struct {
+	ctx  *jobs.WorkerContext
+	inst *instance.Instance
+	fs   vfs.VFS
+	p    *provider
+	c    *client
+	imp  *Import
+}
+
+func runImport(ctx *jobs.WorkerContext, inst *instance.Instance, imp *Import) error {
+	p, ok := providers[imp.Provider]
+	if !ok {
+		return ErrUnknownProvider
+	}
+	c, err := newClient(inst, imp.AccountID)
+	if err != nil {
+		return err
+	}
+	im := &importer{ctx: ctx, inst: inst, fs: inst.VFS(), p: p, c: c, imp: imp}
+	for len(imp.Queue) > 0 {
+		subfolders, err := im.importFolder(imp.Queue[0])
+		if err != nil {
+			return err
+		}
+		// The subfolders are added to the queue only when all the files of
+		// the folder have been imported: if the job is interrupted, the
+		// folder is imported again, and the files already there are skipped.
+		imp.Queue = append(imp.Queue[1:], subfolders...)
+		if err = saveImport(inst, imp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveImport(inst *instance.Instance, imp *Import) error {
+	imp.UpdatedAt = time.Now().UTC()
+	return couchdb.UpdateDoc(inst, imp)
+}
+
+// importFolder copies the files of a remote folder, and returns the remote
+// subfolders, with the directories created for them.
+func (im *importer) importFolder(folder Folder) ([]Folder, error) {
+	parent, err := im.fs.DirByID(folder.DirID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := im.p.list(im.ctx, im.c, folder.RemoteID)
+	if err != nil {
+		return nil, err
+	}
+
+	var subfolders []Folder
+	imported := 0
+	for _, entry := range entries {
+		if err = im.ctx.Err(); err != nil {
+			return nil, err
+		}
+		if entry.Dir {
+			dir, err := im.findOrCreateDir(parent, entry)
+			if err != nil {
+				return nil, err
+			}
+			subfolders = append(subfolders, Folder{RemoteID: entry.ID, DirID: dir.ID()})
+			continue
+		}
+		err = im.importFile(parent, entry)
+		if err == vfs.ErrFileTooBig || err == context.Canceled || err == context.DeadlineExceeded {
+			return nil, err
+		}
+		if err != nil {
+			im.imp.FailedCount++
+			im.ctx.Logger().WithField("nspace", "cloud-import").
+				Infof("Cannot import the file %s: %s", entry.ID, err)
+		}
+		if imported++; imported%saveEvery == 0 {
+			if err = saveImport(im.inst, im.imp); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return subfolders, nil
+}
+
+func (im *importer) findOrCreateDir(parent *vfs.DirDoc, entry *remoteEntry) (*vfs.DirDoc, error) {
+	name := safeName(entry.Name)
+	dir, err := im.fs.DirByPath(path.Join(parent.Fullpath, name))
+	if err == nil {
+		return dir, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	dir, err = vfs.NewDirDoc(im.fs, name, parent.ID(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.ModTime.IsZero() {
+		dir.CreatedAt = entry.ModTime
+		dir.UpdatedAt = entry.ModTime
+	}
+	if err = im.fs.CreateDir(dir); err != nil {
+		return nil, err
+	}
+	return dir, nil
+}
+
+// importFile copies a remote file in the directory. A file with the same
+// name and the same size is considered as already imported.
+func (im *importer) importFile(parent *vfs.DirDoc, entry *remoteEntry) error {
+	name := safeName(entry.Name)
+	for i := 2; ; i++ {
+		existing, err := im.fs.FileByPath(path.Join(parent.Fullpath, name))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Size >= 0 && existing.ByteSize == entry.Size {
+			im.imp.SkippedCount++
+			return nil
+		}
+		ext := path.Ext(name)
+		name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(safeName(entry.Name), ext), i, ext)
+	}
+
+	body, err := im.p.download(im.ctx, im.c, entry)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	mime, class := vfs.ExtractMimeAndClass(entry.Mime)
+	if entry.Mime == "" || mime == "application/octet-stream" {
+		mime, class = vfs.ExtractMimeAndClassFromFilename(name)
+	}
+	mtime := entry.ModTime
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	doc, err := vfs.NewFileDoc(name, parent.ID(), entry.Size, nil, mime, class,
+		mtime, false, false, nil)
+	if err != nil {
+		return err
+	}
+	if err = vfs.InheritEncryption(im.fs, doc); err != nil {
+		return err
+	}
+	file, err := im.fs.CreateFile(doc, nil)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(file, &contextReader{ctx: im.ctx, r: body})
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	im.imp.FilesCount++
+	im.imp.BytesCount += n
+	return nil
+}
+
+// contextReader is a reader that stops when the context is done, to not
+// continue the download of a big file after the timeout of the job.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// safeName replaces the characters that are forbidden in the names of the
+// files and directories of the VFS.
+func safeName(name string) string {
+	name = strings.Replace(name, "/", "_", -1)
+	name = strings.Replace(name, "\x00", "", -1)
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,20 @@
+package cloudimport
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafeName(t *testing.T) {
+	assert.Equal(t, "report.pdf", safeName("report.pdf"))
+	assert.Equal(t, "2019_2020 budget.ods", safeName("2019/2020 budget.ods"))
+	assert.Equal(t, "_", safeName(""))
+	assert.Equal(t, "_..", safeName(".."))
+}
+
+func TestIsValidProvider(t *testing.T) {
+	assert.True(t, IsValidProvider("google_drive"))
+	assert.True(t, IsValidProvider("dropbox"))
+	assert.False(t, IsValidProvider("onedrive"))
+}
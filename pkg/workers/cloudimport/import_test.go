@@ -0,0 +1,207 @@
+package cloudimport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/accounts"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var inst *instance.Instance
+
+var errBrokenFolder = errors.New("broken folder")
+
+// fakeContents are the contents of the files of the fake provider, and the
+// entries are its tree, by the identifiers of the remote folders.
+var fakeContents = map[string]string{
+	"file-a": "hello",
+	"file-b": "slash in the name",
+	"file-d": "in a subfolder",
+}
+
+var fakeEntries = map[string][]*remoteEntry{
+	"root": {
+		{ID: "folder-photos", Name: "Photos", Dir: true},
+		{ID: "file-a", Name: "a.txt", Size: 5, Mime: "text/plain"},
+		{ID: "file-b", Name: "b/c.txt", Size: 17},
+		{ID: "file-missing", Name: "missing.txt", Size: 3},
+	},
+	"folder-photos": {
+		{ID: "file-d", Name: "d.txt", Size: 14, ModTime: time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)},
+	},
+}
+
+func init() {
+	providers["fake"] = &provider{
+		root: "root",
+		list: func(ctx context.Context, c *client, folder string) ([]*remoteEntry, error) {
+			if folder == "broken" {
+				return nil, errBrokenFolder
+			}
+			return fakeEntries[folder], nil
+		},
+		download: func(ctx context.Context, c *client, entry *remoteEntry) (io.ReadCloser, error) {
+			content, ok := fakeContents[entry.ID]
+			if !ok {
+				return nil, errors.New("not found")
+			}
+			return ioutil.NopCloser(strings.NewReader(content)), nil
+		},
+	}
+}
+
+func createAccount(t *testing.T, token string) string {
+	acc := &accounts.Account{
+		AccountType: "fake",
+		Oauth:       &accounts.OauthInfo{AccessToken: token},
+	}
+	require.NoError(t, couchdb.CreateDoc(inst, acc))
+	return acc.ID()
+}
+
+func createImport(t *testing.T, provider, accountID, dirPath, remoteRoot string) *Import {
+	dir, err := vfs.MkdirAll(inst.VFS(), dirPath)
+	require.NoError(t, err)
+	imp := &Import{
+		Provider:  provider,
+		AccountID: accountID,
+		DirID:     dir.ID(),
+		State:     StateRunning,
+		Queue:     []Folder{{RemoteID: remoteRoot, DirID: dir.ID()}},
+		CreatedAt: time.Now(),
+	}
+	require.NoError(t, couchdb.CreateDoc(inst, imp))
+	return imp
+}
+
+func runWorker(t *testing.T, importID string) error {
+	msg, err := jobs.NewMessage(&Options{ImportID: importID})
+	require.NoError(t, err)
+	job := jobs.NewJob(inst, &jobs.JobRequest{WorkerType: "cloud-import", Message: msg})
+	return Worker(jobs.NewWorkerContext("id", job))
+}
+
+func readFile(t *testing.T, name string) string {
+	fs := inst.VFS()
+	doc, err := fs.FileByPath(name)
+	require.NoError(t, err)
+	f, err := fs.OpenFile(doc)
+	require.NoError(t, err)
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestImport(t *testing.T) {
+	accountID := createAccount(t, "token")
+	imp := createImport(t, "fake", accountID, "/Fake", "root")
+	require.NoError(t, runWorker(t, imp.ID()))
+
+	imp, err := Get(inst, imp.ID())
+	require.NoError(t, err)
+	assert.Equal(t, StateDone, imp.State)
+	assert.Empty(t, imp.Error)
+	assert.Empty(t, imp.Queue)
+	assert.Equal(t, 3, imp.FilesCount)
+	assert.EqualValues(t, 5+17+14, imp.BytesCount)
+	assert.Equal(t, 1, imp.FailedCount)
+	assert.Equal(t, 0, imp.SkippedCount)
+
+	assert.Equal(t, "hello", readFile(t, "/Fake/a.txt"))
+	assert.Equal(t, "slash in the name", readFile(t, "/Fake/b_c.txt"))
+	assert.Equal(t, "in a subfolder", readFile(t, "/Fake/Photos/d.txt"))
+	d, err := inst.VFS().FileByPath("/Fake/Photos/d.txt")
+	require.NoError(t, err)
+	assert.True(t, d.UpdatedAt.Equal(time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)))
+	_, err = inst.VFS().FileByPath("/Fake/missing.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	// A finished import is not done again
+	require.NoError(t, runWorker(t, imp.ID()))
+	again, err := Get(inst, imp.ID())
+	require.NoError(t, err)
+	assert.Equal(t, imp.Rev(), again.Rev())
+
+	// When an import is resumed, the files already imported are skipped, and
+	// a file with the same name but another size is renamed
+	fakeContents["file-a"] = "hello world"
+	fakeEntries["root"][1].Size = 11
+	defer func() {
+		fakeContents["file-a"] = "hello"
+		fakeEntries["root"][1].Size = 5
+	}()
+	again.State = StateErrored
+	again.Queue = []Folder{{RemoteID: "root", DirID: again.DirID}}
+	require.NoError(t, couchdb.UpdateDoc(inst, again))
+	require.NoError(t, runWorker(t, again.ID()))
+	again, err = Get(inst, again.ID())
+	require.NoError(t, err)
+	assert.Equal(t, StateDone, again.State)
+	assert.Equal(t, 4, again.FilesCount)
+	assert.Equal(t, 2, again.SkippedCount)
+	assert.Equal(t, "hello", readFile(t, "/Fake/a.txt"))
+	assert.Equal(t, "hello world", readFile(t, "/Fake/a (2).txt"))
+}
+
+func TestImportErrors(t *testing.T) {
+	// The account has no token
+	accountID := createAccount(t, "")
+	imp := createImport(t, "fake", accountID, "/Without token", "root")
+	assert.Equal(t, ErrAccountWithoutToken, runWorker(t, imp.ID()))
+	imp, err := Get(inst, imp.ID())
+	require.NoError(t, err)
+	assert.Equal(t, StateErrored, imp.State)
+	assert.Equal(t, ErrAccountWithoutToken.Error(), imp.Error)
+	assert.Len(t, imp.Queue, 1)
+
+	// The account does not exist
+	imp = createImport(t, "fake", "no-such-account", "/No account", "root")
+	err = runWorker(t, imp.ID())
+	assert.True(t, couchdb.IsNotFoundError(err))
+
+	// The provider is unknown
+	accountID = createAccount(t, "token")
+	imp = createImport(t, "onedrive", accountID, "/Onedrive", "root")
+	assert.Equal(t, ErrUnknownProvider, runWorker(t, imp.ID()))
+	_, err = Start(inst, "onedrive", accountID, consts.RootDirID)
+	assert.Equal(t, ErrUnknownProvider, err)
+
+	// The listing of a folder fails, the folder is kept in the queue
+	imp = createImport(t, "fake", accountID, "/Broken", "broken")
+	assert.Equal(t, errBrokenFolder, runWorker(t, imp.ID()))
+	imp, err = Get(inst, imp.ID())
+	require.NoError(t, err)
+	assert.Equal(t, StateErrored, imp.State)
+	assert.Equal(t, errBrokenFolder.Error(), imp.Error)
+	if assert.Len(t, imp.Queue, 1) {
+		assert.Equal(t, "broken", imp.Queue[0].RemoteID)
+	}
+
+	// The import does not exist
+	err = runWorker(t, "no-such-import")
+	assert.True(t, couchdb.IsNotFoundError(err))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "cloudimport_test")
+	inst = setup.GetTestInstance()
+	os.Exit(setup.Run())
+}
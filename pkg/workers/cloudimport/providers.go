@@ -0,0 +1,323 @@
+package cloudimport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/accounts"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+)
+
+const (
+	googleDriveAPI     = "https://www.googleapis.com/drive/v3"
+	dropboxAPI         = "https://api.dropboxapi.com/2"
+	dropboxContentAPI  = "https://content.dropboxapi.com/2"
+	googleFolderMime   = "application/vnd.google-apps.folder"
+	googleAppsMimePref = "application/vnd.google-apps."
+)
+
+// The downloads can be long for the big files, so there is no global timeout,
+// only for the beginning of the response.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	},
+}
+
+// remoteEntry is a file or a folder of the cloud storage service. The size is
+// -1 when it is not known in advance, like for the exported documents.
+type remoteEntry struct {
+	ID      string
+	Name    string
+	Dir     bool
+	Size    int64
+	Mime    string
+	ModTime time.Time
+	export  string
+}
+
+// provider is a cloud storage service from where the files can be imported.
+type provider struct {
+	root     string
+	list     func(ctx context.Context, c *client, folder string) ([]*remoteEntry, error)
+	download func(ctx context.Context, c *client, entry *remoteEntry) (io.ReadCloser, error)
+}
+
+var providers = map[string]*provider{
+	"google_drive": {root: "root", list: googleList, download: googleDownload},
+	"dropbox":      {root: "", list: dropboxList, download: dropboxDownload},
+}
+
+// IsValidProvider returns true if the files can be imported from this
+// provider.
+func IsValidProvider(provider string) bool {
+	_, ok := providers[provider]
+	return ok
+}
+
+// client sends the requests to a provider, with the OAuth token of an
+// account.
+type client struct {
+	inst      *instance.Instance
+	accountID string
+	token     string
+}
+
+func newClient(inst *instance.Instance, accountID string) (*client, error) {
+	var acc accounts.Account
+	if err := couchdb.GetDoc(inst, consts.Accounts, accountID, &acc); err != nil {
+		return nil, err
+	}
+	if acc.Oauth == nil || acc.Oauth.AccessToken == "" {
+		return nil, ErrAccountWithoutToken
+	}
+	c := &client{inst: inst, accountID: accountID, token: acc.Oauth.AccessToken}
+	if !acc.Oauth.ExpiresAt.IsZero() && time.Now().After(acc.Oauth.ExpiresAt.Add(-time.Minute)) {
+		if err := c.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// refresh asks a new access token with the refresh token of the account, and
+// saves it in the account for the next uses.
+func (c *client) refresh() error {
+	var acc accounts.Account
+	if err := couchdb.GetDoc(c.inst, consts.Accounts, c.accountID, &acc); err != nil {
+		return err
+	}
+	typ, err := accounts.TypeInfo(acc.AccountType)
+	if err != nil {
+		return err
+	}
+	if err = typ.RefreshAccount(acc); err != nil {
+		return err
+	}
+	// The account is updated as a JSON document, to keep the fields that are
+	// not known by the stack.
+	var doc couchdb.JSONDoc
+	if err = couchdb.GetDoc(c.inst, consts.Accounts, c.accountID, &doc); err != nil {
+		return err
+	}
+	doc.Type = consts.Accounts
+	doc.M["oauth"] = acc.Oauth
+	if err = couchdb.UpdateDoc(c.inst, &doc); err != nil {
+		return err
+	}
+	c.token = acc.Oauth.AccessToken
+	return nil
+}
+
+// do sends the request built by newReq with the access token. When the token
+// has expired, it is refreshed and the request is sent again.
+func (c *client) do(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		res, err := httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			res.Body.Close()
+			if err = c.refresh(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+			res.Body.Close()
+			return nil, fmt.Errorf("%s responded with %d: %s", req.URL.Host, res.StatusCode, body)
+		}
+		return res, nil
+	}
+}
+
+func (c *client) getJSON(ctx context.Context, u string, out interface{}) error {
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, u, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (c *client) postJSON(ctx context.Context, u string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// googleExports are the formats used for exporting the documents of Google
+// Docs, that have no binary content in Google Drive.
+var googleExports = map[string]struct{ mime, ext string }{
+	"application/vnd.google-apps.document":     {"application/vnd.oasis.opendocument.text", ".odt"},
+	"application/vnd.google-apps.spreadsheet":  {"application/vnd.oasis.opendocument.spreadsheet", ".ods"},
+	"application/vnd.google-apps.presentation": {"application/vnd.oasis.opendocument.presentation", ".odp"},
+	"application/vnd.google-apps.drawing":      {"image/png", ".png"},
+}
+
+func googleList(ctx context.Context, c *client, folder string) ([]*remoteEntry, error) {
+	var entries []*remoteEntry
+	pageToken := ""
+	for {
+		params := url.Values{
+			"q":        {fmt.Sprintf("'%s' in parents and trashed = false", strings.Replace(folder, "'", `\'`, -1))},
+			"fields":   {"nextPageToken,files(id,name,mimeType,size,modifiedTime)"},
+			"pageSize": {"1000"},
+		}
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+		var res struct {
+			NextPageToken string `json:"nextPageToken"`
+			Files         []struct {
+				ID           string    `json:"id"`
+				Name         string    `json:"name"`
+				MimeType     string    `json:"mimeType"`
+				Size         int64     `json:"size,string"`
+				ModifiedTime time.Time `json:"modifiedTime"`
+			} `json:"files"`
+		}
+		if err := c.getJSON(ctx, googleDriveAPI+"/files?"+params.Encode(), &res); err != nil {
+			return nil, err
+		}
+		for _, f := range res.Files {
+			entry := &remoteEntry{
+				ID:      f.ID,
+				Name:    f.Name,
+				Size:    f.Size,
+				Mime:    f.MimeType,
+				ModTime: f.ModifiedTime,
+			}
+			if f.MimeType == googleFolderMime {
+				entry.Dir = true
+			} else if strings.HasPrefix(f.MimeType, googleAppsMimePref) {
+				export, ok := googleExports[f.MimeType]
+				if !ok {
+					// The forms, the shortcuts, etc. can't be exported
+					continue
+				}
+				entry.Name += export.ext
+				entry.Size = -1
+				entry.Mime = export.mime
+				entry.export = export.mime
+			}
+			entries = append(entries, entry)
+		}
+		if res.NextPageToken == "" {
+			return entries, nil
+		}
+		pageToken = res.NextPageToken
+	}
+}
+
+func googleDownload(ctx context.Context, c *client, entry *remoteEntry) (io.ReadCloser, error) {
+	u := googleDriveAPI + "/files/" + url.PathEscape(entry.ID) + "?alt=media"
+	if entry.export != "" {
+		u = googleDriveAPI + "/files/" + url.PathEscape(entry.ID) + "/export?" +
+			url.Values{"mimeType": {entry.export}}.Encode()
+	}
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, u, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func dropboxList(ctx context.Context, c *client, folder string) ([]*remoteEntry, error) {
+	var entries []*remoteEntry
+	u := dropboxAPI + "/files/list_folder"
+	var in interface{} = map[string]interface{}{"path": folder}
+	for {
+		var res struct {
+			Entries []struct {
+				Tag            string    `json:".tag"`
+				ID             string    `json:"id"`
+				Name           string    `json:"name"`
+				Size           int64     `json:"size"`
+				ClientModified time.Time `json:"client_modified"`
+				IsDownloadable *bool     `json:"is_downloadable"`
+			} `json:"entries"`
+			Cursor  string `json:"cursor"`
+			HasMore bool   `json:"has_more"`
+		}
+		if err := c.postJSON(ctx, u, in, &res); err != nil {
+			return nil, err
+		}
+		for _, e := range res.Entries {
+			switch e.Tag {
+			case "folder":
+				entries = append(entries, &remoteEntry{ID: e.ID, Name: e.Name, Dir: true})
+			case "file":
+				// The Dropbox Paper documents can't be downloaded
+				if e.IsDownloadable != nil && !*e.IsDownloadable {
+					continue
+				}
+				entries = append(entries, &remoteEntry{
+					ID:      e.ID,
+					Name:    e.Name,
+					Size:    e.Size,
+					ModTime: e.ClientModified,
+				})
+			}
+		}
+		if !res.HasMore {
+			return entries, nil
+		}
+		u = dropboxAPI + "/files/list_folder/continue"
+		in = map[string]interface{}{"cursor": res.Cursor}
+	}
+}
+
+func dropboxDownload(ctx context.Context, c *client, entry *remoteEntry) (io.ReadCloser, error) {
+	arg, err := json.Marshal(map[string]string{"path": entry.ID})
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, dropboxContentAPI+"/files/download", nil)
+		if err == nil {
+			req.Header.Set("Dropbox-API-Arg", string(arg))
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
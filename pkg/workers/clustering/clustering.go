@@ -0,0 +1,31 @@
+package clustering
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/photos"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "clustering",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that groups the new photos in moments, that are
+// suggested to the user as albums.
+func Worker(ctx *jobs.WorkerContext) error {
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	ctx.Logger().WithField("nspace", "clustering").Debugf("Clustering the photos")
+	return photos.RunClustering(i)
+}
@@ -0,0 +1,136 @@
+// Package digest is for the worker that sends a summary mail of the
+// notifications and of the activity of an instance, daily or weekly, when the
+// user has asked for it with the digest setting.
+package digest
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/activity"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/notification"
+	"github.com/cozy/cozy-stack/pkg/notification/center"
+)
+
+const (
+	// Daily is the value of the digest setting for a mail each day
+	Daily = "daily"
+	// Weekly is the value of the digest setting for a mail each monday
+	Weekly = "weekly"
+)
+
+const (
+	// maxNotifications is the maximal number of notifications counted in a
+	// digest
+	maxNotifications = 1000
+	// maxTitles is the number of notifications whose title is in a digest
+	maxTitles = 10
+	// maxActivities is the maximal number of activities counted in a digest
+	maxActivities = 1000
+)
+
+// kinds are the kinds of activities in a digest, in the order of the mail
+var kinds = []string{
+	activity.KindFileAdded,
+	activity.KindFileModified,
+	activity.KindSharingAccepted,
+	activity.KindKonnectorRun,
+	activity.KindKonnectorFailed,
+	activity.KindLogin,
+}
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "digest",
+		Concurrency:  4,
+		MaxExecCount: 1,
+		Timeout:      5 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is the worker method to send the digest mail of an instance. It is
+// run each day, and does nothing if the user has not asked for a digest for
+// this day, or if nothing has happened during the period.
+func Worker(ctx *jobs.WorkerContext) error {
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	settings, err := inst.SettingsDocument()
+	if err != nil {
+		return err
+	}
+	frequency, _ := settings.M["digest"].(string)
+	now := time.Now().UTC()
+	var since time.Time
+	switch frequency {
+	case Daily:
+		since = now.Add(-24 * time.Hour)
+	case Weekly:
+		if now.Weekday() != time.Monday {
+			return nil
+		}
+		since = now.Add(-7 * 24 * time.Hour)
+	default:
+		return nil
+	}
+
+	notifs, err := center.FindSince(inst, since, maxNotifications)
+	if err != nil {
+		return err
+	}
+	activities, err := activity.ListSince(inst, since, maxActivities)
+	if err != nil {
+		return err
+	}
+	summary := summarize(inst.Translate, notifs, activities)
+	if summary == "" {
+		ctx.Logger().WithField("nspace", "digest").
+			Debugf("Nothing has happened, no digest is sent")
+		return nil
+	}
+	return inst.SendMail(&instance.Mail{
+		TemplateName: "digest",
+		TemplateValues: map[string]interface{}{
+			"Domain":   inst.ContextualDomain(),
+			"Period":   inst.Translate("Mail Digest Period " + frequency),
+			"Summary":  summary,
+			"HomeLink": inst.DefaultRedirection().String(),
+		},
+	})
+}
+
+// summarize returns the lines of a digest for the given notifications and
+// activities, or an empty string if there is nothing to say. The events of
+// the activities are counted by kind.
+func summarize(translate func(key string, vars ...interface{}) string, notifs []*notification.Notification, activities []*activity.Activity) string {
+	var lines []string
+	if len(notifs) > 0 {
+		lines = append(lines, translate("Mail Digest Notifications", len(notifs)))
+		for i, n := range notifs {
+			if i == maxTitles {
+				break
+			}
+			title := n.Title
+			if title == "" {
+				title = n.Message
+			}
+			if title != "" {
+				lines = append(lines, "- "+title)
+			}
+		}
+	}
+	counts := make(map[string]int)
+	for _, a := range activities {
+		counts[a.Kind] += a.Count
+	}
+	for _, kind := range kinds {
+		if counts[kind] > 0 {
+			lines = append(lines, translate("Mail Digest "+kind, counts[kind]))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,34 @@
+package digest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/activity"
+	"github.com/cozy/cozy-stack/pkg/notification"
+	"github.com/stretchr/testify/assert"
+)
+
+func translate(key string, vars ...interface{}) string {
+	return fmt.Sprintf(key+" %v", vars...)
+}
+
+func TestSummarize(t *testing.T) {
+	assert.Equal(t, "", summarize(translate, nil, nil))
+
+	notifs := []*notification.Notification{
+		{Title: "Your disk is almost full"},
+		{Message: "A bank transaction"},
+	}
+	activities := []*activity.Activity{
+		{Kind: activity.KindLogin, Count: 1},
+		{Kind: activity.KindFileAdded, Count: 12},
+		{Kind: activity.KindFileAdded, Count: 3},
+	}
+	expected := "Mail Digest Notifications 2\n" +
+		"- Your disk is almost full\n" +
+		"- A bank transaction\n" +
+		"Mail Digest file_added 15\n" +
+		"Mail Digest login 1"
+	assert.Equal(t, expected, summarize(translate, notifs, activities))
+}
@@ -0,0 +1,40 @@
+// Package dirsizes is for the worker that recomputes the aggregates of the
+// directories (their size and their number of files), to fix the drift of
+// the aggregates maintained incrementally by the VFS.
+package dirsizes
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "dir-sizes",
+		Concurrency:  1,
+		MaxExecCount: 2,
+		Timeout:      time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is the worker method to recompute the aggregates of all the
+// directories of an instance.
+func Worker(ctx *jobs.WorkerContext) error {
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	fixed, err := vfs.RecomputeDirSizes(inst.VFS(), inst)
+	if err != nil {
+		return err
+	}
+	if fixed > 0 {
+		ctx.Logger().WithField("nspace", "dir-sizes").
+			Infof("The aggregates of %d directories have been fixed", fixed)
+	}
+	return nil
+}
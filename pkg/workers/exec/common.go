@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"io"
 	"math"
 	"os"
 	"runtime"
@@ -13,6 +14,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/metrics"
+	"github.com/cozy/cozy-stack/pkg/tracing"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
@@ -33,6 +35,7 @@ func init() {
 		MaxExecCount: 2,
 		Timeout:      defaultTimeout,
 	})
+	jobs.RegisterTriggerBackoffCallback(konnectorTriggerBackoff)
 
 	jobs.AddWorker(&jobs.WorkerConfig{
 		WorkerType: "service",
@@ -57,6 +60,19 @@ type execWorker interface {
 	Commit(ctx *jobs.WorkerContext, errjob error) error
 }
 
+// interactiveWorker is implemented by the workers that can write on the stdin
+// of the process, like the konnectors to give them the value of an
+// interaction.
+type interactiveWorker interface {
+	SetStdin(stdin io.Writer)
+}
+
+// stderrWorker is implemented by the workers that keep what the process has
+// printed on stderr, like the konnectors for their logs.
+type stderrWorker interface {
+	SetStderr(stderr []byte)
+}
+
 func worker(ctx *jobs.WorkerContext) (err error) {
 	worker := ctx.Cookie().(execWorker)
 	domain := ctx.Domain()
@@ -65,6 +81,7 @@ func worker(ctx *jobs.WorkerContext) (err error) {
 	if err != nil {
 		return err
 	}
+	inst = inst.WithContext(ctx)
 
 	workDir, err := worker.PrepareWorkDir(ctx, inst)
 	if err != nil {
@@ -81,7 +98,9 @@ func worker(ctx *jobs.WorkerContext) (err error) {
 
 	var stderrBuf bytes.Buffer
 	cmd := createCmd(cmdStr, workDir) // #nosec
-	cmd.Env = env
+	// The trace context is given to the konnector or the service with the
+	// TRACEPARENT environment variable.
+	cmd.Env = append(env, tracing.Environ(ctx)...)
 
 	// set stderr writable with a bytes.Buffer limited total size of 256Ko
 	cmd.Stderr = utils.LimitWriterDiscard(&stderrBuf, 256*1024)
@@ -92,6 +111,9 @@ func worker(ctx *jobs.WorkerContext) (err error) {
 	defer func() {
 		if stderrBuf.Len() > 0 {
 			log.Error("Stderr: ", stderrBuf.String())
+			if w, ok := worker.(stderrWorker); ok {
+				w.SetStderr(stderrBuf.Bytes())
+			}
 		}
 	}()
 
@@ -99,6 +121,13 @@ func worker(ctx *jobs.WorkerContext) (err error) {
 	if err != nil {
 		return err
 	}
+	if w, ok := worker.(interactiveWorker); ok {
+		cmdIn, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		w.SetStdin(cmdIn)
+	}
 	scanBuf := make([]byte, 16*1024)
 	scanOut := bufio.NewScanner(cmdOut)
 	scanOut.Buffer(scanBuf, 64*1024)
@@ -0,0 +1,264 @@
+package exec
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/notification"
+	"github.com/cozy/cozy-stack/pkg/notification/center"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+const (
+	// InteractionPending is the state of an interaction waiting for the value
+	// of the user.
+	InteractionPending = "pending"
+	// InteractionAnswered is the state of an interaction when the user has
+	// given the value, until it is read by the konnector.
+	InteractionAnswered = "answered"
+
+	// interactionTimeout is the maximal duration for the user to give the
+	// value asked by a konnector.
+	interactionTimeout = 5 * time.Minute
+
+	// interactionExpired is the error sent to the konnector when the user has
+	// not given the value in time.
+	interactionExpired = "INTERACTION_EXPIRED"
+	// interactionFailed is the error sent to the konnector when the stack
+	// cannot ask the value to the user.
+	interactionFailed = "INTERACTION_FAILED"
+
+	defaultInteractionKind = "two_fa"
+)
+
+var (
+	// ErrInteractionNotPending is used when a value is given for an
+	// interaction that has already been answered.
+	ErrInteractionNotPending = errors.New("The interaction is not pending")
+	// ErrInteractionExpired is used when a value is given for an interaction
+	// after its expiration.
+	ErrInteractionExpired = errors.New("The interaction has expired")
+)
+
+// Interaction is a request of a running konnector for a value that only the
+// user can give, like the code sent by SMS for a two-factor authentication.
+// Its identifier is the one of the job: the konnector is paused until the
+// value is given via the API, or the interaction expires.
+type Interaction struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	Konnector string    `json:"konnector"`
+	Account   string    `json:"account,omitempty"`
+	TriggerID string    `json:"trigger_id,omitempty"`
+	Kind      string    `json:"kind"`
+	Message   string    `json:"message,omitempty"`
+	State     string    `json:"state"`
+	Value     string    `json:"value,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (i *Interaction) ID() string { return i.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (i *Interaction) Rev() string { return i.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (i *Interaction) DocType() string { return consts.KonnectorsInteractions }
+
+// Clone implements couchdb.Doc
+func (i *Interaction) Clone() couchdb.Doc {
+	cloned := *i
+	return &cloned
+}
+
+// SetID is used to implement the couchdb.Doc interface
+func (i *Interaction) SetID(id string) { i.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (i *Interaction) SetRev(rev string) { i.DocRev = rev }
+
+// Expired returns true if the user can no longer answer the interaction.
+func (i *Interaction) Expired() bool {
+	return time.Now().After(i.ExpiresAt)
+}
+
+// GetInteraction returns the interaction of the job with the given
+// identifier.
+func GetInteraction(inst *instance.Instance, jobID string) (*Interaction, error) {
+	interaction := &Interaction{}
+	if err := couchdb.GetDoc(inst, consts.KonnectorsInteractions, jobID, interaction); err != nil {
+		return nil, err
+	}
+	return interaction, nil
+}
+
+// AnswerInteraction gives the value of the user for the interaction of the
+// job with the given identifier. The konnector is resumed with this value.
+func AnswerInteraction(inst *instance.Instance, jobID, value string) (*Interaction, error) {
+	interaction, err := GetInteraction(inst, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if interaction.State != InteractionPending {
+		return nil, ErrInteractionNotPending
+	}
+	if interaction.Expired() {
+		return nil, ErrInteractionExpired
+	}
+	interaction.State = InteractionAnswered
+	interaction.Value = value
+	if err := couchdb.UpdateDoc(inst, interaction); err != nil {
+		return nil, err
+	}
+	return interaction, nil
+}
+
+// interactionResponse is the JSON line written on the stdin of the konnector
+// to resume it after an interaction.
+type interactionResponse struct {
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// requestInteraction saves the interaction asked by the konnector, notifies
+// the user, and waits for the value in background to send it to the
+// konnector.
+func (w *konnectorWorker) requestInteraction(ctx *jobs.WorkerContext, inst *instance.Instance, kind, message string) error {
+	if w.stdin == nil {
+		return errors.New("The konnector cannot be resumed after an interaction")
+	}
+	if !atomic.CompareAndSwapInt32(&w.interacting, 0, 1) {
+		return errors.New("An interaction is already pending")
+	}
+	if kind == "" {
+		kind = defaultInteractionKind
+	}
+	triggerID, _ := ctx.TriggerID()
+	interaction := &Interaction{
+		DocID:     ctx.ID(),
+		Konnector: w.slug,
+		TriggerID: triggerID,
+		Kind:      kind,
+		Message:   message,
+		State:     InteractionPending,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(interactionTimeout),
+	}
+	if w.msg != nil {
+		interaction.Account = w.msg.Account
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(interaction.ExpiresAt) {
+		interaction.ExpiresAt = deadline
+	}
+	if err := couchdb.Upsert(inst, interaction); err != nil {
+		atomic.StoreInt32(&w.interacting, 0)
+		return err
+	}
+
+	// The subscription is done before the notification, to not miss the
+	// answer of the user.
+	sub := realtime.GetHub().Subscriber(inst)
+	if err := sub.Watch(consts.KonnectorsInteractions, interaction.DocID); err != nil {
+		sub.Close()
+		atomic.StoreInt32(&w.interacting, 0)
+		return err
+	}
+	w.notifyInteraction(ctx, inst, interaction)
+	go w.waitInteraction(ctx, inst, sub, interaction)
+	return nil
+}
+
+func (w *konnectorWorker) notifyInteraction(ctx *jobs.WorkerContext, inst *instance.Instance, interaction *Interaction) {
+	name := w.slug
+	if w.man != nil && w.man.Name != "" {
+		name = w.man.Name
+	}
+	link := inst.SubDomain(consts.HomeSlug)
+	link.Fragment = "/connected/" + w.slug
+	n := &notification.Notification{
+		Title:   inst.Translate("Notifications Konnector Interaction Subject"),
+		Message: interaction.Message,
+		Slug:    w.slug,
+		Data: map[string]interface{}{
+			"KonnectorName": name,
+			"KonnectorLink": link.String(),
+			"Message":       interaction.Message,
+			"JobID":         interaction.DocID,
+		},
+		PreferredChannels: []string{"mobile", "mail"},
+	}
+	if err := center.PushStack(inst.Domain, center.NotificationKonnectorInteraction, n); err != nil {
+		w.Logger(ctx).Warnf("Cannot notify the user for the interaction: %s", err)
+	}
+}
+
+// waitInteraction waits for the answer of the user, and writes it on the
+// stdin of the konnector. The interaction is deleted after that, as the value
+// is only useful for the konnector.
+func (w *konnectorWorker) waitInteraction(ctx *jobs.WorkerContext, inst *instance.Instance, sub *realtime.DynamicSubscriber, interaction *Interaction) {
+	defer sub.Close()
+	log := w.Logger(ctx)
+	timer := time.NewTimer(time.Until(interaction.ExpiresAt))
+	defer timer.Stop()
+
+	res := interactionResponse{Type: konnectorMsgTypeInteraction}
+	for res.Error == "" {
+		// The interaction is fetched again on each event, and before the first
+		// one, as it may have been answered before the subscription.
+		current, err := GetInteraction(inst, interaction.DocID)
+		if err == nil && current.State == InteractionAnswered {
+			interaction = current
+			res.Value = current.Value
+			break
+		}
+		select {
+		case <-sub.Channel:
+		case <-timer.C:
+			res.Error = interactionExpired
+		case <-ctx.Done():
+			res.Error = interactionExpired
+		}
+	}
+
+	if err := couchdb.DeleteDoc(inst, interaction); err != nil && !couchdb.IsNotFoundError(err) {
+		log.Warnf("Cannot delete the interaction: %s", err)
+	}
+	atomic.StoreInt32(&w.interacting, 0)
+	if ctx.Err() != nil {
+		return
+	}
+	if err := writeInteractionResponse(w.stdin, &res); err != nil {
+		log.Warnf("Cannot resume the konnector after the interaction: %s", err)
+	}
+}
+
+// cancelInteraction resumes the konnector with an error when the interaction
+// cannot be requested.
+func (w *konnectorWorker) cancelInteraction(ctx *jobs.WorkerContext) {
+	if w.stdin == nil {
+		return
+	}
+	res := interactionResponse{Type: konnectorMsgTypeInteraction, Error: interactionFailed}
+	if err := writeInteractionResponse(w.stdin, &res); err != nil {
+		w.Logger(ctx).Warnf("Cannot resume the konnector after the interaction: %s", err)
+	}
+}
+
+func writeInteractionResponse(stdin io.Writer, res *interactionResponse) error {
+	line, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	_, err = stdin.Write(append(line, '\n'))
+	return err
+}
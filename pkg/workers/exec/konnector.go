@@ -10,6 +10,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cozy/afero"
 	"github.com/cozy/cozy-stack/pkg/accounts"
@@ -31,6 +32,19 @@ const (
 	konnErrorUserActionNeeded = "USER_ACTION_NEEDED"
 )
 
+const (
+	// konnBackoffBase is the delay during which the scheduled jobs of a
+	// konnector are skipped after a failure. It is doubled after each
+	// consecutive failure, up to konnBackoffMax.
+	konnBackoffBase = 1 * time.Hour
+	konnBackoffMax  = 7 * 24 * time.Hour
+
+	// konnDeactivationBase is the same as konnBackoffBase, but after a login
+	// error.
+	konnDeactivationBase = 7 * 24 * time.Hour
+	konnDeactivationMax  = 28 * 24 * time.Hour
+)
+
 type konnectorWorker struct {
 	slug string
 	msg  *KonnectorMessage
@@ -38,6 +52,13 @@ type konnectorWorker struct {
 
 	err     error
 	lastErr error
+
+	// logs are the log entries of the execution, saved on commit
+	logs executionLogs
+
+	// stdin is used to resume the konnector after an interaction
+	stdin       io.Writer
+	interacting int32
 }
 
 const (
@@ -46,6 +67,10 @@ const (
 	konnectorMsgTypeWarning  = "warning"
 	konnectorMsgTypeError    = "error"
 	konnectorMsgTypeCritical = "critical"
+
+	// konnectorMsgTypeInteraction is used by a konnector to ask a value to the
+	// user, like a two-factor authentication code.
+	konnectorMsgTypeInteraction = "interaction"
 )
 
 // KonnectorMessage is the message structure sent to the konnector worker.
@@ -103,15 +128,47 @@ func beforeHookKonnector(job *jobs.Job) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	if state.Status == jobs.Errored {
-		if strings.HasPrefix(state.LastError, konnErrorLoginFailed) ||
-			strings.HasPrefix(state.LastError, konnErrorUserActionNeeded) {
-			return false, nil
-		}
+	if until := konnectorPausedUntil(state); time.Now().Before(until) {
+		job.Logger().Infof("konnector %q has not been triggered because of its %d last failures (paused until %s)",
+			msg.Konnector, state.ConsecutiveFailures, until.Format(time.RFC3339))
+		return false, nil
 	}
 	return true, nil
 }
 
+// konnectorPausedUntil returns the time until which the scheduled jobs of a
+// konnector are skipped after consecutive failures, with an exponential
+// backoff. The konnector is deactivated for a longer time after a login
+// error, as the vendor may block the account if we insist with wrong
+// credentials: it is the user who should fix the account and run the
+// konnector manually.
+func konnectorPausedUntil(state *jobs.TriggerState) time.Time {
+	if state.ConsecutiveFailures == 0 || state.LastFailure == nil {
+		return time.Time{}
+	}
+	base, max := konnBackoffBase, konnBackoffMax
+	if isLoginError(state.LastError) {
+		base, max = konnDeactivationBase, konnDeactivationMax
+	}
+	delay := max
+	if n := uint(state.ConsecutiveFailures - 1); n < 16 && base<<n < max {
+		delay = base << n
+	}
+	return state.LastFailure.Add(delay)
+}
+
+func konnectorTriggerBackoff(t jobs.Trigger, state *jobs.TriggerState) time.Time {
+	if t.Infos().WorkerType != "konnector" {
+		return time.Time{}
+	}
+	return konnectorPausedUntil(state)
+}
+
+func isLoginError(err string) bool {
+	return strings.HasPrefix(err, konnErrorLoginFailed) ||
+		strings.HasPrefix(err, konnErrorUserActionNeeded)
+}
+
 func (w *konnectorWorker) PrepareWorkDir(ctx *jobs.WorkerContext, i *instance.Instance) (string, error) {
 	var err error
 	var data json.RawMessage
@@ -210,20 +267,15 @@ func (w *konnectorWorker) ensureFolderToSave(ctx *jobs.WorkerContext, inst *inst
 	msg := w.msg
 
 	var normalizedFolderPath string
+	template := w.man.DefaultFolderTemplate()
 	if account != nil {
-		admin := inst.Translate("Tree Administrative")
-		r := strings.NewReplacer("&", "_", "/", "_", "\\", "_", "#", "_",
-			",", "_", "+", "_", "(", "_", ")", "_", "$", "_", "@", "_", "~",
-			"_", "%", "_", ".", "_", "'", "_", "\"", "_", ":", "_", "*", "_",
-			"?", "_", "<", "_", ">", "_", "{", "_", "}", "_")
-		accountName := r.Replace(account.Name)
-		normalizedFolderPath = fmt.Sprintf("/%s/%s/%s", admin, strings.Title(w.slug), accountName)
+		normalizedFolderPath = w.folderPathFromTemplate(inst, defaultFolderTemplate, account)
 
 		// This is code to handle legacy: if the konnector does not actually require
 		// a directory (for instance because it does not upload files), but a folder
 		// has been created in the past by the stack which is still empty, then we
 		// delete it.
-		if msg.FolderToSave == "" && account.FolderPath == "" && (account.Basic == nil || account.Basic.FolderPath == "") {
+		if msg.FolderToSave == "" && template == "" && !accountHasFolder(account) {
 			if dir, errp := fs.DirByPath(normalizedFolderPath); errp == nil {
 				if account.Name == "" {
 					innerDirPath := path.Join(normalizedFolderPath, strings.Title(w.slug))
@@ -242,11 +294,23 @@ func (w *konnectorWorker) ensureFolderToSave(ctx *jobs.WorkerContext, inst *inst
 		}
 	}
 
-	// 1. Check if the folder identified by its ID exists
-	if msg.FolderToSave != "" {
-		dir, err := fs.DirByID(msg.FolderToSave)
+	// 1. Check if the folder identified by its ID exists. The folder of the
+	// account is tried too, as the user may have moved it: the konnector
+	// follows it, and the path on the account is updated.
+	ids := []string{msg.FolderToSave}
+	if account != nil && account.FolderID != msg.FolderToSave {
+		ids = append(ids, account.FolderID)
+	}
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		dir, err := fs.DirByID(id)
 		if err == nil {
 			if !strings.HasPrefix(dir.Fullpath, vfs.TrashDirName) {
+				if id != msg.FolderToSave {
+					msg.updateFolderToSave(id)
+				}
 				if len(dir.ReferencedBy) == 0 {
 					dir.AddReferencedBy(couchdb.DocReference{
 						Type: consts.Konnectors,
@@ -254,6 +318,7 @@ func (w *konnectorWorker) ensureFolderToSave(ctx *jobs.WorkerContext, inst *inst
 					})
 					couchdb.UpdateDoc(inst, dir)
 				}
+				w.linkFolderToAccount(ctx, inst, account, dir)
 				return nil
 			}
 		} else if !os.IsNotExist(err) {
@@ -284,6 +349,9 @@ func (w *konnectorWorker) ensureFolderToSave(ctx *jobs.WorkerContext, inst *inst
 		}
 		if count == 1 {
 			msg.updateFolderToSave(dirID)
+			if dir, err := fs.DirByID(dirID); err == nil {
+				w.linkFolderToAccount(ctx, inst, account, dir)
+			}
 			return nil
 		}
 	}
@@ -292,15 +360,19 @@ func (w *konnectorWorker) ensureFolderToSave(ctx *jobs.WorkerContext, inst *inst
 	if account == nil {
 		return nil
 	}
-	if msg.FolderToSave == "" && account.FolderPath == "" && (account.Basic == nil || account.Basic.FolderPath == "") {
+	if msg.FolderToSave == "" && template == "" && !accountHasFolder(account) {
 		return nil
 	}
 
-	// 4. Recreate the folder
+	// 4. Recreate the folder, or create it from the template of the konnector
+	// for a new account
 	folderPath := account.FolderPath
 	if folderPath == "" && account.Basic != nil {
 		folderPath = account.Basic.FolderPath
 	}
+	if folderPath == "" && template != "" {
+		folderPath = w.folderPathFromTemplate(inst, template, account)
+	}
 	if folderPath == "" {
 		folderPath = normalizedFolderPath
 	}
@@ -319,9 +391,107 @@ func (w *konnectorWorker) ensureFolderToSave(ctx *jobs.WorkerContext, inst *inst
 		})
 		couchdb.UpdateDoc(inst, dir)
 	}
+	w.linkFolderToAccount(ctx, inst, account, dir)
 	return nil
 }
 
+// defaultFolderTemplate is the template for the folder of the konnectors that
+// have not declared one in their manifest.
+const defaultFolderTemplate = "/$administrative/$konnector/$account"
+
+// folderNameReplacer removes the characters that are not welcome in the name
+// of a folder.
+var folderNameReplacer = strings.NewReplacer("&", "_", "/", "_", "\\", "_",
+	"#", "_", ",", "_", "+", "_", "(", "_", ")", "_", "$", "_", "@", "_", "~",
+	"_", "%", "_", ".", "_", "'", "_", "\"", "_", ":", "_", "*", "_", "?",
+	"_", "<", "_", ">", "_", "{", "_", "}", "_")
+
+// folderPathFromTemplate returns the path of the folder for the account, from
+// a template where these variables are replaced:
+//
+//   - $administrative and $photos by the name of these folders in the locale
+//     of the user
+//   - $konnector by the slug of the konnector
+//   - $vendor by the name of the konnector
+//   - $account by the name of the account.
+//
+// The konnector is given the permission to write in this folder, so the
+// default template is used instead of a template that is not specific to the
+// konnector or to the account, or that resolves to the root or to a folder of
+// the stack (like the Photos folder).
+func (w *konnectorWorker) folderPathFromTemplate(inst *instance.Instance, template string, account *accounts.Account) string {
+	vendor := w.man.Name
+	if vendor == "" {
+		vendor = strings.Title(w.slug)
+	}
+	r := strings.NewReplacer(
+		"$administrative", inst.Translate("Tree Administrative"),
+		"$photos", inst.Translate("Tree Photos"),
+		"$konnector", strings.Title(w.slug),
+		"$vendor", folderNameReplacer.Replace(vendor),
+		"$account", folderNameReplacer.Replace(account.Name),
+	)
+	folderPath := path.Join("/", r.Replace(template))
+	if template != defaultFolderTemplate &&
+		(!isSpecificFolderTemplate(template) || isReservedFolder(inst, folderPath)) {
+		return path.Join("/", r.Replace(defaultFolderTemplate))
+	}
+	return folderPath
+}
+
+// isSpecificFolderTemplate returns true if the template has a variable for
+// the konnector or the account, and does not go up in the tree.
+func isSpecificFolderTemplate(template string) bool {
+	for _, segment := range strings.Split(template, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	return strings.Contains(template, "$konnector") ||
+		strings.Contains(template, "$vendor") ||
+		strings.Contains(template, "$account")
+}
+
+// isReservedFolder returns true for the root, the trash, and the folders
+// created by the stack, where a konnector must not be allowed to write.
+func isReservedFolder(inst *instance.Instance, folderPath string) bool {
+	if folderPath == "/" || folderPath == vfs.TrashDirName ||
+		strings.HasPrefix(folderPath, vfs.TrashDirName+"/") {
+		return true
+	}
+	photos := "/" + inst.Translate("Tree Photos")
+	reserved := []string{
+		"/" + inst.Translate("Tree Administrative"),
+		photos,
+		path.Join(photos, inst.Translate("Tree Uploaded from Cozy Photos")),
+		path.Join(photos, inst.Translate("Tree Backed up from my mobile")),
+		"/" + inst.Translate("Tree Shared with me"),
+		"/" + inst.Translate("Tree Drives"),
+	}
+	for _, dir := range reserved {
+		if folderPath == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// linkFolderToAccount saves the folder of the konnector on the account, so
+// that it can be found again if the user moves or renames it.
+func (w *konnectorWorker) linkFolderToAccount(ctx *jobs.WorkerContext, inst *instance.Instance, account *accounts.Account, dir *vfs.DirDoc) {
+	if account == nil {
+		return
+	}
+	if err := accounts.SetFolder(inst, account, dir.ID(), dir.Fullpath); err != nil {
+		w.Logger(ctx).Warnf("Cannot save the folder on the account %s: %s", account.ID(), err)
+	}
+}
+
+func accountHasFolder(account *accounts.Account) bool {
+	return account.FolderID != "" || account.FolderPath != "" ||
+		(account.Basic != nil && account.Basic.FolderPath != "")
+}
+
 // ensurePermissions checks that the konnector has the permissions to write
 // files in the folder referenced by the konnector, and adds the permission if
 // needed.
@@ -437,8 +607,12 @@ func (w *konnectorWorker) PrepareCmdEnv(ctx *jobs.WorkerContext, i *instance.Ins
 		language = "node"
 	}
 
-	// Directly pass the job message as fields parameters
-	fieldsJSON := w.msg.ToJSON()
+	// Directly pass the job message as fields parameters, with the decrypted
+	// credentials of the account
+	fieldsJSON, err := w.fieldsWithAuth(i)
+	if err != nil {
+		return
+	}
 	token := i.BuildKonnectorToken(w.man)
 
 	cmd = config.GetConfig().Konnectors.Cmd
@@ -456,6 +630,38 @@ func (w *konnectorWorker) PrepareCmdEnv(ctx *jobs.WorkerContext, i *instance.Ins
 	return
 }
 
+// fieldsWithAuth returns the JSON of the job message, where the auth part of
+// the account has been added with its credentials decrypted. It is the only
+// place where the credentials are decrypted, as the API never returns them in
+// plain text.
+func (w *konnectorWorker) fieldsWithAuth(i *instance.Instance) (string, error) {
+	if w.msg.Account == "" || w.msg.AccountDeleted {
+		return w.msg.ToJSON(), nil
+	}
+	var doc couchdb.JSONDoc
+	if err := couchdb.GetDoc(i, consts.Accounts, w.msg.Account, &doc); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return w.msg.ToJSON(), nil
+		}
+		return "", err
+	}
+	accounts.DecryptAccount(i, doc)
+	auth, ok := doc.M["auth"]
+	if !ok {
+		return w.msg.ToJSON(), nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(w.msg.data, &fields); err != nil {
+		return "", err
+	}
+	fields["auth"] = auth
+	fieldsJSON, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return string(fieldsJSON), nil
+}
+
 func (w *konnectorWorker) Logger(ctx *jobs.WorkerContext) *logrus.Entry {
 	return ctx.Logger().WithField("slug", w.slug)
 }
@@ -465,11 +671,20 @@ func (w *konnectorWorker) ScanOutput(ctx *jobs.WorkerContext, i *instance.Instan
 		Type    string `json:"type"`
 		Message string `json:"message"`
 		NoRetry bool   `json:"no_retry"`
+		Kind    string `json:"kind"`
 	}
 	if err := json.Unmarshal(line, &msg); err != nil {
 		return fmt.Errorf("Could not parse stdout as JSON: %q", string(line))
 	}
 
+	if msg.Type != konnectorMsgTypeInteraction {
+		level := msg.Type
+		if level == "warn" {
+			level = konnectorMsgTypeWarning
+		}
+		w.logs.add(LogSourceStdout, level, msg.Message)
+	}
+
 	log := w.Logger(ctx)
 	switch msg.Type {
 	case konnectorMsgTypeDebug, konnectorMsgTypeInfo:
@@ -488,6 +703,11 @@ func (w *konnectorWorker) ScanOutput(ctx *jobs.WorkerContext, i *instance.Instan
 			ctx.SetNoRetry()
 		}
 		log.Error(msg.Message)
+	case konnectorMsgTypeInteraction:
+		if err := w.requestInteraction(ctx, i, msg.Kind, msg.Message); err != nil {
+			log.Errorf("Cannot request the interaction: %s", err)
+			w.cancelInteraction(ctx)
+		}
 	}
 
 	realtime.GetHub().Publish(i,
@@ -500,6 +720,16 @@ func (w *konnectorWorker) ScanOutput(ctx *jobs.WorkerContext, i *instance.Instan
 	return nil
 }
 
+// SetStdin implements the interactiveWorker interface.
+func (w *konnectorWorker) SetStdin(stdin io.Writer) {
+	w.stdin = stdin
+}
+
+// SetStderr implements the stderrWorker interface.
+func (w *konnectorWorker) SetStderr(stderr []byte) {
+	w.logs.addStderr(stderr)
+}
+
 func (w *konnectorWorker) Error(i *instance.Instance, err error) error {
 	if w.err != nil {
 		return w.err
@@ -523,5 +753,22 @@ func (w *konnectorWorker) Commit(ctx *jobs.WorkerContext, errjob error) error {
 	} else {
 		log.Infof("Konnector failure: %s", errjob)
 	}
+
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	var account string
+	if w.msg != nil {
+		account = w.msg.Account
+	}
+	if err = w.logs.save(inst, ctx.ID(), w.slug, account); err != nil {
+		log.Errorf("Cannot save the logs: %s", err)
+	}
+	if account != "" {
+		if err = updateLastError(inst, account, ctx.ID(), errjob, w.logs.errorDetails()); err != nil {
+			log.Errorf("Cannot save the last error on the account: %s", err)
+		}
+	}
 	return nil
 }
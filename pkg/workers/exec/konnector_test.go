@@ -1,12 +1,15 @@
 package exec
 
 import (
+	"encoding/json"
 	"os"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/accounts"
 	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -17,6 +20,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/stretchr/testify/assert"
 	jwt "gopkg.in/dgrijalva/jwt-go.v3"
@@ -194,6 +198,198 @@ echo "{\"type\": \"manifest\", \"message\": \"$(ls ${1}/manifest.konnector)\" }"
 	wg.Wait()
 }
 
+func TestKonnectorPausedUntil(t *testing.T) {
+	state := &jobs.TriggerState{}
+	assert.True(t, konnectorPausedUntil(state).IsZero())
+
+	failure := time.Now()
+	state.LastFailure = &failure
+	state.LastError = "VENDOR_DOWN"
+	state.ConsecutiveFailures = 1
+	assert.Equal(t, failure.Add(1*time.Hour), konnectorPausedUntil(state))
+	state.ConsecutiveFailures = 3
+	assert.Equal(t, failure.Add(4*time.Hour), konnectorPausedUntil(state))
+	state.ConsecutiveFailures = 100
+	assert.Equal(t, failure.Add(7*24*time.Hour), konnectorPausedUntil(state))
+
+	state.LastError = "LOGIN_FAILED"
+	state.ConsecutiveFailures = 1
+	assert.Equal(t, failure.Add(7*24*time.Hour), konnectorPausedUntil(state))
+	state.ConsecutiveFailures = 2
+	assert.Equal(t, failure.Add(14*24*time.Hour), konnectorPausedUntil(state))
+	state.ConsecutiveFailures = 5
+	assert.Equal(t, failure.Add(28*24*time.Hour), konnectorPausedUntil(state))
+}
+
+func TestFolderFromTemplate(t *testing.T) {
+	folders := json.RawMessage(`[{"defaultDir": "$administrative/$vendor/$account"}]`)
+	man := &apps.KonnManifest{Name: "Train/line", DocSlug: "trainline", Folders: &folders}
+	account := &accounts.Account{AccountType: "trainline", Name: "john@doe"}
+	err := couchdb.CreateDoc(inst, account)
+	assert.NoError(t, err)
+
+	newWorker := func() *konnectorWorker {
+		data, _ := json.Marshal(map[string]interface{}{
+			"konnector": "trainline",
+			"account":   account.ID(),
+		})
+		msg := &KonnectorMessage{Konnector: "trainline", Account: account.ID(), data: data}
+		return &konnectorWorker{slug: "trainline", man: man, msg: msg}
+	}
+	j := jobs.NewJob(inst, &jobs.JobRequest{WorkerType: "konnector"})
+	ctx := jobs.NewWorkerContext("id", j)
+
+	w := newWorker()
+	assert.Equal(t, "/Administrative/Trainline/john_doe",
+		w.folderPathFromTemplate(inst, defaultFolderTemplate, account))
+	err = w.ensureFolderToSave(ctx, inst, account)
+	assert.NoError(t, err)
+	dir, err := inst.VFS().DirByPath("/Administrative/Train_line/john_doe")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, dir.ID(), w.msg.FolderToSave)
+
+	saved := &accounts.Account{}
+	err = couchdb.GetDoc(inst, consts.Accounts, account.ID(), saved)
+	assert.NoError(t, err)
+	assert.Equal(t, dir.ID(), saved.FolderID)
+	assert.Equal(t, "/Administrative/Train_line/john_doe", saved.FolderPath)
+
+	// The user moves the folder: the konnector keeps writing in it
+	name := "Trains"
+	_, err = vfs.ModifyDirMetadata(inst.VFS(), dir, &vfs.DocPatch{Name: &name})
+	assert.NoError(t, err)
+	w = newWorker()
+	err = w.ensureFolderToSave(ctx, inst, saved)
+	assert.NoError(t, err)
+	assert.Equal(t, dir.ID(), w.msg.FolderToSave)
+	err = couchdb.GetDoc(inst, consts.Accounts, account.ID(), saved)
+	assert.NoError(t, err)
+	assert.Equal(t, dir.ID(), saved.FolderID)
+	assert.Equal(t, "/Administrative/Train_line/Trains", saved.FolderPath)
+}
+
+func TestFolderFromUnsafeTemplate(t *testing.T) {
+	man := &apps.KonnManifest{Name: "Trainline", DocSlug: "trainline"}
+	w := &konnectorWorker{slug: "trainline", man: man}
+	account := &accounts.Account{AccountType: "trainline", Name: "john@doe"}
+	expected := "/Administrative/Trainline/john_doe"
+
+	for _, template := range []string{
+		"/",
+		"$photos",
+		"$administrative",
+		"/Documents",
+		"$administrative/$account/../..",
+		"/.cozy_trash/$account",
+	} {
+		assert.Equal(t, expected, w.folderPathFromTemplate(inst, template, account), template)
+	}
+	assert.Equal(t, "/Photos/Trainline",
+		w.folderPathFromTemplate(inst, "$photos/$vendor", account))
+
+	// The account has no name: the template resolves to the Photos folder
+	noname := &accounts.Account{AccountType: "trainline"}
+	assert.Equal(t, "/Administrative/Trainline",
+		w.folderPathFromTemplate(inst, "$photos/$account", noname))
+}
+
+func TestAnswerInteraction(t *testing.T) {
+	interaction := &Interaction{
+		DocID:     "job-with-interaction",
+		Konnector: "two-fa-konnector",
+		Kind:      "two_fa",
+		Message:   "Enter the code sent by SMS",
+		State:     InteractionPending,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(-1 * time.Minute),
+	}
+	assert.NoError(t, couchdb.Upsert(inst, interaction))
+	_, err := AnswerInteraction(inst, interaction.DocID, "123456")
+	assert.Equal(t, ErrInteractionExpired, err)
+
+	interaction.ExpiresAt = time.Now().Add(interactionTimeout)
+	assert.NoError(t, couchdb.UpdateDoc(inst, interaction))
+	answered, err := AnswerInteraction(inst, interaction.DocID, "123456")
+	assert.NoError(t, err)
+	assert.Equal(t, InteractionAnswered, answered.State)
+	assert.Equal(t, "123456", answered.Value)
+
+	_, err = AnswerInteraction(inst, interaction.DocID, "654321")
+	assert.Equal(t, ErrInteractionNotPending, err)
+	assert.NoError(t, couchdb.DeleteDoc(inst, answered))
+
+	_, err = AnswerInteraction(inst, interaction.DocID, "123456")
+	assert.Error(t, err)
+}
+
+func TestKonnectorLogs(t *testing.T) {
+	account := couchdb.JSONDoc{Type: consts.Accounts, M: map[string]interface{}{
+		"account_type": "my-konnector-logs",
+	}}
+	assert.NoError(t, couchdb.CreateDoc(inst, &account))
+
+	msg, err := jobs.NewMessage(map[string]interface{}{
+		"konnector": "my-konnector-logs",
+		"account":   account.ID(),
+	})
+	assert.NoError(t, err)
+	j := jobs.NewJob(inst, &jobs.JobRequest{
+		Message:    msg,
+		WorkerType: "konnector",
+	})
+	w := &konnectorWorker{
+		slug: "my-konnector-logs",
+		msg:  &KonnectorMessage{Account: account.ID()},
+		man:  &apps.KonnManifest{},
+	}
+	ctx := jobs.NewWorkerContext("job-with-logs", j).WithCookie(w)
+	assert.NoError(t, w.ScanOutput(ctx, inst, []byte(`{"type": "info", "message": "Fetching bills"}`)))
+	assert.NoError(t, w.ScanOutput(ctx, inst, []byte(`{"type": "warn", "message": "No bills"}`)))
+	assert.NoError(t, w.ScanOutput(ctx, inst, []byte(`{"type": "critical", "message": "VENDOR_DOWN"}`)))
+	w.SetStderr([]byte("TypeError: foo is undefined\n"))
+	errjob := w.Error(inst, nil)
+	assert.NoError(t, w.Commit(ctx, errjob))
+
+	entries, err := ListLogs(inst, "job-with-logs", couchdb.NewKeyCursor(100, nil, ""))
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 4) {
+		assert.Equal(t, "info", entries[0].Level)
+		assert.Equal(t, "Fetching bills", entries[0].Message)
+		assert.Equal(t, "warning", entries[1].Level)
+		assert.Equal(t, "critical", entries[2].Level)
+		assert.Equal(t, LogSourceStdout, entries[2].Source)
+		assert.Equal(t, "error", entries[3].Level)
+		assert.Equal(t, LogSourceStderr, entries[3].Source)
+		assert.Equal(t, account.ID(), entries[3].Account)
+	}
+
+	var doc couchdb.JSONDoc
+	assert.NoError(t, couchdb.GetDoc(inst, consts.Accounts, account.ID(), &doc))
+	lastError, ok := doc.M["last_error"].(map[string]interface{})
+	if assert.True(t, ok) {
+		assert.Equal(t, "job-with-logs", lastError["job_id"])
+		assert.Equal(t, "VENDOR_DOWN", lastError["error"])
+		assert.Len(t, lastError["details"], 2)
+	}
+
+	w = &konnectorWorker{
+		slug: "my-konnector-logs",
+		msg:  &KonnectorMessage{Account: account.ID()},
+		man:  &apps.KonnManifest{},
+	}
+	ctx = jobs.NewWorkerContext("job-without-error", j).WithCookie(w)
+	assert.NoError(t, w.Commit(ctx, nil))
+	doc = couchdb.JSONDoc{}
+	assert.NoError(t, couchdb.GetDoc(inst, consts.Accounts, account.ID(), &doc))
+	assert.NotContains(t, doc.M, "last_error")
+
+	entries, err = ListLogs(inst, "job-without-error", couchdb.NewKeyCursor(100, nil, ""))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	setup := testutils.NewSetup(m, "konnector_test")
@@ -0,0 +1,335 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const (
+	// LogSourceStdout is the source of the logs printed by a konnector on its
+	// standard output, as JSON messages.
+	LogSourceStdout = "stdout"
+	// LogSourceStderr is the source of the lines printed by a konnector on
+	// its error output.
+	LogSourceStderr = "stderr"
+
+	// maxLogEntries is the maximal number of log entries saved for an
+	// execution of a konnector. The next ones are only sent to the logger.
+	maxLogEntries = 1000
+
+	// maxErrorDetails is the number of error messages kept in the summary of
+	// the last error of an account.
+	maxErrorDetails = 5
+
+	// maxAccountConflicts is the number of tries for saving the last error on
+	// the account, as the konnector can update it at the same time.
+	maxAccountConflicts = 3
+)
+
+// DefaultLogsRetention is the duration during which the logs of the
+// konnectors are kept, if the context of the instance has no
+// konnector_logs_retention.
+const DefaultLogsRetention = 30 * 24 * time.Hour
+
+// logsPurgeInterval is the duration between two purges of the old logs.
+const logsPurgeInterval = 24 * time.Hour
+
+// logsPurgeBatchSize is the number of log entries deleted in one bulk request.
+const logsPurgeBatchSize = 1000
+
+const logsPurgerKey = "konnector-logs-purge"
+
+// LogEntry is a line of the logs of an execution of a konnector.
+type LogEntry struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	JobID     string    `json:"job_id"`
+	Seq       int       `json:"seq"`
+	Konnector string    `json:"konnector"`
+	Account   string    `json:"account,omitempty"`
+	Level     string    `json:"level"`
+	Source    string    `json:"source"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (e *LogEntry) ID() string { return e.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (e *LogEntry) Rev() string { return e.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (e *LogEntry) DocType() string { return consts.KonnectorLogs }
+
+// Clone implements couchdb.Doc
+func (e *LogEntry) Clone() couchdb.Doc {
+	cloned := *e
+	return &cloned
+}
+
+// SetID is used to implement the couchdb.Doc interface
+func (e *LogEntry) SetID(id string) { e.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (e *LogEntry) SetRev(rev string) { e.DocRev = rev }
+
+// executionLogs collects the log entries of an execution of a konnector,
+// from its standard output and its error output.
+type executionLogs struct {
+	mu      sync.Mutex
+	entries []*LogEntry
+	dropped int
+}
+
+func (l *executionLogs) add(source, level, message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) >= maxLogEntries {
+		l.dropped++
+		return
+	}
+	l.entries = append(l.entries, &LogEntry{
+		Seq:       len(l.entries),
+		Level:     level,
+		Source:    source,
+		Message:   message,
+		Timestamp: time.Now().UTC(),
+	})
+}
+
+func (l *executionLogs) addStderr(stderr []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(stderr))
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			l.add(LogSourceStderr, konnectorMsgTypeError, line)
+		}
+	}
+}
+
+// save persists the log entries of the execution in CouchDB.
+func (l *executionLogs) save(inst *instance.Instance, jobID, slug, account string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.dropped > 0 {
+		l.entries = append(l.entries, &LogEntry{
+			Seq:       len(l.entries),
+			Level:     konnectorMsgTypeWarning,
+			Source:    LogSourceStdout,
+			Message:   fmt.Sprintf("%d log entries have been dropped", l.dropped),
+			Timestamp: time.Now().UTC(),
+		})
+		l.dropped = 0
+	}
+	if len(l.entries) == 0 {
+		return nil
+	}
+	docs := make([]couchdb.Doc, len(l.entries))
+	for i, e := range l.entries {
+		e.DocID = fmt.Sprintf("%s-%06d", jobID, e.Seq)
+		e.JobID = jobID
+		e.Konnector = slug
+		e.Account = account
+		docs[i] = e
+	}
+	err := couchdb.BulkCreateDocs(inst, consts.KonnectorLogs, docs)
+	if bulkErr, ok := couchdb.IsBulkError(err); ok {
+		// The entries of a previous try of the same job are kept
+		for _, failure := range bulkErr.Failures {
+			if !couchdb.IsConflictError(failure.Err()) {
+				return err
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+// errorDetails returns the last error messages of the execution.
+func (l *executionLogs) errorDetails() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var details []string
+	for i := len(l.entries) - 1; i >= 0 && len(details) < maxErrorDetails; i-- {
+		e := l.entries[i]
+		if e.Level == konnectorMsgTypeError || e.Level == konnectorMsgTypeCritical {
+			details = append([]string{e.Message}, details...)
+		}
+	}
+	return details
+}
+
+// ListLogs returns a page of the log entries of an execution of a konnector,
+// in the order where they have been printed.
+func ListLogs(inst *instance.Instance, jobID string, cursor couchdb.Cursor) ([]*LogEntry, error) {
+	req := &couchdb.ViewRequest{
+		StartKey:    []interface{}{jobID},
+		EndKey:      []interface{}{jobID, couchdb.MaxString},
+		IncludeDocs: true,
+	}
+	cursor.ApplyTo(req)
+	var res couchdb.ViewResponse
+	if err := couchdb.ExecView(inst, consts.KonnectorLogsByJob, req, &res); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cursor.UpdateFrom(&res)
+	entries := make([]*LogEntry, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var e LogEntry
+		if err := json.Unmarshal(row.Doc, &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+// updateLastError saves a summary of the result of the execution on the
+// account: the last error is set after a failure, and removed after a
+// success.
+func updateLastError(inst *instance.Instance, accountID, jobID string, errjob error, details []string) error {
+	for n := 0; n < maxAccountConflicts; n++ {
+		var doc couchdb.JSONDoc
+		if err := couchdb.GetDoc(inst, consts.Accounts, accountID, &doc); err != nil {
+			if couchdb.IsNotFoundError(err) {
+				return nil
+			}
+			return err
+		}
+		if errjob == nil {
+			if _, ok := doc.M["last_error"]; !ok {
+				return nil
+			}
+			delete(doc.M, "last_error")
+		} else {
+			summary := map[string]interface{}{
+				"job_id": jobID,
+				"error":  errjob.Error(),
+				"date":   time.Now().UTC(),
+			}
+			if len(details) > 0 {
+				summary["details"] = details
+			}
+			doc.M["last_error"] = summary
+		}
+		doc.Type = consts.Accounts
+		err := couchdb.UpdateDoc(inst, &doc)
+		if !couchdb.IsConflictError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// LogsRetention returns the duration during which the logs of the
+// konnectors are kept for the instance: the konnector_logs_retention of its
+// context (like 168h), or else DefaultLogsRetention.
+func LogsRetention(i *instance.Instance) time.Duration {
+	if context, err := i.SettingsContext(); err == nil {
+		if r, ok := context["konnector_logs_retention"].(string); ok {
+			if d, err := time.ParseDuration(r); err == nil && d > 0 {
+				return d
+			}
+		}
+	}
+	return DefaultLogsRetention
+}
+
+// PurgeLogs removes the log entries of the konnectors that are older than
+// the retention period of the instance.
+func PurgeLogs(i *instance.Instance) error {
+	limit := time.Now().UTC().Add(-LogsRetention(i))
+	for {
+		var res couchdb.ViewResponse
+		err := couchdb.ExecView(i, consts.KonnectorLogsByDate, &couchdb.ViewRequest{
+			EndKey:      limit,
+			Limit:       logsPurgeBatchSize,
+			IncludeDocs: true,
+		}, &res)
+		if err != nil {
+			if couchdb.IsNoDatabaseError(err) {
+				return nil
+			}
+			return err
+		}
+		docs := make([]couchdb.Doc, 0, len(res.Rows))
+		for _, row := range res.Rows {
+			var e LogEntry
+			if err := json.Unmarshal(row.Doc, &e); err != nil {
+				return err
+			}
+			docs = append(docs, &e)
+		}
+		if err = couchdb.BulkDeleteDocs(i, consts.KonnectorLogs, docs); err != nil {
+			return err
+		}
+		if len(res.Rows) < logsPurgeBatchSize {
+			return nil
+		}
+	}
+}
+
+// StartLogsPurger starts the process that removes the old logs of the
+// konnectors of all the instances, once a day. When the stack has several
+// processes, only the leader does it.
+func StartLogsPurger() utils.Shutdowner {
+	closed := make(chan struct{})
+	leader := lock.Elect(logsPurgerKey)
+	go func() {
+		waitDuration := logsPurgeInterval
+		for {
+			select {
+			case <-time.After(waitDuration):
+				if !leader.IsLeader() {
+					waitDuration = lock.LeaderTimeout
+					continue
+				}
+				waitDuration = logsPurgeInterval
+				err := instance.ForeachInstances(func(i *instance.Instance) error {
+					if err := PurgeLogs(i); err != nil {
+						i.Logger().WithField("nspace", "konnector").
+							Errorf("Could not purge the konnector logs: %s", err)
+					}
+					return nil
+				})
+				if err != nil {
+					logger.WithNamespace("konnector").
+						Errorf("Could not purge the konnector logs: %s", err)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &logsPurger{closed, leader}
+}
+
+type logsPurger struct {
+	closed chan struct{}
+	leader lock.Leader
+}
+
+func (p *logsPurger) Shutdown(ctx context.Context) error {
+	select {
+	case p.closed <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return p.leader.Shutdown(ctx)
+}
+
+var _ couchdb.Doc = &LogEntry{}
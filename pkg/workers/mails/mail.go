@@ -65,6 +65,8 @@ type Options struct {
 	TemplateValues interface{}           `json:"template_values,omitempty"`
 	Attachments    []*Attachment         `json:"attachments,omitempty"`
 	Locale         string                `json:"locale,omitempty"`
+	Context        string                `json:"context,omitempty"`
+	Logo           string                `json:"logo,omitempty"`
 }
 
 // Part represent a part of the content of the mail. It has a type
@@ -86,8 +88,7 @@ func SendMail(ctx *jobs.WorkerContext) error {
 	if err != nil {
 		return err
 	}
-	from := config.GetConfig().NoReplyAddr
-	name := config.GetConfig().NoReplyName
+	from, name := i.NoReplyAddress()
 	if from == "" {
 		from = "noreply@" + utils.StripPort(domain)
 	}
@@ -114,6 +115,15 @@ func SendMail(ctx *jobs.WorkerContext) error {
 	if opts.TemplateName != "" && opts.Locale == "" {
 		opts.Locale = i.Locale
 	}
+	if opts.TemplateName != "" && opts.Context == "" {
+		opts.Context = i.ContextName
+	}
+	if opts.TemplateName != "" && opts.Logo == "" {
+		opts.Logo = mailLogo(i)
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = i.MailDialer()
+	}
 	return sendMail(ctx, &opts, i.Domain)
 }
 
@@ -162,7 +172,7 @@ func doSendMail(ctx context.Context, opts *Options, domain string) error {
 	var parts []*Part
 	var err error
 	if opts.TemplateName != "" {
-		opts.Subject, parts, err = mailTemplater.Execute(opts.TemplateName, opts.Locale, opts.RecipientName, opts.TemplateValues)
+		opts.Subject, parts, err = mailTemplater.Execute(opts.TemplateName, opts.Locale, opts.Context, opts.Logo, opts.RecipientName, opts.TemplateValues)
 		if err != nil {
 			return err
 		}
@@ -3,19 +3,18 @@ package mails
 import (
 	"bytes"
 	"fmt"
+	"net/url"
+	"path"
 	"strings"
 	"sync"
 	"text/template"
 
 	"github.com/cozy/cozy-stack/pkg/i18n"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/statik/fs"
 	"github.com/cozy/hermes"
 )
 
-// TODO: avoid having a lock by init-ing hermes instances after loading
-// locales.
-var hermeses map[string]hermes.Hermes
-var hermesesMu sync.Mutex
-
 var templateFuncsMap = map[string]interface{}{
 	"splitList": func(sep, orig string) []string {
 		return strings.Split(orig, sep)
@@ -25,31 +24,46 @@ var templateFuncsMap = map[string]interface{}{
 	},
 }
 
-func getHermes(locale string) hermes.Hermes {
-	hermesesMu.Lock()
-	defer hermesesMu.Unlock()
-	if hermeses == nil {
-		hermeses = make(map[string]hermes.Hermes, len(i18n.SupportedLocales))
-		for _, locale := range i18n.SupportedLocales {
-			hermeses[locale] = hermes.Hermes{
-				Theme:         new(MailTheme),
-				TextDirection: hermes.TDLeftToRight,
-				Product: hermes.Product{
-					Name:        i18n.Translate("Mail Cozy Team", locale),
-					Link:        "https://cozy.io",
-					Logo:        "https://files.cozycloud.cc/mailing/logo-cozy-notif-mail_2x.png",
-					Copyright:   "",
-					TroubleText: i18n.Translate("Mail Trouble Text", locale),
-				},
-				TemplateFuncsMap: templateFuncsMap,
-			}
-		}
+// defaultMailLogo is the logo in the header of the mails, when it has not been
+// overridden by the context of the instance.
+const defaultMailLogo = "https://files.cozycloud.cc/mailing/logo-cozy-notif-mail_2x.png"
+
+// mailLogoAsset is the name of the asset that a context can insert to have
+// its own logo in the header of the mails.
+const mailLogoAsset = "/images/icon-cozy-mail.png"
+
+// mailLogo returns the URL of the logo for the header of the mails sent by
+// the instance. If the context of the instance has its own logo, its URL
+// contains the hash of its content (like the URL of the assets of the stack
+// pages), so that the mails sent before an update keep the logo they had.
+func mailLogo(i *instance.Instance) string {
+	if i.ContextName == "" {
+		return defaultMailLogo
 	}
-	h, ok := hermeses[locale]
+	f, ok := fs.Get(mailLogoAsset, i.ContextName)
 	if !ok {
-		h = hermeses[i18n.DefaultLocale]
+		return defaultMailLogo
+	}
+	name := path.Join("/assets/ext", url.PathEscape(i.ContextName), f.NameWithSum)
+	return i.PageURL(name, nil)
+}
+
+func getHermes(locale, context, logo string) hermes.Hermes {
+	if logo == "" {
+		logo = defaultMailLogo
+	}
+	return hermes.Hermes{
+		Theme:         new(MailTheme),
+		TextDirection: hermes.TDLeftToRight,
+		Product: hermes.Product{
+			Name:        i18n.TranslateContext("Mail Cozy Team", locale, context),
+			Link:        "https://cozy.io",
+			Logo:        logo,
+			Copyright:   "",
+			TroubleText: i18n.TranslateContext("Mail Trouble Text", locale, context),
+		},
+		TemplateFuncsMap: templateFuncsMap,
 	}
-	return h
 }
 
 // MailTemplate is a struct to define a mail template with HTML and text parts.
@@ -173,7 +187,7 @@ type MailTemplater struct {
 // Execute will execute the HTML and text temlates for the template with the
 // specified name. It returns the mail parts that should be added to the sent
 // mail.
-func (m *MailTemplater) Execute(name, locale string, recipientName string, data interface{}) (subject string, parts []*Part, err error) {
+func (m *MailTemplater) Execute(name, locale, context, logo, recipientName string, data interface{}) (subject string, parts []*Part, err error) {
 	var tpl *MailTemplate
 	for _, t := range m.tmpls {
 		if name == t.Name {
@@ -195,25 +209,32 @@ func (m *MailTemplater) Execute(name, locale string, recipientName string, data
 			tpl.cache = make(map[string]*mailCache)
 		}
 
+		// The texts can be customized for a context, and so the cache key is
+		// made of the locale and the version of the translations of the
+		// context.
+		key := locale
+		if version := i18n.ContextVersion(locale, context); version != "" {
+			key += ":" + context + ":" + version
+		}
 		var ok bool
-		c, ok = tpl.cache[locale]
+		c, ok = tpl.cache[key]
 		if !ok {
 			c = new(mailCache)
 			if !tpl.NoGreeting {
-				c.greeting = i18n.Translate("Mail Greeting", locale)
+				c.greeting = i18n.TranslateContext("Mail Greeting", locale, context)
 			}
-			c.signature = i18n.Translate("Mail Signature", locale)
+			c.signature = i18n.TranslateContext("Mail Signature", locale, context)
 			if tpl.Subject != "" {
-				c.subject = i18n.Translate(tpl.Subject, locale)
+				c.subject = i18n.TranslateContext(tpl.Subject, locale, context)
 			}
 			if tpl.Intro != "" {
-				c.intro, err = template.New("").Parse(i18n.Translate(tpl.Intro, locale))
+				c.intro, err = template.New("").Parse(i18n.TranslateContext(tpl.Intro, locale, context))
 				if err != nil {
 					return
 				}
 			}
 			if tpl.Outro != "" {
-				c.outro, err = template.New("").Parse(i18n.Translate(tpl.Outro, locale))
+				c.outro, err = template.New("").Parse(i18n.TranslateContext(tpl.Outro, locale, context))
 				if err != nil {
 					return
 				}
@@ -222,13 +243,13 @@ func (m *MailTemplater) Execute(name, locale string, recipientName string, data
 			for i, a := range tpl.Actions {
 				if a.Instructions != "" {
 					c.actions[i].instructions, err = template.New("").Parse(
-						i18n.Translate(a.Instructions, locale))
+						i18n.TranslateContext(a.Instructions, locale, context))
 					if err != nil {
 						return
 					}
 				}
 				if a.Text != "" {
-					c.actions[i].text = i18n.Translate(a.Text, locale)
+					c.actions[i].text = i18n.TranslateContext(a.Text, locale, context)
 				}
 				c.actions[i].link, err = template.New("").Parse(a.Link)
 				if err != nil {
@@ -237,13 +258,13 @@ func (m *MailTemplater) Execute(name, locale string, recipientName string, data
 			}
 			c.entries = make([]mailEntryCache, len(tpl.Entries))
 			for i, e := range tpl.Entries {
-				c.entries[i].key = i18n.Translate(e.Key, locale)
+				c.entries[i].key = i18n.TranslateContext(e.Key, locale, context)
 				c.entries[i].val, err = template.New("").Parse(e.Val)
 				if err != nil {
 					return
 				}
 			}
-			tpl.cache[locale] = c
+			tpl.cache[key] = c
 		}
 	}
 
@@ -252,7 +273,7 @@ func (m *MailTemplater) Execute(name, locale string, recipientName string, data
 		return
 	}
 
-	h := getHermes(locale)
+	h := getHermes(locale, context, logo)
 	email := hermes.Email{Body: body}
 	html, err := h.GenerateHTML(email)
 	if err != nil {
@@ -272,9 +293,9 @@ func (m *MailTemplater) Execute(name, locale string, recipientName string, data
 }
 
 // RenderMail returns a rendered mail for the given template name with the
-// specified locale, recipient name and template data values.
-func RenderMail(name, locale, recipientName string, templateValues interface{}) (string, []*Part, error) {
-	return mailTemplater.Execute(name, locale, recipientName, templateValues)
+// specified locale, context, logo, recipient name and template data values.
+func RenderMail(name, locale, context, logo, recipientName string, templateValues interface{}) (string, []*Part, error) {
+	return mailTemplater.Execute(name, locale, context, logo, recipientName, templateValues)
 }
 
 func init() {
@@ -304,6 +325,18 @@ func init() {
 				},
 			},
 		},
+		{
+			Name:    "portability",
+			Subject: "Mail Portability Subject",
+			Intro:   "Mail Portability Intro",
+			Actions: []MailAction{
+				{
+					Instructions: "Mail Archive Button instruction",
+					Text:         "Mail Archive Button text",
+					Link:         "{{.DownloadLink}}",
+				},
+			},
+		},
 		{
 			Name:    "two_factor",
 			Subject: "Mail Two Factor Subject",
@@ -365,6 +398,20 @@ func init() {
 			},
 		},
 
+		// Comments
+		{
+			Name:    "comment_mention",
+			Subject: "Mail Comment Mention Subject",
+			Intro:   "Mail Comment Mention Intro",
+			Outro:   "Mail Comment Text",
+		},
+		{
+			Name:    "comment_new",
+			Subject: "Mail Comment New Subject",
+			Intro:   "Mail Comment New Intro",
+			Outro:   "Mail Comment Text",
+		},
+
 		// Notifications
 		{
 			Name:    "notifications_diskquota",
@@ -383,6 +430,79 @@ func init() {
 				},
 			},
 		},
+		{
+			Name:    "notifications_konnector_interaction",
+			Subject: "Notifications Konnector Interaction Subject",
+			Intro:   "Notifications Konnector Interaction Intro",
+			Actions: []MailAction{
+				{
+					Instructions: "Notifications Konnector Interaction instruction",
+					Text:         "Notifications Konnector Interaction text",
+					Link:         "{{.KonnectorLink}}",
+				},
+			},
+		},
+		{
+			Name:    "notifications_bank_balance_lower",
+			Subject: "Notifications Bank Balance Lower Subject",
+			Intro:   "Notifications Bank Balance Lower Intro",
+			Actions: []MailAction{
+				{
+					Instructions: "Notifications Bank instruction",
+					Text:         "Notifications Bank text",
+					Link:         "{{.BanksLink}}",
+				},
+			},
+		},
+		{
+			Name:    "notifications_bank_large_transaction",
+			Subject: "Notifications Bank Large Transaction Subject",
+			Intro:   "Notifications Bank Large Transaction Intro",
+			Actions: []MailAction{
+				{
+					Instructions: "Notifications Bank instruction",
+					Text:         "Notifications Bank text",
+					Link:         "{{.BanksLink}}",
+				},
+			},
+		},
+		{
+			Name:    "notifications_corrupted_files",
+			Subject: "Notifications Corrupted Files Subject",
+			Intro:   "Notifications Corrupted Files Intro",
+			Actions: []MailAction{
+				{
+					Instructions: "Notifications Corrupted Files instruction",
+					Text:         "Notifications Corrupted Files text",
+					Link:         "{{.CozyDriveLink}}",
+				},
+			},
+		},
+		{
+			Name:    "digest",
+			Subject: "Mail Digest Subject",
+			Intro:   "Mail Digest Intro",
+			Actions: []MailAction{
+				{
+					Instructions: "Mail Digest instruction",
+					Text:         "Mail Digest text",
+					Link:         "{{.HomeLink}}",
+				},
+			},
+			Outro: "Mail Digest Outro",
+		},
+		{
+			Name:    "instance_deletion_scheduled",
+			Subject: "Mail Instance Deletion Scheduled Subject",
+			Intro:   "Mail Instance Deletion Scheduled Intro",
+			Outro:   "Mail Instance Deletion Outro",
+		},
+		{
+			Name:    "instance_deletion_reminder",
+			Subject: "Mail Instance Deletion Reminder Subject",
+			Intro:   "Mail Instance Deletion Reminder Intro",
+			Outro:   "Mail Instance Deletion Outro",
+		},
 	}}
 }
 
@@ -5,20 +5,25 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"io/ioutil"
 	"net"
 	"net/textproto"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/cache"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/statik/fs"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/cozy/gomail"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const serverString = `220 hello world
@@ -412,6 +417,47 @@ func TestSendMailFrom(t *testing.T) {
 	}
 }
 
+func TestMailLogo(t *testing.T) {
+	previousContext := inst.ContextName
+	defer func() { inst.ContextName = previousContext }()
+
+	inst.ContextName = ""
+	assert.Equal(t, defaultMailLogo, mailLogo(inst))
+
+	// A context without its own logo falls back to the default one
+	inst.ContextName = "without-logo"
+	assert.Equal(t, defaultMailLogo, mailLogo(inst))
+
+	dir, err := ioutil.TempDir("", "mails")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "icon-cozy-mail.png")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("logo of my context"), 0600))
+	err = fs.RegisterCustomExternals(cache.New(nil), []fs.AssetOption{{
+		Name:    mailLogoAsset,
+		Context: "my-context",
+		URL:     "file://" + filename,
+	}}, 0)
+	require.NoError(t, err)
+	asset, ok := fs.Get(mailLogoAsset, "my-context")
+	require.True(t, ok)
+
+	inst.ContextName = "my-context"
+	logo := mailLogo(inst)
+	assert.Equal(t, inst.PageURL("/assets/ext/my-context"+asset.NameWithSum, nil), logo)
+	assert.Regexp(t, `/assets/ext/my-context/images/icon-cozy-mail\.[0-9a-f]+\.png$`, logo)
+
+	templater := &MailTemplater{[]*MailTemplate{{Name: "logo", Subject: "Up?", Intro: "intro"}}}
+	_, parts, err := templater.Execute("logo", "en", "my-context", logo, "", nil)
+	require.NoError(t, err)
+	require.Len(t, parts, 2)
+	assert.Equal(t, "text/html", parts[0].Type)
+	assert.Contains(t, parts[0].Body, `src="`+logo+`"`)
+	_, parts, err = templater.Execute("logo", "en", "", "", "", nil)
+	require.NoError(t, err)
+	assert.Contains(t, parts[0].Body, `src="`+defaultMailLogo+`"`)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	setup := testutils.NewSetup(m, "mails_test")
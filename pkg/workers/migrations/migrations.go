@@ -13,6 +13,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/schema"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
 	"github.com/cozy/swift"
 	multierror "github.com/hashicorp/go-multierror"
@@ -36,10 +37,13 @@ func init() {
 }
 
 const swiftV1ToV2 = "swift-v1-to-v2"
+const indexes = instance.IndexesMigrationType
+const doctypeMigration = "doctype"
 
 type message struct {
 	Type    string `json:"type"`
 	Cluster int    `json:"cluster"`
+	Doctype string `json:"doctype,omitempty"`
 }
 
 func worker(ctx *jobs.WorkerContext) error {
@@ -53,6 +57,10 @@ func worker(ctx *jobs.WorkerContext) error {
 	switch msg.Type {
 	case swiftV1ToV2:
 		return migrateSwiftV1ToV2(domain)
+	case indexes:
+		return migrateIndexes(domain)
+	case doctypeMigration:
+		return migrateDoctype(domain, msg.Doctype)
 	default:
 		return fmt.Errorf("unknown migration type %q", msg.Type)
 	}
@@ -72,6 +80,8 @@ func commit(ctx *jobs.WorkerContext, err error) error {
 	switch msg.Type {
 	case swiftV1ToV2:
 		return commitSwiftV1ToV2(domain, msg.Cluster)
+	case indexes, doctypeMigration:
+		return nil
 	default:
 		return fmt.Errorf("unknown migration type %q", msg.Type)
 	}
@@ -83,6 +93,26 @@ type object struct {
 	containerDst string
 }
 
+func migrateIndexes(domain string) error {
+	// Getting the instance defines its views and indexes if they are outdated.
+	_, err := instance.Get(domain)
+	return err
+}
+
+// migrateDoctype applies the pending migrations of the schema of a doctype to
+// all its documents.
+func migrateDoctype(domain, doctype string) error {
+	if doctype == "" {
+		return fmt.Errorf("missing doctype for the migration")
+	}
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	_, err = schema.MigrateAll(inst, doctype)
+	return err
+}
+
 func migrateSwiftV1ToV2(domain string) error {
 	c := config.GetSwiftConnection()
 	inst, err := instance.Get(domain)
@@ -0,0 +1,177 @@
+package move
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/safehttp"
+)
+
+// maxReadRetries is the number of times the download of a file is resumed
+// after a read error, before giving up.
+const maxReadRetries = 3
+
+// transferClient only dials the public IP addresses, as the URL of the source
+// instance is given by the user.
+var transferClient = &http.Client{
+	Transport: safehttp.NewTransport(60 * time.Second),
+}
+
+// sourceClient is the client used by the target instance of a move for the
+// requests to the source instance. It is authenticated with the move token.
+type sourceClient struct {
+	base  *url.URL
+	token string
+}
+
+func newSourceClient(source, token string) (*sourceClient, error) {
+	u, err := url.Parse(strings.TrimSpace(source))
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, ErrInvalidMoveURL
+	}
+	return &sourceClient{base: &url.URL{Scheme: u.Scheme, Host: u.Host}, token: token}, nil
+}
+
+func (s *sourceClient) do(ctx context.Context, method, path string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	u := *s.base
+	u.Path = "/move/source" + path
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	res, err := transferClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		res.Body.Close()
+		return nil, ErrInvalidMoveToken
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		// The body is not put in the error, as it is saved in the transfer
+		// document and shown to the user.
+		res.Body.Close()
+		return nil, fmt.Errorf("move: source responded with %d", res.StatusCode)
+	}
+	return res, nil
+}
+
+func (s *sourceClient) getJSON(ctx context.Context, path string, query url.Values, out interface{}) error {
+	header := http.Header{"Accept": {"application/json"}}
+	res, err := s.do(ctx, http.MethodGet, path, query, header, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (s *sourceClient) info(ctx context.Context) (*SourceInfo, error) {
+	var info SourceInfo
+	if err := s.getJSON(ctx, "/info", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (s *sourceClient) docs(ctx context.Context, doctype, cursor string, out interface{}) error {
+	query := url.Values{"limit": {strconv.Itoa(docsPageSize)}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	return s.getJSON(ctx, "/docs/"+url.PathEscape(doctype), query, out)
+}
+
+// openFile returns the content of a file, from the given offset.
+func (s *sourceClient) openFile(ctx context.Context, fileID string, offset int64) (io.ReadCloser, error) {
+	header := make(http.Header)
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := s.do(ctx, http.MethodGet, "/files/"+url.PathEscape(fileID), nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, fmt.Errorf("move: the source cannot resume the download of %s", fileID)
+	}
+	return res.Body, nil
+}
+
+func (s *sourceClient) finish(ctx context.Context, target string) error {
+	body, err := json.Marshal(map[string]string{"target": target})
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	res, err := s.do(ctx, http.MethodPost, "/finish", nil, header, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// resumableReader reads the content of a file from the source instance. When
+// the connection is lost, the download is resumed from the last read byte,
+// with a Range request.
+type resumableReader struct {
+	ctx     context.Context
+	client  *sourceClient
+	fileID  string
+	offset  int64
+	retries int
+	body    io.ReadCloser
+}
+
+func newResumableReader(ctx context.Context, client *sourceClient, fileID string) *resumableReader {
+	return &resumableReader{ctx: ctx, client: client, fileID: fileID}
+}
+
+func (r *resumableReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			body, err := r.client.openFile(r.ctx, r.fileID, r.offset)
+			if err != nil {
+				return 0, err
+			}
+			r.body = body
+		}
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		r.body.Close()
+		r.body = nil
+		r.retries++
+		if r.retries > maxReadRetries || r.ctx.Err() != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumableReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
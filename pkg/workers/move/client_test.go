@@ -0,0 +1,77 @@
+package move
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumableReader(t *testing.T) {
+	content := bytes.Repeat([]byte("cozy-move "), 10000)
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer my-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// Cut the connection in the middle of the first response
+			w.Header().Set("Content-Length", "100000")
+			_, _ = w.Write(content[:30000])
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		http.ServeContent(w, r, "file", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	client, err := newSourceClient(ts.URL, "my-token")
+	require.NoError(t, err)
+	r := newResumableReader(context.Background(), client, "file-id")
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	require.Len(t, ranges, 2)
+	assert.Equal(t, "", ranges[0])
+	assert.True(t, strings.HasPrefix(ranges[1], "bytes="))
+	assert.NotEqual(t, "bytes=0-", ranges[1])
+
+	client.token = "invalid"
+	_, err = ioutil.ReadAll(newResumableReader(context.Background(), client, "file-id"))
+	assert.Equal(t, ErrInvalidMoveToken, err)
+}
+
+func TestNewSourceClient(t *testing.T) {
+	client, err := newSourceClient("https://alice.cozy.example/settings/#/move", "token")
+	require.NoError(t, err)
+	assert.Equal(t, "https://alice.cozy.example", client.base.String())
+	_, err = newSourceClient("alice.cozy.example", "token")
+	assert.Equal(t, ErrInvalidMoveURL, err)
+	_, err = newSourceClient("ftp://alice.cozy.example", "token")
+	assert.Equal(t, ErrInvalidMoveURL, err)
+}
+
+func TestSourceErrorWithoutBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("internal secret"))
+	}))
+	defer ts.Close()
+
+	client, err := newSourceClient(ts.URL, "my-token")
+	require.NoError(t, err)
+	_, err = client.info(context.Background())
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "internal secret")
+}
@@ -37,6 +37,15 @@ const (
 	ExportMetasDir = "My Cozy/Metadata"
 )
 
+const (
+	// ExportFormatJSON is the format of an export with all the documents in a
+	// single JSON object, with a key per doctype.
+	ExportFormatJSON = "json"
+	// ExportFormatNDJSON is the format of an export with a JSON object per
+	// line for each document, with its doctype.
+	ExportFormatNDJSON = "ndjson"
+)
+
 // ExportDoc is a documents storing the metadata of an export.
 type ExportDoc struct {
 	DocID     string `json:"_id,omitempty"`
@@ -47,6 +56,7 @@ type ExportDoc struct {
 	PartsCursors     []string      `json:"parts_cursors,omitempty"`
 	WithDoctypes     []string      `json:"with_doctypes,omitempty"`
 	WithoutFiles     bool          `json:"without_files,omitempty"`
+	Format           string        `json:"format,omitempty"`
 	State            string        `json:"state"`
 	CreatedAt        time.Time     `json:"created_at"`
 	ExpiresAt        time.Time     `json:"expires_at"`
@@ -74,6 +84,9 @@ var (
 	ErrExportDoesNotContainIndex = echo.NewHTTPError(http.StatusBadRequest, "export: archive does not contain index data")
 	// ErrExportInvalidCursor is used when the given index cursor is invalid
 	ErrExportInvalidCursor = echo.NewHTTPError(http.StatusBadRequest, "export: cursor is invalid")
+	// ErrExportInvalidFormat is used when the given format is not a known
+	// export format.
+	ErrExportInvalidFormat = echo.NewHTTPError(http.StatusBadRequest, "export: format is invalid")
 )
 
 const (
@@ -124,6 +137,16 @@ func (e *ExportDoc) Relationships() jsonapi.RelationshipMap { return nil }
 // Included implements the jsonapi.Object interface
 func (e *ExportDoc) Included() []jsonapi.Object { return nil }
 
+// IsValidExportFormat returns true if the given format is empty (for the
+// archive with the files) or one of the formats for the data portability.
+func IsValidExportFormat(format string) bool {
+	switch format {
+	case "", ExportFormatJSON, ExportFormatNDJSON:
+		return true
+	}
+	return false
+}
+
 // HasExpired returns whether or not the export document has expired.
 func (e *ExportDoc) HasExpired() bool {
 	return time.Until(e.ExpiresAt) <= 0
@@ -206,6 +229,13 @@ func ExportCopyData(w http.ResponseWriter, inst *instance.Instance, archiver Arc
 		return ErrExportExpired
 	}
 
+	if exportDoc.Format != "" {
+		if cursorStr != "" {
+			return ErrExportInvalidCursor
+		}
+		return exportCopyPortableData(w, inst, archiver, exportDoc)
+	}
+
 	partNumber := 0
 	// check that the given cursor is part of our pre-defined list of cursors.
 	if cursorStr != "" {
@@ -385,8 +415,39 @@ func ExportCopyData(w http.ResponseWriter, inst *instance.Instance, archiver Arc
 	return
 }
 
-// Export is used to create a tarball with files and photos from an instance
+// exportCopyPortableData sends the JSON or NDJSON file of an export made for
+// the data portability.
+func exportCopyPortableData(w http.ResponseWriter, inst *instance.Instance, archiver Archiver, exportDoc *ExportDoc) error {
+	archive, _, err := archiver.OpenArchive(inst, exportDoc)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	gr, err := gzip.NewReader(archive)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	contentType := "application/json"
+	if exportDoc.Format == ExportFormatNDJSON {
+		contentType = "application/x-ndjson"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=cozy-export.%s", exportDoc.Format))
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, gr)
+	return err
+}
+
+// Export is used to create a tarball with files and photos from an instance.
+// With a format for the data portability, it creates instead a JSON or NDJSON
+// file with the documents of the doctypes, including the metadata of the
+// files, but not their content.
 func Export(i *instance.Instance, opts ExportOptions, archiver Archiver) (exportDoc *ExportDoc, err error) {
+	if !IsValidExportFormat(opts.Format) {
+		return nil, ErrExportInvalidFormat
+	}
 	createdAt := time.Now()
 
 	bucketSize := opts.PartsSize
@@ -405,7 +466,8 @@ func Export(i *instance.Instance, opts ExportOptions, archiver Archiver) (export
 		CreatedAt:    createdAt,
 		ExpiresAt:    createdAt.Add(maxAge),
 		WithDoctypes: opts.WithDoctypes,
-		WithoutFiles: opts.WithoutFiles,
+		WithoutFiles: opts.WithoutFiles || opts.Format != "",
+		Format:       opts.Format,
 		TotalSize:    -1,
 		PartsSize:    bucketSize,
 	}
@@ -461,6 +523,24 @@ func Export(i *instance.Instance, opts ExportOptions, archiver Archiver) (export
 		}
 	}()
 
+	if exportDoc.Format != "" {
+		// The portable formats are downloaded as a single gzip archive: its
+		// total size is the size of the compressed data, not of the documents.
+		cw := &countWriter{w: out}
+		var gw *gzip.Writer
+		gw, err = gzip.NewWriterLevel(cw, gzip.BestCompression)
+		if err != nil {
+			return
+		}
+		defer func() {
+			if errc := gw.Close(); err == nil {
+				err = errc
+			}
+			size = cw.n
+		}()
+		_, err = exportPortableDocs(i, exportDoc.Format, opts.WithDoctypes, gw)
+		return
+	}
 	gw, err := gzip.NewWriterLevel(out, gzip.BestCompression)
 	if err != nil {
 		return
@@ -683,6 +763,23 @@ func parseCursor(cursor string) (c indexCursor, err error) {
 	return
 }
 
+// isExportedDoctype returns false for the doctypes that are never exported:
+// the logs, the sessions, the credentials of the devices, etc.
+func isExportedDoctype(doctype string) bool {
+	switch doctype {
+	case consts.KonnectorLogs, consts.Archives,
+		consts.Sessions, consts.OAuthClients, consts.OAuthAccessCodes,
+		consts.OAuthPairingCodes, consts.NotificationDevices,
+		consts.AppPasswords, consts.BitwardenProfiles:
+		// ignore these doctypes
+		return false
+	case consts.Sharings, consts.SharingsAnswer, consts.Shared:
+		// ignore sharings ? TBD
+		return false
+	}
+	return true
+}
+
 func exportDocs(in *instance.Instance, withDoctypes []string, now time.Time, tw *tar.Writer) (size int64, err error) {
 	doctypes, err := couchdb.AllDoctypes(in)
 	if err != nil {
@@ -692,12 +789,10 @@ func exportDocs(in *instance.Instance, withDoctypes []string, now time.Time, tw
 		if len(withDoctypes) > 0 && !utils.IsInArray(doctype, withDoctypes) {
 			continue
 		}
+		if !isExportedDoctype(doctype) {
+			continue
+		}
 		switch doctype {
-		case consts.KonnectorLogs, consts.Archives,
-			consts.Sessions, consts.OAuthClients, consts.OAuthAccessCodes:
-			// ignore these doctypes
-		case consts.Sharings, consts.SharingsAnswer, consts.Shared:
-			// ignore sharings ? TBD
 		case consts.Files, consts.Settings:
 			// already written out in a special file
 		default:
@@ -718,6 +813,90 @@ func exportDocs(in *instance.Instance, withDoctypes []string, now time.Time, tw
 	return
 }
 
+// countWriter is an io.Writer that counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// exportPortableDocs writes the documents of the doctypes in the JSON or NDJSON
+// format. In JSON, it is an object with the doctypes as keys, and the lists of
+// documents as values. In NDJSON, each line is an object with the doctype and
+// the document. The io.cozy.files documents are included, for the metadata
+// of the files and of the directories.
+func exportPortableDocs(in *instance.Instance, format string, withDoctypes []string, w io.Writer) (size int64, err error) {
+	doctypes, err := couchdb.AllDoctypes(in)
+	if err != nil {
+		return
+	}
+	write := func(parts ...[]byte) error {
+		for _, p := range parts {
+			n, errw := w.Write(p)
+			size += int64(n)
+			if errw != nil {
+				return errw
+			}
+		}
+		return nil
+	}
+
+	if format == ExportFormatJSON {
+		if err = write([]byte("{")); err != nil {
+			return
+		}
+	}
+	first := true
+	for _, doctype := range doctypes {
+		if len(withDoctypes) > 0 && !utils.IsInArray(doctype, withDoctypes) {
+			continue
+		}
+		if !isExportedDoctype(doctype) {
+			continue
+		}
+		key, _ := json.Marshal(doctype)
+		if format == ExportFormatJSON {
+			sep := ","
+			if first {
+				sep = ""
+			}
+			if err = write([]byte(sep), key, []byte(":[")); err != nil {
+				return
+			}
+		}
+		first = false
+		firstDoc := true
+		err = couchdb.ForeachDocs(in, doctype, func(_ string, doc json.RawMessage) error {
+			if format == ExportFormatNDJSON {
+				return write([]byte(`{"doctype":`), key, []byte(`,"doc":`), doc, []byte("}\n"))
+			}
+			sep := ","
+			if firstDoc {
+				sep = ""
+			}
+			firstDoc = false
+			return write([]byte(sep), doc)
+		})
+		if err != nil {
+			return
+		}
+		if format == ExportFormatJSON {
+			if err = write([]byte("]")); err != nil {
+				return
+			}
+		}
+	}
+	if format == ExportFormatJSON {
+		err = write([]byte("}"))
+	}
+	return
+}
+
 func writeInstanceDoc(in *instance.Instance, name string,
 	now time.Time, tw *tar.Writer) (int64, error) {
 	clone := in.Clone().(*instance.Instance)
@@ -728,6 +907,7 @@ func writeInstanceDoc(in *instance.Instance, name string,
 	clone.SessionSecret = nil
 	clone.OAuthSecret = nil
 	clone.CLISecret = nil
+	clone.JWTKeys = nil
 	clone.SwiftCluster = 0
 	return writeDoc("", name, clone, now, tw)
 }
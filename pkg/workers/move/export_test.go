@@ -0,0 +1,127 @@
+package move
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const exportedDoctype = "io.cozy.tests.exports"
+
+var inst *instance.Instance
+
+func createExportedDocs(t *testing.T) map[string]bool {
+	ids := make(map[string]bool)
+	for _, name := range []string{"foo", "bar", "baz"} {
+		doc := couchdb.JSONDoc{
+			Type: exportedDoctype,
+			M:    map[string]interface{}{"name": name},
+		}
+		require.NoError(t, couchdb.CreateDoc(inst, &doc))
+		ids[doc.ID()] = true
+	}
+	return ids
+}
+
+func TestExportPortableDocsNDJSON(t *testing.T) {
+	ids := createExportedDocs(t)
+	var buf bytes.Buffer
+	size, err := exportPortableDocs(inst, ExportFormatNDJSON, []string{exportedDoctype}, &buf)
+	require.NoError(t, err)
+	assert.EqualValues(t, buf.Len(), size)
+
+	scanner := bufio.NewScanner(&buf)
+	count := 0
+	for scanner.Scan() {
+		var line struct {
+			Doctype string                 `json:"doctype"`
+			Doc     map[string]interface{} `json:"doc"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		assert.Equal(t, exportedDoctype, line.Doctype)
+		assert.True(t, ids[line.Doc["_id"].(string)])
+		assert.NotEmpty(t, line.Doc["name"])
+		count++
+	}
+	require.NoError(t, scanner.Err())
+	assert.Equal(t, len(ids), count)
+}
+
+func TestExportPortableDocsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	size, err := exportPortableDocs(inst, ExportFormatJSON, []string{exportedDoctype}, &buf)
+	require.NoError(t, err)
+	assert.EqualValues(t, buf.Len(), size)
+
+	var export map[string][]map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &export))
+	assert.Len(t, export, 1)
+	docs, ok := export[exportedDoctype]
+	require.True(t, ok)
+	// The documents of the NDJSON test are also exported
+	assert.True(t, len(docs) >= 3)
+	for _, doc := range docs {
+		assert.NotEmpty(t, doc["_id"])
+		assert.NotEmpty(t, doc["name"])
+	}
+
+	// A doctype without documents is exported as an empty object
+	buf.Reset()
+	_, err = exportPortableDocs(inst, ExportFormatJSON, []string{"io.cozy.tests.nothing"}, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, "{}", buf.String())
+}
+
+func TestExportInvalidFormat(t *testing.T) {
+	assert.True(t, IsValidExportFormat(""))
+	assert.True(t, IsValidExportFormat(ExportFormatJSON))
+	assert.True(t, IsValidExportFormat(ExportFormatNDJSON))
+	assert.False(t, IsValidExportFormat("csv"))
+	_, err := Export(inst, ExportOptions{Format: "csv"}, nil)
+	assert.Equal(t, ErrExportInvalidFormat, err)
+}
+
+func TestExportPortableTotalSize(t *testing.T) {
+	createExportedDocs(t)
+	archiver := newAferoArchiver(afero.NewMemMapFs())
+	exportDoc, err := Export(inst, ExportOptions{
+		Format:       ExportFormatNDJSON,
+		WithDoctypes: []string{exportedDoctype},
+	}, archiver)
+	require.NoError(t, err)
+
+	// The total size is the size of the gzip archive that is downloaded
+	var doc ExportDoc
+	require.NoError(t, couchdb.GetDoc(couchdb.GlobalDB, consts.Exports, exportDoc.ID(), &doc))
+	assert.Equal(t, ExportStateDone, doc.State)
+	archive, size, err := archiver.OpenArchive(inst, &doc)
+	require.NoError(t, err)
+	defer archive.Close()
+	assert.Equal(t, size, doc.TotalSize)
+	gr, err := gzip.NewReader(archive)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(gr)
+	require.NoError(t, err)
+	assert.True(t, int64(len(data)) > 0)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "move_test")
+	inst = setup.GetTestInstance()
+	os.Exit(setup.Run())
+}
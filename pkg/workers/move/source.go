@@ -0,0 +1,204 @@
+package move
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/accounts"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+)
+
+const (
+	moveTokenTTL     = 7 * 24 * time.Hour
+	moveTokenLen     = 32
+	maxDocsPageLimit = 1000
+)
+
+var (
+	// ErrInvalidMoveToken is used when the token given by the target instance
+	// is unknown or has expired.
+	ErrInvalidMoveToken = errors.New("Invalid move token")
+	// ErrInvalidMoveURL is used when the URL of the source or of the target
+	// instance of a move is not valid.
+	ErrInvalidMoveURL = errors.New("Invalid URL for the instance")
+	// ErrNotMovedDoctype is used when the target instance asks for the
+	// documents of a doctype that is not moved.
+	ErrNotMovedDoctype = errors.New("This doctype is not moved")
+)
+
+// MoveToken is the document, on the source instance, for a token that gives
+// to the target instance a read access to the documents and files. Its
+// identifier is the SHA-256 of the token, so that the token itself is not
+// persisted.
+type MoveToken struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	Kind      string    `json:"kind"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ID implements the couchdb.Doc interface
+func (t *MoveToken) ID() string { return t.DocID }
+
+// Rev implements the couchdb.Doc interface
+func (t *MoveToken) Rev() string { return t.DocRev }
+
+// DocType implements the couchdb.Doc interface
+func (t *MoveToken) DocType() string { return consts.Moves }
+
+// SetID implements the couchdb.Doc interface
+func (t *MoveToken) SetID(id string) { t.DocID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (t *MoveToken) SetRev(rev string) { t.DocRev = rev }
+
+// Clone implements the couchdb.Doc interface
+func (t *MoveToken) Clone() couchdb.Doc {
+	cloned := *t
+	return &cloned
+}
+
+// SourceInfo is the description of the source instance, sent to the target
+// instance at the start of a transfer.
+type SourceInfo struct {
+	Domain   string   `json:"domain"`
+	Doctypes []string `json:"doctypes"`
+}
+
+// DocsPage is a page of the documents of a doctype sent by the source
+// instance. Next is the cursor for the next page, and it is empty for the
+// last page.
+type DocsPage struct {
+	Docs []map[string]interface{} `json:"docs"`
+	Next string                   `json:"next,omitempty"`
+}
+
+func hashMoveToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateMoveToken generates a new token that the user can give to the target
+// instance of a move. The token is only returned here.
+func CreateMoveToken(inst *instance.Instance) (string, *MoveToken, error) {
+	token := crypto.GenerateRandomString(moveTokenLen)
+	now := time.Now().UTC()
+	doc := &MoveToken{
+		DocID:     hashMoveToken(token),
+		Kind:      "token",
+		CreatedAt: now,
+		ExpiresAt: now.Add(moveTokenTTL),
+	}
+	if err := couchdb.CreateNamedDocWithDB(inst, doc); err != nil {
+		return "", nil, err
+	}
+	return token, doc, nil
+}
+
+// CheckMoveToken returns the document of the token if it is valid.
+func CheckMoveToken(inst *instance.Instance, token string) (*MoveToken, error) {
+	if token == "" {
+		return nil, ErrInvalidMoveToken
+	}
+	var doc MoveToken
+	if err := couchdb.GetDoc(inst, consts.Moves, hashMoveToken(token), &doc); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil, ErrInvalidMoveToken
+		}
+		return nil, err
+	}
+	if doc.Kind != "token" || time.Now().After(doc.ExpiresAt) {
+		return nil, ErrInvalidMoveToken
+	}
+	return &doc, nil
+}
+
+// isMovedDoctype returns false for the doctypes that are not moved to the
+// target instance: they are linked to the source instance, like the sessions,
+// the OAuth clients, the applications or the jobs.
+func isMovedDoctype(doctype string) bool {
+	switch doctype {
+	case consts.Moves, consts.Backups, consts.Exports, consts.KonnectorLogs,
+		consts.Archives, consts.Sessions, consts.SessionsLogins,
+		consts.OAuthClients, consts.OAuthAccessCodes, consts.OAuthPairingCodes,
+		consts.NotificationDevices, consts.AppPasswords, consts.Permissions,
+		consts.Apps, consts.Konnectors, consts.Jobs, consts.Triggers,
+		consts.TriggersState, consts.Sharings, consts.SharingsAnswer,
+		consts.Shared, consts.BitwardenProfiles, consts.RemoteRequests:
+		return false
+	}
+	return true
+}
+
+// GetSourceInfo returns the domain and the moved doctypes of the source
+// instance.
+func GetSourceInfo(inst *instance.Instance) (*SourceInfo, error) {
+	doctypes, err := couchdb.AllDoctypes(inst)
+	if err != nil {
+		return nil, err
+	}
+	info := &SourceInfo{Domain: inst.Domain, Doctypes: []string{}}
+	for _, doctype := range doctypes {
+		if isMovedDoctype(doctype) {
+			info.Doctypes = append(info.Doctypes, doctype)
+		}
+	}
+	return info, nil
+}
+
+// GetDocsPage returns the documents of a doctype after the given cursor, in
+// the order of their identifiers. The credentials of the accounts are
+// decrypted, as the target instance will encrypt them with its own key.
+func GetDocsPage(inst *instance.Instance, doctype, cursor string, limit int) (*DocsPage, error) {
+	if !isMovedDoctype(doctype) {
+		return nil, ErrNotMovedDoctype
+	}
+	if limit <= 0 || limit > maxDocsPageLimit {
+		limit = maxDocsPageLimit
+	}
+	req := &couchdb.AllDocsRequest{Limit: limit}
+	if cursor != "" {
+		req.StartKey = cursor
+		req.Skip = 1
+	}
+	page := &DocsPage{Docs: []map[string]interface{}{}}
+	if err := couchdb.GetAllDocs(inst, doctype, req, &page.Docs); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return page, nil
+		}
+		return nil, err
+	}
+	// The design documents are filtered out, so a page with less documents
+	// than the limit is not always the last one: only an empty page is.
+	if n := len(page.Docs); n > 0 {
+		page.Next, _ = page.Docs[n-1]["_id"].(string)
+	}
+	if doctype == consts.Accounts {
+		for _, doc := range page.Docs {
+			accounts.DecryptAccount(inst, couchdb.JSONDoc{M: doc, Type: doctype})
+		}
+	}
+	return page, nil
+}
+
+// FinishMove is called by the target instance at the end of a transfer: the
+// source instance is put in redirect mode to the target, and the token is
+// revoked.
+func FinishMove(inst *instance.Instance, token *MoveToken, target string) error {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return ErrInvalidMoveURL
+	}
+	movedTo := u.Scheme + "://" + u.Host
+	if err = instance.Patch(inst, &instance.Options{MovedTo: &movedTo}); err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(inst, token)
+}
@@ -0,0 +1,479 @@
+package move
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/accounts"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+)
+
+// The states of a transfer
+const (
+	TransferRunning = "running"
+	TransferDone    = "done"
+	TransferErrored = "errored"
+)
+
+// The steps of a transfer, in order
+const (
+	stepDocs   = "docs"
+	stepDirs   = "dirs"
+	stepFiles  = "files"
+	stepFinish = "finish"
+)
+
+const docsPageSize = 200
+
+// ErrTransferNotFound is used when the transfer is not found.
+var ErrTransferNotFound = errors.New("Transfer not found")
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "transfer",
+		Concurrency:  2,
+		MaxExecCount: 3,
+		Timeout:      24 * time.Hour,
+		WorkerFunc:   TransferWorker,
+	})
+}
+
+// Transfer is the document, on the target instance, for the progress of the
+// copy of the data from the source instance. It keeps a cursor for the
+// current step, so that the transfer can be resumed after an error.
+type Transfer struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+	Kind   string `json:"kind"`
+	Source string `json:"source"`
+	Token  string `json:"token"` // encrypted with the key of the instance
+	State  string `json:"state"`
+	Error  string `json:"error,omitempty"`
+
+	Step         string            `json:"step"`
+	DoneDoctypes []string          `json:"done_doctypes,omitempty"`
+	Cursor       string            `json:"cursor,omitempty"`
+	Dirs         map[string]string `json:"dirs,omitempty"` // source ID -> target ID, for the existing dirs
+	DocsCount    int               `json:"docs_count"`
+	FilesCount   int               `json:"files_count"`
+	BytesCount   int64             `json:"bytes_count"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ID implements the couchdb.Doc interface
+func (t *Transfer) ID() string { return t.DocID }
+
+// Rev implements the couchdb.Doc interface
+func (t *Transfer) Rev() string { return t.DocRev }
+
+// DocType implements the couchdb.Doc interface
+func (t *Transfer) DocType() string { return consts.Moves }
+
+// SetID implements the couchdb.Doc interface
+func (t *Transfer) SetID(id string) { t.DocID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (t *Transfer) SetRev(rev string) { t.DocRev = rev }
+
+// Clone implements the couchdb.Doc interface
+func (t *Transfer) Clone() couchdb.Doc {
+	cloned := *t
+	cloned.DoneDoctypes = make([]string, len(t.DoneDoctypes))
+	copy(cloned.DoneDoctypes, t.DoneDoctypes)
+	cloned.Dirs = make(map[string]string, len(t.Dirs))
+	for k, v := range t.Dirs {
+		cloned.Dirs[k] = v
+	}
+	return &cloned
+}
+
+// Links implements the jsonapi.Object interface
+func (t *Transfer) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/move/transfers/" + t.DocID}
+}
+
+// Relationships implements the jsonapi.Object interface
+func (t *Transfer) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Included implements the jsonapi.Object interface
+func (t *Transfer) Included() []jsonapi.Object { return nil }
+
+// TransferMessage is the message of the transfer worker.
+type TransferMessage struct {
+	TransferID string `json:"transfer_id"`
+}
+
+// StartTransfer checks that the token is accepted by the source instance,
+// and pushes a job to pull the data from it.
+func StartTransfer(inst *instance.Instance, source, token string) (*Transfer, error) {
+	client, err := newSourceClient(source, token)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = client.info(inst.Context()); err != nil {
+		return nil, err
+	}
+	encrypted, err := accounts.EncryptInstanceCredentials(inst, "", token)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	t := &Transfer{
+		Kind:      "transfer",
+		Source:    client.base.String(),
+		Token:     encrypted,
+		State:     TransferRunning,
+		Step:      stepDocs,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err = couchdb.CreateDoc(inst, t); err != nil {
+		return nil, err
+	}
+	msg, err := jobs.NewMessage(&TransferMessage{TransferID: t.DocID})
+	if err != nil {
+		return nil, err
+	}
+	_, err = jobs.System().PushJob(inst, &jobs.JobRequest{
+		WorkerType: "transfer",
+		Message:    msg,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// GetTransfer returns the transfer with the given identifier.
+func GetTransfer(inst *instance.Instance, id string) (*Transfer, error) {
+	var t Transfer
+	if err := couchdb.GetDoc(inst, consts.Moves, id, &t); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil, ErrTransferNotFound
+		}
+		return nil, err
+	}
+	if t.Kind != "transfer" {
+		return nil, ErrTransferNotFound
+	}
+	return &t, nil
+}
+
+// TransferWorker is the worker that pulls the documents and the files from
+// the source instance. A failed job starts again from the last saved cursor.
+func TransferWorker(ctx *jobs.WorkerContext) error {
+	var msg TransferMessage
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	t, err := GetTransfer(inst, msg.TransferID)
+	if err != nil {
+		return err
+	}
+	if t.State == TransferDone {
+		return nil
+	}
+	_, token, err := accounts.DecryptInstanceCredentials(inst, t.Token)
+	if err != nil {
+		return err
+	}
+	client, err := newSourceClient(t.Source, token)
+	if err != nil {
+		return err
+	}
+	tr := &transferer{ctx: ctx, inst: inst, client: client, transfer: t}
+	t.State = TransferRunning
+	t.Error = ""
+	if err = tr.save(); err != nil {
+		return err
+	}
+
+	if err = tr.run(); err != nil {
+		ctx.Logger().Warnf("Transfer %s: %s", t.DocID, err)
+		if err == ErrInvalidMoveToken {
+			ctx.SetNoRetry()
+		}
+		t.State = TransferErrored
+		t.Error = err.Error()
+		_ = tr.save()
+		return err
+	}
+	t.State = TransferDone
+	return tr.save()
+}
+
+// transferer pulls the data of a source instance for a transfer.
+type transferer struct {
+	ctx      *jobs.WorkerContext
+	inst     *instance.Instance
+	client   *sourceClient
+	transfer *Transfer
+}
+
+func (tr *transferer) save() error {
+	tr.transfer.UpdatedAt = time.Now().UTC()
+	return couchdb.UpdateDoc(tr.inst, tr.transfer)
+}
+
+// nextStep goes to the next step, and saves the progress.
+func (tr *transferer) nextStep(step string) error {
+	tr.transfer.Step = step
+	tr.transfer.Cursor = ""
+	return tr.save()
+}
+
+func (tr *transferer) run() error {
+	t := tr.transfer
+	if t.Step == stepDocs {
+		info, err := tr.client.info(tr.ctx)
+		if err != nil {
+			return err
+		}
+		sort.Strings(info.Doctypes)
+		for _, doctype := range info.Doctypes {
+			if doctype == consts.Files || !isMovedDoctype(doctype) ||
+				utils.IsInArray(doctype, t.DoneDoctypes) {
+				continue
+			}
+			if err = tr.transferDocs(doctype); err != nil {
+				return err
+			}
+		}
+		if err = tr.nextStep(stepDirs); err != nil {
+			return err
+		}
+	}
+	if t.Step == stepDirs {
+		if err := tr.transferDirs(); err != nil {
+			return err
+		}
+		if err := tr.nextStep(stepFiles); err != nil {
+			return err
+		}
+	}
+	if t.Step == stepFiles {
+		if err := tr.transferFiles(); err != nil {
+			return err
+		}
+		if err := tr.nextStep(stepFinish); err != nil {
+			return err
+		}
+	}
+	return tr.client.finish(tr.ctx, tr.inst.PageURL("/", nil))
+}
+
+// transferDocs copies the documents of a doctype, with their revisions. A
+// page is saved at once, and the cursor is saved after it.
+func (tr *transferer) transferDocs(doctype string) error {
+	t := tr.transfer
+	if err := couchdb.CreateDB(tr.inst, doctype); err != nil && !couchdb.IsFileExists(err) {
+		return err
+	}
+	for {
+		var page DocsPage
+		if err := tr.client.docs(tr.ctx, doctype, t.Cursor, &page); err != nil {
+			return err
+		}
+		if len(page.Docs) == 0 {
+			break
+		}
+		if doctype == consts.Accounts {
+			for _, doc := range page.Docs {
+				if _, err := accounts.EncryptAccount(tr.inst, couchdb.JSONDoc{M: doc, Type: doctype}); err != nil {
+					return err
+				}
+			}
+		}
+		if err := couchdb.BulkForceUpdateDocs(tr.inst, doctype, page.Docs); err != nil {
+			return err
+		}
+		t.DocsCount += len(page.Docs)
+		t.Cursor = page.Next
+		if err := tr.save(); err != nil {
+			return err
+		}
+	}
+	t.DoneDoctypes = append(t.DoneDoctypes, doctype)
+	t.Cursor = ""
+	return tr.save()
+}
+
+// filesPage is a page of the io.cozy.files documents of the source instance.
+type filesPage struct {
+	Docs []*vfs.DirOrFileDoc `json:"docs"`
+	Next string              `json:"next,omitempty"`
+}
+
+// transferDirs creates the directories of the source instance, with the same
+// identifiers. They are created from the shortest paths, so that the parent
+// of a directory always exists when it is created.
+func (tr *transferer) transferDirs() error {
+	var dirs []*vfs.DirDoc
+	cursor := ""
+	for {
+		var page filesPage
+		if err := tr.client.docs(tr.ctx, consts.Files, cursor, &page); err != nil {
+			return err
+		}
+		if len(page.Docs) == 0 {
+			break
+		}
+		for _, doc := range page.Docs {
+			if dir, _ := doc.Refine(); dir != nil {
+				dirs = append(dirs, dir)
+			}
+		}
+		cursor = page.Next
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i].Fullpath, "/") < strings.Count(dirs[j].Fullpath, "/")
+	})
+	for _, dir := range dirs {
+		if err := tr.transferDir(dir); err != nil {
+			return err
+		}
+	}
+	return tr.save()
+}
+
+func (tr *transferer) transferDir(dir *vfs.DirDoc) error {
+	if dir.DocID == consts.RootDirID || dir.DocID == consts.TrashDirID ||
+		strings.HasPrefix(dir.Fullpath, vfs.TrashDirName) {
+		return nil
+	}
+	fs := tr.inst.VFS()
+	if _, err := fs.DirByID(dir.DocID); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// A directory with the same path, like the ones created for a new
+	// instance, is reused instead.
+	existing, err := fs.DirByPath(dir.Fullpath)
+	if err == nil {
+		if tr.transfer.Dirs == nil {
+			tr.transfer.Dirs = make(map[string]string)
+		}
+		tr.transfer.Dirs[dir.DocID] = existing.DocID
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	doc, err := vfs.NewDirDocWithPath(dir.DocName, tr.dirID(dir.DirID), path.Dir(dir.Fullpath), dir.Tags)
+	if err != nil {
+		return err
+	}
+	doc.DocID = dir.DocID
+	doc.CreatedAt = dir.CreatedAt
+	doc.UpdatedAt = dir.UpdatedAt
+	doc.ReferencedBy = dir.ReferencedBy
+	return fs.CreateDir(doc)
+}
+
+// dirID returns the identifier on the target instance of a directory of the
+// source instance.
+func (tr *transferer) dirID(sourceID string) string {
+	if id, ok := tr.transfer.Dirs[sourceID]; ok {
+		return id
+	}
+	return sourceID
+}
+
+// transferFiles copies the files that are not in the trash. A file that is
+// already on the target instance with the same content is skipped, so the
+// files of a page can be copied again when a transfer is resumed.
+func (tr *transferer) transferFiles() error {
+	t := tr.transfer
+	for {
+		var page filesPage
+		if err := tr.client.docs(tr.ctx, consts.Files, t.Cursor, &page); err != nil {
+			return err
+		}
+		if len(page.Docs) == 0 {
+			return nil
+		}
+		for _, doc := range page.Docs {
+			if err := tr.ctx.Err(); err != nil {
+				return err
+			}
+			_, file := doc.Refine()
+			if file == nil || file.Trashed {
+				continue
+			}
+			if err := tr.transferFile(file); err != nil {
+				return err
+			}
+		}
+		t.Cursor = page.Next
+		if err := tr.save(); err != nil {
+			return err
+		}
+	}
+}
+
+func (tr *transferer) transferFile(file *vfs.FileDoc) error {
+	fs := tr.inst.VFS()
+	olddoc, err := fs.FileByID(file.DocID)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if olddoc != nil && bytes.Equal(olddoc.MD5Sum, file.MD5Sum) {
+		return nil
+	}
+	newdoc, err := vfs.NewFileDoc(file.DocName, tr.dirID(file.DirID), file.ByteSize,
+		file.MD5Sum, file.Mime, file.Class, file.CreatedAt, file.Executable,
+		false, file.Tags)
+	if err != nil {
+		return err
+	}
+	if olddoc == nil {
+		newdoc.DocID = file.DocID
+	}
+	newdoc.UpdatedAt = file.UpdatedAt
+	newdoc.Metadata = file.Metadata
+	newdoc.ReferencedBy = file.ReferencedBy
+	if err = vfs.InheritEncryption(fs, newdoc); err != nil {
+		return err
+	}
+
+	content := newResumableReader(tr.ctx, tr.client, file.DocID)
+	defer content.Close()
+	f, err := fs.CreateFile(newdoc, olddoc)
+	if os.IsExist(err) {
+		// Another file has the same path on the target instance
+		tr.ctx.Logger().Infof("Transfer %s: file %s skipped: %s",
+			tr.transfer.DocID, file.DocID, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, content)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	tr.transfer.FilesCount++
+	tr.transfer.BytesCount += n
+	return nil
+}
@@ -3,6 +3,7 @@ package move
 import (
 	"encoding/base64"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -27,6 +28,7 @@ type ExportOptions struct {
 	MaxAge       time.Duration `json:"max_age"`
 	WithDoctypes []string      `json:"with_doctypes,omitempty"`
 	WithoutFiles bool          `json:"without_files,omitempty"`
+	Format       string        `json:"format,omitempty"`
 }
 
 // ExportWorker is the worker responsible for creating an export of the
@@ -55,6 +57,15 @@ func ExportWorker(c *jobs.WorkerContext) error {
 		TemplateName:   "archiver",
 		TemplateValues: map[string]string{"ArchiveLink": link.String()},
 	}
+	if exportDoc.Format != "" {
+		// The file for the data portability can be downloaded directly, with
+		// the signed link.
+		mail.TemplateName = "portability"
+		mail.TemplateValues = map[string]string{
+			"DownloadLink": i.PageURL("/move/exports/data/"+mac, nil),
+			"Format":       strings.ToUpper(exportDoc.Format),
+		}
+	}
 
 	msg, err := jobs.NewMessage(&mail)
 	if err != nil {
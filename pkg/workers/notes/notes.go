@@ -0,0 +1,40 @@
+package notes
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/notes"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "notes-save",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Timeout:      2 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that writes a note to its markdown file in the VFS.
+func Worker(ctx *jobs.WorkerContext) error {
+	var msg notes.SaveMessage
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	ctx.Logger().WithField("nspace", "notes").Debugf("Saving the note %s", msg.NoteID)
+	err = notes.Save(i, msg.NoteID)
+	if couchdb.IsNotFoundError(err) {
+		// The note has been deleted
+		return nil
+	}
+	return err
+}
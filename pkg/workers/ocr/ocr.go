@@ -0,0 +1,308 @@
+// Package ocr is for the worker that extracts the text of the images and of
+// the scanned PDFs, with tesseract. This worker is optional: the text is
+// extracted only if the path to tesseract has been configured, and for the
+// instances where the ocr feature flag is enabled.
+package ocr
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// FeatureFlag is the name of the feature flag that enables the OCR for an
+// instance.
+const FeatureFlag = "ocr"
+
+// MetadataKey is the key of the metadata of the files where the extracted
+// text is saved.
+const MetadataKey = "ocr"
+
+const (
+	// maxFileSize is the maximal size of the files for the OCR
+	maxFileSize = 50 * 1024 * 1024
+	// maxPages is the maximal number of pages of a PDF for the OCR
+	maxPages = 20
+	// maxTextLength is the maximal number of bytes of the text saved in the
+	// metadata of a file
+	maxTextLength = 100 * 1024
+	// defaultLanguages is used when the language of the instance has no
+	// tesseract model
+	defaultLanguages = "eng"
+	// pdfResolution is the resolution in DPI of the pages of the PDF for
+	// tesseract
+	pdfResolution = 300
+)
+
+// localeLanguages are the tesseract models for the locales of the instances
+var localeLanguages = map[string]string{
+	"de": "deu",
+	"en": "eng",
+	"es": "spa",
+	"fr": "fra",
+	"it": "ita",
+	"ja": "jpn",
+	"nl": "nld",
+	"pt": "por",
+}
+
+type ocrEvent struct {
+	Verb   string       `json:"verb"`
+	Doc    vfs.FileDoc  `json:"doc"`
+	OldDoc *vfs.FileDoc `json:"old,omitempty"`
+}
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "ocr",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 1,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Enabled returns true if the text of the files of the instance can be
+// extracted.
+func Enabled(i *instance.Instance) bool {
+	if config.GetConfig().Jobs.TesseractCmd == "" {
+		return false
+	}
+	enabled, _ := i.FeatureFlags[FeatureFlag].(bool)
+	return enabled
+}
+
+// Languages returns the languages used by tesseract for the instance, like
+// eng+fra: the ocr_languages of its context, or else the language of its
+// locale.
+func Languages(i *instance.Instance) string {
+	if context, err := i.SettingsContext(); err == nil {
+		if langs, ok := context["ocr_languages"].(string); ok && langs != "" {
+			return langs
+		}
+	}
+	if lang, ok := localeLanguages[i.Locale]; ok {
+		return lang
+	}
+	return defaultLanguages
+}
+
+// Worker is a worker that extracts the text of an image or a PDF, and saves
+// it in the metadata of the file.
+func Worker(ctx *jobs.WorkerContext) error {
+	var event ocrEvent
+	if err := ctx.UnmarshalEvent(&event); err != nil {
+		return err
+	}
+	if event.Doc.Trashed || event.Doc.Encrypted || event.Doc.ByteSize > maxFileSize {
+		return nil
+	}
+	if event.OldDoc != nil && sameContent(&event.Doc, event.OldDoc) {
+		return nil
+	}
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	if !Enabled(i) {
+		return nil
+	}
+
+	// The file may have changed since the event
+	fs := i.VFS()
+	doc, err := fs.FileByID(event.Doc.ID())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(doc.MD5Sum, event.Doc.MD5Sum) {
+		return nil
+	}
+
+	ctx.Logger().WithField("nspace", "ocr").Debugf("%s %s", event.Verb, doc.ID())
+	langs := Languages(i)
+	text, err := extractText(ctx, i, doc, langs)
+	if err != nil {
+		return err
+	}
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	if newdoc.Metadata == nil {
+		newdoc.Metadata = vfs.NewMetadata()
+	}
+	newdoc.Metadata[MetadataKey] = map[string]interface{}{
+		"text":      text,
+		"languages": langs,
+	}
+	return fs.UpdateFileDoc(doc, newdoc)
+}
+
+// sameContent returns true if the content of the file has not changed: the
+// metadata updated by this worker trigger a new event. Like for the
+// thumbnails, the first revision of an uploaded file is marked as trashed.
+func sameContent(doc, old *vfs.FileDoc) bool {
+	if doc.Trashed != old.Trashed {
+		return false
+	}
+	if doc.ByteSize != old.ByteSize {
+		return false
+	}
+	return bytes.Equal(doc.MD5Sum, old.MD5Sum)
+}
+
+func extractText(ctx *jobs.WorkerContext, i *instance.Instance, doc *vfs.FileDoc, langs string) (string, error) {
+	tempDir, err := ioutil.TempDir("", "cozy-ocr")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tempDir) // #nosec
+
+	input := filepath.Join(tempDir, "input")
+	if err = copyFile(i, doc, input); err != nil {
+		return "", err
+	}
+
+	images := []string{input}
+	if doc.Class == "pdf" {
+		if images, err = renderPages(ctx, doc, input, tempDir); err != nil {
+			return "", err
+		}
+	}
+
+	var texts []string
+	for _, image := range images {
+		text, err := recognize(ctx, doc, image, langs)
+		if err != nil {
+			return "", err
+		}
+		if text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return truncate(strings.Join(texts, "\n\n"), maxTextLength), nil
+}
+
+func copyFile(i *instance.Instance, doc *vfs.FileDoc, dst string) error {
+	src, err := i.VFS().OpenFile(doc)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, src); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// renderPages renders the first pages of a PDF as images, with pdftoppm, and
+// returns their paths in the order of the pages.
+func renderPages(ctx *jobs.WorkerContext, doc *vfs.FileDoc, input, outputDir string) ([]string, error) {
+	pdftoppmCmd := config.GetConfig().Jobs.PdftoppmCmd
+	if pdftoppmCmd == "" {
+		pdftoppmCmd = "pdftoppm"
+	}
+	prefix := filepath.Join(outputDir, "page")
+	args := []string{
+		"-r", strconv.Itoa(pdfResolution),
+		"-gray",
+		"-png",
+		"-l", strconv.Itoa(maxPages),
+		input,
+		prefix,
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, pdftoppmCmd, args...) // #nosec
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		ctx.Logger().WithField("nspace", "ocr").
+			WithField("stderr", stderr.String()).
+			WithField("file_id", doc.ID()).
+			Errorf("pdftoppm failed: %s", err)
+		return nil, err
+	}
+	pages, err := filepath.Glob(prefix + "-*.png")
+	if err != nil {
+		return nil, err
+	}
+	sortPages(pages)
+	return pages, nil
+}
+
+// pageRegexp matches the number of a page in the name of an image rendered
+// by pdftoppm, like page-07.png
+var pageRegexp = regexp.MustCompile(`-(\d+)\.png$`)
+
+// sortPages sorts the images of the pages by their number: pdftoppm pads the
+// numbers with zeros according to the number of pages, but it is safer to
+// not rely on it.
+func sortPages(pages []string) {
+	number := func(name string) int {
+		matches := pageRegexp.FindStringSubmatch(name)
+		if len(matches) != 2 {
+			return 0
+		}
+		n, _ := strconv.Atoi(matches[1])
+		return n
+	}
+	sort.SliceStable(pages, func(i, j int) bool {
+		return number(pages[i]) < number(pages[j])
+	})
+}
+
+// recognize extracts the text of an image with tesseract.
+func recognize(ctx *jobs.WorkerContext, doc *vfs.FileDoc, image, langs string) (string, error) {
+	tesseractCmd := config.GetConfig().Jobs.TesseractCmd
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, tesseractCmd, image, "stdout", "-l", langs) // #nosec
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		ctx.Logger().WithField("nspace", "ocr").
+			WithField("stderr", stderr.String()).
+			WithField("file_id", doc.ID()).
+			Errorf("tesseract failed: %s", err)
+		return "", fmt.Errorf("tesseract failed: %s", err)
+	}
+	return cleanText(stdout.String()), nil
+}
+
+// blankLinesRegexp matches the sequences of blank lines
+var blankLinesRegexp = regexp.MustCompile(`\n\s*\n\s*`)
+
+// cleanText removes the form feeds and the useless blank lines of the output
+// of tesseract.
+func cleanText(text string) string {
+	text = strings.Replace(text, "\f", "", -1)
+	text = blankLinesRegexp.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
+
+// truncate cuts the text to at most max bytes, without cutting a character.
+func truncate(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	for max > 0 && !utf8.RuneStart(text[max]) {
+		max--
+	}
+	return text[:max]
+}
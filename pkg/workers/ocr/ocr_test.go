@@ -0,0 +1,27 @@
+package ocr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanText(t *testing.T) {
+	output := "Invoice\n\n\n  \nTotal: 42€\n\f"
+	assert.Equal(t, "Invoice\n\nTotal: 42€", cleanText(output))
+	assert.Equal(t, "", cleanText(" \n\f"))
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "abc", truncate("abc", 10))
+	assert.Equal(t, "ab", truncate("abc", 2))
+	// é is 2 bytes long, and must not be cut
+	assert.Equal(t, "ab", truncate("abé", 3))
+	assert.Equal(t, "abé", truncate("abé", 4))
+}
+
+func TestSortPages(t *testing.T) {
+	pages := []string{"/tmp/page-10.png", "/tmp/page-2.png", "/tmp/page-1.png"}
+	sortPages(pages)
+	assert.Equal(t, []string{"/tmp/page-1.png", "/tmp/page-2.png", "/tmp/page-10.png"}, pages)
+}
@@ -8,8 +8,11 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/http"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -36,12 +39,58 @@ func init() {
 		WorkerType:   "push",
 		Concurrency:  runtime.NumCPU(),
 		MaxExecCount: 1,
-		Timeout:      10 * time.Second,
+		Timeout:      30 * time.Second,
 		WorkerInit:   Init,
 		WorkerFunc:   Worker,
 	})
 }
 
+// maxAttempts is the maximal number of tries to send a notification to a
+// device, when the provider responds with a transient error.
+const maxAttempts = 3
+
+// retryDelay is the delay before the first retry, it is doubled for the next
+// ones.
+var retryDelay = 1 * time.Second
+
+var (
+	// errUnregistered is used when the provider says that the push token is
+	// no longer valid: the device should be unregistered.
+	errUnregistered = errors.New("push token is no longer valid")
+)
+
+// transientError is an error from the provider that may not happen again if
+// the notification is sent later.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+
+func isTransient(err error) bool {
+	_, ok := err.(*transientError)
+	return ok
+}
+
+// fcmStatusRegexp matches the errors of go-fcm when FCM has responded with
+// another status code than 200, like "503 error: 503 Service Unavailable".
+// The types of these errors are not exported by go-fcm.
+var fcmStatusRegexp = regexp.MustCompile(`^(\d{3}) error: `)
+
+// classifyFCMError returns a transient error when the request has not reached
+// FCM, or when FCM has responded with a 5xx. The other responses, like a 401
+// for an invalid API key, will be the same if the notification is sent again.
+func classifyFCMError(err error) error {
+	m := fcmStatusRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return &transientError{err}
+	}
+	if status, _ := strconv.Atoi(m[1]); status >= 500 {
+		return &transientError{err}
+	}
+	return err
+}
+
 // Message contains a push notification request.
 type Message struct {
 	NotificationID string `json:"notification_id"`
@@ -105,7 +154,8 @@ func Init() (err error) {
 	return
 }
 
-// Worker is the worker that just logs its message (useful for debugging)
+// Worker is the worker that sends the push notifications to the registered
+// devices.
 func Worker(ctx *jobs.WorkerContext) error {
 	var msg Message
 	if err := ctx.UnmarshalMessage(&msg); err != nil {
@@ -115,40 +165,94 @@ func Worker(ctx *jobs.WorkerContext) error {
 	if err != nil {
 		return err
 	}
-	cs, err := oauth.GetNotifiables(inst)
+	devices, err := getDevices(inst)
 	if err != nil {
 		return err
 	}
-	for _, c := range cs {
-		if c.NotificationDeviceToken != "" {
-			err = push(ctx, c, &msg)
-			if err != nil {
+	for _, d := range devices {
+		err = pushWithRetry(ctx, d, &msg)
+		if err == errUnregistered && d.ID() != "" {
+			if err = d.Delete(inst); err == nil {
 				ctx.Logger().
-					WithFields(logrus.Fields{
-						"device_id":       c.ID(),
-						"device_platform": c.NotificationPlatform,
-					}).
-					Warnf("could not send notification on device: %s", err)
+					WithField("device_id", d.ID()).
+					Infof("device unregistered: its push token is no longer valid")
+				continue
 			}
 		}
+		if err != nil {
+			ctx.Logger().
+				WithFields(logrus.Fields{
+					"device_id":       d.ID(),
+					"device_platform": d.Platform,
+				}).
+				Warnf("could not send notification on device: %s", err)
+		}
 	}
 	return nil
 }
 
-func push(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) error {
-	switch c.NotificationPlatform {
+// getDevices returns the devices registered for the push notifications, and
+// the clients that have declared a device token in their metadata, for
+// retro-compatibility.
+func getDevices(inst *instance.Instance) ([]*oauth.Device, error) {
+	devices, err := oauth.GetDevices(inst)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		tokens[d.Token] = true
+	}
+	cs, err := oauth.GetNotifiables(inst)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cs {
+		if c.NotificationDeviceToken == "" || tokens[c.NotificationDeviceToken] {
+			continue
+		}
+		tokens[c.NotificationDeviceToken] = true
+		devices = append(devices, &oauth.Device{
+			ClientID: c.ID(),
+			Platform: c.NotificationPlatform,
+			Token:    c.NotificationDeviceToken,
+		})
+	}
+	return devices, nil
+}
+
+func pushWithRetry(ctx *jobs.WorkerContext, d *oauth.Device, msg *Message) error {
+	delay := retryDelay
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = push(ctx, d, msg)
+		if !isTransient(err) || attempt == maxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	return err
+}
+
+func push(ctx *jobs.WorkerContext, d *oauth.Device, msg *Message) error {
+	switch d.Platform {
 	case oauth.PlatformFirebase, "android", "ios":
-		return pushToFirebase(ctx, c, msg)
+		return pushToFirebase(ctx, d, msg)
 	case oauth.PlatformAPNS:
-		return pushToAPNS(ctx, c, msg)
+		return pushToAPNS(ctx, d, msg)
 	default:
-		return fmt.Errorf("notifications: unknown platform %q", c.NotificationPlatform)
+		return fmt.Errorf("notifications: unknown platform %q", d.Platform)
 	}
 }
 
 // Firebase Cloud Messaging HTTP Protocol
 // https://firebase.google.com/docs/cloud-messaging/http-server-ref
-func pushToFirebase(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) error {
+func pushToFirebase(ctx *jobs.WorkerContext, d *oauth.Device, msg *Message) error {
 	if fcmClient == nil {
 		ctx.Logger().Warn("Could not send android notification: not configured")
 		return nil
@@ -174,7 +278,7 @@ func pushToFirebase(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) erro
 	}
 
 	notification := &fcm.Message{
-		To:               c.NotificationDeviceToken,
+		To:               d.Token,
 		Priority:         priority,
 		ContentAvailable: true,
 		Notification: &fcm.Notification{
@@ -197,23 +301,34 @@ func pushToFirebase(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) erro
 		notification.Data[k] = v
 	}
 
+	// An invalid message is rejected before sending it, so that the errors of
+	// Send are only about the request to FCM.
+	if err := notification.Validate(); err != nil {
+		return err
+	}
 	res, err := fcmClient.Send(notification)
 	if err != nil {
-		return err
+		return classifyFCMError(err)
 	}
 	if res.Failure == 0 {
 		return nil
 	}
 
 	for _, result := range res.Results {
-		if err = result.Error; err != nil {
-			return err
+		switch result.Error {
+		case nil:
+		case fcm.ErrNotRegistered, fcm.ErrInvalidRegistration:
+			return errUnregistered
+		case fcm.ErrUnavailable, fcm.ErrInternalServerError:
+			return &transientError{result.Error}
+		default:
+			return result.Error
 		}
 	}
 	return nil
 }
 
-func pushToAPNS(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) error {
+func pushToAPNS(ctx *jobs.WorkerContext, d *oauth.Device, msg *Message) error {
 	if iosClient == nil {
 		ctx.Logger().Warn("Could not send iOS notification: not configured")
 		return nil
@@ -236,20 +351,33 @@ func pushToAPNS(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) error {
 	}
 
 	notification := &apns.Notification{
-		DeviceToken: c.NotificationDeviceToken,
+		DeviceToken: d.Token,
 		Payload:     payload,
 		Priority:    priority,
-		CollapseID:  hex.EncodeToString(hashSource(msg.Source)), // CollapseID should not exceed 64 bytes
+	}
+	if msg.Collapsible {
+		// CollapseID should not exceed 64 bytes
+		notification.CollapseID = hex.EncodeToString(hashSource(msg.Source))
 	}
 
 	res, err := iosClient.PushWithContext(ctx, notification)
 	if err != nil {
-		return err
+		return &transientError{err}
 	}
-	if res.StatusCode != 200 {
-		return fmt.Errorf("failed to push apns notification: %d %s", res.StatusCode, res.Reason)
+	if res.StatusCode == http.StatusOK {
+		return nil
 	}
-	return nil
+	err = fmt.Errorf("failed to push apns notification: %d %s", res.StatusCode, res.Reason)
+	switch {
+	case res.StatusCode == http.StatusGone,
+		res.Reason == apns.ReasonBadDeviceToken,
+		res.Reason == apns.ReasonUnregistered:
+		return errUnregistered
+	case res.StatusCode == http.StatusTooManyRequests,
+		res.StatusCode >= 500:
+		return &transientError{err}
+	}
+	return err
 }
 
 func hashSource(source string) []byte {
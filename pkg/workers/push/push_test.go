@@ -0,0 +1,87 @@
+package push
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	fcm "github.com/appleboy/go-fcm"
+)
+
+func TestClassifyFCMError(t *testing.T) {
+	err := classifyFCMError(errors.New("503 error: 503 Service Unavailable"))
+	assert.True(t, isTransient(err))
+	err = classifyFCMError(errors.New("500 error: 500 Internal Server Error"))
+	assert.True(t, isTransient(err))
+	err = classifyFCMError(errors.New(`Post "https://fcm.googleapis.com/fcm/send": dial tcp: connection refused`))
+	assert.True(t, isTransient(err))
+
+	err = classifyFCMError(errors.New("401 error: 401 Unauthorized"))
+	assert.False(t, isTransient(err))
+	assert.EqualError(t, err, "401 error: 401 Unauthorized")
+	err = classifyFCMError(errors.New("400 error: 400 Bad Request"))
+	assert.False(t, isTransient(err))
+}
+
+// fakeFCM responds with the given status codes, one for each request, and
+// then with a success.
+func fakeFCM(t *testing.T, statuses ...int) (*int, func()) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= len(statuses) {
+			w.WriteHeader(statuses[calls-1])
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"multicast_id": 1, "success": 1, "failure": 0, "results": [{"message_id": "1"}]}`))
+	}))
+	client, err := fcm.NewClient("api-key", fcm.WithEndpoint(ts.URL))
+	require.NoError(t, err)
+	previousClient, previousDelay := fcmClient, retryDelay
+	fcmClient, retryDelay = client, time.Millisecond
+	return &calls, func() {
+		fcmClient, retryDelay = previousClient, previousDelay
+		ts.Close()
+	}
+}
+
+func pushToDevice() error {
+	db := prefixer.NewPrefixer("push.cozy.localhost", "push")
+	ctx := jobs.NewWorkerContext("id", jobs.NewJob(db, &jobs.JobRequest{WorkerType: "push"}))
+	d := &oauth.Device{Platform: oauth.PlatformFirebase, Token: "device-token"}
+	return pushWithRetry(ctx, d, &Message{Title: "title", Message: "message"})
+}
+
+func TestPushRetriesOn5xx(t *testing.T) {
+	calls, cleanup := fakeFCM(t, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	defer cleanup()
+	assert.NoError(t, pushToDevice())
+	assert.Equal(t, 3, *calls)
+}
+
+func TestPushStopsAfterMaxAttempts(t *testing.T) {
+	calls, cleanup := fakeFCM(t, 503, 503, 503, 503)
+	defer cleanup()
+	err := pushToDevice()
+	assert.Error(t, err)
+	assert.True(t, isTransient(err))
+	assert.Equal(t, maxAttempts, *calls)
+}
+
+func TestPushDoesNotRetryOn4xx(t *testing.T) {
+	calls, cleanup := fakeFCM(t, http.StatusUnauthorized)
+	defer cleanup()
+	err := pushToDevice()
+	assert.Error(t, err)
+	assert.False(t, isTransient(err))
+	assert.Equal(t, 1, *calls)
+}
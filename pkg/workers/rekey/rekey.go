@@ -0,0 +1,33 @@
+// Package rekey is for the worker that encrypts again the files of an
+// instance with a new data key.
+package rekey
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "rekey-files",
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      6 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that generates a new data key for an instance, and
+// encrypts again its files with this key.
+func Worker(ctx *jobs.WorkerContext) error {
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	count, err := i.RekeyFiles()
+	ctx.Logger().WithField("nspace", "rekey").
+		Infof("%d files have been encrypted with the new key", count)
+	return err
+}
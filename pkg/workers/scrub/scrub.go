@@ -0,0 +1,275 @@
+// Package scrub is for the verification of the content of the files: their
+// content is read again from the storage, and compared with the size and the
+// checksum of their document, to detect the corruptions of the storage.
+package scrub
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" // #nosec
+	"io"
+	"os"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/notification"
+	"github.com/cozy/cozy-stack/pkg/notification/center"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+const scrubberKey = "scrub"
+
+const (
+	// MetadataCorrupted is the key of the metadata of a file set to true when
+	// its content does not match its size or its checksum.
+	MetadataCorrupted = "corrupted"
+	// MetadataCorruptedAt is the key of the metadata of a file with the date
+	// when its corruption has been detected.
+	MetadataCorruptedAt = "corrupted_at"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "scrub",
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      24 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Options is the option handler for the verification of the files. If
+// Domain is empty, the files of all the instances are verified.
+type Options struct {
+	Domain string `json:"domain,omitempty"`
+}
+
+// Worker is the worker method to verify the content of the files.
+func Worker(ctx *jobs.WorkerContext) error {
+	var opts Options
+	if err := ctx.UnmarshalMessage(&opts); err != nil {
+		return err
+	}
+	bandwidth := config.GetConfig().Scrub.Bandwidth
+	if opts.Domain != "" {
+		inst, err := instance.Get(opts.Domain)
+		if err != nil {
+			return err
+		}
+		return ScrubInstance(ctx, inst, bandwidth)
+	}
+	return instance.ForeachInstances(func(inst *instance.Instance) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := ScrubInstance(ctx, inst, bandwidth); err != nil {
+			ctx.Logger().WithField("domain", inst.Domain).
+				Errorf("Could not verify the files: %s", err)
+		}
+		return nil
+	})
+}
+
+// ScrubInstance reads the content of all the files of the instance, at most
+// bandwidth bytes per second (no limit if it is not positive), and compares
+// it with the size and the checksum of their document. The corrupted files
+// are flagged in their metadata, and the user is notified of the newly
+// detected corruptions. A file that was flagged and whose content is now
+// valid has its flag removed.
+func ScrubInstance(ctx context.Context, inst *instance.Instance, bandwidth int64) error {
+	fs := inst.VFS()
+	log := inst.Logger().WithField("nspace", "scrub")
+	var corrupted []string
+	err := vfs.Walk(fs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir != nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		valid, err := verifyFile(ctx, fs, file, bandwidth)
+		if err != nil {
+			if err == ctx.Err() {
+				return err
+			}
+			log.Errorf("Could not verify the file %s (%s): %s", name, file.DocID, err)
+			return nil
+		}
+		wasCorrupted, _ := file.Metadata[MetadataCorrupted].(bool)
+		if valid == !wasCorrupted {
+			return nil
+		}
+		if !valid {
+			log.Errorf("The content of the file %s (%s) is corrupted", name, file.DocID)
+			corrupted = append(corrupted, name)
+		}
+		if err = flagFile(fs, file, !valid); err != nil {
+			log.Errorf("Could not flag the file %s (%s): %s", name, file.DocID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(corrupted) > 0 {
+		return notifyCorruptions(inst, corrupted)
+	}
+	return nil
+}
+
+// verifyFile returns true if the content of the file matches its size and
+// its checksum. A file whose content is missing is not valid.
+func verifyFile(ctx context.Context, fs vfs.VFS, file *vfs.FileDoc, bandwidth int64) (bool, error) {
+	f, err := fs.OpenFile(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := md5.New() // #nosec
+	var r io.Reader = f
+	if bandwidth > 0 {
+		r = newThrottledReader(ctx, f, bandwidth)
+	}
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return false, err
+	}
+	return size == file.ByteSize && bytes.Equal(h.Sum(nil), file.MD5Sum), nil
+}
+
+func flagFile(fs vfs.VFS, olddoc *vfs.FileDoc, corrupted bool) error {
+	newdoc := olddoc.Clone().(*vfs.FileDoc)
+	if corrupted {
+		newdoc.Metadata[MetadataCorrupted] = true
+		newdoc.Metadata[MetadataCorruptedAt] = time.Now().UTC()
+	} else {
+		delete(newdoc.Metadata, MetadataCorrupted)
+		delete(newdoc.Metadata, MetadataCorruptedAt)
+	}
+	return fs.UpdateFileDoc(olddoc, newdoc)
+}
+
+func notifyCorruptions(inst *instance.Instance, corrupted []string) error {
+	n := &notification.Notification{
+		Title:   inst.Translate("Notifications Corrupted Files Subject"),
+		Message: inst.Translate("Notifications Corrupted Files Message", len(corrupted)),
+		Data: map[string]interface{}{
+			"Count":         len(corrupted),
+			"Files":         corrupted,
+			"CozyDriveLink": inst.SubDomain(consts.DriveSlug).String(),
+		},
+	}
+	return center.PushStack(inst.Domain, center.NotificationCorruptedFiles, n)
+}
+
+// throttledReader is a reader that waits when needed to not read more than
+// bandwidth bytes per second.
+type throttledReader struct {
+	ctx       context.Context
+	r         io.Reader
+	bandwidth int64
+	start     time.Time
+	read      int64
+}
+
+func newThrottledReader(ctx context.Context, r io.Reader, bandwidth int64) *throttledReader {
+	return &throttledReader{
+		ctx:       ctx,
+		r:         r,
+		bandwidth: bandwidth,
+		start:     time.Now(),
+	}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.bandwidth {
+		p = p[:t.bandwidth]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	expected := time.Duration(float64(t.read) / float64(t.bandwidth) * float64(time.Second))
+	if wait := expected - time.Since(t.start); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// StartScrubber starts the process that pushes a job to verify the files of
+// all the instances, at the interval of the configuration. When the stack
+// has several processes, only the leader does it.
+func StartScrubber() utils.Shutdowner {
+	interval := config.GetConfig().Scrub.Interval
+	closed := make(chan struct{})
+	leader := lock.Elect(scrubberKey)
+	go func() {
+		if interval <= 0 {
+			<-closed
+			return
+		}
+		waitDuration := interval
+		for {
+			select {
+			case <-time.After(waitDuration):
+				if !leader.IsLeader() {
+					waitDuration = lock.LeaderTimeout
+					continue
+				}
+				waitDuration = interval
+				if err := pushScrubJob(); err != nil {
+					logger.WithNamespace("scrub").
+						Errorf("Could not push the job to verify the files: %s", err)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &scrubber{closed, leader}
+}
+
+func pushScrubJob() error {
+	msg, err := jobs.NewMessage(&Options{})
+	if err != nil {
+		return err
+	}
+	_, err = jobs.System().PushJob(prefixer.GlobalPrefixer, &jobs.JobRequest{
+		WorkerType: "scrub",
+		Message:    msg,
+		Admin:      true,
+	})
+	return err
+}
+
+type scrubber struct {
+	closed chan struct{}
+	leader lock.Leader
+}
+
+func (s *scrubber) Shutdown(ctx context.Context) error {
+	select {
+	case s.closed <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return s.leader.Shutdown(ctx)
+}
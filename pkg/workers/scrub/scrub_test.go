@@ -0,0 +1,148 @@
+package scrub
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/notification"
+	"github.com/cozy/cozy-stack/pkg/notification/center"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/cozy/cozy-stack/pkg/workers/mails"
+)
+
+var inst *instance.Instance
+var tempdir string
+
+func createFile(t *testing.T, name, content string) *vfs.FileDoc {
+	fs := inst.VFS()
+	doc, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	file, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = file.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	return doc
+}
+
+func corruptedNotifications(t *testing.T) []*notification.Notification {
+	var notifs []*notification.Notification
+	err := couchdb.GetAllDocs(inst, consts.Notifications, &couchdb.AllDocsRequest{}, &notifs)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	assert.NoError(t, err)
+	var corrupted []*notification.Notification
+	for _, n := range notifs {
+		if n.Category == center.NotificationCorruptedFiles {
+			corrupted = append(corrupted, n)
+		}
+	}
+	return corrupted
+}
+
+func TestScrubInstance(t *testing.T) {
+	fs := inst.VFS()
+	good := createFile(t, "good.txt", "the content is fine")
+	bad := createFile(t, "bad.txt", "the content is fine")
+
+	// The content is changed on the disk, with the same size, and the document
+	// is not updated
+	onDisk := filepath.Join(tempdir, inst.DirName(), "bad.txt")
+	err := ioutil.WriteFile(onDisk, []byte("the content is FINE"), 0600)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = ScrubInstance(context.Background(), inst, 0)
+	assert.NoError(t, err)
+
+	good, err = fs.FileByID(good.ID())
+	assert.NoError(t, err)
+	assert.NotContains(t, good.Metadata, MetadataCorrupted)
+	bad, err = fs.FileByID(bad.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, true, bad.Metadata[MetadataCorrupted])
+	assert.Contains(t, bad.Metadata, MetadataCorruptedAt)
+
+	notifs := corruptedNotifications(t)
+	if assert.Len(t, notifs, 1) {
+		assert.EqualValues(t, 1, notifs[0].Data["Count"])
+		assert.Equal(t, []interface{}{"/bad.txt"}, notifs[0].Data["Files"])
+	}
+
+	// A corruption already detected is not notified again
+	err = ScrubInstance(context.Background(), inst, 0)
+	assert.NoError(t, err)
+	assert.Len(t, corruptedNotifications(t), 1)
+
+	// The flag is removed when the content is valid again
+	err = ioutil.WriteFile(onDisk, []byte("the content is fine"), 0600)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = ScrubInstance(context.Background(), inst, 0)
+	assert.NoError(t, err)
+	bad, err = fs.FileByID(bad.ID())
+	assert.NoError(t, err)
+	assert.NotContains(t, bad.Metadata, MetadataCorrupted)
+	assert.Len(t, corruptedNotifications(t), 1)
+}
+
+func TestThrottledReader(t *testing.T) {
+	f, err := ioutil.TempFile(tempdir, "throttled")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(make([]byte, 2000))
+	assert.NoError(t, err)
+	_, err = f.Seek(0, 0)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	r := newThrottledReader(context.Background(), f, 1000)
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Len(t, data, 2000)
+	assert.True(t, time.Since(start) >= time.Second)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "scrub_test")
+
+	var err error
+	tempdir, err = ioutil.TempDir("", "cozy-stack")
+	if err != nil {
+		fmt.Println("Could not create temporary directory.")
+		os.Exit(1)
+	}
+	setup.AddCleanup(func() error { return os.RemoveAll(tempdir) })
+	config.GetConfig().Fs.URL = &url.URL{
+		Scheme: "file",
+		Host:   "localhost",
+		Path:   tempdir,
+	}
+
+	inst = setup.GetTestInstance()
+	os.Exit(setup.Run())
+}
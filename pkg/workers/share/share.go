@@ -39,6 +39,15 @@ func init() {
 		Timeout:      1 * time.Hour,
 		WorkerFunc:   WorkerUpload,
 	})
+
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:  "share-answer",
+		Concurrency: runtime.NumCPU(),
+		// The retries are made with a backoff by the worker itself
+		MaxExecCount: 1,
+		Timeout:      2 * time.Minute,
+		WorkerFunc:   WorkerAnswer,
+	})
 }
 
 // WorkerTrack is used to update the io.cozy.shared database when a document
@@ -102,3 +111,22 @@ func WorkerUpload(ctx *jobs.WorkerContext) error {
 	}
 	return s.Upload(inst, msg.Errors)
 }
+
+// WorkerAnswer is used by a recipient to send its answer to the sharer, after
+// the sharing has been accepted.
+func WorkerAnswer(ctx *jobs.WorkerContext) error {
+	var msg sharing.ReplicateMsg
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	inst.Logger().WithField("nspace", "share").Debugf("Answer %#v", msg)
+	s, err := sharing.FindSharing(inst, msg.SharingID)
+	if err != nil {
+		return err
+	}
+	return s.RetrySendAnswer(inst, msg.Errors)
+}
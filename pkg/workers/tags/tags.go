@@ -0,0 +1,53 @@
+// Package tags is for the worker that renames, merges or deletes a tag on all
+// the files and directories of an instance.
+package tags
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// ErrNoTags is used when a job has no tag to replace.
+var ErrNoTags = errors.New("tags: no tag to replace")
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "tags",
+		Concurrency:  1,
+		MaxExecCount: 2,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Options is the option handler for the tags worker. The tags are removed
+// from the documents that have them, and replaced by the Into tag. Renaming a
+// tag is replacing a single tag, merging tags is replacing several tags, and
+// deleting a tag is replacing it by an empty Into.
+type Options struct {
+	Tags []string `json:"tags"`
+	Into string   `json:"into,omitempty"`
+}
+
+// Worker is the worker method to replace the tags of an instance.
+func Worker(ctx *jobs.WorkerContext) error {
+	var opts Options
+	if err := ctx.UnmarshalMessage(&opts); err != nil {
+		return err
+	}
+	if len(opts.Tags) == 0 {
+		return ErrNoTags
+	}
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	count, err := vfs.ReplaceTags(inst.VFS(), opts.Tags, opts.Into)
+	ctx.Logger().WithField("nspace", "tags").
+		Infof("%d documents have been updated for the tags %v", count, opts.Tags)
+	return err
+}
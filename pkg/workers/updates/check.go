@@ -0,0 +1,183 @@
+package updates
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const checkerKey = "updates-check"
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "updates-check",
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   CheckWorker,
+	})
+}
+
+// CheckOptions is the option handler for the check of the updates. If Domain
+// is empty, the applications of all the instances are checked.
+type CheckOptions struct {
+	Domain string `json:"domain,omitempty"`
+}
+
+// CheckWorker is the worker method to check the new versions of the
+// applications and konnectors.
+func CheckWorker(ctx *jobs.WorkerContext) error {
+	var opts CheckOptions
+	if err := ctx.UnmarshalMessage(&opts); err != nil {
+		return err
+	}
+	if opts.Domain != "" {
+		inst, err := instance.Get(opts.Domain)
+		if err != nil {
+			return err
+		}
+		return CheckInstance(ctx, inst)
+	}
+	return instance.ForeachInstances(func(inst *instance.Instance) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := CheckInstance(ctx, inst); err != nil {
+			ctx.Logger().WithField("domain", inst.Domain).
+				Errorf("Could not check the updates: %s", err)
+		}
+		return nil
+	})
+}
+
+// CheckInstance looks for the new versions of the applications and konnectors
+// of the instance installed from the registries, and records them as their
+// available versions. If the auto-updates are enabled, the applications are
+// also updated: the update is applied if the new version requests no new
+// permissions, and else it is blocked until the user approves them.
+func CheckInstance(ctx *jobs.WorkerContext, inst *instance.Instance) error {
+	webapps, err := apps.ListWebapps(inst)
+	if err != nil {
+		return err
+	}
+	konnectors, err := apps.ListKonnectors(inst)
+	if err != nil {
+		return err
+	}
+	mans := make([]apps.Manifest, 0, len(webapps)+len(konnectors))
+	for _, webapp := range webapps {
+		mans = append(mans, webapp)
+	}
+	mans = append(mans, konnectors...)
+
+	registries := inst.Registries()
+	autoUpdate := config.GetConfig().Updates.AutoUpdate && !inst.NoAutoUpdate
+	for _, man := range mans {
+		version, err := apps.CheckForUpdate(inst, man, availableVersion(man), registries)
+		if err != nil {
+			ctx.Logger().WithFields((&updateError{
+				domain: inst.Domain,
+				slug:   man.Slug(),
+				step:   "CheckForUpdate",
+				reason: err,
+			}).toFields()).Error()
+			continue
+		}
+		if version == "" || !autoUpdate {
+			continue
+		}
+		installer, err := createInstaller(inst, registries, man, &Options{})
+		if err == nil {
+			_, err = installer.RunSync()
+		}
+		if err != nil {
+			ctx.Logger().WithFields((&updateError{
+				domain: inst.Domain,
+				slug:   man.Slug(),
+				step:   "Update",
+				reason: err,
+			}).toFields()).Error()
+		}
+	}
+	return nil
+}
+
+func availableVersion(man apps.Manifest) string {
+	switch m := man.(type) {
+	case *apps.WebappManifest:
+		return m.AvailableVersion
+	case *apps.KonnManifest:
+		return m.AvailableVersion
+	}
+	return ""
+}
+
+// StartChecker starts the process that pushes a job to check the updates of
+// the applications of all the instances, at the interval of the
+// configuration. When the stack has several processes, only the leader does
+// it.
+func StartChecker() utils.Shutdowner {
+	interval := config.GetConfig().Updates.CheckInterval
+	closed := make(chan struct{})
+	leader := lock.Elect(checkerKey)
+	go func() {
+		if interval <= 0 {
+			<-closed
+			return
+		}
+		waitDuration := interval
+		for {
+			select {
+			case <-time.After(waitDuration):
+				if !leader.IsLeader() {
+					waitDuration = lock.LeaderTimeout
+					continue
+				}
+				waitDuration = interval
+				if err := pushCheckJob(); err != nil {
+					logger.WithNamespace("updates").
+						Errorf("Could not push the job to check the updates: %s", err)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &checker{closed, leader}
+}
+
+func pushCheckJob() error {
+	msg, err := jobs.NewMessage(&CheckOptions{})
+	if err != nil {
+		return err
+	}
+	_, err = jobs.System().PushJob(prefixer.GlobalPrefixer, &jobs.JobRequest{
+		WorkerType: "updates-check",
+		Message:    msg,
+		Admin:      true,
+	})
+	return err
+}
+
+type checker struct {
+	closed chan struct{}
+	leader lock.Leader
+}
+
+func (c *checker) Shutdown(ctx context.Context) error {
+	select {
+	case c.closed <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return c.leader.Shutdown(ctx)
+}
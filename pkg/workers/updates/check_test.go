@@ -0,0 +1,252 @@
+package updates
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var inst *instance.Instance
+
+const filesPerms = `{"files": {"type": "io.cozy.files", "verbs": ["GET"]}}`
+const contactsPerms = `{
+  "files": {"type": "io.cozy.files", "verbs": ["GET"]},
+  "contacts": {"type": "io.cozy.contacts"}
+}`
+
+// fakeRegistry serves the versions of some webapps: the last published version
+// is the latest version of the stable channel.
+type fakeRegistry struct {
+	mu     sync.Mutex
+	perms  map[string]map[string]string // slug -> version -> permissions
+	latest map[string]string
+	server *httptest.Server
+}
+
+func newFakeRegistry() *fakeRegistry {
+	reg := &fakeRegistry{
+		perms:  make(map[string]map[string]string),
+		latest: make(map[string]string),
+	}
+	reg.server = httptest.NewServer(http.HandlerFunc(reg.serve))
+	return reg
+}
+
+func (reg *fakeRegistry) publish(slug, version, perms string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.perms[slug] == nil {
+		reg.perms[slug] = make(map[string]string)
+	}
+	reg.perms[slug][version] = perms
+	reg.latest[slug] = version
+}
+
+func (reg *fakeRegistry) manifest(slug, version string) string {
+	return `{
+  "name": "` + slug + `",
+  "slug": "` + slug + `",
+  "version": "` + version + `",
+  "permissions": ` + reg.perms[slug][version] + `
+}`
+}
+
+func (reg *fakeRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	slug, version := parts[1], parts[2]
+	if parts[0] == "tarballs" {
+		w.Header().Set("Content-Type", "application/gzip")
+		_ = writeTarball(w, reg.manifest(slug, version))
+		return
+	}
+	if version == "stable" && len(parts) == 4 && parts[3] == "latest" {
+		version = reg.latest[slug]
+	}
+	if _, ok := reg.perms[slug][version]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"slug":     slug,
+		"version":  version,
+		"url":      reg.server.URL + "/tarballs/" + slug + "/" + version,
+		"manifest": json.RawMessage(reg.manifest(slug, version)),
+	})
+}
+
+func writeTarball(w http.ResponseWriter, manifest string) error {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	files := map[string]string{
+		apps.WebappManifestName: manifest,
+		"index.html":            "<html></html>",
+	}
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+var fakeReg *fakeRegistry
+
+func installWebapp(t *testing.T, slug, perms string) {
+	fakeReg.publish(slug, "1.0.0", perms)
+	installer, err := apps.NewInstaller(inst, inst.AppsCopier(apps.Webapp),
+		&apps.InstallerOptions{
+			Operation:  apps.Install,
+			Type:       apps.Webapp,
+			Slug:       slug,
+			SourceURL:  "registry://" + slug + "/stable",
+			Registries: inst.Registries(),
+		},
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = installer.RunSync()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+}
+
+func checkInstance(t *testing.T, autoUpdate bool) {
+	conf := config.GetConfig()
+	conf.Updates.AutoUpdate = autoUpdate
+	defer func() { conf.Updates.AutoUpdate = false }()
+	job := jobs.NewJob(inst, &jobs.JobRequest{WorkerType: "updates-check"})
+	ctx := jobs.NewWorkerContext("id", job)
+	assert.NoError(t, CheckInstance(ctx, inst))
+}
+
+func getWebapp(t *testing.T, slug string) *apps.WebappManifest {
+	man, err := apps.GetWebappBySlug(inst, slug)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return man
+}
+
+func TestAutoUpdateSamePermissions(t *testing.T) {
+	installWebapp(t, "same-perms", filesPerms)
+	fakeReg.publish("same-perms", "1.0.1", filesPerms)
+
+	checkInstance(t, true)
+	man := getWebapp(t, "same-perms")
+	assert.Equal(t, "1.0.1", man.Version())
+	assert.Nil(t, man.PermissionsUpdate())
+}
+
+func TestAutoUpdateNewPermissions(t *testing.T) {
+	installWebapp(t, "new-perms", filesPerms)
+	fakeReg.publish("new-perms", "1.0.1", contactsPerms)
+
+	// The update is blocked until the user approves the new permissions
+	checkInstance(t, true)
+	man := getWebapp(t, "new-perms")
+	assert.Equal(t, "1.0.0", man.Version())
+	assert.Equal(t, "1.0.1", man.AvailableVersion)
+	assert.Len(t, man.Permissions(), 1)
+	if assert.NotNil(t, man.PermissionsUpdate()) {
+		assert.Equal(t, "1.0.1", man.PermissionsUpdate().Version)
+	}
+}
+
+func TestCheckWithoutAutoUpdate(t *testing.T) {
+	installWebapp(t, "no-auto-update", filesPerms)
+	fakeReg.publish("no-auto-update", "1.0.1", filesPerms)
+
+	// The new version is only recorded as available
+	checkInstance(t, false)
+	man := getWebapp(t, "no-auto-update")
+	assert.Equal(t, "1.0.0", man.Version())
+	assert.Equal(t, "1.0.1", man.AvailableVersion)
+
+	// A version that is already known is not recorded again
+	version, err := apps.CheckForUpdate(inst, man, man.AvailableVersion, inst.Registries())
+	assert.NoError(t, err)
+	assert.Empty(t, version)
+	rev := man.Rev()
+	assert.Equal(t, rev, getWebapp(t, "no-auto-update").Rev())
+}
+
+func TestDoLazyUpdate(t *testing.T) {
+	installWebapp(t, "lazy-update", filesPerms)
+	fakeReg.publish("lazy-update", "1.0.1", filesPerms)
+	copier := inst.AppsCopier(apps.Webapp)
+
+	// The version already known as available is not installed lazily
+	man := getWebapp(t, "lazy-update")
+	updated := apps.DoLazyUpdate(inst, man, "1.0.1", copier, inst.Registries())
+	assert.Equal(t, "1.0.0", updated.Version())
+
+	updated = apps.DoLazyUpdate(inst, man, "", copier, inst.Registries())
+	assert.Equal(t, "1.0.1", updated.Version())
+	assert.Equal(t, "1.0.1", getWebapp(t, "lazy-update").Version())
+
+	// An application that is not installed from a registry is not updated
+	version, err := apps.CheckForUpdate(inst, &apps.WebappManifest{
+		DocSlug:   "not-registry",
+		DocSource: "git://github.com/cozy/cozy-drive.git",
+	}, "", inst.Registries())
+	assert.NoError(t, err)
+	assert.Empty(t, version)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "updates_test")
+
+	fakeReg = newFakeRegistry()
+	setup.AddCleanup(func() error { fakeReg.server.Close(); return nil })
+	u, err := url.Parse(fakeReg.server.URL)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	config.GetConfig().Registries = map[string][]*url.URL{"default": {u}}
+
+	inst = setup.GetTestInstance()
+	os.Exit(setup.Run())
+}
@@ -0,0 +1,60 @@
+package updates
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "apps-install",
+		Concurrency:  4,
+		MaxExecCount: 2,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   InstallWorker,
+	})
+}
+
+// InstallWorker is the worker method to install a default webapp or
+// konnector of the context on a new instance. The onboarding step of the
+// application is marked as done or errored at the end.
+func InstallWorker(ctx *jobs.WorkerContext) error {
+	var app instance.DefaultApp
+	if err := ctx.UnmarshalMessage(&app); err != nil {
+		return err
+	}
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	appType := apps.Webapp
+	if app.Doctype == consts.Konnectors {
+		appType = apps.Konnector
+	}
+	installer, err := apps.NewInstaller(inst, inst.AppsCopier(appType), &apps.InstallerOptions{
+		Operation:  apps.Install,
+		Type:       appType,
+		SourceURL:  app.Source,
+		Slug:       app.Slug,
+		Registries: inst.Registries(),
+	})
+	if err == nil {
+		_, err = installer.RunSync()
+	}
+	if err == apps.ErrAlreadyExists {
+		err = nil
+	}
+	state := instance.StepDone
+	if err != nil {
+		ctx.Logger().Errorf("Could not install %s: %s", app.Slug, err)
+		state = instance.StepErrored
+	}
+	if errs := inst.SetOnboardingStep(app.Step(), state); errs != nil {
+		ctx.Logger().Errorf("Could not save the onboarding step: %s", errs)
+	}
+	return err
+}
@@ -65,6 +65,8 @@ func updateErrorFromInstaller(inst *apps.Installer, step string, reason error) *
 //     update
 //   - ForceRegistry: translates the git:// sourced application into
 //     registry://
+//   - PermissionsAcked: applies the updates that request new permissions,
+//     even if the user has not approved them
 type Options struct {
 	Slugs              []string `json:"slugs,omitempty"`
 	Domain             string   `json:"domain,omitempty"`
@@ -73,6 +75,7 @@ type Options struct {
 	Force              bool     `json:"force"`
 	ForceRegistry      bool     `json:"force_registry"`
 	OnlyRegistry       bool     `json:"only_registry"`
+	PermissionsAcked   bool     `json:"permissions_acked"`
 }
 
 // Worker is the worker method to launch the updates.
@@ -340,7 +343,7 @@ func createInstaller(inst *instance.Instance, registries []*url.URL, man apps.Ma
 			Manifest:         man,
 			Registries:       registries,
 			SourceURL:        sourceURL,
-			PermissionsAcked: true,
+			PermissionsAcked: opts.PermissionsAcked,
 		},
 	)
 }
@@ -0,0 +1,282 @@
+// Package video is for the worker that transcodes the videos for streaming,
+// with HLS (HTTP Live Streaming). This worker is optional: the videos are
+// transcoded only if the path to ffmpeg has been configured.
+package video
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// MasterPlaylist is the name of the HLS playlist with the list of the
+// renditions of a video. It is the entry point for the players.
+const MasterPlaylist = "master.m3u8"
+
+// segmentDuration is the target duration of a segment, in seconds
+const segmentDuration = 6
+
+type videoEvent struct {
+	Verb   string       `json:"verb"`
+	Doc    vfs.FileDoc  `json:"doc"`
+	OldDoc *vfs.FileDoc `json:"old,omitempty"`
+}
+
+// rendition is a quality in which the videos are transcoded. The bitrates
+// are in kbit/s.
+type rendition struct {
+	Name         string
+	Height       int
+	VideoBitrate int
+	AudioBitrate int
+}
+
+// renditions is the list of the renditions, from the lowest to the highest
+// quality. The renditions with a greater height than the original video are
+// skipped, except the first one.
+var renditions = []rendition{
+	{Name: "360p", Height: 360, VideoBitrate: 800, AudioBitrate: 96},
+	{Name: "720p", Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+	{Name: "1080p", Height: 1080, VideoBitrate: 5000, AudioBitrate: 192},
+}
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "video",
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      2 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that transcodes the videos in HLS renditions, and
+// removes them when the video is deleted.
+func Worker(ctx *jobs.WorkerContext) error {
+	ffmpegCmd := config.GetConfig().Jobs.FFmpegCmd
+	if ffmpegCmd == "" {
+		return nil
+	}
+	var video videoEvent
+	if err := ctx.UnmarshalEvent(&video); err != nil {
+		return err
+	}
+	if video.Verb != "DELETED" && video.Doc.Trashed {
+		return nil
+	}
+	if video.OldDoc != nil && sameVideo(&video.Doc, video.OldDoc) {
+		return nil
+	}
+
+	log := ctx.Logger()
+	log.WithField("nspace", "video").Debugf("%s %s", video.Verb, video.Doc.ID())
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	switch video.Verb {
+	case "CREATED":
+		return transcode(ctx, i, &video.Doc, ffmpegCmd)
+	case "UPDATED":
+		if err = i.StreamsFS().RemoveStreams(&video.Doc); err != nil {
+			log.WithField("nspace", "video").Debugf("failed to remove streams for %s: %s", video.Doc.ID(), err)
+		}
+		return transcode(ctx, i, &video.Doc, ffmpegCmd)
+	case "DELETED":
+		return i.StreamsFS().RemoveStreams(&video.Doc)
+	}
+	return fmt.Errorf("Unknown type %s for video event", video.Verb)
+}
+
+// sameVideo returns true if the content of the video has not changed. Like
+// for the thumbnails, the first revision of an uploaded file is marked as
+// trashed, and the video can be transcoded only with the second revision.
+func sameVideo(doc, old *vfs.FileDoc) bool {
+	if doc.Trashed != old.Trashed {
+		return false
+	}
+	if doc.ByteSize != old.ByteSize {
+		return false
+	}
+	return bytes.Equal(doc.MD5Sum, old.MD5Sum)
+}
+
+func transcode(ctx *jobs.WorkerContext, i *instance.Instance, video *vfs.FileDoc, ffmpegCmd string) error {
+	fs := i.StreamsFS()
+	if exists, err := fs.StreamFileExists(video, MasterPlaylist); err != nil || exists {
+		return err
+	}
+
+	tempDir, err := ioutil.TempDir("", "cozy-video")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir) // #nosec
+
+	// ffmpeg needs to seek in the input for some formats (mp4 with the moov
+	// atom at the end for example), so the video is copied to a local file
+	input := filepath.Join(tempDir, "input")
+	if err = copyVideo(i, video, input); err != nil {
+		return err
+	}
+
+	height := probeHeight(ctx, ffmpegCmd, input)
+	selected := selectRenditions(height)
+	for _, r := range selected {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, ffmpegCmd, r.args(input, tempDir)...) // #nosec
+		cmd.Stderr = &stderr
+		if err = cmd.Run(); err != nil {
+			ctx.Logger().WithField("nspace", "video").
+				WithField("stderr", stderr.String()).
+				WithField("file_id", video.ID()).
+				Errorf("ffmpeg failed for %s: %s", r.Name, err)
+			return err
+		}
+	}
+
+	// The master playlist is written last, as its presence means that the
+	// video has been fully transcoded
+	for _, r := range selected {
+		names, err := filepath.Glob(filepath.Join(tempDir, r.Name+"*"))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err = storeFile(fs, video, filepath.Base(name), name); err != nil {
+				return err
+			}
+		}
+	}
+	master := masterPlaylist(selected)
+	return storeContent(fs, video, MasterPlaylist, bytes.NewReader(master))
+}
+
+func copyVideo(i *instance.Instance, video *vfs.FileDoc, dst string) error {
+	src, err := i.VFS().OpenFile(video)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, src); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func storeFile(fs vfs.Streamer, video *vfs.FileDoc, name, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return storeContent(fs, video, name, f)
+}
+
+func storeContent(fs vfs.Streamer, video *vfs.FileDoc, name string, content io.Reader) error {
+	out, err := fs.CreateStreamFile(video, name)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, content); err != nil {
+		_ = out.Abort()
+		return err
+	}
+	return out.Commit()
+}
+
+// dimensionsRegexp matches the dimensions of the video stream in the output
+// of ffmpeg, like "Stream #0:0(und): Video: h264 (...), yuv420p, 1920x1080"
+var dimensionsRegexp = regexp.MustCompile(`Video: .*?, (\d{2,5})x(\d{2,5})`)
+
+// probeHeight returns the height of the video, or 0 if it is not known. For
+// the videos in portrait, the smaller dimension is used.
+func probeHeight(ctx *jobs.WorkerContext, ffmpegCmd, input string) int {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegCmd, "-hide_banner", "-i", input) // #nosec
+	cmd.Stderr = &stderr
+	// ffmpeg exits with an error when no output is given
+	_ = cmd.Run()
+	return parseHeight(stderr.String())
+}
+
+func parseHeight(output string) int {
+	matches := dimensionsRegexp.FindStringSubmatch(output)
+	if len(matches) != 3 {
+		return 0
+	}
+	width, _ := strconv.Atoi(matches[1])
+	height, _ := strconv.Atoi(matches[2])
+	if width < height {
+		return width
+	}
+	return height
+}
+
+// selectRenditions returns the renditions for a video of the given height
+func selectRenditions(height int) []rendition {
+	selected := []rendition{renditions[0]}
+	for _, r := range renditions[1:] {
+		if height > 0 && r.Height <= height {
+			selected = append(selected, r)
+		}
+	}
+	return selected
+}
+
+// args returns the arguments for ffmpeg to transcode the video into this
+// rendition, with a playlist and its segments in the output directory
+func (r rendition) args(input, outputDir string) []string {
+	h := strconv.Itoa(r.Height)
+	vb := r.VideoBitrate
+	keyframes := strconv.Itoa(2 * 24) // A keyframe every 2 seconds at 24fps
+	return []string{
+		"-hide_banner", "-loglevel", "error", "-y",
+		"-i", input,
+		"-map", "0:v:0", "-map", "0:a:0?", // The first video and audio (if any) streams
+		"-vf", "scale=-2:'min(" + h + ",ih)'", // Never upscale the video
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+		"-b:v", strconv.Itoa(vb) + "k",
+		"-maxrate", strconv.Itoa(vb*107/100) + "k",
+		"-bufsize", strconv.Itoa(vb*3/2) + "k",
+		// Aligned keyframes, so that the players can switch of rendition
+		"-g", keyframes, "-keyint_min", keyframes, "-sc_threshold", "0",
+		"-c:a", "aac", "-ac", "2", "-b:a", strconv.Itoa(r.AudioBitrate) + "k",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segmentDuration),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outputDir, r.Name+"_%04d.ts"),
+		filepath.Join(outputDir, r.Name+".m3u8"),
+	}
+}
+
+// masterPlaylist returns the content of the master playlist for the given
+// renditions. The URIs are relative, so that the playlists and the segments
+// are served from the same directory as the master playlist.
+func masterPlaylist(selected []rendition) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range selected {
+		bandwidth := (r.VideoBitrate + r.AudioBitrate) * 1000
+		fmt.Fprintf(&buf, "#EXT-X-STREAM-INF:BANDWIDTH=%d\n", bandwidth)
+		buf.WriteString(r.Name + ".m3u8\n")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,49 @@
+package video
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHeight(t *testing.T) {
+	output := `Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'input':
+  Duration: 00:00:10.03, start: 0.000000, bitrate: 3020 kb/s
+    Stream #0:0(und): Video: h264 (High) (avc1 / 0x31637661), yuv420p(tv, bt709), 1280x720 [SAR 1:1 DAR 16:9], 2887 kb/s, 29.97 fps
+    Stream #0:1(und): Audio: aac (LC) (mp4a / 0x6134706D), 48000 Hz, stereo, fltp, 128 kb/s
+At least one output file must be specified`
+	assert.Equal(t, 720, parseHeight(output))
+
+	portrait := `    Stream #0:0(und): Video: h264 (avc1 / 0x31637661), yuv420p, 1080x1920, 15291 kb/s`
+	assert.Equal(t, 1080, parseHeight(portrait))
+
+	assert.Equal(t, 0, parseHeight("input: Invalid data found when processing input"))
+}
+
+func TestSelectRenditions(t *testing.T) {
+	assert.Len(t, selectRenditions(0), 1)
+	assert.Len(t, selectRenditions(240), 1)
+	assert.Len(t, selectRenditions(720), 2)
+	selected := selectRenditions(2160)
+	assert.Len(t, selected, 3)
+	assert.Equal(t, "1080p", selected[2].Name)
+}
+
+func TestMasterPlaylist(t *testing.T) {
+	expected := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-STREAM-INF:BANDWIDTH=896000
+360p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2928000
+720p.m3u8
+`
+	assert.Equal(t, expected, string(masterPlaylist(selectRenditions(720))))
+}
+
+func TestArgs(t *testing.T) {
+	args := renditions[1].args("/tmp/video/input", "/tmp/video")
+	assert.Contains(t, args, "scale=-2:'min(720,ih)'")
+	assert.Contains(t, args, "2800k")
+	assert.Equal(t, "/tmp/video/720p_%04d.ts", args[len(args)-2])
+	assert.Equal(t, "/tmp/video/720p.m3u8", args[len(args)-1])
+}
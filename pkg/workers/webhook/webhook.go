@@ -0,0 +1,280 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/safehttp"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "webhook",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 5,
+		RetryDelay:   10 * time.Second,
+		Timeout:      30 * time.Second,
+		WorkerFunc:   Worker,
+	})
+}
+
+// maxResponseSize is the maximal size of the body of the response kept in the
+// delivery log.
+const maxResponseSize = 1024
+
+// webhookClient only dials the public IP addresses, and doesn't follow the
+// redirections, as the URL of a webhook is given by an app and the response
+// can be read in the delivery log.
+var webhookClient = &http.Client{
+	Transport: safehttp.NewTransport(30 * time.Second),
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Message is the message of a webhook job: the URL where the payload is
+// posted. The payload is the event for a job pushed by an @event trigger, the
+// payload of the request for a @webhook trigger, and else the payload of the
+// message.
+//
+// The secret used to sign the payload is not in the message, as the jobs and
+// the triggers can be read by the apps. For a trigger, it is kept in its own
+// document (see jobs.SetWebhookSecret), and Signed is true. For the events of
+// the lifecycle of the instances, the job is pushed on the global database,
+// with the domain and the event in the message, and the secret is read from
+// the configuration of the hosting.
+type Message struct {
+	URL     string          `json:"url"`
+	Signed  bool            `json:"signed,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Domain  string          `json:"domain,omitempty"`
+	Event   string          `json:"event,omitempty"`
+}
+
+// Delivery is a document of the log of the deliveries of a webhook: there is
+// one document for each attempt.
+type Delivery struct {
+	DocID      string    `json:"_id,omitempty"`
+	DocRev     string    `json:"_rev,omitempty"`
+	DeliveryID string    `json:"delivery_id"`
+	TriggerID  string    `json:"trigger_id,omitempty"`
+	Domain     string    `json:"domain,omitempty"`
+	Event      string    `json:"event,omitempty"`
+	URL        string    `json:"url"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Response   string    `json:"response,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ID implements the couchdb.Doc interface
+func (d *Delivery) ID() string { return d.DocID }
+
+// Rev implements the couchdb.Doc interface
+func (d *Delivery) Rev() string { return d.DocRev }
+
+// DocType implements the couchdb.Doc interface
+func (d *Delivery) DocType() string { return consts.WebhookDeliveries }
+
+// SetID implements the couchdb.Doc interface
+func (d *Delivery) SetID(id string) { d.DocID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (d *Delivery) SetRev(rev string) { d.DocRev = rev }
+
+// Clone implements the couchdb.Doc interface
+func (d *Delivery) Clone() couchdb.Doc {
+	cloned := *d
+	return &cloned
+}
+
+// GetDeliveries returns the last deliveries of the webhook of the given
+// trigger, from the most recent to the oldest.
+func GetDeliveries(db prefixer.Prefixer, triggerID string, limit int) ([]*Delivery, error) {
+	if limit <= 0 || limit > 50 {
+		limit = 50
+	}
+	var deliveries []*Delivery
+	req := &couchdb.FindRequest{
+		UseIndex: "by-trigger-id",
+		Selector: mango.Equal("trigger_id", triggerID),
+		Sort: mango.SortBy{
+			{Field: "trigger_id", Direction: mango.Desc},
+			{Field: "created_at", Direction: mango.Desc},
+		},
+		Limit: limit,
+	}
+	err := couchdb.FindDocs(db, consts.WebhookDeliveries, req, &deliveries)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// GetLifecycleDeliveries returns the last deliveries of the events of the
+// lifecycle of an instance to the webhook of the hosting, from the most recent
+// to the oldest. They are kept in the global database, even after the
+// instance has been deleted.
+func GetLifecycleDeliveries(domain string, limit int) ([]*Delivery, error) {
+	if limit <= 0 || limit > 50 {
+		limit = 50
+	}
+	var deliveries []*Delivery
+	req := &couchdb.FindRequest{
+		UseIndex: "by-domain",
+		Selector: mango.Equal("domain", domain),
+		Sort: mango.SortBy{
+			{Field: "domain", Direction: mango.Desc},
+			{Field: "created_at", Direction: mango.Desc},
+		},
+		Limit: limit,
+	}
+	err := couchdb.FindDocs(prefixer.GlobalPrefixer, consts.WebhookDeliveries, req, &deliveries)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Worker is the worker that posts a payload to an external service. The
+// payload is signed with the secret, and the attempt is retried with a
+// backoff when the service responds with a 5xx status code.
+func Worker(ctx *jobs.WorkerContext) error {
+	var msg Message
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	var db prefixer.Prefixer = prefixer.GlobalPrefixer
+	secret := config.GetConfig().Hosting.WebhookSecret
+	if ctx.Domain() != prefixer.GlobalPrefixer.DomainName() {
+		inst, err := instance.Get(ctx.Domain())
+		if err != nil {
+			return err
+		}
+		db = inst
+		if secret, err = secretOf(ctx, inst, &msg); err != nil {
+			return err
+		}
+	}
+	u, err := url.Parse(msg.URL)
+	if err != nil || u.Host == "" {
+		ctx.SetNoRetry()
+		return fmt.Errorf("Invalid webhook URL %q", msg.URL)
+	}
+	if u.Scheme != "https" && (u.Scheme != "http" || !config.IsDevRelease()) {
+		ctx.SetNoRetry()
+		return fmt.Errorf("Invalid scheme for the webhook URL %q", msg.URL)
+	}
+
+	payload := payloadOf(ctx, &msg)
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cozy-stack "+config.Version+" ("+runtime.Version()+")")
+	req.Header.Set(jobs.DeliveryHeader, ctx.JobID())
+	if secret != "" {
+		req.Header.Set(jobs.SignatureHeader, jobs.SignPayload(secret, payload))
+	}
+
+	triggerID, _ := ctx.TriggerID()
+	delivery := &Delivery{
+		DeliveryID: ctx.JobID(),
+		TriggerID:  triggerID,
+		Domain:     msg.Domain,
+		Event:      msg.Event,
+		URL:        msg.URL,
+		CreatedAt:  time.Now(),
+	}
+	err = send(ctx, req, delivery)
+	if errc := couchdb.CreateDoc(db, delivery); errc != nil {
+		ctx.Logger().Warnf("Cannot save the delivery %s: %s", delivery.DeliveryID, errc)
+	}
+	return err
+}
+
+// secretOf returns the secret of the trigger of the job, if the payload must
+// be signed. The secret is saved just after the trigger has been created: if
+// it is not here yet, the job is retried later.
+func secretOf(ctx *jobs.WorkerContext, inst *instance.Instance, msg *Message) (string, error) {
+	if !msg.Signed {
+		return "", nil
+	}
+	triggerID, ok := ctx.TriggerID()
+	if !ok {
+		ctx.SetNoRetry()
+		return "", errors.New("The secret of a webhook can only be used by a trigger")
+	}
+	secret, err := jobs.GetWebhookSecret(inst, triggerID)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read the secret of the webhook: %s", err)
+	}
+	return secret, nil
+}
+
+func payloadOf(ctx *jobs.WorkerContext, msg *Message) []byte {
+	var payload json.RawMessage
+	if err := ctx.UnmarshalEvent(&payload); err == nil {
+		return payload
+	}
+	if err := ctx.UnmarshalPayload(&payload); err == nil {
+		return payload
+	}
+	if len(msg.Payload) > 0 {
+		return msg.Payload
+	}
+	return []byte("{}")
+}
+
+func send(ctx *jobs.WorkerContext, req *http.Request, delivery *Delivery) error {
+	start := time.Now()
+	res, err := webhookClient.Do(req.WithContext(ctx))
+	delivery.Duration = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok && uerr.Err == safehttp.ErrForbiddenAddress {
+			ctx.SetNoRetry()
+		}
+		delivery.Error = err.Error()
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	delivery.StatusCode = res.StatusCode
+	delivery.Response = string(body)
+
+	switch {
+	case res.StatusCode >= 500:
+		err = fmt.Errorf("Unexpected response from the webhook: %d", res.StatusCode)
+	case res.StatusCode >= 400:
+		// The request will be rejected again, don't retry it
+		ctx.SetNoRetry()
+		err = fmt.Errorf("Webhook rejected with status code %d", res.StatusCode)
+	case res.StatusCode >= 300:
+		// The redirections are not followed
+		ctx.SetNoRetry()
+		err = fmt.Errorf("Webhook redirected with status code %d", res.StatusCode)
+	default:
+		return nil
+	}
+	delivery.Error = err.Error()
+	return err
+}
+
+var _ couchdb.Doc = &Delivery{}
@@ -0,0 +1,203 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var inst *instance.Instance
+
+// hook is a fake external service that records the requests of the webhooks.
+type hook struct {
+	status     int
+	signatures []string
+	bodies     []string
+	server     *httptest.Server
+}
+
+func newHook() *hook {
+	h := &hook{status: http.StatusOK}
+	h.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		h.signatures = append(h.signatures, r.Header.Get(jobs.SignatureHeader))
+		h.bodies = append(h.bodies, string(body))
+		w.WriteHeader(h.status)
+		_, _ = w.Write([]byte("OK"))
+	}))
+	return h
+}
+
+func runWorker(t *testing.T, db prefixer.Prefixer, msg *Message, triggerID ...string) (*jobs.WorkerContext, error) {
+	m, err := jobs.NewMessage(msg)
+	require.NoError(t, err)
+	req := &jobs.JobRequest{WorkerType: "webhook", Message: m}
+	if len(triggerID) > 0 {
+		req.TriggerID = triggerID[0]
+	}
+	job := jobs.NewJob(db, req)
+	job.SetID(utils.RandomString(16))
+	ctx := jobs.NewWorkerContext("id", job)
+	return ctx, Worker(ctx)
+}
+
+func TestLifecycleWebhook(t *testing.T) {
+	h := newHook()
+	defer h.server.Close()
+	conf := config.GetConfig()
+	conf.Hosting.WebhookSecret = "hosting-secret"
+	defer func() { conf.Hosting.WebhookSecret = "" }()
+
+	// The deliveries of the other runs of the test are kept in the global
+	// database, so a new domain is used each time
+	domain := "lifecycle-" + utils.RandomString(8) + ".cozy.localhost"
+	msg := &Message{
+		URL:     h.server.URL,
+		Signed:  true,
+		Payload: json.RawMessage(`{"event":"instance.created"}`),
+		Domain:  domain,
+		Event:   "instance.created",
+	}
+	_, err := runWorker(t, prefixer.GlobalPrefixer, msg)
+	require.NoError(t, err)
+
+	// The payload is signed with the secret of the configuration
+	require.Len(t, h.bodies, 1)
+	assert.Equal(t, `{"event":"instance.created"}`, h.bodies[0])
+	expected := jobs.SignPayload("hosting-secret", []byte(h.bodies[0]))
+	assert.Equal(t, expected, h.signatures[0])
+
+	// A 5xx response is retried, but logged in the deliveries
+	h.status = http.StatusServiceUnavailable
+	msg.Event = "instance.onboarded"
+	ctx, err := runWorker(t, prefixer.GlobalPrefixer, msg)
+	assert.Error(t, err)
+	assert.False(t, ctx.NoRetry())
+
+	deliveries, err := GetLifecycleDeliveries(domain, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, "instance.onboarded", deliveries[0].Event)
+	assert.Equal(t, http.StatusServiceUnavailable, deliveries[0].StatusCode)
+	assert.NotEmpty(t, deliveries[0].Error)
+	assert.Equal(t, "instance.created", deliveries[1].Event)
+	assert.Equal(t, http.StatusOK, deliveries[1].StatusCode)
+	assert.Equal(t, "OK", deliveries[1].Response)
+	assert.Empty(t, deliveries[1].Error)
+	for _, d := range deliveries {
+		assert.Equal(t, domain, d.Domain)
+		assert.Equal(t, h.server.URL, d.URL)
+	}
+
+	// The limit is applied, from the most recent delivery
+	deliveries, err = GetLifecycleDeliveries(domain, 1)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, "instance.onboarded", deliveries[0].Event)
+
+	// The deliveries of another domain are not returned
+	deliveries, err = GetLifecycleDeliveries("other-"+domain, 10)
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+}
+
+func TestInstanceWebhook(t *testing.T) {
+	h := newHook()
+	defer h.server.Close()
+	config.GetConfig().Hosting.WebhookSecret = "hosting-secret"
+	defer func() { config.GetConfig().Hosting.WebhookSecret = "" }()
+
+	// The webhook of a trigger is signed with the secret of the trigger
+	triggerID := utils.RandomString(16)
+	msg := &Message{
+		URL:     h.server.URL,
+		Signed:  true,
+		Payload: json.RawMessage(`{"foo":"bar"}`),
+	}
+	ctx, err := runWorker(t, inst, msg, triggerID)
+	assert.Error(t, err, "the secret is not saved yet")
+	assert.False(t, ctx.NoRetry())
+	assert.Empty(t, h.bodies)
+	require.NoError(t, jobs.SetWebhookSecret(inst, triggerID, "trigger-secret"))
+	_, err = runWorker(t, inst, msg, triggerID)
+	require.NoError(t, err)
+	require.Len(t, h.bodies, 1)
+	expected := jobs.SignPayload("trigger-secret", []byte(h.bodies[0]))
+	assert.Equal(t, expected, h.signatures[0])
+
+	// A signed webhook can't be pushed without a trigger
+	ctx, err = runWorker(t, inst, msg)
+	assert.Error(t, err)
+	assert.True(t, ctx.NoRetry())
+	assert.Len(t, h.bodies, 1)
+
+	// A 4xx response is not retried
+	h.status = http.StatusBadRequest
+	ctx, err = runWorker(t, inst, &Message{URL: h.server.URL})
+	assert.Error(t, err)
+	assert.True(t, ctx.NoRetry())
+	require.Len(t, h.signatures, 2)
+	assert.Empty(t, h.signatures[1])
+
+	// An invalid URL is not retried
+	ctx, err = runWorker(t, inst, &Message{URL: "ftp://example.org/"})
+	assert.Error(t, err)
+	assert.True(t, ctx.NoRetry())
+	assert.Len(t, h.bodies, 2)
+
+	// The redirections are not followed, and the response of the
+	// redirection is logged
+	h.status = http.StatusOK
+	target := newHook()
+	defer target.server.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.server.URL, http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+	redirectTrigger := utils.RandomString(16)
+	ctx, err = runWorker(t, inst, &Message{URL: redirect.URL}, redirectTrigger)
+	assert.Error(t, err)
+	assert.True(t, ctx.NoRetry())
+	assert.Empty(t, target.bodies)
+	deliveries, err := GetDeliveries(inst, redirectTrigger, 10)
+	require.NoError(t, err)
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, http.StatusTemporaryRedirect, deliveries[0].StatusCode)
+	}
+}
+
+func TestWebhookForbiddenAddress(t *testing.T) {
+	previousMode := config.BuildMode
+	config.BuildMode = config.ModeProd
+	defer func() { config.BuildMode = previousMode }()
+
+	// The services of the private network can't be reached
+	h := newHook()
+	defer h.server.Close()
+	u := strings.Replace(h.server.URL, "http://", "https://", 1)
+	ctx, err := runWorker(t, inst, &Message{URL: u})
+	assert.Error(t, err)
+	assert.True(t, ctx.NoRetry())
+	assert.Empty(t, h.bodies)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "webhook_test")
+	inst = setup.GetTestInstance()
+	os.Exit(setup.Run())
+}
@@ -0,0 +1,112 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/keyring"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeKeyPrefix is the prefix of the names of the secrets in the keyring for
+// the certificates and the ACME account.
+const acmeKeyPrefix = "acme_"
+
+// newACMEManager returns a manager that obtains the TLS certificates of the
+// instances (and of their applications) from the ACME server on the first TLS
+// handshake for a domain, and renews them before their expiration. The
+// certificates are swapped on the fly, without restarting the stack.
+func newACMEManager() (*autocert.Manager, error) {
+	opts := config.GetConfig().ACME
+	cache, err := acmeCache(opts)
+	if err != nil {
+		return nil, err
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      cache,
+		HostPolicy: acmeHostPolicy,
+		Email:      opts.Email,
+	}
+	if opts.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: opts.DirectoryURL}
+	}
+	return m, nil
+}
+
+// acmeCache returns the storage for the certificates: the cache directory if
+// one has been configured, or else the keyring.
+func acmeCache(opts config.ACME) (autocert.Cache, error) {
+	if opts.CacheDir != "" {
+		return autocert.DirCache(opts.CacheDir), nil
+	}
+	kr, err := keyring.New(config.GetConfig().Keyring)
+	if err != nil {
+		return nil, err
+	}
+	store, ok := kr.(keyring.Store)
+	if !ok {
+		return nil, errors.New("acme: a cache_dir, or a file or vault keyring, is required to store the certificates")
+	}
+	return keyringCache{store}, nil
+}
+
+// acmeWellKnownSlugs are the subdomains for which a certificate is accepted
+// even if the application is not installed (yet), as the stack redirects to
+// them, for example during the onboarding.
+var acmeWellKnownSlugs = map[string]bool{
+	consts.OnboardingSlug: true,
+	consts.HomeSlug:       true,
+	consts.SettingsSlug:   true,
+	consts.StoreSlug:      true,
+}
+
+// acmeHostPolicy accepts the domains of the instances, and the subdomains of
+// their installed applications, so that no certificate is requested for an
+// unknown host: the certificates orders are limited by the ACME server.
+func acmeHostPolicy(ctx context.Context, host string) error {
+	if _, err := instance.Get(host); err == nil {
+		return nil
+	}
+	if parent, slug, _ := middlewares.SplitHost(host); slug != "" {
+		if inst, err := instance.Get(parent); err == nil {
+			if acmeWellKnownSlugs[slug] {
+				return nil
+			}
+			if _, err := apps.GetWebappBySlug(inst, slug); err == nil {
+				return nil
+			}
+			return fmt.Errorf("acme: no application %q for the host %q", slug, host)
+		}
+	}
+	return fmt.Errorf("acme: no instance for the host %q", host)
+}
+
+// keyringCache is an autocert cache where the certificates are stored in the
+// keyring.
+type keyringCache struct {
+	store keyring.Store
+}
+
+func (c keyringCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.store.Get(acmeKeyPrefix + key)
+	if err == keyring.ErrNotFound {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (c keyringCache) Put(ctx context.Context, key string, data []byte) error {
+	return c.store.Put(acmeKeyPrefix+key, data)
+}
+
+func (c keyringCache) Delete(ctx context.Context, key string) error {
+	return c.store.Delete(acmeKeyPrefix + key)
+}
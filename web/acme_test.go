@@ -0,0 +1,71 @@
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/keyring"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestKeyringCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	kr, err := keyring.NewFileKeyring(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cache := keyringCache{kr.(keyring.Store)}
+	ctx := context.Background()
+
+	_, err = cache.Get(ctx, "alice.example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+	assert.NoError(t, cache.Put(ctx, "alice.example.com", []byte("cert")))
+	data, err := cache.Get(ctx, "alice.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "cert", string(data))
+	assert.NoError(t, cache.Delete(ctx, "alice.example.com"))
+	_, err = cache.Get(ctx, "alice.example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+}
+
+func TestACMEHostPolicy(t *testing.T) {
+	previous := config.GetConfig().Subdomains
+	config.GetConfig().Subdomains = config.NestedSubdomains
+	defer func() { config.GetConfig().Subdomains = previous }()
+	ctx := context.Background()
+
+	inst, err := instance.Get(domain)
+	if !assert.NoError(t, err) {
+		return
+	}
+	app := &apps.WebappManifest{
+		DocSlug:        "acme-app",
+		DocPermissions: permissions.Set{},
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDocWithDB(inst, app)) {
+		return
+	}
+	defer func() { _ = couchdb.DeleteDoc(inst, app) }()
+
+	assert.NoError(t, acmeHostPolicy(ctx, domain))
+	assert.NoError(t, acmeHostPolicy(ctx, "acme-app."+domain))
+	assert.NoError(t, acmeHostPolicy(ctx, "onboarding."+domain))
+
+	// No certificate for the applications that are not installed, nor for
+	// the unknown instances
+	assert.Error(t, acmeHostPolicy(ctx, "not-installed."+domain))
+	assert.Error(t, acmeHostPolicy(ctx, "unknown.example.net"))
+	assert.Error(t, acmeHostPolicy(ctx, "acme-app.unknown.example.net"))
+}
@@ -202,6 +202,28 @@ func updateHandler(installerType apps.AppType) echo.HandlerFunc {
 	}
 }
 
+// approvePermissionsHandler handles all POST /:slug/permissions/approve: it
+// records that the user has approved the new permissions requested by the
+// available version, and starts the update to this version.
+func approvePermissionsHandler(installerType apps.AppType) echo.HandlerFunc {
+	update := updateHandler(installerType)
+	return func(c echo.Context) error {
+		instance := middlewares.GetInstance(c)
+		slug := c.Param("slug")
+		if err := middlewares.AllowInstallApp(c, installerType, permissions.POST); err != nil {
+			return err
+		}
+		man, err := apps.GetBySlug(instance, slug, installerType)
+		if err != nil {
+			return wrapAppsError(err)
+		}
+		if err = apps.ApprovePermissions(instance, man); err != nil {
+			return wrapAppsError(err)
+		}
+		return update(c)
+	}
+}
+
 // deleteHandler handles all DELETE /:slug used to delete an application with
 // the specified slug.
 func deleteHandler(installerType apps.AppType) echo.HandlerFunc {
@@ -362,6 +384,7 @@ func WebappsRoutes(router *echo.Group) {
 	router.GET("/:slug", getHandler(apps.Webapp))
 	router.POST("/:slug", installHandler(apps.Webapp))
 	router.PUT("/:slug", updateHandler(apps.Webapp))
+	router.POST("/:slug/permissions/approve", approvePermissionsHandler(apps.Webapp))
 	router.DELETE("/:slug", deleteHandler(apps.Webapp))
 	router.GET("/:slug/icon", iconHandler(apps.Webapp))
 	router.GET("/:slug/icon/:version", iconHandler(apps.Webapp))
@@ -373,6 +396,7 @@ func KonnectorRoutes(router *echo.Group) {
 	router.GET("/:slug", getHandler(apps.Konnector))
 	router.POST("/:slug", installHandler(apps.Konnector))
 	router.PUT("/:slug", updateHandler(apps.Konnector))
+	router.POST("/:slug/permissions/approve", approvePermissionsHandler(apps.Konnector))
 	router.DELETE("/:slug", deleteHandler(apps.Konnector))
 	router.GET("/:slug/icon", iconHandler(apps.Konnector))
 	router.GET("/:slug/icon/:version", iconHandler(apps.Konnector))
@@ -396,6 +420,8 @@ func wrapAppsError(err error) error {
 		return jsonapi.BadRequest(err)
 	case apps.ErrMissingSource:
 		return jsonapi.BadRequest(err)
+	case apps.ErrNoPermissionsUpdate:
+		return jsonapi.Conflict(err)
 	}
 	if _, ok := err.(*url.Error); ok {
 		return jsonapi.InvalidParameter("Source", err)
@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 	"testing"
 
@@ -84,6 +85,16 @@ func installMiniApp() error {
 				Index:  "index.html",
 				Public: true,
 			},
+			"/csp": apps.Route{
+				Folder: "/csp",
+				Index:  "index.html",
+				Public: false,
+			},
+		},
+		CSP: &apps.CSP{
+			ConnectSrc: []string{"https://api.example.org", "'unsafe-eval'"},
+			ImgSrc:     []string{"https://*.images.example.org", "*"},
+			FrameSrc:   []string{"https://player.example.org/embed"},
 		},
 	}
 
@@ -125,6 +136,15 @@ func installMiniApp() error {
 		return err
 	}
 	err = createFile(pubdir, "index.html", "this is a file in public/")
+	if err != nil {
+		return err
+	}
+	cspdir := path.Join(appdir, "csp")
+	_, err = vfs.Mkdir(testInstance.VFS(), cspdir, nil)
+	if err != nil {
+		return err
+	}
+	err = createFile(cspdir, "index.html", `<script nonce="{{.CSPNonce}}">init()</script>`)
 	return err
 }
 
@@ -227,6 +247,26 @@ func TestServeWithAnIntents(t *testing.T) {
 	assert.Contains(t, h, "frame-ancestors 'self' https://test-app.cozywithapps.example.net/;")
 }
 
+func TestServeWithCSP(t *testing.T) {
+	res, err := doGet("/csp/", true)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	h := res.Header.Get(echo.HeaderContentSecurityPolicy)
+	assert.Contains(t, h, " https://api.example.org;")
+	assert.Contains(t, h, " https://*.images.example.org;")
+	assert.Contains(t, h, " https://player.example.org/embed;")
+	assert.NotContains(t, h, "'unsafe-eval'")
+	assert.NotContains(t, h, " *;")
+
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	matches := regexp.MustCompile(`nonce="(\w+)"`).FindStringSubmatch(string(body))
+	if assert.Len(t, matches, 2) {
+		assert.Contains(t, h, "'nonce-"+matches[1]+"';")
+	}
+}
+
 func TestServeAppsWithACode(t *testing.T) {
 	config.GetConfig().Subdomains = config.FlatSubdomains
 	appHost := "cozywithapps-mini.example.net"
@@ -51,12 +51,21 @@ func Serve(c echo.Context) error {
 		var redirect string
 		if i.Blocked {
 			redirect, _ = i.ManagerURL(instance.ManagerBlockedURL)
+			if redirect == "" {
+				errHTTP := echo.NewHTTPError(http.StatusPaymentRequired, instance.ErrBlocked)
+				errHTTP.Inner = instance.ErrBlocked
+				return errHTTP
+			}
 		} else {
 			redirect, _ = i.ManagerURL(instance.ManagerTOSURL)
 		}
 		return c.Redirect(http.StatusFound, redirect)
 	}
 
+	if i.AppInMaintenance(slug) {
+		return middlewares.MaintenanceError(c, i)
+	}
+
 	app, err := apps.GetWebappBySlug(i, slug)
 	if err != nil {
 		// Used for the "collect" => "home" renaming
@@ -108,6 +117,66 @@ func handleIntent(c echo.Context, i *instance.Instance, slug, intentID string) {
 	middlewares.AppendCSPRule(c, "frame-ancestors", from)
 }
 
+// cspNonceLength is the number of characters of the nonce used for the inline
+// scripts of the index of an application.
+const cspNonceLength = 24
+
+// handleCSP adds to the Content-Security-Policy header the external sources
+// declared in the manifest of the application, and a nonce for the inline
+// script that bootstraps the application. The other inline scripts are still
+// blocked. It returns the nonce, or an empty string if the CSP is disabled.
+func handleCSP(c echo.Context, i *instance.Instance, app *apps.WebappManifest) string {
+	if c.Response().Header().Get(echo.HeaderContentSecurityPolicy) == "" {
+		return ""
+	}
+	if csp := app.CSP; csp != nil {
+		appendCSPSources(c, i, "connect-src", csp.ConnectSrc)
+		appendCSPSources(c, i, "img-src", csp.ImgSrc)
+		appendCSPSources(c, i, "frame-src", csp.FrameSrc)
+	}
+	nonce := utils.RandomString(cspNonceLength)
+	middlewares.AppendCSPRule(c, "script-src", "'nonce-"+nonce+"'")
+	return nonce
+}
+
+func appendCSPSources(c echo.Context, i *instance.Instance, ruleType string, sources []string) {
+	var valid []string
+	for _, src := range sources {
+		if validCSPSource(src, i.Dev) {
+			valid = append(valid, src)
+		} else {
+			i.Logger().WithField("nspace", "apps").
+				Infof("Invalid source for %s in the manifest: %q", ruleType, src)
+		}
+	}
+	if len(valid) > 0 {
+		middlewares.AppendCSPRule(c, ruleType, valid...)
+	}
+}
+
+// validCSPSource checks that a source from a manifest is an URL with a host,
+// and not a keyword like 'unsafe-inline' or a wildcard for all the hosts.
+func validCSPSource(src string, dev bool) bool {
+	if strings.ContainsAny(src, " \t;,'\"") {
+		return false
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "https", "wss":
+	case "http", "ws":
+		if !dev {
+			return false
+		}
+	default:
+		return false
+	}
+	host := strings.TrimPrefix(u.Hostname(), "*.")
+	return host != "" && !strings.Contains(host, "*")
+}
+
 // ServeAppFile will serve the requested file using the specified application
 // manifest and apps.FileServer context.
 //
@@ -183,6 +252,7 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs apps.FileServer, app
 	if intentID := c.QueryParam("intent"); intentID != "" {
 		handleIntent(c, i, slug, intentID)
 	}
+	nonce := handleCSP(c, i, app)
 
 	// For index file, we inject the locale, the stack domain, and a token if the
 	// user is connected
@@ -235,6 +305,7 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs apps.FileServer, app
 		"CozyBar":       cozybar(i, isLoggedIn),
 		"CozyClientJS":  cozyclientjs(i),
 		"Tracking":      tracking,
+		"CSPNonce":      nonce,
 	})
 }
 
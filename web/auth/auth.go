@@ -15,10 +15,14 @@ import (
 	"strings"
 
 	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/bitwarden"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/errcode"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/sessions"
@@ -28,7 +32,6 @@ import (
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/cozy-stack/web/statik"
 	"github.com/cozy/echo"
-	"github.com/cozy/echo/middleware"
 )
 
 const (
@@ -38,6 +41,9 @@ const (
 	// TwoFactorErrorKey is the key for translating the message showed to the
 	// user when he/she enters incorrect two factor secret
 	TwoFactorErrorKey = "Login Two factor error"
+	// RateLimitErrorKey is the key for translating the message showed to the
+	// user when there were too many login attempts
+	RateLimitErrorKey = "Login Rate limit error"
 )
 
 // Home is the handler for /
@@ -227,6 +233,30 @@ func loginForm(c echo.Context) error {
 	return renderLoginForm(c, instance, http.StatusOK, "", redirect)
 }
 
+// isRateLimited increments the counter of the attempts for the given action,
+// and returns true if there were too many attempts.
+func isRateLimited(inst *instance.Instance, ct limits.CounterType) bool {
+	err := limits.CheckRateLimit(inst, ct)
+	if err == limits.ErrRateLimitReached {
+		inst.Logger().WithField("nspace", "auth").Warnf("Too many login attempts")
+		return true
+	}
+	if err != nil {
+		inst.Logger().WithField("nspace", "auth").Errorf("Could not check the rate limit: %s", err)
+	}
+	return false
+}
+
+func renderRateLimitReached(c echo.Context, inst *instance.Instance, wantsJSON bool, redirect *url.URL) error {
+	errorMessage := inst.Translate(RateLimitErrorKey)
+	if wantsJSON {
+		return c.JSON(http.StatusTooManyRequests, echo.Map{
+			"error": errorMessage,
+		})
+	}
+	return renderLoginForm(c, inst, http.StatusTooManyRequests, errorMessage, redirect)
+}
+
 func login(c echo.Context) error {
 	inst := middlewares.GetInstance(c)
 	wantsJSON := c.Request().Header.Get("Accept") == "application/json"
@@ -254,6 +284,9 @@ func login(c echo.Context) error {
 	if ok {
 		sessionID = session.ID()
 	} else if twoFactorRequest {
+		if isRateLimited(inst, limits.TwoFactorType) {
+			return renderRateLimitReached(c, inst, wantsJSON, redirect)
+		}
 		successfulAuthentication = inst.ValidateTwoFactorPasscode(
 			twoFactorToken, twoFactorPasscode)
 
@@ -262,7 +295,15 @@ func login(c echo.Context) error {
 				inst.GenerateTwoFactorTrustedDeviceSecret(c.Request())
 		}
 	} else if passphraseRequest {
+		if isRateLimited(inst, limits.AuthType) {
+			return renderRateLimitReached(c, inst, wantsJSON, redirect)
+		}
 		if inst.CheckPassphrase(passphrase) == nil {
+			// The passphrase is also the master password of the vault, and it
+			// is the only moment where the stack knows it.
+			if err = bitwarden.InitProfile(inst, passphrase); err != nil {
+				inst.Logger().Errorf("Could not initialize the vault: %s", err)
+			}
 			switch {
 			// In case the second factor authentication mode is "mail", we also
 			// check that the mail has been confirmed. If not, 2FA is not actived.
@@ -294,6 +335,8 @@ func login(c echo.Context) error {
 		if sessionID, err = SetCookieForNewSession(c, longRunSession); err != nil {
 			return err
 		}
+		_ = limits.ResetCounter(inst, limits.AuthType)
+		_ = limits.ResetCounter(inst, limits.TwoFactorType)
 
 		var clientID string
 		if inst.HasDomain(redirect.Host) && redirect.Path == "/auth/authorize" {
@@ -310,10 +353,16 @@ func login(c echo.Context) error {
 		if err = sessions.StoreNewLoginEntry(inst, sessionID, clientID, c.Request(), true); err != nil {
 			inst.Logger().Errorf("Could not store session history %q: %s", sessionID, err)
 		}
+		audit.Record(inst, audit.ActionLogin, c.Request(), nil)
 	}
 
 	// not logged-in
 	if sessionID == "" {
+		if passphraseRequest || twoFactorRequest {
+			audit.Record(inst, audit.ActionLoginFailed, c.Request(), map[string]interface{}{
+				"two_factor": twoFactorRequest,
+			})
+		}
 		var errorMessage string
 		if twoFactorRequest {
 			errorMessage = inst.Translate(TwoFactorErrorKey)
@@ -448,12 +497,17 @@ func checkRedirectParam(c echo.Context, defaultRedirect *url.URL) (*url.URL, err
 }
 
 func registerClient(c echo.Context) error {
-	// TODO add rate-limiting to prevent DOS attacks
+	instance := middlewares.GetInstance(c)
+	if err := limits.CheckRateLimit(instance, limits.OAuthClientType); err == limits.ErrRateLimitReached {
+		return echo.NewHTTPError(http.StatusTooManyRequests, err)
+	}
 	client := new(oauth.Client)
 	if err := json.NewDecoder(c.Request().Body).Decode(client); err != nil {
 		return err
 	}
-	instance := middlewares.GetInstance(c)
+	// Only the pairing can create a client for the flagship app
+	client.Flagship = false
+	client.CertifiedFromStore = false
 	// We do not allow the creation of clients allowed to have an empty scope
 	// ("login" scope), except via the CLI.
 	if client.AllowLoginScope {
@@ -469,6 +523,7 @@ func registerClient(c echo.Context) error {
 	if err := client.Create(instance); err != nil {
 		return c.JSON(err.Code, err)
 	}
+	audit.Record(instance, audit.ActionOAuthClientCreated, c.Request(), clientDetails(client))
 	return c.JSON(http.StatusCreated, client)
 }
 
@@ -498,15 +553,26 @@ func deleteClient(c echo.Context) error {
 	if err := client.Delete(instance); err != nil {
 		return c.JSON(err.Code, err)
 	}
+	audit.Record(instance, audit.ActionOAuthClientRevoked, c.Request(), clientDetails(client))
 	return c.NoContent(http.StatusNoContent)
 }
 
+// clientDetails returns the details of an OAuth client for the audit log.
+func clientDetails(client *oauth.Client) map[string]interface{} {
+	return map[string]interface{}{
+		"client_id":   client.ClientID,
+		"client_name": client.ClientName,
+		"software_id": client.SoftwareID,
+	}
+}
+
 type authorizeParams struct {
 	instance    *instance.Instance
 	state       string
 	clientID    string
 	redirectURI string
 	scope       string
+	optional    string
 	resType     string
 	client      *oauth.Client
 }
@@ -574,6 +640,7 @@ func authorizeForm(c echo.Context) error {
 		clientID:    c.QueryParam("client_id"),
 		redirectURI: c.QueryParam("redirect_uri"),
 		scope:       c.QueryParam("scope"),
+		optional:    c.QueryParam("optional_scope"),
 		resType:     c.QueryParam("response_type"),
 	}
 
@@ -617,7 +684,7 @@ func authorizeForm(c echo.Context) error {
 		return c.Redirect(http.StatusFound, u.String()+"#")
 	}
 
-	permissions, err := permissions.UnmarshalScopeString(params.scope)
+	perms, err := consentPermissions(params.scope, params.optional)
 	if err != nil {
 		return c.Render(http.StatusBadRequest, "error.html", echo.Map{
 			"Domain": instance.ContextualDomain(),
@@ -625,7 +692,7 @@ func authorizeForm(c echo.Context) error {
 		})
 	}
 	readOnly := true
-	for _, p := range permissions {
+	for _, p := range perms {
 		if !p.Verbs.ReadOnly() {
 			readOnly = false
 		}
@@ -661,7 +728,8 @@ func authorizeForm(c echo.Context) error {
 		"State":        params.state,
 		"RedirectURI":  params.redirectURI,
 		"Scope":        params.scope,
-		"Permissions":  permissions,
+		"Optional":     params.optional,
+		"Permissions":  perms,
 		"ReadOnly":     readOnly,
 		"CSRF":         c.Get("csrf"),
 	})
@@ -675,6 +743,7 @@ func authorize(c echo.Context) error {
 		clientID:    c.FormValue("client_id"),
 		redirectURI: c.FormValue("redirect_uri"),
 		scope:       c.FormValue("scope"),
+		optional:    c.FormValue("optional_scope"),
 		resType:     c.FormValue("response_type"),
 	}
 
@@ -697,7 +766,17 @@ func authorize(c echo.Context) error {
 		})
 	}
 
-	access, err := oauth.CreateAccessCode(params.instance, params.clientID, params.scope)
+	// The user may have unticked some optional permissions: the token will
+	// only have the approved ones.
+	scope := approvedScope(params.scope, params.optional, c.Request().Form["approved_scope"])
+	if scope == "" {
+		return c.Render(http.StatusBadRequest, "error.html", echo.Map{
+			"Domain": instance.ContextualDomain(),
+			"Error":  "Error No approved scope",
+		})
+	}
+
+	access, err := oauth.CreateAccessCode(params.instance, params.clientID, scope)
 	if err != nil {
 		return err
 	}
@@ -714,6 +793,52 @@ func authorize(c echo.Context) error {
 	return c.Redirect(http.StatusFound, u.String()+"#")
 }
 
+// consentPermission is a permission shown on the authorize page. When it is
+// optional, the user can untick it before approving.
+type consentPermission struct {
+	permissions.Rule
+	Scope    string
+	Optional bool
+}
+
+// consentPermissions returns the permissions asked in the scope, with the
+// ones listed in the optional scope flagged as optional.
+func consentPermissions(scope, optional string) ([]consentPermission, error) {
+	if scope == "" {
+		return nil, permissions.ErrBadScope
+	}
+	optionals := strings.Fields(optional)
+	parts := strings.Split(scope, " ")
+	perms := make([]consentPermission, len(parts))
+	for i, part := range parts {
+		rule, err := permissions.UnmarshalRuleString(part)
+		if err != nil {
+			return nil, err
+		}
+		perms[i] = consentPermission{
+			Rule:     rule,
+			Scope:    part,
+			Optional: utils.IsInArray(part, optionals),
+		}
+	}
+	return perms, nil
+}
+
+// approvedScope returns the scope approved by the user: the permissions of
+// the scope that are not optional, and the optional ones that the user has
+// kept ticked.
+func approvedScope(scope, optional string, approved []string) string {
+	optionals := strings.Fields(optional)
+	var parts []string
+	for _, part := range strings.Split(scope, " ") {
+		if utils.IsInArray(part, optionals) && !utils.IsInArray(part, approved) {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
 type authorizeSharingParams struct {
 	instance  *instance.Instance
 	state     string
@@ -809,7 +934,7 @@ func authorizeSharing(c echo.Context) error {
 		return sharing.ErrInvalidSharing
 	}
 
-	if err = s.SendAnswer(instance, params.state); err != nil {
+	if err = s.Accept(instance, params.state); err != nil {
 		return err
 	}
 	redirect := s.RedirectAfterAuthorizeURL(instance)
@@ -1107,10 +1232,23 @@ func passphraseRenew(c echo.Context) error {
 				"Error":  "Error Invalid reset token",
 			})
 		}
+		if e, ok := err.(*errcode.Error); ok {
+			return c.Render(e.Status, "error.html", echo.Map{
+				"Domain": inst.ContextualDomain(),
+				"Error":  e.Message,
+			})
+		}
 		return c.JSON(http.StatusBadRequest, echo.Map{
 			"error": "invalid_token",
 		})
 	}
+	audit.Record(inst, audit.ActionPassphraseChanged, c.Request(), map[string]interface{}{
+		"reset": true,
+	})
+	// The vault can't be decrypted without the old passphrase
+	if err := bitwarden.ResetProfile(inst, pass); err != nil {
+		inst.Logger().Errorf("Could not reset the vault: %s", err)
+	}
 	return c.Redirect(http.StatusSeeOther, inst.PageURL("/auth/login", nil))
 }
 
@@ -1145,34 +1283,111 @@ func secretExchange(c echo.Context) error {
 	return c.JSON(http.StatusOK, doc)
 }
 
+type pairingRequest struct {
+	*oauth.Client
+	PairingCode         string `json:"pairing_code"`
+	Attestation         string `json:"attestation"`
+	AttestationPlatform string `json:"attestation_platform"`
+}
+
+type pairingResponse struct {
+	*oauth.Client
+	accessTokenReponse
+}
+
+// pair is used by a mobile app that has scanned the QR code shown in the
+// settings. It trades the pairing code for an OAuth client, and its access
+// and refresh tokens: it is the registration and the authorization in one
+// step, without the user having to log in on the mobile. When the app sends
+// an attestation from its platform, with the pairing code as the nonce, the
+// client is also certified as the genuine app from the store.
+func pair(c echo.Context) error {
+	req := &pairingRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(req); err != nil {
+		return err
+	}
+	if req.Client == nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "the client metadata are mandatory",
+		})
+	}
+	instance := middlewares.GetInstance(c)
+	pc, err := oauth.ConsumePairingCode(instance, req.PairingCode)
+	if err == oauth.ErrInvalidPairingCode || err == oauth.ErrExpiredPairingCode {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	client := req.Client
+	client.AllowLoginScope = false
+	client.Flagship = true
+	client.CertifiedFromStore = false
+	if req.Attestation != "" {
+		err = oauth.CheckAttestation(req.AttestationPlatform, req.Attestation, []byte(req.PairingCode))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"error": err.Error(),
+			})
+		}
+		client.CertifiedFromStore = true
+	}
+	if client.ClientKind == "" {
+		client.ClientKind = "mobile"
+	}
+	if regErr := client.Create(instance); regErr != nil {
+		return c.JSON(regErr.Code, regErr)
+	}
+	audit.Record(instance, audit.ActionOAuthClientCreated, c.Request(), clientDetails(client))
+
+	out := pairingResponse{
+		Client: client,
+		accessTokenReponse: accessTokenReponse{
+			Type:  "bearer",
+			Scope: pc.Scope,
+		},
+	}
+	client.CouchID = client.ClientID // XXX CouchID is required by CreateJWT
+	out.Refresh, err = client.CreateJWT(instance, permissions.RefreshTokenAudience, pc.Scope)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Can't generate refresh token",
+		})
+	}
+	out.Access, err = client.CreateJWT(instance, permissions.AccessTokenAudience, pc.Scope)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Can't generate access token",
+		})
+	}
+	client.CouchID = ""
+	return c.JSON(http.StatusCreated, out)
+}
+
 // Routes sets the routing for the status service
 func Routes(router *echo.Group) {
-	noCSRF := middleware.CSRFWithConfig(middleware.CSRFConfig{
-		TokenLookup:    "form:csrf_token",
-		CookieMaxAge:   3600, // 1 hour
-		CookieHTTPOnly: true,
-		CookieSecure:   !config.IsDevRelease(),
-	})
-
-	router.GET("/login", loginForm, noCSRF)
-	router.POST("/login", login, noCSRF)
+	router.GET("/login", loginForm, middlewares.CSRF)
+	router.POST("/login", login, middlewares.CSRF)
 
 	router.DELETE("/login/others", logoutOthers)
 	router.OPTIONS("/login/others", logoutPreflight)
 	router.DELETE("/login", logout)
 	router.OPTIONS("/login", logoutPreflight)
 
-	router.GET("/passphrase_reset", passphraseResetForm, noCSRF)
-	router.POST("/passphrase_reset", passphraseReset, noCSRF)
-	router.GET("/passphrase_renew", passphraseRenewForm, noCSRF)
-	router.POST("/passphrase_renew", passphraseRenew, noCSRF)
+	router.GET("/passphrase_reset", passphraseResetForm, middlewares.CSRF)
+	router.POST("/passphrase_reset", passphraseReset, middlewares.CSRF)
+	router.GET("/passphrase_renew", passphraseRenewForm, middlewares.CSRF)
+	router.POST("/passphrase_renew", passphraseRenew, middlewares.CSRF)
 
 	router.POST("/register", registerClient, middlewares.AcceptJSON, middlewares.ContentTypeJSON)
 	router.GET("/register/:client-id", readClient, middlewares.AcceptJSON, checkRegistrationToken)
 	router.PUT("/register/:client-id", updateClient, middlewares.AcceptJSON, middlewares.ContentTypeJSON, checkRegistrationToken)
 	router.DELETE("/register/:client-id", deleteClient, checkRegistrationToken)
 
-	authorizeGroup := router.Group("/authorize", noCSRF)
+	authorizeGroup := router.Group("/authorize", middlewares.CSRF)
 	authorizeGroup.GET("", authorizeForm)
 	authorizeGroup.POST("", authorize)
 	authorizeGroup.GET("/sharing", authorizeSharingForm)
@@ -1182,4 +1397,6 @@ func Routes(router *echo.Group) {
 
 	router.POST("/access_token", accessToken)
 	router.POST("/secret_exchange", secretExchange)
+	router.POST("/introspect", introspectToken)
+	router.POST("/pair", pair, middlewares.AcceptJSON, middlewares.ContentTypeJSON)
 }
@@ -189,6 +189,24 @@ func TestLoginWithBadPassphrase(t *testing.T) {
 	assert.Equal(t, "401 Unauthorized", res.Status)
 }
 
+func TestLoginFromAnotherOrigin(t *testing.T) {
+	v := &url.Values{
+		"passphrase": {"MyPassphrase"},
+		"csrf_token": {getLoginCSRFToken(client, t)},
+	}
+	req, _ := http.NewRequest("POST", ts.URL+"/auth/login", bytes.NewBufferString(v.Encode()))
+	req.Host = domain
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Origin", "https://evil.example.org")
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "403 Forbidden", res.Status)
+	for _, cookie := range res.Cookies() {
+		assert.NotEqual(t, sessions.SessionCookieName, cookie.Name)
+	}
+}
+
 func TestLoginWithGoodPassphrase(t *testing.T) {
 	token := getLoginCSRFToken(client, t)
 	res, err := postForm("/auth/login", &url.Values{
@@ -912,6 +930,73 @@ func TestAuthorizeSuccess(t *testing.T) {
 	}
 }
 
+func TestAuthorizeFormOptionalScope(t *testing.T) {
+	u := url.QueryEscape("https://example.org/oauth/callback")
+	scope := url.QueryEscape("files:read io.cozy.contacts")
+	req, _ := http.NewRequest("GET", ts.URL+"/auth/authorize?response_type=code&state=123456&scope="+scope+"&optional_scope=io.cozy.contacts&redirect_uri="+u+"&client_id="+clientID, nil)
+	req.Host = domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), `<input type="hidden" name="optional_scope" value="io.cozy.contacts" />`)
+	assert.Contains(t, string(body), `<input type="checkbox" name="approved_scope" value="io.cozy.contacts" checked />`)
+	assert.NotContains(t, string(body), `name="approved_scope" value="files:read"`)
+}
+
+func TestAuthorizeOptionalScope(t *testing.T) {
+	authorizeScope := func(approved []string) (*http.Response, error) {
+		return postForm("/auth/authorize", &url.Values{
+			"state":          {"123456"},
+			"client_id":      {clientID},
+			"redirect_uri":   {"https://example.org/oauth/callback"},
+			"scope":          {"files:read io.cozy.contacts"},
+			"optional_scope": {"io.cozy.contacts"},
+			"approved_scope": approved,
+			"csrf_token":     {csrfToken},
+			"response_type":  {"code"},
+		})
+	}
+	accessCodeScope := func(res *http.Response) string {
+		location, err := url.Parse(res.Header.Get("Location"))
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		var ac oauth.AccessCode
+		err = couchdb.GetDoc(testInstance, consts.OAuthAccessCodes, location.Query().Get("code"), &ac)
+		assert.NoError(t, err)
+		return ac.Scope
+	}
+
+	res, err := authorizeScope(nil)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	if assert.Equal(t, "302 Found", res.Status) {
+		assert.Equal(t, "files:read", accessCodeScope(res))
+	}
+
+	res2, err := authorizeScope([]string{"io.cozy.contacts"})
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	if assert.Equal(t, "302 Found", res2.Status) {
+		assert.Equal(t, "files:read io.cozy.contacts", accessCodeScope(res2))
+	}
+
+	res3, err := postForm("/auth/authorize", &url.Values{
+		"state":          {"123456"},
+		"client_id":      {clientID},
+		"redirect_uri":   {"https://example.org/oauth/callback"},
+		"scope":          {"io.cozy.contacts"},
+		"optional_scope": {"io.cozy.contacts"},
+		"csrf_token":     {csrfToken},
+		"response_type":  {"code"},
+	})
+	assert.NoError(t, err)
+	defer res3.Body.Close()
+	assert.Equal(t, "400 Bad Request", res3.Status)
+}
+
 func TestAccessTokenNoGrantType(t *testing.T) {
 	res, err := postForm("/auth/access_token", &url.Values{
 		"client_id":     {clientID},
@@ -1079,6 +1164,139 @@ func TestRefreshTokenSuccess(t *testing.T) {
 	assertValidToken(t, response["access_token"], "access")
 }
 
+func TestIntrospectToken(t *testing.T) {
+	k := app.KonnManifest{DocSlug: "introspector"}
+	_, err := permissions.CreateKonnectorSet(testInstance, k.Slug(), permissions.Set{})
+	assert.NoError(t, err)
+	defer permissions.DestroyKonnector(testInstance, k.Slug())
+	callerToken := testInstance.BuildKonnectorToken(&k)
+
+	a := app.WebappManifest{DocSlug: "introspected"}
+	_, err = permissions.CreateWebappSet(testInstance, a.Slug(), permissions.Set{
+		permissions.Rule{Type: "io.cozy.files"},
+	})
+	assert.NoError(t, err)
+	defer permissions.DestroyWebapp(testInstance, a.Slug())
+	token := testInstance.BuildAppToken(&a, "")
+
+	introspect := func(auth string, v *url.Values) (*http.Response, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", ts.URL+"/auth/introspect", bytes.NewBufferString(v.Encode()))
+		req.Host = domain
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if auth != "" {
+			req.Header.Add("Authorization", "Bearer "+auth)
+		}
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		var body map[string]interface{}
+		_ = json.NewDecoder(res.Body).Decode(&body)
+		return res, body
+	}
+
+	res, _ := introspect("", &url.Values{"token": {token}})
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, body := introspect(callerToken, &url.Values{"token": {token}})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, true, body["active"])
+	assert.Equal(t, "app", body["aud"])
+	assert.Equal(t, "introspected", body["sub"])
+	assert.Equal(t, domain, body["iss"])
+	assert.Equal(t, "io.cozy.files", body["scope"])
+	assert.Contains(t, res.Header.Get("Cache-Control"), "private, max-age=")
+
+	res, body = introspect(callerToken, &url.Values{"token": {token}, "audience": {"konn access"}})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, false, body["active"])
+	assert.Equal(t, "no-store", res.Header.Get("Cache-Control"))
+
+	res, body = introspect(callerToken, &url.Values{"token": {"not-a-token"}})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, false, body["active"])
+	assert.NotContains(t, body, "sub")
+}
+
+func TestPairWithInvalidCode(t *testing.T) {
+	res, err := postJSON("/auth/pair", echo.Map{
+		"pairing_code":  "foobar",
+		"redirect_uris": []string{"cozy://mobile"},
+		"client_name":   "cozy-mobile",
+		"software_id":   "github.com/cozy/cozy-mobile",
+	})
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "400 Bad Request", res.Status)
+}
+
+func TestPairSuccess(t *testing.T) {
+	pc, err := oauth.CreatePairingCode(testInstance, "io.cozy.files")
+	assert.NoError(t, err)
+	res, err := postJSON("/auth/pair", echo.Map{
+		"pairing_code":         pc.Code,
+		"redirect_uris":        []string{"cozy://mobile"},
+		"client_name":          "cozy-mobile",
+		"software_id":          "github.com/cozy/cozy-mobile",
+		"flagship":             false,
+		"certified_from_store": true,
+	})
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "201 Created", res.Status)
+	var response map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, response["client_id"])
+	assert.NotEmpty(t, response["client_secret"])
+	assert.NotEmpty(t, response["registration_access_token"])
+	assert.Equal(t, "mobile", response["client_kind"])
+	assert.Equal(t, true, response["flagship"])
+	assert.NotContains(t, response, "certified_from_store")
+	assert.Equal(t, "bearer", response["token_type"])
+	assert.Equal(t, "io.cozy.files", response["scope"])
+	for _, audience := range []string{"access", "refresh"} {
+		claims := permissions.Claims{}
+		err = crypto.ParseJWT(response[audience+"_token"].(string), func(token *jwt.Token) (interface{}, error) {
+			return testInstance.OAuthSecret, nil
+		}, &claims)
+		assert.NoError(t, err)
+		assert.Equal(t, audience, claims.Audience)
+		assert.Equal(t, response["client_id"], claims.Subject)
+		assert.Equal(t, "io.cozy.files", claims.Scope)
+	}
+
+	// The pairing code can be used only once
+	res2, err := postJSON("/auth/pair", echo.Map{
+		"pairing_code":  pc.Code,
+		"redirect_uris": []string{"cozy://mobile"},
+		"client_name":   "cozy-mobile",
+		"software_id":   "github.com/cozy/cozy-mobile",
+	})
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, "400 Bad Request", res2.Status)
+}
+
+func TestPairWithInvalidAttestation(t *testing.T) {
+	pc, err := oauth.CreatePairingCode(testInstance, "io.cozy.files")
+	assert.NoError(t, err)
+	res, err := postJSON("/auth/pair", echo.Map{
+		"pairing_code":         pc.Code,
+		"redirect_uris":        []string{"cozy://mobile"},
+		"client_name":          "cozy-mobile",
+		"software_id":          "github.com/cozy/cozy-mobile",
+		"attestation":          "not-an-attestation",
+		"attestation_platform": "ios",
+	})
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "400 Bad Request", res.Status)
+	var response map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	assert.NoError(t, err)
+	assert.Equal(t, oauth.ErrUnsupportedAttestation.Error(), response["error"])
+}
+
 func TestLogoutNoToken(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", ts.URL+"/auth/login", nil)
 	req.Host = domain
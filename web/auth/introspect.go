@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// maxIntrospectionCache is the maximal duration during which the response of
+// the introspection of an active token can be cached by the caller.
+const maxIntrospectionCache = 5 * time.Minute
+
+// introspectionResponse is the response of the introspection endpoint, as
+// defined in RFC 7662.
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+}
+
+// introspectableAudiences returns the audiences of the tokens that the caller
+// can introspect. The installed apps, the konnectors and the flagship app can
+// verify the tokens given to the apps, konnectors, OAuth clients and shared
+// links. The other OAuth clients can only verify their own tokens.
+func introspectableAudiences(caller *permissions.Permission) []string {
+	switch caller.Type {
+	case permissions.TypeCLI:
+		return []string{
+			permissions.AppAudience,
+			permissions.KonnectorAudience,
+			permissions.AccessTokenAudience,
+			permissions.ShareAudience,
+			permissions.CLIAudience,
+		}
+	case permissions.TypeWebapp, permissions.TypeKonnector:
+		return []string{
+			permissions.AppAudience,
+			permissions.KonnectorAudience,
+			permissions.AccessTokenAudience,
+			permissions.ShareAudience,
+		}
+	case permissions.TypeOauth:
+		if client, ok := caller.Client.(*oauth.Client); ok && client.Flagship {
+			return []string{
+				permissions.AppAudience,
+				permissions.KonnectorAudience,
+				permissions.AccessTokenAudience,
+				permissions.ShareAudience,
+			}
+		}
+		return []string{permissions.AccessTokenAudience}
+	}
+	return nil
+}
+
+func containsAudience(audiences []string, aud string) bool {
+	for _, a := range audiences {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// introspectToken is the token introspection endpoint (RFC 7662): it tells if
+// a token is valid, and gives its scope and subject.
+func introspectToken(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	caller, err := middlewares.GetPermission(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, echo.Map{
+			"error": "invalid_client",
+		})
+	}
+	allowed := introspectableAudiences(caller)
+	if len(allowed) == 0 {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "the caller is not allowed to introspect tokens",
+		})
+	}
+
+	token := c.FormValue("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "the token parameter is mandatory",
+		})
+	}
+	// The caller can restrict the audiences of the tokens that it accepts,
+	// with a space-separated list
+	if audience := c.FormValue("audience"); audience != "" {
+		var restricted []string
+		for _, aud := range strings.Fields(audience) {
+			if containsAudience(allowed, aud) {
+				restricted = append(restricted, aud)
+			}
+		}
+		allowed = restricted
+	}
+
+	inactive := func() error {
+		c.Response().Header().Set("Cache-Control", "no-store")
+		c.Response().Header().Set("Pragma", "no-cache")
+		return c.JSON(http.StatusOK, introspectionResponse{Active: false})
+	}
+
+	pdoc, claims, err := middlewares.IntrospectJWT(inst, token)
+	if err != nil || !containsAudience(allowed, claims.Audience) {
+		return inactive()
+	}
+	if claims.Audience == permissions.AccessTokenAudience && caller.Type == permissions.TypeOauth {
+		if client, ok := caller.Client.(*oauth.Client); !ok || (!client.Flagship && client.ClientID != claims.Subject) {
+			return inactive()
+		}
+	}
+
+	now := time.Now().UTC()
+	validUntil, expires := claims.ValidUntil()
+	if pdoc.ExpiresAt != nil && (!expires || pdoc.ExpiresAt.Before(validUntil)) {
+		validUntil, expires = *pdoc.ExpiresAt, true
+	}
+	if expires && validUntil.Before(now) {
+		return inactive()
+	}
+
+	scope, err := pdoc.Permissions.MarshalScopeString()
+	if err != nil {
+		return inactive()
+	}
+	res := introspectionResponse{
+		Active:    true,
+		Scope:     scope,
+		TokenType: "bearer",
+		Iat:       claims.IssuedAt,
+		Sub:       claims.Subject,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+	}
+	if claims.Audience == permissions.AccessTokenAudience {
+		res.ClientID = claims.Subject
+	}
+
+	// The response can be cached by the caller, but not after the expiration
+	// of the token
+	cache := maxIntrospectionCache
+	if expires {
+		res.Exp = validUntil.Unix()
+		if remaining := validUntil.Sub(now); remaining < cache {
+			cache = remaining
+		}
+	}
+	c.Response().Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(cache.Seconds())))
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,295 @@
+// Package bank gives the routes to import the transactions of the bank
+// accounts and to aggregate their balances.
+package bank
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/bank"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// importDocType is the type of the JSON-API object that describes the result
+// of an import. It is not persisted.
+const importDocType = "io.cozy.bank.imports"
+
+// balanceDocType is the type of the JSON-API objects for the balances of the
+// accounts. They are not persisted.
+const balanceDocType = "io.cozy.bank.balances"
+
+type apiImport struct {
+	res *bank.ImportResult
+}
+
+func (i *apiImport) ID() string                 { return "" }
+func (i *apiImport) Rev() string                { return "" }
+func (i *apiImport) DocType() string            { return importDocType }
+func (i *apiImport) Clone() couchdb.Doc         { return i }
+func (i *apiImport) SetID(_ string)             {}
+func (i *apiImport) SetRev(_ string)            {}
+func (i *apiImport) Links() *jsonapi.LinksList  { return nil }
+func (i *apiImport) Included() []jsonapi.Object { return nil }
+func (i *apiImport) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"created":    refsTo(i.res.Created),
+		"duplicates": refsTo(i.res.Duplicates),
+	}
+}
+func (i *apiImport) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]int{
+		"created":    len(i.res.Created),
+		"duplicates": len(i.res.Duplicates),
+	})
+}
+
+func refsTo(list []*bank.Transaction) jsonapi.Relationship {
+	refs := make([]couchdb.DocReference, len(list))
+	for i, tx := range list {
+		refs[i] = couchdb.DocReference{ID: tx.ID(), Type: consts.BankOperations}
+	}
+	return jsonapi.Relationship{Data: refs}
+}
+
+type apiBalance struct {
+	b *bank.Balance
+}
+
+func (b *apiBalance) ID() string                             { return b.b.Account + ":" + b.b.Period }
+func (b *apiBalance) Rev() string                            { return "" }
+func (b *apiBalance) DocType() string                        { return balanceDocType }
+func (b *apiBalance) Clone() couchdb.Doc                     { return b }
+func (b *apiBalance) SetID(_ string)                         {}
+func (b *apiBalance) SetRev(_ string)                        {}
+func (b *apiBalance) Links() *jsonapi.LinksList              { return nil }
+func (b *apiBalance) Included() []jsonapi.Object             { return nil }
+func (b *apiBalance) Relationships() jsonapi.RelationshipMap { return nil }
+func (b *apiBalance) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.b)
+}
+
+type apiMatching struct {
+	*bank.Matching
+}
+
+func (m *apiMatching) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/bank/matchings/" + m.DocID}
+}
+func (m *apiMatching) Included() []jsonapi.Object { return nil }
+func (m *apiMatching) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"bill": jsonapi.Relationship{
+			Data: couchdb.DocReference{ID: m.Bill, Type: consts.Bills},
+		},
+		"transaction": jsonapi.Relationship{
+			Data: couchdb.DocReference{ID: m.Transaction, Type: consts.BankOperations},
+		},
+	}
+}
+
+func matchingsList(list []*bank.Matching) []jsonapi.Object {
+	objs := make([]jsonapi.Object, len(list))
+	for i, m := range list {
+		objs[i] = &apiMatching{m}
+	}
+	return objs
+}
+
+type apiImportRequest struct {
+	Balance      *float64                 `json:"balance"`
+	Transactions []map[string]interface{} `json:"transactions"`
+}
+
+// importTransactions creates the transactions of an account sent by a
+// konnector, skips the duplicates, and checks the alerts of the account.
+func importTransactions(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.BankOperations); err != nil {
+		return err
+	}
+	accountID := c.Param("account-id")
+	var req apiImportRequest
+	if _, err := jsonapi.Bind(c.Request().Body, &req); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if req.Balance != nil {
+		if err := middlewares.AllowTypeAndID(c, permissions.PUT, consts.BankAccounts, accountID); err != nil {
+			return err
+		}
+	}
+	account, err := bank.GetAccount(inst, accountID)
+	if err != nil {
+		return err
+	}
+
+	docs := make([]couchdb.JSONDoc, len(req.Transactions))
+	for i, tx := range req.Transactions {
+		docs[i] = couchdb.JSONDoc{Type: consts.BankOperations, M: tx}
+	}
+	res, err := bank.Import(inst, account, docs, req.Balance)
+	if err != nil {
+		if err == bank.ErrInvalidTransaction {
+			return jsonapi.BadRequest(err)
+		}
+		return err
+	}
+	if err := bank.CheckAlerts(inst, account, res.Created); err != nil {
+		inst.Logger().WithField("nspace", "bank").
+			Warnf("Cannot check the alerts of the account %s: %s", account.ID(), err)
+	}
+	if _, err := bank.MatchTransactions(inst, res.Created); err != nil {
+		inst.Logger().WithField("nspace", "bank").
+			Warnf("Cannot match the bills for the account %s: %s", account.ID(), err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiImport{res}, nil)
+}
+
+// getBalances returns the balances of the accounts per period. The account
+// parameter can be used to have the balances of only one account.
+func getBalances(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.BankOperations); err != nil {
+		return err
+	}
+	period := c.QueryParam("period")
+	if period == "" {
+		period = "month"
+	}
+	if !bank.IsValidPeriod(period) {
+		return jsonapi.InvalidParameter("period", bank.ErrInvalidPeriod)
+	}
+
+	var accounts []*bank.Account
+	if accountID := c.QueryParam("account"); accountID != "" {
+		if err := middlewares.AllowTypeAndID(c, permissions.GET, consts.BankAccounts, accountID); err != nil {
+			return err
+		}
+		account, err := bank.GetAccount(inst, accountID)
+		if err != nil {
+			return err
+		}
+		accounts = []*bank.Account{account}
+	} else {
+		if err := middlewares.AllowWholeType(c, permissions.GET, consts.BankAccounts); err != nil {
+			return err
+		}
+		var err error
+		if accounts, err = bank.GetAllAccounts(inst); err != nil {
+			return err
+		}
+	}
+
+	objs := make([]jsonapi.Object, 0)
+	for _, account := range accounts {
+		balances, err := bank.Balances(inst, account, period, c.QueryParam("start"), c.QueryParam("end"))
+		if err != nil {
+			return err
+		}
+		for _, b := range balances {
+			objs = append(objs, &apiBalance{b})
+		}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// getMatchings returns the matchings between the bills and the transactions,
+// by default the ones that are suggested.
+func getMatchings(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.BankMatchings); err != nil {
+		return err
+	}
+	state := c.QueryParam("state")
+	if state == "" {
+		state = bank.MatchingSuggested
+	} else if state == "all" {
+		state = ""
+	}
+	list, err := bank.GetMatchings(inst, state)
+	if err != nil {
+		return err
+	}
+	return jsonapi.DataList(c, http.StatusOK, matchingsList(list), nil)
+}
+
+// matchBills looks for the transactions that can be matched with all the
+// bills, and returns the new suggestions.
+func matchBills(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.BankMatchings); err != nil {
+		return err
+	}
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Bills); err != nil {
+		return err
+	}
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.BankOperations); err != nil {
+		return err
+	}
+	bills, err := bank.GetAllBills(inst)
+	if err != nil {
+		return err
+	}
+	list, err := bank.MatchBills(inst, bills)
+	if err != nil {
+		return err
+	}
+	return jsonapi.DataList(c, http.StatusOK, matchingsList(list), nil)
+}
+
+// confirmMatching confirms a suggested matching, and adds the relationship
+// from the transaction to the bill.
+func confirmMatching(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	m, err := bank.GetMatching(inst, c.Param("matching-id"))
+	if err != nil {
+		return err
+	}
+	if err := middlewares.AllowTypeAndID(c, permissions.PUT, consts.BankMatchings, m.ID()); err != nil {
+		return err
+	}
+	if err := middlewares.AllowTypeAndID(c, permissions.PUT, consts.BankOperations, m.Transaction); err != nil {
+		return err
+	}
+	if err := bank.ConfirmMatching(inst, m); err != nil {
+		if err == bank.ErrMatchingNotSuggested {
+			return jsonapi.Conflict(err)
+		}
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiMatching{m}, nil)
+}
+
+// rejectMatching rejects a suggested matching, so that it is not suggested
+// again.
+func rejectMatching(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	m, err := bank.GetMatching(inst, c.Param("matching-id"))
+	if err != nil {
+		return err
+	}
+	if err := middlewares.AllowTypeAndID(c, permissions.PUT, consts.BankMatchings, m.ID()); err != nil {
+		return err
+	}
+	if err := bank.RejectMatching(inst, m); err != nil {
+		if err == bank.ErrMatchingNotSuggested {
+			return jsonapi.Conflict(err)
+		}
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiMatching{m}, nil)
+}
+
+// Routes sets the routing for the bank service
+func Routes(router *echo.Group) {
+	router.POST("/accounts/:account-id/import", importTransactions)
+	router.GET("/balances", getBalances)
+	router.GET("/matchings", getMatchings)
+	router.POST("/matchings", matchBills)
+	router.POST("/matchings/:matching-id/confirm", confirmMatching)
+	router.POST("/matchings/:matching-id/reject", rejectMatching)
+}
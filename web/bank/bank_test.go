@@ -0,0 +1,209 @@
+package bank
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token string
+var accountID string
+var billID string
+
+const transactions = `{
+  "data": {
+    "attributes": {
+      "balance": 1250.5,
+      "transactions": [
+        {"date": "2018-05-28T00:00:00Z", "amount": 2000, "label": "Salary"},
+        {"date": "2018-06-02T00:00:00Z", "amount": -700, "label": "Rent"},
+        {"date": "2018-06-15T00:00:00Z", "amount": -49.5, "label": "CB Bakery"}
+      ]
+    }
+  }
+}`
+
+func postTransactions(body string) (*http.Response, error) {
+	req, _ := http.NewRequest("POST", ts.URL+"/bank/accounts/"+accountID+"/import", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+func TestImportInvalidTransactions(t *testing.T) {
+	res, err := postTransactions(`{"data": {"attributes": {"transactions": [{"label": "no amount"}]}}}`)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 400, res.StatusCode)
+}
+
+func TestImportTransactions(t *testing.T) {
+	res, err := postTransactions(transactions)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	assert.EqualValues(t, 3, attrs["created"])
+	assert.EqualValues(t, 0, attrs["duplicates"])
+
+	var account couchdb.JSONDoc
+	err = couchdb.GetDoc(testInstance, consts.BankAccounts, accountID, &account)
+	assert.NoError(t, err)
+	assert.Equal(t, 1250.5, account.M["balance"])
+	assert.Equal(t, "EUR", account.M["currency"])
+}
+
+func TestImportDuplicates(t *testing.T) {
+	res, err := postTransactions(transactions)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	assert.EqualValues(t, 0, attrs["created"])
+	assert.EqualValues(t, 3, attrs["duplicates"])
+}
+
+func TestGetBalances(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/bank/balances?period=month&account="+accountID, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].([]interface{})
+	if assert.Len(t, data, 2) {
+		may := data[0].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, "2018-05", may["period"])
+		assert.EqualValues(t, 2000, may["credits"])
+		assert.EqualValues(t, 2000, may["balance"])
+		june := data[1].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, "2018-06", june["period"])
+		assert.EqualValues(t, -749.5, june["debits"])
+		assert.EqualValues(t, 2, june["count"])
+		assert.EqualValues(t, 1250.5, june["balance"])
+	}
+
+	req, _ = http.NewRequest("GET", ts.URL+"/bank/balances?period=week", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res2, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 400, res2.StatusCode)
+}
+
+func postMatchingAction(id, action string) (*http.Response, error) {
+	req, _ := http.NewRequest("POST", ts.URL+"/bank/matchings/"+id+"/"+action, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+func TestMatchings(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/bank/matchings", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].([]interface{})
+	if !assert.Len(t, data, 1) {
+		return
+	}
+	matching := data[0].(map[string]interface{})
+	matchingID := matching["id"].(string)
+	attrs := matching["attributes"].(map[string]interface{})
+	assert.Equal(t, "suggested", attrs["state"])
+	assert.Equal(t, billID, attrs["bill"])
+	txID := attrs["transaction"].(string)
+
+	// Running the matching again must not suggest it twice
+	req, _ = http.NewRequest("POST", ts.URL+"/bank/matchings", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res2, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 200, res2.StatusCode)
+	err = json.NewDecoder(res2.Body).Decode(&result)
+	assert.NoError(t, err)
+	assert.Len(t, result["data"], 0)
+
+	res3, err := postMatchingAction(matchingID, "confirm")
+	assert.NoError(t, err)
+	defer res3.Body.Close()
+	assert.Equal(t, 200, res3.StatusCode)
+
+	var tx couchdb.JSONDoc
+	err = couchdb.GetDoc(testInstance, consts.BankOperations, txID, &tx)
+	assert.NoError(t, err)
+	rels := tx.M["relationships"].(map[string]interface{})
+	bills := rels["bills"].(map[string]interface{})["data"].([]interface{})
+	if assert.Len(t, bills, 1) {
+		assert.Equal(t, billID, bills[0].(map[string]interface{})["id"])
+	}
+
+	res4, err := postMatchingAction(matchingID, "reject")
+	assert.NoError(t, err)
+	defer res4.Body.Close()
+	assert.Equal(t, 409, res4.StatusCode)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "bank_test")
+	testInstance = setup.GetTestInstance()
+	_, token = setup.GetTestClient(consts.BankAccounts + " " + consts.BankOperations +
+		" " + consts.BankMatchings + " " + consts.Bills)
+	ts = setup.GetTestServer("/bank", Routes)
+
+	account := couchdb.JSONDoc{
+		Type: consts.BankAccounts,
+		M: map[string]interface{}{
+			"label":    "Checking account",
+			"balance":  0,
+			"currency": "EUR",
+		},
+	}
+	if err := couchdb.CreateDoc(testInstance, &account); err != nil {
+		setup.CleanupAndDie("Cannot create the bank account", err)
+	}
+	accountID = account.ID()
+	bill := couchdb.JSONDoc{
+		Type: consts.Bills,
+		M: map[string]interface{}{
+			"amount": 49.5,
+			"date":   "2018-06-14T00:00:00Z",
+			"vendor": "Bakery",
+		},
+	}
+	if err := couchdb.CreateDoc(testInstance, &bill); err != nil {
+		setup.CleanupAndDie("Cannot create the bill", err)
+	}
+	billID = bill.ID()
+	os.Exit(setup.Run())
+}
@@ -0,0 +1,357 @@
+// Package bitwarden exposes an API compatible with the Bitwarden clients, so
+// that the official applications and browser extensions can be used with the
+// password vault of the cozy.
+package bitwarden
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/bitwarden"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// scope is the scope of the tokens given to the Bitwarden clients
+const scope = consts.BitwardenCiphers + " " + consts.BitwardenFolders
+
+// redirectURI is the redirect URI of the OAuth clients created for the
+// Bitwarden clients. It is not used, as these clients log in with the
+// password grant type, but it is mandatory.
+const redirectURI = "urn:ietf:wg:oauth:2.0:oob"
+
+// prelogin tells to the client the parameters used to derive the master key
+// from the master password. The email is not checked, so that the route can't
+// be used to know if an email has a vault.
+func prelogin(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	iterations := bitwarden.KdfIterations(inst)
+	if profile, err := bitwarden.GetProfile(inst); err == nil {
+		iterations = profile.KdfIterations
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"Kdf":           bitwarden.KdfPBKDF2,
+		"KdfIterations": iterations,
+	})
+}
+
+// getToken is used by the clients to log in with the hashed master password,
+// or to refresh their access token.
+func getToken(c echo.Context) error {
+	switch c.FormValue("grant_type") {
+	case "password":
+		return getInitialCredentials(c)
+	case "refresh_token":
+		return refreshToken(c)
+	case "":
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "the grant_type parameter is mandatory",
+		})
+	default:
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "invalid grant type",
+		})
+	}
+}
+
+func invalidGrant(c echo.Context, description string) error {
+	return c.JSON(http.StatusBadRequest, echo.Map{
+		"error":             "invalid_grant",
+		"error_description": description,
+	})
+}
+
+// getInitialCredentials checks the hashed master password, and registers an
+// OAuth client for the device of the Bitwarden client.
+func getInitialCredentials(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	clientID := c.FormValue("client_id")
+	if clientID == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "the client_id parameter is mandatory",
+		})
+	}
+	if !strings.EqualFold(strings.TrimSpace(c.FormValue("username")), bitwarden.Email(inst)) {
+		return invalidGrant(c, "invalid username or password")
+	}
+	profile, err := bitwarden.GetProfile(inst)
+	if err == bitwarden.ErrNoProfile {
+		return invalidGrant(c, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if err = profile.CheckPassword(c.FormValue("password")); err != nil {
+		return invalidGrant(c, "invalid username or password")
+	}
+
+	client := &oauth.Client{
+		RedirectURIs: []string{redirectURI},
+		ClientName:   "Bitwarden " + c.FormValue("deviceName"),
+		ClientKind:   clientKind(clientID),
+		SoftwareID:   bitwarden.SoftwareIDPrefix + clientID,
+	}
+	if regErr := client.Create(inst); regErr != nil {
+		return c.JSON(regErr.Code, regErr)
+	}
+	client.CouchID = client.ClientID // XXX CouchID is required by CreateJWT
+	refresh, err := client.CreateJWT(inst, permissions.RefreshTokenAudience, scope)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Can't generate refresh token",
+		})
+	}
+	return sendTokens(c, inst, client, profile, refresh)
+}
+
+// refreshToken gives a new access token to a Bitwarden client
+func refreshToken(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	refresh := c.FormValue("refresh_token")
+	claims := permissions.Claims{}
+	keyFunc := inst.JWTKeyFunc(permissions.RefreshTokenAudience)
+	if err := crypto.ParseJWT(refresh, keyFunc, &claims); err != nil {
+		return invalidGrant(c, "invalid refresh token")
+	}
+	client, err := oauth.FindClient(inst, claims.Subject)
+	if err != nil || !strings.HasPrefix(client.SoftwareID, bitwarden.SoftwareIDPrefix) {
+		return invalidGrant(c, "invalid refresh token")
+	}
+	if _, ok := client.ValidToken(inst, permissions.RefreshTokenAudience, refresh); !ok {
+		return invalidGrant(c, "invalid refresh token")
+	}
+	profile, err := bitwarden.GetProfile(inst)
+	if err != nil {
+		return err
+	}
+	return sendTokens(c, inst, client, profile, refresh)
+}
+
+func sendTokens(c echo.Context, inst *instance.Instance, client *oauth.Client, profile *bitwarden.Profile, refresh string) error {
+	access, err := client.CreateJWT(inst, permissions.AccessTokenAudience, scope)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Can't generate access token",
+		})
+	}
+	var privateKey *string
+	if profile.PrivateKey != "" {
+		privateKey = &profile.PrivateKey
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"access_token":  access,
+		"expires_in":    int(permissions.AccessTokenValidityDuration.Seconds()),
+		"token_type":    "Bearer",
+		"refresh_token": refresh,
+		"Key":           profile.Key,
+		"PrivateKey":    privateKey,
+		"Kdf":           0,
+		"KdfIterations": profile.KdfIterations,
+	})
+}
+
+// clientKind returns the kind of the OAuth client from the client_id sent by
+// the Bitwarden client.
+func clientKind(clientID string) string {
+	switch clientID {
+	case "browser", "desktop", "mobile":
+		return clientID
+	}
+	return ""
+}
+
+type profileResponse struct {
+	ID               string        `json:"Id"`
+	Name             string        `json:"Name"`
+	Email            string        `json:"Email"`
+	EmailVerified    bool          `json:"EmailVerified"`
+	Premium          bool          `json:"Premium"`
+	Culture          string        `json:"Culture"`
+	TwoFactorEnabled bool          `json:"TwoFactorEnabled"`
+	Key              string        `json:"Key"`
+	PrivateKey       *string       `json:"PrivateKey"`
+	SecurityStamp    string        `json:"SecurityStamp"`
+	Organizations    []interface{} `json:"Organizations"`
+	Object           string        `json:"Object"`
+}
+
+func newProfileResponse(inst *instance.Instance, profile *bitwarden.Profile) *profileResponse {
+	name, _ := inst.PublicName()
+	res := &profileResponse{
+		ID:            inst.ID(),
+		Name:          name,
+		Email:         bitwarden.Email(inst),
+		Culture:       inst.Locale,
+		Key:           profile.Key,
+		SecurityStamp: profile.SecurityStamp,
+		Organizations: []interface{}{},
+		Object:        "profile",
+	}
+	if profile.PrivateKey != "" {
+		res.PrivateKey = &profile.PrivateKey
+	}
+	return res
+}
+
+// loadProfile loads the profile of the vault, after checking that the request
+// is made by a Bitwarden client
+func loadProfile(c echo.Context) (*bitwarden.Profile, error) {
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.BitwardenCiphers); err != nil {
+		return nil, err
+	}
+	profile, err := bitwarden.GetProfile(middlewares.GetInstance(c))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return profile, nil
+}
+
+// getProfile returns the profile of the user, with the keys of the vault
+func getProfile(c echo.Context) error {
+	profile, err := loadProfile(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newProfileResponse(middlewares.GetInstance(c), profile))
+}
+
+// setKeys is used by the clients to save the key pair that they have
+// generated after the first login. The private key is encrypted.
+func setKeys(c echo.Context) error {
+	profile, err := loadProfile(c)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		PublicKey           string `json:"publicKey"`
+		EncryptedPrivateKey string `json:"encryptedPrivateKey"`
+	}
+	if err = json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return errInvalidPayload
+	}
+	if req.PublicKey == "" || req.EncryptedPrivateKey == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "The keys are mandatory")
+	}
+	if err = profile.SetKeyPair(middlewares.GetInstance(c), req.PublicKey, req.EncryptedPrivateKey); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"PublicKey":  profile.PublicKey,
+		"PrivateKey": profile.PrivateKey,
+		"Object":     "keys",
+	})
+}
+
+// getRevisionDate returns the date of the last change in the vault, as a
+// number of milliseconds since the epoch. The clients use it to know if they
+// need to synchronize.
+func getRevisionDate(c echo.Context) error {
+	profile, err := loadProfile(c)
+	if err != nil {
+		return err
+	}
+	ms := profile.RevisionDate.UnixNano() / int64(time.Millisecond)
+	return c.JSON(http.StatusOK, ms)
+}
+
+// sync returns the whole vault: the profile, the folders and the ciphers
+func sync(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	profile, err := loadProfile(c)
+	if err != nil {
+		return err
+	}
+	if err = middlewares.AllowWholeType(c, permissions.GET, consts.BitwardenFolders); err != nil {
+		return err
+	}
+	folders, err := bitwarden.GetAllFolders(inst)
+	if err != nil {
+		return err
+	}
+	ciphers, err := bitwarden.GetAllCiphers(inst)
+	if err != nil {
+		return err
+	}
+	foldersRes := make([]*folderResponse, len(folders))
+	for i, f := range folders {
+		foldersRes[i] = newFolderResponse(f)
+	}
+	ciphersRes := make([]*cipherResponse, len(ciphers))
+	for i, cipher := range ciphers {
+		ciphersRes[i] = newCipherResponse(cipher)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"Profile":     newProfileResponse(inst, profile),
+		"Folders":     foldersRes,
+		"Ciphers":     ciphersRes,
+		"Collections": []interface{}{},
+		"Domains": echo.Map{
+			"EquivalentDomains":       []interface{}{},
+			"GlobalEquivalentDomains": []interface{}{},
+			"Object":                  "domains",
+		},
+		"Object": "sync",
+	})
+}
+
+var errInvalidPayload = echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON payload")
+
+// wrapError converts the errors of the vault to HTTP errors, that are sent in
+// a JSON format that the Bitwarden clients understand
+func wrapError(err error) error {
+	switch err {
+	case bitwarden.ErrMissingName, bitwarden.ErrInvalidType, bitwarden.ErrUnknownFolder:
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case bitwarden.ErrNoProfile:
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if couchdb.IsNotFoundError(err) {
+		return echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	return err
+}
+
+// PublicRoutes sets the routing for the public routes, used by the clients
+// (vault and flagship apps) before their authentication
+func PublicRoutes(router *echo.Group) {
+	router.POST("/prelogin", prelogin)
+}
+
+// Routes sets the routing for the Bitwarden-like API
+func Routes(router *echo.Group) {
+	identity := router.Group("/identity")
+	identity.POST("/connect/token", getToken)
+
+	api := router.Group("/api")
+	api.POST("/accounts/prelogin", prelogin)
+	api.GET("/accounts/profile", getProfile)
+	api.POST("/accounts/keys", setKeys)
+	api.GET("/accounts/revision-date", getRevisionDate)
+	api.GET("/sync", sync)
+
+	ciphers := api.Group("/ciphers")
+	ciphers.GET("", listCiphers)
+	ciphers.POST("", createCipher)
+	ciphers.GET("/:id", getCipher)
+	ciphers.PUT("/:id", updateCipher)
+	ciphers.POST("/:id", updateCipher)
+	ciphers.DELETE("/:id", deleteCipher)
+	ciphers.POST("/:id/delete", deleteCipher)
+
+	folders := api.Group("/folders")
+	folders.GET("", listFolders)
+	folders.POST("", createFolder)
+	folders.GET("/:id", getFolder)
+	folders.PUT("/:id", renameFolder)
+	folders.POST("/:id", renameFolder)
+	folders.DELETE("/:id", deleteFolder)
+	folders.POST("/:id/delete", deleteFolder)
+}
@@ -0,0 +1,236 @@
+package bitwarden
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/bitwarden"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+const passphrase = "cozy"
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token, refresh string
+var folderID, cipherID string
+
+func doRequest(method, path, body string) (*http.Response, map[string]interface{}) {
+	req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	var result map[string]interface{}
+	_ = json.NewDecoder(res.Body).Decode(&result)
+	return res, result
+}
+
+func postToken(values url.Values) (*http.Response, map[string]interface{}) {
+	res, err := http.PostForm(ts.URL+"/bitwarden/identity/connect/token", values)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	var result map[string]interface{}
+	_ = json.NewDecoder(res.Body).Decode(&result)
+	return res, result
+}
+
+func TestPrelogin(t *testing.T) {
+	res, result := doRequest("POST", "/bitwarden/api/accounts/prelogin", `{"email": "me@cozy.example"}`)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, float64(0), result["Kdf"])
+	assert.Equal(t, float64(bitwarden.DefaultKdfIterations), result["KdfIterations"])
+}
+
+func TestPublicPrelogin(t *testing.T) {
+	res, result := doRequest("POST", "/public/prelogin", `{"email": "me@cozy.example"}`)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, float64(bitwarden.KdfPBKDF2), result["Kdf"])
+	assert.Equal(t, float64(bitwarden.DefaultKdfIterations), result["KdfIterations"])
+}
+
+func TestConnect(t *testing.T) {
+	email := bitwarden.Email(testInstance)
+	masterKey := bitwarden.MasterKey([]byte(passphrase), email, bitwarden.DefaultKdfIterations)
+	values := url.Values{
+		"grant_type": {"password"},
+		"username":   {email},
+		"password":   {"invalid"},
+		"client_id":  {"browser"},
+		"deviceName": {"firefox"},
+	}
+	res, result := postToken(values)
+	assert.Equal(t, 400, res.StatusCode)
+	assert.Equal(t, "invalid_grant", result["error"])
+
+	values.Set("password", bitwarden.HashPassword(masterKey, []byte(passphrase)))
+	res, result = postToken(values)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "Bearer", result["token_type"])
+	token, _ = result["access_token"].(string)
+	refresh, _ = result["refresh_token"].(string)
+	assert.NotEmpty(t, token)
+	assert.NotEmpty(t, refresh)
+
+	profile, err := bitwarden.GetProfile(testInstance)
+	assert.NoError(t, err)
+	assert.Equal(t, profile.Key, result["Key"])
+	key, err := bitwarden.DecryptWithMasterKey(masterKey, profile.Key)
+	assert.NoError(t, err)
+	assert.Len(t, key, 64)
+}
+
+func TestRefreshToken(t *testing.T) {
+	res, _ := postToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"browser"},
+		"refresh_token": {"invalid"},
+	})
+	assert.Equal(t, 400, res.StatusCode)
+
+	res, result := postToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"browser"},
+		"refresh_token": {refresh},
+	})
+	assert.Equal(t, 200, res.StatusCode)
+	assert.NotEmpty(t, result["access_token"])
+	assert.Equal(t, refresh, result["refresh_token"])
+}
+
+func TestProfile(t *testing.T) {
+	res, result := doRequest("GET", "/bitwarden/api/accounts/profile", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, bitwarden.Email(testInstance), result["Email"])
+	assert.Nil(t, result["PrivateKey"])
+
+	res, result = doRequest("POST", "/bitwarden/api/accounts/keys",
+		`{"publicKey": "MIIBIjAN", "encryptedPrivateKey": "2.iv|ct|mac"}`)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "2.iv|ct|mac", result["PrivateKey"])
+}
+
+func TestCreateFolder(t *testing.T) {
+	res, _ := doRequest("POST", "/bitwarden/api/folders", `{"name": ""}`)
+	assert.Equal(t, 400, res.StatusCode)
+
+	res, result := doRequest("POST", "/bitwarden/api/folders", `{"name": "2.FQAwIBaDbczEGnEJw4g4hw==|7KreXaC0duAj0ulzZJ8ncA==|nu2sEvotjd4zusvGF8YZJPnS9SiJPDqc1VIfCrfve/o="}`)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "folder", result["Object"])
+	folderID, _ = result["Id"].(string)
+	assert.NotEmpty(t, folderID)
+}
+
+func TestCreateCipher(t *testing.T) {
+	res, _ := doRequest("POST", "/bitwarden/api/ciphers", `{"type": 10, "name": "2.d7MttWzJTSSKx1qXjHUxlQ==|01Ath5UqFZHk7csk5DVtkQ==|EMLoLREgCUP5Cu4HqIhcLqhiZHn+NsUDp8dAg1Xu0Io="}`)
+	assert.Equal(t, 400, res.StatusCode)
+
+	body := `{
+		"type": 1,
+		"folderId": "` + folderID + `",
+		"name": "2.d7MttWzJTSSKx1qXjHUxlQ==|01Ath5UqFZHk7csk5DVtkQ==|EMLoLREgCUP5Cu4HqIhcLqhiZHn+NsUDp8dAg1Xu0Io=",
+		"notes": null,
+		"login": {
+			"uris": [{"uri": "2.T57BwAuV8ubIn/sZPbQC+A==|EhUSSpJWSzSYOdJ/AQzfXuUXxwzcs/6C4tOXqhWAqcM=|OWV2VIqLfoWPs9DiouXGUOtTEkVeklbtJQHkQFIXkC8=", "match": null}],
+			"username": "2.JbFkAEZPnuMm70cdP44wtA==|fsN6nbT+udGmOWv8K4otgw==|JbtwmNQa7/48KszT2hAdxpmJ6DRPZst0EDEZx5GzesI=",
+			"password": "2.e83hIsk6IRevSr/H1lvZhg==|48KNkSCoTacopXRmIZsbWg==|CIcWgNbaIN2ix2Fx1Gar6rWQeVeboehp4bioAwngr0o="
+		}
+	}`
+	res, result := doRequest("POST", "/bitwarden/api/ciphers", body)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "cipher", result["Object"])
+	assert.Equal(t, float64(1), result["Type"])
+	assert.Equal(t, folderID, result["FolderId"])
+	assert.Nil(t, result["Notes"])
+	login, _ := result["Login"].(map[string]interface{})
+	assert.Equal(t, "2.JbFkAEZPnuMm70cdP44wtA==|fsN6nbT+udGmOWv8K4otgw==|JbtwmNQa7/48KszT2hAdxpmJ6DRPZst0EDEZx5GzesI=", login["username"])
+	cipherID, _ = result["Id"].(string)
+
+	res, result = doRequest("GET", "/bitwarden/api/ciphers/"+cipherID, "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, cipherID, result["Id"])
+}
+
+func TestSync(t *testing.T) {
+	res, result := doRequest("GET", "/bitwarden/api/sync", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "sync", result["Object"])
+	profile, _ := result["Profile"].(map[string]interface{})
+	assert.Equal(t, bitwarden.Email(testInstance), profile["Email"])
+	assert.Len(t, result["Folders"], 1)
+	assert.Len(t, result["Ciphers"], 1)
+}
+
+func TestDeleteFolder(t *testing.T) {
+	res, _ := doRequest("DELETE", "/bitwarden/api/folders/"+folderID, "")
+	assert.Equal(t, 200, res.StatusCode)
+
+	res, _ = doRequest("GET", "/bitwarden/api/folders/"+folderID, "")
+	assert.Equal(t, 404, res.StatusCode)
+
+	res, result := doRequest("GET", "/bitwarden/api/ciphers/"+cipherID, "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Nil(t, result["FolderId"])
+}
+
+func TestDeleteCipher(t *testing.T) {
+	res, _ := doRequest("POST", "/bitwarden/api/ciphers/"+cipherID+"/delete", "")
+	assert.Equal(t, 200, res.StatusCode)
+
+	res, result := doRequest("GET", "/bitwarden/api/ciphers", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Len(t, result["Data"], 0)
+}
+
+func TestChangeMasterPassword(t *testing.T) {
+	before, err := bitwarden.GetProfile(testInstance)
+	assert.NoError(t, err)
+	email := bitwarden.Email(testInstance)
+	oldKey := bitwarden.MasterKey([]byte(passphrase), email, before.KdfIterations)
+	symKey, err := bitwarden.DecryptWithMasterKey(oldKey, before.Key)
+	assert.NoError(t, err)
+
+	err = bitwarden.ChangeMasterPassword(testInstance, []byte("new passphrase"), []byte(passphrase))
+	assert.NoError(t, err)
+	after, err := bitwarden.GetProfile(testInstance)
+	assert.NoError(t, err)
+	newKey := bitwarden.MasterKey([]byte("new passphrase"), email, after.KdfIterations)
+	decrypted, err := bitwarden.DecryptWithMasterKey(newKey, after.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, symKey, decrypted)
+	assert.NoError(t, after.CheckPassword(bitwarden.HashPassword(newKey, []byte("new passphrase"))))
+
+	// The Bitwarden clients have been revoked
+	res, _ := doRequest("GET", "/bitwarden/api/accounts/profile", "")
+	assert.Equal(t, 400, res.StatusCode)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "bitwarden_test")
+	testInstance = setup.GetTestInstance()
+	if err := bitwarden.InitProfile(testInstance, []byte(passphrase)); err != nil {
+		panic(err)
+	}
+	ts = setup.GetTestServerMultipleRoutes(map[string]func(*echo.Group){
+		"/bitwarden": Routes,
+		"/public":    PublicRoutes,
+	})
+	os.Exit(setup.Run())
+}
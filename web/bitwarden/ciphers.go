@@ -0,0 +1,200 @@
+package bitwarden
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/bitwarden"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// cipherRequest is the format of a cipher sent by the Bitwarden clients
+type cipherRequest struct {
+	Type            bitwarden.CipherType `json:"type"`
+	FolderID        string               `json:"folderId"`
+	Favorite        bool                 `json:"favorite"`
+	Name            string               `json:"name"`
+	Notes           string               `json:"notes"`
+	Login           json.RawMessage      `json:"login"`
+	SecureNote      json.RawMessage      `json:"secureNote"`
+	Card            json.RawMessage      `json:"card"`
+	Identity        json.RawMessage      `json:"identity"`
+	Fields          json.RawMessage      `json:"fields"`
+	PasswordHistory json.RawMessage      `json:"passwordHistory"`
+}
+
+func (r *cipherRequest) toCipher() *bitwarden.Cipher {
+	c := &bitwarden.Cipher{
+		Type:            r.Type,
+		FolderID:        r.FolderID,
+		Favorite:        r.Favorite,
+		Name:            r.Name,
+		Notes:           r.Notes,
+		Fields:          nonNull(r.Fields),
+		PasswordHistory: nonNull(r.PasswordHistory),
+	}
+	switch r.Type {
+	case bitwarden.LoginType:
+		c.Data = nonNull(r.Login)
+	case bitwarden.SecureNoteType:
+		c.Data = nonNull(r.SecureNote)
+	case bitwarden.CardType:
+		c.Data = nonNull(r.Card)
+	case bitwarden.IdentityType:
+		c.Data = nonNull(r.Identity)
+	}
+	return c
+}
+
+func nonNull(raw json.RawMessage) json.RawMessage {
+	if string(raw) == "null" {
+		return nil
+	}
+	return raw
+}
+
+// cipherResponse is the format of a cipher expected by the Bitwarden clients
+type cipherResponse struct {
+	ID                  string               `json:"Id"`
+	Type                bitwarden.CipherType `json:"Type"`
+	FolderID            *string              `json:"FolderId"`
+	OrganizationID      *string              `json:"OrganizationId"`
+	Favorite            bool                 `json:"Favorite"`
+	Edit                bool                 `json:"Edit"`
+	Name                string               `json:"Name"`
+	Notes               *string              `json:"Notes"`
+	Login               json.RawMessage      `json:"Login,omitempty"`
+	SecureNote          json.RawMessage      `json:"SecureNote,omitempty"`
+	Card                json.RawMessage      `json:"Card,omitempty"`
+	Identity            json.RawMessage      `json:"Identity,omitempty"`
+	Fields              json.RawMessage      `json:"Fields"`
+	PasswordHistory     json.RawMessage      `json:"PasswordHistory"`
+	Attachments         []interface{}        `json:"Attachments"`
+	OrganizationUseTotp bool                 `json:"OrganizationUseTotp"`
+	RevisionDate        time.Time            `json:"RevisionDate"`
+	CollectionIDs       []string             `json:"CollectionIds"`
+	Object              string               `json:"Object"`
+}
+
+func newCipherResponse(c *bitwarden.Cipher) *cipherResponse {
+	res := &cipherResponse{
+		ID:              c.DocID,
+		Type:            c.Type,
+		Favorite:        c.Favorite,
+		Edit:            true,
+		Name:            c.Name,
+		Fields:          c.Fields,
+		PasswordHistory: c.PasswordHistory,
+		RevisionDate:    c.UpdatedAt,
+		CollectionIDs:   []string{},
+		Object:          "cipher",
+	}
+	if c.FolderID != "" {
+		res.FolderID = &c.FolderID
+	}
+	if c.Notes != "" {
+		res.Notes = &c.Notes
+	}
+	switch c.Type {
+	case bitwarden.LoginType:
+		res.Login = c.Data
+	case bitwarden.SecureNoteType:
+		res.SecureNote = c.Data
+	case bitwarden.CardType:
+		res.Card = c.Data
+	case bitwarden.IdentityType:
+		res.Identity = c.Data
+	}
+	return res
+}
+
+// findCipher loads the cipher of the request, after checking the permissions
+// of the requester for the given verb.
+func findCipher(c echo.Context, v permissions.Verb) (*bitwarden.Cipher, error) {
+	if err := middlewares.AllowWholeType(c, v, consts.BitwardenCiphers); err != nil {
+		return nil, err
+	}
+	cipher, err := bitwarden.FindCipher(middlewares.GetInstance(c), c.Param("id"))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return cipher, nil
+}
+
+func bindCipher(c echo.Context) (*bitwarden.Cipher, error) {
+	var req cipherRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return nil, errInvalidPayload
+	}
+	return req.toCipher(), nil
+}
+
+func listCiphers(c echo.Context) error {
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.BitwardenCiphers); err != nil {
+		return err
+	}
+	ciphers, err := bitwarden.GetAllCiphers(middlewares.GetInstance(c))
+	if err != nil {
+		return err
+	}
+	list := make([]*cipherResponse, len(ciphers))
+	for i, cipher := range ciphers {
+		list[i] = newCipherResponse(cipher)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"Data":   list,
+		"Object": "list",
+	})
+}
+
+func createCipher(c echo.Context) error {
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.BitwardenCiphers); err != nil {
+		return err
+	}
+	cipher, err := bindCipher(c)
+	if err != nil {
+		return err
+	}
+	if err = bitwarden.CreateCipher(middlewares.GetInstance(c), cipher); err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, newCipherResponse(cipher))
+}
+
+func getCipher(c echo.Context) error {
+	cipher, err := findCipher(c, permissions.GET)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newCipherResponse(cipher))
+}
+
+func updateCipher(c echo.Context) error {
+	old, err := findCipher(c, permissions.PUT)
+	if err != nil {
+		return err
+	}
+	cipher, err := bindCipher(c)
+	if err != nil {
+		return err
+	}
+	if err = bitwarden.UpdateCipher(middlewares.GetInstance(c), cipher, old); err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, newCipherResponse(cipher))
+}
+
+func deleteCipher(c echo.Context) error {
+	cipher, err := findCipher(c, permissions.DELETE)
+	if err != nil {
+		return err
+	}
+	if err = bitwarden.DeleteCipher(middlewares.GetInstance(c), cipher); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
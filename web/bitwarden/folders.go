@@ -0,0 +1,125 @@
+package bitwarden
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/bitwarden"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// folderResponse is the format of a folder expected by the Bitwarden clients
+type folderResponse struct {
+	ID           string    `json:"Id"`
+	Name         string    `json:"Name"`
+	RevisionDate time.Time `json:"RevisionDate"`
+	Object       string    `json:"Object"`
+}
+
+func newFolderResponse(f *bitwarden.Folder) *folderResponse {
+	return &folderResponse{
+		ID:           f.DocID,
+		Name:         f.Name,
+		RevisionDate: f.UpdatedAt,
+		Object:       "folder",
+	}
+}
+
+// findFolder loads the folder of the request, after checking the permissions
+// of the requester for the given verb.
+func findFolder(c echo.Context, v permissions.Verb) (*bitwarden.Folder, error) {
+	if err := middlewares.AllowWholeType(c, v, consts.BitwardenFolders); err != nil {
+		return nil, err
+	}
+	folder, err := bitwarden.FindFolder(middlewares.GetInstance(c), c.Param("id"))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return folder, nil
+}
+
+func bindFolderName(c echo.Context) (string, error) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return "", errInvalidPayload
+	}
+	return req.Name, nil
+}
+
+func listFolders(c echo.Context) error {
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.BitwardenFolders); err != nil {
+		return err
+	}
+	folders, err := bitwarden.GetAllFolders(middlewares.GetInstance(c))
+	if err != nil {
+		return err
+	}
+	list := make([]*folderResponse, len(folders))
+	for i, f := range folders {
+		list[i] = newFolderResponse(f)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"Data":   list,
+		"Object": "list",
+	})
+}
+
+func createFolder(c echo.Context) error {
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.BitwardenFolders); err != nil {
+		return err
+	}
+	name, err := bindFolderName(c)
+	if err != nil {
+		return err
+	}
+	folder, err := bitwarden.CreateFolder(middlewares.GetInstance(c), name)
+	if err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, newFolderResponse(folder))
+}
+
+func getFolder(c echo.Context) error {
+	folder, err := findFolder(c, permissions.GET)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newFolderResponse(folder))
+}
+
+func renameFolder(c echo.Context) error {
+	folder, err := findFolder(c, permissions.PUT)
+	if err != nil {
+		return err
+	}
+	name, err := bindFolderName(c)
+	if err != nil {
+		return err
+	}
+	if err = folder.Rename(middlewares.GetInstance(c), name); err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, newFolderResponse(folder))
+}
+
+// deleteFolder removes a folder, but not the ciphers inside it. They are
+// moved out of the folder.
+func deleteFolder(c echo.Context) error {
+	folder, err := findFolder(c, permissions.DELETE)
+	if err != nil {
+		return err
+	}
+	if err = middlewares.AllowWholeType(c, permissions.PUT, consts.BitwardenCiphers); err != nil {
+		return err
+	}
+	if err = bitwarden.DeleteFolder(middlewares.GetInstance(c), folder); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,132 @@
+// Package calendar gives the routes to import and export the events of the
+// calendar as iCalendar files.
+package calendar
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/calendar"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// maxExports is the maximal number of events that can be exported in a
+// single request.
+const maxExports = 10000
+
+// importDocType is the type of the JSON-API object that describes the result
+// of an import. It is not persisted.
+const importDocType = "io.cozy.calendar.imports"
+
+type apiImport struct {
+	res *calendar.ImportResult
+}
+
+func (i *apiImport) ID() string                 { return "" }
+func (i *apiImport) Rev() string                { return "" }
+func (i *apiImport) DocType() string            { return importDocType }
+func (i *apiImport) Clone() couchdb.Doc         { return i }
+func (i *apiImport) SetID(_ string)             {}
+func (i *apiImport) SetRev(_ string)            {}
+func (i *apiImport) Links() *jsonapi.LinksList  { return nil }
+func (i *apiImport) Included() []jsonapi.Object { return nil }
+func (i *apiImport) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"created":    refsTo(i.res.Created),
+		"duplicates": refsTo(i.res.Duplicates),
+	}
+}
+func (i *apiImport) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]int{
+		"created":    len(i.res.Created),
+		"duplicates": len(i.res.Duplicates),
+	})
+}
+
+func refsTo(list []*calendar.Event) jsonapi.Relationship {
+	refs := make([]couchdb.DocReference, len(list))
+	for i, e := range list {
+		refs[i] = couchdb.DocReference{ID: e.ID(), Type: consts.Events}
+	}
+	return jsonapi.Relationship{Data: refs}
+}
+
+// importICalendar creates an event for each VEVENT of the iCalendar file in
+// the request body. The events already in the calendar are skipped.
+func importICalendar(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.Events); err != nil {
+		return err
+	}
+	res, err := calendar.Import(inst, c.Request().Body)
+	if err != nil {
+		if err == calendar.ErrInvalidICalendar || err == calendar.ErrMissingStart {
+			return jsonapi.BadRequest(err)
+		}
+		return err
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiImport{res}, nil)
+}
+
+// exportICalendar sends the events as an iCalendar file. The events can be
+// selected with the ids parameter, else all the events are exported.
+func exportICalendar(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	var list []*calendar.Event
+	if param := c.QueryParam("ids"); param != "" {
+		ids := strings.Split(param, ",")
+		for _, id := range ids {
+			if !pdoc.Permissions.AllowID(permissions.GET, consts.Events, id) {
+				return middlewares.ErrForbidden
+			}
+		}
+		req := &couchdb.AllDocsRequest{Keys: ids}
+		if err = couchdb.GetAllDocs(inst, consts.Events, req, &list); err != nil {
+			return err
+		}
+	} else {
+		if !pdoc.Permissions.AllowWholeType(permissions.GET, consts.Events) {
+			return middlewares.ErrForbidden
+		}
+		req := &couchdb.AllDocsRequest{Limit: maxExports}
+		err = couchdb.GetAllDocs(inst, consts.Events, req, &list)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+	}
+
+	// The deleted or missing docs are null in the response of _all_docs
+	var found []*calendar.Event
+	for _, event := range list {
+		if event != nil {
+			found = append(found, event)
+		}
+	}
+	if len(found) == 0 {
+		return jsonapi.NotFound(calendar.ErrNotFound)
+	}
+
+	header := c.Response().Header()
+	header.Set("Content-Type", "text/calendar; charset=utf-8")
+	header.Set("Content-Disposition", vfs.ContentDisposition("attachment", "calendar.ics"))
+	c.Response().WriteHeader(http.StatusOK)
+	return calendar.WriteICalendar(c.Response(), found)
+}
+
+// Routes sets the routing for the calendar service
+func Routes(router *echo.Group) {
+	router.POST("/import", importICalendar)
+	router.GET("/export", exportICalendar)
+}
@@ -0,0 +1,120 @@
+package calendar
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token string
+var meetingID string
+
+const ics = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Example//Example//EN\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:meeting@example.com\r\n" +
+	"DTSTART:20181204T090000Z\r\n" +
+	"DTEND:20181204T103000Z\r\n" +
+	"SUMMARY:Meeting\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:holidays@example.com\r\n" +
+	"DTSTART;VALUE=DATE:20181224\r\n" +
+	"SUMMARY:Holidays\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func postICalendar(body string) (*http.Response, error) {
+	req, _ := http.NewRequest("POST", ts.URL+"/calendar/import", strings.NewReader(body))
+	req.Header.Add("Content-Type", "text/calendar")
+	req.Header.Add("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+func TestImportInvalidICalendar(t *testing.T) {
+	res, err := postICalendar("not an iCalendar")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 400, res.StatusCode)
+}
+
+func TestImportICalendar(t *testing.T) {
+	res, err := postICalendar(ics)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	assert.EqualValues(t, 2, attrs["created"])
+	assert.EqualValues(t, 0, attrs["duplicates"])
+	rels := data["relationships"].(map[string]interface{})
+	created := rels["created"].(map[string]interface{})["data"].([]interface{})
+	if assert.Len(t, created, 2) {
+		meetingID = created[0].(map[string]interface{})["id"].(string)
+	}
+}
+
+func TestImportDuplicates(t *testing.T) {
+	res, err := postICalendar(ics)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	assert.EqualValues(t, 0, attrs["created"])
+	assert.EqualValues(t, 2, attrs["duplicates"])
+}
+
+func TestExportICalendar(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/calendar/export?ids="+meetingID, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/calendar; charset=utf-8", res.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "UID:meeting@example.com\r\n")
+	assert.Contains(t, string(body), "DTSTART:20181204T090000Z\r\n")
+	assert.NotContains(t, string(body), "Holidays")
+
+	req, _ = http.NewRequest("GET", ts.URL+"/calendar/export", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res2, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 200, res2.StatusCode)
+	body, err = ioutil.ReadAll(res2.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(body), "BEGIN:VEVENT"))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "calendar_test")
+	testInstance = setup.GetTestInstance()
+	_, token = setup.GetTestClient(consts.Events)
+	ts = setup.GetTestServer("/calendar", Routes)
+	os.Exit(setup.Run())
+}
@@ -0,0 +1,205 @@
+// Package comments gives the routes to read and write the comments on the
+// documents, like the files and the notes.
+package comments
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/comments"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/files"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+type apiComment struct {
+	*comments.Comment
+}
+
+func (c *apiComment) MarshalJSON() ([]byte, error) { return json.Marshal(c.Comment) }
+func (c *apiComment) Included() []jsonapi.Object   { return nil }
+func (c *apiComment) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/comments/" + c.Target.Type + "/" + c.Target.ID + "/" + c.DocID}
+}
+func (c *apiComment) Relationships() jsonapi.RelationshipMap {
+	rels := jsonapi.RelationshipMap{
+		"target": jsonapi.Relationship{Data: c.Target},
+	}
+	if c.ParentID != "" {
+		rels["parent"] = jsonapi.Relationship{
+			Data: couchdb.DocReference{ID: c.ParentID, Type: consts.Comments},
+		}
+	}
+	return rels
+}
+
+func wrapError(err error) error {
+	switch err {
+	case comments.ErrEmptyText, comments.ErrTextTooLong:
+		return jsonapi.InvalidAttribute("text", err)
+	case comments.ErrTooManyMentions, comments.ErrUnknownContact:
+		return jsonapi.InvalidAttribute("mentions", err)
+	case comments.ErrParentNotFound:
+		return jsonapi.InvalidAttribute("parent_id", err)
+	}
+	if couchdb.IsNotFoundError(err) {
+		return jsonapi.NotFound(err)
+	}
+	return err
+}
+
+// findTarget checks that the commented document exists and can be read by
+// the requester, and returns its name for the notifications.
+func findTarget(c echo.Context) (couchdb.DocReference, string, error) {
+	inst := middlewares.GetInstance(c)
+	target := couchdb.DocReference{Type: c.Param("doctype"), ID: c.Param("id")}
+	if target.Type == consts.Comments {
+		return target, "", jsonapi.BadRequest(errors.New("A comment cannot be commented"))
+	}
+
+	if target.Type == consts.Files {
+		dir, file, err := inst.VFS().DirOrFileByID(target.ID)
+		if err != nil {
+			return target, "", files.WrapVfsError(err)
+		}
+		if dir != nil {
+			err = middlewares.AllowVFS(c, permissions.GET, dir)
+			return target, dir.DocName, err
+		}
+		err = middlewares.AllowVFS(c, permissions.GET, file)
+		return target, file.DocName, err
+	}
+
+	doc := couchdb.JSONDoc{}
+	if err := couchdb.GetDoc(inst, target.Type, target.ID, &doc); err != nil {
+		return target, "", wrapError(err)
+	}
+	doc.Type = target.Type
+	if err := middlewares.Allow(c, permissions.GET, &doc); err != nil {
+		return target, "", err
+	}
+	name, _ := doc.M["name"].(string)
+	if name == "" {
+		name, _ = doc.M["title"].(string)
+	}
+	return target, name, nil
+}
+
+// findComment loads the comment of the request, and checks that it is on the
+// target document.
+func findComment(c echo.Context, target couchdb.DocReference) (*comments.Comment, error) {
+	comment, err := comments.Find(middlewares.GetInstance(c), c.Param("comment-id"))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if comment.Target != target {
+		return nil, jsonapi.NotFound(comments.ErrParentNotFound)
+	}
+	return comment, nil
+}
+
+type commentAttrs struct {
+	ParentID string   `json:"parent_id"`
+	Text     string   `json:"text"`
+	Mentions []string `json:"mentions"`
+	Author   struct {
+		Name string `json:"name"`
+	} `json:"author"`
+}
+
+func listComments(c echo.Context) error {
+	target, _, err := findTarget(c)
+	if err != nil {
+		return err
+	}
+	if err = middlewares.AllowWholeType(c, permissions.GET, consts.Comments); err != nil {
+		return err
+	}
+	list, err := comments.List(middlewares.GetInstance(c), target)
+	if err != nil {
+		return wrapError(err)
+	}
+	objs := make([]jsonapi.Object, len(list))
+	for i, comment := range list {
+		objs[i] = &apiComment{comment}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func createComment(c echo.Context) error {
+	target, name, err := findTarget(c)
+	if err != nil {
+		return err
+	}
+	if err = middlewares.AllowWholeType(c, permissions.POST, consts.Comments); err != nil {
+		return err
+	}
+	var attrs commentAttrs
+	if _, err = jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	comment := &comments.Comment{
+		Target:   target,
+		ParentID: attrs.ParentID,
+		Author:   comments.Author{Name: attrs.Author.Name},
+		Text:     attrs.Text,
+		Mentions: attrs.Mentions,
+	}
+	if err = comments.Create(middlewares.GetInstance(c), comment, name); err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiComment{comment}, nil)
+}
+
+func updateComment(c echo.Context) error {
+	target, name, err := findTarget(c)
+	if err != nil {
+		return err
+	}
+	if err = middlewares.AllowWholeType(c, permissions.PATCH, consts.Comments); err != nil {
+		return err
+	}
+	comment, err := findComment(c, target)
+	if err != nil {
+		return err
+	}
+	var attrs commentAttrs
+	if _, err = jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if err = comment.Update(middlewares.GetInstance(c), attrs.Text, attrs.Mentions, name); err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiComment{comment}, nil)
+}
+
+func deleteComment(c echo.Context) error {
+	target, _, err := findTarget(c)
+	if err != nil {
+		return err
+	}
+	if err = middlewares.AllowWholeType(c, permissions.DELETE, consts.Comments); err != nil {
+		return err
+	}
+	comment, err := findComment(c, target)
+	if err != nil {
+		return err
+	}
+	if err = comment.Delete(middlewares.GetInstance(c)); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Routes sets the routing for the comments
+func Routes(router *echo.Group) {
+	router.GET("/:doctype/:id", listComments)
+	router.POST("/:doctype/:id", createComment)
+	router.PATCH("/:doctype/:id/:comment-id", updateComment)
+	router.DELETE("/:doctype/:id/:comment-id", deleteComment)
+}
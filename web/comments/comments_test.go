@@ -0,0 +1,110 @@
+package comments
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token string
+
+func doRequest(method, path, body string) (*http.Response, map[string]interface{}) {
+	req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	var result map[string]interface{}
+	_ = json.NewDecoder(res.Body).Decode(&result)
+	return res, result
+}
+
+func createFile(t *testing.T, name string) *vfs.FileDoc {
+	doc, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	f, err := testInstance.VFS().CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, f.Close())
+	return doc
+}
+
+func commentBody(attrs string) string {
+	return `{"data": {"type": "io.cozy.comments", "attributes": ` + attrs + `}}`
+}
+
+func TestThread(t *testing.T) {
+	file := createFile(t, "report.txt")
+	path := "/comments/io.cozy.files/" + file.ID()
+
+	res, _ := doRequest("POST", path, commentBody(`{"text": "  "}`))
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = doRequest("POST", path, commentBody(`{"text": "Hi", "mentions": ["unknown"]}`))
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = doRequest("POST", "/comments/io.cozy.files/no-such-file", commentBody(`{"text": "Hi"}`))
+	assert.Equal(t, 404, res.StatusCode)
+
+	res, result := doRequest("POST", path, commentBody(`{"text": "Is it ready?"}`))
+	assert.Equal(t, 201, res.StatusCode)
+	data := result["data"].(map[string]interface{})
+	rootID := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "Is it ready?", attrs["text"])
+	target := attrs["target"].(map[string]interface{})
+	assert.Equal(t, file.ID(), target["id"])
+
+	res, result = doRequest("POST", path, commentBody(`{"text": "Yes", "parent_id": "`+rootID+`"}`))
+	assert.Equal(t, 201, res.StatusCode)
+	replyID := result["data"].(map[string]interface{})["id"].(string)
+
+	// A reply to a reply is in the same thread
+	res, result = doRequest("POST", path, commentBody(`{"text": "Thanks", "parent_id": "`+replyID+`"}`))
+	assert.Equal(t, 201, res.StatusCode)
+	attrs = result["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, rootID, attrs["parent_id"])
+
+	res, result = doRequest("PATCH", path+"/"+replyID, commentBody(`{"text": "Yes, it is"}`))
+	assert.Equal(t, 200, res.StatusCode)
+	attrs = result["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, "Yes, it is", attrs["text"])
+
+	res, result = doRequest("GET", path, "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Len(t, result["data"], 3)
+
+	res, _ = doRequest("DELETE", path+"/"+rootID, "")
+	assert.Equal(t, 204, res.StatusCode)
+	res, result = doRequest("GET", path, "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Len(t, result["data"], 0)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "comments_test")
+	testInstance = setup.GetTestInstance()
+	scope := consts.Comments + " " + consts.Files
+	_, token = setup.GetTestClient(scope)
+	ts = setup.GetTestServer("/comments", Routes)
+	os.Exit(setup.Run())
+}
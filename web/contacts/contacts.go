@@ -0,0 +1,132 @@
+// Package contacts gives the routes to import and export the contacts as
+// vCards.
+package contacts
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/contacts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// maxExports is the maximal number of contacts that can be exported in a
+// single request.
+const maxExports = 10000
+
+// importDocType is the type of the JSON-API object that describes the result
+// of an import. It is not persisted.
+const importDocType = "io.cozy.contacts.imports"
+
+type apiImport struct {
+	res *contacts.ImportResult
+}
+
+func (i *apiImport) ID() string                 { return "" }
+func (i *apiImport) Rev() string                { return "" }
+func (i *apiImport) DocType() string            { return importDocType }
+func (i *apiImport) Clone() couchdb.Doc         { return i }
+func (i *apiImport) SetID(_ string)             {}
+func (i *apiImport) SetRev(_ string)            {}
+func (i *apiImport) Links() *jsonapi.LinksList  { return nil }
+func (i *apiImport) Included() []jsonapi.Object { return nil }
+func (i *apiImport) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"created":    refsTo(i.res.Created),
+		"duplicates": refsTo(i.res.Duplicates),
+	}
+}
+func (i *apiImport) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]int{
+		"created":    len(i.res.Created),
+		"duplicates": len(i.res.Duplicates),
+	})
+}
+
+func refsTo(list []*contacts.Contact) jsonapi.Relationship {
+	refs := make([]couchdb.DocReference, len(list))
+	for i, c := range list {
+		refs[i] = couchdb.DocReference{ID: c.ID(), Type: consts.Contacts}
+	}
+	return jsonapi.Relationship{Data: refs}
+}
+
+// importVCards creates a contact for each vCard of the request body. The
+// vCards that are duplicates of existing contacts are skipped.
+func importVCards(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.Contacts); err != nil {
+		return err
+	}
+	res, err := contacts.Import(inst, c.Request().Body)
+	if err != nil {
+		if err == contacts.ErrInvalidVCard {
+			return jsonapi.BadRequest(err)
+		}
+		return err
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiImport{res}, nil)
+}
+
+// exportVCards sends the contacts as a vCard file. The contacts can be
+// selected with the ids parameter, else all the contacts are exported.
+func exportVCards(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	var list []*contacts.Contact
+	if param := c.QueryParam("ids"); param != "" {
+		ids := strings.Split(param, ",")
+		for _, id := range ids {
+			if !pdoc.Permissions.AllowID(permissions.GET, consts.Contacts, id) {
+				return middlewares.ErrForbidden
+			}
+		}
+		req := &couchdb.AllDocsRequest{Keys: ids}
+		if err = couchdb.GetAllDocs(inst, consts.Contacts, req, &list); err != nil {
+			return err
+		}
+	} else {
+		if !pdoc.Permissions.AllowWholeType(permissions.GET, consts.Contacts) {
+			return middlewares.ErrForbidden
+		}
+		req := &couchdb.AllDocsRequest{Limit: maxExports}
+		err = couchdb.GetAllDocs(inst, consts.Contacts, req, &list)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+	}
+
+	// The deleted or missing docs are null in the response of _all_docs
+	var found []*contacts.Contact
+	for _, contact := range list {
+		if contact != nil {
+			found = append(found, contact)
+		}
+	}
+	if len(found) == 0 {
+		return jsonapi.NotFound(contacts.ErrNotFound)
+	}
+
+	header := c.Response().Header()
+	header.Set("Content-Type", "text/vcard; charset=utf-8")
+	header.Set("Content-Disposition", vfs.ContentDisposition("attachment", "contacts.vcf"))
+	c.Response().WriteHeader(http.StatusOK)
+	return contacts.WriteVCards(c.Response(), found)
+}
+
+// Routes sets the routing for the contacts service
+func Routes(router *echo.Group) {
+	router.POST("/import", importVCards)
+	router.GET("/export", exportVCards)
+}
@@ -0,0 +1,118 @@
+package contacts
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token string
+var johnID string
+
+const vcards = `BEGIN:VCARD
+VERSION:3.0
+N:Doe;John;;;
+FN:John Doe
+EMAIL;TYPE=INTERNET:john@example.net
+END:VCARD
+BEGIN:VCARD
+VERSION:4.0
+FN:Jane Roe
+TEL:+33 6 12 34 56 78
+END:VCARD
+`
+
+func postVCards(body string) (*http.Response, error) {
+	req, _ := http.NewRequest("POST", ts.URL+"/contacts/import", strings.NewReader(body))
+	req.Header.Add("Content-Type", "text/vcard")
+	req.Header.Add("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+func TestImportInvalidVCard(t *testing.T) {
+	res, err := postVCards("not a vcard")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 400, res.StatusCode)
+}
+
+func TestImportVCards(t *testing.T) {
+	res, err := postVCards(vcards)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	assert.EqualValues(t, 2, attrs["created"])
+	assert.EqualValues(t, 0, attrs["duplicates"])
+	rels := data["relationships"].(map[string]interface{})
+	created := rels["created"].(map[string]interface{})["data"].([]interface{})
+	if assert.Len(t, created, 2) {
+		johnID = created[0].(map[string]interface{})["id"].(string)
+	}
+}
+
+func TestImportDuplicates(t *testing.T) {
+	body := strings.Replace(vcards, "John Doe", "Johnny", 1)
+	res, err := postVCards(body)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	assert.EqualValues(t, 0, attrs["created"])
+	assert.EqualValues(t, 2, attrs["duplicates"])
+}
+
+func TestExportVCards(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/contacts/export?ids="+johnID, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/vcard; charset=utf-8", res.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "FN:John Doe")
+	assert.Contains(t, string(body), "EMAIL:john@example.net")
+	assert.NotContains(t, string(body), "Jane Roe")
+
+	req, _ = http.NewRequest("GET", ts.URL+"/contacts/export", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res2, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 200, res2.StatusCode)
+	body, err = ioutil.ReadAll(res2.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(body), "BEGIN:VCARD"))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "contacts_test")
+	testInstance = setup.GetTestInstance()
+	_, token = setup.GetTestClient(consts.Contacts)
+	ts = setup.GetTestServer("/contacts", Routes)
+	os.Exit(setup.Run())
+}
@@ -3,13 +3,10 @@ package data
 import (
 	"encoding/json"
 	"net/http"
-	"strings"
 
 	"github.com/cozy/cozy-stack/pkg/accounts"
-	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
-	perms "github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/cozy-stack/web/permissions"
@@ -45,20 +42,18 @@ func getAccount(c echo.Context) error {
 		return err
 	}
 
-	if encryptAccount(out) {
-		if err = couchdb.UpdateDoc(instance, out); err != nil {
-			return err
-		}
-	}
-
-	perm, err := middlewares.GetPermission(c)
+	encrypted, err := accounts.EncryptAccount(instance, out)
 	if err != nil {
 		return err
 	}
-	if perm.Type == perms.TypeKonnector {
-		decryptAccount(out)
+	if encrypted {
+		if err = couchdb.UpdateDoc(instance, out); err != nil {
+			return err
+		}
 	}
 
+	// The credentials are never sent decrypted: they are injected by the stack
+	// in the konnector run.
 	return c.JSON(http.StatusOK, out.ToMapWithType())
 }
 
@@ -108,21 +103,15 @@ func updateAccount(c echo.Context) error {
 		}
 	}
 
-	encryptAccount(doc)
+	if _, err := accounts.EncryptAccount(instance, doc); err != nil {
+		return err
+	}
 
 	errUpdate := couchdb.UpdateDoc(instance, doc)
 	if errUpdate != nil {
 		return fixErrorNoDatabaseIsWrongDoctype(errUpdate)
 	}
 
-	perm, err := middlewares.GetPermission(c)
-	if err != nil {
-		return err
-	}
-	if perm.Type == perms.TypeKonnector {
-		decryptAccount(doc)
-	}
-
 	return c.JSON(http.StatusOK, echo.Map{
 		"ok":   true,
 		"id":   doc.ID(),
@@ -132,101 +121,6 @@ func updateAccount(c echo.Context) error {
 	})
 }
 
-func encryptAccount(doc couchdb.JSONDoc) bool {
-	if config.GetVault().CredentialsEncryptorKey() != nil {
-		return encryptMap(doc.M)
-	}
-	return false
-}
-
-func decryptAccount(doc couchdb.JSONDoc) bool {
-	if config.GetVault().CredentialsDecryptorKey() != nil {
-		return decryptMap(doc.M)
-	}
-	return false
-}
-
-func encryptMap(m map[string]interface{}) (encrypted bool) {
-	auth, ok := m["auth"].(map[string]interface{})
-	if !ok {
-		return
-	}
-	login, _ := auth["login"].(string)
-	cloned := make(map[string]interface{}, len(auth))
-	var encKeys []string
-	for k, v := range auth {
-		var err error
-		switch k {
-		case "password":
-			password, _ := v.(string)
-			cloned["credentials_encrypted"], err = accounts.EncryptCredentials(login, password)
-			if err == nil {
-				encrypted = true
-			}
-		case "secret", "dob", "code", "answer", "access_token", "refresh_token", "appSecret":
-			cloned[k+"_encrypted"], err = accounts.EncryptCredentialsData(v)
-			if err == nil {
-				encrypted = true
-			}
-		default:
-			if strings.HasSuffix(k, "_encrypted") {
-				encKeys = append(encKeys, k)
-			} else {
-				cloned[k] = v
-			}
-		}
-	}
-	for _, key := range encKeys {
-		if _, ok := cloned[key]; !ok {
-			cloned[key] = auth[key]
-		}
-	}
-	m["auth"] = cloned
-	if data, ok := m["data"].(map[string]interface{}); ok {
-		if encryptMap(data) && !encrypted {
-			encrypted = true
-		}
-	}
-	return
-}
-
-func decryptMap(m map[string]interface{}) (decrypted bool) {
-	auth, ok := m["auth"].(map[string]interface{})
-	if !ok {
-		return
-	}
-	cloned := make(map[string]interface{}, len(auth))
-	for k, v := range auth {
-		if !strings.HasSuffix(k, "_encrypted") {
-			cloned[k] = v
-			continue
-		}
-		k = strings.TrimSuffix(k, "_encrypted")
-		var str string
-		str, ok = v.(string)
-		if !ok {
-			cloned[k] = v
-			continue
-		}
-		var err error
-		if k == "credentials" {
-			cloned["login"], cloned["password"], err = accounts.DecryptCredentials(str)
-		} else {
-			cloned[k], err = accounts.DecryptCredentialsData(str)
-		}
-		if !decrypted {
-			decrypted = err == nil
-		}
-	}
-	m["auth"] = cloned
-	if data, ok := m["data"].(map[string]interface{}); ok {
-		if decryptMap(data) && !decrypted {
-			decrypted = true
-		}
-	}
-	return
-}
-
 func createAccount(c echo.Context) error {
 	doctype := consts.Accounts
 	instance := middlewares.GetInstance(c)
@@ -240,7 +134,9 @@ func createAccount(c echo.Context) error {
 		return err
 	}
 
-	encryptAccount(doc)
+	if _, err := accounts.EncryptAccount(instance, doc); err != nil {
+		return err
+	}
 
 	if err := couchdb.CreateDoc(instance, doc); err != nil {
 		return err
@@ -3,13 +3,17 @@ package data
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	perm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/schema"
 	"github.com/cozy/cozy-stack/web/files"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
@@ -25,7 +29,7 @@ func paramIsTrue(c echo.Context, param string) bool {
 func ValidDoctype(next echo.HandlerFunc) echo.HandlerFunc {
 	// TODO extends me to verify characters allowed in db name.
 	return func(c echo.Context) error {
-		doctype := c.Param("doctype")
+		doctype := schema.Resolve(c.Param("doctype"))
 		if doctype == "" {
 			return jsonapi.Errorf(http.StatusBadRequest, "Invalid doctype '%s'", doctype)
 		}
@@ -104,6 +108,15 @@ func getDoc(c echo.Context) error {
 		return err
 	}
 
+	// The document is migrated to the current version of the schema of its
+	// doctype when it is read
+	if _, err := schema.UpgradeAndSave(instance, &out); err != nil {
+		return err
+	}
+
+	if jsonapi.NotModified(c, out.Rev(), time.Time{}) {
+		return c.NoContent(http.StatusNotModified)
+	}
 	return c.JSON(http.StatusOK, out.ToMapWithType())
 }
 
@@ -169,7 +182,7 @@ func createNamedDoc(c echo.Context, doc couchdb.JSONDoc) error {
 // the given id.
 func UpdateDoc(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
-	doctype := c.Param("doctype")
+	doctype := schema.Resolve(c.Param("doctype"))
 
 	// Accounts are handled specifically to remove the auth fields
 	if doctype == consts.Accounts {
@@ -196,6 +209,10 @@ func UpdateDoc(c echo.Context) error {
 		return jsonapi.Errorf(http.StatusBadRequest, "document _id doesnt match url")
 	}
 
+	if err := jsonapi.CheckIfMatch(c, doc.Rev()); err != nil {
+		return err
+	}
+
 	if doc.ID() == "" {
 		doc.SetID(c.Get("docid").(string))
 		return createNamedDoc(c, doc)
@@ -225,10 +242,16 @@ func UpdateDoc(c echo.Context) error {
 	}
 
 	errUpdate := couchdb.UpdateDoc(instance, doc)
+	if couchdb.IsConflictError(errUpdate) && c.Request().Header.Get("If-Match") != "" {
+		// The revision of the If-Match header is the one of the body, but it
+		// is not the current revision of the document
+		return jsonapi.PreconditionFailed("If-Match", errors.New("Revision does not match"))
+	}
 	if errUpdate != nil {
 		return fixErrorNoDatabaseIsWrongDoctype(errUpdate)
 	}
 
+	c.Response().Header().Set("Etag", jsonapi.ETag(doc.Rev()))
 	return c.JSON(http.StatusOK, echo.Map{
 		"ok":   true,
 		"id":   doc.ID(),
@@ -243,7 +266,7 @@ func DeleteDoc(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	doctype := c.Get("doctype").(string)
 	docid := c.Get("docid").(string)
-	revHeader := c.Request().Header.Get("If-Match")
+	revHeader := jsonapi.ParseETag(c.Request().Header.Get("If-Match"))
 	revQuery := c.QueryParam("rev")
 	rev := ""
 
@@ -385,6 +408,9 @@ func normalDocs(c echo.Context) error {
 	if err := middlewares.AllowWholeType(c, permissions.GET, doctype); err != nil {
 		return err
 	}
+	if format := exportFormat(c); format != "" {
+		return exportDocs(c, doctype, format)
+	}
 	skip, err := strconv.ParseInt(c.QueryParam("skip"), 10, 64)
 	if err != nil || skip < 0 {
 		skip = 0
@@ -456,5 +482,6 @@ func Routes(router *echo.Group) {
 	group.POST("/_all_docs", allDocs)
 	group.GET("/_normal_docs", normalDocs)
 	group.POST("/_index", defineIndex)
-	group.POST("/_find", findDocuments)
+	group.POST("/_find", findDocuments, middlewares.RateLimit(limits.SearchType))
+	group.GET("/_geo", geoQuery)
 }
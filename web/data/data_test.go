@@ -24,6 +24,7 @@ const ID = "4521C325F6478E45"
 
 var testInstance *instance.Instance
 var token string
+var readOnlyToken string
 
 var ts *httptest.Server
 
@@ -84,6 +85,7 @@ func TestMain(m *testing.M) {
 		"io.cozy.anothertype io.cozy.nottype"
 
 	_, token = setup.GetTestClient(scope)
+	_, readOnlyToken = setup.GetTestClient(Type + ":GET")
 	ts = setup.GetTestServer("/data", Routes)
 
 	couchdb.ResetDB(testInstance, Type)
@@ -109,6 +111,22 @@ func TestSuccessGet(t *testing.T) {
 	}
 }
 
+func TestGetNotModified(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/data/"+Type+"/"+ID, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status)
+	etag := res.Header.Get("Etag")
+	assert.NotEmpty(t, etag)
+
+	req.Header.Add("If-None-Match", etag)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "304 Not Modified", res.Status)
+}
+
 func TestGetWithSlash(t *testing.T) {
 
 	couchdb.CreateNamedDoc(testInstance, &couchdb.JSONDoc{
@@ -389,6 +407,72 @@ func TestPreviousRevInDocUpdate(t *testing.T) {
 	assert.Equal(t, "409 Conflict", res2.Status, "should get a 409")
 }
 
+func TestStaleIfMatchInDocUpdate(t *testing.T) {
+	doc := getDocForTest()
+	url := ts.URL + "/data/" + doc.DocType() + "/" + doc.ID()
+
+	var in = jsonReader(&map[string]interface{}{
+		"_id":       doc.ID(),
+		"_rev":      doc.Rev(),
+		"somefield": "anewvalue",
+	})
+	req, _ := http.NewRequest("PUT", url, in)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"1-238238232322121"`)
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "412 Precondition Failed", res.Status)
+
+	in = jsonReader(&map[string]interface{}{
+		"_id":       doc.ID(),
+		"_rev":      doc.Rev(),
+		"somefield": "anewvalue",
+	})
+	req, _ = http.NewRequest("PUT", url, in)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"`+doc.Rev()+`"`)
+	var out stackUpdateResponse
+	_, res, err = doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status)
+	assert.Equal(t, `"`+out.Rev+`"`, res.Header.Get("Etag"))
+}
+
+func TestStaleIfMatchAndRevInDocUpdate(t *testing.T) {
+	doc := getDocForTest()
+	firstRev := doc.Rev()
+	url := ts.URL + "/data/" + doc.DocType() + "/" + doc.ID()
+
+	var in = jsonReader(&map[string]interface{}{
+		"_id":       doc.ID(),
+		"_rev":      firstRev,
+		"somefield": "anewvalue",
+	})
+	req, _ := http.NewRequest("PUT", url, in)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "first update should work")
+
+	// The If-Match and the _rev of the body agree, but they are not the
+	// current revision of the document
+	in = jsonReader(&map[string]interface{}{
+		"_id":       doc.ID(),
+		"_rev":      firstRev,
+		"somefield": "anewvalue2",
+	})
+	req, _ = http.NewRequest("PUT", url, in)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"`+firstRev+`"`)
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "412 Precondition Failed", res.Status)
+}
+
 func TestSuccessDeleteIfMatch(t *testing.T) {
 	// Get revision
 	doc := getDocForTest()
@@ -697,86 +781,6 @@ func TestUnsupportedOption(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestAccountsEncryptDecrypt(t *testing.T) {
-	config.UseTestFile()
-
-	v := []byte(`
-{
-    "_id": "d01aa821781612dce542a13d6989e6d0",
-    "_rev": "5-c8fc2169ff3226165688865e7cb609ef",
-    "_type": "io.cozy.accounts",
-    "account_type": "labanquepostale44",
-    "auth": {
-        "accountName": "Perso",
-        "identifier": "WHATYOUWANT",
-        "secret": "YOUWANTTOREADMYSECRET"
-    },
-    "data": {
-        "account_type": "linxo",
-        "auth": {
-            "login": "linxo.SOMEID@cozy.rocks",
-            "password": "SOMEPASSWORD"
-        },
-        "status": "connected",
-        "token": "4D757B74AD",
-        "uuid": "f6bb19cf-1c03-4d80-92e9-af66c18c4aa4"
-    },
-    "type": "io.cozy.accounts"
-}
-`)
-
-	var encrypted, decrypted bool
-	var m1 map[string]interface{} // original
-	var m2 map[string]interface{} // encrypted
-	var m3 map[string]interface{} // decrypted
-	json.Unmarshal(v, &m1)
-	json.Unmarshal(v, &m2)
-	json.Unmarshal(v, &m3)
-
-	encrypted = encryptMap(m2)
-	assert.True(t, encrypted)
-
-	{
-		auth1 := m2["auth"].(map[string]interface{})
-		auth2 := m2["data"].(map[string]interface{})["auth"].(map[string]interface{})
-		{
-			_, ok1 := auth1["secret"]
-			_, ok2 := auth1["secret_encrypted"]
-			assert.False(t, ok1)
-			assert.True(t, ok2)
-		}
-		{
-			_, ok1 := auth2["password"]
-			_, ok2 := auth2["credentials_encrypted"]
-			assert.False(t, ok1)
-			assert.True(t, ok2)
-		}
-	}
-
-	encrypted = encryptMap(m3)
-	decrypted = decryptMap(m3)
-	assert.True(t, encrypted)
-	assert.True(t, decrypted)
-	assert.EqualValues(t, m1, m3)
-
-	{
-		auth1 := m3["auth"].(map[string]interface{})
-		auth2 := m3["data"].(map[string]interface{})["auth"].(map[string]interface{})
-		{
-			_, ok1 := auth1["secret"]
-			_, ok2 := auth1["secret_encrypted"]
-			assert.True(t, ok1)
-			assert.False(t, ok2)
-		}
-		{
-			_, ok1 := auth2["password"]
-			_, ok2 := auth2["credentials_encrypted"]
-			assert.True(t, ok1)
-			assert.False(t, ok2)
-		}
-	}
-}
-
 func TestGetAllDocs(t *testing.T) {
 	url := ts.URL + "/data/" + Type + "/_all_docs?include_docs=true"
 	req, _ := http.NewRequest("GET", url, nil)
@@ -853,3 +857,48 @@ function(doc) {
 	value = row["test"].(string)
 	assert.Equal(t, "fourthvalue", value)
 }
+
+func TestExportDocs(t *testing.T) {
+	err := couchdb.CreateNamedDoc(testInstance, &couchdb.JSONDoc{
+		Type: Type,
+		M: map[string]interface{}{
+			"_id":     "nested",
+			"test":    "=1+1",
+			"address": map[string]interface{}{"city": "Paris"},
+			"tags":    []interface{}{"foo", "bar"},
+		},
+	})
+	assert.NoError(t, err)
+	url := ts.URL + "/data/" + Type + "/_normal_docs"
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Accept", "application/x-ndjson")
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+	assert.Contains(t, res.Header.Get("Content-Type"), "application/x-ndjson")
+	body, _ := ioutil.ReadAll(res.Body)
+	lines := bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+	found := false
+	for _, line := range lines {
+		var doc map[string]interface{}
+		assert.NoError(t, json.Unmarshal(line, &doc))
+		if doc["_id"] == "nested" {
+			found = true
+		}
+	}
+	assert.True(t, found)
+
+	req, _ = http.NewRequest("GET", url+"?columns=_id,test,address.city,tags", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Accept", "text/csv")
+	res2, err := client.Do(req)
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, "200 OK", res2.Status)
+	body, _ = ioutil.ReadAll(res2.Body)
+	assert.Contains(t, string(body), "_id,test,address.city,tags\n")
+	assert.Contains(t, string(body), `nested,'=1+1,Paris,"[""foo"",""bar""]"`)
+}
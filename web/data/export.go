@@ -0,0 +1,180 @@
+package data
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+const (
+	// MIMENDJSON is the media type for the exports as newline delimited JSON
+	MIMENDJSON = "application/x-ndjson"
+	// MIMECSV is the media type for the exports as CSV
+	MIMECSV = "text/csv"
+)
+
+// exportFormat returns the media type of the export asked by the client in
+// the Accept header, or an empty string for the default JSON response. The
+// first media type of the header that is known wins.
+func exportFormat(c echo.Context) string {
+	for _, accept := range strings.Split(c.Request().Header.Get("Accept"), ",") {
+		mime := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+		switch mime {
+		case MIMENDJSON, "application/ndjson":
+			return MIMENDJSON
+		case MIMECSV:
+			return MIMECSV
+		case echo.MIMEApplicationJSON, "*/*":
+			return ""
+		}
+	}
+	return ""
+}
+
+// exportDocs sends all the documents of a doctype, in the given format. The
+// response is streamed, so an error in the middle of the export can only be
+// logged.
+func exportDocs(c echo.Context, doctype, format string) error {
+	instance := middlewares.GetInstance(c)
+
+	var columns []string
+	if format == MIMECSV {
+		if cols := c.QueryParam("columns"); cols != "" {
+			columns = strings.Split(cols, ",")
+		} else {
+			var err error
+			if columns, err = csvColumns(instance, doctype); err != nil {
+				return err
+			}
+		}
+	}
+
+	filename := strings.Replace(doctype, ".", "-", -1)
+	if format == MIMECSV {
+		filename += ".csv"
+	} else {
+		filename += ".ndjson"
+	}
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, format+"; charset=utf-8")
+	res.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	res.WriteHeader(http.StatusOK)
+
+	var err error
+	if format == MIMECSV {
+		w := csv.NewWriter(res)
+		if err = w.Write(columns); err == nil {
+			err = couchdb.ForeachDocs(instance, doctype, func(_ string, doc json.RawMessage) error {
+				flat, err := flattenDoc(doc)
+				if err != nil {
+					return err
+				}
+				record := make([]string, len(columns))
+				for i, col := range columns {
+					record[i] = flat[col]
+				}
+				return w.Write(record)
+			})
+		}
+		w.Flush()
+		if err == nil {
+			err = w.Error()
+		}
+	} else {
+		err = couchdb.ForeachDocs(instance, doctype, func(_ string, doc json.RawMessage) error {
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, doc); err != nil {
+				return err
+			}
+			buf.WriteByte('\n')
+			_, err := res.Write(buf.Bytes())
+			return err
+		})
+	}
+	if err != nil {
+		middlewares.GetLogger(c).Errorf("Error during the export of %s: %s", doctype, err)
+	}
+	return nil
+}
+
+// csvColumns returns the columns of the CSV export: the flattened fields of
+// all the documents, with _id and _rev first, and then in alphabetical order.
+func csvColumns(db couchdb.Database, doctype string) ([]string, error) {
+	seen := map[string]struct{}{}
+	err := couchdb.ForeachDocs(db, doctype, func(_ string, doc json.RawMessage) error {
+		flat, err := flattenDoc(doc)
+		if err != nil {
+			return err
+		}
+		for key := range flat {
+			seen[key] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	delete(seen, "_id")
+	delete(seen, "_rev")
+	columns := make([]string, 0, len(seen)+2)
+	for key := range seen {
+		columns = append(columns, key)
+	}
+	sort.Strings(columns)
+	return append([]string{"_id", "_rev"}, columns...), nil
+}
+
+// flattenDoc transforms a document to a flat map for a CSV line: the fields
+// of the nested objects have their path joined with dots as key (like
+// address.city), and the arrays are kept as JSON in a single cell. The strings
+// that can be interpreted as formulas by a spreadsheet are prefixed by a quote.
+func flattenDoc(doc json.RawMessage) (map[string]string, error) {
+	var m map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	flat := make(map[string]string)
+	flatten(flat, "", m)
+	return flat, nil
+}
+
+func flatten(flat map[string]string, prefix string, m map[string]interface{}) {
+	for key, value := range m {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case nil:
+			flat[key] = ""
+		case string:
+			// Protect the spreadsheets from the formulas injections
+			if v != "" && strings.ContainsRune("=+-@", rune(v[0])) {
+				v = "'" + v
+			}
+			flat[key] = v
+		case json.Number:
+			flat[key] = v.String()
+		case bool:
+			if v {
+				flat[key] = "true"
+			} else {
+				flat[key] = "false"
+			}
+		case map[string]interface{}:
+			flatten(flat, key, v)
+		default:
+			b, _ := json.Marshal(v)
+			flat[key] = string(b)
+		}
+	}
+}
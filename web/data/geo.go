@@ -0,0 +1,74 @@
+package data
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/geo"
+	perm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const (
+	// MIMEGeoJSON is the media type of the responses for the geospatial
+	// queries
+	MIMEGeoJSON = "application/geo+json"
+
+	defaultGeoLimit = 100
+	maxGeoLimit     = 1000
+)
+
+// geoQuery returns the documents of a doctype inside a bounding box, or near
+// a point, as a GeoJSON collection.
+func geoQuery(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Get("doctype").(string)
+	if err := perm.CheckReadable(doctype); err != nil {
+		return err
+	}
+	if err := middlewares.AllowWholeType(c, permissions.GET, doctype); err != nil {
+		return err
+	}
+
+	var area geo.Area
+	var err error
+	if bbox := c.QueryParam("bbox"); bbox != "" {
+		area, err = geo.ParseBBox(bbox)
+	} else if radius := c.QueryParam("radius"); radius != "" {
+		area, err = geo.ParseCircle(c.QueryParam("lat"), c.QueryParam("long"), radius)
+	} else {
+		return jsonapi.Errorf(http.StatusBadRequest, "The bbox or radius parameter is mandatory")
+	}
+	if err != nil {
+		return jsonapi.Errorf(http.StatusBadRequest, "%s", err)
+	}
+
+	limit := defaultGeoLimit
+	if l := c.QueryParam("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxGeoLimit {
+			return jsonapi.Errorf(http.StatusBadRequest, "Invalid limit '%s'", l)
+		}
+	}
+
+	features, next, err := geo.Query(instance, doctype, area, limit)
+	if err != nil {
+		return err
+	}
+	if features == nil {
+		features = []*geo.Feature{}
+	}
+	b, err := json.Marshal(&geo.FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: features,
+		Next:     next,
+	})
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, MIMEGeoJSON, b)
+}
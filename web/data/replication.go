@@ -1,8 +1,13 @@
 package data
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	perm "github.com/cozy/cozy-stack/pkg/permissions"
@@ -81,35 +86,90 @@ func bulkGet(c echo.Context) error {
 	return proxy(c, "_bulk_get")
 }
 
+// bulkDocsVerbs returns the verbs needed to write the documents of a
+// _bulk_docs request: POST for a new document, PUT for a new revision of an
+// existing document, and DELETE for a deletion. The _design and _local
+// documents can't be written via this route.
+func bulkDocsVerbs(body []byte) (perm.VerbSet, error) {
+	var req struct {
+		Docs []couchdb.JSONDoc `json:"docs"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			"request body is not valid JSON")
+	}
+	verbs := make(perm.VerbSet)
+	for _, doc := range req.Docs {
+		id := doc.ID()
+		if strings.HasPrefix(id, "_design/") || strings.HasPrefix(id, "_local/") {
+			return nil, echo.NewHTTPError(http.StatusForbidden,
+				"_design and _local docs can't be written by _bulk_docs")
+		}
+		rev := doc.Rev()
+		switch {
+		case doc.M["_deleted"] == true:
+			verbs[perm.DELETE] = struct{}{}
+		case rev == "" || strings.HasPrefix(rev, "1-"):
+			verbs[perm.POST] = struct{}{}
+		default:
+			verbs[perm.PUT] = struct{}{}
+		}
+	}
+	return verbs, nil
+}
+
 func bulkDocs(c echo.Context) error {
 	doctype := c.Get("doctype").(string)
 
-	if err := middlewares.AllowWholeType(c, permissions.POST, doctype); err != nil {
+	if err := perm.CheckWritable(doctype); err != nil {
 		return err
 	}
 
-	if err := perm.CheckWritable(doctype); err != nil {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
 		return err
 	}
+	c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+	verbs, err := bulkDocsVerbs(body)
+	if err != nil {
+		return replicationError(c, err)
+	}
+	if len(verbs) == 0 {
+		verbs[perm.POST] = struct{}{}
+	}
+	for verb := range verbs {
+		if err := middlewares.AllowWholeType(c, verb, doctype); err != nil {
+			return err
+		}
+	}
 
 	instance := middlewares.GetInstance(c)
 	p, req, err := couchdb.ProxyBulkDocs(instance, doctype, c.Request())
 	if err != nil {
-		var code int
-		if errHTTP, ok := err.(*echo.HTTPError); ok {
-			code = errHTTP.Code
-		} else {
-			code = http.StatusInternalServerError
-		}
-		return c.JSON(code, echo.Map{
-			"error": err.Error(),
-		})
+		return replicationError(c, err)
 	}
 
 	p.ServeHTTP(c.Response(), req)
 	return nil
 }
 
+// replicationError sends an error in the format of CouchDB, as the clients
+// of the replication routes are CouchDB or PouchDB.
+func replicationError(c echo.Context, err error) error {
+	var code int
+	var msg string
+	if errHTTP, ok := err.(*echo.HTTPError); ok {
+		code = errHTTP.Code
+		msg = fmt.Sprintf("%v", errHTTP.Message)
+	} else {
+		code = http.StatusInternalServerError
+		msg = err.Error()
+	}
+	return c.JSON(code, echo.Map{
+		"error": msg,
+	})
+}
+
 func createDB(c echo.Context) error {
 	doctype := c.Get("doctype").(string)
 
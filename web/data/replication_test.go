@@ -66,3 +66,78 @@ func TestReplicationFromcozy(t *testing.T) {
 	assert.Equal(t, "200 OK", res.Status)
 	assert.Equal(t, out["_id"], doc4.ID())
 }
+
+func TestReplicationToCozy(t *testing.T) {
+	doc := getDocForTest()
+	newRev := "2-" + strings.Repeat("a", 32)
+	var source = ts.URL + "/data/" + Type
+	bulk := map[string]interface{}{
+		"new_edits": false,
+		"docs": []map[string]interface{}{
+			{
+				"_id":  doc.ID(),
+				"_rev": newRev,
+				"_revisions": map[string]interface{}{
+					"start": 2,
+					"ids":   []string{strings.Repeat("a", 32), strings.TrimPrefix(doc.Rev(), "1-")},
+				},
+				"test": "replicated",
+			},
+		},
+	}
+
+	req, _ := http.NewRequest("POST", source+"/_revs_diff", jsonReader(&map[string]interface{}{
+		doc.ID(): []string{doc.Rev(), newRev},
+	}))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status)
+	missing := out[doc.ID()].(map[string]interface{})["missing"].([]interface{})
+	assert.Equal(t, []interface{}{newRev}, missing)
+
+	req, _ = http.NewRequest("POST", source+"/_bulk_docs", jsonReader(&bulk))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+readOnlyToken)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+
+	req, _ = http.NewRequest("POST", source+"/_bulk_docs", jsonReader(&bulk))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res.Body.Close()
+
+	req, _ = http.NewRequest("POST", source+"/_bulk_get?revs=true", jsonReader(&map[string]interface{}{
+		"docs": []map[string]interface{}{{"id": doc.ID(), "rev": newRev}},
+	}))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+readOnlyToken)
+	out, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status)
+	results := out["results"].([]interface{})
+	assert.Len(t, results, 1)
+	docs := results[0].(map[string]interface{})["docs"].([]interface{})
+	replicated := docs[0].(map[string]interface{})["ok"].(map[string]interface{})
+	assert.Equal(t, "replicated", replicated["test"])
+}
+
+func TestBulkDocsRejectsDesignDocs(t *testing.T) {
+	req, _ := http.NewRequest("POST", ts.URL+"/data/"+Type+"/_bulk_docs", jsonReader(&map[string]interface{}{
+		"docs": []map[string]interface{}{
+			{"_id": "_design/evil", "views": map[string]interface{}{}},
+		},
+	}))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Contains(t, out["error"], "_design")
+}
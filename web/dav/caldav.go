@@ -0,0 +1,519 @@
+package dav
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/calendar"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+const (
+	calendarsPath = "/dav/calendars/"
+	calendarPath  = "/dav/calendars/calendar/"
+	icalExt       = ".ics"
+	icalType      = "text/calendar; charset=utf-8"
+)
+
+// maxICalendarSize is the maximal size of the body of a PUT request for an
+// event
+const maxICalendarSize = 1 << 20 // 1MB
+
+// serveCalDAV handles the requests on the calendar. There is only one
+// calendar, and an iCalendar resource for each event in it.
+func serveCalDAV(c echo.Context, m string, parts []string) error {
+	switch len(parts) {
+	case 0:
+		if m == echo.PROPFIND {
+			return propfindCalendarsHome(c)
+		}
+	case 1:
+		if parts[0] != "calendar" {
+			return c.NoContent(http.StatusNotFound)
+		}
+		switch m {
+		case echo.PROPFIND:
+			return propfindCalendar(c)
+		case "REPORT":
+			return reportCalendar(c)
+		}
+	case 2:
+		if parts[0] != "calendar" || !strings.HasSuffix(parts[1], icalExt) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		id := strings.TrimSuffix(parts[1], icalExt)
+		if id == "" || strings.HasPrefix(id, "_") {
+			return c.NoContent(http.StatusNotFound)
+		}
+		switch m {
+		case echo.GET, echo.HEAD:
+			return getICalendar(c, id)
+		case echo.PUT:
+			return putICalendar(c, id)
+		case echo.DELETE:
+			return deleteICalendar(c, id)
+		case echo.PROPFIND:
+			return propfindICalendar(c, id)
+		}
+	default:
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.NoContent(http.StatusMethodNotAllowed)
+}
+
+func eventHref(id string) string {
+	return calendarPath + id + icalExt
+}
+
+func eventIDFromHref(href string) (string, bool) {
+	if u, err := url.Parse(href); err == nil {
+		href = u.Path
+	}
+	if !strings.HasPrefix(href, calendarPath) || !strings.HasSuffix(href, icalExt) {
+		return "", false
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(href, calendarPath), icalExt)
+	if id == "" || strings.Contains(id, "/") || strings.HasPrefix(id, "_") {
+		return "", false
+	}
+	return id, true
+}
+
+func icalData(event *calendar.Event) (string, error) {
+	var buf bytes.Buffer
+	if err := calendar.WriteICalendar(&buf, []*calendar.Event{event}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// eventResource returns the resource for an event. The iCalendar data is
+// added only if it was requested.
+func eventResource(event *calendar.Event, names propNames) (*resource, error) {
+	r := &resource{
+		href: eventHref(event.ID()),
+		props: []property{
+			rawProp(nsDAV, "resourcetype", ""),
+			textProp(nsDAV, "getetag", etag(event.Rev())),
+			textProp(nsDAV, "getcontenttype", icalType),
+		},
+	}
+	if names.contains(nsCalDAV, "calendar-data") {
+		data, err := icalData(event)
+		if err != nil {
+			return nil, err
+		}
+		r.props = append(r.props, textProp(nsCalDAV, "calendar-data", data))
+	}
+	return r, nil
+}
+
+func calendarResource(c echo.Context) (*resource, error) {
+	seq, err := lastSeq(c, consts.Events)
+	if err != nil {
+		return nil, err
+	}
+	return &resource{
+		href: calendarPath,
+		props: []property{
+			rawProp(nsDAV, "resourcetype", `<collection xmlns="DAV:"/><calendar xmlns="urn:ietf:params:xml:ns:caldav"/>`),
+			textProp(nsDAV, "displayname", "Calendar"),
+			hrefProp(nsDAV, "owner", principalPath),
+			textProp(nsCS, "getctag", seq),
+			textProp(nsDAV, "sync-token", syncTokenPrefix+seq),
+			rawProp(nsDAV, "current-user-privilege-set", privileges),
+			rawProp(nsDAV, "supported-report-set", supportedReports(
+				xml.Name{Space: nsCalDAV, Local: "calendar-multiget"},
+				xml.Name{Space: nsCalDAV, Local: "calendar-query"},
+				xml.Name{Space: nsDAV, Local: "sync-collection"},
+			)),
+			rawProp(nsCalDAV, "supported-calendar-component-set",
+				`<comp xmlns="urn:ietf:params:xml:ns:caldav" name="VEVENT"/>`),
+			rawProp(nsCalDAV, "supported-calendar-data",
+				`<calendar-data xmlns="urn:ietf:params:xml:ns:caldav" content-type="text/calendar" version="2.0"/>`),
+		},
+	}, nil
+}
+
+func propfindCalendarsHome(c echo.Context) error {
+	if err := allowWholeType(c, permissions.GET, consts.Events); err != nil {
+		return err
+	}
+	names, err := parsePropfind(c)
+	if err != nil {
+		return err
+	}
+	home := &resource{
+		href: calendarsPath,
+		props: []property{
+			rawProp(nsDAV, "resourcetype", `<collection xmlns="DAV:"/>`),
+			hrefProp(nsDAV, "current-user-principal", principalPath),
+		},
+	}
+	ms := &multistatus{Responses: []response{home.response(names)}}
+	if depth(c) > 0 {
+		cal, err := calendarResource(c)
+		if err != nil {
+			return err
+		}
+		ms.Responses = append(ms.Responses, cal.response(names))
+	}
+	return sendMultistatus(c, ms)
+}
+
+func propfindCalendar(c echo.Context) error {
+	if err := allowWholeType(c, permissions.GET, consts.Events); err != nil {
+		return err
+	}
+	names, err := parsePropfind(c)
+	if err != nil {
+		return err
+	}
+	cal, err := calendarResource(c)
+	if err != nil {
+		return err
+	}
+	ms := &multistatus{Responses: []response{cal.response(names)}}
+	if depth(c) > 0 {
+		list, err := calendar.GetAll(middlewares.GetInstance(c))
+		if err != nil {
+			return err
+		}
+		for _, event := range list {
+			r, err := eventResource(event, names)
+			if err != nil {
+				return err
+			}
+			ms.Responses = append(ms.Responses, r.response(names))
+		}
+	}
+	return sendMultistatus(c, ms)
+}
+
+func propfindICalendar(c echo.Context, id string) error {
+	if err := allowWholeType(c, permissions.GET, consts.Events); err != nil {
+		return err
+	}
+	names, err := parsePropfind(c)
+	if err != nil {
+		return err
+	}
+	event, err := findEvent(c, id)
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	r, err := eventResource(event, names)
+	if err != nil {
+		return err
+	}
+	return sendMultistatus(c, &multistatus{Responses: []response{r.response(names)}})
+}
+
+// calReportRequest is the body of a REPORT request on the calendar:
+// calendar-multiget, calendar-query or sync-collection.
+type calReportRequest struct {
+	XMLName   xml.Name
+	Prop      propNames  `xml:"DAV: prop"`
+	Hrefs     []string   `xml:"DAV: href"`
+	SyncToken string     `xml:"DAV: sync-token"`
+	Filter    *calFilter `xml:"urn:ietf:params:xml:ns:caldav filter"`
+}
+
+func reportCalendar(c echo.Context) error {
+	if err := allowWholeType(c, permissions.GET, consts.Events); err != nil {
+		return err
+	}
+	var req calReportRequest
+	if err := xml.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid XML body")
+	}
+	switch req.XMLName {
+	case xml.Name{Space: nsCalDAV, Local: "calendar-multiget"}:
+		return calendarMultiget(c, &req)
+	case xml.Name{Space: nsCalDAV, Local: "calendar-query"}:
+		return calendarQuery(c, &req)
+	case xml.Name{Space: nsDAV, Local: "sync-collection"}:
+		return syncCalendar(c, &req)
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, "Unsupported report")
+}
+
+func calendarMultiget(c echo.Context, req *calReportRequest) error {
+	ms := &multistatus{}
+	var ids []string
+	for _, href := range req.Hrefs {
+		id, ok := eventIDFromHref(href)
+		if !ok {
+			ms.Responses = append(ms.Responses, response{Href: href, Status: statusLine(http.StatusNotFound)})
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) > 0 {
+		var list []*calendar.Event
+		allReq := &couchdb.AllDocsRequest{Keys: ids}
+		err := couchdb.GetAllDocs(middlewares.GetInstance(c), consts.Events, allReq, &list)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+		found := make(map[string]*calendar.Event, len(list))
+		for _, event := range list {
+			if event != nil {
+				found[event.ID()] = event
+			}
+		}
+		for _, id := range ids {
+			event, ok := found[id]
+			if !ok {
+				ms.Responses = append(ms.Responses, response{Href: eventHref(id), Status: statusLine(http.StatusNotFound)})
+				continue
+			}
+			r, err := eventResource(event, req.Prop)
+			if err != nil {
+				return err
+			}
+			ms.Responses = append(ms.Responses, r.response(req.Prop))
+		}
+	}
+	return sendMultistatus(c, ms)
+}
+
+func calendarQuery(c echo.Context, req *calReportRequest) error {
+	list, err := calendar.GetAll(middlewares.GetInstance(c))
+	if err != nil {
+		return err
+	}
+	ms := &multistatus{}
+	for _, event := range list {
+		if !req.Filter.match(event) {
+			continue
+		}
+		r, err := eventResource(event, req.Prop)
+		if err != nil {
+			return err
+		}
+		ms.Responses = append(ms.Responses, r.response(req.Prop))
+	}
+	return sendMultistatus(c, ms)
+}
+
+// syncCalendar implements the sync-collection report for the calendar, like
+// syncAddressbook does for the address book.
+func syncCalendar(c echo.Context, req *calReportRequest) error {
+	inst := middlewares.GetInstance(c)
+	ms := &multistatus{}
+
+	if req.SyncToken == "" {
+		seq, err := lastSeq(c, consts.Events)
+		if err != nil {
+			return err
+		}
+		list, err := calendar.GetAll(inst)
+		if err != nil {
+			return err
+		}
+		for _, event := range list {
+			r, err := eventResource(event, req.Prop)
+			if err != nil {
+				return err
+			}
+			ms.Responses = append(ms.Responses, r.response(req.Prop))
+		}
+		ms.SyncToken = syncTokenPrefix + seq
+		return sendMultistatus(c, ms)
+	}
+
+	changes, seq, err := changesSince(c, consts.Events, req.SyncToken)
+	if err == errInvalidSyncToken {
+		return sendInvalidSyncToken(c)
+	}
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if change.Doc.M["_deleted"] == true {
+			ms.Responses = append(ms.Responses, response{Href: eventHref(change.DocID), Status: statusLine(http.StatusNotFound)})
+			continue
+		}
+		raw, err := json.Marshal(change.Doc)
+		if err != nil {
+			return err
+		}
+		var event calendar.Event
+		if err = json.Unmarshal(raw, &event); err != nil {
+			return err
+		}
+		r, err := eventResource(&event, req.Prop)
+		if err != nil {
+			return err
+		}
+		ms.Responses = append(ms.Responses, r.response(req.Prop))
+	}
+	ms.SyncToken = syncTokenPrefix + seq
+	return sendMultistatus(c, ms)
+}
+
+func findEvent(c echo.Context, id string) (*calendar.Event, error) {
+	event, err := calendar.Find(middlewares.GetInstance(c), id)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return event, nil
+}
+
+func getICalendar(c echo.Context, id string) error {
+	if err := allowWholeType(c, permissions.GET, consts.Events); err != nil {
+		return err
+	}
+	event, err := findEvent(c, id)
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	data, err := icalData(event)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("ETag", etag(event.Rev()))
+	return c.Blob(http.StatusOK, icalType, []byte(data))
+}
+
+// putICalendar creates or updates an event from the iCalendar resource in
+// the request body. Like for the vCards, no ETag is sent in the response.
+func putICalendar(c echo.Context, id string) error {
+	old, err := findEvent(c, id)
+	if err != nil {
+		return err
+	}
+	verb := permissions.PUT
+	if old == nil {
+		verb = permissions.POST
+	}
+	if err = allowWholeType(c, verb, consts.Events); err != nil {
+		return err
+	}
+	oldRev := ""
+	if old != nil {
+		oldRev = old.Rev()
+	}
+	if !checkPreconditions(c, oldRev) {
+		return c.NoContent(http.StatusPreconditionFailed)
+	}
+
+	list, err := calendar.ParseICalendar(io.LimitReader(c.Request().Body, maxICalendarSize))
+	if err != nil || len(list) != 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, calendar.ErrInvalidICalendar.Error())
+	}
+	event := list[0]
+	inst := middlewares.GetInstance(c)
+
+	if old == nil {
+		event.SetID(id)
+		if err = couchdb.CreateNamedDocWithDB(inst, event); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusCreated)
+	}
+
+	event.SetID(old.ID())
+	event.SetRev(old.Rev())
+	if err = couchdb.UpdateDoc(inst, event); err != nil {
+		if couchdb.IsConflictError(err) {
+			return c.NoContent(http.StatusPreconditionFailed)
+		}
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func deleteICalendar(c echo.Context, id string) error {
+	if err := allowWholeType(c, permissions.DELETE, consts.Events); err != nil {
+		return err
+	}
+	event, err := findEvent(c, id)
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if !checkPreconditions(c, event.Rev()) {
+		return c.NoContent(http.StatusPreconditionFailed)
+	}
+	if err = couchdb.DeleteDoc(middlewares.GetInstance(c), event); err != nil {
+		if couchdb.IsConflictError(err) {
+			return c.NoContent(http.StatusPreconditionFailed)
+		}
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// calFilter is the filter of a calendar-query report (RFC 4791 section
+// 9.7). Only the comp-filter and time-range elements are supported: the
+// prop-filter elements are ignored.
+type calFilter struct {
+	Comp *compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+type compFilter struct {
+	Name         string       `xml:"name,attr"`
+	IsNotDefined *struct{}    `xml:"urn:ietf:params:xml:ns:caldav is-not-defined"`
+	TimeRange    *timeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	Comps        []compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+type timeRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+// match returns true if the event matches the filter
+func (f *calFilter) match(event *calendar.Event) bool {
+	if f == nil || f.Comp == nil {
+		return true
+	}
+	if f.Comp.Name != "VCALENDAR" {
+		return false
+	}
+	for _, comp := range f.Comp.Comps {
+		if !comp.match(event) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cf *compFilter) match(event *calendar.Event) bool {
+	if cf.Name != "VEVENT" {
+		return cf.IsNotDefined != nil
+	}
+	if cf.IsNotDefined != nil {
+		return false
+	}
+	if cf.TimeRange != nil {
+		start, _ := time.Parse("20060102T150405Z", cf.TimeRange.Start)
+		end, _ := time.Parse("20060102T150405Z", cf.TimeRange.End)
+		return event.Overlaps(start, end)
+	}
+	return true
+}
@@ -0,0 +1,563 @@
+package dav
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/contacts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+	vcard "github.com/emersion/go-vcard"
+)
+
+const (
+	contactsPath    = "/dav/contacts/"
+	addressbookPath = "/dav/contacts/addressbook/"
+	vcardExt        = ".vcf"
+	vcardType       = "text/vcard; charset=utf-8"
+)
+
+// maxVCardSize is the maximal size of the body of a PUT request for a vCard
+const maxVCardSize = 1 << 20 // 1MB
+
+// serveCardDAV handles the requests on the address book. There is only one
+// address book for the contacts, and a vCard for each contact in it.
+func serveCardDAV(c echo.Context, m string, parts []string) error {
+	switch len(parts) {
+	case 0:
+		if m == echo.PROPFIND {
+			return propfindContactsHome(c)
+		}
+	case 1:
+		if parts[0] != "addressbook" {
+			return c.NoContent(http.StatusNotFound)
+		}
+		switch m {
+		case echo.PROPFIND:
+			return propfindAddressbook(c)
+		case "REPORT":
+			return reportAddressbook(c)
+		}
+	case 2:
+		if parts[0] != "addressbook" || !strings.HasSuffix(parts[1], vcardExt) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		id := strings.TrimSuffix(parts[1], vcardExt)
+		if id == "" || strings.HasPrefix(id, "_") {
+			return c.NoContent(http.StatusNotFound)
+		}
+		switch m {
+		case echo.GET, echo.HEAD:
+			return getVCard(c, id)
+		case echo.PUT:
+			return putVCard(c, id)
+		case echo.DELETE:
+			return deleteVCard(c, id)
+		case echo.PROPFIND:
+			return propfindVCard(c, id)
+		}
+	default:
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.NoContent(http.StatusMethodNotAllowed)
+}
+
+func contactHref(id string) string {
+	return addressbookPath + id + vcardExt
+}
+
+func contactIDFromHref(href string) (string, bool) {
+	if u, err := url.Parse(href); err == nil {
+		href = u.Path
+	}
+	if !strings.HasPrefix(href, addressbookPath) || !strings.HasSuffix(href, vcardExt) {
+		return "", false
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(href, addressbookPath), vcardExt)
+	if id == "" || strings.Contains(id, "/") || strings.HasPrefix(id, "_") {
+		return "", false
+	}
+	return id, true
+}
+
+func vcardData(contact *contacts.Contact) (string, error) {
+	var buf bytes.Buffer
+	if err := contacts.WriteVCards(&buf, []*contacts.Contact{contact}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// contactResource returns the resource for a contact. The vCard is added
+// only if it was requested, as its generation is more expensive.
+func contactResource(contact *contacts.Contact, names propNames) (*resource, error) {
+	r := &resource{
+		href: contactHref(contact.ID()),
+		props: []property{
+			rawProp(nsDAV, "resourcetype", ""),
+			textProp(nsDAV, "getetag", etag(contact.Rev())),
+			textProp(nsDAV, "getcontenttype", vcardType),
+		},
+	}
+	if names.contains(nsCardDAV, "address-data") {
+		data, err := vcardData(contact)
+		if err != nil {
+			return nil, err
+		}
+		r.props = append(r.props, textProp(nsCardDAV, "address-data", data))
+	}
+	return r, nil
+}
+
+func addressbookResource(c echo.Context) (*resource, error) {
+	seq, err := lastSeq(c, consts.Contacts)
+	if err != nil {
+		return nil, err
+	}
+	return &resource{
+		href: addressbookPath,
+		props: []property{
+			rawProp(nsDAV, "resourcetype", `<collection xmlns="DAV:"/><addressbook xmlns="urn:ietf:params:xml:ns:carddav"/>`),
+			textProp(nsDAV, "displayname", "Contacts"),
+			hrefProp(nsDAV, "owner", principalPath),
+			textProp(nsCS, "getctag", seq),
+			textProp(nsDAV, "sync-token", syncTokenPrefix+seq),
+			rawProp(nsDAV, "current-user-privilege-set", privileges),
+			rawProp(nsDAV, "supported-report-set", supportedReports(
+				xml.Name{Space: nsCardDAV, Local: "addressbook-multiget"},
+				xml.Name{Space: nsCardDAV, Local: "addressbook-query"},
+				xml.Name{Space: nsDAV, Local: "sync-collection"},
+			)),
+			rawProp(nsCardDAV, "supported-address-data",
+				`<address-data-type xmlns="urn:ietf:params:xml:ns:carddav" content-type="text/vcard" version="3.0"/>`+
+					`<address-data-type xmlns="urn:ietf:params:xml:ns:carddav" content-type="text/vcard" version="4.0"/>`),
+		},
+	}, nil
+}
+
+func propfindContactsHome(c echo.Context) error {
+	if err := allowWholeType(c, permissions.GET, consts.Contacts); err != nil {
+		return err
+	}
+	names, err := parsePropfind(c)
+	if err != nil {
+		return err
+	}
+	home := &resource{
+		href: contactsPath,
+		props: []property{
+			rawProp(nsDAV, "resourcetype", `<collection xmlns="DAV:"/>`),
+			hrefProp(nsDAV, "current-user-principal", principalPath),
+		},
+	}
+	ms := &multistatus{Responses: []response{home.response(names)}}
+	if depth(c) > 0 {
+		book, err := addressbookResource(c)
+		if err != nil {
+			return err
+		}
+		ms.Responses = append(ms.Responses, book.response(names))
+	}
+	return sendMultistatus(c, ms)
+}
+
+func propfindAddressbook(c echo.Context) error {
+	if err := allowWholeType(c, permissions.GET, consts.Contacts); err != nil {
+		return err
+	}
+	names, err := parsePropfind(c)
+	if err != nil {
+		return err
+	}
+	book, err := addressbookResource(c)
+	if err != nil {
+		return err
+	}
+	ms := &multistatus{Responses: []response{book.response(names)}}
+	if depth(c) > 0 {
+		list, err := contacts.GetAll(middlewares.GetInstance(c))
+		if err != nil {
+			return err
+		}
+		for _, contact := range list {
+			r, err := contactResource(contact, names)
+			if err != nil {
+				return err
+			}
+			ms.Responses = append(ms.Responses, r.response(names))
+		}
+	}
+	return sendMultistatus(c, ms)
+}
+
+func propfindVCard(c echo.Context, id string) error {
+	if err := allowWholeType(c, permissions.GET, consts.Contacts); err != nil {
+		return err
+	}
+	names, err := parsePropfind(c)
+	if err != nil {
+		return err
+	}
+	contact, err := contacts.Find(middlewares.GetInstance(c), id)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+	r, err := contactResource(contact, names)
+	if err != nil {
+		return err
+	}
+	return sendMultistatus(c, &multistatus{Responses: []response{r.response(names)}})
+}
+
+// reportRequest is the body of a REPORT request: addressbook-multiget,
+// addressbook-query or sync-collection.
+type reportRequest struct {
+	XMLName   xml.Name
+	Prop      propNames   `xml:"DAV: prop"`
+	Hrefs     []string    `xml:"DAV: href"`
+	SyncToken string      `xml:"DAV: sync-token"`
+	Limit     int         `xml:"limit>nresults"`
+	Filter    *cardFilter `xml:"urn:ietf:params:xml:ns:carddav filter"`
+}
+
+func reportAddressbook(c echo.Context) error {
+	if err := allowWholeType(c, permissions.GET, consts.Contacts); err != nil {
+		return err
+	}
+	var req reportRequest
+	if err := xml.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid XML body")
+	}
+	switch req.XMLName {
+	case xml.Name{Space: nsCardDAV, Local: "addressbook-multiget"}:
+		return addressbookMultiget(c, &req)
+	case xml.Name{Space: nsCardDAV, Local: "addressbook-query"}:
+		return addressbookQuery(c, &req)
+	case xml.Name{Space: nsDAV, Local: "sync-collection"}:
+		return syncAddressbook(c, &req)
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, "Unsupported report")
+}
+
+func addressbookMultiget(c echo.Context, req *reportRequest) error {
+	ms := &multistatus{}
+	var ids []string
+	for _, href := range req.Hrefs {
+		id, ok := contactIDFromHref(href)
+		if !ok {
+			ms.Responses = append(ms.Responses, response{Href: href, Status: statusLine(http.StatusNotFound)})
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) > 0 {
+		var list []*contacts.Contact
+		allReq := &couchdb.AllDocsRequest{Keys: ids}
+		err := couchdb.GetAllDocs(middlewares.GetInstance(c), consts.Contacts, allReq, &list)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+		found := make(map[string]*contacts.Contact, len(list))
+		for _, contact := range list {
+			if contact != nil {
+				found[contact.ID()] = contact
+			}
+		}
+		for _, id := range ids {
+			contact, ok := found[id]
+			if !ok {
+				ms.Responses = append(ms.Responses, response{Href: contactHref(id), Status: statusLine(http.StatusNotFound)})
+				continue
+			}
+			r, err := contactResource(contact, req.Prop)
+			if err != nil {
+				return err
+			}
+			ms.Responses = append(ms.Responses, r.response(req.Prop))
+		}
+	}
+	return sendMultistatus(c, ms)
+}
+
+func addressbookQuery(c echo.Context, req *reportRequest) error {
+	list, err := contacts.GetAll(middlewares.GetInstance(c))
+	if err != nil {
+		return err
+	}
+	ms := &multistatus{}
+	for _, contact := range list {
+		if req.Limit > 0 && len(ms.Responses) >= req.Limit {
+			break
+		}
+		if !req.Filter.match(contact.ToVCard()) {
+			continue
+		}
+		r, err := contactResource(contact, req.Prop)
+		if err != nil {
+			return err
+		}
+		ms.Responses = append(ms.Responses, r.response(req.Prop))
+	}
+	return sendMultistatus(c, ms)
+}
+
+// syncAddressbook implements the sync-collection report of RFC 6578. The
+// sync token is built from the update sequence of CouchDB: without a token,
+// all the contacts are sent, else the contacts changed since the token are
+// sent, and the deleted ones are sent with a 404 status.
+func syncAddressbook(c echo.Context, req *reportRequest) error {
+	inst := middlewares.GetInstance(c)
+	ms := &multistatus{}
+
+	if req.SyncToken == "" {
+		seq, err := lastSeq(c, consts.Contacts)
+		if err != nil {
+			return err
+		}
+		list, err := contacts.GetAll(inst)
+		if err != nil {
+			return err
+		}
+		for _, contact := range list {
+			r, err := contactResource(contact, req.Prop)
+			if err != nil {
+				return err
+			}
+			ms.Responses = append(ms.Responses, r.response(req.Prop))
+		}
+		ms.SyncToken = syncTokenPrefix + seq
+		return sendMultistatus(c, ms)
+	}
+
+	changes, seq, err := changesSince(c, consts.Contacts, req.SyncToken)
+	if err == errInvalidSyncToken {
+		return sendInvalidSyncToken(c)
+	}
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if change.Doc.M["_deleted"] == true {
+			ms.Responses = append(ms.Responses, response{Href: contactHref(change.DocID), Status: statusLine(http.StatusNotFound)})
+			continue
+		}
+		raw, err := json.Marshal(change.Doc)
+		if err != nil {
+			return err
+		}
+		var contact contacts.Contact
+		if err = json.Unmarshal(raw, &contact); err != nil {
+			return err
+		}
+		r, err := contactResource(&contact, req.Prop)
+		if err != nil {
+			return err
+		}
+		ms.Responses = append(ms.Responses, r.response(req.Prop))
+	}
+	ms.SyncToken = syncTokenPrefix + seq
+	return sendMultistatus(c, ms)
+}
+
+func findContact(c echo.Context, id string) (*contacts.Contact, error) {
+	contact, err := contacts.Find(middlewares.GetInstance(c), id)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return contact, nil
+}
+
+func getVCard(c echo.Context, id string) error {
+	if err := allowWholeType(c, permissions.GET, consts.Contacts); err != nil {
+		return err
+	}
+	contact, err := findContact(c, id)
+	if err != nil {
+		return err
+	}
+	if contact == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	data, err := vcardData(contact)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("ETag", etag(contact.Rev()))
+	return c.Blob(http.StatusOK, vcardType, []byte(data))
+}
+
+// putVCard creates or updates a contact from the vCard in the request body.
+// The vCard is converted to the fields of the contact, so no ETag is sent in
+// the response, and the client will have to fetch the vCard again.
+func putVCard(c echo.Context, id string) error {
+	old, err := findContact(c, id)
+	if err != nil {
+		return err
+	}
+	verb := permissions.PUT
+	if old == nil {
+		verb = permissions.POST
+	}
+	if err = allowWholeType(c, verb, consts.Contacts); err != nil {
+		return err
+	}
+	oldRev := ""
+	if old != nil {
+		oldRev = old.Rev()
+	}
+	if !checkPreconditions(c, oldRev) {
+		return c.NoContent(http.StatusPreconditionFailed)
+	}
+
+	list, err := contacts.ParseVCards(io.LimitReader(c.Request().Body, maxVCardSize))
+	if err != nil || len(list) != 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, contacts.ErrInvalidVCard.Error())
+	}
+	contact := list[0]
+	inst := middlewares.GetInstance(c)
+
+	if old == nil {
+		contact.SetID(id)
+		if err = couchdb.CreateNamedDocWithDB(inst, contact); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusCreated)
+	}
+
+	// The cozy instances of the contact are not in the vCard
+	contact.SetID(old.ID())
+	contact.SetRev(old.Rev())
+	contact.Cozy = old.Cozy
+	if err = couchdb.UpdateDoc(inst, contact); err != nil {
+		if couchdb.IsConflictError(err) {
+			return c.NoContent(http.StatusPreconditionFailed)
+		}
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func deleteVCard(c echo.Context, id string) error {
+	if err := allowWholeType(c, permissions.DELETE, consts.Contacts); err != nil {
+		return err
+	}
+	contact, err := findContact(c, id)
+	if err != nil {
+		return err
+	}
+	if contact == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if !checkPreconditions(c, contact.Rev()) {
+		return c.NoContent(http.StatusPreconditionFailed)
+	}
+	if err = couchdb.DeleteDoc(middlewares.GetInstance(c), contact); err != nil {
+		if couchdb.IsConflictError(err) {
+			return c.NoContent(http.StatusPreconditionFailed)
+		}
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// cardFilter is the filter of an addressbook-query report (RFC 6352 section
+// 10.5). The param-filter elements are not supported and are ignored.
+type cardFilter struct {
+	Test  string       `xml:"test,attr"`
+	Props []propFilter `xml:"urn:ietf:params:xml:ns:carddav prop-filter"`
+}
+
+type propFilter struct {
+	Name         string      `xml:"name,attr"`
+	Test         string      `xml:"test,attr"`
+	IsNotDefined *struct{}   `xml:"urn:ietf:params:xml:ns:carddav is-not-defined"`
+	TextMatches  []textMatch `xml:"urn:ietf:params:xml:ns:carddav text-match"`
+}
+
+type textMatch struct {
+	Text      string `xml:",chardata"`
+	MatchType string `xml:"match-type,attr"`
+	Negate    string `xml:"negate-condition,attr"`
+}
+
+// match returns true if the vCard matches the filter. The default test is
+// anyof.
+func (f *cardFilter) match(card vcard.Card) bool {
+	if f == nil || len(f.Props) == 0 {
+		return true
+	}
+	allof := f.Test == "allof"
+	for _, pf := range f.Props {
+		ok := pf.match(card)
+		if allof && !ok {
+			return false
+		}
+		if !allof && ok {
+			return true
+		}
+	}
+	return allof
+}
+
+func (pf *propFilter) match(card vcard.Card) bool {
+	fields := card[strings.ToUpper(pf.Name)]
+	if pf.IsNotDefined != nil {
+		return len(fields) == 0
+	}
+	if len(pf.TextMatches) == 0 {
+		return len(fields) > 0
+	}
+	allof := pf.Test == "allof"
+	for _, tm := range pf.TextMatches {
+		ok := tm.match(fields)
+		if allof && !ok {
+			return false
+		}
+		if !allof && ok {
+			return true
+		}
+	}
+	return allof
+}
+
+// match returns true if one of the fields matches the text. The comparison
+// is case-insensitive and the default match type is contains.
+func (tm *textMatch) match(fields []*vcard.Field) bool {
+	text := strings.ToLower(tm.Text)
+	found := false
+	for _, f := range fields {
+		value := strings.ToLower(f.Value)
+		switch tm.MatchType {
+		case "equals":
+			found = value == text
+		case "starts-with":
+			found = strings.HasPrefix(value, text)
+		case "ends-with":
+			found = strings.HasSuffix(value, text)
+		default:
+			found = strings.Contains(value, text)
+		}
+		if found {
+			break
+		}
+	}
+	if tm.Negate == "yes" {
+		return !found
+	}
+	return found
+}
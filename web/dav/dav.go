@@ -0,0 +1,495 @@
+// Package dav is the DAV servers of the stack: CardDAV for the contacts and
+// CalDAV for the events of the calendar. The clients authenticate with an app
+// password, generated by the user from the settings, via HTTP Basic Auth.
+package dav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+const (
+	nsDAV     = "DAV:"
+	nsCardDAV = "urn:ietf:params:xml:ns:carddav"
+	nsCalDAV  = "urn:ietf:params:xml:ns:caldav"
+	nsCS      = "http://calendarserver.org/ns/"
+)
+
+// contextMethod is the key in the echo context of the WebDAV methods that the
+// echo router doesn't know, like REPORT. It is never read from the request,
+// as the method must not be chosen by a header sent by the client.
+const contextMethod = "dav_method"
+
+const contextAppPassword = "app_password"
+
+// errInvalidSyncToken is sent when a client tries to sync with a token that
+// has not been generated by the stack, as explained in RFC 6578.
+var errInvalidSyncToken = errors.New("Invalid sync token")
+
+const (
+	rootPath      = "/dav/"
+	principalPath = "/dav/principal/"
+)
+
+// syncTokenPrefix is the prefix of the sync tokens, which must be URIs. The
+// rest of the token is the update sequence of the CouchDB database.
+const syncTokenPrefix = "https://cozy.io/ns/sync/"
+
+// privileges is the value of the current-user-privilege-set property: the
+// app password can read and write, but the permissions are checked on each
+// request.
+const privileges = `<privilege xmlns="DAV:"><read xmlns="DAV:"/></privilege>` +
+	`<privilege xmlns="DAV:"><write xmlns="DAV:"/></privilege>` +
+	`<privilege xmlns="DAV:"><write-content xmlns="DAV:"/></privilege>` +
+	`<privilege xmlns="DAV:"><bind xmlns="DAV:"/></privilege>` +
+	`<privilege xmlns="DAV:"><unbind xmlns="DAV:"/></privilege>`
+
+// TunnelMethods is a middleware, to be used with echo.Pre, that makes the
+// REPORT requests on the DAV routes pass the router, by changing them to
+// PROPFIND requests. The real method is kept in the context.
+func TunnelMethods(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Method == "REPORT" && strings.HasPrefix(req.URL.Path, "/dav/") {
+			c.Set(contextMethod, req.Method)
+			req.Method = echo.PROPFIND
+		}
+		return next(c)
+	}
+}
+
+// WellKnown redirects the /.well-known/carddav and /.well-known/caldav
+// requests to the root of the DAV server, as explained in RFC 6764.
+func WellKnown(c echo.Context) error {
+	return c.Redirect(http.StatusMovedPermanently, rootPath)
+}
+
+func method(c echo.Context) string {
+	if m, ok := c.Get(contextMethod).(string); ok {
+		return m
+	}
+	return c.Request().Method
+}
+
+// services returns the services of the app passwords that can be used for
+// the request: the discovery of the principal is shared by CardDAV and CalDAV,
+// and the webdav service gives access to all the DAV routes.
+func services(c echo.Context) []string {
+	path := strings.Trim(c.Param("*"), "/")
+	switch strings.Split(path, "/")[0] {
+	case "contacts":
+		return []string{oauth.ServiceWebDAV, oauth.ServiceCardDAV}
+	case "calendars":
+		return []string{oauth.ServiceWebDAV, oauth.ServiceCalDAV}
+	}
+	return []string{oauth.ServiceWebDAV, oauth.ServiceCardDAV, oauth.ServiceCalDAV}
+}
+
+// checkAppPassword is a middleware that authenticates the request with the
+// app password in the HTTP Basic Auth header. The username is ignored.
+func checkAppPassword(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Request().Method == http.MethodOptions {
+			return next(c)
+		}
+		inst := middlewares.GetInstance(c)
+		_, password, ok := c.Request().BasicAuth()
+		if !ok {
+			return unauthorized(c)
+		}
+		// The attempts are counted with the logins on the web and the SFTP
+		// server, to avoid a brute force attack on the app passwords.
+		if err := limits.CheckRateLimit(inst, limits.AuthType); err != nil {
+			if err == limits.ErrRateLimitReached {
+				inst.Logger().WithField("nspace", "dav").Warnf("Too many login attempts")
+				return c.NoContent(http.StatusTooManyRequests)
+			}
+			inst.Logger().WithField("nspace", "dav").
+				Errorf("Could not check the rate limit: %s", err)
+		}
+		ap, err := oauth.CheckAppPassword(inst, password, services(c)...)
+		if err != nil {
+			if err == oauth.ErrInvalidAppPassword {
+				return unauthorized(c)
+			}
+			return err
+		}
+		_ = limits.ResetCounter(inst, limits.AuthType)
+		c.Set(contextAppPassword, ap)
+		return next(c)
+	}
+}
+
+func unauthorized(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="Cozy"`)
+	return c.NoContent(http.StatusUnauthorized)
+}
+
+// allowWholeType checks that the app password of the request gives the
+// permission on the whole doctype for the verb.
+func allowWholeType(c echo.Context, v permissions.Verb, doctype string) error {
+	ap, ok := c.Get(contextAppPassword).(*oauth.AppPassword)
+	if !ok {
+		return middlewares.ErrForbidden
+	}
+	set, err := ap.Permissions()
+	if err != nil {
+		return err
+	}
+	if !set.AllowWholeType(v, doctype) {
+		return middlewares.ErrForbidden
+	}
+	return nil
+}
+
+// depth returns the value of the Depth header: 0 or 1. Infinity is treated
+// like 1, as there are no nested collections.
+func depth(c echo.Context) int {
+	if c.Request().Header.Get("Depth") == "0" {
+		return 0
+	}
+	return 1
+}
+
+// multistatus is the body of the responses to PROPFIND and REPORT requests
+type multistatus struct {
+	XMLName   xml.Name   `xml:"DAV: multistatus"`
+	Responses []response `xml:"response"`
+	SyncToken string     `xml:"sync-token,omitempty"`
+}
+
+type response struct {
+	Href      string     `xml:"href"`
+	Status    string     `xml:"status,omitempty"`
+	Propstats []propstat `xml:"propstat,omitempty"`
+}
+
+type propstat struct {
+	Props  []property `xml:"prop>property"`
+	Status string     `xml:"status"`
+}
+
+// property is a WebDAV property, with its value as raw XML. The name of the
+// element is given by XMLName, not by the tag of the field in propstat.
+type property struct {
+	XMLName xml.Name
+	Inner   string `xml:",innerxml"`
+}
+
+func statusLine(code int) string {
+	return "HTTP/1.1 " + strconv.Itoa(code) + " " + http.StatusText(code)
+}
+
+// escape returns the text, escaped to be put inside a XML element
+func escape(text string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(text))
+	return buf.String()
+}
+
+func textProp(space, local, text string) property {
+	return property{XMLName: xml.Name{Space: space, Local: local}, Inner: escape(text)}
+}
+
+func hrefProp(space, local, href string) property {
+	return property{
+		XMLName: xml.Name{Space: space, Local: local},
+		Inner:   `<href xmlns="DAV:">` + escape(href) + `</href>`,
+	}
+}
+
+func rawProp(space, local, inner string) property {
+	return property{XMLName: xml.Name{Space: space, Local: local}, Inner: inner}
+}
+
+func etag(rev string) string {
+	return `"` + rev + `"`
+}
+
+// checkPreconditions checks the If-Match and If-None-Match headers of the
+// request, for a resource with the given revision (empty if the resource
+// doesn't exist).
+func checkPreconditions(c echo.Context, rev string) bool {
+	header := c.Request().Header
+	if match := header.Get("If-Match"); match != "" {
+		if rev == "" {
+			return false
+		}
+		if match != "*" && match != etag(rev) {
+			return false
+		}
+	}
+	if noneMatch := header.Get("If-None-Match"); noneMatch != "" && rev != "" {
+		if noneMatch == "*" || noneMatch == etag(rev) {
+			return false
+		}
+	}
+	return true
+}
+
+func supportedReports(reports ...xml.Name) string {
+	var inner string
+	for _, r := range reports {
+		inner += `<supported-report xmlns="DAV:"><report xmlns="DAV:">` +
+			`<` + r.Local + ` xmlns="` + r.Space + `"/></report></supported-report>`
+	}
+	return inner
+}
+
+// lastSeq returns the last update sequence of the database of the doctype,
+// used for the ctags and the sync tokens.
+func lastSeq(c echo.Context, doctype string) (string, error) {
+	res, err := couchdb.GetChanges(middlewares.GetInstance(c), &couchdb.ChangesRequest{
+		DocType: doctype,
+		Since:   "now",
+	})
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return "0", nil
+		}
+		return "", err
+	}
+	return res.LastSeq, nil
+}
+
+// changesSince returns the changes of the doctype since the sync token, with
+// the new update sequence. The design docs are filtered out.
+func changesSince(c echo.Context, doctype, token string) ([]couchdb.Change, string, error) {
+	if !strings.HasPrefix(token, syncTokenPrefix) {
+		return nil, "", errInvalidSyncToken
+	}
+	since := strings.TrimPrefix(token, syncTokenPrefix)
+	res, err := couchdb.GetChanges(middlewares.GetInstance(c), &couchdb.ChangesRequest{
+		DocType:     doctype,
+		Since:       since,
+		IncludeDocs: true,
+	})
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, since, nil
+		}
+		if couchErr, ok := err.(*couchdb.Error); ok && couchErr.StatusCode == http.StatusBadRequest {
+			return nil, "", errInvalidSyncToken
+		}
+		return nil, "", err
+	}
+	var changes []couchdb.Change
+	for _, change := range res.Results {
+		if !strings.HasPrefix(change.DocID, "_design") {
+			changes = append(changes, change)
+		}
+	}
+	return changes, res.LastSeq, nil
+}
+
+// resource is something that can be described by a response of a PROPFIND
+// request: a collection, a contact, etc.
+type resource struct {
+	href  string
+	props []property
+}
+
+// response returns the response for the requested properties. The known
+// properties are in a propstat with a 200 status, the unknown ones are in a
+// propstat with a 404 status. If no properties are requested, all the
+// properties are returned.
+func (r *resource) response(names []xml.Name) response {
+	res := response{Href: r.href}
+	if len(names) == 0 {
+		res.Propstats = []propstat{{Props: r.props, Status: statusLine(http.StatusOK)}}
+		return res
+	}
+	var found, missing []property
+	for _, name := range names {
+		p, ok := r.find(name)
+		if ok {
+			found = append(found, p)
+		} else {
+			missing = append(missing, property{XMLName: name})
+		}
+	}
+	if len(found) > 0 {
+		res.Propstats = append(res.Propstats, propstat{Props: found, Status: statusLine(http.StatusOK)})
+	}
+	if len(missing) > 0 {
+		res.Propstats = append(res.Propstats, propstat{Props: missing, Status: statusLine(http.StatusNotFound)})
+	}
+	return res
+}
+
+func (r *resource) find(name xml.Name) (property, bool) {
+	for _, p := range r.props {
+		if p.XMLName == name {
+			return p, true
+		}
+	}
+	return property{}, false
+}
+
+// propNames is the list of the properties requested in a <prop> element
+type propNames []xml.Name
+
+func (pn *propNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			*pn = append(*pn, t.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+func (pn propNames) contains(space, local string) bool {
+	for _, name := range pn {
+		if name.Space == space && name.Local == local {
+			return true
+		}
+	}
+	return false
+}
+
+// propfindRequest is the body of a PROPFIND request. An empty body is
+// equivalent to allprop.
+type propfindRequest struct {
+	XMLName xml.Name  `xml:"DAV: propfind"`
+	Prop    propNames `xml:"DAV: prop"`
+}
+
+func parsePropfind(c echo.Context) (propNames, error) {
+	var req propfindRequest
+	err := xml.NewDecoder(c.Request().Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid XML body")
+	}
+	return req.Prop, nil
+}
+
+// sendInvalidSyncToken sends the response for errInvalidSyncToken, with the
+// precondition in the body.
+func sendInvalidSyncToken(c echo.Context) error {
+	body := xml.Header + `<error xmlns="DAV:"><valid-sync-token/></error>`
+	return c.Blob(http.StatusForbidden, "application/xml; charset=utf-8", []byte(body))
+}
+
+func sendMultistatus(c echo.Context, ms *multistatus) error {
+	body, err := xml.Marshal(ms)
+	if err != nil {
+		return err
+	}
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/xml; charset=utf-8")
+	res.WriteHeader(http.StatusMultiStatus)
+	if _, err = res.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	_, err = res.Write(body)
+	return err
+}
+
+func options(c echo.Context) error {
+	header := c.Response().Header()
+	header.Set("DAV", "1, 3, addressbook, calendar-access")
+	header.Set(echo.HeaderAllow, "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+	return c.NoContent(http.StatusOK)
+}
+
+// principal is the resource that describes the user, and where its address
+// books and calendars can be found.
+func principal(c echo.Context) *resource {
+	inst := middlewares.GetInstance(c)
+	name, _ := inst.PublicName()
+	return &resource{
+		href: principalPath,
+		props: []property{
+			rawProp(nsDAV, "resourcetype", `<collection xmlns="DAV:"/><principal xmlns="DAV:"/>`),
+			textProp(nsDAV, "displayname", name),
+			hrefProp(nsDAV, "current-user-principal", principalPath),
+			hrefProp(nsDAV, "principal-URL", principalPath),
+			hrefProp(nsCardDAV, "addressbook-home-set", contactsPath),
+			hrefProp(nsCalDAV, "calendar-home-set", calendarsPath),
+		},
+	}
+}
+
+func serveRoot(c echo.Context) error {
+	names, err := parsePropfind(c)
+	if err != nil {
+		return err
+	}
+	root := &resource{
+		href: rootPath,
+		props: []property{
+			rawProp(nsDAV, "resourcetype", `<collection xmlns="DAV:"/>`),
+			hrefProp(nsDAV, "current-user-principal", principalPath),
+		},
+	}
+	ms := &multistatus{Responses: []response{root.response(names)}}
+	if depth(c) > 0 {
+		ms.Responses = append(ms.Responses, principal(c).response(names))
+	}
+	return sendMultistatus(c, ms)
+}
+
+func servePrincipal(c echo.Context) error {
+	names, err := parsePropfind(c)
+	if err != nil {
+		return err
+	}
+	ms := &multistatus{Responses: []response{principal(c).response(names)}}
+	return sendMultistatus(c, ms)
+}
+
+// serve dispatches the DAV requests, as the echo router can't route on the
+// WebDAV methods.
+func serve(c echo.Context) error {
+	m := method(c)
+	if m == http.MethodOptions {
+		return options(c)
+	}
+
+	path := strings.Trim(c.Param("*"), "/")
+	parts := strings.Split(path, "/")
+	switch parts[0] {
+	case "":
+		if m == echo.PROPFIND {
+			return serveRoot(c)
+		}
+	case "principal":
+		if len(parts) == 1 && m == echo.PROPFIND {
+			return servePrincipal(c)
+		}
+	case "contacts":
+		return serveCardDAV(c, m, parts[1:])
+	case "calendars":
+		return serveCalDAV(c, m, parts[1:])
+	default:
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.NoContent(http.StatusMethodNotAllowed)
+}
+
+// Routes sets the routing for the DAV servers
+func Routes(router *echo.Group) {
+	router.Any("", serve, checkAppPassword)
+	router.Any("/*", serve, checkAppPassword)
+}
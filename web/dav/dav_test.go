@@ -0,0 +1,338 @@
+package dav
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var password string
+
+const johnCard = `BEGIN:VCARD
+VERSION:3.0
+N:Doe;John;;;
+FN:John Doe
+EMAIL;TYPE=INTERNET:john@example.net
+END:VCARD
+`
+
+const meeting = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Example//Example//EN\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:meeting@example.com\r\n" +
+	"DTSTART:20181204T090000Z\r\n" +
+	"DTEND:20181204T103000Z\r\n" +
+	"SUMMARY:Meeting\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func doRequest(method, path, pass, body string, headers map[string]string) (*http.Response, string) {
+	req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	req.SetBasicAuth("alice", pass)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	return res, string(b)
+}
+
+func TestUnauthorized(t *testing.T) {
+	res, _ := doRequest("PROPFIND", "/dav/", "", "", nil)
+	assert.Equal(t, 401, res.StatusCode)
+	assert.Contains(t, res.Header.Get("WWW-Authenticate"), "Basic")
+	res, _ = doRequest("PROPFIND", "/dav/", "wrong password", "", nil)
+	assert.Equal(t, 401, res.StatusCode)
+}
+
+func TestRateLimitedLogin(t *testing.T) {
+	defer func() { _ = limits.ResetCounter(testInstance, limits.AuthType) }()
+
+	// A successful login resets the counter
+	for i := 0; i < 30; i++ {
+		res, _ := doRequest("PROPFIND", "/dav/", "wrong password", "", nil)
+		assert.Equal(t, 401, res.StatusCode)
+	}
+	res, _ := doRequest("PROPFIND", "/dav/principal/", password, "", nil)
+	assert.Equal(t, 207, res.StatusCode)
+
+	limited := false
+	for i := 0; i < 100 && !limited; i++ {
+		res, _ = doRequest("PROPFIND", "/dav/", "wrong password", "", nil)
+		limited = res.StatusCode == 429
+	}
+	assert.True(t, limited)
+	res, _ = doRequest("PROPFIND", "/dav/principal/", password, "", nil)
+	assert.Equal(t, 429, res.StatusCode)
+}
+
+func TestMethodHeaderIgnored(t *testing.T) {
+	body := `<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:displayname/></d:prop></d:propfind>`
+	headers := map[string]string{"X-Cozy-Dav-Method": "DELETE"}
+	res, _ := doRequest("PROPFIND", "/dav/principal/", password, body, headers)
+	assert.Equal(t, 207, res.StatusCode)
+}
+
+func TestPropfindPrincipal(t *testing.T) {
+	body := `<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav">
+  <d:prop><card:addressbook-home-set/><d:unknown/></d:prop>
+</d:propfind>`
+	res, out := doRequest("PROPFIND", "/dav/principal/", password, body, nil)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, out, `<href xmlns="DAV:">/dav/contacts/</href>`)
+	assert.Contains(t, out, "404 Not Found")
+}
+
+func TestPropfindAddressbook(t *testing.T) {
+	headers := map[string]string{"Depth": "0"}
+	res, out := doRequest("PROPFIND", "/dav/contacts/addressbook/", password, "", headers)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, out, `<addressbook xmlns="urn:ietf:params:xml:ns:carddav"/>`)
+	assert.Contains(t, out, "https://cozy.io/ns/sync/")
+}
+
+func TestPutAndGetVCard(t *testing.T) {
+	res, _ := doRequest("PUT", "/dav/contacts/addressbook/john.vcf", password, johnCard, nil)
+	assert.Equal(t, 201, res.StatusCode)
+
+	headers := map[string]string{"If-None-Match": "*"}
+	res, _ = doRequest("PUT", "/dav/contacts/addressbook/john.vcf", password, johnCard, headers)
+	assert.Equal(t, 412, res.StatusCode)
+
+	res, out := doRequest("GET", "/dav/contacts/addressbook/john.vcf", password, "", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, out, "FN:John Doe")
+	etag := res.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	headers = map[string]string{"If-Match": `"1-wrong"`}
+	res, _ = doRequest("PUT", "/dav/contacts/addressbook/john.vcf", password, johnCard, headers)
+	assert.Equal(t, 412, res.StatusCode)
+
+	updated := strings.Replace(johnCard, "FN:John Doe", "FN:Johnny Doe", 1)
+	headers = map[string]string{"If-Match": etag}
+	res, _ = doRequest("PUT", "/dav/contacts/addressbook/john.vcf", password, updated, headers)
+	assert.Equal(t, 204, res.StatusCode)
+
+	res, out = doRequest("GET", "/dav/contacts/addressbook/john.vcf", password, "", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, out, "FN:Johnny Doe")
+}
+
+func TestAddressbookQuery(t *testing.T) {
+	body := `<?xml version="1.0"?>
+<C:addressbook-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+  <D:prop><D:getetag/><C:address-data/></D:prop>
+  <C:filter>
+    <C:prop-filter name="EMAIL">
+      <C:text-match match-type="starts-with">JOHN@</C:text-match>
+    </C:prop-filter>
+  </C:filter>
+</C:addressbook-query>`
+	res, out := doRequest("REPORT", "/dav/contacts/addressbook/", password, body, nil)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, out, "/dav/contacts/addressbook/john.vcf")
+	assert.Contains(t, out, "FN:Johnny Doe")
+
+	body = strings.Replace(body, "JOHN@", "jane@", 1)
+	res, out = doRequest("REPORT", "/dav/contacts/addressbook/", password, body, nil)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.NotContains(t, out, "john.vcf")
+}
+
+func TestAddressbookMultiget(t *testing.T) {
+	body := `<?xml version="1.0"?>
+<C:addressbook-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+  <D:prop><D:getetag/><C:address-data/></D:prop>
+  <D:href>/dav/contacts/addressbook/john.vcf</D:href>
+  <D:href>/dav/contacts/addressbook/missing.vcf</D:href>
+</C:addressbook-multiget>`
+	res, out := doRequest("REPORT", "/dav/contacts/addressbook/", password, body, nil)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, out, "FN:Johnny Doe")
+	assert.Contains(t, out, "<href>/dav/contacts/addressbook/missing.vcf</href><status>HTTP/1.1 404 Not Found</status>")
+}
+
+func TestSyncCollection(t *testing.T) {
+	body := `<?xml version="1.0"?>
+<d:sync-collection xmlns:d="DAV:">
+  <d:sync-token></d:sync-token>
+  <d:sync-level>1</d:sync-level>
+  <d:prop><d:getetag/></d:prop>
+</d:sync-collection>`
+	res, out := doRequest("REPORT", "/dav/contacts/addressbook/", password, body, nil)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, out, "/dav/contacts/addressbook/john.vcf")
+	matches := regexp.MustCompile(`<sync-token>([^<]+)</sync-token>`).FindStringSubmatch(out)
+	if !assert.Len(t, matches, 2) {
+		return
+	}
+	token := matches[1]
+
+	res, _ = doRequest("DELETE", "/dav/contacts/addressbook/john.vcf", password, "", nil)
+	assert.Equal(t, 204, res.StatusCode)
+
+	body = strings.Replace(body, "<d:sync-token></d:sync-token>", "<d:sync-token>"+token+"</d:sync-token>", 1)
+	res, out = doRequest("REPORT", "/dav/contacts/addressbook/", password, body, nil)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, out, "<href>/dav/contacts/addressbook/john.vcf</href><status>HTTP/1.1 404 Not Found</status>")
+
+	body = strings.Replace(body, token, "invalid", 1)
+	res, out = doRequest("REPORT", "/dav/contacts/addressbook/", password, body, nil)
+	assert.Equal(t, 403, res.StatusCode)
+	assert.Contains(t, out, "valid-sync-token")
+}
+
+func TestPutAndGetICalendar(t *testing.T) {
+	res, _ := doRequest("PUT", "/dav/calendars/calendar/meeting.ics", password, meeting, nil)
+	assert.Equal(t, 201, res.StatusCode)
+
+	res, out := doRequest("GET", "/dav/calendars/calendar/meeting.ics", password, "", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/calendar; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Contains(t, out, "SUMMARY:Meeting\r\n")
+	etag := res.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	updated := strings.Replace(meeting, "SUMMARY:Meeting", "SUMMARY:Weekly meeting", 1)
+	headers := map[string]string{"If-Match": etag}
+	res, _ = doRequest("PUT", "/dav/calendars/calendar/meeting.ics", password, updated, headers)
+	assert.Equal(t, 204, res.StatusCode)
+
+	res, _ = doRequest("PUT", "/dav/calendars/calendar/meeting.ics", password, "not an iCalendar", nil)
+	assert.Equal(t, 400, res.StatusCode)
+}
+
+func TestCalendarQuery(t *testing.T) {
+	body := `<?xml version="1.0"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop><D:getetag/><C:calendar-data/></D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:time-range start="20181204T000000Z" end="20181205T000000Z"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`
+	res, out := doRequest("REPORT", "/dav/calendars/calendar/", password, body, nil)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, out, "/dav/calendars/calendar/meeting.ics")
+	assert.Contains(t, out, "SUMMARY:Weekly meeting")
+
+	body = strings.Replace(body, "20181204T000000Z", "20181205T000000Z", 1)
+	body = strings.Replace(body, "20181205T000000Z\"/>", "20181206T000000Z\"/>", 1)
+	res, out = doRequest("REPORT", "/dav/calendars/calendar/", password, body, nil)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.NotContains(t, out, "meeting.ics")
+}
+
+func TestSyncCalendar(t *testing.T) {
+	body := `<?xml version="1.0"?>
+<d:sync-collection xmlns:d="DAV:">
+  <d:sync-token></d:sync-token>
+  <d:sync-level>1</d:sync-level>
+  <d:prop><d:getetag/></d:prop>
+</d:sync-collection>`
+	res, out := doRequest("REPORT", "/dav/calendars/calendar/", password, body, nil)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, out, "/dav/calendars/calendar/meeting.ics")
+	matches := regexp.MustCompile(`<sync-token>([^<]+)</sync-token>`).FindStringSubmatch(out)
+	if !assert.Len(t, matches, 2) {
+		return
+	}
+	token := matches[1]
+
+	res, _ = doRequest("DELETE", "/dav/calendars/calendar/meeting.ics", password, "", nil)
+	assert.Equal(t, 204, res.StatusCode)
+
+	body = strings.Replace(body, "<d:sync-token></d:sync-token>", "<d:sync-token>"+token+"</d:sync-token>", 1)
+	res, out = doRequest("REPORT", "/dav/calendars/calendar/", password, body, nil)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, out, "<href>/dav/calendars/calendar/meeting.ics</href><status>HTTP/1.1 404 Not Found</status>")
+}
+
+func TestPermissions(t *testing.T) {
+	_, files, err := oauth.CreateAppPassword(testInstance, "files only", consts.Files, nil)
+	assert.NoError(t, err)
+	res, _ := doRequest("PROPFIND", "/dav/contacts/addressbook/", files, "", nil)
+	assert.Equal(t, 403, res.StatusCode)
+	res, _ = doRequest("PROPFIND", "/dav/calendars/calendar/", files, "", nil)
+	assert.Equal(t, 403, res.StatusCode)
+}
+
+func TestServices(t *testing.T) {
+	_, calendar, err := oauth.CreateAppPassword(testInstance, "calendar only",
+		consts.Contacts+" "+consts.Events, []string{oauth.ServiceCalDAV})
+	assert.NoError(t, err)
+	res, _ := doRequest("PROPFIND", "/dav/contacts/addressbook/", calendar, "", nil)
+	assert.Equal(t, 401, res.StatusCode)
+	res, _ = doRequest("PROPFIND", "/dav/calendars/calendar/", calendar, "", nil)
+	assert.Equal(t, 207, res.StatusCode)
+	res, _ = doRequest("PROPFIND", "/dav/principal/", calendar, "", nil)
+	assert.Equal(t, 207, res.StatusCode)
+
+	_, sftp, err := oauth.CreateAppPassword(testInstance, "sftp only",
+		consts.Contacts+" "+consts.Events, []string{oauth.ServiceSFTP})
+	assert.NoError(t, err)
+	res, _ = doRequest("PROPFIND", "/dav/principal/", sftp, "", nil)
+	assert.Equal(t, 401, res.StatusCode)
+	res, _ = doRequest("PROPFIND", "/dav/calendars/calendar/", sftp, "", nil)
+	assert.Equal(t, 401, res.StatusCode)
+	_, err = oauth.CheckAppPassword(testInstance, sftp)
+	assert.Equal(t, oauth.ErrInvalidAppPassword, err)
+
+	_, webdav, err := oauth.CreateAppPassword(testInstance, "webdav",
+		consts.Contacts+" "+consts.Events, []string{oauth.ServiceWebDAV})
+	assert.NoError(t, err)
+	res, _ = doRequest("PROPFIND", "/dav/contacts/addressbook/", webdav, "", nil)
+	assert.Equal(t, 207, res.StatusCode)
+	res, _ = doRequest("PROPFIND", "/dav/calendars/calendar/", webdav, "", nil)
+	assert.Equal(t, 207, res.StatusCode)
+	res, _ = doRequest("PROPFIND", "/dav/principal/", webdav, "", nil)
+	assert.Equal(t, 207, res.StatusCode)
+
+	_, _, err = oauth.CreateAppPassword(testInstance, "unknown", consts.Contacts, []string{"ftp"})
+	assert.Equal(t, oauth.ErrUnknownAppPasswordService, err)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "dav_test")
+	testInstance = setup.GetTestInstance()
+
+	var err error
+	_, password, err = oauth.CreateAppPassword(testInstance, "my phone", consts.Contacts+" "+consts.Events, nil)
+	if err != nil {
+		setup.CleanupAndDie("Cannot create the app password", err)
+	}
+
+	ts = setup.GetTestServer("/dav", Routes, func(e *echo.Echo) *echo.Echo {
+		e.Pre(TunnelMethods)
+		return e
+	})
+	os.Exit(setup.Run())
+}
@@ -12,7 +12,8 @@ import (
 // devMailHandler allow to easily render a mail from a route of the stack. The
 // query parameters are used as data input for the mail template. The
 // ContentType query parameter allow to render the mail in "text/html" or
-// "text/plain".
+// "text/plain", the context one with the translations of a context, and the
+// logo one with the URL of the logo in the header.
 func devMailsHandler(c echo.Context) error {
 	name := c.Param("name")
 	locale := c.QueryParam("locale")
@@ -25,7 +26,9 @@ func devMailsHandler(c echo.Context) error {
 		recipientName = "Jean Dupont"
 	}
 
-	_, parts, err := mails.RenderMail(name, locale, recipientName, devData(c))
+	context := c.QueryParam("context")
+	logo := c.QueryParam("logo")
+	_, parts, err := mails.RenderMail(name, locale, context, logo, recipientName, devData(c))
 	if err != nil {
 		return err
 	}
@@ -9,13 +9,12 @@ import (
 	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/errcode"
 	"github.com/cozy/cozy-stack/pkg/instance"
-	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 
 	"github.com/cozy/echo"
-	"github.com/sirupsen/logrus"
 )
 
 // ErrorHandler is the default error handler of our APIs.
@@ -37,24 +36,22 @@ func ErrorHandler(err error, c echo.Context) {
 		je = &jsonapi.Error{
 			Status: ce.StatusCode,
 			Title:  ce.Name,
+			Code:   errcode.FromStatus(ce.StatusCode),
 			Detail: ce.Reason,
 		}
+	} else if _, ok = err.(*errcode.Error); ok {
+		je = jsonapi.FromError(err)
 	} else if je, ok = err.(*jsonapi.Error); !ok {
 		je = &jsonapi.Error{
 			Status: http.StatusInternalServerError,
 			Title:  "Unqualified error",
+			Code:   errcode.Internal,
 			Detail: err.Error(),
 		}
 	}
 
 	if config.IsDevRelease() {
-		var log *logrus.Entry
-		inst, ok := middlewares.GetInstanceSafe(c)
-		if ok {
-			log = inst.Logger().WithField("nspace", "http")
-		} else {
-			log = logger.WithNamespace("http")
-		}
+		log := middlewares.GetLogger(c)
 		log.Errorf("%s %s %s", req.Method, req.URL.Path, err)
 	}
 
@@ -82,17 +79,11 @@ func HTMLErrorHandler(err error, c echo.Context) {
 
 	req := c.Request()
 
-	var log *logrus.Entry
-	inst, ok := middlewares.GetInstanceSafe(c)
-	if ok {
-		log = inst.Logger().WithField("nspace", "http")
-	} else {
-		log = logger.WithNamespace("http")
-	}
+	log := middlewares.GetLogger(c)
 	log.Errorf("%s %s %s", req.Method, req.URL.Path, err)
 
-	var he *echo.HTTPError
-	if he, ok = err.(*echo.HTTPError); ok {
+	he, ok := err.(*echo.HTTPError)
+	if ok {
 		status = he.Code
 		if he.Inner != nil {
 			err = he.Inner
@@ -114,6 +105,17 @@ func HTMLErrorHandler(err error, c echo.Context) {
 		value = "Error Application not found Message"
 	case apps.ErrInvalidSlugName:
 		status = http.StatusBadRequest
+	case instance.ErrInMaintenance:
+		status = http.StatusServiceUnavailable
+		title = "Error Maintenance Title"
+		value = "Error Maintenance Message"
+	case instance.ErrBlocked:
+		status = http.StatusPaymentRequired
+		title = "Error Blocked Title"
+		value = "Instance Blocked blocked"
+		if i, ok := middlewares.GetInstanceSafe(c); ok && i.BlockingReason != "" {
+			value = "Instance Blocked " + i.BlockingReason
+		}
 	}
 
 	if title == "" {
@@ -138,6 +140,10 @@ func HTMLErrorHandler(err error, c echo.Context) {
 		i, ok := middlewares.GetInstanceSafe(c)
 		if ok {
 			domain = i.ContextualDomain()
+		} else {
+			// The page for an unknown host is rendered with the settings of
+			// the default context.
+			i = &instance.Instance{}
 		}
 
 		var actionTitle, actionURL string
@@ -147,11 +153,13 @@ func HTMLErrorHandler(err error, c echo.Context) {
 		}
 
 		err = c.Render(status, "error.html", echo.Map{
-			"Domain":      domain,
-			"ErrorTitle":  title,
-			"Error":       value,
-			"ActionTitle": actionTitle,
-			"ActionURL":   actionURL,
+			"Domain":         domain,
+			"ContextName":    i.ContextName,
+			"ErrorTitle":     title,
+			"Error":          value,
+			"ActionTitle":    actionTitle,
+			"ActionURL":      actionURL,
+			"SupportAddress": i.SupportEmailAddress(),
 		})
 	} else {
 		err = c.String(status, fmt.Sprintf("%v", he.Message))
@@ -0,0 +1,148 @@
+package files
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/imaging"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/sharing"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// EditImageHandler handles POST requests on /files/:file-id/edit to rotate,
+// crop and resize an image. The edited image is a new version of the file, or
+// a new file in the same directory with Copy=true. The thumbnails are then
+// regenerated by the thumbnail worker, like for an upload.
+func EditImageHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	fs := inst.VFS()
+
+	olddoc, err := fs.FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, olddoc); err != nil {
+		return err
+	}
+	if olddoc.Encrypted || olddoc.Class != "image" || !imaging.CanEdit(olddoc.Mime) {
+		return jsonapi.Errorf(http.StatusUnsupportedMediaType, "%s", imaging.ErrUnsupportedFormat)
+	}
+	if olddoc.ByteSize > imaging.MaxSize {
+		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "The image is too large to be edited")
+	}
+
+	var edition imaging.Edition
+	if rotate := c.QueryParam("Rotate"); rotate != "" {
+		if edition.Rotate, err = imaging.ParseRotate(rotate); err != nil {
+			return jsonapi.InvalidParameter("Rotate", err)
+		}
+	}
+	if crop := c.QueryParam("Crop"); crop != "" {
+		if edition.Crop, err = imaging.ParseCrop(crop); err != nil {
+			return jsonapi.InvalidParameter("Crop", err)
+		}
+	}
+	if resize := c.QueryParam("Resize"); resize != "" {
+		if edition.Resize, err = imaging.ParseResize(resize); err != nil {
+			return jsonapi.InvalidParameter("Resize", err)
+		}
+	}
+	if edition.Rotate == 0 && edition.Crop == nil && edition.Resize == nil {
+		return jsonapi.BadRequest(imaging.ErrNoOperation)
+	}
+
+	asCopy := c.QueryParam("Copy") == "true"
+	if !asCopy {
+		if err = CheckIfMatch(c, olddoc.Rev()); err != nil {
+			return WrapVfsError(err)
+		}
+	}
+
+	content, err := fs.OpenFile(olddoc)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	var edited bytes.Buffer
+	err = edition.Apply(c.Request().Context(), olddoc.Mime, content, &edited)
+	if errc := content.Close(); err == nil {
+		err = errc
+	}
+	if err == imaging.ErrEditFailed {
+		return jsonapi.Errorf(http.StatusUnprocessableEntity, "%s", err)
+	}
+	if err != nil {
+		return WrapVfsError(err)
+	}
+
+	if asCopy {
+		return createEditedImage(c, olddoc, &edited)
+	}
+	return overwriteWithEditedImage(c, olddoc, &edited)
+}
+
+// createEditedImage saves the edited image as a new file, next to the
+// original.
+func createEditedImage(c echo.Context, olddoc *vfs.FileDoc, edited *bytes.Buffer) error {
+	inst := middlewares.GetInstance(c)
+	fs := inst.VFS()
+
+	name := c.QueryParam("Name")
+	if name == "" {
+		ext := path.Ext(olddoc.DocName)
+		name = strings.TrimSuffix(olddoc.DocName, ext) + " (edited)" + ext
+	}
+	newdoc, err := vfs.NewFileDoc(name, olddoc.DirID, int64(edited.Len()), nil,
+		olddoc.Mime, olddoc.Class, time.Now(), false, false, olddoc.Tags)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.POST, nil, newdoc); err != nil {
+		return err
+	}
+	if err = sharing.CheckDriveQuota(inst, newdoc.DirID, newdoc.ByteSize); err != nil {
+		return WrapVfsError(err)
+	}
+	if err = createFileFromReader(fs, newdoc, edited); err != nil {
+		return WrapVfsError(err)
+	}
+	return fileData(c, http.StatusCreated, newdoc, nil)
+}
+
+// overwriteWithEditedImage saves the edited image as a new version of the
+// file.
+func overwriteWithEditedImage(c echo.Context, olddoc *vfs.FileDoc, edited *bytes.Buffer) (err error) {
+	inst := middlewares.GetInstance(c)
+	fs := inst.VFS()
+
+	newdoc := olddoc.Clone().(*vfs.FileDoc)
+	newdoc.ByteSize = int64(edited.Len())
+	newdoc.MD5Sum = nil
+	newdoc.UpdatedAt = time.Now()
+	newdoc.Metadata = nil
+	if err = checkPerm(c, permissions.PUT, nil, newdoc); err != nil {
+		return err
+	}
+	if err = sharing.CheckDriveQuota(inst, newdoc.DirID, newdoc.ByteSize-olddoc.ByteSize); err != nil {
+		return WrapVfsError(err)
+	}
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	_, err = edited.WriteTo(file)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return fileData(c, http.StatusOK, newdoc, nil)
+}
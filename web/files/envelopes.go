@@ -0,0 +1,108 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiKeyEnvelope struct {
+	*vfs.KeyEnvelope
+}
+
+func (e *apiKeyEnvelope) MarshalJSON() ([]byte, error) { return json.Marshal(e.KeyEnvelope) }
+func (e *apiKeyEnvelope) Included() []jsonapi.Object   { return nil }
+func (e *apiKeyEnvelope) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/" + e.DirID + "/keys/" + e.Recipient}
+}
+func (e *apiKeyEnvelope) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"dir": jsonapi.Relationship{
+			Data: couchdb.DocReference{ID: e.DirID, Type: consts.Files},
+		},
+	}
+}
+
+// encryptedDir loads the directory of the request, after checking the
+// permissions of the requester for the given verb.
+func encryptedDir(c echo.Context, v pkgperm.Verb) (*vfs.DirDoc, error) {
+	fs := middlewares.GetInstance(c).VFS()
+	dir, err := fs.DirByID(c.Param("file-id"))
+	if err != nil {
+		return nil, WrapVfsError(err)
+	}
+	if err = checkPerm(c, v, dir, nil); err != nil {
+		return nil, err
+	}
+	return dir, nil
+}
+
+// ListKeyEnvelopesHandler handles GET requests on /files/:file-id/keys to
+// list the envelopes of the key of an encrypted directory.
+func ListKeyEnvelopesHandler(c echo.Context) error {
+	dir, err := encryptedDir(c, permissions.GET)
+	if err != nil {
+		return err
+	}
+	envelopes, err := vfs.ListKeyEnvelopes(middlewares.GetInstance(c), dir)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	objs := make([]jsonapi.Object, len(envelopes))
+	for i, envelope := range envelopes {
+		objs[i] = &apiKeyEnvelope{envelope}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// PutKeyEnvelopeHandler handles PUT requests on /files/:file-id/keys/:recipient
+// to add or replace the envelope of the key of an encrypted directory for a
+// recipient.
+func PutKeyEnvelopeHandler(c echo.Context) error {
+	dir, err := encryptedDir(c, permissions.PUT)
+	if err != nil {
+		return err
+	}
+	var attrs struct {
+		PublicKey  string `json:"public_key"`
+		WrappedKey string `json:"wrapped_key"`
+	}
+	if _, err = jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	envelope := &vfs.KeyEnvelope{
+		Recipient:  c.Param("recipient"),
+		PublicKey:  attrs.PublicKey,
+		WrappedKey: attrs.WrappedKey,
+	}
+	if err = vfs.PutKeyEnvelope(middlewares.GetInstance(c), dir, envelope); err != nil {
+		return WrapVfsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiKeyEnvelope{envelope}, nil)
+}
+
+// DeleteKeyEnvelopeHandler handles DELETE requests on
+// /files/:file-id/keys/:recipient to remove the envelope of the key of an
+// encrypted directory for a recipient.
+func DeleteKeyEnvelopeHandler(c echo.Context) error {
+	dir, err := encryptedDir(c, permissions.PUT)
+	if err != nil {
+		return err
+	}
+	err = vfs.DeleteKeyEnvelope(middlewares.GetInstance(c), dir, c.Param("recipient"))
+	if couchdb.IsNotFoundError(err) {
+		return jsonapi.NotFound(err)
+	}
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
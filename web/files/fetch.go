@@ -0,0 +1,162 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/safehttp"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// maxFetchSize is the maximal size of a file created from a remote URL.
+const maxFetchSize = 1 << 30 // 1 GiB
+
+var (
+	errFetchFailed         = errors.New("The remote file could not be downloaded")
+	errFetchTooBig         = errors.New("The remote file is too big")
+	errFetchForbiddenURL   = errors.New("The URL is not allowed")
+	errFetchBadContentType = errors.New("The remote file has not the expected content-type")
+)
+
+// fetchClient only dials the public IP addresses, to avoid that the route of
+// the upload by URL is used to reach the services of the private network of
+// the stack.
+var fetchClient = &http.Client{
+	Timeout:   10 * time.Minute,
+	Transport: safehttp.NewTransport(30 * time.Second),
+}
+
+// FetchHandler handles POST requests on /files/:dir-id/fetch to create a
+// file in the directory from the content of a remote URL, downloaded by the
+// stack.
+func FetchHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	fs := inst.VFS()
+
+	u, err := url.Parse(c.QueryParam("URL"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return jsonapi.InvalidParameter("URL", errFetchForbiddenURL)
+	}
+
+	// The permission is checked before the download, with a document without
+	// content, and checked again on the real document before its creation.
+	dirID := c.Param("file-id")
+	tags := strings.Split(c.QueryParam("Tags"), TagSeparator)
+	name := c.QueryParam("Name")
+	if name == "" {
+		name = path.Base(u.Path)
+	}
+	draft, err := vfs.NewFileDoc(name, dirID, -1, nil, "", "", time.Now(), false, false, tags)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, "POST", nil, draft); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return jsonapi.InvalidParameter("URL", err)
+	}
+	req.Header.Set("User-Agent", "cozy-stack "+config.Version)
+	res, err := fetchClient.Do(req.WithContext(c.Request().Context()))
+	if err != nil {
+		inst.Logger().WithField("nspace", "files").
+			Infof("Error on fetching %s: %s", u.Host, err)
+		if uerr, ok := err.(*url.Error); ok && uerr.Err == safehttp.ErrForbiddenAddress {
+			return jsonapi.InvalidParameter("URL", errFetchForbiddenURL)
+		}
+		return jsonapi.BadGateway(errFetchFailed)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return jsonapi.BadGateway(fmt.Errorf("%s (status %d)", errFetchFailed, res.StatusCode))
+	}
+	if res.ContentLength > maxFetchSize {
+		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", errFetchTooBig)
+	}
+
+	if c.QueryParam("Name") == "" {
+		if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+			if filename := path.Base(params["filename"]); filename != "" && filename != "." && filename != "/" {
+				name = filename
+			}
+		}
+	}
+	var mimetype, class string
+	if ctype, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err == nil &&
+		ctype != "application/octet-stream" {
+		mimetype, class = vfs.ExtractMimeAndClass(ctype)
+	} else {
+		mimetype, class = vfs.ExtractMimeAndClassFromFilename(name)
+	}
+	if expected := c.QueryParam("ContentType"); expected != "" && !matchContentType(expected, mimetype) {
+		return jsonapi.Errorf(http.StatusUnsupportedMediaType, "%s", errFetchBadContentType)
+	}
+	cdate := time.Now()
+	if modified, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		cdate = modified
+	}
+
+	doc, err := vfs.NewFileDoc(name, dirID, res.ContentLength, nil, mimetype, class,
+		cdate, false, false, tags)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = vfs.InheritEncryption(fs, doc); err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, "POST", nil, doc); err != nil {
+		return err
+	}
+
+	content := &maxSizeReader{r: res.Body, remaining: maxFetchSize}
+	if err = createFileFromReader(fs, doc, content); err != nil {
+		if err == errFetchTooBig {
+			return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
+		}
+		if errj := wrapVfsError(err); errj != nil {
+			return errj
+		}
+		inst.Logger().WithField("nspace", "files").
+			Infof("Error on fetching %s: %s", u.Host, err)
+		return jsonapi.BadGateway(errFetchFailed)
+	}
+	return fileData(c, http.StatusCreated, doc, nil)
+}
+
+// maxSizeReader is a reader that fails with errFetchTooBig when more than
+// remaining bytes are read.
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		return n, errFetchTooBig
+	}
+	return n, err
+}
+
+// matchContentType returns true if the mime type is the expected one, or is
+// of the expected class for a pattern like image/*.
+func matchContentType(expected, mimetype string) bool {
+	if strings.HasSuffix(expected, "/*") {
+		return strings.HasPrefix(mimetype, strings.TrimSuffix(expected, "*"))
+	}
+	return expected == mimetype
+}
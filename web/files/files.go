@@ -21,7 +21,10 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/previews"
+	"github.com/cozy/cozy-stack/pkg/sharing"
 	statikFS "github.com/cozy/cozy-stack/pkg/statik/fs"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/pkg/vfs"
@@ -49,6 +52,10 @@ const TagSeparator = ","
 // recognized
 var ErrDocTypeInvalid = errors.New("Invalid document type")
 
+// errRevokedDownload is used when a secret given to a visitor of a share by
+// link has been revoked
+var errRevokedDownload = jsonapi.NewError(http.StatusForbidden, "This download token has been revoked")
+
 // CreationHandler handle all POST requests on /files/:file-id
 // aiming at creating a new document in the FS. Given the Type
 // parameter of the request, it will either upload a new file or
@@ -83,12 +90,20 @@ func createFileHandler(c echo.Context, fs vfs.VFS) (f *file, err error) {
 	if err != nil {
 		return
 	}
+	if err = vfs.InheritEncryption(fs, doc); err != nil {
+		return
+	}
 
 	err = checkPerm(c, "POST", nil, doc)
 	if err != nil {
 		return
 	}
 
+	err = sharing.CheckDriveQuota(middlewares.GetInstance(c), doc.DirID, doc.ByteSize)
+	if err != nil {
+		return
+	}
+
 	file, err := fs.CreateFile(doc, nil)
 	if err != nil {
 		return
@@ -137,6 +152,9 @@ func createDirHandler(c echo.Context, fs vfs.VFS) (*dir, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.QueryParam("Encrypted") == "true" {
+		doc.Encrypted = true
+	}
 	if date := c.Request().Header.Get("Date"); date != "" {
 		if t, err2 := time.Parse(time.RFC1123, date); err2 == nil {
 			doc.CreatedAt = t
@@ -184,6 +202,10 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 	}
 
 	newdoc.ReferencedBy = olddoc.ReferencedBy
+	newdoc.Favorite = olddoc.Favorite
+	if olddoc.Encrypted {
+		newdoc.MarkAsEncrypted()
+	}
 
 	if err = CheckIfMatch(c, olddoc.Rev()); err != nil {
 		return WrapVfsError(err)
@@ -200,6 +222,11 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 		return
 	}
 
+	err = sharing.CheckDriveQuota(instance, newdoc.DirID, newdoc.ByteSize-olddoc.ByteSize)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+
 	file, err := instance.VFS().CreateFile(newdoc, olddoc)
 	if err != nil {
 		return WrapVfsError(err)
@@ -438,6 +465,9 @@ func ReadMetadataFromIDHandler(c echo.Context) error {
 	if dir != nil {
 		return dirData(c, http.StatusOK, dir)
 	}
+	if jsonapi.NotModified(c, file.Rev(), file.UpdatedAt) {
+		return c.NoContent(http.StatusNotModified)
+	}
 	return fileData(c, http.StatusOK, file, nil)
 }
 
@@ -478,6 +508,9 @@ func ReadMetadataFromPathHandler(c echo.Context) error {
 	if dir != nil {
 		return dirData(c, http.StatusOK, dir)
 	}
+	if jsonapi.NotModified(c, file.Rev(), file.UpdatedAt) {
+		return c.NoContent(http.StatusNotModified)
+	}
 	return fileData(c, http.StatusOK, file, nil)
 }
 
@@ -501,6 +534,7 @@ func ReadFileContentFromIDHandler(c echo.Context) error {
 	if c.QueryParam("Dl") == "1" {
 		disposition = "attachment"
 	}
+	recordAccess(c, doc)
 	err = vfs.ServeFileContent(instance.VFS(), doc, disposition, c.Request(), c.Response())
 	if err != nil {
 		return WrapVfsError(err)
@@ -534,34 +568,117 @@ func HeadDirOrFile(c echo.Context) error {
 // ThumbnailHandler serves thumbnails of the images/photos
 func ThumbnailHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
+	doc, err := fileFromSecret(c)
+	if err != nil {
+		return err
+	}
 
-	secret := c.Param("secret")
-	path, err := vfs.GetStore().GetFile(instance, secret)
+	fs := instance.ThumbsFS()
+	format := c.Param("format")
+	err = fs.ServeThumbContent(c.Response(), c.Request(), doc, format)
 	if err != nil {
-		return WrapVfsError(err)
+		return serveThumbnailPlaceholder(c.Response(), c.Request(), doc, format)
 	}
-	if path == "" {
-		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
+	return nil
+}
+
+// fileFromSecret returns the file of the request, after checking that the
+// secret in the URL is a download token for this file.
+func fileFromSecret(c echo.Context) (*vfs.FileDoc, error) {
+	instance := middlewares.GetInstance(c)
+
+	path, err := pathFromSecret(c, c.Param("secret"))
+	if err != nil {
+		return nil, err
 	}
 
 	doc, err := instance.VFS().FileByID(c.Param("file-id"))
 	if err != nil {
-		return WrapVfsError(err)
+		return nil, WrapVfsError(err)
 	}
 
 	expected, err := doc.Path(instance.VFS())
 	if err != nil {
-		return WrapVfsError(err)
+		return nil, WrapVfsError(err)
 	}
 	if expected != path {
-		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
+		return nil, jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
 	}
+	return doc, nil
+}
 
-	fs := instance.ThumbsFS()
-	format := c.Param("format")
-	err = fs.ServeThumbContent(c.Response(), c.Request(), doc, format)
+// PageHandler renders a page of a PDF file as an image, for the previews.
+// The width and the format can be given in the query string.
+func PageHandler(c echo.Context) error {
+	doc, err := fileFromSecret(c)
 	if err != nil {
-		return serveThumbnailPlaceholder(c.Response(), c.Request(), doc, format)
+		return err
+	}
+
+	page := &previews.Page{Format: c.QueryParam("format")}
+	if page.Number, err = strconv.Atoi(c.Param("page")); err != nil {
+		return jsonapi.InvalidParameter("page", previews.ErrInvalidPage)
+	}
+	if width := c.QueryParam("width"); width != "" {
+		if page.Width, err = strconv.Atoi(width); err != nil {
+			return jsonapi.InvalidParameter("width", previews.ErrInvalidWidth)
+		}
+	}
+	if err = page.Validate(); err != nil {
+		switch err {
+		case previews.ErrInvalidWidth:
+			return jsonapi.InvalidParameter("width", err)
+		case previews.ErrInvalidFormat:
+			return jsonapi.InvalidParameter("format", err)
+		}
+		return jsonapi.InvalidParameter("page", err)
+	}
+
+	etag := page.ETag(doc)
+	if web_utils.CheckPreconditions(c.Response(), c.Request(), etag) {
+		return nil
+	}
+
+	data, err := previews.Render(middlewares.GetInstance(c), doc, page)
+	switch err {
+	case nil:
+	case previews.ErrNotPDF:
+		return jsonapi.BadRequest(err)
+	case previews.ErrPageNotFound:
+		return jsonapi.NotFound(err)
+	default:
+		return err
+	}
+	c.Response().Header().Set("Etag", etag)
+	return c.Blob(http.StatusOK, previews.Formats[page.Format], data)
+}
+
+// StreamHandler serves the HLS playlists and segments of a video, after its
+// transcoding for streaming. The relative URIs in the playlists are resolved
+// by the players to this route, with the same secret.
+func StreamHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := fileFromSecret(c)
+	if err != nil {
+		return err
+	}
+
+	name := c.Param("name")
+	var contentType string
+	switch path.Ext(name) {
+	case ".m3u8":
+		contentType = "application/vnd.apple.mpegurl"
+	case ".ts":
+		contentType = "video/mp2t"
+	}
+	if contentType == "" || path.Base(name) != name {
+		return jsonapi.NewError(http.StatusNotFound, "Unknown stream file")
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	err = instance.StreamsFS().ServeStreamContent(c.Response(), c.Request(), doc, name)
+	if err != nil {
+		return WrapVfsError(err)
 	}
 	return nil
 }
@@ -602,11 +719,11 @@ func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
 	if c.QueryParam("Dl") == "1" {
 		disposition = "attachment"
 	} else if !checkPermission {
-		// Allow some files to be displayed by the browser in the client-side apps
-		if doc.Mime == "text/plain" || doc.Class == "image" || doc.Class == "audio" || doc.Class == "video" || doc.Mime == "application/pdf" {
+		if canBeFramed(doc) {
 			middlewares.AppendCSPRule(c, "frame-ancestors", "*")
 		}
 	}
+	recordAccess(c, doc)
 	err = vfs.ServeFileContent(instance.VFS(), doc, disposition, c.Request(), c.Response())
 	if err != nil {
 		return WrapVfsError(err)
@@ -615,6 +732,12 @@ func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
 	return nil
 }
 
+// canBeFramed returns true for the files that can be displayed by the browser
+// in the client-side apps.
+func canBeFramed(doc *vfs.FileDoc) bool {
+	return doc.Mime == "text/plain" || doc.Class == "image" || doc.Class == "audio" || doc.Class == "video" || doc.Mime == "application/pdf"
+}
+
 // ReadFileContentFromPathHandler handles all GET request on /files/download
 // aiming at downloading a file given its path. It serves the file in in
 // attachment mode.
@@ -698,7 +821,13 @@ func FileDownloadCreateHandler(c echo.Context) error {
 		return err
 	}
 
-	secret, err := vfs.GetStore().AddFile(instance, path)
+	var secret string
+	if shared := sharedFileTemplate(c); shared != nil {
+		shared.Path = path
+		secret, err = vfs.GetStore().AddSharedFile(instance, shared)
+	} else {
+		secret, err = vfs.GetStore().AddFile(instance, path)
+	}
 	if err != nil {
 		return WrapVfsError(err)
 	}
@@ -728,16 +857,64 @@ func ArchiveDownloadHandler(c echo.Context) error {
 // FileDownloadHandler send a file that have previously be defined
 // through FileDownloadCreateHandler
 func FileDownloadHandler(c echo.Context) error {
+	path, err := pathFromSecret(c, c.Param("secret"))
+	if err != nil {
+		return err
+	}
+	return sendFileFromPath(c, path, false)
+}
+
+// sharedFileTemplate returns the informations to bind the download secrets to
+// the sharecode of the requester, or nil if the request is not made by a
+// visitor of a share by link.
+func sharedFileTemplate(c echo.Context) *vfs.SharedFile {
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil || !pdoc.SharedByCode() {
+		return nil
+	}
+	return &vfs.SharedFile{
+		PermissionID: pdoc.ID(),
+		CodeHash:     pkgperm.CodeHash(middlewares.GetRequestToken(c)),
+	}
+}
+
+// pathFromSecret returns the path of the file that can be downloaded with
+// the given secret. The secrets given to the visitors of a share by link are
+// revoked as soon as their sharecode is removed from the permission doc, or
+// when the file is no longer shared.
+func pathFromSecret(c echo.Context, secret string) (string, error) {
 	instance := middlewares.GetInstance(c)
-	secret := c.Param("secret")
-	path, err := vfs.GetStore().GetFile(instance, secret)
+	store := vfs.GetStore()
+	path, err := store.GetFile(instance, secret)
 	if err != nil {
-		return WrapVfsError(err)
+		return "", WrapVfsError(err)
 	}
-	if path == "" {
-		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
+	if path != "" {
+		return path, nil
 	}
-	return sendFileFromPath(c, path, false)
+
+	shared, err := store.GetSharedFile(instance, secret)
+	if err != nil {
+		return "", WrapVfsError(err)
+	}
+	if shared == nil {
+		return "", jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
+	}
+	pdoc, err := pkgperm.GetByID(instance, shared.PermissionID)
+	if err != nil && err != pkgperm.ErrExpiredToken && !couchdb.IsNotFoundError(err) {
+		return "", err
+	}
+	if err != nil || !pdoc.SharedByCode() || !pdoc.HasCodeHash(shared.CodeHash) {
+		return "", errRevokedDownload
+	}
+	doc, err := instance.VFS().FileByPath(shared.Path)
+	if err != nil {
+		return "", WrapVfsError(err)
+	}
+	if err = vfs.Allows(instance.VFS(), pdoc.Permissions, pkgperm.GET, doc); err != nil {
+		return "", errRevokedDownload
+	}
+	return shared.Path, nil
 }
 
 // TrashHandler handles all DELETE requests on /files/:file-id and
@@ -1002,7 +1179,18 @@ func Routes(router *echo.Group) {
 	router.HEAD("/download/:file-id", ReadFileContentFromIDHandler)
 	router.GET("/download/:file-id", ReadFileContentFromIDHandler)
 
-	router.POST("/_find", FindFilesMango)
+	router.POST("/_find", FindFilesMango, middlewares.RateLimit(limits.SearchType))
+	router.GET("/_recent", RecentFilesHandler)
+	router.GET("/_favorites", FavoritesHandler)
+	router.GET("/_tags", ListTagsHandler)
+	router.POST("/_tags/_merge", MergeTagsHandler)
+	router.PATCH("/_tags/:tag", RenameTagHandler)
+	router.DELETE("/_tags/:tag", DeleteTagHandler)
+	router.POST("/_imports", CreateImportHandler)
+	router.GET("/_imports/:import-id", ImportHandler)
+	router.POST("/_uploads", StageUploadHandler)
+	router.POST("/_uploads/:upload-id/commit", CommitUploadHandler)
+	router.DELETE("/_uploads/:upload-id", AbortUploadHandler)
 
 	router.HEAD("/:file-id", HeadDirOrFile)
 
@@ -1018,7 +1206,13 @@ func Routes(router *echo.Group) {
 	router.POST("/:file-id", CreationHandler)
 	router.PUT("/:file-id", OverwriteFileContentHandler)
 
-	router.GET("/:file-id/thumbnails/:secret/:format", ThumbnailHandler)
+	router.GET("/:file-id/thumbnails/:secret/:format", ThumbnailHandler, middlewares.RateLimit(limits.ThumbnailType))
+	router.GET("/:file-id/pages/:secret/:page", PageHandler, middlewares.RateLimit(limits.ThumbnailType))
+	router.GET("/:file-id/stream/:secret/:name", StreamHandler)
+
+	router.GET("/:file-id/keys", ListKeyEnvelopesHandler)
+	router.PUT("/:file-id/keys/:recipient", PutKeyEnvelopeHandler)
+	router.DELETE("/:file-id/keys/:recipient", DeleteKeyEnvelopeHandler)
 
 	router.POST("/archive", ArchiveDownloadCreateHandler)
 	router.GET("/archive/:secret/:fake-name", ArchiveDownloadHandler)
@@ -1026,6 +1220,13 @@ func Routes(router *echo.Group) {
 	router.POST("/downloads", FileDownloadCreateHandler)
 	router.GET("/downloads/:secret/:fake-name", FileDownloadHandler)
 
+	router.POST("/:file-id/signed", SignedURLCreateHandler)
+	router.POST("/:file-id/fetch", FetchHandler)
+	router.POST("/:file-id/multipart", MultipartUploadHandler)
+	router.POST("/:file-id/template", CreateFromTemplateHandler)
+	router.POST("/:file-id/edit", EditImageHandler)
+	router.GET("/signed/:token/:fake-name", SignedURLDownloadHandler)
+
 	router.POST("/:file-id/relationships/referenced_by", AddReferencedHandler)
 	router.DELETE("/:file-id/relationships/referenced_by", RemoveReferencedHandler)
 
@@ -1077,10 +1278,12 @@ func wrapVfsError(err error) *jsonapi.Error {
 	case vfs.ErrConflict:
 		return jsonapi.Conflict(err)
 	case vfs.ErrFileInTrash, vfs.ErrNonAbsolutePath,
-		vfs.ErrDirNotEmpty:
+		vfs.ErrDirNotEmpty, vfs.ErrNotEncrypted:
 		return jsonapi.BadRequest(err)
-	case vfs.ErrFileTooBig:
-		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
+	case vfs.ErrInvalidKeyEnvelope:
+		return jsonapi.InvalidAttribute("wrapped_key", err)
+	case vfs.ErrFileTooBig, sharing.ErrDriveQuotaExceeded:
+		return jsonapi.FromError(err)
 	}
 	return nil
 }
@@ -1111,24 +1314,7 @@ func FileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 		}
 	}
 
-	var mime, class string
-	contentType := header.Get("Content-Type")
-	if contentType == "" {
-		mime, class = vfs.ExtractMimeAndClassFromFilename(name)
-	} else if contentType == "application/octet-stream" {
-		// TODO: remove this special path for the heic/heif file extensions with
-		// when we deal with a better detection of the files magic numbers.
-		switch strings.ToLower(path.Ext(name)) {
-		case ".heif":
-			contentType = "image/heif"
-		case ".heic":
-			contentType = "image/heic"
-		}
-		mime, class = vfs.ExtractMimeAndClass(contentType)
-	} else {
-		mime, class = vfs.ExtractMimeAndClass(contentType)
-	}
-
+	mime, class := mimeAndClass(header.Get("Content-Type"), name)
 	executable := c.QueryParam("Executable") == "true"
 	trashed := false
 	return vfs.NewFileDoc(
@@ -1145,19 +1331,33 @@ func FileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 	)
 }
 
+// mimeAndClass returns the mime type and the class of an uploaded file, from
+// its Content-Type, or from its name if there is no Content-Type.
+func mimeAndClass(contentType, name string) (mime, class string) {
+	if contentType == "" {
+		return vfs.ExtractMimeAndClassFromFilename(name)
+	}
+	if contentType == "application/octet-stream" {
+		// TODO: remove this special path for the heic/heif file extensions with
+		// when we deal with a better detection of the files magic numbers.
+		switch strings.ToLower(path.Ext(name)) {
+		case ".heif":
+			contentType = "image/heif"
+		case ".heic":
+			contentType = "image/heic"
+		}
+	}
+	return vfs.ExtractMimeAndClass(contentType)
+}
+
 // CheckIfMatch checks if the revision provided matches the revision number
-// given in the request, in the header and/or the query.
+// given in the request, in the If-Match header (as an ETag or a raw revision)
+// or else in the query.
 func CheckIfMatch(c echo.Context, rev string) error {
-	ifMatch := c.Request().Header.Get("If-Match")
-	revQuery := c.QueryParam("rev")
-	var wantedRev string
-	if ifMatch != "" {
-		wantedRev = ifMatch
-	}
-	if revQuery != "" && wantedRev == "" {
-		wantedRev = revQuery
+	if c.Request().Header.Get("If-Match") != "" {
+		return jsonapi.CheckIfMatch(c, rev)
 	}
-	return checkIfMatch(rev, wantedRev)
+	return checkIfMatch(rev, c.QueryParam("rev"))
 }
 
 func checkIfMatch(rev, wantedRev string) error {
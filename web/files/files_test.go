@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -13,6 +14,7 @@ import (
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -376,8 +378,13 @@ func TestUploadToTrashedFolder(t *testing.T) {
 
 func TestUploadBadHash(t *testing.T) {
 	body := "foo"
-	res, _ := upload(t, "/files/?Type=file&Name=badhash", "text/plain", body, "3FbbMXfH+PdjAlWFfVb1dQ==")
+	res, v := upload(t, "/files/?Type=file&Name=badhash", "text/plain", body, "3FbbMXfH+PdjAlWFfVb1dQ==")
 	assert.Equal(t, 412, res.StatusCode)
+	errs, _ := v["errors"].([]interface{})
+	if assert.Len(t, errs, 1) {
+		first, _ := errs[0].(map[string]interface{})
+		assert.Equal(t, "invalid_hash", first["code"])
+	}
 
 	storage := testInstance.VFS()
 	_, err := readFile(storage, "/badhash")
@@ -435,6 +442,74 @@ func TestUploadWithParentSuccess(t *testing.T) {
 	assert.Equal(t, body, string(buf))
 }
 
+func TestFetchFromURL(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Disposition", `attachment; filename="remote.txt"`)
+		_, _ = w.Write([]byte("fetched content"))
+	}))
+	defer remote.Close()
+
+	u := "/files/" + consts.RootDirID + "/fetch?URL=" + url.QueryEscape(remote.URL+"/file")
+	res, _ := upload(t, u+"&ContentType=image/*", "", "", "")
+	assert.Equal(t, 415, res.StatusCode)
+
+	res, obj := upload(t, u+"&ContentType=text/*", "", "", "")
+	assert.Equal(t, 201, res.StatusCode)
+	data := obj["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "remote.txt", attrs["name"])
+	assert.Equal(t, "text/plain", attrs["mime"])
+	assert.Equal(t, "15", attrs["size"])
+
+	buf, err := readFile(testInstance.VFS(), "/remote.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "fetched content", string(buf))
+
+	res, _ = upload(t, "/files/"+consts.RootDirID+"/fetch?URL=ftp://example.org/file", "", "", "")
+	assert.Equal(t, 422, res.StatusCode)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for _, name := range []string{"multi/one.txt", "multi/sub/two.txt", "multi/one.txt"} {
+		part, err := w.CreateFormFile("files", name)
+		assert.NoError(t, err)
+		_, err = part.Write([]byte("content of " + name))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/"+consts.RootDirID+"/multipart", body)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Add("Content-Type", w.FormDataContentType())
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+
+	var out struct {
+		Data []struct {
+			Path   string `json:"path"`
+			Status string `json:"status"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+	if assert.Len(t, out.Data, 3) {
+		assert.Equal(t, "multi/one.txt", out.Data[0].Path)
+		assert.Equal(t, "201", out.Data[0].Status)
+		assert.Equal(t, "multi/sub/two.txt", out.Data[1].Path)
+		assert.Equal(t, "201", out.Data[1].Status)
+		assert.Equal(t, "409", out.Data[2].Status)
+	}
+
+	buf, err := readFile(testInstance.VFS(), "/multi/sub/two.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "content of multi/sub/two.txt", string(buf))
+}
+
 func TestUploadAtRootAlreadyExists(t *testing.T) {
 	body := "foo"
 	res1, _ := upload(t, "/files/?Type=file&Name=iexistfile", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
@@ -874,6 +949,76 @@ func TestDownloadFileByIDSuccess(t *testing.T) {
 	assert.Equal(t, body, string(resbody))
 }
 
+func TestRecentAndFavoriteFiles(t *testing.T) {
+	res1, filedata := upload(t, "/files/?Type=file&Name=recentandfav", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID := filedata["data"].(map[string]interface{})["id"].(string)
+
+	res2, _ := download(t, "/files/download/"+fileID, "")
+	assert.Equal(t, 200, res2.StatusCode)
+
+	res3, err := httpGet(ts.URL + "/files/_recent")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res3.StatusCode)
+	var recent map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res3.Body).Decode(&recent))
+	res3.Body.Close()
+	data := recent["data"].([]interface{})
+	if assert.NotEmpty(t, data) {
+		assert.Equal(t, fileID, data[0].(map[string]interface{})["id"])
+	}
+
+	attrs := map[string]interface{}{"favorite": true}
+	res4, patched := patchFile(t, "/files/"+fileID, "file", fileID, attrs, nil)
+	assert.Equal(t, 200, res4.StatusCode)
+	patchedAttrs := patched["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, true, patchedAttrs["favorite"])
+
+	res5, err := httpGet(ts.URL + "/files/_favorites")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res5.StatusCode)
+	var favorites map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res5.Body).Decode(&favorites))
+	res5.Body.Close()
+	data = favorites["data"].([]interface{})
+	if assert.Len(t, data, 1) {
+		assert.Equal(t, fileID, data[0].(map[string]interface{})["id"])
+	}
+}
+
+func TestTags(t *testing.T) {
+	res1, _ := upload(t, "/files/?Type=file&Name=tagsone&Tags=tagtest-foo,tagtest-bar", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	res2, filedata := upload(t, "/files/?Type=file&Name=tagstwo&Tags=tagtest-foo", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res2.StatusCode)
+	fileID := filedata["data"].(map[string]interface{})["id"].(string)
+
+	res3, err := httpGet(ts.URL + "/files/_tags")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res3.StatusCode)
+	var list struct {
+		Data []vfs.TagCount `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(res3.Body).Decode(&list))
+	res3.Body.Close()
+	assert.Contains(t, list.Data, vfs.TagCount{Name: "tagtest-foo", Count: 2})
+	assert.Contains(t, list.Data, vfs.TagCount{Name: "tagtest-bar", Count: 1})
+
+	count, err := vfs.ReplaceTags(testInstance.VFS(), []string{"tagtest-foo", "tagtest-bar"}, "tagtest-baz")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	doc, err := testInstance.VFS().FileByID(fileID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tagtest-baz"}, doc.Tags)
+
+	req4, err := http.NewRequest("DELETE", ts.URL+"/files/_tags/tagtest-baz", nil)
+	assert.NoError(t, err)
+	req4.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res4, err := http.DefaultClient.Do(req4)
+	assert.NoError(t, err)
+	assert.Equal(t, 202, res4.StatusCode)
+}
+
 func TestDownloadFileByPathSuccess(t *testing.T) {
 	body := "foo"
 	res1, _ := upload(t, "/files/?Type=file&Name=downloadme2", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
@@ -956,6 +1101,44 @@ func TestGetDirMetadataFromID(t *testing.T) {
 	assert.Equal(t, 200, res3.StatusCode)
 }
 
+func TestGetDirMetadataNotModified(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=getdirmetanotmodified&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+	dirID, _ := extractDirData(t, data1)
+
+	getIfNoneMatch := func(path, etag string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		assert.NoError(t, err)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		if etag != "" {
+			req.Header.Add("If-None-Match", etag)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	res2 := getIfNoneMatch("/files/"+dirID, "")
+	assert.Equal(t, 200, res2.StatusCode)
+	etag := res2.Header.Get("Etag")
+	assert.Regexp(t, `^W/"[0-9a-f]{32}"$`, etag)
+
+	res3 := getIfNoneMatch("/files/"+dirID, etag)
+	assert.Equal(t, 304, res3.StatusCode)
+	res4 := getIfNoneMatch("/files/metadata?Path=/getdirmetanotmodified", etag)
+	assert.Equal(t, 304, res4.StatusCode)
+
+	// Adding a child to the directory changes its ETag
+	res5, _ := upload(t, "/files/"+dirID+"?Type=file&Name=child", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res5.StatusCode)
+	res6 := getIfNoneMatch("/files/"+dirID, etag)
+	assert.Equal(t, 200, res6.StatusCode)
+	assert.NotEqual(t, etag, res6.Header.Get("Etag"))
+	res7 := getIfNoneMatch("/files/metadata?Path=/getdirmetanotmodified", etag)
+	assert.Equal(t, 200, res7.StatusCode)
+}
+
 func TestArchiveNoFiles(t *testing.T) {
 	body := bytes.NewBufferString(`{
 		"data": {
@@ -1144,6 +1327,61 @@ func TestFileCreateAndDownloadByID(t *testing.T) {
 	assert.Equal(t, `inline; filename="todownload2stepsbis"`, disposition)
 }
 
+func TestSignedURL(t *testing.T) {
+	body := "foo,bar"
+	res1, obj := upload(t, "/files/?Type=file&Name=signed.txt", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID := obj["data"].(map[string]interface{})["id"].(string)
+
+	sign := func(query string) (*http.Response, string) {
+		req, err := http.NewRequest("POST", ts.URL+"/files/"+fileID+"/signed"+query, nil)
+		assert.NoError(t, err)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return res, ""
+		}
+		var data map[string]interface{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&data))
+		return res, data["links"].(map[string]interface{})["related"].(string)
+	}
+
+	res2, link := sign("?TTL=5m")
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.True(t, strings.HasPrefix(link, "/files/signed/"))
+	assert.True(t, strings.HasSuffix(link, "/signed.txt"))
+	res3, err := http.Get(ts.URL + link)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res3.StatusCode)
+	content, err := ioutil.ReadAll(res3.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(content))
+
+	res4, err := http.Get(ts.URL + strings.Replace(link, "/files/signed/", "/files/signed/x", 1))
+	assert.NoError(t, err)
+	assert.Equal(t, 400, res4.StatusCode)
+
+	res5, _ := sign("?TTL=2h")
+	assert.Equal(t, 422, res5.StatusCode)
+
+	// A signed URL bound to an IP address can't be used from another address
+	res6, link := sign("?BindIP=true")
+	assert.Equal(t, 200, res6.StatusCode)
+	res7, err := http.Get(ts.URL + link)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res7.StatusCode)
+	req, err := http.NewRequest("GET", ts.URL+link, nil)
+	assert.NoError(t, err)
+	req.Header.Add("X-Forwarded-For", "203.0.113.42")
+	res8, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, res8.StatusCode)
+}
+
 func TestHeadDirOrFileNotFound(t *testing.T) {
 	req, _ := http.NewRequest("HEAD", ts.URL+"/files/fakeid/?Type=directory", strings.NewReader(""))
 	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
@@ -1721,6 +1959,216 @@ func TestThumbnail(t *testing.T) {
 	assert.True(t, strings.HasPrefix(res4.Header.Get("Content-Type"), "image/jpeg"))
 }
 
+func TestThumbnailRateLimit(t *testing.T) {
+	conf := config.GetConfig()
+	conf.RateLimits = map[string]config.RateLimit{"thumbnail": {Limit: 2}}
+	defer func() { conf.RateLimits = nil }()
+
+	res1, _ := httpGet(ts.URL + "/files/" + imgID)
+	assert.Equal(t, 200, res1.StatusCode)
+	var obj map[string]interface{}
+	err := extractJSONRes(res1, &obj)
+	assert.NoError(t, err)
+	data := obj["data"].(map[string]interface{})
+	links := data["links"].(map[string]interface{})
+	small := links["small"].(string)
+
+	// The requests with a secret and without a token are counted per client
+	get := func(ip string) int {
+		req, err := http.NewRequest("GET", ts.URL+small, nil)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		req.Header.Set("X-Real-IP", ip)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, 200, get("198.51.100.1"))
+	assert.Equal(t, 200, get("198.51.100.1"))
+	assert.Equal(t, 429, get("198.51.100.1"))
+	assert.Equal(t, 200, get("198.51.100.2"))
+}
+
+func TestPDFPages(t *testing.T) {
+	res1, obj := upload(t, "/files/?Type=file&Name=preview.pdf", "application/pdf", "%PDF-1.4 foo", "")
+	assert.Equal(t, 201, res1.StatusCode)
+	data := obj["data"].(map[string]interface{})
+	links := data["links"].(map[string]interface{})
+	pages := links["pages"].(string)
+	assert.Contains(t, pages, "/pages/")
+	assert.Nil(t, links["small"])
+
+	res2, _ := download(t, pages+"/0", "")
+	assert.Equal(t, 422, res2.StatusCode)
+	res3, _ := download(t, pages+"/1?width=4", "")
+	assert.Equal(t, 422, res3.StatusCode)
+	res4, _ := download(t, pages+"/1?format=gif", "")
+	assert.Equal(t, 422, res4.StatusCode)
+	res5, _ := download(t, "/files/"+data["id"].(string)+"/pages/badsecret/1", "")
+	assert.Equal(t, 400, res5.StatusCode)
+}
+
+func TestVideoStream(t *testing.T) {
+	res1, obj := upload(t, "/files/?Type=file&Name=clip.mp4", "video/mp4", "not really a video", "")
+	assert.Equal(t, 201, res1.StatusCode)
+	data := obj["data"].(map[string]interface{})
+	videoID := data["id"].(string)
+	links := data["links"].(map[string]interface{})
+	assert.Nil(t, links["stream"])
+
+	// The link is given only when the videos are transcoded
+	config.GetConfig().Jobs.FFmpegCmd = "ffmpeg"
+	res2, _ := httpGet(ts.URL + "/files/" + videoID)
+	config.GetConfig().Jobs.FFmpegCmd = ""
+	assert.Equal(t, 200, res2.StatusCode)
+	err := extractJSONRes(res2, &obj)
+	assert.NoError(t, err)
+	data = obj["data"].(map[string]interface{})
+	links = data["links"].(map[string]interface{})
+	stream := links["stream"].(string)
+	assert.True(t, strings.HasSuffix(stream, "/master.m3u8"))
+
+	res3, _ := download(t, stream, "")
+	assert.Equal(t, 404, res3.StatusCode)
+
+	doc, err := testInstance.VFS().FileByID(videoID)
+	assert.NoError(t, err)
+	th, err := testInstance.StreamsFS().CreateStreamFile(doc, "master.m3u8")
+	assert.NoError(t, err)
+	_, err = th.Write([]byte("#EXTM3U\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, th.Commit())
+
+	res4, body := download(t, stream, "")
+	assert.Equal(t, 200, res4.StatusCode)
+	assert.Equal(t, "application/vnd.apple.mpegurl", res4.Header.Get("Content-Type"))
+	assert.Equal(t, "#EXTM3U\n", string(body))
+
+	res5, _ := download(t, strings.TrimSuffix(stream, "master.m3u8")+"clip.mp4", "")
+	assert.Equal(t, 404, res5.StatusCode)
+	assert.NoError(t, testInstance.StreamsFS().RemoveStreams(doc))
+}
+
+func TestEncryptedDir(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=encrypted&Type=directory&Encrypted=true")
+	assert.Equal(t, 201, res1.StatusCode)
+	dirID, dirData := extractDirData(t, data1)
+	attrs := dirData["attributes"].(map[string]interface{})
+	assert.Equal(t, true, attrs["encrypted"])
+
+	res2, data2 := createDir(t, "/files/"+dirID+"?Name=subdir&Type=directory")
+	assert.Equal(t, 201, res2.StatusCode)
+	_, dirData = extractDirData(t, data2)
+	attrs = dirData["attributes"].(map[string]interface{})
+	assert.Equal(t, true, attrs["encrypted"])
+
+	res3, obj := upload(t, "/files/"+dirID+"?Type=file&Name=blob.jpg", "image/jpeg", "opaque blob", "")
+	assert.Equal(t, 201, res3.StatusCode)
+	data := obj["data"].(map[string]interface{})
+	fileID := data["id"].(string)
+	attrs = data["attributes"].(map[string]interface{})
+	assert.Equal(t, true, attrs["encrypted"])
+	assert.Equal(t, "application/octet-stream", attrs["mime"])
+	assert.Equal(t, "files", attrs["class"])
+	links := data["links"].(map[string]interface{})
+	assert.Nil(t, links["small"])
+
+	// The content can't be moved out of the encrypted directory
+	move := map[string]interface{}{"dir_id": consts.RootDirID}
+	res4, _ := patchFile(t, "/files/"+fileID, "file", fileID, move, nil)
+	assert.Equal(t, 412, res4.StatusCode)
+
+	res5, _ := uploadMod(t, "/files/"+dirID+"/keys/laptop", "application/vnd.api+json",
+		`{"data": {"attributes": {"public_key": "pub", "wrapped_key": "wrapped"}}}`, "")
+	assert.Equal(t, 200, res5.StatusCode)
+	res6, _ := uploadMod(t, "/files/"+dirID+"/keys/phone", "application/vnd.api+json",
+		`{"data": {"attributes": {"public_key": "pub"}}}`, "")
+	assert.Equal(t, 422, res6.StatusCode)
+
+	res7, err := httpGet(ts.URL + "/files/" + dirID + "/keys")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res7.StatusCode)
+	err = extractJSONRes(res7, &obj)
+	assert.NoError(t, err)
+	list := obj["data"].([]interface{})
+	if assert.Len(t, list, 1) {
+		attrs = list[0].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, "laptop", attrs["recipient"])
+		assert.Equal(t, "wrapped", attrs["wrapped_key"])
+	}
+
+	res8, _ := trash(t, "/files/"+dirID+"/keys/laptop")
+	assert.Equal(t, 204, res8.StatusCode)
+	res9, _ := trash(t, "/files/"+dirID+"/keys/laptop")
+	assert.Equal(t, 404, res9.StatusCode)
+
+	res10, err := httpGet(ts.URL + "/files/" + consts.RootDirID + "/keys")
+	assert.NoError(t, err)
+	assert.Equal(t, 400, res10.StatusCode)
+}
+
+func TestUploadInTwoPhases(t *testing.T) {
+	config.GetConfig().Uploads.TTL = time.Hour
+
+	// The checksum is the one of foo
+	res1, _ := upload(t, "/files/_uploads?DirID="+consts.RootDirID, "text/plain", "bar", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 412, res1.StatusCode)
+
+	body := "Hello two phases"
+	res3, obj := upload(t, "/files/_uploads?DirID="+consts.RootDirID, "text/plain", body, "")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+	data := obj["data"].(map[string]interface{})
+	assert.Equal(t, consts.FilesUploads, data["type"])
+	uploadID := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "ready", attrs["state"])
+	assert.Equal(t, "16", attrs["size"])
+	assert.Equal(t, "text/plain", attrs["mime"])
+
+	// The file does not exist before the commit
+	res4, err := httpGet(ts.URL + "/files/metadata?Path=/two-phases.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res4.StatusCode)
+
+	commit := `{"data": {"attributes": {"name": "two-phases.txt", "tags": ["staged"]}}}`
+	res5, obj := upload(t, "/files/_uploads/"+uploadID+"/commit", "application/vnd.api+json", commit, "")
+	if !assert.Equal(t, 201, res5.StatusCode) {
+		return
+	}
+	data = obj["data"].(map[string]interface{})
+	attrs = data["attributes"].(map[string]interface{})
+	assert.Equal(t, "two-phases.txt", attrs["name"])
+	assert.Equal(t, "16", attrs["size"])
+	assert.Equal(t, []interface{}{"staged"}, attrs["tags"])
+
+	res6, err := httpGet(ts.URL + "/files/download?Path=/two-phases.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res6.StatusCode)
+	content, err := ioutil.ReadAll(res6.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(content))
+
+	// The upload has been removed
+	res7, _ := upload(t, "/files/_uploads/"+uploadID+"/commit", "application/vnd.api+json", commit, "")
+	assert.Equal(t, 404, res7.StatusCode)
+
+	res8, obj := upload(t, "/files/_uploads?DirID="+consts.RootDirID, "text/plain", body, "")
+	if !assert.Equal(t, 201, res8.StatusCode) {
+		return
+	}
+	uploadID = obj["data"].(map[string]interface{})["id"].(string)
+	res9, _ := trash(t, "/files/_uploads/"+uploadID)
+	assert.Equal(t, 204, res9.StatusCode)
+	res10, _ := trash(t, "/files/_uploads/"+uploadID)
+	assert.Equal(t, 404, res10.StatusCode)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
@@ -0,0 +1,115 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/workers/cloudimport"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+var errMissingAccount = errors.New("The account is missing")
+
+// importDirs are the directories where the files are imported when the
+// request has no dir_id.
+var importDirs = map[string]string{
+	"google_drive": "/Google Drive",
+	"dropbox":      "/Dropbox",
+}
+
+type apiImport struct {
+	*cloudimport.Import
+}
+
+func (i *apiImport) MarshalJSON() ([]byte, error) { return json.Marshal(i.Import) }
+func (i *apiImport) Included() []jsonapi.Object   { return nil }
+func (i *apiImport) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/_imports/" + i.ID()}
+}
+func (i *apiImport) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"dir": jsonapi.Relationship{
+			Data: couchdb.DocReference{ID: i.DirID, Type: consts.Files},
+		},
+	}
+}
+
+// CreateImportHandler handles POST requests on /files/_imports to start the
+// import of the files of a Google Drive or Dropbox account.
+func CreateImportHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	var attrs struct {
+		Provider string `json:"provider"`
+		Account  string `json:"account"`
+		DirID    string `json:"dir_id"`
+	}
+	if _, err := jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return err
+	}
+	if !cloudimport.IsValidProvider(attrs.Provider) {
+		return jsonapi.InvalidAttribute("provider", cloudimport.ErrUnknownProvider)
+	}
+	if attrs.Account == "" {
+		return jsonapi.InvalidAttribute("account", errMissingAccount)
+	}
+	if err := middlewares.AllowTypeAndID(c, permissions.GET, consts.Accounts, attrs.Account); err != nil {
+		return err
+	}
+
+	fs := inst.VFS()
+	var dir *vfs.DirDoc
+	var err error
+	if attrs.DirID != "" {
+		dir, err = fs.DirByID(attrs.DirID)
+	} else {
+		if err = middlewares.AllowWholeType(c, permissions.POST, consts.Files); err != nil {
+			return err
+		}
+		dir, err = vfs.MkdirAll(fs, importDirs[attrs.Provider])
+	}
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.POST, dir, nil); err != nil {
+		return err
+	}
+
+	imp, err := cloudimport.Start(inst, attrs.Provider, attrs.Account, dir.ID())
+	if err != nil {
+		return wrapImportError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, &apiImport{imp}, nil)
+}
+
+// ImportHandler handles GET requests on /files/_imports/:import-id to follow
+// the progress of an import. As the import writes the files in its
+// directory, the same permission as for starting it is required.
+func ImportHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	imp, err := cloudimport.Get(inst, c.Param("import-id"))
+	if err != nil {
+		return wrapImportError(err)
+	}
+	dir, err := inst.VFS().DirByID(imp.DirID)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.POST, dir, nil); err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiImport{imp}, nil)
+}
+
+func wrapImportError(err error) error {
+	if couchdb.IsNotFoundError(err) {
+		return jsonapi.NotFound(err)
+	}
+	return WrapVfsError(err)
+}
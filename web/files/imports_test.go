@@ -0,0 +1,157 @@
+package files
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/workers/cloudimport"
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func importToken(t *testing.T, scope string) string {
+	tok, err := testInstance.MakeJWT(permissions.AccessTokenAudience,
+		clientID, scope, "", time.Now())
+	require.NoError(t, err)
+	return tok
+}
+
+func postImport(t *testing.T, tok string, attrs map[string]interface{}) (*http.Response, map[string]interface{}) {
+	body, err := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"type":       consts.FilesImports,
+			"attributes": attrs,
+		},
+	})
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", ts.URL+"/files/_imports", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Add(echo.HeaderContentType, "application/vnd.api+json")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+tok)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var v map[string]interface{}
+	require.NoError(t, extractJSONRes(res, &v))
+	return res, v
+}
+
+func getImport(t *testing.T, tok, id string) (*http.Response, map[string]interface{}) {
+	req, err := http.NewRequest("GET", ts.URL+"/files/_imports/"+id, nil)
+	require.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+tok)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var v map[string]interface{}
+	require.NoError(t, extractJSONRes(res, &v))
+	return res, v
+}
+
+func TestCreateImportErrors(t *testing.T) {
+	full := importToken(t, consts.Files+" "+consts.Accounts)
+
+	res, _ := postImport(t, full, map[string]interface{}{
+		"provider": "onedrive",
+		"account":  "account-id",
+	})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, _ = postImport(t, full, map[string]interface{}{
+		"provider": "dropbox",
+	})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, _ = postImport(t, full, map[string]interface{}{
+		"provider": "dropbox",
+		"account":  "account-id",
+		"dir_id":   "no-such-dir",
+	})
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestCreateImportPermissions(t *testing.T) {
+	dir, err := vfs.MkdirAll(testInstance.VFS(), "/Imports/Allowed")
+	require.NoError(t, err)
+	other, err := vfs.MkdirAll(testInstance.VFS(), "/Imports/Other")
+	require.NoError(t, err)
+	attrs := map[string]interface{}{
+		"provider": "google_drive",
+		"account":  "account-id",
+		"dir_id":   dir.ID(),
+	}
+
+	// The account must be readable
+	res, _ := postImport(t, token, attrs)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	otherAccount := importToken(t, consts.Files+" "+consts.Accounts+":GET:other-account-id")
+	res, _ = postImport(t, otherAccount, attrs)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	// And the files must be writable in the directory
+	readOnly := importToken(t, consts.Files+":GET "+consts.Accounts)
+	res, _ = postImport(t, readOnly, attrs)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	inOtherDir := importToken(t, consts.Files+":POST:"+other.ID()+" "+consts.Accounts)
+	res, _ = postImport(t, inOtherDir, attrs)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	// Without a directory, the default one can only be created with the
+	// permission on the whole type
+	delete(attrs, "dir_id")
+	inDir := importToken(t, consts.Files+":POST:"+dir.ID()+" "+consts.Accounts)
+	res, _ = postImport(t, inDir, attrs)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	attrs["dir_id"] = dir.ID()
+	res, v := postImport(t, inDir, attrs)
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+	data := v["data"].(map[string]interface{})
+	assert.NotEmpty(t, data["id"])
+	rels := data["relationships"].(map[string]interface{})
+	dirRel := rels["dir"].(map[string]interface{})["data"].(map[string]interface{})
+	assert.Equal(t, dir.ID(), dirRel["id"])
+}
+
+func TestGetImport(t *testing.T) {
+	dir, err := vfs.MkdirAll(testInstance.VFS(), "/Imports/Followed")
+	require.NoError(t, err)
+	other, err := vfs.MkdirAll(testInstance.VFS(), "/Imports/Elsewhere")
+	require.NoError(t, err)
+	imp := &cloudimport.Import{
+		Provider:  "dropbox",
+		AccountID: "account-id",
+		DirID:     dir.ID(),
+		State:     cloudimport.StateDone,
+		CreatedAt: time.Now(),
+	}
+	require.NoError(t, couchdb.CreateDoc(testInstance, imp))
+
+	res, v := getImport(t, token, imp.ID())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	attrs := v["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, cloudimport.StateDone, attrs["state"])
+	assert.Equal(t, "dropbox", attrs["provider"])
+
+	// The permission to write in the directory of the import is required
+	readOnly := importToken(t, consts.Files+":GET")
+	res, _ = getImport(t, readOnly, imp.ID())
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	inOtherDir := importToken(t, consts.Files+":POST:"+other.ID())
+	res, _ = getImport(t, inOtherDir, imp.ID())
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	inDir := importToken(t, consts.Files+":POST:"+dir.ID())
+	res, _ = getImport(t, inDir, imp.ID())
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, _ = getImport(t, token, "no-such-import")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
@@ -0,0 +1,176 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/errcode"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+var errMultipartNoFilename = errors.New("The part has no filename")
+
+// multipartResult is the result of the upload of a part of a multipart
+// request: the created file, or the error.
+type multipartResult struct {
+	Path   string          `json:"path"`
+	Status int             `json:"status,string"`
+	File   json.RawMessage `json:"file,omitempty"`
+	Error  *jsonapi.Error  `json:"error,omitempty"`
+}
+
+// MultipartUploadHandler handles POST requests on /files/:dir-id/multipart
+// to upload several files in one multipart/form-data request. The filename
+// of each part can be a relative path, like the ones of the files of a
+// folder dropped in a browser: the missing directories are created inside
+// the directory of the request. The response has a result for each part,
+// as an error for a file does not stop the upload of the next ones.
+func MultipartUploadHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	fs := inst.VFS()
+	root, err := fs.DirByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, "POST", root, nil); err != nil {
+		return err
+	}
+	reader, err := c.Request().MultipartReader()
+	if err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	tags := strings.Split(c.QueryParam("Tags"), TagSeparator)
+
+	dirs := map[string]*vfs.DirDoc{".": root}
+	results := make([]*multipartResult, 0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return jsonapi.BadRequest(err)
+		}
+		_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if err != nil || params["filename"] == "" {
+			// The part is not a file, like a field of a form
+			part.Close()
+			continue
+		}
+		// The filename is not taken from part.FileName(), as it may keep only
+		// the base name, and the path is needed to create the directories.
+		relpath := strings.TrimPrefix(path.Clean("/"+params["filename"]), "/")
+		result := &multipartResult{Path: relpath}
+		doc, err := uploadPart(c, fs, dirs, relpath, part, tags)
+		if err != nil {
+			result.Error = partError(err)
+			result.Status = result.Error.Status
+		} else {
+			result.Status = http.StatusCreated
+			if result.File, err = jsonapi.MarshalObject(newFile(doc, inst)); err != nil {
+				return err
+			}
+		}
+		part.Close()
+		results = append(results, result)
+	}
+	return c.JSON(http.StatusOK, struct {
+		Data []*multipartResult `json:"data"`
+	}{results})
+}
+
+// uploadPart creates the file of a part, and its missing parent directories.
+// The directories are kept in the dirs map, indexed by their path relative to
+// the directory of the request, for the next parts.
+func uploadPart(c echo.Context, fs vfs.VFS, dirs map[string]*vfs.DirDoc, relpath string, part *multipart.Part, tags []string) (*vfs.FileDoc, error) {
+	if relpath == "" {
+		return nil, errMultipartNoFilename
+	}
+	dirpath, name := path.Split(relpath)
+	dirpath = path.Clean(dirpath)
+	parent, ok := dirs[dirpath]
+	if !ok {
+		var err error
+		parent, err = vfs.MkdirAll(fs, path.Join(dirs["."].Fullpath, dirpath))
+		if err != nil {
+			return nil, err
+		}
+		dirs[dirpath] = parent
+	}
+
+	var md5Sum []byte
+	if md5Str := part.Header.Get("Content-MD5"); md5Str != "" {
+		var err error
+		if md5Sum, err = parseMD5Hash(md5Str); err != nil {
+			return nil, jsonapi.InvalidParameter("Content-MD5", err)
+		}
+	}
+	mime, class := mimeAndClass(part.Header.Get("Content-Type"), name)
+	doc, err := vfs.NewFileDoc(name, parent.DocID, -1, md5Sum, mime, class,
+		time.Now(), false, false, tags)
+	if err != nil {
+		return nil, err
+	}
+	if err = vfs.InheritEncryption(fs, doc); err != nil {
+		return nil, err
+	}
+	if err = checkPerm(c, "POST", nil, doc); err != nil {
+		return nil, err
+	}
+	if err = createFileFromReader(fs, doc, part); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// partError converts the error of a part to a JSON-API error, like the error
+// handler does for the errors of a request.
+func partError(err error) *jsonapi.Error {
+	switch e := err.(type) {
+	case *jsonapi.Error:
+		return e
+	case *echo.HTTPError:
+		return jsonapi.NewError(e.Code, fmt.Sprintf("%v", e.Message))
+	case *couchdb.Error:
+		return &jsonapi.Error{Status: e.StatusCode, Title: e.Name, Code: errcode.FromStatus(e.StatusCode), Detail: e.Reason}
+	}
+	if os.IsExist(err) {
+		return jsonapi.Conflict(err)
+	}
+	if os.IsNotExist(err) {
+		return jsonapi.NotFound(err)
+	}
+	return wrapVfsErrorJSONAPI(err)
+}
+
+// createFileFromReader creates a file with the content of the reader. When
+// the size of the file is not known in advance, the file is created even if
+// the reader fails before the end of the content, so it is removed.
+func createFileFromReader(fs vfs.VFS, doc *vfs.FileDoc, r io.Reader) error {
+	file, err := fs.CreateFile(doc, nil)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	cerr := file.Close()
+	if err != nil {
+		if cerr == nil {
+			_ = fs.DestroyFile(doc)
+		}
+		return err
+	}
+	return cerr
+}
@@ -3,11 +3,15 @@ package files
 // Links is used to generate a JSON-API link for the directory (part of
 import (
 	"encoding/json"
+	"net/http"
+	"strconv"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/workers/video"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/echo"
@@ -21,11 +25,16 @@ type dir struct {
 	doc      *vfs.DirDoc
 	rel      jsonapi.RelationshipMap
 	included []jsonapi.Object
+	// size has the aggregates of the directory, when they are known
+	size *vfs.DirSize
 }
 
 type file struct {
 	doc      *vfs.FileDoc
 	instance *instance.Instance
+	// share is set when the file is sent to a visitor of a share by link, to
+	// bind the secrets of the links to their sharecode
+	share *vfs.SharedFile
 }
 
 type apiArchive struct {
@@ -91,7 +100,6 @@ func getDirData(c echo.Context, doc *vfs.DirDoc) (int, couchdb.Cursor, []vfs.Dir
 }
 
 func dirData(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
-	instance := middlewares.GetInstance(c)
 	count, cursor, children, err := getDirData(c, doc)
 	if err != nil {
 		return err
@@ -99,6 +107,7 @@ func dirData(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
 
 	relsData := make([]couchdb.DocReference, 0)
 	included := make([]jsonapi.Object, 0)
+	var dirs []*dir
 
 	for _, child := range children {
 		if child.ID() == consts.TrashDirID {
@@ -107,9 +116,11 @@ func dirData(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
 		relsData = append(relsData, couchdb.DocReference{ID: child.ID(), Type: child.DocType()})
 		d, f := child.Refine()
 		if d != nil {
-			included = append(included, newDir(d))
+			sub := newDir(d)
+			dirs = append(dirs, sub)
+			included = append(included, sub)
 		} else {
-			included = append(included, newFile(f, instance))
+			included = append(included, newFileForRequest(c, f))
 		}
 	}
 
@@ -157,51 +168,106 @@ func dirData(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
 		rel:      rel,
 		included: included,
 	}
+	dirs = append(dirs, d)
+	addDirSizes(c, dirs)
+
+	// The response has the contents of the directory: its entity tag is
+	// computed from the revisions of the directory and of its children.
+	etag := []string{doc.Rev(), strconv.Itoa(count), links.Next}
+	for _, child := range children {
+		etag = append(etag, child.ID(), child.Rev())
+	}
+	for _, sub := range dirs {
+		if sub.size != nil {
+			etag = append(etag, sub.ID(), sub.size.DocRev)
+		}
+	}
+	if jsonapi.NotModifiedWeak(c, jsonapi.WeakETag(etag...)) && statusCode == http.StatusOK {
+		return c.NoContent(http.StatusNotModified)
+	}
 
 	return jsonapi.Data(c, statusCode, d, &links)
 }
 
 func dirDataList(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
-	instance := middlewares.GetInstance(c)
 	count, cursor, children, err := getDirData(c, doc)
 	if err != nil {
 		return err
 	}
 
 	included := make([]jsonapi.Object, 0)
+	var dirs []*dir
 	for _, child := range children {
 		if child.ID() == consts.TrashDirID {
 			continue
 		}
 		d, f := child.Refine()
 		if d != nil {
-			included = append(included, newDir(d))
+			sub := newDir(d)
+			dirs = append(dirs, sub)
+			included = append(included, sub)
 		} else {
-			included = append(included, newFile(f, instance))
+			included = append(included, newFileForRequest(c, f))
 		}
 	}
+	addDirSizes(c, dirs)
 
-	var links jsonapi.LinksList
-	if cursor.HasMore() {
-		params, err := jsonapi.PaginationCursorToParams(cursor)
-		if err != nil {
-			return err
-		}
-		next := c.Request().URL.Path + "?" + params.Encode()
-		links.Next = next
+	links, err := jsonapi.PaginationLinks(c, cursor)
+	if err != nil {
+		return err
 	}
 
-	return jsonapi.DataListWithTotal(c, statusCode, count, included, &links)
+	return jsonapi.DataListWithTotal(c, statusCode, count, included, links)
+}
+
+// addDirSizes fetches the aggregates of the directories. They are optional:
+// the directories are sent without them if they cannot be fetched.
+func addDirSizes(c echo.Context, dirs []*dir) {
+	if len(dirs) == 0 {
+		return
+	}
+	ids := make([]string, len(dirs))
+	for i, d := range dirs {
+		ids[i] = d.ID()
+	}
+	sizes, err := vfs.GetDirSizes(middlewares.GetInstance(c), ids)
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		d.size = sizes[d.ID()]
+	}
 }
 
 // newFile creates an instance of file struct from a vfs.FileDoc document.
 func newFile(doc *vfs.FileDoc, i *instance.Instance) *file {
-	return &file{doc, i}
+	return &file{doc: doc, instance: i}
+}
+
+// newFileForRequest is like newFile, but the secrets in the links are bound
+// to the sharecode of the requester for the visitors of a share by link.
+func newFileForRequest(c echo.Context, doc *vfs.FileDoc) *file {
+	f := newFile(doc, middlewares.GetInstance(c))
+	f.share = sharedFileTemplate(c)
+	return f
+}
+
+// downloadSecret returns a secret that can be used in the links to download
+// the file at the given path, or to see its thumbnails.
+func (f *file) downloadSecret(path string) (string, error) {
+	if f.share == nil {
+		return vfs.GetStore().AddFile(f.instance, path)
+	}
+	shared := *f.share
+	shared.Path = path
+	return vfs.GetStore().AddSharedFile(f.instance, &shared)
 }
 
 func fileData(c echo.Context, statusCode int, doc *vfs.FileDoc, links *jsonapi.LinksList) error {
-	instance := middlewares.GetInstance(c)
-	return jsonapi.Data(c, statusCode, newFile(doc, instance), links)
+	if doc.Rev() != "" {
+		c.Response().Header().Set("Etag", jsonapi.ETag(doc.Rev()))
+	}
+	return jsonapi.Data(c, statusCode, newFileForRequest(c, doc), links)
 }
 
 var (
@@ -218,7 +284,16 @@ func (d *dir) DocType() string                        { return d.doc.DocType() }
 func (d *dir) Clone() couchdb.Doc                     { cloned := *d; return &cloned }
 func (d *dir) Relationships() jsonapi.RelationshipMap { return d.rel }
 func (d *dir) Included() []jsonapi.Object             { return d.included }
-func (d *dir) MarshalJSON() ([]byte, error)           { return json.Marshal(d.doc) }
+func (d *dir) MarshalJSON() ([]byte, error) {
+	if d.size == nil {
+		return json.Marshal(d.doc)
+	}
+	return json.Marshal(struct {
+		*vfs.DirDoc
+		Size       int64 `json:"size,string"`
+		FilesCount int64 `json:"files_count"`
+	}{d.doc, d.size.Size, d.size.FilesCount})
+}
 func (d *dir) Links() *jsonapi.LinksList {
 	return &jsonapi.LinksList{Self: "/files/" + d.doc.DocID}
 }
@@ -267,12 +342,24 @@ func (f *file) Links() *jsonapi.LinksList {
 	links := jsonapi.LinksList{Self: "/files/" + f.doc.DocID}
 	if f.doc.Class == "image" {
 		if path, err := f.doc.Path(f.instance.VFS()); err == nil {
-			if secret, err := vfs.GetStore().AddFile(f.instance, path); err == nil {
+			if secret, err := f.downloadSecret(path); err == nil {
 				links.Small = "/files/" + f.doc.DocID + "/thumbnails/" + secret + "/small"
 				links.Medium = "/files/" + f.doc.DocID + "/thumbnails/" + secret + "/medium"
 				links.Large = "/files/" + f.doc.DocID + "/thumbnails/" + secret + "/large"
 			}
 		}
+	} else if f.doc.Mime == "application/pdf" {
+		if path, err := f.doc.Path(f.instance.VFS()); err == nil {
+			if secret, err := f.downloadSecret(path); err == nil {
+				links.Pages = "/files/" + f.doc.DocID + "/pages/" + secret
+			}
+		}
+	} else if f.doc.Class == "video" && config.GetConfig().Jobs.FFmpegCmd != "" {
+		if path, err := f.doc.Path(f.instance.VFS()); err == nil {
+			if secret, err := f.downloadSecret(path); err == nil {
+				links.Stream = "/files/" + f.doc.DocID + "/stream/" + secret + "/" + video.MasterPlaylist
+			}
+		}
 	}
 	return &links
 }
@@ -0,0 +1,88 @@
+package files
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+const (
+	defaultFilesPerPage = 30
+	maxFilesPerPage     = 100
+)
+
+// recordAccess records that the content of a file has been sent to the user,
+// for the list of the recent files. An error is only logged, as it must not
+// prevent the file from being downloaded.
+func recordAccess(c echo.Context, doc *vfs.FileDoc) {
+	if c.Request().Method == http.MethodHead {
+		return
+	}
+	inst := middlewares.GetInstance(c)
+	if err := vfs.RecordAccess(inst, doc); err != nil {
+		inst.Logger().WithField("nspace", "files").
+			Warnf("Could not record the access to %s: %s", doc.ID(), err)
+	}
+}
+
+// RecentFilesHandler handles GET requests on /files/_recent to list the
+// files recently opened or downloaded, from the most recent.
+func RecentFilesHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Files); err != nil {
+		return err
+	}
+	cursor, err := jsonapi.ExtractPaginationCursor(c, defaultFilesPerPage, maxFilesPerPage)
+	if err != nil {
+		return err
+	}
+	files, err := vfs.RecentFiles(inst.VFS(), cursor)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	links, err := jsonapi.PaginationLinks(c, cursor)
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, len(files))
+	for i, f := range files {
+		objs[i] = newFile(f, inst)
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+// FavoritesHandler handles GET requests on /files/_favorites to list the
+// files and directories marked as favorites, sorted by name.
+func FavoritesHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Files); err != nil {
+		return err
+	}
+	cursor, err := jsonapi.ExtractPaginationCursor(c, defaultFilesPerPage, maxFilesPerPage)
+	if err != nil {
+		return err
+	}
+	docs, err := vfs.Favorites(inst, cursor)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	links, err := jsonapi.PaginationLinks(c, cursor)
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, 0, len(docs))
+	for _, doc := range docs {
+		d, f := doc.Refine()
+		if d != nil {
+			objs = append(objs, newDir(d))
+		} else if f != nil {
+			objs = append(objs, newFile(f, inst))
+		}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
@@ -3,7 +3,6 @@ package files
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"strings"
 
@@ -105,14 +104,9 @@ func ListReferencesHandler(c echo.Context) error {
 
 	cursor.UpdateFrom(&res)
 
-	var links = &jsonapi.LinksList{}
-	if cursor.HasMore() {
-		params, err2 := jsonapi.PaginationCursorToParams(cursor)
-		if err2 != nil {
-			return err2
-		}
-		links.Next = fmt.Sprintf("%s?%s",
-			c.Request().URL.Path, params.Encode())
+	links, err := jsonapi.PaginationLinks(c, cursor)
+	if err != nil {
+		return err
 	}
 
 	var refs = make([]couchdb.DocReference, len(res.Rows))
@@ -0,0 +1,138 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const (
+	// defaultSignedURLTTL is the validity of a signed URL when no TTL is given
+	defaultSignedURLTTL = 10 * time.Minute
+	// maxSignedURLTTL is the maximal validity of a signed URL
+	maxSignedURLTTL = 1 * time.Hour
+)
+
+var signedURLMACConfig = crypto.MACConfig{
+	Name:   "signed-url",
+	MaxAge: maxSignedURLTTL,
+	MaxLen: 256,
+}
+
+var (
+	errSignedURLInvalid = errors.New("The signed URL is invalid")
+	errSignedURLExpired = errors.New("The signed URL has expired")
+)
+
+// signFileURL returns a token that gives access to the content of the file
+// until the given expiration date. If ip is not empty, the token can only be
+// used from this IP address.
+func signFileURL(inst *instance.Instance, doc *vfs.FileDoc, expires time.Time, ip string) (string, error) {
+	value := strconv.FormatInt(expires.Unix(), 10) + "|" + ip + "|" + doc.ID()
+	token, err := crypto.EncodeAuthMessage(signedURLMACConfig, inst.SessionSecret, []byte(value), nil)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// verifySignedURL checks the token of a signed URL, and returns the ID of the
+// file that can be downloaded with it.
+func verifySignedURL(inst *instance.Instance, token, ip string) (string, error) {
+	value, err := crypto.DecodeAuthMessage(signedURLMACConfig, inst.SessionSecret, []byte(token), nil)
+	if err != nil {
+		return "", errSignedURLInvalid
+	}
+	parts := strings.SplitN(string(value), "|", 3)
+	if len(parts) != 3 {
+		return "", errSignedURLInvalid
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", errSignedURLInvalid
+	}
+	if time.Unix(expires, 0).Before(time.Now()) {
+		return "", errSignedURLExpired
+	}
+	if parts[1] != "" && parts[1] != ip {
+		return "", errSignedURLInvalid
+	}
+	return parts[2], nil
+}
+
+// SignedURLCreateHandler handles POST requests on /files/:file-id/signed to
+// mint a short-lived URL for downloading the file without any credential.
+// It can be given to a media element or to a third-party viewer, without
+// leaking the token or the session cookie of the application.
+func SignedURLCreateHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	doc, err := inst.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+
+	ttl := defaultSignedURLTTL
+	if param := c.QueryParam("TTL"); param != "" {
+		ttl, err = time.ParseDuration(param)
+		if err != nil || ttl <= 0 || ttl > maxSignedURLTTL {
+			return jsonapi.InvalidParameter("TTL", errors.New("The TTL is invalid"))
+		}
+	}
+	ip := ""
+	if c.QueryParam("BindIP") == "true" {
+		ip = c.RealIP()
+	}
+
+	expires := time.Now().Add(ttl)
+	token, err := signFileURL(inst, doc, expires, ip)
+	if err != nil {
+		return err
+	}
+	links := &jsonapi.LinksList{
+		Related: "/files/signed/" + token + "/" + doc.DocName,
+	}
+	return fileData(c, http.StatusOK, doc, links)
+}
+
+// SignedURLDownloadHandler handles GET requests on /files/signed/:token/:name
+// to send the content of a file with a signed URL.
+func SignedURLDownloadHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	fileID, err := verifySignedURL(inst, c.Param("token"), c.RealIP())
+	if err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	doc, err := inst.VFS().FileByID(fileID)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if doc.Trashed {
+		return jsonapi.NotFound(errors.New("The file is in the trash"))
+	}
+
+	disposition := "inline"
+	if c.QueryParam("Dl") == "1" {
+		disposition = "attachment"
+	} else if canBeFramed(doc) {
+		middlewares.AppendCSPRule(c, "frame-ancestors", "*")
+	}
+	recordAccess(c, doc)
+	err = vfs.ServeFileContent(inst.VFS(), doc, disposition, c.Request(), c.Response())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/workers/tags"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+var errMissingTag = errors.New("The tag is missing")
+
+// apiTagsJob is the job pushed for replacing tags, as a JSON-API object.
+type apiTagsJob struct{ j *jobs.Job }
+
+func (j apiTagsJob) ID() string                             { return j.j.ID() }
+func (j apiTagsJob) Rev() string                            { return j.j.Rev() }
+func (j apiTagsJob) DocType() string                        { return consts.Jobs }
+func (j apiTagsJob) Clone() couchdb.Doc                     { return j }
+func (j apiTagsJob) SetID(_ string)                         {}
+func (j apiTagsJob) SetRev(_ string)                        {}
+func (j apiTagsJob) Relationships() jsonapi.RelationshipMap { return nil }
+func (j apiTagsJob) Included() []jsonapi.Object             { return nil }
+func (j apiTagsJob) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/" + j.j.WorkerType + "/" + j.j.ID()}
+}
+func (j apiTagsJob) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.j)
+}
+
+// ListTagsHandler handles GET requests on /files/_tags to list the tags used
+// on the files and directories, with their usage counts.
+func ListTagsHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Files); err != nil {
+		return err
+	}
+	list, err := vfs.ListTags(inst)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return c.JSON(http.StatusOK, struct {
+		Data []vfs.TagCount `json:"data"`
+	}{list})
+}
+
+// RenameTagHandler handles PATCH requests on /files/_tags/:tag to rename a
+// tag on all the files and directories.
+func RenameTagHandler(c echo.Context) error {
+	var attrs struct {
+		Name string `json:"name"`
+	}
+	if _, err := jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return err
+	}
+	into := strings.TrimSpace(attrs.Name)
+	if into == "" {
+		return jsonapi.InvalidAttribute("name", errMissingTag)
+	}
+	return pushTagsJob(c, []string{c.Param("tag")}, into)
+}
+
+// MergeTagsHandler handles POST requests on /files/_tags/_merge to replace
+// several tags by a single one on all the files and directories.
+func MergeTagsHandler(c echo.Context) error {
+	var attrs struct {
+		Tags []string `json:"tags"`
+		Into string   `json:"into"`
+	}
+	if _, err := jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return err
+	}
+	if len(attrs.Tags) == 0 {
+		return jsonapi.InvalidAttribute("tags", errMissingTag)
+	}
+	into := strings.TrimSpace(attrs.Into)
+	if into == "" {
+		return jsonapi.InvalidAttribute("into", errMissingTag)
+	}
+	return pushTagsJob(c, attrs.Tags, into)
+}
+
+// DeleteTagHandler handles DELETE requests on /files/_tags/:tag to remove a
+// tag from all the files and directories.
+func DeleteTagHandler(c echo.Context) error {
+	return pushTagsJob(c, []string{c.Param("tag")}, "")
+}
+
+// pushTagsJob pushes a job to replace the tags, as it can take some time for
+// the instances with a lot of files.
+func pushTagsJob(c echo.Context, list []string, into string) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.PATCH, consts.Files); err != nil {
+		return err
+	}
+	msg, err := jobs.NewMessage(&tags.Options{Tags: list, Into: into})
+	if err != nil {
+		return err
+	}
+	job, err := jobs.System().PushJob(inst, &jobs.JobRequest{
+		WorkerType: "tags",
+		Message:    msg,
+	})
+	if err != nil {
+		return jsonapi.InternalServerError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, apiTagsJob{job}, nil)
+}
@@ -0,0 +1,74 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	statikFS "github.com/cozy/cozy-stack/pkg/statik/fs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+var errUnknownTemplate = errors.New("Unknown template")
+
+// fileTemplates are the templates that can be used to create a new file: the
+// names of the templates to their asset. The assets can be overridden for a
+// context.
+var fileTemplates = map[string]string{
+	"note":         "/files-templates/note.md",
+	"text":         "/files-templates/text.odt",
+	"spreadsheet":  "/files-templates/spreadsheet.ods",
+	"presentation": "/files-templates/presentation.odp",
+}
+
+// CreateFromTemplateHandler handles POST requests on /files/:dir-id/template
+// to create a new file in the directory from a template, like an empty text
+// document, ready to be edited.
+func CreateFromTemplateHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	fs := inst.VFS()
+
+	template := c.QueryParam("Template")
+	assetName, ok := fileTemplates[template]
+	if !ok {
+		return jsonapi.InvalidParameter("Template", errUnknownTemplate)
+	}
+	asset, ok := statikFS.Get(assetName, inst.ContextName)
+	if !ok {
+		if asset, ok = statikFS.Get(assetName); !ok {
+			return jsonapi.NotFound(errUnknownTemplate)
+		}
+	}
+
+	ext := path.Ext(assetName)
+	name := c.QueryParam("Name")
+	if name == "" {
+		name = inst.Translate("Files Template Name " + template)
+	}
+	if !strings.EqualFold(path.Ext(name), ext) {
+		name += ext
+	}
+	tags := strings.Split(c.QueryParam("Tags"), TagSeparator)
+	content := asset.Reader()
+	mime, class := vfs.ExtractMimeAndClassFromFilename(name)
+	doc, err := vfs.NewFileDoc(name, c.Param("file-id"), content.Size(), nil,
+		mime, class, time.Now(), false, false, tags)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = vfs.InheritEncryption(fs, doc); err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, "POST", nil, doc); err != nil {
+		return err
+	}
+	if err = createFileFromReader(fs, doc, content); err != nil {
+		return WrapVfsError(err)
+	}
+	return fileData(c, http.StatusCreated, doc, nil)
+}
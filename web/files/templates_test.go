@@ -0,0 +1,121 @@
+package files
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/cache"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/statik/fs"
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// registerTemplate registers the asset of a template for the given context,
+// as it is done for the assets of the contexts in the configuration.
+func registerTemplate(t *testing.T, context, name, content string) {
+	dir, err := ioutil.TempDir("", "templates")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, filepath.Base(name))
+	require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0600))
+	err = fs.RegisterCustomExternals(cache.New(nil), []fs.AssetOption{{
+		Name:    name,
+		Context: context,
+		URL:     "file://" + filename,
+	}}, 0)
+	require.NoError(t, err)
+}
+
+func createFromTemplate(t *testing.T, query, tok string) (*http.Response, map[string]interface{}) {
+	req, err := http.NewRequest("POST", ts.URL+"/files/"+consts.RootDirID+"/template?"+query, nil)
+	require.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+tok)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var v map[string]interface{}
+	require.NoError(t, extractJSONRes(res, &v))
+	return res, v
+}
+
+func templateFileName(t *testing.T, v map[string]interface{}) string {
+	data, ok := v["data"].(map[string]interface{})
+	require.True(t, ok)
+	attrs, ok := data["attributes"].(map[string]interface{})
+	require.True(t, ok)
+	return attrs["name"].(string)
+}
+
+func TestCreateFromUnknownTemplate(t *testing.T) {
+	res, _ := createFromTemplate(t, "Template=unknown&Name=foo", token)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, _ = createFromTemplate(t, "Name=foo", token)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestCreateFromTemplate(t *testing.T) {
+	registerTemplate(t, "default", "/files-templates/note.md", "# Default note")
+
+	// The extension of the template is appended to the name
+	res, v := createFromTemplate(t, "Template=note&Name=My%20note&Tags=foo,bar", token)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "My note.md", templateFileName(t, v))
+	content, err := readFile(testInstance.VFS(), "/My note.md")
+	assert.NoError(t, err)
+	assert.Equal(t, "# Default note", string(content))
+
+	// But not when the name already has it
+	res, v = createFromTemplate(t, "Template=note&Name=Other%20note.MD", token)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "Other note.MD", templateFileName(t, v))
+
+	// Without a name, a translated one is used
+	res, v = createFromTemplate(t, "Template=note", token)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.True(t, strings.HasSuffix(templateFileName(t, v), ".md"))
+
+	// A file with the same name can't be created twice
+	res, _ = createFromTemplate(t, "Template=note&Name=My%20note", token)
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+}
+
+func TestCreateFromTemplateOfContext(t *testing.T) {
+	registerTemplate(t, "default", "/files-templates/note.md", "# Default note")
+	registerTemplate(t, "templates", "/files-templates/note.md", "# Note of the context")
+	testInstance.ContextName = "templates"
+	defer func() { testInstance.ContextName = "" }()
+
+	res, _ := createFromTemplate(t, "Template=note&Name=Context%20note", token)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	content, err := readFile(testInstance.VFS(), "/Context note.md")
+	assert.NoError(t, err)
+	assert.Equal(t, "# Note of the context", string(content))
+
+	// The default asset is used when the context has not overridden it
+	registerTemplate(t, "default", "/files-templates/text.odt", "default text")
+	res, _ = createFromTemplate(t, "Template=text&Name=Context%20text", token)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	content, err = readFile(testInstance.VFS(), "/Context text.odt")
+	assert.NoError(t, err)
+	assert.Equal(t, "default text", string(content))
+}
+
+func TestCreateFromTemplateWithoutPermission(t *testing.T) {
+	registerTemplate(t, "default", "/files-templates/note.md", "# Default note")
+	readOnly, err := testInstance.MakeJWT(permissions.AccessTokenAudience,
+		clientID, consts.Files+":GET", "", time.Now())
+	require.NoError(t, err)
+
+	res, _ := createFromTemplate(t, "Template=note&Name=Forbidden", readOnly)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	_, err = readFile(testInstance.VFS(), "/Forbidden.md")
+	assert.Error(t, err)
+}
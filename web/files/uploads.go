@@ -0,0 +1,201 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/sharing"
+	"github.com/cozy/cozy-stack/pkg/staging"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+type apiUpload struct {
+	*staging.Upload
+}
+
+func (u *apiUpload) MarshalJSON() ([]byte, error) { return json.Marshal(u.Upload) }
+func (u *apiUpload) Included() []jsonapi.Object   { return nil }
+func (u *apiUpload) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/_uploads/" + u.ID()}
+}
+func (u *apiUpload) Relationships() jsonapi.RelationshipMap {
+	if u.DirID == "" {
+		return nil
+	}
+	return jsonapi.RelationshipMap{
+		"dir": jsonapi.Relationship{
+			Data: couchdb.DocReference{ID: u.DirID, Type: consts.Files},
+		},
+	}
+}
+
+// StageUploadHandler handles POST requests on /files/_uploads to upload the
+// content of a file in the staging area. The file is created in the VFS only
+// when the upload is committed.
+func StageUploadHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	dirID := c.QueryParam("DirID")
+	if dirID == "" {
+		dirID = consts.RootDirID
+	}
+	doc, err := FileDocFromReq(c, c.QueryParam("Name"), dirID, nil)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if doc.DocName == "" {
+		doc.DocName = "upload"
+	}
+	if err = checkPerm(c, permissions.POST, nil, doc); err != nil {
+		return err
+	}
+	if doc.ByteSize >= 0 {
+		if err = sharing.CheckDriveQuota(inst, doc.DirID, doc.ByteSize); err != nil {
+			return WrapVfsError(err)
+		}
+	}
+	maxSize, err := availableDiskSpace(inst)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+
+	up, err := staging.Stage(inst, c.Request().Body, &staging.Options{
+		DirID:        doc.DirID,
+		Size:         doc.ByteSize,
+		MD5Sum:       doc.MD5Sum,
+		Mime:         doc.Mime,
+		Class:        doc.Class,
+		MaxSize:      maxSize,
+		PermissionID: pdoc.ID(),
+	})
+	if err != nil {
+		return wrapUploadError(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiUpload{up}, nil)
+}
+
+// CommitUploadHandler handles POST requests on
+// /files/_uploads/:upload-id/commit to create the file in the VFS with the
+// staged content and the given metadata.
+func CommitUploadHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	up, err := getUploadForRequest(c)
+	if err != nil {
+		return err
+	}
+
+	var attrs struct {
+		Name       string    `json:"name"`
+		DirID      string    `json:"dir_id"`
+		Tags       []string  `json:"tags"`
+		Executable bool      `json:"executable"`
+		UpdatedAt  time.Time `json:"updated_at"`
+	}
+	if _, err = jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return err
+	}
+	if attrs.DirID == "" {
+		attrs.DirID = up.DirID
+	}
+	if attrs.UpdatedAt.IsZero() {
+		attrs.UpdatedAt = time.Now()
+	}
+
+	newdoc, err := vfs.NewFileDoc(attrs.Name, attrs.DirID, up.Size, up.MD5Sum,
+		up.Mime, up.Class, attrs.UpdatedAt, attrs.Executable, false, attrs.Tags)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = vfs.InheritEncryption(inst.VFS(), newdoc); err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.POST, nil, newdoc); err != nil {
+		return err
+	}
+	if err = sharing.CheckDriveQuota(inst, newdoc.DirID, newdoc.ByteSize); err != nil {
+		return WrapVfsError(err)
+	}
+	if err = staging.Commit(inst, up, newdoc); err != nil {
+		return wrapUploadError(err)
+	}
+	return fileData(c, http.StatusCreated, newdoc, nil)
+}
+
+// AbortUploadHandler handles DELETE requests on /files/_uploads/:upload-id
+// to remove an upload and its staged content.
+func AbortUploadHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	up, err := getUploadForRequest(c)
+	if err != nil {
+		return err
+	}
+	if err = staging.Abort(inst, up); err != nil {
+		return wrapUploadError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// getUploadForRequest returns the upload of the request. Only the permission
+// used to stage an upload can commit or abort it.
+func getUploadForRequest(c echo.Context) (*staging.Upload, error) {
+	inst := middlewares.GetInstance(c)
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return nil, err
+	}
+	up, err := staging.Get(inst, c.Param("upload-id"))
+	if err != nil {
+		return nil, wrapUploadError(err)
+	}
+	if up.PermissionID != pdoc.ID() {
+		return nil, jsonapi.NewError(http.StatusForbidden, "This upload has been staged by another client")
+	}
+	return up, nil
+}
+
+// availableDiskSpace returns the number of bytes that can still be stored
+// for the instance, or 0 if there is no quota.
+func availableDiskSpace(inst *instance.Instance) (int64, error) {
+	fs := inst.VFS()
+	quota := fs.DiskQuota()
+	if quota <= 0 {
+		return 0, nil
+	}
+	usage, err := fs.DiskUsage()
+	if err != nil {
+		return 0, err
+	}
+	if usage >= quota {
+		return 0, vfs.ErrFileTooBig
+	}
+	return quota - usage, nil
+}
+
+func wrapUploadError(err error) error {
+	if couchdb.IsNotFoundError(err) {
+		return jsonapi.NotFound(err)
+	}
+	switch err {
+	case staging.ErrExpired:
+		return jsonapi.Errorf(http.StatusGone, "%s", err)
+	case staging.ErrNotReady:
+		return jsonapi.Conflict(err)
+	case staging.ErrInfected:
+		return jsonapi.Errorf(http.StatusUnprocessableEntity, "%s", err)
+	case staging.ErrAntivirusFailed:
+		return jsonapi.Errorf(http.StatusServiceUnavailable, "%s", err)
+	}
+	return WrapVfsError(err)
+}
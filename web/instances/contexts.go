@@ -0,0 +1,37 @@
+package instances
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/echo"
+)
+
+// getContextOverrides returns the overrides of a context made via the admin
+// API.
+func getContextOverrides(c echo.Context) error {
+	overrides, err := instance.GetContextsOverrides()
+	if err != nil {
+		return err
+	}
+	ctx := overrides[c.Param("context")]
+	if ctx == nil {
+		ctx = map[string]interface{}{}
+	}
+	return c.JSON(http.StatusOK, ctx)
+}
+
+// putContextOverrides replaces the overrides of a context (SMTP relay, disk
+// quota, registries and password policy), without restarting the stack.
+func putContextOverrides(c echo.Context) error {
+	var overrides map[string]interface{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&overrides); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if err := instance.SetContextOverrides(c.Param("context"), overrides); err != nil {
+		return wrapError(err)
+	}
+	return getContextOverrides(c)
+}
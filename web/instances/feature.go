@@ -0,0 +1,68 @@
+package instances
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/feature"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/echo"
+)
+
+func flagsResponse(c echo.Context, flags *feature.Flags) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"flags":   flags.M,
+		"sources": flags.Sources,
+	})
+}
+
+func getFeatureFlags(c echo.Context) error {
+	inst, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	flags, err := feature.GetFlags(inst)
+	if err != nil {
+		return err
+	}
+	return flagsResponse(c, flags)
+}
+
+// patchFeatureFlags changes the flags of an instance: the flags in the body
+// are added or replaced, and the ones with a null value are removed.
+func patchFeatureFlags(c echo.Context) error {
+	inst, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	var patch map[string]interface{}
+	if err = json.NewDecoder(c.Request().Body).Decode(&patch); err != nil {
+		return jsonapi.BadJSON()
+	}
+	flags, err := feature.SetInstanceFlags(inst, patch)
+	if err != nil {
+		return wrapError(err)
+	}
+	return flagsResponse(c, flags)
+}
+
+func getFeatureDefaults(c echo.Context) error {
+	defaults, err := feature.GetDefaults()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, defaults)
+}
+
+// putFeatureDefaults replaces the default flags, for all the instances.
+func putFeatureDefaults(c echo.Context) error {
+	var defaults map[string]interface{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&defaults); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if err := feature.SetDefaults(defaults); err != nil {
+		return err
+	}
+	return getFeatureDefaults(c)
+}
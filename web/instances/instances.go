@@ -18,10 +18,12 @@ import (
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/schema"
 	"github.com/cozy/cozy-stack/pkg/statik/fs"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/pkg/workers/updates"
+	"github.com/cozy/cozy-stack/pkg/workers/webhook"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/echo"
 )
@@ -95,6 +97,7 @@ func createHandler(c echo.Context) error {
 	}
 	in.OAuthSecret = nil
 	in.SessionSecret = nil
+	in.JWTKeys = nil
 	in.PassphraseHash = nil
 	return jsonapi.Data(c, http.StatusCreated, &apiInstance{in}, nil)
 }
@@ -145,9 +148,20 @@ func modifyHandler(c echo.Context) error {
 	if debug, err := strconv.ParseBool(c.QueryParam("Debug")); err == nil {
 		opts.Debug = &debug
 	}
+	if ttl := c.QueryParam("DebugTTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return wrapError(err)
+		}
+		opts.DebugTTL = d
+	}
 	if blocked, err := strconv.ParseBool(c.QueryParam("Blocked")); err == nil {
 		opts.Blocked = &blocked
 	}
+	opts.BlockingReason = c.QueryParam("BlockingReason")
+	if maintenance, err := strconv.ParseBool(c.QueryParam("Maintenance")); err == nil {
+		opts.Maintenance = &maintenance
+	}
 	i, err := instance.Get(domain)
 	if err != nil {
 		return wrapError(err)
@@ -171,6 +185,7 @@ func listHandler(c echo.Context) error {
 	for i, in := range is {
 		in.OAuthSecret = nil
 		in.SessionSecret = nil
+		in.JWTKeys = nil
 		in.PassphraseHash = nil
 		objs[i] = &apiInstance{in}
 	}
@@ -195,6 +210,7 @@ func fsckHandler(c echo.Context) (err error) {
 	}
 
 	indexIntegrityCheck, _ := strconv.ParseBool(c.QueryParam("IndexIntegrity"))
+	repair, _ := strconv.ParseBool(c.QueryParam("Repair"))
 
 	logCh := make(chan *vfs.FsckLog)
 	go func() {
@@ -210,7 +226,17 @@ func fsckHandler(c echo.Context) (err error) {
 	w := c.Response().Writer
 	w.WriteHeader(200)
 	encoder := json.NewEncoder(w)
+	index := vfs.NewCouchdbIndexer(i)
 	for log := range logCh {
+		// Without the Repair parameter, it is a dry-run: the inconsistencies
+		// are only reported.
+		if repair {
+			if errr := vfs.Repair(i.VFS(), index, log); errr != nil {
+				log.RepairError = errr.Error()
+			} else {
+				log.Repaired = true
+			}
+		}
 		if errenc := encoder.Encode(log); errenc != nil {
 			return errenc
 		}
@@ -390,11 +416,13 @@ func updatesHandler(c echo.Context) error {
 	domainsWithContext := c.QueryParam("DomainsWithContext")
 	forceRegistry, _ := strconv.ParseBool(c.QueryParam("ForceRegistry"))
 	onlyRegistry, _ := strconv.ParseBool(c.QueryParam("OnlyRegistry"))
+	permissionsAcked, _ := strconv.ParseBool(c.QueryParam("PermissionsAcked"))
 	msg, err := jobs.NewMessage(&updates.Options{
 		Slugs:              slugs,
 		Force:              true,
 		ForceRegistry:      forceRegistry,
 		OnlyRegistry:       onlyRegistry,
+		PermissionsAcked:   permissionsAcked,
 		Domain:             domain,
 		DomainsWithContext: domainsWithContext,
 		AllDomains:         domain == "",
@@ -425,6 +453,199 @@ func showPrefix(c echo.Context) error {
 	return c.JSON(http.StatusOK, instance.DBPrefix())
 }
 
+// lifecycleDeliveries returns the last deliveries of the events of the
+// lifecycle of an instance to the webhook of the hosting. It works for the
+// deleted instances too.
+func lifecycleDeliveries(c echo.Context) error {
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	deliveries, err := webhook.GetLifecycleDeliveries(c.Param("domain"), limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+func indexesStatus(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	states, err := inst.ViewsAndIndexesStatus()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"version": inst.IndexViewsVersion,
+		"indexes": states,
+	})
+}
+
+// doctypeVersion returns the version of the schema of a doctype, and the
+// state of its migrations on an instance.
+func doctypeVersion(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	doctype := schema.Resolve(c.Param("doctype"))
+	state, err := schema.GetState(inst, doctype)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"doctype":  doctype,
+		"version":  schema.Version(doctype),
+		"instance": state,
+	})
+}
+
+// migrateDoctype pushes a job to apply the pending migrations of the schema of
+// a doctype to all its documents on an instance.
+func migrateDoctype(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	msg, err := jobs.NewMessage(map[string]interface{}{
+		"type":    "doctype",
+		"doctype": schema.Resolve(c.Param("doctype")),
+	})
+	if err != nil {
+		return err
+	}
+	job, err := jobs.System().PushJob(inst, &jobs.JobRequest{
+		WorkerType: "migrations",
+		Message:    msg,
+		Admin:      true,
+	})
+	if err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// reencryptAccounts encrypts again the secrets of an instance and the
+// credentials of its accounts, after a rotation of the master secrets. The
+// secrets are read again from the keyring before that.
+func reencryptAccounts(c echo.Context) error {
+	if err := config.ReloadVault(); err != nil {
+		return err
+	}
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	secrets := len(config.GetVault().InstanceSecretsMasterKey()) > 0
+	if secrets {
+		if err = inst.ReencryptSecrets(); err != nil {
+			return wrapError(err)
+		}
+	}
+	count, err := accounts.ReencryptAccounts(inst)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"domain":   inst.Domain,
+		"secrets":  secrets,
+		"accounts": count,
+	})
+}
+
+// rekeyFiles pushes a job to encrypt again the files of an instance with a
+// new data key.
+func rekeyFiles(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	if len(config.GetVault().FilesMasterKey()) == 0 {
+		return wrapError(instance.ErrNoFilesMasterKey)
+	}
+	if !instance.CanEncryptFiles() {
+		return wrapError(instance.ErrEncryptionNotSupported)
+	}
+	job, err := jobs.System().PushJob(inst, &jobs.JobRequest{
+		WorkerType: "rekey-files",
+		Admin:      true,
+	})
+	if err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// rotateJWTKeys generates new keys for signing the tokens of the instance.
+// With the force parameter, the existing tokens are invalidated.
+func rotateJWTKeys(c echo.Context) error {
+	inst, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	force, _ := strconv.ParseBool(c.QueryParam("Force"))
+	if err = inst.RotateJWTKeys(force); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// cloneHandler copies an instance to a new domain, given by the Domain
+// parameter.
+func cloneHandler(c echo.Context) error {
+	src, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	in, err := instance.Clone(src, c.QueryParam("Domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	in.OAuthSecret = nil
+	in.SessionSecret = nil
+	in.JWTKeys = nil
+	in.PassphraseHash = nil
+	return jsonapi.Data(c, http.StatusCreated, &apiInstance{in}, nil)
+}
+
+// appMaintenance puts an application of an instance in maintenance (PUT), or
+// takes it out of maintenance (DELETE).
+func appMaintenance(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	maintenance := c.Request().Method == http.MethodPut
+	if err = inst.SetAppMaintenance(c.Param("slug"), maintenance); err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiInstance{inst}, nil)
+}
+
+// scheduleDeletion schedules the deletion of an instance (POST), or cancels
+// its scheduled deletion (DELETE).
+func scheduleDeletion(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	if c.Request().Method == http.MethodPost {
+		err = inst.ScheduleDeletion()
+	} else {
+		err = inst.CancelDeletion()
+	}
+	if err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiInstance{inst}, nil)
+}
+
 func getSwiftBucketName(c echo.Context) error {
 	domain := c.Param("domain")
 
@@ -463,6 +684,20 @@ func wrapError(err error) error {
 		return jsonapi.BadRequest(err)
 	case instance.ErrBadTOSVersion:
 		return jsonapi.BadRequest(err)
+	case instance.ErrBadBlockingReason:
+		return jsonapi.BadRequest(err)
+	case instance.ErrBadContextOverride:
+		return jsonapi.BadRequest(err)
+	case instance.ErrNoFilesMasterKey:
+		return jsonapi.BadRequest(err)
+	case instance.ErrEncryptionNotSupported:
+		return jsonapi.BadRequest(err)
+	case instance.ErrCloneNotSupported:
+		return jsonapi.BadRequest(err)
+	case instance.ErrDeletionScheduled:
+		return jsonapi.Conflict(err)
+	case instance.ErrDeletionNotScheduled:
+		return jsonapi.Conflict(err)
 	}
 	return err
 }
@@ -475,6 +710,10 @@ func Routes(router *echo.Group) {
 	router.PATCH("/:domain", modifyHandler)
 	router.DELETE("/:domain", deleteHandler)
 	router.GET("/:domain/fsck", fsckHandler)
+	router.GET("/:domain/indexes", indexesStatus)
+	router.GET("/:domain/webhooks", lifecycleDeliveries)
+	router.GET("/:domain/doctypes/:doctype", doctypeVersion)
+	router.POST("/:domain/doctypes/:doctype/migrate", migrateDoctype)
 	router.POST("/updates", updatesHandler)
 	router.POST("/token", createToken)
 	router.GET("/oauth_client", findClientBySoftwareID)
@@ -482,9 +721,23 @@ func Routes(router *echo.Group) {
 	router.POST("/:domain/export", exporter)
 	router.POST("/:domain/import", importer)
 	router.POST("/:domain/orphan_accounts", cleanOrphanAccounts)
+	router.POST("/:domain/reencrypt_accounts", reencryptAccounts)
+	router.POST("/:domain/rekey_files", rekeyFiles)
+	router.POST("/:domain/rotate_jwt_keys", rotateJWTKeys)
+	router.POST("/:domain/clone", cloneHandler)
+	router.PUT("/:domain/maintenance/:slug", appMaintenance)
+	router.DELETE("/:domain/maintenance/:slug", appMaintenance)
+	router.POST("/:domain/deletion", scheduleDeletion)
+	router.DELETE("/:domain/deletion", scheduleDeletion)
 	router.POST("/redis", rebuildRedis)
 	router.GET("/assets", assetsInfos)
 	router.POST("/assets", addAssets)
 	router.GET("/:domain/prefix", showPrefix)
 	router.GET("/:domain/swift-prefix", getSwiftBucketName)
+	router.GET("/:domain/feature/flags", getFeatureFlags)
+	router.PATCH("/:domain/feature/flags", patchFeatureFlags)
+	router.GET("/feature/defaults", getFeatureDefaults)
+	router.PUT("/feature/defaults", putFeatureDefaults)
+	router.GET("/contexts/:context/overrides", getContextOverrides)
+	router.PUT("/contexts/:context/overrides", putContextOverrides)
 }
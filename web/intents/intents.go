@@ -13,6 +13,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	webpermissions "github.com/cozy/cozy-stack/web/permissions"
 	"github.com/cozy/echo"
 )
 
@@ -118,10 +119,42 @@ func getIntent(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, api, nil)
 }
 
+// grantPermissions is used by the service of an intent to give to the client
+// a temporary access to some documents (the one picked by the user for
+// example).
+func grantPermissions(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil || pdoc.Type != permissions.TypeWebapp {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	intent := &intents.Intent{}
+	if err = couchdb.GetDoc(instance, consts.Intents, c.Param("id"), intent); err != nil {
+		return wrapIntentsError(err)
+	}
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if _, err = jsonapi.Bind(c.Request().Body, &req); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	perm, err := intent.GrantPermissions(instance, pdoc, req.IDs)
+	if err != nil {
+		return wrapIntentsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &webpermissions.APIPermission{Permission: perm}, nil)
+}
+
 func wrapIntentsError(err error) error {
 	if couchdb.IsNotFoundError(err) {
 		return jsonapi.NotFound(err)
 	}
+	switch err {
+	case intents.ErrNotAService, permissions.ErrNotSubset:
+		return jsonapi.Forbidden(err)
+	case intents.ErrNoPermissions:
+		return jsonapi.BadRequest(err)
+	}
 	return jsonapi.InternalServerError(err)
 }
 
@@ -129,4 +162,5 @@ func wrapIntentsError(err error) error {
 func Routes(router *echo.Group) {
 	router.POST("", createIntent)
 	router.GET("/:id", getIntent)
+	router.POST("/:id/permissions", grantPermissions)
 }
@@ -92,6 +92,59 @@ func TestGetIntentNotFromTheService(t *testing.T) {
 	assert.Equal(t, 403, res.StatusCode)
 }
 
+func TestGrantPermissions(t *testing.T) {
+	body := `{
+		"data": {
+			"type": "io.cozy.permissions",
+			"attributes": {
+				"ids": ["4c8ac9a6-8e7c-11e9-aed8-7b1ab3e4ef36"]
+			}
+		}
+	}`
+	req, _ := http.NewRequest("POST", ts.URL+"/intents/"+intentID+"/permissions", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Accept", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+filesToken)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "share", attrs["type"])
+	assert.NotEmpty(t, attrs["expires_at"])
+	codes := attrs["codes"].(map[string]interface{})
+	assert.NotEmpty(t, codes["app"])
+	rules := attrs["permissions"].(map[string]interface{})
+	assert.Len(t, rules, 1)
+	for _, r := range rules {
+		rule := r.(map[string]interface{})
+		assert.Equal(t, consts.Files, rule["type"])
+		assert.Equal(t, []interface{}{"GET"}, rule["verbs"])
+		assert.Equal(t, []interface{}{"4c8ac9a6-8e7c-11e9-aed8-7b1ab3e4ef36"}, rule["values"])
+	}
+}
+
+func TestGrantPermissionsNotFromTheService(t *testing.T) {
+	body := `{
+		"data": {
+			"type": "io.cozy.permissions",
+			"attributes": {
+				"ids": ["4c8ac9a6-8e7c-11e9-aed8-7b1ab3e4ef36"]
+			}
+		}
+	}`
+	req, _ := http.NewRequest("POST", ts.URL+"/intents/"+intentID+"/permissions", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Accept", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+appToken)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+}
+
 func TestCreateIntentOAuth(t *testing.T) {
 	body := `{
 		"data": {
@@ -137,8 +190,13 @@ func TestMain(m *testing.M) {
 	}
 	appToken = ins.BuildAppToken(app, "")
 	files := &apps.WebappManifest{
-		DocSlug:        "files",
-		DocPermissions: permissions.Set{},
+		DocSlug: "files",
+		DocPermissions: permissions.Set{
+			permissions.Rule{
+				Type:  consts.Files,
+				Verbs: permissions.ALL,
+			},
+		},
 		Intents: []apps.Intent{
 			{
 				Action: "PICK",
@@ -2,6 +2,9 @@ package jobs
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"time"
@@ -11,6 +14,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/web/jsonapi"
@@ -20,16 +24,38 @@ import (
 	multierror "github.com/hashicorp/go-multierror"
 
 	// import workers
+	_ "github.com/cozy/cozy-stack/pkg/workers/backup"
+	_ "github.com/cozy/cozy-stack/pkg/workers/classification"
+	_ "github.com/cozy/cozy-stack/pkg/workers/cloudimport"
+	_ "github.com/cozy/cozy-stack/pkg/workers/clustering"
+	_ "github.com/cozy/cozy-stack/pkg/workers/digest"
+	_ "github.com/cozy/cozy-stack/pkg/workers/dirsizes"
 	"github.com/cozy/cozy-stack/pkg/workers/exec"
 	_ "github.com/cozy/cozy-stack/pkg/workers/log"
 	_ "github.com/cozy/cozy-stack/pkg/workers/mails"
 	_ "github.com/cozy/cozy-stack/pkg/workers/migrations"
 	_ "github.com/cozy/cozy-stack/pkg/workers/move"
+	_ "github.com/cozy/cozy-stack/pkg/workers/notes"
+	_ "github.com/cozy/cozy-stack/pkg/workers/ocr"
 	_ "github.com/cozy/cozy-stack/pkg/workers/push"
+	_ "github.com/cozy/cozy-stack/pkg/workers/rekey"
+	_ "github.com/cozy/cozy-stack/pkg/workers/scrub"
 	_ "github.com/cozy/cozy-stack/pkg/workers/share"
+	_ "github.com/cozy/cozy-stack/pkg/workers/tags"
 	_ "github.com/cozy/cozy-stack/pkg/workers/thumbnail"
 	_ "github.com/cozy/cozy-stack/pkg/workers/unzip"
 	_ "github.com/cozy/cozy-stack/pkg/workers/updates"
+	_ "github.com/cozy/cozy-stack/pkg/workers/video"
+	"github.com/cozy/cozy-stack/pkg/workers/webhook"
+)
+
+// maxWebhookPayloadSize is the maximal size of the body of a request sent to
+// a @webhook trigger.
+const maxWebhookPayloadSize = 1 << 20 // 1MB
+
+const (
+	defaultLogsPerPage = 100
+	maxLogsPerPage     = 1000
 )
 
 type (
@@ -51,6 +77,18 @@ type (
 		t *jobs.TriggerInfos
 		s *jobs.TriggerState
 	}
+	apiDelivery struct {
+		d *webhook.Delivery
+	}
+	apiInteraction struct {
+		i *exec.Interaction
+	}
+	apiLogEntry struct {
+		e *exec.LogEntry
+	}
+	apiInteractionRequest struct {
+		Value string `json:"value"`
+	}
 	apiTriggerRequest struct {
 		Type            string           `json:"type"`
 		Arguments       string           `json:"arguments"`
@@ -95,7 +133,11 @@ func (t apiTrigger) SetRev(_ string)                        {}
 func (t apiTrigger) Relationships() jsonapi.RelationshipMap { return nil }
 func (t apiTrigger) Included() []jsonapi.Object             { return nil }
 func (t apiTrigger) Links() *jsonapi.LinksList {
-	return &jsonapi.LinksList{Self: "/jobs/triggers/" + t.ID()}
+	links := &jsonapi.LinksList{Self: "/jobs/triggers/" + t.ID()}
+	if t.t.Type == "@webhook" {
+		links.Webhook = "/jobs/webhooks/" + t.ID()
+	}
+	return links
 }
 func (t apiTrigger) MarshalJSON() ([]byte, error) {
 	return json.Marshal(t.t)
@@ -116,6 +158,52 @@ func (t apiTriggerState) MarshalJSON() ([]byte, error) {
 	return json.Marshal(t.s)
 }
 
+func (d apiDelivery) ID() string                             { return d.d.DocID }
+func (d apiDelivery) Rev() string                            { return d.d.DocRev }
+func (d apiDelivery) DocType() string                        { return consts.WebhookDeliveries }
+func (d apiDelivery) Clone() couchdb.Doc                     { return d }
+func (d apiDelivery) SetID(_ string)                         {}
+func (d apiDelivery) SetRev(_ string)                        {}
+func (d apiDelivery) Relationships() jsonapi.RelationshipMap { return nil }
+func (d apiDelivery) Included() []jsonapi.Object             { return nil }
+func (d apiDelivery) Links() *jsonapi.LinksList              { return nil }
+func (d apiDelivery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.d)
+}
+
+func (i apiInteraction) ID() string                             { return i.i.DocID }
+func (i apiInteraction) Rev() string                            { return i.i.DocRev }
+func (i apiInteraction) DocType() string                        { return consts.KonnectorsInteractions }
+func (i apiInteraction) Clone() couchdb.Doc                     { return i }
+func (i apiInteraction) SetID(_ string)                         {}
+func (i apiInteraction) SetRev(_ string)                        {}
+func (i apiInteraction) Relationships() jsonapi.RelationshipMap { return nil }
+func (i apiInteraction) Included() []jsonapi.Object             { return nil }
+func (i apiInteraction) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/" + i.ID() + "/interaction"}
+}
+
+// MarshalJSON removes the value given by the user, as it is only for the
+// konnector.
+func (i apiInteraction) MarshalJSON() ([]byte, error) {
+	cloned := *i.i
+	cloned.Value = ""
+	return json.Marshal(cloned)
+}
+
+func (e apiLogEntry) ID() string                             { return e.e.DocID }
+func (e apiLogEntry) Rev() string                            { return e.e.DocRev }
+func (e apiLogEntry) DocType() string                        { return consts.KonnectorLogs }
+func (e apiLogEntry) Clone() couchdb.Doc                     { return e }
+func (e apiLogEntry) SetID(_ string)                         {}
+func (e apiLogEntry) SetRev(_ string)                        {}
+func (e apiLogEntry) Relationships() jsonapi.RelationshipMap { return nil }
+func (e apiLogEntry) Included() []jsonapi.Object             { return nil }
+func (e apiLogEntry) Links() *jsonapi.LinksList              { return nil }
+func (e apiLogEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.e)
+}
+
 func getQueue(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	workerType := c.Param("worker-type")
@@ -156,6 +244,17 @@ func pushJob(c echo.Context) error {
 		ForwardLogs: req.ForwardLogs,
 		Message:     jobs.Message(req.Arguments),
 	}
+	if jr.WorkerType == "webhook" {
+		args, secret, err := extractWebhookSecret(req.Arguments)
+		if err != nil {
+			return jsonapi.BadRequest(err)
+		}
+		if secret != "" {
+			return jsonapi.InvalidAttribute("secret",
+				errors.New("A webhook can be signed only when it is pushed by a trigger"))
+		}
+		jr.Message = jobs.Message(args)
+	}
 
 	// TODO: uncomment to restric jobs permissions.
 	// if err := middlewares.AllowOnFields(c, webpermissions.POST, jr, "worker"); err != nil {
@@ -195,6 +294,15 @@ func newTrigger(c echo.Context) error {
 		}
 	}
 
+	var secret string
+	if req.WorkerType == "webhook" {
+		var err error
+		req.WorkerArguments, secret, err = extractWebhookSecret(req.WorkerArguments)
+		if err != nil {
+			return jsonapi.BadRequest(err)
+		}
+	}
+
 	t, err := jobs.NewTrigger(instance, jobs.TriggerInfos{
 		Type:       req.Type,
 		WorkerType: req.WorkerType,
@@ -217,9 +325,40 @@ func newTrigger(c echo.Context) error {
 	if err = sched.AddTrigger(t); err != nil {
 		return wrapJobsError(err)
 	}
+	if secret != "" {
+		if err = jobs.SetWebhookSecret(instance, t.ID(), secret); err != nil {
+			_ = sched.DeleteTrigger(instance, t.ID())
+			return wrapJobsError(err)
+		}
+	}
 	return jsonapi.Data(c, http.StatusCreated, apiTrigger{t.Infos()}, nil)
 }
 
+// extractWebhookSecret removes the secret from the arguments of the webhook
+// worker, as they are kept in the trigger and the jobs, that can be read by
+// the apps. When there is a secret, the arguments say that the payload must
+// be signed, and the secret is then saved on the server side.
+func extractWebhookSecret(args json.RawMessage) (json.RawMessage, string, error) {
+	if len(args) == 0 {
+		return args, "", nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(args, &fields); err != nil {
+		return nil, "", err
+	}
+	secret, _ := fields["secret"].(string)
+	delete(fields, "secret")
+	delete(fields, "signed")
+	if secret != "" {
+		fields["signed"] = true
+	}
+	args, err := json.Marshal(fields)
+	if err != nil {
+		return nil, "", err
+	}
+	return args, secret, nil
+}
+
 func getTrigger(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	sched := jobs.System()
@@ -235,6 +374,7 @@ func getTrigger(c echo.Context) error {
 	if err != nil {
 		return wrapJobsError(err)
 	}
+	jobs.PlanNextExecution(t, tInfos.CurrentState)
 	return jsonapi.Data(c, http.StatusOK, apiTrigger{tInfos}, nil)
 }
 
@@ -260,6 +400,7 @@ func getTriggerState(c echo.Context) error {
 	if err != nil {
 		return wrapJobsError(err)
 	}
+	jobs.PlanNextExecution(t, state)
 	return jsonapi.Data(c, http.StatusOK, apiTriggerState{t: t.Infos(), s: state}, nil)
 }
 
@@ -348,6 +489,11 @@ func launchTrigger(c echo.Context) error {
 	if err = middlewares.Allow(c, webpermissions.POST, t); err != nil {
 		return err
 	}
+	if t.Infos().WorkerType == "konnector" {
+		if err = middlewares.CheckRateLimit(c, limits.KonnectorTriggerType); err != nil {
+			return err
+		}
+	}
 	req := t.Infos().JobRequest()
 	req.Manual = true
 	j, err := jobs.System().PushJob(instance, req)
@@ -357,6 +503,79 @@ func launchTrigger(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusCreated, apiJob{j}, nil)
 }
 
+func getTriggerDeliveries(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	var err error
+
+	var limit int
+	if queryLimit := c.QueryParam("Limit"); queryLimit != "" {
+		limit, err = strconv.Atoi(queryLimit)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+	}
+
+	t, err := jobs.System().GetTrigger(instance, c.Param("trigger-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err = middlewares.Allow(c, webpermissions.GET, t); err != nil {
+		return err
+	}
+	if t.Infos().WorkerType != "webhook" {
+		return jsonapi.BadRequest(errors.New("The trigger does not use the webhook worker"))
+	}
+
+	ds, err := webhook.GetDeliveries(instance, t.ID(), limit)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+
+	objs := make([]jsonapi.Object, len(ds))
+	for i, d := range ds {
+		objs[i] = apiDelivery{d}
+	}
+
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// fireWebhook is called by an external service: the request is not
+// authenticated with a token, but the body must be signed with the secret of
+// the trigger.
+func fireWebhook(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	t, err := jobs.System().GetTrigger(instance, c.Param("trigger-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	wt, ok := t.(*jobs.WebhookTrigger)
+	if !ok {
+		return jsonapi.NotFound(jobs.ErrNotFoundTrigger)
+	}
+
+	payload, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxWebhookPayloadSize+1))
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxWebhookPayloadSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge)
+	}
+	if !wt.CheckSignature(payload, c.Request().Header.Get(jobs.SignatureHeader)) {
+		return echo.NewHTTPError(http.StatusForbidden, "invalid signature")
+	}
+
+	req := wt.Fire(payload)
+	if req == nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+	j, err := jobs.System().PushJob(instance, req)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, apiJob{j}, nil)
+}
+
 func deleteTrigger(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	sched := jobs.System()
@@ -406,6 +625,7 @@ func getAllTriggers(c echo.Context) error {
 			if err != nil {
 				return wrapJobsError(err)
 			}
+			jobs.PlanNextExecution(t, tInfos.CurrentState)
 			objs = append(objs, apiTrigger{tInfos})
 		}
 	}
@@ -425,6 +645,78 @@ func getJob(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, apiJob{job}, nil)
 }
 
+func getJobInteraction(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	job, err := jobs.Get(instance, c.Param("job-id"))
+	if err != nil {
+		return err
+	}
+	if err := middlewares.Allow(c, webpermissions.GET, job); err != nil {
+		return err
+	}
+	interaction, err := exec.GetInteraction(instance, job.ID())
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, apiInteraction{interaction}, nil)
+}
+
+func getJobLogs(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	job, err := jobs.Get(instance, c.Param("job-id"))
+	if err != nil {
+		return err
+	}
+	if err := middlewares.Allow(c, webpermissions.GET, job); err != nil {
+		return err
+	}
+	cursor, err := jsonapi.ExtractPaginationCursor(c, defaultLogsPerPage, maxLogsPerPage)
+	if err != nil {
+		return err
+	}
+	entries, err := exec.ListLogs(instance, job.ID(), cursor)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	links, err := jsonapi.PaginationLinks(c, cursor)
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, len(entries))
+	for i, e := range entries {
+		objs[i] = apiLogEntry{e}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+func answerJobInteraction(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	job, err := jobs.Get(instance, c.Param("job-id"))
+	if err != nil {
+		return err
+	}
+	if err := middlewares.Allow(c, webpermissions.PUT, job); err != nil {
+		return err
+	}
+	var req apiInteractionRequest
+	if _, err := jsonapi.Bind(c.Request().Body, &req); err != nil {
+		return err
+	}
+	if req.Value == "" {
+		return jsonapi.InvalidAttribute("value", errors.New("The value is missing"))
+	}
+	interaction, err := exec.AnswerInteraction(instance, job.ID(), req.Value)
+	switch err {
+	case nil:
+		return jsonapi.Data(c, http.StatusOK, apiInteraction{interaction}, nil)
+	case exec.ErrInteractionNotPending:
+		return jsonapi.Conflict(err)
+	case exec.ErrInteractionExpired:
+		return jsonapi.NewError(http.StatusGone, err.Error())
+	}
+	return err
+}
+
 func cleanJobs(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	if err := middlewares.AllowWholeType(c, webpermissions.POST, consts.Jobs); err != nil {
@@ -471,11 +763,17 @@ func Routes(router *echo.Group) {
 	router.GET("/triggers/:trigger-id", getTrigger)
 	router.GET("/triggers/:trigger-id/state", getTriggerState)
 	router.GET("/triggers/:trigger-id/jobs", getTriggerJobs)
+	router.GET("/triggers/:trigger-id/deliveries", getTriggerDeliveries)
 	router.POST("/triggers/:trigger-id/launch", launchTrigger)
 	router.DELETE("/triggers/:trigger-id", deleteTrigger)
 
+	router.POST("/webhooks/:trigger-id", fireWebhook)
+
 	router.POST("/clean", cleanJobs)
 	router.GET("/:job-id", getJob)
+	router.GET("/:job-id/interaction", getJobInteraction)
+	router.PUT("/:job-id/interaction", answerJobInteraction)
+	router.GET("/:job-id/logs", getJobLogs)
 }
 
 func wrapJobsError(err error) error {
@@ -13,6 +13,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/permissions"
@@ -262,6 +263,167 @@ func TestAddGetAndDeleteTriggerIn(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, res5.StatusCode)
 }
 
+func TestWebhookTrigger(t *testing.T) {
+	body, _ := json.Marshal(&jsonapiReq{
+		Data: &jsonapiData{
+			Attributes: map[string]interface{}{
+				"type":             "@webhook",
+				"worker":           "print",
+				"worker_arguments": "foo",
+			},
+		},
+	})
+	req1, err := http.NewRequest(http.MethodPost, ts.URL+"/jobs/triggers", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req1.Header.Add("Authorization", "Bearer "+token)
+	res1, err := http.DefaultClient.Do(req1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res1.Body.Close()
+	assert.Equal(t, http.StatusCreated, res1.StatusCode)
+
+	var v struct {
+		Data struct {
+			ID         string             `json:"id"`
+			Attributes *jobs.TriggerInfos `json:"attributes"`
+			Links      struct {
+				Webhook string `json:"webhook"`
+			} `json:"links"`
+		}
+	}
+	err = json.NewDecoder(res1.Body).Decode(&v)
+	if !assert.NoError(t, err) || !assert.NotNil(t, v.Data.Attributes) {
+		return
+	}
+	secret := v.Data.Attributes.Secret
+	assert.NotEmpty(t, secret)
+	assert.Equal(t, "/jobs/webhooks/"+v.Data.ID, v.Data.Links.Webhook)
+
+	payload := []byte(`{"event":"ping"}`)
+	req2, err := http.NewRequest(http.MethodPost, ts.URL+v.Data.Links.Webhook, bytes.NewReader(payload))
+	assert.NoError(t, err)
+	req2.Header.Add(jobs.SignatureHeader, jobs.SignPayload("wrong secret", payload))
+	res2, err := http.DefaultClient.Do(req2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res2.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res2.StatusCode)
+
+	req3, err := http.NewRequest(http.MethodPost, ts.URL+v.Data.Links.Webhook, bytes.NewReader(payload))
+	assert.NoError(t, err)
+	req3.Header.Add(jobs.SignatureHeader, jobs.SignPayload(secret, payload))
+	res3, err := http.DefaultClient.Do(req3)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res3.Body.Close()
+	assert.Equal(t, http.StatusAccepted, res3.StatusCode)
+	var j struct {
+		Data struct {
+			Attributes *jobs.Job `json:"attributes"`
+		}
+	}
+	err = json.NewDecoder(res3.Body).Decode(&j)
+	if assert.NoError(t, err) && assert.NotNil(t, j.Data.Attributes) {
+		assert.Equal(t, v.Data.ID, j.Data.Attributes.TriggerID)
+		assert.JSONEq(t, string(payload), string(j.Data.Attributes.Payload))
+	}
+
+	req4, err := http.NewRequest(http.MethodGet, ts.URL+"/jobs/triggers/"+v.Data.ID+"/deliveries", nil)
+	assert.NoError(t, err)
+	req4.Header.Add("Authorization", "Bearer "+token)
+	res4, err := http.DefaultClient.Do(req4)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res4.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res4.StatusCode)
+
+	req5, err := http.NewRequest("DELETE", ts.URL+"/jobs/triggers/"+v.Data.ID, nil)
+	assert.NoError(t, err)
+	req5.Header.Add("Authorization", "Bearer "+token)
+	res5, err := http.DefaultClient.Do(req5)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res5.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res5.StatusCode)
+}
+
+func TestWebhookWorkerSecret(t *testing.T) {
+	scope := consts.Jobs + ":ALL:webhook:worker " + consts.Triggers + ":ALL:webhook:worker"
+	tok, _ := testInstance.MakeJWT(permissions.CLIAudience, "CLI", scope, "", time.Now())
+	args := map[string]interface{}{
+		"url":    "https://example.org/hooks/cozy",
+		"secret": "7dba7e43b00fd1bd4ec3c3f5a2e8a8c1",
+	}
+
+	// The secret can't be given to a job pushed without a trigger
+	body, _ := json.Marshal(&jsonapiReq{
+		Data: &jsonapiData{Attributes: map[string]interface{}{"arguments": args}},
+	})
+	req1, err := http.NewRequest(http.MethodPost, ts.URL+"/jobs/queue/webhook", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req1.Header.Add("Authorization", "Bearer "+tok)
+	res1, err := http.DefaultClient.Do(req1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res1.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, res1.StatusCode)
+
+	// For a trigger, the secret is kept out of its message
+	body, _ = json.Marshal(&jsonapiReq{
+		Data: &jsonapiData{
+			Attributes: map[string]interface{}{
+				"type":             "@in",
+				"arguments":        "1h",
+				"worker":           "webhook",
+				"worker_arguments": args,
+			},
+		},
+	})
+	req2, err := http.NewRequest(http.MethodPost, ts.URL+"/jobs/triggers", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req2.Header.Add("Authorization", "Bearer "+tok)
+	res2, err := http.DefaultClient.Do(req2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res2.Body.Close()
+	assert.Equal(t, http.StatusCreated, res2.StatusCode)
+	var v struct {
+		Data struct {
+			ID         string             `json:"id"`
+			Attributes *jobs.TriggerInfos `json:"attributes"`
+		}
+	}
+	err = json.NewDecoder(res2.Body).Decode(&v)
+	if !assert.NoError(t, err) || !assert.NotNil(t, v.Data.Attributes) {
+		return
+	}
+	assert.NotContains(t, string(v.Data.Attributes.Message), "7dba7e43b00fd1bd4ec3c3f5a2e8a8c1")
+	assert.JSONEq(t, `{"url":"https://example.org/hooks/cozy","signed":true}`, string(v.Data.Attributes.Message))
+	secret, err := jobs.GetWebhookSecret(testInstance, v.Data.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "7dba7e43b00fd1bd4ec3c3f5a2e8a8c1", secret)
+
+	// And it is deleted with the trigger
+	req3, err := http.NewRequest("DELETE", ts.URL+"/jobs/triggers/"+v.Data.ID, nil)
+	assert.NoError(t, err)
+	req3.Header.Add("Authorization", "Bearer "+tok)
+	res3, err := http.DefaultClient.Do(req3)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res3.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res3.StatusCode)
+	_, err = jobs.GetWebhookSecret(testInstance, v.Data.ID)
+	assert.True(t, couchdb.IsNotFoundError(err))
+}
+
 func TestGetAllJobs(t *testing.T) {
 	var v struct {
 		Data []struct {
@@ -286,8 +448,9 @@ func TestGetAllJobs(t *testing.T) {
 		return
 	}
 
-	// The instance already has a trigger for thumbnails
-	assert.Len(t, v.Data, 1)
+	// The instance already has triggers for the thumbnails, the videos and
+	// the clustering of the photos
+	assert.Len(t, v.Data, 3)
 
 	body, _ := json.Marshal(&jsonapiReq{
 		Data: &jsonapiData{
@@ -322,12 +485,12 @@ func TestGetAllJobs(t *testing.T) {
 		return
 	}
 
-	if assert.Len(t, v.Data, 2) {
+	if assert.Len(t, v.Data, 4) {
 		var index int
-		if v.Data[1].Attributes.Type == "@in" {
-			index = 1
-		} else {
-			index = 0
+		for i, data := range v.Data {
+			if data.Attributes.Type == "@in" {
+				index = i
+			}
 		}
 		assert.Equal(t, consts.Triggers, v.Data[index].Type)
 		assert.Equal(t, "@in", v.Data[index].Attributes.Type)
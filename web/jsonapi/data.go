@@ -38,6 +38,12 @@ type LinksList struct {
 	Small  string `json:"small,omitempty"`
 	Medium string `json:"medium,omitempty"`
 	Large  string `json:"large,omitempty"`
+	// Pages of a PDF
+	Pages string `json:"pages,omitempty"`
+	// HLS playlist of a video
+	Stream string `json:"stream,omitempty"`
+	// URL of a @webhook trigger
+	Webhook string `json:"webhook,omitempty"`
 }
 
 // Relationship is a resource linkage, as described in JSON-API
@@ -89,6 +95,12 @@ func (o *ObjectMarshalling) GetRelationship(name string) (*Relationship, bool) {
 // MarshalObject serializes an Object to JSON.
 // It returns a json.RawMessage that can be used a in Document.
 func MarshalObject(o Object) (json.RawMessage, error) {
+	return marshalObject(o, nil)
+}
+
+// marshalObject serializes an Object to JSON, with only the attributes and
+// relationships of the sparse fieldsets (if any).
+func marshalObject(o Object, fields Fieldsets) (json.RawMessage, error) {
 	id := o.ID()
 	rev := o.Rev()
 	links := o.Links()
@@ -105,6 +117,12 @@ func MarshalObject(o Object) (json.RawMessage, error) {
 	if err != nil {
 		return nil, err
 	}
+	if fields != nil {
+		if b, err = fields.filterAttributes(o.DocType(), b); err != nil {
+			return nil, err
+		}
+		rels = fields.filterRelationships(o.DocType(), rels)
+	}
 
 	data := ObjectMarshalling{
 		Type:          o.DocType(),
@@ -116,3 +134,26 @@ func MarshalObject(o Object) (json.RawMessage, error) {
 	}
 	return json.Marshal(data)
 }
+
+// marshalIncluded serializes the objects for the included member of a
+// compound document. An object is included only once, even if it is related
+// to several objects of the primary data.
+func marshalIncluded(objs []Object, fields Fieldsets) ([]interface{}, error) {
+	included := make([]interface{}, 0, len(objs))
+	seen := make(map[string]struct{}, len(objs))
+	for _, o := range objs {
+		if id := o.ID(); id != "" {
+			key := o.DocType() + "/" + id
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+		}
+		data, err := marshalObject(o, fields)
+		if err != nil {
+			return nil, err
+		}
+		included = append(included, &data)
+	}
+	return included, nil
+}
@@ -1,9 +1,12 @@
 package jsonapi
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/errcode"
 )
 
 // SourceError contains references to the source of the error
@@ -24,6 +27,19 @@ type Error struct {
 	Links  *LinksList  `json:"links,omitempty"`
 }
 
+// MarshalJSON is used to omit the source member of an error when it is empty.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	type alias Error
+	var source *SourceError
+	if e.Source.Pointer != "" || e.Source.Parameter != "" {
+		source = &e.Source
+	}
+	return json.Marshal(struct {
+		*alias
+		Source *SourceError `json:"source,omitempty"`
+	}{(*alias)(e), source})
+}
+
 // ErrorList is just an array of error objects
 type ErrorList []*Error
 
@@ -36,6 +52,7 @@ func NewError(status int, detail string) *Error {
 	return &Error{
 		Status: status,
 		Title:  http.StatusText(status),
+		Code:   errcode.FromStatus(status),
 		Detail: detail,
 	}
 }
@@ -46,11 +63,27 @@ func Errorf(status int, format string, args ...interface{}) *Error {
 	return NewError(status, detail)
 }
 
+// FromError returns an error object for an error with a stable code, with
+// the status of this error. The other errors are internal server errors.
+func FromError(err error) *Error {
+	e, ok := err.(*errcode.Error)
+	if !ok {
+		return InternalServerError(err)
+	}
+	return &Error{
+		Status: e.Status,
+		Title:  http.StatusText(e.Status),
+		Code:   e.Code,
+		Detail: e.Message,
+	}
+}
+
 // NotFound returns a 404 formatted error
 func NotFound(err error) *Error {
 	return &Error{
 		Status: http.StatusNotFound,
 		Title:  "Not Found",
+		Code:   errcode.Of(err, http.StatusNotFound),
 		Detail: err.Error(),
 	}
 }
@@ -60,6 +93,7 @@ func BadRequest(err error) *Error {
 	return &Error{
 		Status: http.StatusBadRequest,
 		Title:  "Bad request",
+		Code:   errcode.Of(err, http.StatusBadRequest),
 		Detail: err.Error(),
 	}
 }
@@ -70,6 +104,7 @@ func BadJSON() *Error {
 	return &Error{
 		Status: http.StatusBadRequest,
 		Title:  "Bad request",
+		Code:   errcode.BadRequest,
 		Detail: "JSON input is malformed or is missing mandatory fields",
 	}
 }
@@ -79,6 +114,7 @@ func MethodNotAllowed(method string) *Error {
 	return &Error{
 		Status: http.StatusMethodNotAllowed,
 		Title:  "Method Not Allowed",
+		Code:   errcode.MethodNotAllowed,
 		Detail: method + " is not allowed on this endpoint",
 	}
 }
@@ -88,6 +124,7 @@ func Conflict(err error) *Error {
 	return &Error{
 		Status: http.StatusConflict,
 		Title:  "Conflict",
+		Code:   errcode.Of(err, http.StatusConflict),
 		Detail: err.Error(),
 	}
 }
@@ -97,6 +134,7 @@ func InternalServerError(err error) *Error {
 	return &Error{
 		Status: http.StatusInternalServerError,
 		Title:  "Internal Server Error",
+		Code:   errcode.Of(err, http.StatusInternalServerError),
 		Detail: err.Error(),
 	}
 }
@@ -107,6 +145,7 @@ func PreconditionFailed(parameter string, err error) *Error {
 	return &Error{
 		Status: http.StatusPreconditionFailed,
 		Title:  "Precondition Failed",
+		Code:   errcode.Of(err, http.StatusPreconditionFailed),
 		Detail: err.Error(),
 		Source: SourceError{
 			Parameter: parameter,
@@ -120,6 +159,7 @@ func InvalidParameter(parameter string, err error) *Error {
 	return &Error{
 		Status: http.StatusUnprocessableEntity,
 		Title:  "Invalid Parameter",
+		Code:   errcode.Of(err, http.StatusUnprocessableEntity),
 		Detail: err.Error(),
 		Source: SourceError{
 			Parameter: parameter,
@@ -132,6 +172,7 @@ func InvalidAttribute(attribute string, err error) *Error {
 	return &Error{
 		Status: http.StatusUnprocessableEntity,
 		Title:  "Invalid Attribute",
+		Code:   errcode.Of(err, http.StatusUnprocessableEntity),
 		Detail: err.Error(),
 		Source: SourceError{
 			Pointer: "/data/attributes/" + attribute,
@@ -145,6 +186,7 @@ func Forbidden(err error) *Error {
 	return &Error{
 		Status: http.StatusForbidden,
 		Title:  "Forbidden",
+		Code:   errcode.Of(err, http.StatusForbidden),
 		Detail: err.Error(),
 	}
 }
@@ -154,6 +196,7 @@ func BadGateway(err error) *Error {
 	return &Error{
 		Status: http.StatusBadGateway,
 		Title:  "Bad Gateway",
+		Code:   errcode.Of(err, http.StatusBadGateway),
 		Detail: err.Error(),
 	}
 }
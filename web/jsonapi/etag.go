@@ -0,0 +1,105 @@
+package jsonapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cozy/echo"
+)
+
+// ETag returns the entity tag of a document, from its CouchDB revision.
+func ETag(rev string) string {
+	return `"` + rev + `"`
+}
+
+// ParseETag returns the revision from an entity tag. For compatibility, the
+// raw revision (without quotes) is also accepted.
+func ParseETag(etag string) string {
+	etag = strings.TrimSpace(etag)
+	etag = strings.TrimPrefix(etag, "W/")
+	if len(etag) >= 2 && etag[0] == '"' && etag[len(etag)-1] == '"' {
+		etag = etag[1 : len(etag)-1]
+	}
+	return etag
+}
+
+// matchETag returns true if one of the entity tags in the header (a list
+// separated by commas, or *) is the one of the revision.
+func matchETag(header, rev string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return rev != ""
+	}
+	for _, etag := range strings.Split(header, ",") {
+		if ParseETag(etag) == rev {
+			return true
+		}
+	}
+	return false
+}
+
+// NotModified sets the ETag and Last-Modified headers of the response for a
+// document with the given revision and date of last modification (that can
+// be zero if unknown). It returns true if the copy of the client, given by
+// the If-None-Match or If-Modified-Since header, is still fresh: the handler
+// should then respond with a 304 Not Modified.
+func NotModified(c echo.Context, rev string, updatedAt time.Time) bool {
+	res := c.Response().Header()
+	if rev != "" {
+		res.Set("Etag", ETag(rev))
+	}
+	if !updatedAt.IsZero() {
+		res.Set("Last-Modified", updatedAt.UTC().Format(http.TimeFormat))
+	}
+
+	req := c.Request()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if noneMatch := req.Header.Get("If-None-Match"); noneMatch != "" {
+		return rev != "" && matchETag(noneMatch, rev)
+	}
+	if since := req.Header.Get("If-Modified-Since"); since != "" && !updatedAt.IsZero() {
+		t, err := http.ParseTime(since)
+		return err == nil && !updatedAt.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// WeakETag returns a weak entity tag for a response built from several
+// documents, computed from the given values (like their revisions). As it is
+// weak, it can be used in the If-None-Match header, but not in If-Match.
+func WeakETag(values ...string) string {
+	h := sha256.New()
+	for _, v := range values {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// NotModifiedWeak is like NotModified, but for a weak entity tag (see
+// WeakETag), and without a Last-Modified date.
+func NotModifiedWeak(c echo.Context, etag string) bool {
+	c.Response().Header().Set("Etag", etag)
+	req := c.Request()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	noneMatch := req.Header.Get("If-None-Match")
+	return noneMatch != "" && matchETag(noneMatch, ParseETag(etag))
+}
+
+// CheckIfMatch returns a 412 Precondition Failed error if the request has an
+// If-Match header that doesn't match the current revision of the document,
+// ie if the client wants to modify a document from a stale version.
+func CheckIfMatch(c echo.Context, rev string) error {
+	ifMatch := c.Request().Header.Get("If-Match")
+	if ifMatch != "" && !matchETag(ifMatch, rev) {
+		return PreconditionFailed("If-Match", errors.New("Revision does not match"))
+	}
+	return nil
+}
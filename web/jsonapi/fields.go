@@ -0,0 +1,84 @@
+package jsonapi
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/cozy/echo"
+)
+
+// Fieldsets are the sparse fieldsets asked by a client with the fields[TYPE]
+// query-string parameters: for each type, the names of the attributes and
+// relationships to put in the response.
+// See http://jsonapi.org/format/#fetching-sparse-fieldsets
+type Fieldsets map[string][]string
+
+// ExtractFieldsets returns the sparse fieldsets of the request, or nil if the
+// client has not asked for them.
+func ExtractFieldsets(c echo.Context) Fieldsets {
+	var fields Fieldsets
+	for key, values := range c.QueryParams() {
+		if !strings.HasPrefix(key, "fields[") || !strings.HasSuffix(key, "]") {
+			continue
+		}
+		doctype := key[len("fields[") : len(key)-1]
+		if doctype == "" || len(values) == 0 {
+			continue
+		}
+		if fields == nil {
+			fields = make(Fieldsets)
+		}
+		list := make([]string, 0)
+		for _, name := range strings.Split(values[0], ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				list = append(list, name)
+			}
+		}
+		fields[doctype] = list
+	}
+	return fields
+}
+
+func (f Fieldsets) has(list []string, name string) bool {
+	for _, n := range list {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAttributes keeps only the attributes of the fieldset for the doctype.
+func (f Fieldsets) filterAttributes(doctype string, attrs json.RawMessage) (json.RawMessage, error) {
+	list, ok := f[doctype]
+	if !ok {
+		return attrs, nil
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(attrs, &all); err != nil {
+		return nil, err
+	}
+	filtered := make(map[string]json.RawMessage, len(list))
+	for name, value := range all {
+		if f.has(list, name) {
+			filtered[name] = value
+		}
+	}
+	return json.Marshal(filtered)
+}
+
+// filterRelationships keeps only the relationships of the fieldset for the
+// doctype.
+func (f Fieldsets) filterRelationships(doctype string, rels RelationshipMap) RelationshipMap {
+	list, ok := f[doctype]
+	if !ok || rels == nil {
+		return rels
+	}
+	filtered := make(RelationshipMap, len(list))
+	for name, rel := range rels {
+		if f.has(list, name) {
+			filtered[name] = rel
+		}
+	}
+	return filtered
+}
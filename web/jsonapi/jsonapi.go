@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/echo"
@@ -30,20 +31,21 @@ type Document struct {
 // WriteData can be called to write an answer with a JSON-API document
 // containing a single object as data into an io.Writer.
 func WriteData(w io.Writer, o Object, links *LinksList) error {
+	return writeData(w, o, links, nil)
+}
+
+func writeData(w io.Writer, o Object, links *LinksList, fields Fieldsets) error {
 	var included []interface{}
 
 	if inc := o.Included(); inc != nil {
-		included = make([]interface{}, len(inc))
-		for i, o := range inc {
-			data, err := MarshalObject(o)
-			if err != nil {
-				return err
-			}
-			included[i] = &data
+		var err error
+		included, err = marshalIncluded(inc, fields)
+		if err != nil {
+			return err
 		}
 	}
 
-	data, err := MarshalObject(o)
+	data, err := marshalObject(o, fields)
 	if err != nil {
 		return err
 	}
@@ -62,7 +64,7 @@ func Data(c echo.Context, statusCode int, o Object, links *LinksList) error {
 	resp := c.Response()
 	resp.Header().Set("Content-Type", ContentType)
 	resp.WriteHeader(statusCode)
-	return WriteData(resp, o, links)
+	return writeData(resp, o, links, ExtractFieldsets(c))
 }
 
 // DataList can be called to send an multiple-value answer with a
@@ -74,13 +76,16 @@ func DataList(c echo.Context, statusCode int, objs []Object, links *LinksList) e
 // DataListWithTotal can be called to send a list of Object with a different
 // meta:count, useful to indicate total number of results with pagination.
 func DataListWithTotal(c echo.Context, statusCode, total int, objs []Object, links *LinksList) error {
+	fields := ExtractFieldsets(c)
 	objsMarshaled := make([]json.RawMessage, len(objs))
+	var inc []Object
 	for i, o := range objs {
-		j, err := MarshalObject(o)
+		j, err := marshalObject(o, fields)
 		if err != nil {
 			return InternalServerError(err)
 		}
 		objsMarshaled[i] = j
+		inc = append(inc, o.Included()...)
 	}
 
 	data, err := json.Marshal(objsMarshaled)
@@ -94,6 +99,12 @@ func DataListWithTotal(c echo.Context, statusCode, total int, objs []Object, lin
 		Links: links,
 	}
 
+	if len(inc) > 0 {
+		if doc.Included, err = marshalIncluded(inc, fields); err != nil {
+			return InternalServerError(err)
+		}
+	}
+
 	resp := c.Response()
 	resp.Header().Set("Content-Type", ContentType)
 	resp.WriteHeader(statusCode)
@@ -117,15 +128,9 @@ func DataRelations(c echo.Context, statusCode int, refs []couchdb.DocReference,
 	}
 
 	if included != nil {
-		includedMarshaled := make([]interface{}, len(included))
-		for i, o := range included {
-			j, err := MarshalObject(o)
-			if err != nil {
-				return InternalServerError(err)
-			}
-			includedMarshaled[i] = &j
+		if doc.Included, err = marshalIncluded(included, ExtractFieldsets(c)); err != nil {
+			return InternalServerError(err)
 		}
-		doc.Included = includedMarshaled
 	}
 
 	resp := c.Response()
@@ -253,6 +258,51 @@ func PaginationCursorToParams(cursor couchdb.Cursor) (url.Values, error) {
 	return v, nil
 }
 
+// PaginationLinks returns the links for the pages after and before the
+// current one, with the path and the query-string of the request (the other
+// parameters, like the sort or the sparse fieldsets, are kept). It must be
+// called after the cursor has been updated from the response of CouchDB. The
+// prev link is only available for the skip cursors.
+func PaginationLinks(c echo.Context, cursor couchdb.Cursor) (*LinksList, error) {
+	links := &LinksList{}
+	path := c.Request().URL.Path
+	pageURL := func(params url.Values) string {
+		query := url.Values{}
+		for key, values := range c.QueryParams() {
+			if !strings.HasPrefix(key, "page[") {
+				query[key] = values
+			}
+		}
+		for key, values := range params {
+			query[key] = values
+		}
+		return path + "?" + query.Encode()
+	}
+
+	if cursor.HasMore() {
+		params, err := PaginationCursorToParams(cursor)
+		if err != nil {
+			return nil, err
+		}
+		links.Next = pageURL(params)
+	}
+
+	// UpdateFrom has moved the skip cursor to the next page
+	if sc, ok := cursor.(*couchdb.SkipCursor); ok {
+		if current := sc.Skip - sc.Limit; current > 0 {
+			prev := current - sc.Limit
+			if prev < 0 {
+				prev = 0
+			}
+			params := url.Values{}
+			params.Set("page[limit]", strconv.Itoa(sc.Limit))
+			params.Set("page[skip]", strconv.Itoa(prev))
+			links.Prev = pageURL(params)
+		}
+	}
+	return links, nil
+}
+
 // ExtractPaginationCursor creates a Cursor from context Query.
 func ExtractPaginationCursor(c echo.Context, defaultLimit, maxLimit int) (couchdb.Cursor, error) {
 	limit := defaultLimit
@@ -7,9 +7,11 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/errcode"
 	"github.com/cozy/echo"
 	"github.com/stretchr/testify/assert"
 )
@@ -148,6 +150,71 @@ func TestData(t *testing.T) {
 	assert.Equal(t, qux["id"], "qux")
 }
 
+func TestDataList(t *testing.T) {
+	res, err := http.Get(ts.URL + "/foos")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&body)
+
+	data := body["data"].([]interface{})
+	assert.Len(t, data, 2)
+	included := body["included"].([]interface{})
+	assert.Len(t, included, 1)
+}
+
+func TestSparseFieldsets(t *testing.T) {
+	res, err := http.Get(ts.URL + "/foos/courge?fields[io.cozy.foos]=single")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&body)
+
+	data := body["data"].(map[string]interface{})
+	assert.Equal(t, data["id"], "courge")
+	attrs := data["attributes"].(map[string]interface{})
+	assert.NotContains(t, attrs, "bar")
+	rels := data["relationships"].(map[string]interface{})
+	assert.Contains(t, rels, "single")
+	assert.NotContains(t, rels, "multiple")
+	included := body["included"].([]interface{})
+	qux := included[0].(map[string]interface{})
+	assert.NotContains(t, qux["attributes"], "bar")
+}
+
+func TestErrorSource(t *testing.T) {
+	b, err := json.Marshal(NewError(http.StatusBadRequest, "foo"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "source")
+	b, err = json.Marshal(InvalidParameter("bar", fmt.Errorf("baz")))
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"source":{"parameter":"bar"}`)
+	assert.Contains(t, string(b), `"status":"422"`)
+}
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, "not_found", NotFound(fmt.Errorf("foo")).Code)
+	assert.Equal(t, "forbidden", NewError(http.StatusForbidden, "foo").Code)
+	quota := errcode.New(errcode.QuotaExceeded, http.StatusRequestEntityTooLarge, "Quota")
+	je := FromError(quota)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, je.Status)
+	assert.Equal(t, "quota_exceeded", je.Code)
+	assert.Equal(t, "quota_exceeded", InvalidParameter("size", quota).Code)
+	b, err := json.Marshal(je)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"code":"quota_exceeded"`)
+}
+
+func TestPaginationLinks(t *testing.T) {
+	res, err := http.Get(ts.URL + "/links?page[limit]=10&page[skip]=20&sort=name")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var links LinksList
+	json.NewDecoder(res.Body).Decode(&links)
+	assert.Equal(t, "/links?page%5Blimit%5D=10&page%5Bskip%5D=30&sort=name", links.Next)
+	assert.Equal(t, "/links?page%5Blimit%5D=10&page%5Bskip%5D=10&sort=name", links.Prev)
+}
+
 func TestPagination(t *testing.T) {
 	res, err := http.Get(ts.URL + "/paginated")
 	assert.NoError(t, err)
@@ -183,13 +250,77 @@ func TestPaginationWithCursor(t *testing.T) {
 
 }
 
+func TestETag(t *testing.T) {
+	assert.Equal(t, `"1-abc"`, ETag("1-abc"))
+	assert.Equal(t, "1-abc", ParseETag(`"1-abc"`))
+	assert.Equal(t, "1-abc", ParseETag(`W/"1-abc"`))
+	assert.Equal(t, "1-abc", ParseETag("1-abc"))
+	assert.True(t, matchETag(`"1-abc"`, "1-abc"))
+	assert.True(t, matchETag(`"2-def", "1-abc"`, "1-abc"))
+	assert.True(t, matchETag("*", "1-abc"))
+	assert.False(t, matchETag("*", ""))
+	assert.False(t, matchETag(`"2-def"`, "1-abc"))
+
+	weak := WeakETag("1-abc", "2-def")
+	assert.Regexp(t, `^W/"[0-9a-f]{32}"$`, weak)
+	assert.Equal(t, weak, WeakETag("1-abc", "2-def"))
+	assert.NotEqual(t, weak, WeakETag("1-abc", "2-deg"))
+	assert.NotEqual(t, weak, WeakETag("1-abc2-def"))
+}
+
+func TestNotModified(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/foos/courge", nil)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	etag := res.Header.Get("Etag")
+	assert.Equal(t, `"1-abc"`, etag)
+
+	req.Header.Set("If-None-Match", etag)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 304, res.StatusCode)
+
+	req.Header.Set("If-None-Match", `"2-def"`)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	router := echo.New()
 	router.GET("/foos/courge", func(c echo.Context) error {
 		courge := &Foo{FID: "courge", FRev: "1-abc", Bar: "baz"}
+		if NotModified(c, courge.Rev(), time.Time{}) {
+			return c.NoContent(http.StatusNotModified)
+		}
 		return Data(c, 200, courge, nil)
 	})
+	router.GET("/foos", func(c echo.Context) error {
+		foos := []Object{
+			&Foo{FID: "courge", FRev: "1-abc", Bar: "baz"},
+			&Foo{FID: "grault", FRev: "1-def", Bar: "baz"},
+		}
+		return DataList(c, 200, foos, nil)
+	})
+	router.GET("/links", func(c echo.Context) error {
+		cursor, err := ExtractPaginationCursor(c, 13, 1000)
+		if err != nil {
+			return err
+		}
+		// Simulate a response from CouchDB with more rows than the limit
+		rows := make([]*couchdb.ViewResponseRow, 11)
+		cursor.UpdateFrom(&couchdb.ViewResponse{Rows: rows})
+		links, err := PaginationLinks(c, cursor)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, links)
+	})
 	router.GET("/paginated", func(c echo.Context) error {
 		cursor, err := ExtractPaginationCursor(c, 13, 1000)
 		if err != nil {
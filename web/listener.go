@@ -0,0 +1,54 @@
+package web
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd for the
+// socket activation (SD_LISTEN_FDS_START).
+const listenFdsStart = 3
+
+// activatedListeners returns the listeners passed by systemd with the socket
+// activation, if any. The env variables are unset, so that they are not
+// inherited by the konnectors.
+func activatedListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, nfds)
+	for fd := listenFdsStart; fd < listenFdsStart+nfds; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid socket passed by systemd: %s", err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenMajor returns the listener of the main server. It is a TCP socket on
+// the configured address, opened with SO_REUSEPORT if reuse_port is enabled,
+// so that a new stack process can accept the connections on the same port
+// while the old one finishes its requests.
+func listenMajor() (net.Listener, error) {
+	if config.GetConfig().ReusePort {
+		return listenReusePort(config.ServerAddr())
+	}
+	return net.Listen("tcp", config.ServerAddr())
+}
@@ -0,0 +1,36 @@
+package web
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivatedListenersWithoutSystemd(t *testing.T) {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	listeners, err := activatedListeners()
+	assert.NoError(t, err)
+	assert.Len(t, listeners, 0)
+}
+
+func TestListenReusePort(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SO_REUSEPORT is not supported on windows")
+	}
+	l1, err := listenReusePort("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l1.Close()
+
+	// A second socket can listen on the same port
+	l2, err := listenReusePort(l1.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l2.Close()
+	assert.Equal(t, l1.Addr().String(), l2.Addr().String())
+}
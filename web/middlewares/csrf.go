@@ -0,0 +1,109 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/echo"
+)
+
+const (
+	// CSRFCookieName is the name of the cookie with the CSRF token
+	CSRFCookieName = "_csrf"
+	// CSRFTokenField is the name of the field of the forms with the CSRF token
+	CSRFTokenField = "csrf_token"
+
+	csrfTokenLength = 32
+	csrfMaxAge      = 3600 // 1 hour
+)
+
+// CSRF is a middleware that protects the HTML forms of the stack against the
+// cross-site request forgery. A token is put in a cookie and in the context
+// (with the "csrf" key) for the template of the form, and the requests with
+// an unsafe method must send it back in the csrf_token field. These requests
+// are also rejected if their origin is not the cozy or one of its apps.
+func CSRF(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		var token string
+		if cookie, err := req.Cookie(CSRFCookieName); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		} else {
+			token = utils.RandomString(csrfTokenLength)
+		}
+
+		if !isSafeMethod(req.Method) {
+			if !checkSameOrigin(req) {
+				return echo.NewHTTPError(http.StatusForbidden, "cross-origin request")
+			}
+			sent := c.FormValue(CSRFTokenField)
+			if sent == "" {
+				return echo.NewHTTPError(http.StatusBadRequest, "missing csrf token in the form parameter")
+			}
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				return echo.NewHTTPError(http.StatusForbidden, "invalid csrf token")
+			}
+		}
+
+		scheme := "https"
+		if inst, ok := GetInstanceSafe(c); ok {
+			scheme = inst.Scheme()
+		}
+		cookie := &http.Cookie{
+			Name:     CSRFCookieName,
+			Value:    token,
+			MaxAge:   csrfMaxAge,
+			Path:     "/",
+			HttpOnly: true,
+		}
+		config.CookieAttributesFor(scheme).Apply(cookie)
+		c.SetCookie(cookie)
+		c.Set("csrf", token)
+		c.Response().Header().Add(echo.HeaderVary, echo.HeaderCookie)
+		return next(c)
+	}
+}
+
+// SameOrigin is a middleware that rejects the requests with an unsafe method
+// if their origin is not the cozy or one of its apps. The requests without
+// Origin and Referer headers are accepted, as they are not sent by all the
+// clients.
+func SameOrigin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if !isSafeMethod(req.Method) && !checkSameOrigin(req) {
+			return echo.NewHTTPError(http.StatusForbidden, "cross-origin request")
+		}
+		return next(c)
+	}
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func checkSameOrigin(req *http.Request) bool {
+	origin := req.Header.Get(echo.HeaderOrigin)
+	if origin == "" {
+		origin = req.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if u.Host == req.Host {
+		return true
+	}
+	parent, slug, _ := SplitHost(u.Host)
+	return slug != "" && parent == req.Host
+}
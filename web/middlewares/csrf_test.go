@@ -0,0 +1,84 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSameOrigin(t *testing.T) {
+	config.UseTestFile()
+	cfg := config.GetConfig()
+	was := cfg.Subdomains
+	defer func() { cfg.Subdomains = was }()
+	cfg.Subdomains = config.NestedSubdomains
+
+	req, _ := http.NewRequest(echo.POST, "https://joe.example.net/auth/login", nil)
+	assert.True(t, checkSameOrigin(req))
+	req.Header.Set("Origin", "https://joe.example.net")
+	assert.True(t, checkSameOrigin(req))
+	req.Header.Set("Origin", "https://onboarding.joe.example.net")
+	assert.True(t, checkSameOrigin(req))
+	req.Header.Set("Origin", "https://jane.example.net")
+	assert.False(t, checkSameOrigin(req))
+	req.Header.Set("Origin", "null")
+	assert.False(t, checkSameOrigin(req))
+
+	req.Header.Del("Origin")
+	req.Header.Set("Referer", "https://evil.example.org/login")
+	assert.False(t, checkSameOrigin(req))
+	req.Header.Set("Referer", "https://joe.example.net/auth/login")
+	assert.True(t, checkSameOrigin(req))
+}
+
+func TestCSRF(t *testing.T) {
+	config.UseTestFile()
+	e := echo.New()
+	h := CSRF(func(c echo.Context) error {
+		return c.String(http.StatusOK, c.Get("csrf").(string))
+	})
+
+	req, _ := http.NewRequest(echo.GET, "https://joe.example.net/auth/login", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	token := rec.Body.String()
+	assert.Len(t, token, csrfTokenLength)
+	cookies := (&http.Response{Header: rec.Header()}).Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, CSRFCookieName, cookies[0].Name)
+		assert.Equal(t, token, cookies[0].Value)
+		assert.True(t, cookies[0].HttpOnly)
+		assert.True(t, cookies[0].Secure)
+	}
+
+	post := func(sent, origin string) error {
+		form := url.Values{CSRFTokenField: {sent}}
+		req, _ := http.NewRequest(echo.POST, "https://joe.example.net/auth/login", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		req.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: token})
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return h(e.NewContext(req, httptest.NewRecorder()))
+	}
+	assert.NoError(t, post(token, ""))
+	assert.NoError(t, post(token, "https://joe.example.net"))
+	err := post(token, "https://evil.example.org")
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+	err = post("", "")
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+	err = post("azertyuiop", "")
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+}
@@ -2,7 +2,10 @@ package middlewares
 
 import (
 	"net/http"
+	"net/url"
+	"strings"
 
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/web/jsonapi"
@@ -30,7 +33,10 @@ func NeedInstance(next echo.HandlerFunc) echo.HandlerFunc {
 			errHTTP.Inner = err
 			return errHTTP
 		}
-		c.Set("instance", i.WithContextualDomain(c.Request().Host))
+		// The hot documents are cached for the duration of the request
+		ctx := couchdb.WithDocCache(c.Request().Context())
+		i = i.WithContextualDomain(c.Request().Host).WithContext(ctx)
+		c.Set("instance", i)
 		return next(c)
 	}
 }
@@ -51,13 +57,88 @@ func CheckInstanceBlocked(next echo.HandlerFunc) echo.HandlerFunc {
 			case jsonapi.ContentType, echo.MIMEApplicationJSON:
 				return c.JSON(http.StatusPaymentRequired, i.Warnings())
 			default:
-				return echo.NewHTTPError(http.StatusPaymentRequired)
+				if !i.Blocked {
+					return echo.NewHTTPError(http.StatusPaymentRequired)
+				}
+				errHTTP := echo.NewHTTPError(http.StatusPaymentRequired, instance.ErrBlocked)
+				errHTTP.Inner = instance.ErrBlocked
+				return errHTTP
 			}
 		}
 		return next(c)
 	}
 }
 
+// CheckMaintenance is a middleware that blocks the routing access when the
+// instance, or the application that makes the request, is in maintenance. The
+// requests made with a CLI token are still allowed.
+func CheckMaintenance(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		i := GetInstance(c)
+		if !i.Maintenance && len(i.MaintenanceApps) == 0 {
+			return next(c)
+		}
+		pdoc, err := GetPermission(c)
+		if err == nil && pdoc.Type == permissions.TypeCLI {
+			return next(c)
+		}
+		inMaintenance := i.Maintenance
+		if err == nil && (pdoc.Type == permissions.TypeWebapp || pdoc.Type == permissions.TypeKonnector) {
+			slug := pdoc.SourceID[strings.Index(pdoc.SourceID, "/")+1:]
+			inMaintenance = i.AppInMaintenance(slug)
+		}
+		if !inMaintenance {
+			return next(c)
+		}
+		return MaintenanceError(c, i)
+	}
+}
+
+// CheckMoved is a middleware that redirects the requests to the new instance
+// of the user, when the data has been moved to another instance. The GET
+// requests are permanently redirected, and the other ones keep their method
+// and their body.
+func CheckMoved(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		i := GetInstance(c)
+		if i.MovedTo == "" {
+			return next(c)
+		}
+		u, err := url.Parse(i.MovedTo)
+		if err != nil {
+			return next(c)
+		}
+		req := c.Request()
+		u.Path = req.URL.Path
+		u.RawQuery = req.URL.RawQuery
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			return c.Redirect(http.StatusMovedPermanently, u.String())
+		}
+		return c.Redirect(http.StatusPermanentRedirect, u.String())
+	}
+}
+
+// MaintenanceError returns the error sent to the user when the instance or
+// the application is in maintenance: a JSON error or an HTML page, with the
+// locale of the instance.
+func MaintenanceError(c echo.Context, i *instance.Instance) error {
+	// The Accept middleware is not used for all the routes, like the ones of
+	// the applications
+	contentType, _ := c.Get(acceptContentTypeKey).(string)
+	switch contentType {
+	case jsonapi.ContentType, echo.MIMEApplicationJSON:
+		return &jsonapi.Error{
+			Status: http.StatusServiceUnavailable,
+			Title:  i.Translate("Error Maintenance Title"),
+			Detail: i.Translate("Error Maintenance Message"),
+		}
+	default:
+		errHTTP := echo.NewHTTPError(http.StatusServiceUnavailable, instance.ErrInMaintenance)
+		errHTTP.Inner = instance.ErrInMaintenance
+		return errHTTP
+	}
+}
+
 // GetInstance will return the instance linked to the given echo
 // context or panic if none exists
 func GetInstance(c echo.Context) *instance.Instance {
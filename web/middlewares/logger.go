@@ -0,0 +1,49 @@
+package middlewares
+
+import (
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/echo"
+	"github.com/sirupsen/logrus"
+)
+
+// HeaderRequestID is the header used for the identifier of a request: it can
+// be given by a reverse-proxy, and it is sent in the response.
+const HeaderRequestID = "X-Request-Id"
+
+// RequestID is a middleware that gives an identifier to the request, if it
+// doesn't have one, so that the logs of the request can be correlated. The
+// identifier is kept in the headers of the request, as the request can be
+// served by several echo routers.
+func RequestID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := req.Header.Get(HeaderRequestID)
+		if id == "" || len(id) > 64 {
+			id = utils.RandomString(16)
+			req.Header.Set(HeaderRequestID, id)
+		}
+		c.Response().Header().Set(HeaderRequestID, id)
+		return next(c)
+	}
+}
+
+// GetLogger returns a logger for the request, with the domain of the
+// instance, the identifier of the request, and the doctype (for the routes
+// with a doctype).
+func GetLogger(c echo.Context) *logrus.Entry {
+	var log *logrus.Entry
+	if inst, ok := GetInstanceSafe(c); ok {
+		log = inst.Logger().WithField("nspace", "http")
+	} else {
+		log = logger.WithNamespace("http")
+	}
+	fields := logrus.Fields{}
+	if id := c.Request().Header.Get(HeaderRequestID); id != "" {
+		fields["req_id"] = id
+	}
+	if doctype := c.Param("doctype"); doctype != "" {
+		fields["doctype"] = doctype
+	}
+	return log.WithFields(fields)
+}
@@ -0,0 +1,39 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	e := echo.New()
+	var id string
+	h := RequestID(func(c echo.Context) error {
+		c.Set("instance", &instance.Instance{Domain: "cozy.local"})
+		log := GetLogger(c)
+		id, _ = log.Data["req_id"].(string)
+		assert.Equal(t, "cozy.local", log.Data["domain"])
+		assert.Equal(t, "http", log.Data["nspace"])
+		return nil
+	})
+
+	req, _ := http.NewRequest(echo.GET, "http://cozy.local", nil)
+	rec := httptest.NewRecorder()
+	err := h(e.NewContext(req, rec))
+	assert.NoError(t, err)
+	assert.Len(t, id, 16)
+	assert.Equal(t, id, rec.Header().Get(HeaderRequestID))
+
+	req, _ = http.NewRequest(echo.GET, "http://cozy.local", nil)
+	req.Header.Set(HeaderRequestID, "from-the-proxy")
+	rec = httptest.NewRecorder()
+	err = h(e.NewContext(req, rec))
+	assert.NoError(t, err)
+	assert.Equal(t, "from-the-proxy", id)
+	assert.Equal(t, "from-the-proxy", rec.Header().Get(HeaderRequestID))
+}
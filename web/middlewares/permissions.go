@@ -15,6 +15,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/echo"
 	jwt "gopkg.in/dgrijalva/jwt-go.v3"
@@ -64,39 +65,58 @@ func GetRequestToken(c echo.Context) string {
 
 // ParseJWT parses a JSON Web Token, and returns the associated permissions.
 func ParseJWT(c echo.Context, instance *instance.Instance, token string) (*permissions.Permission, error) {
+	pdoc, _, err := parseJWT(instance, token, func(sessionID string) bool {
+		s, ok := GetSession(c)
+		return ok && s.ID() == sessionID
+	})
+	return pdoc, err
+}
+
+// IntrospectJWT parses a JSON Web Token for the introspection of a token sent
+// by a third party, and returns the associated permissions and claims. A token
+// associated to a session is valid as long as this session exists, even if it
+// is not the session of the current request.
+func IntrospectJWT(instance *instance.Instance, token string) (*permissions.Permission, *permissions.Claims, error) {
+	return parseJWT(instance, token, func(sessionID string) bool {
+		_, err := sessions.Get(instance, sessionID)
+		return err == nil
+	})
+}
+
+func parseJWT(instance *instance.Instance, token string, checkSession func(sessionID string) bool) (*permissions.Permission, *permissions.Claims, error) {
 	var claims permissions.Claims
 	var err error
 
 	if isShortCode, _ := regexp.MatchString("^(\\w|\\d){12}$", token); isShortCode { // token is a shortcode
 		token, err = permissions.GetTokenFromShortcode(instance, token)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
 	err = crypto.ParseJWT(token, func(token *jwt.Token) (interface{}, error) {
-		return instance.PickKey(token.Claims.(*permissions.Claims).Audience)
+		audience := token.Claims.(*permissions.Claims).Audience
+		return instance.JWTKeyFunc(audience)(token)
 	}, &claims)
 
 	if err != nil {
-		return nil, permissions.ErrInvalidToken
+		return nil, nil, permissions.ErrInvalidToken
 	}
 
 	// check if the claim is valid
 	if claims.Issuer != instance.Domain {
-		return nil, permissions.ErrInvalidToken
+		return nil, nil, permissions.ErrInvalidToken
 	}
 
 	if claims.Expired() {
-		return nil, permissions.ErrExpiredToken
+		return nil, nil, permissions.ErrExpiredToken
 	}
 
 	// If claims contains a SessionID, we check that we are actually authorized
 	// with the corresponding session.
 	if claims.SessionID != "" {
-		s, ok := GetSession(c)
-		if !ok || s.ID() != claims.SessionID {
-			return nil, permissions.ErrInvalidToken
+		if !checkSession(claims.SessionID) {
+			return nil, nil, permissions.ErrInvalidToken
 		}
 	}
 
@@ -106,39 +126,41 @@ func ParseJWT(c echo.Context, instance *instance.Instance, token string) (*permi
 		c, err := oauth.FindClient(instance, claims.Subject)
 		if err != nil {
 			if couchdb.IsInternalServerError(err) {
-				return nil, err
+				return nil, nil, err
 			}
-			return nil, permissions.ErrInvalidToken
+			return nil, nil, permissions.ErrInvalidToken
 		}
-		return permissions.GetForOauth(&claims, c)
+		pdoc, err := permissions.GetForOauth(&claims, c)
+		return pdoc, &claims, err
 
 	case permissions.CLIAudience:
 		// do not check client existence
-		return permissions.GetForCLI(&claims)
+		pdoc, err := permissions.GetForCLI(&claims)
+		return pdoc, &claims, err
 
 	case permissions.AppAudience:
 		pdoc, err := permissions.GetForWebapp(instance, claims.Subject)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		return pdoc, nil
+		return pdoc, &claims, nil
 
 	case permissions.KonnectorAudience:
 		pdoc, err := permissions.GetForKonnector(instance, claims.Subject)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		return pdoc, nil
+		return pdoc, &claims, nil
 
 	case permissions.ShareAudience:
 		pdoc, err := permissions.GetForShareCode(instance, token)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		return pdoc, nil
+		return pdoc, &claims, nil
 
 	default:
-		return nil, echo.NewHTTPError(http.StatusBadRequest, "Unrecognized token audience "+claims.Audience)
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "Unrecognized token audience "+claims.Audience)
 	}
 }
 
@@ -220,7 +242,9 @@ func AllowTypeAndID(c echo.Context, v permissions.Verb, doctype, id string) erro
 	return nil
 }
 
-// AllowVFS validates a vfs.Matcher against the context permission set
+// AllowVFS validates a vfs.Matcher against the context permission set. For
+// an OAuth client, the ACLs on the files granted to this client are also
+// checked.
 func AllowVFS(c echo.Context, v permissions.Verb, o vfs.Matcher) error {
 	instance := GetInstance(c)
 	pdoc, err := GetPermission(c)
@@ -228,6 +252,12 @@ func AllowVFS(c echo.Context, v permissions.Verb, o vfs.Matcher) error {
 		return err
 	}
 	err = vfs.Allows(instance.VFS(), pdoc.Permissions, v, o)
+	if err != nil && pdoc.Type == permissions.TypeOauth {
+		acls, errl := permissions.GetFileACLsForClient(instance, pdoc.SourceID)
+		if errl == nil && len(acls) > 0 {
+			err = vfs.Allows(instance.VFS(), permissions.FileACLsSet(acls), v, o)
+		}
+	}
 	if err != nil {
 		return ErrForbidden
 	}
@@ -0,0 +1,83 @@
+package middlewares
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/echo"
+)
+
+// The headers for the rate limits, from the IETF draft "RateLimit Header
+// Fields for HTTP".
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+	headerRetryAfter         = "Retry-After"
+)
+
+// RateLimit returns a middleware that checks the rate limit of the given type
+// for the token of the request.
+func RateLimit(ct limits.CounterType) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := CheckRateLimit(c, ct); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// CheckRateLimit increments the counter of the given type for the token of
+// the request, or for its client IP if the request has no token, and adds the
+// RateLimit headers to the response. It returns a 429 error if the limit has
+// been exceeded.
+func CheckRateLimit(c echo.Context, ct limits.CounterType) error {
+	inst := GetInstance(c)
+	quota, err := limits.CheckQuota(inst, ct, RateLimitToken(c))
+	if quota != nil {
+		setRateLimitHeaders(c, quota)
+	}
+	if err == limits.ErrRateLimitReached {
+		c.Response().Header().Set(headerRetryAfter, seconds(quota.Reset))
+		return jsonapi.NewError(http.StatusTooManyRequests, err.Error())
+	}
+	if err != nil {
+		// The rate limiting must not break the requests when redis is down
+		inst.Logger().WithField("nspace", "limits").
+			Errorf("Could not check the rate limit: %s", err)
+	}
+	return nil
+}
+
+// RateLimitToken returns the key of the token of the request for the
+// counters: the source of its permissions, so that the counter is not reset
+// when the token is refreshed. For a request without token, like the ones
+// authenticated by a secret in the URL, it is the client IP, so that the
+// requests of different clients don't share the same counter.
+func RateLimitToken(c echo.Context) string {
+	pdoc, err := GetPermission(c)
+	if err != nil {
+		return "ip:" + c.RealIP()
+	}
+	if pdoc.SourceID != "" {
+		return pdoc.SourceID
+	}
+	return pdoc.ID()
+}
+
+func setRateLimitHeaders(c echo.Context, quota *limits.Quota) {
+	h := c.Response().Header()
+	h.Set(HeaderRateLimitLimit, strconv.FormatInt(quota.Limit, 10))
+	h.Set(HeaderRateLimitRemaining, strconv.FormatInt(quota.Remaining, 10))
+	h.Set(HeaderRateLimitReset, seconds(quota.Reset))
+}
+
+func seconds(d time.Duration) string {
+	secs := int64((d + time.Second - 1) / time.Second)
+	return strconv.FormatInt(secs, 10)
+}
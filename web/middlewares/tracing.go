@@ -0,0 +1,40 @@
+package middlewares
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/tracing"
+	"github.com/cozy/echo"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Tracing is a middleware that creates a span for the request, as a child of
+// the trace context given in its headers if any. The context of the request
+// has this span, and it is given to the instance by NeedInstance.
+func Tracing(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !tracing.Enabled() {
+			return next(c)
+		}
+		req := c.Request()
+		ctx := tracing.Extract(req.Context(), req.Header)
+		ctx, span := tracing.StartServer(ctx, "HTTP "+req.Method,
+			attribute.String("http.method", req.Method),
+			attribute.String("http.host", req.Host),
+			attribute.String("http.target", req.URL.Path),
+			attribute.String("http.request_id", req.Header.Get(HeaderRequestID)),
+		)
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+		status := c.Response().Status
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if err == nil && status >= 500 {
+			tracing.End(span, errors.New(http.StatusText(status)))
+		} else {
+			tracing.End(span, err)
+		}
+		return err
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/workers/move"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
@@ -63,6 +64,9 @@ func createExport(c echo.Context) error {
 	if _, err := jsonapi.Bind(c.Request().Body, &exportOptions); err != nil {
 		return err
 	}
+	if !move.IsValidExportFormat(exportOptions.Format) {
+		return move.ErrExportInvalidFormat
+	}
 
 	msg, err := jobs.NewMessage(exportOptions)
 	if err != nil {
@@ -82,7 +86,16 @@ func createExport(c echo.Context) error {
 
 // Routes defines the routing layout for the /move module.
 func Routes(g *echo.Group) {
+	g.POST("/tokens", createMoveToken)
+	g.POST("/transfers", createTransfer)
+	g.GET("/transfers/:transfer-id", getTransfer)
+}
+
+// ExportsRoutes defines the routing layout for the exports of the /move
+// module. They are kept apart from the other routes, as the user can still
+// export their data when the instance is blocked.
+func ExportsRoutes(g *echo.Group) {
 	g.GET("/exports/:export-mac", exportHandler)
 	g.GET("/exports/data/:export-mac", exportDataHandler)
-	g.POST("/exports", createExport)
+	g.POST("/exports", createExport, middlewares.RateLimit(limits.ExportType))
 }
@@ -0,0 +1,205 @@
+package move
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/workers/move"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const moveTokenKey = "move-token"
+
+// apiTransfer is the progress of a transfer, without the token.
+type apiTransfer struct{ *move.Transfer }
+
+func (t *apiTransfer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Source       string    `json:"source"`
+		State        string    `json:"state"`
+		Error        string    `json:"error,omitempty"`
+		Step         string    `json:"step"`
+		DoneDoctypes []string  `json:"done_doctypes,omitempty"`
+		DocsCount    int       `json:"docs_count"`
+		FilesCount   int       `json:"files_count"`
+		BytesCount   int64     `json:"bytes_count"`
+		CreatedAt    time.Time `json:"created_at"`
+		UpdatedAt    time.Time `json:"updated_at"`
+	}{
+		Source:       t.Source,
+		State:        t.State,
+		Error:        t.Error,
+		Step:         t.Step,
+		DoneDoctypes: t.DoneDoctypes,
+		DocsCount:    t.DocsCount,
+		FilesCount:   t.FilesCount,
+		BytesCount:   t.BytesCount,
+		CreatedAt:    t.CreatedAt,
+		UpdatedAt:    t.UpdatedAt,
+	})
+}
+
+// createMoveToken is used on the source instance to generate the token that
+// the user gives to the target instance.
+func createMoveToken(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.Moves); err != nil {
+		return err
+	}
+
+	token, doc, err := move.CreateMoveToken(inst)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, echo.Map{
+		"token":      token,
+		"expires_at": doc.ExpiresAt,
+	})
+}
+
+// createTransfer is used on the target instance to start pulling the data
+// from the source instance.
+func createTransfer(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.Moves); err != nil {
+		return err
+	}
+
+	var attrs struct {
+		Source string `json:"source"`
+		Token  string `json:"token"`
+	}
+	if _, err := jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if attrs.Source == "" || attrs.Token == "" {
+		return jsonapi.BadRequest(move.ErrInvalidMoveURL)
+	}
+	t, err := move.StartTransfer(inst, attrs.Source, attrs.Token)
+	if err != nil {
+		return wrapMoveError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, &apiTransfer{t}, nil)
+}
+
+func getTransfer(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Moves); err != nil {
+		return err
+	}
+
+	t, err := move.GetTransfer(inst, c.Param("transfer-id"))
+	if err != nil {
+		return wrapMoveError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiTransfer{t}, nil)
+}
+
+// checkMoveToken is the middleware for the routes of the source instance:
+// they are authenticated with a move token, and not with a session or an
+// OAuth token.
+func checkMoveToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		inst := middlewares.GetInstance(c)
+		header := c.Request().Header.Get(echo.HeaderAuthorization)
+		if !strings.HasPrefix(header, "Bearer ") {
+			return jsonapi.NewError(http.StatusUnauthorized, move.ErrInvalidMoveToken.Error())
+		}
+		token, err := move.CheckMoveToken(inst, strings.TrimPrefix(header, "Bearer "))
+		if err == move.ErrInvalidMoveToken {
+			return jsonapi.NewError(http.StatusUnauthorized, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		c.Set(moveTokenKey, token)
+		return next(c)
+	}
+}
+
+func sourceInfo(c echo.Context) error {
+	info, err := move.GetSourceInfo(middlewares.GetInstance(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+func sourceDocs(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	page, err := move.GetDocsPage(inst, c.Param("doctype"), c.QueryParam("cursor"), limit)
+	if err != nil {
+		return wrapMoveError(err)
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// sourceFile sends the content of a file. The Range header is supported, so
+// that the target instance can resume an interrupted download.
+func sourceFile(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	doc, err := fs.FileByID(c.Param("file-id"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return jsonapi.NotFound(err)
+		}
+		return err
+	}
+	return vfs.ServeFileContent(fs, doc, "", c.Request(), c.Response())
+}
+
+func sourceFinish(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	token := c.Get(moveTokenKey).(*move.MoveToken)
+	var body struct {
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if err := move.FinishMove(inst, token, body.Target); err != nil {
+		return wrapMoveError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func wrapMoveError(err error) error {
+	switch err {
+	case move.ErrInvalidMoveToken:
+		return jsonapi.InvalidAttribute("token", err)
+	case move.ErrInvalidMoveURL:
+		return jsonapi.BadRequest(err)
+	case move.ErrNotMovedDoctype:
+		return jsonapi.Forbidden(err)
+	case move.ErrTransferNotFound:
+		return jsonapi.NotFound(err)
+	}
+	if _, ok := couchdb.IsCouchError(err); ok {
+		return err
+	}
+	return jsonapi.BadGateway(err)
+}
+
+// SourceRoutes defines the routing layout for the routes of the source
+// instance of a move, used by the target instance.
+func SourceRoutes(g *echo.Group) {
+	g.Use(checkMoveToken)
+	g.GET("/info", sourceInfo)
+	g.GET("/docs/:doctype", sourceDocs)
+	g.GET("/files/:file-id", sourceFile)
+	g.POST("/finish", sourceFinish)
+}
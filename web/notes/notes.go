@@ -0,0 +1,234 @@
+// Package notes gives the routes to create the notes and to edit them
+// collaboratively, by sending the steps of the modifications.
+package notes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/notes"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+type apiNote struct {
+	*notes.Note
+}
+
+func (n *apiNote) MarshalJSON() ([]byte, error) { return json.Marshal(n.Note) }
+func (n *apiNote) Included() []jsonapi.Object   { return nil }
+func (n *apiNote) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/notes/" + n.DocID}
+}
+func (n *apiNote) Relationships() jsonapi.RelationshipMap {
+	if n.FileID == "" {
+		return nil
+	}
+	return jsonapi.RelationshipMap{
+		"file": jsonapi.Relationship{
+			Data: couchdb.DocReference{ID: n.FileID, Type: consts.Files},
+		},
+	}
+}
+
+type apiStep struct {
+	*notes.Step
+}
+
+func (s *apiStep) MarshalJSON() ([]byte, error)           { return json.Marshal(s.Step) }
+func (s *apiStep) Included() []jsonapi.Object             { return nil }
+func (s *apiStep) Links() *jsonapi.LinksList              { return nil }
+func (s *apiStep) Relationships() jsonapi.RelationshipMap { return nil }
+
+func wrapError(err error) error {
+	switch err {
+	case notes.ErrMissingTitle:
+		return jsonapi.InvalidAttribute("title", err)
+	case notes.ErrVersionConflict:
+		return jsonapi.Conflict(err)
+	case notes.ErrTooOld:
+		return jsonapi.PreconditionFailed("version", err)
+	case notes.ErrInvalidStep, notes.ErrInvalidPosition, notes.ErrCannotApply:
+		return jsonapi.InvalidAttribute("steps", err)
+	case os.ErrNotExist:
+		return jsonapi.NotFound(err)
+	}
+	if couchdb.IsNotFoundError(err) {
+		return jsonapi.NotFound(err)
+	}
+	return err
+}
+
+// findNote loads the note of the request, after checking the permissions
+// of the requester for the given verb.
+func findNote(c echo.Context, v permissions.Verb) (*notes.Note, error) {
+	id := c.Param("note-id")
+	if err := middlewares.AllowTypeAndID(c, v, consts.Notes, id); err != nil {
+		return nil, err
+	}
+	note, err := notes.Find(middlewares.GetInstance(c), id)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return note, nil
+}
+
+func createNote(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.Notes); err != nil {
+		return err
+	}
+	var attrs struct {
+		Title string `json:"title"`
+		DirID string `json:"dir_id"`
+	}
+	if _, err := jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if attrs.DirID != "" {
+		dir, err := inst.VFS().DirByID(attrs.DirID)
+		if err != nil {
+			return jsonapi.InvalidAttribute("dir_id", err)
+		}
+		if err = middlewares.AllowVFS(c, permissions.POST, dir); err != nil {
+			return err
+		}
+	}
+	note, err := notes.Create(inst, attrs.Title, attrs.DirID)
+	if err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiNote{note}, nil)
+}
+
+func listNotes(c echo.Context) error {
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Notes); err != nil {
+		return err
+	}
+	list, err := notes.GetAll(middlewares.GetInstance(c))
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, len(list))
+	for i, note := range list {
+		objs[i] = &apiNote{note}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func getNote(c echo.Context) error {
+	note, err := findNote(c, permissions.GET)
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiNote{note}, nil)
+}
+
+func deleteNote(c echo.Context) error {
+	note, err := findNote(c, permissions.DELETE)
+	if err != nil {
+		return err
+	}
+	if err = notes.Delete(middlewares.GetInstance(c), note); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// patchNote applies the steps sent by an editor. The If-Match header must
+// have the version of the note on which the steps are based.
+func patchNote(c echo.Context) error {
+	note, err := findNote(c, permissions.PATCH)
+	if err != nil {
+		return err
+	}
+	version, err := strconv.ParseInt(c.Request().Header.Get("If-Match"), 10, 64)
+	if err != nil {
+		return jsonapi.PreconditionFailed("If-Match", errors.New("The version is missing"))
+	}
+	objs, err := jsonapi.BindCompound(c.Request().Body)
+	if err != nil {
+		return jsonapi.BadJSON()
+	}
+	steps := make([]*notes.Step, len(objs))
+	sessionID := ""
+	for i, obj := range objs {
+		if obj.Attributes == nil {
+			return jsonapi.BadJSON()
+		}
+		var step notes.Step
+		if err = json.Unmarshal(*obj.Attributes, &step); err != nil {
+			return jsonapi.BadJSON()
+		}
+		if step.SessionID != "" {
+			sessionID = step.SessionID
+		}
+		steps[i] = &step
+	}
+	note, err = notes.ApplySteps(middlewares.GetInstance(c), note.ID(), sessionID, version, steps)
+	if err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiNote{note}, nil)
+}
+
+// getSteps returns the steps applied to the note since the version given in
+// the query string, so that an editor can catch up.
+func getSteps(c echo.Context) error {
+	note, err := findNote(c, permissions.GET)
+	if err != nil {
+		return err
+	}
+	since, err := strconv.ParseInt(c.QueryParam("version"), 10, 64)
+	if err != nil {
+		return jsonapi.InvalidParameter("version", err)
+	}
+	steps, err := notes.GetSteps(middlewares.GetInstance(c), note, since)
+	if err != nil {
+		if err == notes.ErrInvalidPosition {
+			return jsonapi.InvalidParameter("version", err)
+		}
+		return wrapError(err)
+	}
+	objs := make([]jsonapi.Object, len(steps))
+	for i, step := range steps {
+		objs[i] = &apiStep{step}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func changeTitle(c echo.Context) error {
+	note, err := findNote(c, permissions.PUT)
+	if err != nil {
+		return err
+	}
+	var attrs struct {
+		Title     string `json:"title"`
+		SessionID string `json:"sessionID"`
+	}
+	if _, err = jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if err = notes.SetTitle(middlewares.GetInstance(c), note, attrs.SessionID, attrs.Title); err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiNote{note}, nil)
+}
+
+// Routes sets the routing for the notes service
+func Routes(router *echo.Group) {
+	router.POST("", createNote)
+	router.GET("", listNotes)
+	router.GET("/:note-id", getNote)
+	router.DELETE("/:note-id", deleteNote)
+	router.PATCH("/:note-id", patchNote)
+	router.GET("/:note-id/steps", getSteps)
+	router.PUT("/:note-id/title", changeTitle)
+}
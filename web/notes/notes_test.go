@@ -0,0 +1,149 @@
+package notes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	pkgnotes "github.com/cozy/cozy-stack/pkg/notes"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token string
+var noteID string
+
+func doRequest(method, path, body string, headers map[string]string) (*http.Response, map[string]interface{}) {
+	req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	var result map[string]interface{}
+	_ = json.NewDecoder(res.Body).Decode(&result)
+	return res, result
+}
+
+const insertHello = `{"data": [{
+	"type": "io.cozy.notes.steps",
+	"attributes": {
+		"sessionID": "543781490137",
+		"stepType": "replace",
+		"from": 1,
+		"to": 1,
+		"slice": {"content": [{"type": "text", "text": "Hello"}]}
+	}
+}]}`
+
+func TestCreateNote(t *testing.T) {
+	res, _ := doRequest("POST", "/notes", `{"data": {"type": "io.cozy.notes", "attributes": {}}}`, nil)
+	assert.Equal(t, 422, res.StatusCode)
+
+	res, result := doRequest("POST", "/notes", `{"data": {"type": "io.cozy.notes", "attributes": {"title": "My note"}}}`, nil)
+	assert.Equal(t, 201, res.StatusCode)
+	data := result["data"].(map[string]interface{})
+	noteID = data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "My note", attrs["title"])
+	assert.Equal(t, float64(0), attrs["version"])
+	content := attrs["content"].(map[string]interface{})
+	assert.Equal(t, "doc", content["type"])
+
+	file, err := testInstance.VFS().FileByPath(pkgnotes.DefaultDirPath + "/My note.md")
+	assert.NoError(t, err)
+	rels := data["relationships"].(map[string]interface{})
+	ref := rels["file"].(map[string]interface{})["data"].(map[string]interface{})
+	assert.Equal(t, file.ID(), ref["id"])
+}
+
+func TestApplySteps(t *testing.T) {
+	res, _ := doRequest("PATCH", "/notes/"+noteID, insertHello, nil)
+	assert.Equal(t, 412, res.StatusCode)
+
+	res, result := doRequest("PATCH", "/notes/"+noteID, insertHello, map[string]string{"If-Match": "0"})
+	assert.Equal(t, 200, res.StatusCode)
+	data := result["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, float64(1), attrs["version"])
+
+	// The same steps can't be applied twice on the version 0
+	res, _ = doRequest("PATCH", "/notes/"+noteID, insertHello, map[string]string{"If-Match": "0"})
+	assert.Equal(t, 409, res.StatusCode)
+
+	invalid := strings.Replace(insertHello, `"from": 1`, `"from": 100`, 1)
+	res, _ = doRequest("PATCH", "/notes/"+noteID, invalid, map[string]string{"If-Match": "1"})
+	assert.Equal(t, 422, res.StatusCode)
+
+	res, result = doRequest("GET", "/notes/"+noteID+"/steps?version=0", "", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	steps := result["data"].([]interface{})
+	if assert.Len(t, steps, 1) {
+		step := steps[0].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, float64(1), step["version"])
+		assert.Equal(t, "543781490137", step["sessionID"])
+		assert.Equal(t, "replace", step["stepType"])
+	}
+
+	res, result = doRequest("GET", "/notes/"+noteID+"/steps?version=1", "", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Len(t, result["data"], 0)
+}
+
+func TestSaveNote(t *testing.T) {
+	res, _ := doRequest("PUT", "/notes/"+noteID+"/title", `{"data": {"type": "io.cozy.notes", "attributes": {"title": "Greetings"}}}`, nil)
+	assert.Equal(t, 200, res.StatusCode)
+
+	assert.NoError(t, pkgnotes.Save(testInstance, noteID))
+	fs := testInstance.VFS()
+	file, err := fs.FileByPath(pkgnotes.DefaultDirPath + "/Greetings.md")
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.OpenFile(file)
+	assert.NoError(t, err)
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "Hello\n", string(buf))
+
+	note, err := pkgnotes.Find(testInstance, noteID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), note.SavedVersion)
+}
+
+func TestDeleteNote(t *testing.T) {
+	res, _ := doRequest("DELETE", "/notes/"+noteID, "", nil)
+	assert.Equal(t, 204, res.StatusCode)
+
+	res, _ = doRequest("GET", "/notes/"+noteID, "", nil)
+	assert.Equal(t, 404, res.StatusCode)
+
+	_, err := testInstance.VFS().FileByPath(pkgnotes.DefaultDirPath + "/Greetings.md")
+	assert.Error(t, err)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "notes_test")
+	testInstance = setup.GetTestInstance()
+	scope := consts.Notes + " " + consts.Files
+	_, token = setup.GetTestClient(scope)
+	ts = setup.GetTestServer("/notes", Routes)
+	os.Exit(setup.Run())
+}
@@ -2,6 +2,7 @@ package notifications
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/cozy/cozy-stack/pkg/apps"
@@ -9,6 +10,8 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/notification"
 	"github.com/cozy/cozy-stack/pkg/notification/center"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/echo"
@@ -49,6 +52,80 @@ func createHandler(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusCreated, &apiNotif{n}, nil)
 }
 
+type apiDevice struct {
+	d *oauth.Device
+}
+
+func (d *apiDevice) ID() string                             { return d.d.ID() }
+func (d *apiDevice) Rev() string                            { return d.d.Rev() }
+func (d *apiDevice) DocType() string                        { return consts.NotificationDevices }
+func (d *apiDevice) Clone() couchdb.Doc                     { return d }
+func (d *apiDevice) SetID(_ string)                         {}
+func (d *apiDevice) SetRev(_ string)                        {}
+func (d *apiDevice) Relationships() jsonapi.RelationshipMap { return nil }
+func (d *apiDevice) Included() []jsonapi.Object             { return nil }
+func (d *apiDevice) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/notifications/devices/" + d.d.ID()}
+}
+func (d *apiDevice) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.d)
+}
+
+// getOAuthClientID returns the identifier of the OAuth client that has made
+// the request: only the OAuth clients (mobile apps) can register devices.
+func getOAuthClientID(c echo.Context) (string, error) {
+	perm, err := middlewares.GetPermission(c)
+	if err != nil {
+		return "", err
+	}
+	if perm.Type != permissions.TypeOauth || perm.SourceID == "" {
+		return "", jsonapi.Forbidden(errors.New("Only OAuth clients can register devices"))
+	}
+	return perm.SourceID, nil
+}
+
+func registerDevice(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	clientID, err := getOAuthClientID(c)
+	if err != nil {
+		return err
+	}
+	var attrs struct {
+		Platform string `json:"platform"`
+		Token    string `json:"token"`
+	}
+	if _, err = jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	d, err := oauth.RegisterDevice(inst, clientID, attrs.Platform, attrs.Token)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiDevice{d}, nil)
+}
+
+func unregisterDevice(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	clientID, err := getOAuthClientID(c)
+	if err != nil {
+		return err
+	}
+	d, err := oauth.FindDevice(inst, c.Param("id"))
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return jsonapi.NotFound(err)
+		}
+		return err
+	}
+	if d.ClientID != clientID {
+		return jsonapi.Forbidden(errors.New("The device has been registered by another client"))
+	}
+	if err = d.Delete(inst); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
 func wrapErrors(err error) error {
 	if err == nil {
 		return nil
@@ -58,6 +135,10 @@ func wrapErrors(err error) error {
 		return jsonapi.BadRequest(err)
 	case center.ErrUnauthorized:
 		return jsonapi.Forbidden(err)
+	case oauth.ErrInvalidPlatform:
+		return jsonapi.InvalidAttribute("platform", err)
+	case oauth.ErrMissingDeviceToken:
+		return jsonapi.InvalidAttribute("token", err)
 	case apps.ErrNotFound:
 		return jsonapi.NotFound(err)
 	}
@@ -67,4 +148,6 @@ func wrapErrors(err error) error {
 // Routes sets the routing for the notification service.
 func Routes(router *echo.Group) {
 	router.POST("", createHandler)
+	router.POST("/devices", registerDevice)
+	router.DELETE("/devices/:id", unregisterDevice)
 }
@@ -0,0 +1,128 @@
+package notifications
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var clientID string
+var token string
+var otherToken string
+
+func postDevice(tok, body string) (*http.Response, error) {
+	req, _ := http.NewRequest("POST", ts.URL+"/notifications/devices", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+tok)
+	return http.DefaultClient.Do(req)
+}
+
+func deleteDevice(tok, id string) (*http.Response, error) {
+	req, _ := http.NewRequest("DELETE", ts.URL+"/notifications/devices/"+id, nil)
+	req.Header.Add("Authorization", "Bearer "+tok)
+	return http.DefaultClient.Do(req)
+}
+
+func deviceBody(platform, deviceToken string) string {
+	return `{"data": {"type": "io.cozy.notifications.devices", "attributes": {"platform": "` +
+		platform + `", "token": "` + deviceToken + `"}}}`
+}
+
+func TestRegisterDeviceErrors(t *testing.T) {
+	res, err := postDevice(token, deviceBody("windows", "device-token"))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 422, res.StatusCode)
+
+	res2, err := postDevice(token, deviceBody("firebase", ""))
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 422, res2.StatusCode)
+
+	res3, err := postDevice(token, `{"data": `)
+	assert.NoError(t, err)
+	defer res3.Body.Close()
+	assert.Equal(t, 400, res3.StatusCode)
+
+	// Only the OAuth clients can register devices
+	cliToken, _ := testInstance.MakeJWT(permissions.CLIAudience, "CLI",
+		consts.Notifications, "", time.Now())
+	res4, err := postDevice(cliToken, deviceBody("firebase", "device-token"))
+	assert.NoError(t, err)
+	defer res4.Body.Close()
+	assert.Equal(t, 403, res4.StatusCode)
+}
+
+func TestRegisterAndUnregisterDevice(t *testing.T) {
+	res, err := postDevice(token, deviceBody("Firebase", "device-token"))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	id := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "firebase", attrs["platform"])
+	assert.Equal(t, "device-token", attrs["token"])
+	assert.Equal(t, clientID, attrs["client_id"])
+
+	// The same device token is registered only once
+	res2, err := postDevice(token, deviceBody("firebase", "device-token"))
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 201, res2.StatusCode)
+	err = json.NewDecoder(res2.Body).Decode(&result)
+	assert.NoError(t, err)
+	assert.Equal(t, id, result["data"].(map[string]interface{})["id"])
+	devices, err := oauth.GetDevices(testInstance)
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+
+	// A client can't unregister the device of another client
+	res3, err := deleteDevice(otherToken, id)
+	assert.NoError(t, err)
+	defer res3.Body.Close()
+	assert.Equal(t, 403, res3.StatusCode)
+
+	res4, err := deleteDevice(token, "no-such-device")
+	assert.NoError(t, err)
+	defer res4.Body.Close()
+	assert.Equal(t, 404, res4.StatusCode)
+
+	res5, err := deleteDevice(token, id)
+	assert.NoError(t, err)
+	defer res5.Body.Close()
+	assert.Equal(t, 204, res5.StatusCode)
+	devices, err = oauth.GetDevices(testInstance)
+	assert.NoError(t, err)
+	assert.Len(t, devices, 0)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "notifications_test")
+	testInstance = setup.GetTestInstance()
+	client, tok := setup.GetTestClient(consts.Notifications)
+	clientID = client.ClientID
+	token = tok
+	_, otherToken = setup.GetTestClient(consts.Notifications)
+	ts = setup.GetTestServer("/notifications", Routes)
+	os.Exit(setup.Run())
+}
@@ -0,0 +1,99 @@
+// Package office gives the routes for opening the office documents in the
+// editor of a document server, and for the callbacks of this server when a
+// document has been edited.
+package office
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/office"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/files"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+type apiOfficeURL struct {
+	DocID      string             `json:"document_id"`
+	OnlyOffice *office.OnlyOffice `json:"onlyoffice"`
+}
+
+func (o *apiOfficeURL) ID() string                             { return o.DocID }
+func (o *apiOfficeURL) Rev() string                            { return "" }
+func (o *apiOfficeURL) DocType() string                        { return consts.OfficeURL }
+func (o *apiOfficeURL) Clone() couchdb.Doc                     { return o }
+func (o *apiOfficeURL) SetID(id string)                        {}
+func (o *apiOfficeURL) SetRev(rev string)                      {}
+func (o *apiOfficeURL) Relationships() jsonapi.RelationshipMap { return nil }
+func (o *apiOfficeURL) Included() []jsonapi.Object             { return nil }
+func (o *apiOfficeURL) Links() *jsonapi.LinksList              { return nil }
+func (o *apiOfficeURL) MarshalJSON() ([]byte, error) {
+	type alias apiOfficeURL
+	return json.Marshal((*alias)(o))
+}
+
+func wrapError(err error) error {
+	switch err {
+	case office.ErrNoServer, office.ErrInvalidKey, os.ErrNotExist:
+		return jsonapi.NotFound(err)
+	case office.ErrUnsupportedFile:
+		return jsonapi.BadRequest(err)
+	case office.ErrInvalidToken:
+		return jsonapi.Forbidden(err)
+	case office.ErrDownloadFailed:
+		return jsonapi.BadGateway(err)
+	}
+	return files.WrapVfsError(err)
+}
+
+// Open returns the parameters to open an office document in the editor of
+// the document server. The document is opened in read-only mode if the
+// requester has no permission to modify it.
+func Open(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	doc, err := inst.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = middlewares.AllowVFS(c, permissions.GET, doc); err != nil {
+		return err
+	}
+	readOnly := middlewares.AllowVFS(c, permissions.PUT, doc) != nil
+	o, err := office.Open(inst, doc, readOnly)
+	if err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiOfficeURL{DocID: doc.ID(), OnlyOffice: o}, nil)
+}
+
+// Callback is called by the document server when the status of a document
+// changes, and in particular when an edited document must be saved.
+func Callback(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	params := &office.CallbackParameters{}
+	if err := json.NewDecoder(c.Request().Body).Decode(params); err != nil {
+		return jsonapi.BadJSON()
+	}
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	header = strings.TrimPrefix(header, "Bearer ")
+	if err := office.Callback(inst, params, header); err != nil {
+		inst.Logger().WithField("nspace", "office").
+			Infof("Error on the callback for %s: %s", params.Key, err)
+		return wrapError(err)
+	}
+	// The document server expects this response when the callback has been
+	// processed successfully
+	return c.JSON(http.StatusOK, echo.Map{"error": 0})
+}
+
+// Routes sets the routing for the office documents
+func Routes(router *echo.Group) {
+	router.GET("/:file-id/open", Open)
+	router.POST("/callback", Callback)
+}
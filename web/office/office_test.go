@@ -0,0 +1,160 @@
+package office
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+const secret = "s3cr3t"
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token string
+var fileID, key string
+
+func doRequest(method, path, body string) (*http.Response, map[string]interface{}) {
+	req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	var result map[string]interface{}
+	_ = json.NewDecoder(res.Body).Decode(&result)
+	return res, result
+}
+
+func createFile(name, content string) *vfs.FileDoc {
+	fs := testInstance.VFS()
+	doc, err := vfs.NewFileDoc(name, consts.RootDirID, int64(len(content)), nil,
+		"application/octet-stream", "text", time.Now(), false, false, nil)
+	if err != nil {
+		panic(err)
+	}
+	file, err := fs.CreateFile(doc, nil)
+	if err != nil {
+		panic(err)
+	}
+	if _, err = file.Write([]byte(content)); err != nil {
+		panic(err)
+	}
+	if err = file.Close(); err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+func TestOpen(t *testing.T) {
+	img := createFile("photo.jpg", "not really a photo")
+	res, _ := doRequest("GET", "/office/"+img.ID()+"/open", "")
+	assert.Equal(t, 400, res.StatusCode)
+
+	doc := createFile("letter.docx", "Dear Alice")
+	fileID = doc.ID()
+	res, result := doRequest("GET", "/office/"+fileID+"/open", "")
+	assert.Equal(t, 200, res.StatusCode)
+	data := result["data"].(map[string]interface{})
+	assert.Equal(t, consts.OfficeURL, data["type"])
+	assert.Equal(t, fileID, data["id"])
+	attrs := data["attributes"].(map[string]interface{})
+	oo := attrs["onlyoffice"].(map[string]interface{})
+	assert.Equal(t, "https://documentserver.example/", oo["url"])
+	assert.Equal(t, "word", oo["documentType"])
+	document := oo["document"].(map[string]interface{})
+	assert.Equal(t, "docx", document["fileType"])
+	assert.Equal(t, "letter.docx", document["title"])
+	key, _ = document["key"].(string)
+	assert.True(t, strings.HasPrefix(key, fileID+"-"))
+	editor := oo["editorConfig"].(map[string]interface{})
+	assert.Equal(t, "edit", editor["mode"])
+	assert.Contains(t, editor["callbackUrl"], "/office/callback")
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(oo["token"].(string), claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	})
+	assert.NoError(t, err)
+	signed := claims["document"].(map[string]interface{})
+	assert.Equal(t, key, signed["key"])
+}
+
+func TestCallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Dear Bob"))
+	}))
+	defer server.Close()
+
+	claims := jwt.MapClaims{"key": key, "status": 2, "url": server.URL}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("invalid"))
+	assert.NoError(t, err)
+	res, _ := doRequest("POST", "/office/callback", `{"key": "`+key+`", "status": 2, "token": "`+signed+`"}`)
+	assert.Equal(t, 403, res.StatusCode)
+
+	signed, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	assert.NoError(t, err)
+	res, result := doRequest("POST", "/office/callback", `{"key": "`+key+`", "status": 2, "token": "`+signed+`"}`)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, float64(0), result["error"])
+
+	fs := testInstance.VFS()
+	doc, err := fs.FileByID(fileID)
+	assert.NoError(t, err)
+	f, err := fs.OpenFile(doc)
+	assert.NoError(t, err)
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "Dear Bob", string(content))
+}
+
+func TestCallbackForbiddenAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Dear Alice"))
+	}))
+	defer server.Close()
+
+	claims := jwt.MapClaims{"key": key, "status": 2, "url": server.URL}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	assert.NoError(t, err)
+
+	// The private addresses are allowed only for the development releases
+	previousMode := config.BuildMode
+	config.BuildMode = config.ModeProd
+	defer func() { config.BuildMode = previousMode }()
+	res, _ := doRequest("POST", "/office/callback", `{"key": "`+key+`", "status": 2, "token": "`+signed+`"}`)
+	assert.Equal(t, 502, res.StatusCode)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	config.GetConfig().Contexts = map[string]interface{}{
+		"default": map[string]interface{}{
+			"office": map[string]interface{}{
+				"url":    "https://documentserver.example/",
+				"secret": secret,
+			},
+		},
+	}
+	setup := testutils.NewSetup(m, "office_test")
+	testInstance = setup.GetTestInstance()
+	_, token = setup.GetTestClient(consts.Files)
+	ts = setup.GetTestServer("/office", Routes)
+	os.Exit(setup.Run())
+}
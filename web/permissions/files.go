@@ -0,0 +1,130 @@
+package permissions
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/sharing"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+type apiFileACL struct {
+	*permissions.FileACL
+}
+
+func (a *apiFileACL) MarshalJSON() ([]byte, error) { return json.Marshal(a.FileACL) }
+func (a *apiFileACL) Included() []jsonapi.Object   { return nil }
+func (a *apiFileACL) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/permissions/files/" + a.ID()}
+}
+func (a *apiFileACL) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"file": jsonapi.Relationship{
+			Data: couchdb.DocReference{ID: a.FileID, Type: consts.Files},
+		},
+	}
+}
+
+// createFileACL handles POST requests on /permissions/files to grant an
+// access on a file or a directory to an OAuth client, or to a member of a
+// sharing.
+func createFileACL(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.Files); err != nil {
+		return err
+	}
+
+	var acl permissions.FileACL
+	if _, err := jsonapi.Bind(c.Request().Body, &acl); err != nil {
+		return err
+	}
+	if _, _, err := inst.VFS().DirOrFileByID(acl.FileID); err != nil {
+		return jsonapi.InvalidAttribute("file_id", err)
+	}
+	if acl.SharingID != "" {
+		clientID, err := memberClientID(inst, acl.SharingID, acl.MemberIndex)
+		if err != nil {
+			return err
+		}
+		acl.ClientID = clientID
+	} else if _, err := oauth.FindClient(inst, acl.ClientID); err != nil {
+		return jsonapi.InvalidAttribute("client_id", err)
+	}
+	if err := permissions.CreateFileACL(inst, &acl); err != nil {
+		return err
+	}
+	audit.Record(inst, audit.ActionFileACLGranted, c.Request(), map[string]interface{}{
+		"acl_id":    acl.ID(),
+		"file_id":   acl.FileID,
+		"client_id": acl.ClientID,
+		"access":    acl.Access,
+	})
+	return jsonapi.Data(c, http.StatusCreated, &apiFileACL{&acl}, nil)
+}
+
+// memberClientID returns the identifier of the OAuth client used by a member
+// of a sharing for its requests.
+func memberClientID(inst *instance.Instance, sharingID string, index int) (string, error) {
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		return "", jsonapi.InvalidAttribute("sharing_id", err)
+	}
+	if !s.Owner || index < 1 || index >= len(s.Members) || index > len(s.Credentials) {
+		return "", jsonapi.InvalidAttribute("member_index", sharing.ErrMemberNotFound)
+	}
+	clientID := s.Credentials[index-1].InboundClientID
+	if clientID == "" {
+		// The member has not yet accepted the sharing
+		return "", jsonapi.InvalidAttribute("member_index", sharing.ErrMemberNotFound)
+	}
+	return clientID, nil
+}
+
+// listFileACLs handles GET requests on /permissions/files/:file-id to list
+// the ACLs on a file or a directory.
+func listFileACLs(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Files); err != nil {
+		return err
+	}
+	acls, err := permissions.GetFileACLsOnFile(inst, c.Param("file-id"))
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, len(acls))
+	for i, acl := range acls {
+		objs[i] = &apiFileACL{acl}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// deleteFileACL handles DELETE requests on /permissions/files/:acl-id to
+// revoke an access.
+func deleteFileACL(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.DELETE, consts.Files); err != nil {
+		return err
+	}
+	acl, err := permissions.GetFileACL(inst, c.Param("acl-id"))
+	if err != nil {
+		return err
+	}
+	if err = couchdb.DeleteDoc(inst, acl); err != nil {
+		return err
+	}
+	audit.Record(inst, audit.ActionFileACLRevoked, c.Request(), map[string]interface{}{
+		"acl_id":    acl.ID(),
+		"file_id":   acl.FileID,
+		"client_id": acl.ClientID,
+		"access":    acl.Access,
+	})
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,93 @@
+package permissions
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+	"github.com/justincampbell/bigduration"
+)
+
+// defaultGuestTTL is the validity of a guest token when no ttl is given
+const defaultGuestTTL = 24 * time.Hour
+
+type guestDocument struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type guestAttrs struct {
+	Name      string              `json:"name"`
+	Documents []guestDocument     `json:"documents"`
+	Verbs     permissions.VerbSet `json:"verbs"`
+	TTL       string              `json:"ttl"`
+}
+
+// createGuestToken handles POST requests on /permissions/guests to mint a
+// guest token, restricted to a list of documents and verbs, with an
+// expiration date.
+func createGuestToken(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	parent, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	var attrs guestAttrs
+	if _, err = jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return err
+	}
+	if attrs.Name == "" {
+		attrs.Name = "guest"
+	}
+	ttl := defaultGuestTTL
+	if attrs.TTL != "" {
+		if ttl, err = bigduration.ParseDuration(attrs.TTL); err != nil {
+			return jsonapi.InvalidAttribute("ttl", err)
+		}
+	}
+
+	// The documents are grouped by doctype, with a rule for each doctype
+	var set permissions.Set
+	byType := make(map[string]int)
+	for _, doc := range attrs.Documents {
+		if doc.Type == "" || doc.ID == "" {
+			return jsonapi.InvalidAttribute("documents", permissions.ErrGuestNotExplicit)
+		}
+		if i, ok := byType[doc.Type]; ok {
+			set[i].Values = append(set[i].Values, doc.ID)
+			continue
+		}
+		byType[doc.Type] = len(set)
+		set = append(set, permissions.Rule{
+			Type:   doc.Type,
+			Verbs:  attrs.Verbs,
+			Values: []string{doc.ID},
+		})
+	}
+
+	code, err := inst.CreateShareCode(attrs.Name)
+	if err != nil {
+		return err
+	}
+	codes := map[string]string{attrs.Name: code}
+	expiresAt := time.Now().Add(ttl)
+	pdoc, err := permissions.CreateGuestSet(inst, parent, codes, set, expiresAt)
+	if err != nil {
+		return err
+	}
+	audit.Record(inst, audit.ActionGuestTokenCreated, c.Request(), map[string]interface{}{
+		"permission_id": pdoc.ID(),
+		"source_id":     pdoc.SourceID,
+		"name":          attrs.Name,
+		"documents":     attrs.Documents,
+		"verbs":         attrs.Verbs,
+		"expires_at":    expiresAt,
+	})
+
+	return jsonapi.Data(c, http.StatusCreated, &APIPermission{pdoc}, nil)
+}
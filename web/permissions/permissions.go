@@ -2,11 +2,11 @@ package permissions
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
@@ -126,6 +126,12 @@ func createPermission(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	audit.Record(instance, audit.ActionPermissionGranted, c.Request(), map[string]interface{}{
+		"permission_id": pdoc.ID(),
+		"source_id":     pdoc.SourceID,
+		"codes":         c.QueryParam("codes"),
+		"expires_at":    expiresAt,
+	})
 
 	return jsonapi.Data(c, http.StatusOK, &APIPermission{pdoc}, nil)
 }
@@ -135,7 +141,7 @@ const (
 	maxPermissionsByDoctype     = 100
 )
 
-func listPermissionsByDoctype(c echo.Context, route, permType string) error {
+func listPermissionsByDoctype(c echo.Context, permType string) error {
 	ins := middlewares.GetInstance(c)
 	doctype := c.Param("doctype")
 	if doctype == "" {
@@ -162,14 +168,9 @@ func listPermissionsByDoctype(c echo.Context, route, permType string) error {
 		return err
 	}
 
-	links := &jsonapi.LinksList{}
-	if cursor.HasMore() {
-		params, err := jsonapi.PaginationCursorToParams(cursor)
-		if err != nil {
-			return err
-		}
-		links.Next = fmt.Sprintf("/permissions/doctype/%s/%s?%s",
-			doctype, route, params.Encode())
+	links, err := jsonapi.PaginationLinks(c, cursor)
+	if err != nil {
+		return err
 	}
 
 	out := make([]jsonapi.Object, len(perms))
@@ -181,7 +182,7 @@ func listPermissionsByDoctype(c echo.Context, route, permType string) error {
 }
 
 func listByLinkPermissionsByDoctype(c echo.Context) error {
-	return listPermissionsByDoctype(c, "shared-by-link", permissions.TypeShareByLink)
+	return listPermissionsByDoctype(c, permissions.TypeShareByLink)
 }
 
 type refAndVerb struct {
@@ -303,6 +304,12 @@ func revokePermission(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	if toRevoke.Type == permissions.TypeShareGuest {
+		audit.Record(instance, audit.ActionGuestTokenRevoked, c.Request(), map[string]interface{}{
+			"permission_id": toRevoke.ID(),
+			"source_id":     toRevoke.SourceID,
+		})
+	}
 
 	return c.NoContent(http.StatusNoContent)
 }
@@ -321,6 +328,12 @@ func Routes(router *echo.Group) {
 
 	router.GET("/doctype/:doctype/shared-by-link", listByLinkPermissionsByDoctype)
 
+	router.POST("/files", createFileACL)
+	router.GET("/files/:file-id", listFileACLs)
+	router.DELETE("/files/:acl-id", deleteFileACL)
+
+	router.POST("/guests", createGuestToken)
+
 	// Legacy routes, kept here for compatibility reasons
 	router.GET("/doctype/:doctype/sharedByLink", listByLinkPermissionsByDoctype)
 }
@@ -11,12 +11,15 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/stretchr/testify/assert"
@@ -28,6 +31,110 @@ var token string
 var testInstance *instance.Instance
 var clientVal *oauth.Client
 var clientID string
+var adminToken string
+
+func TestFileACLs(t *testing.T) {
+	fs := testInstance.VFS()
+	dir, err := vfs.MkdirAll(fs, "/acl-dir/sub")
+	if !assert.NoError(t, err) {
+		return
+	}
+	parent, err := dir.Parent(fs)
+	if !assert.NoError(t, err) {
+		return
+	}
+	body := fmt.Sprintf(`{"data": {"type": "io.cozy.files.acls", "attributes": {
+		"file_id": "%s", "client_id": "%s", "access": "read"
+	}}}`, parent.ID(), clientID)
+
+	// Only a client with the whole io.cozy.files doctype can grant accesses
+	_, err = doRequest(http.MethodPost, ts.URL+"/permissions/files", token, body)
+	assert.Error(t, err)
+
+	out, err := doRequest(http.MethodPost, ts.URL+"/permissions/files", adminToken, body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := out["data"].(map[string]interface{})
+	aclID := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "read", attrs["access"])
+	assert.Equal(t, clientID, attrs["client_id"])
+
+	out, err = doRequest(http.MethodGet, ts.URL+"/permissions/files/"+parent.ID(), adminToken, "")
+	if assert.NoError(t, err) {
+		assert.Len(t, out["data"], 1)
+	}
+
+	// The access is granted on the sub-tree of the directory
+	acls, err := permissions.GetFileACLsForClient(testInstance, clientID)
+	if assert.NoError(t, err) && assert.Len(t, acls, 1) {
+		set := permissions.FileACLsSet(acls)
+		assert.NoError(t, vfs.Allows(fs, set, permissions.GET, dir))
+		assert.Error(t, vfs.Allows(fs, set, permissions.PUT, dir))
+	}
+
+	_, err = doRequest(http.MethodDelete, ts.URL+"/permissions/files/"+aclID, adminToken, "")
+	assert.NoError(t, err)
+	acls, err = permissions.GetFileACLsForClient(testInstance, clientID)
+	assert.NoError(t, err)
+	assert.Len(t, acls, 0)
+
+	// The grant and the revocation are in the audit log
+	entries, err := audit.List(testInstance, couchdb.NewSkipCursor(2, 0))
+	if assert.NoError(t, err) && assert.Len(t, entries, 2) {
+		assert.Equal(t, audit.ActionFileACLRevoked, entries[0].Action)
+		assert.Equal(t, audit.ActionFileACLGranted, entries[1].Action)
+		for _, entry := range entries {
+			assert.Equal(t, aclID, entry.Details["acl_id"])
+			assert.Equal(t, parent.ID(), entry.Details["file_id"])
+			assert.Equal(t, clientID, entry.Details["client_id"])
+		}
+	}
+}
+
+func TestGuestToken(t *testing.T) {
+	body := `{"data": {"type": "io.cozy.permissions", "attributes": {
+		"name": "support",
+		"documents": [{"type": "io.cozy.files", "id": "guest-file"}],
+		"verbs": ["GET"],
+		"ttl": "2h"
+	}}}`
+	out, err := doRequest(http.MethodPost, ts.URL+"/permissions/guests", token, body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := out["data"].(map[string]interface{})
+	id := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "share-guest", attrs["type"])
+	assert.NotEmpty(t, attrs["expires_at"])
+	code := attrs["codes"].(map[string]interface{})["support"].(string)
+
+	out, err = doRequest(http.MethodGet, ts.URL+"/permissions/self", code, "")
+	if assert.NoError(t, err) {
+		attrs = out["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+		perms := attrs["permissions"].(map[string]interface{})
+		assert.Len(t, perms, 1)
+		for _, rule := range perms {
+			values := rule.(map[string]interface{})["values"].([]interface{})
+			assert.Equal(t, []interface{}{"guest-file"}, values)
+		}
+	}
+
+	// The verbs must be explicit, and the token must expire soon enough
+	_, err = doRequest(http.MethodPost, ts.URL+"/permissions/guests", token,
+		strings.Replace(body, `["GET"]`, `["ALL"]`, 1))
+	assert.Error(t, err)
+	_, err = doRequest(http.MethodPost, ts.URL+"/permissions/guests", token,
+		strings.Replace(body, `"2h"`, `"60D"`, 1))
+	assert.Error(t, err)
+
+	_, err = doRequest(http.MethodDelete, ts.URL+"/permissions/"+id, token, "")
+	assert.NoError(t, err)
+	_, err = doRequest(http.MethodGet, ts.URL+"/permissions/self", code, "")
+	assert.Error(t, err)
+}
 
 func TestMain(m *testing.M) {
 	config.UseTestFile()
@@ -40,6 +147,7 @@ func TestMain(m *testing.M) {
 	clientVal = client
 	clientID = client.ClientID
 	token = tok
+	_, adminToken = testSetup.GetTestClient(consts.Files)
 
 	ts = testSetup.GetTestServer("/permissions", Routes)
 
@@ -0,0 +1,406 @@
+// Package photos gives the routes to manage the albums of photos, to share
+// them by link or with other cozy instances, and to accept or dismiss the
+// moments suggested by the clustering of the photos.
+package photos
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/contacts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/photos"
+	"github.com/cozy/cozy-stack/pkg/sharing"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/workers/thumbnail"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	webpermissions "github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+	"github.com/justincampbell/bigduration"
+)
+
+type apiAlbum struct {
+	*photos.Album
+}
+
+func (a *apiAlbum) MarshalJSON() ([]byte, error) { return json.Marshal(a.Album) }
+func (a *apiAlbum) Included() []jsonapi.Object   { return nil }
+func (a *apiAlbum) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/photos/albums/" + a.DocID}
+}
+func (a *apiAlbum) Relationships() jsonapi.RelationshipMap {
+	if a.CoverID == "" {
+		return nil
+	}
+	return jsonapi.RelationshipMap{
+		"cover": jsonapi.Relationship{
+			Links: &jsonapi.LinksList{Related: "/photos/albums/" + a.DocID + "/cover"},
+			Data:  couchdb.DocReference{ID: a.CoverID, Type: consts.Files},
+		},
+	}
+}
+
+type apiMoment struct {
+	*photos.Moment
+}
+
+func (m *apiMoment) MarshalJSON() ([]byte, error) { return json.Marshal(m.Moment) }
+func (m *apiMoment) Included() []jsonapi.Object   { return nil }
+func (m *apiMoment) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/photos/moments/" + m.DocID}
+}
+func (m *apiMoment) Relationships() jsonapi.RelationshipMap {
+	ids := m.PhotoIDs()
+	data := make([]couchdb.DocReference, len(ids))
+	for i, id := range ids {
+		data[i] = couchdb.DocReference{ID: id, Type: consts.Files}
+	}
+	return jsonapi.RelationshipMap{
+		"photos": jsonapi.Relationship{Data: data},
+	}
+}
+
+func wrapError(err error) error {
+	switch err {
+	case photos.ErrMissingName:
+		return jsonapi.InvalidAttribute("name", err)
+	case photos.ErrNotAPhoto:
+		return jsonapi.BadRequest(err)
+	case photos.ErrNoCover:
+		return jsonapi.NotFound(err)
+	case photos.ErrMomentNotSuggested:
+		return jsonapi.Conflict(err)
+	case contacts.ErrNoMailAddress:
+		return jsonapi.InvalidAttribute("recipients", err)
+	case sharing.ErrNoRecipients, sharing.ErrMailNotSent:
+		return jsonapi.BadRequest(err)
+	case os.ErrNotExist:
+		return jsonapi.NotFound(err)
+	}
+	if couchdb.IsNotFoundError(err) {
+		return jsonapi.NotFound(err)
+	}
+	return err
+}
+
+// findAlbum loads the album of the request, after checking the permissions
+// of the requester for the given verb.
+func findAlbum(c echo.Context, v permissions.Verb) (*photos.Album, error) {
+	id := c.Param("album-id")
+	if err := middlewares.AllowTypeAndID(c, v, consts.PhotosAlbums, id); err != nil {
+		return nil, err
+	}
+	album, err := photos.Find(middlewares.GetInstance(c), id)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return album, nil
+}
+
+func createAlbum(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.PhotosAlbums); err != nil {
+		return err
+	}
+	var attrs struct {
+		Name string `json:"name"`
+	}
+	if _, err := jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	album, err := photos.Create(inst, attrs.Name)
+	if err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiAlbum{album}, nil)
+}
+
+func getAlbum(c echo.Context) error {
+	album, err := findAlbum(c, permissions.GET)
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiAlbum{album}, nil)
+}
+
+func deleteAlbum(c echo.Context) error {
+	album, err := findAlbum(c, permissions.DELETE)
+	if err != nil {
+		return err
+	}
+	if err = album.Delete(middlewares.GetInstance(c)); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func bindFileIDs(c echo.Context) ([]string, error) {
+	refs, err := jsonapi.BindRelations(c.Request())
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(refs))
+	for i, ref := range refs {
+		ids[i] = ref.ID
+	}
+	return ids, nil
+}
+
+func addPhotos(c echo.Context) error {
+	album, err := findAlbum(c, permissions.PUT)
+	if err != nil {
+		return err
+	}
+	ids, err := bindFileIDs(c)
+	if err != nil {
+		return err
+	}
+	if err = album.AddPhotos(middlewares.GetInstance(c), ids); err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiAlbum{album}, nil)
+}
+
+func removePhotos(c echo.Context) error {
+	album, err := findAlbum(c, permissions.PUT)
+	if err != nil {
+		return err
+	}
+	ids, err := bindFileIDs(c)
+	if err != nil {
+		return err
+	}
+	if err = album.RemovePhotos(middlewares.GetInstance(c), ids); err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiAlbum{album}, nil)
+}
+
+// getCover sends the thumbnail of the photo used as the cover of the album
+func getCover(c echo.Context) error {
+	album, err := findAlbum(c, permissions.GET)
+	if err != nil {
+		return err
+	}
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "medium"
+	}
+	if !utils.IsInArray(format, thumbnail.FormatsNames) {
+		return jsonapi.InvalidParameter("format", errors.New("Format does not exist"))
+	}
+	inst := middlewares.GetInstance(c)
+	cover, err := album.Cover(inst)
+	if err != nil {
+		return wrapError(err)
+	}
+	err = inst.ThumbsFS().ServeThumbContent(c.Response(), c.Request(), cover, format)
+	if err != nil {
+		return jsonapi.NotFound(err)
+	}
+	return nil
+}
+
+// shareByLink creates the codes for sharing the album by a link, as
+// POST /permissions does, but with the permissions of the album.
+func shareByLink(c echo.Context) error {
+	album, err := findAlbum(c, permissions.GET)
+	if err != nil {
+		return err
+	}
+	inst := middlewares.GetInstance(c)
+	parent, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	param := c.QueryParam("codes")
+	if param == "" {
+		return jsonapi.InvalidParameter("codes", errors.New("Missing codes"))
+	}
+	names := strings.Split(param, ",")
+	codes := make(map[string]string, len(names))
+	shortcodes := make(map[string]string, len(names))
+	for _, name := range names {
+		longcode, err := inst.CreateShareCode(name)
+		if err != nil {
+			return err
+		}
+		codes[name] = longcode
+		shortcodes[name] = crypto.GenerateRandomString(consts.ShortCodeLen)
+	}
+
+	var expiresAt *time.Time
+	if ttl := c.QueryParam("ttl"); ttl != "" {
+		if d, err := bigduration.ParseDuration(ttl); err == nil {
+			ex := time.Now().Add(d)
+			expiresAt = &ex
+		}
+	}
+
+	pdoc, err := permissions.CreateShareSet(inst, parent, codes, shortcodes, album.LinkPermissions(), expiresAt)
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, &webpermissions.APIPermission{Permission: pdoc}, nil)
+}
+
+// shareWithRecipients creates a sharing of the album with the contacts given
+// in the recipients and read_only_recipients relationships, as
+// POST /sharings/ does.
+func shareWithRecipients(c echo.Context) error {
+	album, err := findAlbum(c, permissions.GET)
+	if err != nil {
+		return err
+	}
+	inst := middlewares.GetInstance(c)
+
+	requestPerm, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+	if requestPerm.Type != permissions.TypeWebapp && requestPerm.Type != permissions.TypeOauth {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	slug := ""
+	if requestPerm.Type == permissions.TypeWebapp {
+		slug = strings.TrimPrefix(requestPerm.SourceID, consts.Apps+"/")
+	}
+
+	s, err := album.NewSharing(inst, slug)
+	if err != nil {
+		return err
+	}
+	for _, rule := range s.Rules {
+		pr := permissions.Rule{
+			Title:    rule.Title,
+			Type:     rule.DocType,
+			Verbs:    permissions.ALL,
+			Selector: rule.Selector,
+			Values:   rule.Values,
+		}
+		if !requestPerm.Permissions.RuleInSubset(pr) {
+			return echo.NewHTTPError(http.StatusForbidden)
+		}
+	}
+
+	var attrs struct{}
+	obj, err := jsonapi.Bind(c.Request().Body, &attrs)
+	if err != nil {
+		return jsonapi.BadJSON()
+	}
+	for _, name := range []string{"recipients", "read_only_recipients"} {
+		rel, ok := obj.GetRelationship(name)
+		if !ok {
+			continue
+		}
+		data, ok := rel.Data.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, ref := range data {
+			if id, ok := ref.(map[string]interface{})["id"].(string); ok {
+				if err = s.AddContact(inst, id, name == "read_only_recipients"); err != nil {
+					return wrapError(err)
+				}
+			}
+		}
+	}
+
+	codes, err := s.Create(inst)
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = s.SendMails(inst, codes); err != nil {
+		return wrapError(err)
+	}
+	as := &sharing.APISharing{Sharing: s}
+	return jsonapi.Data(c, http.StatusCreated, as, nil)
+}
+
+// listMoments returns the moments suggested by the clustering of the photos
+func listMoments(c echo.Context) error {
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.PhotosMoments); err != nil {
+		return err
+	}
+	moments, err := photos.GetSuggestedMoments(middlewares.GetInstance(c))
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, len(moments))
+	for i, m := range moments {
+		objs[i] = &apiMoment{m}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func findMoment(c echo.Context) (*photos.Moment, error) {
+	id := c.Param("moment-id")
+	if err := middlewares.AllowTypeAndID(c, permissions.PUT, consts.PhotosMoments, id); err != nil {
+		return nil, err
+	}
+	moment, err := photos.FindMoment(middlewares.GetInstance(c), id)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return moment, nil
+}
+
+// acceptMoment transforms a suggested moment in an album
+func acceptMoment(c echo.Context) error {
+	moment, err := findMoment(c)
+	if err != nil {
+		return err
+	}
+	if err = middlewares.AllowWholeType(c, permissions.POST, consts.PhotosAlbums); err != nil {
+		return err
+	}
+	var attrs struct {
+		Name string `json:"name"`
+	}
+	if c.Request().ContentLength != 0 {
+		if _, err = jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+			return jsonapi.BadJSON()
+		}
+	}
+	album, err := moment.Accept(middlewares.GetInstance(c), attrs.Name)
+	if err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiAlbum{album}, nil)
+}
+
+func dismissMoment(c echo.Context) error {
+	moment, err := findMoment(c)
+	if err != nil {
+		return err
+	}
+	if err = moment.Dismiss(middlewares.GetInstance(c)); err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiMoment{moment}, nil)
+}
+
+// Routes sets the routing for the photos service
+func Routes(router *echo.Group) {
+	router.POST("/albums", createAlbum)
+	router.GET("/albums/:album-id", getAlbum)
+	router.DELETE("/albums/:album-id", deleteAlbum)
+	router.POST("/albums/:album-id/relationships/photos", addPhotos)
+	router.DELETE("/albums/:album-id/relationships/photos", removePhotos)
+	router.GET("/albums/:album-id/cover", getCover)
+	router.POST("/albums/:album-id/link", shareByLink)
+	router.POST("/albums/:album-id/sharings", shareWithRecipients)
+
+	router.GET("/moments", listMoments)
+	router.POST("/moments/:moment-id/accept", acceptMoment)
+	router.POST("/moments/:moment-id/dismiss", dismissMoment)
+}
@@ -0,0 +1,216 @@
+package photos
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	pkgphotos "github.com/cozy/cozy-stack/pkg/photos"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token string
+var albumID string
+
+func doRequest(method, path, body string) (*http.Response, map[string]interface{}) {
+	req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	var result map[string]interface{}
+	_ = json.NewDecoder(res.Body).Decode(&result)
+	return res, result
+}
+
+func createFile(t *testing.T, name, mime, class string) *vfs.FileDoc {
+	doc, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil, mime, class, time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	f, err := testInstance.VFS().CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, f.Close())
+	return doc
+}
+
+func photosBody(ids ...string) string {
+	refs := make([]string, len(ids))
+	for i, id := range ids {
+		refs[i] = `{"type": "io.cozy.files", "id": "` + id + `"}`
+	}
+	return `{"data": [` + strings.Join(refs, ",") + `]}`
+}
+
+func TestCreateAlbum(t *testing.T) {
+	res, _ := doRequest("POST", "/photos/albums", `{"data": {"type": "io.cozy.photos.albums", "attributes": {}}}`)
+	assert.Equal(t, 422, res.StatusCode)
+
+	res, result := doRequest("POST", "/photos/albums", `{"data": {"type": "io.cozy.photos.albums", "attributes": {"name": "Holidays"}}}`)
+	assert.Equal(t, 201, res.StatusCode)
+	data := result["data"].(map[string]interface{})
+	albumID = data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "Holidays", attrs["name"])
+	assert.NotEmpty(t, attrs["created_at"])
+}
+
+func TestAddAndRemovePhotos(t *testing.T) {
+	photo := createFile(t, "beach.jpg", "image/jpeg", "image")
+	text := createFile(t, "notes.txt", "text/plain", "text")
+
+	res, _ := doRequest("POST", "/photos/albums/"+albumID+"/relationships/photos", photosBody(text.ID()))
+	assert.Equal(t, 400, res.StatusCode)
+
+	res, result := doRequest("POST", "/photos/albums/"+albumID+"/relationships/photos", photosBody(photo.ID()))
+	assert.Equal(t, 200, res.StatusCode)
+	data := result["data"].(map[string]interface{})
+	rels := data["relationships"].(map[string]interface{})
+	cover := rels["cover"].(map[string]interface{})["data"].(map[string]interface{})
+	assert.Equal(t, photo.ID(), cover["id"])
+
+	file, err := testInstance.VFS().FileByID(photo.ID())
+	assert.NoError(t, err)
+	if assert.Len(t, file.ReferencedBy, 1) {
+		assert.Equal(t, albumID, file.ReferencedBy[0].ID)
+		assert.Equal(t, consts.PhotosAlbums, file.ReferencedBy[0].Type)
+	}
+
+	res, result = doRequest("DELETE", "/photos/albums/"+albumID+"/relationships/photos", photosBody(photo.ID()))
+	assert.Equal(t, 200, res.StatusCode)
+	data = result["data"].(map[string]interface{})
+	assert.Nil(t, data["relationships"])
+
+	res, _ = doRequest("GET", "/photos/albums/"+albumID+"/cover", "")
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestShareByLink(t *testing.T) {
+	res, _ := doRequest("POST", "/photos/albums/"+albumID+"/link", "")
+	assert.Equal(t, 422, res.StatusCode)
+
+	res, result := doRequest("POST", "/photos/albums/"+albumID+"/link?codes=bob", "")
+	assert.Equal(t, 200, res.StatusCode)
+	data := result["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	codes := attrs["codes"].(map[string]interface{})
+	assert.NotEmpty(t, codes["bob"])
+	perms := attrs["permissions"].(map[string]interface{})
+	assert.Len(t, perms, 2)
+}
+
+func TestShareWithoutRecipients(t *testing.T) {
+	res, _ := doRequest("POST", "/photos/albums/"+albumID+"/sharings", `{"data": {"type": "io.cozy.sharings", "attributes": {}}}`)
+	assert.Equal(t, 400, res.StatusCode)
+}
+
+func TestDeleteAlbum(t *testing.T) {
+	photo := createFile(t, "mountain.jpg", "image/jpeg", "image")
+	res, _ := doRequest("POST", "/photos/albums/"+albumID+"/relationships/photos", photosBody(photo.ID()))
+	assert.Equal(t, 200, res.StatusCode)
+
+	res, _ = doRequest("DELETE", "/photos/albums/"+albumID, "")
+	assert.Equal(t, 204, res.StatusCode)
+
+	file, err := testInstance.VFS().FileByID(photo.ID())
+	assert.NoError(t, err)
+	assert.Len(t, file.ReferencedBy, 0)
+
+	res, _ = doRequest("GET", "/photos/albums/"+albumID, "")
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func createMoment(t *testing.T, photos ...*vfs.FileDoc) *pkgphotos.Moment {
+	start := time.Date(2018, 7, 14, 10, 0, 0, 0, time.UTC)
+	m := &pkgphotos.Moment{
+		Status:    pkgphotos.MomentSuggested,
+		StartDate: start,
+		EndDate:   start.Add(time.Hour),
+		CreatedAt: time.Now(),
+	}
+	for _, photo := range photos {
+		m.Photos = append(m.Photos, pkgphotos.Point{ID: photo.ID(), Datetime: start})
+	}
+	if !assert.NoError(t, couchdb.CreateDoc(testInstance, m)) {
+		t.FailNow()
+	}
+	return m
+}
+
+func TestAcceptMoment(t *testing.T) {
+	photo := createFile(t, "fireworks.jpg", "image/jpeg", "image")
+	moment := createMoment(t, photo)
+
+	res, result := doRequest("GET", "/photos/moments", "")
+	assert.Equal(t, 200, res.StatusCode)
+	data := result["data"].([]interface{})
+	if assert.Len(t, data, 1) {
+		first := data[0].(map[string]interface{})
+		assert.Equal(t, moment.ID(), first["id"])
+		rels := first["relationships"].(map[string]interface{})
+		refs := rels["photos"].(map[string]interface{})["data"].([]interface{})
+		assert.Len(t, refs, 1)
+	}
+
+	res, result = doRequest("POST", "/photos/moments/"+moment.ID()+"/accept", "")
+	assert.Equal(t, 201, res.StatusCode)
+	album := result["data"].(map[string]interface{})
+	assert.Equal(t, consts.PhotosAlbums, album["type"])
+	attrs := album["attributes"].(map[string]interface{})
+	assert.Equal(t, "14 July 2018", attrs["name"])
+
+	file, err := testInstance.VFS().FileByID(photo.ID())
+	assert.NoError(t, err)
+	if assert.Len(t, file.ReferencedBy, 1) {
+		assert.Equal(t, album["id"], file.ReferencedBy[0].ID)
+	}
+
+	res, _ = doRequest("POST", "/photos/moments/"+moment.ID()+"/accept", "")
+	assert.Equal(t, 409, res.StatusCode)
+
+	res, result = doRequest("GET", "/photos/moments", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Len(t, result["data"], 0)
+}
+
+func TestDismissMoment(t *testing.T) {
+	photo := createFile(t, "party.jpg", "image/jpeg", "image")
+	moment := createMoment(t, photo)
+
+	res, result := doRequest("POST", "/photos/moments/"+moment.ID()+"/dismiss", "")
+	assert.Equal(t, 200, res.StatusCode)
+	data := result["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, pkgphotos.MomentDismissed, attrs["status"])
+
+	res, _ = doRequest("POST", "/photos/moments/"+moment.ID()+"/dismiss", "")
+	assert.Equal(t, 409, res.StatusCode)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "photos_test")
+	testInstance = setup.GetTestInstance()
+	scope := consts.PhotosAlbums + " " + consts.PhotosMoments + " " + consts.Files + " " + consts.Sharings
+	_, token = setup.GetTestClient(scope)
+	ts = setup.GetTestServer("/photos", Routes)
+	os.Exit(setup.Run())
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -32,6 +33,32 @@ const (
 	maxMessageSize = 1024
 )
 
+// closing is closed when the stack is stopped, to close the websockets, and
+// active is used to wait that they are closed.
+var (
+	closing     = make(chan struct{})
+	closingOnce sync.Once
+	active      sync.WaitGroup
+)
+
+// CloseAll closes the websockets with the "service restart" close code, that
+// tells the clients that they can reconnect (to another stack process), and
+// waits that they are closed.
+func CloseAll(ctx context.Context) error {
+	closingOnce.Do(func() { close(closing) })
+	done := make(chan struct{})
+	go func() {
+		active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 var upgrader = websocket.Upgrader{
 	// Don't check the origin of the connexion, we check authorization later
 	CheckOrigin:     func(r *http.Request) bool { return true },
@@ -203,6 +230,9 @@ func ws(c echo.Context) error {
 		db = inst
 	}
 
+	active.Add(1)
+	defer active.Done()
+
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		return err
@@ -261,6 +291,10 @@ func ws(c echo.Context) error {
 			if err := ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
 				return nil
 			}
+		case <-closing:
+			msg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "reconnect")
+			_ = ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+			return nil
 		}
 	}
 }
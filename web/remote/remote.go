@@ -1,6 +1,9 @@
 package remote
 
 import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/remote"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
@@ -21,6 +24,9 @@ func remoteGet(c echo.Context) error {
 	if remote.Verb != "GET" {
 		return jsonapi.MethodNotAllowed("GET")
 	}
+	if err = limits.CheckRateLimit(instance, limits.RemoteType); err != nil {
+		return wrapRemoteErr(err)
+	}
 	err = remote.ProxyTo(doctype, instance, c.Response(), c.Request())
 	if err != nil {
 		return wrapRemoteErr(err)
@@ -41,6 +47,9 @@ func remotePost(c echo.Context) error {
 	if remote.Verb != "POST" {
 		return jsonapi.MethodNotAllowed("POST")
 	}
+	if err = limits.CheckRateLimit(instance, limits.RemoteType); err != nil {
+		return wrapRemoteErr(err)
+	}
 	err = remote.ProxyTo(doctype, instance, c.Response(), c.Request())
 	if err != nil {
 		return wrapRemoteErr(err)
@@ -80,6 +89,10 @@ func wrapRemoteErr(err error) error {
 		return jsonapi.BadGateway(err)
 	case remote.ErrRemoteAssetNotFound:
 		return jsonapi.NotFound(err)
+	case remote.ErrReservedVariable:
+		return jsonapi.BadRequest(err)
+	case limits.ErrRateLimitReached:
+		return echo.NewHTTPError(http.StatusTooManyRequests, err)
 	}
 	return err
 }
@@ -0,0 +1,12 @@
+// +build windows
+
+package web
+
+import (
+	"errors"
+	"net"
+)
+
+func listenReusePort(addr string) (net.Listener, error) {
+	return nil, errors.New("SO_REUSEPORT is not supported on windows")
+}
@@ -3,6 +3,7 @@
 package web
 
 import (
+	"net/http"
 	"strconv"
 	"time"
 
@@ -11,8 +12,14 @@ import (
 	"github.com/cozy/cozy-stack/pkg/metrics"
 	"github.com/cozy/cozy-stack/web/apps"
 	"github.com/cozy/cozy-stack/web/auth"
+	"github.com/cozy/cozy-stack/web/bank"
+	"github.com/cozy/cozy-stack/web/bitwarden"
+	"github.com/cozy/cozy-stack/web/calendar"
+	"github.com/cozy/cozy-stack/web/comments"
 	"github.com/cozy/cozy-stack/web/compat"
+	"github.com/cozy/cozy-stack/web/contacts"
 	"github.com/cozy/cozy-stack/web/data"
+	"github.com/cozy/cozy-stack/web/dav"
 	"github.com/cozy/cozy-stack/web/errors"
 	"github.com/cozy/cozy-stack/web/files"
 	"github.com/cozy/cozy-stack/web/instances"
@@ -22,8 +29,11 @@ import (
 	"github.com/cozy/cozy-stack/web/konnectorsauth"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/cozy-stack/web/move"
+	"github.com/cozy/cozy-stack/web/notes"
 	"github.com/cozy/cozy-stack/web/notifications"
+	"github.com/cozy/cozy-stack/web/office"
 	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/cozy-stack/web/photos"
 	"github.com/cozy/cozy-stack/web/realtime"
 	"github.com/cozy/cozy-stack/web/registry"
 	"github.com/cozy/cozy-stack/web/remote"
@@ -105,11 +115,14 @@ func SetupAssets(router *echo.Echo, assetsPath string) (err error) {
 	router.GET("/favicon.ico", echo.WrapHandler(r), cacheControl)
 	router.GET("/robots.txt", echo.WrapHandler(r), cacheControl)
 	router.GET("/security.txt", echo.WrapHandler(r), cacheControl)
+	router.GET("/branding/:name", statik.Branding, middlewares.NeedInstance)
 	return nil
 }
 
 // SetupRoutes sets the routing for HTTP endpoints
 func SetupRoutes(router *echo.Echo) error {
+	router.Pre(dav.TunnelMethods)
+	router.Pre(middlewares.RequestID)
 	router.Use(timersMiddleware)
 
 	if !config.GetConfig().CSPDisabled {
@@ -135,6 +148,8 @@ func SetupRoutes(router *echo.Echo) error {
 				DefaultContentTypeOffer: echo.MIMETextHTML,
 			}),
 			middlewares.CheckIE,
+			middlewares.CheckMaintenance,
+			middlewares.CheckMoved,
 		}
 		router.GET("/", auth.Home, mws...)
 		auth.Routes(router.Group("/auth", mws...))
@@ -148,16 +163,27 @@ func SetupRoutes(router *echo.Echo) error {
 			middlewares.Accept(middlewares.AcceptOptions{
 				DefaultContentTypeOffer: jsonapi.ContentType,
 			}),
+			middlewares.CheckMaintenance,
+			middlewares.CheckMoved,
 		}
 		mws := append(mwsNotBlocked, middlewares.CheckInstanceBlocked)
 		registry.Routes(router.Group("/registry", mws...))
+		bank.Routes(router.Group("/bank", mws...))
+		bitwarden.Routes(router.Group("/bitwarden", mws...))
+		calendar.Routes(router.Group("/calendar", mws...))
+		comments.Routes(router.Group("/comments", mws...))
+		contacts.Routes(router.Group("/contacts", mws...))
 		data.Routes(router.Group("/data", mws...))
 		files.Routes(router.Group("/files", mws...))
 		intents.Routes(router.Group("/intents", mws...))
 		jobs.Routes(router.Group("/jobs", mws...))
+		notes.Routes(router.Group("/notes", mws...))
 		notifications.Routes(router.Group("/notifications", mws...))
+		office.Routes(router.Group("/office", mws...))
 		move.Routes(router.Group("/move", mws...))
+		move.ExportsRoutes(router.Group("/move", mwsNotBlocked...))
 		permissions.Routes(router.Group("/permissions", mws...))
+		photos.Routes(router.Group("/photos", mws...))
 		realtime.Routes(router.Group("/realtime", mws...))
 		remote.Routes(router.Group("/remote", mws...))
 		sharings.Routes(router.Group("/sharings", mws...))
@@ -172,6 +198,21 @@ func SetupRoutes(router *echo.Echo) error {
 		// applied to this group in web/routing since they should not be used for
 		// oauth redirection.
 		konnectorsauth.Routes(router.Group("/accounts"))
+
+		// The routes used by the target instance of a move to pull the data,
+		// authenticated with a move token: they are not redirected.
+		move.SourceRoutes(router.Group("/move/source", middlewares.NeedInstance))
+
+		// The routes used by the clients before their authentication, to know
+		// how to derive their keys.
+		bitwarden.PublicRoutes(router.Group("/public", middlewares.NeedInstance, middlewares.CheckMaintenance))
+	}
+
+	// DAV servers, authentified with the app passwords
+	{
+		router.Any("/.well-known/carddav", dav.WellKnown)
+		router.Any("/.well-known/caldav", dav.WellKnown)
+		dav.Routes(router.Group("/dav", middlewares.NeedInstance, middlewares.CheckMaintenance, middlewares.CheckInstanceBlocked))
 	}
 
 	// non-authentified JSON API routes
@@ -219,6 +260,7 @@ func SetupAdminRoutes(router *echo.Echo) error {
 	version.Routes(router.Group("/version", mws...))
 	metrics.Routes(router.Group("/metrics", mws...))
 	realtime.Routes(router.Group("/realtime", mws...))
+	router.POST("/config/reload", reloadConfig, mws...)
 
 	setupRecover(router)
 
@@ -226,6 +268,15 @@ func SetupAdminRoutes(router *echo.Echo) error {
 	return nil
 }
 
+// reloadConfig reloads the configuration file of the stack process that
+// receives the request, like the SIGHUP signal.
+func reloadConfig(c echo.Context) error {
+	if err := config.Reload(); err != nil {
+		return jsonapi.InternalServerError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
 // CreateSubdomainProxy returns a new web server that will handle that apps
 // proxy routing if the host of the request match an application, and route to
 // the given router otherwise.
@@ -243,12 +294,14 @@ func CreateSubdomainProxy(router *echo.Echo, appsHandler echo.HandlerFunc) (*ech
 	main := echo.New()
 	main.HideBanner = true
 	main.HidePort = true
+	main.Pre(dav.TunnelMethods)
+	main.Pre(middlewares.RequestID)
+	main.Use(middlewares.Tracing)
 	main.Renderer = router.Renderer
 	main.Any("/*", func(c echo.Context) error {
-		// TODO(optim): minimize the number of instance requests
 		if parent, slug, _ := middlewares.SplitHost(c.Request().Host); slug != "" {
 			if i, err := instance.Get(parent); err == nil {
-				c.Set("instance", i.WithContextualDomain(parent))
+				c.Set("instance", i.WithContextualDomain(parent).WithContext(c.Request().Context()))
 				c.Set("slug", slug)
 				return appsHandler(c)
 			}
@@ -1,11 +1,15 @@
 package web
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"testing"
+	"time"
 
+	"github.com/cozy/cozy-stack/client/tlsclient"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/cozy/cozy-stack/web/middlewares"
@@ -106,6 +110,44 @@ func TestSetupRoutes(t *testing.T) {
 	assert.Equal(t, 200, res.StatusCode)
 }
 
+func TestAdminUnixSocket(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cozy-stack")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tempdir)
+
+	socket := path.Join(tempdir, "admin.sock")
+	l, err := listenUnixSocket(socket)
+	if !assert.NoError(t, err) {
+		return
+	}
+	infos, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), infos.Mode().Perm())
+
+	admin := echo.New()
+	err = SetupAdminRoutes(admin)
+	if !assert.NoError(t, err) {
+		return
+	}
+	server := &http.Server{Handler: admin}
+	go server.Serve(l) // #nosec
+	defer server.Close()
+
+	client, u, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
+		Socket:  socket,
+		Timeout: 5 * time.Second,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := client.Get(u.String() + "/version")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+}
+
 func TestParseHost(t *testing.T) {
 	apis := echo.New()
 
@@ -5,8 +5,10 @@ package web
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -16,9 +18,11 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/i18n"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/sftpd"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	webapps "github.com/cozy/cozy-stack/web/apps"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/realtime"
 
 	"github.com/cozy/echo"
 	"github.com/cozy/echo/middleware"
@@ -175,10 +179,60 @@ func listenAndServe(appsHandler echo.HandlerFunc) (*Servers, error) {
 		return nil, err
 	}
 
-	return &Servers{
+	// With the socket activation, the first socket is used for the main
+	// server, and the second one (if any) for the administration.
+	listeners, err := activatedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		major.Listener = listeners[0]
+	} else if major.Listener, err = listenMajor(); err != nil {
+		return nil, err
+	}
+	if len(listeners) > 1 {
+		admin.Listener = listeners[1]
+	} else if socket := config.GetConfig().AdminSocket; socket != "" {
+		if admin.Listener, err = listenUnixSocket(socket); err != nil {
+			return nil, err
+		}
+	}
+
+	servers := &Servers{
 		major: major,
 		admin: admin,
-	}, nil
+	}
+
+	// With ACME, the main server speaks TLS with the certificates obtained
+	// for the instances, and a plain HTTP server answers to the HTTP-01
+	// challenges and redirects the other requests to HTTPS.
+	if config.GetConfig().ACME.Enabled {
+		m, err := newACMEManager()
+		if err != nil {
+			return nil, err
+		}
+		major.Listener = tls.NewListener(major.Listener, m.TLSConfig())
+		addr := config.GetConfig().ACME.HTTPAddr
+		if servers.acmeListener, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+		servers.acme = &http.Server{
+			Addr:              addr,
+			Handler:           m.HTTPHandler(nil),
+			ReadHeaderTimeout: ReadHeaderTimeout,
+		}
+	}
+
+	if opts := config.GetConfig().SFTP; opts.Enabled {
+		if servers.sftp, err = sftpd.NewServer(opts); err != nil {
+			return nil, err
+		}
+		if err = servers.sftp.Listen(); err != nil {
+			return nil, err
+		}
+	}
+
+	return servers, nil
 }
 
 // Servers contains the started HTTP servers and implement the Shutdowner
@@ -187,6 +241,11 @@ type Servers struct {
 	major *echo.Echo
 	admin *echo.Echo
 	errs  chan error
+
+	acme         *http.Server
+	acmeListener net.Listener
+
+	sftp *sftpd.Server
 }
 
 // Start starts the servers.
@@ -194,14 +253,55 @@ func (e *Servers) Start() {
 	e.errs = make(chan error)
 
 	go e.start(e.major, "major", &http.Server{
-		Addr:              config.ServerAddr(),
+		Addr:              e.major.Listener.Addr().String(),
 		ReadHeaderTimeout: ReadHeaderTimeout,
 	})
 
+	adminAddr := config.AdminServerAddr()
+	if e.admin.Listener != nil {
+		adminAddr = e.admin.Listener.Addr().String()
+	}
 	go e.start(e.admin, "admin", &http.Server{
-		Addr:              config.AdminServerAddr(),
+		Addr:              adminAddr,
 		ReadHeaderTimeout: ReadHeaderTimeout,
 	})
+
+	if e.acme != nil {
+		go func() {
+			fmt.Printf("  http server acme started on %q\n", e.acme.Addr)
+			e.errs <- e.acme.Serve(e.acmeListener)
+		}()
+	}
+
+	if e.sftp != nil {
+		go func() {
+			fmt.Printf("  sftp server started on %q\n", e.sftp.Addr())
+			e.errs <- e.sftp.Serve()
+		}()
+	}
+}
+
+// listenUnixSocket returns a listener on the unix socket at the given path,
+// that can only be used by the user of the stack. The socket is created with a
+// restrictive umask, so that there is no window where other users can connect
+// to it before the chmod.
+func listenUnixSocket(socket string) (net.Listener, error) {
+	// The socket can have been left by a stack that has not been stopped
+	// properly
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	restore := restrictUmask()
+	l, err := net.Listen("unix", socket)
+	restore()
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
 }
 
 func (e *Servers) start(s *echo.Echo, name string, server *http.Server) {
@@ -214,14 +314,29 @@ func (e *Servers) Wait() <-chan error {
 	return e.errs
 }
 
-// Shutdown gracefully stops the servers.
+// Shutdown gracefully stops the servers: they stop accepting new connections,
+// and wait for the requests in progress (like the uploads) to be finished.
+// Then, the websockets are closed, with a hint for the clients to reconnect.
 func (e *Servers) Shutdown(ctx context.Context) error {
-	g := utils.NewGroupShutdown(e.admin, e.major)
+	shutdowners := []utils.Shutdowner{e.admin, e.major}
+	if e.acme != nil {
+		shutdowners = append(shutdowners, e.acme)
+	}
+	if e.sftp != nil {
+		shutdowners = append(shutdowners, e.sftp)
+	}
+	g := utils.NewGroupShutdown(shutdowners...)
 	fmt.Print("  shutting down servers...")
 	if err := g.Shutdown(ctx); err != nil {
 		fmt.Println("failed: ", err.Error())
 		return err
 	}
 	fmt.Println("ok.")
+	fmt.Print("  closing websockets...")
+	if err := realtime.CloseAll(ctx); err != nil {
+		fmt.Println("failed: ", err.Error())
+		return err
+	}
+	fmt.Println("ok.")
 	return nil
 }
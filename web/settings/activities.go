@@ -0,0 +1,62 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/activity"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const (
+	defaultActivitiesPerPage = 20
+	maxActivitiesPerPage     = 100
+)
+
+type apiActivity struct{ *activity.Activity }
+
+func (a *apiActivity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Activity)
+}
+
+// Links is part of the jsonapi.Object interface
+func (a *apiActivity) Links() *jsonapi.LinksList { return nil }
+
+// Relationships is part of the jsonapi.Object interface
+func (a *apiActivity) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Included is part of the jsonapi.Object interface
+func (a *apiActivity) Included() []jsonapi.Object { return nil }
+
+// listActivities returns the activities of the feed, from the most recent to
+// the oldest.
+func listActivities(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Activities); err != nil {
+		return err
+	}
+
+	cursor, err := jsonapi.ExtractPaginationCursor(c, defaultActivitiesPerPage, maxActivitiesPerPage)
+	if err != nil {
+		return err
+	}
+	activities, err := activity.List(inst, cursor)
+	if err != nil {
+		return err
+	}
+	links, err := jsonapi.PaginationLinks(c, cursor)
+	if err != nil {
+		return err
+	}
+
+	objs := make([]jsonapi.Object, len(activities))
+	for i, a := range activities {
+		objs[i] = &apiActivity{a}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
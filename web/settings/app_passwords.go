@@ -0,0 +1,131 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	perms "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiAppPassword struct {
+	ap *oauth.AppPassword
+	// password is only sent in the response of the creation
+	password string
+}
+
+func (a *apiAppPassword) ID() string                             { return a.ap.ID() }
+func (a *apiAppPassword) Rev() string                            { return a.ap.Rev() }
+func (a *apiAppPassword) DocType() string                        { return consts.AppPasswords }
+func (a *apiAppPassword) Clone() couchdb.Doc                     { return a }
+func (a *apiAppPassword) SetID(_ string)                         {}
+func (a *apiAppPassword) SetRev(_ string)                        {}
+func (a *apiAppPassword) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiAppPassword) Included() []jsonapi.Object             { return nil }
+func (a *apiAppPassword) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/app_passwords/" + a.ap.ID()}
+}
+func (a *apiAppPassword) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Label      string     `json:"label"`
+		Scope      string     `json:"scope"`
+		Services   []string   `json:"services,omitempty"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+		Password   string     `json:"password,omitempty"`
+	}{
+		Label:      a.ap.Label,
+		Scope:      a.ap.Scope,
+		Services:   a.ap.Services,
+		CreatedAt:  a.ap.CreatedAt,
+		LastUsedAt: a.ap.LastUsedAt,
+		Password:   a.password,
+	})
+}
+
+func listAppPasswords(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.AppPasswords); err != nil {
+		return err
+	}
+
+	list, err := oauth.GetAppPasswords(inst)
+	if err != nil {
+		return err
+	}
+
+	objs := make([]jsonapi.Object, len(list))
+	for i, ap := range list {
+		objs[i] = &apiAppPassword{ap: ap}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// createAppPassword generates a password for a DAV or SFTP client, that can
+// be restricted to some services. The password is only shown once, in the
+// response.
+func createAppPassword(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.AppPasswords); err != nil {
+		return err
+	}
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	var attrs struct {
+		Label    string   `json:"label"`
+		Scope    string   `json:"scope"`
+		Services []string `json:"services"`
+	}
+	if _, err := jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if attrs.Label == "" {
+		return jsonapi.InvalidAttribute("label", oauth.ErrMissingAppPasswordLabel)
+	}
+	set, err := perms.UnmarshalScopeString(attrs.Scope)
+	if err != nil {
+		return jsonapi.InvalidAttribute("scope", err)
+	}
+	if !set.IsSubSetOf(pdoc.Permissions) {
+		return jsonapi.InvalidAttribute("scope", errors.New("The scope is not allowed"))
+	}
+
+	ap, password, err := oauth.CreateAppPassword(inst, attrs.Label, attrs.Scope, attrs.Services)
+	if err == oauth.ErrUnknownAppPasswordService {
+		return jsonapi.InvalidAttribute("services", err)
+	}
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiAppPassword{ap: ap, password: password}, nil)
+}
+
+func revokeAppPassword(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.DELETE, consts.AppPasswords); err != nil {
+		return err
+	}
+
+	ap, err := oauth.FindAppPassword(inst, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if err := ap.Delete(inst); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
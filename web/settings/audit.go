@@ -0,0 +1,62 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const (
+	defaultAuditLogsPerPage = 50
+	maxAuditLogsPerPage     = 500
+)
+
+type apiAuditEntry struct{ *audit.Entry }
+
+func (e *apiAuditEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.Entry)
+}
+
+// Links is part of the jsonapi.Object interface
+func (e *apiAuditEntry) Links() *jsonapi.LinksList { return nil }
+
+// Relationships is part of the jsonapi.Object interface
+func (e *apiAuditEntry) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Included is part of the jsonapi.Object interface
+func (e *apiAuditEntry) Included() []jsonapi.Object { return nil }
+
+// listAuditLogs returns the entries of the audit log, from the most recent to
+// the oldest.
+func listAuditLogs(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.AuditLogs); err != nil {
+		return err
+	}
+
+	cursor, err := jsonapi.ExtractPaginationCursor(c, defaultAuditLogsPerPage, maxAuditLogsPerPage)
+	if err != nil {
+		return err
+	}
+	entries, err := audit.List(inst, cursor)
+	if err != nil {
+		return err
+	}
+	links, err := jsonapi.PaginationLinks(c, cursor)
+	if err != nil {
+		return err
+	}
+
+	objs := make([]jsonapi.Object, len(entries))
+	for i, e := range entries {
+		objs[i] = &apiAuditEntry{e}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
@@ -0,0 +1,157 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/workers/backup"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// apiBackup is the configuration of the backups, without the secrets.
+type apiBackup struct{ conf *backup.Config }
+
+func (b *apiBackup) ID() string                             { return b.conf.ID() }
+func (b *apiBackup) Rev() string                            { return b.conf.Rev() }
+func (b *apiBackup) DocType() string                        { return consts.Backups }
+func (b *apiBackup) Clone() couchdb.Doc                     { return b }
+func (b *apiBackup) SetID(_ string)                         {}
+func (b *apiBackup) SetRev(_ string)                        {}
+func (b *apiBackup) Relationships() jsonapi.RelationshipMap { return nil }
+func (b *apiBackup) Included() []jsonapi.Object             { return nil }
+func (b *apiBackup) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/backup"}
+}
+func (b *apiBackup) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Endpoint         string     `json:"endpoint"`
+		Region           string     `json:"region"`
+		Bucket           string     `json:"bucket"`
+		Prefix           string     `json:"prefix"`
+		AccessKeyID      string     `json:"access_key_id"`
+		Frequency        string     `json:"frequency,omitempty"`
+		State            string     `json:"state,omitempty"`
+		Error            string     `json:"error,omitempty"`
+		FilesCount       int        `json:"files_count"`
+		TransferredCount int        `json:"transferred_count"`
+		TransferredBytes int64      `json:"transferred_bytes"`
+		LastBackupAt     *time.Time `json:"last_backup_at,omitempty"`
+		LastRestoreAt    *time.Time `json:"last_restore_at,omitempty"`
+		UpdatedAt        time.Time  `json:"updated_at"`
+	}{
+		Endpoint:         b.conf.Endpoint,
+		Region:           b.conf.Region,
+		Bucket:           b.conf.Bucket,
+		Prefix:           b.conf.Prefix,
+		AccessKeyID:      b.conf.AccessKeyID,
+		Frequency:        b.conf.Frequency,
+		State:            b.conf.State,
+		Error:            b.conf.Error,
+		FilesCount:       b.conf.FilesCount,
+		TransferredCount: b.conf.TransferredCount,
+		TransferredBytes: b.conf.TransferredBytes,
+		LastBackupAt:     b.conf.LastBackupAt,
+		LastRestoreAt:    b.conf.LastRestoreAt,
+		UpdatedAt:        b.conf.UpdatedAt,
+	})
+}
+
+func getBackup(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Backups); err != nil {
+		return err
+	}
+
+	conf, err := backup.GetConfig(inst)
+	if err != nil {
+		return wrapBackupError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiBackup{conf}, nil)
+}
+
+// configureBackup saves the bucket and the passphrase of the backups. The
+// access to the bucket is checked before saving them.
+func configureBackup(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.PUT, consts.Backups); err != nil {
+		return err
+	}
+
+	var params backup.Params
+	if _, err := jsonapi.Bind(c.Request().Body, &params); err != nil {
+		return jsonapi.BadJSON()
+	}
+	conf, err := backup.Configure(inst, &params)
+	if err != nil {
+		return wrapBackupError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiBackup{conf}, nil)
+}
+
+func removeBackup(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.DELETE, consts.Backups); err != nil {
+		return err
+	}
+
+	if err := backup.Remove(inst); err != nil {
+		return wrapBackupError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func runBackup(c echo.Context) error {
+	return pushBackupJob(c, false)
+}
+
+func restoreBackup(c echo.Context) error {
+	return pushBackupJob(c, true)
+}
+
+func pushBackupJob(c echo.Context, restore bool) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.Backups); err != nil {
+		return err
+	}
+
+	if _, err := backup.Run(inst, restore); err != nil {
+		return wrapBackupError(err)
+	}
+	conf, err := backup.GetConfig(inst)
+	if err != nil {
+		return wrapBackupError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, &apiBackup{conf}, nil)
+}
+
+func wrapBackupError(err error) error {
+	switch err {
+	case backup.ErrNotConfigured:
+		return jsonapi.NotFound(err)
+	case backup.ErrMissingParams:
+		return jsonapi.BadRequest(err)
+	case backup.ErrInvalidPrefix:
+		return jsonapi.InvalidAttribute("prefix", err)
+	case backup.ErrInvalidFrequency:
+		return jsonapi.InvalidAttribute("frequency", err)
+	case backup.ErrWrongPassphrase:
+		return jsonapi.InvalidAttribute("passphrase", err)
+	case backup.ErrAlreadyRunning:
+		return jsonapi.Conflict(err)
+	}
+	if _, ok := couchdb.IsCouchError(err); ok {
+		return err
+	}
+	// The other errors are from the S3 service
+	return jsonapi.BadGateway(err)
+}
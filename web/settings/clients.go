@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
@@ -75,6 +76,11 @@ func revokeClient(c echo.Context) error {
 	if err := client.Delete(instance); err != nil {
 		return errors.New(err.Error)
 	}
+	audit.Record(instance, audit.ActionOAuthClientRevoked, c.Request(), map[string]interface{}{
+		"client_id":   client.ClientID,
+		"client_name": client.ClientName,
+		"software_id": client.SoftwareID,
+	})
 	return c.NoContent(http.StatusNoContent)
 }
 
@@ -88,7 +94,8 @@ func synchronized(c echo.Context) error {
 
 	var claims perms.Claims
 	err := crypto.ParseJWT(tok, func(token *jwt.Token) (interface{}, error) {
-		return instance.PickKey(token.Claims.(*perms.Claims).Audience)
+		audience := token.Claims.(*perms.Claims).Audience
+		return instance.JWTKeyFunc(audience)(token)
 	}, &claims)
 	if err != nil {
 		return perms.ErrInvalidToken
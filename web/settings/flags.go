@@ -0,0 +1,37 @@
+package settings
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/feature"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+type apiFlags struct{ *feature.Flags }
+
+func (f *apiFlags) Rev() string                            { return "" }
+func (f *apiFlags) Clone() couchdb.Doc                     { return f }
+func (f *apiFlags) SetID(id string)                        {}
+func (f *apiFlags) SetRev(rev string)                      {}
+func (f *apiFlags) Relationships() jsonapi.RelationshipMap { return nil }
+func (f *apiFlags) Included() []jsonapi.Object             { return nil }
+func (f *apiFlags) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/flags"}
+}
+
+// flags sends the feature flags of the instance to the apps. A realtime
+// event is sent on the io.cozy.settings.flags document when they change.
+func flags(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	if _, err := middlewares.GetPermission(c); err != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	f, err := feature.GetFlags(i)
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiFlags{f}, nil)
+}
@@ -4,12 +4,18 @@ package settings
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/mail"
+	"strconv"
+	"unicode"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/i18n"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	webpermissions "github.com/cozy/cozy-stack/web/permissions"
@@ -35,6 +41,81 @@ func (i *apiInstance) MarshalJSON() ([]byte, error) {
 	return json.Marshal(i.doc)
 }
 
+// maxPublicNameLength is the maximal number of characters for the public name
+const maxPublicNameLength = 256
+
+// validateSettings checks the values of the fields that have a special
+// meaning for the stack. The other fields are left untouched.
+func validateSettings(doc *couchdb.JSONDoc) error {
+	if v, ok := doc.M["email"]; ok && v != nil {
+		email, ok := v.(string)
+		if !ok {
+			return jsonapi.InvalidAttribute("email", errors.New("The email must be a string"))
+		}
+		if email != "" {
+			addr, err := mail.ParseAddress(email)
+			if err != nil || addr.Address != email {
+				return jsonapi.InvalidAttribute("email", errors.New("The email is not valid"))
+			}
+		}
+	}
+	if v, ok := doc.M["public_name"]; ok && v != nil {
+		name, ok := v.(string)
+		if !ok {
+			return jsonapi.InvalidAttribute("public_name", errors.New("The public name must be a string"))
+		}
+		if len([]rune(name)) > maxPublicNameLength {
+			return jsonapi.InvalidAttribute("public_name", errors.New("The public name is too long"))
+		}
+		for _, r := range name {
+			if unicode.IsControl(r) {
+				return jsonapi.InvalidAttribute("public_name", errors.New("The public name contains invalid characters"))
+			}
+		}
+	}
+	if v, ok := doc.M["digest"]; ok && v != nil {
+		switch v {
+		case "", "daily", "weekly":
+		default:
+			return jsonapi.InvalidAttribute("digest", errors.New("The digest must be daily or weekly"))
+		}
+	}
+	if v, ok := doc.M["locale"]; ok {
+		locale, ok := v.(string)
+		if v != nil && !ok {
+			return jsonapi.InvalidAttribute("locale", errors.New("The locale must be a string"))
+		}
+		// A null or empty locale means that the locale is left unchanged
+		if locale == "" {
+			delete(doc.M, "locale")
+		} else {
+			supported := false
+			for _, l := range i18n.SupportedLocales {
+				if l == locale {
+					supported = true
+				}
+			}
+			if !supported {
+				return jsonapi.InvalidAttribute("locale", errors.New("The locale is not supported"))
+			}
+		}
+	}
+	if v, ok := doc.M["auto_update"]; ok {
+		// The instance options expect a string for auto_update
+		switch autoUpdate := v.(type) {
+		case bool:
+			doc.M["auto_update"] = strconv.FormatBool(autoUpdate)
+		case string:
+			if _, err := strconv.ParseBool(autoUpdate); err != nil {
+				return jsonapi.InvalidAttribute("auto_update", errors.New("The auto_update must be a boolean"))
+			}
+		default:
+			return jsonapi.InvalidAttribute("auto_update", errors.New("The auto_update must be a boolean"))
+		}
+	}
+	return nil
+}
+
 func getInstance(c echo.Context) error {
 	inst := middlewares.GetInstance(c)
 
@@ -45,6 +126,9 @@ func getInstance(c echo.Context) error {
 
 	doc.M["locale"] = inst.Locale
 	doc.M["onboarding_finished"] = inst.OnboardingFinished
+	if len(inst.OnboardingSteps) > 0 {
+		doc.M["onboarding_steps"] = inst.OnboardingSteps
+	}
 	doc.M["auto_update"] = !inst.NoAutoUpdate
 	doc.M["auth_mode"] = instance.AuthModeToString(inst.AuthMode)
 	doc.M["tos"] = inst.TOSSigned
@@ -85,12 +169,23 @@ func updateInstance(c echo.Context) error {
 		delete(doc.M, "context")
 	}
 
+	// The onboarding steps are updated by the installation jobs only
+	delete(doc.M, "onboarding_steps")
+
+	if err = validateSettings(doc); err != nil {
+		return err
+	}
+
+	locale, autoUpdate := inst.Locale, inst.NoAutoUpdate
 	if err := instance.Patch(inst, &instance.Options{SettingsObj: doc}); err != nil {
 		return err
 	}
 
 	doc.M["locale"] = inst.Locale
 	doc.M["onboarding_finished"] = inst.OnboardingFinished
+	if len(inst.OnboardingSteps) > 0 {
+		doc.M["onboarding_steps"] = inst.OnboardingSteps
+	}
 	doc.M["auto_update"] = !inst.NoAutoUpdate
 	doc.M["auth_mode"] = instance.AuthModeToString(inst.AuthMode)
 	doc.M["tos"] = inst.TOSSigned
@@ -98,6 +193,13 @@ func updateInstance(c echo.Context) error {
 	doc.M["uuid"] = inst.UUID
 	doc.M["context"] = inst.ContextName
 
+	// The locale and auto_update are saved in the instance document, in the
+	// global database: the change of the settings document is not enough for
+	// the apps to be notified of them.
+	if locale != inst.Locale || autoUpdate != inst.NoAutoUpdate {
+		realtime.GetHub().Publish(inst, realtime.EventUpdate, doc, nil)
+	}
+
 	return jsonapi.Data(c, http.StatusOK, &apiInstance{doc}, nil)
 }
 
@@ -0,0 +1,82 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	perms "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiPairingCode struct {
+	pc  *oauth.PairingCode
+	url string
+}
+
+func (p *apiPairingCode) ID() string                             { return p.pc.ID() }
+func (p *apiPairingCode) Rev() string                            { return p.pc.Rev() }
+func (p *apiPairingCode) DocType() string                        { return consts.OAuthPairingCodes }
+func (p *apiPairingCode) Clone() couchdb.Doc                     { return p }
+func (p *apiPairingCode) SetID(_ string)                         {}
+func (p *apiPairingCode) SetRev(_ string)                        {}
+func (p *apiPairingCode) Relationships() jsonapi.RelationshipMap { return nil }
+func (p *apiPairingCode) Included() []jsonapi.Object             { return nil }
+func (p *apiPairingCode) Links() *jsonapi.LinksList              { return nil }
+func (p *apiPairingCode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Code      string    `json:"code"`
+		Scope     string    `json:"scope"`
+		ExpiresAt time.Time `json:"expires_at"`
+		URL       string    `json:"url"`
+	}{
+		Code:      p.pc.Code,
+		Scope:     p.pc.Scope,
+		ExpiresAt: p.pc.ExpiresAt(),
+		URL:       p.url,
+	})
+}
+
+// createPairingCode is used by the settings app to show a QR code that can
+// be scanned by a mobile app to be paired with the cozy.
+func createPairingCode(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.OAuthClients); err != nil {
+		return err
+	}
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	var attrs struct {
+		Scope string `json:"scope"`
+	}
+	if _, err := jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	set, err := perms.UnmarshalScopeString(attrs.Scope)
+	if err != nil {
+		return jsonapi.InvalidAttribute("scope", err)
+	}
+	// The mobile app can't have more permissions than the app that has
+	// generated the QR code.
+	if !set.IsSubSetOf(pdoc.Permissions) {
+		return jsonapi.InvalidAttribute("scope", errors.New("The scope is not allowed"))
+	}
+
+	pc, err := oauth.CreatePairingCode(inst, attrs.Scope)
+	if err != nil {
+		return err
+	}
+	doc := &apiPairingCode{pc: pc, url: pc.URL(inst)}
+	return jsonapi.Data(c, http.StatusCreated, doc, nil)
+}
@@ -6,7 +6,10 @@ import (
 	"encoding/hex"
 	"net/http"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/bitwarden"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/errcode"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/web/auth"
@@ -34,7 +37,10 @@ func registerPassphrase(c echo.Context) error {
 
 	passphrase := []byte(args.Passphrase)
 	if err = instance.RegisterPassphrase(passphrase, registerToken); err != nil {
-		return jsonapi.BadRequest(err)
+		return passphraseError(err)
+	}
+	if err = bitwarden.ResetProfile(instance, passphrase); err != nil {
+		instance.Logger().Errorf("Could not initialize the vault: %s", err)
 	}
 
 	longRunSession := true
@@ -91,7 +97,11 @@ func updatePassphrase(c echo.Context) error {
 	err = inst.UpdatePassphrase(newPassphrase, currentPassphrase,
 		args.TwoFactorPasscode, args.TwoFactorToken)
 	if err != nil {
-		return jsonapi.BadRequest(err)
+		return passphraseError(err)
+	}
+	audit.Record(inst, audit.ActionPassphraseChanged, c.Request(), nil)
+	if err = bitwarden.ChangeMasterPassword(inst, newPassphrase, currentPassphrase); err != nil {
+		inst.Logger().Errorf("Could not update the vault: %s", err)
 	}
 
 	longRunSession := true
@@ -104,3 +114,13 @@ func updatePassphrase(c echo.Context) error {
 
 	return c.NoContent(http.StatusNoContent)
 }
+
+// passphraseError returns the JSON-API error for a passphrase that can't be
+// set: the errors of the password policy keep their status and code, so that
+// the client can explain to the user what is wrong.
+func passphraseError(err error) error {
+	if _, ok := err.(*errcode.Error); ok {
+		return jsonapi.FromError(err)
+	}
+	return jsonapi.BadRequest(err)
+}
@@ -0,0 +1,58 @@
+package settings
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+type apiQuota struct {
+	Limit     int64 `json:"limit"`
+	Remaining int64 `json:"remaining"`
+	// Reset is the number of seconds before the counter is reset
+	Reset int64 `json:"reset"`
+}
+
+type apiQuotas map[string]apiQuota
+
+func (q apiQuotas) ID() string                             { return consts.QuotasID }
+func (q apiQuotas) Rev() string                            { return "" }
+func (q apiQuotas) DocType() string                        { return consts.Settings }
+func (q apiQuotas) Clone() couchdb.Doc                     { return q }
+func (q apiQuotas) SetID(_ string)                         {}
+func (q apiQuotas) SetRev(_ string)                        {}
+func (q apiQuotas) Relationships() jsonapi.RelationshipMap { return nil }
+func (q apiQuotas) Included() []jsonapi.Object             { return nil }
+func (q apiQuotas) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/quotas"}
+}
+
+// getQuotas returns the remaining quotas of the rate limits for the token of
+// the request. No permission is needed, as an application can only see its
+// own quotas.
+func getQuotas(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if _, err := middlewares.GetPermission(c); err != nil {
+		return err
+	}
+
+	token := middlewares.RateLimitToken(c)
+	quotas := make(apiQuotas)
+	for _, ct := range limits.QuotaTypes {
+		quota, err := limits.GetQuota(inst, ct, token)
+		if err != nil {
+			return err
+		}
+		quotas[quota.Name] = apiQuota{
+			Limit:     quota.Limit,
+			Remaining: quota.Remaining,
+			Reset:     int64(quota.Reset.Seconds()),
+		}
+	}
+	return jsonapi.Data(c, http.StatusOK, quotas, nil)
+}
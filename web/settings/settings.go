@@ -77,9 +77,10 @@ func warnings(c echo.Context) error {
 // Routes sets the routing for the settings service
 func Routes(router *echo.Group) {
 	router.GET("/disk-usage", diskUsage)
+	router.GET("/quotas", getQuotas)
 
-	router.POST("/passphrase", registerPassphrase)
-	router.PUT("/passphrase", updatePassphrase)
+	router.POST("/passphrase", registerPassphrase, middlewares.SameOrigin)
+	router.PUT("/passphrase", updatePassphrase, middlewares.SameOrigin)
 
 	router.GET("/instance", getInstance)
 	router.PUT("/instance", updateInstance)
@@ -87,12 +88,28 @@ func Routes(router *echo.Group) {
 	router.PUT("/instance/sign_tos", updateInstanceTOS)
 
 	router.GET("/sessions", getSessions)
+	router.GET("/audit-logs", listAuditLogs)
+	router.GET("/activities", listActivities)
 
 	router.GET("/clients", listClients)
 	router.DELETE("/clients/:id", revokeClient)
 	router.POST("/synchronized", synchronized)
+	router.POST("/pairing", createPairingCode)
+
+	router.GET("/app_passwords", listAppPasswords)
+	router.POST("/app_passwords", createAppPassword)
+	router.DELETE("/app_passwords/:id", revokeAppPassword)
+
+	router.GET("/backup", getBackup)
+	router.PUT("/backup", configureBackup, middlewares.SameOrigin)
+	router.DELETE("/backup", removeBackup)
+	router.POST("/backup/run", runBackup)
+	router.POST("/backup/restore", restoreBackup)
 
 	router.GET("/onboarded", onboarded)
 	router.GET("/context", context)
+	router.GET("/theme", theme)
+	router.GET("/capabilities", capabilities)
+	router.GET("/flags", flags)
 	router.GET("/warnings", warnings)
 }
@@ -10,6 +10,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/cozy/cozy-stack/pkg/activity"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/instance"
@@ -226,6 +227,104 @@ func TestUpdateInstance(t *testing.T) {
 	instanceRev = newRev
 }
 
+func TestUpdateInstanceWithInvalidSettings(t *testing.T) {
+	for _, attrs := range []string{
+		`{"email": "not an email"}`,
+		`{"public_name": 42}`,
+		`{"locale": "xx"}`,
+		`{"locale": 42}`,
+		`{"auto_update": "maybe"}`,
+		`{"digest": "monthly"}`,
+	} {
+		body := `{
+			"data": {
+				"type": "io.cozy.settings",
+				"id": "io.cozy.settings.instance",
+				"meta": {
+					"rev": "%s"
+				},
+				"attributes": %s
+			}
+		}`
+		body = fmt.Sprintf(body, instanceRev, attrs)
+		req, _ := http.NewRequest("PUT", ts.URL+"/settings/instance", bytes.NewBufferString(body))
+		req.Header.Add("Content-Type", "application/vnd.api+json")
+		req.Header.Add("Accept", "application/vnd.api+json")
+		req.Header.Add("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 422, res.StatusCode, attrs)
+		res.Body.Close()
+	}
+}
+
+func TestUpdateInstanceWithNullLocale(t *testing.T) {
+	body := `{
+		"data": {
+			"type": "io.cozy.settings",
+			"id": "io.cozy.settings.instance",
+			"meta": {
+				"rev": "%s"
+			},
+			"attributes": {
+				"tz": "Europe/London",
+				"email": "alice@example.org",
+				"locale": null
+			}
+		}
+	}`
+	body = fmt.Sprintf(body, instanceRev)
+	req, _ := http.NewRequest("PUT", ts.URL+"/settings/instance", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Accept", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	instanceRev = data["meta"].(map[string]interface{})["rev"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "fr", attrs["locale"])
+	assert.Equal(t, "fr", testInstance.Locale)
+}
+
+func TestGetTheme(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/settings/theme", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	assert.Equal(t, "io.cozy.settings.theme", data["id"])
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "default", attrs["name"])
+	assert.NotEmpty(t, attrs["primary_color"])
+	assert.Regexp(t, `^/assets/images/icon-cozy\.[0-9a-f]{10}\.svg$`, attrs["logo"])
+}
+
+func TestGetCapabilities(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/settings/capabilities", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	assert.Equal(t, "io.cozy.settings.capabilities", data["id"])
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, false, attrs["two_factor_auth"])
+	assert.Equal(t, true, attrs["accounts_encryption"])
+}
+
 func TestUpdatePassphraseWithTwoFactorAuth(t *testing.T) {
 	body := `{
 		"auth_mode": "two_factor_mail"
@@ -373,6 +472,220 @@ func TestRevokeClient(t *testing.T) {
 	assert.Len(t, data, 1)
 }
 
+func TestListAuditLogs(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/settings/audit-logs", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].([]interface{})
+	var actions []string
+	for _, item := range data {
+		attrs := item.(map[string]interface{})["attributes"].(map[string]interface{})
+		actions = append(actions, attrs["action"].(string))
+	}
+	assert.Contains(t, actions, "passphrase_changed")
+	assert.Contains(t, actions, "oauth_client_revoked")
+	// The most recent entry is the first one
+	assert.Equal(t, "oauth_client_revoked", actions[0])
+
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/settings/audit-logs?page[limit]=1", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res2, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 200, res2.StatusCode)
+	err = json.NewDecoder(res2.Body).Decode(&result)
+	assert.NoError(t, err)
+	assert.Len(t, result["data"], 1)
+	links := result["links"].(map[string]interface{})
+	assert.NotEmpty(t, links["next"])
+}
+
+func TestListActivities(t *testing.T) {
+	// The files added in the same directory are grouped
+	for _, name := range []string{"one.txt", "two.txt"} {
+		err := activity.Record(testInstance, activity.KindFileAdded, "file_added/dir-activity",
+			activity.Object{Type: consts.Files, ID: "id-" + name, Name: name})
+		assert.NoError(t, err)
+	}
+	err := activity.Record(testInstance, activity.KindLogin, activity.KindLogin,
+		activity.Object{Type: consts.AuditLogs, ID: "login-activity"})
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/settings/activities", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].([]interface{})
+	if !assert.Len(t, data, 2) {
+		return
+	}
+	// The most recent activity is the first one
+	attrs := data[0].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, "login", attrs["kind"])
+	attrs = data[1].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, "file_added", attrs["kind"])
+	assert.EqualValues(t, 2, attrs["count"])
+	objects := attrs["objects"].([]interface{})
+	if assert.Len(t, objects, 2) {
+		assert.Equal(t, "two.txt", objects[0].(map[string]interface{})["name"])
+	}
+}
+
+func TestCreatePairingCode(t *testing.T) {
+	body := `{"data": {"type": "io.cozy.oauth.pairing_codes", "attributes": {"scope": "io.cozy.files"}}}`
+	req, _ := http.NewRequest("POST", ts.URL+"/settings/pairing", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	// The scope is larger than the permissions of the token
+	assert.Equal(t, 422, res.StatusCode)
+
+	body = `{"data": {"type": "io.cozy.oauth.pairing_codes", "attributes": {"scope": "io.cozy.settings:GET"}}}`
+	req, _ = http.NewRequest("POST", ts.URL+"/settings/pairing", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res2, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 201, res2.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res2.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	assert.Equal(t, "io.cozy.oauth.pairing_codes", data["type"])
+	attrs := data["attributes"].(map[string]interface{})
+	code := attrs["code"].(string)
+	assert.NotEmpty(t, code)
+	// The identifier is the hash of the code, not the code itself
+	assert.NotEmpty(t, data["id"])
+	assert.NotEqual(t, code, data["id"])
+	assert.Equal(t, "io.cozy.settings:GET", attrs["scope"])
+	assert.Contains(t, attrs["url"], "/auth/pair?code="+code)
+}
+
+func TestAppPasswords(t *testing.T) {
+	body := `{"data": {"type": "io.cozy.auth.app_passwords", "attributes": {"label": "My phone", "scope": "io.cozy.contacts"}}}`
+	req, _ := http.NewRequest("POST", ts.URL+"/settings/app_passwords", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	// The scope is larger than the permissions of the token
+	assert.Equal(t, 422, res.StatusCode)
+
+	body = `{"data": {"type": "io.cozy.auth.app_passwords", "attributes": {"label": "My phone", "scope": "io.cozy.settings:GET"}}}`
+	req, _ = http.NewRequest("POST", ts.URL+"/settings/app_passwords", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res2, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 201, res2.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res2.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	id := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "My phone", attrs["label"])
+	password, _ := attrs["password"].(string)
+	assert.NotEmpty(t, password)
+	_, err = oauth.CheckAppPassword(testInstance, password)
+	assert.Equal(t, oauth.ErrInvalidAppPassword, err)
+	ap, err := oauth.CheckAppPassword(testInstance, password, oauth.ServiceCardDAV)
+	assert.NoError(t, err)
+	assert.Equal(t, id, ap.ID())
+
+	req, _ = http.NewRequest("GET", ts.URL+"/settings/app_passwords", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res3, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res3.Body.Close()
+	assert.Equal(t, 200, res3.StatusCode)
+	var list map[string]interface{}
+	err = json.NewDecoder(res3.Body).Decode(&list)
+	assert.NoError(t, err)
+	items := list["data"].([]interface{})
+	if assert.Len(t, items, 1) {
+		attrs = items[0].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Nil(t, attrs["password"])
+	}
+
+	req, _ = http.NewRequest("DELETE", ts.URL+"/settings/app_passwords/"+id, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res4, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res4.Body.Close()
+	assert.Equal(t, 204, res4.StatusCode)
+	_, err = oauth.CheckAppPassword(testInstance, password, oauth.ServiceCardDAV)
+	assert.Equal(t, oauth.ErrInvalidAppPassword, err)
+}
+
+func TestAppPasswordServices(t *testing.T) {
+	body := `{"data": {"type": "io.cozy.auth.app_passwords", "attributes": {"label": "NAS", "scope": "io.cozy.settings:GET", "services": ["ftp"]}}}`
+	req, _ := http.NewRequest("POST", ts.URL+"/settings/app_passwords", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 422, res.StatusCode)
+
+	body = `{"data": {"type": "io.cozy.auth.app_passwords", "attributes": {"label": "NAS", "scope": "io.cozy.settings:GET", "services": ["sftp"]}}}`
+	req, _ = http.NewRequest("POST", ts.URL+"/settings/app_passwords", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res2, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 201, res2.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res2.Body).Decode(&result)
+	assert.NoError(t, err)
+	attrs := result["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"sftp"}, attrs["services"])
+	password, _ := attrs["password"].(string)
+	_, err = oauth.CheckAppPassword(testInstance, password, oauth.ServiceSFTP)
+	assert.NoError(t, err)
+	_, err = oauth.CheckAppPassword(testInstance, password, oauth.ServiceCardDAV)
+	assert.Equal(t, oauth.ErrInvalidAppPassword, err)
+}
+
+func TestGetQuotas(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/settings/quotas", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	assert.Equal(t, consts.QuotasID, data["id"])
+	attrs := data["attributes"].(map[string]interface{})
+	search, ok := attrs["search"].(map[string]interface{})
+	if assert.True(t, ok) {
+		assert.Equal(t, search["limit"], search["remaining"])
+	}
+	assert.Contains(t, attrs, "export")
+	assert.Contains(t, attrs, "konnector_trigger")
+}
+
 func TestRedirectOnboardingSecret(t *testing.T) {
 	url := tsB.URL + "/settings/onboarded"
 
@@ -420,7 +733,8 @@ func TestMain(m *testing.M) {
 		Timezone: "Europe/Berlin",
 		Email:    "alice@example.com",
 	})
-	scope := consts.Settings + " " + consts.OAuthClients
+	scope := consts.Settings + " " + consts.OAuthClients + " " + consts.AppPasswords +
+		" " + consts.AuditLogs + " " + consts.Activities
 	_, token = setup.GetTestClient(scope)
 
 	ts = setup.GetTestServer("/settings", Routes)
@@ -0,0 +1,115 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/accounts"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/statik"
+	"github.com/cozy/echo"
+)
+
+// defaultTheme is the theme used when the context of the instance does not
+// define one. The context can override each of these keys.
+var defaultTheme = map[string]interface{}{
+	"name":          "default",
+	"primary_color": "#297ef2",
+	"logo":          "/assets/images/icon-cozy.svg",
+	"favicon":       "/assets/favicon.ico",
+}
+
+type apiTheme struct {
+	doc map[string]interface{}
+}
+
+func (t *apiTheme) ID() string                             { return consts.ThemeSettingsID }
+func (t *apiTheme) Rev() string                            { return "" }
+func (t *apiTheme) DocType() string                        { return consts.Settings }
+func (t *apiTheme) Clone() couchdb.Doc                     { return t }
+func (t *apiTheme) SetID(id string)                        {}
+func (t *apiTheme) SetRev(rev string)                      {}
+func (t *apiTheme) Relationships() jsonapi.RelationshipMap { return nil }
+func (t *apiTheme) Included() []jsonapi.Object             { return nil }
+func (t *apiTheme) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/theme"}
+}
+func (t *apiTheme) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.doc)
+}
+
+type apiCapabilities struct {
+	doc map[string]interface{}
+}
+
+func (c *apiCapabilities) ID() string                             { return consts.CapabilitiesSettingsID }
+func (c *apiCapabilities) Rev() string                            { return "" }
+func (c *apiCapabilities) DocType() string                        { return consts.Settings }
+func (c *apiCapabilities) Clone() couchdb.Doc                     { return c }
+func (c *apiCapabilities) SetID(id string)                        {}
+func (c *apiCapabilities) SetRev(rev string)                      {}
+func (c *apiCapabilities) Relationships() jsonapi.RelationshipMap { return nil }
+func (c *apiCapabilities) Included() []jsonapi.Object             { return nil }
+func (c *apiCapabilities) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/capabilities"}
+}
+func (c *apiCapabilities) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.doc)
+}
+
+// themeAssets are the keys of the theme for the branding assets, that can be
+// overridden by the assets of the context.
+var themeAssets = []string{"logo", "favicon", "stylesheet"}
+
+// buildTheme returns the theme of the instance: the default theme, with the
+// branding assets of its context, overridden by the theme key of its context.
+func buildTheme(i *instance.Instance) map[string]interface{} {
+	theme := make(map[string]interface{}, len(defaultTheme)+len(themeAssets))
+	for k, v := range defaultTheme {
+		theme[k] = v
+	}
+	for _, name := range themeAssets {
+		if u, ok := statik.BrandingAssetPath("", name, i.ContextName); ok {
+			theme[name] = u
+		}
+	}
+	ctx, err := i.SettingsContext()
+	if err != nil {
+		return theme
+	}
+	if custom, ok := ctx["theme"].(map[string]interface{}); ok {
+		for k, v := range custom {
+			theme[k] = v
+		}
+	}
+	return theme
+}
+
+func theme(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	if _, err := middlewares.GetPermission(c); err != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiTheme{buildTheme(i)}, nil)
+}
+
+// capabilities tells the apps which features are available on this instance,
+// so that they can show or hide the related options.
+func capabilities(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	if _, err := middlewares.GetPermission(c); err != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	doc := map[string]interface{}{
+		"flat_subdomains":     config.GetConfig().Subdomains == config.FlatSubdomains,
+		"two_factor_auth":     i.HasAuthMode(instance.TwoFactorMail),
+		"disk_quota":          i.DiskQuota() > 0,
+		"accounts_encryption": accounts.CanEncryptAccounts(),
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiCapabilities{doc}, nil)
+}
@@ -0,0 +1,233 @@
+package sharings
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/sharing"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// CreateDrive creates a new shared drive, with a folder in the Drives
+// directory
+func CreateDrive(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.POST, consts.Files); err != nil {
+		return err
+	}
+	var attrs sharing.Sharing
+	if _, err := jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if attrs.Description == "" {
+		return jsonapi.InvalidAttribute("description", errors.New("The name of the drive is missing"))
+	}
+	if attrs.DriveQuota < 0 {
+		return jsonapi.InvalidAttribute("drive_quota", errors.New("The quota must be positive"))
+	}
+	var slug string
+	if requestPerm, err := middlewares.GetPermission(c); err == nil && requestPerm.Type == permissions.TypeWebapp {
+		slug, _ = extractSlugFromSourceID(requestPerm.SourceID)
+	}
+	s, err := sharing.CreateDrive(inst, slug, attrs.Description, attrs.DriveQuota)
+	if os.IsExist(err) {
+		return jsonapi.Conflict(err)
+	}
+	if err != nil {
+		return wrapErrors(err)
+	}
+	as := &sharing.APISharing{
+		Sharing:     s,
+		Credentials: nil,
+		SharedDocs:  nil,
+	}
+	return jsonapi.Data(c, http.StatusCreated, as, nil)
+}
+
+// ListDrives returns the shared drives of the instance
+func ListDrives(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Sharings); err != nil {
+		return err
+	}
+	drives, err := sharing.GetDrives(inst)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	data := make([]jsonapi.Object, len(drives))
+	for i, s := range drives {
+		data[i] = &sharing.APISharing{
+			Sharing:     s,
+			Credentials: nil,
+			SharedDocs:  nil,
+		}
+	}
+	return jsonapi.DataList(c, http.StatusOK, data, nil)
+}
+
+// AddDriveMembers adds members to a shared drive, with their roles
+func AddDriveMembers(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	s, err := findDrive(c)
+	if err != nil {
+		return err
+	}
+	if err = checkDriveManager(c, s); err != nil {
+		return err
+	}
+	var body sharing.Sharing
+	obj, err := jsonapi.Bind(c.Request().Body, &body)
+	if err != nil {
+		return jsonapi.BadJSON()
+	}
+	roles := make(map[string]string)
+	for rel, role := range map[string]string{
+		"readers":  sharing.RoleReader,
+		"writers":  sharing.RoleWriter,
+		"managers": sharing.RoleManager,
+	} {
+		relationship, ok := obj.GetRelationship(rel)
+		if !ok {
+			continue
+		}
+		if data, ok := relationship.Data.([]interface{}); ok {
+			for _, ref := range data {
+				if id, ok := ref.(map[string]interface{})["id"].(string); ok {
+					roles[id] = role
+				}
+			}
+		}
+	}
+	if s.Owner {
+		err = s.AddDriveMembers(inst, roles)
+	} else {
+		// The owner can only be asked for readers and writers, and the
+		// manager can change the roles after
+		ids := make(map[string]bool, len(roles))
+		for id, role := range roles {
+			ids[id] = role == sharing.RoleReader
+		}
+		err = s.DelegateAddContacts(inst, ids)
+	}
+	if err != nil {
+		return wrapErrors(err)
+	}
+	return jsonapiSharingWithDocs(c, s)
+}
+
+// ChangeDriveRole changes the role of a member of a shared drive
+func ChangeDriveRole(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	s, err := findDrive(c)
+	if err != nil {
+		return err
+	}
+	if err = checkDriveManager(c, s); err != nil {
+		return err
+	}
+	index, err := driveMemberIndex(c, s)
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err = json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if !sharing.IsValidRole(body.Role) {
+		return jsonapi.InvalidParameter("role", sharing.ErrInvalidRole)
+	}
+	if s.Owner {
+		err = s.SetDriveRole(inst, index, body.Role)
+	} else {
+		err = s.DelegateDriveMember(inst, index, body.Role)
+	}
+	if err != nil {
+		return wrapErrors(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RemoveDriveMember removes a member from a shared drive
+func RemoveDriveMember(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	s, err := findDrive(c)
+	if err != nil {
+		return err
+	}
+	if err = checkDriveManager(c, s); err != nil {
+		return err
+	}
+	index, err := driveMemberIndex(c, s)
+	if err != nil {
+		return err
+	}
+	if s.Owner {
+		if err = s.RevokeRecipient(inst, index); err != nil {
+			return wrapErrors(err)
+		}
+		go s.NotifyRecipients(inst, nil)
+	} else {
+		if err = s.DelegateDriveMember(inst, index, ""); err != nil {
+			return wrapErrors(err)
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func findDrive(c echo.Context) (*sharing.Sharing, error) {
+	inst := middlewares.GetInstance(c)
+	s, err := sharing.FindSharing(inst, c.Param("sharing-id"))
+	if err != nil {
+		return nil, wrapErrors(err)
+	}
+	if !s.Drive {
+		return nil, jsonapi.NotFound(errors.New("This sharing is not a shared drive"))
+	}
+	return s, nil
+}
+
+func driveMemberIndex(c echo.Context, s *sharing.Sharing) (int, error) {
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		return 0, jsonapi.InvalidParameter("index", err)
+	}
+	if index == 0 || index >= len(s.Members) {
+		return 0, jsonapi.InvalidParameter("index", errors.New("Invalid index"))
+	}
+	return index, nil
+}
+
+// checkDriveManager checks that the request comes from an application of a
+// manager of the shared drive, or from the Cozy of a manager for a delegated
+// request on the owner's Cozy.
+func checkDriveManager(c echo.Context, s *sharing.Sharing) error {
+	if _, err := checkCreatePermissions(c, s); err == nil {
+		if s.OwnDriveRole() == sharing.RoleManager {
+			return nil
+		}
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	if s.Owner && hasSharingWritePermissions(c) == nil {
+		if m, err := requestMember(c, s); err == nil && m.DriveRole() == sharing.RoleManager {
+			return nil
+		}
+	}
+	return echo.NewHTTPError(http.StatusForbidden)
+}
+
+func drivesRoutes(router *echo.Group) {
+	router.POST("/drives", CreateDrive)
+	router.GET("/drives", ListDrives)
+	router.POST("/drives/:sharing-id/members", AddDriveMembers)
+	router.PUT("/drives/:sharing-id/members/:index", ChangeDriveRole)
+	router.DELETE("/drives/:sharing-id/members/:index", RemoveDriveMember)
+}
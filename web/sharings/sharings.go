@@ -1,12 +1,15 @@
 package sharings
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/contacts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -69,6 +72,12 @@ func CreateSharing(c echo.Context) error {
 	if err = s.SendMails(inst, codes); err != nil {
 		return wrapErrors(err)
 	}
+	audit.Record(inst, audit.ActionSharingCreated, c.Request(), map[string]interface{}{
+		"sharing_id":  s.SID,
+		"description": s.Description,
+		"app_slug":    s.AppSlug,
+		"recipients":  len(s.Members) - 1,
+	})
 	as := &sharing.APISharing{
 		Sharing:     &s,
 		Credentials: nil,
@@ -81,13 +90,30 @@ func CreateSharing(c echo.Context) error {
 func PutSharing(c echo.Context) error {
 	inst := middlewares.GetInstance(c)
 
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return jsonapi.BadJSON()
+	}
 	var s sharing.Sharing
-	obj, err := jsonapi.Bind(c.Request().Body, &s)
+	obj, err := jsonapi.Bind(bytes.NewReader(body), &s)
 	if err != nil {
 		return jsonapi.BadJSON()
 	}
 	s.SID = obj.ID
 
+	// The public keys are pinned by this Cozy, not given by the sharer
+	for i := range s.Members {
+		s.Members[i].PublicKey = ""
+		s.Members[i].KeyChanged = false
+	}
+	if len(s.Members) > 0 {
+		key, err := sharing.VerifyRequest(inst, s.Members[0].Instance, c.Request(), body)
+		if err != nil {
+			return wrapErrors(err)
+		}
+		s.Members[0].PinPublicKey(key)
+	}
+
 	if err := s.CreateRequest(inst); err != nil {
 		return wrapErrors(err)
 	}
@@ -174,6 +200,34 @@ func GetSharingsInfoByDocType(c echo.Context) error {
 	return sharing.InfoByDocTypeData(c, http.StatusOK, res)
 }
 
+// GetIdentity returns the public key of the instance, used by the other Cozy
+// instances to check the signatures of the requests for the sharings.
+func GetIdentity(c echo.Context) error {
+	identity, err := sharing.GetIdentity(middlewares.GetInstance(c))
+	if err != nil {
+		return wrapErrors(err)
+	}
+	return c.JSON(http.StatusOK, identity)
+}
+
+// GetSharingsStatus returns a summary of the health of all the sharings of
+// the instance, for a dashboard.
+func GetSharingsStatus(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Sharings); err != nil {
+		return err
+	}
+	statuses, err := sharing.GetStatuses(inst)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	data := make([]jsonapi.Object, len(statuses))
+	for i, status := range statuses {
+		data[i] = status
+	}
+	return jsonapi.DataList(c, http.StatusOK, data, nil)
+}
+
 // AnswerSharing is used to exchange credentials between 2 cozys, after the
 // recipient has accepted a sharing.
 func AnswerSharing(c echo.Context) error {
@@ -183,10 +237,20 @@ func AnswerSharing(c echo.Context) error {
 	if err != nil {
 		return wrapErrors(err)
 	}
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return jsonapi.BadJSON()
+	}
 	var creds sharing.APICredentials
-	if _, err = jsonapi.Bind(c.Request().Body, &creds); err != nil {
+	if _, err = jsonapi.Bind(bytes.NewReader(body), &creds); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if creds.Credentials == nil {
 		return jsonapi.BadJSON()
 	}
+	if err = s.VerifyAnswer(inst, creds.State, c.Request(), body); err != nil {
+		return wrapErrors(err)
+	}
 	ac, err := s.ProcessAnswer(inst, &creds)
 	if err != nil {
 		return wrapErrors(err)
@@ -253,6 +317,11 @@ func AddRecipientsDelegated(c echo.Context) error {
 	if !s.Owner || !s.Open {
 		return echo.NewHTTPError(http.StatusForbidden)
 	}
+	if s.Drive {
+		if err = checkDriveManager(c, s); err != nil {
+			return err
+		}
+	}
 	var body sharing.Sharing
 	obj, err := jsonapi.Bind(c.Request().Body, &body)
 	if err != nil {
@@ -312,6 +381,11 @@ func AddReadOnly(c echo.Context) error {
 		if err = hasSharingWritePermissions(c); err != nil {
 			return err
 		}
+		if s.Drive {
+			if err = checkDriveManager(c, s); err != nil {
+				return err
+			}
+		}
 	}
 	index, err := strconv.Atoi(c.Param("index"))
 	if err != nil {
@@ -366,6 +440,11 @@ func RemoveReadOnly(c echo.Context) error {
 		if err = hasSharingWritePermissions(c); err != nil {
 			return err
 		}
+		if s.Drive {
+			if err = checkDriveManager(c, s); err != nil {
+				return err
+			}
+		}
 	}
 	index, err := strconv.Atoi(c.Param("index"))
 	if err != nil {
@@ -661,6 +740,11 @@ func Routes(router *echo.Group) {
 	router.POST("/:sharing-id/recipients/delegated", AddRecipientsDelegated, checkSharingWritePermissions)
 
 	router.GET("/doctype/:doctype", GetSharingsInfoByDocType)
+	router.GET("/status", GetSharingsStatus)
+	router.GET("/identity", GetIdentity)
+
+	// Shared drives
+	drivesRoutes(router)
 
 	// Register the URL of their Cozy for recipients
 	router.GET("/:sharing-id/discovery", GetDiscovery)
@@ -761,6 +845,8 @@ func wrapErrors(err error) error {
 		return jsonapi.BadRequest(err)
 	case sharing.ErrMissingID, sharing.ErrMissingRev:
 		return jsonapi.BadRequest(err)
+	case sharing.ErrInvalidSignature:
+		return jsonapi.Forbidden(err)
 	case sharing.ErrInternalServerError:
 		return jsonapi.InternalServerError(err)
 	case sharing.ErrMissingFileMetadata:
@@ -773,6 +859,8 @@ func wrapErrors(err error) error {
 		return jsonapi.BadRequest(err)
 	case sharing.ErrAlreadyAccepted:
 		return jsonapi.Conflict(err)
+	case sharing.ErrInvalidRole:
+		return jsonapi.InvalidParameter("role", err)
 	}
 	return err
 }
@@ -12,6 +12,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -23,6 +24,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/sharing"
+	_ "github.com/cozy/cozy-stack/pkg/workers/share"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/cozy/cozy-stack/web"
 	"github.com/cozy/cozy-stack/web/auth"
@@ -437,6 +439,17 @@ func TestAuthorizeSharing(t *testing.T) {
 	location := res.Header.Get("Location")
 	assert.Contains(t, location, "home."+bobInstance.Domain)
 
+	// The answer is sent to Alice's Cozy by a share-answer job
+	for i := 0; i < 50; i++ {
+		s, err := sharing.FindSharing(bobInstance, sharingID)
+		assert.NoError(t, err)
+		if s.Active || s.AnswerState != sharing.AnswerStatePending {
+			assert.Empty(t, s.AnswerError)
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
 	assertCredentialsHasBeenExchanged(t)
 }
 
@@ -735,6 +748,170 @@ func TestCheckSharingInfoByDocType(t *testing.T) {
 	res2.Body.Close()
 }
 
+func TestGetSharingsStatus(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, tsA.URL+"/sharings/status", nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+aliceAppToken)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+
+	token, _ := aliceInstance.MakeJWT(permissions.CLIAudience, "CLI", consts.Sharings, "", time.Now())
+	req, err = http.NewRequest(http.MethodGet, tsA.URL+"/sharings/status", nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	defer res.Body.Close()
+
+	var result struct {
+		Data []struct {
+			ID         string                 `json:"id"`
+			Type       string                 `json:"type"`
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	found := false
+	for _, data := range result.Data {
+		assert.Equal(t, consts.SharingsStatus, data.Type)
+		if data.ID != sharingID {
+			continue
+		}
+		found = true
+		assert.Equal(t, "sent", data.Attributes["direction"])
+		assert.Equal(t, []interface{}{iocozytests}, data.Attributes["doctypes"])
+		members := data.Attributes["members"].([]interface{})
+		assert.Len(t, members, 3)
+		owner := members[0].(map[string]interface{})
+		assert.Equal(t, "owner", owner["status"])
+		assert.EqualValues(t, 0, data.Attributes["errors"])
+	}
+	assert.True(t, found)
+}
+
+func TestSharedDrive(t *testing.T) {
+	rules := permissions.Set{
+		permissions.Rule{Type: consts.Files, Verbs: permissions.ALL},
+		permissions.Rule{Type: consts.Sharings, Verbs: permissions.ALL},
+	}
+	token := generateAppTokenWithRules(aliceInstance, "drive", rules)
+	assert.NotEmpty(t, token)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": consts.Sharings,
+			"attributes": map[string]interface{}{
+				"description": "Team",
+				"drive_quota": 100,
+			},
+		},
+	})
+	req, err := http.NewRequest(http.MethodPost, tsA.URL+"/sharings/drives", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderContentType, "application/vnd.api+json")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var created struct {
+		Data struct {
+			ID         string                 `json:"id"`
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&created))
+	res.Body.Close()
+	driveID := created.Data.ID
+	assert.NotEmpty(t, driveID)
+	assert.Equal(t, true, created.Data.Attributes["drive"])
+	assert.EqualValues(t, 100, created.Data.Attributes["drive_quota"])
+
+	drives, err := aliceInstance.VFS().DirByID(consts.DrivesDirID)
+	assert.NoError(t, err)
+	dir, err := aliceInstance.VFS().DirByPath(drives.Fullpath + "/Team")
+	assert.NoError(t, err)
+
+	req, err = http.NewRequest(http.MethodGet, tsA.URL+"/sharings/drives", nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	res.Body.Close()
+	if assert.Len(t, list.Data, 1) {
+		assert.Equal(t, driveID, list.Data[0].ID)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": consts.Sharings,
+			"relationships": map[string]interface{}{
+				"readers": map[string]interface{}{
+					"data": []interface{}{
+						map[string]interface{}{
+							"id":   bobContact.ID(),
+							"type": consts.Contacts,
+						},
+					},
+				},
+			},
+		},
+	})
+	req, err = http.NewRequest(http.MethodPost, tsA.URL+"/sharings/drives/"+driveID+"/members", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderContentType, "application/vnd.api+json")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	s, err := sharing.FindSharing(aliceInstance, driveID)
+	assert.NoError(t, err)
+	if assert.Len(t, s.Members, 2) {
+		assert.Equal(t, sharing.RoleReader, s.Members[1].DriveRole())
+		assert.True(t, s.Members[1].ReadOnly)
+	}
+
+	// An app without the permissions on the folder can't manage the drive
+	body = []byte(`{"role": "manager"}`)
+	req, err = http.NewRequest(http.MethodPut, tsA.URL+"/sharings/drives/"+driveID+"/members/1", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderContentType, "application/json")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+aliceAppToken)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+
+	req, err = http.NewRequest(http.MethodPut, tsA.URL+"/sharings/drives/"+driveID+"/members/1", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderContentType, "application/json")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res.Body.Close()
+
+	s, err = sharing.FindSharing(aliceInstance, driveID)
+	assert.NoError(t, err)
+	assert.Equal(t, sharing.RoleManager, s.Members[1].DriveRole())
+	assert.False(t, s.Members[1].ReadOnly)
+
+	assert.NoError(t, sharing.CheckDriveQuota(aliceInstance, dir.ID(), 60))
+	assert.Equal(t, sharing.ErrDriveQuotaExceeded, sharing.CheckDriveQuota(aliceInstance, dir.ID(), 101))
+	assert.NoError(t, sharing.CheckDriveQuota(aliceInstance, consts.RootDirID, 101))
+}
+
 func TestRevokeSharing(t *testing.T) {
 	sharedDocs := []string{"mygreatid1", "mygreatid2"}
 	sharedRefs := []*sharing.SharedRef{}
@@ -1065,6 +1242,10 @@ func generateAppToken(inst *instance.Instance, slug string) string {
 			Verbs: permissions.ALL,
 		},
 	}
+	return generateAppTokenWithRules(inst, slug, rules)
+}
+
+func generateAppTokenWithRules(inst *instance.Instance, slug string, rules permissions.Set) string {
 	permReq := permissions.Permission{
 		Permissions: rules,
 		Type:        permissions.TypeWebapp,
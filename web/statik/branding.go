@@ -0,0 +1,52 @@
+package statik
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/statik/fs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// brandingAssets are the assets that a context can override for its
+// branding, by the name used in the /branding/:name URL.
+var brandingAssets = map[string]string{
+	"logo":       "/images/icon-cozy.svg",
+	"icon":       "/images/happycloud.png",
+	"favicon":    "/favicon.ico",
+	"stylesheet": "/styles/theme.css",
+	"mail-logo":  "/images/icon-cozy-mail.png",
+}
+
+// BrandingAssetPath returns the path of a branding asset for the given
+// context, with the hash of its content for the cache-busting. The second
+// returned value is false if the branding asset is not known.
+func BrandingAssetPath(domain, name, context string) (string, bool) {
+	file, ok := brandingAssets[name]
+	if !ok {
+		return "", false
+	}
+	if _, ok := fs.Get(file, context); !ok {
+		if _, ok := fs.Get(file); !ok {
+			return "", false
+		}
+	}
+	if assetsFromDir {
+		return assetPath(domain, file), true
+	}
+	return AssetPath(domain, file, context), true
+}
+
+// Branding redirects to the current version of a branding asset for the
+// context of the instance. The apps can use this well-known URL, and the
+// browsers can cache for a long time the asset where they are redirected, as
+// its URL changes when it is updated.
+func Branding(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	u, ok := BrandingAssetPath("", c.Param("name"), i.ContextName)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Asset not found")
+	}
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	return c.Redirect(http.StatusFound, u)
+}
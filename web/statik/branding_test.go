@@ -0,0 +1,120 @@
+package statik
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/cache"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/statik/fs"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+
+var noRedirect = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// registerAsset registers an asset for the given context, as it is done for
+// the assets of the contexts in the configuration.
+func registerAsset(t *testing.T, name, context, content string) {
+	dir, err := ioutil.TempDir("", "branding")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, filepath.Base(name))
+	require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0600))
+	err = fs.RegisterCustomExternals(cache.New(nil), []fs.AssetOption{{
+		Name:    name,
+		Context: context,
+		URL:     "file://" + filename,
+	}}, 0)
+	require.NoError(t, err)
+}
+
+func getBranding(t *testing.T, name string) *http.Response {
+	res, err := noRedirect.Get(ts.URL + "/branding/" + name)
+	require.NoError(t, err)
+	res.Body.Close()
+	return res
+}
+
+func TestBrandingAssetPath(t *testing.T) {
+	logo, ok := fs.Get("/images/icon-cozy.svg")
+	require.True(t, ok)
+
+	u, ok := BrandingAssetPath("", "logo", "")
+	assert.True(t, ok)
+	assert.Equal(t, "/assets"+logo.NameWithSum, u)
+	u, ok = BrandingAssetPath("cozy.example.net", "logo", "")
+	assert.True(t, ok)
+	assert.Equal(t, "//cozy.example.net/assets"+logo.NameWithSum, u)
+
+	// A context without its own asset falls back to the default one
+	u, ok = BrandingAssetPath("", "logo", "without-branding")
+	assert.True(t, ok)
+	assert.Equal(t, "/assets"+logo.NameWithSum, u)
+
+	registerAsset(t, "/images/icon-cozy.svg", "branded", "<svg>branded</svg>")
+	branded, ok := fs.Get("/images/icon-cozy.svg", "branded")
+	require.True(t, ok)
+	assert.NotEqual(t, logo.NameWithSum, branded.NameWithSum)
+	u, ok = BrandingAssetPath("", "logo", "branded")
+	assert.True(t, ok)
+	assert.Equal(t, "/assets/ext/branded"+branded.NameWithSum, u)
+
+	_, ok = BrandingAssetPath("", "no-such-asset", "branded")
+	assert.False(t, ok)
+}
+
+func TestBrandingRedirect(t *testing.T) {
+	icon, ok := fs.Get("/images/happycloud.png")
+	require.True(t, ok)
+	registerAsset(t, "/favicon.ico", "my-context", "favicon of my context")
+	favicon, ok := fs.Get("/favicon.ico", "my-context")
+	require.True(t, ok)
+
+	previousContext := testInstance.ContextName
+	defer func() { testInstance.ContextName = previousContext }()
+
+	testInstance.ContextName = ""
+	res := getBranding(t, "icon")
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	assert.Equal(t, "/assets"+icon.NameWithSum, res.Header.Get("Location"))
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+
+	testInstance.ContextName = "my-context"
+	res = getBranding(t, "favicon")
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	assert.Equal(t, "/assets/ext/my-context"+favicon.NameWithSum, res.Header.Get("Location"))
+
+	// The assets not overridden by the context are the default ones
+	res = getBranding(t, "icon")
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	assert.Equal(t, "/assets"+icon.NameWithSum, res.Header.Get("Location"))
+
+	res = getBranding(t, "no-such-asset")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "statik_test")
+	testInstance = setup.GetTestInstance()
+	ts = setup.GetTestServer("/branding", func(g *echo.Group) {
+		g.GET("/:name", Branding)
+	})
+	os.Exit(setup.Run())
+}
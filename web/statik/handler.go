@@ -15,7 +15,6 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/i18n"
 	"github.com/cozy/cozy-stack/pkg/statik/fs"
-	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	web_utils "github.com/cozy/cozy-stack/web/utils"
 	"github.com/cozy/echo"
@@ -44,6 +43,10 @@ const (
 // FuncsMap is a the helper functions used in templates
 var FuncsMap template.FuncMap
 
+// assetsFromDir is true when the assets are read from a directory, without
+// the hashes in their names and the assets of the contexts.
+var assetsFromDir bool
+
 // AssetRenderer is an interface for both a template renderer and an asset HTTP
 // handler.
 type AssetRenderer interface {
@@ -80,6 +83,7 @@ func NewDirRenderer(assetsPath string) (AssetRenderer, error) {
 
 	t := template.New("stub")
 	h := http.StripPrefix(assetsPrefix, http.FileServer(dir(assetsPath)))
+	assetsFromDir = true
 	FuncsMap = template.FuncMap{
 		"t":     fmt.Sprintf,
 		"split": strings.Split,
@@ -99,7 +103,7 @@ func NewDirRenderer(assetsPath string) (AssetRenderer, error) {
 // representation into the binary.
 func NewRenderer() (AssetRenderer, error) {
 	t := template.New("stub")
-
+	assetsFromDir = false
 	FuncsMap = template.FuncMap{
 		"t":     fmt.Sprintf,
 		"split": strings.Split,
@@ -134,6 +138,16 @@ func (r *renderer) Render(w io.Writer, name string, data interface{}, c echo.Con
 	i, ok := middlewares.GetInstanceSafe(c)
 	if ok {
 		funcMap = template.FuncMap{"t": i.Translate}
+		if !assetsFromDir && i.ContextName != "" {
+			// The assets of the context of the instance are used, even when
+			// the template doesn't give it explicitly.
+			funcMap["asset"] = func(domain, name string, context ...string) string {
+				if len(context) == 0 {
+					context = []string{i.ContextName}
+				}
+				return AssetPath(domain, name, context...)
+			}
+		}
 	} else {
 		lang := GetLanguageFromHeader(c.Request().Header)
 		funcMap = template.FuncMap{"t": i18n.Translator(lang)}
@@ -256,31 +270,7 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // GetLanguageFromHeader return the language tag given the Accept-Language
 // header.
 func GetLanguageFromHeader(header http.Header) (lang string) {
-	// TODO: improve language detection with a package like
-	// "golang.org/x/text/language"
-	lang = i18n.DefaultLocale
-	acceptHeader := header.Get("Accept-Language")
-	if acceptHeader == "" {
-		return
-	}
-	acceptLanguages := utils.SplitTrimString(acceptHeader, ",")
-	for _, tag := range acceptLanguages {
-		// tag may contain a ';q=' for a quality factor that we do not take into
-		// account.
-		if i := strings.Index(tag, ";q="); i >= 0 {
-			tag = tag[:i]
-		}
-		// tag may contain a '-' to introduce a country variante, that we do not
-		// take into account.
-		if i := strings.IndexByte(tag, '-'); i >= 0 {
-			tag = tag[:i]
-		}
-		if utils.IsInArray(tag, i18n.SupportedLocales) {
-			lang = tag
-			return
-		}
-	}
-	return
+	return i18n.NegotiateLocale(header.Get("Accept-Language"))
 }
 
 // ExtractAssetID checks if a long hexadecimal string is contained in given
@@ -0,0 +1,155 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/echo"
+	"github.com/go-redis/redis"
+)
+
+// readyTimeout is the maximal duration of the checks of the readiness
+const readyTimeout = 5 * time.Second
+
+// Component is the status of a component used by the stack, with the latency
+// of its check.
+type Component struct {
+	Status  string `json:"status"`
+	Latency int64  `json:"latency_ms"`
+	Error   string `json:"error,omitempty"`
+}
+
+type checker func(ctx context.Context) error
+
+// Ready responds with the status of each component used by the stack: CouchDB,
+// the storage backend and redis (if configured). The status code is 503 if one
+// of them is not available, so that it can be used as a readiness probe.
+func Ready(c echo.Context) error {
+	components := checkComponents(readinessCheckers())
+	status := http.StatusOK
+	message := "OK"
+	for _, component := range components {
+		if component.Status != "ok" {
+			status = http.StatusServiceUnavailable
+			message = "KO"
+		}
+	}
+	if c.Request().Method == http.MethodHead {
+		return c.NoContent(status)
+	}
+	return c.JSON(status, echo.Map{
+		"message":    message,
+		"components": components,
+	})
+}
+
+func readinessCheckers() map[string]checker {
+	checkers := map[string]checker{
+		"couchdb": checkCouchDB,
+		"storage": checkStorage,
+	}
+	cfg := config.GetConfig()
+	clients := map[string]redis.UniversalClient{
+		"jobs":       cfg.Jobs.Client(),
+		"lock":       cfg.Lock.Client(),
+		"sessions":   cfg.SessionStorage.Client(),
+		"downloads":  cfg.DownloadStorage.Client(),
+		"oauthstate": cfg.KonnectorsOauthStateStorage.Client(),
+		"realtime":   cfg.Realtime.Client(),
+		"ratelimit":  cfg.RateLimitingStorage.Client(),
+		"log":        cfg.Logger.Redis,
+	}
+	for name, cli := range clients {
+		if cli == nil {
+			continue
+		}
+		cli := cli
+		checkers["redis_"+name] = func(ctx context.Context) error {
+			return cli.Ping().Err()
+		}
+	}
+	return checkers
+}
+
+// checkComponents runs the checkers in parallel, and returns their results.
+// A checker that doesn't respond before the timeout is reported as failed.
+func checkComponents(checkers map[string]checker) map[string]*Component {
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	components := make(map[string]*Component, len(checkers))
+	for name, check := range checkers {
+		wg.Add(1)
+		go func(name string, check checker) {
+			defer wg.Done()
+			start := time.Now()
+			errc := make(chan error, 1)
+			go func() { errc <- check(ctx) }()
+			var err error
+			select {
+			case err = <-errc:
+			case <-ctx.Done():
+				err = errors.New("timeout")
+			}
+			component := &Component{
+				Status:  "ok",
+				Latency: int64(time.Since(start) / time.Millisecond),
+			}
+			if err != nil {
+				component.Status = "ko"
+				component.Error = err.Error()
+			}
+			mu.Lock()
+			components[name] = component
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	return components
+}
+
+func checkCouchDB(ctx context.Context) error {
+	u := *config.CouchURL()
+	u.User = config.GetConfig().CouchDB.Auth
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/_up"
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := config.GetConfig().CouchDB.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+func checkStorage(ctx context.Context) error {
+	fsURL := config.FsURL()
+	switch fsURL.Scheme {
+	case config.SchemeFile:
+		info, err := os.Stat(fsURL.Path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", fsURL.Path)
+		}
+	case config.SchemeSwift, config.SchemeSwiftSecure:
+		_, _, err := config.GetSwiftConnection().Account()
+		return err
+	}
+	return nil
+}
@@ -10,7 +10,8 @@ import (
 	"github.com/cozy/echo"
 )
 
-// Status responds with the status of the service
+// Status responds with the status of the service. It can be used as a
+// liveness probe: the status code is always 200 if the stack is running.
 func Status(c echo.Context) error {
 	checker := checkup.HTTPChecker{
 		Name:     "CouchDB",
@@ -39,4 +40,6 @@ func Routes(router *echo.Group) {
 	router.HEAD("", Status)
 	router.GET("/", Status)
 	router.HEAD("/", Status)
+	router.GET("/ready", Ready)
+	router.HEAD("/ready", Ready)
 }
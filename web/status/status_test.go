@@ -1,6 +1,9 @@
 package status
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -35,6 +38,46 @@ func TestRoutes(t *testing.T) {
 	testRequest(t, ts.URL+"/status")
 }
 
+func TestReady(t *testing.T) {
+	handler := echo.New()
+	handler.HTTPErrorHandler = errors.ErrorHandler
+	Routes(handler.Group("/status"))
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/status/ready")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var body struct {
+		Message    string                `json:"message"`
+		Components map[string]*Component `json:"components"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", body.Message)
+	if assert.Contains(t, body.Components, "couchdb") {
+		assert.Equal(t, "ok", body.Components["couchdb"].Status)
+	}
+	if assert.Contains(t, body.Components, "storage") {
+		assert.Equal(t, "ok", body.Components["storage"].Status)
+	}
+}
+
+func TestCheckComponents(t *testing.T) {
+	components := checkComponents(map[string]checker{
+		"up": func(ctx context.Context) error { return nil },
+		"down": func(ctx context.Context) error {
+			return fmt.Errorf("connection refused")
+		},
+	})
+	assert.Equal(t, "ok", components["up"].Status)
+	assert.Equal(t, "ko", components["down"].Status)
+	assert.Equal(t, "connection refused", components["down"].Error)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	os.Exit(m.Run())
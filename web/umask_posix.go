@@ -0,0 +1,12 @@
+// +build !windows
+
+package web
+
+import "golang.org/x/sys/unix"
+
+// restrictUmask sets a umask that gives no permission to the group and the
+// others, and returns a function that restores the previous umask.
+func restrictUmask() func() {
+	previous := unix.Umask(0077)
+	return func() { unix.Umask(previous) }
+}
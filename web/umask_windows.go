@@ -0,0 +1,7 @@
+// +build windows
+
+package web
+
+func restrictUmask() func() {
+	return func() {}
+}